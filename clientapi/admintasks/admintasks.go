@@ -0,0 +1,285 @@
+// Package admintasks runs long admin operations, such as purging a room,
+// in the background. Each task is recorded in the userapi database so that
+// its progress and outcome can be queried after the request that started
+// it has returned.
+package admintasks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/neilalexander/harmony/clientapi/api"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
+	"github.com/sirupsen/logrus"
+)
+
+// progressInterval limits how often progress updates are written to the
+// database, since tasks may report progress for every item they process.
+const progressInterval = time.Second
+
+var (
+	ErrUnknownType = errors.New("unknown task type")
+	ErrNotFound    = errors.New("task not found")
+	ErrFinished    = errors.New("task has already finished")
+)
+
+// Progress is called by a running task to report that done out of total
+// units of work have been completed.
+type Progress func(done, total int64)
+
+type taskIDKey struct{}
+
+// TaskID returns the ID of the task running with the given context.
+func TaskID(ctx context.Context) string {
+	taskID, _ := ctx.Value(taskIDKey{}).(string)
+	return taskID
+}
+
+// Func performs a task against the given target. It should return promptly
+// with ctx.Err() once ctx is cancelled.
+type Func func(ctx context.Context, target string, progress Progress) error
+
+// Store persists task records. It is satisfied by the userapi.
+type Store interface {
+	PerformAdminUpsertTask(ctx context.Context, task *api.AdminTask) error
+	PerformAdminFailUnfinishedTasks(ctx context.Context, reason string) (int64, error)
+	QueryAdminTask(ctx context.Context, taskID string) (*api.AdminTask, error)
+	QueryAdminTasks(ctx context.Context, limit int) ([]api.AdminTask, error)
+}
+
+type runningTask struct {
+	task        api.AdminTask
+	cancel      context.CancelFunc
+	cancelled   bool
+	lastPersist time.Time
+}
+
+// Manager starts tasks, limits how many run at once and tracks the ones
+// which have not finished yet.
+type Manager struct {
+	ctx     context.Context
+	store   Store
+	slots   chan struct{}
+	funcs   map[string]Func
+	mu      sync.Mutex
+	running map[string]*runningTask
+	startMu sync.Mutex // held by StartOnce
+}
+
+// NewManager creates a manager which runs at most concurrency tasks at the
+// same time. Tasks left unfinished by a previous process can never complete,
+// so they are marked as failed.
+func NewManager(ctx context.Context, store Store, concurrency int) *Manager {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if n, err := store.PerformAdminFailUnfinishedTasks(ctx, "interrupted by server restart"); err != nil {
+		logrus.WithError(err).Error("Failed to mark interrupted admin tasks as failed")
+	} else if n > 0 {
+		logrus.Warnf("Marked %d interrupted admin task(s) as failed", n)
+	}
+	return &Manager{
+		ctx:     ctx,
+		store:   store,
+		slots:   make(chan struct{}, concurrency),
+		funcs:   map[string]Func{},
+		running: map[string]*runningTask{},
+	}
+}
+
+// Register makes a task type available to Start.
+func (m *Manager) Register(taskType string, fn Func) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.funcs[taskType] = fn
+}
+
+// Start records a new task and runs it in the background once a slot is
+// free. The returned record is in the pending state.
+func (m *Manager) Start(ctx context.Context, taskType, target, createdBy string) (*api.AdminTask, error) {
+	m.mu.Lock()
+	fn, ok := m.funcs[taskType]
+	m.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, taskType)
+	}
+	now := int64(spec.AsTimestamp(time.Now()))
+	rt := &runningTask{
+		task: api.AdminTask{
+			TaskID:    util.RandomString(16),
+			Type:      taskType,
+			Target:    target,
+			Status:    api.AdminTaskPending,
+			CreatedBy: createdBy,
+			CreatedTS: now,
+			UpdatedTS: now,
+		},
+	}
+	if err := m.store.PerformAdminUpsertTask(ctx, &rt.task); err != nil {
+		return nil, fmt.Errorf("m.store.PerformAdminUpsertTask: %w", err)
+	}
+	var taskCtx context.Context
+	taskCtx, rt.cancel = context.WithCancel(context.WithValue(m.ctx, taskIDKey{}, rt.task.TaskID))
+
+	m.mu.Lock()
+	m.running[rt.task.TaskID] = rt
+	task := rt.task
+	m.mu.Unlock()
+
+	go m.run(taskCtx, rt, fn)
+	return &task, nil
+}
+
+// StartOnce is like Start, but if the same user already has a pending or
+// running task of the same type and target then that task is returned
+// instead of starting another one.
+func (m *Manager) StartOnce(ctx context.Context, taskType, target, createdBy string) (*api.AdminTask, error) {
+	m.startMu.Lock()
+	defer m.startMu.Unlock()
+	m.mu.Lock()
+	for _, rt := range m.running {
+		if rt.task.Type == taskType && rt.task.Target == target && rt.task.CreatedBy == createdBy && !rt.task.Status.Finished() {
+			task := rt.task
+			m.mu.Unlock()
+			return &task, nil
+		}
+	}
+	m.mu.Unlock()
+	return m.Start(ctx, taskType, target, createdBy)
+}
+
+func (m *Manager) run(ctx context.Context, rt *runningTask, fn Func) {
+	defer rt.cancel()
+	logger := logrus.WithFields(logrus.Fields{
+		"task_id":   rt.task.TaskID,
+		"task_type": rt.task.Type,
+		"target":    rt.task.Target,
+	})
+
+	var err error
+	select {
+	case m.slots <- struct{}{}:
+		m.update(rt, true, func(t *api.AdminTask) {
+			t.Status = api.AdminTaskRunning
+		})
+		logger.Info("Admin task started")
+		err = fn(ctx, rt.task.Target, func(done, total int64) {
+			m.update(rt, false, func(t *api.AdminTask) {
+				t.Progress, t.Total = done, total
+			})
+		})
+		<-m.slots
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// A task which finished anyway after being asked to stop has still
+	// completed.
+	m.mu.Lock()
+	cancelled := rt.cancelled && err != nil
+	m.mu.Unlock()
+	m.update(rt, true, func(t *api.AdminTask) {
+		switch {
+		case cancelled:
+			t.Status = api.AdminTaskCancelled
+		case err != nil:
+			t.Status = api.AdminTaskFailed
+			t.Error = err.Error()
+		default:
+			t.Status = api.AdminTaskCompleted
+			if t.Total > 0 {
+				t.Progress = t.Total
+			}
+		}
+	})
+	if err != nil && !cancelled {
+		logger.WithError(err).Error("Admin task failed")
+	} else {
+		logger.Infof("Admin task %s", rt.task.Status)
+	}
+
+	m.mu.Lock()
+	delete(m.running, rt.task.TaskID)
+	m.mu.Unlock()
+}
+
+// update applies fn to the in-memory record and writes it to the store,
+// either unconditionally or if enough time has passed since the last write.
+func (m *Manager) update(rt *runningTask, force bool, fn func(t *api.AdminTask)) {
+	m.mu.Lock()
+	fn(&rt.task)
+	now := time.Now()
+	rt.task.UpdatedTS = int64(spec.AsTimestamp(now))
+	if !force && now.Sub(rt.lastPersist) < progressInterval {
+		m.mu.Unlock()
+		return
+	}
+	rt.lastPersist = now
+	task := rt.task
+	m.mu.Unlock()
+
+	// The task context may have been cancelled by now, but the outcome still
+	// needs to be recorded.
+	if err := m.store.PerformAdminUpsertTask(context.Background(), &task); err != nil {
+		logrus.WithError(err).WithField("task_id", task.TaskID).Error("Failed to store admin task")
+	}
+}
+
+// Cancel asks a pending or running task to stop. The task is marked as
+// cancelled once it has returned.
+func (m *Manager) Cancel(ctx context.Context, taskID string) (*api.AdminTask, error) {
+	m.mu.Lock()
+	if rt, ok := m.running[taskID]; ok {
+		rt.cancelled = true
+		rt.cancel()
+		task := rt.task
+		m.mu.Unlock()
+		return &task, nil
+	}
+	m.mu.Unlock()
+
+	if _, err := m.Get(ctx, taskID); err != nil {
+		return nil, err
+	}
+	return nil, ErrFinished
+}
+
+// Get returns the task with the given ID, or ErrNotFound.
+func (m *Manager) Get(ctx context.Context, taskID string) (*api.AdminTask, error) {
+	m.mu.Lock()
+	if rt, ok := m.running[taskID]; ok {
+		task := rt.task
+		m.mu.Unlock()
+		return &task, nil
+	}
+	m.mu.Unlock()
+
+	task, err := m.store.QueryAdminTask(ctx, taskID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return task, err
+}
+
+// List returns up to limit tasks, newest first.
+func (m *Manager) List(ctx context.Context, limit int) ([]api.AdminTask, error) {
+	tasks, err := m.store.QueryAdminTasks(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	// Progress of running tasks is only written to the store periodically,
+	// so prefer the in-memory copy.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range tasks {
+		if rt, ok := m.running[tasks[i].TaskID]; ok {
+			tasks[i] = rt.task
+		}
+	}
+	return tasks, nil
+}
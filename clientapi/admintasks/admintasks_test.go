@@ -0,0 +1,246 @@
+package admintasks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/clientapi/api"
+)
+
+type memoryStore struct {
+	mu    sync.Mutex
+	tasks map[string]api.AdminTask
+}
+
+func (s *memoryStore) PerformAdminUpsertTask(_ context.Context, task *api.AdminTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[task.TaskID] = *task
+	return nil
+}
+
+func (s *memoryStore) PerformAdminFailUnfinishedTasks(_ context.Context, reason string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for id, task := range s.tasks {
+		if !task.Status.Finished() {
+			task.Status, task.Error = api.AdminTaskFailed, reason
+			s.tasks[id] = task
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) QueryAdminTask(_ context.Context, taskID string) (*api.AdminTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[taskID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &task, nil
+}
+
+func (s *memoryStore) QueryAdminTasks(_ context.Context, limit int) ([]api.AdminTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := make([]api.AdminTask, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].CreatedTS > tasks[j].CreatedTS
+	})
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+	}
+	return tasks, nil
+}
+
+func (s *memoryStore) get(taskID string) api.AdminTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tasks[taskID]
+}
+
+func waitForStatus(t *testing.T, store *memoryStore, taskID string, want api.AdminTaskStatus) api.AdminTask {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if task := store.get(taskID); task.Status == want {
+			return task
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("task %s did not reach status %q, got %q", taskID, want, store.get(taskID).Status)
+	return api.AdminTask{}
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{tasks: map[string]api.AdminTask{
+		"old": {TaskID: "old", Status: api.AdminTaskRunning},
+	}}
+	m := NewManager(ctx, store, 1)
+	if task := store.get("old"); task.Status != api.AdminTaskFailed {
+		t.Fatalf("expected interrupted task to be failed, got %q", task.Status)
+	}
+
+	release := make(chan struct{})
+	m.Register("block", func(ctx context.Context, target string, progress Progress) error {
+		progress(1, 2)
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	m.Register("fail", func(ctx context.Context, target string, progress Progress) error {
+		return errors.New("task " + TaskID(ctx) + " failed on " + target)
+	})
+
+	if _, err := m.Start(ctx, "unknown", "", "@admin:test"); !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("expected ErrUnknownType, got %v", err)
+	}
+
+	t.Run("completes with progress", func(t *testing.T) {
+		task, err := m.Start(ctx, "block", "!room:test", "@admin:test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Status != api.AdminTaskPending || task.CreatedBy != "@admin:test" {
+			t.Fatalf("unexpected task %+v", task)
+		}
+		waitForStatus(t, store, task.TaskID, api.AdminTaskRunning)
+		close(release)
+		task2 := waitForStatus(t, store, task.TaskID, api.AdminTaskCompleted)
+		if task2.Progress != 2 || task2.Total != 2 {
+			t.Fatalf("expected completed progress 2/2, got %d/%d", task2.Progress, task2.Total)
+		}
+		if _, err = m.Cancel(ctx, task.TaskID); !errors.Is(err, ErrFinished) {
+			t.Fatalf("expected ErrFinished, got %v", err)
+		}
+	})
+
+	t.Run("records failures", func(t *testing.T) {
+		task, err := m.Start(ctx, "fail", "!room:test", "@admin:test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		task2 := waitForStatus(t, store, task.TaskID, api.AdminTaskFailed)
+		if task2.Error != "task "+task.TaskID+" failed on !room:test" {
+			t.Fatalf("unexpected error %q", task2.Error)
+		}
+	})
+
+	t.Run("limits concurrency and cancels", func(t *testing.T) {
+		m.Register("block", func(ctx context.Context, target string, progress Progress) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		first, err := m.Start(ctx, "block", "", "@admin:test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForStatus(t, store, first.TaskID, api.AdminTaskRunning)
+		second, err := m.Start(ctx, "block", "", "@admin:test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 50)
+		if got, _ := m.Get(ctx, second.TaskID); got.Status != api.AdminTaskPending {
+			t.Fatalf("expected second task to wait for a slot, got %q", got.Status)
+		}
+
+		if _, err = m.Cancel(ctx, second.TaskID); err != nil {
+			t.Fatal(err)
+		}
+		waitForStatus(t, store, second.TaskID, api.AdminTaskCancelled)
+		if _, err = m.Cancel(ctx, first.TaskID); err != nil {
+			t.Fatal(err)
+		}
+		waitForStatus(t, store, first.TaskID, api.AdminTaskCancelled)
+	})
+
+	t.Run("completes despite being cancelled", func(t *testing.T) {
+		m.Register("ignore_cancel", func(ctx context.Context, target string, progress Progress) error {
+			<-ctx.Done()
+			return nil
+		})
+		task, err := m.Start(ctx, "ignore_cancel", "", "@admin:test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForStatus(t, store, task.TaskID, api.AdminTaskRunning)
+		if _, err = m.Cancel(ctx, task.TaskID); err != nil {
+			t.Fatal(err)
+		}
+		waitForStatus(t, store, task.TaskID, api.AdminTaskCompleted)
+	})
+
+	t.Run("starts once", func(t *testing.T) {
+		m.Register("block", func(ctx context.Context, target string, progress Progress) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		first, err := m.StartOnce(ctx, "block", "@alice:test", "@alice:test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := m.StartOnce(ctx, "block", "@alice:test", "@alice:test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.TaskID != first.TaskID {
+			t.Fatalf("expected the running task %s to be returned, got %s", first.TaskID, again.TaskID)
+		}
+		other, err := m.StartOnce(ctx, "block", "@alice:test", "@admin:test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other.TaskID == first.TaskID {
+			t.Fatal("expected a task for another user to be started separately")
+		}
+		for _, task := range []*api.AdminTask{first, other} {
+			if _, err = m.Cancel(ctx, task.TaskID); err != nil {
+				t.Fatal(err)
+			}
+			waitForStatus(t, store, task.TaskID, api.AdminTaskCancelled)
+		}
+
+		// Once the task has finished, a new one can be started.
+		next, err := m.StartOnce(ctx, "block", "@alice:test", "@alice:test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next.TaskID == first.TaskID {
+			t.Fatal("expected a new task once the first had finished")
+		}
+		if _, err = m.Cancel(ctx, next.TaskID); err != nil {
+			t.Fatal(err)
+		}
+		waitForStatus(t, store, next.TaskID, api.AdminTaskCancelled)
+	})
+
+	if _, err := m.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := m.Cancel(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	tasks, err := m.List(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 9 {
+		t.Fatalf("expected 9 tasks, got %d", len(tasks))
+	}
+}
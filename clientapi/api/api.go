@@ -29,3 +29,34 @@ type RegistrationToken struct {
 	Completed   *int32  `json:"completed"`
 	ExpiryTime  *int64  `json:"expiry_time"`
 }
+
+// AdminTaskStatus is the lifecycle state of a background admin task.
+type AdminTaskStatus string
+
+const (
+	AdminTaskPending   AdminTaskStatus = "pending"
+	AdminTaskRunning   AdminTaskStatus = "running"
+	AdminTaskCompleted AdminTaskStatus = "completed"
+	AdminTaskFailed    AdminTaskStatus = "failed"
+	AdminTaskCancelled AdminTaskStatus = "cancelled"
+)
+
+// Finished returns true if the task will not make any further progress.
+func (s AdminTaskStatus) Finished() bool {
+	return s == AdminTaskCompleted || s == AdminTaskFailed || s == AdminTaskCancelled
+}
+
+// AdminTask is the persistent record of a long-running admin operation,
+// such as purging a room, along with its progress.
+type AdminTask struct {
+	TaskID    string          `json:"task_id"`
+	Type      string          `json:"type"`
+	Target    string          `json:"target"`
+	Status    AdminTaskStatus `json:"status"`
+	Progress  int64           `json:"progress"`
+	Total     int64           `json:"total"`
+	Error     string          `json:"error,omitempty"`
+	CreatedBy string          `json:"created_by"`
+	CreatedTS int64           `json:"created_ts"`
+	UpdatedTS int64           `json:"updated_ts"`
+}
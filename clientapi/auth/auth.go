@@ -84,7 +84,7 @@ func VerifyUserFromRequest(
 	if res.Device == nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusUnauthorized,
-			JSON: spec.UnknownToken("Unknown token"),
+			JSON: spec.UnknownTokenWithSoftLogout("Unknown token", res.SoftLogout),
 		}
 	}
 	return res.Device, nil
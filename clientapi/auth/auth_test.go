@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	uapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+type accessTokenAPI struct {
+	devices    map[string]*uapi.Device
+	softLogout map[string]bool
+}
+
+func (a *accessTokenAPI) QueryAccessToken(ctx context.Context, req *uapi.QueryAccessTokenRequest, res *uapi.QueryAccessTokenResponse) error {
+	res.Device = a.devices[req.AccessToken]
+	res.SoftLogout = a.softLogout[req.AccessToken]
+	return nil
+}
+
+func TestVerifyUserFromRequest(t *testing.T) {
+	userAPI := &accessTokenAPI{
+		devices:    map[string]*uapi.Device{"valid": {UserID: "@alice:test", ID: "DEVICE"}},
+		softLogout: map[string]bool{"soft": true},
+	}
+	for token, wantSoftLogout := range map[string]bool{
+		"soft":    true,
+		"unknown": false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		device, res := VerifyUserFromRequest(req, userAPI)
+		if device != nil || res == nil || res.Code != http.StatusUnauthorized {
+			t.Fatalf("expected a 401 for token %q, got %+v, %+v", token, device, res)
+		}
+		body, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var matrixErr struct {
+			ErrCode    spec.MatrixErrorCode `json:"errcode"`
+			SoftLogout bool                 `json:"soft_logout"`
+		}
+		if err = json.Unmarshal(body, &matrixErr); err != nil {
+			t.Fatal(err)
+		}
+		if matrixErr.ErrCode != spec.ErrorUnknownToken || matrixErr.SoftLogout != wantSoftLogout {
+			t.Fatalf("got %s for token %q, want M_UNKNOWN_TOKEN with soft_logout %v", body, token, wantSoftLogout)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer valid")
+	if device, res := VerifyUserFromRequest(req, userAPI); res != nil || device == nil || device.ID != "DEVICE" {
+		t.Fatalf("expected the device for a valid token, got %+v, %+v", device, res)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"net/http"
 
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/clientapi/httputil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/neilalexander/harmony/setup/config"
@@ -63,6 +64,7 @@ func LoginFromJSONReader(
 		typ = &LoginTypePassword{
 			GetAccountByPassword: useraccountAPI.QueryAccountByPassword,
 			Config:               cfg,
+			RemoteIP:             httputil.RemoteIP(req, cfg.Matrix.RealIPHeader),
 		}
 	case authtypes.LoginTypeToken:
 		typ = &LoginTypeToken{
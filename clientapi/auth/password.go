@@ -17,9 +17,9 @@ package auth
 import (
 	"context"
 	"net/http"
-	"strings"
 
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/clientapi/httputil"
 	"github.com/neilalexander/harmony/clientapi/userutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -39,6 +39,8 @@ type PasswordRequest struct {
 type LoginTypePassword struct {
 	GetAccountByPassword GetAccountByPassword
 	Config               *config.ClientAPI
+	// The IP address of the client, if known, used to limit failed attempts
+	RemoteIP string
 }
 
 func (t *LoginTypePassword) Name() string {
@@ -87,41 +89,32 @@ func (t *LoginTypePassword) Login(ctx context.Context, req interface{}) (*Login,
 			JSON: spec.InvalidUsername("The server name is not known."),
 		}
 	}
-	// Squash username to all lowercase letters
+	// The user API tries the lower cased localpart first, then the provided
+	// localpart as is.
 	res := &api.QueryAccountByPasswordResponse{}
 	err = t.GetAccountByPassword(ctx, &api.QueryAccountByPasswordRequest{
-		Localpart:         strings.ToLower(localpart),
+		Localpart:         localpart,
 		ServerName:        domain,
 		PlaintextPassword: r.Password,
+		RemoteIP:          t.RemoteIP,
 	}, res)
 	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Unable to fetch account by password.")
+		jsonRes := clienterror.Internal().JSONResponse()
+		return nil, &jsonRes
+	}
+	if res.RetryAfter > 0 {
 		return nil, &util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("Unable to fetch account by password."),
+			Code: http.StatusTooManyRequests,
+			JSON: spec.LimitExceeded("Too many failed login attempts, try again later.", res.RetryAfter.Milliseconds()),
 		}
 	}
-
-	// If we couldn't find the user by the lower cased localpart, try the provided
-	// localpart as is.
+	// Technically we could tell them if the user does not exist by checking if err == sql.ErrNoRows
+	// but that would leak the existence of the user.
 	if !res.Exists {
-		err = t.GetAccountByPassword(ctx, &api.QueryAccountByPasswordRequest{
-			Localpart:         localpart,
-			ServerName:        domain,
-			PlaintextPassword: r.Password,
-		}, res)
-		if err != nil {
-			return nil, &util.JSONResponse{
-				Code: http.StatusInternalServerError,
-				JSON: spec.Unknown("Unable to fetch account by password."),
-			}
-		}
-		// Technically we could tell them if the user does not exist by checking if err == sql.ErrNoRows
-		// but that would leak the existence of the user.
-		if !res.Exists {
-			return nil, &util.JSONResponse{
-				Code: http.StatusForbidden,
-				JSON: spec.Forbidden("The username or password was incorrect or the account does not exist."),
-			}
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("The username or password was incorrect or the account does not exist."),
 		}
 	}
 	// Set the user, so login.Username() can do the right thing
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"sync"
 
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/neilalexander/harmony/setup/config"
@@ -242,10 +243,8 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 	if !ok {
 		// if the login type is part of a single stage flow then allow them to omit the session ID
 		if !u.IsSingleStageFlow(authType) {
-			return nil, &util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: spec.Unknown("The auth.session is missing or unknown."),
-			}
+			jsonRes := clienterror.InvalidParam("The auth.session is missing or unknown.").JSONResponse()
+			return nil, &jsonRes
 		}
 	}
 
@@ -15,15 +15,19 @@
 package clientapi
 
 import (
+	"fmt"
+
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/httputil"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/setup/process"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 
+	"github.com/neilalexander/harmony/clientapi/admintasks"
 	"github.com/neilalexander/harmony/clientapi/api"
 	"github.com/neilalexander/harmony/clientapi/producers"
 	"github.com/neilalexander/harmony/clientapi/routing"
+	"github.com/neilalexander/harmony/clientapi/spamcheck"
 	federationAPI "github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/internal/transactions"
 	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
@@ -31,6 +35,7 @@ import (
 )
 
 // AddPublicRoutes sets up and registers HTTP handlers for the ClientAPI component.
+// It returns an error if the spam checker can't be set up from the config.
 func AddPublicRoutes(
 	processContext *process.ProcessContext,
 	routers httputil.Routers,
@@ -42,8 +47,9 @@ func AddPublicRoutes(
 	fsAPI federationAPI.ClientFederationAPI,
 	userAPI userapi.ClientUserAPI,
 	userDirectoryProvider userapi.QuerySearchProfilesAPI,
-	extRoomsProvider api.ExtraPublicRoomsProvider, enableMetrics bool,
-) {
+	extRoomsProvider api.ExtraPublicRoomsProvider,
+	rateLimitStore httputil.RateLimitStore, enableMetrics bool,
+) error {
 	js, natsClient := natsInstance.Prepare(processContext, &cfg.Global.JetStream)
 
 	syncProducer := &producers.SyncAPIProducer{
@@ -56,11 +62,23 @@ func AddPublicRoutes(
 		ServerName:             cfg.Global.ServerName,
 	}
 
+	adminTasks := admintasks.NewManager(processContext.Context(), userAPI, cfg.ClientAPI.AdminTaskConcurrency)
+	routing.RegisterAdminTasks(adminTasks, &cfg.ClientAPI, rsAPI, userAPI, natsClient)
+	go routing.CleanupDataExports(processContext.Context(), &cfg.ClientAPI)
+
+	spamChecker, err := spamcheck.New(&cfg.ClientAPI.SpamChecker)
+	if err != nil {
+		return fmt.Errorf("failed to set up spam checker: %w", err)
+	}
+
+	rateLimits := httputil.NewRateLimits(processContext.Context(), "clientapi", &cfg.ClientAPI.RateLimiting, rateLimitStore)
+
 	routing.Setup(
 		routers,
 		cfg, rsAPI,
 		userAPI, userDirectoryProvider, federation,
 		syncProducer, transactionsCache, fsAPI,
-		extRoomsProvider, natsClient, enableMetrics,
+		extRoomsProvider, natsClient, adminTasks, spamChecker, rateLimits, enableMetrics,
 	)
+	return nil
 }
@@ -126,7 +126,9 @@ func TestGetPutDevices(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -175,7 +177,9 @@ func TestDeleteDevice(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI/ for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -280,7 +284,9 @@ func TestDeleteDevices(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI/ for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -446,7 +452,9 @@ func TestSetDisplayname(t *testing.T) {
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
-		AddPublicRoutes(processCtx, routers, cfg, natsInstance, base.CreateFederationClient(cfg, nil), rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, natsInstance, base.CreateFederationClient(cfg, nil, nil), rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -557,7 +565,9 @@ func TestSetAvatarURL(t *testing.T) {
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
-		AddPublicRoutes(processCtx, routers, cfg, natsInstance, base.CreateFederationClient(cfg, nil), rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, natsInstance, base.CreateFederationClient(cfg, nil, nil), rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -634,7 +644,9 @@ func TestTyping(t *testing.T) {
 		// Needed to create accounts
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		// We mostly need the rsAPI/userAPI for this test, so nil for other APIs etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -719,7 +731,9 @@ func TestMembership(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		rsAPI.SetUserAPI(userAPI)
 		// We mostly need the rsAPI/userAPI for this test, so nil for other APIs etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -926,6 +940,10 @@ func TestCapabilities(t *testing.T) {
 	var tempRoomServerCfg config.RoomServer
 	tempRoomServerCfg.Defaults(config.DefaultOpts{})
 	defaultRoomVersion := tempRoomServerCfg.DefaultRoomVersion
+	roomCapabilities := map[version.Feature]version.FeatureSupport{}
+	for _, feature := range version.Features {
+		roomCapabilities[feature] = version.FeatureSupportFor(defaultRoomVersion, feature)
+	}
 
 	expectedMap := map[string]interface{}{
 		"capabilities": map[string]interface{}{
@@ -933,8 +951,9 @@ func TestCapabilities(t *testing.T) {
 				"enabled": true,
 			},
 			"m.room_versions": map[string]interface{}{
-				"default":   defaultRoomVersion,
-				"available": versionsMap,
+				"default":                              defaultRoomVersion,
+				"available":                            versionsMap,
+				"org.matrix.msc3244.room_capabilities": roomCapabilities,
 			},
 		},
 	}
@@ -958,7 +977,9 @@ func TestCapabilities(t *testing.T) {
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		// We mostly need the rsAPI/userAPI for this test, so nil for other APIs etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -1007,7 +1028,9 @@ func TestTurnserver(t *testing.T) {
 	userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 	//rsAPI.SetUserAPI(userAPI)
 	// We mostly need the rsAPI/userAPI for this test, so nil for other APIs etc.
-	AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+	if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+		t.Fatal(err)
+	}
 
 	// Create the users in the userapi and login
 	accessTokens := map[*test.User]userDevice{
@@ -1112,7 +1135,9 @@ func TestPushRules(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -1499,7 +1524,9 @@ func TestKeys(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -1961,7 +1988,9 @@ func TestKeyBackup(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -2065,7 +2094,9 @@ func TestGetMembership(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -2128,7 +2159,9 @@ func TestCreateRoomInvite(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -0,0 +1,185 @@
+// Package clienterror provides typed errors for client API handlers. Each
+// error carries the Matrix errcode together with the HTTP status it must be
+// returned with, so that handlers can't accidentally pair, for example,
+// M_UNKNOWN with a 403 when the client should see M_FORBIDDEN.
+package clienterror
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
+)
+
+// Error is a Matrix standard error response and the HTTP status code that it
+// should be sent with. Details, if set, are added to the top level of the
+// response body alongside "errcode" and "error".
+type Error struct {
+	spec.MatrixError
+	Status  int
+	Details map[string]interface{}
+}
+
+// New returns an error with the given HTTP status, errcode and message.
+func New(status int, code spec.MatrixErrorCode, msg string) *Error {
+	return &Error{
+		MatrixError: spec.MatrixError{ErrCode: code, Err: msg},
+		Status:      status,
+	}
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return e.MatrixError.Error()
+}
+
+// WithDetail returns a copy of the error with an extra field in the response
+// body. Fields named "errcode" or "error" are ignored.
+func (e *Error) WithDetail(key string, value interface{}) *Error {
+	details := make(map[string]interface{}, len(e.Details)+1)
+	for k, v := range e.Details {
+		details[k] = v
+	}
+	details[key] = value
+	return &Error{
+		MatrixError: e.MatrixError,
+		Status:      e.Status,
+		Details:     details,
+	}
+}
+
+// MarshalJSON flattens the details into the standard error response.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	body := make(map[string]interface{}, len(e.Details)+2)
+	for k, v := range e.Details {
+		body[k] = v
+	}
+	body["errcode"] = e.ErrCode
+	body["error"] = e.Err
+	return json.Marshal(body)
+}
+
+// JSONResponse returns the error as a response for a util.JSONRequestHandler.
+func (e *Error) JSONResponse() util.JSONResponse {
+	return util.JSONResponse{
+		Code: e.Status,
+		JSON: e,
+	}
+}
+
+// Forbidden is returned when the user isn't allowed to do what they asked.
+func Forbidden(msg string) *Error {
+	return New(http.StatusForbidden, spec.ErrorForbidden, msg)
+}
+
+// NotFound is returned when the requested resource doesn't exist.
+func NotFound(msg string) *Error {
+	return New(http.StatusNotFound, spec.ErrorNotFound, msg)
+}
+
+// BadJSON is returned when the request body is valid JSON but doesn't match
+// what the endpoint expects.
+func BadJSON(msg string) *Error {
+	return New(http.StatusBadRequest, spec.ErrorBadJSON, msg)
+}
+
+// NotJSON is returned when the request body is missing or isn't JSON.
+func NotJSON(msg string) *Error {
+	return New(http.StatusBadRequest, spec.ErrorNotJSON, msg)
+}
+
+// InvalidParam is returned when a parameter has the wrong value.
+func InvalidParam(msg string) *Error {
+	return New(http.StatusBadRequest, spec.ErrorInvalidParam, msg)
+}
+
+// MissingParam is returned when a required parameter wasn't supplied.
+func MissingParam(msg string) *Error {
+	return New(http.StatusBadRequest, spec.ErrorMissingParam, msg)
+}
+
+// Conflict is returned when the request clashes with the current state of
+// a resource, e.g. creating something which already exists. The spec has
+// no dedicated errcode for this so M_UNKNOWN is used.
+func Conflict(msg string) *Error {
+	return New(http.StatusConflict, spec.ErrorUnknown, msg)
+}
+
+// Internal is returned when the request failed because of a problem on the
+// server. The message is not sent to the client.
+func Internal() *Error {
+	return New(http.StatusInternalServerError, spec.ErrorUnknown, "Internal server error")
+}
+
+// BadGateway is returned when a server that we depend on, such as an
+// identity server, failed to handle the request.
+func BadGateway(msg string) *Error {
+	return New(http.StatusBadGateway, spec.ErrorUnknown, msg)
+}
+
+// statusForCode is the HTTP status used when converting a spec.MatrixError
+// which doesn't come with one of its own.
+var statusForCode = map[spec.MatrixErrorCode]int{
+	spec.ErrorForbidden:                   http.StatusForbidden,
+	spec.ErrorGuestAccessForbidden:        http.StatusForbidden,
+	spec.ErrorCannotLeaveServerNoticeRoom: http.StatusForbidden,
+	spec.ErrorThreePIDAuthFailed:          http.StatusForbidden,
+	spec.ErrorNotFound:                    http.StatusNotFound,
+	spec.ErrorUnrecognized:                http.StatusNotFound,
+	spec.ErrorWrongRoomKeysVersion:        http.StatusForbidden,
+	spec.ErrorMissingToken:                http.StatusUnauthorized,
+	spec.ErrorUnknownToken:                http.StatusUnauthorized,
+	spec.ErrorBadJSON:                     http.StatusBadRequest,
+	spec.ErrorNotJSON:                     http.StatusBadRequest,
+	spec.ErrorBadAlias:                    http.StatusBadRequest,
+	spec.ErrorInvalidParam:                http.StatusBadRequest,
+	spec.ErrorMissingParam:                http.StatusBadRequest,
+	spec.ErrorWeakPassword:                http.StatusBadRequest,
+	spec.ErrorInvalidUsername:             http.StatusBadRequest,
+	spec.ErrorUserInUse:                   http.StatusBadRequest,
+	spec.ErrorRoomInUse:                   http.StatusBadRequest,
+	spec.ErrorExclusive:                   http.StatusBadRequest,
+	spec.ErrorInvalidSignature:            http.StatusBadRequest,
+	spec.ErrorIncompatibleRoomVersion:     http.StatusBadRequest,
+	spec.ErrorUnsupportedRoomVersion:      http.StatusBadRequest,
+	spec.ErrorUnableToAuthoriseJoin:       http.StatusBadRequest,
+	spec.ErrorServerNotTrusted:            http.StatusBadRequest,
+	spec.ErrorSessionNotValidated:         http.StatusBadRequest,
+	spec.ErrorThreePIDInUse:               http.StatusBadRequest,
+	spec.ErrorDuplicateAnnotation:         http.StatusBadRequest,
+	spec.ErrorTooLarge:                    http.StatusRequestEntityTooLarge,
+	spec.ErrorLimitExceeded:               http.StatusTooManyRequests,
+}
+
+// StatusForCode returns the HTTP status that an error with the given errcode
+// is normally returned with. Unknown errcodes map to 500.
+func StatusForCode(code spec.MatrixErrorCode) int {
+	if status, ok := statusForCode[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// FromError converts an error returned by an internal API into a response.
+// A *Error is returned as-is, a spec.MatrixError is given the status for its
+// errcode and anything else becomes an internal server error, so that the
+// details of unexpected failures aren't sent to clients.
+func FromError(err error) util.JSONResponse {
+	var clientErr *Error
+	if errors.As(err, &clientErr) {
+		return clientErr.JSONResponse()
+	}
+	var matrixErr spec.MatrixError
+	if errors.As(err, &matrixErr) {
+		return util.JSONResponse{
+			Code: StatusForCode(matrixErr.ErrCode),
+			JSON: matrixErr,
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusInternalServerError,
+		JSON: spec.InternalServerError{},
+	}
+}
@@ -0,0 +1,66 @@
+package clienterror
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorStatuses(t *testing.T) {
+	tests := map[string]struct {
+		err        *Error
+		wantStatus int
+		wantCode   spec.MatrixErrorCode
+	}{
+		"forbidden":     {err: Forbidden("msg"), wantStatus: http.StatusForbidden, wantCode: spec.ErrorForbidden},
+		"not found":     {err: NotFound("msg"), wantStatus: http.StatusNotFound, wantCode: spec.ErrorNotFound},
+		"bad json":      {err: BadJSON("msg"), wantStatus: http.StatusBadRequest, wantCode: spec.ErrorBadJSON},
+		"not json":      {err: NotJSON("msg"), wantStatus: http.StatusBadRequest, wantCode: spec.ErrorNotJSON},
+		"invalid param": {err: InvalidParam("msg"), wantStatus: http.StatusBadRequest, wantCode: spec.ErrorInvalidParam},
+		"missing param": {err: MissingParam("msg"), wantStatus: http.StatusBadRequest, wantCode: spec.ErrorMissingParam},
+		"conflict":      {err: Conflict("msg"), wantStatus: http.StatusConflict, wantCode: spec.ErrorUnknown},
+		"internal":      {err: Internal(), wantStatus: http.StatusInternalServerError, wantCode: spec.ErrorUnknown},
+		"bad gateway":   {err: BadGateway("msg"), wantStatus: http.StatusBadGateway, wantCode: spec.ErrorUnknown},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			res := tc.err.JSONResponse()
+			assert.Equal(t, tc.wantStatus, res.Code)
+			assert.Equal(t, tc.wantCode, tc.err.ErrCode)
+			// Anything which isn't M_UNKNOWN must be mapped back to the same status.
+			if tc.wantCode != spec.ErrorUnknown {
+				assert.Equal(t, tc.wantStatus, StatusForCode(tc.wantCode))
+			}
+		})
+	}
+}
+
+func TestErrorJSON(t *testing.T) {
+	b, err := json.Marshal(NotFound("no such room"))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"errcode":"M_NOT_FOUND","error":"no such room"}`, string(b))
+
+	withDetails := Forbidden("nope").WithDetail("room_id", "!a:test").WithDetail("errcode", "M_SPOOFED")
+	b, err = json.Marshal(withDetails)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"errcode":"M_FORBIDDEN","error":"nope","room_id":"!a:test"}`, string(b))
+}
+
+func TestFromError(t *testing.T) {
+	res := FromError(fmt.Errorf("wrapped: %w", Forbidden("nope")))
+	assert.Equal(t, http.StatusForbidden, res.Code)
+
+	res = FromError(fmt.Errorf("wrapped: %w", spec.NotFound("missing")))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	assert.Equal(t, spec.NotFound("missing"), res.JSON)
+
+	res = FromError(fmt.Errorf("database is on fire"))
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	b, err := json.Marshal(res.JSON)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "on fire")
+}
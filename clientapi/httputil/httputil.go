@@ -16,8 +16,12 @@ package httputil
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 	"unicode/utf8"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -30,6 +34,12 @@ func UnmarshalJSONRequest(req *http.Request, iface interface{}) *util.JSONRespon
 	// encoding/json allows invalid utf-8, matrix does not
 	// https://matrix.org/docs/spec/client_server/r0.6.1#api-standards
 	body, err := io.ReadAll(req.Body)
+	if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+		return &util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: spec.TooLarge(fmt.Sprintf("The request body is larger than the maximum allowed size (%d bytes).", maxBytesErr.Limit)),
+		}
+	}
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("io.ReadAll failed")
 		return &util.JSONResponse{
@@ -60,3 +70,27 @@ func UnmarshalJSON(body []byte, iface interface{}) *util.JSONResponse {
 	}
 	return nil
 }
+
+// RemoteIP returns the IP address of the client. When running behind a
+// reverse proxy, realIPHeader names the header which the proxy puts the
+// client's address in. If the header is a list, such as X-Forwarded-For,
+// only the last address is used, as that is the one which the proxy added
+// and the ones before it were sent by the client. Otherwise the headers are
+// ignored, as clients could set them to anything.
+func RemoteIP(req *http.Request, realIPHeader string) string {
+	if realIPHeader != "" {
+		if header := req.Header.Values(realIPHeader); len(header) > 0 {
+			last := header[len(header)-1]
+			if i := strings.LastIndex(last, ","); i >= 0 {
+				last = last[i+1:]
+			}
+			if ip := net.ParseIP(strings.TrimSpace(last)); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
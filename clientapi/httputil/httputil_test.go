@@ -0,0 +1,32 @@
+package httputil
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		name         string
+		realIPHeader string
+		header       string
+		want         string
+	}{
+		{name: "no header configured", header: "1.2.3.4", want: "192.0.2.1"},
+		{name: "header configured", realIPHeader: "X-Forwarded-For", header: "1.2.3.4, 5.6.7.8", want: "5.6.7.8"},
+		{name: "header spoofed", realIPHeader: "X-Forwarded-For", header: "1.2.3.4, not an address", want: "192.0.2.1"},
+		{name: "header missing", realIPHeader: "X-Forwarded-For", want: "192.0.2.1"},
+		{name: "header invalid", realIPHeader: "X-Forwarded-For", header: "not an address", want: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/login", nil)
+			if tt.header != "" {
+				req.Header.Set("X-Forwarded-For", tt.header)
+			}
+			if got := RemoteIP(req, tt.realIPHeader); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Package postregister runs the configured actions once a user has
+// registered: sending them a welcome message and telling a webhook.
+package postregister
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/sirupsen/logrus"
+)
+
+// NoticeSender sends a message to the user from the server notices user.
+type NoticeSender func(ctx context.Context, userID string, content map[string]interface{}) error
+
+// welcomeData is given to the welcome message template.
+type welcomeData struct {
+	UserID     string
+	Localpart  string
+	ServerName string
+}
+
+// Hooks runs the post-registration actions. A nil Hooks does nothing.
+type Hooks struct {
+	cfg        *config.PostRegistration
+	welcome    *template.Template
+	sendNotice NoticeSender
+	client     *http.Client
+}
+
+// New returns the Hooks for the config, or nil if no actions are configured.
+// The notice sender is only needed if the welcome message is enabled.
+func New(cfg *config.PostRegistration, sendNotice NoticeSender) (*Hooks, error) {
+	h := &Hooks{
+		cfg:        cfg,
+		sendNotice: sendNotice,
+		client: &http.Client{
+			Timeout: cfg.Webhook.Timeout,
+		},
+	}
+	if cfg.WelcomeMessage.Enabled {
+		if sendNotice == nil {
+			return nil, fmt.Errorf("the welcome message requires server notices")
+		}
+		var err error
+		if h.welcome, err = template.New("welcome").Parse(cfg.WelcomeMessage.Body); err != nil {
+			return nil, fmt.Errorf("failed to parse welcome message: %w", err)
+		}
+	}
+	if h.welcome == nil && cfg.Webhook.URL == "" {
+		return nil, nil
+	}
+	return h, nil
+}
+
+// Registered runs the actions for the newly registered user in the
+// background, so that they don't hold up registration. Failures are logged.
+func (h *Hooks) Registered(userID string) {
+	if h == nil {
+		return
+	}
+	go h.run(context.Background(), userID)
+}
+
+func (h *Hooks) run(ctx context.Context, userID string) {
+	logger := logrus.WithField("user_id", userID)
+	if h.welcome != nil {
+		if err := h.sendWelcome(ctx, userID); err != nil {
+			logger.WithError(err).Error("Failed to send welcome message")
+		}
+	}
+	if h.cfg.Webhook.URL != "" {
+		if err := h.callWebhook(ctx, userID); err != nil {
+			logger.WithError(err).Error("Failed to call post-registration webhook")
+		}
+	}
+}
+
+func (h *Hooks) sendWelcome(ctx context.Context, userID string) error {
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	var body strings.Builder
+	if err = h.welcome.Execute(&body, welcomeData{
+		UserID:     userID,
+		Localpart:  localpart,
+		ServerName: string(serverName),
+	}); err != nil {
+		return err
+	}
+	return h.sendNotice(ctx, userID, map[string]interface{}{
+		"msgtype": h.cfg.WelcomeMessage.MsgType,
+		"body":    body.String(),
+	})
+}
+
+func (h *Hooks) callWebhook(ctx context.Context, userID string) error {
+	body, err := json.Marshal(map[string]string{
+		"user_id": userID,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
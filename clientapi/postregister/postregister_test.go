@@ -0,0 +1,55 @@
+package postregister
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func TestHooks(t *testing.T) {
+	var webhookUserID string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		webhookUserID = body["user_id"]
+	}))
+	defer srv.Close()
+
+	cfg := &config.PostRegistration{}
+	cfg.Defaults()
+	if h, err := New(cfg, nil); h != nil || err != nil {
+		t.Fatalf("expected no hooks when nothing is configured, got %v, %v", h, err)
+	}
+
+	cfg.WelcomeMessage.Enabled = true
+	cfg.WelcomeMessage.Body = "Welcome to {{.ServerName}}, {{.Localpart}}!"
+	if _, err := New(cfg, nil); err == nil {
+		t.Fatal("expected the welcome message to require a notice sender")
+	}
+
+	cfg.Webhook.URL = srv.URL
+	var noticeUserID string
+	var notice map[string]interface{}
+	h, err := New(cfg, func(ctx context.Context, userID string, content map[string]interface{}) error {
+		noticeUserID, notice = userID, content
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.run(context.Background(), "@alice:test")
+
+	if noticeUserID != "@alice:test" || notice["body"] != "Welcome to test, alice!" || notice["msgtype"] != "m.text" {
+		t.Fatalf("unexpected welcome message to %s: %v", noticeUserID, notice)
+	}
+	if webhookUserID != "@alice:test" {
+		t.Fatalf("expected webhook to be told about @alice:test, got %q", webhookUserID)
+	}
+
+	var nilHooks *Hooks
+	nilHooks.Registered("@alice:test")
+}
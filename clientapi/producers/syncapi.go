@@ -26,6 +26,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/setup/jetstream"
 	"github.com/neilalexander/harmony/syncapi/types"
 	userapi "github.com/neilalexander/harmony/userapi/api"
@@ -57,12 +58,13 @@ func (p *SyncAPIProducer) SendReceipt(
 	m.Header.Set("timestamp", fmt.Sprintf("%d", timestamp))
 
 	log.WithFields(log.Fields{}).Tracef("Producing to topic '%s'", p.TopicReceiptEvent)
+	tracing.InjectNATS(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
 
 func (p *SyncAPIProducer) SendToDevice(
-	ctx context.Context, sender, userID, deviceID, eventType string,
+	ctx context.Context, sender, userID, deviceID, eventType, messageID string,
 	message json.RawMessage,
 ) error {
 	devices := []string{}
@@ -98,8 +100,9 @@ func (p *SyncAPIProducer) SendToDevice(
 	}).Tracef("Producing to topic '%s'", p.TopicSendToDeviceEvent)
 	for i, device := range devices {
 		ote := &types.OutputSendToDeviceEvent{
-			UserID:   userID,
-			DeviceID: device,
+			UserID:    userID,
+			DeviceID:  device,
+			MessageID: messageID,
 			SendToDeviceEvent: gomatrixserverlib.SendToDeviceEvent{
 				Sender:  sender,
 				Type:    eventType,
@@ -117,6 +120,7 @@ func (p *SyncAPIProducer) SendToDevice(
 		m.Header.Set("sender", sender)
 		m.Header.Set(jetstream.UserID, userID)
 
+		tracing.InjectNATS(ctx, m)
 		if _, err = p.JetStream.PublishMsg(m, nats.Context(ctx)); err != nil {
 			if i < len(devices)-1 {
 				log.WithError(err).Warn("sendToDevice failed to PublishMsg, trying further devices")
@@ -141,6 +145,7 @@ func (p *SyncAPIProducer) SendTyping(
 	m.Header.Set("typing", strconv.FormatBool(typing))
 	m.Header.Set("timeout_ms", strconv.Itoa(int(timeoutMS)))
 
+	tracing.InjectNATS(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -157,6 +162,7 @@ func (p *SyncAPIProducer) SendPresence(
 
 	m.Header.Set("last_active_ts", strconv.Itoa(int(spec.AsTimestamp(time.Now()))))
 
+	tracing.InjectNATS(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -5,13 +5,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/nats-io/nats.go"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
@@ -20,7 +24,9 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/exp/constraints"
 
+	"github.com/neilalexander/harmony/clientapi/admintasks"
 	clientapi "github.com/neilalexander/harmony/clientapi/api"
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/internal/httputil"
 	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/setup/config"
@@ -266,75 +272,921 @@ func AdminUpdateRegistrationToken(req *http.Request, cfg *config.ClientAPI, user
 	}
 }
 
-func AdminEvacuateRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+// adminAuditLog returns a logger for recording an action taken by an admin on
+// behalf of other users, so that it can later be traced back to the admin.
+func adminAuditLog(device *api.Device, action string) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"admin":        device.UserID,
+		"admin_action": action,
+	})
+}
+
+func AdminEvacuateRoom(req *http.Request, device *api.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	affected, err := rsAPI.PerformAdminEvacuateRoom(req.Context(), vars["roomID"])
+	if err == nil {
+		adminAuditLog(device, "evacuate_room").WithFields(logrus.Fields{
+			"room_id":  vars["roomID"],
+			"affected": affected,
+		}).Warn("Admin removed all local users from room")
+	}
+	switch err.(type) {
+	case nil:
+	case eventutil.ErrRoomNoExists:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(err.Error()),
+		}
+	default:
+		logrus.WithError(err).WithField("room_id", vars["roomID"]).Error("Failed to evacuate room")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"affected": affected,
+		},
+	}
+}
+
+func AdminEvacuateUser(req *http.Request, device *api.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	affected, err := rsAPI.PerformAdminEvacuateUser(req.Context(), vars["userID"])
+	if err != nil {
+		logrus.WithError(err).WithField("user_id", vars["userID"]).Error("Failed to evacuate user")
+		return util.MessageResponse(http.StatusBadRequest, err.Error())
+	}
+	adminAuditLog(device, "evacuate_user").WithFields(logrus.Fields{
+		"user_id":  vars["userID"],
+		"affected": affected,
+	}).Warn("Admin removed user from all rooms")
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"affected": affected,
+		},
+	}
+}
+
+// AdminForceJoin joins a local user to a room without them needing to be
+// invited first.
+func AdminForceJoin(req *http.Request, cfg *config.ClientAPI, device *api.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	roomIDOrAlias := vars["roomIDOrAlias"]
+	if !strings.HasPrefix(roomIDOrAlias, "!") && !strings.HasPrefix(roomIDOrAlias, "#") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Expected a room ID or alias."),
+		}
+	}
+	request := struct {
+		UserID string `json:"user_id"`
+	}{}
+	if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	userID, err := spec.NewUserID(request.UserID, true)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid user ID: " + err.Error()),
+		}
+	}
+	if !cfg.Matrix.IsLocalServerName(userID.Domain()) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Can only force join local users."),
+		}
+	}
+
+	roomID, err := rsAPI.PerformAdminForceJoin(req.Context(), roomIDOrAlias, *userID)
+	switch e := err.(type) {
+	case nil:
+	case eventutil.ErrRoomNoExists:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(e.Error()),
+		}
+	case roomserverAPI.ErrNotAllowed:
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden(e.Error()),
+		}
+	default:
+		logrus.WithError(err).WithField("room_id_or_alias", roomIDOrAlias).Error("Failed to force join user")
+		return util.ErrorResponse(err)
+	}
+	adminAuditLog(device, "force_join").WithFields(logrus.Fields{
+		"room_id": roomID,
+		"user_id": userID.String(),
+	}).Warn("Admin joined user to room")
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]string{
+			"room_id": roomID,
+		},
+	}
+}
+
+func AdminPurgeRoom(req *http.Request, device *api.Device, tasks *admintasks.Manager) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if _, err = spec.NewRoomID(vars["roomID"]); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	return startAdminTask(req, device, tasks, adminTaskPurgeRoom, vars["roomID"])
+}
+
+func AdminRepairRoomState(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	dryRun := req.URL.Query().Get("dry_run") == "true"
+
+	added, removed, err := rsAPI.PerformAdminRepairRoomState(req.Context(), vars["roomID"], dryRun)
+	switch err.(type) {
+	case nil:
+	case eventutil.ErrRoomNoExists:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(err.Error()),
+		}
+	default:
+		logrus.WithError(err).WithField("room_id", vars["roomID"]).Error("Failed to repair room state")
+		return util.ErrorResponse(err)
+	}
+	if added == nil {
+		added = []string{}
+	}
+	if removed == nil {
+		removed = []string{}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"added":    added,
+			"removed":  removed,
+			"repaired": !dryRun && len(added)+len(removed) > 0,
+		},
+	}
+}
+
+// AdminEventContext returns a stored event along with its auth chain and how
+// the roomserver handled it, to help with debugging.
+func AdminEventContext(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	res, err := rsAPI.QueryAdminEventContext(req.Context(), vars["eventID"])
+	if err != nil {
+		logrus.WithError(err).WithField("event_id", vars["eventID"]).Error("Failed to query event context")
+		return util.ErrorResponse(err)
+	}
+	if res == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("event not found"),
+		}
+	}
+	authChain := make([]json.RawMessage, 0, len(res.AuthChain))
+	for _, event := range res.AuthChain {
+		authChain = append(authChain, event.JSON())
+	}
+	destinations := res.Destinations
+	if destinations == nil {
+		destinations = []spec.ServerName{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"event":              json.RawMessage(res.Event.JSON()),
+			"auth_chain":         authChain,
+			"state_snapshot_nid": res.StateSnapshotNID,
+			"rejected":           res.Rejected,
+			"soft_failed":        res.SoftFailed,
+			"sent_to_output":     res.SentToOutput,
+			"destinations":       destinations,
+		},
+	}
+}
+
+// AdminAuthRejections returns the most recent events in a room which failed
+// auth, along with the rule they failed and the state they were checked against.
+func AdminAuthRejections(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	rejections, err := rsAPI.QueryAdminAuthRejections(req.Context(), vars["roomID"])
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", vars["roomID"]).Error("Failed to query auth rejections")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"rejections": rejections,
+		},
+	}
+}
+
+// AdminReplayInputQueue queues the input events journalled by the roomserver
+// again, for when they have been lost from JetStream.
+func AdminReplayInputQueue(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	replayed, err := rsAPI.PerformAdminReplayInputQueue(req.Context())
+	if err != nil {
+		logrus.WithError(err).WithField("replayed", replayed).Error("Failed to replay the input queue")
+		return clienterror.Internal().JSONResponse()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"replayed": replayed,
+		},
+	}
+}
+
+// AdminStreamLag reports, for each of the internal streams, the last message
+// produced into it and how far behind each of its consumers are, such as the
+// sync API and federation sender consumers of the roomserver output stream.
+// It also reports how far behind the sync API's PDU and device list streams
+// are in syncing clients up to what has been produced into them.
+func AdminStreamLag(req *http.Request, cfg *config.ClientAPI, natsClient *nats.Conn) util.JSONResponse {
+	js, err := natsClient.JetStream(nats.Context(req.Context()))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	streams, err := jetstream.Lag(&cfg.Matrix.JetStream, js)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get stream lag")
+		return util.ErrorResponse(err)
+	}
+	syncStreams, err := syncStreamLag(req.Context(), cfg, natsClient)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get sync stream lag")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"streams":      streams,
+			"sync_streams": syncStreams,
+		},
+	}
+}
+
+// syncStreamLag asks the sync API how far behind its streams are.
+func syncStreamLag(ctx context.Context, cfg *config.ClientAPI, natsClient *nats.Conn) ([]jetstream.SyncStreamLag, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	msg := nats.NewMsg(cfg.Matrix.JetStream.Prefixed(jetstream.RequestSyncStreamLag))
+	res, err := natsClient.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	if errMsg := res.Header.Get("error"); errMsg != "" {
+		return nil, errors.New(errMsg)
+	}
+	var lag []jetstream.SyncStreamLag
+	if err = json.Unmarshal(res.Data, &lag); err != nil {
+		return nil, err
+	}
+	return lag, nil
+}
+
+// AdminExportRoom starts a task which writes the event DAG and state of a room
+// to a portable JSON archive, which can be downloaded once the task completes
+// and imported into another server with AdminImportRoom.
+func AdminExportRoom(req *http.Request, device *api.Device, tasks *admintasks.Manager) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if _, err = spec.NewRoomID(vars["roomID"]); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	return startAdminTask(req, device, tasks, adminTaskExportRoom, vars["roomID"])
+}
+
+// AdminImportRoom stores the events of a room exported with AdminExportRoom.
+// The room must not already be known to this server. The archive is written
+// to a temporary file first, as it is read through twice while importing.
+func AdminImportRoom(req *http.Request, device *api.Device, cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	if err := os.MkdirAll(dataExportDir(cfg), 0o700); err != nil {
+		logrus.WithError(err).Error("Failed to create the data export directory")
+		return util.ErrorResponse(err)
+	}
+	f, err := os.CreateTemp(dataExportDir(cfg), "import-*.tmp")
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create a file for the room archive")
+		return util.ErrorResponse(err)
+	}
+	defer os.Remove(f.Name()) // nolint:errcheck
+	defer f.Close()           // nolint:errcheck
+	// The request body is limited to the same size when it is routed, but
+	// the archive is capped here too so that the disk can't be filled.
+	maxSize := int64(cfg.MaxRoomImportSize)
+	n, err := io.Copy(f, io.LimitReader(req.Body, maxSize+1))
+	if maxBytesErr := (*http.MaxBytesError)(nil); n > maxSize || errors.As(err, &maxBytesErr) {
+		return util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: spec.TooLarge(fmt.Sprintf("The room archive is larger than the maximum allowed size (%d bytes).", maxSize)),
+		}
+	}
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Failed to read request body: " + err.Error()),
+		}
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	res, err := rsAPI.PerformAdminImportRoom(req.Context(), f, func(done, total int64) {})
+	switch e := err.(type) {
+	case nil:
+	case roomserverAPI.ErrInvalidID:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(e.Error()),
+		}
+	case roomserverAPI.ErrNotAllowed:
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden(e.Error()),
+		}
+	default:
+		logrus.WithError(err).Error("Failed to import room")
+		return util.ErrorResponse(err)
+	}
+	adminAuditLog(device, "import_room").WithFields(logrus.Fields{
+		"room_id":  res.RoomID,
+		"imported": res.Imported,
+		"rejected": res.Rejected,
+		"resigned": res.Resigned,
+	}).Warn("Admin imported room")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminListRoomDirectory lists the rooms which are published in, or blocked
+// from, the room directory.
+func AdminListRoomDirectory(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	var published roomserverAPI.QueryPublishedRoomsResponse
+	if err := rsAPI.QueryPublishedRooms(req.Context(), &roomserverAPI.QueryPublishedRoomsRequest{
+		IncludeAllNetworks: true,
+	}, &published); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryPublishedRooms failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	blocked, err := rsAPI.QueryDirectoryBlockedRooms(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryDirectoryBlockedRooms failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if published.RoomIDs == nil {
+		published.RoomIDs = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string][]string{
+			"published": published.RoomIDs,
+			"blocked":   blocked,
+		},
+	}
+}
+
+// AdminUnpublishRoom removes a room from the room directory. The room can
+// still be published again by its moderators unless it is also blocked.
+func AdminUnpublishRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if _, err = spec.NewRoomID(vars["roomID"]); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid room ID"),
+		}
+	}
+	if err = rsAPI.PerformAdminUnpublishRoom(req.Context(), vars["roomID"]); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformAdminUnpublishRoom failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminSetRoomDirectoryBlocked returns or sets whether a room is blocked from
+// the room directory. Blocking a room removes it from the directory and stops
+// anyone from publishing it again until it is unblocked.
+func AdminSetRoomDirectoryBlocked(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	roomID := vars["roomID"]
+	if _, err = spec.NewRoomID(roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid room ID"),
+		}
+	}
+
+	if req.Method == http.MethodGet {
+		blockedRooms, err := rsAPI.QueryDirectoryBlockedRooms(req.Context())
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryDirectoryBlockedRooms failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		blocked := false
+		for _, blockedRoomID := range blockedRooms {
+			if blockedRoomID == roomID {
+				blocked = true
+				break
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]bool{"blocked": blocked},
+		}
+	}
+
+	request := struct {
+		Blocked bool `json:"blocked"`
+	}{}
+	if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return clienterror.BadJSON("Failed to decode request body: " + err.Error()).JSONResponse()
+	}
+	if err = rsAPI.PerformAdminSetRoomDirectoryBlocked(req.Context(), roomID, request.Blocked); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformAdminSetRoomDirectoryBlocked failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]bool{"blocked": request.Blocked},
+	}
+}
+
+func AdminSetRoomFederation(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	roomID := vars["roomID"]
+	if _, err = spec.NewRoomID(roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid room ID"),
+		}
+	}
+
+	if req.Method == http.MethodGet {
+		disabled, err := fsAPI.QueryRoomFederationDisabled(req.Context(), roomID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("fsAPI.QueryRoomFederationDisabled failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]bool{"disabled": disabled},
+		}
+	}
+
+	request := struct {
+		Disabled bool `json:"disabled"`
+	}{}
+	if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return clienterror.BadJSON("Failed to decode request body: " + err.Error()).JSONResponse()
+	}
+	if err = fsAPI.PerformAdminSetRoomFederationDisabled(req.Context(), roomID, request.Disabled); err != nil {
+		switch err.(type) {
+		case eventutil.ErrRoomNoExists:
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound(err.Error()),
+			}
+		case *federationAPI.RoomNotFederatableError:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.Unknown(err.Error()),
+			}
+		default:
+			util.GetLogger(req.Context()).WithError(err).Error("fsAPI.PerformAdminSetRoomFederationDisabled failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]bool{"disabled": request.Disabled},
+	}
+}
+
+func AdminListDestinations(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	destinations, err := fsAPI.QueryAdminDestinations(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.QueryAdminDestinations failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"destinations": destinations,
+		},
+	}
+}
+
+func AdminUnblacklistDestination(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
 		return util.ErrorResponse(err)
 	}
+	if err = fsAPI.PerformAdminUnblacklistDestination(req.Context(), spec.ServerName(vars["serverName"])); err != nil {
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
 
-	affected, err := rsAPI.PerformAdminEvacuateRoom(req.Context(), vars["roomID"])
-	switch err.(type) {
-	case nil:
-	case eventutil.ErrRoomNoExists:
+func AdminListDestinationQueues(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	queues, err := fsAPI.QueryAdminDestinationQueues(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.QueryAdminDestinationQueues failed")
 		return util.JSONResponse{
-			Code: http.StatusNotFound,
-			JSON: spec.NotFound(err.Error()),
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
 		}
-	default:
-		logrus.WithError(err).WithField("roomID", vars["roomID"]).Error("Failed to evacuate room")
-		return util.ErrorResponse(err)
 	}
 	return util.JSONResponse{
-		Code: 200,
+		Code: http.StatusOK,
 		JSON: map[string]interface{}{
-			"affected": affected,
+			"queues": queues,
 		},
 	}
 }
 
-func AdminEvacuateUser(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+// AdminDestinationQueue returns the queue for a destination on GET, or drops
+// everything waiting to be sent to it on DELETE.
+func AdminDestinationQueue(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
 		return util.ErrorResponse(err)
 	}
+	serverName := spec.ServerName(vars["serverName"])
+	if req.Method == http.MethodDelete {
+		if err = fsAPI.PerformAdminDropDestinationQueue(req.Context(), serverName); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("fsAPI.PerformAdminDropDestinationQueue failed")
+			return util.ErrorResponse(err)
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+	queue, err := fsAPI.QueryAdminDestinationQueue(req.Context(), serverName)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.QueryAdminDestinationQueue failed")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queue,
+	}
+}
 
-	affected, err := rsAPI.PerformAdminEvacuateUser(req.Context(), vars["userID"])
+func AdminRetryDestinationQueue(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
-		logrus.WithError(err).WithField("userID", vars["userID"]).Error("Failed to evacuate user")
-		return util.MessageResponse(http.StatusBadRequest, err.Error())
+		return util.ErrorResponse(err)
+	}
+	if err = fsAPI.PerformAdminRetryDestinationQueue(req.Context(), spec.ServerName(vars["serverName"])); err != nil {
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
 	}
+}
 
+func AdminListIgnoredOrigins(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	origins, err := fsAPI.QueryAdminIgnoredOrigins(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.QueryAdminIgnoredOrigins failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
 	return util.JSONResponse{
-		Code: 200,
+		Code: http.StatusOK,
 		JSON: map[string]interface{}{
-			"affected": affected,
+			"origins": origins,
 		},
 	}
 }
 
-func AdminPurgeRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+// AdminUnignoreOrigin lets a server which was ignored by the join flood
+// protection back in before its ignore period is over.
+func AdminUnignoreOrigin(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
 		return util.ErrorResponse(err)
 	}
-
-	if err = rsAPI.PerformAdminPurgeRoom(context.Background(), vars["roomID"]); err != nil {
+	if err = fsAPI.PerformAdminUnignoreOrigin(req.Context(), spec.ServerName(vars["serverName"])); err != nil {
 		return util.ErrorResponse(err)
 	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
 
+// AdminListResolutionCache returns what is cached about how to reach other
+// servers: where their .well-known files delegated to, or why they couldn't
+// be used, the addresses found and when they will be looked up again.
+func AdminListResolutionCache(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	entries, err := fsAPI.QueryAdminResolutionCache(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.QueryAdminResolutionCache failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
 	return util.JSONResponse{
-		Code: 200,
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"servers": entries,
+		},
+	}
+}
+
+// AdminForgetResolution removes a server from the resolution cache, for when
+// it has moved and shouldn't have to wait for the cached results to expire.
+func AdminForgetResolution(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if err = fsAPI.PerformAdminForgetResolution(req.Context(), spec.ServerName(vars["serverName"])); err != nil {
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
 		JSON: struct{}{},
 	}
 }
 
-func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, device *api.Device, userAPI api.ClientUserAPI) util.JSONResponse {
-	if req.Body == nil {
+// AdminListServerKeys returns the signing keys of other servers that we have
+// cached, with when they are valid until or expired, either for one server or
+// for all of them.
+func AdminListServerKeys(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	keys, err := fsAPI.QueryAdminServerKeys(req.Context(), spec.ServerName(vars["serverName"]))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.QueryAdminServerKeys failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"keys": keys,
+		},
+	}
+}
+
+// AdminRefetchServerKeys fetches the signing keys of another server again,
+// replacing the cached ones, for when the server has rotated its keys in a
+// way that stops its events from being verified.
+func AdminRefetchServerKeys(req *http.Request, cfg *config.ClientAPI, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	serverName := spec.ServerName(vars["serverName"])
+	if cfg.Matrix.IsLocalServerName(serverName) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Can't refetch the keys of a local server name"),
+		}
+	}
+	keys, err := fsAPI.PerformAdminRefetchServerKeys(req.Context(), serverName)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.PerformAdminRefetchServerKeys failed")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"keys": keys,
+		},
+	}
+}
+
+// AdminPurgeExpiredServerKeys removes the cached keys of other servers which
+// have been replaced by newer keys and stopped being valid a long time ago.
+// Keys which the servers have said are expired are kept, as they are still
+// needed to verify old events.
+func AdminPurgeExpiredServerKeys(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	purged, err := fsAPI.PerformAdminPurgeExpiredServerKeys(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.PerformAdminPurgeExpiredServerKeys failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"purged": purged,
+		},
+	}
+}
+
+// maxDeviceKeysSnapshotUsers is how many users' keys can be fetched in one
+// device keys snapshot.
+const maxDeviceKeysSnapshotUsers = 1000
+
+// AdminDeviceKeysSnapshot returns the device and cross-signing keys that we know
+// about for a set of local or remote users, as they were at a single point in
+// time, so that bots and bridges can bootstrap encryption without querying the
+// keys of each user separately.
+func AdminDeviceKeysSnapshot(req *http.Request, userAPI api.ClientUserAPI) util.JSONResponse {
+	request := struct {
+		UserIDs []string `json:"user_ids"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: spec.Unknown("Missing request body"),
+			JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	if len(request.UserIDs) > maxDeviceKeysSnapshotUsers {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(fmt.Sprintf("At most %d user IDs can be requested at once", maxDeviceKeysSnapshotUsers)),
+		}
+	}
+	for _, userID := range request.UserIDs {
+		if _, err := spec.NewUserID(userID, true); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam(fmt.Sprintf("Invalid user ID %q", userID)),
+			}
+		}
+	}
+
+	var res api.QueryDeviceKeysSnapshotResponse
+	if err := userAPI.QueryDeviceKeysSnapshot(req.Context(), &api.QueryDeviceKeysSnapshotRequest{
+		UserIDs: request.UserIDs,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryDeviceKeysSnapshot failed")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"device_keys":       res.DeviceKeys,
+			"master_keys":       res.MasterKeys,
+			"self_signing_keys": res.SelfSigningKeys,
+		},
+	}
+}
+
+func AdminCreateUser(req *http.Request, cfg *config.ClientAPI, userAPI api.ClientUserAPI) util.JSONResponse {
+	request := struct {
+		Username    string `json:"username"`
+		Password    string `json:"password"`
+		DisplayName string `json:"displayname"`
+		Admin       bool   `json:"admin"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	localpart := strings.ToLower(request.Username)
+	if err := internal.ValidateUsername(localpart, cfg.Matrix.ServerName); err != nil {
+		return *internal.UsernameResponse(err)
+	}
+	if err := internal.ValidatePassword(request.Password); err != nil {
+		return *internal.PasswordResponse(err)
+	}
+	accType := api.AccountTypeUser
+	if request.Admin {
+		accType = api.AccountTypeAdmin
+	}
+
+	var accRes api.PerformAccountCreationResponse
+	err := userAPI.PerformAccountCreation(req.Context(), &api.PerformAccountCreationRequest{
+		Localpart:   localpart,
+		ServerName:  cfg.Matrix.ServerName,
+		Password:    request.Password,
+		AccountType: accType,
+		OnConflict:  api.ConflictAbort,
+	}, &accRes)
+	if err != nil {
+		if _, ok := err.(*api.ErrorConflict); ok {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.UserInUse("Desired user ID is already taken."),
+			}
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformAccountCreation failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	amtRegUsers.Inc()
+
+	if request.DisplayName != "" {
+		if _, _, err = userAPI.SetDisplayName(req.Context(), localpart, cfg.Matrix.ServerName, request.DisplayName); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.SetDisplayName failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
 		}
 	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"user_id": accRes.Account.UserID,
+			"admin":   request.Admin,
+		},
+	}
+}
+
+func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, device *api.Device, userAPI api.ClientUserAPI) util.JSONResponse {
+	if req.Body == nil {
+		return clienterror.NotJSON("Missing request body").JSONResponse()
+	}
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
 		return util.ErrorResponse(err)
@@ -359,25 +1211,26 @@ func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, device *api.De
 		}
 	}
 	if accAvailableResp.Available {
-		return util.JSONResponse{
-			Code: http.StatusNotFound,
-			JSON: spec.Unknown("User does not exist"),
-		}
+		return clienterror.NotFound("User does not exist").JSONResponse()
 	}
 	request := struct {
 		Password      string `json:"password"`
 		LogoutDevices bool   `json:"logout_devices"`
+		SoftLogout    bool   `json:"soft_logout"`
 	}{}
 	if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return clienterror.BadJSON("Failed to decode request body: " + err.Error()).JSONResponse()
+	}
+	if request.Password == "" {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: spec.Unknown("Failed to decode request body: " + err.Error()),
+			JSON: spec.MissingParam("Expecting non-empty password."),
 		}
 	}
-	if request.Password == "" {
+	if request.SoftLogout && !request.LogoutDevices {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: spec.MissingParam("Expecting non-empty password."),
+			JSON: spec.InvalidParam("soft_logout can only be used with logout_devices"),
 		}
 	}
 
@@ -390,13 +1243,12 @@ func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, device *api.De
 		ServerName:    serverName,
 		Password:      request.Password,
 		LogoutDevices: request.LogoutDevices,
+		SoftLogout:    request.SoftLogout,
 	}
 	updateRes := &api.PerformPasswordUpdateResponse{}
 	if err := userAPI.PerformPasswordUpdate(req.Context(), updateReq, updateRes); err != nil {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: spec.Unknown("Failed to perform password update: " + err.Error()),
-		}
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to perform password update")
+		return clienterror.Internal().JSONResponse()
 	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -408,19 +1260,8 @@ func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, device *api.De
 	}
 }
 
-func AdminReindex(req *http.Request, cfg *config.ClientAPI, device *api.Device, natsClient *nats.Conn) util.JSONResponse {
-	_, err := natsClient.RequestMsg(nats.NewMsg(cfg.Matrix.JetStream.Prefixed(jetstream.InputFulltextReindex)), time.Second*10)
-	if err != nil {
-		logrus.WithError(err).Error("failed to publish nats message")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.InternalServerError{},
-		}
-	}
-	return util.JSONResponse{
-		Code: http.StatusOK,
-		JSON: struct{}{},
-	}
+func AdminReindex(req *http.Request, device *api.Device, tasks *admintasks.Manager) util.JSONResponse {
+	return startAdminTask(req, device, tasks, adminTaskReindexSearch, "")
 }
 
 func AdminMarkAsStale(req *http.Request, cfg *config.ClientAPI, keyAPI api.ClientKeyAPI) util.JSONResponse {
@@ -446,10 +1287,8 @@ func AdminMarkAsStale(req *http.Request, cfg *config.ClientAPI, keyAPI api.Clien
 		Domain: domain,
 	}, &struct{}{})
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown(fmt.Sprintf("Failed to mark device list as stale: %s", err)),
-		}
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to mark device list as stale")
+		return clienterror.Internal().JSONResponse()
 	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -457,6 +1296,38 @@ func AdminMarkAsStale(req *http.Request, cfg *config.ClientAPI, keyAPI api.Clien
 	}
 }
 
+func AdminReloadConfig(req *http.Request, dendriteCfg *config.Dendrite) util.JSONResponse {
+	if err := dendriteCfg.Reload(); err != nil {
+		logrus.WithError(err).Error("Failed to reload config")
+		// The error is about the config file, so it is passed on to the
+		// admin rather than hidden as with other internal errors.
+		return clienterror.New(http.StatusInternalServerError, spec.ErrorUnknown, err.Error()).JSONResponse()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func AdminRotateSigningKey(req *http.Request, dendriteCfg *config.Dendrite) util.JSONResponse {
+	oldKeyID, newKeyID, err := dendriteCfg.RotateSigningKey()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to rotate signing key")
+		return clienterror.Internal().JSONResponse()
+	}
+	logrus.WithFields(logrus.Fields{
+		"old_key_id": oldKeyID,
+		"new_key_id": newKeyID,
+	}).Info("Rotated signing key")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"old_key_id": oldKeyID,
+			"new_key_id": newKeyID,
+		},
+	}
+}
+
 func AdminDownloadState(req *http.Request, device *api.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
@@ -484,9 +1355,9 @@ func AdminDownloadState(req *http.Request, device *api.Device, rsAPI roomserverA
 			}
 		}
 		logrus.WithError(err).WithFields(logrus.Fields{
-			"userID":     device.UserID,
+			"user_id":    device.UserID,
 			"serverName": serverName,
-			"roomID":     roomID,
+			"room_id":    roomID,
 		}).Error("failed to download state")
 		return util.ErrorResponse(err)
 	}
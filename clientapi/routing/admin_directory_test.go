@@ -0,0 +1,42 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+)
+
+// unpublishRoomserverAPI records the rooms which are unpublished.
+type unpublishRoomserverAPI struct {
+	roomserverAPI.ClientRoomserverAPI
+	unpublished []string
+}
+
+func (r *unpublishRoomserverAPI) PerformAdminUnpublishRoom(ctx context.Context, roomID string) error {
+	r.unpublished = append(r.unpublished, roomID)
+	return nil
+}
+
+func TestAdminUnpublishRoom(t *testing.T) {
+	for roomID, wantCode := range map[string]int{
+		"!room:test": http.StatusOK,
+		"room:test":  http.StatusBadRequest,
+		"!room":      http.StatusBadRequest,
+	} {
+		rsAPI := &unpublishRoomserverAPI{}
+		req := httptest.NewRequest(http.MethodDelete, "/_dendrite/admin/roomDirectory/"+roomID, nil)
+		req = mux.SetURLVars(req, map[string]string{"roomID": roomID})
+		res := AdminUnpublishRoom(req, rsAPI)
+		if res.Code != wantCode {
+			t.Fatalf("got status %d for %q, want %d", res.Code, roomID, wantCode)
+		}
+		if unpublished := len(rsAPI.unpublished) == 1; unpublished != (wantCode == http.StatusOK) {
+			t.Fatalf("got unpublished rooms %v for %q", rsAPI.unpublished, roomID)
+		}
+	}
+}
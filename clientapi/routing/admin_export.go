@@ -0,0 +1,455 @@
+package routing
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
+	"github.com/neilalexander/harmony/clientapi/admintasks"
+	clientapi "github.com/neilalexander/harmony/clientapi/api"
+	"github.com/neilalexander/harmony/clientapi/auth"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/httputil"
+	"github.com/neilalexander/harmony/internal/util"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/neilalexander/harmony/userapi/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	adminTaskExportUserData = "export_user_data"
+	adminTaskExportRoom     = "export_room"
+)
+
+// userDataExportPageSize is how many of the user's events are requested
+// from the sync API at a time.
+const userDataExportPageSize = 500
+
+// dataExportCleanupInterval is how often export archives which are older
+// than the retention period are looked for.
+const dataExportCleanupInterval = time.Hour
+
+// userDataExportMemberships are the memberships which are looked up for the
+// rooms section of an export.
+var userDataExportMemberships = []string{
+	spec.Join, spec.Invite, spec.Knock, spec.Leave, spec.Ban,
+}
+
+// exportedDevice leaves the access token and session out of the exported
+// devices.
+type exportedDevice struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name,omitempty"`
+	LastSeenTS  int64  `json:"last_seen_ts,omitempty"`
+	LastSeenIP  string `json:"last_seen_ip,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+}
+
+// userDataExporter writes the data held about a local user into a zip
+// archive, with one JSON file per section.
+type userDataExporter struct {
+	cfg        *config.ClientAPI
+	rsAPI      roomserverAPI.ClientRoomserverAPI
+	userAPI    api.ClientUserAPI
+	natsClient *nats.Conn
+}
+
+// dataExportDir returns where the files written by export tasks are stored.
+func dataExportDir(cfg *config.ClientAPI) string {
+	if cfg.AbsDataExportPath != "" {
+		return string(cfg.AbsDataExportPath)
+	}
+	return string(cfg.DataExportPath)
+}
+
+// exportPath returns where the file written by the given export task is
+// stored, by the type of the task.
+func exportPath(cfg *config.ClientAPI, taskType, taskID string) string {
+	ext := ".zip"
+	if taskType == adminTaskExportRoom {
+		ext = ".json"
+	}
+	return filepath.Join(dataExportDir(cfg), taskID+ext)
+}
+
+// createExportFile creates a temporary file for an export task to write to.
+// The file is only moved into place by finishExportFile once it is complete,
+// so that partial exports are never downloaded.
+func createExportFile(ctx context.Context, cfg *config.ClientAPI) (*os.File, error) {
+	if err := os.MkdirAll(dataExportDir(cfg), 0o700); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dataExportDir(cfg), admintasks.TaskID(ctx)+"-*.tmp")
+}
+
+func finishExportFile(ctx context.Context, cfg *config.ClientAPI, f *os.File, taskType string) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), exportPath(cfg, taskType, admintasks.TaskID(ctx)))
+}
+
+// removeExpiredExports deletes the export archives, along with any temporary
+// files left behind by interrupted exports, which were last written to
+// before the cutoff. It returns how many files were deleted.
+func removeExpiredExports(dir string, cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".zip", ".json", ".tmp":
+		default:
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// CleanupDataExports deletes export archives once they are older than the
+// configured retention period, until ctx is done.
+func CleanupDataExports(ctx context.Context, cfg *config.ClientAPI) {
+	ticker := time.NewTicker(dataExportCleanupInterval)
+	defer ticker.Stop()
+	for {
+		removed, err := removeExpiredExports(dataExportDir(cfg), time.Now().Add(-cfg.DataExportRetention))
+		if err != nil {
+			logrus.WithError(err).Error("Failed to remove expired data exports")
+		} else if removed > 0 {
+			logrus.Infof("Removed %d expired data export(s)", removed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// exportRoom writes an archive of the room which can be imported into
+// another server.
+func exportRoom(ctx context.Context, cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI, roomID string, progress admintasks.Progress) error {
+	if _, err := spec.NewRoomID(roomID); err != nil {
+		return err
+	}
+	f, err := createExportFile(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint:errcheck
+	defer f.Close()           // nolint:errcheck
+
+	w := bufio.NewWriter(f)
+	if err = rsAPI.PerformAdminExportRoom(ctx, roomID, w, progress); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return finishExportFile(ctx, cfg, f, adminTaskExportRoom)
+}
+
+func (e *userDataExporter) export(ctx context.Context, target string, progress admintasks.Progress) error {
+	userID, err := spec.NewUserID(target, true)
+	if err != nil {
+		return err
+	}
+	if !e.cfg.Matrix.IsLocalServerName(userID.Domain()) {
+		return fmt.Errorf("%s is not a local user", userID.String())
+	}
+	f, err := createExportFile(ctx, e.cfg)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint:errcheck
+	defer f.Close()           // nolint:errcheck
+
+	sections := []struct {
+		name  string
+		write func(ctx context.Context, w io.Writer, userID spec.UserID) error
+	}{
+		{"profile.json", e.writeProfile},
+		{"account_data.json", e.writeAccountData},
+		{"devices.json", e.writeDevices},
+		{"rooms.json", e.writeRooms},
+		{"media.json", e.writeMedia},
+		{"messages.json", e.writeMessages},
+	}
+	zw := zip.NewWriter(f)
+	progress(0, int64(len(sections)))
+	for i, section := range sections {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		w, err := zw.Create(section.name)
+		if err != nil {
+			return err
+		}
+		if err = section.write(ctx, w, *userID); err != nil {
+			return fmt.Errorf("%s: %w", section.name, err)
+		}
+		progress(int64(i+1), int64(len(sections)))
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	return finishExportFile(ctx, e.cfg, f, adminTaskExportUserData)
+}
+
+func (e *userDataExporter) writeProfile(ctx context.Context, w io.Writer, userID spec.UserID) error {
+	profile, err := e.userAPI.QueryProfile(ctx, userID.String())
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(map[string]string{
+		"user_id":     userID.String(),
+		"displayname": profile.DisplayName,
+		"avatar_url":  profile.AvatarURL,
+	})
+}
+
+func (e *userDataExporter) writeAccountData(ctx context.Context, w io.Writer, userID spec.UserID) error {
+	var res api.QueryAccountDataResponse
+	if err := e.userAPI.QueryAccountData(ctx, &api.QueryAccountDataRequest{UserID: userID.String()}, &res); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"global": res.GlobalAccountData,
+		"rooms":  res.RoomAccountData,
+	})
+}
+
+func (e *userDataExporter) writeDevices(ctx context.Context, w io.Writer, userID spec.UserID) error {
+	var res api.QueryDevicesResponse
+	if err := e.userAPI.QueryDevices(ctx, &api.QueryDevicesRequest{UserID: userID.String()}, &res); err != nil {
+		return err
+	}
+	devices := make([]exportedDevice, 0, len(res.Devices))
+	for _, dev := range res.Devices {
+		devices = append(devices, exportedDevice{
+			DeviceID:    dev.ID,
+			DisplayName: dev.DisplayName,
+			LastSeenTS:  dev.LastSeenTS,
+			LastSeenIP:  dev.LastSeenIP,
+			UserAgent:   dev.UserAgent,
+		})
+	}
+	return json.NewEncoder(w).Encode(devices)
+}
+
+func (e *userDataExporter) writeRooms(ctx context.Context, w io.Writer, userID spec.UserID) error {
+	rooms := make(map[string][]string, len(userDataExportMemberships))
+	for _, membership := range userDataExportMemberships {
+		roomIDs, err := e.rsAPI.QueryRoomsForUser(ctx, userID, membership)
+		if err != nil {
+			return err
+		}
+		// spec.RoomID has no JSON encoding of its own.
+		rooms[membership] = make([]string, 0, len(roomIDs))
+		for _, roomID := range roomIDs {
+			rooms[membership] = append(rooms[membership], roomID.String())
+		}
+	}
+	return json.NewEncoder(w).Encode(rooms)
+}
+
+func (e *userDataExporter) writeMedia(ctx context.Context, w io.Writer, userID spec.UserID) error {
+	msg := nats.NewMsg(e.cfg.Matrix.JetStream.Prefixed(jetstream.RequestUserMedia))
+	msg.Header.Set(jetstream.UserID, userID.String())
+	res, err := e.natsClient.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if errMsg := res.Header.Get("error"); errMsg != "" {
+		return errors.New(errMsg)
+	}
+	_, err = w.Write(res.Data)
+	return err
+}
+
+// writeMessages pages through the events sent by the user, writing them out
+// as a single JSON array as they arrive.
+func (e *userDataExporter) writeMessages(ctx context.Context, w io.Writer, userID spec.UserID) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	first := true
+	from := "0"
+	for from != "" {
+		msg := nats.NewMsg(e.cfg.Matrix.JetStream.Prefixed(jetstream.RequestUserEvents))
+		msg.Header.Set(jetstream.UserID, userID.String())
+		msg.Header.Set("from", from)
+		msg.Header.Set("limit", strconv.Itoa(userDataExportPageSize))
+		res, err := e.natsClient.RequestMsgWithContext(ctx, msg)
+		if err != nil {
+			return err
+		}
+		if errMsg := res.Header.Get("error"); errMsg != "" {
+			return errors.New(errMsg)
+		}
+		var chunk []json.RawMessage
+		if err = json.Unmarshal(res.Data, &chunk); err != nil {
+			return err
+		}
+		for _, ev := range chunk {
+			if !first {
+				if _, err = io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			first = false
+			if _, err = w.Write(ev); err != nil {
+				return err
+			}
+		}
+		from = res.Header.Get("next")
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+func AdminExportUserData(req *http.Request, device *api.Device, tasks *admintasks.Manager) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if _, err = spec.NewUserID(vars["userID"], true); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	return startAdminTask(req, device, tasks, adminTaskExportUserData, vars["userID"])
+}
+
+// ExportOwnUserData starts an export of the requesting user's own data, or
+// returns their export which is already under way.
+func ExportOwnUserData(req *http.Request, device *api.Device, tasks *admintasks.Manager) util.JSONResponse {
+	task, err := tasks.StartOnce(req.Context(), adminTaskExportUserData, device.UserID, device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to start user data export")
+		return clienterror.Internal().JSONResponse()
+	}
+	return util.JSONResponse{
+		Code: http.StatusAccepted,
+		JSON: task,
+	}
+}
+
+// ownUserDataExport returns the export task with the given ID, as long as it
+// is an export of the user's data which they started themselves.
+func ownUserDataExport(req *http.Request, userID string, tasks *admintasks.Manager) (*clientapi.AdminTask, *util.JSONResponse) {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		res := util.ErrorResponse(err)
+		return nil, &res
+	}
+	task, err := tasks.Get(req.Context(), vars["taskID"])
+	if err == nil && (task.Type != adminTaskExportUserData || task.Target != userID || task.CreatedBy != userID) {
+		err = admintasks.ErrNotFound
+	}
+	if err != nil {
+		res := adminTaskErrorResponse(err)
+		return nil, &res
+	}
+	return task, nil
+}
+
+// GetOwnUserDataExport returns the progress of one of the user's exports.
+func GetOwnUserDataExport(req *http.Request, device *api.Device, tasks *admintasks.Manager) util.JSONResponse {
+	task, resErr := ownUserDataExport(req, device.UserID, tasks)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: task,
+	}
+}
+
+// DownloadOwnUserDataExport serves the archive of one of the user's
+// completed exports.
+func DownloadOwnUserDataExport(w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI, userAPI api.QueryAcccessTokenAPI, tasks *admintasks.Manager) {
+	device, resErr := auth.VerifyUserFromRequest(req, userAPI)
+	if resErr != nil {
+		writeExportError(w, *resErr)
+		return
+	}
+	task, resErr := ownUserDataExport(req, device.UserID, tasks)
+	if resErr != nil {
+		writeExportError(w, *resErr)
+		return
+	}
+	serveExport(w, req, cfg, task)
+}
+
+// AdminDownloadExport serves the file written by a completed user data or
+// room export task.
+func AdminDownloadExport(w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI, tasks *admintasks.Manager) {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		writeExportError(w, util.ErrorResponse(err))
+		return
+	}
+	task, err := tasks.Get(req.Context(), vars["taskID"])
+	if err != nil {
+		writeExportError(w, adminTaskErrorResponse(err))
+		return
+	}
+	serveExport(w, req, cfg, task)
+}
+
+func writeExportError(w http.ResponseWriter, res util.JSONResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Code)
+	if err := json.NewEncoder(w).Encode(res.JSON); err != nil {
+		logrus.WithError(err).Error("Failed to encode JSON response")
+	}
+}
+
+// serveExport sends the file written by the export task, if it completed and
+// the file hasn't been deleted since.
+func serveExport(w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI, task *clientapi.AdminTask) {
+	if (task.Type != adminTaskExportUserData && task.Type != adminTaskExportRoom) || task.Status != clientapi.AdminTaskCompleted {
+		writeExportError(w, clienterror.NotFound("No completed export with this task ID").JSONResponse())
+		return
+	}
+	path := exportPath(cfg, task.Type, task.TaskID)
+	if _, err := os.Stat(path); err != nil {
+		writeExportError(w, clienterror.NotFound("The archive of this export no longer exists").JSONResponse())
+		return
+	}
+	contentType := "application/zip"
+	if task.Type == adminTaskExportRoom {
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "export-"+filepath.Base(path)))
+	http.ServeFile(w, req, path)
+}
@@ -0,0 +1,334 @@
+package routing
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
+	"github.com/neilalexander/harmony/clientapi/admintasks"
+	clientapi "github.com/neilalexander/harmony/clientapi/api"
+	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/neilalexander/harmony/setup/process"
+	"github.com/neilalexander/harmony/userapi/api"
+	"github.com/stretchr/testify/assert"
+)
+
+type exportRoomserverAPI struct {
+	roomserverAPI.ClientRoomserverAPI
+	err error
+}
+
+func (r *exportRoomserverAPI) QueryRoomsForUser(ctx context.Context, userID spec.UserID, desiredMembership string) ([]spec.RoomID, error) {
+	if desiredMembership != spec.Join {
+		return nil, nil
+	}
+	roomID, err := spec.NewRoomID("!joined:test")
+	if err != nil {
+		return nil, err
+	}
+	return []spec.RoomID{*roomID}, nil
+}
+
+func (r *exportRoomserverAPI) PerformAdminExportRoom(ctx context.Context, roomID string, w io.Writer, progress func(done, total int64)) error {
+	progress(0, 1)
+	if _, err := io.WriteString(w, `{"room_id":"`+roomID+`"}`); err != nil {
+		return err
+	}
+	return r.err
+}
+
+func (r *exportRoomserverAPI) PerformAdminImportRoom(ctx context.Context, archive io.ReadSeeker, progress func(done, total int64)) (*roomserverAPI.RoomImportResult, error) {
+	data, err := io.ReadAll(archive)
+	if err != nil {
+		return nil, err
+	}
+	return &roomserverAPI.RoomImportResult{RoomID: string(data), Imported: 2, Rejected: 1}, r.err
+}
+
+func TestImportRoom(t *testing.T) {
+	cfg := &config.ClientAPI{DataExportPath: config.Path(t.TempDir()), MaxRoomImportSize: 8}
+	device := &api.Device{UserID: "@admin:test"}
+	importRoom := func(body string) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/importRoom", strings.NewReader(body))
+		return AdminImportRoom(req, device, cfg, &exportRoomserverAPI{})
+	}
+
+	res := importRoom("!room:test")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+	res = importRoom("!r:test")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, &roomserverAPI.RoomImportResult{RoomID: "!r:test", Imported: 2, Rejected: 1}, res.JSON)
+
+	// The archive is only kept while it is being imported.
+	entries, err := os.ReadDir(dataExportDir(cfg))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestExportRoom(t *testing.T) {
+	cfg := &config.ClientAPI{DataExportPath: config.Path(t.TempDir())}
+	progress := func(done, total int64) {}
+
+	// A failed export doesn't leave a partial archive behind.
+	rsAPI := &exportRoomserverAPI{err: errors.New("failed")}
+	assert.Error(t, exportRoom(context.Background(), cfg, rsAPI, "!room:test", progress))
+	entries, err := os.ReadDir(dataExportDir(cfg))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	rsAPI.err = nil
+	assert.Error(t, exportRoom(context.Background(), cfg, rsAPI, "room", progress))
+	assert.NoError(t, exportRoom(context.Background(), cfg, rsAPI, "!room:test", progress))
+	archive, err := os.ReadFile(exportPath(cfg, adminTaskExportRoom, ""))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"room_id":"!room:test"}`, string(archive))
+}
+
+// exportUserAPI holds the data of a single user, and knows a single access
+// token for each of the users in tokens.
+type exportUserAPI struct {
+	api.ClientUserAPI
+	tokens map[string]string
+}
+
+func (u *exportUserAPI) QueryProfile(ctx context.Context, userID string) (*authtypes.Profile, error) {
+	return &authtypes.Profile{DisplayName: "Alice", AvatarURL: "mxc://test/avatar"}, nil
+}
+
+func (u *exportUserAPI) QueryAccountData(ctx context.Context, req *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse) error {
+	res.GlobalAccountData = map[string]json.RawMessage{"m.direct": json.RawMessage(`{}`)}
+	return nil
+}
+
+func (u *exportUserAPI) QueryDevices(ctx context.Context, req *api.QueryDevicesRequest, res *api.QueryDevicesResponse) error {
+	res.UserExists = true
+	res.Devices = []api.Device{{ID: "DEVICE", UserID: req.UserID, AccessToken: "secret", DisplayName: "Phone"}}
+	return nil
+}
+
+func (u *exportUserAPI) QueryAccessToken(ctx context.Context, req *api.QueryAccessTokenRequest, res *api.QueryAccessTokenResponse) error {
+	if userID, ok := u.tokens[req.AccessToken]; ok {
+		res.Device = &api.Device{UserID: userID}
+	}
+	return nil
+}
+
+// replyToExportRequests answers the media and event requests of a user data
+// export as the media and sync APIs would, returning the user's events in
+// pages of one.
+func replyToExportRequests(t *testing.T, cfg *config.ClientAPI, nc *nats.Conn, events []string) {
+	t.Helper()
+	mediaSub, err := nc.Subscribe(cfg.Matrix.JetStream.Prefixed(jetstream.RequestUserMedia), func(msg *nats.Msg) {
+		_ = msg.Respond([]byte(`[{"media_id":"abc"}]`))
+	})
+	assert.NoError(t, err)
+	eventsSub, err := nc.Subscribe(cfg.Matrix.JetStream.Prefixed(jetstream.RequestUserEvents), func(msg *nats.Msg) {
+		from, _ := strconv.Atoi(msg.Header.Get("from"))
+		res := nats.NewMsg(msg.Reply)
+		res.Data = []byte("[]")
+		if from < len(events) {
+			res.Data = []byte("[" + events[from] + "]")
+			res.Header.Set("next", strconv.Itoa(from+1))
+		}
+		_ = msg.RespondMsg(res)
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = mediaSub.Unsubscribe()
+		_ = eventsSub.Unsubscribe()
+	})
+}
+
+func TestUserDataExport(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	t.Cleanup(func() {
+		processCtx.ShutdownDendrite()
+		processCtx.WaitForShutdown()
+	})
+	var cfg config.Dendrite
+	cfg.Defaults(config.DefaultOpts{SingleDatabase: true})
+	cfg.Global.ServerName = "test"
+	cfg.Global.JetStream.InMemory = true
+	cfg.Global.JetStream.TopicPrefix = "TestUserDataExport_"
+	cfg.ClientAPI.DataExportPath = config.Path(t.TempDir())
+	natsInstance := jetstream.NATSInstance{}
+	_, nc := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	replyToExportRequests(t, &cfg.ClientAPI, nc, []string{`{"event_id":"$a"}`, `{"event_id":"$b"}`})
+
+	exporter := &userDataExporter{
+		cfg:        &cfg.ClientAPI,
+		rsAPI:      &exportRoomserverAPI{},
+		userAPI:    &exportUserAPI{},
+		natsClient: nc,
+	}
+	ctx := context.Background()
+	var done, total int64
+	progress := func(d, t int64) { done, total = d, t }
+	assert.Error(t, exporter.export(ctx, "@alice:remote", progress), "remote users can't be exported")
+	if err := exporter.export(ctx, "@alice:test", progress); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, total, done)
+
+	archive, err := zip.OpenReader(exportPath(&cfg.ClientAPI, adminTaskExportUserData, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close() // nolint:errcheck
+	files := map[string]string{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		assert.NoError(t, err)
+		b, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		files[f.Name] = string(b)
+	}
+	assert.JSONEq(t, `{"user_id":"@alice:test","displayname":"Alice","avatar_url":"mxc://test/avatar"}`, files["profile.json"])
+	assert.JSONEq(t, `{"global":{"m.direct":{}},"rooms":null}`, files["account_data.json"])
+	assert.JSONEq(t, `[{"device_id":"DEVICE","display_name":"Phone"}]`, files["devices.json"], "access tokens aren't exported")
+	assert.JSONEq(t, `{"join":["!joined:test"],"invite":[],"knock":[],"leave":[],"ban":[]}`, files["rooms.json"])
+	assert.JSONEq(t, `[{"media_id":"abc"}]`, files["media.json"])
+	assert.JSONEq(t, `[{"event_id":"$a"},{"event_id":"$b"}]`, files["messages.json"])
+}
+
+func TestRemoveExpiredExports(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	files := map[string]time.Time{
+		"old.zip":     now.Add(-time.Hour * 2),
+		"old.json":    now.Add(-time.Hour * 2),
+		"old-123.tmp": now.Add(-time.Hour * 2),
+		"new.zip":     now,
+		"other.txt":   now.Add(-time.Hour * 2),
+	}
+	for name, mtime := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, []byte("{}"), 0o600))
+		assert.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+
+	removed, err := removeExpiredExports(dir, now.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, removed)
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	remaining := []string{}
+	for _, entry := range entries {
+		remaining = append(remaining, entry.Name())
+	}
+	assert.ElementsMatch(t, []string{"new.zip", "other.txt"}, remaining)
+
+	removed, err = removeExpiredExports(filepath.Join(dir, "missing"), now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+// exportTaskStore keeps admin tasks in memory.
+type exportTaskStore struct {
+	mu    sync.Mutex
+	tasks map[string]clientapi.AdminTask
+}
+
+func (s *exportTaskStore) PerformAdminUpsertTask(ctx context.Context, task *clientapi.AdminTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[task.TaskID] = *task
+	return nil
+}
+
+func (s *exportTaskStore) PerformAdminFailUnfinishedTasks(ctx context.Context, reason string) (int64, error) {
+	return 0, nil
+}
+
+func (s *exportTaskStore) QueryAdminTask(ctx context.Context, taskID string) (*clientapi.AdminTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[taskID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &task, nil
+}
+
+func (s *exportTaskStore) QueryAdminTasks(ctx context.Context, limit int) ([]clientapi.AdminTask, error) {
+	return nil, nil
+}
+
+func TestOwnUserDataExport(t *testing.T) {
+	cfg := &config.ClientAPI{DataExportPath: config.Path(t.TempDir())}
+	store := &exportTaskStore{tasks: map[string]clientapi.AdminTask{}}
+	tasks := admintasks.NewManager(context.Background(), store, 1)
+	tasks.Register(adminTaskExportUserData, func(ctx context.Context, target string, progress admintasks.Progress) error {
+		f, err := createExportFile(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		if _, err = f.WriteString("archive of " + target); err != nil {
+			return err
+		}
+		return finishExportFile(ctx, cfg, f, adminTaskExportUserData)
+	})
+	alice := &api.Device{UserID: "@alice:test"}
+	bob := &api.Device{UserID: "@bob:test"}
+	userAPI := &exportUserAPI{tokens: map[string]string{"alice": alice.UserID, "bob": bob.UserID}}
+
+	res := ExportOwnUserData(httptest.NewRequest(http.MethodPost, "/data_export", nil), alice, tasks)
+	assert.Equal(t, http.StatusAccepted, res.Code)
+	task := res.JSON.(*clientapi.AdminTask)
+	assert.Equal(t, alice.UserID, task.Target)
+	assert.Eventually(t, func() bool {
+		got, err := tasks.Get(context.Background(), task.TaskID)
+		return err == nil && got.Status == clientapi.AdminTaskCompleted
+	}, time.Second*5, time.Millisecond*10)
+
+	withTaskID := func(req *http.Request) *http.Request {
+		return mux.SetURLVars(req, map[string]string{"taskID": task.TaskID})
+	}
+	res = GetOwnUserDataExport(withTaskID(httptest.NewRequest(http.MethodGet, "/data_export/"+task.TaskID, nil)), alice, tasks)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	// Other users can't see or download the export.
+	res = GetOwnUserDataExport(withTaskID(httptest.NewRequest(http.MethodGet, "/data_export/"+task.TaskID, nil)), bob, tasks)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	download := func(token string) *httptest.ResponseRecorder {
+		req := withTaskID(httptest.NewRequest(http.MethodGet, "/data_export/"+task.TaskID+"/download", nil))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		DownloadOwnUserDataExport(rec, req, cfg, userAPI, tasks)
+		return rec
+	}
+	rec := download("alice")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "archive of @alice:test", rec.Body.String())
+	assert.Equal(t, http.StatusNotFound, download("bob").Code)
+	assert.Equal(t, http.StatusUnauthorized, download("unknown").Code)
+
+	// Once the archive has expired, it can't be downloaded any more.
+	removed, err := removeExpiredExports(dataExportDir(cfg), time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	rec = download("alice")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.True(t, bytes.Contains(rec.Body.Bytes(), []byte(spec.ErrorNotFound)))
+}
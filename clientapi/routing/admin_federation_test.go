@@ -0,0 +1,49 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
+	"github.com/neilalexander/harmony/internal/eventutil"
+)
+
+// roomFederationAPI fails to change the federation status of a room with
+// the given error.
+type roomFederationAPI struct {
+	federationAPI.ClientFederationAPI
+	err error
+}
+
+func (f *roomFederationAPI) PerformAdminSetRoomFederationDisabled(ctx context.Context, roomID string, disabled bool) error {
+	return f.err
+}
+
+func TestAdminSetRoomFederation(t *testing.T) {
+	for name, tt := range map[string]struct {
+		roomID   string
+		err      error
+		wantCode int
+	}{
+		"success":         {roomID: "!room:test", wantCode: http.StatusOK},
+		"invalid room ID": {roomID: "room:test", wantCode: http.StatusBadRequest},
+		"not federatable": {roomID: "!room:test", err: &federationAPI.RoomNotFederatableError{RoomID: "!room:test"}, wantCode: http.StatusBadRequest},
+		"unknown room":    {roomID: "!room:test", err: eventutil.ErrRoomNoExists{}, wantCode: http.StatusNotFound},
+		"internal error":  {roomID: "!room:test", err: errors.New("database is down"), wantCode: http.StatusInternalServerError},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/_dendrite/admin/roomFederation/"+tt.roomID, strings.NewReader(`{"disabled":false}`))
+			req = mux.SetURLVars(req, map[string]string{"roomID": tt.roomID})
+			res := AdminSetRoomFederation(req, &roomFederationAPI{err: tt.err})
+			if res.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", res.Code, tt.wantCode)
+			}
+		})
+	}
+}
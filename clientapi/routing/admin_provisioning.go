@@ -0,0 +1,472 @@
+package routing
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/neilalexander/harmony/clientapi/admintasks"
+	clientapi "github.com/neilalexander/harmony/clientapi/api"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/httputil"
+	"github.com/neilalexander/harmony/internal/util"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/userapi/api"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const adminTaskCreateUsers = "create_users"
+
+// maxBulkUsers limits how many users can be created by a single request.
+const maxBulkUsers = 10000
+
+// maxReportedFailures limits how many failures are included in the error of
+// a bulk provisioning task.
+const maxReportedFailures = 5
+
+// bulkUser is a user to be created by a bulk provisioning task. Users
+// without a password can't log in until an admin sets one for them.
+type bulkUser struct {
+	Username    string   `json:"username"`
+	Password    string   `json:"password,omitempty"`
+	DisplayName string   `json:"displayname,omitempty"`
+	Admin       bool     `json:"admin,omitempty"`
+	Rooms       []string `json:"rooms,omitempty"`
+}
+
+// storedBulkUser is a user of a batch as it is written to disk, with a
+// hash of the password rather than the password itself.
+type storedBulkUser struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_hash,omitempty"`
+	DisplayName  string   `json:"displayname,omitempty"`
+	Admin        bool     `json:"admin,omitempty"`
+	Rooms        []string `json:"rooms,omitempty"`
+}
+
+// provisioningStep is a step of creating a user which has been completed,
+// as it is written to the progress file of a batch.
+type provisioningStep struct {
+	Username string `json:"username"`
+	Step     string `json:"step"`
+}
+
+const (
+	provisioningStepCreating    = "creating"
+	provisioningStepCreate      = "create"
+	provisioningStepDisplayName = "displayname"
+	provisioningStepJoin        = "join "
+)
+
+// userProvisioner creates the users of a batch which has been written to
+// disk, so that the batch can be resumed if the task is interrupted. The
+// steps completed for each user are recorded, so that a resumed batch
+// carries on where it left off.
+type userProvisioner struct {
+	cfg        *config.ClientAPI
+	rsAPI      roomserverAPI.ClientRoomserverAPI
+	userAPI    api.ClientUserAPI
+	bcryptCost int
+
+	// The batches which haven't been written to disk yet, as their
+	// passwords haven't been hashed.
+	mu      sync.Mutex
+	pending map[string][]bulkUser
+}
+
+func newUserProvisioner(
+	cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI, userAPI api.ClientUserAPI, bcryptCost int,
+) *userProvisioner {
+	return &userProvisioner{
+		cfg:        cfg,
+		rsAPI:      rsAPI,
+		userAPI:    userAPI,
+		bcryptCost: bcryptCost,
+		pending:    make(map[string][]bulkUser),
+	}
+}
+
+func (p *userProvisioner) dir() string {
+	if p.cfg.AbsAdminTaskDataPath != "" {
+		return string(p.cfg.AbsAdminTaskDataPath)
+	}
+	return string(p.cfg.AdminTaskDataPath)
+}
+
+func (p *userProvisioner) batchPath(batchID string) string {
+	return filepath.Join(p.dir(), "create_users_"+batchID+".json")
+}
+
+func (p *userProvisioner) progressPath(batchID string) string {
+	return filepath.Join(p.dir(), "create_users_"+batchID+".progress")
+}
+
+// queueBatch keeps the users in memory until the task which creates them
+// has hashed their passwords, so that the passwords are never written to
+// disk.
+func (p *userProvisioner) queueBatch(users []bulkUser) string {
+	batchID := util.RandomString(16)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending[batchID] = users
+	return batchID
+}
+
+// forgetBatch removes a batch which was queued from memory.
+func (p *userProvisioner) forgetBatch(batchID string) ([]bulkUser, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	users, ok := p.pending[batchID]
+	delete(p.pending, batchID)
+	return users, ok
+}
+
+// storeBatch hashes the passwords of a batch which was queued, and writes
+// it to disk. It does nothing if the batch was stored by an earlier task.
+func (p *userProvisioner) storeBatch(batchID string) error {
+	users, ok := p.forgetBatch(batchID)
+	if !ok {
+		return nil
+	}
+	stored := make([]storedBulkUser, len(users))
+	for i, user := range users {
+		stored[i] = storedBulkUser{
+			Username:    user.Username,
+			DisplayName: user.DisplayName,
+			Admin:       user.Admin,
+			Rooms:       user.Rooms,
+		}
+		if user.Password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), p.bcryptCost)
+			if err != nil {
+				return fmt.Errorf("unable to hash password of %s: %w", user.Username, err)
+			}
+			stored[i].PasswordHash = string(hash)
+		}
+	}
+	if err := os.MkdirAll(p.dir(), 0o700); err != nil {
+		return err
+	}
+	js, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.batchPath(batchID), js, 0o600)
+}
+
+// completedSteps reads the steps which earlier tasks completed for the
+// batch, by username. A step which was only partly written when the server
+// stopped is removed from the file, and will be done again.
+func (p *userProvisioner) completedSteps(batchID string) (map[string]map[string]bool, error) {
+	completed := map[string]map[string]bool{}
+	f, err := os.Open(p.progressPath(batchID))
+	if errors.Is(err, os.ErrNotExist) {
+		return completed, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	decoder := json.NewDecoder(f)
+	var valid int64
+	for {
+		var step provisioningStep
+		if err = decoder.Decode(&step); err == io.EOF {
+			return completed, nil
+		} else if err != nil {
+			return completed, os.Truncate(p.progressPath(batchID), valid)
+		}
+		valid = decoder.InputOffset()
+		if completed[step.Username] == nil {
+			completed[step.Username] = map[string]bool{}
+		}
+		completed[step.Username][step.Step] = true
+	}
+}
+
+// provision creates the users of the batch, skipping the steps which were
+// completed by earlier tasks for the batch. The batch is removed once all
+// of the users have been created.
+func (p *userProvisioner) provision(ctx context.Context, batchID string, progress admintasks.Progress) error {
+	if err := p.storeBatch(batchID); err != nil {
+		return fmt.Errorf("unable to store batch: %w", err)
+	}
+	js, err := os.ReadFile(p.batchPath(batchID))
+	if err != nil {
+		return fmt.Errorf("unable to read batch: %w", err)
+	}
+	var users []storedBulkUser
+	if err = json.Unmarshal(js, &users); err != nil {
+		return fmt.Errorf("unable to parse batch: %w", err)
+	}
+	completed, err := p.completedSteps(batchID)
+	if err != nil {
+		return fmt.Errorf("unable to read batch progress: %w", err)
+	}
+	progressFile, err := os.OpenFile(p.progressPath(batchID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to open batch progress: %w", err)
+	}
+	defer progressFile.Close() // nolint: errcheck
+	encoder := json.NewEncoder(progressFile)
+
+	var failures []string
+	progress(0, int64(len(users)))
+	for i := range users {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		user := &users[i]
+		done := completed[user.Username]
+		if err = p.createUser(ctx, user, done, func(step string) error {
+			return encoder.Encode(provisioningStep{Username: user.Username, Step: step})
+		}); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", user.Username, err))
+		}
+		progress(int64(i+1), int64(len(users)))
+	}
+	if len(failures) > 0 {
+		reported := failures
+		if len(reported) > maxReportedFailures {
+			reported = reported[:maxReportedFailures]
+		}
+		return fmt.Errorf("%d of %d users failed, resume the task to retry them: %s", len(failures), len(users), strings.Join(reported, "; "))
+	}
+	if err = os.Remove(p.batchPath(batchID)); err != nil {
+		return err
+	}
+	return os.Remove(p.progressPath(batchID))
+}
+
+// createUser carries out the steps of creating the user which aren't
+// already done, calling complete as each one succeeds. An account which
+// already exists but wasn't created by the batch is a failure, rather than
+// being given the rooms and display name of the batch.
+//
+// The batch records that it is about to create the account before doing
+// so, once it has checked that the username is free. If the server stops
+// before the account is recorded as created, the resumed batch knows that
+// an account with the username was created by the batch.
+func (p *userProvisioner) createUser(ctx context.Context, user *storedBulkUser, done map[string]bool, complete func(step string) error) error {
+	if !done[provisioningStepCreate] {
+		if !done[provisioningStepCreating] {
+			var availRes api.QueryAccountAvailabilityResponse
+			if err := p.userAPI.QueryAccountAvailability(ctx, &api.QueryAccountAvailabilityRequest{
+				Localpart:  user.Username,
+				ServerName: p.cfg.Matrix.ServerName,
+			}, &availRes); err != nil {
+				return err
+			}
+			if !availRes.Available {
+				return errors.New("the user already exists")
+			}
+			if err := complete(provisioningStepCreating); err != nil {
+				return fmt.Errorf("unable to record progress: %w", err)
+			}
+		}
+		accType := api.AccountTypeUser
+		if user.Admin {
+			accType = api.AccountTypeAdmin
+		}
+		var accRes api.PerformAccountCreationResponse
+		err := p.userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+			Localpart:    user.Username,
+			ServerName:   p.cfg.Matrix.ServerName,
+			PasswordHash: user.PasswordHash,
+			AccountType:  accType,
+			OnConflict:   api.ConflictAbort,
+		}, &accRes)
+		if _, ok := err.(*api.ErrorConflict); ok {
+			if !done[provisioningStepCreating] {
+				return errors.New("the user already exists")
+			}
+		} else if err != nil {
+			return err
+		} else {
+			amtRegUsers.Inc()
+		}
+		if err = complete(provisioningStepCreate); err != nil {
+			return fmt.Errorf("unable to record progress: %w", err)
+		}
+	}
+	if user.DisplayName != "" && !done[provisioningStepDisplayName] {
+		if _, _, err := p.userAPI.SetDisplayName(ctx, user.Username, p.cfg.Matrix.ServerName, user.DisplayName); err != nil {
+			return fmt.Errorf("unable to set display name: %w", err)
+		}
+		if err := complete(provisioningStepDisplayName); err != nil {
+			return fmt.Errorf("unable to record progress: %w", err)
+		}
+	}
+	userID := fmt.Sprintf("@%s:%s", user.Username, p.cfg.Matrix.ServerName)
+	for _, room := range user.Rooms {
+		if done[provisioningStepJoin+room] {
+			continue
+		}
+		if _, _, err := p.rsAPI.PerformJoin(ctx, &roomserverAPI.PerformJoinRequest{
+			RoomIDOrAlias: room,
+			UserID:        userID,
+			Content:       map[string]interface{}{},
+		}); err != nil {
+			return fmt.Errorf("unable to join %s: %w", room, err)
+		}
+		if err := complete(provisioningStepJoin + room); err != nil {
+			return fmt.Errorf("unable to record progress: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseBulkUsers reads the users from either a JSON body, which has the
+// users in a "users" array, or a CSV body with a header row naming the
+// columns. In CSV, the rooms to join are separated by spaces.
+func parseBulkUsers(req *http.Request) ([]bulkUser, error) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "text/csv" {
+		var body struct {
+			Users []bulkUser `json:"users"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		return body.Users, nil
+	}
+
+	r := csv.NewReader(req.Body)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read header row: %w", err)
+	}
+	var users []bulkUser
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return users, nil
+		} else if err != nil {
+			return nil, err
+		}
+		var user bulkUser
+		for i, column := range header {
+			value := strings.TrimSpace(record[i])
+			switch strings.ToLower(strings.TrimSpace(column)) {
+			case "username":
+				user.Username = value
+			case "password":
+				user.Password = value
+			case "displayname":
+				user.DisplayName = value
+			case "admin":
+				if value != "" {
+					if user.Admin, err = strconv.ParseBool(value); err != nil {
+						return nil, fmt.Errorf("line %d: invalid admin value %q", len(users)+2, value)
+					}
+				}
+			case "rooms":
+				if value != "" {
+					user.Rooms = strings.Fields(value)
+				}
+			default:
+				return nil, fmt.Errorf("unknown column %q", column)
+			}
+		}
+		users = append(users, user)
+	}
+}
+
+// validateBulkUsers checks all of the users before any are created, so that
+// a mistake in the batch doesn't leave it partly created.
+func validateBulkUsers(serverName spec.ServerName, users []bulkUser) error {
+	if len(users) == 0 {
+		return errors.New("no users were given")
+	}
+	if len(users) > maxBulkUsers {
+		return fmt.Errorf("at most %d users can be created at once", maxBulkUsers)
+	}
+	seen := make(map[string]struct{}, len(users))
+	for i := range users {
+		user := &users[i]
+		user.Username = strings.ToLower(user.Username)
+		if err := internal.ValidateUsername(user.Username, serverName); err != nil {
+			return fmt.Errorf("user %d (%q): %w", i+1, user.Username, err)
+		}
+		if user.Password != "" {
+			if err := internal.ValidatePassword(user.Password); err != nil {
+				return fmt.Errorf("user %d (%q): %w", i+1, user.Username, err)
+			}
+		}
+		if _, ok := seen[user.Username]; ok {
+			return fmt.Errorf("user %d (%q) is given more than once", i+1, user.Username)
+		}
+		seen[user.Username] = struct{}{}
+		for _, room := range user.Rooms {
+			if !strings.HasPrefix(room, "!") && !strings.HasPrefix(room, "#") {
+				return fmt.Errorf("user %d (%q): %q is not a room ID or alias", i+1, user.Username, room)
+			}
+		}
+	}
+	return nil
+}
+
+func AdminCreateUsers(req *http.Request, device *api.Device, provisioner *userProvisioner, tasks *admintasks.Manager) util.JSONResponse {
+	users, err := parseBulkUsers(req)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	if err = validateBulkUsers(provisioner.cfg.Matrix.ServerName, users); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	batchID := provisioner.queueBatch(users)
+	res := startAdminTask(req, device, tasks, adminTaskCreateUsers, batchID)
+	if res.Code != http.StatusAccepted {
+		provisioner.forgetBatch(batchID)
+	}
+	return res
+}
+
+// AdminResumeCreateUsers starts a new task for the batch of a bulk
+// provisioning task which didn't complete.
+func AdminResumeCreateUsers(req *http.Request, device *api.Device, provisioner *userProvisioner, tasks *admintasks.Manager) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	task, err := tasks.Get(req.Context(), vars["taskID"])
+	if err != nil {
+		return adminTaskErrorResponse(err)
+	}
+	switch {
+	case task.Type != adminTaskCreateUsers:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("The task is not a user provisioning task"),
+		}
+	case !task.Status.Finished() || task.Status == clientapi.AdminTaskCompleted:
+		return clienterror.Conflict("Only failed or cancelled tasks can be resumed").JSONResponse()
+	}
+	if _, err = os.Stat(provisioner.batchPath(task.Target)); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("The batch of this task no longer exists"),
+		}
+	}
+	return startAdminTask(req, device, tasks, adminTaskCreateUsers, task.Target)
+}
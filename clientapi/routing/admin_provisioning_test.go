@@ -0,0 +1,205 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/userapi/api"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type provisioningUserAPI struct {
+	api.ClientUserAPI
+	accounts     map[string]string // localpart -> password hash
+	displayNames map[string]string
+}
+
+func (a *provisioningUserAPI) PerformAccountCreation(ctx context.Context, req *api.PerformAccountCreationRequest, res *api.PerformAccountCreationResponse) error {
+	if _, ok := a.accounts[req.Localpart]; ok {
+		return &api.ErrorConflict{Message: "exists"}
+	}
+	a.accounts[req.Localpart] = req.PasswordHash
+	res.AccountCreated = true
+	res.Account = &api.Account{Localpart: req.Localpart, ServerName: req.ServerName}
+	return nil
+}
+
+func (a *provisioningUserAPI) QueryAccountAvailability(ctx context.Context, req *api.QueryAccountAvailabilityRequest, res *api.QueryAccountAvailabilityResponse) error {
+	_, exists := a.accounts[req.Localpart]
+	res.Available = !exists
+	return nil
+}
+
+func (a *provisioningUserAPI) SetDisplayName(ctx context.Context, localpart string, serverName spec.ServerName, displayName string) (*authtypes.Profile, bool, error) {
+	a.displayNames[localpart] = displayName
+	return &authtypes.Profile{}, true, nil
+}
+
+type provisioningRoomserverAPI struct {
+	roomserverAPI.ClientRoomserverAPI
+	joins   map[string][]string // user ID -> rooms
+	failing map[string]bool
+}
+
+func (r *provisioningRoomserverAPI) PerformJoin(ctx context.Context, req *roomserverAPI.PerformJoinRequest) (string, spec.ServerName, error) {
+	if r.failing[req.RoomIDOrAlias] {
+		return "", "", errors.New("unavailable")
+	}
+	r.joins[req.UserID] = append(r.joins[req.UserID], req.RoomIDOrAlias)
+	return req.RoomIDOrAlias, "", nil
+}
+
+func TestProvisionUsers(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix:            &config.Global{SigningIdentity: fclient.SigningIdentity{ServerName: "test"}},
+		AdminTaskDataPath: config.Path(t.TempDir()),
+	}
+	userAPI := &provisioningUserAPI{
+		accounts:     map[string]string{"existing": ""},
+		displayNames: map[string]string{},
+	}
+	rsAPI := &provisioningRoomserverAPI{
+		joins:   map[string][]string{},
+		failing: map[string]bool{"!broken:test": true},
+	}
+	provisioner := newUserProvisioner(cfg, rsAPI, userAPI, bcrypt.MinCost)
+	progress := func(done, total int64) {}
+
+	// The passwords are hashed before the batch is written to disk. The
+	// existing user and the room which can't be joined both fail.
+	batchID := provisioner.queueBatch([]bulkUser{
+		{Username: "alice", Password: "correct horse battery", DisplayName: "Alice", Rooms: []string{"!room:test", "!broken:test"}},
+		{Username: "bob"},
+		{Username: "existing", DisplayName: "Hijacked", Rooms: []string{"!room:test"}},
+	})
+	err := provisioner.provision(context.Background(), batchID, progress)
+	assert.ErrorContains(t, err, "2 of 3 users failed")
+	batch, err := os.ReadFile(provisioner.batchPath(batchID))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(batch), "correct horse battery")
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(userAPI.accounts["alice"]), []byte("correct horse battery")))
+	assert.Equal(t, "", userAPI.accounts["bob"])
+	assert.Equal(t, map[string]string{"alice": "Alice"}, userAPI.displayNames)
+	assert.Equal(t, map[string][]string{"@alice:test": {"!room:test"}}, rsAPI.joins)
+
+	// Resuming the batch carries on from the step which failed, rather than
+	// skipping alice because her account already exists.
+	delete(rsAPI.failing, "!broken:test")
+	delete(userAPI.displayNames, "alice")
+	err = provisioner.provision(context.Background(), batchID, progress)
+	assert.ErrorContains(t, err, "1 of 3 users failed")
+	assert.Equal(t, map[string][]string{"@alice:test": {"!room:test", "!broken:test"}}, rsAPI.joins)
+	assert.Empty(t, userAPI.displayNames)
+
+	// Once the batch completes, its files are removed.
+	delete(userAPI.accounts, "existing")
+	assert.NoError(t, provisioner.provision(context.Background(), batchID, progress))
+	assert.Equal(t, "Hijacked", userAPI.displayNames["existing"])
+	_, err = os.Stat(provisioner.batchPath(batchID))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(provisioner.progressPath(batchID))
+	assert.True(t, os.IsNotExist(err))
+
+	// A batch which was neither queued nor stored can't be provisioned.
+	assert.Error(t, provisioner.provision(context.Background(), "missing", progress))
+}
+
+func TestProvisionUsersResumeAfterCreating(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix:            &config.Global{SigningIdentity: fclient.SigningIdentity{ServerName: "test"}},
+		AdminTaskDataPath: config.Path(t.TempDir()),
+	}
+	userAPI := &provisioningUserAPI{
+		accounts:     map[string]string{},
+		displayNames: map[string]string{},
+	}
+	provisioner := newUserProvisioner(cfg, nil, userAPI, bcrypt.MinCost)
+	progress := func(done, total int64) {}
+	batchID := provisioner.queueBatch([]bulkUser{{Username: "alice", DisplayName: "Alice"}})
+	assert.NoError(t, provisioner.storeBatch(batchID))
+
+	// The server stopped after the account was created, but before that was
+	// recorded, so the existing account belongs to the batch.
+	userAPI.accounts["alice"] = ""
+	assert.NoError(t, os.WriteFile(provisioner.progressPath(batchID), []byte(
+		`{"username":"alice","step":"creating"}`+"\n",
+	), 0o600))
+	assert.NoError(t, provisioner.provision(context.Background(), batchID, progress))
+	assert.Equal(t, map[string]string{"alice": "Alice"}, userAPI.displayNames)
+}
+
+func TestCompletedStepsPartialWrite(t *testing.T) {
+	cfg := &config.ClientAPI{AdminTaskDataPath: config.Path(t.TempDir())}
+	provisioner := newUserProvisioner(cfg, nil, nil, bcrypt.MinCost)
+	assert.NoError(t, os.WriteFile(provisioner.progressPath("batch"), []byte(
+		`{"username":"alice","step":"create"}`+"\n"+`{"username":"alice","st`,
+	), 0o600))
+	completed, err := provisioner.completedSteps("batch")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]bool{"alice": {provisioningStepCreate: true}}, completed)
+
+	// The partly written step is removed, so that later steps can be read.
+	f, err := os.OpenFile(provisioner.progressPath("batch"), os.O_APPEND|os.O_WRONLY, 0o600)
+	assert.NoError(t, err)
+	_, err = f.WriteString(`{"username":"alice","step":"displayname"}` + "\n")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	completed, err = provisioner.completedSteps("batch")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]bool{"alice": {provisioningStepCreate: true, provisioningStepDisplayName: true}}, completed)
+}
+
+func TestParseBulkUsers(t *testing.T) {
+	req := httptest.NewRequest("POST", "/admin/createUsers", strings.NewReader(
+		"username,password,displayname,admin,rooms\n"+
+			"Alice,correct horse battery,Alice A,true,!room:test #lobby:test\n"+
+			"bob,another long password,,,\n",
+	))
+	req.Header.Set("Content-Type", "text/csv; charset=utf-8")
+	users, err := parseBulkUsers(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []bulkUser{
+		{Username: "Alice", Password: "correct horse battery", DisplayName: "Alice A", Admin: true, Rooms: []string{"!room:test", "#lobby:test"}},
+		{Username: "bob", Password: "another long password"},
+	}, users)
+	assert.NoError(t, validateBulkUsers("test", users))
+	assert.Equal(t, "alice", users[0].Username)
+
+	req = httptest.NewRequest("POST", "/admin/createUsers", strings.NewReader(
+		`{"users":[{"username":"carol","password":"a long enough password","rooms":["!room:test"]}]}`,
+	))
+	users, err = parseBulkUsers(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []bulkUser{{Username: "carol", Password: "a long enough password", Rooms: []string{"!room:test"}}}, users)
+
+	req = httptest.NewRequest("POST", "/admin/createUsers", strings.NewReader("username,unknown\nalice,x\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	_, err = parseBulkUsers(req)
+	assert.Error(t, err)
+}
+
+func TestValidateBulkUsers(t *testing.T) {
+	valid := bulkUser{Username: "alice", Password: "correct horse battery"}
+	assert.Error(t, validateBulkUsers("test", nil))
+	assert.Error(t, validateBulkUsers("test", []bulkUser{valid, valid}))
+	assert.Error(t, validateBulkUsers("test", []bulkUser{{Username: "alice", Password: "short"}}))
+	assert.Error(t, validateBulkUsers("test", []bulkUser{{Username: "al ice", Password: "correct horse battery"}}))
+	assert.Error(t, validateBulkUsers("test", []bulkUser{{Username: "alice", Password: "correct horse battery", Rooms: []string{"room"}}}))
+
+	// Users without a password can be created, and given one later.
+	assert.NoError(t, validateBulkUsers("test", []bulkUser{{Username: "alice"}}))
+}
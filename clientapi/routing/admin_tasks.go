@@ -0,0 +1,185 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
+	"github.com/neilalexander/harmony/clientapi/admintasks"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/httputil"
+	"github.com/neilalexander/harmony/internal/util"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/neilalexander/harmony/userapi/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	adminTaskPurgeRoom     = "purge_room"
+	adminTaskReindexSearch = "reindex_search"
+)
+
+// RegisterAdminTasks makes the background admin operations available to
+// the task manager.
+func RegisterAdminTasks(
+	tasks *admintasks.Manager, cfg *config.ClientAPI,
+	rsAPI roomserverAPI.ClientRoomserverAPI, userAPI api.ClientUserAPI, natsClient *nats.Conn,
+) {
+	tasks.Register(adminTaskPurgeRoom, func(ctx context.Context, roomID string, progress admintasks.Progress) error {
+		if _, err := spec.NewRoomID(roomID); err != nil {
+			return err
+		}
+		progress(0, 1)
+		// Once the roomserver has purged the room, the other components must
+		// be told about it, so the purge can't be interrupted part way.
+		return rsAPI.PerformAdminPurgeRoom(context.WithoutCancel(ctx), roomID)
+	})
+
+	tasks.Register(adminTaskReindexSearch, func(ctx context.Context, _ string, progress admintasks.Progress) error {
+		// The sync API replies once the reindex has finished.
+		msg := nats.NewMsg(cfg.Matrix.JetStream.Prefixed(jetstream.InputFulltextReindex))
+		res, err := natsClient.RequestMsgWithContext(ctx, msg)
+		if err != nil {
+			return err
+		}
+		if errMsg := res.Header.Get("error"); errMsg != "" {
+			return errors.New(errMsg)
+		}
+		return nil
+	})
+
+	exporter := &userDataExporter{
+		cfg:        cfg,
+		rsAPI:      rsAPI,
+		userAPI:    userAPI,
+		natsClient: natsClient,
+	}
+	tasks.Register(adminTaskExportUserData, exporter.export)
+
+	tasks.Register(adminTaskExportRoom, func(ctx context.Context, roomID string, progress admintasks.Progress) error {
+		return exportRoom(ctx, cfg, rsAPI, roomID, progress)
+	})
+}
+
+func startAdminTask(req *http.Request, device *api.Device, tasks *admintasks.Manager, taskType, target string) util.JSONResponse {
+	task, err := tasks.Start(req.Context(), taskType, target, device.UserID)
+	switch {
+	case err == nil:
+	case errors.Is(err, admintasks.ErrUnknownType):
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	default:
+		logrus.WithError(err).Error("Failed to start admin task")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	adminAuditLog(device, taskType).WithFields(logrus.Fields{
+		"task_id": task.TaskID,
+		"target":  target,
+	}).Warn("Admin started background task")
+	return util.JSONResponse{
+		Code: http.StatusAccepted,
+		JSON: task,
+	}
+}
+
+func AdminStartTask(req *http.Request, device *api.Device, tasks *admintasks.Manager) util.JSONResponse {
+	request := struct {
+		Type   string `json:"type"`
+		Target string `json:"target"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	return startAdminTask(req, device, tasks, request.Type, request.Target)
+}
+
+func AdminListTasks(req *http.Request, tasks *admintasks.Manager) util.JSONResponse {
+	limit := 100
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("limit must be a positive integer"),
+			}
+		}
+	}
+	list, err := tasks.List(req.Context(), limit)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list admin tasks")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"tasks": list,
+		},
+	}
+}
+
+func AdminGetTask(req *http.Request, tasks *admintasks.Manager) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	task, err := tasks.Get(req.Context(), vars["taskID"])
+	if err != nil {
+		return adminTaskErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: task,
+	}
+}
+
+func AdminCancelTask(req *http.Request, device *api.Device, tasks *admintasks.Manager) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	task, err := tasks.Cancel(req.Context(), vars["taskID"])
+	if err != nil {
+		return adminTaskErrorResponse(err)
+	}
+	adminAuditLog(device, "cancel_task").WithField("task_id", task.TaskID).Warn("Admin cancelled background task")
+	return util.JSONResponse{
+		Code: http.StatusAccepted,
+		JSON: task,
+	}
+}
+
+func adminTaskErrorResponse(err error) util.JSONResponse {
+	switch {
+	case errors.Is(err, admintasks.ErrNotFound):
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(err.Error()),
+		}
+	case errors.Is(err, admintasks.ErrFinished):
+		return clienterror.Conflict(err.Error()).JSONResponse()
+	default:
+		logrus.WithError(err).Error("Failed to query admin task")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+}
@@ -15,8 +15,12 @@
 package routing
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
 	"net/http"
 
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/userapi/api"
 
@@ -24,12 +28,33 @@ import (
 )
 
 type adminWhoisResponse struct {
-	UserID  string                `json:"user_id"`
-	Devices map[string]deviceInfo `json:"devices"`
+	UserID       string                `json:"user_id"`
+	Devices      map[string]deviceInfo `json:"devices"`
+	CrossSigning *crossSigningInfo     `json:"cross_signing,omitempty"`
 }
 
 type deviceInfo struct {
-	Sessions []sessionInfo `json:"sessions"`
+	Sessions []sessionInfo  `json:"sessions"`
+	Keys     *deviceKeyInfo `json:"keys,omitempty"`
+}
+
+// deviceKeyInfo describes a device's end-to-end encryption keys. The device
+// is verified if it has been signed by the user's self-signing key, and that
+// key has been signed by the user's master key.
+type deviceKeyInfo struct {
+	Algorithms   []string                                                `json:"algorithms"`
+	IdentityKeys map[gomatrixserverlib.KeyID]spec.Base64Bytes            `json:"identity_keys"`
+	Signatures   map[string]map[gomatrixserverlib.KeyID]spec.Base64Bytes `json:"signatures,omitempty"`
+	Verified     bool                                                    `json:"verified"`
+}
+
+// crossSigningInfo describes the user's cross-signing keys. The self-signing
+// key is verified if it has been signed by the master key.
+type crossSigningInfo struct {
+	MasterKey           *fclient.CrossSigningKey `json:"master_key,omitempty"`
+	SelfSigningKey      *fclient.CrossSigningKey `json:"self_signing_key,omitempty"`
+	UserSigningKey      *fclient.CrossSigningKey `json:"user_signing_key,omitempty"`
+	SelfSigningVerified bool                     `json:"self_signing_verified"`
 }
 
 type sessionInfo struct {
@@ -67,6 +92,20 @@ func GetAdminWhois(
 		}
 	}
 
+	var keysRes api.QueryKeysResponse
+	userAPI.QueryKeys(req.Context(), &api.QueryKeysRequest{
+		UserID:        device.UserID,
+		UserToDevices: map[string][]string{userID: {}},
+	}, &keysRes)
+	if keysRes.Error != nil {
+		util.GetLogger(req.Context()).WithError(keysRes.Error).Error("GetAdminWhois failed to query user keys")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	crossSigning := whoisCrossSigningInfo(userID, &keysRes)
+
 	devices := make(map[string]deviceInfo)
 	for _, device := range queryRes.Devices {
 		connInfo := connectionInfo{
@@ -77,6 +116,7 @@ func GetAdminWhois(
 		dev, ok := devices[device.ID]
 		if !ok {
 			dev.Sessions = []sessionInfo{{}}
+			dev.Keys = whoisDeviceKeyInfo(userID, keysRes.DeviceKeys[userID][device.ID], crossSigning)
 		}
 		dev.Sessions[0].Connections = append(dev.Sessions[0].Connections, connInfo)
 		devices[device.ID] = dev
@@ -84,8 +124,64 @@ func GetAdminWhois(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: adminWhoisResponse{
-			UserID:  userID,
-			Devices: devices,
+			UserID:       userID,
+			Devices:      devices,
+			CrossSigning: crossSigning,
 		},
 	}
 }
+
+func whoisCrossSigningInfo(userID string, res *api.QueryKeysResponse) *crossSigningInfo {
+	info := &crossSigningInfo{}
+	if key, ok := res.MasterKeys[userID]; ok {
+		info.MasterKey = &key
+	}
+	if key, ok := res.SelfSigningKeys[userID]; ok {
+		info.SelfSigningKey = &key
+	}
+	if key, ok := res.UserSigningKeys[userID]; ok {
+		info.UserSigningKey = &key
+	}
+	if info.MasterKey == nil && info.SelfSigningKey == nil && info.UserSigningKey == nil {
+		return nil
+	}
+	if info.MasterKey != nil && info.SelfSigningKey != nil {
+		if selfSigningJSON, err := json.Marshal(info.SelfSigningKey); err == nil {
+			info.SelfSigningVerified = whoisVerifySignature(userID, info.MasterKey, selfSigningJSON)
+		}
+	}
+	return info
+}
+
+func whoisDeviceKeyInfo(userID string, deviceKeyJSON json.RawMessage, crossSigning *crossSigningInfo) *deviceKeyInfo {
+	if len(deviceKeyJSON) == 0 {
+		return nil
+	}
+	var deviceKeys fclient.DeviceKeys
+	if err := json.Unmarshal(deviceKeyJSON, &deviceKeys); err != nil {
+		return nil
+	}
+	info := &deviceKeyInfo{
+		Algorithms:   deviceKeys.Algorithms,
+		IdentityKeys: deviceKeys.Keys,
+		Signatures:   deviceKeys.Signatures,
+	}
+	if crossSigning != nil && crossSigning.SelfSigningVerified {
+		info.Verified = whoisVerifySignature(userID, crossSigning.SelfSigningKey, deviceKeyJSON)
+	}
+	return info
+}
+
+// whoisVerifySignature returns whether the JSON has been signed by the user
+// with the given cross-signing key.
+func whoisVerifySignature(userID string, signingKey *fclient.CrossSigningKey, message []byte) bool {
+	for keyID, publicKey := range signingKey.Keys {
+		if len(publicKey) != ed25519.PublicKeySize {
+			continue
+		}
+		if gomatrixserverlib.VerifyJSON(userID, keyID, ed25519.PublicKey(publicKey), message) == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package routing
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/userapi/api"
+)
+
+func TestWhoisKeyVerification(t *testing.T) {
+	userID := "@alice:test"
+	masterPublic, masterPrivate, _ := ed25519.GenerateKey(nil)
+	selfSigningPublic, selfSigningPrivate, _ := ed25519.GenerateKey(nil)
+	masterKeyID := gomatrixserverlib.KeyID("ed25519:" + spec.Base64Bytes(masterPublic).Encode())
+	selfSigningKeyID := gomatrixserverlib.KeyID("ed25519:" + spec.Base64Bytes(selfSigningPublic).Encode())
+
+	sign := func(keyID gomatrixserverlib.KeyID, privateKey ed25519.PrivateKey, v interface{}) []byte {
+		unsigned, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := gomatrixserverlib.SignJSON(userID, keyID, privateKey, unsigned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	var selfSigningKey fclient.CrossSigningKey
+	if err := json.Unmarshal(sign(masterKeyID, masterPrivate, fclient.CrossSigningKey{
+		UserID: userID,
+		Usage:  []fclient.CrossSigningKeyPurpose{fclient.CrossSigningKeyPurposeSelfSigning},
+		Keys:   map[gomatrixserverlib.KeyID]spec.Base64Bytes{selfSigningKeyID: spec.Base64Bytes(selfSigningPublic)},
+	}), &selfSigningKey); err != nil {
+		t.Fatal(err)
+	}
+	res := &api.QueryKeysResponse{
+		MasterKeys: map[string]fclient.CrossSigningKey{userID: {
+			UserID: userID,
+			Usage:  []fclient.CrossSigningKeyPurpose{fclient.CrossSigningKeyPurposeMaster},
+			Keys:   map[gomatrixserverlib.KeyID]spec.Base64Bytes{masterKeyID: spec.Base64Bytes(masterPublic)},
+		}},
+		SelfSigningKeys: map[string]fclient.CrossSigningKey{userID: selfSigningKey},
+	}
+	crossSigning := whoisCrossSigningInfo(userID, res)
+	if crossSigning == nil || !crossSigning.SelfSigningVerified {
+		t.Fatalf("expected the self-signing key to be verified, got %+v", crossSigning)
+	}
+
+	deviceKeys := fclient.RespUserDeviceKeys{
+		UserID:     userID,
+		DeviceID:   "DEVICE",
+		Algorithms: []string{"m.olm.v1.curve25519-aes-sha2"},
+		Keys:       map[gomatrixserverlib.KeyID]spec.Base64Bytes{"curve25519:DEVICE": spec.Base64Bytes("curve")},
+		Signatures: map[string]map[gomatrixserverlib.KeyID]spec.Base64Bytes{},
+	}
+	unverified, err := json.Marshal(deviceKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := whoisDeviceKeyInfo(userID, unverified, crossSigning); info == nil || info.Verified || len(info.IdentityKeys) != 1 {
+		t.Fatalf("expected an unverified device, got %+v", info)
+	}
+	verified := sign(selfSigningKeyID, selfSigningPrivate, deviceKeys)
+	if info := whoisDeviceKeyInfo(userID, verified, crossSigning); info == nil || !info.Verified {
+		t.Fatalf("expected a verified device, got %+v", info)
+	}
+	// A device signed by a self-signing key which the master key didn't sign
+	// isn't verified.
+	unsignedSelfSigning := *crossSigning
+	unsignedSelfSigning.SelfSigningVerified = false
+	if info := whoisDeviceKeyInfo(userID, verified, &unsignedSelfSigning); info == nil || info.Verified {
+		t.Fatalf("expected an unverified device with an unverified self-signing key, got %+v", info)
+	}
+	if info := whoisDeviceKeyInfo(userID, nil, crossSigning); info != nil {
+		t.Fatalf("expected no key info for a device without keys, got %+v", info)
+	}
+}
@@ -15,14 +15,17 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 )
 
@@ -54,12 +57,14 @@ func GetAliases(
 		}
 		visibility = content.HistoryVisibility
 	}
+	// Only members of the room may list its aliases, unless anyone can read
+	// the room's history anyway.
 	if visibility != spec.WorldReadable {
 		deviceUserID, err := spec.NewUserID(device.UserID, true)
 		if err != nil {
 			return util.JSONResponse{
 				Code: http.StatusForbidden,
-				JSON: spec.Forbidden("userID doesn't have power level to change visibility"),
+				JSON: spec.Forbidden("You aren't a member of this room."),
 			}
 		}
 		queryReq := api.QueryMembershipForUserRequest{
@@ -105,3 +110,70 @@ func GetAliases(
 		JSON: response,
 	}
 }
+
+// validateCanonicalAlias checks the content of a new m.room.canonical_alias
+// event. All of the aliases must be well-formed, and those which weren't in
+// the room's previous canonical alias event must point to the room, so that a
+// room can't claim aliases which belong to another room.
+func validateCanonicalAlias(
+	ctx context.Context, rsAPI api.ClientRoomserverAPI, federation fclient.FederationClient,
+	cfg *config.ClientAPI, roomID string, content []byte,
+) *util.JSONResponse {
+	var aliasEvent api.AliasEvent
+	if err := json.Unmarshal(content, &aliasEvent); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Unable to parse alias event: " + err.Error()),
+		}
+	}
+	if !aliasEvent.Valid() {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Request contains invalid aliases."),
+		}
+	}
+
+	stateTuple := gomatrixserverlib.StateKeyTuple{
+		EventType: spec.MRoomCanonicalAlias,
+		StateKey:  "",
+	}
+	stateRes := &api.QueryCurrentStateResponse{}
+	if err := rsAPI.QueryCurrentState(ctx, &api.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{stateTuple},
+	}, stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryCurrentState failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	previous := map[string]struct{}{}
+	if ev, ok := stateRes.StateEvents[stateTuple]; ok {
+		var previousEvent api.AliasEvent
+		if err := json.Unmarshal(ev.Content(), &previousEvent); err == nil {
+			previous[previousEvent.Alias] = struct{}{}
+			for _, alias := range previousEvent.AltAliases {
+				previous[alias] = struct{}{}
+			}
+		}
+	}
+
+	aliases := append([]string{aliasEvent.Alias}, aliasEvent.AltAliases...)
+	for _, alias := range aliases {
+		if _, ok := previous[alias]; ok || alias == "" {
+			continue
+		}
+		aliasRoomID, err := resolveRoomAlias(ctx, rsAPI, federation, cfg, alias)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("alias", alias).Warn("Failed to resolve alias for canonical alias event")
+		}
+		if aliasRoomID != roomID {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadAlias(fmt.Sprintf("Room alias %s does not point to this room.", alias)),
+			}
+		}
+	}
+	return nil
+}
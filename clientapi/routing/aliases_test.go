@@ -0,0 +1,87 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+type fakeAliasRoomserverAPI struct {
+	api.ClientRoomserverAPI
+	aliases map[string]string
+}
+
+func (f *fakeAliasRoomserverAPI) QueryCurrentState(ctx context.Context, req *api.QueryCurrentStateRequest, res *api.QueryCurrentStateResponse) error {
+	return nil
+}
+
+func (f *fakeAliasRoomserverAPI) GetRoomIDForAlias(ctx context.Context, req *api.GetRoomIDForAliasRequest, res *api.GetRoomIDForAliasResponse) error {
+	res.RoomID = f.aliases[req.Alias]
+	return nil
+}
+
+type fakeAliasFederation struct {
+	fclient.FederationClient
+	aliases map[string]string
+	calls   int
+}
+
+func (f *fakeAliasFederation) LookupRoomAlias(ctx context.Context, origin, s spec.ServerName, roomAlias string) (fclient.RespDirectory, error) {
+	f.calls++
+	return fclient.RespDirectory{RoomID: f.aliases[roomAlias]}, nil
+}
+
+func TestValidateCanonicalAlias(t *testing.T) {
+	remoteAliases = remoteAliasCache{entries: map[string]remoteAliasEntry{}}
+	cfg := &config.ClientAPI{
+		Matrix:                   &config.Global{SigningIdentity: fclient.SigningIdentity{ServerName: "test"}},
+		RemoteAliasCacheDuration: time.Minute,
+	}
+	rsAPI := &fakeAliasRoomserverAPI{aliases: map[string]string{
+		"#room:test":  "!room:test",
+		"#other:test": "!other:test",
+	}}
+	fed := &fakeAliasFederation{aliases: map[string]string{
+		"#room:remote":  "!room:test",
+		"#other:remote": "!other:test",
+	}}
+
+	testCases := []struct {
+		name     string
+		content  string
+		wantCode int
+	}{
+		{"no aliases", `{}`, 0},
+		{"local alias", `{"alias":"#room:test"}`, 0},
+		{"remote alt alias", `{"alias":"#room:test","alt_aliases":["#room:remote"]}`, 0},
+		{"alias for another room", `{"alias":"#other:test"}`, http.StatusBadRequest},
+		{"alt alias for another room", `{"alt_aliases":["#other:remote"]}`, http.StatusBadRequest},
+		{"unknown alt alias", `{"alias":"#room:test","alt_aliases":["#missing:test"]}`, http.StatusBadRequest},
+		{"malformed alt alias", `{"alt_aliases":["room"]}`, http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resErr := validateCanonicalAlias(context.Background(), rsAPI, fed, cfg, "!room:test", []byte(tc.content))
+			switch {
+			case resErr == nil && tc.wantCode != 0:
+				t.Fatalf("expected HTTP %d, got no error", tc.wantCode)
+			case resErr != nil && resErr.Code != tc.wantCode:
+				t.Fatalf("expected HTTP %d, got %d: %v", tc.wantCode, resErr.Code, resErr.JSON)
+			}
+		})
+	}
+
+	// Remote aliases are cached, so shouldn't be looked up again.
+	if resErr := validateCanonicalAlias(context.Background(), rsAPI, fed, cfg, "!room:test", []byte(`{"alt_aliases":["#room:remote"]}`)); resErr != nil {
+		t.Fatalf("unexpected error: %v", resErr.JSON)
+	}
+	if fed.calls != 2 {
+		t.Fatalf("expected two federation lookups, got %d", fed.calls)
+	}
+}
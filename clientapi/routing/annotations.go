@@ -0,0 +1,68 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/jetstream"
+)
+
+// duplicateAnnotationCheckTimeout is how long to wait for the sync API to
+// say whether an annotation is a duplicate. The check is made on the send
+// path and the event is allowed through if it fails, so this is kept short.
+const duplicateAnnotationCheckTimeout = time.Second
+
+// checkDuplicateAnnotation rejects an m.annotation relation if the user has
+// already annotated the same event with the same event type and key. The
+// sync API holds the relations, so it is asked over NATS. If it can't be
+// reached, the event is allowed through rather than failing the send.
+func checkDuplicateAnnotation(
+	ctx context.Context, cfg *config.ClientAPI, natsClient *nats.Conn,
+	userID, roomID, eventType string, content map[string]interface{},
+) *util.JSONResponse {
+	relatesTo, ok := content["m.relates_to"].(map[string]interface{})
+	if !ok || natsClient == nil {
+		return nil
+	}
+	if relType, _ := relatesTo["rel_type"].(string); relType != "m.annotation" {
+		return nil
+	}
+	eventID, _ := relatesTo["event_id"].(string)
+	key, _ := relatesTo["key"].(string)
+	if eventID == "" || key == "" {
+		return nil
+	}
+
+	msg := nats.NewMsg(cfg.Matrix.JetStream.Prefixed(jetstream.RequestAnnotation))
+	msg.Header.Set(jetstream.RoomID, roomID)
+	msg.Header.Set(jetstream.EventID, eventID)
+	msg.Header.Set(jetstream.UserID, userID)
+	msg.Header.Set("type", eventType)
+	msg.Header.Set("key", key)
+
+	logger := util.GetLogger(ctx).WithField("event_id", eventID)
+	ctx, cancel := context.WithTimeout(ctx, duplicateAnnotationCheckTimeout)
+	defer cancel()
+	res, err := natsClient.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		logger.WithError(err).Warn("Unable to check for duplicate annotation")
+		return nil
+	}
+	if e := res.Header.Get("error"); e != "" {
+		logger.Warnf("Unable to check for duplicate annotation: %s", e)
+		return nil
+	}
+	if duplicate, _ := strconv.ParseBool(res.Header.Get("duplicate")); duplicate {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.DuplicateAnnotation("You have already sent this annotation"),
+		}
+	}
+	return nil
+}
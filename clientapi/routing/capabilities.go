@@ -35,14 +35,24 @@ func GetCapabilities(rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse
 		}
 	}
 
+	// Tell clients which room versions to use for rooms that need optional
+	// features, as per MSC3244.
+	roomCapabilities := map[version.Feature]version.FeatureSupport{}
+	for _, feature := range version.Features {
+		if support := version.FeatureSupportFor(rsAPI.DefaultRoomVersion(), feature); len(support.Support) > 0 {
+			roomCapabilities[feature] = support
+		}
+	}
+
 	response := map[string]interface{}{
 		"capabilities": map[string]interface{}{
 			"m.change_password": map[string]bool{
 				"enabled": true,
 			},
 			"m.room_versions": map[string]interface{}{
-				"default":   rsAPI.DefaultRoomVersion(),
-				"available": versionsMap,
+				"default":                              rsAPI.DefaultRoomVersion(),
+				"available":                            versionsMap,
+				"org.matrix.msc3244.room_capabilities": roomCapabilities,
 			},
 		},
 	}
@@ -28,6 +28,7 @@ import (
 	"github.com/neilalexander/harmony/userapi/api"
 
 	"github.com/neilalexander/harmony/clientapi/httputil"
+	"github.com/neilalexander/harmony/clientapi/spamcheck"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/neilalexander/harmony/setup/config"
@@ -111,6 +112,7 @@ func CreateRoom(
 	req *http.Request, device *api.Device,
 	cfg *config.ClientAPI,
 	profileAPI api.ClientUserAPI, rsAPI roomserverAPI.ClientRoomserverAPI,
+	spamChecker *spamcheck.Chain,
 ) util.JSONResponse {
 	var createRequest createRoomRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &createRequest)
@@ -120,6 +122,38 @@ func CreateRoom(
 	if resErr = createRequest.Validate(); resErr != nil {
 		return *resErr
 	}
+	if spamChecker.Enabled() {
+		content, err := json.Marshal(createRequest)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		modified, resErr := checkSpam(req.Context(), spamChecker, &spamcheck.Request{
+			Action:  spamcheck.ActionCreateRoom,
+			UserID:  device.UserID,
+			Content: content,
+		})
+		if resErr != nil {
+			return *resErr
+		}
+		if modified != nil {
+			createRequest = createRoomRequest{}
+			if err = json.Unmarshal(modified, &createRequest); err != nil {
+				return util.JSONResponse{
+					Code: http.StatusInternalServerError,
+					JSON: spec.InternalServerError{},
+				}
+			}
+			if resErr = createRequest.Validate(); resErr != nil {
+				return *resErr
+			}
+		}
+	}
+	if resErr = applyRoomCreationDefaults(&cfg.RoomCreation, &createRequest); resErr != nil {
+		return *resErr
+	}
 	evTime, err := httputil.ParseTSParam(req)
 	if err != nil {
 		return util.JSONResponse{
@@ -130,6 +164,163 @@ func CreateRoom(
 	return createRoom(req.Context(), createRequest, device, cfg, profileAPI, rsAPI, evTime)
 }
 
+// applyRoomCreationDefaults rejects rooms created with blocked presets and
+// applies the server's defaults for the preset to the request. They aren't
+// applied to the rooms which the server creates itself, like server notices.
+func applyRoomCreationDefaults(cfg *config.RoomCreation, r *createRoomRequest) *util.JSONResponse {
+	// Rooms created without a preset get one based on their visibility.
+	preset := r.Preset
+	if preset == "" {
+		preset = spec.PresetPrivateChat
+		if r.Visibility == spec.Public {
+			preset = spec.PresetPublicChat
+		}
+	}
+	if cfg.IsPresetBlocked(preset) {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden(fmt.Sprintf("Creating rooms with the %s preset is not allowed", preset)),
+		}
+	}
+
+	encrypt := cfg.EncryptionByDefault == config.EncryptionByDefaultAll ||
+		(cfg.EncryptionByDefault == config.EncryptionByDefaultInvite && preset != spec.PresetPublicChat)
+	if encrypt {
+		for _, ev := range r.InitialState {
+			if ev.Type == spec.MRoomEncryption {
+				encrypt = false
+				break
+			}
+		}
+	}
+	if encrypt {
+		r.InitialState = append(r.InitialState, gomatrixserverlib.FledglingEvent{
+			Type: spec.MRoomEncryption,
+			Content: map[string]interface{}{
+				"algorithm": "m.megolm.v1.aes-sha2",
+			},
+		})
+	}
+
+	if override, ok := cfg.PowerLevelOverrides[preset]; ok {
+		// Merge the client's override over ours, so that it takes precedence.
+		content, err := json.Marshal(override)
+		if err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		merged := map[string]interface{}{}
+		if err = json.Unmarshal(content, &merged); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if len(r.PowerLevelContentOverride) > 0 {
+			clientOverride := map[string]interface{}{}
+			if err = json.Unmarshal(r.PowerLevelContentOverride, &clientOverride); err != nil {
+				return &util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.BadJSON("malformed power_level_content_override"),
+				}
+			}
+			mergePowerLevelContent(merged, clientOverride)
+		}
+		if r.PowerLevelContentOverride, err = json.Marshal(merged); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
+	return nil
+}
+
+// mergePowerLevelContent merges the override into the power level content.
+// Nested objects, like "users" and "events", are merged key by key rather
+// than replaced, so that an override for one event type doesn't drop the
+// levels set for the others.
+func mergePowerLevelContent(content, override map[string]interface{}) {
+	for key, value := range override {
+		overrideObject, ok := value.(map[string]interface{})
+		if !ok {
+			content[key] = value
+			continue
+		}
+		contentObject, ok := content[key].(map[string]interface{})
+		if !ok {
+			content[key] = value
+			continue
+		}
+		mergePowerLevelContent(contentObject, overrideObject)
+	}
+}
+
+// selectRoomVersion returns the room version to create the room with. This
+// is the requested one if there is one, or otherwise the default one, unless
+// the requested join rule needs a feature which the default doesn't support,
+// in which case it is the preferred room version for that feature.
+func selectRoomVersion(r *createRoomRequest, defaultVersion gomatrixserverlib.RoomVersion) (gomatrixserverlib.RoomVersion, *util.JSONResponse) {
+	if r.RoomVersion != "" {
+		if _, err := roomserverVersion.SupportedRoomVersion(r.RoomVersion); err != nil {
+			supported := make([]string, 0, len(roomserverVersion.SupportedRoomVersions()))
+			for _, v := range roomserverVersion.SortedSupportedRoomVersions() {
+				supported = append(supported, string(v))
+			}
+			return "", &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.UnsupportedRoomVersion(fmt.Sprintf("%s, supported room versions are: %s", err, strings.Join(supported, ", "))),
+			}
+		}
+	}
+
+	var joinRule gomatrixserverlib.JoinRuleContent
+	for _, ev := range r.InitialState {
+		if ev.Type != spec.MRoomJoinRules || ev.StateKey != "" {
+			continue
+		}
+		content, err := json.Marshal(ev.Content)
+		if err == nil {
+			err = json.Unmarshal(content, &joinRule)
+		}
+		if err != nil {
+			return "", &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("malformed m.room.join_rules in initial_state"),
+			}
+		}
+	}
+	features := roomserverVersion.JoinRuleFeatures(joinRule.JoinRule)
+
+	roomVersion := r.RoomVersion
+	if roomVersion == "" {
+		roomVersion = defaultVersion
+	}
+	verImpl, err := roomserverVersion.SupportedRoomVersion(roomVersion)
+	if err != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.UnsupportedRoomVersion(err.Error()),
+		}
+	}
+	for _, feature := range features {
+		if roomserverVersion.SupportsFeature(verImpl, feature) {
+			continue
+		}
+		support := roomserverVersion.FeatureSupportFor(defaultVersion, features...)
+		if r.RoomVersion == "" && support.Preferred != "" {
+			return support.Preferred, nil
+		}
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.UnsupportedRoomVersion(fmt.Sprintf("room version %q does not support the %q join rule", roomVersion, joinRule.JoinRule)),
+		}
+	}
+	return roomVersion, nil
+}
+
 // createRoom implements /createRoom
 func createRoom(
 	ctx context.Context,
@@ -168,22 +359,14 @@ func createRoom(
 
 	// Clobber keys: creator, room_version
 
-	roomVersion := rsAPI.DefaultRoomVersion()
-	if createRequest.RoomVersion != "" {
-		candidateVersion := gomatrixserverlib.RoomVersion(createRequest.RoomVersion)
-		_, roomVersionError := roomserverVersion.SupportedRoomVersion(candidateVersion)
-		if roomVersionError != nil {
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: spec.UnsupportedRoomVersion(roomVersionError.Error()),
-			}
-		}
-		roomVersion = candidateVersion
+	roomVersion, resErr := selectRoomVersion(&createRequest, rsAPI.DefaultRoomVersion())
+	if resErr != nil {
+		return *resErr
 	}
 
 	logger.WithFields(log.Fields{
-		"userID":      userID.String(),
-		"roomID":      roomID.String(),
+		"user_id":     userID.String(),
+		"room_id":     roomID.String(),
 		"roomVersion": roomVersion,
 	}).Info("Creating new room")
 
@@ -199,8 +382,7 @@ func createRoom(
 	userDisplayName := profile.DisplayName
 	userAvatarURL := profile.AvatarURL
 
-	keyID := cfg.Matrix.KeyID
-	privateKey := cfg.Matrix.PrivateKey
+	keyID, privateKey := cfg.Matrix.SigningKey()
 
 	req := roomserverAPI.PerformCreateRoomRequest{
 		InvitedUsers:              createRequest.Invite,
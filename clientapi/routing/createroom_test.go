@@ -0,0 +1,113 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func TestApplyRoomCreationDefaults(t *testing.T) {
+	fifty, hundred := int64(50), int64(100)
+	cfg := &config.RoomCreation{
+		EncryptionByDefault: config.EncryptionByDefaultInvite,
+		PowerLevelOverrides: map[string]config.PowerLevelOverride{
+			spec.PresetPublicChat: {
+				Invite: &fifty,
+				Kick:   &hundred,
+				Events: map[string]int64{"m.room.name": 50, "m.room.topic": 50},
+			},
+		},
+		BlockedPresets: []string{spec.PresetTrustedPrivateChat},
+	}
+
+	if resErr := applyRoomCreationDefaults(cfg, &createRoomRequest{Preset: spec.PresetTrustedPrivateChat}); resErr == nil || resErr.Code != http.StatusForbidden {
+		t.Fatalf("expected blocked preset to be forbidden, got %+v", resErr)
+	}
+
+	// Private rooms are encrypted, unless the client already set it up.
+	private := createRoomRequest{}
+	if resErr := applyRoomCreationDefaults(cfg, &private); resErr != nil {
+		t.Fatalf("unexpected error %+v", resErr)
+	}
+	if len(private.InitialState) != 1 || private.InitialState[0].Type != spec.MRoomEncryption {
+		t.Fatalf("expected private room to be encrypted, got %+v", private.InitialState)
+	}
+	private = createRoomRequest{
+		InitialState: []gomatrixserverlib.FledglingEvent{{Type: spec.MRoomEncryption}},
+	}
+	if resErr := applyRoomCreationDefaults(cfg, &private); resErr != nil || len(private.InitialState) != 1 {
+		t.Fatalf("expected the client's encryption to be kept, got %+v, %+v", private.InitialState, resErr)
+	}
+
+	// Public rooms aren't encrypted, and take the power level overrides with
+	// the client's taking precedence.
+	public := createRoomRequest{
+		Visibility:                spec.Public,
+		PowerLevelContentOverride: json.RawMessage(`{"kick":75,"events":{"m.room.topic":75},"users":{"@bob:test":50}}`),
+	}
+	if resErr := applyRoomCreationDefaults(cfg, &public); resErr != nil {
+		t.Fatalf("unexpected error %+v", resErr)
+	}
+	if len(public.InitialState) != 0 {
+		t.Fatalf("expected public room not to be encrypted, got %+v", public.InitialState)
+	}
+	var powerLevels gomatrixserverlib.PowerLevelContent
+	if err := json.Unmarshal(public.PowerLevelContentOverride, &powerLevels); err != nil {
+		t.Fatal(err)
+	}
+	if powerLevels.Invite != 50 || powerLevels.Kick != 75 {
+		t.Fatalf("unexpected power levels %+v", powerLevels)
+	}
+	// The client's events are merged with ours rather than replacing them.
+	if powerLevels.Events["m.room.name"] != 50 || powerLevels.Events["m.room.topic"] != 75 || powerLevels.Users["@bob:test"] != 50 {
+		t.Fatalf("unexpected power levels for events and users %+v", powerLevels)
+	}
+
+	public.PowerLevelContentOverride = json.RawMessage(`[]`)
+	if resErr := applyRoomCreationDefaults(cfg, &public); resErr == nil || resErr.Code != http.StatusBadRequest {
+		t.Fatalf("expected malformed override to be rejected, got %+v", resErr)
+	}
+}
+
+func TestSelectRoomVersion(t *testing.T) {
+	joinRule := func(rule string) []gomatrixserverlib.FledglingEvent {
+		return []gomatrixserverlib.FledglingEvent{{
+			Type:    spec.MRoomJoinRules,
+			Content: map[string]interface{}{"join_rule": rule},
+		}}
+	}
+	for _, tc := range []struct {
+		name        string
+		request     createRoomRequest
+		defaultVer  gomatrixserverlib.RoomVersion
+		wantVersion gomatrixserverlib.RoomVersion
+		wantCode    int
+	}{
+		{name: "default", defaultVer: gomatrixserverlib.RoomVersionV10, wantVersion: gomatrixserverlib.RoomVersionV10},
+		{name: "requested", request: createRoomRequest{RoomVersion: gomatrixserverlib.RoomVersionV6}, defaultVer: gomatrixserverlib.RoomVersionV10, wantVersion: gomatrixserverlib.RoomVersionV6},
+		{name: "unknown", request: createRoomRequest{RoomVersion: "nope"}, defaultVer: gomatrixserverlib.RoomVersionV10, wantCode: http.StatusBadRequest},
+		{name: "default supports join rule", request: createRoomRequest{InitialState: joinRule(spec.Knock)}, defaultVer: gomatrixserverlib.RoomVersionV10, wantVersion: gomatrixserverlib.RoomVersionV10},
+		{name: "default lacks join rule", request: createRoomRequest{InitialState: joinRule(spec.Restricted)}, defaultVer: gomatrixserverlib.RoomVersionV6, wantVersion: gomatrixserverlib.RoomVersionV11},
+		{name: "requested lacks join rule", request: createRoomRequest{RoomVersion: gomatrixserverlib.RoomVersionV7, InitialState: joinRule(spec.Restricted)}, defaultVer: gomatrixserverlib.RoomVersionV10, wantCode: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			roomVersion, resErr := selectRoomVersion(&tc.request, tc.defaultVer)
+			if tc.wantCode != 0 {
+				if resErr == nil || resErr.Code != tc.wantCode {
+					t.Fatalf("expected HTTP %d, got %+v", tc.wantCode, resErr)
+				}
+				return
+			}
+			if resErr != nil {
+				t.Fatalf("unexpected error %+v", resErr)
+			}
+			if roomVersion != tc.wantVersion {
+				t.Fatalf("expected room version %q, got %q", tc.wantVersion, roomVersion)
+			}
+		})
+	}
+}
@@ -1,13 +1,16 @@
 package routing
 
 import (
+	"context"
 	"io"
 	"net/http"
 
 	"github.com/neilalexander/harmony/clientapi/auth"
+	"github.com/neilalexander/harmony/clientapi/threepid"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
+	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/userapi/api"
 )
 
@@ -17,6 +20,8 @@ func Deactivate(
 	userInteractiveAuth *auth.UserInteractive,
 	accountAPI api.ClientUserAPI,
 	deviceAPI *api.Device,
+	cfg *config.ClientAPI,
+	identity *threepid.IdentityClient,
 ) util.JSONResponse {
 	ctx := req.Context()
 	defer req.Body.Close() // nolint:errcheck
@@ -33,9 +38,30 @@ func Deactivate(
 		return *errRes
 	}
 
-	localpart, serverName, err := gomatrixserverlib.SplitID('@', login.Username())
+	return deactivateAccount(ctx, accountAPI, cfg, identity, login.Username())
+}
+
+// deactivateAccount deactivates the account and then removes the user's
+// third-party identifiers from the identity servers they were bound to
+// through us. The account is deactivated first so that a failing identity
+// server can't leave it active, and any failures to unbind are reported
+// in the result instead.
+func deactivateAccount(
+	ctx context.Context, accountAPI api.ClientUserAPI, cfg *config.ClientAPI,
+	identity *threepid.IdentityClient, userID string,
+) util.JSONResponse {
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	bindings, err := accountAPI.QueryThreePIDBindings(ctx, userID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountAPI.QueryThreePIDBindings failed")
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
 			JSON: spec.InternalServerError{},
@@ -55,8 +81,18 @@ func Deactivate(
 		}
 	}
 
+	// Each binding is unbound on its own, so that one which can't be unbound
+	// doesn't stop the rest from being unbound.
+	unbindResult := "success"
+	for i := range bindings {
+		result, resErr := unbindThreePIDs(ctx, accountAPI, cfg, identity, userID, bindings[i:i+1])
+		if resErr != nil || result != "success" {
+			unbindResult = "no-support"
+		}
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: threePIDUnbindResponse{IDServerUnbindResult: unbindResult},
 	}
 }
@@ -0,0 +1,35 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+func TestDeactivateAccount(t *testing.T) {
+	userAPI := &threePIDBindingUserAPI{}
+	cfg, identity, idServer := newThreePIDIdentityServer(t, userAPI)
+	userAPI.bindings = []userapi.ThreePIDBinding{
+		{Medium: "email", Address: "untrusted@example.com", IDServer: "untrusted.example.com"},
+		{Medium: "email", Address: "alice@example.com", IDServer: idServer},
+	}
+
+	// The account is deactivated before anything is unbound, and a binding
+	// which can't be unbound doesn't stop the others from being unbound.
+	res := deactivateAccount(context.Background(), userAPI, cfg, identity, "@alice:test")
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	if got := res.JSON.(threePIDUnbindResponse).IDServerUnbindResult; got != "no-support" {
+		t.Fatalf("got unbind result %q, want %q", got, "no-support")
+	}
+	want := []string{"deactivate alice", "unbind alice@example.com"}
+	if len(userAPI.calls) != len(want) || userAPI.calls[0] != want[0] || userAPI.calls[1] != want[1] {
+		t.Fatalf("got calls %v, want %v", userAPI.calls, want)
+	}
+	if len(userAPI.bindings) != 1 || userAPI.bindings[0].IDServer != "untrusted.example.com" {
+		t.Fatalf("expected only the untrusted binding to be left, got %+v", userAPI.bindings)
+	}
+}
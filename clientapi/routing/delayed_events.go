@@ -0,0 +1,460 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/neilalexander/harmony/clientapi/httputil"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/types"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+	"github.com/sirupsen/logrus"
+)
+
+// delayQueryParam is the query parameter which asks for an event to be
+// delayed, in milliseconds.
+const delayQueryParam = "org.matrix.msc4140.delay"
+
+// maxDelayedEventsPerUser stops a user from holding on to an unbounded
+// amount of memory and storage with delayed events.
+const maxDelayedEventsPerUser = 100
+
+// callMemberEventTypes are the MatrixRTC call membership state events, which
+// clients keep a delayed event pending for throughout a call.
+var callMemberEventTypes = map[string]bool{
+	"m.call.member":                  true,
+	"org.matrix.msc3401.call.member": true,
+}
+
+// DelayedEvents holds the events which clients have asked to be sent after a
+// delay, as described by MSC4140. Until then, the client can restart the
+// delay, cancel the event or send it early. Element Call uses this to leave
+// calls for clients which disconnect, by scheduling a call membership event
+// which removes them and restarting it every so often while still connected.
+// Delayed events are stored by the user API, so that they survive restarts,
+// and are deleted along with the device which scheduled them. The timers are
+// kept in memory, and the stored event is checked for before sending.
+type DelayedEvents struct {
+	rsAPI    api.ClientRoomserverAPI
+	userAPI  userapi.ClientUserAPI
+	maxDelay time.Duration
+	mu       sync.Mutex
+	events   map[string]*delayedEvent // delay ID -> event
+}
+
+type delayedEvent struct {
+	DelayID      string                 `json:"delay_id"`
+	RoomID       string                 `json:"room_id"`
+	Type         string                 `json:"type"`
+	StateKey     *string                `json:"state_key,omitempty"`
+	Delay        int64                  `json:"delay"`
+	RunningSince spec.Timestamp         `json:"running_since"`
+	Content      map[string]interface{} `json:"content"`
+	userID       string
+	deviceID     string
+	timer        *time.Timer
+}
+
+// NewDelayedEvents creates a DelayedEvents which allows delays of up to
+// maxDelay, or none at all if maxDelay is 0.
+func NewDelayedEvents(rsAPI api.ClientRoomserverAPI, userAPI userapi.ClientUserAPI, maxDelay time.Duration) *DelayedEvents {
+	return &DelayedEvents{
+		rsAPI:    rsAPI,
+		userAPI:  userAPI,
+		maxDelay: maxDelay,
+		events:   map[string]*delayedEvent{},
+	}
+}
+
+// Enabled returns whether clients may delay events.
+func (d *DelayedEvents) Enabled() bool {
+	return d != nil && d.maxDelay > 0
+}
+
+// Load starts the timers for the delayed events which were stored before the
+// server last stopped. Events which are already overdue are sent straight
+// away.
+func (d *DelayedEvents) Load(ctx context.Context) error {
+	stored, err := d.userAPI.QueryDelayedEvents(ctx, "")
+	if err != nil {
+		return fmt.Errorf("d.userAPI.QueryDelayedEvents: %w", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range stored {
+		ev, err := newDelayedEventFromStored(&stored[i])
+		if err != nil {
+			logrus.WithError(err).WithField("delay_id", stored[i].DelayID).Error("Failed to load delayed event")
+			continue
+		}
+		due := ev.RunningSince.Time().Add(time.Duration(ev.Delay) * time.Millisecond)
+		ev.timer = time.AfterFunc(time.Until(due), func() { d.fire(ev) })
+		d.events[ev.DelayID] = ev
+	}
+	return nil
+}
+
+func newDelayedEventFromStored(stored *userapi.DelayedEvent) (*delayedEvent, error) {
+	ev := &delayedEvent{
+		DelayID:      stored.DelayID,
+		RoomID:       stored.RoomID,
+		Type:         stored.Type,
+		StateKey:     stored.StateKey,
+		Delay:        stored.Delay,
+		RunningSince: stored.RunningSince,
+		userID:       stored.UserID,
+		deviceID:     stored.DeviceID,
+	}
+	if err := json.Unmarshal(stored.Content, &ev.Content); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// parseDelay returns the delay the client asked for, or 0 if it didn't ask
+// for one.
+func (d *DelayedEvents) parseDelay(req *http.Request) (time.Duration, *util.JSONResponse) {
+	param := req.URL.Query().Get(delayQueryParam)
+	if param == "" || !d.Enabled() {
+		return 0, nil
+	}
+	ms, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(delayQueryParam + " must be a positive number of milliseconds"),
+		}
+	}
+	delay := time.Duration(ms) * time.Millisecond
+	if delay > d.maxDelay {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("The requested delay exceeds the allowed maximum of " + strconv.FormatInt(d.maxDelay.Milliseconds(), 10) + "ms"),
+		}
+	}
+	return delay, nil
+}
+
+// schedule sends the event after the delay, returning the delay ID which the
+// client uses to manage it. The event is checked now so that the client finds
+// out straight away if it could never be sent.
+func (d *DelayedEvents) schedule(
+	ctx context.Context, device *userapi.Device,
+	roomID, eventType string, stateKey *string, content map[string]interface{},
+	delay time.Duration,
+) util.JSONResponse {
+	if _, resErr := generateSendEvent(ctx, content, device, roomID, eventType, stateKey, d.rsAPI, time.Now()); resErr != nil {
+		return *resErr
+	}
+
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("json.Marshal failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	// The limit is checked and the event stored under the same lock so that
+	// concurrent requests can't take the user past it.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	count := 0
+	var retryAfter time.Duration
+	for _, ev := range d.events {
+		if ev.userID != device.UserID {
+			continue
+		}
+		due := time.Until(ev.RunningSince.Time().Add(time.Duration(ev.Delay) * time.Millisecond))
+		if count == 0 || due < retryAfter {
+			retryAfter = due
+		}
+		count++
+	}
+	if count >= maxDelayedEventsPerUser {
+		return util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: spec.LimitExceeded("Too many delayed events", max(retryAfter, 0).Milliseconds()),
+		}
+	}
+	ev := &delayedEvent{
+		DelayID:      util.RandomString(24),
+		RoomID:       roomID,
+		Type:         eventType,
+		StateKey:     stateKey,
+		Delay:        delay.Milliseconds(),
+		RunningSince: spec.AsTimestamp(time.Now()),
+		Content:      content,
+		userID:       device.UserID,
+		deviceID:     device.ID,
+	}
+	if err = d.userAPI.PerformSaveDelayedEvent(ctx, &userapi.DelayedEvent{
+		DelayID:      ev.DelayID,
+		UserID:       ev.userID,
+		DeviceID:     ev.deviceID,
+		RoomID:       ev.RoomID,
+		Type:         ev.Type,
+		StateKey:     ev.StateKey,
+		Content:      contentJSON,
+		Delay:        ev.Delay,
+		RunningSince: ev.RunningSince,
+	}); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("d.userAPI.PerformSaveDelayedEvent failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	ev.timer = time.AfterFunc(delay, func() { d.fire(ev) })
+	d.events[ev.DelayID] = ev
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			DelayID string `json:"delay_id"`
+		}{ev.DelayID},
+	}
+}
+
+// fire sends the delayed event once its delay has passed.
+func (d *DelayedEvents) fire(ev *delayedEvent) {
+	ctx := context.Background()
+	taken, err := d.take(ctx, ev.DelayID, ev.userID)
+	if err != nil {
+		logrus.WithError(err).WithField("delay_id", ev.DelayID).Error("Failed to remove delayed event")
+		return
+	}
+	if taken != nil {
+		d.send(ctx, taken)
+	}
+}
+
+// take removes the user's delayed event, returning nil if there is no such
+// event, it belongs to someone else, or the device which scheduled it has
+// since been deleted.
+func (d *DelayedEvents) take(ctx context.Context, delayID, userID string) (*delayedEvent, error) {
+	d.mu.Lock()
+	ev, ok := d.events[delayID]
+	if !ok || ev.userID != userID {
+		d.mu.Unlock()
+		return nil, nil
+	}
+	ev.timer.Stop()
+	delete(d.events, delayID)
+	d.mu.Unlock()
+
+	found, err := d.userAPI.PerformRemoveDelayedEvent(ctx, delayID)
+	if err != nil || !found {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// send sends the delayed event now, as the device which scheduled it.
+func (d *DelayedEvents) send(ctx context.Context, ev *delayedEvent) *util.JSONResponse {
+	mutex, _ := userRoomSendMutexes.LoadOrStore(ev.RoomID+ev.userID, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer mutex.(*sync.Mutex).Unlock()
+
+	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
+		"delay_id":  ev.DelayID,
+		"room_id":   ev.RoomID,
+		"user_id":   ev.userID,
+		"device_id": ev.deviceID,
+	})
+	var devicesRes userapi.QueryDevicesResponse
+	if err := d.userAPI.QueryDevices(ctx, &userapi.QueryDevicesRequest{UserID: ev.userID}, &devicesRes); err != nil {
+		logger.WithError(err).Error("d.userAPI.QueryDevices failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	var device *userapi.Device
+	for i := range devicesRes.Devices {
+		if devicesRes.Devices[i].ID == ev.deviceID {
+			device = &devicesRes.Devices[i]
+		}
+	}
+	if device == nil {
+		logger.Warn("Not sending delayed event as its device no longer exists")
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("No such delayed event"),
+		}
+	}
+
+	e, resErr := generateSendEvent(ctx, ev.Content, device, ev.RoomID, ev.Type, ev.StateKey, d.rsAPI, time.Now())
+	if resErr != nil {
+		logger.Warnf("Unable to send delayed event: %v", resErr.JSON)
+		return resErr
+	}
+	domain := device.UserDomain()
+	if err := api.SendEvents(
+		ctx, d.rsAPI, api.KindNew,
+		[]*types.HeaderedEvent{{PDU: e}},
+		domain, domain, domain, nil, false,
+	); err != nil {
+		logger.WithError(err).Error("SendEvents failed for delayed event")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	logger.WithField("event_id", e.EventID()).Info("Sent delayed event to roomserver")
+	if ev.StateKey != nil {
+		d.cancelOverwritten(ctx, ev.RoomID, ev.Type, *ev.StateKey, ev.userID)
+	}
+	return nil
+}
+
+// cancelOverwritten cancels other users' delayed state events which would
+// overwrite a state event which the sender has just sent, as they were
+// scheduled against the state which has now been replaced. The sender's own
+// delayed events are kept, as clients schedule them before sending the state
+// which they will replace.
+func (d *DelayedEvents) cancelOverwritten(ctx context.Context, roomID, eventType, stateKey, sender string) {
+	if d == nil {
+		return
+	}
+	var cancelled []string
+	d.mu.Lock()
+	for delayID, ev := range d.events {
+		if ev.RoomID == roomID && ev.Type == eventType && ev.StateKey != nil && *ev.StateKey == stateKey && ev.userID != sender {
+			ev.timer.Stop()
+			delete(d.events, delayID)
+			cancelled = append(cancelled, delayID)
+		}
+	}
+	d.mu.Unlock()
+	for _, delayID := range cancelled {
+		if _, err := d.userAPI.PerformRemoveDelayedEvent(ctx, delayID); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("delay_id", delayID).Error("Failed to remove overwritten delayed event")
+		}
+	}
+}
+
+// IsCallMembership returns whether the delayed event is a call membership
+// event, for which clients restart the delay every few seconds throughout a
+// call, so which shouldn't be rate limited.
+func (d *DelayedEvents) IsCallMembership(delayID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ev, ok := d.events[delayID]
+	return ok && callMemberEventTypes[ev.Type]
+}
+
+// GetDelayedEvents implements:
+//
+//	GET /unstable/org.matrix.msc4140/delayed_events
+func (d *DelayedEvents) GetDelayedEvents(req *http.Request, device *userapi.Device) util.JSONResponse {
+	stored, err := d.userAPI.QueryDelayedEvents(req.Context(), device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("d.userAPI.QueryDelayedEvents failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	events := make([]*delayedEvent, 0, len(stored))
+	for i := range stored {
+		ev, err := newDelayedEventFromStored(&stored[i])
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("delay_id", stored[i].DelayID).Error("Failed to load delayed event")
+			continue
+		}
+		events = append(events, ev)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			DelayedEvents []*delayedEvent `json:"delayed_events"`
+		}{events},
+	}
+}
+
+// UpdateDelayedEvent implements:
+//
+//	POST /unstable/org.matrix.msc4140/delayed_events/{delayID}
+func (d *DelayedEvents) UpdateDelayedEvent(req *http.Request, device *userapi.Device, delayID string) util.JSONResponse {
+	var body struct {
+		Action string `json:"action"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	switch body.Action {
+	case "cancel", "send", "restart":
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("action must be one of cancel, send or restart"),
+		}
+	}
+
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: spec.NotFound("No such delayed event"),
+	}
+	internalErr := util.JSONResponse{
+		Code: http.StatusInternalServerError,
+		JSON: spec.InternalServerError{},
+	}
+	if body.Action == "restart" {
+		d.mu.Lock()
+		ev, ok := d.events[delayID]
+		d.mu.Unlock()
+		if !ok || ev.userID != device.UserID {
+			return notFound
+		}
+		runningSince := spec.AsTimestamp(time.Now())
+		found, err := d.userAPI.PerformRestartDelayedEvent(req.Context(), delayID, runningSince)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("d.userAPI.PerformRestartDelayedEvent failed")
+			return internalErr
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if !found {
+			// The device which scheduled it has been deleted.
+			ev.timer.Stop()
+			delete(d.events, delayID)
+			return notFound
+		}
+		if d.events[delayID] != ev || !ev.timer.Stop() {
+			return notFound
+		}
+		ev.RunningSince = runningSince
+		ev.timer.Reset(time.Duration(ev.Delay) * time.Millisecond)
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	ev, err := d.take(req.Context(), delayID, device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("d.userAPI.PerformRemoveDelayedEvent failed")
+		return internalErr
+	}
+	if ev == nil {
+		return notFound
+	}
+	if body.Action == "send" {
+		if resErr := d.send(req.Context(), ev); resErr != nil {
+			return *resErr
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
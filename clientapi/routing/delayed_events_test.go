@@ -0,0 +1,248 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+// delayedEventsUserAPI stores delayed events in memory, as the user API
+// would in the database.
+type delayedEventsUserAPI struct {
+	userapi.ClientUserAPI
+	mu     sync.Mutex
+	stored map[string]userapi.DelayedEvent
+}
+
+func newDelayedEventsUserAPI() *delayedEventsUserAPI {
+	return &delayedEventsUserAPI{stored: map[string]userapi.DelayedEvent{}}
+}
+
+func (u *delayedEventsUserAPI) PerformSaveDelayedEvent(ctx context.Context, ev *userapi.DelayedEvent) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.stored[ev.DelayID] = *ev
+	return nil
+}
+
+func (u *delayedEventsUserAPI) PerformRestartDelayedEvent(ctx context.Context, delayID string, runningSince spec.Timestamp) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ev, ok := u.stored[delayID]
+	if ok {
+		ev.RunningSince = runningSince
+		u.stored[delayID] = ev
+	}
+	return ok, nil
+}
+
+func (u *delayedEventsUserAPI) PerformRemoveDelayedEvent(ctx context.Context, delayID string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, ok := u.stored[delayID]
+	delete(u.stored, delayID)
+	return ok, nil
+}
+
+func (u *delayedEventsUserAPI) QueryDelayedEvents(ctx context.Context, userID string) ([]userapi.DelayedEvent, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var events []userapi.DelayedEvent
+	for _, ev := range u.stored {
+		if userID == "" || ev.UserID == userID {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+// deleteDevice removes the delayed events of the device, as the user API
+// does when a device is deleted.
+func (u *delayedEventsUserAPI) deleteDevice(userID, deviceID string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for delayID, ev := range u.stored {
+		if ev.UserID == userID && ev.DeviceID == deviceID {
+			delete(u.stored, delayID)
+		}
+	}
+}
+
+func TestParseDelay(t *testing.T) {
+	d := NewDelayedEvents(nil, newDelayedEventsUserAPI(), time.Minute)
+	tests := []struct {
+		query   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{query: "", want: 0},
+		{query: delayQueryParam + "=1500", want: 1500 * time.Millisecond},
+		{query: delayQueryParam + "=0", wantErr: true},
+		{query: delayQueryParam + "=abc", wantErr: true},
+		{query: delayQueryParam + "=60001", wantErr: true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, "/rooms/!r:test/state/m.call.member/k?"+tt.query, nil)
+		got, resErr := d.parseDelay(req)
+		if (resErr != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v, got %v", tt.query, tt.wantErr, resErr)
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected delay %s, got %s", tt.query, tt.want, got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/send?"+delayQueryParam+"=1000", nil)
+	if got, resErr := NewDelayedEvents(nil, newDelayedEventsUserAPI(), 0).parseDelay(req); got != 0 || resErr != nil {
+		t.Errorf("expected delay to be ignored when disabled, got %s, %v", got, resErr)
+	}
+}
+
+func addTestDelayedEvent(d *DelayedEvents, delayID, userID, stateKey string) *delayedEvent {
+	ev := &delayedEvent{
+		DelayID:  delayID,
+		RoomID:   "!room:test",
+		Type:     "org.matrix.msc3401.call.member",
+		StateKey: &stateKey,
+		Delay:    time.Hour.Milliseconds(),
+		userID:   userID,
+		deviceID: "DEVICE",
+		timer:    time.NewTimer(time.Hour),
+	}
+	d.events[delayID] = ev
+	_ = d.userAPI.PerformSaveDelayedEvent(context.Background(), &userapi.DelayedEvent{
+		DelayID:  delayID,
+		UserID:   userID,
+		DeviceID: ev.deviceID,
+		RoomID:   ev.RoomID,
+		Type:     ev.Type,
+		StateKey: ev.StateKey,
+		Content:  []byte("{}"),
+		Delay:    ev.Delay,
+	})
+	return ev
+}
+
+func TestUpdateDelayedEvent(t *testing.T) {
+	userAPI := newDelayedEventsUserAPI()
+	d := NewDelayedEvents(nil, userAPI, time.Hour)
+	alice := &userapi.Device{UserID: "@alice:test"}
+	addTestDelayedEvent(d, "a", alice.UserID, "_@alice:test_DEVICE")
+
+	update := func(device *userapi.Device, delayID, action string) int {
+		req := httptest.NewRequest(http.MethodPost, "/delayed_events/"+delayID, strings.NewReader(`{"action":"`+action+`"}`))
+		return d.UpdateDelayedEvent(req, device, delayID).Code
+	}
+	if code := update(alice, "a", "explode"); code != http.StatusBadRequest {
+		t.Errorf("expected an unknown action to be rejected, got %d", code)
+	}
+	if code := update(&userapi.Device{UserID: "@bob:test"}, "a", "cancel"); code != http.StatusNotFound {
+		t.Errorf("expected another user's delayed event to be hidden, got %d", code)
+	}
+	if code := update(alice, "a", "restart"); code != http.StatusOK {
+		t.Errorf("expected restart to succeed, got %d", code)
+	}
+	if !d.IsCallMembership("a") {
+		t.Errorf("expected the delayed event to be a call membership")
+	}
+	if code := update(alice, "a", "cancel"); code != http.StatusOK {
+		t.Errorf("expected cancel to succeed, got %d", code)
+	}
+	if code := update(alice, "a", "restart"); code != http.StatusNotFound {
+		t.Errorf("expected a cancelled delayed event to be gone, got %d", code)
+	}
+	if len(userAPI.stored) != 0 {
+		t.Errorf("expected the cancelled delayed event to be removed from storage")
+	}
+}
+
+func TestDelayedEventDeviceDeleted(t *testing.T) {
+	userAPI := newDelayedEventsUserAPI()
+	d := NewDelayedEvents(nil, userAPI, time.Hour)
+	alice := &userapi.Device{UserID: "@alice:test", ID: "DEVICE"}
+	addTestDelayedEvent(d, "send", alice.UserID, "send")
+	addTestDelayedEvent(d, "restart", alice.UserID, "restart")
+	userAPI.deleteDevice(alice.UserID, alice.ID)
+
+	// The events can no longer be sent or restarted once their device has
+	// been deleted, even though their timers were still running.
+	update := func(delayID, action string) int {
+		req := httptest.NewRequest(http.MethodPost, "/delayed_events/"+delayID, strings.NewReader(`{"action":"`+action+`"}`))
+		return d.UpdateDelayedEvent(req, alice, delayID).Code
+	}
+	if code := update("send", "send"); code != http.StatusNotFound {
+		t.Errorf("expected sending to fail, got %d", code)
+	}
+	if code := update("restart", "restart"); code != http.StatusNotFound {
+		t.Errorf("expected restarting to fail, got %d", code)
+	}
+	if len(d.events) != 0 {
+		t.Errorf("expected the delayed events to be dropped, got %d", len(d.events))
+	}
+}
+
+func TestLoadDelayedEvents(t *testing.T) {
+	userAPI := newDelayedEventsUserAPI()
+	stateKey := "key"
+	_ = userAPI.PerformSaveDelayedEvent(context.Background(), &userapi.DelayedEvent{
+		DelayID:      "a",
+		UserID:       "@alice:test",
+		DeviceID:     "DEVICE",
+		RoomID:       "!room:test",
+		Type:         "org.matrix.msc3401.call.member",
+		StateKey:     &stateKey,
+		Content:      []byte(`{"foo":"bar"}`),
+		Delay:        time.Hour.Milliseconds(),
+		RunningSince: spec.AsTimestamp(time.Now()),
+	})
+
+	d := NewDelayedEvents(nil, userAPI, time.Hour)
+	if err := d.Load(context.Background()); err != nil {
+		t.Fatalf("failed to load delayed events: %s", err)
+	}
+	ev, ok := d.events["a"]
+	if !ok {
+		t.Fatalf("expected the stored delayed event to be loaded")
+	}
+	defer ev.timer.Stop()
+	if ev.userID != "@alice:test" || ev.deviceID != "DEVICE" || ev.Content["foo"] != "bar" {
+		t.Errorf("loaded delayed event doesn't match what was stored: %+v", ev)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/delayed_events", nil)
+	res := d.GetDelayedEvents(req, &userapi.Device{UserID: "@alice:test"})
+	if events := res.JSON.(struct {
+		DelayedEvents []*delayedEvent `json:"delayed_events"`
+	}).DelayedEvents; len(events) != 1 || events[0].DelayID != "a" {
+		t.Errorf("expected the stored delayed event to be listed, got %+v", events)
+	}
+}
+
+func TestCancelOverwritten(t *testing.T) {
+	userAPI := newDelayedEventsUserAPI()
+	d := NewDelayedEvents(nil, userAPI, time.Hour)
+	addTestDelayedEvent(d, "alice", "@alice:test", "key")
+	addTestDelayedEvent(d, "bob", "@bob:test", "key")
+	addTestDelayedEvent(d, "other", "@bob:test", "other")
+
+	d.cancelOverwritten(context.Background(), "!room:test", "org.matrix.msc3401.call.member", "key", "@alice:test")
+	if _, ok := d.events["alice"]; !ok {
+		t.Errorf("expected the sender's own delayed event to be kept")
+	}
+	if _, ok := d.events["bob"]; ok {
+		t.Errorf("expected another user's delayed event for the same state to be cancelled")
+	}
+	if _, ok := d.events["other"]; !ok {
+		t.Errorf("expected a delayed event for other state to be kept")
+	}
+	if _, ok := userAPI.stored["bob"]; ok {
+		t.Errorf("expected the cancelled delayed event to be removed from storage")
+	}
+}
@@ -15,9 +15,13 @@
 package routing
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -30,6 +34,89 @@ import (
 	userapi "github.com/neilalexander/harmony/userapi/api"
 )
 
+// remoteAliases caches the rooms which aliases on remote servers point to, so
+// that repeatedly resolving a popular alias doesn't result in a federation
+// request each time.
+var remoteAliases = remoteAliasCache{
+	entries: map[string]remoteAliasEntry{},
+}
+
+type remoteAliasCache struct {
+	mu      sync.Mutex
+	entries map[string]remoteAliasEntry
+}
+
+type remoteAliasEntry struct {
+	response fclient.RespDirectory
+	expires  time.Time
+}
+
+func (c *remoteAliasCache) get(alias string) (fclient.RespDirectory, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[alias]
+	if !ok || time.Now().After(entry.expires) {
+		return fclient.RespDirectory{}, false
+	}
+	return entry.response, true
+}
+
+func (c *remoteAliasCache) set(alias string, res fclient.RespDirectory, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[alias] = remoteAliasEntry{
+		response: res,
+		expires:  now.Add(ttl),
+	}
+}
+
+// lookupRemoteAlias asks the server which the alias belongs to which room it
+// points to, unless we already asked recently.
+func lookupRemoteAlias(
+	ctx context.Context, federation fclient.FederationClient, cfg *config.ClientAPI,
+	domain spec.ServerName, roomAlias string,
+) (fclient.RespDirectory, error) {
+	if res, ok := remoteAliases.get(roomAlias); ok {
+		return res, nil
+	}
+	res, err := federation.LookupRoomAlias(ctx, cfg.Matrix.ServerName, domain, roomAlias)
+	if err != nil {
+		return res, err
+	}
+	if res.RoomID != "" {
+		remoteAliases.set(roomAlias, res, cfg.RemoteAliasCacheDuration)
+	}
+	return res, nil
+}
+
+// resolveRoomAlias returns the room which the alias points to, or an empty
+// string if the alias doesn't exist.
+func resolveRoomAlias(
+	ctx context.Context, rsAPI roomserverAPI.ClientRoomserverAPI, federation fclient.FederationClient,
+	cfg *config.ClientAPI, roomAlias string,
+) (string, error) {
+	_, domain, err := gomatrixserverlib.SplitID('#', roomAlias)
+	if err != nil {
+		return "", err
+	}
+	if !cfg.Matrix.IsLocalServerName(domain) {
+		res, err := lookupRemoteAlias(ctx, federation, cfg, domain, roomAlias)
+		return res.RoomID, err
+	}
+	queryRes := &roomserverAPI.GetRoomIDForAliasResponse{}
+	err = rsAPI.GetRoomIDForAlias(ctx, &roomserverAPI.GetRoomIDForAliasRequest{
+		Alias:              roomAlias,
+		IncludeAppservices: true,
+	}, queryRes)
+	return queryRes.RoomID, err
+}
+
 type roomDirectoryResponse struct {
 	RoomID  string   `json:"room_id"`
 	Servers []string `json:"servers"`
@@ -81,7 +168,7 @@ func DirectoryRoom(
 		// If we don't know it locally, do a federation query.
 		// But don't send the query to ourselves.
 		if !cfg.Matrix.IsLocalServerName(domain) {
-			fedRes, fedErr := federation.LookupRoomAlias(req.Context(), cfg.Matrix.ServerName, domain, roomAlias)
+			fedRes, fedErr := lookupRemoteAlias(req.Context(), federation, cfg, domain, roomAlias)
 			if fedErr != nil {
 				// TODO: Return 502 if the remote server errored.
 				// TODO: Return 504 if the remote server timed out.
@@ -162,25 +249,17 @@ func SetLocalAlias(
 
 	userID, err := spec.NewUserID(device.UserID, true)
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("internal server error"),
-		}
+		util.GetLogger(req.Context()).WithError(err).Error("device UserID is invalid")
+		return clienterror.Internal().JSONResponse()
 	}
 
 	senderID, err := rsAPI.QuerySenderIDForUser(req.Context(), *roomID, *userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("QuerySenderIDForUser failed")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("internal server error"),
-		}
+		return clienterror.Internal().JSONResponse()
 	} else if senderID == nil {
-		util.GetLogger(req.Context()).WithField("roomID", *roomID).WithField("userID", *userID).Error("Sender ID not found")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("internal server error"),
-		}
+		util.GetLogger(req.Context()).WithField("room_id", *roomID).WithField("user_id", *userID).Error("Sender ID not found")
+		return clienterror.Internal().JSONResponse()
 	}
 
 	aliasAlreadyExists, err := rsAPI.SetRoomAlias(req.Context(), *senderID, *roomID, alias)
@@ -193,10 +272,7 @@ func SetLocalAlias(
 	}
 
 	if aliasAlreadyExists {
-		return util.JSONResponse{
-			Code: http.StatusConflict,
-			JSON: spec.Unknown("The alias " + alias + " already exists."),
-		}
+		return clienterror.Conflict("The alias " + alias + " already exists.").JSONResponse()
 	}
 
 	return util.JSONResponse{
@@ -238,6 +314,26 @@ func RemoveLocalAlias(
 		}
 	}
 
+	// Server administrators may remove any local alias, for example to take
+	// over an alias which is being used by a spam room.
+	if device.AccountType == userapi.AccountTypeAdmin {
+		aliasFound, err := rsAPI.PerformAdminRemoveRoomAlias(req.Context(), alias)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.PerformAdminRemoveRoomAlias failed")
+			return clienterror.Internal().JSONResponse()
+		}
+		if !aliasFound {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound("The alias does not exist."),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
 	// This seems like the kind of auth check that should be done in the roomserver, but
 	// if this check fails (user is not in the room), then there will be no SenderID for the user
 	// for pseudo-ID rooms - it will just return "". However, we can't use lack of a sender ID
@@ -250,10 +346,7 @@ func RemoveLocalAlias(
 	}, &queryResp)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("roomserverAPI.QueryMembershipForUser failed")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("internal server error"),
-		}
+		return clienterror.Internal().JSONResponse()
 	}
 	if !queryResp.IsInRoom {
 		return util.JSONResponse{
@@ -271,19 +364,14 @@ func RemoveLocalAlias(
 	}
 	// TODO: how to handle this case? missing user/room keys seem to be a whole new class of errors
 	if deviceSenderID == nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("internal server error"),
-		}
+		util.GetLogger(req.Context()).WithField("room_id", *validRoomID).WithField("user_id", *userID).Error("Sender ID not found")
+		return clienterror.Internal().JSONResponse()
 	}
 
 	aliasFound, aliasRemoved, err := rsAPI.RemoveRoomAlias(req.Context(), *deviceSenderID, alias)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.RemoveRoomAlias failed")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("internal server error"),
-		}
+		return clienterror.Internal().JSONResponse()
 	}
 
 	if !aliasFound {
@@ -362,12 +450,16 @@ func SetVisibility(
 		}
 	}
 	senderID, err := rsAPI.QuerySenderIDForUser(req.Context(), *validRoomID, *deviceUserID)
-	if err != nil || senderID == nil {
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("QuerySenderIDForUser failed")
 		return util.JSONResponse{
-			Code: http.StatusBadRequest,
+			Code: http.StatusInternalServerError,
 			JSON: spec.Unknown("failed to find senderID for this user"),
 		}
 	}
+	if senderID == nil {
+		return clienterror.Forbidden("failed to find senderID for this user").JSONResponse()
+	}
 
 	resErr := checkMemberInRoom(req.Context(), rsAPI, *deviceUserID, roomID)
 	if resErr != nil {
@@ -404,11 +496,23 @@ func SetVisibility(
 	if reqErr := httputil.UnmarshalJSONRequest(req, &v); reqErr != nil {
 		return *reqErr
 	}
+	if v.Visibility != spec.Public && v.Visibility != "private" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("visibility must be either public or private"),
+		}
+	}
 
 	if err = rsAPI.PerformPublish(req.Context(), &roomserverAPI.PerformPublishRequest{
 		RoomID:     roomID,
 		Visibility: v.Visibility,
 	}); err != nil {
+		if e, ok := err.(roomserverAPI.ErrNotAllowed); ok {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden(e.Error()),
+			}
+		}
 		util.GetLogger(req.Context()).WithError(err).Error("failed to publish room")
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -448,6 +552,12 @@ func SetVisibilityAS(
 		NetworkID:    networkID,
 		AppserviceID: dev.AppserviceID,
 	}); err != nil {
+		if e, ok := err.(roomserverAPI.ErrNotAllowed); ok {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden(e.Error()),
+			}
+		}
 		util.GetLogger(req.Context()).WithError(err).Error("failed to publish room")
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -16,12 +16,14 @@ package routing
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -38,6 +40,81 @@ var (
 	publicRoomsCache []fclient.PublicRoom
 )
 
+// maxIncludedRemoteRooms is how many rooms are listed from each of the remote
+// servers whose directories are included in ours.
+const maxIncludedRemoteRooms = 500
+
+// remoteDirectoryTimeout is how long to wait for a remote server's directory.
+const remoteDirectoryTimeout = time.Second * 10
+
+// remoteDirectories caches the responses from the directories of remote
+// servers, so that browsing or paging through a busy server's directory
+// doesn't result in a federation request each time.
+var remoteDirectories = remoteDirectoryCache{
+	entries: map[string]remoteDirectoryEntry{},
+}
+
+type remoteDirectoryCache struct {
+	mu      sync.Mutex
+	entries map[string]remoteDirectoryEntry
+}
+
+type remoteDirectoryEntry struct {
+	response fclient.RespPublicRooms
+	expires  time.Time
+}
+
+// get returns the cached response, if any, and whether it is still fresh.
+func (c *remoteDirectoryCache) get(key string) (res fclient.RespPublicRooms, fresh, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	return entry.response, ok && time.Now().Before(entry.expires), ok
+}
+
+func (c *remoteDirectoryCache) set(key string, res fclient.RespPublicRooms, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		// Stale entries are kept for a while in case the server goes away.
+		if now.Sub(entry.expires) > ttl {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = remoteDirectoryEntry{response: res, expires: now.Add(ttl)}
+}
+
+// getRemotePublicRooms returns the public rooms of a remote server, from the
+// cache if they were fetched recently enough. The cached response is returned
+// if the server can't be reached.
+func getRemotePublicRooms(
+	ctx context.Context, federation fclient.FederationClient, cfg *config.ClientAPI,
+	serverName spec.ServerName, limit int, since, searchTerm string,
+	includeAllNetworks bool, networkID string,
+) (fclient.RespPublicRooms, error) {
+	key := fmt.Sprintf("%s|%d|%s|%s|%t|%s", serverName, limit, since, searchTerm, includeAllNetworks, networkID)
+	cached, fresh, ok := remoteDirectories.get(key)
+	if fresh {
+		return cached, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, remoteDirectoryTimeout)
+	defer cancel()
+	res, err := federation.GetPublicRoomsFiltered(
+		ctx, cfg.Matrix.ServerName, serverName,
+		limit, since, searchTerm, includeAllNetworks, networkID,
+	)
+	if err != nil {
+		if ok {
+			util.GetLogger(ctx).WithError(err).WithField("server_name", serverName).Warn("Failed to refresh public rooms, using cached copy")
+			return cached, nil
+		}
+		return res, err
+	}
+	remoteDirectories.set(key, res, cfg.PublicRooms.RemoteCacheDuration)
+	return res, nil
+}
+
 type PublicRoomReq struct {
 	Since              string `json:"since,omitempty"`
 	Limit              int64  `json:"limit,omitempty"`
@@ -73,11 +150,16 @@ func GetPostPublicRooms(
 
 	serverName := spec.ServerName(request.Server)
 	if serverName != "" && !cfg.Matrix.IsLocalServerName(serverName) {
-		res, err := federation.GetPublicRoomsFiltered(
-			req.Context(), cfg.Matrix.ServerName, serverName,
-			int(request.Limit), request.Since,
-			request.Filter.SearchTerms, false,
-			"",
+		if cfg.PublicRooms.IsExcluded(serverName) {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden("Browsing the public rooms of this server is not allowed"),
+			}
+		}
+		res, err := getRemotePublicRooms(
+			req.Context(), federation, cfg, serverName,
+			int(request.Limit), request.Since, request.Filter.SearchTerms,
+			request.IncludeAllNetworks, request.NetworkID,
 		)
 		if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("failed to get public rooms")
@@ -92,7 +174,7 @@ func GetPostPublicRooms(
 		}
 	}
 
-	response, err := publicRooms(req.Context(), request, rsAPI, extRoomsProvider)
+	response, err := publicRooms(req.Context(), request, rsAPI, extRoomsProvider, federation, cfg)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Errorf("failed to work out public rooms")
 		return util.JSONResponse{
@@ -108,6 +190,7 @@ func GetPostPublicRooms(
 
 func publicRooms(
 	ctx context.Context, request PublicRoomReq, rsAPI roomserverAPI.ClientRoomserverAPI, extRoomsProvider api.ExtraPublicRoomsProvider,
+	federation fclient.FederationClient, cfg *config.ClientAPI,
 ) (*fclient.RespPublicRooms, error) {
 
 	response := fclient.RespPublicRooms{
@@ -130,14 +213,21 @@ func publicRooms(
 
 	var rooms []fclient.PublicRoom
 	if request.Since == "" {
-		rooms = refreshPublicRoomCache(ctx, rsAPI, extRoomsProvider, request)
+		remoteRooms := includedRemoteRooms(ctx, federation, cfg)
+		rooms = refreshPublicRoomCache(ctx, rsAPI, extRoomsProvider, remoteRooms, request)
 	} else {
 		rooms = getPublicRoomsFromCache()
 	}
 
 	response.TotalRoomCountEstimate = len(rooms)
 
-	rooms = filterRooms(rooms, request.Filter.SearchTerms)
+	rooms = roomserverAPI.FilterPublicRooms(rooms, request.Filter.SearchTerms, func(roomID string) []string {
+		var aliasRes roomserverAPI.GetAliasesForRoomIDResponse
+		if err := rsAPI.GetAliasesForRoomID(ctx, &roomserverAPI.GetAliasesForRoomIDRequest{RoomID: roomID}, &aliasRes); err != nil {
+			return nil
+		}
+		return aliasRes.Aliases
+	})
 
 	chunk, prev, next := sliceInto(rooms, offset, limit)
 	if prev >= 0 {
@@ -152,23 +242,37 @@ func publicRooms(
 	return &response, err
 }
 
-func filterRooms(rooms []fclient.PublicRoom, searchTerm string) []fclient.PublicRoom {
-	if searchTerm == "" {
-		return rooms
-	}
-
-	normalizedTerm := strings.ToLower(searchTerm)
-
-	result := make([]fclient.PublicRoom, 0)
-	for _, room := range rooms {
-		if strings.Contains(strings.ToLower(room.Name), normalizedTerm) ||
-			strings.Contains(strings.ToLower(room.Topic), normalizedTerm) ||
-			strings.Contains(strings.ToLower(room.CanonicalAlias), normalizedTerm) {
-			result = append(result, room)
+// includedRemoteRooms returns the public rooms of the remote servers whose
+// directories are included in ours. The servers are all asked at once, within
+// remoteDirectoryTimeout overall, and servers which can't be reached are left
+// out.
+func includedRemoteRooms(ctx context.Context, federation fclient.FederationClient, cfg *config.ClientAPI) []fclient.PublicRoom {
+	ctx, cancel := context.WithTimeout(ctx, remoteDirectoryTimeout)
+	defer cancel()
+	chunks := make([][]fclient.PublicRoom, len(cfg.PublicRooms.IncludeServers))
+	var wg sync.WaitGroup
+	for i, serverName := range cfg.PublicRooms.IncludeServers {
+		if cfg.Matrix.IsLocalServerName(serverName) {
+			continue
 		}
+		wg.Add(1)
+		go func(i int, serverName spec.ServerName) {
+			defer wg.Done()
+			res, err := getRemotePublicRooms(ctx, federation, cfg, serverName, maxIncludedRemoteRooms, "", "", false, "")
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).WithField("server_name", serverName).Warn("Failed to get public rooms to include")
+				return
+			}
+			chunks[i] = res.Chunk
+		}(i, serverName)
 	}
-
-	return result
+	wg.Wait()
+	// The rooms are kept in the order that the servers are configured in.
+	var rooms []fclient.PublicRoom
+	for _, chunk := range chunks {
+		rooms = append(rooms, chunk...)
+	}
+	return rooms
 }
 
 // fillPublicRoomsReq fills the Limit, Since and Filter attributes of a GET or POST request
@@ -246,7 +350,7 @@ func sliceInto(slice []fclient.PublicRoom, since int64, limit int64) (subset []f
 
 func refreshPublicRoomCache(
 	ctx context.Context, rsAPI roomserverAPI.ClientRoomserverAPI, extRoomsProvider api.ExtraPublicRoomsProvider,
-	request PublicRoomReq,
+	remoteRooms []fclient.PublicRoom, request PublicRoomReq,
 ) []fclient.PublicRoom {
 	cacheMu.Lock()
 	defer cacheMu.Unlock()
@@ -275,10 +379,16 @@ func refreshPublicRoomCache(
 		util.GetLogger(ctx).WithError(err).Error("PopulatePublicRooms failed")
 		return publicRoomsCache
 	}
+	blockedRooms, err := rsAPI.QueryDirectoryBlockedRooms(ctx)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("QueryDirectoryBlockedRooms failed")
+		return publicRoomsCache
+	}
 	publicRoomsCache = []fclient.PublicRoom{}
 	publicRoomsCache = append(publicRoomsCache, pubRooms...)
 	publicRoomsCache = append(publicRoomsCache, extraRooms...)
-	publicRoomsCache = dedupeAndShuffle(publicRoomsCache)
+	publicRoomsCache = append(publicRoomsCache, remoteRooms...)
+	publicRoomsCache = withoutBlockedRooms(dedupeAndShuffle(publicRoomsCache), blockedRooms)
 
 	// sort by total joined member count (big to small)
 	sort.SliceStable(publicRoomsCache, func(i, j int) bool {
@@ -287,6 +397,26 @@ func refreshPublicRoomCache(
 	return publicRoomsCache
 }
 
+// withoutBlockedRooms removes the rooms which an administrator has blocked
+// from the room directory, so that they aren't listed through other servers'
+// directories or extra rooms providers either.
+func withoutBlockedRooms(rooms []fclient.PublicRoom, blockedRooms []string) []fclient.PublicRoom {
+	if len(blockedRooms) == 0 {
+		return rooms
+	}
+	blocked := make(map[string]struct{}, len(blockedRooms))
+	for _, roomID := range blockedRooms {
+		blocked[roomID] = struct{}{}
+	}
+	filtered := rooms[:0]
+	for _, room := range rooms {
+		if _, ok := blocked[room.RoomID]; !ok {
+			filtered = append(filtered, room)
+		}
+	}
+	return filtered
+}
+
 func getPublicRoomsFromCache() []fclient.PublicRoom {
 	cacheMu.Lock()
 	defer cacheMu.Unlock()
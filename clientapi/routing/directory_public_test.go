@@ -1,10 +1,16 @@
 package routing
 
 import (
+	"context"
+	"errors"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
 )
 
 func pubRoom(name string) fclient.PublicRoom {
@@ -56,3 +62,113 @@ func TestSliceInto(t *testing.T) {
 		}
 	}
 }
+
+type fakePublicRoomsFederation struct {
+	fclient.FederationClient
+	calls int
+	err   error
+}
+
+func (f *fakePublicRoomsFederation) GetPublicRoomsFiltered(
+	ctx context.Context, origin, s spec.ServerName, limit int, since, filter string,
+	includeAllNetworks bool, thirdPartyInstanceID string,
+) (fclient.RespPublicRooms, error) {
+	f.calls++
+	if f.err != nil {
+		return fclient.RespPublicRooms{}, f.err
+	}
+	return fclient.RespPublicRooms{Chunk: []fclient.PublicRoom{pubRoom(string(s))}}, nil
+}
+
+func TestGetRemotePublicRoomsCaches(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix:      &config.Global{},
+		PublicRooms: config.PublicRooms{RemoteCacheDuration: time.Millisecond * 50},
+	}
+	fed := &fakePublicRoomsFederation{}
+	get := func() (fclient.RespPublicRooms, error) {
+		return getRemotePublicRooms(context.Background(), fed, cfg, "remote.test", 10, "", "", false, "")
+	}
+
+	if _, err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if fed.calls != 1 {
+		t.Fatalf("expected the second request to be cached, got %d calls", fed.calls)
+	}
+
+	time.Sleep(time.Millisecond * 60)
+	fed.err = errors.New("unreachable")
+	res, err := get()
+	if err != nil {
+		t.Fatalf("expected the stale response when the server is unreachable, got %s", err)
+	}
+	if fed.calls != 2 || len(res.Chunk) != 1 {
+		t.Fatalf("expected a refresh attempt and the stale response, got %d calls and %v", fed.calls, res.Chunk)
+	}
+}
+
+// barrierPublicRoomsFederation only answers once every server has been asked,
+// so that asking the servers one at a time times out.
+type barrierPublicRoomsFederation struct {
+	fclient.FederationClient
+	asked sync.WaitGroup
+}
+
+func (f *barrierPublicRoomsFederation) GetPublicRoomsFiltered(
+	ctx context.Context, origin, s spec.ServerName, limit int, since, filter string,
+	includeAllNetworks bool, thirdPartyInstanceID string,
+) (fclient.RespPublicRooms, error) {
+	f.asked.Done()
+	done := make(chan struct{})
+	go func() {
+		f.asked.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fclient.RespPublicRooms{}, ctx.Err()
+	}
+	if s == "down.include.test" {
+		return fclient.RespPublicRooms{}, errors.New("unreachable")
+	}
+	return fclient.RespPublicRooms{Chunk: []fclient.PublicRoom{pubRoom(string(s))}}, nil
+}
+
+func TestIncludedRemoteRoomsAsksServersAtOnce(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{SigningIdentity: fclient.SigningIdentity{ServerName: "local.test"}},
+		PublicRooms: config.PublicRooms{
+			IncludeServers:      []spec.ServerName{"one.include.test", "local.test", "down.include.test", "two.include.test"},
+			RemoteCacheDuration: time.Minute,
+		},
+	}
+	fed := &barrierPublicRoomsFederation{}
+	fed.asked.Add(3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	got := includedRemoteRooms(ctx, fed, cfg)
+	want := []fclient.PublicRoom{pubRoom("one.include.test"), pubRoom("two.include.test")}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestWithoutBlockedRooms(t *testing.T) {
+	rooms := []fclient.PublicRoom{
+		{RoomID: "!a:test"}, {RoomID: "!spam:remote"}, {RoomID: "!b:test"},
+	}
+	got := withoutBlockedRooms(rooms, []string{"!spam:remote", "!unlisted:test"})
+	want := []fclient.PublicRoom{{RoomID: "!a:test"}, {RoomID: "!b:test"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if got := withoutBlockedRooms(want, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rooms changed with no blocked rooms: got %v", got)
+	}
+}
@@ -17,6 +17,7 @@ package routing
 import (
 	"net/http"
 
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal/util"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -36,19 +37,13 @@ func GetJoinedRooms(
 	deviceUserID, err := spec.NewUserID(device.UserID, true)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("Invalid device user ID")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("internal server error"),
-		}
+		return clienterror.Internal().JSONResponse()
 	}
 
 	rooms, err := rsAPI.QueryRoomsForUser(req.Context(), *deviceUserID, "join")
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("QueryRoomsForUser failed")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("internal server error"),
-		}
+		return clienterror.Internal().JSONResponse()
 	}
 
 	var roomIDStrs []string
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/gomatrix"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/clientapi/httputil"
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -43,15 +44,14 @@ func JoinRoomByIDOrAlias(
 		Content:       map[string]interface{}{},
 	}
 
-	// Check to see if any ?server_name= query parameters were
-	// given in the request.
-	if serverNames, ok := req.URL.Query()["server_name"]; ok {
-		for _, serverName := range serverNames {
-			joinReq.ServerNames = append(
-				joinReq.ServerNames,
-				spec.ServerName(serverName),
-			)
-		}
+	// Check to see if any ?via= or the older ?server_name= query
+	// parameters were given in the request.
+	query := req.URL.Query()
+	for _, serverName := range append(query["via"], query["server_name"]...) {
+		joinReq.ServerNames = append(
+			joinReq.ServerNames,
+			spec.ServerName(serverName),
+		)
 	}
 
 	// If content was provided in the request then include that
@@ -69,11 +69,8 @@ func JoinRoomByIDOrAlias(
 		joinReq.Content["displayname"] = profile.DisplayName
 		joinReq.Content["avatar_url"] = profile.AvatarURL
 	default:
-		util.GetLogger(req.Context()).Error("Unable to query user profile, no profile found.")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("Unable to query user profile, no profile found."),
-		}
+		util.GetLogger(req.Context()).WithError(err).Error("Unable to query user profile, no profile found.")
+		return clienterror.Internal().JSONResponse()
 	}
 
 	// Ask the roomserver to perform the join.
@@ -93,10 +90,7 @@ func JoinRoomByIDOrAlias(
 				}{roomID},
 			}
 		case roomserverAPI.ErrInvalidID:
-			response = util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: spec.Unknown(e.Error()),
-			}
+			response = clienterror.InvalidParam(e.Error()).JSONResponse()
 		case roomserverAPI.ErrNotAllowed:
 			jsonErr := spec.Forbidden(e.Error())
 			if device.AccountType == api.AccountTypeGuest {
@@ -130,10 +124,9 @@ func JoinRoomByIDOrAlias(
 	timer := time.NewTimer(time.Second * 20)
 	select {
 	case <-timer.C:
-		return util.JSONResponse{
-			Code: http.StatusAccepted,
-			JSON: spec.Unknown("The room join will continue in the background."),
-		}
+		return clienterror.New(
+			http.StatusAccepted, spec.ErrorUnknown, "The room join will continue in the background.",
+		).JSONResponse()
 	case result := <-done:
 		// Stop and drain the timer
 		if !timer.Stop() {
@@ -19,6 +19,7 @@ import (
 
 	"github.com/neilalexander/harmony/clientapi/auth"
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/clientapi/httputil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
@@ -64,6 +65,7 @@ func UploadCrossSigningDeviceKeys(
 	typePassword := auth.LoginTypePassword{
 		GetAccountByPassword: accountAPI.QueryAccountByPassword,
 		Config:               cfg,
+		RemoteIP:             httputil.RemoteIP(req, cfg.Matrix.RealIPHeader),
 	}
 	if _, authErr := typePassword.Login(req.Context(), &uploadReq.Auth.PasswordRequest); authErr != nil {
 		return *authErr
@@ -91,10 +93,8 @@ func UploadCrossSigningDeviceKeys(
 				JSON: spec.InvalidParam(err.Error()),
 			}
 		default:
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: spec.Unknown(err.Error()),
-			}
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to upload cross-signing keys")
+			return clienterror.Internal().JSONResponse()
 		}
 	}
 
@@ -133,10 +133,8 @@ func UploadCrossSigningDeviceSignatures(req *http.Request, keyserverAPI api.Clie
 				JSON: spec.InvalidParam(err.Error()),
 			}
 		default:
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: spec.Unknown(err.Error()),
-			}
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to upload cross-signing signatures")
+			return clienterror.Internal().JSONResponse()
 		}
 	}
 
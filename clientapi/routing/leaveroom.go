@@ -17,6 +17,7 @@ package routing
 import (
 	"net/http"
 
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
 	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
@@ -31,10 +32,8 @@ func LeaveRoomByID(
 ) util.JSONResponse {
 	userID, err := spec.NewUserID(device.UserID, true)
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: spec.Unknown("device userID is invalid"),
-		}
+		util.GetLogger(req.Context()).WithError(err).Error("device userID is invalid")
+		return clienterror.Internal().JSONResponse()
 	}
 
 	// Prepare to ask the roomserver to perform the room join.
@@ -52,9 +51,14 @@ func LeaveRoomByID(
 				JSON: spec.LeaveServerNoticeError(),
 			}
 		}
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: spec.Unknown(err.Error()),
+		switch e := err.(type) {
+		case roomserverAPI.ErrInvalidID:
+			return clienterror.InvalidParam(e.Error()).JSONResponse()
+		case roomserverAPI.ErrNotAllowed:
+			return clienterror.Forbidden(e.Error()).JSONResponse()
+		default:
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformLeave failed")
+			return clienterror.Internal().JSONResponse()
 		}
 	}
 
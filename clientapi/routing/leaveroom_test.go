@@ -0,0 +1,50 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilalexander/harmony/clientapi/clienterror"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+// leaveRoomserverAPI fails every leave with the given error.
+type leaveRoomserverAPI struct {
+	roomserverAPI.ClientRoomserverAPI
+	err error
+}
+
+func (r *leaveRoomserverAPI) PerformLeave(
+	ctx context.Context, req *roomserverAPI.PerformLeaveRequest, res *roomserverAPI.PerformLeaveResponse,
+) error {
+	return r.err
+}
+
+func TestLeaveRoomByIDErrors(t *testing.T) {
+	device := &userapi.Device{UserID: "@alice:test"}
+	for name, tc := range map[string]struct {
+		err     error
+		code    int
+		errcode spec.MatrixErrorCode
+	}{
+		"invalid room ID": {roomserverAPI.ErrInvalidID{Err: errors.New("room ID is invalid")}, http.StatusBadRequest, spec.ErrorInvalidParam},
+		"not in room":     {roomserverAPI.ErrNotAllowed{Err: errors.New("not a member")}, http.StatusForbidden, spec.ErrorForbidden},
+		"other failure":   {errors.New("database is down"), http.StatusInternalServerError, spec.ErrorUnknown},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/rooms/!room:test/leave", nil)
+			res := LeaveRoomByID(req, device, &leaveRoomserverAPI{err: tc.err}, "!room:test")
+			if res.Code != tc.code {
+				t.Fatalf("got status %d, want %d", res.Code, tc.code)
+			}
+			if jsonErr, ok := res.JSON.(*clienterror.Error); !ok || jsonErr.ErrCode != tc.errcode {
+				t.Fatalf("got response %+v, want errcode %s", res.JSON, tc.errcode)
+			}
+		})
+	}
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/neilalexander/harmony/clientapi/auth"
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/clientapi/userutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
@@ -103,10 +104,8 @@ func completeAuth(
 		UserAgent:         userAgent,
 	}, &performRes)
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("failed to create device: " + err.Error()),
-		}
+		util.GetLogger(ctx).WithError(err).Error("failed to create device")
+		return clienterror.Internal().JSONResponse()
 	}
 
 	return util.JSONResponse{
@@ -52,7 +52,7 @@ func TestLogin(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the userAPI for this test, so nil for other APIs/caches etc.
-		Setup(routers, cfg, nil, userAPI, userAPI, nil, nil, nil, nil, nil, nil, caching.DisableMetrics)
+		Setup(routers, cfg, nil, userAPI, userAPI, nil, nil, nil, nil, nil, nil, nil, nil, httputil.NewRateLimits(processCtx.Context(), "clientapi", &cfg.ClientAPI.RateLimiting, nil), caching.DisableMetrics)
 
 		// Create password
 		password := util.RandomString(8)
@@ -17,12 +17,15 @@ package routing
 import (
 	"context"
 	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/clientapi/httputil"
+	"github.com/neilalexander/harmony/clientapi/spamcheck"
 	"github.com/neilalexander/harmony/clientapi/threepid"
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
@@ -209,10 +212,7 @@ func SendKick(
 	}
 	// kick is only valid if the user is not currently banned or left (that is, they are joined or invited)
 	if queryRes.Membership != spec.Join && queryRes.Membership != spec.Invite {
-		return util.JSONResponse{
-			Code: http.StatusForbidden,
-			JSON: spec.Unknown("cannot /kick banned or left users"),
-		}
+		return clienterror.Forbidden("cannot /kick banned or left users").JSONResponse()
 	}
 	// TODO: should we be using SendLeave instead?
 	return sendMembership(req.Context(), profileAPI, device, roomID, spec.Leave, body.Reason, cfg, body.UserID, evTime, rsAPI)
@@ -265,10 +265,7 @@ func SendUnban(
 
 	// unban is only valid if the user is currently banned
 	if queryRes.Membership != spec.Ban {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: spec.Unknown("can only /unban users that are banned"),
-		}
+		return clienterror.Forbidden("can only /unban users that are banned").JSONResponse()
 	}
 	// TODO: should we be using SendLeave instead?
 	return sendMembership(req.Context(), profileAPI, device, roomID, spec.Leave, body.Reason, cfg, body.UserID, evTime, rsAPI)
@@ -278,13 +275,28 @@ func SendInvite(
 	req *http.Request, profileAPI userapi.ClientUserAPI, device *userapi.Device,
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.ClientRoomserverAPI,
+	spamChecker *spamcheck.Chain, identity *threepid.IdentityClient,
 ) util.JSONResponse {
 	body, evTime, reqErr := extractRequestData(req)
 	if reqErr != nil {
 		return *reqErr
 	}
 
-	if body.UserID == "" {
+	if body.UserID == "" && body.Medium != "" && body.Address != "" {
+		if body.IDServer == "" || body.IDAccessToken == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.MissingParam("id_server and id_access_token are required to invite by third-party identifier"),
+			}
+		}
+		mxid, resErr := lookupThreePID(req.Context(), identity, body.IDServer, body.IDAccessToken, body.Medium, body.Address)
+		if resErr != nil {
+			return *resErr
+		}
+		body.UserID = mxid
+	}
+
+	if body.UserID == "" && (body.Medium == "" || body.Address == "") {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: spec.BadJSON("missing user_id"),
@@ -304,6 +316,40 @@ func SendInvite(
 		return *errRes
 	}
 
+	// If the identity server doesn't know of a Matrix ID for the third-party
+	// identifier, invite the identifier itself so that whoever binds it can
+	// claim the invite.
+	if body.UserID == "" {
+		content, err := json.Marshal(map[string]string{
+			"medium":  body.Medium,
+			"address": body.Address,
+		})
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if _, errRes = checkSpam(req.Context(), spamChecker, &spamcheck.Request{
+			Action:  spamcheck.ActionInvite,
+			UserID:  device.UserID,
+			RoomID:  roomID,
+			Content: content,
+		}); errRes != nil {
+			return *errRes
+		}
+		return sendThirdPartyInvite(req.Context(), device, roomID, body, rsAPI, profileAPI, identity, evTime)
+	}
+
+	if _, errRes = checkSpam(req.Context(), spamChecker, &spamcheck.Request{
+		Action:  spamcheck.ActionInvite,
+		UserID:  device.UserID,
+		RoomID:  roomID,
+		Invitee: body.UserID,
+	}); errRes != nil {
+		return *errRes
+	}
+
 	// We already received the return value, so no need to check for an error here.
 	response, _ := sendInvite(req.Context(), device, roomID, body.UserID, body.Reason, cfg, rsAPI, evTime)
 	return response
@@ -364,10 +410,7 @@ func sendInvite(
 
 	switch e := err.(type) {
 	case roomserverAPI.ErrInvalidID:
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: spec.Unknown(e.Error()),
-		}, e
+		return clienterror.InvalidParam(e.Error()).JSONResponse(), e
 	case roomserverAPI.ErrNotAllowed:
 		return util.JSONResponse{
 			Code: http.StatusForbidden,
@@ -542,7 +585,7 @@ func SendForget(
 	roomID string, rsAPI roomserverAPI.ClientRoomserverAPI,
 ) util.JSONResponse {
 	ctx := req.Context()
-	logger := util.GetLogger(ctx).WithField("roomID", roomID).WithField("userID", device.UserID)
+	logger := util.GetLogger(ctx).WithField("room_id", roomID).WithField("user_id", device.UserID)
 
 	deviceUserID, err := spec.NewUserID(device.UserID, true)
 	if err != nil {
@@ -572,10 +615,9 @@ func SendForget(
 		}
 	}
 	if membershipRes.IsInRoom {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: spec.Unknown(fmt.Sprintf("User %s is in room %s", device.UserID, roomID)),
-		}
+		return clienterror.New(
+			http.StatusBadRequest, spec.ErrorUnknown, fmt.Sprintf("User %s is in room %s", device.UserID, roomID),
+		).JSONResponse()
 	}
 
 	request := roomserverAPI.PerformForgetRequest{
@@ -38,8 +38,8 @@ func Password(
 	r.LogoutDevices = true
 
 	logrus.WithFields(logrus.Fields{
-		"sessionId": device.SessionID,
-		"userId":    device.UserID,
+		"session_id": device.SessionID,
+		"user_id":    device.UserID,
 	}).Debug("Changing password")
 
 	// Unmarshal the request.
@@ -75,6 +75,7 @@ func Password(
 	typePassword := auth.LoginTypePassword{
 		GetAccountByPassword: userAPI.QueryAccountByPassword,
 		Config:               cfg,
+		RemoteIP:             httputil.RemoteIP(req, cfg.Matrix.RealIPHeader),
 	}
 	if _, authErr := typePassword.Login(req.Context(), &r.Auth.PasswordRequest); authErr != nil {
 		return *authErr
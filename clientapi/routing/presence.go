@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/clientapi/httputil"
 	"github.com/neilalexander/harmony/clientapi/producers"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -64,10 +65,7 @@ func SetPresence(
 
 	presenceStatus, ok := types.PresenceFromString(presence.Presence)
 	if !ok {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: spec.Unknown(fmt.Sprintf("Unknown presence '%s'.", presence.Presence)),
-		}
+		return clienterror.InvalidParam(fmt.Sprintf("Unknown presence '%s'.", presence.Presence)).JSONResponse()
 	}
 	err := producer.SendPresence(req.Context(), userID, presenceStatus, presence.StatusMsg)
 	if err != nil {
@@ -123,6 +121,7 @@ func GetPresence(
 	}
 
 	p := types.PresenceInternal{LastActiveTS: spec.Timestamp(lastActive)}
+	p.Presence, _ = types.PresenceFromString(presence.Header.Get("presence"))
 	currentlyActive := p.CurrentlyActive()
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -250,10 +251,7 @@ func updateProfile(
 ) (util.JSONResponse, error) {
 	deviceUserID, err := spec.NewUserID(device.UserID, true)
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("internal server error"),
-		}, err
+		return clienterror.Internal().JSONResponse(), err
 	}
 
 	rooms, err := rsAPI.QueryRoomsForUser(ctx, *deviceUserID, "join")
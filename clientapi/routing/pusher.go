@@ -22,6 +22,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
+	"github.com/neilalexander/harmony/setup/config"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 )
 
@@ -84,6 +85,11 @@ func SetPusher(
 	if len(body.PushKey) > 512 {
 		return invalidParam("length of pushkey must be no more than 512 bytes")
 	}
+	if fInt, ok := body.Data["format"]; ok && body.Kind == userapi.HTTPKind {
+		if f, ok := fInt.(string); !ok || (f != "" && f != config.PushFormatEventIDOnly) {
+			return invalidParam("format must be event_id_only or empty")
+		}
+	}
 	uInt := body.Data["url"]
 	if uInt != nil {
 		u, ok := uInt.(string)
@@ -33,8 +33,8 @@ func errorResponse(ctx context.Context, err error, msg string, args ...interface
 	}
 }
 
-func GetAllPushRules(ctx context.Context, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
-	ruleSets, err := userAPI.QueryPushRules(ctx, device.UserID)
+func GetAllPushRules(ctx context.Context, device *userapi.Device, userAPI userapi.ClientUserAPI, serverRules *pushrules.ServerRules) util.JSONResponse {
+	ruleSets, err := queryPushRulesWithServerRules(ctx, device.UserID, userAPI, serverRules)
 	if err != nil {
 		return errorResponse(ctx, err, "queryPushRulesJSON failed")
 	}
@@ -44,8 +44,8 @@ func GetAllPushRules(ctx context.Context, device *userapi.Device, userAPI userap
 	}
 }
 
-func GetPushRulesByScope(ctx context.Context, scope string, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
-	ruleSets, err := userAPI.QueryPushRules(ctx, device.UserID)
+func GetPushRulesByScope(ctx context.Context, scope string, device *userapi.Device, userAPI userapi.ClientUserAPI, serverRules *pushrules.ServerRules) util.JSONResponse {
+	ruleSets, err := queryPushRulesWithServerRules(ctx, device.UserID, userAPI, serverRules)
 	if err != nil {
 		return errorResponse(ctx, err, "queryPushRulesJSON failed")
 	}
@@ -59,8 +59,8 @@ func GetPushRulesByScope(ctx context.Context, scope string, device *userapi.Devi
 	}
 }
 
-func GetPushRulesByKind(ctx context.Context, scope, kind string, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
-	ruleSets, err := userAPI.QueryPushRules(ctx, device.UserID)
+func GetPushRulesByKind(ctx context.Context, scope, kind string, device *userapi.Device, userAPI userapi.ClientUserAPI, serverRules *pushrules.ServerRules) util.JSONResponse {
+	ruleSets, err := queryPushRulesWithServerRules(ctx, device.UserID, userAPI, serverRules)
 	if err != nil {
 		return errorResponse(ctx, err, "queryPushRules failed")
 	}
@@ -79,8 +79,8 @@ func GetPushRulesByKind(ctx context.Context, scope, kind string, device *userapi
 	}
 }
 
-func GetPushRuleByRuleID(ctx context.Context, scope, kind, ruleID string, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
-	ruleSets, err := userAPI.QueryPushRules(ctx, device.UserID)
+func GetPushRuleByRuleID(ctx context.Context, scope, kind, ruleID string, device *userapi.Device, userAPI userapi.ClientUserAPI, serverRules *pushrules.ServerRules) util.JSONResponse {
+	ruleSets, err := queryPushRulesWithServerRules(ctx, device.UserID, userAPI, serverRules)
 	if err != nil {
 		return errorResponse(ctx, err, "queryPushRules failed")
 	}
@@ -102,7 +102,10 @@ func GetPushRuleByRuleID(ctx context.Context, scope, kind, ruleID string, device
 	}
 }
 
-func PutPushRuleByRuleID(ctx context.Context, scope, kind, ruleID, afterRuleID, beforeRuleID string, body io.Reader, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+func PutPushRuleByRuleID(ctx context.Context, scope, kind, ruleID, afterRuleID, beforeRuleID string, body io.Reader, device *userapi.Device, userAPI userapi.ClientUserAPI, serverRules *pushrules.ServerRules) util.JSONResponse {
+	if isServerPushRule(serverRules, scope, kind, ruleID) {
+		return serverPushRuleResponse()
+	}
 	var newRule pushrules.Rule
 	if err := json.NewDecoder(body).Decode(&newRule); err != nil {
 		return util.JSONResponse{
@@ -168,7 +171,10 @@ func PutPushRuleByRuleID(ctx context.Context, scope, kind, ruleID, afterRuleID,
 	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
 }
 
-func DeletePushRuleByRuleID(ctx context.Context, scope, kind, ruleID string, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+func DeletePushRuleByRuleID(ctx context.Context, scope, kind, ruleID string, device *userapi.Device, userAPI userapi.ClientUserAPI, serverRules *pushrules.ServerRules) util.JSONResponse {
+	if isServerPushRule(serverRules, scope, kind, ruleID) {
+		return serverPushRuleResponse()
+	}
 	ruleSets, err := userAPI.QueryPushRules(ctx, device.UserID)
 	if err != nil {
 		return errorResponse(ctx, err, "queryPushRules failed")
@@ -195,12 +201,12 @@ func DeletePushRuleByRuleID(ctx context.Context, scope, kind, ruleID string, dev
 	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
 }
 
-func GetPushRuleAttrByRuleID(ctx context.Context, scope, kind, ruleID, attr string, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+func GetPushRuleAttrByRuleID(ctx context.Context, scope, kind, ruleID, attr string, device *userapi.Device, userAPI userapi.ClientUserAPI, serverRules *pushrules.ServerRules) util.JSONResponse {
 	attrGet, err := pushRuleAttrGetter(attr)
 	if err != nil {
 		return errorResponse(ctx, err, "pushRuleAttrGetter failed")
 	}
-	ruleSets, err := userAPI.QueryPushRules(ctx, device.UserID)
+	ruleSets, err := queryPushRulesWithServerRules(ctx, device.UserID, userAPI, serverRules)
 	if err != nil {
 		return errorResponse(ctx, err, "queryPushRules failed")
 	}
@@ -224,7 +230,10 @@ func GetPushRuleAttrByRuleID(ctx context.Context, scope, kind, ruleID, attr stri
 	}
 }
 
-func PutPushRuleAttrByRuleID(ctx context.Context, scope, kind, ruleID, attr string, body io.Reader, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+func PutPushRuleAttrByRuleID(ctx context.Context, scope, kind, ruleID, attr string, body io.Reader, device *userapi.Device, userAPI userapi.ClientUserAPI, serverRules *pushrules.ServerRules) util.JSONResponse {
+	if isServerPushRule(serverRules, scope, kind, ruleID) {
+		return serverPushRuleResponse()
+	}
 	var newPartialRule pushrules.Rule
 	if err := json.NewDecoder(body).Decode(&newPartialRule); err != nil {
 		return util.JSONResponse{
@@ -274,6 +283,43 @@ func PutPushRuleAttrByRuleID(ctx context.Context, scope, kind, ruleID, attr stri
 	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
 }
 
+// queryPushRulesWithServerRules returns the push rules of the user with the
+// server's push rules merged in, so that clients see the rules which are
+// actually evaluated. The server's rules are never stored with the user's.
+func queryPushRulesWithServerRules(ctx context.Context, userID string, userAPI userapi.ClientUserAPI, serverRules *pushrules.ServerRules) (*pushrules.AccountRuleSets, error) {
+	ruleSets, err := userAPI.QueryPushRules(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	ruleSets.Global = *serverRules.Apply(&ruleSets.Global)
+	return ruleSets, nil
+}
+
+// isServerPushRule returns true if the rule was configured by the server
+// rather than the user, in which case the user can't change it.
+func isServerPushRule(serverRules *pushrules.ServerRules, scope, kind, ruleID string) bool {
+	if serverRules == nil || pushrules.Scope(scope) != pushrules.GlobalScope {
+		return false
+	}
+	var rules []*pushrules.Rule
+	switch pushrules.Kind(kind) {
+	case pushrules.OverrideKind:
+		rules = serverRules.Override
+	case pushrules.ContentKind:
+		rules = serverRules.Content
+	case pushrules.UnderrideKind:
+		rules = serverRules.Underride
+	}
+	return pushRuleIndexByID(rules, ruleID) >= 0
+}
+
+func serverPushRuleResponse() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: spec.Forbidden("push rule is configured by the server and can't be changed"),
+	}
+}
+
 func pushRuleSetByScope(ruleSets *pushrules.AccountRuleSets, scope pushrules.Scope) *pushrules.RuleSet {
 	switch scope {
 	case pushrules.GlobalScope:
@@ -0,0 +1,84 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/pushrules"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+type pushRulesUserAPI struct {
+	userapi.ClientUserAPI
+	ruleSets *pushrules.AccountRuleSets
+	puts     int
+}
+
+func (u *pushRulesUserAPI) QueryPushRules(ctx context.Context, userID string) (*pushrules.AccountRuleSets, error) {
+	return u.ruleSets, nil
+}
+
+func (u *pushRulesUserAPI) PerformPushRulesPut(ctx context.Context, userID string, ruleSets *pushrules.AccountRuleSets) error {
+	u.puts++
+	return nil
+}
+
+func TestServerPushRules(t *testing.T) {
+	ctx := context.Background()
+	device := &userapi.Device{UserID: "@alice:test"}
+	serverRule := &pushrules.Rule{
+		RuleID:     "mute_bots",
+		Default:    true,
+		Enabled:    true,
+		Conditions: []*pushrules.Condition{{Kind: pushrules.EventMatchCondition, Key: "type", Pattern: new(string)}},
+		Actions:    []*pushrules.Action{{Kind: pushrules.DontNotifyAction}},
+	}
+	serverRules := &pushrules.ServerRules{
+		Override:         []*pushrules.Rule{serverRule},
+		DisabledDefaults: map[string]struct{}{pushrules.MRuleSuppressNotices: {}},
+	}
+	newUserAPI := func() *pushRulesUserAPI {
+		return &pushRulesUserAPI{ruleSets: pushrules.DefaultAccountRuleSets("alice", "test")}
+	}
+
+	// Clients see the server's rules as they are evaluated.
+	res := GetPushRuleByRuleID(ctx, "global", "override", "mute_bots", device, newUserAPI(), serverRules)
+	if res.Code != http.StatusOK || res.JSON != serverRule {
+		t.Fatalf("got %d %+v, want the server rule", res.Code, res.JSON)
+	}
+	res = GetPushRuleAttrByRuleID(ctx, "global", "override", pushrules.MRuleSuppressNotices, "enabled", device, newUserAPI(), serverRules)
+	if res.Code != http.StatusOK || res.JSON.(map[string]interface{})["enabled"] != false {
+		t.Fatalf("got %d %+v, want the default rule to be disabled", res.Code, res.JSON)
+	}
+	res = GetAllPushRules(ctx, device, newUserAPI(), serverRules)
+	if res.Code != http.StatusOK || pushRuleIndexByID(res.JSON.(*pushrules.AccountRuleSets).Global.Override, "mute_bots") < 0 {
+		t.Fatalf("got %d %+v, want the server rule to be included", res.Code, res.JSON)
+	}
+
+	// They can't be changed or deleted by users.
+	userAPI := newUserAPI()
+	responses := map[string]int{
+		"put":      PutPushRuleByRuleID(ctx, "global", "override", "mute_bots", "", "", strings.NewReader(`{"actions":["notify"]}`), device, userAPI, serverRules).Code,
+		"put attr": PutPushRuleAttrByRuleID(ctx, "global", "override", "mute_bots", "enabled", strings.NewReader(`{"enabled":false}`), device, userAPI, serverRules).Code,
+		"delete":   DeletePushRuleByRuleID(ctx, "global", "override", "mute_bots", device, userAPI, serverRules).Code,
+	}
+	for name, code := range responses {
+		if code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want %d", name, code, http.StatusForbidden)
+		}
+	}
+	if userAPI.puts != 0 {
+		t.Fatalf("expected the user's push rules not to be stored, got %d puts", userAPI.puts)
+	}
+
+	// The server's rules are never stored with the user's own rules.
+	userAPI = newUserAPI()
+	if res = PutPushRuleAttrByRuleID(ctx, "global", "override", pushrules.MRuleMaster, "enabled", strings.NewReader(`{"enabled":true}`), device, userAPI, serverRules); res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.Code, http.StatusOK)
+	}
+	if userAPI.puts != 1 || pushRuleIndexByID(userAPI.ruleSets.Global.Override, "mute_bots") >= 0 {
+		t.Fatalf("expected the user's own push rules to be stored without the server rules")
+	}
+}
@@ -31,11 +31,11 @@ import (
 func SetReceipt(req *http.Request, userAPI userapi.ClientUserAPI, syncProducer *producers.SyncAPIProducer, device *userapi.Device, roomID, receiptType, eventID string) util.JSONResponse {
 	timestamp := spec.AsTimestamp(time.Now())
 	logrus.WithFields(logrus.Fields{
-		"roomID":      roomID,
-		"receiptType": receiptType,
-		"eventID":     eventID,
-		"userId":      device.UserID,
-		"timestamp":   timestamp,
+		"room_id":      roomID,
+		"receipt_type": receiptType,
+		"event_id":     eventID,
+		"user_id":      device.UserID,
+		"timestamp":    timestamp,
 	}).Debug("Setting receipt")
 
 	switch receiptType {
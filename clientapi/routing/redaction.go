@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
@@ -78,11 +79,8 @@ func SendRedaction(
 	// if user is member of room, and sender ID is nil, then this user doesn't have a pseudo ID for some reason,
 	// which is unexpected.
 	if senderID == nil {
-		util.GetLogger(req.Context()).WithField("userID", *deviceUserID).WithField("roomID", roomID).Error("missing sender ID for user, despite having membership")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("internal server error"),
-		}
+		util.GetLogger(req.Context()).WithField("user_id", *deviceUserID).WithField("room_id", roomID).Error("missing sender ID for user, despite having membership")
+		return clienterror.Internal().JSONResponse()
 	}
 
 	if txnID != nil {
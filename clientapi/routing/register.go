@@ -30,6 +30,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal"
 	"github.com/tidwall/gjson"
 
@@ -46,6 +47,8 @@ import (
 	"github.com/neilalexander/harmony/clientapi/auth"
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
 	"github.com/neilalexander/harmony/clientapi/httputil"
+	"github.com/neilalexander/harmony/clientapi/postregister"
+	"github.com/neilalexander/harmony/clientapi/spamcheck"
 	"github.com/neilalexander/harmony/clientapi/userutil"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 )
@@ -332,6 +335,8 @@ func Register(
 	req *http.Request,
 	userAPI userapi.ClientUserAPI,
 	cfg *config.ClientAPI,
+	spamChecker *spamcheck.Chain,
+	postRegister *postregister.Hooks,
 ) util.JSONResponse {
 	defer req.Body.Close() // nolint: errcheck
 	reqBody, err := io.ReadAll(req.Body)
@@ -433,7 +438,7 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI)
+	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, spamChecker, postRegister)
 }
 
 func handleGuestRegistration(
@@ -442,8 +447,8 @@ func handleGuestRegistration(
 	cfg *config.ClientAPI,
 	userAPI userapi.ClientUserAPI,
 ) util.JSONResponse {
-	registrationEnabled := !cfg.RegistrationDisabled
-	guestsEnabled := !cfg.GuestsDisabled
+	registrationEnabled := !cfg.IsRegistrationDisabled()
+	guestsEnabled := !cfg.IsGuestsDisabled()
 	if v := cfg.Matrix.VirtualHost(r.ServerName); v != nil {
 		registrationEnabled, guestsEnabled = v.RegistrationAllowed()
 	}
@@ -463,22 +468,19 @@ func handleGuestRegistration(
 		ServerName:  r.ServerName,
 	}, &res)
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("failed to create account: " + err.Error()),
-		}
+		util.GetLogger(req.Context()).WithError(err).Error("failed to create account")
+		return clienterror.Internal().JSONResponse()
 	}
+	_, privateKey := cfg.Matrix.SigningKey()
 	token, err := tokens.GenerateLoginToken(tokens.TokenOptions{
-		ServerPrivateKey: cfg.Matrix.PrivateKey.Seed(),
+		ServerPrivateKey: privateKey.Seed(),
 		ServerName:       string(res.Account.ServerName),
 		UserID:           res.Account.UserID,
 	})
 
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("Failed to generate access token"),
-		}
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to generate access token")
+		return clienterror.Internal().JSONResponse()
 	}
 	//we don't allow guests to specify their own device_id
 	var devRes userapi.PerformDeviceCreationResponse
@@ -487,15 +489,13 @@ func handleGuestRegistration(
 		ServerName:        res.Account.ServerName,
 		DeviceDisplayName: r.InitialDisplayName,
 		AccessToken:       token,
-		IPAddr:            req.RemoteAddr,
+		IPAddr:            httputil.RemoteIP(req, cfg.Matrix.RealIPHeader),
 		UserAgent:         req.UserAgent(),
 		FromRegistration:  true,
 	}, &devRes)
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("failed to create device: " + err.Error()),
-		}
+		util.GetLogger(req.Context()).WithError(err).Error("failed to create device")
+		return clienterror.Internal().JSONResponse()
 	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -516,6 +516,8 @@ func handleRegistrationFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.ClientUserAPI,
+	spamChecker *spamcheck.Chain,
+	postRegister *postregister.Hooks,
 ) util.JSONResponse {
 	// TODO: Enable registration config flag
 	// TODO: Guest account upgrading
@@ -536,7 +538,7 @@ func handleRegistrationFlow(
 		}
 	}
 
-	registrationEnabled := !cfg.RegistrationDisabled
+	registrationEnabled := !cfg.IsRegistrationDisabled()
 	if v := cfg.Matrix.VirtualHost(r.ServerName); v != nil {
 		registrationEnabled, _ = v.RegistrationAllowed()
 	}
@@ -552,10 +554,10 @@ func handleRegistrationFlow(
 	switch r.Auth.Type {
 	case authtypes.LoginTypeRecaptcha:
 		// Check given captcha response
-		err := validateRecaptcha(cfg, r.Auth.Response, req.RemoteAddr)
+		err := validateRecaptcha(cfg, r.Auth.Response, httputil.RemoteIP(req, cfg.Matrix.RealIPHeader))
 		switch err {
 		case ErrCaptchaDisabled:
-			return util.JSONResponse{Code: http.StatusForbidden, JSON: spec.Unknown(err.Error())}
+			return clienterror.Forbidden(err.Error()).JSONResponse()
 		case ErrMissingResponse:
 			return util.JSONResponse{Code: http.StatusBadRequest, JSON: spec.BadJSON(err.Error())}
 		case ErrInvalidCaptcha:
@@ -579,17 +581,14 @@ func handleRegistrationFlow(
 		// flows. It can also mean that we want to register as an appservice
 		// but that is handed above.
 	default:
-		return util.JSONResponse{
-			Code: http.StatusNotImplemented,
-			JSON: spec.Unknown("unknown/unimplemented auth type"),
-		}
+		return clienterror.InvalidParam("unknown/unimplemented auth type").JSONResponse()
 	}
 
 	// Check if the user's registration flow has been completed successfully
 	// A response with current registration flow and remaining available methods
 	// will be returned if a flow has not been successfully completed yet
 	return checkAndCompleteFlow(sessions.getCompletedStages(sessionID),
-		req, r, sessionID, cfg, userAPI)
+		req, r, sessionID, cfg, userAPI, spamChecker, postRegister)
 }
 
 // checkAndCompleteFlow checks if a given registration flow is completed given
@@ -602,14 +601,29 @@ func checkAndCompleteFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.ClientUserAPI,
+	spamChecker *spamcheck.Chain,
+	postRegister *postregister.Hooks,
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
-		return completeRegistration(
-			req.Context(), userAPI, r.Username, r.ServerName, "", r.Password, "", req.RemoteAddr,
+		if spamChecker.Enabled() {
+			content, _ := json.Marshal(map[string]string{
+				"ip_address": httputil.RemoteIP(req, cfg.Matrix.RealIPHeader),
+				"user_agent": req.UserAgent(),
+			})
+			if _, resErr := checkSpam(req.Context(), spamChecker, &spamcheck.Request{
+				Action:  spamcheck.ActionRegister,
+				UserID:  userutil.MakeUserID(r.Username, r.ServerName),
+				Content: content,
+			}); resErr != nil {
+				return *resErr
+			}
+		}
+		return runPostRegistration(postRegister, completeRegistration(
+			req.Context(), userAPI, r.Username, r.ServerName, "", r.Password, "", httputil.RemoteIP(req, cfg.Matrix.RealIPHeader),
 			req.UserAgent(), sessionID, r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
 			userapi.AccountTypeUser,
-		)
+		))
 	}
 	sessions.addParams(sessionID, r)
 	// There are still more stages to complete.
@@ -621,6 +635,15 @@ func checkAndCompleteFlow(
 	}
 }
 
+// runPostRegistration runs the post-registration hooks for the new user if
+// the registration succeeded, and returns the response unchanged.
+func runPostRegistration(postRegister *postregister.Hooks, res util.JSONResponse) util.JSONResponse {
+	if r, ok := res.JSON.(registerResponse); ok && res.Code == http.StatusOK {
+		postRegister.Registered(r.UserID)
+	}
+	return res
+}
+
 // completeRegistration runs some rudimentary checks against the submitted
 // input, then if successful creates an account and a newly associated device
 // We pass in each individual part of the request here instead of just passing a
@@ -665,10 +688,8 @@ func completeRegistration(
 				JSON: spec.UserInUse("Desired user ID is already taken."),
 			}
 		}
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("failed to create account: " + err.Error()),
-		}
+		util.GetLogger(ctx).WithError(err).Error("failed to create account")
+		return clienterror.Internal().JSONResponse()
 	}
 
 	// Increment prometheus counter for created users
@@ -687,19 +708,15 @@ func completeRegistration(
 
 	token, err := auth.GenerateAccessToken()
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("Failed to generate access token"),
-		}
+		util.GetLogger(ctx).WithError(err).Error("Failed to generate access token")
+		return clienterror.Internal().JSONResponse()
 	}
 
 	if displayName != "" {
 		_, _, err = userAPI.SetDisplayName(ctx, username, serverName, displayName)
 		if err != nil {
-			return util.JSONResponse{
-				Code: http.StatusInternalServerError,
-				JSON: spec.Unknown("failed to set display name: " + err.Error()),
-			}
+			util.GetLogger(ctx).WithError(err).Error("failed to set display name")
+			return clienterror.Internal().JSONResponse()
 		}
 	}
 
@@ -715,10 +732,8 @@ func completeRegistration(
 		FromRegistration:  true,
 	}, &devRes)
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("failed to create device: " + err.Error()),
-		}
+		util.GetLogger(ctx).WithError(err).Error("failed to create device")
+		return clienterror.Internal().JSONResponse()
 	}
 
 	result := registerResponse{
@@ -829,10 +844,8 @@ func RegisterAvailable(
 		ServerName: domain,
 	}, res)
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("failed to check availability:" + err.Error()),
-		}
+		util.GetLogger(req.Context()).WithError(err).Error("failed to check availability")
+		return clienterror.Internal().JSONResponse()
 	}
 
 	if !res.Available {
@@ -850,7 +863,7 @@ func RegisterAvailable(
 	}
 }
 
-func handleSharedSecretRegistration(cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, sr *SharedSecretRegistration, req *http.Request) util.JSONResponse {
+func handleSharedSecretRegistration(cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, sr *SharedSecretRegistration, req *http.Request, postRegister *postregister.Hooks) util.JSONResponse {
 	ssrr, err := NewSharedSecretRegistrationRequest(req.Body)
 	if err != nil {
 		return util.JSONResponse{
@@ -883,5 +896,5 @@ func handleSharedSecretRegistration(cfg *config.ClientAPI, userAPI userapi.Clien
 	if ssrr.Admin {
 		accType = userapi.AccountTypeAdmin
 	}
-	return completeRegistration(req.Context(), userAPI, ssrr.User, cfg.Matrix.ServerName, ssrr.DisplayName, ssrr.Password, "", req.RemoteAddr, req.UserAgent(), "", false, &ssrr.User, &deviceID, accType)
+	return runPostRegistration(postRegister, completeRegistration(req.Context(), userAPI, ssrr.User, cfg.Matrix.ServerName, ssrr.DisplayName, ssrr.Password, "", httputil.RemoteIP(req, cfg.Matrix.RealIPHeader), req.UserAgent(), "", false, &ssrr.User, &deviceID, accType))
 }
@@ -27,6 +27,7 @@ import (
 	"time"
 
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -252,12 +253,9 @@ func Test_register(t *testing.T) {
 			wantUsername: "1",
 		},
 		{
-			name:      "unknown login type",
-			loginType: "im.not.known",
-			wantErrorResponse: util.JSONResponse{
-				Code: http.StatusNotImplemented,
-				JSON: spec.Unknown("unknown/unimplemented auth type"),
-			},
+			name:              "unknown login type",
+			loginType:         "im.not.known",
+			wantErrorResponse: clienterror.InvalidParam("unknown/unimplemented auth type").JSONResponse(),
 		},
 		{
 			name:                 "disabled registration",
@@ -311,12 +309,9 @@ func Test_register(t *testing.T) {
 			},
 		},
 		{
-			name:      "disabled recaptcha login",
-			loginType: authtypes.LoginTypeRecaptcha,
-			wantErrorResponse: util.JSONResponse{
-				Code: http.StatusForbidden,
-				JSON: spec.Unknown(ErrCaptchaDisabled.Error()),
-			},
+			name:              "disabled recaptcha login",
+			loginType:         authtypes.LoginTypeRecaptcha,
+			wantErrorResponse: clienterror.Forbidden(ErrCaptchaDisabled.Error()).JSONResponse(),
 		},
 		{
 			name:            "enabled recaptcha, no response defined",
@@ -421,7 +416,7 @@ func Test_register(t *testing.T) {
 
 				req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/?kind=%s", tc.kind), body)
 
-				resp := Register(req, userAPI, &cfg.ClientAPI)
+				resp := Register(req, userAPI, &cfg.ClientAPI, nil, nil)
 				t.Logf("Resp: %+v", resp)
 
 				// The first request should return a userInteractiveResponse
@@ -492,7 +487,7 @@ func Test_register(t *testing.T) {
 
 				req = httptest.NewRequest(http.MethodPost, "/", body)
 
-				resp = Register(req, userAPI, &cfg.ClientAPI)
+				resp = Register(req, userAPI, &cfg.ClientAPI, nil, nil)
 
 				switch rr := resp.JSON.(type) {
 				case spec.InternalServerError, spec.MatrixError, util.JSONResponse:
@@ -603,6 +598,7 @@ func TestRegisterAdminUsingSharedSecret(t *testing.T) {
 			userAPI,
 			r,
 			ssrr,
+			nil,
 		)
 		assert.Equal(t, http.StatusOK, response.Code)
 
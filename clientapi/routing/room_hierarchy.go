@@ -20,6 +20,7 @@ import (
 	"sync"
 
 	"github.com/google/uuid"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
@@ -150,10 +151,7 @@ func QueryRoomHierarchy(req *http.Request, device *userapi.Device, roomIDStr str
 			}
 		default:
 			log.WithError(err).Errorf("failed to fetch next page of room hierarchy (CS API)")
-			return util.JSONResponse{
-				Code: http.StatusInternalServerError,
-				JSON: spec.Unknown("internal server error"),
-			}
+			return clienterror.Internal().JSONResponse()
 		}
 	}
 
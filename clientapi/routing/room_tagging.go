@@ -15,12 +15,13 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
-	"github.com/matrix-org/gomatrix"
 	"github.com/neilalexander/harmony/clientapi/httputil"
 	"github.com/neilalexander/harmony/clientapi/producers"
+	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/neilalexander/harmony/userapi/api"
@@ -52,6 +53,11 @@ func GetTags(
 		}
 	}
 
+	// Clients expect an object even if the room has never been tagged.
+	if tagContent.Tags == nil {
+		tagContent.Tags = map[string]eventutil.TagProperties{}
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: tagContent,
@@ -78,10 +84,16 @@ func PutTag(
 		}
 	}
 
-	var properties gomatrix.TagProperties
+	var properties eventutil.TagProperties
 	if reqErr := httputil.UnmarshalJSONRequest(req, &properties); reqErr != nil {
 		return *reqErr
 	}
+	if properties.Order != nil && (*properties.Order < 0 || *properties.Order > 1) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("order must be a number between 0 and 1"),
+		}
+	}
 
 	tagContent, err := obtainSavedTags(req, userID, roomID, userAPI)
 	if err != nil {
@@ -93,11 +105,11 @@ func PutTag(
 	}
 
 	if tagContent.Tags == nil {
-		tagContent.Tags = make(map[string]gomatrix.TagProperties)
+		tagContent.Tags = make(map[string]eventutil.TagProperties)
 	}
 	tagContent.Tags[tag] = properties
 
-	if err = saveTagData(req, userID, roomID, userAPI, tagContent); err != nil {
+	if err = saveTagData(req.Context(), userID, roomID, userAPI, tagContent); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("saveTagData failed")
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -151,7 +163,7 @@ func DeleteTag(
 		}
 	}
 
-	if err = saveTagData(req, userID, roomID, userAPI, tagContent); err != nil {
+	if err = saveTagData(req.Context(), userID, roomID, userAPI, tagContent); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("saveTagData failed")
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -172,7 +184,7 @@ func obtainSavedTags(
 	userID string,
 	roomID string,
 	userAPI api.ClientUserAPI,
-) (tags gomatrix.TagContent, err error) {
+) (tags eventutil.TagContent, err error) {
 	dataReq := api.QueryAccountDataRequest{
 		UserID:   userID,
 		RoomID:   roomID,
@@ -195,11 +207,11 @@ func obtainSavedTags(
 
 // saveTagData saves the provided tag data into the database
 func saveTagData(
-	req *http.Request,
+	ctx context.Context,
 	userID string,
 	roomID string,
 	userAPI api.ClientUserAPI,
-	Tag gomatrix.TagContent,
+	Tag eventutil.TagContent,
 ) error {
 	newTagData, err := json.Marshal(Tag)
 	if err != nil {
@@ -212,5 +224,5 @@ func saveTagData(
 		AccountData: json.RawMessage(newTagData),
 	}
 	dataRes := api.InputAccountDataResponse{}
-	return userAPI.InputAccountData(req.Context(), &dataReq, &dataRes)
+	return userAPI.InputAccountData(ctx, &dataReq, &dataRes)
 }
@@ -16,6 +16,7 @@ package routing
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strings"
 
@@ -30,10 +31,14 @@ import (
 
 	userapi "github.com/neilalexander/harmony/userapi/api"
 
+	"github.com/neilalexander/harmony/clientapi/admintasks"
 	"github.com/neilalexander/harmony/clientapi/api"
 	"github.com/neilalexander/harmony/clientapi/auth"
 	clientutil "github.com/neilalexander/harmony/clientapi/httputil"
+	"github.com/neilalexander/harmony/clientapi/postregister"
 	"github.com/neilalexander/harmony/clientapi/producers"
+	"github.com/neilalexander/harmony/clientapi/spamcheck"
+	"github.com/neilalexander/harmony/clientapi/threepid"
 	federationAPI "github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/internal/httputil"
 	"github.com/neilalexander/harmony/internal/transactions"
@@ -53,6 +58,12 @@ type WellKnownSlidingSyncProxy struct {
 type WellKnownClientResponse struct {
 	Homeserver       WellKnownClientHomeserver  `json:"m.homeserver"`
 	SlidingSyncProxy *WellKnownSlidingSyncProxy `json:"org.matrix.msc3575.proxy,omitempty"`
+	RTCFoci          []config.RTCFocus          `json:"org.matrix.msc4143.rtc_foci,omitempty"`
+}
+
+type WellKnownSupportResponse struct {
+	Contacts    []config.SupportContact `json:"contacts,omitempty"`
+	SupportPage string                  `json:"support_page,omitempty"`
 }
 
 // Setup registers HTTP handlers with the given ServeMux. It also supplies the given http.Client
@@ -72,7 +83,8 @@ func Setup(
 	transactionsCache *transactions.Cache,
 	federationSender federationAPI.ClientFederationAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
-	natsClient *nats.Conn, enableMetrics bool,
+	natsClient *nats.Conn, adminTasks *admintasks.Manager, spamChecker *spamcheck.Chain,
+	rateLimits *httputil.RateLimits, enableMetrics bool,
 ) {
 	cfg := &dendriteCfg.ClientAPI
 	publicAPIMux := routers.Client
@@ -81,11 +93,48 @@ func Setup(
 	dendriteAdminRouter := routers.DendriteAdmin
 
 	if enableMetrics {
-		prometheus.MustRegister(amtRegUsers, sendEventDuration)
+		prometheus.MustRegister(amtRegUsers, sendEventDuration, sendRateLimitRejections)
 	}
 
-	rateLimits := httputil.NewRateLimits(&cfg.RateLimiting)
+	delayedEvents := NewDelayedEvents(rsAPI, userAPI, cfg.MaxEventDelayDuration)
+	if delayedEvents.Enabled() {
+		if err := delayedEvents.Load(context.Background()); err != nil {
+			logrus.WithError(err).Error("Failed to load delayed events")
+		}
+	}
+	sendLimiter := newSendRateLimiter(&cfg.SendRateLimiting, rsAPI)
+	// The config has already been verified at this point.
+	serverPushRules, _ := dendriteCfg.UserAPI.PushRules.ServerRules()
 	userInteractiveAuth := auth.NewUserInteractive(userAPI, cfg)
+	identity := threepid.NewIdentityClient(&cfg.IdentityServers)
+
+	var serverNotificationSender *userapi.Device
+	var sendNotice postregister.NoticeSender
+	if cfg.Matrix.ServerNotices.Enabled {
+		var err error
+		serverNotificationSender, err = getSenderDevice(context.Background(), rsAPI, userAPI, cfg)
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to get account for sending sending server notices")
+		}
+		sendNotice = func(ctx context.Context, userID string, content map[string]interface{}) error {
+			recipient, err := spec.NewUserID(userID, true)
+			if err != nil {
+				return err
+			}
+			_, resErr := sendServerNotice(
+				ctx, *recipient, content, &cfg.Matrix.ServerNotices,
+				cfg, userAPI, rsAPI, serverNotificationSender, nil,
+			)
+			if resErr != nil {
+				return fmt.Errorf("failed to send server notice: %v", resErr.JSON)
+			}
+			return nil
+		}
+	}
+	postRegister, err := postregister.New(&cfg.PostRegistration, sendNotice)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to set up post-registration hooks")
+	}
 
 	unstableFeatures := map[string]bool{
 		"org.matrix.e2e_cross_signing": true,
@@ -95,6 +144,9 @@ func Setup(
 	for _, msc := range cfg.MSCs.MSCs {
 		unstableFeatures["org.matrix."+msc] = true
 	}
+	if delayedEvents.Enabled() {
+		unstableFeatures["org.matrix.msc4140"] = true
+	}
 
 	// singleflight protects /join endpoints from being invoked
 	// multiple times from the same user and room, otherwise
@@ -118,10 +170,28 @@ func Setup(
 					Url: cfg.Matrix.WellKnownSlidingSyncProxy,
 				}
 			}
+			if len(cfg.Matrix.WellKnownRTCFoci) > 0 {
+				response.RTCFoci = cfg.Matrix.WellKnownRTCFoci
+			}
 
+			return util.JSONResponse{
+				Code:    http.StatusOK,
+				JSON:    response,
+				Headers: httputil.CacheHeaders(dendriteCfg.Global.WellKnownCacheMaxAge),
+			}
+		})).Methods(http.MethodGet, http.MethodOptions)
+	}
+
+	if support := &dendriteCfg.Global.WellKnownSupport; support.Enabled() {
+		logrus.Infof("Setting support contacts at /.well-known/matrix/support")
+		wkMux.Handle("/support", httputil.MakeExternalAPI("wellknown", func(r *http.Request) util.JSONResponse {
 			return util.JSONResponse{
 				Code: http.StatusOK,
-				JSON: response,
+				JSON: WellKnownSupportResponse{
+					Contacts:    support.Contacts,
+					SupportPage: support.SupportPage,
+				},
+				Headers: httputil.CacheHeaders(dendriteCfg.Global.WellKnownCacheMaxAge),
 			}
 		})).Methods(http.MethodGet, http.MethodOptions)
 	}
@@ -171,7 +241,7 @@ func Setup(
 					}
 				}
 				if req.Method == http.MethodPost {
-					return handleSharedSecretRegistration(cfg, userAPI, sr, req)
+					return handleSharedSecretRegistration(cfg, userAPI, sr, req, postRegister)
 				}
 				return util.JSONResponse{
 					Code: http.StatusMethodNotAllowed,
@@ -213,19 +283,181 @@ func Setup(
 
 	dendriteAdminRouter.Handle("/admin/evacuateRoom/{roomID}",
 		httputil.MakeAdminAPI("admin_evacuate_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return AdminEvacuateRoom(req, rsAPI)
+			return AdminEvacuateRoom(req, device, rsAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	dendriteAdminRouter.Handle("/admin/evacuateUser/{userID}",
 		httputil.MakeAdminAPI("admin_evacuate_user", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return AdminEvacuateUser(req, rsAPI)
+			return AdminEvacuateUser(req, device, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/joinRoom/{roomIDOrAlias}",
+		httputil.MakeAdminAPI("admin_join_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminForceJoin(req, cfg, device, rsAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	dendriteAdminRouter.Handle("/admin/purgeRoom/{roomID}",
 		httputil.MakeAdminAPI("admin_purge_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return AdminPurgeRoom(req, rsAPI)
+			return AdminPurgeRoom(req, device, adminTasks)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/roomFederation/{roomID}",
+		httputil.MakeAdminAPI("admin_room_federation", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminSetRoomFederation(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/roomDirectory",
+		httputil.MakeAdminAPI("admin_list_room_directory", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListRoomDirectory(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/roomDirectory/{roomID}",
+		httputil.MakeAdminAPI("admin_unpublish_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminUnpublishRoom(req, rsAPI)
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/roomDirectory/{roomID}/blocked",
+		httputil.MakeAdminAPI("admin_room_directory_blocked", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminSetRoomDirectoryBlocked(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/destinations",
+		httputil.MakeAdminAPI("admin_list_destinations", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListDestinations(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/destinations/{serverName}/unblacklist",
+		httputil.MakeAdminAPI("admin_unblacklist_destination", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminUnblacklistDestination(req, federationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/queues",
+		httputil.MakeAdminAPI("admin_list_destination_queues", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListDestinationQueues(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/queues/{serverName}",
+		httputil.MakeAdminAPI("admin_destination_queue", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminDestinationQueue(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/queues/{serverName}/retry",
+		httputil.MakeAdminAPI("admin_retry_destination_queue", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRetryDestinationQueue(req, federationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/ignoredOrigins",
+		httputil.MakeAdminAPI("admin_list_ignored_origins", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListIgnoredOrigins(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/ignoredOrigins/{serverName}/unignore",
+		httputil.MakeAdminAPI("admin_unignore_origin", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminUnignoreOrigin(req, federationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/resolutionCache",
+		httputil.MakeAdminAPI("admin_list_resolution_cache", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListResolutionCache(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/resolutionCache/{serverName}",
+		httputil.MakeAdminAPI("admin_forget_resolution", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminForgetResolution(req, federationSender)
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/serverKeys",
+		httputil.MakeAdminAPI("admin_list_server_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListServerKeys(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/serverKeys/purgeExpired",
+		httputil.MakeAdminAPI("admin_purge_expired_server_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPurgeExpiredServerKeys(req, federationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/serverKeys/{serverName}",
+		httputil.MakeAdminAPI("admin_server_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListServerKeys(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/serverKeys/{serverName}/refetch",
+		httputil.MakeAdminAPI("admin_refetch_server_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRefetchServerKeys(req, cfg, federationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/repairRoomState/{roomID}",
+		httputil.MakeAdminAPI("admin_repair_room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRepairRoomState(req, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/eventContext/{eventID}",
+		httputil.MakeAdminAPI("admin_event_context", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminEventContext(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/exportRoom/{roomID}",
+		httputil.MakeAdminAPI("admin_export_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminExportRoom(req, device, adminTasks)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/importRoom",
+		httputil.MakeAdminAPI("admin_import_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminImportRoom(req, device, cfg, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/authRejections/{roomID}",
+		httputil.MakeAdminAPI("admin_auth_rejections", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminAuthRejections(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/inputQueue/replay",
+		httputil.MakeAdminAPI("admin_replay_input_queue", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminReplayInputQueue(req, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/streamLag",
+		httputil.MakeAdminAPI("admin_stream_lag", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminStreamLag(req, cfg, natsClient)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/deviceKeysSnapshot",
+		httputil.MakeAdminAPI("admin_device_keys_snapshot", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminDeviceKeysSnapshot(req, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/createUser",
+		httputil.MakeAdminAPI("admin_create_user", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminCreateUser(req, cfg, userAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -241,12 +473,93 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/reloadConfig",
+		httputil.MakeAdminAPI("admin_reload_config", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminReloadConfig(req, dendriteCfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rotateSigningKey",
+		httputil.MakeAdminAPI("admin_rotate_signing_key", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRotateSigningKey(req, dendriteCfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.PathPrefix("/admin/debug/").Handler(
+		httputil.MakeHTTPAPI("admin_debug", userAPI, false,
+			httputil.DebugHandler(httputil.DendriteAdminPathPrefix+"admin", dendriteCfg.Global.Debug.IsEnabled).ServeHTTP,
+			httputil.WithAdminOnly(),
+		),
+	)
+
 	dendriteAdminRouter.Handle("/admin/fulltext/reindex",
 		httputil.MakeAdminAPI("admin_fultext_reindex", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return AdminReindex(req, cfg, device, natsClient)
+			return AdminReindex(req, device, adminTasks)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/tasks",
+		httputil.MakeAdminAPI("admin_tasks", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			switch req.Method {
+			case http.MethodGet:
+				return AdminListTasks(req, adminTasks)
+			case http.MethodPost:
+				return AdminStartTask(req, device, adminTasks)
+			default:
+				return util.MatrixErrorResponse(
+					404,
+					string(spec.ErrorNotFound),
+					"unknown method",
+				)
+			}
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/tasks/{taskID}",
+		httputil.MakeAdminAPI("admin_task", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			switch req.Method {
+			case http.MethodGet:
+				return AdminGetTask(req, adminTasks)
+			case http.MethodDelete:
+				return AdminCancelTask(req, device, adminTasks)
+			default:
+				return util.MatrixErrorResponse(
+					404,
+					string(spec.ErrorNotFound),
+					"unknown method",
+				)
+			}
+		}),
+	).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/tasks/{taskID}/download",
+		httputil.MakeHTTPAPI("admin_task_download", userAPI, enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+			AdminDownloadExport(w, req, cfg, adminTasks)
+		}, httputil.WithAuth(), httputil.WithAdminOnly()),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/exportUserData/{userID}",
+		httputil.MakeAdminAPI("admin_export_user_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminExportUserData(req, device, adminTasks)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	// The provisioner keeps the batches in memory until their task starts,
+	// so it is registered here rather than with the other admin tasks.
+	provisioner := newUserProvisioner(cfg, rsAPI, userAPI, dendriteCfg.UserAPI.BCryptCost)
+	adminTasks.Register(adminTaskCreateUsers, provisioner.provision)
+	dendriteAdminRouter.Handle("/admin/createUsers",
+		httputil.MakeAdminAPI("admin_create_users", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminCreateUsers(req, device, provisioner, adminTasks)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/createUsers/{taskID}/resume",
+		httputil.MakeAdminAPI("admin_resume_create_users", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminResumeCreateUsers(req, device, provisioner, adminTasks)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	dendriteAdminRouter.Handle("/admin/refreshDevices/{userID}",
 		httputil.MakeAdminAPI("admin_refresh_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return AdminMarkAsStale(req, cfg, userAPI)
@@ -256,10 +569,6 @@ func Setup(
 	// server notifications
 	if cfg.Matrix.ServerNotices.Enabled {
 		logrus.Info("Enabling server notices at /_synapse/admin/v1/send_server_notice")
-		serverNotificationSender, err := getSenderDevice(context.Background(), rsAPI, userAPI, cfg)
-		if err != nil {
-			logrus.WithError(err).Fatal("unable to get account for sending sending server notices")
-		}
 
 		synapseAdminRouter.Handle("/admin/v1/send_server_notice/{txnID}",
 			httputil.MakeAuthAPI("send_server_notice", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -312,7 +621,7 @@ func Setup(
 
 	v3mux.Handle("/createRoom",
 		httputil.MakeAuthAPI("createRoom", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return CreateRoom(req, device, cfg, userAPI, rsAPI)
+			return CreateRoom(req, device, cfg, userAPI, rsAPI, spamChecker)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/join/{roomIDOrAlias}",
@@ -397,7 +706,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendInvite(req, userAPI, device, vars["roomID"], cfg, rsAPI)
+			return SendInvite(req, userAPI, device, vars["roomID"], cfg, rsAPI, spamChecker, identity)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/kick",
@@ -424,7 +733,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, federation, nil, delayedEvents, sendLimiter, natsClient, spamChecker)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
@@ -435,7 +744,7 @@ func Setup(
 			}
 			txnID := vars["txnID"]
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
-				nil, cfg, rsAPI, transactionsCache)
+				nil, cfg, rsAPI, federation, transactionsCache, delayedEvents, sendLimiter, natsClient, spamChecker)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -483,7 +792,7 @@ func Setup(
 			}
 			emptyString := ""
 			eventType := strings.TrimSuffix(vars["eventType"], "/")
-			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, federation, nil, delayedEvents, sendLimiter, natsClient, spamChecker)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -494,10 +803,34 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			stateKey := vars["stateKey"]
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, federation, nil, delayedEvents, sendLimiter, natsClient, spamChecker)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 
+	if delayedEvents.Enabled() {
+		unstableMux.Handle("/org.matrix.msc4140/delayed_events",
+			httputil.MakeAuthAPI("delayed_events", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return delayedEvents.GetDelayedEvents(req, device)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		unstableMux.Handle("/org.matrix.msc4140/delayed_events/{delayID}",
+			httputil.MakeAuthAPI("delayed_events", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				// Clients restart the delay of their call membership every
+				// few seconds throughout a call.
+				if !delayedEvents.IsCallMembership(vars["delayID"]) {
+					if r := rateLimits.Limit(req, device); r != nil {
+						return *r
+					}
+				}
+				return delayedEvents.UpdateDelayedEvent(req, device, vars["delayID"])
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
+
 	// Defined outside of handler to persist between calls
 	// TODO: clear based on some criteria
 	roomHierarchyPaginationCache := NewRoomHierarchyPaginationCache()
@@ -515,7 +848,7 @@ func Setup(
 		if r := rateLimits.Limit(req, nil); r != nil {
 			return *r
 		}
-		return Register(req, userAPI, cfg)
+		return Register(req, userAPI, cfg, spamChecker, postRegister)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	v3mux.Handle("/register/available", httputil.MakeExternalAPI("registerAvailable", func(req *http.Request) util.JSONResponse {
@@ -692,10 +1025,60 @@ func Setup(
 			if r := rateLimits.Limit(req, device); r != nil {
 				return *r
 			}
-			return Deactivate(req, userInteractiveAuth, userAPI, device)
+			return Deactivate(req, userInteractiveAuth, userAPI, device, cfg, identity)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	v3mux.Handle("/account/3pid/bind",
+		httputil.MakeAuthAPI("account_3pid_bind", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return Bind3PID(req, userAPI, device, identity)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	v3mux.Handle("/account/3pid/unbind",
+		httputil.MakeAuthAPI("account_3pid_unbind", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return Unbind3PID(req, userAPI, device, cfg, identity)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	if identity.ProxyLookups() {
+		unstableMux.Handle("/org.matrix.dendrite/identity/lookup",
+			httputil.MakeAuthAPI("identity_lookup", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				if r := rateLimits.Limit(req, device); r != nil {
+					return *r
+				}
+				return LookupThreePID(req, identity)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
+
+	unstableMux.Handle("/org.matrix.dendrite/data_export",
+		httputil.MakeAuthAPI("data_export", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return ExportOwnUserData(req, device, adminTasks)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	unstableMux.Handle("/org.matrix.dendrite/data_export/{taskID}",
+		httputil.MakeAuthAPI("data_export", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetOwnUserDataExport(req, device, adminTasks)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	unstableMux.Handle("/org.matrix.dendrite/data_export/{taskID}/download",
+		httputil.MakeHTTPAPI("data_export_download", userAPI, enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+			DownloadOwnUserDataExport(w, req, cfg, userAPI, adminTasks)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	// Stub endpoints required by Element
 
 	v3mux.Handle("/login",
@@ -727,7 +1110,7 @@ func Setup(
 
 	v3mux.Handle("/pushrules/",
 		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return GetAllPushRules(req.Context(), device, userAPI)
+			return GetAllPushRules(req.Context(), device, userAPI, serverPushRules)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -746,7 +1129,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetPushRulesByScope(req.Context(), vars["scope"], device, userAPI)
+			return GetPushRulesByScope(req.Context(), vars["scope"], device, userAPI, serverPushRules)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -774,7 +1157,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetPushRulesByKind(req.Context(), vars["scope"], vars["kind"], device, userAPI)
+			return GetPushRulesByKind(req.Context(), vars["scope"], vars["kind"], device, userAPI, serverPushRules)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -802,7 +1185,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetPushRuleByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], device, userAPI)
+			return GetPushRuleByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], device, userAPI, serverPushRules)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -816,7 +1199,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			query := req.URL.Query()
-			return PutPushRuleByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], query.Get("after"), query.Get("before"), req.Body, device, userAPI)
+			return PutPushRuleByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], query.Get("after"), query.Get("before"), req.Body, device, userAPI, serverPushRules)
 		}),
 	).Methods(http.MethodPut)
 
@@ -826,7 +1209,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return DeletePushRuleByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], device, userAPI)
+			return DeletePushRuleByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], device, userAPI, serverPushRules)
 		}),
 	).Methods(http.MethodDelete)
 
@@ -836,7 +1219,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetPushRuleAttrByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], vars["attr"], device, userAPI)
+			return GetPushRuleAttrByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], vars["attr"], device, userAPI, serverPushRules)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -846,7 +1229,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return PutPushRuleAttrByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], vars["attr"], req.Body, device, userAPI)
+			return PutPushRuleAttrByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], vars["attr"], req.Body, device, userAPI, serverPushRules)
 		}),
 	).Methods(http.MethodPut)
 
@@ -0,0 +1,199 @@
+package routing
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var sendRateLimitRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "clientapi",
+		Name:      "send_rate_limit_rejections_total",
+		Help:      "Number of events which local users were stopped from sending by the send rate limits",
+	},
+	[]string{"limit"},
+)
+
+// sendBucket is a token bucket which refills at a steady rate up to the
+// burst size. Each event sent takes one token from it.
+type sendBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens which have accumulated since the bucket was last
+// updated.
+func (b *sendBucket) refill(now time.Time, rate config.SendRate) {
+	b.tokens = math.Min(float64(rate.Burst), b.tokens+now.Sub(b.updated).Seconds()*rate.EventsPerSecond)
+	b.updated = now
+}
+
+// wait returns how long it will be until the bucket has a token, or zero
+// if it has one now.
+func (b *sendBucket) wait(rate config.SendRate) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate.EventsPerSecond * float64(time.Second))
+}
+
+// sendBucketKey identifies a bucket. The room ID is empty for the buckets
+// which apply to a user across all rooms.
+type sendBucketKey struct {
+	userID string
+	roomID string
+}
+
+// sendRateLimiter limits how quickly local users can send events, both across
+// all rooms and into each room. The room limits are per user, so that one user
+// flooding a room doesn't stop everyone else from sending into it. Users with
+// a high enough power level in the room, appservice users and server
+// administrators are exempt.
+type sendRateLimiter struct {
+	cfg       *config.SendRateLimiting
+	rsAPI     api.ClientRoomserverAPI
+	mu        sync.Mutex
+	users     map[sendBucketKey]*sendBucket // user ID -> events sent
+	rooms     map[sendBucketKey]*sendBucket // user ID and room ID -> events sent
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// newSendRateLimiter returns a sendRateLimiter, or nil if send rate limiting
+// is disabled. A nil sendRateLimiter allows everything.
+func newSendRateLimiter(cfg *config.SendRateLimiting, rsAPI api.ClientRoomserverAPI) *sendRateLimiter {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &sendRateLimiter{
+		cfg:   cfg,
+		rsAPI: rsAPI,
+		users: map[sendBucketKey]*sendBucket{},
+		rooms: map[sendBucketKey]*sendBucket{},
+		now:   time.Now,
+	}
+}
+
+// limit counts an event sent by the device into the room, returning a 429
+// response if the user has gone over either of its limits. Nothing is
+// counted against either if the event is rejected.
+func (l *sendRateLimiter) limit(ctx context.Context, device *userapi.Device, roomID string) *util.JSONResponse {
+	if l == nil {
+		return nil
+	}
+	switch device.AccountType {
+	case userapi.AccountTypeAdmin, userapi.AccountTypeAppService:
+		return nil
+	}
+
+	retryAfter, which := l.take(device.UserID, roomID)
+	if retryAfter == 0 {
+		return nil
+	}
+	// Only look up the power levels once the limit has been reached, so
+	// that they aren't fetched for every event sent.
+	if l.isExempt(ctx, device.UserID, roomID) {
+		return nil
+	}
+	sendRateLimitRejections.WithLabelValues(which).Inc()
+	return &util.JSONResponse{
+		Code: http.StatusTooManyRequests,
+		JSON: spec.LimitExceeded("You are sending events too quickly!", retryAfter.Milliseconds()),
+	}
+}
+
+// take takes a token from both the user's bucket and their bucket for the
+// room if they each have one. Otherwise it returns how long until they both will, and
+// which of the limits was hit.
+func (l *sendRateLimiter) take(userID, roomID string) (time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+
+	user := l.bucket(l.users, sendBucketKey{userID: userID}, now, l.cfg.PerUser)
+	room := l.bucket(l.rooms, sendBucketKey{userID: userID, roomID: roomID}, now, l.cfg.PerRoom)
+	userWait, roomWait := user.wait(l.cfg.PerUser), room.wait(l.cfg.PerRoom)
+	switch {
+	case userWait >= roomWait && userWait > 0:
+		return userWait, "user"
+	case roomWait > 0:
+		return roomWait, "room"
+	}
+	user.tokens--
+	room.tokens--
+	return 0, ""
+}
+
+// bucket returns the refilled bucket for the key, creating a full one if
+// there isn't one yet.
+func (l *sendRateLimiter) bucket(buckets map[sendBucketKey]*sendBucket, key sendBucketKey, now time.Time, rate config.SendRate) *sendBucket {
+	b, ok := buckets[key]
+	if !ok {
+		b = &sendBucket{tokens: float64(rate.Burst), updated: now}
+		buckets[key] = b
+	}
+	b.refill(now, rate)
+	return b
+}
+
+// prune removes full buckets, as they are no different to the ones which
+// would be created in their place. This happens at most once a minute.
+func (l *sendRateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	pruneSendBuckets(l.users, now, l.cfg.PerUser)
+	pruneSendBuckets(l.rooms, now, l.cfg.PerRoom)
+}
+
+func pruneSendBuckets(buckets map[sendBucketKey]*sendBucket, now time.Time, rate config.SendRate) {
+	for key, b := range buckets {
+		b.refill(now, rate)
+		if b.tokens >= float64(rate.Burst) {
+			delete(buckets, key)
+		}
+	}
+}
+
+// isExempt returns whether the user's power level in the room is at least the
+// exempt power level. If it can't be worked out then the user isn't exempt.
+func (l *sendRateLimiter) isExempt(ctx context.Context, userID, roomID string) bool {
+	fullUserID, err := spec.NewUserID(userID, true)
+	if err != nil {
+		return false
+	}
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return false
+	}
+	senderID, err := l.rsAPI.QuerySenderIDForUser(ctx, *validRoomID, *fullUserID)
+	if err != nil || senderID == nil {
+		return false
+	}
+	plEvent := api.GetStateEvent(ctx, l.rsAPI, roomID, gomatrixserverlib.StateKeyTuple{
+		EventType: spec.MRoomPowerLevels,
+		StateKey:  "",
+	})
+	if plEvent == nil {
+		return false
+	}
+	pl, err := plEvent.PowerLevels()
+	if err != nil {
+		return false
+	}
+	return pl.UserLevel(*senderID) >= l.cfg.ExemptPowerLevel
+}
@@ -0,0 +1,112 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/api"
+	rstypes "github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+type fakeSendLimitRoomserverAPI struct {
+	api.ClientRoomserverAPI
+	powerLevels *rstypes.HeaderedEvent
+}
+
+func (f *fakeSendLimitRoomserverAPI) QuerySenderIDForUser(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.SenderID, error) {
+	senderID := spec.SenderID(userID.String())
+	return &senderID, nil
+}
+
+func (f *fakeSendLimitRoomserverAPI) QueryCurrentState(ctx context.Context, req *api.QueryCurrentStateRequest, res *api.QueryCurrentStateResponse) error {
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*rstypes.HeaderedEvent{
+		{EventType: spec.MRoomPowerLevels, StateKey: ""}: f.powerLevels,
+	}
+	return nil
+}
+
+func TestSendRateLimiter(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	var powerLevels *rstypes.HeaderedEvent
+	for _, ev := range room.CurrentState() {
+		if ev.Type() == spec.MRoomPowerLevels {
+			powerLevels = ev
+		}
+	}
+
+	cfg := &config.SendRateLimiting{
+		Enabled:          true,
+		PerUser:          config.SendRate{EventsPerSecond: 1, Burst: 3},
+		PerRoom:          config.SendRate{EventsPerSecond: 1, Burst: 2},
+		ExemptPowerLevel: 50,
+	}
+	l := newSendRateLimiter(cfg, &fakeSendLimitRoomserverAPI{powerLevels: powerLevels})
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+	bobDevice := &userapi.Device{UserID: bob.ID}
+	charlieDevice := &userapi.Device{UserID: charlie.ID}
+
+	// Bob can send a burst of two events into the room before being limited.
+	for i := 0; i < 2; i++ {
+		if res := l.limit(ctx, bobDevice, room.ID); res != nil {
+			t.Fatalf("event %d: expected to be allowed, got %+v", i, res.JSON)
+		}
+	}
+	res := l.limit(ctx, bobDevice, room.ID)
+	if res == nil || res.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected to be limited, got %+v", res)
+	}
+	if err, ok := res.JSON.(spec.LimitExceededError); !ok || err.RetryAfterMS != 1000 {
+		t.Fatalf("expected M_LIMIT_EXCEEDED with a retry of 1000ms, got %+v", res.JSON)
+	}
+
+	// Bob flooding the room doesn't stop Charlie from sending into it.
+	for i := 0; i < 2; i++ {
+		if res = l.limit(ctx, charlieDevice, room.ID); res != nil {
+			t.Fatalf("event %d: expected to be allowed, got %+v", i, res.JSON)
+		}
+	}
+
+	// Bob can still send into another room until their own limit is reached.
+	if res = l.limit(ctx, bobDevice, "!other:test"); res != nil {
+		t.Fatalf("expected another room to be allowed, got %+v", res.JSON)
+	}
+	if res = l.limit(ctx, bobDevice, "!another:test"); res == nil {
+		t.Fatal("expected the user to be limited")
+	}
+
+	// Alice created the room so has a high enough power level to be exempt.
+	for i := 0; i < 5; i++ {
+		if res = l.limit(ctx, &userapi.Device{UserID: alice.ID}, room.ID); res != nil {
+			t.Fatalf("event %d: expected the room creator to be exempt, got %+v", i, res.JSON)
+		}
+	}
+
+	// As are appservice users.
+	if res = l.limit(ctx, &userapi.Device{UserID: bob.ID, AccountType: userapi.AccountTypeAppService}, room.ID); res != nil {
+		t.Fatalf("expected an appservice user to be exempt, got %+v", res.JSON)
+	}
+
+	// The limits refill over time.
+	now = now.Add(time.Second)
+	if res = l.limit(ctx, bobDevice, room.ID); res != nil {
+		t.Fatalf("expected to be allowed after waiting, got %+v", res.JSON)
+	}
+
+	// A disabled limiter allows everything.
+	var disabled *sendRateLimiter
+	if res = disabled.limit(ctx, bobDevice, room.ID); res != nil {
+		t.Fatalf("expected a disabled limiter to allow everything, got %+v", res.JSON)
+	}
+}
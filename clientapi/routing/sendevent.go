@@ -23,9 +23,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/neilalexander/harmony/clientapi/httputil"
+	"github.com/neilalexander/harmony/clientapi/spamcheck"
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/transactions"
 	"github.com/neilalexander/harmony/internal/util"
@@ -75,7 +78,12 @@ func SendEvent(
 	roomID, eventType string, txnID, stateKey *string,
 	cfg *config.ClientAPI,
 	rsAPI api.ClientRoomserverAPI,
+	federation fclient.FederationClient,
 	txnCache *transactions.Cache,
+	delayedEvents *DelayedEvents,
+	sendLimiter *sendRateLimiter,
+	natsClient *nats.Conn,
+	spamChecker *spamcheck.Chain,
 ) util.JSONResponse {
 	roomVersion, err := rsAPI.QueryRoomVersionForRoom(req.Context(), roomID)
 	if err != nil {
@@ -92,6 +100,12 @@ func SendEvent(
 		}
 	}
 
+	// Retries of transactions which have already been sent are answered
+	// from the cache above, so they don't count towards the limits.
+	if resErr := sendLimiter.limit(req.Context(), device, roomID); resErr != nil {
+		return *resErr
+	}
+
 	// create a mutex for the specific user in the specific room
 	// this avoids a situation where events that are received in quick succession are sent to the roomserver in a jumbled order
 	userID := device.UserID
@@ -106,7 +120,53 @@ func SendEvent(
 		return *resErr
 	}
 
-	if stateKey != nil {
+	if spamChecker.Enabled() {
+		content, err := json.Marshal(r)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		modified, resErr := checkSpam(req.Context(), spamChecker, &spamcheck.Request{
+			Action:    spamcheck.ActionSendEvent,
+			UserID:    userID,
+			RoomID:    roomID,
+			EventType: eventType,
+			StateKey:  stateKey,
+			Content:   content,
+		})
+		if resErr != nil {
+			return *resErr
+		}
+		if modified != nil {
+			r = nil
+			if err = json.Unmarshal(modified, &r); err != nil {
+				return util.JSONResponse{
+					Code: http.StatusInternalServerError,
+					JSON: spec.InternalServerError{},
+				}
+			}
+		}
+	}
+
+	delay, resErr := delayedEvents.parseDelay(req)
+	if resErr != nil {
+		return *resErr
+	}
+	if delay > 0 {
+		res := delayedEvents.schedule(req.Context(), device, roomID, eventType, stateKey, r, delay)
+		if txnID != nil && res.Code == http.StatusOK {
+			txnCache.AddTransaction(device.AccessToken, *txnID, req.URL, &res)
+		}
+		return res
+	}
+
+	if stateKey == nil {
+		if resErr = checkDuplicateAnnotation(req.Context(), cfg, natsClient, userID, roomID, eventType, r); resErr != nil {
+			return *resErr
+		}
+	} else {
 		// If the existing/new state content are equal, return the existing event_id, making the request idempotent.
 		if resp := stateEqual(req.Context(), rsAPI, eventType, *stateKey, roomID, r); resp != nil {
 			return *resp
@@ -136,40 +196,10 @@ func SendEvent(
 	}
 	timeToGenerateEvent := time.Since(startedGeneratingEvent)
 
-	// validate that the aliases exists
+	// validate that the aliases exist and point to this room
 	if eventType == spec.MRoomCanonicalAlias && stateKey != nil && *stateKey == "" {
-		aliasReq := api.AliasEvent{}
-		if err = json.Unmarshal(e.Content(), &aliasReq); err != nil {
-			return util.ErrorResponse(fmt.Errorf("unable to parse alias event: %w", err))
-		}
-		if !aliasReq.Valid() {
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: spec.InvalidParam("Request contains invalid aliases."),
-			}
-		}
-		aliasRes := &api.GetAliasesForRoomIDResponse{}
-		if err = rsAPI.GetAliasesForRoomID(req.Context(), &api.GetAliasesForRoomIDRequest{RoomID: roomID}, aliasRes); err != nil {
-			return util.JSONResponse{
-				Code: http.StatusInternalServerError,
-				JSON: spec.InternalServerError{},
-			}
-		}
-		var found int
-		requestAliases := append(aliasReq.AltAliases, aliasReq.Alias)
-		for _, alias := range aliasRes.Aliases {
-			for _, altAlias := range requestAliases {
-				if altAlias == alias {
-					found++
-				}
-			}
-		}
-		// check that we found at least the same amount of existing aliases as are in the request
-		if aliasReq.Alias != "" && found < len(requestAliases) {
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: spec.BadAlias("No matching alias found."),
-			}
+		if resErr = validateCanonicalAlias(req.Context(), rsAPI, federation, cfg, roomID, e.Content()); resErr != nil {
+			return *resErr
 		}
 	}
 
@@ -208,6 +238,9 @@ func SendEvent(
 		"room_id":      roomID,
 		"room_version": roomVersion,
 	}).Info("Sent event to roomserver")
+	if stateKey != nil {
+		delayedEvents.cancelOverwritten(req.Context(), roomID, eventType, *stateKey, userID)
+	}
 
 	res := util.JSONResponse{
 		Code: http.StatusOK,
@@ -257,6 +290,37 @@ func stateEqual(ctx context.Context, rsAPI api.ClientRoomserverAPI, eventType, s
 	return nil
 }
 
+// checkEventLimits rejects events whose type, state key or content are too large
+// to ever be accepted, so that the client gets a clean error before the event is
+// built rather than it being rejected by the roomserver or by remote servers.
+func checkEventLimits(eventType string, stateKey *string, content []byte) *util.JSONResponse {
+	tooLarge := func(msg string) *util.JSONResponse {
+		return &util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: spec.TooLarge(msg),
+		}
+	}
+	if len(eventType) > gomatrixserverlib.MaxIDLength {
+		return tooLarge(fmt.Sprintf("Event type is too long, %d bytes > maximum %d bytes", len(eventType), gomatrixserverlib.MaxIDLength))
+	}
+	if stateKey != nil && len(*stateKey) > gomatrixserverlib.MaxIDLength {
+		return tooLarge(fmt.Sprintf("State key is too long, %d bytes > maximum %d bytes", len(*stateKey), gomatrixserverlib.MaxIDLength))
+	}
+	canonical, err := gomatrixserverlib.CanonicalJSON(content)
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(err.Error()),
+		}
+	}
+	// The content is only part of the event, so if it alone is over the limit
+	// then the event certainly will be.
+	if len(canonical) > gomatrixserverlib.MaxEventLength {
+		return tooLarge(fmt.Sprintf("Event content is too large, %d bytes > maximum %d bytes", len(canonical), gomatrixserverlib.MaxEventLength))
+	}
+	return nil
+}
+
 func generateSendEvent(
 	ctx context.Context,
 	r map[string]interface{},
@@ -310,6 +374,9 @@ func generateSendEvent(
 			JSON: spec.InternalServerError{},
 		}
 	}
+	if resErr := checkEventLimits(eventType, stateKey, proto.Content); resErr != nil {
+		return nil, resErr
+	}
 
 	identity, err := rsAPI.SigningIdentityFor(ctx, *fullUserID)
 	if err != nil {
@@ -337,7 +404,7 @@ func generateSendEvent(
 		if specificErr.Code == gomatrixserverlib.EventValidationTooLarge {
 			return nil, &util.JSONResponse{
 				Code: http.StatusRequestEntityTooLarge,
-				JSON: spec.BadJSON(specificErr.Error()),
+				JSON: spec.TooLarge(specificErr.Error()),
 			}
 		}
 		return nil, &util.JSONResponse{
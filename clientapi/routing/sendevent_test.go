@@ -0,0 +1,49 @@
+package routing
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+)
+
+func TestCheckEventLimits(t *testing.T) {
+	longID := strings.Repeat("a", gomatrixserverlib.MaxIDLength+1)
+	largeContent := []byte(`{"body":"` + strings.Repeat("a", gomatrixserverlib.MaxEventLength) + `"}`)
+
+	for name, tc := range map[string]struct {
+		eventType string
+		stateKey  *string
+		content   []byte
+		tooLarge  bool
+	}{
+		"allowed":             {eventType: "m.room.message", content: []byte(`{"body":"hello"}`)},
+		"empty state key":     {eventType: "m.room.name", stateKey: new(string), content: []byte(`{}`)},
+		"long event type":     {eventType: longID, content: []byte(`{}`), tooLarge: true},
+		"long state key":      {eventType: "m.room.name", stateKey: &longID, content: []byte(`{}`), tooLarge: true},
+		"large content":       {eventType: "m.room.message", content: largeContent, tooLarge: true},
+		"max length type":     {eventType: longID[1:], content: []byte(`{}`)},
+		"multibyte state key": {eventType: "m.room.name", stateKey: func() *string { s := strings.Repeat("é", 128); return &s }(), content: []byte(`{}`), tooLarge: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			res := checkEventLimits(tc.eventType, tc.stateKey, tc.content)
+			if !tc.tooLarge {
+				if res != nil {
+					t.Fatalf("expected the event to be allowed, got %+v", res.JSON)
+				}
+				return
+			}
+			if res == nil {
+				t.Fatal("expected the event to be rejected")
+			}
+			if res.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("expected status %d, got %d", http.StatusRequestEntityTooLarge, res.Code)
+			}
+			if err, ok := res.JSON.(spec.MatrixError); !ok || err.ErrCode != spec.ErrorTooLarge {
+				t.Fatalf("expected M_TOO_LARGE, got %+v", res.JSON)
+			}
+		})
+	}
+}
@@ -13,6 +13,8 @@
 package routing
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 
@@ -47,10 +49,19 @@ func SendToDevice(
 		return *resErr
 	}
 
+	// All messages from this request share a message ID, which lets the
+	// federation sender batch them into a single EDU per destination. If
+	// the client retries the same transaction, the same ID is generated.
+	messageID := util.RandomString(32)
+	if txnID != nil {
+		sum := sha256.Sum256([]byte(device.UserID + "\x00" + device.ID + "\x00" + *txnID))
+		messageID = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
 	for userID, byUser := range httpReq.Messages {
 		for deviceID, message := range byUser {
 			if err := syncProducer.SendToDevice(
-				req.Context(), device.UserID, userID, deviceID, eventType, message,
+				req.Context(), device.UserID, userID, deviceID, eventType, messageID, message,
 			); err != nil {
 				util.GetLogger(req.Context()).WithError(err).Error("eduProducer.SendToDevice failed")
 				return util.JSONResponse{
@@ -21,7 +21,7 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/matrix-org/gomatrix"
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/tokens"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -50,7 +50,6 @@ type sendServerNoticeRequest struct {
 	StateKey string `json:"state_key,omitempty"`
 }
 
-// nolint:gocyclo
 // SendServerNotice sends a message to a specific user. It can only be invoked by an admin.
 func SendServerNotice(
 	req *http.Request,
@@ -100,13 +99,62 @@ func SendServerNotice(
 		}
 	}
 
+	var txnAndSessionID *api.TransactionID
+	if txnID != nil {
+		txnAndSessionID = &api.TransactionID{
+			TransactionID: *txnID,
+			SessionID:     device.SessionID,
+		}
+	}
+
+	eventID, resErr := sendServerNotice(
+		ctx, *userID, map[string]interface{}{
+			"body":    r.Content.Body,
+			"msgtype": r.Content.MsgType,
+		},
+		cfgNotices, cfgClient, userAPI, rsAPI, senderDevice, txnAndSessionID,
+	)
+	if resErr != nil {
+		return *resErr
+	}
+
+	res := util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: sendEventResponse{eventID},
+	}
+	// Add response to transactionsCache
+	if txnID != nil {
+		txnCache.AddTransaction(device.AccessToken, *txnID, req.URL, &res)
+	}
+	return res
+}
+
+// sendServerNotice sends a message to the user in their server notices room,
+// creating the room or inviting them back to it first if needed. It returns
+// the ID of the sent event.
+func sendServerNotice( // nolint:gocyclo
+	ctx context.Context,
+	userID spec.UserID,
+	content map[string]interface{},
+	cfgNotices *config.ServerNotices,
+	cfgClient *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	senderDevice *userapi.Device,
+	txnAndSessionID *api.TransactionID,
+) (string, *util.JSONResponse) {
+	errorResponse := func(err error) (string, *util.JSONResponse) {
+		res := util.ErrorResponse(err)
+		return "", &res
+	}
+
 	// get rooms for specified user
 	allUserRooms := []spec.RoomID{}
 	// Get rooms the user is either joined, invited or has left.
 	for _, membership := range []string{"join", "invite", "leave"} {
-		userRooms, queryErr := rsAPI.QueryRoomsForUser(ctx, *userID, membership)
+		userRooms, queryErr := rsAPI.QueryRoomsForUser(ctx, userID, membership)
 		if queryErr != nil {
-			return util.ErrorResponse(err)
+			return errorResponse(queryErr)
 		}
 		allUserRooms = append(allUserRooms, userRooms...)
 	}
@@ -114,14 +162,13 @@ func SendServerNotice(
 	// get rooms of the sender
 	senderUserID, err := spec.NewUserID(fmt.Sprintf("@%s:%s", cfgNotices.LocalPart, cfgClient.Matrix.ServerName), true)
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("internal server error"),
-		}
+		util.GetLogger(ctx).WithError(err).Error("server notices sender user ID is invalid")
+		res := clienterror.Internal().JSONResponse()
+		return "", &res
 	}
 	senderRooms, err := rsAPI.QueryRoomsForUser(ctx, *senderUserID, "join")
 	if err != nil {
-		return util.ErrorResponse(err)
+		return errorResponse(err)
 	}
 
 	// check if we have rooms in common
@@ -135,7 +182,7 @@ func SendServerNotice(
 	}
 
 	if len(commonRooms) > 1 {
-		return util.ErrorResponse(fmt.Errorf("expected to find one room, but got %d", len(commonRooms)))
+		return errorResponse(fmt.Errorf("expected to find one room, but got %d", len(commonRooms)))
 	}
 
 	var (
@@ -146,19 +193,19 @@ func SendServerNotice(
 	// create a new room for the user
 	if len(commonRooms) == 0 {
 		powerLevelContent := eventutil.InitialPowerLevelsContent(senderUserID.String())
-		powerLevelContent.Users[r.UserID] = -10 // taken from Synapse
+		powerLevelContent.Users[userID.String()] = -10 // taken from Synapse
 		pl, err := json.Marshal(powerLevelContent)
 		if err != nil {
-			return util.ErrorResponse(err)
+			return errorResponse(err)
 		}
 		createContent := map[string]interface{}{}
 		createContent["m.federate"] = false
 		cc, err := json.Marshal(createContent)
 		if err != nil {
-			return util.ErrorResponse(err)
+			return errorResponse(err)
 		}
 		crReq := createRoomRequest{
-			Invite:                    []string{r.UserID},
+			Invite:                    []string{userID.String()},
 			Name:                      cfgNotices.RoomName,
 			Visibility:                "private",
 			Preset:                    spec.PresetPrivateChat,
@@ -174,14 +221,15 @@ func SendServerNotice(
 			roomID = data.RoomID
 
 			// tag the room, so we can later check if the user tries to reject an invite
-			serverAlertTag := gomatrix.TagContent{Tags: map[string]gomatrix.TagProperties{
+			order := 1.0
+			serverAlertTag := eventutil.TagContent{Tags: map[string]eventutil.TagProperties{
 				"m.server_notice": {
-					Order: 1.0,
+					Order: &order,
 				},
 			}}
-			if err = saveTagData(req, r.UserID, roomID, userAPI, serverAlertTag); err != nil {
+			if err = saveTagData(ctx, userID.String(), roomID, userAPI, serverAlertTag); err != nil {
 				util.GetLogger(ctx).WithError(err).Error("saveTagData failed")
-				return util.JSONResponse{
+				return "", &util.JSONResponse{
 					Code: http.StatusInternalServerError,
 					JSON: spec.InternalServerError{},
 				}
@@ -189,58 +237,38 @@ func SendServerNotice(
 
 		default:
 			// if we didn't get a createRoomResponse, we probably received an error, so return that.
-			return roomRes
+			return "", &roomRes
 		}
 	} else {
 		// we've found a room in common, check the membership
-		deviceUserID, err := spec.NewUserID(r.UserID, true)
-		if err != nil {
-			return util.JSONResponse{
-				Code: http.StatusForbidden,
-				JSON: spec.Forbidden("userID doesn't have power level to change visibility"),
-			}
-		}
-
 		roomID = commonRooms[0].String()
 		membershipRes := api.QueryMembershipForUserResponse{}
-		err = rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{UserID: *deviceUserID, RoomID: roomID}, &membershipRes)
+		err = rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{UserID: userID, RoomID: roomID}, &membershipRes)
 		if err != nil {
 			util.GetLogger(ctx).WithError(err).Error("unable to query membership for user")
-			return util.JSONResponse{
+			return "", &util.JSONResponse{
 				Code: http.StatusInternalServerError,
 				JSON: spec.InternalServerError{},
 			}
 		}
 		if !membershipRes.IsInRoom {
 			// re-invite the user
-			res, err := sendInvite(ctx, senderDevice, roomID, r.UserID, "Server notice room", cfgClient, rsAPI, time.Now())
+			res, err := sendInvite(ctx, senderDevice, roomID, userID.String(), "Server notice room", cfgClient, rsAPI, time.Now())
 			if err != nil {
-				return res
+				return "", &res
 			}
 		}
 	}
 
 	startedGeneratingEvent := time.Now()
 
-	request := map[string]interface{}{
-		"body":    r.Content.Body,
-		"msgtype": r.Content.MsgType,
-	}
-	e, resErr := generateSendEvent(ctx, request, senderDevice, roomID, "m.room.message", nil, rsAPI, time.Now())
+	e, resErr := generateSendEvent(ctx, content, senderDevice, roomID, "m.room.message", nil, rsAPI, time.Now())
 	if resErr != nil {
 		logrus.Errorf("failed to send message: %+v", resErr)
-		return *resErr
+		return "", resErr
 	}
 	timeToGenerateEvent := time.Since(startedGeneratingEvent)
 
-	var txnAndSessionID *api.TransactionID
-	if txnID != nil {
-		txnAndSessionID = &api.TransactionID{
-			TransactionID: *txnID,
-			SessionID:     device.SessionID,
-		}
-	}
-
 	// pass the new event to the roomserver and receive the correct event ID
 	// event ID in case of duplicate transaction is discarded
 	startedSubmittingEvent := time.Now()
@@ -250,14 +278,14 @@ func SendServerNotice(
 		[]*types.HeaderedEvent{
 			{PDU: e},
 		},
-		device.UserDomain(),
+		senderDevice.UserDomain(),
 		cfgClient.Matrix.ServerName,
 		cfgClient.Matrix.ServerName,
 		txnAndSessionID,
 		false,
 	); err != nil {
 		util.GetLogger(ctx).WithError(err).Error("SendEvents failed")
-		return util.JSONResponse{
+		return "", &util.JSONResponse{
 			Code: http.StatusInternalServerError,
 			JSON: spec.InternalServerError{},
 		}
@@ -269,21 +297,12 @@ func SendServerNotice(
 	}).Info("Sent event to roomserver")
 	timeToSubmitEvent := time.Since(startedSubmittingEvent)
 
-	res := util.JSONResponse{
-		Code: http.StatusOK,
-		JSON: sendEventResponse{e.EventID()},
-	}
-	// Add response to transactionsCache
-	if txnID != nil {
-		txnCache.AddTransaction(device.AccessToken, *txnID, req.URL, &res)
-	}
-
 	// Take a note of how long it took to generate the event vs submit
 	// it to the roomserver.
 	sendEventDuration.With(prometheus.Labels{"action": "build"}).Observe(float64(timeToGenerateEvent.Milliseconds()))
 	sendEventDuration.With(prometheus.Labels{"action": "submit"}).Observe(float64(timeToSubmitEvent.Milliseconds()))
 
-	return res
+	return e.EventID(), nil
 }
 
 func (r sendServerNoticeRequest) valid() (ok bool) {
@@ -364,8 +383,9 @@ func getSenderDevice(
 	}
 
 	// create an AccessToken
+	_, privateKey := cfg.Matrix.SigningKey()
 	token, err := tokens.GenerateLoginToken(tokens.TokenOptions{
-		ServerPrivateKey: cfg.Matrix.PrivateKey.Seed(),
+		ServerPrivateKey: privateKey.Seed(),
 		ServerName:       string(cfg.Matrix.ServerName),
 		UserID:           accRes.Account.UserID,
 	})
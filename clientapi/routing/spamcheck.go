@@ -0,0 +1,41 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/neilalexander/harmony/clientapi/spamcheck"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
+)
+
+// checkSpam asks the spam checkers whether an action may go ahead. It
+// returns the replacement content if a checker modified the action, or the
+// response to send if the action was rejected or couldn't be checked.
+func checkSpam(ctx context.Context, spamChecker *spamcheck.Chain, req *spamcheck.Request) (json.RawMessage, *util.JSONResponse) {
+	res, err := spamChecker.Check(ctx, req)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("action", req.Action).Error("Spam check failed")
+		return nil, &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	switch res.Decision {
+	case spamcheck.Reject:
+		reason := res.Reason
+		if reason == "" {
+			reason = "This action has been rejected as spam"
+		}
+		util.GetLogger(ctx).WithField("action", req.Action).Info("Spam checker rejected action")
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden(reason),
+		}
+	case spamcheck.Modify:
+		return res.Content, nil
+	default:
+		return nil, nil
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/neilalexander/harmony/clientapi/clienterror"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
@@ -102,10 +103,7 @@ func OnIncomingStateRequest(ctx context.Context, device *userapi.Device, rsAPI a
 		userID, err := spec.NewUserID(device.UserID, true)
 		if err != nil {
 			util.GetLogger(ctx).WithError(err).Error("UserID is invalid")
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: spec.Unknown("Device UserID is invalid"),
-			}
+			return clienterror.Internal().JSONResponse()
 		}
 		err = rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
 			RoomID: roomID,
@@ -137,7 +135,7 @@ func OnIncomingStateRequest(ctx context.Context, device *userapi.Device, rsAPI a
 	}
 
 	util.GetLogger(ctx).WithFields(log.Fields{
-		"roomID":         roomID,
+		"room_id":        roomID,
 		"state_at_event": !wantLatestState,
 	}).Info("Fetching all state")
 
@@ -261,10 +259,7 @@ func OnIncomingStateTypeRequest(
 		userID, err := spec.NewUserID(device.UserID, true)
 		if err != nil {
 			util.GetLogger(ctx).WithError(err).Error("UserID is invalid")
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: spec.Unknown("Device UserID is invalid"),
-			}
+			return clienterror.Internal().JSONResponse()
 		}
 		// The room isn't world-readable so try to work out based on the
 		// user's membership if we want the latest state or not.
@@ -298,7 +293,7 @@ func OnIncomingStateTypeRequest(
 	}
 
 	util.GetLogger(ctx).WithFields(log.Fields{
-		"roomID":         roomID,
+		"room_id":        roomID,
 		"evType":         evType,
 		"stateKey":       stateKey,
 		"state_at_event": !wantLatestState,
@@ -0,0 +1,348 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/neilalexander/harmony/clientapi/clienterror"
+	"github.com/neilalexander/harmony/clientapi/httputil"
+	"github.com/neilalexander/harmony/clientapi/threepid"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/setup/config"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+	"github.com/tidwall/gjson"
+)
+
+type threePIDBindRequest struct {
+	ClientSecret  string `json:"client_secret"`
+	IDServer      string `json:"id_server"`
+	IDAccessToken string `json:"id_access_token"`
+	SID           string `json:"sid"`
+}
+
+type threePIDUnbindRequest struct {
+	IDServer string `json:"id_server"`
+	Medium   string `json:"medium"`
+	Address  string `json:"address"`
+}
+
+type threePIDUnbindResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+type threePIDLookupRequest struct {
+	IDServer      string `json:"id_server"`
+	IDAccessToken string `json:"id_access_token"`
+	Medium        string `json:"medium"`
+	Address       string `json:"address"`
+}
+
+type threePIDLookupResponse struct {
+	MXID string `json:"mxid"`
+}
+
+// Bind3PID implements POST /account/3pid/bind
+func Bind3PID(
+	req *http.Request, userAPI userapi.ClientUserAPI, device *userapi.Device,
+	identity *threepid.IdentityClient,
+) util.JSONResponse {
+	var body threePIDBindRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if body.ClientSecret == "" || body.IDServer == "" || body.IDAccessToken == "" || body.SID == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("client_secret, id_server, id_access_token and sid are required"),
+		}
+	}
+
+	association, err := identity.Bind(req.Context(), body.IDServer, body.IDAccessToken, body.SID, body.ClientSecret, device.UserID)
+	switch {
+	case errors.Is(err, threepid.ErrNotTrusted):
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.NotTrusted(body.IDServer),
+		}
+	case err != nil:
+		util.GetLogger(req.Context()).WithError(err).Error("identity.Bind failed")
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.ThreePIDAuthFailed("The identity server didn't bind the third-party identifier"),
+		}
+	}
+
+	if err = userAPI.PerformSaveThreePIDBinding(req.Context(), device.UserID, &userapi.ThreePIDBinding{
+		Medium:   association.Medium,
+		Address:  association.Address,
+		IDServer: body.IDServer,
+	}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformSaveThreePIDBinding failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// Unbind3PID implements POST /account/3pid/unbind
+func Unbind3PID(
+	req *http.Request, userAPI userapi.ClientUserAPI, device *userapi.Device,
+	cfg *config.ClientAPI, identity *threepid.IdentityClient,
+) util.JSONResponse {
+	var body threePIDUnbindRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if body.Medium == "" || body.Address == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("medium and address are required"),
+		}
+	}
+
+	// If the client didn't say which identity server to unbind from, use the
+	// ones which the identifier was bound to through us.
+	var bindings []userapi.ThreePIDBinding
+	if body.IDServer != "" {
+		bindings = append(bindings, userapi.ThreePIDBinding{
+			Medium:   body.Medium,
+			Address:  body.Address,
+			IDServer: body.IDServer,
+		})
+	} else {
+		existing, err := userAPI.QueryThreePIDBindings(req.Context(), device.UserID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryThreePIDBindings failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		for _, binding := range existing {
+			if binding.Medium == body.Medium && binding.Address == body.Address {
+				bindings = append(bindings, binding)
+			}
+		}
+	}
+
+	result, resErr := unbindThreePIDs(req.Context(), userAPI, cfg, identity, device.UserID, bindings)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: threePIDUnbindResponse{IDServerUnbindResult: result},
+	}
+}
+
+// unbindThreePIDs removes the bindings from their identity servers, returning
+// "success" if every identity server removed them, or "no-support" otherwise.
+func unbindThreePIDs(
+	ctx context.Context, userAPI userapi.ClientUserAPI, cfg *config.ClientAPI,
+	identity *threepid.IdentityClient, userID string, bindings []userapi.ThreePIDBinding,
+) (string, *util.JSONResponse) {
+	if len(bindings) == 0 {
+		return "no-support", nil
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	signingIdentity, err := cfg.Matrix.SigningIdentityFor(domain)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("cfg.Matrix.SigningIdentityFor failed")
+		return "", &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	result := "success"
+	for i := range bindings {
+		binding := &bindings[i]
+		supported, err := identity.Unbind(ctx, signingIdentity, binding.IDServer, userID, binding.Medium, binding.Address)
+		switch {
+		case errors.Is(err, threepid.ErrNotTrusted):
+			return "", &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.NotTrusted(binding.IDServer),
+			}
+		case err != nil:
+			util.GetLogger(ctx).WithError(err).WithField("id_server", binding.IDServer).Error("identity.Unbind failed")
+			result = "no-support"
+			continue
+		case !supported:
+			result = "no-support"
+			continue
+		}
+		if err = userAPI.PerformRemoveThreePIDBinding(ctx, userID, binding); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("userAPI.PerformRemoveThreePIDBinding failed")
+			return "", &util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
+	return result, nil
+}
+
+// LookupThreePID looks up the Matrix ID which a third-party identifier is
+// bound to on the identity server, hashing the identifier on behalf of the
+// client.
+func LookupThreePID(req *http.Request, identity *threepid.IdentityClient) util.JSONResponse {
+	var body threePIDLookupRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if body.IDServer == "" || body.IDAccessToken == "" || body.Medium == "" || body.Address == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("id_server, id_access_token, medium and address are required"),
+		}
+	}
+	mxid, resErr := lookupThreePID(req.Context(), identity, body.IDServer, body.IDAccessToken, body.Medium, body.Address)
+	if resErr != nil {
+		return *resErr
+	}
+	if mxid == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("No Matrix ID is bound to the third-party identifier"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: threePIDLookupResponse{MXID: mxid},
+	}
+}
+
+func lookupThreePID(
+	ctx context.Context, identity *threepid.IdentityClient,
+	idServer, idAccessToken, medium, address string,
+) (string, *util.JSONResponse) {
+	mxid, err := identity.Lookup(ctx, idServer, idAccessToken, medium, address)
+	switch {
+	case errors.Is(err, threepid.ErrNotTrusted):
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.NotTrusted(idServer),
+		}
+	case err != nil:
+		util.GetLogger(ctx).WithError(err).Error("identity.Lookup failed")
+		res := clienterror.BadGateway("The identity server lookup failed").JSONResponse()
+		return "", &res
+	}
+	return mxid, nil
+}
+
+// threePIDInviteStore is the part of the identity client which stores
+// third-party invites.
+type threePIDInviteStore interface {
+	StoreInvite(ctx context.Context, idServer, idAccessToken string, invite *threepid.StoreInviteRequest) (*threepid.StoreInviteResponse, error)
+}
+
+// sendThirdPartyInvite invites a third-party identifier which isn't bound to
+// a Matrix ID. The identity server stores the invite and tells the invitee
+// about it, and the m.room.third_party_invite event carries the token and
+// keys which the invitee's homeserver needs to claim it once they bind the
+// identifier.
+func sendThirdPartyInvite(
+	ctx context.Context, device *userapi.Device, roomID string, body *threepid.MembershipRequest,
+	rsAPI roomserverAPI.ClientRoomserverAPI, profileAPI userapi.ClientUserAPI,
+	identity threePIDInviteStore, evTime time.Time,
+) util.JSONResponse {
+	invite := &threepid.StoreInviteRequest{
+		Medium:  body.Medium,
+		Address: body.Address,
+		RoomID:  roomID,
+		Sender:  device.UserID,
+	}
+
+	// The identity server uses the room's details and the sender's profile
+	// to describe the invite to the invitee.
+	stateRes := roomserverAPI.QueryCurrentStateResponse{}
+	if err := rsAPI.QueryCurrentState(ctx, &roomserverAPI.QueryCurrentStateRequest{
+		RoomID: roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{
+			{EventType: spec.MRoomName, StateKey: ""},
+			{EventType: spec.MRoomCanonicalAlias, StateKey: ""},
+			{EventType: spec.MRoomAvatar, StateKey: ""},
+			{EventType: spec.MRoomJoinRules, StateKey: ""},
+		},
+	}, &stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryCurrentState failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	for tuple, ev := range stateRes.StateEvents {
+		content := gjson.ParseBytes(ev.Content())
+		switch tuple.EventType {
+		case spec.MRoomName:
+			invite.RoomName = content.Get("name").Str
+		case spec.MRoomCanonicalAlias:
+			invite.RoomAlias = content.Get("alias").Str
+		case spec.MRoomAvatar:
+			invite.RoomAvatarURL = content.Get("url").Str
+		case spec.MRoomJoinRules:
+			invite.RoomJoinRules = content.Get("join_rule").Str
+		}
+	}
+	if profile, err := profileAPI.QueryProfile(ctx, device.UserID); err == nil {
+		invite.SenderDisplayName = profile.DisplayName
+		invite.SenderAvatarURL = profile.AvatarURL
+	}
+
+	stored, err := identity.StoreInvite(ctx, body.IDServer, body.IDAccessToken, invite)
+	switch {
+	case errors.Is(err, threepid.ErrNotTrusted):
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.NotTrusted(body.IDServer),
+		}
+	case err != nil:
+		util.GetLogger(ctx).WithError(err).Error("identity.StoreInvite failed")
+		return clienterror.BadGateway("The identity server didn't store the invite").JSONResponse()
+	}
+
+	// public_key and key_validity_url are kept for older servers which
+	// don't understand public_keys.
+	content := map[string]interface{}{
+		"display_name":     stored.DisplayName,
+		"key_validity_url": stored.PublicKeys[0].KeyValidityURL,
+		"public_key":       stored.PublicKeys[0].PublicKey.Encode(),
+		"public_keys":      stored.PublicKeys,
+	}
+	e, resErr := generateSendEvent(ctx, content, device, roomID, spec.MRoomThirdPartyInvite, &stored.Token, rsAPI, evTime)
+	if resErr != nil {
+		return *resErr
+	}
+	domain := device.UserDomain()
+	if err = roomserverAPI.SendEvents(ctx, rsAPI, roomserverAPI.KindNew, []*types.HeaderedEvent{{PDU: e}}, domain, domain, domain, nil, false); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("roomserverAPI.SendEvents failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
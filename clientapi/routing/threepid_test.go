@@ -0,0 +1,336 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/clientapi/threepid"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+// threePIDInviteRoomserverAPI answers queries about the room from its current
+// state and keeps the events which are sent into it.
+type threePIDInviteRoomserverAPI struct {
+	roomserverAPI.ClientRoomserverAPI
+	room *test.Room
+	sent []*types.HeaderedEvent
+}
+
+func (r *threePIDInviteRoomserverAPI) QueryCurrentState(
+	ctx context.Context, req *roomserverAPI.QueryCurrentStateRequest, res *roomserverAPI.QueryCurrentStateResponse,
+) error {
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*types.HeaderedEvent{}
+	for _, ev := range r.room.CurrentState() {
+		for _, tuple := range req.StateTuples {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				res.StateEvents[tuple] = ev
+			}
+		}
+	}
+	return nil
+}
+
+func (r *threePIDInviteRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context, req *roomserverAPI.QueryLatestEventsAndStateRequest, res *roomserverAPI.QueryLatestEventsAndStateResponse,
+) error {
+	if req.RoomID != r.room.ID {
+		return nil
+	}
+	res.RoomExists = true
+	res.RoomVersion = r.room.Version
+	res.LatestEvents = r.room.ForwardExtremities()
+	res.Depth = int64(len(r.room.Events()) + 1)
+	for _, ev := range r.room.CurrentState() {
+		for _, tuple := range req.StateToFetch {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				res.StateEvents = append(res.StateEvents, ev)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *threePIDInviteRoomserverAPI) QuerySenderIDForUser(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.SenderID, error) {
+	senderID := spec.SenderID(userID.String())
+	return &senderID, nil
+}
+
+func (r *threePIDInviteRoomserverAPI) QueryUserIDForSender(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	return spec.NewUserID(string(senderID), true)
+}
+
+func (r *threePIDInviteRoomserverAPI) SigningIdentityFor(ctx context.Context, userID spec.UserID) (fclient.SigningIdentity, error) {
+	return fclient.SigningIdentity{
+		ServerName: userID.Domain(),
+		KeyID:      "ed25519:auto",
+		PrivateKey: test.PrivateKeyA,
+	}, nil
+}
+
+func (r *threePIDInviteRoomserverAPI) InputRoomEvents(
+	ctx context.Context, req *roomserverAPI.InputRoomEventsRequest, res *roomserverAPI.InputRoomEventsResponse,
+) {
+	for _, ire := range req.InputRoomEvents {
+		r.sent = append(r.sent, ire.Event)
+	}
+}
+
+type threePIDInviteProfileAPI struct {
+	userapi.ClientUserAPI
+}
+
+func (p *threePIDInviteProfileAPI) QueryProfile(ctx context.Context, userID string) (*authtypes.Profile, error) {
+	return &authtypes.Profile{DisplayName: "Alice"}, nil
+}
+
+// threePIDInviteStorer stores invites as if it were an identity server.
+type threePIDInviteStorer struct {
+	stored []*threepid.StoreInviteRequest
+	err    error
+}
+
+func (s *threePIDInviteStorer) StoreInvite(
+	ctx context.Context, idServer, idAccessToken string, invite *threepid.StoreInviteRequest,
+) (*threepid.StoreInviteResponse, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.stored = append(s.stored, invite)
+	return &threepid.StoreInviteResponse{
+		Token:       "invitetoken",
+		DisplayName: "b...@e...",
+		PublicKeys: []gomatrixserverlib.PublicKey{{
+			PublicKey:      spec.Base64Bytes("key"),
+			KeyValidityURL: "https://id.example.com/_matrix/identity/v2/pubkey/isvalid",
+		}},
+	}, nil
+}
+
+func TestSendThirdPartyInvite(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, alice, spec.MRoomName, map[string]interface{}{"name": "Test Room"}, test.WithStateKey(""))
+	device := &userapi.Device{UserID: alice.ID}
+	body := &threepid.MembershipRequest{
+		IDServer:      "id.example.com",
+		IDAccessToken: "token",
+		Medium:        "email",
+		Address:       "bob@example.com",
+	}
+
+	// The identity server is told about the room and the inviter, and the
+	// m.room.third_party_invite event carries the token that it stored the
+	// invite under.
+	rsAPI := &threePIDInviteRoomserverAPI{room: room}
+	storer := &threePIDInviteStorer{}
+	res := sendThirdPartyInvite(context.Background(), device, room.ID, body, rsAPI, &threePIDInviteProfileAPI{}, storer, time.Now())
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	if len(storer.stored) != 1 {
+		t.Fatalf("got %d invites stored, want 1", len(storer.stored))
+	}
+	stored := storer.stored[0]
+	if stored.RoomName != "Test Room" || stored.SenderDisplayName != "Alice" || stored.Address != "bob@example.com" {
+		t.Fatalf("unexpected stored invite %+v", stored)
+	}
+	if len(rsAPI.sent) != 1 {
+		t.Fatalf("got %d events sent, want 1", len(rsAPI.sent))
+	}
+	sent := rsAPI.sent[0]
+	if sent.Type() != spec.MRoomThirdPartyInvite || !sent.StateKeyEquals("invitetoken") {
+		t.Fatalf("unexpected event %s with state key %q", sent.Type(), *sent.StateKey())
+	}
+	var content gomatrixserverlib.ThirdPartyInviteContent
+	if err := json.Unmarshal(sent.Content(), &content); err != nil {
+		t.Fatal(err)
+	}
+	if content.DisplayName != "b...@e..." || content.PublicKey == "" || len(content.PublicKeys) != 1 {
+		t.Fatalf("unexpected content %s", sent.Content())
+	}
+
+	// Nothing is sent into the room if the identity server fails.
+	for err, code := range map[error]int{
+		threepid.ErrNotTrusted:    http.StatusBadRequest,
+		errors.New("unreachable"): http.StatusBadGateway,
+	} {
+		rsAPI = &threePIDInviteRoomserverAPI{room: room}
+		res = sendThirdPartyInvite(context.Background(), device, room.ID, body, rsAPI, &threePIDInviteProfileAPI{}, &threePIDInviteStorer{err: err}, time.Now())
+		if res.Code != code {
+			t.Fatalf("got status %d for %q, want %d", res.Code, err, code)
+		}
+		if len(rsAPI.sent) != 0 {
+			t.Fatalf("expected nothing to be sent for %q", err)
+		}
+	}
+}
+
+// threePIDBindingUserAPI keeps the user's bindings, and records the calls
+// which are made to it in the order that they happen.
+type threePIDBindingUserAPI struct {
+	userapi.ClientUserAPI
+	mu       sync.Mutex
+	bindings []userapi.ThreePIDBinding
+	calls    []string
+}
+
+func (u *threePIDBindingUserAPI) record(call string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.calls = append(u.calls, call)
+}
+
+func (u *threePIDBindingUserAPI) PerformSaveThreePIDBinding(ctx context.Context, userID string, binding *userapi.ThreePIDBinding) error {
+	u.bindings = append(u.bindings, *binding)
+	return nil
+}
+
+func (u *threePIDBindingUserAPI) PerformRemoveThreePIDBinding(ctx context.Context, userID string, binding *userapi.ThreePIDBinding) error {
+	for i := range u.bindings {
+		if u.bindings[i] == *binding {
+			u.bindings = append(u.bindings[:i], u.bindings[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (u *threePIDBindingUserAPI) QueryThreePIDBindings(ctx context.Context, userID string) ([]userapi.ThreePIDBinding, error) {
+	return append([]userapi.ThreePIDBinding(nil), u.bindings...), nil
+}
+
+func (u *threePIDBindingUserAPI) PerformAccountDeactivation(
+	ctx context.Context, req *userapi.PerformAccountDeactivationRequest, res *userapi.PerformAccountDeactivationResponse,
+) error {
+	u.record("deactivate " + req.Localpart)
+	return nil
+}
+
+// newThreePIDIdentityServer starts an identity server which binds any
+// identifier and records unbind requests with the user API.
+func newThreePIDIdentityServer(t *testing.T, userAPI *threePIDBindingUserAPI) (*config.ClientAPI, *threepid.IdentityClient, string) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idServer string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_matrix/identity/v2/pubkey/ed25519:0", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"public_key": base64.RawStdEncoding.EncodeToString(publicKey),
+		})
+	})
+	mux.HandleFunc("/_matrix/identity/v2/3pid/bind", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		association, _ := json.Marshal(threepid.Association{
+			Medium:  "email",
+			Address: "alice@example.com",
+			MXID:    req["mxid"],
+			TS:      spec.AsTimestamp(time.Now()),
+		})
+		signed, err := gomatrixserverlib.SignJSON(idServer, "ed25519:0", privateKey, association)
+		if err != nil {
+			t.Error(err)
+		}
+		_, _ = w.Write(signed)
+	})
+	mux.HandleFunc("/_matrix/identity/v2/3pid/unbind", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			MXID     string            `json:"mxid"`
+			ThreePID map[string]string `json:"threepid"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		userAPI.record("unbind " + req.ThreePID["address"])
+		_, _ = w.Write([]byte("{}"))
+	})
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+	idServer = strings.TrimPrefix(srv.URL, "https://")
+
+	cfg := &config.ClientAPI{Matrix: &config.Global{}}
+	cfg.Matrix.ServerName = "test"
+	cfg.Matrix.KeyID = "ed25519:auto"
+	cfg.Matrix.PrivateKey = test.PrivateKeyA
+	cfg.IdentityServers.TrustedServers = []string{idServer}
+	cfg.IdentityServers.Defaults()
+	return cfg, threepid.NewIdentityClientWithHTTPClient(&cfg.IdentityServers, srv.Client()), idServer
+}
+
+func TestBindAndUnbind3PID(t *testing.T) {
+	userAPI := &threePIDBindingUserAPI{}
+	cfg, identity, idServer := newThreePIDIdentityServer(t, userAPI)
+	device := &userapi.Device{UserID: "@alice:test"}
+	request := func(body interface{}) *http.Request {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httptest.NewRequest(http.MethodPost, "/account/3pid", bytes.NewReader(data))
+	}
+
+	// Binding through us is remembered, so that it can be unbound later.
+	res := Bind3PID(request(map[string]string{
+		"client_secret": "secret", "id_server": idServer, "id_access_token": "token", "sid": "sid",
+	}), userAPI, device, identity)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d binding, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	want := userapi.ThreePIDBinding{Medium: "email", Address: "alice@example.com", IDServer: idServer}
+	if len(userAPI.bindings) != 1 || userAPI.bindings[0] != want {
+		t.Fatalf("got bindings %+v, want %+v", userAPI.bindings, want)
+	}
+
+	// Untrusted identity servers aren't asked to bind or unbind anything.
+	res = Bind3PID(request(map[string]string{
+		"client_secret": "secret", "id_server": "untrusted.example.com", "id_access_token": "token", "sid": "sid",
+	}), userAPI, device, identity)
+	if res.Code != http.StatusBadRequest || len(userAPI.bindings) != 1 {
+		t.Fatalf("got status %d and bindings %+v binding with an untrusted identity server", res.Code, userAPI.bindings)
+	}
+	res = Unbind3PID(request(map[string]string{
+		"medium": "email", "address": "alice@example.com", "id_server": "untrusted.example.com",
+	}), userAPI, device, cfg, identity)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d unbinding from an untrusted identity server, want %d", res.Code, http.StatusBadRequest)
+	}
+
+	// Without an id_server, the identity servers which the identifier was
+	// bound to through us are used.
+	res = Unbind3PID(request(map[string]string{
+		"medium": "email", "address": "alice@example.com",
+	}), userAPI, device, cfg, identity)
+	if res.Code != http.StatusOK || res.JSON.(threePIDUnbindResponse).IDServerUnbindResult != "success" {
+		t.Fatalf("got status %d unbinding: %+v", res.Code, res.JSON)
+	}
+	if len(userAPI.bindings) != 0 || len(userAPI.calls) != 1 || userAPI.calls[0] != "unbind alice@example.com" {
+		t.Fatalf("got bindings %+v and calls %v after unbinding", userAPI.bindings, userAPI.calls)
+	}
+
+	// Nothing to unbind from.
+	res = Unbind3PID(request(map[string]string{
+		"medium": "email", "address": "alice@example.com",
+	}), userAPI, device, cfg, identity)
+	if res.Code != http.StatusOK || res.JSON.(threePIDUnbindResponse).IDServerUnbindResult != "no-support" {
+		t.Fatalf("got status %d unbinding with no bindings: %+v", res.Code, res.JSON)
+	}
+}
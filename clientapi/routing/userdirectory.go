@@ -36,6 +36,10 @@ type UserDirectoryResponse struct {
 	Limited bool                              `json:"limited"`
 }
 
+// knownUsersMaxPages is how many pages of the users who share a room with
+// the searching user are looked through for matches.
+const knownUsersMaxPages = 10
+
 func SearchUserDirectory(
 	ctx context.Context,
 	device *userapi.Device,
@@ -56,76 +60,83 @@ func SearchUserDirectory(
 		Limited: false,
 	}
 
-	// Get users we share a room with
+	// Get users we share a room with, a page at a time until there are
+	// enough results
 	knownUsersReq := &api.QueryKnownUsersRequest{
 		UserID: device.UserID,
 		Limit:  limit,
 	}
-	knownUsersRes := &api.QueryKnownUsersResponse{}
-	if err := rsAPI.QueryKnownUsers(ctx, knownUsersReq, knownUsersRes); err != nil && err != sql.ErrNoRows {
-		return util.ErrorResponse(fmt.Errorf("rsAPI.QueryKnownUsers: %w", err))
-	}
-
 knownUsersLoop:
-	for _, profile := range knownUsersRes.Users {
-		if len(results) == limit {
-			response.Limited = true
-			break
+	for page := 0; page < knownUsersMaxPages; page++ {
+		knownUsersRes := &api.QueryKnownUsersResponse{}
+		if err := rsAPI.QueryKnownUsers(ctx, knownUsersReq, knownUsersRes); err != nil && err != sql.ErrNoRows {
+			return util.ErrorResponse(fmt.Errorf("rsAPI.QueryKnownUsers: %w", err))
 		}
-		userID := profile.UserID
-		// get the full profile of the local user
-		localpart, serverName, _ := gomatrixserverlib.SplitID('@', userID)
-		if serverName == localServerName {
-			userReq := &userapi.QuerySearchProfilesRequest{
-				SearchString: localpart,
-				Limit:        limit,
-			}
-			userRes := &userapi.QuerySearchProfilesResponse{}
-			if err := provider.QuerySearchProfiles(ctx, userReq, userRes); err != nil {
-				return util.ErrorResponse(fmt.Errorf("userAPI.QuerySearchProfiles: %w", err))
+
+		for _, profile := range knownUsersRes.Users {
+			if len(results) == limit {
+				response.Limited = true
+				break knownUsersLoop
 			}
-			for _, p := range userRes.Profiles {
-				if strings.Contains(p.DisplayName, searchString) ||
-					strings.Contains(p.Localpart, searchString) {
-					profile.DisplayName = p.DisplayName
-					profile.AvatarURL = p.AvatarURL
+			userID := profile.UserID
+			// get the full profile of the local user
+			localpart, serverName, _ := gomatrixserverlib.SplitID('@', userID)
+			if serverName == localServerName {
+				userReq := &userapi.QuerySearchProfilesRequest{
+					SearchString: localpart,
+					Limit:        limit,
+				}
+				userRes := &userapi.QuerySearchProfilesResponse{}
+				if err := provider.QuerySearchProfiles(ctx, userReq, userRes); err != nil {
+					return util.ErrorResponse(fmt.Errorf("userAPI.QuerySearchProfiles: %w", err))
+				}
+				for _, p := range userRes.Profiles {
+					if strings.Contains(p.DisplayName, searchString) ||
+						strings.Contains(p.Localpart, searchString) {
+						profile.DisplayName = p.DisplayName
+						profile.AvatarURL = p.AvatarURL
+						results[userID] = profile
+						if len(results) == limit {
+							response.Limited = true
+							break knownUsersLoop
+						}
+					}
+				}
+			} else {
+				// If the username already contains the search string, don't bother hitting federation.
+				// This will result in missing avatars and displaynames, but saves the federation roundtrip.
+				if strings.Contains(localpart, searchString) {
 					results[userID] = profile
 					if len(results) == limit {
 						response.Limited = true
 						break knownUsersLoop
 					}
+					continue
 				}
-			}
-		} else {
-			// If the username already contains the search string, don't bother hitting federation.
-			// This will result in missing avatars and displaynames, but saves the federation roundtrip.
-			if strings.Contains(localpart, searchString) {
-				results[userID] = profile
-				if len(results) == limit {
-					response.Limited = true
-					break knownUsersLoop
-				}
-				continue
-			}
-			// TODO: We should probably cache/store this
-			fedProfile, fedErr := federation.LookupProfile(ctx, localServerName, serverName, userID, "")
-			if fedErr != nil {
-				if x, ok := fedErr.(gomatrix.HTTPError); ok {
-					if x.Code == http.StatusNotFound {
-						continue
+				// TODO: We should probably cache/store this
+				fedProfile, fedErr := federation.LookupProfile(ctx, localServerName, serverName, userID, "")
+				if fedErr != nil {
+					if x, ok := fedErr.(gomatrix.HTTPError); ok {
+						if x.Code == http.StatusNotFound {
+							continue
+						}
 					}
 				}
-			}
-			if strings.Contains(fedProfile.DisplayName, searchString) {
-				profile.DisplayName = fedProfile.DisplayName
-				profile.AvatarURL = fedProfile.AvatarURL
-				results[userID] = profile
-				if len(results) == limit {
-					response.Limited = true
-					break knownUsersLoop
+				if strings.Contains(fedProfile.DisplayName, searchString) {
+					profile.DisplayName = fedProfile.DisplayName
+					profile.AvatarURL = fedProfile.AvatarURL
+					results[userID] = profile
+					if len(results) == limit {
+						response.Limited = true
+						break knownUsersLoop
+					}
 				}
 			}
 		}
+		if knownUsersRes.NextBatch == "" {
+			break
+		}
+		knownUsersReq.From = knownUsersRes.NextBatch
 	}
 
 	for _, result := range results {
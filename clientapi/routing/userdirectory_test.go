@@ -0,0 +1,79 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+// knownUsersRoomserverAPI pages through the known users in order, as the
+// roomserver does.
+type knownUsersRoomserverAPI struct {
+	roomserverAPI.ClientRoomserverAPI
+	users   []string
+	queries int
+}
+
+func (r *knownUsersRoomserverAPI) QueryKnownUsers(
+	ctx context.Context, req *roomserverAPI.QueryKnownUsersRequest, res *roomserverAPI.QueryKnownUsersResponse,
+) error {
+	r.queries++
+	for _, userID := range r.users {
+		if userID <= req.From {
+			continue
+		}
+		if len(res.Users) == req.Limit {
+			res.NextBatch = res.Users[len(res.Users)-1].UserID
+			break
+		}
+		res.Users = append(res.Users, authtypes.FullyQualifiedProfile{UserID: userID})
+	}
+	return nil
+}
+
+// searchProfilesAPI gives every local user a display name which is their
+// localpart in upper case.
+type searchProfilesAPI struct{}
+
+func (searchProfilesAPI) QuerySearchProfiles(
+	ctx context.Context, req *userapi.QuerySearchProfilesRequest, res *userapi.QuerySearchProfilesResponse,
+) error {
+	res.Profiles = []authtypes.Profile{{Localpart: req.SearchString, DisplayName: strings.ToUpper(req.SearchString)}}
+	return nil
+}
+
+func TestSearchUserDirectoryPages(t *testing.T) {
+	// Only the last few users match, so they can only be found by
+	// looking through more than one page of known users.
+	rsAPI := &knownUsersRoomserverAPI{}
+	for i := 0; i < 25; i++ {
+		rsAPI.users = append(rsAPI.users, fmt.Sprintf("@user%02d:test", i))
+	}
+	rsAPI.users = append(rsAPI.users, "@wanted1:test", "@wanted2:test")
+	sort.Strings(rsAPI.users)
+
+	device := &userapi.Device{UserID: "@searcher:test"}
+	res := SearchUserDirectory(context.Background(), device, rsAPI, searchProfilesAPI{}, "WANTED", 10, nil, "test")
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.Code, http.StatusOK)
+	}
+	results := res.JSON.(*UserDirectoryResponse).Results
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2: %+v", len(results), results)
+	}
+	for _, result := range results {
+		if !strings.HasPrefix(result.UserID, "@wanted") || result.DisplayName == "" {
+			t.Fatalf("unexpected result %+v", result)
+		}
+	}
+	if rsAPI.queries != 3 {
+		t.Fatalf("got %d queries, want 3", rsAPI.queries)
+	}
+}
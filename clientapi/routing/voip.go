@@ -19,6 +19,7 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
+	"hash/fnv"
 	"net/http"
 	"time"
 
@@ -33,44 +34,59 @@ import (
 // RequestTurnServer implements:
 //
 //	GET /voip/turnServer
+//
+// The user is given credentials for one of the TURN servers, chosen by their
+// user ID so that the same user keeps getting the same server, along with the
+// URIs of all of the STUN servers.
 func RequestTurnServer(req *http.Request, device *api.Device, cfg *config.ClientAPI) util.JSONResponse {
-	turnConfig := cfg.TURN
-
 	// TODO Guest Support
-	if len(turnConfig.URIs) == 0 || turnConfig.UserLifetime == "" {
-		return util.JSONResponse{
-			Code: http.StatusOK,
-			JSON: struct{}{},
+	var turnServers []config.TURNServer
+	var stunURIs []string
+	for _, server := range cfg.TURN.ServerList() {
+		if server.HasCredentials() {
+			turnServers = append(turnServers, server)
+		} else {
+			stunURIs = append(stunURIs, server.URIs...)
 		}
 	}
 
-	// Duration checked at startup, err not possible
-	duration, _ := time.ParseDuration(turnConfig.UserLifetime)
-
-	resp := gomatrix.RespTurnServer{
-		URIs: turnConfig.URIs,
-		TTL:  int(duration.Seconds()),
-	}
-
-	if turnConfig.SharedSecret != "" {
-		expiry := time.Now().Add(duration).Unix()
-		resp.Username = fmt.Sprintf("%d:%s", expiry, device.UserID)
-		mac := hmac.New(sha1.New, []byte(turnConfig.SharedSecret))
-		_, err := mac.Write([]byte(resp.Username))
-
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("mac.Write failed")
+	var resp gomatrix.RespTurnServer
+	switch {
+	case len(turnServers) > 0:
+		server := turnServers[serverIndex(device.UserID, len(turnServers))]
+		if server.UserLifetime == "" {
 			return util.JSONResponse{
-				Code: http.StatusInternalServerError,
-				JSON: spec.InternalServerError{},
+				Code: http.StatusOK,
+				JSON: struct{}{},
 			}
 		}
-
-		resp.Password = base64.StdEncoding.EncodeToString(mac.Sum(nil))
-	} else if turnConfig.Username != "" && turnConfig.Password != "" {
-		resp.Username = turnConfig.Username
-		resp.Password = turnConfig.Password
-	} else {
+		// Duration checked at startup, err not possible
+		duration, _ := time.ParseDuration(server.UserLifetime)
+		resp = gomatrix.RespTurnServer{
+			URIs: append(append([]string{}, server.URIs...), stunURIs...),
+			TTL:  int(duration.Seconds()),
+		}
+		if server.SharedSecret != "" {
+			var err error
+			resp.Username, resp.Password, err = ephemeralTURNCredentials(server.SharedSecret, device.UserID, time.Now().Add(duration))
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("mac.Write failed")
+				return util.JSONResponse{
+					Code: http.StatusInternalServerError,
+					JSON: spec.InternalServerError{},
+				}
+			}
+		} else {
+			resp.Username = server.Username
+			resp.Password = server.Password
+		}
+	case len(stunURIs) > 0 && cfg.TURN.UserLifetime != "":
+		duration, _ := time.ParseDuration(cfg.TURN.UserLifetime)
+		resp = gomatrix.RespTurnServer{
+			URIs: stunURIs,
+			TTL:  int(duration.Seconds()),
+		}
+	default:
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: struct{}{},
@@ -82,3 +98,23 @@ func RequestTurnServer(req *http.Request, device *api.Device, cfg *config.Client
 		JSON: resp,
 	}
 }
+
+// ephemeralTURNCredentials returns credentials for a TURN server using the
+// "TURN REST API" scheme implemented by coturn's use-auth-secret option, where
+// the username is the expiry time and user ID and the password is an HMAC of
+// the username using the shared secret.
+func ephemeralTURNCredentials(sharedSecret, userID string, expiry time.Time) (username, password string, err error) {
+	username = fmt.Sprintf("%d:%s", expiry.Unix(), userID)
+	mac := hmac.New(sha1.New, []byte(sharedSecret))
+	if _, err = mac.Write([]byte(username)); err != nil {
+		return "", "", err
+	}
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// serverIndex picks one of n servers for the user.
+func serverIndex(userID string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userID))
+	return int(h.Sum32() % uint32(n))
+}
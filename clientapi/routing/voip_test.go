@@ -0,0 +1,76 @@
+package routing
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/userapi/api"
+)
+
+func TestRequestTurnServer(t *testing.T) {
+	cfg := &config.ClientAPI{
+		TURN: config.TURN{
+			UserLifetime: "5m",
+			Servers: []config.TURNServer{
+				{URIs: []string{"turn:turn.test"}, SharedSecret: "secret", UserLifetime: "1h"},
+				{URIs: []string{"stun:stun.test"}},
+			},
+		},
+	}
+	device := &api.Device{UserID: "@alice:test"}
+	res := RequestTurnServer(httptest.NewRequest("GET", "/voip/turnServer", nil), device, cfg)
+	resp, ok := res.JSON.(gomatrix.RespTurnServer)
+	if !ok {
+		t.Fatalf("expected TURN server response, got %#v", res.JSON)
+	}
+	if want := []string{"turn:turn.test", "stun:stun.test"}; !reflect.DeepEqual(resp.URIs, want) {
+		t.Errorf("expected URIs %v, got %v", want, resp.URIs)
+	}
+	if resp.TTL != 3600 {
+		t.Errorf("expected the server's own lifetime, got TTL %d", resp.TTL)
+	}
+	if !strings.HasSuffix(resp.Username, ":"+device.UserID) {
+		t.Errorf("expected username to end with the user ID, got %q", resp.Username)
+	}
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte(resp.Username))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); resp.Password != want {
+		t.Errorf("expected password %q, got %q", want, resp.Password)
+	}
+}
+
+func TestRequestTurnServerSpreadsUsers(t *testing.T) {
+	cfg := &config.ClientAPI{
+		TURN: config.TURN{
+			UserLifetime: "5m",
+			URIs:         []string{"turn:a.test"},
+			Username:     "a",
+			Password:     "a",
+			Servers: []config.TURNServer{
+				{URIs: []string{"turn:b.test"}, Username: "b", Password: "b"},
+			},
+		},
+	}
+	seen := map[string]bool{}
+	for _, userID := range []string{"@a:test", "@b:test", "@c:test", "@d:test", "@e:test", "@f:test"} {
+		device := &api.Device{UserID: userID}
+		res := RequestTurnServer(httptest.NewRequest("GET", "/voip/turnServer", nil), device, cfg)
+		first := res.JSON.(gomatrix.RespTurnServer)
+		res = RequestTurnServer(httptest.NewRequest("GET", "/voip/turnServer", nil), device, cfg)
+		if second := res.JSON.(gomatrix.RespTurnServer); first.Username != second.Username {
+			t.Errorf("expected %s to be given the same server each time", userID)
+		}
+		seen[first.Username] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected users to be spread over both servers, got %v", seen)
+	}
+}
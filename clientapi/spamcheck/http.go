@@ -0,0 +1,56 @@
+package spamcheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxHookResponseSize limits how much of the hook's response is read, as
+// it may return replacement content but nothing larger than an event.
+const maxHookResponseSize = 1024 * 1024
+
+// httpHook POSTs each request as JSON to an external service, which must
+// respond with 200 and a JSON Result.
+type httpHook struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPHook(url string, timeout time.Duration) *httpHook {
+	return &httpHook{
+		url: url,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+func (h *httpHook) Check(ctx context.Context, req *Request) (*Result, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	res, err := h.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	var result Result
+	if err = json.NewDecoder(io.LimitReader(res.Body, maxHookResponseSize)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &result, nil
+}
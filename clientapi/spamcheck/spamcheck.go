@@ -0,0 +1,198 @@
+// Package spamcheck lets server operators accept, reject or modify actions
+// taken by local users, such as sending events or creating rooms, without
+// forking the server. Checks are made by modules which are compiled in and
+// registered by name, and optionally by an external HTTP hook.
+package spamcheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Action is the kind of action being checked.
+type Action string
+
+const (
+	ActionSendEvent  Action = "send_event"
+	ActionInvite     Action = "invite"
+	ActionCreateRoom Action = "create_room"
+	ActionRegister   Action = "register"
+)
+
+// Modifiable returns whether checkers may replace the content of the action.
+// Invites and registrations can only be allowed or rejected.
+func (a Action) Modifiable() bool {
+	return a == ActionSendEvent || a == ActionCreateRoom
+}
+
+// Request describes an action which is about to be taken.
+type Request struct {
+	Action Action `json:"action"`
+	// The user taking the action, or being registered
+	UserID string `json:"user_id"`
+	RoomID string `json:"room_id,omitempty"`
+	// The event type and state key of sent events
+	EventType string  `json:"event_type,omitempty"`
+	StateKey  *string `json:"state_key,omitempty"`
+	// The user being invited
+	Invitee string `json:"invitee,omitempty"`
+	// The content of sent events, the /createRoom request body, or details
+	// of the registration
+	Content json.RawMessage `json:"content,omitempty"`
+}
+
+// Decision is what a checker decided to do with an action.
+type Decision string
+
+const (
+	Allow  Decision = "allow"
+	Reject Decision = "reject"
+	Modify Decision = "modify"
+)
+
+// Result is returned by a checker. An empty decision allows the action.
+type Result struct {
+	Decision Decision `json:"decision"`
+	// Why the action was rejected, which is shown to the user
+	Reason string `json:"reason,omitempty"`
+	// The replacement content when the decision is to modify
+	Content json.RawMessage `json:"content,omitempty"`
+}
+
+// Checker is implemented by spam checker modules.
+type Checker interface {
+	Check(ctx context.Context, req *Request) (*Result, error)
+}
+
+// CheckerFunc allows a function to be used as a Checker.
+type CheckerFunc func(ctx context.Context, req *Request) (*Result, error)
+
+func (f CheckerFunc) Check(ctx context.Context, req *Request) (*Result, error) {
+	return f(ctx, req)
+}
+
+// registry holds the modules which have been registered by name.
+type registry struct {
+	mu      sync.RWMutex
+	modules map[string]Checker
+}
+
+func newRegistry() *registry {
+	return &registry{modules: map[string]Checker{}}
+}
+
+// modules are the modules which can be enabled in the config.
+var modules = newRegistry()
+
+// Register makes a module available by name to the spam_checker.modules
+// config option. It is intended to be called from the init function of
+// the package implementing the module, and panics if the name is taken.
+func Register(name string, checker Checker) {
+	modules.register(name, checker)
+}
+
+func (r *registry) register(name string, checker Checker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if checker == nil {
+		panic("spamcheck: Register checker is nil")
+	}
+	if _, dup := r.modules[name]; dup {
+		panic("spamcheck: Register called twice for module " + name)
+	}
+	r.modules[name] = checker
+}
+
+type namedChecker struct {
+	name     string
+	checker  Checker
+	failOpen bool
+}
+
+// Chain runs the configured checkers in order. A nil Chain allows every
+// action.
+type Chain struct {
+	checkers []namedChecker
+}
+
+// New builds the chain of checkers from the config. It fails if any of the
+// configured modules haven't been registered.
+func New(cfg *config.SpamChecker) (*Chain, error) {
+	return modules.newChain(cfg)
+}
+
+func (r *registry) newChain(cfg *config.SpamChecker) (*Chain, error) {
+	c := &Chain{}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, name := range cfg.Modules {
+		checker, ok := r.modules[name]
+		if !ok {
+			return nil, fmt.Errorf("spam checker module %q is not registered", name)
+		}
+		c.checkers = append(c.checkers, namedChecker{name: name, checker: checker})
+	}
+	if cfg.HTTPHook.URL != "" {
+		c.checkers = append(c.checkers, namedChecker{
+			name:     "http_hook",
+			checker:  newHTTPHook(cfg.HTTPHook.URL, cfg.HTTPHook.Timeout),
+			failOpen: cfg.HTTPHook.FailOpen,
+		})
+	}
+	return c, nil
+}
+
+// Enabled returns whether there are any checkers to run, so that callers
+// can avoid building requests that nothing will look at.
+func (c *Chain) Enabled() bool {
+	return c != nil && len(c.checkers) > 0
+}
+
+// Check runs each checker in turn. The first rejection stops the chain. If
+// a checker modifies the action, the following checkers see the modified
+// content and the result carries it. Otherwise the action is allowed.
+func (c *Chain) Check(ctx context.Context, req *Request) (*Result, error) {
+	if !c.Enabled() {
+		return &Result{Decision: Allow}, nil
+	}
+	modified := false
+	for _, nc := range c.checkers {
+		res, err := nc.checker.Check(ctx, req)
+		if err != nil {
+			if nc.failOpen {
+				logrus.WithError(err).WithField("checker", nc.name).Warn("Spam checker failed, allowing action")
+				continue
+			}
+			return nil, fmt.Errorf("spam checker %q: %w", nc.name, err)
+		}
+		if res == nil {
+			continue
+		}
+		switch res.Decision {
+		case Allow, "":
+		case Reject:
+			return res, nil
+		case Modify:
+			if !req.Action.Modifiable() {
+				return nil, fmt.Errorf("spam checker %q can't modify %s actions", nc.name, req.Action)
+			}
+			var object map[string]json.RawMessage
+			if err = json.Unmarshal(res.Content, &object); err != nil {
+				return nil, fmt.Errorf("spam checker %q returned invalid content: %w", nc.name, err)
+			}
+			req.Content = res.Content
+			modified = true
+		default:
+			return nil, fmt.Errorf("spam checker %q returned unknown decision %q", nc.name, res.Decision)
+		}
+	}
+	if modified {
+		return &Result{Decision: Modify, Content: req.Content}, nil
+	}
+	return &Result{Decision: Allow}, nil
+}
@@ -0,0 +1,131 @@
+package spamcheck
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func TestChain(t *testing.T) {
+	modules := newRegistry()
+	modules.register("test_reject_bad_word", CheckerFunc(func(ctx context.Context, req *Request) (*Result, error) {
+		if string(req.Content) == `{"body":"bad"}` {
+			return &Result{Decision: Reject, Reason: "no bad words"}, nil
+		}
+		return nil, nil
+	}))
+	modules.register("test_rewrite", CheckerFunc(func(ctx context.Context, req *Request) (*Result, error) {
+		if string(req.Content) == `{"body":"rewrite"}` {
+			return &Result{Decision: Modify, Content: json.RawMessage(`{"body":"rewritten"}`)}, nil
+		}
+		return nil, nil
+	}))
+
+	if _, err := modules.newChain(&config.SpamChecker{Modules: []string{"unknown"}}); err == nil {
+		t.Fatal("expected an error for an unknown module")
+	}
+
+	var nilChain *Chain
+	if nilChain.Enabled() {
+		t.Fatal("nil chain should not be enabled")
+	}
+
+	chain, err := modules.newChain(&config.SpamChecker{Modules: []string{"test_reject_bad_word", "test_rewrite"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chain.Enabled() {
+		t.Fatal("chain should be enabled")
+	}
+
+	testCases := []struct {
+		name        string
+		action      Action
+		content     string
+		wantErr     bool
+		wantResult  Decision
+		wantContent string
+	}{
+		{name: "allowed", action: ActionSendEvent, content: `{"body":"hello"}`, wantResult: Allow},
+		{name: "rejected", action: ActionSendEvent, content: `{"body":"bad"}`, wantResult: Reject},
+		{name: "modified", action: ActionSendEvent, content: `{"body":"rewrite"}`, wantResult: Modify, wantContent: `{"body":"rewritten"}`},
+		{name: "can't modify invites", action: ActionInvite, content: `{"body":"rewrite"}`, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := chain.Check(context.Background(), &Request{
+				Action:  tc.action,
+				UserID:  "@alice:test",
+				Content: json.RawMessage(tc.content),
+			})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Decision != tc.wantResult {
+				t.Fatalf("got decision %q, want %q", res.Decision, tc.wantResult)
+			}
+			if tc.wantContent != "" && string(res.Content) != tc.wantContent {
+				t.Fatalf("got content %s, want %s", res.Content, tc.wantContent)
+			}
+		})
+	}
+}
+
+func TestHTTPHook(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.UserID {
+		case "@spammer:test":
+			_ = json.NewEncoder(w).Encode(Result{Decision: Reject, Reason: "spammer"})
+		case "@broken:test":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			_ = json.NewEncoder(w).Encode(Result{Decision: Allow})
+		}
+	}))
+	defer srv.Close()
+
+	for _, failOpen := range []bool{true, false} {
+		chain, err := New(&config.SpamChecker{
+			HTTPHook: config.SpamCheckerHTTPHook{
+				URL:      srv.URL,
+				Timeout:  time.Second,
+				FailOpen: failOpen,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := chain.Check(context.Background(), &Request{Action: ActionRegister, UserID: "@alice:test"})
+		if err != nil || res.Decision != Allow {
+			t.Fatalf("expected alice to be allowed, got %+v, %v", res, err)
+		}
+		res, err = chain.Check(context.Background(), &Request{Action: ActionRegister, UserID: "@spammer:test"})
+		if err != nil || res.Decision != Reject || res.Reason != "spammer" {
+			t.Fatalf("expected spammer to be rejected, got %+v, %v", res, err)
+		}
+		res, err = chain.Check(context.Background(), &Request{Action: ActionRegister, UserID: "@broken:test"})
+		if failOpen && (err != nil || res.Decision != Allow) {
+			t.Fatalf("expected hook failure to be allowed when failing open, got %+v, %v", res, err)
+		}
+		if !failOpen && err == nil {
+			t.Fatal("expected hook failure to return an error when failing closed")
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package threepid
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// ErrNotTrusted is returned when asked to talk to an identity server which
+// isn't one of the trusted ones.
+var ErrNotTrusted = errors.New("identity server is not trusted")
+
+// maxResponseSize limits how much of an identity server's response is read.
+const maxResponseSize = 64 * 1024
+
+// Association is a signed association of a third-party identifier with a
+// Matrix ID, as returned by an identity server when binding.
+type Association struct {
+	Medium    string         `json:"medium"`
+	Address   string         `json:"address"`
+	MXID      string         `json:"mxid"`
+	NotBefore spec.Timestamp `json:"not_before"`
+	NotAfter  spec.Timestamp `json:"not_after"`
+	TS        spec.Timestamp `json:"ts"`
+}
+
+// StoreInviteRequest describes a room invite for a third-party identifier
+// which isn't bound to a Matrix ID, which the identity server stores and
+// tells the invitee about.
+type StoreInviteRequest struct {
+	Medium            string `json:"medium"`
+	Address           string `json:"address"`
+	RoomID            string `json:"room_id"`
+	Sender            string `json:"sender"`
+	RoomAlias         string `json:"room_alias,omitempty"`
+	RoomAvatarURL     string `json:"room_avatar_url,omitempty"`
+	RoomJoinRules     string `json:"room_join_rules,omitempty"`
+	RoomName          string `json:"room_name,omitempty"`
+	SenderDisplayName string `json:"sender_display_name,omitempty"`
+	SenderAvatarURL   string `json:"sender_avatar_url,omitempty"`
+}
+
+// StoreInviteResponse carries the token which the invite is stored under
+// and the keys which the identity server will sign the invitee's Matrix ID
+// with once the identifier is bound.
+type StoreInviteResponse struct {
+	Token       string                        `json:"token"`
+	DisplayName string                        `json:"display_name"`
+	PublicKeys  []gomatrixserverlib.PublicKey `json:"public_keys"`
+}
+
+// IdentityClient talks to v2 identity servers on behalf of local users.
+type IdentityClient struct {
+	cfg    *config.IdentityServers
+	client *http.Client
+	scheme string
+}
+
+func NewIdentityClient(cfg *config.IdentityServers) *IdentityClient {
+	return NewIdentityClientWithHTTPClient(cfg, &http.Client{
+		Timeout: cfg.RequestTimeout,
+	})
+}
+
+// NewIdentityClientWithHTTPClient creates an IdentityClient which makes its
+// requests with the given HTTP client, i.e. one which trusts a test server.
+func NewIdentityClientWithHTTPClient(cfg *config.IdentityServers, client *http.Client) *IdentityClient {
+	return &IdentityClient{
+		cfg:    cfg,
+		client: client,
+		scheme: "https",
+	}
+}
+
+// ProxyLookups returns whether clients may look up identifiers through us.
+func (c *IdentityClient) ProxyLookups() bool {
+	return c.cfg.ProxyLookups
+}
+
+// Bind asks the identity server to bind the third-party identifier which was
+// validated in the session to the user. The association which the identity
+// server returns must be signed by it and name the user.
+func (c *IdentityClient) Bind(ctx context.Context, idServer, idAccessToken, sid, clientSecret, userID string) (*Association, error) {
+	body, err := json.Marshal(map[string]string{
+		"sid":           sid,
+		"client_secret": clientSecret,
+		"mxid":          userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	raw, err := c.do(ctx, http.MethodPost, idServer, "/_matrix/identity/v2/3pid/bind", idAccessToken, body)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.verifySignature(ctx, idServer, raw); err != nil {
+		return nil, fmt.Errorf("invalid association: %w", err)
+	}
+	var association Association
+	if err = json.Unmarshal(raw, &association); err != nil {
+		return nil, err
+	}
+	if association.MXID != userID {
+		return nil, fmt.Errorf("association is for %q rather than %q", association.MXID, userID)
+	}
+	now := spec.AsTimestamp(time.Now())
+	if (association.NotBefore != 0 && now < association.NotBefore) || (association.NotAfter != 0 && now > association.NotAfter) {
+		return nil, fmt.Errorf("association is not currently valid")
+	}
+	return &association, nil
+}
+
+// Unbind asks the identity server to remove the binding of the third-party
+// identifier to the user. The request is signed as our server, as the user
+// may no longer have an access token for the identity server. It returns
+// false if the identity server doesn't support unbinding.
+func (c *IdentityClient) Unbind(ctx context.Context, identity *fclient.SigningIdentity, idServer, userID, medium, address string) (bool, error) {
+	if !c.cfg.IsTrusted(idServer) {
+		return false, ErrNotTrusted
+	}
+	fedReq := fclient.NewFederationRequest(http.MethodPost, identity.ServerName, spec.ServerName(idServer), "/_matrix/identity/v2/3pid/unbind")
+	if err := fedReq.SetContent(map[string]interface{}{
+		"mxid": userID,
+		"threepid": map[string]string{
+			"medium":  medium,
+			"address": address,
+		},
+	}); err != nil {
+		return false, err
+	}
+	if err := fedReq.Sign(identity.ServerName, identity.KeyID, identity.PrivateKey); err != nil {
+		return false, err
+	}
+	httpReq, err := fedReq.HTTPRequest()
+	if err != nil {
+		return false, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.URL.Scheme = c.scheme
+	res, err := c.client.Do(httpReq)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound, http.StatusNotImplemented:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+}
+
+// Lookup returns the Matrix ID which the third-party identifier is bound to
+// on the identity server, or an empty string if it isn't bound. The
+// identifier is hashed with the identity server's pepper if it supports it.
+func (c *IdentityClient) Lookup(ctx context.Context, idServer, idAccessToken, medium, address string) (string, error) {
+	raw, err := c.do(ctx, http.MethodGet, idServer, "/_matrix/identity/v2/hash_details", idAccessToken, nil)
+	if err != nil {
+		return "", err
+	}
+	var details struct {
+		Algorithms []string `json:"algorithms"`
+		Pepper     string   `json:"lookup_pepper"`
+	}
+	if err = json.Unmarshal(raw, &details); err != nil {
+		return "", err
+	}
+	algorithm, lookupAddress, err := hashThreePID(details.Algorithms, details.Pepper, medium, address)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"addresses": []string{lookupAddress},
+		"algorithm": algorithm,
+		"pepper":    details.Pepper,
+	})
+	if err != nil {
+		return "", err
+	}
+	raw, err = c.do(ctx, http.MethodPost, idServer, "/_matrix/identity/v2/lookup", idAccessToken, body)
+	if err != nil {
+		return "", err
+	}
+	var lookup struct {
+		Mappings map[string]string `json:"mappings"`
+	}
+	if err = json.Unmarshal(raw, &lookup); err != nil {
+		return "", err
+	}
+	return lookup.Mappings[lookupAddress], nil
+}
+
+// StoreInvite asks the identity server to store the invite until the
+// third-party identifier is bound, and to tell the invitee about it.
+func (c *IdentityClient) StoreInvite(ctx context.Context, idServer, idAccessToken string, invite *StoreInviteRequest) (*StoreInviteResponse, error) {
+	body, err := json.Marshal(invite)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := c.do(ctx, http.MethodPost, idServer, "/_matrix/identity/v2/store-invite", idAccessToken, body)
+	if err != nil {
+		return nil, err
+	}
+	var res StoreInviteResponse
+	if err = json.Unmarshal(raw, &res); err != nil {
+		return nil, err
+	}
+	if res.Token == "" || len(res.PublicKeys) == 0 {
+		return nil, fmt.Errorf("identity server returned no token or public keys")
+	}
+	return &res, nil
+}
+
+// hashThreePID prepares the identifier for a lookup with the best algorithm
+// which the identity server supports.
+func hashThreePID(algorithms []string, pepper, medium, address string) (algorithm, lookupAddress string, err error) {
+	supported := map[string]bool{}
+	for _, algorithm := range algorithms {
+		supported[algorithm] = true
+	}
+	switch {
+	case supported["sha256"]:
+		hash := sha256.Sum256([]byte(address + " " + medium + " " + pepper))
+		return "sha256", base64.RawURLEncoding.EncodeToString(hash[:]), nil
+	case supported["none"]:
+		return "none", address + " " + medium, nil
+	default:
+		return "", "", fmt.Errorf("identity server supports none of our lookup algorithms")
+	}
+}
+
+// verifySignature checks that the JSON has been signed by the identity server
+// with one of its keys.
+func (c *IdentityClient) verifySignature(ctx context.Context, idServer string, raw []byte) error {
+	var signed struct {
+		Signatures map[string]map[gomatrixserverlib.KeyID]spec.Base64Bytes `json:"signatures"`
+	}
+	if err := json.Unmarshal(raw, &signed); err != nil {
+		return err
+	}
+	if len(signed.Signatures[idServer]) == 0 {
+		return fmt.Errorf("not signed by %s", idServer)
+	}
+	var err error
+	for keyID := range signed.Signatures[idServer] {
+		var publicKey ed25519.PublicKey
+		if publicKey, err = c.publicKey(ctx, idServer, keyID); err != nil {
+			continue
+		}
+		if err = gomatrixserverlib.VerifyJSON(idServer, keyID, publicKey, raw); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *IdentityClient) publicKey(ctx context.Context, idServer string, keyID gomatrixserverlib.KeyID) (ed25519.PublicKey, error) {
+	raw, err := c.do(ctx, http.MethodGet, idServer, "/_matrix/identity/v2/pubkey/"+string(keyID), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		PublicKey spec.Base64Bytes `json:"public_key"`
+	}
+	if err = json.Unmarshal(raw, &res); err != nil {
+		return nil, err
+	}
+	if len(res.PublicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q", keyID)
+	}
+	return ed25519.PublicKey(res.PublicKey), nil
+}
+
+// do makes a request to a trusted identity server, returning the body of a
+// successful response.
+func (c *IdentityClient) do(ctx context.Context, method, idServer, path, idAccessToken string, body []byte) ([]byte, error) {
+	if !c.cfg.IsTrusted(idServer) {
+		return nil, ErrNotTrusted
+	}
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.scheme+"://"+idServer+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idAccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+idAccessToken)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	raw, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("identity server returned status code %d: %s", res.StatusCode, raw)
+	}
+	return raw, nil
+}
@@ -0,0 +1,174 @@
+package threepid
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+const testPepper = "matrixrocks"
+
+func newTestIdentityServer(t *testing.T) (*IdentityClient, string) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idServer string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_matrix/identity/v2/pubkey/ed25519:0", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"public_key": base64.RawStdEncoding.EncodeToString(publicKey),
+		})
+	})
+	mux.HandleFunc("/_matrix/identity/v2/3pid/bind", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		association, _ := json.Marshal(Association{
+			Medium:    "email",
+			Address:   "alice@example.com",
+			MXID:      req["mxid"],
+			NotBefore: spec.AsTimestamp(time.Now().Add(-time.Hour)),
+			NotAfter:  spec.AsTimestamp(time.Now().Add(time.Hour)),
+			TS:        spec.AsTimestamp(time.Now()),
+		})
+		signed, err := gomatrixserverlib.SignJSON(idServer, "ed25519:0", privateKey, association)
+		if err != nil {
+			t.Error(err)
+		}
+		_, _ = w.Write(signed)
+	})
+	mux.HandleFunc("/_matrix/identity/v2/3pid/unbind", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "X-Matrix ") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	})
+	mux.HandleFunc("/_matrix/identity/v2/hash_details", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"algorithms":    []string{"none", "sha256"},
+			"lookup_pepper": testPepper,
+		})
+	})
+	mux.HandleFunc("/_matrix/identity/v2/lookup", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Addresses []string `json:"addresses"`
+			Algorithm string   `json:"algorithm"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		hash := sha256.Sum256([]byte("alice@example.com email " + testPepper))
+		mappings := map[string]string{}
+		if req.Algorithm == "sha256" && len(req.Addresses) == 1 && req.Addresses[0] == base64.RawURLEncoding.EncodeToString(hash[:]) {
+			mappings[req.Addresses[0]] = "@alice:test"
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"mappings": mappings})
+	})
+	mux.HandleFunc("/_matrix/identity/v2/store-invite", func(w http.ResponseWriter, r *http.Request) {
+		var req StoreInviteRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req.Medium != "email" || req.RoomID == "" || req.Sender == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(StoreInviteResponse{
+			Token:       "invitetoken",
+			DisplayName: "b...@e...",
+			PublicKeys: []gomatrixserverlib.PublicKey{{
+				PublicKey:      spec.Base64Bytes(publicKey),
+				KeyValidityURL: "https://" + idServer + "/_matrix/identity/v2/pubkey/isvalid",
+			}},
+		})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	idServer = strings.TrimPrefix(srv.URL, "http://")
+
+	cfg := &config.IdentityServers{TrustedServers: []string{idServer}}
+	cfg.Defaults()
+	client := NewIdentityClient(cfg)
+	client.scheme = "http"
+	return client, idServer
+}
+
+func TestIdentityClient(t *testing.T) {
+	ctx := context.Background()
+	client, idServer := newTestIdentityServer(t)
+
+	association, err := client.Bind(ctx, idServer, "token", "sid", "secret", "@alice:test")
+	if err != nil {
+		t.Fatalf("failed to bind: %s", err)
+	}
+	if association.Address != "alice@example.com" || association.MXID != "@alice:test" {
+		t.Fatalf("unexpected association %+v", association)
+	}
+	if _, err = client.Bind(ctx, idServer, "wrong", "sid", "secret", "@alice:test"); err == nil {
+		t.Fatal("expected bind with the wrong access token to fail")
+	}
+
+	mxid, err := client.Lookup(ctx, idServer, "token", "email", "alice@example.com")
+	if err != nil || mxid != "@alice:test" {
+		t.Fatalf("expected lookup to find @alice:test, got %q, %v", mxid, err)
+	}
+	mxid, err = client.Lookup(ctx, idServer, "token", "email", "bob@example.com")
+	if err != nil || mxid != "" {
+		t.Fatalf("expected lookup to find nothing, got %q, %v", mxid, err)
+	}
+
+	stored, err := client.StoreInvite(ctx, idServer, "token", &StoreInviteRequest{
+		Medium:  "email",
+		Address: "bob@example.com",
+		RoomID:  "!room:test",
+		Sender:  "@alice:test",
+	})
+	if err != nil {
+		t.Fatalf("failed to store invite: %s", err)
+	}
+	if stored.Token != "invitetoken" || len(stored.PublicKeys) != 1 {
+		t.Fatalf("unexpected stored invite %+v", stored)
+	}
+	if _, err = client.StoreInvite(ctx, idServer, "token", &StoreInviteRequest{Medium: "email"}); err == nil {
+		t.Fatal("expected storing an invalid invite to fail")
+	}
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	identity := &fclient.SigningIdentity{ServerName: "test", KeyID: "ed25519:auto", PrivateKey: privateKey}
+	supported, err := client.Unbind(ctx, identity, idServer, "@alice:test", "email", "alice@example.com")
+	if err != nil || !supported {
+		t.Fatalf("expected unbind to succeed, got %v, %v", supported, err)
+	}
+
+	if _, err = client.Lookup(ctx, "untrusted.example.com", "token", "email", "alice@example.com"); !errors.Is(err, ErrNotTrusted) {
+		t.Fatalf("expected ErrNotTrusted, got %v", err)
+	}
+	if _, err = client.Unbind(ctx, identity, "untrusted.example.com", "@alice:test", "email", "alice@example.com"); !errors.Is(err, ErrNotTrusted) {
+		t.Fatalf("expected ErrNotTrusted, got %v", err)
+	}
+}
+
+func TestHashThreePID(t *testing.T) {
+	algorithm, address, err := hashThreePID([]string{"none"}, testPepper, "email", "alice@example.com")
+	if err != nil || algorithm != "none" || address != "alice@example.com email" {
+		t.Fatalf("unexpected result %q, %q, %v", algorithm, address, err)
+	}
+	if _, _, err = hashThreePID([]string{"md5"}, testPepper, "email", "alice@example.com"); err == nil {
+		t.Fatal("expected unsupported algorithms to fail")
+	}
+}
@@ -19,4 +19,10 @@ package threepid
 type MembershipRequest struct {
 	UserID string `json:"user_id"`
 	Reason string `json:"reason"`
+	// Invites can name a third-party identifier instead of a user ID, which
+	// is looked up on the identity server
+	IDServer      string `json:"id_server"`
+	IDAccessToken string `json:"id_access_token"`
+	Medium        string `json:"medium"`
+	Address       string `json:"address"`
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+const selectTablesSQL = "" +
+	"SELECT table_name FROM information_schema.tables" +
+	" WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' ORDER BY table_name"
+
+const selectSequencesSQL = "" +
+	"SELECT sequence_name FROM information_schema.sequences" +
+	" WHERE sequence_schema = current_schema() ORDER BY sequence_name"
+
+const selectMediaSQL = "" +
+	"SELECT DISTINCT base64hash, file_size_bytes FROM mediaapi_media_repository" +
+	" WHERE media_origin = $1 ORDER BY base64hash"
+
+// mediaFile is an entry in the media manifest.
+type mediaFile struct {
+	Base64Hash string `json:"base64hash"`
+	Size       int64  `json:"size"`
+}
+
+func createBackup(ctx context.Context, cm *sqlutil.Connections, cfg *config.Dendrite, dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	m := manifest{
+		Version:    internal.VersionString(),
+		ServerName: string(cfg.Global.ServerName),
+		CreatedAt:  time.Now().UnixMilli(),
+	}
+	for _, db := range databases(cfg) {
+		sqlDB, err := connection(cm, cfg, db)
+		if err != nil {
+			return fmt.Errorf("database %s: %w", db.Name, err)
+		}
+		logrus.Infof("Backing up database %s (%v)", db.Name, db.Components)
+		if err = backupDatabaseTo(ctx, sqlDB, &db, filepath.Join(dir, db.Name)); err != nil {
+			return fmt.Errorf("database %s: %w", db.Name, err)
+		}
+		m.Databases = append(m.Databases, db)
+	}
+
+	mediaDB, err := connection(cm, cfg, backupDatabase{Components: []string{"mediaapi"}})
+	if err != nil {
+		return err
+	}
+	if err = writeMediaManifest(ctx, mediaDB, cfg, filepath.Join(dir, "media.jsonl.gz")); err != nil {
+		return fmt.Errorf("media manifest: %w", err)
+	}
+
+	if err = os.Mkdir(filepath.Join(dir, "keys"), 0700); err != nil {
+		return err
+	}
+	for i, path := range keyPaths(cfg) {
+		name := filepath.Join("keys", fmt.Sprintf("%d.pem", i))
+		if err = copyFile(path, filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("signing key %s: %w", path, err)
+		}
+		m.Keys = append(m.Keys, backupKey{File: name, Path: path})
+	}
+
+	manifestJSON, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(dir, "manifest.json"), manifestJSON, 0600); err != nil {
+		return err
+	}
+	logrus.Infof("Backup written to %s", dir)
+	return nil
+}
+
+// backupDatabaseTo writes every table in the database to its own file as
+// JSON, one row per line, and records the sequence positions. It is all
+// read in one repeatable read transaction so that it is consistent.
+func backupDatabaseTo(ctx context.Context, db *sql.DB, bdb *backupDatabase, dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	txn, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback() // nolint: errcheck
+
+	tables, err := queryStrings(ctx, txn, selectTablesSQL)
+	if err != nil {
+		return err
+	}
+	bdb.Tables = make(map[string]int64, len(tables))
+	for _, table := range tables {
+		count, err := backupTable(ctx, txn, table, filepath.Join(dir, table+".jsonl.gz"))
+		if err != nil {
+			return fmt.Errorf("table %s: %w", table, err)
+		}
+		bdb.Tables[table] = count
+	}
+
+	sequences, err := queryStrings(ctx, txn, selectSequencesSQL)
+	if err != nil {
+		return err
+	}
+	for _, name := range sequences {
+		seq := sequence{Name: name}
+		if err = txn.QueryRowContext(ctx,
+			"SELECT last_value, is_called FROM "+pq.QuoteIdentifier(name),
+		).Scan(&seq.LastValue, &seq.IsCalled); err != nil {
+			return fmt.Errorf("sequence %s: %w", name, err)
+		}
+		bdb.Sequences = append(bdb.Sequences, seq)
+	}
+	return nil
+}
+
+// backupTable writes the rows of the table as JSON objects, which Postgres
+// can turn back into rows of the same type with json_populate_record.
+func backupTable(ctx context.Context, txn *sql.Tx, table, path string) (int64, error) {
+	rows, err := txn.QueryContext(ctx, "SELECT row_to_json(t) FROM "+pq.QuoteIdentifier(table)+" t")
+	if err != nil {
+		return 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "backupTable: rows.close() failed")
+	var count int64
+	err = writeGzipLines(path, func(w io.Writer) error {
+		var row []byte
+		for rows.Next() {
+			if err = rows.Scan(&row); err != nil {
+				return err
+			}
+			if _, err = w.Write(append(row, '\n')); err != nil {
+				return err
+			}
+			count++
+		}
+		return rows.Err()
+	})
+	return count, err
+}
+
+// writeMediaManifest lists the files for all local media, so that restore
+// can check that they have all been copied across.
+func writeMediaManifest(ctx context.Context, db *sql.DB, cfg *config.Dendrite, path string) error {
+	rows, err := db.QueryContext(ctx, selectMediaSQL, cfg.Global.ServerName)
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "writeMediaManifest: rows.close() failed")
+	return writeGzipLines(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for rows.Next() {
+			var file mediaFile
+			if err = rows.Scan(&file.Base64Hash, &file.Size); err != nil {
+				return err
+			}
+			if err = enc.Encode(file); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// keyPaths returns the paths of all of the signing keys in the config.
+func keyPaths(cfg *config.Dendrite) []string {
+	paths := []string{absPath(cfg.Global.PrivateKeyPath)}
+	for _, key := range cfg.Global.OldVerifyKeys {
+		if key.PrivateKeyPath != "" {
+			paths = append(paths, absPath(key.PrivateKeyPath))
+		}
+	}
+	for _, host := range cfg.Global.VirtualHosts {
+		if host.PrivateKeyPath != "" {
+			paths = append(paths, absPath(host.PrivateKeyPath))
+		}
+	}
+	return paths
+}
+
+// absPath resolves paths in the config relative to the working directory,
+// which is how they were resolved when the keys were loaded.
+func absPath(path config.Path) string {
+	abs, err := filepath.Abs(string(path))
+	if err != nil {
+		return string(path)
+	}
+	return abs
+}
+
+func queryStrings(ctx context.Context, txn *sql.Tx, query string) ([]string, error) {
+	rows, err := txn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "queryStrings: rows.close() failed")
+	var result []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+func writeGzipLines(path string, write func(w io.Writer) error) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close() // nolint: errcheck
+	gz := gzip.NewWriter(file)
+	buf := bufio.NewWriter(gz)
+	if err = write(buf); err != nil {
+		return err
+	}
+	if err = buf.Flush(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0600)
+}
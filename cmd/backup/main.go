@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/setup"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+	"github.com/sirupsen/logrus"
+)
+
+// This is a utility for taking a logical backup of a server and restoring
+// it into a fresh deployment.
+//
+// create writes every table and sequence of each component database, the
+// signing keys and a manifest of the media files into a new directory. Each
+// database is read in a single transaction, so it is consistent on its own.
+// If components have separate databases, the server should be stopped while
+// the backup is taken, so that they are consistent with each other too. The
+// media files themselves aren't copied, as they are much better copied with
+// something like rsync.
+//
+// restore creates the schema in the configured databases, loads the backup
+// into them and puts the signing keys in place. It then checks that every
+// sequence is at or past the highest value that has been used from it, so
+// that sync tokens which were handed out before the backup stay valid, and
+// that every media file in the manifest exists.
+//
+// Usage: ./backup --config dendrite.yaml create|restore <directory>
+
+func main() {
+	ctx := context.Background()
+	cfg := setup.ParseFlags(true)
+	args := flag.Args()
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: backup --config dendrite.yaml create|restore <directory>")
+		os.Exit(1)
+	}
+	cm := sqlutil.NewConnectionManager(process.NewProcessContext(), cfg.Global.DatabaseOptions)
+
+	var err error
+	switch args[0] {
+	case "create":
+		err = createBackup(ctx, cm, cfg, args[1])
+	case "restore":
+		err = restoreBackup(ctx, cm, cfg, args[1])
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to %s backup", args[0])
+	}
+}
+
+// manifest describes the contents of a backup.
+type manifest struct {
+	Version    string           `json:"version"`
+	ServerName string           `json:"server_name"`
+	CreatedAt  int64            `json:"created_at"`
+	Databases  []backupDatabase `json:"databases"`
+	Keys       []backupKey      `json:"keys"`
+}
+
+// backupKey is a signing key, in the order they appear in the config.
+type backupKey struct {
+	File string `json:"file"` // relative to the backup directory
+	Path string `json:"path"` // where the key was backed up from
+}
+
+// backupDatabase is a database which is shared by one or more components.
+type backupDatabase struct {
+	Name       string           `json:"name"`
+	Components []string         `json:"components"`
+	Tables     map[string]int64 `json:"tables"` // table name -> row count
+	Sequences  []sequence       `json:"sequences"`
+}
+
+type sequence struct {
+	Name      string `json:"name"`
+	LastValue int64  `json:"last_value"`
+	IsCalled  bool   `json:"is_called"`
+}
+
+// databases groups the components by the database they use, as several of
+// them often share the global one.
+func databases(cfg *config.Dendrite) []backupDatabase {
+	byConnection := map[config.DataSource]*backupDatabase{}
+	components := setup.ComponentDatabases(cfg)
+	names := make([]string, 0, len(components))
+	for component := range components {
+		names = append(names, component)
+	}
+	sort.Strings(names)
+	var result []*backupDatabase
+	for _, component := range names {
+		connectionString, name := components[component].ConnectionString, component
+		if connectionString == "" {
+			connectionString, name = cfg.Global.DatabaseOptions.ConnectionString, "global"
+		}
+		db, ok := byConnection[connectionString]
+		if !ok {
+			db = &backupDatabase{Name: name}
+			byConnection[connectionString] = db
+			result = append(result, db)
+		}
+		db.Components = append(db.Components, component)
+	}
+	dbs := make([]backupDatabase, len(result))
+	for i, db := range result {
+		dbs[i] = *db
+	}
+	return dbs
+}
+
+// connection returns the connection for the first component using the
+// database, which is the same for all of them.
+func connection(cm *sqlutil.Connections, cfg *config.Dendrite, db backupDatabase) (*sql.DB, error) {
+	sqlDB, _, err := cm.Connection(setup.ComponentDatabases(cfg)[db.Components[0]])
+	return sqlDB, err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/mediaapi/fileutils"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+)
+
+func newConfig(t *testing.T, connStr string) *config.Dendrite {
+	t.Helper()
+	var cfg config.Dendrite
+	cfg.Defaults(config.DefaultOpts{SingleDatabase: true})
+	cfg.Global.ServerName = "test"
+	cfg.Global.DatabaseOptions.ConnectionString = config.DataSource(connStr)
+	cfg.Global.PrivateKeyPath = config.Path(filepath.Join(t.TempDir(), "matrix_key.pem"))
+	cfg.MediaAPI.AbsBasePath = config.Path(t.TempDir())
+	return &cfg
+}
+
+func TestDatabases(t *testing.T) {
+	cfg := newConfig(t, "postgres://global")
+	cfg.MediaAPI.Database.ConnectionString = "postgres://media"
+	cfg.SyncAPI.Database.ConnectionString = "postgres://global"
+
+	// Components which use the same database are backed up together, under
+	// the name of the first component using it unless it's the global one.
+	got := databases(cfg)
+	want := []backupDatabase{
+		{Name: "global", Components: []string{"federationapi", "keyserver", "mscs", "roomserver", "syncapi", "userapi"}},
+		{Name: "mediaapi", Components: []string{"mediaapi"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got databases %+v, want %+v", got, want)
+	}
+}
+
+func TestRestoreKeys(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newConfig(t, "")
+	cfg.Global.OldVerifyKeys = []*config.OldVerifyKeys{
+		{PrivateKeyPath: config.Path(filepath.Join(dir, "old.pem"))},
+		{KeyID: "ed25519:public"}, // only the public key is known, so there is nothing to back up
+	}
+	paths := keyPaths(cfg)
+	if want := []string{string(cfg.Global.PrivateKeyPath), filepath.Join(dir, "old.pem")}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got key paths %v, want %v", paths, want)
+	}
+
+	backupDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(backupDir, "keys"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	m := manifest{}
+	for i, key := range []string{"current", "old"} {
+		file := filepath.Join("keys", key+".pem")
+		if err := os.WriteFile(filepath.Join(backupDir, file), []byte(key), 0600); err != nil {
+			t.Fatal(err)
+		}
+		m.Keys = append(m.Keys, backupKey{File: file, Path: paths[i]})
+	}
+
+	// A different key which is already in place is kept, and a missing
+	// key is written.
+	if err := os.WriteFile(paths[0], []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreKeys(cfg, m, backupDir); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		paths[0]:          "current",
+		paths[0] + ".bak": "other",
+		paths[1]:          "old",
+	} {
+		if got, err := os.ReadFile(path); err != nil || string(got) != want {
+			t.Fatalf("got %q, %v in %s, want %q", got, err, path, want)
+		}
+	}
+	// Restoring again leaves the keys as they are.
+	if err := restoreKeys(cfg, m, backupDir); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(paths[0] + ".bak"); err != nil || string(got) != "other" {
+		t.Fatalf("got %q, %v in the backup of the key", got, err)
+	}
+
+	// The keys must line up with the config.
+	m.Keys = m.Keys[:1]
+	if err := restoreKeys(cfg, m, backupDir); err == nil {
+		t.Fatal("expected restoring too few keys to fail")
+	}
+}
+
+func TestCheckMedia(t *testing.T) {
+	cfg := newConfig(t, "")
+	files := []mediaFile{
+		{Base64Hash: "present", Size: 4},
+		{Base64Hash: "wrongsize", Size: 10},
+		{Base64Hash: "missing", Size: 4},
+	}
+	for _, file := range files[:2] {
+		path, err := fileutils.GetPathFromBase64Hash(types.Base64Hash(file.Base64Hash), cfg.MediaAPI.AbsBasePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(path, []byte("file"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifestPath := filepath.Join(t.TempDir(), "media.jsonl.gz")
+	if err := writeGzipLines(manifestPath, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, file := range files {
+			if err := enc.Encode(file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := checkMedia(cfg, manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing != 2 {
+		t.Fatalf("got %d missing files, want 2", missing)
+	}
+	// Backups are never written over.
+	if err = writeGzipLines(manifestPath, func(w io.Writer) error { return nil }); err == nil {
+		t.Fatal("expected writing over the manifest to fail")
+	}
+}
+
+func TestNextvalRegexp(t *testing.T) {
+	for columnDefault, want := range map[string]string{
+		"nextval('syncapi_stream_id'::regclass)":          "syncapi_stream_id",
+		`nextval('"roomserver_event_nid_seq"'::regclass)`: "roomserver_event_nid_seq",
+		"0": "",
+		"nextval('syncapi_stream_id'::regclass) + 1": "",
+	} {
+		got := ""
+		if match := nextvalRegexp.FindStringSubmatch(columnDefault); match != nil {
+			got = match[1]
+		}
+		if got != want {
+			t.Errorf("got sequence %q for %s, want %q", got, columnDefault, want)
+		}
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		ctx := context.Background()
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		cfg := newConfig(t, connStr)
+		cm := sqlutil.NewConnectionManager(nil, cfg.Global.DatabaseOptions)
+		if err := setup.OpenStorage(ctx, cm, cfg); err != nil {
+			t.Fatal(err)
+		}
+		db, _, err := cm.Connection(&cfg.Global.DatabaseOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(string(cfg.Global.PrivateKeyPath), []byte("key"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// Add an account and use the stream position sequence, which the
+		// restore must carry on from.
+		if _, err = db.Exec(
+			"INSERT INTO userapi_accounts (localpart, server_name, created_ts, password_hash, account_type) VALUES ('alice', 'test', 0, 'hash', 1)",
+		); err != nil {
+			t.Fatal(err)
+		}
+		var position int64
+		for i := 0; i < 5; i++ {
+			if err = db.QueryRow("SELECT nextval('syncapi_stream_id')").Scan(&position); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dir := filepath.Join(t.TempDir(), "backup")
+		if err = createBackup(ctx, cm, cfg, dir); err != nil {
+			t.Fatal(err)
+		}
+		var m manifest
+		manifestJSON, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(manifestJSON, &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.ServerName != "test" || len(m.Databases) != 1 || m.Databases[0].Tables["userapi_accounts"] != 1 || len(m.Keys) != 1 {
+			t.Fatalf("unexpected manifest %s", manifestJSON)
+		}
+		// Backups are never written over.
+		if err = createBackup(ctx, cm, cfg, dir); err == nil {
+			t.Fatal("expected backing up into an existing directory to fail")
+		}
+
+		// Restoring into the same deployment would mix the two up.
+		if err = restoreBackup(ctx, cm, cfg, dir); err == nil || !strings.Contains(err.Error(), "fresh deployment") {
+			t.Fatalf("expected restoring over the deployment to fail, got %v", err)
+		}
+		// Nor can it be restored into a different server.
+		otherCfg := newConfig(t, connStr)
+		otherCfg.Global.ServerName = "other"
+		if err = restoreBackup(ctx, cm, otherCfg, dir); err == nil {
+			t.Fatal("expected restoring a backup of another server to fail")
+		}
+
+		// Restore into a fresh database and a fresh key path.
+		closeDB()
+		cfg.Global.PrivateKeyPath = config.Path(filepath.Join(t.TempDir(), "matrix_key.pem"))
+		if err = restoreBackup(ctx, cm, cfg, dir); err != nil {
+			t.Fatal(err)
+		}
+		var localpart string
+		if err = db.QueryRow("SELECT localpart FROM userapi_accounts").Scan(&localpart); err != nil || localpart != "alice" {
+			t.Fatalf("got account %q, %v", localpart, err)
+		}
+		var next int64
+		if err = db.QueryRow("SELECT nextval('syncapi_stream_id')").Scan(&next); err != nil || next != position+1 {
+			t.Fatalf("got stream position %d, %v, want %d", next, err, position+1)
+		}
+		if key, err := os.ReadFile(string(cfg.Global.PrivateKeyPath)); err != nil || string(key) != "key" {
+			t.Fatalf("got key %q, %v", key, err)
+		}
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/mediaapi/fileutils"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// restoreBatchSize is the number of rows inserted per transaction.
+const restoreBatchSize = 1000
+
+// freshTables must be empty in the databases being restored into, so that
+// a backup doesn't get mixed in with an existing deployment.
+var freshTables = []string{"userapi_accounts", "roomserver_events", "syncapi_output_room_events"}
+
+const selectSequenceColumnsSQL = "" +
+	"SELECT table_name, column_name, column_default FROM information_schema.columns" +
+	" WHERE table_schema = current_schema() AND column_default LIKE 'nextval(%'"
+
+var nextvalRegexp = regexp.MustCompile(`^nextval\('"?([^'"]+)"?'::regclass\)$`)
+
+func restoreBackup(ctx context.Context, cm *sqlutil.Connections, cfg *config.Dendrite, dir string) error {
+	manifestJSON, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	var m manifest
+	if err = json.Unmarshal(manifestJSON, &m); err != nil {
+		return fmt.Errorf("manifest: %w", err)
+	}
+	if m.ServerName != string(cfg.Global.ServerName) {
+		return fmt.Errorf("backup is of %s but the config is for %s", m.ServerName, cfg.Global.ServerName)
+	}
+	if m.Version != internal.VersionString() {
+		logrus.Warnf("Backup was taken by version %s, this is version %s", m.Version, internal.VersionString())
+	}
+	current := databases(cfg)
+	if len(current) != len(m.Databases) {
+		return fmt.Errorf("backup has %d databases but the config has %d, the components must share databases in the same way", len(m.Databases), len(current))
+	}
+	for i := range current {
+		if current[i].Name != m.Databases[i].Name {
+			return fmt.Errorf("backup has database %s but the config has %s, the components must share databases in the same way", m.Databases[i].Name, current[i].Name)
+		}
+	}
+
+	// Opening the storage creates all of the tables, at which point the
+	// backup can be loaded into them.
+	if err = setup.OpenStorage(ctx, cm, cfg); err != nil {
+		return err
+	}
+	for _, bdb := range m.Databases {
+		db, err := connection(cm, cfg, bdb)
+		if err != nil {
+			return fmt.Errorf("database %s: %w", bdb.Name, err)
+		}
+		logrus.Infof("Restoring database %s (%v)", bdb.Name, bdb.Components)
+		if err = restoreDatabase(ctx, db, bdb, filepath.Join(dir, bdb.Name)); err != nil {
+			return fmt.Errorf("database %s: %w", bdb.Name, err)
+		}
+		if err = checkSequences(ctx, db); err != nil {
+			return fmt.Errorf("database %s: %w", bdb.Name, err)
+		}
+	}
+
+	if err = restoreKeys(cfg, m, dir); err != nil {
+		return err
+	}
+	missing, err := checkMedia(cfg, filepath.Join(dir, "media.jsonl.gz"))
+	if err != nil {
+		return fmt.Errorf("media manifest: %w", err)
+	}
+	if missing > 0 {
+		logrus.Warnf("%d media files are missing from %s, copy them from the old media store", missing, cfg.MediaAPI.AbsBasePath)
+	}
+	logrus.Info("Backup restored")
+	return nil
+}
+
+func restoreDatabase(ctx context.Context, db *sql.DB, bdb backupDatabase, dir string) error {
+	for _, table := range freshTables {
+		if _, ok := bdb.Tables[table]; !ok {
+			continue
+		}
+		var count int64
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+pq.QuoteIdentifier(table)).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("%s isn't empty, backups can only be restored into a fresh deployment", table)
+		}
+	}
+
+	tables := make([]string, 0, len(bdb.Tables))
+	for table := range bdb.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		if err := restoreTable(ctx, db, table, filepath.Join(dir, table+".jsonl.gz")); err != nil {
+			return fmt.Errorf("table %s: %w", table, err)
+		}
+		// Some tables are populated when they are created, so there may be
+		// more rows than in the backup, but never fewer.
+		var count int64
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+pq.QuoteIdentifier(table)).Scan(&count); err != nil {
+			return err
+		}
+		if count < bdb.Tables[table] {
+			return fmt.Errorf("table %s: restored %d rows but the backup has %d", table, count, bdb.Tables[table])
+		}
+	}
+
+	for _, seq := range bdb.Sequences {
+		if _, err := db.ExecContext(ctx, "SELECT setval($1, $2, $3)", seq.Name, seq.LastValue, seq.IsCalled); err != nil {
+			return fmt.Errorf("sequence %s: %w", seq.Name, err)
+		}
+	}
+	return nil
+}
+
+// restoreTable inserts the rows from the backup, letting Postgres convert
+// them back from JSON. Rows which conflict with those that were added when
+// the table was created are skipped.
+func restoreTable(ctx context.Context, db *sql.DB, table, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close() // nolint: errcheck
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	insertSQL := fmt.Sprintf(
+		"INSERT INTO %[1]s SELECT * FROM json_populate_record(NULL::%[1]s, $1) ON CONFLICT DO NOTHING",
+		pq.QuoteIdentifier(table),
+	)
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(nil, 64*1024*1024)
+	for more := true; more; {
+		err = sqlutil.WithTransaction(db, func(txn *sql.Tx) error {
+			stmt, err := txn.PrepareContext(ctx, insertSQL)
+			if err != nil {
+				return err
+			}
+			defer internal.CloseAndLogIfError(ctx, stmt, "restoreTable: stmt.close() failed")
+			for i := 0; i < restoreBatchSize; i++ {
+				if more = scanner.Scan(); !more {
+					return scanner.Err()
+				}
+				if _, err = stmt.ExecContext(ctx, string(scanner.Bytes())); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSequences makes sure that no sequence is behind the values already
+// used from it. Sync tokens are made from stream positions which come from
+// sequences, so if one was behind, positions would be handed out again and
+// clients would miss whatever was sent with them.
+func checkSequences(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, selectSequenceColumnsSQL)
+	if err != nil {
+		return err
+	}
+	type column struct{ table, name, sequence string }
+	var columns []column
+	for rows.Next() {
+		var c column
+		var columnDefault string
+		if err = rows.Scan(&c.table, &c.name, &columnDefault); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if match := nextvalRegexp.FindStringSubmatch(columnDefault); match != nil {
+			c.sequence = match[1]
+			columns = append(columns, c)
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+	for _, c := range columns {
+		var maxValue, lastValue int64
+		if err = db.QueryRowContext(ctx, fmt.Sprintf(
+			"SELECT COALESCE(MAX(%s), 0) FROM %s", pq.QuoteIdentifier(c.name), pq.QuoteIdentifier(c.table),
+		)).Scan(&maxValue); err != nil {
+			return fmt.Errorf("%s.%s: %w", c.table, c.name, err)
+		}
+		if err = db.QueryRowContext(ctx,
+			"SELECT last_value FROM "+pq.QuoteIdentifier(c.sequence),
+		).Scan(&lastValue); err != nil {
+			return fmt.Errorf("sequence %s: %w", c.sequence, err)
+		}
+		if lastValue < maxValue {
+			return fmt.Errorf("sequence %s is at %d but %s.%s has already used %d", c.sequence, lastValue, c.table, c.name, maxValue)
+		}
+	}
+	return nil
+}
+
+// restoreKeys puts the signing keys from the backup at the paths given in
+// the config, keeping a copy of any other key which is already there.
+func restoreKeys(cfg *config.Dendrite, m manifest, dir string) error {
+	paths := keyPaths(cfg)
+	if len(paths) != len(m.Keys) {
+		return fmt.Errorf("backup has %d signing keys but the config has %d", len(m.Keys), len(paths))
+	}
+	for i, backupKey := range m.Keys {
+		key, err := os.ReadFile(filepath.Join(dir, backupKey.File))
+		if err != nil {
+			return err
+		}
+		existing, err := os.ReadFile(paths[i])
+		switch {
+		case err == nil && bytes.Equal(existing, key):
+			continue
+		case err == nil:
+			if err = os.Rename(paths[i], paths[i]+".bak"); err != nil {
+				return err
+			}
+			logrus.Warnf("Replaced signing key %s, the old key was moved to %s.bak", paths[i], paths[i])
+		case !os.IsNotExist(err):
+			return err
+		}
+		if err = os.WriteFile(paths[i], key, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMedia returns the number of files in the media manifest which are
+// missing from the media store or which are the wrong size.
+func checkMedia(cfg *config.Dendrite, path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close() // nolint: errcheck
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+	missing := 0
+	dec := json.NewDecoder(gz)
+	for dec.More() {
+		var media mediaFile
+		if err = dec.Decode(&media); err != nil {
+			return missing, err
+		}
+		filePath, err := fileutils.GetPathFromBase64Hash(types.Base64Hash(media.Base64Hash), cfg.MediaAPI.AbsBasePath)
+		if err != nil {
+			return missing, err
+		}
+		if stat, err := os.Stat(filePath); err != nil || stat.Size() != media.Size {
+			logrus.Debugf("Media file %s is missing", filePath)
+			missing++
+		}
+	}
+	return missing, nil
+}
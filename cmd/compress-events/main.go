@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/caching"
+	"github.com/neilalexander/harmony/internal/eventcompress"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	roomserverStorage "github.com/neilalexander/harmony/roomserver/storage"
+	"github.com/neilalexander/harmony/setup"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+	syncapiStorage "github.com/neilalexander/harmony/syncapi/storage"
+)
+
+// This is a utility for rewriting event JSON which is already stored in the
+// roomserver and sync API databases using the compression algorithm that is
+// currently configured for each of them. It can be used after turning on
+// event_compression to compress old events, or after turning it off to
+// decompress them again. It is safe to run while the server is running and
+// to interrupt, as rows are rewritten in small batches and values in either
+// form are always readable. Each batch is locked while it is rewritten, so
+// that an event which is redacted at the same time keeps its redaction.
+//
+// Usage: ./compress-events --config dendrite.yaml [--batch-size=1000]
+
+var batchSize = flag.Int("batch-size", 1000, "the number of rows to rewrite per transaction")
+
+// eventJSONTable describes where event JSON is stored in a table. The key
+// column must be unique so that the table can be walked in key order.
+type eventJSONTable struct {
+	name       string
+	keyColumn  string
+	jsonColumn string
+	startKey   string
+}
+
+var roomserverTables = []eventJSONTable{
+	{name: "roomserver_event_json", keyColumn: "event_nid", jsonColumn: "event_json", startKey: "0"},
+}
+
+var syncAPITables = []eventJSONTable{
+	{name: "syncapi_output_room_events", keyColumn: "id", jsonColumn: "headered_event_json", startKey: "0"},
+	{name: "syncapi_current_room_state", keyColumn: "event_id", jsonColumn: "headered_event_json", startKey: ""},
+}
+
+func main() {
+	ctx := context.Background()
+	cfg := setup.ParseFlags(true)
+	cfg.Logging = append(cfg.Logging[:0], config.LogrusHook{
+		Type:  "std",
+		Level: "error",
+	})
+
+	processCtx := process.NewProcessContext()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+
+	// Opening the databases makes sure that all migrations have run, so
+	// that the event JSON columns are able to hold compressed values.
+	fmt.Println("Opening roomserver database")
+	if _, err := roomserverStorage.Open(
+		processCtx.Context(), cm, &cfg.RoomServer.Database,
+		caching.NewRistrettoCache(8*1024*1024, time.Minute*5, caching.DisableMetrics),
+	); err != nil {
+		panic(err)
+	}
+	fmt.Println("Opening sync API database")
+	if _, err := syncapiStorage.NewSyncServerDatasource(processCtx.Context(), cm, &cfg.SyncAPI.Database); err != nil {
+		panic(err)
+	}
+
+	for _, component := range []struct {
+		dbOpts config.DatabaseOptions
+		tables []eventJSONTable
+	}{
+		{cfg.RoomServer.Database, roomserverTables},
+		{cfg.SyncAPI.Database, syncAPITables},
+	} {
+		compressor, err := eventcompress.NewCompressor(component.dbOpts.EventCompression)
+		if err != nil {
+			panic(err)
+		}
+		db, _, err := cm.Connection(&component.dbOpts)
+		if err != nil {
+			panic(err)
+		}
+		for _, table := range component.tables {
+			fmt.Printf("Rewriting %s using %q\n", table.name, compressor.Algorithm())
+			rewritten, saved, err := rewriteTable(ctx, db, table, compressor, *batchSize)
+			if err != nil {
+				panic(fmt.Errorf("%s: %w", table.name, err))
+			}
+			fmt.Printf("Rewrote %d rows in %s, changing size by %d bytes\n", rewritten, table.name, -saved)
+		}
+	}
+}
+
+// rewriteTable walks the table in key order, rewriting any event JSON which
+// isn't already stored in the form that the compressor would produce. It
+// returns the number of rows rewritten and the number of bytes saved.
+func rewriteTable(
+	ctx context.Context, db *sql.DB, table eventJSONTable,
+	compressor *eventcompress.Compressor, batchSize int,
+) (rewritten, saved int64, err error) {
+	selectSQL := fmt.Sprintf(
+		"SELECT %[2]s::TEXT, %[3]s FROM %[1]s WHERE %[2]s > $1 ORDER BY %[2]s ASC LIMIT $2 FOR UPDATE",
+		table.name, table.keyColumn, table.jsonColumn,
+	)
+	updateSQL := fmt.Sprintf(
+		"UPDATE %[1]s SET %[3]s = $1 WHERE %[2]s = $2",
+		table.name, table.keyColumn, table.jsonColumn,
+	)
+
+	lastKey := table.startKey
+	for {
+		var count int
+		err = sqlutil.WithTransaction(db, func(txn *sql.Tx) error {
+			rows, err := txn.QueryContext(ctx, selectSQL, lastKey, batchSize)
+			if err != nil {
+				return err
+			}
+			type row struct {
+				key    string
+				stored []byte
+			}
+			var batch []row
+			for rows.Next() {
+				var r row
+				if err = rows.Scan(&r.key, &r.stored); err != nil {
+					_ = rows.Close()
+					return err
+				}
+				batch = append(batch, r)
+			}
+			if err = rows.Close(); err != nil {
+				return err
+			}
+			count = len(batch)
+			for _, r := range batch {
+				lastKey = r.key
+				eventJSON, err := eventcompress.Decompress(r.stored)
+				if err != nil {
+					return fmt.Errorf("row %s: %w", r.key, err)
+				}
+				updated := compressor.Compress(eventJSON)
+				if string(updated) == string(r.stored) {
+					continue
+				}
+				if _, err = txn.ExecContext(ctx, updateSQL, updated, r.key); err != nil {
+					return err
+				}
+				rewritten++
+				saved += int64(len(r.stored) - len(updated))
+			}
+			return nil
+		})
+		if err != nil || count < batchSize {
+			return rewritten, saved, err
+		}
+	}
+}
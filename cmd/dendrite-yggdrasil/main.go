@@ -90,6 +90,9 @@ func main() {
 
 	processCtx := process.NewProcessContext()
 	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	if err := setup.CheckSchemaOwnership(processCtx.Context(), cm, cfg); err != nil {
+		logrus.WithError(err).Fatal("Failed to check database schema ownership")
+	}
 	routers := httputil.NewRouters()
 
 	basepkg.ConfigureAdminEndpoints(processCtx, routers)
@@ -108,7 +111,7 @@ func main() {
 	serverKeyAPI := &signing.YggdrasilKeys{}
 	keyRing := serverKeyAPI.KeyRing()
 
-	caches := caching.NewRistrettoCache(cfg.Global.Cache.EstimatedMaxSize, cfg.Global.Cache.MaxAge, caching.EnableMetrics)
+	caches := caching.NewRistrettoCacheFromConfig(&cfg.Global.Cache, caching.EnableMetrics)
 	natsInstance := jetstream.NATSInstance{}
 	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.EnableMetrics)
 
@@ -134,7 +137,9 @@ func main() {
 			ygg, fsAPI, federation,
 		),
 	}
-	monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics)
+	if err := monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics); err != nil {
+		logrus.WithError(err).Fatalf("Failed to add public routes")
+	}
 	if err := mscs.Enable(cfg, cm, routers, &monolith, caches); err != nil {
 		logrus.WithError(err).Fatalf("Failed to enable MSCs")
 	}
@@ -216,5 +221,5 @@ func main() {
 	}()
 
 	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
-	basepkg.WaitForShutdown(processCtx)
+	basepkg.WaitForShutdown(processCtx, cfg.Global.ShutdownDrainTimeout)
 }
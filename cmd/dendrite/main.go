@@ -15,13 +15,16 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"time"
 
 	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/httputil"
 	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/setup/jetstream"
 	"github.com/neilalexander/harmony/setup/process"
 	"github.com/prometheus/client_golang/prometheus"
@@ -38,10 +41,10 @@ import (
 
 var (
 	unixSocket = flag.String("unix-socket", "",
-		"EXPERIMENTAL(unstable): The HTTP listening unix socket for the server (disables http[s]-bind-address feature)",
+		"The HTTP listening unix socket for the server, serving both the client and federation APIs (disables http[s]-bind-address feature)",
 	)
 	unixSocketPermission = flag.String("unix-socket-permission", "755",
-		"EXPERIMENTAL(unstable): The HTTP listening unix socket permission for the server (in chmod format like 755)",
+		"The HTTP listening unix socket permission for the server (in chmod format like 755)",
 	)
 	httpBindAddr  = flag.String("http-bind-address", ":8008", "The HTTP listening port for the server")
 	httpsBindAddr = flag.String("https-bind-address", ":8448", "The HTTPS listening port for the server")
@@ -53,7 +56,32 @@ func main() {
 	cfg := setup.ParseFlags(true)
 	httpAddr := config.ServerAddress{}
 	httpsAddr := config.ServerAddress{}
-	if *unixSocket == "" {
+	listeners, err := basepkg.SystemdListeners()
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to use systemd sockets")
+	}
+	switch {
+	case len(listeners) > 0:
+		// Sockets named "http" and "https" in the systemd unit are used as
+		// such, otherwise the first is HTTP and the second is HTTPS.
+		for _, names := range [][2]string{{"http", "0"}, {"https", "1"}} {
+			listener, ok := listeners[names[0]]
+			if !ok {
+				listener, ok = listeners[names[1]]
+			}
+			if !ok {
+				continue
+			}
+			if names[0] == "http" {
+				httpAddr = config.ListenerAddress(listener)
+			} else {
+				httpsAddr = config.ListenerAddress(listener)
+			}
+		}
+		if !httpAddr.Enabled() && !httpsAddr.Enabled() {
+			logrus.Fatalf("None of the sockets passed by systemd are named http or https")
+		}
+	case *unixSocket == "":
 		http, err := config.HTTPAddress("http://" + *httpBindAddr)
 		if err != nil {
 			logrus.WithError(err).Fatalf("Failed to parse http address")
@@ -64,7 +92,7 @@ func main() {
 			logrus.WithError(err).Fatalf("Failed to parse https address")
 		}
 		httpsAddr = https
-	} else {
+	default:
 		socket, err := config.UnixSocketAddress(*unixSocket, *unixSocketPermission)
 		if err != nil {
 			logrus.WithError(err).Fatalf("Failed to parse unix socket")
@@ -84,8 +112,24 @@ func main() {
 
 	internal.SetupStdLogging()
 	internal.SetupHookLogging(cfg.Logging)
+	if err := internal.SetComponentLogLevels(cfg.ComponentLogLevels); err != nil {
+		logrus.WithError(err).Fatal("Failed to set component log levels")
+	}
+	config.OnReload(func() {
+		if err := internal.ReloadHookLogging(cfg.CurrentLogging()); err != nil {
+			logrus.WithError(err).Error("Failed to reload logging config")
+		}
+		if err := internal.SetComponentLogLevels(cfg.CurrentComponentLogLevels()); err != nil {
+			logrus.WithError(err).Error("Failed to reload component log levels")
+		}
+	})
 	internal.SetupPprof()
 
+	shutdownTracing, err := tracing.Setup(processCtx.Context(), &cfg.Global.Tracing, internal.VersionString())
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to set up tracing")
+	}
+
 	basepkg.PlatformSanityChecks()
 
 	logrus.Infof("Dendrite version %s", internal.VersionString())
@@ -107,14 +151,20 @@ func main() {
 		)
 	}
 
-	federationClient := basepkg.CreateFederationClient(cfg, dnsCache)
-	httpClient := basepkg.CreateClient(cfg, dnsCache)
+	// The federation and media clients share what they find out about how
+	// to reach other servers.
+	resolutionCache := fclient.NewResolutionCache()
+	federationClient := basepkg.CreateFederationClient(cfg, dnsCache, resolutionCache)
+	httpClient := basepkg.CreateClient(cfg, dnsCache, resolutionCache)
 
 	// prepare required dependencies
 	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	if err := setup.CheckSchemaOwnership(processCtx.Context(), cm, cfg); err != nil {
+		logrus.WithError(err).Fatal("Failed to check database schema ownership")
+	}
 	routers := httputil.NewRouters()
 
-	caches := caching.NewRistrettoCache(cfg.Global.Cache.EstimatedMaxSize, cfg.Global.Cache.MaxAge, caching.EnableMetrics)
+	caches := caching.NewRistrettoCacheFromConfig(&cfg.Global.Cache, caching.EnableMetrics)
 	natsInstance := jetstream.NATSInstance{}
 	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.EnableMetrics)
 	fsAPI := federationapi.NewInternalAPI(
@@ -143,7 +193,9 @@ func main() {
 		RoomserverAPI: rsAPI,
 		UserAPI:       userAPI,
 	}
-	monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics)
+	if err := monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics); err != nil {
+		logrus.WithError(err).Fatalf("Failed to add public routes")
+	}
 
 	if len(cfg.MSCs.MSCs) > 0 {
 		if err := mscs.Enable(cfg, cm, routers, &monolith, caches); err != nil {
@@ -165,13 +217,26 @@ func main() {
 	go func() {
 		basepkg.SetupAndServeHTTP(processCtx, cfg, routers, httpAddr, nil, nil)
 	}()
-	// Handle HTTPS if certificate and key are provided
-	if *unixSocket == "" && *certFile != "" && *keyFile != "" {
+	// Handle HTTPS if certificate and key are provided, or obtained using ACME
+	if httpsAddr.Enabled() && (*certFile != "" && *keyFile != "" || cfg.Global.ACME.Enabled) {
+		if cfg.Global.ACME.Enabled && *certFile != "" {
+			logrus.Warn("Ignoring --tls-cert and --tls-key as ACME is enabled")
+		}
 		go func() {
 			basepkg.SetupAndServeHTTP(processCtx, cfg, routers, httpsAddr, certFile, keyFile)
 		}()
 	}
 
+	// Reload the config on SIGHUP.
+	basepkg.HandleReloadSignal(processCtx, cfg)
+
 	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
-	basepkg.WaitForShutdown(processCtx)
+	basepkg.WaitForShutdown(processCtx, cfg.Global.ShutdownDrainTimeout)
+
+	// Flush any spans which haven't been exported yet.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err = shutdownTracing(ctx); err != nil {
+		logrus.WithError(err).Warn("Failed to flush traces")
+	}
 }
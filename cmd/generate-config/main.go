@@ -62,6 +62,7 @@ func main() {
 		}
 		if *defaultsForCI {
 			cfg.ClientAPI.RateLimiting.Enabled = false
+			cfg.ClientAPI.SendRateLimiting.Enabled = false
 			cfg.FederationAPI.DisableTLSValidation = false
 			cfg.FederationAPI.DisableHTTPKeepalives = true
 			// don't hit matrix.org when running tests!!!
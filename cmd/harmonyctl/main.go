@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// harmonyctl is a client for the admin API, for the operations which are
+// commonly needed when running a server. It authenticates with the access
+// token of an admin account.
+//
+// Usage: ./harmonyctl [-server http://localhost:8008] [-token TOKEN] <command> [arguments]
+
+const usage = `Usage: %s [flags] <command> [arguments]
+
+Commands:
+
+	create-user [-admin] [-displayname NAME] [-password PASSWORD | -passwordstdin] <username>
+	create-users [-csv] <file> | -resume <task ID>
+	reset-password [-logout-devices [-soft-logout]] [-password PASSWORD | -passwordstdin] <user ID>
+	destinations list
+	destinations unblacklist <server name>
+	ignored-origins list
+	ignored-origins unignore <server name>
+	resolution-cache list
+	resolution-cache forget <server name>
+	server-keys list [server name]
+	server-keys refetch <server name>
+	server-keys purge-expired
+	purge-room <room ID>
+	quarantine-media [-lift] <mxc:// URI>
+	force-join <user ID> <room ID or alias>
+	evacuate-room <room ID>
+	evacuate-user <user ID>
+	export-room <room ID>
+	import-room <file>
+	rotate-signing-key
+	replay-input-queue
+	stream-lag
+	reindex-search
+	tasks list
+	tasks get|cancel|download <task ID>
+
+Purging a room, reindexing search, creating users in bulk and exporting a
+room run in the background on the server, and print a task whose progress
+can be followed with "tasks get".
+
+The file given to create-users is either JSON, with the users in a "users"
+array, or CSV with a header row naming the columns. Both have the fields
+username, password, displayname, admin and rooms. Users without a password
+can only log in with single sign-on. The file is read from stdin if it is
+"-". A task which didn't create all of the users can be resumed, which
+carries on from the steps that failed.
+
+export-room starts a task which writes a JSON archive of the events and
+state of a room, which "tasks download" prints once the task has completed.
+import-room stores the archive on a server which doesn't know the room yet.
+In rooms created by this server, events which it signed with one of the keys
+in old_private_keys are signed again with its current key. The file given to
+import-room is read from stdin if it is "-".
+
+replay-input-queue queues the events journalled by the room server again,
+for when they have been lost from JetStream. It needs persist_input_queue
+to be enabled in the room server config.
+
+stream-lag shows the last message produced into each of the internal streams
+and how many messages each of their consumers have yet to process, as well as
+how far behind the sync API's PDU and device list streams are in syncing
+clients, to find where a backlog is building up.
+
+The access token of an admin account must be given with -token or in the
+HARMONY_ADMIN_TOKEN environment variable.
+
+Flags:
+
+`
+
+var (
+	serverURL   = flag.String("server", "http://localhost:8008", "The URL of the server to connect to")
+	accessToken = flag.String("token", "", "The access token of an admin account (default $HARMONY_ADMIN_TOKEN)")
+	timeout     = flag.Duration("timeout", time.Minute*5, "Timeout for requests to the server")
+)
+
+func main() {
+	name := os.Args[0]
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, usage, name)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	token := *accessToken
+	if token == "" {
+		token = os.Getenv("HARMONY_ADMIN_TOKEN")
+	}
+	if token == "" {
+		fmt.Fprintln(os.Stderr, "An admin access token is required, use -token or set HARMONY_ADMIN_TOKEN")
+		os.Exit(1)
+	}
+	c := &client{
+		server: strings.TrimRight(*serverURL, "/"),
+		token:  token,
+		http:   &http.Client{Timeout: *timeout},
+	}
+	res, err := run(c, flag.Args(), os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	_, _ = os.Stdout.Write(res)
+}
+
+// run runs a command, returning the response from the server.
+func run(c *client, args []string, stdin io.Reader) ([]byte, error) {
+	command, args := args[0], args[1:]
+	switch command {
+	case "create-user":
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		admin := fs.Bool("admin", false, "Create an admin account")
+		displayName := fs.String("displayname", "", "The display name of the account")
+		password := fs.String("password", "", "The password of the account")
+		pwdStdin := fs.Bool("passwordstdin", false, "Read the password from stdin")
+		username, err := parseArgs(fs, args, "username")
+		if err != nil {
+			return nil, err
+		}
+		pass, err := getPassword(*password, *pwdStdin, stdin)
+		if err != nil {
+			return nil, err
+		}
+		return c.do(http.MethodPost, "/_dendrite/admin/createUser", map[string]interface{}{
+			"username":    username,
+			"password":    pass,
+			"displayname": *displayName,
+			"admin":       *admin,
+		})
+
+	case "create-users":
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		isCSV := fs.Bool("csv", false, "The file is CSV rather than JSON")
+		resume := fs.Bool("resume", false, "Resume the task with the given ID instead")
+		arg, err := parseArgs(fs, args, "file")
+		if err != nil {
+			return nil, err
+		}
+		if *resume {
+			return c.do(http.MethodPost, "/_dendrite/admin/createUsers/"+url.PathEscape(arg)+"/resume", nil)
+		}
+		var data []byte
+		if arg == "-" {
+			data, err = io.ReadAll(stdin)
+		} else {
+			data, err = os.ReadFile(arg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read users: %w", err)
+		}
+		contentType := "application/json"
+		if *isCSV {
+			contentType = "text/csv"
+		}
+		return c.doRaw(http.MethodPost, "/_dendrite/admin/createUsers", contentType, data)
+
+	case "reset-password":
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		logoutDevices := fs.Bool("logout-devices", false, "Log out all of the user's devices")
+		softLogout := fs.Bool("soft-logout", false, "Keep the devices and their keys when logging them out")
+		password := fs.String("password", "", "The new password")
+		pwdStdin := fs.Bool("passwordstdin", false, "Read the password from stdin")
+		userID, err := parseArgs(fs, args, "user ID")
+		if err != nil {
+			return nil, err
+		}
+		if *softLogout && !*logoutDevices {
+			return nil, fmt.Errorf("-soft-logout can only be used with -logout-devices")
+		}
+		pass, err := getPassword(*password, *pwdStdin, stdin)
+		if err != nil {
+			return nil, err
+		}
+		return c.do(http.MethodPost, "/_dendrite/admin/resetPassword/"+url.PathEscape(userID), map[string]interface{}{
+			"password":       pass,
+			"logout_devices": *logoutDevices,
+			"soft_logout":    *softLogout,
+		})
+
+	case "destinations":
+		if len(args) == 1 && args[0] == "list" {
+			return c.do(http.MethodGet, "/_dendrite/admin/federation/destinations", nil)
+		}
+		if len(args) == 2 && args[0] == "unblacklist" {
+			return c.do(http.MethodPost, "/_dendrite/admin/federation/destinations/"+url.PathEscape(args[1])+"/unblacklist", nil)
+		}
+		return nil, fmt.Errorf("usage: destinations list|unblacklist <server name>")
+
+	case "ignored-origins":
+		if len(args) == 1 && args[0] == "list" {
+			return c.do(http.MethodGet, "/_dendrite/admin/federation/ignoredOrigins", nil)
+		}
+		if len(args) == 2 && args[0] == "unignore" {
+			return c.do(http.MethodPost, "/_dendrite/admin/federation/ignoredOrigins/"+url.PathEscape(args[1])+"/unignore", nil)
+		}
+		return nil, fmt.Errorf("usage: ignored-origins list|unignore <server name>")
+
+	case "resolution-cache":
+		if len(args) == 1 && args[0] == "list" {
+			return c.do(http.MethodGet, "/_dendrite/admin/federation/resolutionCache", nil)
+		}
+		if len(args) == 2 && args[0] == "forget" {
+			return c.do(http.MethodDelete, "/_dendrite/admin/federation/resolutionCache/"+url.PathEscape(args[1]), nil)
+		}
+		return nil, fmt.Errorf("usage: resolution-cache list|forget <server name>")
+
+	case "server-keys":
+		switch {
+		case len(args) == 1 && args[0] == "list":
+			return c.do(http.MethodGet, "/_dendrite/admin/federation/serverKeys", nil)
+		case len(args) == 2 && args[0] == "list":
+			return c.do(http.MethodGet, "/_dendrite/admin/federation/serverKeys/"+url.PathEscape(args[1]), nil)
+		case len(args) == 2 && args[0] == "refetch":
+			return c.do(http.MethodPost, "/_dendrite/admin/federation/serverKeys/"+url.PathEscape(args[1])+"/refetch", nil)
+		case len(args) == 1 && args[0] == "purge-expired":
+			return c.do(http.MethodPost, "/_dendrite/admin/federation/serverKeys/purgeExpired", nil)
+		}
+		return nil, fmt.Errorf("usage: server-keys list [server name]|refetch <server name>|purge-expired")
+
+	case "purge-room":
+		roomID, err := parseArgs(flag.NewFlagSet(command, flag.ExitOnError), args, "room ID")
+		if err != nil {
+			return nil, err
+		}
+		return c.do(http.MethodPost, "/_dendrite/admin/purgeRoom/"+url.PathEscape(roomID), nil)
+
+	case "quarantine-media":
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		lift := fs.Bool("lift", false, "Lift the quarantine instead")
+		uri, err := parseArgs(fs, args, "mxc:// URI")
+		if err != nil {
+			return nil, err
+		}
+		serverName, mediaID, ok := strings.Cut(strings.TrimPrefix(uri, "mxc://"), "/")
+		if !ok || !strings.HasPrefix(uri, "mxc://") || serverName == "" || mediaID == "" {
+			return nil, fmt.Errorf("%q is not a valid mxc:// URI", uri)
+		}
+		method := http.MethodPost
+		if *lift {
+			method = http.MethodDelete
+		}
+		return c.do(method, "/_dendrite/admin/quarantineMedia/"+url.PathEscape(serverName)+"/"+url.PathEscape(mediaID), nil)
+
+	case "force-join":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("usage: force-join <user ID> <room ID or alias>")
+		}
+		return c.do(http.MethodPost, "/_dendrite/admin/joinRoom/"+url.PathEscape(args[1]), map[string]interface{}{
+			"user_id": args[0],
+		})
+
+	case "evacuate-room":
+		roomID, err := parseArgs(flag.NewFlagSet(command, flag.ExitOnError), args, "room ID")
+		if err != nil {
+			return nil, err
+		}
+		return c.do(http.MethodPost, "/_dendrite/admin/evacuateRoom/"+url.PathEscape(roomID), nil)
+
+	case "evacuate-user":
+		userID, err := parseArgs(flag.NewFlagSet(command, flag.ExitOnError), args, "user ID")
+		if err != nil {
+			return nil, err
+		}
+		return c.do(http.MethodPost, "/_dendrite/admin/evacuateUser/"+url.PathEscape(userID), nil)
+
+	case "export-room":
+		roomID, err := parseArgs(flag.NewFlagSet(command, flag.ExitOnError), args, "room ID")
+		if err != nil {
+			return nil, err
+		}
+		return c.do(http.MethodPost, "/_dendrite/admin/exportRoom/"+url.PathEscape(roomID), nil)
+
+	case "import-room":
+		arg, err := parseArgs(flag.NewFlagSet(command, flag.ExitOnError), args, "file")
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		if arg == "-" {
+			data, err = io.ReadAll(stdin)
+		} else {
+			data, err = os.ReadFile(arg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read room export: %w", err)
+		}
+		return c.doRaw(http.MethodPost, "/_dendrite/admin/importRoom", "application/json", data)
+
+	case "rotate-signing-key":
+		if len(args) != 0 {
+			return nil, fmt.Errorf("usage: rotate-signing-key")
+		}
+		return c.do(http.MethodPost, "/_dendrite/admin/rotateSigningKey", nil)
+
+	case "replay-input-queue":
+		if len(args) != 0 {
+			return nil, fmt.Errorf("usage: replay-input-queue")
+		}
+		return c.do(http.MethodPost, "/_dendrite/admin/inputQueue/replay", nil)
+
+	case "stream-lag":
+		if len(args) != 0 {
+			return nil, fmt.Errorf("usage: stream-lag")
+		}
+		return c.do(http.MethodGet, "/_dendrite/admin/streamLag", nil)
+
+	case "reindex-search":
+		if len(args) != 0 {
+			return nil, fmt.Errorf("usage: reindex-search")
+		}
+		return c.do(http.MethodGet, "/_dendrite/admin/fulltext/reindex", nil)
+
+	case "tasks":
+		if len(args) == 1 && args[0] == "list" {
+			return c.do(http.MethodGet, "/_dendrite/admin/tasks", nil)
+		}
+		if len(args) == 2 && args[0] == "get" {
+			return c.do(http.MethodGet, "/_dendrite/admin/tasks/"+url.PathEscape(args[1]), nil)
+		}
+		if len(args) == 2 && args[0] == "cancel" {
+			return c.do(http.MethodDelete, "/_dendrite/admin/tasks/"+url.PathEscape(args[1]), nil)
+		}
+		if len(args) == 2 && args[0] == "download" {
+			return c.do(http.MethodGet, "/_dendrite/admin/tasks/"+url.PathEscape(args[1])+"/download", nil)
+		}
+		return nil, fmt.Errorf("usage: tasks list|get <task ID>|cancel <task ID>|download <task ID>")
+
+	default:
+		return nil, fmt.Errorf("unknown command %q, run with -help for a list of commands", command)
+	}
+}
+
+// parseArgs parses the flags of a command, which must be followed by exactly
+// one argument.
+func parseArgs(fs *flag.FlagSet, args []string, argName string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("usage: %s [flags] <%s>", fs.Name(), argName)
+	}
+	return fs.Arg(0), nil
+}
+
+// getPassword returns the password given by flag or on stdin, or otherwise
+// asks for it.
+func getPassword(password string, pwdStdin bool, r io.Reader) (string, error) {
+	if pwdStdin {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return "", fmt.Errorf("unable to read password from stdin: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if password != "" {
+		return password, nil
+	}
+	fmt.Fprint(os.Stderr, "Enter Password: ")
+	bytePassword, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("unable to read password: %w", err)
+	}
+	fmt.Fprint(os.Stderr, "Confirm Password: ")
+	bytePassword2, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("unable to read password: %w", err)
+	}
+	if !bytes.Equal(bytePassword, bytePassword2) {
+		return "", fmt.Errorf("entered passwords don't match")
+	}
+	return strings.TrimSpace(string(bytePassword)), nil
+}
+
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+// do makes an authenticated request to the admin API, returning the response
+// body indented for reading.
+func (c *client) do(method, path string, body interface{}) ([]byte, error) {
+	if body == nil {
+		return c.doRaw(method, path, "", nil)
+	}
+	js, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal request: %w", err)
+	}
+	return c.doRaw(method, path, "application/json", js)
+}
+
+// doRaw makes an authenticated request to the admin API with a body which
+// has already been encoded.
+func (c *client) doRaw(method, path, contentType string, body []byte) ([]byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.server+path, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body (HTTP %d): %w", res.StatusCode, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("got HTTP %d error from server: %s", res.StatusCode, strings.TrimSpace(string(resBody)))
+	}
+	var out bytes.Buffer
+	if err = json.Indent(&out, bytes.TrimSpace(resBody), "", "  "); err != nil {
+		return resBody, nil
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		args   []string
+		method string
+		path   string
+		body   string
+	}{
+		{
+			args:   []string{"create-user", "-admin", "-password", "hunter2", "alice"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/createUser",
+			body:   `{"admin":true,"displayname":"","password":"hunter2","username":"alice"}`,
+		},
+		{
+			args:   []string{"create-users", "-csv", "-"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/createUsers",
+			body:   "fromstdin\n",
+		},
+		{
+			args:   []string{"create-users", "-resume", "abc"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/createUsers/abc/resume",
+		},
+		{
+			args:   []string{"reset-password", "-logout-devices", "-soft-logout", "-passwordstdin", "@alice:test"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/resetPassword/@alice:test",
+			body:   `{"logout_devices":true,"password":"fromstdin","soft_logout":true}`,
+		},
+		{
+			args:   []string{"destinations", "list"},
+			method: http.MethodGet,
+			path:   "/_dendrite/admin/federation/destinations",
+		},
+		{
+			args:   []string{"destinations", "unblacklist", "remote.test"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/federation/destinations/remote.test/unblacklist",
+		},
+		{
+			args:   []string{"ignored-origins", "unignore", "remote.test"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/federation/ignoredOrigins/remote.test/unignore",
+		},
+		{
+			args:   []string{"resolution-cache", "forget", "remote.test"},
+			method: http.MethodDelete,
+			path:   "/_dendrite/admin/federation/resolutionCache/remote.test",
+		},
+		{
+			args:   []string{"server-keys", "list", "remote.test"},
+			method: http.MethodGet,
+			path:   "/_dendrite/admin/federation/serverKeys/remote.test",
+		},
+		{
+			args:   []string{"server-keys", "refetch", "remote.test"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/federation/serverKeys/remote.test/refetch",
+		},
+		{
+			args:   []string{"server-keys", "purge-expired"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/federation/serverKeys/purgeExpired",
+		},
+		{
+			args:   []string{"purge-room", "!room:test"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/purgeRoom/%21room:test",
+		},
+		{
+			args:   []string{"quarantine-media", "-lift", "mxc://test/abc"},
+			method: http.MethodDelete,
+			path:   "/_dendrite/admin/quarantineMedia/test/abc",
+		},
+		{
+			args:   []string{"force-join", "@alice:test", "#room:test"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/joinRoom/%23room:test",
+			body:   `{"user_id":"@alice:test"}`,
+		},
+		{
+			args:   []string{"evacuate-user", "@alice:test"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/evacuateUser/@alice:test",
+		},
+		{
+			args:   []string{"export-room", "!room:test"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/exportRoom/%21room:test",
+		},
+		{
+			args:   []string{"import-room", "-"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/importRoom",
+			body:   "fromstdin\n",
+		},
+		{
+			args:   []string{"rotate-signing-key"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/rotateSigningKey",
+		},
+		{
+			args:   []string{"replay-input-queue"},
+			method: http.MethodPost,
+			path:   "/_dendrite/admin/inputQueue/replay",
+		},
+		{
+			args:   []string{"stream-lag"},
+			method: http.MethodGet,
+			path:   "/_dendrite/admin/streamLag",
+		},
+		{
+			args:   []string{"reindex-search"},
+			method: http.MethodGet,
+			path:   "/_dendrite/admin/fulltext/reindex",
+		},
+		{
+			args:   []string{"tasks", "get", "abc"},
+			method: http.MethodGet,
+			path:   "/_dendrite/admin/tasks/abc",
+		},
+		{
+			args:   []string{"tasks", "cancel", "abc"},
+			method: http.MethodDelete,
+			path:   "/_dendrite/admin/tasks/abc",
+		},
+		{
+			args:   []string{"tasks", "download", "abc"},
+			method: http.MethodGet,
+			path:   "/_dendrite/admin/tasks/abc/download",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.args[0], func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.Header.Get("Authorization"); got != "Bearer secret" {
+					t.Errorf("unexpected authorization header %q", got)
+				}
+				if req.Method != tc.method || req.URL.EscapedPath() != tc.path {
+					t.Errorf("expected %s %s, got %s %s", tc.method, tc.path, req.Method, req.URL.EscapedPath())
+				}
+				body, _ := io.ReadAll(req.Body)
+				if string(body) != tc.body {
+					t.Errorf("expected body %s, got %s", tc.body, body)
+				}
+				_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+			}))
+			defer srv.Close()
+
+			c := &client{server: srv.URL, token: "secret", http: srv.Client()}
+			res, err := run(c, tc.args, strings.NewReader("fromstdin\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(res) != "{\n  \"ok\": true\n}\n" {
+				t.Fatalf("unexpected response %q", res)
+			}
+		})
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN"}`))
+	}))
+	defer srv.Close()
+	c := &client{server: srv.URL, token: "secret", http: srv.Client()}
+
+	if _, err := run(c, []string{"evacuate-room", "!room:test"}, nil); err == nil || !strings.Contains(err.Error(), "HTTP 403") {
+		t.Fatalf("expected an HTTP 403 error, got %v", err)
+	}
+	if _, err := run(c, []string{"quarantine-media", "https://test/abc"}, nil); err == nil {
+		t.Fatal("expected an error for an invalid mxc:// URI")
+	}
+	if _, err := run(c, []string{"reset-password", "-soft-logout", "-password", "hunter2", "@alice:test"}, nil); err == nil || strings.Contains(err.Error(), "HTTP") {
+		t.Fatalf("expected an error for a soft logout without logging out, got %v", err)
+	}
+	if _, err := run(c, []string{"unknown"}, nil); err == nil {
+		t.Fatal("expected an error for an unknown command")
+	}
+}
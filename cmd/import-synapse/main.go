@@ -0,0 +1,1002 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/mediaapi/fileutils"
+	mediaapiStorage "github.com/neilalexander/harmony/mediaapi/storage"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+	userapiStorage "github.com/neilalexander/harmony/userapi/storage"
+	userapiTypes "github.com/neilalexander/harmony/userapi/types"
+)
+
+// This is a utility for importing a Synapse homeserver: the local users,
+// along with their profiles, devices and access tokens, the media that they
+// uploaded, their end-to-end encryption keys and key backups, and the rooms
+// that the server is in. Synapse must be using PostgreSQL and must have the
+// same server name as this server. Run it before starting this server for
+// the first time, while Synapse is stopped.
+//
+// Rooms are written out as room archives, one file per room, which are then
+// imported with "harmonyctl import-room" once this server is running, which
+// rebuilds the state of each room from the state that Synapse stored. The
+// events that Synapse sent are checked against its signing key, and in rooms
+// created by Synapse they are signed again with this server's key, so add
+// the public key and key ID of Synapse's signing key to old_private_keys in
+// the config first, with expired_at set to the time that Synapse was stopped.
+// Rooms whose events Synapse signed can't be imported without it.
+//
+// Each stage skips anything which already exists, so if the import fails
+// or is interrupted, it can just be run again to carry on. Running it with
+// --verify afterwards compares what is in each database without importing.
+//
+// Usage: ./import-synapse --config dendrite.yaml --synapse-db postgres://... [--synapse-media-path /path/to/media_store] [--room-archive-path /path/to/archives] [--verify]
+
+var (
+	synapseDB        = flag.String("synapse-db", "", "the connection string for the Synapse PostgreSQL database")
+	synapseMediaPath = flag.String("synapse-media-path", "", "the media_store directory of Synapse, to import local media from")
+	roomArchivePath  = flag.String("room-archive-path", "", "the directory to write room archives to, to import with harmonyctl import-room")
+	verify           = flag.Bool("verify", false, "compare the Synapse and Harmony databases instead of importing")
+)
+
+func main() {
+	ctx := context.Background()
+	cfg := setup.ParseFlags(true)
+	if *synapseDB == "" {
+		logrus.Fatal("--synapse-db must be supplied")
+	}
+
+	src, err := sql.Open("postgres", *synapseDB)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open Synapse database")
+	}
+	defer src.Close() // nolint: errcheck
+
+	// Opening the storage makes sure that all of the tables exist.
+	cm := sqlutil.NewConnectionManager(process.NewProcessContext(), cfg.Global.DatabaseOptions)
+	if _, err = userapiStorage.NewUserDatabase(
+		ctx, cm, &cfg.UserAPI.AccountDatabase, cfg.Global.ServerName, cfg.UserAPI.BCryptCost,
+		userapi.DefaultLoginTokenLifetime, cfg.UserAPI.Matrix.ServerNotices.LocalPart,
+	); err != nil {
+		logrus.WithError(err).Fatal("Failed to open user API database")
+	}
+	userDB, _, err := cm.Connection(&cfg.UserAPI.AccountDatabase)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to connect to user API database")
+	}
+	mediaDB, err := mediaapiStorage.NewMediaAPIDatasource(cm, &cfg.MediaAPI.Database)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open media API database")
+	}
+	mediaSQL, _, err := cm.Connection(&cfg.MediaAPI.Database)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to connect to media API database")
+	}
+
+	imp := &importer{
+		src:        src,
+		userDB:     userDB,
+		mediaDB:    mediaDB,
+		mediaSQL:   mediaSQL,
+		serverName: cfg.Global.ServerName,
+		suffix:     ":" + string(cfg.Global.ServerName),
+		mediaPath:  cfg.MediaAPI.AbsBasePath,
+		// The paths to import media from and write rooms to are optional.
+		synapseMediaPath: *synapseMediaPath,
+		roomArchivePath:  *roomArchivePath,
+	}
+	if *verify {
+		if !imp.verify(ctx) {
+			os.Exit(1)
+		}
+		return
+	}
+	if err = imp.run(ctx); err != nil {
+		logrus.WithError(err).Fatal("Import failed, run again to resume")
+	}
+	logrus.Info("Import complete, run with --verify to check the result")
+}
+
+type importer struct {
+	src              *sql.DB
+	userDB           *sql.DB
+	mediaDB          mediaapiStorage.Database
+	mediaSQL         *sql.DB
+	serverName       spec.ServerName
+	suffix           string
+	mediaPath        config.Path
+	synapseMediaPath string
+	roomArchivePath  string
+}
+
+// run runs each stage of the import in turn, stopping at the first to fail.
+func (i *importer) run(ctx context.Context) error {
+	for _, stage := range []struct {
+		name string
+		run  func(context.Context) (int, error)
+	}{
+		{"users", i.importUsers},
+		{"profiles", i.importProfiles},
+		{"devices", i.importDevices},
+		{"media", i.importMedia},
+		{"device keys", i.importDeviceKeys},
+		{"one-time keys", i.importOneTimeKeys},
+		{"fallback keys", i.importFallbackKeys},
+		{"cross-signing keys", i.importCrossSigningKeys},
+		{"cross-signing signatures", i.importCrossSigningSigs},
+		{"key backup versions", i.importKeyBackupVersions},
+		{"key backups", i.importKeyBackups},
+		{"rooms", i.importRooms},
+	} {
+		logrus.Infof("Importing %s", stage.name)
+		imported, err := stage.run(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %w", stage.name, err)
+		}
+		logrus.Infof("Imported %d %s", imported, stage.name)
+	}
+	return nil
+}
+
+// localpart returns the localpart of a Synapse user ID, or false if the
+// user doesn't belong to this server.
+func (i *importer) localpart(userID string) (string, bool) {
+	if !strings.HasPrefix(userID, "@") || !strings.HasSuffix(userID, i.suffix) {
+		return "", false
+	}
+	return userID[1 : len(userID)-len(i.suffix)], true
+}
+
+// Synapse uses 1 for true in its boolean columns.
+const selectSynapseUsersSQL = "" +
+	"SELECT name, password_hash, COALESCE(creation_ts, 0), admin = 1, is_guest = 1, COALESCE(deactivated, 0) = 1, appservice_id" +
+	" FROM users ORDER BY name"
+
+const insertUserSQL = "" +
+	"INSERT INTO userapi_accounts(localpart, server_name, created_ts, password_hash, appservice_id, is_deactivated, account_type)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING"
+
+func (i *importer) importUsers(ctx context.Context) (int, error) {
+	rows, err := i.src.QueryContext(ctx, selectSynapseUsersSQL)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close() // nolint: errcheck
+	imported := 0
+	for rows.Next() {
+		var userID string
+		var passwordHash, appserviceID sql.NullString
+		var createdSecs int64
+		var admin, guest, deactivated bool
+		if err = rows.Scan(&userID, &passwordHash, &createdSecs, &admin, &guest, &deactivated, &appserviceID); err != nil {
+			return imported, err
+		}
+		localpart, ok := i.localpart(userID)
+		if !ok {
+			logrus.Warnf("Skipping user %s which doesn't belong to %s", userID, i.serverName)
+			continue
+		}
+		accountType := userapi.AccountTypeUser
+		switch {
+		case appserviceID.Valid:
+			accountType = userapi.AccountTypeAppService
+		case admin:
+			accountType = userapi.AccountTypeAdmin
+		case guest:
+			accountType = userapi.AccountTypeGuest
+		}
+		// Synapse stores bcrypt hashes, the same as we do, so they can be
+		// copied as they are and users can keep their passwords.
+		res, err := i.userDB.ExecContext(ctx, insertUserSQL,
+			localpart, i.serverName, createdSecs*1000, passwordHash, appserviceID, deactivated, accountType,
+		)
+		if err != nil {
+			return imported, fmt.Errorf("user %s: %w", userID, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			imported++
+		}
+	}
+	return imported, rows.Err()
+}
+
+const selectSynapseProfilesSQL = "" +
+	"SELECT user_id, displayname, avatar_url FROM profiles ORDER BY user_id"
+
+const insertProfileSQL = "" +
+	"INSERT INTO userapi_profiles(localpart, server_name, display_name, avatar_url)" +
+	" VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING"
+
+func (i *importer) importProfiles(ctx context.Context) (int, error) {
+	rows, err := i.src.QueryContext(ctx, selectSynapseProfilesSQL)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close() // nolint: errcheck
+	imported := 0
+	for rows.Next() {
+		// Synapse stores the localpart in the user_id column of profiles.
+		var localpart string
+		var displayName, avatarURL sql.NullString
+		if err = rows.Scan(&localpart, &displayName, &avatarURL); err != nil {
+			return imported, err
+		}
+		res, err := i.userDB.ExecContext(ctx, insertProfileSQL, localpart, i.serverName, displayName.String, avatarURL.String)
+		if err != nil {
+			return imported, fmt.Errorf("profile %s: %w", localpart, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			imported++
+		}
+	}
+	return imported, rows.Err()
+}
+
+// We only keep one access token per device, so take the newest one. Hidden
+// devices are used by Synapse for cross-signing keys and aren't real devices.
+const selectSynapseDevicesSQL = "" +
+	"SELECT d.user_id, d.device_id, d.display_name, d.last_seen, d.ip, d.user_agent, t.token" +
+	" FROM devices d JOIN (" +
+	"  SELECT DISTINCT ON (user_id, device_id) user_id, device_id, token FROM access_tokens" +
+	"  WHERE device_id IS NOT NULL ORDER BY user_id, device_id, id DESC" +
+	" ) t ON d.user_id = t.user_id AND d.device_id = t.device_id" +
+	" WHERE NOT d.hidden ORDER BY d.user_id, d.device_id"
+
+const insertDeviceSQL = "" +
+	"INSERT INTO userapi_devices(device_id, localpart, server_name, access_token, created_ts, display_name, last_seen_ts, ip, user_agent)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT DO NOTHING"
+
+func (i *importer) importDevices(ctx context.Context) (int, error) {
+	rows, err := i.src.QueryContext(ctx, selectSynapseDevicesSQL)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close() // nolint: errcheck
+	imported := 0
+	for rows.Next() {
+		var userID, deviceID, token string
+		var displayName, ip, userAgent sql.NullString
+		var lastSeen sql.NullInt64
+		if err = rows.Scan(&userID, &deviceID, &displayName, &lastSeen, &ip, &userAgent, &token); err != nil {
+			return imported, err
+		}
+		localpart, ok := i.localpart(userID)
+		if !ok {
+			continue
+		}
+		// Synapse doesn't record when a device was created, so the best we
+		// can do is when it was last seen.
+		seen := lastSeen.Int64
+		if !lastSeen.Valid {
+			seen = time.Now().UnixMilli()
+		}
+		res, err := i.userDB.ExecContext(ctx, insertDeviceSQL,
+			deviceID, localpart, i.serverName, token, seen, displayName, seen, ip.String, userAgent.String,
+		)
+		if err != nil {
+			return imported, fmt.Errorf("device %s of %s: %w", deviceID, userID, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			imported++
+		}
+	}
+	return imported, rows.Err()
+}
+
+// URL previews are cached by Synapse as local media, but we don't want them.
+const selectSynapseMediaSQL = "" +
+	"SELECT media_id, media_type, media_length, created_ts, COALESCE(upload_name, ''), COALESCE(user_id, '')" +
+	" FROM local_media_repository WHERE url_cache IS NULL AND quarantined_by IS NULL ORDER BY media_id"
+
+func (i *importer) importMedia(ctx context.Context) (int, error) {
+	if i.synapseMediaPath == "" {
+		logrus.Warn("Not importing media as --synapse-media-path wasn't supplied")
+		return 0, nil
+	}
+	rows, err := i.src.QueryContext(ctx, selectSynapseMediaSQL)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close() // nolint: errcheck
+	imported := 0
+	for rows.Next() {
+		var mediaID, contentType, uploadName, userID string
+		var size, created int64
+		if err = rows.Scan(&mediaID, &contentType, &size, &created, &uploadName, &userID); err != nil {
+			return imported, err
+		}
+		existing, err := i.mediaDB.GetMediaMetadata(ctx, types.MediaID(mediaID), i.serverName)
+		if err != nil {
+			return imported, fmt.Errorf("media %s: %w", mediaID, err)
+		}
+		if existing != nil {
+			continue
+		}
+		// Keeping the media ID means that existing mxc:// URIs keep working.
+		metadata := &types.MediaMetadata{
+			MediaID:           types.MediaID(mediaID),
+			Origin:            i.serverName,
+			ContentType:       types.ContentType(contentType),
+			CreationTimestamp: spec.Timestamp(created),
+			UploadName:        types.Filename(uploadName),
+			UserID:            types.MatrixUserID(userID),
+		}
+		if err = i.copyMediaFile(ctx, metadata); err != nil {
+			if os.IsNotExist(err) {
+				logrus.Warnf("Skipping media %s as its file is missing", mediaID)
+				continue
+			}
+			return imported, fmt.Errorf("media %s: %w", mediaID, err)
+		}
+		if err = i.mediaDB.StoreMediaMetadata(ctx, metadata); err != nil {
+			return imported, fmt.Errorf("media %s: %w", mediaID, err)
+		}
+		imported++
+	}
+	return imported, rows.Err()
+}
+
+// copyMediaFile copies the file for the media from the Synapse media store,
+// where it is stored by media ID, into our media store, where it is stored
+// by hash, and fills in the hash and size.
+func (i *importer) copyMediaFile(ctx context.Context, metadata *types.MediaMetadata) error {
+	mediaID := string(metadata.MediaID)
+	if len(mediaID) < 5 || strings.ContainsAny(mediaID, "/\\.") {
+		return fmt.Errorf("unexpected media ID")
+	}
+	file, err := os.Open(filepath.Join(i.synapseMediaPath, "local_content", mediaID[0:2], mediaID[2:4], mediaID[4:]))
+	if err != nil {
+		return err
+	}
+	defer file.Close() // nolint: errcheck
+	hash, size, tmpDir, err := fileutils.WriteTempFile(ctx, file, i.mediaPath)
+	if err != nil {
+		return err
+	}
+	metadata.Base64Hash, metadata.FileSizeBytes = hash, size
+	_, _, err = fileutils.MoveFileWithHashCheck(tmpDir, metadata, i.mediaPath, logrus.WithField("media_id", mediaID))
+	return err
+}
+
+// copyRows copies the rows selected from the Synapse database, given our
+// server name, into the user API database, returning how many
+// were inserted. The insert must skip rows which already exist.
+func (i *importer) copyRows(ctx context.Context, selectSQL, insertSQL string) (int, error) {
+	rows, err := i.src.QueryContext(ctx, selectSQL, i.serverName)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close() // nolint: errcheck
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for n := range values {
+		dest[n] = &values[n]
+	}
+	imported := 0
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return imported, err
+		}
+		res, err := i.userDB.ExecContext(ctx, insertSQL, values...)
+		if err != nil {
+			return imported, fmt.Errorf("%v: %w", values[:2], err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			imported++
+		}
+	}
+	return imported, rows.Err()
+}
+
+// Synapse stores when keys were added in milliseconds, and we store seconds.
+// The stream IDs of device keys are per user, so they can all start again.
+const selectSynapseDeviceKeysSQL = "" +
+	"SELECT k.user_id, k.device_id, k.ts_added_ms / 1000, k.key_json, d.display_name" +
+	" FROM e2e_device_keys_json k JOIN devices d ON k.user_id = d.user_id AND k.device_id = d.device_id" +
+	" WHERE NOT d.hidden AND k.user_id LIKE '@%:' || $1 ORDER BY k.user_id, k.device_id"
+
+const insertDeviceKeysSQL = "" +
+	"INSERT INTO keyserver_device_keys (user_id, device_id, ts_added_secs, key_json, stream_id, display_name)" +
+	" VALUES ($1, $2, $3, $4, 1, $5) ON CONFLICT DO NOTHING"
+
+func (i *importer) importDeviceKeys(ctx context.Context) (int, error) {
+	return i.copyRows(ctx, selectSynapseDeviceKeysSQL, insertDeviceKeysSQL)
+}
+
+const selectSynapseOneTimeKeysSQL = "" +
+	"SELECT user_id, device_id, key_id, algorithm, ts_added_ms / 1000, key_json FROM e2e_one_time_keys_json" +
+	" WHERE user_id LIKE '@%:' || $1 ORDER BY user_id, device_id"
+
+const insertOneTimeKeySQL = "" +
+	"INSERT INTO keyserver_one_time_keys (user_id, device_id, key_id, algorithm, ts_added_secs, key_json)" +
+	" VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING"
+
+func (i *importer) importOneTimeKeys(ctx context.Context) (int, error) {
+	return i.copyRows(ctx, selectSynapseOneTimeKeysSQL, insertOneTimeKeySQL)
+}
+
+// Synapse doesn't record when fallback keys were added.
+const selectSynapseFallbackKeysSQL = "" +
+	"SELECT user_id, device_id, key_id, algorithm, CAST(EXTRACT(EPOCH FROM NOW()) AS BIGINT), key_json, used" +
+	" FROM e2e_fallback_keys_json WHERE user_id LIKE '@%:' || $1 ORDER BY user_id, device_id"
+
+const insertFallbackKeySQL = "" +
+	"INSERT INTO keyserver_fallback_keys (user_id, device_id, key_id, algorithm, ts_added_secs, key_json, used)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING"
+
+func (i *importer) importFallbackKeys(ctx context.Context) (int, error) {
+	return i.copyRows(ctx, selectSynapseFallbackKeysSQL, insertFallbackKeySQL)
+}
+
+// Synapse keeps every cross-signing key that a user has uploaded, so take
+// the newest of each type.
+const selectSynapseCrossSigningKeysSQL = "" +
+	"SELECT DISTINCT ON (user_id, keytype) user_id, keytype, keydata FROM e2e_cross_signing_keys" +
+	" WHERE user_id LIKE '@%:' || $1 ORDER BY user_id, keytype, stream_id DESC"
+
+const insertCrossSigningKeySQL = "" +
+	"INSERT INTO keyserver_cross_signing_keys (user_id, key_type, key_data)" +
+	" VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+
+const insertCrossSigningSigSQL = "" +
+	"INSERT INTO keyserver_cross_signing_sigs (origin_user_id, origin_key_id, target_user_id, target_key_id, signature)" +
+	" VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING"
+
+func (i *importer) importCrossSigningKeys(ctx context.Context) (int, error) {
+	rows, err := i.src.QueryContext(ctx, selectSynapseCrossSigningKeysSQL, i.serverName)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close() // nolint: errcheck
+	imported := 0
+	for rows.Next() {
+		var userID, keyType string
+		var keyData []byte
+		if err = rows.Scan(&userID, &keyType, &keyData); err != nil {
+			return imported, err
+		}
+		key, err := parseCrossSigningKey(userID, keyType, keyData)
+		if err != nil {
+			return imported, fmt.Errorf("%s key of %s: %w", keyType, userID, err)
+		}
+		res, err := i.userDB.ExecContext(ctx, insertCrossSigningKeySQL, userID, key.keyType, key.keyData)
+		if err != nil {
+			return imported, fmt.Errorf("%s key of %s: %w", keyType, userID, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			imported++
+		}
+		for originKeyID, signature := range key.signatures {
+			if _, err = i.userDB.ExecContext(ctx, insertCrossSigningSigSQL,
+				userID, originKeyID, userID, key.keyID, signature,
+			); err != nil {
+				return imported, fmt.Errorf("signature on %s key of %s: %w", keyType, userID, err)
+			}
+		}
+	}
+	return imported, rows.Err()
+}
+
+// crossSigningKey is a cross-signing key as we store it: only the public key
+// is stored, and the signatures on it are stored separately.
+type crossSigningKey struct {
+	keyType    int16
+	keyID      gomatrixserverlib.KeyID
+	keyData    spec.Base64Bytes
+	signatures map[gomatrixserverlib.KeyID]spec.Base64Bytes
+}
+
+// parseCrossSigningKey parses a cross-signing key as Synapse stores it, which
+// is the whole key as it was uploaded, keeping only the signatures made by the
+// user who owns it, as they are the only ones that we store.
+func parseCrossSigningKey(userID, keyType string, keyData []byte) (*crossSigningKey, error) {
+	purpose := fclient.CrossSigningKeyPurpose(keyType)
+	keyTypeInt, ok := userapiTypes.KeyTypePurposeToInt[purpose]
+	if !ok {
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+	var uploaded fclient.CrossSigningKey
+	if err := json.Unmarshal(keyData, &uploaded); err != nil {
+		return nil, err
+	}
+	if len(uploaded.Keys) != 1 {
+		return nil, fmt.Errorf("expected one key but got %d", len(uploaded.Keys))
+	}
+	key := &crossSigningKey{
+		keyType:    keyTypeInt,
+		signatures: uploaded.Signatures[userID],
+	}
+	for keyID, publicKey := range uploaded.Keys {
+		key.keyID, key.keyData = keyID, publicKey
+	}
+	return key, nil
+}
+
+// Synapse stores the signatures that users upload for their devices and for
+// cross-signing keys alike, using the public key as the device ID for keys,
+// whereas we store the key ID of cross-signing keys.
+const selectSynapseCrossSigningSigsSQL = "" +
+	"SELECT s.user_id, s.key_id, s.target_user_id," +
+	"  CASE WHEN EXISTS (" +
+	"    SELECT 1 FROM e2e_cross_signing_keys k WHERE k.user_id = s.target_user_id" +
+	"    AND k.keydata::jsonb -> 'keys' ? ('ed25519:' || s.target_device_id)" +
+	"  ) THEN 'ed25519:' || s.target_device_id ELSE s.target_device_id END," +
+	"  s.signature" +
+	" FROM e2e_cross_signing_signatures s WHERE s.user_id LIKE '@%:' || $1 ORDER BY s.user_id"
+
+func (i *importer) importCrossSigningSigs(ctx context.Context) (int, error) {
+	return i.copyRows(ctx, selectSynapseCrossSigningSigsSQL, insertCrossSigningSigSQL)
+}
+
+// Backup versions are per user in Synapse, so the same version can be used
+// by more than one user, which is fine as we only need them to be unique per
+// user. The etag is a counter in Synapse, which we store as a string.
+const selectSynapseKeyBackupVersionsSQL = "" +
+	"SELECT user_id, version, algorithm, auth_data, COALESCE(etag, 0)::TEXT, deleted FROM e2e_room_keys_versions" +
+	" WHERE user_id LIKE '@%:' || $1 ORDER BY user_id, version"
+
+const insertKeyBackupVersionSQL = "" +
+	"INSERT INTO userapi_key_backup_versions (user_id, version, algorithm, auth_data, etag, deleted)" +
+	" VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING"
+
+// Clients use the newest backup version, so new versions must come after
+// all of the imported ones.
+const updateKeyBackupVersionSeqSQL = "" +
+	"SELECT setval('userapi_key_backup_versions_seq', GREATEST(" +
+	"  (SELECT COALESCE(MAX(version), 0) FROM userapi_key_backup_versions)," +
+	"  (SELECT last_value FROM userapi_key_backup_versions_seq)" +
+	"))"
+
+func (i *importer) importKeyBackupVersions(ctx context.Context) (int, error) {
+	imported, err := i.copyRows(ctx, selectSynapseKeyBackupVersionsSQL, insertKeyBackupVersionSQL)
+	if err != nil {
+		return imported, err
+	}
+	_, err = i.userDB.ExecContext(ctx, updateKeyBackupVersionSeqSQL)
+	return imported, err
+}
+
+const selectSynapseKeyBackupsSQL = "" +
+	"SELECT user_id, room_id, session_id, version::TEXT, first_message_index, forwarded_count, is_verified, session_data" +
+	" FROM e2e_room_keys WHERE user_id LIKE '@%:' || $1 ORDER BY user_id, version"
+
+const insertKeyBackupSQL = "" +
+	"INSERT INTO userapi_key_backups (user_id, room_id, session_id, version, first_message_index, forwarded_count, is_verified, session_data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING"
+
+func (i *importer) importKeyBackups(ctx context.Context) (int, error) {
+	return i.copyRows(ctx, selectSynapseKeyBackupsSQL, insertKeyBackupSQL)
+}
+
+// Rooms which were joined over federation and whose state hasn't been fully
+// fetched yet can't be imported, as we don't know their state.
+const selectSynapseRoomsSQL = "" +
+	"SELECT room_id, room_version FROM rooms r WHERE room_version IS NOT NULL" +
+	" AND EXISTS (SELECT 1 FROM event_forward_extremities f WHERE f.room_id = r.room_id)" +
+	" AND NOT EXISTS (SELECT 1 FROM partial_state_rooms p WHERE p.room_id = r.room_id)" +
+	" ORDER BY room_id"
+
+const selectSynapseForwardExtremitiesSQL = "" +
+	"SELECT event_id FROM event_forward_extremities WHERE room_id = $1 ORDER BY event_id"
+
+const selectSynapseCurrentStateSQL = "" +
+	"SELECT event_id FROM current_state_events WHERE room_id = $1 ORDER BY event_id"
+
+// The events are ordered by depth, so that they come after their prev_events
+// and auth_events.
+const selectSynapseRoomEventsSQL = "" +
+	"SELECT e.event_id, j.json, e.outlier, r.event_id IS NOT NULL, COALESCE(g.state_group, 0)," +
+	"  s.event_id IS NOT NULL, COALESCE(s.prev_state, '')" +
+	" FROM events e JOIN event_json j ON e.event_id = j.event_id" +
+	" LEFT JOIN rejections r ON e.event_id = r.event_id" +
+	" LEFT JOIN event_to_state_groups g ON e.event_id = g.event_id" +
+	" LEFT JOIN state_events s ON e.event_id = s.event_id" +
+	" WHERE e.room_id = $1 ORDER BY e.topological_ordering, e.stream_ordering"
+
+// Synapse stores the state at a state group as a delta against the previous
+// state group, so the whole state is found by walking back through them.
+const selectSynapseStateGroupSQL = "" +
+	"WITH RECURSIVE groups(state_group) AS (" +
+	"  VALUES($1::BIGINT)" +
+	"  UNION ALL SELECT e.prev_state_group FROM state_group_edges e, groups g WHERE e.state_group = g.state_group" +
+	") SELECT DISTINCT ON (type, state_key) type, state_key, event_id FROM state_groups_state" +
+	" WHERE state_group IN (SELECT state_group FROM groups) ORDER BY type, state_key, state_group DESC"
+
+// importRooms writes an archive of each room into the room archive path,
+// skipping rooms which have already been written.
+func (i *importer) importRooms(ctx context.Context) (int, error) {
+	if i.roomArchivePath == "" {
+		logrus.Warn("Not importing rooms as --room-archive-path wasn't supplied")
+		return 0, nil
+	}
+	if err := os.MkdirAll(i.roomArchivePath, 0700); err != nil {
+		return 0, err
+	}
+	rows, err := i.src.QueryContext(ctx, selectSynapseRoomsSQL)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close() // nolint: errcheck
+	type room struct {
+		roomID      string
+		roomVersion gomatrixserverlib.RoomVersion
+	}
+	rooms := []room{}
+	for rows.Next() {
+		var r room
+		if err = rows.Scan(&r.roomID, &r.roomVersion); err != nil {
+			return 0, err
+		}
+		rooms = append(rooms, r)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, r := range rooms {
+		if strings.ContainsAny(r.roomID, "/\\") {
+			logrus.Warnf("Skipping room %s as its ID can't be used as a file name", r.roomID)
+			continue
+		}
+		path := filepath.Join(i.roomArchivePath, r.roomID+".json")
+		if _, err = os.Stat(path); err == nil {
+			continue
+		}
+		if err = i.writeRoomArchiveFile(ctx, path, r.roomID, r.roomVersion); err != nil {
+			return imported, fmt.Errorf("room %s: %w", r.roomID, err)
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// writeRoomArchiveFile writes the archive to a temporary file first, so that
+// an archive is never left half written if the import is interrupted.
+func (i *importer) writeRoomArchiveFile(ctx context.Context, path, roomID string, roomVersion gomatrixserverlib.RoomVersion) error {
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + ".tmp") // nolint: errcheck
+	w := bufio.NewWriter(file)
+	if err = i.writeRoomArchive(ctx, w, roomID, roomVersion); err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// writeRoomArchive writes every event that Synapse stored in the room to w
+// as a RoomExport, in the same way as the room server exports rooms, so that
+// it can be imported with harmonyctl import-room.
+func (i *importer) writeRoomArchive(ctx context.Context, w io.Writer, roomID string, roomVersion gomatrixserverlib.RoomVersion) error {
+	verImpl, err := gomatrixserverlib.GetRoomVersion(roomVersion)
+	if err != nil {
+		return err
+	}
+	latestEventIDs, err := i.selectEventIDs(ctx, selectSynapseForwardExtremitiesSQL, roomID)
+	if err != nil {
+		return err
+	}
+	stateEventIDs, err := i.selectEventIDs(ctx, selectSynapseCurrentStateSQL, roomID)
+	if err != nil {
+		return err
+	}
+
+	// The events are written out one at a time into the events array, which
+	// is the last field of the export.
+	header, err := json.Marshal(&roomserverAPI.RoomExport{
+		Format:         roomserverAPI.RoomExportFormat,
+		RoomID:         roomID,
+		RoomVersion:    roomVersion,
+		ExportedBy:     i.serverName,
+		ExportedTS:     spec.AsTimestamp(time.Now()),
+		LatestEventIDs: latestEventIDs,
+		StateEventIDs:  stateEventIDs,
+		Events:         []roomserverAPI.RoomExportEvent{},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(bytes.TrimSuffix(header, []byte("]}"))); err != nil {
+		return err
+	}
+
+	rows, err := i.src.QueryContext(ctx, selectSynapseRoomEventsSQL, roomID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	stateAt := func(stateGroup int64) (map[gomatrixserverlib.StateKeyTuple]string, error) {
+		return i.selectStateGroup(ctx, stateGroup)
+	}
+	withState := map[string]struct{}{}
+	written := 0
+	for rows.Next() {
+		var ev synapseEvent
+		if err = rows.Scan(
+			&ev.eventID, &ev.json, &ev.outlier, &ev.rejected, &ev.stateGroup, &ev.isState, &ev.replacesState,
+		); err != nil {
+			return err
+		}
+		exported, err := exportEvent(verImpl, &ev, withState, stateAt)
+		if err != nil {
+			return fmt.Errorf("event %s: %w", ev.eventID, err)
+		}
+		js, err := json.Marshal(exported)
+		if err != nil {
+			return err
+		}
+		if written > 0 {
+			if _, err = io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if _, err = w.Write(js); err != nil {
+			return err
+		}
+		written++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]}")
+	return err
+}
+
+func (i *importer) selectEventIDs(ctx context.Context, query, roomID string) ([]string, error) {
+	rows, err := i.src.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	eventIDs := []string{}
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (i *importer) selectStateGroup(ctx context.Context, stateGroup int64) (map[gomatrixserverlib.StateKeyTuple]string, error) {
+	rows, err := i.src.QueryContext(ctx, selectSynapseStateGroupSQL, stateGroup)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	state := map[gomatrixserverlib.StateKeyTuple]string{}
+	for rows.Next() {
+		var tuple gomatrixserverlib.StateKeyTuple
+		var eventID string
+		if err = rows.Scan(&tuple.EventType, &tuple.StateKey, &eventID); err != nil {
+			return nil, err
+		}
+		state[tuple] = eventID
+	}
+	return state, rows.Err()
+}
+
+// synapseEvent is an event as Synapse stored it. The state group is of the
+// state after the event, or before it if it was rejected, and for state
+// events Synapse records the event that they replaced in the state.
+type synapseEvent struct {
+	eventID       string
+	json          []byte
+	outlier       bool
+	rejected      bool
+	stateGroup    int64
+	isState       bool
+	replacesState string
+}
+
+// exportEvent converts an event stored by Synapse into an event in a room
+// archive. The events with state are added to withState, and events whose
+// prev_events don't have state in the archive carry the state before them,
+// which is worked out from the state group of the event.
+func exportEvent(
+	verImpl gomatrixserverlib.IRoomVersion, ev *synapseEvent, withState map[string]struct{},
+	stateAt func(stateGroup int64) (map[gomatrixserverlib.StateKeyTuple]string, error),
+) (*roomserverAPI.RoomExportEvent, error) {
+	event, err := verImpl.NewEventFromTrustedJSONWithEventID(ev.eventID, ev.json, false)
+	if err != nil {
+		return nil, err
+	}
+	// Without a state group, there is no way to know the state at the event,
+	// so it can only be imported as an outlier.
+	exported := &roomserverAPI.RoomExportEvent{
+		Event:    event.JSON(),
+		Outlier:  ev.outlier || ev.stateGroup == 0,
+		Rejected: ev.rejected,
+	}
+	if exported.Outlier {
+		return exported, nil
+	}
+	for _, prevEventID := range event.PrevEventIDs() {
+		if _, ok := withState[prevEventID]; ok {
+			continue
+		}
+		state, err := stateAt(ev.stateGroup)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load state group %d: %w", ev.stateGroup, err)
+		}
+		if ev.isState && !ev.rejected && event.StateKey() != nil {
+			tuple := gomatrixserverlib.StateKeyTuple{EventType: event.Type(), StateKey: *event.StateKey()}
+			if ev.replacesState != "" {
+				state[tuple] = ev.replacesState
+			} else {
+				delete(state, tuple)
+			}
+		}
+		exported.StateBefore = make([]string, 0, len(state))
+		for _, eventID := range state {
+			exported.StateBefore = append(exported.StateBefore, eventID)
+		}
+		sort.Strings(exported.StateBefore)
+		break
+	}
+	withState[ev.eventID] = struct{}{}
+	return exported, nil
+}
+
+// verify compares the number of users, profiles, devices, media, keys and
+// rooms in Synapse with the number imported, returning false if any are
+// missing. Media whose files were missing will show up here.
+func (i *importer) verify(ctx context.Context) bool {
+	ok := true
+	for _, check := range []struct {
+		name        string
+		synapse     string
+		synapseArgs []interface{}
+		harmony     string
+		harmonyDB   *sql.DB
+	}{
+		{
+			name:        "users",
+			synapse:     "SELECT COUNT(*) FROM users WHERE name LIKE '@%:' || $1",
+			synapseArgs: []interface{}{i.serverName},
+			harmony:     "SELECT COUNT(*) FROM userapi_accounts WHERE server_name = $1",
+			harmonyDB:   i.userDB,
+		},
+		{
+			name:      "profiles",
+			synapse:   "SELECT COUNT(*) FROM profiles",
+			harmony:   "SELECT COUNT(*) FROM userapi_profiles WHERE server_name = $1",
+			harmonyDB: i.userDB,
+		},
+		{
+			name: "devices",
+			synapse: "SELECT COUNT(DISTINCT (d.user_id, d.device_id)) FROM devices d JOIN access_tokens t" +
+				" ON d.user_id = t.user_id AND d.device_id = t.device_id WHERE NOT d.hidden AND d.user_id LIKE '@%:' || $1",
+			synapseArgs: []interface{}{i.serverName},
+			harmony:     "SELECT COUNT(*) FROM userapi_devices WHERE server_name = $1",
+			harmonyDB:   i.userDB,
+		},
+		{
+			name:      "media",
+			synapse:   "SELECT COUNT(*) FROM local_media_repository WHERE url_cache IS NULL AND quarantined_by IS NULL",
+			harmony:   "SELECT COUNT(*) FROM mediaapi_media_repository WHERE media_origin = $1",
+			harmonyDB: i.mediaSQL,
+		},
+		{
+			name: "device keys",
+			synapse: "SELECT COUNT(*) FROM e2e_device_keys_json k JOIN devices d" +
+				" ON k.user_id = d.user_id AND k.device_id = d.device_id WHERE NOT d.hidden AND k.user_id LIKE '@%:' || $1",
+			synapseArgs: []interface{}{i.serverName},
+			harmony:     "SELECT COUNT(*) FROM keyserver_device_keys WHERE user_id LIKE '@%:' || $1",
+			harmonyDB:   i.userDB,
+		},
+		{
+			name:        "one-time keys",
+			synapse:     "SELECT COUNT(*) FROM e2e_one_time_keys_json WHERE user_id LIKE '@%:' || $1",
+			synapseArgs: []interface{}{i.serverName},
+			harmony:     "SELECT COUNT(*) FROM keyserver_one_time_keys WHERE user_id LIKE '@%:' || $1",
+			harmonyDB:   i.userDB,
+		},
+		{
+			name:        "cross-signing keys",
+			synapse:     "SELECT COUNT(DISTINCT (user_id, keytype)) FROM e2e_cross_signing_keys WHERE user_id LIKE '@%:' || $1",
+			synapseArgs: []interface{}{i.serverName},
+			harmony:     "SELECT COUNT(*) FROM keyserver_cross_signing_keys WHERE user_id LIKE '@%:' || $1",
+			harmonyDB:   i.userDB,
+		},
+		{
+			name:        "key backups",
+			synapse:     "SELECT COUNT(*) FROM e2e_room_keys WHERE user_id LIKE '@%:' || $1",
+			synapseArgs: []interface{}{i.serverName},
+			harmony:     "SELECT COUNT(*) FROM userapi_key_backups WHERE user_id LIKE '@%:' || $1",
+			harmonyDB:   i.userDB,
+		},
+	} {
+		var fromSynapse, fromHarmony int64
+		if err := i.src.QueryRowContext(ctx, check.synapse, check.synapseArgs...).Scan(&fromSynapse); err != nil {
+			logrus.WithError(err).Errorf("Failed to count %s in Synapse", check.name)
+			ok = false
+			continue
+		}
+		if err := check.harmonyDB.QueryRowContext(ctx, check.harmony, i.serverName).Scan(&fromHarmony); err != nil {
+			logrus.WithError(err).Errorf("Failed to count %s in Harmony", check.name)
+			ok = false
+			continue
+		}
+		// There may be more in Harmony, i.e. the server notices user, but
+		// there should never be fewer.
+		if fromHarmony < fromSynapse {
+			logrus.Errorf("%s: %d in Synapse but only %d in Harmony", check.name, fromSynapse, fromHarmony)
+			ok = false
+			continue
+		}
+		logrus.Infof("%s: %d in Synapse, %d in Harmony", check.name, fromSynapse, fromHarmony)
+	}
+	if i.roomArchivePath != "" && !i.verifyRooms(ctx) {
+		ok = false
+	}
+	return ok
+}
+
+// verifyRooms checks that there is an archive for every room that can be
+// imported. The rooms themselves are checked by the room server when the
+// archives are imported.
+func (i *importer) verifyRooms(ctx context.Context) bool {
+	rows, err := i.src.QueryContext(ctx, selectSynapseRoomsSQL)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list rooms in Synapse")
+		return false
+	}
+	defer rows.Close() // nolint: errcheck
+	rooms, missing := 0, 0
+	for rows.Next() {
+		var roomID, roomVersion string
+		if err = rows.Scan(&roomID, &roomVersion); err != nil {
+			logrus.WithError(err).Error("Failed to list rooms in Synapse")
+			return false
+		}
+		rooms++
+		if _, err = os.Stat(filepath.Join(i.roomArchivePath, roomID+".json")); err != nil {
+			logrus.Errorf("rooms: no archive of %s", roomID)
+			missing++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		logrus.WithError(err).Error("Failed to list rooms in Synapse")
+		return false
+	}
+	logrus.Infof("rooms: %d in Synapse, %d archived", rooms, rooms-missing)
+	return missing == 0
+}
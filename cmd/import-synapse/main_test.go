@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/caching"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	mediaapiStorage "github.com/neilalexander/harmony/mediaapi/storage"
+	"github.com/neilalexander/harmony/roomserver"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/neilalexander/harmony/test"
+	"github.com/neilalexander/harmony/test/testrig"
+	userapiStorage "github.com/neilalexander/harmony/userapi/storage"
+)
+
+func TestLocalpart(t *testing.T) {
+	imp := &importer{serverName: "test", suffix: ":test"}
+	for userID, want := range map[string]string{
+		"@alice:test":        "alice",
+		"@alice:test.remote": "",
+		"@alice:remote":      "",
+		"alice:test":         "",
+	} {
+		localpart, ok := imp.localpart(userID)
+		if localpart != want || ok != (want != "") {
+			t.Errorf("got %q, %v for %s, want %q", localpart, ok, userID, want)
+		}
+	}
+}
+
+func TestParseCrossSigningKey(t *testing.T) {
+	keyData := []byte(`{
+		"user_id": "@alice:test",
+		"usage": ["self_signing"],
+		"keys": {"ed25519:c3Nr": "c3Nr"},
+		"signatures": {
+			"@alice:test": {"ed25519:bWFzdGVy": "c2lnbmF0dXJl"},
+			"@bob:test": {"ed25519:Ym9i": "c2lnbmF0dXJl"}
+		}
+	}`)
+	key, err := parseCrossSigningKey("@alice:test", "self_signing", keyData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.keyType != 2 || key.keyID != "ed25519:c3Nr" || string(key.keyData) != "ssk" {
+		t.Fatalf("unexpected key %+v", key)
+	}
+	// Only the signatures made by the owner of the key are kept.
+	want := map[gomatrixserverlib.KeyID]spec.Base64Bytes{"ed25519:bWFzdGVy": spec.Base64Bytes("signature")}
+	if !reflect.DeepEqual(key.signatures, want) {
+		t.Fatalf("got signatures %v, want %v", key.signatures, want)
+	}
+
+	if _, err = parseCrossSigningKey("@alice:test", "unknown", keyData); err == nil {
+		t.Fatal("expected an unknown key type to fail")
+	}
+	if _, err = parseCrossSigningKey("@alice:test", "master", []byte(`{"keys": {}}`)); err == nil {
+		t.Fatal("expected a key without a public key to fail")
+	}
+}
+
+func TestExportEvent(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	events := room.Events()
+	verImpl := gomatrixserverlib.MustGetRoomVersion(room.Version)
+	create, member, powerLevels := events[0], events[1], events[2]
+
+	// The state after the power levels, which is what Synapse stores for it.
+	stateGroups := map[int64]map[gomatrixserverlib.StateKeyTuple]string{
+		3: {
+			{EventType: spec.MRoomCreate, StateKey: ""}:            create.EventID(),
+			{EventType: spec.MRoomMember, StateKey: alice.ID}:      member.EventID(),
+			{EventType: spec.MRoomPowerLevels, StateKey: ""}:       powerLevels.EventID(),
+			{EventType: spec.MRoomHistoryVisibility, StateKey: ""}: "$other",
+		},
+	}
+	lookups := 0
+	stateAt := func(stateGroup int64) (map[gomatrixserverlib.StateKeyTuple]string, error) {
+		lookups++
+		state, ok := stateGroups[stateGroup]
+		if !ok {
+			return nil, errors.New("unknown state group")
+		}
+		// Return a copy, as Synapse would.
+		copied := make(map[gomatrixserverlib.StateKeyTuple]string, len(state))
+		for tuple, eventID := range state {
+			copied[tuple] = eventID
+		}
+		return copied, nil
+	}
+	export := func(withState map[string]struct{}, ev *synapseEvent) *roomserverAPI.RoomExportEvent {
+		t.Helper()
+		exported, err := exportEvent(verImpl, ev, withState, stateAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exported
+	}
+
+	// The prev_events of the power levels have state, so no state is needed.
+	withState := map[string]struct{}{member.EventID(): {}}
+	exported := export(withState, &synapseEvent{eventID: powerLevels.EventID(), json: powerLevels.JSON(), stateGroup: 3, isState: true})
+	if exported.Outlier || exported.StateBefore != nil || lookups != 0 {
+		t.Fatalf("unexpected export %+v after %d lookups", exported, lookups)
+	}
+	if _, ok := withState[powerLevels.EventID()]; !ok {
+		t.Fatal("expected the power levels to have state")
+	}
+
+	// Otherwise the state before the event is worked out from the state after
+	// it, which means replacing the event with the one that it replaced.
+	exported = export(map[string]struct{}{}, &synapseEvent{
+		eventID: powerLevels.EventID(), json: powerLevels.JSON(), stateGroup: 3, isState: true, replacesState: "$old",
+	})
+	if want := sortedStrings(create.EventID(), member.EventID(), "$old", "$other"); !reflect.DeepEqual(exported.StateBefore, want) {
+		t.Fatalf("got state before %v, want %v", exported.StateBefore, want)
+	}
+	// If it didn't replace anything, it isn't in the state before.
+	exported = export(map[string]struct{}{}, &synapseEvent{
+		eventID: powerLevels.EventID(), json: powerLevels.JSON(), stateGroup: 3, isState: true,
+	})
+	if want := sortedStrings(create.EventID(), member.EventID(), "$other"); !reflect.DeepEqual(exported.StateBefore, want) {
+		t.Fatalf("got state before %v, want %v", exported.StateBefore, want)
+	}
+	// Rejected events didn't change the state, so Synapse stored the state
+	// before them.
+	exported = export(map[string]struct{}{}, &synapseEvent{
+		eventID: powerLevels.EventID(), json: powerLevels.JSON(), stateGroup: 3, isState: true, rejected: true,
+	})
+	if !exported.Rejected || len(exported.StateBefore) != 4 {
+		t.Fatalf("unexpected export %+v", exported)
+	}
+
+	// Outliers and events without a state group don't have state.
+	lookups = 0
+	for _, ev := range []*synapseEvent{
+		{eventID: powerLevels.EventID(), json: powerLevels.JSON(), stateGroup: 3, isState: true, outlier: true},
+		{eventID: powerLevels.EventID(), json: powerLevels.JSON(), isState: true},
+	} {
+		withState = map[string]struct{}{}
+		exported = export(withState, ev)
+		if !exported.Outlier || exported.StateBefore != nil || len(withState) != 0 || lookups != 0 {
+			t.Fatalf("unexpected export %+v", exported)
+		}
+	}
+
+	// Failing to load the state fails the export.
+	if _, err := exportEvent(verImpl, &synapseEvent{
+		eventID: powerLevels.EventID(), json: powerLevels.JSON(), stateGroup: 4,
+	}, map[string]struct{}{}, stateAt); err == nil {
+		t.Fatal("expected an unknown state group to fail")
+	}
+}
+
+func sortedStrings(s ...string) []string {
+	sort.Strings(s)
+	return s
+}
+
+// synapseSchema is the part of the Synapse schema that is imported.
+const synapseSchema = `
+CREATE TABLE users (name TEXT, password_hash TEXT, creation_ts BIGINT, admin SMALLINT, is_guest SMALLINT, appservice_id TEXT, deactivated SMALLINT);
+CREATE TABLE profiles (user_id TEXT, displayname TEXT, avatar_url TEXT);
+CREATE TABLE devices (user_id TEXT, device_id TEXT, display_name TEXT, last_seen BIGINT, ip TEXT, user_agent TEXT, hidden BOOLEAN);
+CREATE TABLE access_tokens (id BIGINT, user_id TEXT, device_id TEXT, token TEXT);
+CREATE TABLE local_media_repository (media_id TEXT, media_type TEXT, media_length INT, created_ts BIGINT, upload_name TEXT, user_id TEXT, url_cache TEXT, quarantined_by TEXT);
+CREATE TABLE e2e_device_keys_json (user_id TEXT, device_id TEXT, ts_added_ms BIGINT, key_json TEXT);
+CREATE TABLE e2e_one_time_keys_json (user_id TEXT, device_id TEXT, algorithm TEXT, key_id TEXT, ts_added_ms BIGINT, key_json TEXT);
+CREATE TABLE e2e_fallback_keys_json (user_id TEXT, device_id TEXT, algorithm TEXT, key_id TEXT, key_json TEXT, used BOOLEAN);
+CREATE TABLE e2e_cross_signing_keys (user_id TEXT, keytype TEXT, keydata TEXT, stream_id BIGINT);
+CREATE TABLE e2e_cross_signing_signatures (user_id TEXT, key_id TEXT, target_user_id TEXT, target_device_id TEXT, signature TEXT);
+CREATE TABLE e2e_room_keys_versions (user_id TEXT, version BIGINT, algorithm TEXT, auth_data TEXT, deleted SMALLINT, etag BIGINT);
+CREATE TABLE e2e_room_keys (user_id TEXT, room_id TEXT, session_id TEXT, version BIGINT, first_message_index INT, forwarded_count INT, is_verified BOOLEAN, session_data TEXT);
+CREATE TABLE rooms (room_id TEXT, room_version TEXT);
+CREATE TABLE partial_state_rooms (room_id TEXT);
+CREATE TABLE events (event_id TEXT, room_id TEXT, topological_ordering BIGINT, stream_ordering BIGINT, outlier BOOLEAN);
+CREATE TABLE event_json (event_id TEXT, room_id TEXT, json TEXT);
+CREATE TABLE rejections (event_id TEXT);
+CREATE TABLE event_forward_extremities (event_id TEXT, room_id TEXT);
+CREATE TABLE current_state_events (event_id TEXT, room_id TEXT, type TEXT, state_key TEXT);
+CREATE TABLE state_events (event_id TEXT, room_id TEXT, type TEXT, state_key TEXT, prev_state TEXT);
+CREATE TABLE event_to_state_groups (event_id TEXT, state_group BIGINT);
+CREATE TABLE state_group_edges (state_group BIGINT, prev_state_group BIGINT);
+CREATE TABLE state_groups_state (state_group BIGINT, room_id TEXT, type TEXT, state_key TEXT, event_id TEXT);
+`
+
+func TestImport(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		ctx := context.Background()
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		// Synapse signs with its own key, which this server doesn't have.
+		alice := test.NewUser(t, test.WithSigningServer("test", "ed25519:synapse", test.PrivateKeyA))
+		room := test.NewRoom(t, alice)
+
+		// Synapse and Harmony don't share any table names, so they can both
+		// use the same database.
+		src, err := sql.Open("postgres", connStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close() // nolint: errcheck
+		mustExec := func(query string, args ...interface{}) {
+			t.Helper()
+			if _, err := src.Exec(query, args...); err != nil {
+				t.Fatalf("%s: %s", query, err)
+			}
+		}
+		mustExec(synapseSchema)
+		mustExec("INSERT INTO users VALUES ($1, 'hash', 1700000000, 1, 0, NULL, 0), ('@bob:remote', 'hash', 0, 0, 0, NULL, 0)", alice.ID)
+		mustExec("INSERT INTO profiles VALUES ($1, 'Alice', 'mxc://test/avatar')", alice.Localpart)
+		mustExec("INSERT INTO devices VALUES ($1, 'DEV', 'Phone', 1700000000000, '127.0.0.1', 'test', FALSE), ($1, 'bWFzdGVy', NULL, NULL, NULL, NULL, TRUE)", alice.ID)
+		mustExec("INSERT INTO access_tokens VALUES (1, $1, 'DEV', 'old'), (2, $1, 'DEV', 'new')", alice.ID)
+		mustExec("INSERT INTO e2e_device_keys_json VALUES ($1, 'DEV', 1700000000000, '{}'), ($1, 'bWFzdGVy', 1700000000000, '{}')", alice.ID)
+		mustExec("INSERT INTO e2e_one_time_keys_json VALUES ($1, 'DEV', 'signed_curve25519', 'AAAAAQ', 1700000000000, '{}')", alice.ID)
+		mustExec("INSERT INTO e2e_fallback_keys_json VALUES ($1, 'DEV', 'signed_curve25519', 'AAAAAg', '{}', TRUE)", alice.ID)
+		mustExec("INSERT INTO e2e_cross_signing_keys VALUES"+
+			" ($1, 'master', '{\"keys\": {\"ed25519:b2xk\": \"b2xk\"}}', 1),"+
+			" ($1, 'master', $2, 2),"+
+			" ('@bob:remote', 'master', '{\"keys\": {\"ed25519:Ym9i\": \"Ym9i\"}}', 3)",
+			alice.ID, `{"keys": {"ed25519:bWFzdGVy": "bWFzdGVy"}, "signatures": {"`+alice.ID+`": {"ed25519:DEV": "c2lnbmF0dXJl"}}}`)
+		mustExec("INSERT INTO e2e_cross_signing_signatures VALUES ($1, 'ed25519:c3Nr', $1, 'DEV', 'c2ln'), ($1, 'ed25519:dXNr', '@bob:remote', 'Ym9i', 'c2ln')", alice.ID)
+		mustExec("INSERT INTO e2e_room_keys_versions VALUES ($1, 5, 'm.megolm_backup.v1.curve25519-aes-sha2', '{}', 0, NULL)", alice.ID)
+		mustExec("INSERT INTO e2e_room_keys VALUES ($1, $2, 'session', 5, 0, 0, TRUE, '{}')", alice.ID, room.ID)
+
+		// The room is stored as Synapse would have, with a state group for
+		// each state event, each of which is a delta against the last. The
+		// create event is an outlier, so the event after it needs state.
+		mustExec("INSERT INTO rooms VALUES ($1, $2), ('!partial:test', $2)", room.ID, room.Version)
+		mustExec("INSERT INTO partial_state_rooms VALUES ('!partial:test')")
+		mustExec("INSERT INTO event_forward_extremities VALUES ('$partial', '!partial:test')")
+		state := map[gomatrixserverlib.StateKeyTuple]string{}
+		stateGroup := int64(0)
+		for i, ev := range room.Events() {
+			outlier := i == 0
+			mustExec("INSERT INTO events VALUES ($1, $2, $3, $4, $5)", ev.EventID(), room.ID, ev.Depth(), i+1, outlier)
+			mustExec("INSERT INTO event_json VALUES ($1, $2, $3)", ev.EventID(), room.ID, string(ev.JSON()))
+			tuple := gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}
+			mustExec("INSERT INTO state_events VALUES ($1, $2, $3, $4, NULLIF($5, ''))", ev.EventID(), room.ID, tuple.EventType, tuple.StateKey, state[tuple])
+			state[tuple] = ev.EventID()
+			stateGroup++
+			if stateGroup > 1 {
+				mustExec("INSERT INTO state_group_edges VALUES ($1, $2)", stateGroup, stateGroup-1)
+			}
+			mustExec("INSERT INTO state_groups_state VALUES ($1, $2, $3, $4, $5)", stateGroup, room.ID, tuple.EventType, tuple.StateKey, ev.EventID())
+			if !outlier {
+				mustExec("INSERT INTO event_to_state_groups VALUES ($1, $2)", ev.EventID(), stateGroup)
+			}
+			mustExec("INSERT INTO current_state_events VALUES ($1, $2, $3, $4)", ev.EventID(), room.ID, tuple.EventType, tuple.StateKey)
+		}
+		mustExec("INSERT INTO event_forward_extremities VALUES ($1, $2)", room.ForwardExtremities()[0], room.ID)
+
+		cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+		dbOpts := &config.DatabaseOptions{ConnectionString: config.DataSource(connStr)}
+		if _, err = userapiStorage.NewUserDatabase(ctx, cm, dbOpts, "test", 4, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+		mediaDB, err := mediaapiStorage.NewMediaAPIDatasource(cm, dbOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, _, err := cm.Connection(dbOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imp := &importer{
+			src:             src,
+			userDB:          db,
+			mediaDB:         mediaDB,
+			mediaSQL:        db,
+			serverName:      "test",
+			suffix:          ":test",
+			mediaPath:       config.Path(t.TempDir()),
+			roomArchivePath: filepath.Join(t.TempDir(), "rooms"),
+		}
+		if imp.verify(ctx) {
+			t.Fatal("expected verifying before importing to fail")
+		}
+		// Running the import again carries on where it left off, without
+		// importing anything twice.
+		for i := 0; i < 2; i++ {
+			if err = imp.run(ctx); err != nil {
+				t.Fatalf("import %d failed: %s", i, err)
+			}
+		}
+		if !imp.verify(ctx) {
+			t.Fatal("expected verifying after importing to succeed")
+		}
+
+		for query, want := range map[string]string{
+			"SELECT account_type FROM userapi_accounts WHERE localpart = $1":                                "3",
+			"SELECT display_name FROM userapi_profiles WHERE localpart = $1":                                "Alice",
+			"SELECT access_token FROM userapi_devices WHERE localpart = $1":                                 "new",
+			"SELECT ts_added_secs FROM keyserver_device_keys WHERE user_id = '@' || $1 || ':test'":          "1700000000",
+			"SELECT key_id FROM keyserver_one_time_keys WHERE user_id = '@' || $1 || ':test'":               "AAAAAQ",
+			"SELECT used FROM keyserver_fallback_keys WHERE user_id = '@' || $1 || ':test'":                 "true",
+			"SELECT key_data FROM keyserver_cross_signing_keys WHERE user_id = '@' || $1 || ':test'":        "bWFzdGVy",
+			"SELECT etag FROM userapi_key_backup_versions WHERE user_id = '@' || $1 || ':test'":             "0",
+			"SELECT version FROM userapi_key_backups WHERE user_id = '@' || $1 || ':test'":                  "5",
+			"SELECT COUNT(*) FROM keyserver_cross_signing_sigs WHERE origin_user_id = '@' || $1 || ':test'": "3",
+		} {
+			var got string
+			if err = db.QueryRow(query, alice.Localpart).Scan(&got); err != nil {
+				t.Fatalf("%s: %s", query, err)
+			}
+			if got != want {
+				t.Errorf("%s: got %q, want %q", query, got, want)
+			}
+		}
+		// Signatures on cross-signing keys are stored against their key ID.
+		var targetKeyID string
+		if err = db.QueryRow(
+			"SELECT target_key_id FROM keyserver_cross_signing_sigs WHERE target_user_id = '@bob:remote'",
+		).Scan(&targetKeyID); err != nil || targetKeyID != "ed25519:Ym9i" {
+			t.Fatalf("got target key ID %q, %v", targetKeyID, err)
+		}
+		// New backup versions come after the imported ones.
+		var nextVersion int64
+		if err = db.QueryRow("SELECT nextval('userapi_key_backup_versions_seq')").Scan(&nextVersion); err != nil || nextVersion <= 5 {
+			t.Fatalf("got next backup version %d, %v", nextVersion, err)
+		}
+
+		// The room is archived, but the partial state room isn't.
+		if _, err = os.Stat(filepath.Join(imp.roomArchivePath, "!partial:test.json")); !os.IsNotExist(err) {
+			t.Fatalf("expected no archive of the partial state room, got %v", err)
+		}
+		archive, err := os.ReadFile(filepath.Join(imp.roomArchivePath, room.ID+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var export roomserverAPI.RoomExport
+		if err = json.Unmarshal(archive, &export); err != nil {
+			t.Fatal(err)
+		}
+		events := room.Events()
+		if export.Format != roomserverAPI.RoomExportFormat || export.RoomVersion != room.Version || len(export.Events) != len(events) {
+			t.Fatalf("unexpected export of %d events: %+v", len(export.Events), export)
+		}
+		if !reflect.DeepEqual(export.LatestEventIDs, room.ForwardExtremities()) || len(export.StateEventIDs) != len(events) {
+			t.Fatalf("got latest events %v and state %v", export.LatestEventIDs, export.StateEventIDs)
+		}
+		for i, exported := range export.Events {
+			switch {
+			case i == 0 && !exported.Outlier:
+				t.Fatal("expected the create event to be an outlier")
+			case i == 1 && !reflect.DeepEqual(exported.StateBefore, []string{events[0].EventID()}):
+				t.Fatalf("got state before the join %v, want the create event", exported.StateBefore)
+			case i > 1 && (exported.Outlier || exported.StateBefore != nil):
+				t.Fatalf("unexpected export of event %d: %+v", i, exported)
+			}
+		}
+
+		// The room server rebuilds the room and its state from the archive.
+		// The room was created by Synapse, whose key is configured as an old
+		// key of this server, so the events are signed again with this
+		// server's key.
+		cfg, processCtx, closeRig := testrig.CreateConfig(t, dbType)
+		defer closeRig()
+		cfg.Global.OldVerifyKeys = []*config.OldVerifyKeys{{
+			KeyID:     "ed25519:synapse",
+			PublicKey: spec.Base64Bytes(test.PrivateKeyA.Public().(ed25519.PublicKey)),
+		}}
+		caches := caching.NewRistrettoCache(8*1024*1024, time.Hour, caching.DisableMetrics)
+		rsCM := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, rsCM, &jetstream.NATSInstance{}, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, &gomatrixserverlib.KeyRing{KeyDatabase: &localKeyDatabase{cfg: &cfg.Global}})
+		file, err := os.Open(filepath.Join(imp.roomArchivePath, room.ID+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close() // nolint: errcheck
+		res, err := rsAPI.PerformAdminImportRoom(ctx, file, func(done, total int64) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Imported != len(events) || res.Resigned != len(events) {
+			t.Fatalf("unexpected import result %+v", res)
+		}
+		var stateRes roomserverAPI.QueryLatestEventsAndStateResponse
+		if err = rsAPI.QueryLatestEventsAndState(ctx, &roomserverAPI.QueryLatestEventsAndStateRequest{RoomID: room.ID}, &stateRes); err != nil {
+			t.Fatal(err)
+		}
+		stateEventIDs := make([]string, 0, len(stateRes.StateEvents))
+		for _, ev := range stateRes.StateEvents {
+			stateEventIDs = append(stateEventIDs, ev.EventID())
+		}
+		sort.Strings(stateEventIDs)
+		if !stateRes.RoomExists || !reflect.DeepEqual(stateEventIDs, export.StateEventIDs) {
+			t.Fatalf("got state %v, want %v", stateEventIDs, export.StateEventIDs)
+		}
+	})
+}
+
+// localKeyDatabase only knows the current signing key of this server.
+type localKeyDatabase struct {
+	cfg *config.Global
+}
+
+func (d *localKeyDatabase) FetcherName() string {
+	return "localKeyDatabase"
+}
+
+func (d *localKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		if req.ServerName != d.cfg.ServerName || req.KeyID != d.cfg.KeyID {
+			continue
+		}
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    gomatrixserverlib.VerifyKey{Key: spec.Base64Bytes(d.cfg.PrivateKey.Public().(ed25519.PublicKey))},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: spec.AsTimestamp(time.Now().Add(time.Hour)),
+		}
+	}
+	return results, nil
+}
+
+func (d *localKeyDatabase) StoreKeys(ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) error {
+	return nil
+}
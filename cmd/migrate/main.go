@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/setup"
+	"github.com/neilalexander/harmony/setup/process"
+)
+
+// This is a utility for managing database migrations explicitly, rather than
+// leaving them to run when the server starts. Migrations are found by opening
+// the storage for each component, which is also what applies them.
+//
+// status lists the migrations for each component and whether they have been
+// applied. up applies any pending migrations. down reverts a single applied
+// migration, if it can be reverted, but note that it will be applied again
+// the next time that the server starts, so this is only useful before going
+// back to an older version. down refuses to run while there are pending
+// migrations, as opening the storage would apply them first.
+//
+// With --dry-run, nothing is committed to the database and the SQL which
+// would be run by each migration is printed instead. status always works
+// this way. This also creates any missing tables in the same transaction,
+// so it works on an empty database too.
+//
+// Usage: ./migrate --config dendrite.yaml [--dry-run] status|up|down <version>
+
+var dryRun = flag.Bool("dry-run", false, "print the SQL that would be run instead of running it")
+
+func main() {
+	ctx := context.Background()
+	cfg := setup.ParseFlags(true)
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: migrate --config dendrite.yaml [--dry-run] status|up|down <version>")
+		os.Exit(1)
+	}
+
+	var statements []migrationStatement
+	var cm *sqlutil.Connections
+	if *dryRun || args[0] == "status" {
+		cm = sqlutil.NewSandboxConnectionManager(cfg.Global.DatabaseOptions, func(ctx context.Context, _ time.Time, query string) {
+			if version, ok := sqlutil.MigrationFromContext(ctx); ok {
+				statements = append(statements, migrationStatement{version, query})
+			}
+		})
+	} else {
+		cm = sqlutil.NewConnectionManager(process.NewProcessContext(), cfg.Global.DatabaseOptions)
+	}
+
+	switch args[0] {
+	case "status":
+		if err := setup.OpenStorage(ctx, cm, cfg); err != nil {
+			fatal(err)
+		}
+		for _, migration := range sqlutil.Migrations() {
+			status := "pending"
+			if migration.Applied {
+				status = "applied"
+			}
+			if migration.Reversible {
+				status += ", reversible"
+			}
+			fmt.Printf("%-16s %-20s %s\n", component(migration.Version), status, migration.Version)
+		}
+
+	case "up":
+		if err := setup.OpenStorage(ctx, cm, cfg); err != nil {
+			fatal(err)
+		}
+		applied := 0
+		for _, migration := range sqlutil.Migrations() {
+			if migration.Applied {
+				continue
+			}
+			applied++
+			if *dryRun {
+				fmt.Printf("Would apply %q\n", migration.Version)
+				printStatements(statements, migration.Version)
+			} else {
+				fmt.Printf("Applied %q\n", migration.Version)
+			}
+		}
+		if applied == 0 {
+			fmt.Println("No pending migrations")
+		}
+
+	case "down":
+		if len(args) != 2 {
+			fatal(fmt.Errorf("down needs the version of the migration to revert"))
+		}
+		if !*dryRun {
+			// Opening the storage applies any pending migrations, so check
+			// that there aren't any without committing anything first.
+			sandbox := sqlutil.NewSandboxConnectionManager(cfg.Global.DatabaseOptions, func(context.Context, time.Time, string) {})
+			if err := setup.OpenStorage(ctx, sandbox, cfg); err != nil {
+				fatal(err)
+			}
+			for _, migration := range sqlutil.Migrations() {
+				if !migration.Applied {
+					fatal(fmt.Errorf("migration %q is pending, run up before reverting migrations", migration.Version))
+				}
+			}
+		}
+		if err := setup.OpenStorage(ctx, cm, cfg); err != nil {
+			fatal(err)
+		}
+		if err := sqlutil.RevertMigration(ctx, args[1]); err != nil {
+			fatal(err)
+		}
+		if *dryRun {
+			fmt.Printf("Would revert %q\n", args[1])
+			printStatements(statements, args[1])
+		} else {
+			fmt.Printf("Reverted %q\n", args[1])
+		}
+
+	default:
+		fatal(fmt.Errorf("unknown command %q", args[0]))
+	}
+}
+
+type migrationStatement struct {
+	version string
+	query   string
+}
+
+func printStatements(statements []migrationStatement, version string) {
+	for _, statement := range statements {
+		if statement.version == version {
+			fmt.Printf("    %s;\n", strings.Join(strings.Fields(statement.query), " "))
+		}
+	}
+}
+
+// component returns the component that a migration belongs to, which by
+// convention is the start of the version up to the first colon.
+func component(version string) string {
+	if i := strings.Index(version, ":"); i > 0 {
+		return version[:i]
+	}
+	return "-"
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(1)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
 
 	"github.com/neilalexander/harmony/federationapi/types"
 	rstypes "github.com/neilalexander/harmony/roomserver/types"
@@ -46,6 +47,57 @@ type ClientFederationAPI interface {
 	// containing only the server names (without information for membership events).
 	// The response will include this server if they are joined to the room.
 	QueryJoinedHostServerNamesInRoom(ctx context.Context, request *QueryJoinedHostServerNamesInRoomRequest, response *QueryJoinedHostServerNamesInRoomResponse) error
+	// QueryRoomFederationDisabled returns whether federation is disabled for the room, either
+	// because it was created with "m.federate": false or because an admin has disabled it.
+	QueryRoomFederationDisabled(ctx context.Context, roomID string) (bool, error)
+	// QueryFederatedRooms returns those of the rooms which don't have federation disabled,
+	// in the same order.
+	QueryFederatedRooms(ctx context.Context, roomIDs []string) ([]string, error)
+	// PerformAdminSetRoomFederationDisabled disables or re-enables federation for a room.
+	// Federation can't be re-enabled for rooms created with "m.federate": false.
+	PerformAdminSetRoomFederationDisabled(ctx context.Context, roomID string, disabled bool) error
+	// QueryAdminDestinations returns the destinations which are blacklisted or being backed off from.
+	QueryAdminDestinations(ctx context.Context) ([]DestinationStatus, error)
+	// PerformAdminUnblacklistDestination removes a destination from the blacklist and clears any
+	// backoff, so that we start sending to it again.
+	PerformAdminUnblacklistDestination(ctx context.Context, serverName spec.ServerName) error
+	// QueryAdminDestinationQueues returns the state of the queue for each destination that
+	// has anything waiting to be sent, or that is blacklisted or being backed off from.
+	QueryAdminDestinationQueues(ctx context.Context) ([]DestinationQueueStatus, error)
+	// QueryAdminDestinationQueue returns the state of the queue for a single destination.
+	QueryAdminDestinationQueue(ctx context.Context, serverName spec.ServerName) (*DestinationQueueStatus, error)
+	// PerformAdminDropDestinationQueue discards everything waiting to be sent to a destination.
+	PerformAdminDropDestinationQueue(ctx context.Context, serverName spec.ServerName) error
+	// PerformAdminRetryDestinationQueue clears any backoff or blacklisting for a destination
+	// and starts sending to it again immediately.
+	PerformAdminRetryDestinationQueue(ctx context.Context, serverName spec.ServerName) error
+	// CheckInboundMembership returns a *MembershipFloodError if a remote user joining or leaving
+	// the room with make_join or make_leave would go over the join flood limits. The change isn't
+	// counted.
+	CheckInboundMembership(ctx context.Context, roomID spec.RoomID, userID spec.UserID, membership string) error
+	// RecordInboundMembership counts a remote user joining or leaving the room against the join
+	// flood limits, returning a *MembershipFloodError if it should be rejected.
+	RecordInboundMembership(ctx context.Context, roomID spec.RoomID, userID spec.UserID, membership string) error
+	// QueryAdminIgnoredOrigins returns the servers which are being ignored because their users
+	// went over the join flood limits.
+	QueryAdminIgnoredOrigins(ctx context.Context) ([]IgnoredOriginStatus, error)
+	// PerformAdminUnignoreOrigin stops ignoring a server before its ignore period is over.
+	PerformAdminUnignoreOrigin(ctx context.Context, serverName spec.ServerName) error
+	// QueryAdminResolutionCache returns what is cached about how to reach other servers.
+	QueryAdminResolutionCache(ctx context.Context) ([]fclient.ResolutionCacheEntry, error)
+	// PerformAdminForgetResolution removes a server from the resolution cache, so that its
+	// .well-known file and SRV records are looked up again next time it is contacted.
+	PerformAdminForgetResolution(ctx context.Context, serverName spec.ServerName) error
+	// QueryAdminServerKeys returns the signing keys cached for a server, or for every server if
+	// serverName is empty.
+	QueryAdminServerKeys(ctx context.Context, serverName spec.ServerName) ([]ServerKeyStatus, error)
+	// PerformAdminRefetchServerKeys fetches the signing keys of a server again, replacing the
+	// cached keys even if they don't look any older, and returns the keys that were fetched.
+	PerformAdminRefetchServerKeys(ctx context.Context, serverName spec.ServerName) ([]ServerKeyStatus, error)
+	// PerformAdminPurgeExpiredServerKeys removes the cached keys which have been replaced by a
+	// newer key for the same server and stopped being valid a long time ago, returning how many
+	// were removed. Keys which the server has marked as expired are kept.
+	PerformAdminPurgeExpiredServerKeys(ctx context.Context) (int, error)
 }
 
 type RoomserverFederationAPI interface {
@@ -71,6 +123,9 @@ type RoomserverFederationAPI interface {
 	LookupMissingEvents(ctx context.Context, origin, s spec.ServerName, roomID string, missing fclient.MissingEvents, roomVersion gomatrixserverlib.RoomVersion) (res fclient.RespMissingEvents, err error)
 
 	RoomHierarchies(ctx context.Context, origin, dst spec.ServerName, roomID string, suggestedOnly bool) (res fclient.RoomHierarchyResponse, err error)
+
+	// IsServerBackingOff returns true if the server is blacklisted or being backed off from.
+	IsServerBackingOff(serverName spec.ServerName) bool
 }
 
 // KeyserverFederationAPI is a subset of gomatrixserverlib.FederationClient functions which the keyserver
@@ -189,9 +244,89 @@ type PerformWakeupServersRequest struct {
 type PerformWakeupServersResponse struct {
 }
 
+// DestinationStatus describes a destination which we aren't currently sending to.
+type DestinationStatus struct {
+	ServerName   spec.ServerName `json:"server_name"`
+	Blacklisted  bool            `json:"blacklisted"`
+	BackoffUntil *spec.Timestamp `json:"backoff_until,omitempty"`
+}
+
+// IgnoredOriginStatus describes a server which is being ignored by the join
+// flood protection.
+type IgnoredOriginStatus struct {
+	ServerName   spec.ServerName `json:"server_name"`
+	IgnoredUntil spec.Timestamp  `json:"ignored_until"`
+}
+
+// ServerKeyStatus describes a signing key of another server which we have
+// cached.
+type ServerKeyStatus struct {
+	ServerName   spec.ServerName         `json:"server_name"`
+	KeyID        gomatrixserverlib.KeyID `json:"key_id"`
+	Key          spec.Base64Bytes        `json:"key"`
+	ValidUntilTS spec.Timestamp          `json:"valid_until_ts"`
+	ExpiredTS    spec.Timestamp          `json:"expired_ts,omitempty"`
+}
+
+// MembershipFloodError is returned when a join or leave by a user on another
+// server, or any request from a server which is being ignored, is rejected by
+// the join flood protection.
+type MembershipFloodError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *MembershipFloodError) Error() string {
+	return "rejected by join flood protection: " + e.Reason
+}
+
+// RoomNotFederatableError is returned when an admin tries to re-enable
+// federation for a room which was created with "m.federate": false.
+type RoomNotFederatableError struct {
+	RoomID string
+}
+
+func (e *RoomNotFederatableError) Error() string {
+	return fmt.Sprintf("room %s was created with federation disabled", e.RoomID)
+}
+
+// RoomFederationDisabledError is returned when something would have to be
+// sent to another server about a room which has federation disabled.
+type RoomFederationDisabledError struct {
+	RoomID string
+}
+
+func (e *RoomFederationDisabledError) Error() string {
+	return fmt.Sprintf("federation is disabled for room %s", e.RoomID)
+}
+
+// DestinationQueueStatus describes what is waiting to be sent to a destination.
+type DestinationQueueStatus struct {
+	ServerName  spec.ServerName `json:"server_name"`
+	PendingPDUs int64           `json:"pending_pdus"`
+	PendingEDUs int64           `json:"pending_edus"`
+	// How long the oldest pending PDU or EDU has been waiting, if known.
+	OldestPendingAgeMS *int64          `json:"oldest_pending_age_ms,omitempty"`
+	Running            bool            `json:"running"`
+	Blacklisted        bool            `json:"blacklisted"`
+	BackoffCount       uint32          `json:"backoff_count"`
+	BackoffUntil       *spec.Timestamp `json:"backoff_until,omitempty"`
+}
+
 type InputPublicKeysRequest struct {
 	Keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult `json:"keys"`
 }
 
 type InputPublicKeysResponse struct {
 }
+
+// IsRoomFederationDisabled returns whether federation is disabled for the room. If
+// this can't be determined then it will return true to err on the side of caution.
+func IsRoomFederationDisabled(ctx context.Context, fsAPI ClientFederationAPI, roomID string) bool {
+	disabled, err := fsAPI.QueryRoomFederationDisabled(ctx, roomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to QueryRoomFederationDisabled")
+		return true
+	}
+	return disabled
+}
@@ -18,6 +18,8 @@ import (
 	"context"
 	"encoding/json"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/neilalexander/harmony/federationapi/queue"
@@ -45,6 +47,72 @@ type OutputPresenceConsumer struct {
 	rsAPI                   roomserverAPI.FederationRoomserverAPI
 	topic                   string
 	outboundPresenceEnabled bool
+	limiter                 *presenceLimiter
+}
+
+type presenceDestination struct {
+	userID      string
+	destination spec.ServerName
+}
+
+type sentPresence struct {
+	state string // the presence and status message that were sent
+	at    time.Time
+}
+
+// presenceLimiter stops a user's presence being sent to the same server
+// more often than the minimum interval, unless it has changed.
+type presenceLimiter struct {
+	sync.Mutex
+	minInterval time.Duration
+	sent        map[presenceDestination]sentPresence
+	lastPruned  time.Time
+}
+
+func newPresenceLimiter(minInterval time.Duration) *presenceLimiter {
+	return &presenceLimiter{
+		minInterval: minInterval,
+		sent:        make(map[presenceDestination]sentPresence),
+	}
+}
+
+// filter returns the destinations which the user's presence should be sent to.
+func (l *presenceLimiter) filter(userID, state string, destinations []spec.ServerName, now time.Time) []spec.ServerName {
+	if l.minInterval <= 0 {
+		return destinations
+	}
+	l.Lock()
+	defer l.Unlock()
+	if now.Sub(l.lastPruned) > l.minInterval {
+		for k, sent := range l.sent {
+			if now.Sub(sent.at) >= l.minInterval {
+				delete(l.sent, k)
+			}
+		}
+		l.lastPruned = now
+	}
+	allowed := destinations[:0:0]
+	for _, destination := range destinations {
+		key := presenceDestination{userID, destination}
+		if sent, ok := l.sent[key]; ok && sent.state == state && now.Sub(sent.at) < l.minInterval {
+			continue
+		}
+		allowed = append(allowed, destination)
+	}
+	return allowed
+}
+
+// record remembers that the user's presence has been sent to the destinations,
+// once it has been queued for them.
+func (l *presenceLimiter) record(userID, state string, destinations []spec.ServerName, now time.Time) {
+	if l.minInterval <= 0 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	for _, destination := range destinations {
+		l.sent[presenceDestination{userID, destination}] = sentPresence{state, now}
+	}
 }
 
 // NewOutputPresenceConsumer creates a new OutputPresenceConsumer. Call Start() to begin consuming events.
@@ -65,6 +133,7 @@ func NewOutputPresenceConsumer(
 		durable:                 cfg.Matrix.JetStream.Durable("FederationAPIPresenceConsumer"),
 		topic:                   cfg.Matrix.JetStream.Prefixed(jetstream.OutputPresenceEvent),
 		outboundPresenceEnabled: cfg.Matrix.Presence.EnableOutbound,
+		limiter:                 newPresenceLimiter(cfg.Matrix.Presence.OutboundMinInterval),
 		rsAPI:                   rsAPI,
 	}
 }
@@ -111,6 +180,11 @@ func (t *OutputPresenceConsumer) onMessage(ctx context.Context, msgs []*nats.Msg
 	for i, roomID := range roomIDs {
 		roomIDStrs[i] = roomID.String()
 	}
+	// don't send presence into rooms which have federation disabled
+	if roomIDStrs, err = t.db.FederatedRooms(ctx, roomIDStrs); err != nil {
+		log.WithError(err).Error("failed to check which rooms have federation disabled")
+		return false
+	}
 
 	presence := msg.Header.Get("presence")
 
@@ -126,17 +200,23 @@ func (t *OutputPresenceConsumer) onMessage(ctx context.Context, msgs []*nats.Msg
 		return true
 	}
 
-	if len(joined) == 0 {
-		return true
-	}
-
 	var statusMsg *string = nil
+	state := presence
 	if data, ok := msg.Header["status_msg"]; ok && len(data) > 0 {
 		status := msg.Header.Get("status_msg")
 		statusMsg = &status
+		state += "\n" + status
+	}
+
+	// don't flood servers with updates that haven't changed anything.
+	now := time.Now()
+	joined = t.limiter.filter(userID, state, joined, now)
+	if len(joined) == 0 {
+		return true
 	}
 
 	p := types.PresenceInternal{LastActiveTS: spec.Timestamp(ts)}
+	p.Presence, _ = types.PresenceFromString(presence)
 
 	content := fedTypes.Presence{
 		Push: []fedTypes.PresenceContent{
@@ -164,6 +244,7 @@ func (t *OutputPresenceConsumer) onMessage(ctx context.Context, msgs []*nats.Msg
 		log.WithError(err).Error("failed to send EDU")
 		return false
 	}
+	t.limiter.record(userID, state, joined, now)
 
 	return true
 }
@@ -0,0 +1,28 @@
+package consumers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresenceLimiter(t *testing.T) {
+	limiter := newPresenceLimiter(time.Minute)
+	servers := []spec.ServerName{"a", "b"}
+	now := time.Now()
+
+	// Presence which wasn't sent isn't limited.
+	assert.Equal(t, servers, limiter.filter("@alice:test", "online", servers, now))
+	assert.Equal(t, servers, limiter.filter("@alice:test", "online", servers, now.Add(time.Second)), "unsent presence shouldn't be limited")
+	limiter.record("@alice:test", "online", servers, now)
+
+	assert.Empty(t, limiter.filter("@alice:test", "online", servers, now.Add(time.Second)), "unchanged presence should be limited")
+	assert.Equal(t, []spec.ServerName{"c"}, limiter.filter("@alice:test", "online", []spec.ServerName{"a", "c"}, now.Add(time.Second)), "new servers should get presence")
+	assert.Equal(t, servers, limiter.filter("@bob:test", "online", servers, now.Add(time.Second)), "other users shouldn't be limited")
+	assert.Equal(t, servers, limiter.filter("@alice:test", "unavailable", servers, now.Add(2*time.Second)), "changed presence should be sent")
+	assert.Equal(t, servers, limiter.filter("@alice:test", "online", servers, now.Add(2*time.Minute)), "presence should be sent again after the interval")
+
+	assert.Equal(t, servers, newPresenceLimiter(0).filter("@alice:test", "online", servers, now), "no limit")
+}
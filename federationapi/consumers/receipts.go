@@ -108,6 +108,13 @@ func (t *OutputReceiptConsumer) onMessage(ctx context.Context, msgs []*nats.Msg)
 
 	receipt.Timestamp = spec.Timestamp(timestamp)
 
+	if disabled, err := t.db.IsRoomFederationDisabled(ctx, receipt.RoomID); err != nil {
+		log.WithError(err).WithField("room_id", receipt.RoomID).Error("failed to check if federation is disabled for room")
+		return false
+	} else if disabled {
+		return true
+	}
+
 	joined, err := t.db.GetJoinedHosts(ctx, receipt.RoomID)
 	if err != nil {
 		log.WithError(err).WithField("room_id", receipt.RoomID).Error("failed to get joined hosts for room")
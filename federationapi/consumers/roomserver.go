@@ -172,6 +172,20 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent, rew
 	if err != nil {
 		return err
 	}
+
+	// Rooms created with "m.federate": false must never be sent to other
+	// servers, so remember that when we see the create event.
+	if ore.Event.Type() == spec.MRoomCreate && ore.Event.StateKeyEquals("") {
+		if !federateFromCreateEvent(ore.Event.PDU) {
+			if err = s.db.SetRoomFederationDisabled(s.ctx, ore.Event.RoomID().String(), true); err != nil {
+				return fmt.Errorf("s.db.SetRoomFederationDisabled: %w", err)
+			}
+		}
+	}
+	federationDisabled, err := s.db.IsRoomFederationDisabled(s.ctx, ore.Event.RoomID().String())
+	if err != nil {
+		return fmt.Errorf("s.db.IsRoomFederationDisabled: %w", err)
+	}
 	// Update our copy of the current state.
 	// We keep a copy of the current state because the state at each event is
 	// expressed as a delta against the current state.
@@ -189,7 +203,7 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent, rew
 	}
 
 	// If we added new hosts, inform them about our known presence events for this room
-	if s.cfg.Matrix.Presence.EnableOutbound && len(addsJoinedHosts) > 0 && ore.Event.Type() == spec.MRoomMember && ore.Event.StateKey() != nil {
+	if s.cfg.Matrix.Presence.EnableOutbound && !federationDisabled && len(addsJoinedHosts) > 0 && ore.Event.Type() == spec.MRoomMember && ore.Event.StateKey() != nil {
 		membership, _ := ore.Event.Membership()
 		if membership == spec.Join {
 			s.sendPresence(ore.Event.RoomID().String(), addsJoinedHosts)
@@ -204,7 +218,7 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent, rew
 		return nil
 	}
 
-	if ore.SendAsServer == api.DoNotSendToOtherServers {
+	if ore.SendAsServer == api.DoNotSendToOtherServers || federationDisabled {
 		// Ignore event that we don't need to send anywhere.
 		return nil
 	}
@@ -221,32 +235,58 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent, rew
 	)
 }
 
+// federateFromCreateEvent returns the value of the "m.federate" flag from
+// the given create event, which defaults to true if not present.
+func federateFromCreateEvent(ev gomatrixserverlib.PDU) bool {
+	var content gomatrixserverlib.CreateContent
+	if err := json.Unmarshal(ev.Content(), &content); err != nil || content.Federate == nil {
+		return true
+	}
+	return *content.Federate
+}
+
+// membershipsPageSize is how many membership events are fetched from the
+// roomserver at once.
+const membershipsPageSize = 1000
+
 func (s *OutputRoomEventConsumer) sendPresence(roomID string, addedJoined []types.JoinedHost) {
 	joined := make([]spec.ServerName, 0, len(addedJoined))
 	for _, added := range addedJoined {
 		joined = append(joined, added.ServerName)
 	}
 
-	// get our locally joined users
-	var queryRes api.QueryMembershipsForRoomResponse
-	err := s.rsAPI.QueryMembershipsForRoom(s.ctx, &api.QueryMembershipsForRoomRequest{
-		JoinedOnly: true,
-		LocalOnly:  true,
-		RoomID:     roomID,
-	}, &queryRes)
-	if err != nil {
-		log.WithError(err).Error("failed to calculate joined rooms for user")
-		return
+	// get our locally joined users, a page at a time so that large rooms
+	// aren't loaded all at once
+	var senders []string
+	queryReq := &api.QueryMembershipsForRoomRequest{
+		JoinedOnly:    true,
+		LocalOnly:     true,
+		RoomID:        roomID,
+		Limit:         membershipsPageSize,
+		MinimalEvents: true,
+	}
+	for {
+		var queryRes api.QueryMembershipsForRoomResponse
+		if err := s.rsAPI.QueryMembershipsForRoom(s.ctx, queryReq, &queryRes); err != nil {
+			log.WithError(err).Error("failed to calculate joined rooms for user")
+			return
+		}
+		for _, ev := range queryRes.JoinEvents {
+			senders = append(senders, ev.Sender)
+		}
+		if queryRes.NextBatch == "" {
+			break
+		}
+		queryReq.From = queryRes.NextBatch
 	}
 
 	// send every presence we know about to the remote server
 	content := types.Presence{}
-	for _, ev := range queryRes.JoinEvents {
+	for _, sender := range senders {
 		msg := nats.NewMsg(s.topicPresence)
-		msg.Header.Set(jetstream.UserID, ev.Sender)
+		msg.Header.Set(jetstream.UserID, sender)
 
-		var presence *nats.Msg
-		presence, err = s.natsClient.RequestMsg(msg, time.Second*10)
+		presence, err := s.natsClient.RequestMsg(msg, time.Second*10)
 		if err != nil {
 			log.WithError(err).Errorf("unable to get presence")
 			continue
@@ -257,20 +297,20 @@ func (s *OutputRoomEventConsumer) sendPresence(roomID string, addedJoined []type
 		if e != "" {
 			continue
 		}
-		var lastActive int
-		lastActive, err = strconv.Atoi(presence.Header.Get("last_active_ts"))
+		lastActive, err := strconv.Atoi(presence.Header.Get("last_active_ts"))
 		if err != nil {
 			continue
 		}
 
 		p := syncAPITypes.PresenceInternal{LastActiveTS: spec.Timestamp(lastActive)}
+		p.Presence, _ = syncAPITypes.PresenceFromString(presence.Header.Get("presence"))
 
 		content.Push = append(content.Push, types.PresenceContent{
 			CurrentlyActive: p.CurrentlyActive(),
 			LastActiveAgo:   p.LastActiveAgo(),
 			Presence:        presence.Header.Get("presence"),
 			StatusMsg:       &statusMsg,
-			UserID:          ev.Sender,
+			UserID:          sender,
 		})
 	}
 
@@ -282,6 +322,7 @@ func (s *OutputRoomEventConsumer) sendPresence(roomID string, addedJoined []type
 		Type:   spec.MPresence,
 		Origin: string(s.cfg.Matrix.ServerName),
 	}
+	var err error
 	if edu.Content, err = json.Marshal(content); err != nil {
 		log.WithError(err).Error("failed to marshal EDU JSON")
 		return
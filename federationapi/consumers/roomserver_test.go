@@ -15,7 +15,10 @@
 package consumers
 
 import (
+	"fmt"
 	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 )
 
 func TestCombineNoOp(t *testing.T) {
@@ -51,3 +54,25 @@ func TestCombineDedup(t *testing.T) {
 		t.Errorf("wanted combined removes to be %#v, got %#v", []string{"b"}, gotDel)
 	}
 }
+
+func TestFederateFromCreateEvent(t *testing.T) {
+	verImpl := gomatrixserverlib.MustGetRoomVersion(gomatrixserverlib.RoomVersionV10)
+	tests := map[string]bool{
+		`{}`:                    true,
+		`{"m.federate": true}`:  true,
+		`{"m.federate": false}`: false,
+	}
+	for content, want := range tests {
+		ev, err := verImpl.NewEventFromTrustedJSONWithEventID("$create", []byte(fmt.Sprintf(`{
+			"type": "m.room.create", "state_key": "",
+			"room_id": "!room:test", "sender": "@alice:test",
+			"content": %s
+		}`, content)), false)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		if got := federateFromCreateEvent(ev); got != want {
+			t.Errorf("content %s: wanted %v, got %v", content, want, got)
+		}
+	}
+}
@@ -107,10 +107,14 @@ func (t *OutputSendToDeviceConsumer) onMessage(ctx context.Context, msgs []*nats
 		Type:   spec.MDirectToDevice,
 		Origin: string(originServerName),
 	}
+	messageID := ote.MessageID
+	if messageID == "" {
+		messageID = util.RandomString(32)
+	}
 	tdm := gomatrixserverlib.ToDeviceMessage{
 		Sender:    ote.Sender,
 		Type:      ote.Type,
-		MessageID: util.RandomString(32),
+		MessageID: messageID,
 		Messages: map[string]map[string]json.RawMessage{
 			ote.UserID: {
 				ote.DeviceID: ote.Content,
@@ -92,6 +92,13 @@ func (t *OutputTypingConsumer) onMessage(ctx context.Context, msgs []*nats.Msg)
 		return true
 	}
 
+	if disabled, err := t.db.IsRoomFederationDisabled(ctx, roomID); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("failed to check if federation is disabled for room")
+		return false
+	} else if disabled {
+		return true
+	}
+
 	joined, err := t.db.GetJoinedHosts(ctx, roomID)
 	if err != nil {
 		log.WithError(err).WithField("room_id", roomID).Error("failed to get joined hosts for room")
@@ -52,6 +52,7 @@ func AddPublicRoutes(
 	keyRing gomatrixserverlib.JSONVerifier,
 	rsAPI roomserverAPI.FederationRoomserverAPI,
 	fedAPI federationAPI.FederationInternalAPI,
+	caches *caching.Caches,
 	enableMetrics bool,
 ) {
 	cfg := &dendriteConfig.FederationAPI
@@ -83,7 +84,7 @@ func AddPublicRoutes(
 	routing.Setup(
 		routers,
 		dendriteConfig,
-		rsAPI, f, keyRing,
+		rsAPI, f, keyRing, caches,
 		federation, userAPI, mscCfg,
 		producer, enableMetrics,
 	)
@@ -126,7 +127,7 @@ func NewInternalAPI(
 		federationDB, processContext,
 		cfg.Matrix.DisableFederation,
 		cfg.Matrix.ServerName, federation, &stats,
-		signingInfo,
+		signingInfo, cfg.ReceiptBatchWindow, cfg.EDUTypes.Outbound,
 	)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
@@ -24,14 +24,17 @@ import (
 
 // FederationInternalAPI is an implementation of api.FederationInternalAPI
 type FederationInternalAPI struct {
-	db         storage.Database
-	cfg        *config.FederationAPI
-	statistics *statistics.Statistics
-	rsAPI      roomserverAPI.FederationRoomserverAPI
-	federation fclient.FederationClient
-	keyRing    *gomatrixserverlib.KeyRing
-	queues     *queue.OutgoingQueues
-	joins      sync.Map // joins currently in progress
+	db          storage.Database
+	cfg         *config.FederationAPI
+	statistics  *statistics.Statistics
+	rsAPI       roomserverAPI.FederationRoomserverAPI
+	federation  fclient.FederationClient
+	keyRing     *gomatrixserverlib.KeyRing
+	keyCache    caching.ServerKeyCache
+	queues      *queue.OutgoingQueues
+	joins       sync.Map          // joins currently in progress
+	failedJoins failedJoinServers // servers which recently couldn't be joined through
+	joinFlood   *joinFloodLimiter // limits on membership events from other servers
 }
 
 func NewFederationInternalAPI(
@@ -54,14 +57,15 @@ func NewFederationInternalAPI(
 			KeyDatabase: serverKeyDB,
 		}
 
-		pubKey := cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey)
 		addDirectFetcher := func() {
 			keyRing.KeyFetchers = append(
 				keyRing.KeyFetchers,
 				&gomatrixserverlib.DirectKeyFetcher{
 					Client:            federation,
 					IsLocalServerName: cfg.Matrix.IsLocalServerName,
-					LocalPublicKey:    []byte(pubKey),
+					LocalKey: func(keyID gomatrixserverlib.KeyID) (gomatrixserverlib.PublicKeyLookupResult, bool) {
+						return localKey(cfg, keyID)
+					},
 				},
 			)
 		}
@@ -106,9 +110,11 @@ func NewFederationInternalAPI(
 		cfg:        cfg,
 		rsAPI:      rsAPI,
 		keyRing:    keyRing,
+		keyCache:   caches,
 		federation: federation,
 		statistics: statistics,
 		queues:     queues,
+		joinFlood:  newJoinFloodLimiter(&cfg.JoinFloodProtection),
 	}
 }
 
@@ -66,7 +66,7 @@ func TestFederationClientQueryKeys(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, 0, config.EDUTypeFilter{},
 	)
 	fedapi := FederationInternalAPI{
 		db:         testDB,
@@ -97,7 +97,7 @@ func TestFederationClientQueryKeysBlacklisted(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, 0, config.EDUTypeFilter{},
 	)
 	fedapi := FederationInternalAPI{
 		db:         testDB,
@@ -127,7 +127,7 @@ func TestFederationClientQueryKeysFailure(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, 0, config.EDUTypeFilter{},
 	)
 	fedapi := FederationInternalAPI{
 		db:         testDB,
@@ -157,7 +157,7 @@ func TestFederationClientClaimKeys(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, 0, config.EDUTypeFilter{},
 	)
 	fedapi := FederationInternalAPI{
 		db:         testDB,
@@ -188,7 +188,7 @@ func TestFederationClientClaimKeysBlacklisted(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, 0, config.EDUTypeFilter{},
 	)
 	fedapi := FederationInternalAPI{
 		db:         testDB,
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxJoinProbes is how many servers are asked at once whether we can
+	// join through them.
+	maxJoinProbes = 5
+	// joinProbeTimeout is how long a server has to answer, which is halved
+	// for each backoff the server is in so that unreliable servers don't hold
+	// up the join, down to minJoinProbeTimeout.
+	joinProbeTimeout    = time.Second * 10
+	minJoinProbeTimeout = time.Second * 2
+	// failedJoinServerTTL is how long a server which couldn't be joined
+	// through is skipped for the same room.
+	failedJoinServerTTL = time.Minute
+)
+
+type failedJoinServer struct {
+	RoomID     string
+	ServerName spec.ServerName
+}
+
+// failedJoinServers remembers servers which recently couldn't be joined through,
+// because they couldn't be reached or aren't in the room, so that they aren't tried
+// again straight away.
+type failedJoinServers struct {
+	sync.Mutex
+	expiries map[failedJoinServer]time.Time
+}
+
+func (f *failedJoinServers) add(roomID string, serverName spec.ServerName) {
+	f.Lock()
+	defer f.Unlock()
+	if f.expiries == nil {
+		f.expiries = make(map[failedJoinServer]time.Time)
+	}
+	now := time.Now()
+	for k, expiry := range f.expiries {
+		if now.After(expiry) {
+			delete(f.expiries, k)
+		}
+	}
+	f.expiries[failedJoinServer{roomID, serverName}] = now.Add(failedJoinServerTTL)
+}
+
+func (f *failedJoinServers) failed(roomID string, serverName spec.ServerName) bool {
+	f.Lock()
+	defer f.Unlock()
+	expiry, ok := f.expiries[failedJoinServer{roomID, serverName}]
+	return ok && time.Now().Before(expiry)
+}
+
+// joinCandidates orders the servers to try joining through. Blacklisted servers
+// are dropped, as are servers which recently failed unless there is nothing
+// else to try, and servers which are backing off are tried last.
+func (r *FederationInternalAPI) joinCandidates(roomID string, serverNames []spec.ServerName) []spec.ServerName {
+	var healthy, backingOff, failed []spec.ServerName
+	now := time.Now()
+	for _, serverName := range serverNames {
+		stats := r.statistics.ForServer(serverName)
+		until := stats.BackoffInfo()
+		switch {
+		case stats.Blacklisted():
+			continue
+		case r.failedJoins.failed(roomID, serverName):
+			failed = append(failed, serverName)
+		case until != nil && now.Before(*until):
+			backingOff = append(backingOff, serverName)
+		default:
+			healthy = append(healthy, serverName)
+		}
+	}
+	if candidates := append(healthy, backingOff...); len(candidates) > 0 {
+		return candidates
+	}
+	return failed
+}
+
+// joinProbeTimeoutFor returns how long to wait for a server to answer a make_join.
+func (r *FederationInternalAPI) joinProbeTimeoutFor(serverName spec.ServerName) time.Duration {
+	timeout := joinProbeTimeout
+	for i := r.statistics.ForServer(serverName).BackoffCount(); i > 0 && timeout > minJoinProbeTimeout; i-- {
+		timeout /= 2
+	}
+	if timeout < minJoinProbeTimeout {
+		return minJoinProbeTimeout
+	}
+	return timeout
+}
+
+type joinProbeResult struct {
+	serverName spec.ServerName
+	makeJoin   *fclient.RespMakeJoin
+	err        error
+}
+
+// probeJoinServers asks the servers in parallel whether we can join the room
+// through them, returning the results in the order that the servers answered.
+// The make_join responses are returned too, so that they can be used for the
+// join itself. Cancelling the context stops any probes which haven't finished.
+func (r *FederationInternalAPI) probeJoinServers(
+	ctx context.Context, origin spec.ServerName, roomID, userID string, serverNames []spec.ServerName,
+) <-chan joinProbeResult {
+	results := make(chan joinProbeResult, len(serverNames))
+	limit := make(chan struct{}, maxJoinProbes)
+	for _, serverName := range serverNames {
+		go func(serverName spec.ServerName) {
+			select {
+			case limit <- struct{}{}:
+				defer func() { <-limit }()
+			case <-ctx.Done():
+				results <- joinProbeResult{serverName, nil, ctx.Err()}
+				return
+			}
+			probeCtx, cancel := context.WithTimeout(ctx, r.joinProbeTimeoutFor(serverName))
+			defer cancel()
+			res, err := r.federation.MakeJoin(probeCtx, origin, serverName, roomID, userID)
+			if err != nil && ctx.Err() == nil {
+				// Only remember servers which can't be reached or aren't in the
+				// room, as a server refusing the join may accept it once the user
+				// has been invited. A server which was only too slow for our own
+				// short probe timeout isn't counted as a federation failure.
+				var httpErr gomatrix.HTTPError
+				if !errors.As(err, &httpErr) {
+					if probeCtx.Err() == nil {
+						r.statistics.ForServer(serverName).Failure()
+					}
+					r.failedJoins.add(roomID, serverName)
+				} else {
+					r.statistics.ForServer(serverName).Success()
+					if httpErr.Code == 404 {
+						r.failedJoins.add(roomID, serverName)
+					}
+				}
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"server_name": serverName,
+					"room_id":     roomID,
+				}).Warn("Server can't be joined through")
+			}
+			if err != nil {
+				results <- joinProbeResult{serverName, nil, err}
+				return
+			}
+			results <- joinProbeResult{serverName, &res, nil}
+		}(serverName)
+	}
+	return results
+}
+
+// probedJoinClient answers make_join for the server which was probed with the
+// response which the probe got, so that it isn't asked twice.
+type probedJoinClient struct {
+	gomatrixserverlib.FederatedJoinClient
+	serverName spec.ServerName
+	makeJoin   *fclient.RespMakeJoin
+}
+
+func (c *probedJoinClient) MakeJoin(
+	ctx context.Context, origin, s spec.ServerName, roomID, userID string,
+) (gomatrixserverlib.MakeJoinResponse, error) {
+	if s == c.serverName {
+		return c.makeJoin, nil
+	}
+	return c.FederatedJoinClient.MakeJoin(ctx, origin, s, roomID, userID)
+}
+
+// joinErrorRank ranks how useful an error is to explain a failed join. A
+// server refusing the join says more than a server which isn't in the room,
+// which says more than a server which couldn't be reached.
+func joinErrorRank(err error) int {
+	var httpErr gomatrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return 0
+	}
+	switch {
+	case httpErr.Code == 403:
+		return 4
+	case httpErr.Code == 400:
+		return 3
+	case httpErr.Code == 404:
+		return 1
+	case httpErr.Code >= 400 && httpErr.Code < 500:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// mostRelevantJoinError returns the error which best explains why the join
+// failed, preferring earlier errors where they are equally relevant.
+func mostRelevantJoinError(errs []error) error {
+	var best error
+	for _, err := range errs {
+		if best == nil || joinErrorRank(err) > joinErrorRank(best) {
+			best = err
+		}
+	}
+	return best
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/neilalexander/harmony/federationapi/statistics"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/test"
+	"github.com/stretchr/testify/assert"
+)
+
+type makeJoinFedClient struct {
+	fclient.FederationClient
+	delays map[spec.ServerName]time.Duration
+	errs   map[spec.ServerName]error
+}
+
+func (f *makeJoinFedClient) MakeJoin(ctx context.Context, origin, s spec.ServerName, roomID, userID string) (fclient.RespMakeJoin, error) {
+	select {
+	case <-time.After(f.delays[s]):
+	case <-ctx.Done():
+		return fclient.RespMakeJoin{}, ctx.Err()
+	}
+	return fclient.RespMakeJoin{}, f.errs[s]
+}
+
+func TestProbeJoinServers(t *testing.T) {
+	testDB := test.NewInMemoryFederationDatabase()
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist)
+	fedClient := &makeJoinFedClient{
+		delays: map[spec.ServerName]time.Duration{
+			"slow": 50 * time.Millisecond,
+		},
+		errs: map[spec.ServerName]error{
+			"forbidden":   gomatrix.HTTPError{Code: 403},
+			"notresident": gomatrix.HTTPError{Code: 404},
+			"unreachable": errors.New("connection refused"),
+		},
+	}
+	fedAPI := &FederationInternalAPI{
+		statistics: &stats,
+		federation: fedClient,
+	}
+	roomID := "!room:test"
+	servers := []spec.ServerName{"slow", "forbidden", "notresident", "unreachable", "fast"}
+
+	probes := fedAPI.probeJoinServers(context.Background(), "origin", roomID, "@alice:origin", servers)
+	var joinable []spec.ServerName
+	var errs []error
+	for range servers {
+		probe := <-probes
+		if probe.err != nil {
+			errs = append(errs, probe.err)
+			continue
+		}
+		assert.NotNil(t, probe.makeJoin, "the make_join response is kept for the join")
+		joinable = append(joinable, probe.serverName)
+	}
+	assert.Equal(t, []spec.ServerName{"fast", "slow"}, joinable, "joinable servers in the order they answered")
+	assert.Equal(t, gomatrix.HTTPError{Code: 403}, mostRelevantJoinError(errs))
+
+	// Servers which aren't in the room or can't be reached are skipped for a while,
+	// unless there is nothing else to try.
+	assert.Equal(t, []spec.ServerName{"slow", "forbidden", "fast"}, fedAPI.joinCandidates(roomID, servers))
+	assert.Equal(t, []spec.ServerName{"notresident"}, fedAPI.joinCandidates(roomID, []spec.ServerName{"notresident"}))
+	assert.Equal(t, []spec.ServerName{"slow", "forbidden", "notresident", "fast", "unreachable"}, fedAPI.joinCandidates("!other:test", servers), "servers backing off are tried last")
+}
+
+func TestProbeJoinServersTimeout(t *testing.T) {
+	testDB := test.NewInMemoryFederationDatabase()
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist)
+	fedAPI := &FederationInternalAPI{
+		statistics: &stats,
+		federation: &makeJoinFedClient{
+			delays: map[spec.ServerName]time.Duration{"slow": time.Minute},
+		},
+	}
+
+	// A server which is backing off gets the shortest probe timeout, but it
+	// running out isn't counted as another failure to reach the server.
+	for i := 0; i < 3; i++ {
+		stats.ForServer("slow").Failure()
+		stats.ForServer("slow").ClearBackoff()
+	}
+	assert.Equal(t, minJoinProbeTimeout, fedAPI.joinProbeTimeoutFor("slow"))
+	probe := <-fedAPI.probeJoinServers(context.Background(), "origin", "!room:test", "@alice:origin", []spec.ServerName{"slow"})
+	assert.ErrorIs(t, probe.err, context.DeadlineExceeded)
+	assert.Equal(t, uint32(3), stats.ForServer("slow").BackoffCount())
+	assert.True(t, fedAPI.failedJoins.failed("!room:test", "slow"))
+}
+
+func TestProbedJoinClient(t *testing.T) {
+	probed := &fclient.RespMakeJoin{RoomVersion: "10"}
+	c := &probedJoinClient{
+		FederatedJoinClient: &FederationInternalAPI{
+			federation: &makeJoinFedClient{
+				errs: map[spec.ServerName]error{"other": errors.New("not probed")},
+			},
+		},
+		serverName: "probed",
+		makeJoin:   probed,
+	}
+	res, err := c.MakeJoin(context.Background(), "origin", "probed", "!room:test", "@alice:origin")
+	assert.NoError(t, err)
+	assert.Same(t, probed, res)
+	_, err = c.MakeJoin(context.Background(), "origin", "other", "!room:test", "@alice:origin")
+	assert.EqualError(t, err, "not probed")
+}
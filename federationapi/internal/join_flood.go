@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/neilalexander/harmony/federationapi/api"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// joinFloodStrikeWindow is the period over which the rejected membership
+// changes of users from a server are counted towards ignoring it.
+const joinFloodStrikeWindow = time.Minute
+
+var (
+	membershipFloodRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "membership_flood_rejections_total",
+			Help:      "Number of joins and leaves by users on other servers rejected by join flood protection",
+		},
+		[]string{"reason"},
+	)
+	membershipFloodIgnores = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "membership_flood_ignores_total",
+			Help:      "Number of times a server was ignored after too many joins and leaves by its users were rejected",
+		},
+	)
+	membershipFloodIgnoredOrigins = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "membership_flood_ignored_origins",
+			Help:      "Number of servers currently ignored by join flood protection",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		membershipFloodRejections, membershipFloodIgnores,
+		membershipFloodIgnoredOrigins,
+	)
+}
+
+// floodWindow counts events within a fixed window of time.
+type floodWindow struct {
+	start time.Time
+	count int
+}
+
+// take counts an event, starting a new window if the current one is older
+// than the period, and returns false if the limit was already reached.
+func (w *floodWindow) take(now time.Time, period time.Duration, limit int) bool {
+	if w.full(now, period, limit) {
+		return false
+	}
+	if now.Sub(w.start) >= period {
+		w.start, w.count = now, 0
+	}
+	w.count++
+	return true
+}
+
+// full returns whether the limit has been reached in the current window,
+// without counting an event.
+func (w *floodWindow) full(now time.Time, period time.Duration, limit int) bool {
+	return now.Sub(w.start) < period && w.count >= limit
+}
+
+// joinFloodLimiter limits how quickly users from other servers can join and
+// leave rooms, whether through make_join, send_join, make_leave and send_leave
+// or in transactions. Servers whose users have too many of these rejected are
+// ignored for a while, so that nothing they send us over federation is
+// accepted.
+type joinFloodLimiter struct {
+	cfg       *config.JoinFloodProtection
+	mu        sync.Mutex
+	rooms     map[string]*floodWindow          // room ID and server -> joins this second
+	users     map[string]*floodWindow          // user ID -> joins and leaves
+	strikes   map[spec.ServerName]*floodWindow // server -> rejected joins and leaves
+	ignored   map[spec.ServerName]time.Time    // server -> ignored until
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// newJoinFloodLimiter returns a joinFloodLimiter, or nil if join flood
+// protection is disabled. A nil joinFloodLimiter allows everything.
+func newJoinFloodLimiter(cfg *config.JoinFloodProtection) *joinFloodLimiter {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &joinFloodLimiter{
+		cfg:     cfg,
+		rooms:   map[string]*floodWindow{},
+		users:   map[string]*floodWindow{},
+		strikes: map[spec.ServerName]*floodWindow{},
+		ignored: map[spec.ServerName]time.Time{},
+		now:     time.Now,
+	}
+}
+
+// check returns an error if the user joining or leaving the room would go
+// over the limits. Only joins count towards the limit for the room, but both
+// joins and leaves count towards the limit for the user. The change is only
+// counted if record is set, which it isn't for make_join and make_leave, so
+// that each change is only counted once. Limits are applied to the server of
+// the user rather than to the server which sent the request, so that a server
+// can't get the users of another refused, and the joins of each server to a
+// room are counted separately, so that one server can't stop the users of
+// others from joining.
+func (l *joinFloodLimiter) check(roomID spec.RoomID, userID spec.UserID, membership string, record bool) *api.MembershipFloodError {
+	server := userID.Domain()
+	if l == nil || l.cfg.IsExempt(server) {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+
+	if err := l.checkIgnored(now, server); err != nil {
+		return err
+	}
+
+	var reason, label string
+	var retryAfter time.Duration
+	isJoin := membership == spec.Join
+	room := l.window(l.rooms, roomID.String()+" "+string(server))
+	user := l.window(l.users, userID.String())
+	switch {
+	case isJoin && room.full(now, time.Second, l.cfg.RoomJoinsPerSecond):
+		reason, label = "too many users are joining the room", "room_joins"
+		retryAfter = room.start.Add(time.Second).Sub(now)
+	case user.full(now, l.cfg.UserChurnPeriod, l.cfg.UserChurnLimit):
+		reason, label = "the user is joining and leaving rooms too often", "user_churn"
+		retryAfter = user.start.Add(l.cfg.UserChurnPeriod).Sub(now)
+	default:
+		if record {
+			if isJoin {
+				room.take(now, time.Second, l.cfg.RoomJoinsPerSecond)
+			}
+			user.take(now, l.cfg.UserChurnPeriod, l.cfg.UserChurnLimit)
+		}
+		return nil
+	}
+	membershipFloodRejections.WithLabelValues(label).Inc()
+
+	strikes, ok := l.strikes[server]
+	if !ok {
+		strikes = &floodWindow{}
+		l.strikes[server] = strikes
+	}
+	if !strikes.take(now, joinFloodStrikeWindow, l.cfg.IgnoreThreshold) {
+		delete(l.strikes, server)
+		l.ignored[server] = now.Add(l.cfg.IgnoreDuration)
+		membershipFloodIgnores.Inc()
+		membershipFloodIgnoredOrigins.Set(float64(len(l.ignored)))
+		logrus.WithFields(logrus.Fields{
+			"server_name": server,
+			"duration":    l.cfg.IgnoreDuration,
+		}).Warn("Ignoring server after too many joins and leaves from it were rejected")
+	}
+	return &api.MembershipFloodError{
+		Reason:     reason,
+		RetryAfter: retryAfter,
+	}
+}
+
+// checkIgnored returns an error if the server is being ignored. The lock
+// must be held.
+func (l *joinFloodLimiter) checkIgnored(now time.Time, server spec.ServerName) *api.MembershipFloodError {
+	if until, ok := l.ignored[server]; ok && now.Before(until) {
+		membershipFloodRejections.WithLabelValues("ignored").Inc()
+		return &api.MembershipFloodError{
+			Reason:     "too many joins and leaves from this server have been rejected",
+			RetryAfter: until.Sub(now),
+		}
+	}
+	return nil
+}
+
+// ignoring returns an error if the server is being ignored, in which case
+// none of its federation requests should be accepted.
+func (l *joinFloodLimiter) ignoring(server spec.ServerName) *api.MembershipFloodError {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.checkIgnored(l.now(), server)
+}
+
+func (l *joinFloodLimiter) window(windows map[string]*floodWindow, key string) *floodWindow {
+	w, ok := windows[key]
+	if !ok {
+		w = &floodWindow{}
+		windows[key] = w
+	}
+	return w
+}
+
+// ignoredOrigins returns the servers which are currently being ignored.
+func (l *joinFloodLimiter) ignoredOrigins() []api.IgnoredOriginStatus {
+	if l == nil {
+		return []api.IgnoredOriginStatus{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	origins := make([]api.IgnoredOriginStatus, 0, len(l.ignored))
+	for origin, until := range l.ignored {
+		if now.Before(until) {
+			origins = append(origins, api.IgnoredOriginStatus{
+				ServerName:   origin,
+				IgnoredUntil: spec.AsTimestamp(until),
+			})
+		}
+	}
+	sort.Slice(origins, func(i, j int) bool {
+		return origins[i].ServerName < origins[j].ServerName
+	})
+	return origins
+}
+
+// unignore stops ignoring the server and forgets its rejected joins and
+// leaves.
+func (l *joinFloodLimiter) unignore(origin spec.ServerName) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.ignored, origin)
+	delete(l.strikes, origin)
+	membershipFloodIgnoredOrigins.Set(float64(len(l.ignored)))
+}
+
+// prune removes windows which have ended and servers which are no longer
+// ignored. It runs at most once per user churn period.
+func (l *joinFloodLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.cfg.UserChurnPeriod {
+		return
+	}
+	l.lastPrune = now
+	for roomID, w := range l.rooms {
+		if now.Sub(w.start) >= time.Second {
+			delete(l.rooms, roomID)
+		}
+	}
+	for userID, w := range l.users {
+		if now.Sub(w.start) >= l.cfg.UserChurnPeriod {
+			delete(l.users, userID)
+		}
+	}
+	for origin, w := range l.strikes {
+		if now.Sub(w.start) >= joinFloodStrikeWindow {
+			delete(l.strikes, origin)
+		}
+	}
+	for origin, until := range l.ignored {
+		if !now.Before(until) {
+			delete(l.ignored, origin)
+		}
+	}
+	membershipFloodIgnoredOrigins.Set(float64(len(l.ignored)))
+}
+
+// CheckInboundMembership implements api.FederationInternalAPI
+func (r *FederationInternalAPI) CheckInboundMembership(
+	ctx context.Context, roomID spec.RoomID, userID spec.UserID, membership string,
+) error {
+	if floodErr := r.joinFlood.check(roomID, userID, membership, false); floodErr != nil {
+		return floodErr
+	}
+	return nil
+}
+
+// RecordInboundMembership implements api.FederationInternalAPI
+func (r *FederationInternalAPI) RecordInboundMembership(
+	ctx context.Context, roomID spec.RoomID, userID spec.UserID, membership string,
+) error {
+	if floodErr := r.joinFlood.check(roomID, userID, membership, true); floodErr != nil {
+		return floodErr
+	}
+	return nil
+}
+
+// CheckOriginIgnored returns a *api.MembershipFloodError if the server is
+// being ignored by the join flood protection.
+func (r *FederationInternalAPI) CheckOriginIgnored(origin spec.ServerName) error {
+	if floodErr := r.joinFlood.ignoring(origin); floodErr != nil {
+		return floodErr
+	}
+	return nil
+}
+
+// QueryAdminIgnoredOrigins implements api.FederationInternalAPI
+func (r *FederationInternalAPI) QueryAdminIgnoredOrigins(
+	ctx context.Context,
+) ([]api.IgnoredOriginStatus, error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.QueryAdminIgnoredOrigins")
+	defer span.End()
+
+	return r.joinFlood.ignoredOrigins(), nil
+}
+
+// PerformAdminUnignoreOrigin implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformAdminUnignoreOrigin(
+	ctx context.Context, serverName spec.ServerName,
+) error {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformAdminUnignoreOrigin")
+	defer span.End()
+
+	logrus.WithField("server_name", serverName).Warn("No longer ignoring server for join flood protection")
+	r.joinFlood.unignore(serverName)
+	return nil
+}
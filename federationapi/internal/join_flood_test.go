@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func mustUserID(t *testing.T, userID string) spec.UserID {
+	t.Helper()
+	u, err := spec.NewUserID(userID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *u
+}
+
+func mustRoomID(t *testing.T, roomID string) spec.RoomID {
+	t.Helper()
+	r, err := spec.NewRoomID(roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *r
+}
+
+func TestJoinFloodLimiter(t *testing.T) {
+	cfg := &config.JoinFloodProtection{}
+	cfg.Defaults()
+	cfg.RoomJoinsPerSecond = 3
+	cfg.UserChurnLimit = 4
+	cfg.IgnoreThreshold = 5
+	cfg.ExemptServers = []spec.ServerName{"trusted.test"}
+
+	now := time.Unix(1700000000, 0)
+	l := newJoinFloodLimiter(cfg)
+	l.now = func() time.Time { return now }
+
+	room := mustRoomID(t, "!room:test")
+	other := mustRoomID(t, "!other:test")
+	late := mustUserID(t, "@late:remote.test")
+
+	// Only so many users from a server can join a room each second. Checking
+	// a join at make_join doesn't count it.
+	for i := 0; i < cfg.RoomJoinsPerSecond; i++ {
+		user := mustUserID(t, fmt.Sprintf("@user%d:remote.test", i))
+		if err := l.check(room, user, spec.Join, false); err != nil {
+			t.Fatalf("make_join %d rejected: %s", i, err)
+		}
+		if err := l.check(room, user, spec.Join, true); err != nil {
+			t.Fatalf("send_join %d rejected: %s", i, err)
+		}
+	}
+	err := l.check(room, late, spec.Join, false)
+	if err == nil {
+		t.Fatal("expected join over the room limit to be rejected")
+	}
+	if err.RetryAfter != time.Second {
+		t.Fatalf("got retry after %s, want %s", err.RetryAfter, time.Second)
+	}
+
+	// Users from other servers can still join the room, and users from the
+	// same server can still join other rooms.
+	if err := l.check(room, mustUserID(t, "@user:elsewhere.test"), spec.Join, true); err != nil {
+		t.Fatalf("join from another server rejected: %s", err)
+	}
+	if err := l.check(other, late, spec.Join, true); err != nil {
+		t.Fatalf("join to another room rejected: %s", err)
+	}
+	now = now.Add(time.Second)
+	if err := l.check(room, late, spec.Join, true); err != nil {
+		t.Fatalf("join in the next second rejected: %s", err)
+	}
+
+	// Users can only join so often across all rooms. The late user has
+	// joined twice already.
+	for i := 0; i < cfg.UserChurnLimit-2; i++ {
+		if err := l.check(mustRoomID(t, fmt.Sprintf("!room%d:test", i)), late, spec.Join, true); err != nil {
+			t.Fatalf("join %d rejected: %s", i, err)
+		}
+	}
+	if l.check(mustRoomID(t, "!third:test"), late, spec.Join, true) == nil {
+		t.Fatal("expected join over the user limit to be rejected")
+	}
+
+	// Exempt servers are never limited.
+	for i := 0; i < cfg.UserChurnLimit*2; i++ {
+		if err := l.check(room, mustUserID(t, "@bot:trusted.test"), spec.Join, true); err != nil {
+			t.Fatalf("exempt server rejected: %s", err)
+		}
+	}
+
+	// Once enough joins have been rejected, all joins from the server of
+	// the users are refused, but not those from other servers. One has been
+	// rejected for the room limit and one for the user limit.
+	for i := 0; i < cfg.IgnoreThreshold-1; i++ {
+		if l.check(mustRoomID(t, "!third:test"), late, spec.Join, true) == nil {
+			t.Fatalf("expected join %d to be rejected", i)
+		}
+	}
+	if err := l.check(mustRoomID(t, "!new:test"), mustUserID(t, "@new:remote.test"), spec.Join, true); err == nil {
+		t.Fatal("expected joins from an ignored server to be rejected")
+	} else if err.RetryAfter != cfg.IgnoreDuration {
+		t.Fatalf("got ignored for %s, want %s", err.RetryAfter, cfg.IgnoreDuration)
+	}
+	if err := l.check(mustRoomID(t, "!new:test"), mustUserID(t, "@new:elsewhere.test"), spec.Join, true); err != nil {
+		t.Fatalf("join from another server rejected: %s", err)
+	}
+	if l.ignoring("remote.test") == nil {
+		t.Fatal("expected federation requests from an ignored server to be rejected")
+	}
+	if err := l.ignoring("elsewhere.test"); err != nil {
+		t.Fatalf("federation request from another server rejected: %s", err)
+	}
+	if origins := l.ignoredOrigins(); len(origins) != 1 || origins[0].ServerName != "remote.test" {
+		t.Fatalf("unexpected ignored origins %+v", origins)
+	}
+
+	// Admins can let the server back in early.
+	l.unignore("remote.test")
+	if err := l.check(mustRoomID(t, "!new:test"), mustUserID(t, "@new:remote.test"), spec.Join, true); err != nil {
+		t.Fatalf("join rejected after unignoring: %s", err)
+	}
+
+	// A server is ignored only for the ignore duration.
+	l.ignored["remote.test"] = now.Add(time.Minute)
+	now = now.Add(time.Minute)
+	if err := l.check(mustRoomID(t, "!later:test"), mustUserID(t, "@later:remote.test"), spec.Join, true); err != nil {
+		t.Fatalf("join rejected after the ignore duration: %s", err)
+	}
+}
+
+func TestJoinFloodLimiterLeaves(t *testing.T) {
+	cfg := &config.JoinFloodProtection{}
+	cfg.Defaults()
+	cfg.RoomJoinsPerSecond = 1
+	cfg.UserChurnLimit = 4
+
+	now := time.Unix(1700000000, 0)
+	l := newJoinFloodLimiter(cfg)
+	l.now = func() time.Time { return now }
+	room := mustRoomID(t, "!room:test")
+
+	// Leaves don't count towards the joins to a room.
+	for i := 0; i < 3; i++ {
+		user := mustUserID(t, fmt.Sprintf("@user%d:remote.test", i))
+		if err := l.check(room, user, spec.Leave, true); err != nil {
+			t.Fatalf("leave %d rejected: %s", i, err)
+		}
+	}
+	if err := l.check(room, mustUserID(t, "@joiner:remote.test"), spec.Join, true); err != nil {
+		t.Fatalf("join after leaves rejected: %s", err)
+	}
+
+	// Joining and leaving both count towards the churn of a user.
+	churner := mustUserID(t, "@churner:remote.test")
+	for i := 0; i < cfg.UserChurnLimit; i++ {
+		now = now.Add(time.Second)
+		membership := spec.Join
+		if i%2 == 1 {
+			membership = spec.Leave
+		}
+		if err := l.check(room, churner, membership, true); err != nil {
+			t.Fatalf("%s %d rejected: %s", membership, i, err)
+		}
+	}
+	if l.check(room, churner, spec.Leave, false) == nil {
+		t.Fatal("expected leave over the user limit to be rejected")
+	}
+}
+
+func TestJoinFloodLimiterDisabled(t *testing.T) {
+	cfg := &config.JoinFloodProtection{}
+	l := newJoinFloodLimiter(cfg)
+	if l != nil {
+		t.Fatal("expected no limiter when disabled")
+	}
+	if err := l.check(mustRoomID(t, "!room:test"), mustUserID(t, "@user:remote.test"), spec.Join, true); err != nil {
+		t.Fatalf("nil limiter rejected: %s", err)
+	}
+	if err := l.ignoring("remote.test"); err != nil {
+		t.Fatalf("nil limiter ignored server: %s", err)
+	}
+	if origins := l.ignoredOrigins(); len(origins) != 0 {
+		t.Fatalf("unexpected ignored origins %+v", origins)
+	}
+}
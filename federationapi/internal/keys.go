@@ -4,10 +4,14 @@ import (
 	"context"
 	"crypto/ed25519"
 	"fmt"
+	"sort"
 	"time"
 
+	"github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
+	"github.com/neilalexander/harmony/setup/config"
 	"github.com/sirupsen/logrus"
 )
 
@@ -103,44 +107,41 @@ func (s *FederationInternalAPI) handleLocalKeys(
 		if !s.cfg.Matrix.IsLocalServerName(req.ServerName) {
 			continue
 		}
-		if req.KeyID == s.cfg.Matrix.KeyID {
-			// We found a key request that is supposed to be for our own
-			// keys. Remove it from the request list so we don't hit the
+		if result, ok := localKey(s.cfg, req.KeyID); ok {
+			// Remove it from the request list so we don't hit the
 			// database or the fetchers for it.
 			delete(requests, req)
+			results[req] = result
+		}
+	}
+}
 
-			// Insert our own key into the response.
-			results[req] = gomatrixserverlib.PublicKeyLookupResult{
+// localKey looks up one of our own keys, either the one we are signing with
+// or one we used to sign with. The key is looked up each time, as it can be
+// rotated while the server is running.
+func localKey(cfg *config.FederationAPI, keyID gomatrixserverlib.KeyID) (gomatrixserverlib.PublicKeyLookupResult, bool) {
+	currentKeyID, privateKey := cfg.Matrix.SigningKey()
+	if keyID == currentKeyID {
+		return gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: spec.Base64Bytes(privateKey.Public().(ed25519.PublicKey)),
+			},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: spec.AsTimestamp(time.Now().Add(cfg.Matrix.KeyValidityPeriod)),
+		}, true
+	}
+	for _, oldVerifyKey := range cfg.Matrix.CurrentOldVerifyKeys() {
+		if keyID == oldVerifyKey.KeyID {
+			return gomatrixserverlib.PublicKeyLookupResult{
 				VerifyKey: gomatrixserverlib.VerifyKey{
-					Key: spec.Base64Bytes(s.cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey)),
+					Key: oldVerifyKey.PublicKey,
 				},
-				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
-				ValidUntilTS: spec.AsTimestamp(time.Now().Add(s.cfg.Matrix.KeyValidityPeriod)),
-			}
-		} else {
-			// The key request doesn't match our current key. Let's see
-			// if it matches any of our old verify keys.
-			for _, oldVerifyKey := range s.cfg.Matrix.OldVerifyKeys {
-				if req.KeyID == oldVerifyKey.KeyID {
-					// We found a key request that is supposed to be an expired
-					// key.
-					delete(requests, req)
-
-					// Insert our own key into the response.
-					results[req] = gomatrixserverlib.PublicKeyLookupResult{
-						VerifyKey: gomatrixserverlib.VerifyKey{
-							Key: spec.Base64Bytes(oldVerifyKey.PrivateKey.Public().(ed25519.PublicKey)),
-						},
-						ExpiredTS:    oldVerifyKey.ExpiredAt,
-						ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
-					}
-
-					// No need to look at the other keys.
-					break
-				}
-			}
+				ExpiredTS:    oldVerifyKey.ExpiredAt,
+				ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+			}, true
 		}
 	}
+	return gomatrixserverlib.PublicKeyLookupResult{}, false
 }
 
 // handleDatabaseKeys handles cases where the key requests can be
@@ -247,3 +248,113 @@ func (s *FederationInternalAPI) handleFetcherKeys(
 
 	return nil
 }
+
+// QueryAdminServerKeys implements api.FederationInternalAPI
+func (s *FederationInternalAPI) QueryAdminServerKeys(
+	ctx context.Context, serverName spec.ServerName,
+) ([]api.ServerKeyStatus, error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.QueryAdminServerKeys")
+	defer span.End()
+
+	keys, err := s.db.GetServerKeys(ctx, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("s.db.GetServerKeys: %w", err)
+	}
+	return serverKeyStatuses(keys), nil
+}
+
+// PerformAdminRefetchServerKeys implements api.FederationInternalAPI
+func (s *FederationInternalAPI) PerformAdminRefetchServerKeys(
+	ctx context.Context, serverName spec.ServerName,
+) ([]api.ServerKeyStatus, error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformAdminRefetchServerKeys")
+	defer span.End()
+
+	if s.cfg.Matrix.IsLocalServerName(serverName) {
+		return nil, fmt.Errorf("%q is one of our own server names", serverName)
+	}
+
+	// Ask each of the fetchers in turn for all of the server's keys, until
+	// one of them returns some. Unlike handleFetcherKeys, the keys are stored
+	// even if they aren't valid for any longer than the ones we had, as the
+	// ones we had might be the problem.
+	requests := map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp{
+		{ServerName: serverName}: spec.AsTimestamp(time.Now()),
+	}
+	for _, fetcher := range s.keyRing.KeyFetchers {
+		fetcherCtx, fetcherCancel := context.WithTimeout(ctx, time.Second*30)
+		results, err := fetcher.FetchKeys(fetcherCtx, requests)
+		fetcherCancel()
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"fetcher_name": fetcher.FetcherName(),
+				"server_name":  serverName,
+			}).Warn("Failed to refetch keys")
+			continue
+		}
+		for req := range results {
+			if req.ServerName != serverName || req.KeyID == "" {
+				delete(results, req)
+			}
+		}
+		if len(results) == 0 {
+			continue
+		}
+		if err = s.keyRing.KeyDatabase.StoreKeys(ctx, results); err != nil {
+			return nil, fmt.Errorf("s.keyRing.KeyDatabase.StoreKeys: %w", err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"fetcher_name": fetcher.FetcherName(),
+			"server_name":  serverName,
+		}).Warnf("Refetched %d key(s)", len(results))
+		return serverKeyStatuses(results), nil
+	}
+	return nil, fmt.Errorf("couldn't fetch any keys for %q", serverName)
+}
+
+// serverKeyPurgeGracePeriod is how long ago a key must have stopped being
+// valid before it can be purged. Events signed with a key are still checked
+// against it after the key has been replaced, for instance when backfilling,
+// so keys are only purged once they are unlikely to be needed again.
+const serverKeyPurgeGracePeriod = time.Hour * 24 * 365
+
+// PerformAdminPurgeExpiredServerKeys implements api.FederationInternalAPI
+func (s *FederationInternalAPI) PerformAdminPurgeExpiredServerKeys(
+	ctx context.Context,
+) (int, error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformAdminPurgeExpiredServerKeys")
+	defer span.End()
+
+	before := spec.AsTimestamp(time.Now().Add(-serverKeyPurgeGracePeriod))
+	purged, err := s.db.PurgeExpiredServerKeys(ctx, before)
+	if err != nil {
+		return 0, fmt.Errorf("s.db.PurgeExpiredServerKeys: %w", err)
+	}
+	for _, req := range purged {
+		s.keyCache.InvalidateServerKey(req)
+	}
+	logrus.Warnf("Purged %d expired server key(s)", len(purged))
+	return len(purged), nil
+}
+
+func serverKeyStatuses(
+	keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) []api.ServerKeyStatus {
+	result := make([]api.ServerKeyStatus, 0, len(keys))
+	for req, res := range keys {
+		result = append(result, api.ServerKeyStatus{
+			ServerName:   req.ServerName,
+			KeyID:        req.KeyID,
+			Key:          res.Key,
+			ValidUntilTS: res.ValidUntilTS,
+			ExpiredTS:    res.ExpiredTS,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ServerName != result[j].ServerName {
+			return result[i].ServerName < result[j].ServerName
+		}
+		return result[i].KeyID < result[j].KeyID
+	})
+	return result
+}
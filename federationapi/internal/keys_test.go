@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/federationapi/api"
+	"github.com/neilalexander/harmony/federationapi/statistics"
+	"github.com/neilalexander/harmony/internal/caching"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+	"github.com/stretchr/testify/assert"
+)
+
+type testKeyFetcher struct {
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+	err     error
+}
+
+func (f *testKeyFetcher) FetcherName() string {
+	return "testKeyFetcher"
+}
+
+func (f *testKeyFetcher) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req, res := range f.results {
+		results[req] = res
+	}
+	return results, f.err
+}
+
+type testKeyDatabase struct {
+	testKeyFetcher
+	stored map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+}
+
+func (d *testKeyDatabase) StoreKeys(
+	ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	for req, res := range results {
+		d.stored[req] = res
+	}
+	return nil
+}
+
+func TestPerformAdminRefetchServerKeys(t *testing.T) {
+	testDB := test.NewInMemoryFederationDatabase()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	cfg := config.FederationAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{
+				ServerName: "local",
+				KeyID:      "ed25519:1",
+				PrivateKey: key,
+			},
+		},
+	}
+
+	// The first fetcher fails, so the keys come from the second, which also
+	// returns a key for a server that we didn't ask about. The key that we
+	// did ask about has a shorter validity than the one we had, but it should
+	// replace it anyway.
+	remoteKey := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote", KeyID: "ed25519:new"}
+	otherKey := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "other", KeyID: "ed25519:1"}
+	keyDB := &testKeyDatabase{
+		stored: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteKey: {ValidUntilTS: 2000},
+		},
+	}
+	keyRing := &gomatrixserverlib.KeyRing{
+		KeyFetchers: []gomatrixserverlib.KeyFetcher{
+			&testKeyFetcher{err: errors.New("unreachable")},
+			&testKeyFetcher{
+				results: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+					remoteKey: {ValidUntilTS: 1000},
+					otherKey:  {ValidUntilTS: 1000},
+				},
+			},
+		},
+		KeyDatabase: keyDB,
+	}
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist)
+	fedAPI := NewFederationInternalAPI(
+		testDB, &cfg, nil, &testFedClient{}, &stats, nil, nil, keyRing,
+	)
+
+	keys, err := fedAPI.PerformAdminRefetchServerKeys(context.Background(), "remote")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.Equal(t, spec.ServerName("remote"), keys[0].ServerName)
+	assert.Equal(t, gomatrixserverlib.KeyID("ed25519:new"), keys[0].KeyID)
+	assert.Equal(t, spec.Timestamp(1000), keyDB.stored[remoteKey].ValidUntilTS)
+	assert.NotContains(t, keyDB.stored, otherKey)
+
+	// Our own keys are never fetched.
+	_, err = fedAPI.PerformAdminRefetchServerKeys(context.Background(), "local")
+	assert.Error(t, err)
+
+	// Nothing is stored if none of the fetchers return any keys.
+	_, err = fedAPI.PerformAdminRefetchServerKeys(context.Background(), "missing")
+	assert.Error(t, err)
+}
+
+type testServerKeysDatabase struct {
+	*test.InMemoryFederationDatabase
+	keys        map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+	purged      []gomatrixserverlib.PublicKeyLookupRequest
+	purgeBefore spec.Timestamp
+}
+
+func (d *testServerKeysDatabase) GetServerKeys(
+	ctx context.Context, serverName spec.ServerName,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req, res := range d.keys {
+		if serverName == "" || req.ServerName == serverName {
+			results[req] = res
+		}
+	}
+	return results, nil
+}
+
+func (d *testServerKeysDatabase) PurgeExpiredServerKeys(
+	ctx context.Context, before spec.Timestamp,
+) ([]gomatrixserverlib.PublicKeyLookupRequest, error) {
+	d.purgeBefore = before
+	return d.purged, nil
+}
+
+type testServerKeyCache map[string]gomatrixserverlib.PublicKeyLookupResult
+
+func (c testServerKeyCache) Get(key string) (gomatrixserverlib.PublicKeyLookupResult, bool) {
+	res, ok := c[key]
+	return res, ok
+}
+
+func (c testServerKeyCache) Set(key string, value gomatrixserverlib.PublicKeyLookupResult) {
+	c[key] = value
+}
+
+func (c testServerKeyCache) Unset(key string) {
+	delete(c, key)
+}
+
+func TestQueryAdminServerKeys(t *testing.T) {
+	testDB := &testServerKeysDatabase{
+		InMemoryFederationDatabase: test.NewInMemoryFederationDatabase(),
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			{ServerName: "b", KeyID: "ed25519:1"}: {ValidUntilTS: 1000},
+			{ServerName: "a", KeyID: "ed25519:2"}: {ValidUntilTS: 2000},
+			{ServerName: "a", KeyID: "ed25519:1"}: {ValidUntilTS: 1000, ExpiredTS: 500},
+		},
+	}
+	cfg := config.FederationAPI{Matrix: &config.Global{}}
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist)
+	fedAPI := NewFederationInternalAPI(
+		testDB, &cfg, nil, &testFedClient{}, &stats, nil, nil, &gomatrixserverlib.KeyRing{},
+	)
+
+	// All of the keys are returned, sorted by server name and key ID.
+	keys, err := fedAPI.QueryAdminServerKeys(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, []api.ServerKeyStatus{
+		{ServerName: "a", KeyID: "ed25519:1", ValidUntilTS: 1000, ExpiredTS: 500},
+		{ServerName: "a", KeyID: "ed25519:2", ValidUntilTS: 2000},
+		{ServerName: "b", KeyID: "ed25519:1", ValidUntilTS: 1000},
+	}, keys)
+
+	keys, err = fedAPI.QueryAdminServerKeys(context.Background(), "b")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.Equal(t, spec.ServerName("b"), keys[0].ServerName)
+}
+
+func TestPerformAdminPurgeExpiredServerKeys(t *testing.T) {
+	purgedKey := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote", KeyID: "ed25519:old"}
+	testDB := &testServerKeysDatabase{
+		InMemoryFederationDatabase: test.NewInMemoryFederationDatabase(),
+		purged:                     []gomatrixserverlib.PublicKeyLookupRequest{purgedKey},
+	}
+	keyCache := testServerKeyCache{
+		"remote/ed25519:old": {ValidUntilTS: 1000},
+		"remote/ed25519:new": {ValidUntilTS: 2000},
+	}
+	cfg := config.FederationAPI{Matrix: &config.Global{}}
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist)
+	fedAPI := NewFederationInternalAPI(
+		testDB, &cfg, nil, &testFedClient{}, &stats, &caching.Caches{ServerKeys: keyCache}, nil, &gomatrixserverlib.KeyRing{},
+	)
+
+	purged, err := fedAPI.PerformAdminPurgeExpiredServerKeys(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	// Only keys which stopped being valid before the grace period are purged.
+	if latest := spec.AsTimestamp(time.Now().Add(-serverKeyPurgeGracePeriod)); testDB.purgeBefore > latest {
+		t.Fatalf("keys valid until %d were purged, want before %d", testDB.purgeBefore, latest)
+	}
+
+	// The purged keys are removed from the cache too.
+	assert.NotContains(t, keyCache, "remote/ed25519:old")
+	assert.Contains(t, keyCache, "remote/ed25519:new")
+}
+
+func TestLocalKeys(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	_, newKey, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	cfg := config.FederationAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{
+				ServerName: "local",
+				KeyID:      "ed25519:1",
+				PrivateKey: key,
+			},
+			KeyValidityPeriod: time.Hour,
+		},
+	}
+	testDB := test.NewInMemoryFederationDatabase()
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist)
+	fedAPI := NewFederationInternalAPI(
+		testDB, &cfg, nil, &testFedClient{}, &stats, &caching.Caches{ServerKeys: testServerKeyCache{}}, nil, nil,
+	)
+	fetcher := fedAPI.keyRing.KeyFetchers[0]
+
+	currentKey := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "local", KeyID: "ed25519:1"}
+	results, err := fetcher.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp{currentKey: 0})
+	assert.NoError(t, err)
+	assert.Equal(t, spec.Base64Bytes(key.Public().(ed25519.PublicKey)), results[currentKey].Key)
+	assert.Equal(t, gomatrixserverlib.PublicKeyNotExpired, results[currentKey].ExpiredTS)
+
+	// The keys are looked up each time, so that a rotated key is picked up
+	// straight away and the old one is still known.
+	cfg.Matrix.KeyID, cfg.Matrix.PrivateKey = "ed25519:2", newKey
+	cfg.Matrix.OldVerifyKeys = []*config.OldVerifyKeys{{
+		KeyID:     "ed25519:1",
+		PublicKey: spec.Base64Bytes(key.Public().(ed25519.PublicKey)),
+		ExpiredAt: 1000,
+	}}
+	newKeyReq := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "local", KeyID: "ed25519:2"}
+	unknownKey := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "local", KeyID: "ed25519:3"}
+	requests := map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp{currentKey: 0, newKeyReq: 0, unknownKey: 0}
+	results, err = fetcher.FetchKeys(context.Background(), requests)
+	assert.NoError(t, err)
+	assert.Equal(t, spec.Base64Bytes(newKey.Public().(ed25519.PublicKey)), results[newKeyReq].Key)
+	assert.Equal(t, spec.Base64Bytes(key.Public().(ed25519.PublicKey)), results[currentKey].Key)
+	assert.Equal(t, spec.Timestamp(1000), results[currentKey].ExpiredTS)
+	assert.NotContains(t, results, unknownKey)
+
+	// The same goes for the keys which the federation API serves itself.
+	results = map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	fedAPI.handleLocalKeys(context.Background(), requests, results)
+	assert.Len(t, results, 2)
+	assert.Equal(t, spec.Base64Bytes(newKey.Public().(ed25519.PublicKey)), results[newKeyReq].Key)
+	assert.Equal(t, map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp{unknownKey: 0}, requests)
+}
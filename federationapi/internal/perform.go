@@ -3,14 +3,17 @@ package internal
 import (
 	"context"
 	"crypto/ed25519"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/matrix-org/gomatrix"
+	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/sirupsen/logrus"
 
@@ -26,6 +29,9 @@ func (r *FederationInternalAPI) PerformDirectoryLookup(
 	request *api.PerformDirectoryLookupRequest,
 	response *api.PerformDirectoryLookupResponse,
 ) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformDirectoryLookup")
+	defer span.End()
+
 	dir, err := r.federation.LookupRoomAlias(
 		ctx,
 		r.cfg.Matrix.ServerName,
@@ -53,6 +59,9 @@ func (r *FederationInternalAPI) PerformJoin(
 	request *api.PerformJoinRequest,
 	response *api.PerformJoinResponse,
 ) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformJoin")
+	defer span.End()
+
 	// Check that a join isn't already in progress for this user/room.
 	j := federatedJoin{request.UserID, request.RoomID}
 	if _, found := r.joins.Load(j); found {
@@ -80,32 +89,52 @@ func (r *FederationInternalAPI) PerformJoin(
 		seenSet[srv] = true
 		uniqueList = append(uniqueList, srv)
 	}
-	request.ServerNames = uniqueList
+	request.ServerNames = r.joinCandidates(request.RoomID, uniqueList)
 
-	// Try each server that we were provided until we land on one that
-	// successfully completes the make-join send-join dance.
-	var lastErr error
-	for _, serverName := range request.ServerNames {
-		if err := r.performJoinUsingServer(
+	user, err := spec.NewUserID(request.UserID, true)
+	if err != nil {
+		response.LastError = &gomatrix.HTTPError{
+			Code:    0,
+			Message: err.Error(),
+		}
+		return
+	}
+
+	// Ask the servers in parallel whether we can join through them, then
+	// try the make-join send-join dance through each server that said yes,
+	// in the order that they answered, until one of them succeeds.
+	probeCtx, cancelProbes := context.WithCancel(ctx)
+	defer cancelProbes()
+	probes := r.probeJoinServers(probeCtx, user.Domain(), request.RoomID, request.UserID, request.ServerNames)
+	var errs []error
+	for range request.ServerNames {
+		probe := <-probes
+		if probe.err != nil {
+			errs = append(errs, probe.err)
+			continue
+		}
+		if err = r.performJoinUsingServer(
 			ctx,
 			request.RoomID,
 			request.UserID,
 			request.Content,
-			serverName,
+			probe.serverName,
+			probe.makeJoin,
 			request.Unsigned,
 		); err != nil {
 			logrus.WithError(err).WithFields(logrus.Fields{
-				"server_name": serverName,
+				"server_name": probe.serverName,
 				"room_id":     request.RoomID,
 			}).Warnf("Failed to join room through server")
-			lastErr = err
+			errs = append(errs, err)
 			continue
 		}
 
 		// We're all good.
-		response.JoinedVia = serverName
+		response.JoinedVia = probe.serverName
 		return
 	}
+	lastErr := mostRelevantJoinError(errs)
 
 	// If we reach here then we didn't complete a join for some reason.
 	var httpErr gomatrix.HTTPError
@@ -134,6 +163,7 @@ func (r *FederationInternalAPI) performJoinUsingServer(
 	roomID, userID string,
 	content map[string]interface{},
 	serverName spec.ServerName,
+	makeJoin *fclient.RespMakeJoin,
 	unsigned map[string]interface{},
 ) error {
 	user, err := spec.NewUserID(userID, true)
@@ -145,14 +175,15 @@ func (r *FederationInternalAPI) performJoinUsingServer(
 		return err
 	}
 
+	keyID, privateKey := r.cfg.Matrix.SigningKey()
 	joinInput := gomatrixserverlib.PerformJoinInput{
 		UserID:     user,
 		RoomID:     room,
 		ServerName: serverName,
 		Content:    content,
 		Unsigned:   unsigned,
-		PrivateKey: r.cfg.Matrix.PrivateKey,
-		KeyID:      r.cfg.Matrix.KeyID,
+		PrivateKey: privateKey,
+		KeyID:      keyID,
 		KeyRing:    r.keyRing,
 		EventProvider: federatedEventProvider(ctx, r.federation, r.keyRing, user.Domain(), serverName, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 			return r.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
@@ -180,7 +211,13 @@ func (r *FederationInternalAPI) performJoinUsingServer(
 			return r.rsAPI.StoreUserRoomPublicKey(ctx, senderID, *storeUserID, roomID)
 		},
 	}
-	response, joinErr := gomatrixserverlib.PerformJoin(ctx, r, joinInput)
+	// Use the make_join response from probing the server if there was one,
+	// rather than asking for it again.
+	var fedClient gomatrixserverlib.FederatedJoinClient = r
+	if makeJoin != nil {
+		fedClient = &probedJoinClient{r, serverName, makeJoin}
+	}
+	response, joinErr := gomatrixserverlib.PerformJoin(ctx, fedClient, joinInput)
 
 	if joinErr != nil {
 		if !joinErr.Reachable {
@@ -206,7 +243,7 @@ func (r *FederationInternalAPI) performJoinUsingServer(
 		return fmt.Errorf("JoinedHostsFromEvents: failed to get joined hosts: %s", err)
 	}
 
-	logrus.WithField("room", roomID).Infof("Joined federated room with %d hosts", len(joinedHosts))
+	logrus.WithField("room_id", roomID).Infof("Joined federated room with %d hosts", len(joinedHosts))
 	if _, err = r.db.UpdateRoom(context.Background(), roomID, joinedHosts, nil, true); err != nil {
 		return fmt.Errorf("UpdatedRoom: failed to update room with joined hosts: %s", err)
 	}
@@ -234,6 +271,9 @@ func (r *FederationInternalAPI) PerformLeave(
 	request *api.PerformLeaveRequest,
 	response *api.PerformLeaveResponse,
 ) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformLeave")
+	defer span.End()
+
 	userID, err := spec.NewUserID(request.UserID, true)
 	if err != nil {
 		return err
@@ -303,11 +343,12 @@ func (r *FederationInternalAPI) PerformLeave(
 		}
 
 		// Build the leave event.
+		keyID, privateKey := r.cfg.Matrix.SigningKey()
 		event, err := leaveEB.Build(
 			time.Now(),
 			userID.Domain(),
-			r.cfg.Matrix.KeyID,
-			r.cfg.Matrix.PrivateKey,
+			keyID,
+			privateKey,
 		)
 		if err != nil {
 			logrus.WithError(err).Warnf("respMakeLeave.LeaveEvent.Build failed")
@@ -344,6 +385,14 @@ func (r *FederationInternalAPI) SendInvite(
 	event gomatrixserverlib.PDU,
 	strippedState []gomatrixserverlib.InviteStrippedState,
 ) (gomatrixserverlib.PDU, error) {
+	disabled, err := r.db.IsRoomFederationDisabled(ctx, event.RoomID().String())
+	if err != nil {
+		return nil, fmt.Errorf("r.db.IsRoomFederationDisabled: %w", err)
+	}
+	if disabled {
+		return nil, &api.RoomFederationDisabledError{RoomID: event.RoomID().String()}
+	}
+
 	inviter, err := r.rsAPI.QueryUserIDForSender(ctx, event.RoomID(), event.SenderID())
 	if err != nil {
 		return nil, err
@@ -393,6 +442,9 @@ func (r *FederationInternalAPI) PerformBroadcastEDU(
 	request *api.PerformBroadcastEDURequest,
 	response *api.PerformBroadcastEDUResponse,
 ) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformBroadcastEDU")
+	defer span.End()
+
 	destinations, err := r.db.GetAllJoinedHosts(ctx)
 	if err != nil {
 		return fmt.Errorf("r.db.GetAllJoinedHosts: %w", err)
@@ -421,10 +473,94 @@ func (r *FederationInternalAPI) PerformWakeupServers(
 	request *api.PerformWakeupServersRequest,
 	response *api.PerformWakeupServersResponse,
 ) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformWakeupServers")
+	defer span.End()
+
 	r.MarkServersAlive(request.ServerNames)
 	return nil
 }
 
+// PerformAdminSetRoomFederationDisabled implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformAdminSetRoomFederationDisabled(
+	ctx context.Context, roomID string, disabled bool,
+) error {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformAdminSetRoomFederationDisabled")
+	defer span.End()
+
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return err
+	}
+	createEvent, err := r.rsAPI.CurrentStateEvent(ctx, *validRoomID, spec.MRoomCreate, "")
+	if err != nil {
+		return fmt.Errorf("r.rsAPI.CurrentStateEvent: %w", err)
+	}
+	if createEvent == nil {
+		return eventutil.ErrRoomNoExists{}
+	}
+	if !disabled {
+		var content gomatrixserverlib.CreateContent
+		if err = json.Unmarshal(createEvent.Content(), &content); err == nil && content.Federate != nil && !*content.Federate {
+			return &api.RoomNotFederatableError{RoomID: roomID}
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id":  roomID,
+		"disabled": disabled,
+	}).Warn("Changing federation status of room")
+	return r.db.SetRoomFederationDisabled(ctx, roomID, disabled)
+}
+
+// PerformAdminUnblacklistDestination implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformAdminUnblacklistDestination(
+	ctx context.Context, serverName spec.ServerName,
+) error {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformAdminUnblacklistDestination")
+	defer span.End()
+
+	logrus.WithField("server_name", serverName).Warn("Removing destination from blacklist")
+	r.MarkServersAlive([]spec.ServerName{serverName})
+	return nil
+}
+
+// PerformAdminDropDestinationQueue implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformAdminDropDestinationQueue(
+	ctx context.Context, serverName spec.ServerName,
+) error {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformAdminDropDestinationQueue")
+	defer span.End()
+
+	logrus.WithField("server_name", serverName).Warn("Dropping destination queue")
+	return r.queues.DropQueue(ctx, serverName)
+}
+
+// PerformAdminRetryDestinationQueue implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformAdminRetryDestinationQueue(
+	ctx context.Context, serverName spec.ServerName,
+) error {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformAdminRetryDestinationQueue")
+	defer span.End()
+
+	logrus.WithField("server_name", serverName).Warn("Retrying destination queue")
+	r.statistics.ForServer(serverName).MarkServerAlive()
+	r.queues.RetryServer(serverName, true)
+	return nil
+}
+
+// PerformAdminForgetResolution implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformAdminForgetResolution(
+	ctx context.Context, serverName spec.ServerName,
+) error {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.PerformAdminForgetResolution")
+	defer span.End()
+
+	if cache := r.federation.ResolutionCache(); cache != nil {
+		logrus.WithField("server_name", serverName).Info("Forgetting cached server resolution")
+		cache.Forget(serverName)
+	}
+	return nil
+}
+
 func (r *FederationInternalAPI) MarkServersAlive(destinations []spec.ServerName) {
 	for _, srv := range destinations {
 		wasBlacklisted := r.statistics.ForServer(srv).MarkServerAlive()
@@ -432,6 +568,11 @@ func (r *FederationInternalAPI) MarkServersAlive(destinations []spec.ServerName)
 	}
 }
 
+func (r *FederationInternalAPI) IsServerBackingOff(serverName spec.ServerName) bool {
+	_, err := r.IsBlacklistedOrBackingOff(serverName)
+	return err != nil
+}
+
 // federatedEventProvider is an event provider which fetches events from the server provided
 func federatedEventProvider(
 	ctx context.Context, federation fclient.FederationClient,
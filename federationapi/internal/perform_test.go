@@ -35,6 +35,12 @@ type testFedClient struct {
 	queryKeysCalled bool
 	claimKeysCalled bool
 	shouldFail      bool
+	invitesSent     int
+}
+
+func (t *testFedClient) SendInviteV2(ctx context.Context, origin, s spec.ServerName, request fclient.InviteV2Request) (res fclient.RespInviteV2, err error) {
+	t.invitesSent++
+	return fclient.RespInviteV2{}, nil
 }
 
 func (t *testFedClient) LookupRoomAlias(ctx context.Context, origin, s spec.ServerName, roomAlias string) (res fclient.RespDirectory, err error) {
@@ -71,7 +77,7 @@ func TestPerformWakeupServers(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, 0, config.EDUTypeFilter{},
 	)
 	fedAPI := NewFederationInternalAPI(
 		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
@@ -109,7 +115,7 @@ func TestPerformDirectoryLookup(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, 0, config.EDUTypeFilter{},
 	)
 	fedAPI := NewFederationInternalAPI(
 		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
@@ -123,3 +129,51 @@ func TestPerformDirectoryLookup(t *testing.T) {
 	err = fedAPI.PerformDirectoryLookup(context.Background(), &req, &res)
 	assert.NoError(t, err)
 }
+
+func TestSendInviteFederationDisabled(t *testing.T) {
+	testDB := test.NewInMemoryFederationDatabase()
+	cfg := config.FederationAPI{Matrix: &config.Global{}}
+	fedClient := &testFedClient{}
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist)
+	fedAPI := NewFederationInternalAPI(
+		testDB, &cfg, nil, fedClient, &stats, nil, nil, nil,
+	)
+
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	invite := room.CreateEvent(t, alice, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Invite,
+	}, test.WithStateKey("@bob:remote"))
+	assert.NoError(t, testDB.SetRoomFederationDisabled(context.Background(), room.ID, true))
+
+	_, err := fedAPI.SendInvite(context.Background(), invite.PDU, nil)
+	var disabledErr *api.RoomFederationDisabledError
+	assert.ErrorAs(t, err, &disabledErr)
+	assert.Equal(t, room.ID, disabledErr.RoomID)
+	assert.Zero(t, fedClient.invitesSent)
+}
+
+func TestIsServerBackingOff(t *testing.T) {
+	testDB := test.NewInMemoryFederationDatabase()
+	cfg := config.FederationAPI{Matrix: &config.Global{}}
+	fedClient := &testFedClient{}
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist)
+	queues := queue.NewOutgoingQueues(
+		testDB, process.NewProcessContext(),
+		false,
+		cfg.Matrix.ServerName, fedClient, &stats,
+		nil, 0, config.EDUTypeFilter{},
+	)
+	fedAPI := NewFederationInternalAPI(
+		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+	)
+
+	server := spec.ServerName("backfill")
+	assert.False(t, fedAPI.IsServerBackingOff(server))
+
+	stats.ForServer(server).Failure()
+	assert.True(t, fedAPI.IsServerBackingOff(server))
+
+	fedAPI.MarkServersAlive([]spec.ServerName{server})
+	assert.False(t, fedAPI.IsServerBackingOff(server))
+}
@@ -3,11 +3,14 @@ package internal
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/internal/util"
 )
 
@@ -17,6 +20,9 @@ func (f *FederationInternalAPI) QueryJoinedHostServerNamesInRoom(
 	request *api.QueryJoinedHostServerNamesInRoomRequest,
 	response *api.QueryJoinedHostServerNamesInRoomResponse,
 ) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.QueryJoinedHostServerNamesInRoom")
+	defer span.End()
+
 	joinedHosts, err := f.db.GetJoinedHostsForRooms(ctx, []string{request.RoomID}, request.ExcludeSelf, request.ExcludeBlacklisted)
 	if err != nil {
 		return
@@ -26,6 +32,150 @@ func (f *FederationInternalAPI) QueryJoinedHostServerNamesInRoom(
 	return
 }
 
+// QueryRoomFederationDisabled implements api.FederationInternalAPI
+func (f *FederationInternalAPI) QueryRoomFederationDisabled(
+	ctx context.Context, roomID string,
+) (bool, error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.QueryRoomFederationDisabled")
+	defer span.End()
+
+	return f.db.IsRoomFederationDisabled(ctx, roomID)
+}
+
+// QueryFederatedRooms implements api.FederationInternalAPI
+func (f *FederationInternalAPI) QueryFederatedRooms(
+	ctx context.Context, roomIDs []string,
+) ([]string, error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.QueryFederatedRooms")
+	defer span.End()
+
+	return f.db.FederatedRooms(ctx, roomIDs)
+}
+
+// QueryAdminDestinations implements api.FederationInternalAPI
+func (f *FederationInternalAPI) QueryAdminDestinations(
+	ctx context.Context,
+) ([]api.DestinationStatus, error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.QueryAdminDestinations")
+	defer span.End()
+
+	blacklisted, err := f.db.GetBlacklistedServers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("f.db.GetBlacklistedServers: %w", err)
+	}
+	destinations := map[spec.ServerName]*api.DestinationStatus{}
+	for _, serverName := range blacklisted {
+		destinations[serverName] = &api.DestinationStatus{
+			ServerName:  serverName,
+			Blacklisted: true,
+		}
+	}
+	for serverName, until := range f.statistics.BackingOff() {
+		destination, ok := destinations[serverName]
+		if !ok {
+			destination = &api.DestinationStatus{ServerName: serverName}
+			destinations[serverName] = destination
+		}
+		ts := spec.AsTimestamp(until)
+		destination.BackoffUntil = &ts
+	}
+	result := make([]api.DestinationStatus, 0, len(destinations))
+	for _, destination := range destinations {
+		result = append(result, *destination)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ServerName < result[j].ServerName
+	})
+	return result, nil
+}
+
+// QueryAdminResolutionCache implements api.FederationInternalAPI
+func (f *FederationInternalAPI) QueryAdminResolutionCache(
+	ctx context.Context,
+) ([]fclient.ResolutionCacheEntry, error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.QueryAdminResolutionCache")
+	defer span.End()
+
+	cache := f.federation.ResolutionCache()
+	if cache == nil {
+		return []fclient.ResolutionCacheEntry{}, nil
+	}
+	return cache.Entries(), nil
+}
+
+// QueryAdminDestinationQueues implements api.FederationInternalAPI
+func (f *FederationInternalAPI) QueryAdminDestinationQueues(
+	ctx context.Context,
+) ([]api.DestinationQueueStatus, error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.QueryAdminDestinationQueues")
+	defer span.End()
+
+	serverNames := map[spec.ServerName]struct{}{}
+	pduServerNames, err := f.db.GetPendingPDUServerNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("f.db.GetPendingPDUServerNames: %w", err)
+	}
+	eduServerNames, err := f.db.GetPendingEDUServerNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("f.db.GetPendingEDUServerNames: %w", err)
+	}
+	blacklisted, err := f.db.GetBlacklistedServers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("f.db.GetBlacklistedServers: %w", err)
+	}
+	for _, names := range [][]spec.ServerName{pduServerNames, eduServerNames, blacklisted} {
+		for _, serverName := range names {
+			serverNames[serverName] = struct{}{}
+		}
+	}
+	for serverName := range f.statistics.BackingOff() {
+		serverNames[serverName] = struct{}{}
+	}
+	result := make([]api.DestinationQueueStatus, 0, len(serverNames))
+	for serverName := range serverNames {
+		status, err := f.QueryAdminDestinationQueue(ctx, serverName)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ServerName < result[j].ServerName
+	})
+	return result, nil
+}
+
+// QueryAdminDestinationQueue implements api.FederationInternalAPI
+func (f *FederationInternalAPI) QueryAdminDestinationQueue(
+	ctx context.Context, serverName spec.ServerName,
+) (*api.DestinationQueueStatus, error) {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.QueryAdminDestinationQueue")
+	defer span.End()
+
+	pdus, edus, oldest, err := f.db.GetPendingSummary(ctx, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("f.db.GetPendingSummary: %w", err)
+	}
+	stats := f.statistics.ForServer(serverName)
+	status := &api.DestinationQueueStatus{
+		ServerName:   serverName,
+		PendingPDUs:  pdus,
+		PendingEDUs:  edus,
+		Blacklisted:  stats.Blacklisted(),
+		BackoffCount: stats.BackoffCount(),
+	}
+	status.Running, _ = f.queues.QueueState(serverName)
+	if oldest != 0 {
+		age := time.Since(oldest.Time()).Milliseconds()
+		status.OldestPendingAgeMS = &age
+	}
+	if until := stats.BackoffInfo(); until != nil && until.After(time.Now()) {
+		ts := spec.AsTimestamp(*until)
+		status.BackoffUntil = &ts
+	}
+	return status, nil
+}
+
 func (a *FederationInternalAPI) fetchServerKeysDirectly(ctx context.Context, serverName spec.ServerName) (*gomatrixserverlib.ServerKeys, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
 	defer cancel()
@@ -77,6 +227,9 @@ func (a *FederationInternalAPI) fetchServerKeysFromCache(
 func (a *FederationInternalAPI) QueryServerKeys(
 	ctx context.Context, req *api.QueryServerKeysRequest, res *api.QueryServerKeysResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "federationapi.QueryServerKeys")
+	defer span.End()
+
 	// attempt to satisfy the entire request from the cache first
 	results, err := a.fetchServerKeysFromCache(ctx, req)
 	if err == nil {
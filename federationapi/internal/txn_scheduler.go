@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrTransactionQueueFull is returned when a server already has as many
+// transactions waiting to be processed as it is allowed.
+var ErrTransactionQueueFull = errors.New("too many transactions from this server are waiting to be processed")
+
+var (
+	queuedTransactions = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "queued_transactions",
+			Help:      "Number of transactions from other servers waiting for a worker",
+		},
+	)
+	rejectedTransactions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "rejected_transactions_total",
+			Help:      "Number of transactions from other servers rejected because too many were already queued",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		queuedTransactions, rejectedTransactions,
+	)
+}
+
+// queuedTransaction is a transaction waiting for a worker.
+type queuedTransaction struct {
+	ready chan struct{} // closed when the transaction has a worker
+}
+
+// originQueue is the transactions from a server waiting for a worker.
+type originQueue struct {
+	origin  spec.ServerName
+	waiting []*queuedTransaction
+	credit  int // how many more transactions to start in the current turn
+}
+
+// TransactionScheduler shares the workers which process incoming
+// transactions between the servers sending them. While all of the workers
+// are busy, the transactions from each server wait in their own queue, and
+// the queues take turns in weighted round-robin order to start transactions
+// as workers become free.
+type TransactionScheduler struct {
+	cfg     *config.TransactionScheduling
+	mu      sync.Mutex
+	running int                              // transactions being processed
+	origins map[spec.ServerName]*originQueue // servers with waiting transactions
+	ring    []*originQueue                   // the same servers, in turn order
+	next    int                              // index into ring of the server whose turn it is
+}
+
+func NewTransactionScheduler(cfg *config.TransactionScheduling) *TransactionScheduler {
+	return &TransactionScheduler{
+		cfg:     cfg,
+		origins: make(map[spec.ServerName]*originQueue),
+	}
+}
+
+// Acquire waits for a worker to process a transaction from the origin. The
+// returned function must be called once the transaction has been processed,
+// to hand the worker on. An error is returned if the origin has too many
+// transactions waiting already, or if the context is done first.
+func (s *TransactionScheduler) Acquire(ctx context.Context, origin spec.ServerName) (func(), error) {
+	s.mu.Lock()
+	// There are only free workers when nothing is waiting, so the
+	// transaction can start straight away.
+	if s.running < s.cfg.Workers {
+		s.running++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	q := s.origins[origin]
+	if q == nil {
+		q = &originQueue{origin: origin}
+		s.origins[origin] = q
+		s.ring = append(s.ring, q)
+	} else if len(q.waiting) >= s.cfg.MaxQueuedPerServer {
+		s.mu.Unlock()
+		rejectedTransactions.Inc()
+		return nil, ErrTransactionQueueFull
+	}
+	txn := &queuedTransaction{ready: make(chan struct{})}
+	q.waiting = append(q.waiting, txn)
+	queuedTransactions.Inc()
+	s.mu.Unlock()
+
+	select {
+	case <-txn.ready:
+		return s.release, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-txn.ready:
+		// The transaction was given a worker just as we gave up on it, so
+		// hand the worker on to the next one.
+		s.running--
+		s.dispatch()
+	default:
+		s.forget(q, txn)
+	}
+	return nil, ctx.Err()
+}
+
+// release frees up the worker of a transaction which has been processed.
+func (s *TransactionScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.dispatch()
+}
+
+// dispatch starts waiting transactions while there are free workers. Each
+// server gets to start as many transactions in a row as its weight before
+// it is the next server's turn. s.mu must be held.
+func (s *TransactionScheduler) dispatch() {
+	for s.running < s.cfg.Workers && len(s.ring) > 0 {
+		if s.next >= len(s.ring) {
+			s.next = 0
+		}
+		q := s.ring[s.next]
+		if q.credit <= 0 {
+			q.credit = s.cfg.Weight(q.origin)
+		}
+		txn := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.credit--
+		s.running++
+		queuedTransactions.Dec()
+		close(txn.ready)
+		switch {
+		case len(q.waiting) == 0:
+			s.remove(s.next)
+		case q.credit == 0:
+			s.next++
+		}
+	}
+}
+
+// forget removes a transaction which is no longer waiting from its queue.
+// s.mu must be held.
+func (s *TransactionScheduler) forget(q *originQueue, txn *queuedTransaction) {
+	for i := range q.waiting {
+		if q.waiting[i] == txn {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			queuedTransactions.Dec()
+			break
+		}
+	}
+	if len(q.waiting) > 0 {
+		return
+	}
+	for i := range s.ring {
+		if s.ring[i] == q {
+			s.remove(i)
+			break
+		}
+	}
+}
+
+// remove takes the server at index i out of the turn order, as it has no
+// more transactions waiting. s.mu must be held.
+func (s *TransactionScheduler) remove(i int) {
+	delete(s.origins, s.ring[i].origin)
+	s.ring = append(s.ring[:i], s.ring[i+1:]...)
+	if i < s.next {
+		s.next--
+	}
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func TestTransactionScheduler(t *testing.T) {
+	cfg := &config.TransactionScheduling{}
+	cfg.Defaults()
+	cfg.Workers = 1
+	cfg.MaxQueuedPerServer = 3
+	cfg.ServerWeights = map[spec.ServerName]int{"weighted.test": 2}
+	s := NewTransactionScheduler(cfg)
+	ctx := context.Background()
+
+	// The first transaction gets the only worker straight away.
+	release, err := s.Acquire(ctx, "busy.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queue up transactions while the worker is busy, noting the order
+	// that they are started in. Each one is queued before the next, so
+	// that the queues are in a known order.
+	started := make(chan spec.ServerName, 10)
+	var wg sync.WaitGroup
+	waiting := func(origin spec.ServerName) int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if q := s.origins[origin]; q != nil {
+			return len(q.waiting)
+		}
+		return 0
+	}
+	enqueue := func(origin spec.ServerName) {
+		before := waiting(origin)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := s.Acquire(ctx, origin)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			started <- origin
+			release()
+		}()
+		for waiting(origin) == before {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	enqueue("busy.test")
+	for i := 0; i < 2; i++ {
+		enqueue("busy.test")
+		enqueue("weighted.test")
+	}
+	enqueue("quiet.test")
+
+	// The busy server can't queue any more.
+	if _, err = s.Acquire(ctx, "busy.test"); !errors.Is(err, ErrTransactionQueueFull) {
+		t.Fatalf("expected the queue to be full, got %v", err)
+	}
+
+	// Giving up on a queued transaction takes it out of the queue.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = s.Acquire(cancelled, "quiet.test"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the transaction to be cancelled, got %v", err)
+	}
+
+	release()
+	want := []spec.ServerName{
+		"busy.test", "weighted.test", "weighted.test", "quiet.test",
+		"busy.test", "busy.test",
+	}
+	for i, origin := range want {
+		select {
+		case got := <-started:
+			if got != origin {
+				t.Fatalf("transaction %d: got %q, want %q", i, got, origin)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("transaction %d from %q was never started", i, origin)
+		}
+	}
+
+	// Each transaction is released after it is started, so wait for them
+	// all to finish before checking that nothing is left running.
+	wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running != 0 || len(s.ring) != 0 || len(s.origins) != 0 {
+		t.Fatalf("expected the scheduler to be idle, got %d running and %d servers waiting", s.running, len(s.ring))
+	}
+}
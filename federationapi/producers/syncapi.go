@@ -26,6 +26,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/setup/jetstream"
 	"github.com/neilalexander/harmony/syncapi/types"
@@ -60,6 +61,7 @@ func (p *SyncAPIProducer) SendReceipt(
 	m.Header.Set("timestamp", fmt.Sprintf("%d", timestamp))
 
 	log.WithFields(log.Fields{}).Tracef("Producing to topic '%s'", p.TopicReceiptEvent)
+	tracing.InjectNATS(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -120,6 +122,7 @@ func (p *SyncAPIProducer) SendToDevice(
 		m.Header.Set("sender", sender)
 		m.Header.Set(jetstream.UserID, userID)
 
+		tracing.InjectNATS(ctx, m)
 		if _, err = p.JetStream.PublishMsg(m, nats.Context(ctx)); err != nil {
 			if i < len(devices)-1 {
 				log.WithError(err).Warn("sendToDevice failed to PublishMsg, trying further devices")
@@ -143,6 +146,7 @@ func (p *SyncAPIProducer) SendTyping(
 	m.Header.Set(jetstream.RoomID, roomID)
 	m.Header.Set("typing", strconv.FormatBool(typing))
 	m.Header.Set("timeout_ms", strconv.Itoa(int(timeoutMS)))
+	tracing.InjectNATS(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -160,6 +164,7 @@ func (p *SyncAPIProducer) SendPresence(
 
 	m.Header.Set("last_active_ts", strconv.Itoa(int(lastActiveTS)))
 	log.Tracef("Sending presence to syncAPI: %+v", m.Header)
+	tracing.InjectNATS(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -171,6 +176,7 @@ func (p *SyncAPIProducer) SendDeviceListUpdate(
 	m.Header.Set("origin", string(origin))
 	m.Data = deviceListUpdate
 	log.Debugf("Sending device list update: %+v", m.Header)
+	tracing.InjectNATS(ctx, m)
 	_, err = p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -183,6 +189,7 @@ func (p *SyncAPIProducer) SendSigningKeyUpdate(
 	m.Data = data
 
 	log.Debugf("Sending signing key update")
+	tracing.InjectNATS(ctx, m)
 	_, err = p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -58,13 +59,20 @@ type destinationQueue struct {
 	running            atomic.Bool                     // is the queue worker running?
 	backingOff         atomic.Bool                     // true if we're backing off
 	overflowed         atomic.Bool                     // the queues exceed maxPDUsInMemory/maxEDUsInMemory, so we should consult the database for more
+	receiptsWaiting    atomic.Bool                     // read receipts are waiting for the receipt window to end
 	statistics         *statistics.ServerStatistics    // statistics about this remote server
-	transactionIDMutex sync.Mutex                      // protects transactionID
+	transactionIDMutex sync.Mutex                      // protects transactionID, transactionPDUs and transactionEDUs
 	transactionID      gomatrixserverlib.TransactionID // last transaction ID if retrying, or "" if last txn was successful
+	transactionPDUs    int                             // number of PDUs at the start of pendingPDUs in the transaction being retried
+	transactionEDUs    int                             // number of EDUs at the start of pendingEDUs in the transaction being retried
 	notify             chan struct{}                   // interrupts idle wait pending PDUs/EDUs
+	stopCtx            context.Context                 // cancelled when the queue is dropped
+	stop               context.CancelFunc              // stops the queue worker for good
+	workerMutex        sync.Mutex                      // held by the queue worker while it runs
 	pendingPDUs        []*queuedPDU                    // PDUs waiting to be sent
 	pendingEDUs        []*queuedEDU                    // EDUs waiting to be sent
-	pendingMutex       sync.RWMutex                    // protects pendingPDUs and pendingEDUs
+	pendingMutex       sync.RWMutex                    // protects pendingPDUs, pendingEDUs and inFlightLoaded
+	inFlightLoaded     bool                            // the unfinished transaction from before restarting has been loaded
 }
 
 // Send event adds the event to the pending queue for the destination.
@@ -123,6 +131,21 @@ func (oq *destinationQueue) sendEDU(event *gomatrixserverlib.EDU, dbReceipt *rec
 		}
 		oq.pendingMutex.Unlock()
 
+		// Read receipts wait for the receipt window to end, so that other
+		// receipts sent in the meantime can be combined with them. They
+		// are sent sooner if anything else wakes the queue first.
+		if event.Type == spec.MReceipt && oq.queues.receiptWindow > 0 {
+			if oq.receiptsWaiting.CompareAndSwap(false, true) {
+				time.AfterFunc(oq.queues.receiptWindow, func() {
+					oq.receiptsWaiting.Store(false)
+					if !oq.backingOff.Load() {
+						oq.wakeQueueAndNotify()
+					}
+				})
+			}
+			return
+		}
+
 		if !oq.backingOff.Load() {
 			oq.wakeQueueAndNotify()
 		}
@@ -207,6 +230,13 @@ func (oq *destinationQueue) getPendingFromDatabase() {
 	// have cached. We will index them based on the receipt,
 	// which ultimately just contains the index of the PDU/EDU
 	// in the database.
+	if !oq.inFlightLoaded {
+		oq.inFlightLoaded = true
+		if oq.getInFlightFromDatabase() {
+			retrieved = true
+		}
+	}
+
 	gotPDUs := map[string]struct{}{}
 	gotEDUs := map[string]struct{}{}
 	for _, pdu := range oq.pendingPDUs {
@@ -274,6 +304,66 @@ func (oq *destinationQueue) getPendingFromDatabase() {
 	}
 }
 
+// getInFlightFromDatabase looks for a transaction which was started but
+// not finished before restarting. If there is one, its PDUs and EDUs are
+// put at the start of the queue so that it is retried unchanged, with the
+// same transaction ID. The caller must hold pendingMutex.
+func (oq *destinationQueue) getInFlightFromDatabase() bool {
+	transactionID, pdus, edus, err := oq.db.GetInFlightTransaction(oq.process.Context(), oq.destination)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get in-flight transaction for %q", oq.destination)
+		return false
+	}
+	if transactionID == "" || (len(pdus) == 0 && len(edus) == 0) {
+		return false
+	}
+
+	inFlightPDUs := make([]*queuedPDU, 0, len(pdus))
+	for receipt, pdu := range pdus {
+		inFlightPDUs = append(inFlightPDUs, &queuedPDU{receipt, pdu})
+	}
+	sort.Slice(inFlightPDUs, func(i, j int) bool {
+		return inFlightPDUs[i].dbReceipt.GetNID() < inFlightPDUs[j].dbReceipt.GetNID()
+	})
+	inFlightEDUs := make([]*queuedEDU, 0, len(edus))
+	for receipt, edu := range edus {
+		inFlightEDUs = append(inFlightEDUs, &queuedEDU{receipt, edu})
+	}
+	sort.Slice(inFlightEDUs, func(i, j int) bool {
+		return inFlightEDUs[i].dbReceipt.GetNID() < inFlightEDUs[j].dbReceipt.GetNID()
+	})
+
+	// Anything which was queued in memory before we got here goes after
+	// the in-flight transaction, unless it's already part of it.
+	gotPDUs := map[string]struct{}{}
+	gotEDUs := map[string]struct{}{}
+	for _, pdu := range inFlightPDUs {
+		gotPDUs[pdu.dbReceipt.String()] = struct{}{}
+	}
+	for _, edu := range inFlightEDUs {
+		gotEDUs[edu.dbReceipt.String()] = struct{}{}
+	}
+	for _, pdu := range oq.pendingPDUs {
+		if _, ok := gotPDUs[pdu.dbReceipt.String()]; !ok {
+			inFlightPDUs = append(inFlightPDUs, pdu)
+		}
+	}
+	for _, edu := range oq.pendingEDUs {
+		if _, ok := gotEDUs[edu.dbReceipt.String()]; !ok {
+			inFlightEDUs = append(inFlightEDUs, edu)
+		}
+	}
+
+	oq.transactionIDMutex.Lock()
+	oq.transactionID = transactionID
+	oq.transactionPDUs = len(pdus)
+	oq.transactionEDUs = len(edus)
+	oq.transactionIDMutex.Unlock()
+	oq.pendingPDUs = inFlightPDUs
+	oq.pendingEDUs = inFlightEDUs
+	return true
+}
+
 // checkNotificationsOnClose checks for any remaining notifications
 // and starts a new backgroundSend goroutine if any exist.
 func (oq *destinationQueue) checkNotificationsOnClose() {
@@ -305,6 +395,14 @@ func (oq *destinationQueue) backgroundSend() {
 	defer oq.checkNotificationsOnClose()
 	defer oq.running.Store(false)
 
+	// Dropping the queue waits for the worker to stop, and no worker starts
+	// once it has been dropped.
+	oq.workerMutex.Lock()
+	defer oq.workerMutex.Unlock()
+	if oq.stopCtx.Err() != nil {
+		return
+	}
+
 	destinationQueueRunning.Inc()
 	defer destinationQueueRunning.Dec()
 
@@ -347,6 +445,9 @@ func (oq *destinationQueue) backgroundSend() {
 			// The parent process is shutting down, so stop.
 			oq.statistics.ClearBackoff()
 			return
+		case <-oq.stopCtx.Done():
+			// The queue has been dropped, so stop.
+			return
 		}
 
 		// Work out which PDUs/EDUs to include in the next transaction.
@@ -359,6 +460,14 @@ func (oq *destinationQueue) backgroundSend() {
 		if eduCount > maxEDUsPerTransaction {
 			eduCount = maxEDUsPerTransaction
 		}
+		// A transaction which is being retried is sent again unchanged,
+		// even if more PDUs or EDUs have been queued since.
+		oq.transactionIDMutex.Lock()
+		if oq.transactionID != "" {
+			pduCount = min(pduCount, oq.transactionPDUs)
+			eduCount = min(eduCount, oq.transactionEDUs)
+		}
+		oq.transactionIDMutex.Unlock()
 		toSendPDUs := oq.pendingPDUs[:pduCount]
 		toSendEDUs := oq.pendingEDUs[:eduCount]
 		oq.pendingMutex.RUnlock()
@@ -369,9 +478,21 @@ func (oq *destinationQueue) backgroundSend() {
 			continue
 		}
 
+		// If the process is closing then stop here. The events are still
+		// in the database so they will be sent after restarting.
+		if !oq.process.WorkStarted() {
+			return
+		}
+
 		// If we have pending PDUs or EDUs then construct a transaction.
 		// Try sending the next transaction and see what happens.
 		terr := oq.nextTransaction(toSendPDUs, toSendEDUs)
+		oq.process.WorkFinished()
+		if oq.stopCtx.Err() != nil {
+			// The queue was dropped while the transaction was in flight, so
+			// whatever happened to it doesn't matter anymore.
+			return
+		}
 		if terr != nil {
 			// We failed to send the transaction. Mark it as a failure.
 			_, blacklisted := oq.statistics.Failure()
@@ -405,27 +526,24 @@ func (oq *destinationQueue) nextTransaction(
 	t, pduReceipts, eduReceipts := oq.createTransaction(pdus, edus)
 	logrus.WithField("server_name", oq.destination).Debugf("Sending transaction %q containing %d PDUs, %d EDUs", t.TransactionID, len(t.PDUs), len(t.EDUs))
 
-	// Try to send the transaction to the destination server.
-	ctx, cancel := context.WithTimeout(oq.process.Context(), time.Minute*5)
+	// Try to send the transaction to the destination server. A transaction
+	// which has started is allowed to finish if the process shuts down, so
+	// that the events aren't sent again after restarting.
+	ctx := context.WithoutCancel(oq.process.Context())
+	sendCtx, cancel := context.WithTimeout(ctx, time.Minute*5)
 	defer cancel()
+	// Dropping the queue gives up on the transaction.
+	stopSending := context.AfterFunc(oq.stopCtx, cancel)
+	defer stopSending()
 
 	// Try sending directly to the destination first in case they came back online.
-	_, err = oq.client.SendTransaction(ctx, t)
+	_, err = oq.client.SendTransaction(sendCtx, t)
 
 	switch errResponse := err.(type) {
 	case nil:
 		// Clean up the transaction in the database.
-		if pduReceipts != nil {
-			//logrus.Infof("Cleaning PDUs %q", pduReceipt.String())
-			if err = oq.db.CleanPDUs(oq.process.Context(), oq.destination, pduReceipts); err != nil {
-				logrus.WithError(err).Errorf("Failed to clean PDUs for server %q", t.Destination)
-			}
-		}
-		if eduReceipts != nil {
-			//logrus.Infof("Cleaning EDUs %q", eduReceipt.String())
-			if err = oq.db.CleanEDUs(oq.process.Context(), oq.destination, eduReceipts); err != nil {
-				logrus.WithError(err).Errorf("Failed to clean EDUs for server %q", t.Destination)
-			}
+		if err = oq.db.FinishTransaction(ctx, oq.destination, pduReceipts, eduReceipts); err != nil {
+			logrus.WithError(err).Errorf("Failed to clean up transaction for server %q", t.Destination)
 		}
 		// Reset the transaction ID.
 		oq.transactionIDMutex.Lock()
@@ -458,17 +576,6 @@ func (oq *destinationQueue) createTransaction(
 	pdus []*queuedPDU,
 	edus []*queuedEDU,
 ) (gomatrixserverlib.Transaction, []*receipt.Receipt, []*receipt.Receipt) {
-	// If there's no projected transaction ID then generate one. If
-	// the transaction succeeds then we'll set it back to "" so that
-	// we generate a new one next time. If it fails, we'll preserve
-	// it so that we retry with the same transaction ID.
-	oq.transactionIDMutex.Lock()
-	if oq.transactionID == "" {
-		now := spec.AsTimestamp(time.Now())
-		oq.transactionID = gomatrixserverlib.TransactionID(fmt.Sprintf("%d-%d", now, oq.statistics.SuccessCount()))
-	}
-	oq.transactionIDMutex.Unlock()
-
 	t := gomatrixserverlib.Transaction{
 		PDUs: []json.RawMessage{},
 		EDUs: []gomatrixserverlib.EDU{},
@@ -476,7 +583,6 @@ func (oq *destinationQueue) createTransaction(
 	t.Origin = oq.origin
 	t.Destination = oq.destination
 	t.OriginServerTS = spec.AsTimestamp(time.Now())
-	t.TransactionID = oq.transactionID
 
 	var pduReceipts []*receipt.Receipt
 	var eduReceipts []*receipt.Receipt
@@ -504,9 +610,152 @@ func (oq *destinationQueue) createTransaction(
 		eduReceipts = append(eduReceipts, edu.dbReceipt)
 	}
 
+	// If there's no projected transaction ID then generate one. If
+	// the transaction succeeds then we'll set it back to "" so that
+	// we generate a new one next time. If it fails, we'll preserve
+	// it so that we retry with the same transaction ID and contents.
+	// The counter and the contents are stored in the database, so
+	// that IDs aren't reused and the transaction is retried unchanged
+	// after a restart, but if that fails then fall back to using the
+	// time.
+	oq.transactionIDMutex.Lock()
+	if oq.transactionID == "" {
+		if transactionID, err := oq.db.StartTransaction(oq.process.Context(), oq.destination, pduReceipts, eduReceipts); err == nil {
+			oq.transactionID = transactionID
+		} else {
+			logrus.WithError(err).WithField("server_name", oq.destination).Error("Failed to start transaction")
+			now := spec.AsTimestamp(time.Now())
+			oq.transactionID = gomatrixserverlib.TransactionID(fmt.Sprintf("%d-%d", now, oq.statistics.SuccessCount()))
+		}
+		oq.transactionPDUs = len(pdus)
+		oq.transactionEDUs = len(edus)
+	}
+	t.TransactionID = oq.transactionID
+	oq.transactionIDMutex.Unlock()
+
+	t.EDUs = batchReceiptEDUs(batchToDeviceEDUs(t.EDUs, t.TransactionID))
+
 	return t, pduReceipts, eduReceipts
 }
 
+// batchToDeviceEDUs combines m.direct_to_device EDUs that share the same
+// origin, sender, type and message ID into a single EDU, so that a message
+// sent to many devices only takes up one EDU in the transaction. Repeated
+// messages for the same device with the same message ID are deduplicated.
+// EDUs which can't be combined are returned unchanged and in order.
+//
+// A message sent to more devices than fit into one transaction is split
+// across several, and receiving servers drop repeated message IDs, so the
+// transaction ID is added to the message ID of every batched EDU. Retries
+// of the same transaction keep the same transaction ID, and so the same
+// message IDs.
+func batchToDeviceEDUs(edus []gomatrixserverlib.EDU, txnID gomatrixserverlib.TransactionID) []gomatrixserverlib.EDU {
+	type toDeviceKey struct {
+		origin    string
+		sender    string
+		eventType string
+		messageID string
+	}
+	batched := make([]gomatrixserverlib.EDU, 0, len(edus))
+	messages := map[toDeviceKey]*gomatrixserverlib.ToDeviceMessage{}
+	positions := map[toDeviceKey]int{}
+	for _, edu := range edus {
+		if edu.Type != spec.MDirectToDevice {
+			batched = append(batched, edu)
+			continue
+		}
+		var tdm gomatrixserverlib.ToDeviceMessage
+		if err := json.Unmarshal(edu.Content, &tdm); err != nil || tdm.MessageID == "" {
+			batched = append(batched, edu)
+			continue
+		}
+		key := toDeviceKey{edu.Origin, tdm.Sender, tdm.Type, tdm.MessageID}
+		existing, ok := messages[key]
+		if !ok {
+			tdm.MessageID = fmt.Sprintf("%s-%s", tdm.MessageID, txnID)
+			messages[key] = &tdm
+			positions[key] = len(batched)
+			batched = append(batched, edu)
+			continue
+		}
+		if existing.Messages == nil {
+			existing.Messages = map[string]map[string]json.RawMessage{}
+		}
+		for userID, byDevice := range tdm.Messages {
+			if existing.Messages[userID] == nil {
+				existing.Messages[userID] = map[string]json.RawMessage{}
+			}
+			for deviceID, content := range byDevice {
+				existing.Messages[userID][deviceID] = content
+			}
+		}
+	}
+	for key, tdm := range messages {
+		content, err := json.Marshal(tdm)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to marshal batched send-to-device EDU")
+			continue
+		}
+		batched[positions[key]].Content = content
+	}
+	return batched
+}
+
+// batchReceiptEDUs combines m.receipt EDUs with the same origin into a
+// single EDU containing the receipts for all of their rooms and users. If
+// there is more than one receipt of the same type for a user in a room
+// then the latest one is kept. EDUs which can't be combined are returned
+// unchanged and in order.
+func batchReceiptEDUs(edus []gomatrixserverlib.EDU) []gomatrixserverlib.EDU {
+	// room ID -> receipt type -> user ID -> receipt
+	type receipts map[string]map[string]map[string]json.RawMessage
+	batched := make([]gomatrixserverlib.EDU, 0, len(edus))
+	byOrigin := map[string]receipts{}
+	positions := map[string]int{}
+	merged := map[string]struct{}{}
+	for _, edu := range edus {
+		if edu.Type != spec.MReceipt {
+			batched = append(batched, edu)
+			continue
+		}
+		var content receipts
+		if err := json.Unmarshal(edu.Content, &content); err != nil || content == nil {
+			batched = append(batched, edu)
+			continue
+		}
+		existing, ok := byOrigin[edu.Origin]
+		if !ok {
+			byOrigin[edu.Origin] = content
+			positions[edu.Origin] = len(batched)
+			batched = append(batched, edu)
+			continue
+		}
+		for roomID, byType := range content {
+			if existing[roomID] == nil {
+				existing[roomID] = map[string]map[string]json.RawMessage{}
+			}
+			for receiptType, byUser := range byType {
+				if existing[roomID][receiptType] == nil {
+					existing[roomID][receiptType] = map[string]json.RawMessage{}
+				}
+				for userID, receipt := range byUser {
+					existing[roomID][receiptType][userID] = receipt
+				}
+			}
+		}
+		merged[edu.Origin] = struct{}{}
+	}
+	for origin := range merged {
+		content, err := json.Marshal(byOrigin[origin])
+		if err != nil {
+			logrus.WithError(err).Error("Failed to marshal batched receipt EDU")
+			continue
+		}
+		batched[positions[origin]].Content = content
+	}
+	return batched
+}
+
 // blacklistDestination removes all pending PDUs and EDUs that have been cached
 // and deletes this queue.
 func (oq *destinationQueue) blacklistDestination() {
@@ -15,6 +15,7 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -31,21 +32,24 @@ import (
 	"github.com/neilalexander/harmony/federationapi/storage"
 	"github.com/neilalexander/harmony/federationapi/storage/shared/receipt"
 	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/setup/process"
 )
 
 // OutgoingQueues is a collection of queues for sending transactions to other
 // matrix servers
 type OutgoingQueues struct {
-	db          storage.Database
-	process     *process.ProcessContext
-	disabled    bool
-	origin      spec.ServerName
-	client      fclient.FederationClient
-	statistics  *statistics.Statistics
-	signing     map[spec.ServerName]*fclient.SigningIdentity
-	queuesMutex sync.Mutex // protects the below
-	queues      map[spec.ServerName]*destinationQueue
+	db            storage.Database
+	process       *process.ProcessContext
+	disabled      bool
+	origin        spec.ServerName
+	client        fclient.FederationClient
+	statistics    *statistics.Statistics
+	signing       map[spec.ServerName]*fclient.SigningIdentity
+	receiptWindow time.Duration // how long read receipts wait so that they can be sent together
+	outboundEDUs  config.EDUTypeFilter
+	queuesMutex   sync.Mutex // protects the below
+	queues        map[spec.ServerName]*destinationQueue
 }
 
 func init() {
@@ -88,16 +92,20 @@ func NewOutgoingQueues(
 	client fclient.FederationClient,
 	statistics *statistics.Statistics,
 	signing []*fclient.SigningIdentity,
+	receiptWindow time.Duration,
+	outboundEDUs config.EDUTypeFilter,
 ) *OutgoingQueues {
 	queues := &OutgoingQueues{
-		disabled:   disabled,
-		process:    process,
-		db:         db,
-		origin:     origin,
-		client:     client,
-		statistics: statistics,
-		signing:    map[spec.ServerName]*fclient.SigningIdentity{},
-		queues:     map[spec.ServerName]*destinationQueue{},
+		disabled:      disabled,
+		process:       process,
+		db:            db,
+		origin:        origin,
+		client:        client,
+		statistics:    statistics,
+		signing:       map[spec.ServerName]*fclient.SigningIdentity{},
+		receiptWindow: receiptWindow,
+		outboundEDUs:  outboundEDUs,
+		queues:        map[spec.ServerName]*destinationQueue{},
 	}
 	for _, identity := range signing {
 		queues.signing[identity.ServerName] = identity
@@ -163,6 +171,7 @@ func (oqs *OutgoingQueues) getQueue(destination spec.ServerName) *destinationQue
 			notify:      make(chan struct{}, 1),
 			signing:     oqs.signing,
 		}
+		oq.stopCtx, oq.stop = context.WithCancel(context.Background())
 		oq.statistics.AssignBackoffNotifier(oq.handleBackoffNotifier)
 		oqs.queues[destination] = oq
 	}
@@ -266,6 +275,10 @@ func (oqs *OutgoingQueues) SendEDU(
 		log.Trace("Federation is disabled, not sending EDU")
 		return nil
 	}
+	if !oqs.outboundEDUs.Allows(e.Type) {
+		log.Tracef("Sending %q EDUs is disabled, not sending EDU", e.Type)
+		return nil
+	}
 	if _, ok := oqs.signing[origin]; !ok {
 		return fmt.Errorf(
 			"sendevent: unexpected server to send as %q",
@@ -347,3 +360,52 @@ func (oqs *OutgoingQueues) RetryServer(srv spec.ServerName, wasBlacklisted bool)
 		queue.wakeQueueIfEventsPending(wasBlacklisted)
 	}
 }
+
+// QueueState returns whether the queue for the given server is currently
+// running and whether it is backing off.
+func (oqs *OutgoingQueues) QueueState(srv spec.ServerName) (running, backingOff bool) {
+	oqs.queuesMutex.Lock()
+	defer oqs.queuesMutex.Unlock()
+	if oq, ok := oqs.queues[srv]; ok && oq != nil {
+		return oq.running.Load(), oq.backingOff.Load()
+	}
+	return false, false
+}
+
+// DropQueue discards everything that is waiting to be sent to the given
+// server, both in memory and in the database. Anything sent to the server
+// afterwards will start a new queue.
+func (oqs *OutgoingQueues) DropQueue(ctx context.Context, srv spec.ServerName) error {
+	oqs.queuesMutex.Lock()
+	oq, ok := oqs.queues[srv]
+	if ok {
+		delete(oqs.queues, srv)
+		destinationQueueTotal.Dec()
+	}
+	oqs.queuesMutex.Unlock()
+
+	if oq != nil {
+		// Stop the queue worker, and wait for it, so that it doesn't carry on
+		// sending what is about to be dropped.
+		oq.statistics.AssignBackoffNotifier(nil)
+		oq.stop()
+		oq.workerMutex.Lock()
+		oq.workerMutex.Unlock() // nolint:staticcheck
+		if oq.backingOff.CompareAndSwap(true, false) {
+			destinationQueueBackingOff.Dec()
+		}
+		oq.pendingMutex.Lock()
+		for i := range oq.pendingPDUs {
+			oq.pendingPDUs[i] = nil
+		}
+		for i := range oq.pendingEDUs {
+			oq.pendingEDUs[i] = nil
+		}
+		oq.pendingPDUs = nil
+		oq.pendingEDUs = nil
+		oq.overflowed.Store(false)
+		oq.pendingMutex.Unlock()
+	}
+
+	return oqs.db.DropPending(ctx, srv)
+}
@@ -18,6 +18,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -68,6 +70,10 @@ type stubFederationClient struct {
 	fclient.FederationClient
 	shouldTxSucceed bool
 	txCount         atomic.Uint32
+	txnIDsMutex     sync.Mutex
+	txnIDs          []gomatrixserverlib.TransactionID
+	txnEDUCounts    []int
+	lastEDUs        []gomatrixserverlib.EDU
 }
 
 func (f *stubFederationClient) SendTransaction(ctx context.Context, t gomatrixserverlib.Transaction) (res fclient.RespSend, err error) {
@@ -76,6 +82,11 @@ func (f *stubFederationClient) SendTransaction(ctx context.Context, t gomatrixse
 		result = fmt.Errorf("transaction failed")
 	}
 
+	f.txnIDsMutex.Lock()
+	f.txnIDs = append(f.txnIDs, t.TransactionID)
+	f.txnEDUCounts = append(f.txnEDUCounts, len(t.EDUs))
+	f.lastEDUs = t.EDUs
+	f.txnIDsMutex.Unlock()
 	f.txCount.Add(1)
 	return fclient.RespSend{}, result
 }
@@ -111,7 +122,7 @@ func testSetup(failuresUntilBlacklist uint32, shouldTxSucceed bool, t *testing.T
 			ServerName: "localhost",
 		},
 	}
-	queues := NewOutgoingQueues(db, processContext, false, "localhost", fc, &stats, signingInfo)
+	queues := NewOutgoingQueues(db, processContext, false, "localhost", fc, &stats, signingInfo, 0, config.EDUTypeFilter{})
 
 	return db, fc, queues, processContext, close
 }
@@ -145,6 +156,182 @@ func TestSendPDUOnSuccessRemovedFromDB(t *testing.T) {
 	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
 }
 
+func TestTransactionIDsSurviveRestart(t *testing.T) {
+	t.Parallel()
+	for name, realDatabase := range map[string]bool{"memory": false, "postgres": true} {
+		realDatabase := realDatabase
+		t.Run(name, func(t *testing.T) {
+			failuresUntilBlacklist := uint32(16)
+			destination := spec.ServerName("remotehost")
+			db, fc, queues, pc, close := testSetup(failuresUntilBlacklist, true, t, test.DBTypePostgres, realDatabase)
+			defer close()
+			defer func() {
+				pc.ShutdownDendrite()
+				<-pc.WaitForShutdown()
+			}()
+
+			waitForTransactions := func(count uint32) {
+				poll.WaitOn(t, func(log poll.LogT) poll.Result {
+					if fc.txCount.Load() == count {
+						return poll.Success()
+					}
+					return poll.Continue("waiting for %d transactions, currently %d", count, fc.txCount.Load())
+				}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+			}
+			for i := uint32(1); i <= 2; i++ {
+				assert.NoError(t, queues.SendEDU(mustCreateEDU(t), "localhost", []spec.ServerName{destination}))
+				waitForTransactions(i)
+			}
+
+			// New queues using the same database continue counting where the old
+			// ones stopped.
+			stats := statistics.NewStatistics(db, failuresUntilBlacklist)
+			restarted := NewOutgoingQueues(db, pc, false, "localhost", fc, &stats, []*fclient.SigningIdentity{
+				{
+					KeyID:      "ed21019:auto",
+					PrivateKey: test.PrivateKeyA,
+					ServerName: "localhost",
+				},
+			}, 0, config.EDUTypeFilter{})
+			assert.NoError(t, restarted.SendEDU(mustCreateEDU(t), "localhost", []spec.ServerName{destination}))
+			waitForTransactions(3)
+
+			fc.txnIDsMutex.Lock()
+			defer fc.txnIDsMutex.Unlock()
+			assert.Equal(t, []string{"1", "2", "3"}, transactionCounters(t, fc.txnIDs))
+		})
+	}
+}
+
+// transactionCounters checks that the transaction IDs all have the same
+// prefix and returns the counters after it.
+func transactionCounters(t *testing.T, transactionIDs []gomatrixserverlib.TransactionID) []string {
+	t.Helper()
+	counters := make([]string, 0, len(transactionIDs))
+	for _, transactionID := range transactionIDs {
+		prefix, counter, ok := strings.Cut(string(transactionID), "-")
+		assert.True(t, ok, "transaction ID %q has no prefix", transactionID)
+		assert.NotEmpty(t, prefix)
+		firstPrefix, _, _ := strings.Cut(string(transactionIDs[0]), "-")
+		assert.Equal(t, firstPrefix, prefix)
+		counters = append(counters, counter)
+	}
+	return counters
+}
+
+func TestInFlightTransactionRetriedAfterRestart(t *testing.T) {
+	t.Parallel()
+	for name, realDatabase := range map[string]bool{"memory": false, "postgres": true} {
+		realDatabase := realDatabase
+		t.Run(name, func(t *testing.T) {
+			failuresUntilBlacklist := uint32(16)
+			destination := spec.ServerName("remotehost")
+			db, fc, queues, pc, close := testSetup(failuresUntilBlacklist, false, t, test.DBTypePostgres, realDatabase)
+			defer close()
+			defer func() {
+				pc.ShutdownDendrite()
+				<-pc.WaitForShutdown()
+			}()
+
+			// The first transaction fails, and another EDU is queued while
+			// backing off.
+			assert.NoError(t, queues.SendEDU(mustCreateEDU(t), "localhost", []spec.ServerName{destination}))
+			poll.WaitOn(t, func(log poll.LogT) poll.Result {
+				if fc.txCount.Load() == 1 {
+					return poll.Success()
+				}
+				return poll.Continue("waiting for the first transaction, currently %d", fc.txCount.Load())
+			}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+			assert.NoError(t, queues.SendEDU(mustCreateEDU(t), "localhost", []spec.ServerName{destination}))
+			queues.getQueue(destination).stop()
+
+			// After restarting, the failed transaction is retried with the same
+			// ID and contents before the other EDUs are sent.
+			restartedFC := &stubFederationClient{shouldTxSucceed: true}
+			stats := statistics.NewStatistics(db, failuresUntilBlacklist)
+			restarted := NewOutgoingQueues(db, pc, false, "localhost", restartedFC, &stats, []*fclient.SigningIdentity{
+				{
+					KeyID:      "ed21019:auto",
+					PrivateKey: test.PrivateKeyA,
+					ServerName: "localhost",
+				},
+			}, 0, config.EDUTypeFilter{})
+			assert.NoError(t, restarted.SendEDU(mustCreateEDU(t), "localhost", []spec.ServerName{destination}))
+			poll.WaitOn(t, func(log poll.LogT) poll.Result {
+				if restartedFC.txCount.Load() == 2 {
+					return poll.Success()
+				}
+				return poll.Continue("waiting for 2 transactions, currently %d", restartedFC.txCount.Load())
+			}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+
+			restartedFC.txnIDsMutex.Lock()
+			defer restartedFC.txnIDsMutex.Unlock()
+			assert.Equal(t, []string{"1", "2"}, transactionCounters(t, restartedFC.txnIDs))
+			assert.Equal(t, []int{1, 2}, restartedFC.txnEDUCounts)
+		})
+	}
+}
+
+func TestReceiptsWaitForReceiptWindow(t *testing.T) {
+	t.Parallel()
+	failuresUntilBlacklist := uint32(16)
+	destination := spec.ServerName("remotehost")
+	_, fc, queues, pc, close := testSetup(failuresUntilBlacklist, true, t, test.DBTypePostgres, false)
+	defer close()
+	defer func() {
+		pc.ShutdownDendrite()
+		<-pc.WaitForShutdown()
+	}()
+	queues.receiptWindow = 200 * time.Millisecond
+
+	for _, userID := range []string{"@alice:localhost", "@bob:localhost"} {
+		edu := &gomatrixserverlib.EDU{
+			Type:    spec.MReceipt,
+			Origin:  "localhost",
+			Content: []byte(`{"!room:localhost":{"m.read":{"` + userID + `":{"data":{"ts":1},"event_ids":["$a"]}}}}`),
+		}
+		assert.NoError(t, queues.SendEDU(edu, "localhost", []spec.ServerName{destination}))
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, uint32(0), fc.txCount.Load(), "receipts should wait for the receipt window")
+
+	poll.WaitOn(t, func(log poll.LogT) poll.Result {
+		if fc.txCount.Load() == 1 {
+			return poll.Success()
+		}
+		return poll.Continue("waiting for receipts to be sent, currently %d transactions", fc.txCount.Load())
+	}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+
+	fc.txnIDsMutex.Lock()
+	defer fc.txnIDsMutex.Unlock()
+	assert.Len(t, fc.lastEDUs, 1, "receipts should be combined into one EDU")
+}
+
+func TestBatchReceiptEDUs(t *testing.T) {
+	receipt := func(origin, content string) gomatrixserverlib.EDU {
+		return gomatrixserverlib.EDU{Type: spec.MReceipt, Origin: origin, Content: []byte(content)}
+	}
+	edus := []gomatrixserverlib.EDU{
+		receipt("localhost", `{"!a:x":{"m.read":{"@alice:localhost":{"data":{"ts":1},"event_ids":["$1"]}}}}`),
+		*mustCreateEDU(t),
+		receipt("localhost", `{"!a:x":{"m.read":{"@alice:localhost":{"data":{"ts":2},"event_ids":["$2"]}}}}`),
+		receipt("localhost", `{"!b:x":{"m.read":{"@bob:localhost":{"data":{"ts":3},"event_ids":["$3"]}}}}`),
+		receipt("other", `{"!a:x":{"m.read":{"@charlie:other":{"data":{"ts":4},"event_ids":["$4"]}}}}`),
+	}
+
+	batched := batchReceiptEDUs(edus)
+	assert.Len(t, batched, 3)
+	assert.Equal(t, spec.MTyping, batched[1].Type)
+	assert.JSONEq(t, `{
+		"!a:x":{"m.read":{"@alice:localhost":{"data":{"ts":2},"event_ids":["$2"]}}},
+		"!b:x":{"m.read":{"@bob:localhost":{"data":{"ts":3},"event_ids":["$3"]}}}
+	}`, string(batched[0].Content))
+	assert.Equal(t, edus[4].Content, batched[2].Content)
+
+	// The queued EDUs themselves must not have been modified.
+	assert.JSONEq(t, `{"!a:x":{"m.read":{"@alice:localhost":{"data":{"ts":1},"event_ids":["$1"]}}}}`, string(edus[0].Content))
+}
+
 func TestSendEDUOnSuccessRemovedFromDB(t *testing.T) {
 	t.Parallel()
 	failuresUntilBlacklist := uint32(16)
@@ -204,6 +391,96 @@ func TestSendPDUOnFailStoredInDB(t *testing.T) {
 	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
 }
 
+func TestDropQueue(t *testing.T) {
+	t.Parallel()
+	failuresUntilBlacklist := uint32(16)
+	destination := spec.ServerName("remotehost")
+	db, fc, queues, pc, close := testSetup(failuresUntilBlacklist, false, t, test.DBTypePostgres, false)
+	defer close()
+	defer func() {
+		pc.ShutdownDendrite()
+		<-pc.WaitForShutdown()
+	}()
+
+	assert.NoError(t, queues.SendEvent(mustCreatePDU(t), "localhost", []spec.ServerName{destination}))
+	assert.NoError(t, queues.SendEDU(mustCreateEDU(t), "localhost", []spec.ServerName{destination}))
+
+	check := func(log poll.LogT) poll.Result {
+		if _, backingOff := queues.QueueState(destination); backingOff {
+			return poll.Success()
+		}
+		return poll.Continue("waiting for the queue to back off. Currently %d send attempts", fc.txCount.Load())
+	}
+	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
+
+	pdus, edus, _, err := db.GetPendingSummary(pc.Context(), destination)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), pdus)
+	assert.Equal(t, int64(1), edus)
+
+	assert.NoError(t, queues.DropQueue(pc.Context(), destination))
+	pdus, edus, _, err = db.GetPendingSummary(pc.Context(), destination)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pdus)
+	assert.Equal(t, int64(0), edus)
+	running, backingOff := queues.QueueState(destination)
+	assert.False(t, running)
+	assert.False(t, backingOff)
+}
+
+// blockingFederationClient holds on to transactions until they are given up on.
+type blockingFederationClient struct {
+	fclient.FederationClient
+	sending chan struct{}
+}
+
+func (f *blockingFederationClient) SendTransaction(ctx context.Context, t gomatrixserverlib.Transaction) (res fclient.RespSend, err error) {
+	f.sending <- struct{}{}
+	<-ctx.Done()
+	return fclient.RespSend{}, ctx.Err()
+}
+
+func TestDropQueueStopsSending(t *testing.T) {
+	t.Parallel()
+	failuresUntilBlacklist := uint32(16)
+	destination := spec.ServerName("remotehost")
+	db, _, queues, pc, close := testSetup(failuresUntilBlacklist, false, t, test.DBTypePostgres, false)
+	defer close()
+	defer func() {
+		pc.ShutdownDendrite()
+		<-pc.WaitForShutdown()
+	}()
+	fc := &blockingFederationClient{sending: make(chan struct{}, 1)}
+	queues.client = fc
+
+	assert.NoError(t, queues.SendEvent(mustCreatePDU(t), "localhost", []spec.ServerName{destination}))
+	select {
+	case <-fc.sending:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the transaction to be sent")
+	}
+	oq := queues.getQueue(destination)
+
+	// Dropping the queue gives up on the transaction in flight, and waits for
+	// the worker to stop before dropping what was pending.
+	assert.NoError(t, queues.DropQueue(pc.Context(), destination))
+	assert.False(t, oq.running.Load())
+	assert.False(t, oq.backingOff.Load())
+	assert.Equal(t, uint32(0), oq.statistics.BackoffCount())
+	pdus, edus, _, err := db.GetPendingSummary(pc.Context(), destination)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pdus)
+	assert.Equal(t, int64(0), edus)
+
+	// The dropped queue doesn't start again.
+	oq.wakeQueueAndNotify()
+	select {
+	case <-fc.sending:
+		t.Fatal("expected the dropped queue not to send anything")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
 func TestSendEDUOnFailStoredInDB(t *testing.T) {
 	t.Parallel()
 	failuresUntilBlacklist := uint32(16)
@@ -814,3 +1091,59 @@ func TestQueueInteractsWithRealDatabasePDUAndEDU(t *testing.T) {
 		poll.WaitOn(t, checkRetry, poll.WithTimeout(10*time.Second), poll.WithDelay(100*time.Millisecond))
 	})
 }
+
+func TestBatchToDeviceEDUs(t *testing.T) {
+	toDevice := func(sender, messageID, userID, deviceID, content string) gomatrixserverlib.EDU {
+		j, err := json.Marshal(gomatrixserverlib.ToDeviceMessage{
+			Sender:    sender,
+			Type:      "m.room_key_request",
+			MessageID: messageID,
+			Messages: map[string]map[string]json.RawMessage{
+				userID: {deviceID: json.RawMessage(content)},
+			},
+		})
+		assert.NoError(t, err)
+		return gomatrixserverlib.EDU{Type: spec.MDirectToDevice, Origin: "localhost", Content: j}
+	}
+
+	edus := []gomatrixserverlib.EDU{
+		toDevice("@alice:localhost", "abc", "@bob:remotehost", "BOB1", `{"n":1}`),
+		*mustCreateEDU(t),
+		toDevice("@alice:localhost", "abc", "@bob:remotehost", "BOB2", `{"n":2}`),
+		toDevice("@alice:localhost", "abc", "@bob:remotehost", "BOB1", `{"n":1}`),
+		toDevice("@alice:localhost", "def", "@bob:remotehost", "BOB1", `{"n":3}`),
+		toDevice("@charlie:localhost", "abc", "@bob:remotehost", "BOB1", `{"n":4}`),
+	}
+
+	batched := batchToDeviceEDUs(edus, "1")
+	assert.Len(t, batched, 4)
+	assert.Equal(t, spec.MTyping, batched[1].Type)
+
+	var tdm gomatrixserverlib.ToDeviceMessage
+	assert.NoError(t, json.Unmarshal(batched[0].Content, &tdm))
+	assert.Equal(t, "abc-1", tdm.MessageID)
+	assert.Equal(t, map[string]map[string]json.RawMessage{
+		"@bob:remotehost": {
+			"BOB1": json.RawMessage(`{"n":1}`),
+			"BOB2": json.RawMessage(`{"n":2}`),
+		},
+	}, tdm.Messages)
+
+	// The queued EDUs themselves must not have been modified.
+	var original gomatrixserverlib.ToDeviceMessage
+	assert.NoError(t, json.Unmarshal(edus[0].Content, &original))
+	assert.Len(t, original.Messages["@bob:remotehost"], 1)
+
+	// A message which is split across transactions must have a different
+	// message ID in each, or the remote server will drop all but the first.
+	first := batchToDeviceEDUs(edus[:1], "1")
+	second := batchToDeviceEDUs(edus[2:3], "2")
+	var firstTDM, secondTDM gomatrixserverlib.ToDeviceMessage
+	assert.NoError(t, json.Unmarshal(first[0].Content, &firstTDM))
+	assert.NoError(t, json.Unmarshal(second[0].Content, &secondTDM))
+	assert.NotEqual(t, firstTDM.MessageID, secondTDM.MessageID)
+
+	// Retrying the same transaction uses the same message ID.
+	retried := batchToDeviceEDUs(edus[:1], "1")
+	assert.Equal(t, first[0].Content, retried[0].Content)
+}
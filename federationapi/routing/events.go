@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"time"
 
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -32,6 +33,7 @@ func GetEvent(
 	ctx context.Context,
 	request *fclient.FederationRequest,
 	rsAPI api.FederationRoomserverAPI,
+	fsAPI federationAPI.ClientFederationAPI,
 	eventID string,
 	origin spec.ServerName,
 ) util.JSONResponse {
@@ -42,6 +44,12 @@ func GetEvent(
 		return *err
 	}
 
+	// The room isn't known until the event has been fetched, so it can only
+	// be checked here rather than when routing the request.
+	if err = errorIfRoomFederationDisabled(ctx, fsAPI, event.RoomID().String()); err != nil {
+		return *err
+	}
+
 	err = allowedToSeeEvent(ctx, request.Origin(), rsAPI, eventID, event.RoomID().String())
 	if err != nil {
 		return *err
@@ -0,0 +1,29 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/test"
+)
+
+func TestGetEventFederationDisabled(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	eventID := room.Events()[0].EventID()
+	fedReq := fclient.NewFederationRequest(http.MethodGet, "remote", "test", "/event/"+eventID)
+	rsAPI := &stateRoomserverAPI{room: room}
+
+	fsAPI := &disabledRoomsFederationAPI{}
+	if res := GetEvent(context.Background(), &fedReq, rsAPI, fsAPI, eventID, "test"); res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+
+	// Events in rooms with federation disabled can't be fetched by ID.
+	fsAPI.disabled = map[string]struct{}{room.ID: {}}
+	if res := GetEvent(context.Background(), &fedReq, rsAPI, fsAPI, eventID, "test"); res.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, want %d: %+v", res.Code, http.StatusForbidden, res.JSON)
+	}
+}
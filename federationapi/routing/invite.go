@@ -83,12 +83,13 @@ func InviteV2(
 			}
 		}
 
+		keyID, privateKey := cfg.Matrix.SigningKey()
 		input := gomatrixserverlib.HandleInviteInput{
 			RoomVersion:       inviteReq.RoomVersion(),
 			RoomID:            roomID,
 			InvitedUser:       *invitedUser,
-			KeyID:             cfg.Matrix.KeyID,
-			PrivateKey:        cfg.Matrix.PrivateKey,
+			KeyID:             keyID,
+			PrivateKey:        privateKey,
 			Verifier:          keys,
 			RoomQuerier:       rsAPI,
 			MembershipQuerier: &api.MembershipQuerier{Roomserver: rsAPI},
@@ -176,12 +177,13 @@ func InviteV1(
 		}
 	}
 
+	keyID, privateKey := cfg.Matrix.SigningKey()
 	input := gomatrixserverlib.HandleInviteInput{
 		RoomVersion:       roomVer,
 		RoomID:            roomID,
 		InvitedUser:       *invitedUser,
-		KeyID:             cfg.Matrix.KeyID,
-		PrivateKey:        cfg.Matrix.PrivateKey,
+		KeyID:             keyID,
+		PrivateKey:        privateKey,
 		Verifier:          keys,
 		RoomQuerier:       rsAPI,
 		MembershipQuerier: &api.MembershipQuerier{Roomserver: rsAPI},
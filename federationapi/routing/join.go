@@ -27,6 +27,7 @@ import (
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/sirupsen/logrus"
 
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/roomserver/types"
@@ -39,9 +40,14 @@ func MakeJoin(
 	request *fclient.FederationRequest,
 	cfg *config.FederationAPI,
 	rsAPI api.FederationRoomserverAPI,
+	fsAPI federationAPI.ClientFederationAPI,
 	roomID spec.RoomID, userID spec.UserID,
 	remoteVersions []gomatrixserverlib.RoomVersion,
 ) util.JSONResponse {
+	if err := fsAPI.CheckInboundMembership(httpReq.Context(), roomID, userID, spec.Join); err != nil {
+		return membershipFloodResponse(err)
+	}
+
 	roomVersion, err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), roomID.String())
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("failed obtaining room version")
@@ -195,6 +201,7 @@ func SendJoin(
 	request *fclient.FederationRequest,
 	cfg *config.FederationAPI,
 	rsAPI api.FederationRoomserverAPI,
+	fsAPI federationAPI.ClientFederationAPI,
 	keys gomatrixserverlib.JSONVerifier,
 	roomID spec.RoomID,
 	eventID string,
@@ -208,6 +215,7 @@ func SendJoin(
 		}
 	}
 
+	keyID, privateKey := cfg.Matrix.SigningKey()
 	input := gomatrixserverlib.HandleSendJoinInput{
 		Context:           httpReq.Context(),
 		RoomID:            roomID,
@@ -216,8 +224,8 @@ func SendJoin(
 		RoomVersion:       roomVersion,
 		RequestOrigin:     request.Origin(),
 		LocalServerName:   cfg.Matrix.ServerName,
-		KeyID:             cfg.Matrix.KeyID,
-		PrivateKey:        cfg.Matrix.PrivateKey,
+		KeyID:             keyID,
+		PrivateKey:        privateKey,
 		Verifier:          keys,
 		MembershipQuerier: &api.MembershipQuerier{Roomserver: rsAPI},
 		UserIDQuerier: func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
@@ -274,6 +282,19 @@ func SendJoin(
 		}
 
 	}
+	if !response.AlreadyJoined {
+		userID, userErr := rsAPI.QueryUserIDForSender(httpReq.Context(), roomID, response.JoinEvent.SenderID())
+		if userErr != nil || userID == nil {
+			util.GetLogger(httpReq.Context()).WithError(userErr).Error("rsAPI.QueryUserIDForSender failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if err = fsAPI.RecordInboundMembership(httpReq.Context(), roomID, *userID, spec.Join); err != nil {
+			return membershipFloodResponse(err)
+		}
+	}
 
 	// Fetch the state and auth chain. We do this before we send the events
 	// on, in case this fails.
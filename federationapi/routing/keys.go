@@ -153,16 +153,16 @@ func localKeys(cfg *config.FederationAPI, serverName spec.ServerName) (*gomatrix
 		if identity, err = cfg.Matrix.SigningIdentityFor(cfg.Matrix.ServerName); err != nil {
 			return nil, err
 		}
-		publicKey := cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey)
+		publicKey := identity.PrivateKey.Public().(ed25519.PublicKey)
 		keys.ServerName = cfg.Matrix.ServerName
 		keys.ValidUntilTS = spec.AsTimestamp(time.Now().Add(cfg.Matrix.KeyValidityPeriod))
 		keys.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
-			cfg.Matrix.KeyID: {
+			identity.KeyID: {
 				Key: spec.Base64Bytes(publicKey),
 			},
 		}
 		keys.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
-		for _, oldVerifyKey := range cfg.Matrix.OldVerifyKeys {
+		for _, oldVerifyKey := range cfg.Matrix.CurrentOldVerifyKeys() {
 			keys.OldVerifyKeys[oldVerifyKey.KeyID] = gomatrixserverlib.OldVerifyKey{
 				VerifyKey: gomatrixserverlib.VerifyKey{
 					Key: oldVerifyKey.PublicKey,
@@ -174,11 +174,11 @@ func localKeys(cfg *config.FederationAPI, serverName spec.ServerName) (*gomatrix
 		if identity, err = cfg.Matrix.SigningIdentityFor(virtualHost.ServerName); err != nil {
 			return nil, err
 		}
-		publicKey := virtualHost.PrivateKey.Public().(ed25519.PublicKey)
+		publicKey := identity.PrivateKey.Public().(ed25519.PublicKey)
 		keys.ServerName = virtualHost.ServerName
 		keys.ValidUntilTS = spec.AsTimestamp(time.Now().Add(virtualHost.KeyValidityPeriod))
 		keys.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
-			virtualHost.KeyID: {
+			identity.KeyID: {
 				Key: spec.Base64Bytes(publicKey),
 			},
 		}
@@ -258,8 +258,9 @@ func NotaryKeys(
 				}
 			}
 
+			keyID, privateKey := cfg.Matrix.SigningKey()
 			js, err := gomatrixserverlib.SignJSON(
-				string(cfg.Matrix.ServerName), cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, j,
+				string(cfg.Matrix.ServerName), keyID, privateKey, j,
 			)
 			if err != nil {
 				logrus.WithError(err).Errorf("Failed to sign %q response", serverName)
@@ -17,6 +17,7 @@ import (
 	"net/http"
 	"time"
 
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
@@ -34,8 +35,13 @@ func MakeLeave(
 	request *fclient.FederationRequest,
 	cfg *config.FederationAPI,
 	rsAPI api.FederationRoomserverAPI,
+	fsAPI federationAPI.ClientFederationAPI,
 	roomID spec.RoomID, userID spec.UserID,
 ) util.JSONResponse {
+	if err := fsAPI.CheckInboundMembership(httpReq.Context(), roomID, userID, spec.Leave); err != nil {
+		return membershipFloodResponse(err)
+	}
+
 	roomVersion, err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), roomID.String())
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("failed obtaining room version")
@@ -95,7 +101,7 @@ func MakeLeave(
 			JSON: spec.InternalServerError{},
 		}
 	} else if senderID == nil {
-		util.GetLogger(httpReq.Context()).WithField("roomID", roomID).WithField("userID", userID).Error("rsAPI.QuerySenderIDForUser returned nil sender ID")
+		util.GetLogger(httpReq.Context()).WithField("room_id", roomID).WithField("user_id", userID).Error("rsAPI.QuerySenderIDForUser returned nil sender ID")
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
 			JSON: spec.InternalServerError{},
@@ -173,6 +179,7 @@ func SendLeave(
 	request *fclient.FederationRequest,
 	cfg *config.FederationAPI,
 	rsAPI api.FederationRoomserverAPI,
+	fsAPI federationAPI.ClientFederationAPI,
 	keys gomatrixserverlib.JSONVerifier,
 	roomID, eventID string,
 ) util.JSONResponse {
@@ -345,6 +352,9 @@ func SendLeave(
 			JSON: spec.BadJSON("The membership in the event content must be set to leave"),
 		}
 	}
+	if err = fsAPI.RecordInboundMembership(httpReq.Context(), event.RoomID(), *sender, spec.Leave); err != nil {
+		return membershipFloodResponse(err)
+	}
 
 	// Send the events to the room server.
 	// We are responsible for notifying other servers that the user has left
@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
@@ -12,9 +15,70 @@ import (
 	"github.com/neilalexander/harmony/internal/util"
 
 	"github.com/neilalexander/harmony/clientapi/httputil"
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
 	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
 )
 
+// searchablePublicRoomsDuration is how long the filled in public rooms are
+// kept for searching. Searches don't need to be authenticated, so without
+// this any server could make us fill in every published room over and over.
+const searchablePublicRoomsDuration = time.Minute
+
+// searchablePublicRooms caches the filled in public rooms for each network,
+// sorted by the number of joined members.
+var searchablePublicRooms = searchablePublicRoomsCache{
+	entries: map[string]searchablePublicRoomsEntry{},
+}
+
+type searchablePublicRoomsCache struct {
+	mu      sync.Mutex
+	entries map[string]searchablePublicRoomsEntry
+}
+
+type searchablePublicRoomsEntry struct {
+	rooms   []fclient.PublicRoom
+	expires time.Time
+}
+
+// get returns the given published rooms of the network, filling them in if
+// they aren't cached or have expired. The lock is held while filling them in,
+// so that searches which arrive at the same time only do so once. Rooms which
+// have been unpublished since are left out straight away, but rooms which
+// have been published since only appear once the cache expires.
+func (c *searchablePublicRoomsCache) get(
+	ctx context.Context, roomIDs []string, networkID string, rsAPI roomserverAPI.FederationRoomserverAPI,
+) ([]fclient.PublicRoom, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[networkID]
+	if !ok || !time.Now().Before(entry.expires) {
+		rooms, err := fillInRooms(ctx, roomIDs, rsAPI)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(rooms, func(i, j int) bool {
+			return rooms[i].JoinedMembersCount > rooms[j].JoinedMembersCount
+		})
+		entry = searchablePublicRoomsEntry{
+			rooms:   rooms,
+			expires: time.Now().Add(searchablePublicRoomsDuration),
+		}
+		c.entries[networkID] = entry
+	}
+	published := make(map[string]struct{}, len(roomIDs))
+	for _, roomID := range roomIDs {
+		published[roomID] = struct{}{}
+	}
+	rooms := make([]fclient.PublicRoom, 0, len(entry.rooms))
+	for _, room := range entry.rooms {
+		if _, ok := published[room.RoomID]; ok {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms, nil
+}
+
 type PublicRoomReq struct {
 	Since              string `json:"since,omitempty"`
 	Limit              int16  `json:"limit,omitempty"`
@@ -29,7 +93,16 @@ type filter struct {
 }
 
 // GetPostPublicRooms implements GET and POST /publicRooms
-func GetPostPublicRooms(req *http.Request, rsAPI roomserverAPI.FederationRoomserverAPI) util.JSONResponse {
+func GetPostPublicRooms(
+	req *http.Request, rsAPI roomserverAPI.FederationRoomserverAPI,
+	fsAPI federationAPI.ClientFederationAPI, cfg *config.FederationAPI,
+) util.JSONResponse {
+	if !cfg.IsPublicRoomsOverFederationAllowed() {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("This server does not list its public rooms over federation"),
+		}
+	}
 	var request PublicRoomReq
 	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
 		return *fillErr
@@ -37,7 +110,7 @@ func GetPostPublicRooms(req *http.Request, rsAPI roomserverAPI.FederationRoomser
 	if request.Limit == 0 {
 		request.Limit = 50
 	}
-	response, err := publicRooms(req.Context(), request, rsAPI)
+	response, err := publicRooms(req.Context(), request, rsAPI, fsAPI)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -52,6 +125,7 @@ func GetPostPublicRooms(req *http.Request, rsAPI roomserverAPI.FederationRoomser
 
 func publicRooms(
 	ctx context.Context, request PublicRoomReq, rsAPI roomserverAPI.FederationRoomserverAPI,
+	fsAPI federationAPI.ClientFederationAPI,
 ) (*fclient.RespPublicRooms, error) {
 
 	var response fclient.RespPublicRooms
@@ -78,7 +152,26 @@ func publicRooms(
 		util.GetLogger(ctx).WithError(err).Error("QueryPublishedRooms failed")
 		return nil, err
 	}
-	response.TotalRoomCountEstimate = len(queryRes.RoomIDs)
+	// Rooms which have federation disabled are never listed to other servers,
+	// even if they are published.
+	if queryRes.RoomIDs, err = fsAPI.QueryFederatedRooms(ctx, queryRes.RoomIDs); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("QueryFederatedRooms failed")
+		return nil, err
+	}
+
+	// Searching needs every room to be filled in, rather than only the page
+	// which is being returned, so the filled in rooms are cached.
+	var matching []fclient.PublicRoom
+	if request.Filter.SearchTerms != "" {
+		rooms, err := searchablePublicRooms.get(ctx, queryRes.RoomIDs, request.NetworkID, rsAPI)
+		if err != nil {
+			return nil, err
+		}
+		matching = roomserverAPI.FilterPublicRooms(rooms, request.Filter.SearchTerms, nil)
+		response.TotalRoomCountEstimate = len(matching)
+	} else {
+		response.TotalRoomCountEstimate = len(queryRes.RoomIDs)
+	}
 
 	if offset > 0 {
 		response.PrevBatch = strconv.Itoa(int(offset) - 1)
@@ -91,8 +184,15 @@ func publicRooms(
 	if offset < 0 {
 		offset = 0
 	}
-	if nextIndex > len(queryRes.RoomIDs) {
-		nextIndex = len(queryRes.RoomIDs)
+	if nextIndex > response.TotalRoomCountEstimate {
+		nextIndex = response.TotalRoomCountEstimate
+	}
+	if int(offset) > nextIndex {
+		offset = int64(nextIndex)
+	}
+	if matching != nil {
+		response.Chunk = matching[offset:nextIndex]
+		return &response, nil
 	}
 	roomIDs := queryRes.RoomIDs[offset:nextIndex]
 	response.Chunk, err = fillInRooms(ctx, roomIDs, rsAPI)
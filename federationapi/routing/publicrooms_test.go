@@ -0,0 +1,149 @@
+package routing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/api"
+)
+
+// publicRoomsRoomserverAPI publishes the rooms with the given names, and
+// counts how many times it is asked for their state.
+type publicRoomsRoomserverAPI struct {
+	api.FederationRoomserverAPI
+	names        map[string]string
+	stateQueries int
+}
+
+func (r *publicRoomsRoomserverAPI) QueryPublishedRooms(
+	ctx context.Context, req *api.QueryPublishedRoomsRequest, res *api.QueryPublishedRoomsResponse,
+) error {
+	for roomID := range r.names {
+		res.RoomIDs = append(res.RoomIDs, roomID)
+	}
+	return nil
+}
+
+func (r *publicRoomsRoomserverAPI) QueryBulkStateContent(
+	ctx context.Context, req *api.QueryBulkStateContentRequest, res *api.QueryBulkStateContentResponse,
+) error {
+	r.stateQueries++
+	res.Rooms = map[string]map[gomatrixserverlib.StateKeyTuple]string{}
+	for _, roomID := range req.RoomIDs {
+		res.Rooms[roomID] = map[gomatrixserverlib.StateKeyTuple]string{
+			{EventType: "m.room.name", StateKey: ""}:           r.names[roomID],
+			{EventType: spec.MRoomMember, StateKey: "@a:test"}: spec.Join,
+		}
+	}
+	return nil
+}
+
+// disabledRoomsFederationAPI has federation disabled for the given rooms.
+type disabledRoomsFederationAPI struct {
+	federationAPI.ClientFederationAPI
+	disabled map[string]struct{}
+}
+
+func (f *disabledRoomsFederationAPI) QueryRoomFederationDisabled(ctx context.Context, roomID string) (bool, error) {
+	_, disabled := f.disabled[roomID]
+	return disabled, nil
+}
+
+func (f *disabledRoomsFederationAPI) QueryFederatedRooms(ctx context.Context, roomIDs []string) ([]string, error) {
+	federated := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if _, disabled := f.disabled[roomID]; !disabled {
+			federated = append(federated, roomID)
+		}
+	}
+	return federated, nil
+}
+
+func TestPublicRoomsSearch(t *testing.T) {
+	searchablePublicRooms.entries = map[string]searchablePublicRoomsEntry{}
+	defer func() {
+		searchablePublicRooms.entries = map[string]searchablePublicRoomsEntry{}
+	}()
+
+	rsAPI := &publicRoomsRoomserverAPI{names: map[string]string{
+		"!a:test": "Matrix HQ",
+		"!b:test": "Matrix Dev",
+		"!c:test": "Something else",
+	}}
+	search := func(terms string) []string {
+		t.Helper()
+		res, err := publicRooms(context.Background(), PublicRoomReq{
+			Limit:  10,
+			Filter: filter{SearchTerms: terms},
+		}, rsAPI, &disabledRoomsFederationAPI{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		roomIDs := []string{}
+		for _, room := range res.Chunk {
+			roomIDs = append(roomIDs, room.RoomID)
+		}
+		return roomIDs
+	}
+
+	// The rooms are only filled in once for all of the searches.
+	if roomIDs := search("matrix"); len(roomIDs) != 2 {
+		t.Fatalf("got rooms %v, want 2", roomIDs)
+	}
+	if roomIDs := search("else"); len(roomIDs) != 1 || roomIDs[0] != "!c:test" {
+		t.Fatalf("got rooms %v, want [!c:test]", roomIDs)
+	}
+	if rsAPI.stateQueries != 1 {
+		t.Fatalf("got %d state queries, want 1", rsAPI.stateQueries)
+	}
+
+	// Unpublished rooms are left out straight away.
+	delete(rsAPI.names, "!c:test")
+	if roomIDs := search("else"); len(roomIDs) != 0 {
+		t.Fatalf("got rooms %v, want none", roomIDs)
+	}
+
+	// Once the cache expires, the rooms are filled in again.
+	entry := searchablePublicRooms.entries[""]
+	entry.expires = time.Now()
+	searchablePublicRooms.entries[""] = entry
+	rsAPI.names["!d:test"] = "New Matrix room"
+	if roomIDs := search("matrix"); len(roomIDs) != 3 {
+		t.Fatalf("got rooms %v, want 3", roomIDs)
+	}
+	if rsAPI.stateQueries != 2 {
+		t.Fatalf("got %d state queries, want 2", rsAPI.stateQueries)
+	}
+}
+
+func TestPublicRoomsFederationDisabled(t *testing.T) {
+	searchablePublicRooms.entries = map[string]searchablePublicRoomsEntry{}
+	defer func() {
+		searchablePublicRooms.entries = map[string]searchablePublicRoomsEntry{}
+	}()
+
+	rsAPI := &publicRoomsRoomserverAPI{names: map[string]string{
+		"!a:test": "Matrix HQ",
+		"!b:test": "Matrix Dev",
+	}}
+	fsAPI := &disabledRoomsFederationAPI{disabled: map[string]struct{}{"!b:test": {}}}
+
+	// Rooms with federation disabled are left out of both listing and
+	// searching, even though they are published.
+	for _, terms := range []string{"", "matrix"} {
+		res, err := publicRooms(context.Background(), PublicRoomReq{
+			Limit:  10,
+			Filter: filter{SearchTerms: terms},
+		}, rsAPI, fsAPI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Chunk) != 1 || res.Chunk[0].RoomID != "!a:test" || res.TotalRoomCountEstimate != 1 {
+			t.Fatalf("got rooms %+v for %q, want only !a:test", res.Chunk, terms)
+		}
+	}
+}
@@ -122,7 +122,10 @@ func RoomAliasToID(
 // Query the immediate children of a room/space
 //
 // Implements /_matrix/federation/v1/hierarchy/{roomID}
-func QueryRoomHierarchy(httpReq *http.Request, request *fclient.FederationRequest, roomIDStr string, rsAPI roomserverAPI.FederationRoomserverAPI) util.JSONResponse {
+func QueryRoomHierarchy(
+	httpReq *http.Request, request *fclient.FederationRequest, roomIDStr string,
+	rsAPI roomserverAPI.FederationRoomserverAPI, fsAPI federationAPI.ClientFederationAPI,
+) util.JSONResponse {
 	parsedRoomID, err := spec.NewRoomID(roomIDStr)
 	if err != nil {
 		return util.JSONResponse{
@@ -165,6 +168,34 @@ func QueryRoomHierarchy(httpReq *http.Request, request *fclient.FederationReques
 		}
 	}
 
+	// Child rooms which have federation disabled are left out, as other
+	// servers aren't allowed to know about them.
+	if len(discoveredRooms) > 1 {
+		childRoomIDs := make([]string, 0, len(discoveredRooms)-1)
+		for _, room := range discoveredRooms[1:] {
+			childRoomIDs = append(childRoomIDs, room.RoomID)
+		}
+		federated, err := fsAPI.QueryFederatedRooms(httpReq.Context(), childRoomIDs)
+		if err != nil {
+			util.GetLogger(httpReq.Context()).WithError(err).Error("QueryFederatedRooms failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		federatedRooms := make(map[string]struct{}, len(federated))
+		for _, roomID := range federated {
+			federatedRooms[roomID] = struct{}{}
+		}
+		rooms := []fclient.RoomHierarchyRoom{discoveredRooms[0]}
+		for _, room := range discoveredRooms[1:] {
+			if _, ok := federatedRooms[room.RoomID]; ok {
+				rooms = append(rooms, room)
+			}
+		}
+		discoveredRooms = rooms
+	}
+
 	if len(discoveredRooms) == 0 {
 		util.GetLogger(httpReq.Context()).Debugln("no rooms found when handling SS room hierarchy request")
 		return util.JSONResponse{
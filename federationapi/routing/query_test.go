@@ -0,0 +1,45 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/roomserver/api"
+)
+
+// hierarchyRoomserverAPI returns the given rooms as the first page of
+// every room hierarchy.
+type hierarchyRoomserverAPI struct {
+	api.FederationRoomserverAPI
+	rooms []fclient.RoomHierarchyRoom
+}
+
+func (r *hierarchyRoomserverAPI) QueryNextRoomHierarchyPage(ctx context.Context, walker api.RoomHierarchyWalker, limit int) ([]fclient.RoomHierarchyRoom, *api.RoomHierarchyWalker, error) {
+	return r.rooms, nil, nil
+}
+
+func TestQueryRoomHierarchyFederationDisabled(t *testing.T) {
+	rsAPI := &hierarchyRoomserverAPI{}
+	for _, roomID := range []string{"!space:test", "!a:test", "!b:test"} {
+		rsAPI.rooms = append(rsAPI.rooms, fclient.RoomHierarchyRoom{PublicRoom: fclient.PublicRoom{RoomID: roomID}})
+	}
+	fsAPI := &disabledRoomsFederationAPI{disabled: map[string]struct{}{"!b:test": {}}}
+	httpReq := httptest.NewRequest(http.MethodGet, "/hierarchy/!space:test", nil)
+	fedReq := fclient.NewFederationRequest(http.MethodGet, "remote", "test", "/hierarchy/!space:test")
+
+	res := QueryRoomHierarchy(httpReq, &fedReq, "!space:test", rsAPI, fsAPI)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	hierarchy := res.JSON.(fclient.RoomHierarchyResponse)
+	if hierarchy.Room.RoomID != "!space:test" {
+		t.Fatalf("got root room %q, want !space:test", hierarchy.Room.RoomID)
+	}
+	// Children with federation disabled are left out.
+	if len(hierarchy.Children) != 1 || hierarchy.Children[0].RoomID != "!a:test" {
+		t.Fatalf("got children %+v, want only !a:test", hierarchy.Children)
+	}
+}
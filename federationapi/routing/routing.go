@@ -17,15 +17,18 @@ package routing
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
 	fedInternal "github.com/neilalexander/harmony/federationapi/internal"
 	"github.com/neilalexander/harmony/federationapi/producers"
 	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -59,6 +62,7 @@ func Setup(
 	rsAPI roomserverAPI.FederationRoomserverAPI,
 	fsAPI *fedInternal.FederationInternalAPI,
 	keys gomatrixserverlib.JSONVerifier,
+	verifiedEvents caching.VerifiedEventCache,
 	federation fclient.FederationClient,
 	userAPI userapi.FederationUserAPI,
 	mscCfg *config.MSCs,
@@ -117,6 +121,7 @@ func Setup(
 				}{
 					ServerName: cfg.Matrix.WellKnownServerName,
 				},
+				Headers: httputil.CacheHeaders(cfg.Matrix.WellKnownCacheMaxAge),
 			}
 		}),
 		).Methods(http.MethodGet, http.MethodOptions)
@@ -133,12 +138,13 @@ func Setup(
 	v2keysmux.Handle("/query/{serverName}/{keyID}", notaryKeys).Methods(http.MethodGet)
 
 	mu := internal.NewMutexByRoom()
+	scheduler := fedInternal.NewTransactionScheduler(&cfg.TransactionScheduling)
 	v1fedmux.Handle("/send/{txnID}", MakeFedAPI(
 		"federation_send", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
-				cfg, rsAPI, userAPI, keys, federation, mu, producer,
+				cfg, rsAPI, fsAPI, userAPI, keys, verifiedEvents, federation, mu, scheduler, producer,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions).Name(SendRouteName)
@@ -152,6 +158,9 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 
 			roomID, err := spec.NewRoomID(vars["roomID"])
 			if err != nil {
@@ -176,6 +185,9 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 
 			roomID, err := spec.NewRoomID(vars["roomID"])
 			if err != nil {
@@ -191,11 +203,35 @@ func Setup(
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
 
+	v1fedmux.Handle("/exchange_third_party_invite/{roomID}", MakeFedAPI(
+		"exchange_third_party_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
+			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: spec.Forbidden("Forbidden by server ACLs"),
+				}
+			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
+			return ExchangeThirdPartyInvite(
+				httpReq, request, vars["roomID"], cfg, rsAPI, fsAPI,
+			)
+		},
+	)).Methods(http.MethodPut, http.MethodOptions)
+
+	v1fedmux.Handle("/3pid/onbind", httputil.MakeExternalAPI("3pid_onbind",
+		func(req *http.Request) util.JSONResponse {
+			return OnBindThirdPartyInvites(req, cfg, rsAPI, federation)
+		},
+	)).Methods(http.MethodPost, http.MethodOptions)
+
 	v1fedmux.Handle("/event/{eventID}", MakeFedAPI(
 		"federation_get_event", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return GetEvent(
-				httpReq.Context(), request, rsAPI, vars["eventID"], cfg.Matrix.ServerName,
+				httpReq.Context(), request, rsAPI, fsAPI, vars["eventID"], cfg.Matrix.ServerName,
 			)
 		},
 	)).Methods(http.MethodGet)
@@ -209,6 +245,9 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return GetState(
 				httpReq.Context(), request, rsAPI, vars["roomID"],
 			)
@@ -224,6 +263,9 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return GetStateIDs(
 				httpReq.Context(), request, rsAPI, vars["roomID"],
 			)
@@ -239,6 +281,9 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return GetEventAuth(
 				httpReq.Context(), request, rsAPI, vars["roomID"], vars["eventID"],
 			)
@@ -281,6 +326,9 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			queryVars := httpReq.URL.Query()
 			remoteVersions := []gomatrixserverlib.RoomVersion{}
 			if vers, ok := queryVars["ver"]; ok {
@@ -313,7 +361,7 @@ func Setup(
 
 			logrus.Debugf("Processing make_join for user %s, room %s", userID.String(), roomID.String())
 			return MakeJoin(
-				httpReq, request, cfg, rsAPI, *roomID, *userID, remoteVersions,
+				httpReq, request, cfg, rsAPI, fsAPI, *roomID, *userID, remoteVersions,
 			)
 		},
 	)).Methods(http.MethodGet)
@@ -327,6 +375,9 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			eventID := vars["eventID"]
 			roomID, err := spec.NewRoomID(vars["roomID"])
 			if err != nil {
@@ -337,7 +388,7 @@ func Setup(
 			}
 
 			res := SendJoin(
-				httpReq, request, cfg, rsAPI, keys, *roomID, eventID,
+				httpReq, request, cfg, rsAPI, fsAPI, keys, *roomID, eventID,
 			)
 			// not all responses get wrapped in [code, body]
 			var body interface{}
@@ -366,6 +417,9 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			eventID := vars["eventID"]
 			roomID, err := spec.NewRoomID(vars["roomID"])
 			if err != nil {
@@ -376,7 +430,7 @@ func Setup(
 			}
 
 			return SendJoin(
-				httpReq, request, cfg, rsAPI, keys, *roomID, eventID,
+				httpReq, request, cfg, rsAPI, fsAPI, keys, *roomID, eventID,
 			)
 		},
 	)).Methods(http.MethodPut)
@@ -390,6 +444,9 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			roomID, err := spec.NewRoomID(vars["roomID"])
 			if err != nil {
 				return util.JSONResponse{
@@ -405,7 +462,7 @@ func Setup(
 				}
 			}
 			return MakeLeave(
-				httpReq, request, cfg, rsAPI, *roomID, *userID,
+				httpReq, request, cfg, rsAPI, fsAPI, *roomID, *userID,
 			)
 		},
 	)).Methods(http.MethodGet)
@@ -419,10 +476,13 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			roomID := vars["roomID"]
 			eventID := vars["eventID"]
 			res := SendLeave(
-				httpReq, request, cfg, rsAPI, keys, roomID, eventID,
+				httpReq, request, cfg, rsAPI, fsAPI, keys, roomID, eventID,
 			)
 			// not all responses get wrapped in [code, body]
 			var body interface{}
@@ -451,10 +511,13 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			roomID := vars["roomID"]
 			eventID := vars["eventID"]
 			return SendLeave(
-				httpReq, request, cfg, rsAPI, keys, roomID, eventID,
+				httpReq, request, cfg, rsAPI, fsAPI, keys, roomID, eventID,
 			)
 		},
 	)).Methods(http.MethodPut)
@@ -475,6 +538,9 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return GetMissingEvents(httpReq, request, rsAPI, vars["roomID"])
 		},
 	)).Methods(http.MethodPost)
@@ -488,13 +554,16 @@ func Setup(
 					JSON: spec.Forbidden("Forbidden by server ACLs"),
 				}
 			}
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return Backfill(httpReq, request, rsAPI, vars["roomID"], cfg)
 		},
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/publicRooms",
 		httputil.MakeExternalAPI("federation_public_rooms", func(req *http.Request) util.JSONResponse {
-			return GetPostPublicRooms(req, rsAPI)
+			return GetPostPublicRooms(req, rsAPI, fsAPI, cfg)
 		}),
 	).Methods(http.MethodGet, http.MethodPost)
 
@@ -515,7 +584,10 @@ func Setup(
 	v1fedmux.Handle("/hierarchy/{roomID}", MakeFedAPI(
 		"federation_room_hierarchy", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
-			return QueryRoomHierarchy(httpReq, request, vars["roomID"], rsAPI)
+			if resErr := errorIfRoomFederationDisabled(httpReq.Context(), fsAPI, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
+			return QueryRoomHierarchy(httpReq, request, vars["roomID"], rsAPI, fsAPI)
 		},
 	)).Methods(http.MethodGet)
 }
@@ -544,6 +616,36 @@ func ErrorIfLocalServerNotInRoom(
 	return nil
 }
 
+// errorIfRoomFederationDisabled returns a 403 response if federation has been
+// disabled for the room, so that other servers can't take part in it.
+func errorIfRoomFederationDisabled(
+	ctx context.Context,
+	fsAPI federationAPI.ClientFederationAPI,
+	roomID string,
+) *util.JSONResponse {
+	if !federationAPI.IsRoomFederationDisabled(ctx, fsAPI, roomID) {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: spec.Forbidden("Federation is disabled for this room"),
+	}
+}
+
+// membershipFloodResponse returns the response for a join or leave which was
+// rejected by the join flood protection, or for a request from a server which
+// it is ignoring.
+func membershipFloodResponse(err error) util.JSONResponse {
+	var floodErr *federationAPI.MembershipFloodError
+	if !errors.As(err, &floodErr) {
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusTooManyRequests,
+		JSON: spec.LimitExceeded(floodErr.Error(), floodErr.RetryAfter.Milliseconds()),
+	}
+}
+
 // MakeFedAPI makes an http.Handler that checks matrix federation authentication.
 func MakeFedAPI(
 	metricsName string, serverName spec.ServerName,
@@ -559,6 +661,11 @@ func MakeFedAPI(
 		if fedReq == nil {
 			return errResp
 		}
+		// Servers which have been flooding us with joins and leaves are
+		// ignored for a while.
+		if err := wakeup.FsAPI.CheckOriginIgnored(fedReq.Origin()); err != nil {
+			return membershipFloodResponse(err)
+		}
 		go wakeup.Wakeup(req.Context(), fedReq.Origin())
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
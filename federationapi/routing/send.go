@@ -17,6 +17,7 @@ package routing
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"sync"
 	"time"
@@ -25,8 +26,11 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/util"
 
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
+	fedInternal "github.com/neilalexander/harmony/federationapi/internal"
 	"github.com/neilalexander/harmony/federationapi/producers"
 	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/setup/config"
@@ -50,7 +54,16 @@ const (
 	MetricsWorkMissingPrevEvents = "missing_prev_events"
 )
 
-var inFlightTxnsPerOrigin sync.Map // transaction ID -> chan util.JSONResponse
+var inFlightTxnsPerOrigin sync.Map // transaction ID -> *inFlightTxn
+
+// inFlightTxn is a transaction which is being processed. The result is
+// set before done is closed, so that everyone waiting for the transaction
+// can read it afterwards. If the result is nil once done is closed, the
+// transaction wasn't processed.
+type inFlightTxn struct {
+	done chan struct{}
+	res  *util.JSONResponse
+}
 
 // Send implements /_matrix/federation/v1/send/{txnID}
 func Send(
@@ -59,10 +72,13 @@ func Send(
 	txnID gomatrixserverlib.TransactionID,
 	cfg *config.FederationAPI,
 	rsAPI api.FederationRoomserverAPI,
+	fsAPI federationAPI.ClientFederationAPI,
 	keyAPI userAPI.FederationUserAPI,
 	keys gomatrixserverlib.JSONVerifier,
+	verifiedEvents caching.VerifiedEventCache,
 	federation fclient.FederationClient,
 	mu *internal.MutexByRoom,
+	scheduler *fedInternal.TransactionScheduler,
 	producer *producers.SyncAPIProducer,
 ) util.JSONResponse {
 	// First we should check if this origin has already submitted this
@@ -70,8 +86,8 @@ func Send(
 	// the transaction is still being worked on. The new client can wait
 	// for it to complete rather than creating more work.
 	index := string(request.Origin()) + "\000" + string(txnID)
-	v, ok := inFlightTxnsPerOrigin.LoadOrStore(index, make(chan util.JSONResponse, 1))
-	ch := v.(chan util.JSONResponse)
+	v, ok := inFlightTxnsPerOrigin.LoadOrStore(index, &inFlightTxn{done: make(chan struct{})})
+	txn := v.(*inFlightTxn)
 	if ok {
 		// This origin already submitted this txn ID to us, and the work
 		// is still taking place, so we'll just wait for it to finish.
@@ -81,19 +97,26 @@ func Send(
 		case <-ctx.Done():
 			// If the caller gives up then return straight away. We don't
 			// want to attempt to process what they sent us any further.
-			return util.JSONResponse{Code: http.StatusRequestTimeout}
-		case res := <-ch:
+			return util.JSONResponse{
+				Code: http.StatusTooManyRequests,
+				JSON: spec.LimitExceeded("The transaction is still being processed", time.Second.Milliseconds()),
+			}
+		case <-txn.done:
 			// The original task just finished processing so let's return
-			// the result of it.
-			if res.Code == 0 {
-				return util.JSONResponse{Code: http.StatusAccepted}
+			// the result of it. If it finished without a result then it
+			// wasn't processed, so the server needs to send it again.
+			if txn.res == nil {
+				return util.JSONResponse{
+					Code: http.StatusTooManyRequests,
+					JSON: spec.LimitExceeded("The transaction was not processed", time.Second.Milliseconds()),
+				}
 			}
-			return res
+			return *txn.res
 		}
 	}
 	// Otherwise, store that we're currently working on this txn from
 	// this origin. When we're done processing, close the channel.
-	defer close(ch)
+	defer close(txn.done)
 	defer inFlightTxnsPerOrigin.Delete(index)
 
 	var txnEvents struct {
@@ -116,11 +139,46 @@ func Send(
 		}
 	}
 
+	// Drop any EDUs of types which we have been configured not to process.
+	edus := txnEvents.EDUs[:0]
+	for _, edu := range txnEvents.EDUs {
+		if cfg.EDUTypes.Inbound.Allows(edu.Type) {
+			edus = append(edus, edu)
+		}
+	}
+	txnEvents.EDUs = edus
+
+	// Wait for a worker to process the transaction. The servers which have
+	// transactions waiting take turns, so that a busy server can't starve
+	// the others.
+	release, err := scheduler.Acquire(httpReq.Context(), request.Origin())
+	if err != nil {
+		// Either there are too many transactions waiting or the request
+		// ended before a worker became free, so ask the server to try
+		// again later.
+		msg := "Timed out waiting for the transaction to be processed"
+		if errors.Is(err, fedInternal.ErrTransactionQueueFull) {
+			msg = err.Error()
+		}
+		res := util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: spec.LimitExceeded(msg, time.Second.Milliseconds()),
+		}
+		// Anyone waiting for the same transaction must retry it too,
+		// rather than treating it as delivered.
+		txn.res = &res
+		return res
+	}
+	defer release()
+
 	t := internal.NewTxnReq(
 		rsAPI,
+		fsAPI,
 		keyAPI,
 		cfg.Matrix.ServerName,
 		keys,
+		verifiedEvents,
+		cfg.SignatureVerificationWorkers,
 		mu,
 		producer,
 		cfg.Matrix.Presence.EnableInbound,
@@ -146,6 +204,6 @@ func Send(
 		Code: http.StatusOK,
 		JSON: resp,
 	}
-	ch <- res
+	txn.res = &res
 	return res
 }
@@ -0,0 +1,79 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	fedInternal "github.com/neilalexander/harmony/federationapi/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func TestSendDuplicateTransactions(t *testing.T) {
+	cfg := &config.FederationAPI{}
+	cfg.TransactionScheduling.Defaults()
+	cfg.TransactionScheduling.Workers = 1
+	scheduler := fedInternal.NewTransactionScheduler(&cfg.TransactionScheduling)
+
+	// Keep the only worker busy, so that the transaction waits for it.
+	release, err := scheduler.Acquire(context.Background(), "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	send := func(ctx context.Context) util.JSONResponse {
+		fedReq := fclient.NewFederationRequest(http.MethodPut, "remote", "test", "/send/txn")
+		if err := fedReq.SetContent(map[string]interface{}{"pdus": []interface{}{}, "edus": []interface{}{}}); err != nil {
+			t.Fatal(err)
+		}
+		httpReq := httptest.NewRequest(http.MethodPut, "/send/txn", nil).WithContext(ctx)
+		return Send(httpReq, &fedReq, "txn", cfg, nil, nil, nil, nil, nil, nil, nil, scheduler, nil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	original := make(chan util.JSONResponse, 1)
+	go func() {
+		original <- send(ctx)
+	}()
+	for {
+		if _, ok := inFlightTxnsPerOrigin.Load("remote\000txn"); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Send the same transaction a few more times while the first one is
+	// still waiting.
+	var wg sync.WaitGroup
+	duplicates := make(chan util.JSONResponse, 3)
+	for i := 0; i < cap(duplicates); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			duplicates <- send(context.Background())
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Give up on the first one. Every duplicate gets the same answer as
+	// it, rather than being told that the transaction wasn't processed.
+	cancel()
+	want := <-original
+	if want.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", want.Code, http.StatusTooManyRequests)
+	}
+	wg.Wait()
+	close(duplicates)
+	for res := range duplicates {
+		if res.Code != want.Code || res.JSON.(spec.LimitExceededError).Err != want.JSON.(spec.LimitExceededError).Err {
+			t.Fatalf("got %d %+v, want %d %+v", res.Code, res.JSON, want.Code, want.JSON)
+		}
+	}
+}
@@ -36,14 +36,14 @@ func GetState(
 		return *err
 	}
 
-	stateEvents, authChain, err := getState(ctx, request, rsAPI, roomID, eventID)
+	response, err := getState(ctx, request, rsAPI, roomID, eventID, false)
 	if err != nil {
 		return *err
 	}
 
 	return util.JSONResponse{Code: http.StatusOK, JSON: &fclient.RespState{
-		AuthEvents:  types.NewEventJSONsFromHeaderedEvents(authChain),
-		StateEvents: types.NewEventJSONsFromHeaderedEvents(stateEvents),
+		AuthEvents:  types.NewEventJSONsFromHeaderedEvents(response.AuthChainEvents),
+		StateEvents: types.NewEventJSONsFromHeaderedEvents(response.StateEvents),
 	}}
 }
 
@@ -59,17 +59,16 @@ func GetStateIDs(
 		return *err
 	}
 
-	stateEvents, authEvents, err := getState(ctx, request, rsAPI, roomID, eventID)
+	// Only the event IDs are needed, so the roomserver doesn't need to load
+	// the events themselves.
+	response, err := getState(ctx, request, rsAPI, roomID, eventID, true)
 	if err != nil {
 		return *err
 	}
 
-	stateEventIDs := getIDsFromEvent(stateEvents)
-	authEventIDs := getIDsFromEvent(authEvents)
-
 	return util.JSONResponse{Code: http.StatusOK, JSON: fclient.RespStateIDs{
-		StateEventIDs: stateEventIDs,
-		AuthEventIDs:  authEventIDs,
+		StateEventIDs: response.StateEventIDs,
+		AuthEventIDs:  response.AuthChainEventIDs,
 	},
 	}
 }
@@ -101,24 +100,25 @@ func getState(
 	rsAPI api.FederationRoomserverAPI,
 	roomID string,
 	eventID string,
-) (stateEvents, authEvents []*types.HeaderedEvent, errRes *util.JSONResponse) {
+	onlyEventIDs bool,
+) (*api.QueryStateAndAuthChainResponse, *util.JSONResponse) {
 	// If we don't think we belong to this room then don't waste the effort
 	// responding to expensive requests for it.
 	if err := ErrorIfLocalServerNotInRoom(ctx, rsAPI, roomID); err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	event, resErr := fetchEvent(ctx, rsAPI, roomID, eventID)
 	if resErr != nil {
-		return nil, nil, resErr
+		return nil, resErr
 	}
 
 	if event.RoomID().String() != roomID {
-		return nil, nil, &util.JSONResponse{Code: http.StatusNotFound, JSON: spec.NotFound("event does not belong to this room")}
+		return nil, &util.JSONResponse{Code: http.StatusNotFound, JSON: spec.NotFound("event does not belong to this room")}
 	}
 	resErr = allowedToSeeEvent(ctx, request.Origin(), rsAPI, eventID, event.RoomID().String())
 	if resErr != nil {
-		return nil, nil, resErr
+		return nil, resErr
 	}
 
 	var response api.QueryStateAndAuthChainResponse
@@ -128,40 +128,32 @@ func getState(
 			RoomID:       roomID,
 			PrevEventIDs: []string{eventID},
 			AuthEventIDs: event.AuthEventIDs(),
+			OnlyEventIDs: onlyEventIDs,
 		},
 		&response,
 	)
 	if err != nil {
 		resErr := util.ErrorResponse(err)
-		return nil, nil, &resErr
+		return nil, &resErr
 	}
 
 	switch {
 	case !response.RoomExists:
-		return nil, nil, &util.JSONResponse{
+		return nil, &util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: spec.NotFound("Room not found"),
 		}
 	case !response.StateKnown:
-		return nil, nil, &util.JSONResponse{
+		return nil, &util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: spec.NotFound("State not known"),
 		}
 	case response.IsRejected:
-		return nil, nil, &util.JSONResponse{
+		return nil, &util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: spec.NotFound("Event not found"),
 		}
 	}
 
-	return response.StateEvents, response.AuthChainEvents, nil
-}
-
-func getIDsFromEvent(events []*types.HeaderedEvent) []string {
-	IDs := make([]string, len(events))
-	for i := range events {
-		IDs[i] = events[i].EventID()
-	}
-
-	return IDs
+	return &response, nil
 }
@@ -0,0 +1,101 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/test"
+)
+
+// stateRoomserverAPI answers state queries from the room, returning only
+// event IDs if asked to.
+type stateRoomserverAPI struct {
+	api.FederationRoomserverAPI
+	room    *test.Room
+	request *api.QueryStateAndAuthChainRequest
+}
+
+func (r *stateRoomserverAPI) QueryServerJoinedToRoom(
+	ctx context.Context, req *api.QueryServerJoinedToRoomRequest, res *api.QueryServerJoinedToRoomResponse,
+) error {
+	res.IsInRoom = true
+	return nil
+}
+
+func (r *stateRoomserverAPI) QueryEventsByID(
+	ctx context.Context, req *api.QueryEventsByIDRequest, res *api.QueryEventsByIDResponse,
+) error {
+	for _, ev := range r.room.Events() {
+		if ev.EventID() == req.EventIDs[0] {
+			res.Events = []*types.HeaderedEvent{ev}
+		}
+	}
+	return nil
+}
+
+func (r *stateRoomserverAPI) QueryServerAllowedToSeeEvent(
+	ctx context.Context, serverName spec.ServerName, eventID string, roomID string,
+) (bool, error) {
+	return true, nil
+}
+
+func (r *stateRoomserverAPI) QueryStateAndAuthChain(
+	ctx context.Context, req *api.QueryStateAndAuthChainRequest, res *api.QueryStateAndAuthChainResponse,
+) error {
+	r.request = req
+	res.RoomExists = true
+	res.StateKnown = true
+	for _, ev := range r.room.CurrentState() {
+		if req.OnlyEventIDs {
+			res.StateEventIDs = append(res.StateEventIDs, ev.EventID())
+			res.AuthChainEventIDs = append(res.AuthChainEventIDs, ev.EventID())
+		} else {
+			res.StateEvents = append(res.StateEvents, ev)
+			res.AuthChainEvents = append(res.AuthChainEvents, ev)
+		}
+	}
+	return nil
+}
+
+func TestGetState(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	lastEvent := room.Events()[len(room.Events())-1]
+	requestURI := "/state/" + room.ID + "?event_id=" + url.QueryEscape(lastEvent.EventID())
+	fedReq := fclient.NewFederationRequest(http.MethodGet, "remote", "test", requestURI)
+	stateSize := len(room.CurrentState())
+
+	// Only the event IDs are asked for to answer /state_ids.
+	rsAPI := &stateRoomserverAPI{room: room}
+	res := GetStateIDs(context.Background(), &fedReq, rsAPI, room.ID)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	if !rsAPI.request.OnlyEventIDs {
+		t.Fatal("expected only event IDs to be asked for")
+	}
+	stateIDs := res.JSON.(fclient.RespStateIDs)
+	if len(stateIDs.StateEventIDs) != stateSize || len(stateIDs.AuthEventIDs) != stateSize {
+		t.Fatalf("got %d state and %d auth event IDs, want %d", len(stateIDs.StateEventIDs), len(stateIDs.AuthEventIDs), stateSize)
+	}
+
+	// The events themselves are asked for to answer /state.
+	rsAPI = &stateRoomserverAPI{room: room}
+	res = GetState(context.Background(), &fedReq, rsAPI, room.ID)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	if rsAPI.request.OnlyEventIDs {
+		t.Fatal("expected the events to be asked for")
+	}
+	state := res.JSON.(*fclient.RespState)
+	if len(state.StateEvents) != stateSize || len(state.AuthEvents) != stateSize {
+		t.Fatalf("got %d state and %d auth events, want %d", len(state.StateEvents), len(state.AuthEvents), stateSize)
+	}
+}
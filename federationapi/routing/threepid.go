@@ -0,0 +1,298 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/neilalexander/harmony/clientapi/httputil"
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
+	"github.com/neilalexander/harmony/internal/eventutil"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+type invitesOnBindRequest struct {
+	Medium  string              `json:"medium"`
+	Address string              `json:"address"`
+	MXID    string              `json:"mxid"`
+	Invites []invitesOnBindItem `json:"invites"`
+}
+
+type invitesOnBindItem struct {
+	Medium  string                                         `json:"medium"`
+	Address string                                         `json:"address"`
+	MXID    string                                         `json:"mxid"`
+	RoomID  string                                         `json:"room_id"`
+	Sender  string                                         `json:"sender"`
+	Signed  gomatrixserverlib.MemberThirdPartyInviteSigned `json:"signed"`
+}
+
+// ExchangeThirdPartyInvite implements PUT /_matrix/federation/v1/exchange_third_party_invite/{roomID}
+// The invitee's homeserver sends us the m.room.member invite which claims a
+// third-party invite that one of our users sent, for us to build and send
+// into the room on their behalf.
+func ExchangeThirdPartyInvite(
+	httpReq *http.Request,
+	request *fclient.FederationRequest,
+	roomID string,
+	cfg *config.FederationAPI,
+	rsAPI api.FederationRoomserverAPI,
+	fsAPI federationAPI.FederationInternalAPI,
+) util.JSONResponse {
+	var proto gomatrixserverlib.ProtoEvent
+	if err := json.Unmarshal(request.Content(), &proto); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	if proto.RoomID != roomID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The room ID in the request path must match the room ID in the invite event JSON"),
+		}
+	}
+	if proto.Type != spec.MRoomMember || proto.StateKey == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The event must be a m.room.member event"),
+		}
+	}
+	_, senderDomain, err := cfg.Matrix.SplitLocalID('@', proto.SenderID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The event's sender isn't a local user"),
+		}
+	}
+	invitee, err := spec.NewUserID(*proto.StateKey, true)
+	if err != nil || invitee.Domain() != request.Origin() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The event's state key isn't a Matrix user ID belonging to the origin server"),
+		}
+	}
+
+	identity, err := cfg.Matrix.SigningIdentityFor(senderDomain)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("Server name %q does not exist", senderDomain)),
+		}
+	}
+	event, resErr := buildThirdPartyInviteMembership(httpReq.Context(), &proto, identity, rsAPI)
+	if resErr != nil {
+		return *resErr
+	}
+
+	// Have the invitee's homeserver sign the invite, so that we know it
+	// accepted it, before sending it into the room.
+	signed, err := fsAPI.SendInvite(httpReq.Context(), event, nil)
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("fsAPI.SendInvite failed")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: spec.Unknown("The invitee's homeserver didn't sign the invite"),
+		}
+	}
+	if err = api.SendEvents(
+		httpReq.Context(), rsAPI, api.KindNew,
+		[]*types.HeaderedEvent{{PDU: signed}},
+		senderDomain, request.Origin(), senderDomain, nil, false,
+	); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("api.SendEvents failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// OnBindThirdPartyInvites implements POST /_matrix/federation/v1/3pid/onbind
+// An identity server tells us that a third-party identifier has been bound to
+// one of our users, along with the pending invites for it. We claim each of
+// them from the inviter's homeserver.
+func OnBindThirdPartyInvites(
+	httpReq *http.Request,
+	cfg *config.FederationAPI,
+	rsAPI api.FederationRoomserverAPI,
+	federation fclient.FederationClient,
+) util.JSONResponse {
+	var body invitesOnBindRequest
+	if reqErr := httputil.UnmarshalJSONRequest(httpReq, &body); reqErr != nil {
+		return *reqErr
+	}
+	_, inviteeDomain, err := cfg.Matrix.SplitLocalID('@', body.MXID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The mxid isn't a local user"),
+		}
+	}
+
+	for _, invite := range body.Invites {
+		if invite.MXID != body.MXID || invite.Signed.MXID != body.MXID {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("Every invite must be for the bound mxid"),
+			}
+		}
+		if err = claimThirdPartyInvite(httpReq.Context(), cfg, rsAPI, federation, inviteeDomain, &invite); err != nil {
+			util.GetLogger(httpReq.Context()).WithError(err).WithField("room_id", invite.RoomID).Error("failed to claim third-party invite")
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// claimThirdPartyInvite turns a pending third-party invite into an invite for
+// the user who bound the identifier. If the inviter is one of our users we
+// send the invite ourselves, otherwise their homeserver has to.
+func claimThirdPartyInvite(
+	ctx context.Context, cfg *config.FederationAPI, rsAPI api.FederationRoomserverAPI,
+	federation fclient.FederationClient, inviteeDomain spec.ServerName, invite *invitesOnBindItem,
+) error {
+	_, senderDomain, err := gomatrixserverlib.SplitID('@', invite.Sender)
+	if err != nil {
+		return fmt.Errorf("invalid sender: %w", err)
+	}
+	proto := gomatrixserverlib.ProtoEvent{
+		SenderID: invite.Sender,
+		RoomID:   invite.RoomID,
+		Type:     spec.MRoomMember,
+		StateKey: &invite.MXID,
+	}
+	if err = proto.SetContent(gomatrixserverlib.MemberContent{
+		Membership: spec.Invite,
+		ThirdPartyInvite: &gomatrixserverlib.MemberThirdPartyInvite{
+			Signed: invite.Signed,
+		},
+	}); err != nil {
+		return err
+	}
+
+	if !cfg.Matrix.IsLocalServerName(senderDomain) {
+		return federation.ExchangeThirdPartyInvite(ctx, inviteeDomain, senderDomain, proto)
+	}
+	identity, err := cfg.Matrix.SigningIdentityFor(senderDomain)
+	if err != nil {
+		return err
+	}
+	event, resErr := buildThirdPartyInviteMembership(ctx, &proto, identity, rsAPI)
+	if resErr != nil {
+		return fmt.Errorf("failed to build invite: %v", resErr.JSON)
+	}
+	return api.SendEvents(ctx, rsAPI, api.KindNew, []*types.HeaderedEvent{event}, senderDomain, senderDomain, senderDomain, nil, false)
+}
+
+// buildThirdPartyInviteMembership builds the m.room.member invite which claims
+// a third-party invite, taking the display name from the m.room.third_party_invite
+// event as the spec requires.
+func buildThirdPartyInviteMembership(
+	ctx context.Context, proto *gomatrixserverlib.ProtoEvent,
+	identity *fclient.SigningIdentity, rsAPI api.FederationRoomserverAPI,
+) (*types.HeaderedEvent, *util.JSONResponse) {
+	if resErr := fillThirdPartyInviteDisplayName(ctx, proto, rsAPI); resErr != nil {
+		return nil, resErr
+	}
+
+	event, err := eventutil.QueryAndBuildEvent(ctx, proto, identity, time.Now(), rsAPI, nil)
+	switch e := err.(type) {
+	case nil:
+		return event, nil
+	case eventutil.ErrRoomNoExists:
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Unknown room " + proto.RoomID),
+		}
+	case gomatrixserverlib.BadJSONError:
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(e.Error()),
+		}
+	default:
+		util.GetLogger(ctx).WithError(err).Error("eventutil.QueryAndBuildEvent failed")
+		return nil, &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+}
+
+// fillThirdPartyInviteDisplayName sets the display name of the membership
+// content to the one in the m.room.third_party_invite event whose token the
+// membership claims.
+func fillThirdPartyInviteDisplayName(
+	ctx context.Context, proto *gomatrixserverlib.ProtoEvent, rsAPI api.FederationRoomserverAPI,
+) *util.JSONResponse {
+	var content gomatrixserverlib.MemberContent
+	if err := json.Unmarshal(proto.Content, &content); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The event content is invalid: " + err.Error()),
+		}
+	}
+	if content.Membership != spec.Invite || content.ThirdPartyInvite == nil || content.ThirdPartyInvite.Signed.Token == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The event must be an invite claiming a third-party invite"),
+		}
+	}
+
+	queryRes := api.QueryLatestEventsAndStateResponse{}
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID: proto.RoomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: spec.MRoomThirdPartyInvite, StateKey: content.ThirdPartyInvite.Signed.Token},
+		},
+	}, &queryRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryLatestEventsAndState failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !queryRes.RoomExists {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Unknown room " + proto.RoomID),
+		}
+	}
+	if len(queryRes.StateEvents) == 0 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("No third-party invite with the token exists in the room"),
+		}
+	}
+
+	var inviteContent gomatrixserverlib.ThirdPartyInviteContent
+	if err := json.Unmarshal(queryRes.StateEvents[0].Content(), &inviteContent); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to unmarshal third-party invite content")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	content.ThirdPartyInvite.DisplayName = inviteContent.DisplayName
+	if err := proto.SetContent(content); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+)
+
+const testInviteToken = "invitetoken"
+
+// threePIDRoomserverAPI answers queries about the room from its current
+// state and keeps the events which are sent into it.
+type threePIDRoomserverAPI struct {
+	api.FederationRoomserverAPI
+	room *test.Room
+	sent []*types.HeaderedEvent
+}
+
+func (r *threePIDRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context, req *api.QueryLatestEventsAndStateRequest, res *api.QueryLatestEventsAndStateResponse,
+) error {
+	if req.RoomID != r.room.ID {
+		return nil
+	}
+	res.RoomExists = true
+	res.RoomVersion = r.room.Version
+	res.LatestEvents = r.room.ForwardExtremities()
+	res.Depth = int64(len(r.room.Events()) + 1)
+	for _, ev := range r.room.CurrentState() {
+		for _, tuple := range req.StateToFetch {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				res.StateEvents = append(res.StateEvents, ev)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *threePIDRoomserverAPI) InputRoomEvents(
+	ctx context.Context, req *api.InputRoomEventsRequest, res *api.InputRoomEventsResponse,
+) {
+	for _, ire := range req.InputRoomEvents {
+		r.sent = append(r.sent, ire.Event)
+	}
+}
+
+// threePIDFederationAPI signs invites as if it were the invitee's homeserver.
+type threePIDFederationAPI struct {
+	federationAPI.FederationInternalAPI
+	invited []gomatrixserverlib.PDU
+}
+
+func (f *threePIDFederationAPI) SendInvite(
+	ctx context.Context, event gomatrixserverlib.PDU, strippedState []gomatrixserverlib.InviteStrippedState,
+) (gomatrixserverlib.PDU, error) {
+	f.invited = append(f.invited, event)
+	return event, nil
+}
+
+// threePIDFederationClient keeps the invites which it is asked to exchange
+// with other servers.
+type threePIDFederationClient struct {
+	fclient.FederationClient
+	exchanged map[spec.ServerName]gomatrixserverlib.ProtoEvent
+}
+
+func (f *threePIDFederationClient) ExchangeThirdPartyInvite(
+	ctx context.Context, origin, s spec.ServerName, proto gomatrixserverlib.ProtoEvent,
+) error {
+	f.exchanged[s] = proto
+	return nil
+}
+
+// newThreePIDInviteRoom creates a room with a third-party invite in it,
+// returning the config for the server which the room's creator is on.
+func newThreePIDInviteRoom(t *testing.T) (*config.FederationAPI, *test.User, *test.Room) {
+	t.Helper()
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, alice, spec.MRoomThirdPartyInvite, map[string]interface{}{
+		"display_name":     "b...@e...",
+		"key_validity_url": "https://id.example.com/_matrix/identity/v2/pubkey/isvalid",
+		"public_key":       "aGVsbG8",
+	}, test.WithStateKey(testInviteToken))
+
+	_, domain, err := gomatrixserverlib.SplitID('@', alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{
+				ServerName: domain,
+				KeyID:      "ed25519:auto",
+				PrivateKey: test.PrivateKeyA,
+			},
+		},
+	}
+	return cfg, alice, room
+}
+
+func threePIDInviteContent(t *testing.T, mxid, token string) spec.RawJSON {
+	t.Helper()
+	content, err := json.Marshal(gomatrixserverlib.MemberContent{
+		Membership: spec.Invite,
+		ThirdPartyInvite: &gomatrixserverlib.MemberThirdPartyInvite{
+			Signed: gomatrixserverlib.MemberThirdPartyInviteSigned{MXID: mxid, Token: token},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestExchangeThirdPartyInvite(t *testing.T) {
+	cfg, alice, room := newThreePIDInviteRoom(t)
+	bob := "@bob:remote"
+
+	exchange := func(origin spec.ServerName, roomID string, proto gomatrixserverlib.ProtoEvent) (*threePIDRoomserverAPI, *threePIDFederationAPI, int) {
+		rsAPI := &threePIDRoomserverAPI{room: room}
+		fsAPI := &threePIDFederationAPI{}
+		fedReq := fclient.NewFederationRequest(http.MethodPut, origin, "test", "/exchange_third_party_invite/"+roomID)
+		if err := fedReq.SetContent(proto); err != nil {
+			t.Fatal(err)
+		}
+		httpReq := httptest.NewRequest(http.MethodPut, "/exchange_third_party_invite/"+roomID, nil)
+		res := ExchangeThirdPartyInvite(httpReq, &fedReq, roomID, cfg, rsAPI, fsAPI)
+		return rsAPI, fsAPI, res.Code
+	}
+	proto := func(sender, invitee, token string) gomatrixserverlib.ProtoEvent {
+		return gomatrixserverlib.ProtoEvent{
+			SenderID: sender,
+			RoomID:   room.ID,
+			Type:     spec.MRoomMember,
+			StateKey: &invitee,
+			Content:  threePIDInviteContent(t, invitee, token),
+		}
+	}
+
+	// The invite is signed by the invitee's homeserver and then sent into
+	// the room, with the display name from the third-party invite.
+	rsAPI, fsAPI, code := exchange("remote", room.ID, proto(alice.ID, bob, testInviteToken))
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if len(fsAPI.invited) != 1 || len(rsAPI.sent) != 1 {
+		t.Fatalf("got %d invites signed and %d events sent, want 1 of each", len(fsAPI.invited), len(rsAPI.sent))
+	}
+	var content gomatrixserverlib.MemberContent
+	if err := json.Unmarshal(rsAPI.sent[0].Content(), &content); err != nil {
+		t.Fatal(err)
+	}
+	if content.ThirdPartyInvite == nil || content.ThirdPartyInvite.DisplayName != "b...@e..." {
+		t.Fatalf("unexpected content %s", rsAPI.sent[0].Content())
+	}
+	if !rsAPI.sent[0].StateKeyEquals(bob) {
+		t.Fatalf("invite is for %q, want %q", *rsAPI.sent[0].StateKey(), bob)
+	}
+
+	for name, tc := range map[string]struct {
+		origin spec.ServerName
+		roomID string
+		proto  gomatrixserverlib.ProtoEvent
+		code   int
+	}{
+		"room ID mismatch":      {"remote", "!other:test", proto(alice.ID, bob, testInviteToken), http.StatusBadRequest},
+		"remote sender":         {"remote", room.ID, proto("@carol:remote", bob, testInviteToken), http.StatusBadRequest},
+		"invitee not on origin": {"elsewhere", room.ID, proto(alice.ID, bob, testInviteToken), http.StatusBadRequest},
+		"unknown token":         {"remote", room.ID, proto(alice.ID, bob, "wrongtoken"), http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rsAPI, fsAPI, code := exchange(tc.origin, tc.roomID, tc.proto)
+			if code != tc.code {
+				t.Fatalf("got status %d, want %d", code, tc.code)
+			}
+			if len(fsAPI.invited) != 0 || len(rsAPI.sent) != 0 {
+				t.Fatal("expected nothing to be signed or sent")
+			}
+		})
+	}
+}
+
+func TestOnBindThirdPartyInvites(t *testing.T) {
+	cfg, alice, room := newThreePIDInviteRoom(t)
+	_, domain, _ := gomatrixserverlib.SplitID('@', alice.ID)
+	bob := "@bob:" + string(domain)
+
+	onBind := func(body map[string]interface{}) (*threePIDRoomserverAPI, *threePIDFederationClient, int) {
+		rsAPI := &threePIDRoomserverAPI{room: room}
+		federation := &threePIDFederationClient{exchanged: map[spec.ServerName]gomatrixserverlib.ProtoEvent{}}
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpReq := httptest.NewRequest(http.MethodPost, "/3pid/onbind", bytes.NewReader(raw))
+		res := OnBindThirdPartyInvites(httpReq, cfg, rsAPI, federation)
+		return rsAPI, federation, res.Code
+	}
+	invite := func(roomID, sender, mxid string) map[string]interface{} {
+		return map[string]interface{}{
+			"medium":  "email",
+			"address": "bob@example.com",
+			"mxid":    mxid,
+			"room_id": roomID,
+			"sender":  sender,
+			"signed":  gomatrixserverlib.MemberThirdPartyInviteSigned{MXID: mxid, Token: testInviteToken},
+		}
+	}
+
+	// Invites from our own users are sent into the room by us, and invites
+	// from other servers' users are exchanged with their homeservers.
+	rsAPI, federation, code := onBind(map[string]interface{}{
+		"medium":  "email",
+		"address": "bob@example.com",
+		"mxid":    bob,
+		"invites": []interface{}{
+			invite(room.ID, alice.ID, bob),
+			invite("!remote:remote", "@carol:remote", bob),
+		},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if len(rsAPI.sent) != 1 || !rsAPI.sent[0].StateKeyEquals(bob) {
+		t.Fatalf("expected an invite for %s to be sent into the room, got %d events", bob, len(rsAPI.sent))
+	}
+	proto, ok := federation.exchanged["remote"]
+	if !ok || proto.RoomID != "!remote:remote" || proto.SenderID != "@carol:remote" {
+		t.Fatalf("expected the remote invite to be exchanged, got %+v", federation.exchanged)
+	}
+
+	// Every invite must be for the user who bound the identifier.
+	rsAPI, federation, code = onBind(map[string]interface{}{
+		"medium":  "email",
+		"address": "bob@example.com",
+		"mxid":    bob,
+		"invites": []interface{}{invite(room.ID, alice.ID, "@mallory:"+string(domain))},
+	})
+	if code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", code, http.StatusBadRequest)
+	}
+	if len(rsAPI.sent) != 0 || len(federation.exchanged) != 0 {
+		t.Fatal("expected nothing to be sent or exchanged")
+	}
+
+	// The bound user must be one of ours.
+	if _, _, code = onBind(map[string]interface{}{
+		"medium":  "email",
+		"address": "bob@example.com",
+		"mxid":    "@bob:remote",
+		"invites": []interface{}{},
+	}); code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", code, http.StatusBadRequest)
+	}
+}
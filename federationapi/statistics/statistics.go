@@ -68,6 +68,21 @@ func (s *Statistics) ForServer(serverName spec.ServerName) *ServerStatistics {
 	return server
 }
 
+// BackingOff returns the servers which we are currently backing off from,
+// along with when each backoff ends.
+func (s *Statistics) BackingOff() map[spec.ServerName]time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	now := time.Now()
+	result := map[spec.ServerName]time.Time{}
+	for serverName, server := range s.servers {
+		if until := server.BackoffInfo(); until != nil && until.After(now) {
+			result[serverName] = *until
+		}
+	}
+	return result
+}
+
 // ServerStatistics contains information about our interactions with a
 // remote federated host, e.g. how many times we were successful, how
 // many times we failed etc. It also manages the backoff time and black-
@@ -233,3 +248,9 @@ func (s *ServerStatistics) removeBlacklist() bool {
 func (s *ServerStatistics) SuccessCount() uint32 {
 	return s.successCounter.Load()
 }
+
+// BackoffCount returns the number of consecutive failures that we have
+// backed off for since the last success.
+func (s *ServerStatistics) BackoffCount() uint32 {
+	return s.backoffCount.Load()
+}
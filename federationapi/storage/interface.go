@@ -49,18 +49,48 @@ type Database interface {
 
 	GetPendingPDUServerNames(ctx context.Context) ([]spec.ServerName, error)
 	GetPendingEDUServerNames(ctx context.Context) ([]spec.ServerName, error)
+	// GetPendingSummary returns how many PDUs and EDUs are waiting to be sent to the
+	// server, and when the oldest of them was queued.
+	GetPendingSummary(ctx context.Context, serverName spec.ServerName) (pdus, edus int64, oldest spec.Timestamp, err error)
+	// DropPending removes all of the PDUs and EDUs waiting to be sent to the server.
+	DropPending(ctx context.Context, serverName spec.ServerName) error
+	// StartTransaction returns the next transaction ID for the server, which is never
+	// reused, even after restarting. The PDUs and EDUs in the transaction are stored
+	// with it, so that it can be retried unchanged after restarting.
+	StartTransaction(ctx context.Context, serverName spec.ServerName, pdus, edus []*receipt.Receipt) (gomatrixserverlib.TransactionID, error)
+	// GetInFlightTransaction returns the transaction which was started but not finished
+	// for the server, if any, along with the PDUs and EDUs in it.
+	GetInFlightTransaction(ctx context.Context, serverName spec.ServerName) (gomatrixserverlib.TransactionID, map[*receipt.Receipt]*rstypes.HeaderedEvent, map[*receipt.Receipt]*gomatrixserverlib.EDU, error)
+	// FinishTransaction cleans up the PDUs and EDUs in the transaction once it has been
+	// sent successfully, and forgets about the transaction.
+	FinishTransaction(ctx context.Context, serverName spec.ServerName, pdus, edus []*receipt.Receipt) error
 
 	// these don't have contexts passed in as we want things to happen regardless of the request context
 	AddServerToBlacklist(serverName spec.ServerName) error
 	RemoveServerFromBlacklist(serverName spec.ServerName) error
 	RemoveAllServersFromBlacklist() error
 	IsServerBlacklisted(serverName spec.ServerName) (bool, error)
+	GetBlacklistedServers(ctx context.Context) ([]spec.ServerName, error)
+
+	// SetRoomFederationDisabled marks a room as local-only, so that no events
+	// or EDUs for it are sent to or accepted from other servers.
+	SetRoomFederationDisabled(ctx context.Context, roomID string, disabled bool) error
+	IsRoomFederationDisabled(ctx context.Context, roomID string) (bool, error)
+	// FederatedRooms returns those of the rooms which don't have federation
+	// disabled, in the same order.
+	FederatedRooms(ctx context.Context, roomIDs []string) ([]string, error)
 
 	// Update the notary with the given server keys from the given server name.
 	UpdateNotaryKeys(ctx context.Context, serverName spec.ServerName, serverKeys gomatrixserverlib.ServerKeys) error
 	// Query the notary for the server keys for the given server. If `optKeyIDs` is not empty, multiple server keys may be returned (between 1 - len(optKeyIDs))
 	// such that the combination of all server keys will include all the `optKeyIDs`.
 	GetNotaryKeys(ctx context.Context, serverName spec.ServerName, optKeyIDs []gomatrixserverlib.KeyID) ([]gomatrixserverlib.ServerKeys, error)
+	// GetServerKeys returns the keys cached for the server, or for every server if serverName is empty.
+	GetServerKeys(ctx context.Context, serverName spec.ServerName) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
+	// PurgeExpiredServerKeys removes the cached keys which were only valid until before the given time
+	// and which have been replaced by a key for the same server that is valid for longer. Keys which
+	// the server has marked as expired are kept.
+	PurgeExpiredServerKeys(ctx context.Context, before spec.Timestamp) ([]gomatrixserverlib.PublicKeyLookupRequest, error)
 	// DeleteExpiredEDUs cleans up expired EDUs
 	DeleteExpiredEDUs(ctx context.Context) error
 
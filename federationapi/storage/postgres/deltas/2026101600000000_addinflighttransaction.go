@@ -0,0 +1,29 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpAddInFlightTransaction(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE federationsender_transaction_ids ADD COLUMN IF NOT EXISTS in_flight_transaction_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE federationsender_transaction_ids ADD COLUMN IF NOT EXISTS in_flight_pdus BIGINT[] NOT NULL DEFAULT '{}';
+ALTER TABLE federationsender_transaction_ids ADD COLUMN IF NOT EXISTS in_flight_edus BIGINT[] NOT NULL DEFAULT '{}';`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddInFlightTransaction(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE federationsender_transaction_ids DROP COLUMN in_flight_transaction_id;
+ALTER TABLE federationsender_transaction_ids DROP COLUMN in_flight_pdus;
+ALTER TABLE federationsender_transaction_ids DROP COLUMN in_flight_edus;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+)
+
+const disabledRoomsSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_disabled_rooms (
+	-- The room ID of the room which should not be federated, either
+	-- because it was created with "m.federate": false or because an
+	-- admin has disabled federation for it
+	room_id TEXT NOT NULL,
+	UNIQUE (room_id)
+);
+`
+
+const insertDisabledRoomSQL = "" +
+	"INSERT INTO federationsender_disabled_rooms (room_id) VALUES ($1)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectDisabledRoomSQL = "" +
+	"SELECT room_id FROM federationsender_disabled_rooms WHERE room_id = $1"
+
+const selectDisabledRoomsSQL = "" +
+	"SELECT room_id FROM federationsender_disabled_rooms WHERE room_id = ANY($1)"
+
+const deleteDisabledRoomSQL = "" +
+	"DELETE FROM federationsender_disabled_rooms WHERE room_id = $1"
+
+type disabledRoomsStatements struct {
+	db                      *sql.DB
+	insertDisabledRoomStmt  *sql.Stmt
+	selectDisabledRoomStmt  *sql.Stmt
+	selectDisabledRoomsStmt *sql.Stmt
+	deleteDisabledRoomStmt  *sql.Stmt
+}
+
+func NewPostgresDisabledRoomsTable(db *sql.DB) (s *disabledRoomsStatements, err error) {
+	s = &disabledRoomsStatements{
+		db: db,
+	}
+	_, err = db.Exec(disabledRoomsSchema)
+	if err != nil {
+		return
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertDisabledRoomStmt, insertDisabledRoomSQL},
+		{&s.selectDisabledRoomStmt, selectDisabledRoomSQL},
+		{&s.selectDisabledRoomsStmt, selectDisabledRoomsSQL},
+		{&s.deleteDisabledRoomStmt, deleteDisabledRoomSQL},
+	}.Prepare(db)
+}
+
+func (s *disabledRoomsStatements) InsertDisabledRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertDisabledRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *disabledRoomsStatements) SelectDisabledRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectDisabledRoomStmt)
+	res, err := stmt.QueryContext(ctx, roomID)
+	if err != nil {
+		return false, err
+	}
+	defer res.Close() // nolint:errcheck
+	// The query will return the room ID if federation is disabled for the
+	// room, and will return no rows if not.
+	return res.Next(), nil
+}
+
+func (s *disabledRoomsStatements) SelectDisabledRooms(
+	ctx context.Context, txn *sql.Tx, roomIDs []string,
+) (map[string]struct{}, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectDisabledRoomsStmt)
+	rows, err := stmt.QueryContext(ctx, pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectDisabledRooms: rows.close() failed")
+	disabled := map[string]struct{}{}
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		disabled[roomID] = struct{}{}
+	}
+	return disabled, rows.Err()
+}
+
+func (s *disabledRoomsStatements) DeleteDisabledRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteDisabledRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
@@ -71,6 +71,14 @@ const selectExpiredEDUsSQL = "" +
 const deleteExpiredEDUsSQL = "" +
 	"DELETE FROM federationsender_queue_edus WHERE expires_at > 0 AND expires_at <= $1"
 
+const selectQueueEDUSummarySQL = "" +
+	"SELECT COUNT(*), COALESCE(MIN(j.queued_at), 0) FROM federationsender_queue_edus AS q" +
+	" LEFT JOIN federationsender_queue_json AS j ON j.json_nid = q.json_nid" +
+	" WHERE q.server_name = $1"
+
+const deleteAllQueueEDUsSQL = "" +
+	"DELETE FROM federationsender_queue_edus WHERE server_name = $1 RETURNING json_nid"
+
 type queueEDUsStatements struct {
 	db                                   *sql.DB
 	insertQueueEDUStmt                   *sql.Stmt
@@ -78,6 +86,8 @@ type queueEDUsStatements struct {
 	selectQueueEDUStmt                   *sql.Stmt
 	selectQueueEDUReferenceJSONCountStmt *sql.Stmt
 	selectQueueEDUServerNamesStmt        *sql.Stmt
+	selectQueueEDUSummaryStmt            *sql.Stmt
+	deleteAllQueueEDUsStmt               *sql.Stmt
 	selectExpiredEDUsStmt                *sql.Stmt
 	deleteExpiredEDUsStmt                *sql.Stmt
 }
@@ -112,6 +122,8 @@ func (s *queueEDUsStatements) Prepare() error {
 		{&s.selectQueueEDUStmt, selectQueueEDUSQL},
 		{&s.selectQueueEDUReferenceJSONCountStmt, selectQueueEDUReferenceJSONCountSQL},
 		{&s.selectQueueEDUServerNamesStmt, selectQueueServerNamesSQL},
+		{&s.selectQueueEDUSummaryStmt, selectQueueEDUSummarySQL},
+		{&s.deleteAllQueueEDUsStmt, deleteAllQueueEDUsSQL},
 		{&s.selectExpiredEDUsStmt, selectExpiredEDUsSQL},
 		{&s.deleteExpiredEDUsStmt, deleteExpiredEDUsSQL},
 	}.Prepare(s.db)
@@ -230,3 +242,31 @@ func (s *queueEDUsStatements) DeleteExpiredEDUs(
 	_, err := stmt.ExecContext(ctx, expiredBefore)
 	return err
 }
+
+func (s *queueEDUsStatements) SelectQueueEDUSummary(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (count int64, oldest spec.Timestamp, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectQueueEDUSummaryStmt)
+	err = stmt.QueryRowContext(ctx, serverName).Scan(&count, &oldest)
+	return
+}
+
+func (s *queueEDUsStatements) DeleteAllQueueEDUs(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) ([]int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteAllQueueEDUsStmt)
+	rows, err := stmt.QueryContext(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "deleteAllQueueEDUs: rows.close() failed")
+	var result []int64
+	for rows.Next() {
+		var nid int64
+		if err = rows.Scan(&nid); err != nil {
+			return nil, err
+		}
+		result = append(result, nid)
+	}
+	return result, rows.Err()
+}
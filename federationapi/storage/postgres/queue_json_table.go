@@ -17,9 +17,12 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/lib/pq"
+	"github.com/neilalexander/harmony/federationapi/storage/postgres/deltas"
 	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 )
 
@@ -31,7 +34,9 @@ CREATE TABLE IF NOT EXISTS federationsender_queue_json (
 	-- cross-reference to find the JSON blob.
 	json_nid BIGSERIAL,
 	-- The JSON body. Text so that we preserve UTF-8.
-	json_body TEXT NOT NULL
+	json_body TEXT NOT NULL,
+	-- When the JSON was queued, or 0 if it was queued before this was recorded.
+	queued_at BIGINT NOT NULL DEFAULT 0
 );
 
 CREATE UNIQUE INDEX IF NOT EXISTS federationsender_queue_json_json_nid_idx
@@ -39,8 +44,8 @@ CREATE UNIQUE INDEX IF NOT EXISTS federationsender_queue_json_json_nid_idx
 `
 
 const insertJSONSQL = "" +
-	"INSERT INTO federationsender_queue_json (json_body)" +
-	" VALUES ($1)" +
+	"INSERT INTO federationsender_queue_json (json_body, queued_at)" +
+	" VALUES ($1, $2)" +
 	" RETURNING json_nid"
 
 const deleteJSONSQL = "" +
@@ -65,6 +70,14 @@ func NewPostgresQueueJSONTable(db *sql.DB) (s *queueJSONStatements, err error) {
 	if err != nil {
 		return
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "federationapi: add queued_at column",
+		Up:      deltas.UpAddQueuedAt,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return
+	}
 	return s, sqlutil.StatementList{
 		{&s.insertJSONStmt, insertJSONSQL},
 		{&s.deleteJSONStmt, deleteJSONSQL},
@@ -77,7 +90,7 @@ func (s *queueJSONStatements) InsertQueueJSON(
 ) (int64, error) {
 	stmt := sqlutil.TxStmt(txn, s.insertJSONStmt)
 	var lastid int64
-	if err := stmt.QueryRowContext(ctx, json).Scan(&lastid); err != nil {
+	if err := stmt.QueryRowContext(ctx, json, spec.AsTimestamp(time.Now())).Scan(&lastid); err != nil {
 		return 0, err
 	}
 	return lastid, nil
@@ -62,6 +62,14 @@ const selectQueuePDUReferenceJSONCountSQL = "" +
 const selectQueuePDUServerNamesSQL = "" +
 	"SELECT DISTINCT server_name FROM federationsender_queue_pdus"
 
+const selectQueuePDUSummarySQL = "" +
+	"SELECT COUNT(*), COALESCE(MIN(j.queued_at), 0) FROM federationsender_queue_pdus AS q" +
+	" LEFT JOIN federationsender_queue_json AS j ON j.json_nid = q.json_nid" +
+	" WHERE q.server_name = $1"
+
+const deleteAllQueuePDUsSQL = "" +
+	"DELETE FROM federationsender_queue_pdus WHERE server_name = $1 RETURNING json_nid"
+
 type queuePDUsStatements struct {
 	db                                   *sql.DB
 	insertQueuePDUStmt                   *sql.Stmt
@@ -69,6 +77,8 @@ type queuePDUsStatements struct {
 	selectQueuePDUsStmt                  *sql.Stmt
 	selectQueuePDUReferenceJSONCountStmt *sql.Stmt
 	selectQueuePDUServerNamesStmt        *sql.Stmt
+	selectQueuePDUSummaryStmt            *sql.Stmt
+	deleteAllQueuePDUsStmt               *sql.Stmt
 }
 
 func NewPostgresQueuePDUsTable(db *sql.DB) (s *queuePDUsStatements, err error) {
@@ -85,6 +95,8 @@ func NewPostgresQueuePDUsTable(db *sql.DB) (s *queuePDUsStatements, err error) {
 		{&s.selectQueuePDUsStmt, selectQueuePDUsSQL},
 		{&s.selectQueuePDUReferenceJSONCountStmt, selectQueuePDUReferenceJSONCountSQL},
 		{&s.selectQueuePDUServerNamesStmt, selectQueuePDUServerNamesSQL},
+		{&s.selectQueuePDUSummaryStmt, selectQueuePDUSummarySQL},
+		{&s.deleteAllQueuePDUsStmt, deleteAllQueuePDUsSQL},
 	}.Prepare(db)
 }
 
@@ -173,3 +185,31 @@ func (s *queuePDUsStatements) SelectQueuePDUServerNames(
 
 	return result, rows.Err()
 }
+
+func (s *queuePDUsStatements) SelectQueuePDUSummary(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (count int64, oldest spec.Timestamp, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectQueuePDUSummaryStmt)
+	err = stmt.QueryRowContext(ctx, serverName).Scan(&count, &oldest)
+	return
+}
+
+func (s *queuePDUsStatements) DeleteAllQueuePDUs(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) ([]int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteAllQueuePDUsStmt)
+	rows, err := stmt.QueryContext(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "deleteAllQueuePDUs: rows.close() failed")
+	var result []int64
+	for rows.Next() {
+		var nid int64
+		if err = rows.Scan(&nid); err != nil {
+			return nil, err
+		}
+		result = append(result, nid)
+	}
+	return result, rows.Err()
+}
@@ -55,6 +55,20 @@ const bulkSelectServerSigningKeysSQL = "" +
 	"   server_key FROM keydb_server_keys" +
 	" WHERE server_name_and_key_id = ANY($1)"
 
+const selectServerSigningKeysSQL = "" +
+	"SELECT server_name, server_key_id, valid_until_ts, expired_ts, " +
+	"   server_key FROM keydb_server_keys" +
+	" WHERE $1 = '' OR server_name = $1"
+
+const deleteExpiredServerSigningKeysSQL = "" +
+	"DELETE FROM keydb_server_keys AS old" +
+	" WHERE old.expired_ts = 0 AND old.valid_until_ts < $1" +
+	" AND EXISTS (" +
+	"   SELECT 1 FROM keydb_server_keys AS newer" +
+	"   WHERE newer.server_name = old.server_name AND newer.valid_until_ts > old.valid_until_ts" +
+	" )" +
+	" RETURNING old.server_name, old.server_key_id"
+
 const upsertServerSigningKeysSQL = "" +
 	"INSERT INTO keydb_server_keys (server_name, server_key_id," +
 	" server_name_and_key_id, valid_until_ts, expired_ts, server_key)" +
@@ -63,8 +77,10 @@ const upsertServerSigningKeysSQL = "" +
 	" DO UPDATE SET valid_until_ts = $4, expired_ts = $5, server_key = $6"
 
 type serverSigningKeyStatements struct {
-	bulkSelectServerKeysStmt *sql.Stmt
-	upsertServerKeysStmt     *sql.Stmt
+	bulkSelectServerKeysStmt    *sql.Stmt
+	selectServerKeysStmt        *sql.Stmt
+	deleteExpiredServerKeysStmt *sql.Stmt
+	upsertServerKeysStmt        *sql.Stmt
 }
 
 func NewPostgresServerSigningKeysTable(db *sql.DB) (s *serverSigningKeyStatements, err error) {
@@ -75,6 +91,8 @@ func NewPostgresServerSigningKeysTable(db *sql.DB) (s *serverSigningKeyStatement
 	}
 	return s, sqlutil.StatementList{
 		{&s.bulkSelectServerKeysStmt, bulkSelectServerSigningKeysSQL},
+		{&s.selectServerKeysStmt, selectServerSigningKeysSQL},
+		{&s.deleteExpiredServerKeysStmt, deleteExpiredServerSigningKeysSQL},
 		{&s.upsertServerKeysStmt, upsertServerSigningKeysSQL},
 	}.Prepare(db)
 }
@@ -93,6 +111,42 @@ func (s *serverSigningKeyStatements) BulkSelectServerKeys(
 		return nil, err
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectServerKeys: rows.close() failed")
+	return scanServerKeys(rows)
+}
+
+func (s *serverSigningKeyStatements) SelectServerKeys(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectServerKeysStmt)
+	rows, err := stmt.QueryContext(ctx, string(serverName))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectServerKeys: rows.close() failed")
+	return scanServerKeys(rows)
+}
+
+func (s *serverSigningKeyStatements) DeleteExpiredServerKeys(
+	ctx context.Context, txn *sql.Tx, before spec.Timestamp,
+) ([]gomatrixserverlib.PublicKeyLookupRequest, error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteExpiredServerKeysStmt)
+	rows, err := stmt.QueryContext(ctx, before)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "deleteExpiredServerKeys: rows.close() failed")
+	var deleted []gomatrixserverlib.PublicKeyLookupRequest
+	for rows.Next() {
+		var req gomatrixserverlib.PublicKeyLookupRequest
+		if err = rows.Scan(&req.ServerName, &req.KeyID); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, req)
+	}
+	return deleted, rows.Err()
+}
+
+func scanServerKeys(rows *sql.Rows) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
 	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
 
 	var serverName string
@@ -102,15 +156,14 @@ func (s *serverSigningKeyStatements) BulkSelectServerKeys(
 	var expiredTS int64
 	var vk gomatrixserverlib.VerifyKey
 	for rows.Next() {
-		if err = rows.Scan(&serverName, &keyID, &validUntilTS, &expiredTS, &key); err != nil {
+		if err := rows.Scan(&serverName, &keyID, &validUntilTS, &expiredTS, &key); err != nil {
 			return nil, err
 		}
 		r := gomatrixserverlib.PublicKeyLookupRequest{
 			ServerName: spec.ServerName(serverName),
 			KeyID:      gomatrixserverlib.KeyID(keyID),
 		}
-		err = vk.Key.Decode(key)
-		if err != nil {
+		if err := vk.Key.Decode(key); err != nil {
 			return nil, err
 		}
 		results[r] = gomatrixserverlib.PublicKeyLookupResult{
@@ -46,19 +46,23 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, err
 	}
+	disabledRooms, err := NewPostgresDisabledRoomsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	joinedHosts, err := NewPostgresJoinedHostsTable(d.db)
 	if err != nil {
 		return nil, err
 	}
-	queuePDUs, err := NewPostgresQueuePDUsTable(d.db)
+	queueJSON, err := NewPostgresQueueJSONTable(d.db)
 	if err != nil {
 		return nil, err
 	}
-	queueEDUs, err := NewPostgresQueueEDUsTable(d.db)
+	queuePDUs, err := NewPostgresQueuePDUsTable(d.db)
 	if err != nil {
 		return nil, err
 	}
-	queueJSON, err := NewPostgresQueueJSONTable(d.db)
+	queueEDUs, err := NewPostgresQueueEDUsTable(d.db)
 	if err != nil {
 		return nil, err
 	}
@@ -74,6 +78,10 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, err
 	}
+	transactionIDs, err := NewPostgresTransactionIDsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrator(d.db)
 	m.AddMigrations(sqlutil.Migration{
 		Version: "federationsender: drop federationsender_rooms",
@@ -96,6 +104,8 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 		FederationQueueEDUs:      queueEDUs,
 		FederationQueueJSON:      queueJSON,
 		FederationBlacklist:      blacklist,
+		FederationDisabledRooms:  disabledRooms,
+		FederationTransactionIDs: transactionIDs,
 		NotaryServerKeysJSON:     notaryJSON,
 		NotaryServerKeysMetadata: notaryMetadata,
 		ServerSigningKeys:        serverSigningKeys,
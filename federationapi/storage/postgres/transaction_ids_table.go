@@ -0,0 +1,143 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/neilalexander/harmony/federationapi/storage/postgres/deltas"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/internal/util"
+)
+
+const transactionIDsSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_transaction_ids (
+    -- The destination server name
+	server_name TEXT PRIMARY KEY NOT NULL,
+    -- The last transaction counter used for the destination, which only
+    -- ever increases so that transaction IDs are never reused, even
+    -- after restarting
+	counter BIGINT NOT NULL,
+    -- The transaction which is being sent to the destination, if any,
+    -- and the queue JSON NIDs of the PDUs and EDUs in it, so that it can
+    -- be retried unchanged after restarting
+	in_flight_transaction_id TEXT NOT NULL DEFAULT '',
+	in_flight_pdus BIGINT[] NOT NULL DEFAULT '{}',
+	in_flight_edus BIGINT[] NOT NULL DEFAULT '{}'
+);
+
+-- Stores a random prefix for transaction IDs, which is chosen once when the
+-- database is created. The counters go backwards if the database is reset or
+-- restored from a backup, but the new database gets a new prefix, so that
+-- transaction IDs still aren't reused.
+CREATE TABLE IF NOT EXISTS federationsender_transaction_id_prefix (
+    -- Makes sure that there is only ever one row
+	id BOOLEAN PRIMARY KEY NOT NULL DEFAULT TRUE CHECK (id),
+    -- The prefix, which is put before the counter in transaction IDs
+	prefix TEXT NOT NULL
+);
+`
+
+// The prefix in a backup conflicts with the one chosen when the schema was
+// created, so restoring a backup keeps the new prefix.
+const insertTransactionIDPrefixSQL = "" +
+	"INSERT INTO federationsender_transaction_id_prefix (prefix) VALUES ($1)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectTransactionIDPrefixSQL = "" +
+	"SELECT prefix FROM federationsender_transaction_id_prefix"
+
+const nextTransactionIDSQL = "" +
+	"INSERT INTO federationsender_transaction_ids (server_name, counter) VALUES ($1, 1)" +
+	" ON CONFLICT (server_name) DO UPDATE SET counter = federationsender_transaction_ids.counter + 1" +
+	" RETURNING counter"
+
+const updateInFlightTransactionSQL = "" +
+	"UPDATE federationsender_transaction_ids SET in_flight_transaction_id = $2, in_flight_pdus = $3, in_flight_edus = $4" +
+	" WHERE server_name = $1"
+
+const selectInFlightTransactionSQL = "" +
+	"SELECT in_flight_transaction_id, in_flight_pdus, in_flight_edus FROM federationsender_transaction_ids" +
+	" WHERE server_name = $1"
+
+type transactionIDsStatements struct {
+	db                            *sql.DB
+	nextTransactionIDStmt         *sql.Stmt
+	updateInFlightTransactionStmt *sql.Stmt
+	selectInFlightTransactionStmt *sql.Stmt
+	selectTransactionIDPrefixStmt *sql.Stmt
+}
+
+func NewPostgresTransactionIDsTable(db *sql.DB) (s *transactionIDsStatements, err error) {
+	s = &transactionIDsStatements{
+		db: db,
+	}
+	_, err = db.Exec(transactionIDsSchema)
+	if err != nil {
+		return
+	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "federationapi: add in-flight transaction columns",
+		Up:      deltas.UpAddInFlightTransaction,
+		Down:    deltas.DownAddInFlightTransaction,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return
+	}
+	if _, err = db.Exec(insertTransactionIDPrefixSQL, util.RandomString(8)); err != nil {
+		return
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.nextTransactionIDStmt, nextTransactionIDSQL},
+		{&s.updateInFlightTransactionStmt, updateInFlightTransactionSQL},
+		{&s.selectInFlightTransactionStmt, selectInFlightTransactionSQL},
+		{&s.selectTransactionIDPrefixStmt, selectTransactionIDPrefixSQL},
+	}.Prepare(db)
+}
+
+func (s *transactionIDsStatements) NextTransactionID(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (counter int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.nextTransactionIDStmt)
+	err = stmt.QueryRowContext(ctx, serverName).Scan(&counter)
+	return
+}
+
+func (s *transactionIDsStatements) UpdateInFlightTransaction(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+	transactionID gomatrixserverlib.TransactionID, pduNIDs, eduNIDs []int64,
+) error {
+	if pduNIDs == nil {
+		pduNIDs = []int64{}
+	}
+	if eduNIDs == nil {
+		eduNIDs = []int64{}
+	}
+	stmt := sqlutil.TxStmt(txn, s.updateInFlightTransactionStmt)
+	_, err := stmt.ExecContext(ctx, serverName, transactionID, pq.Int64Array(pduNIDs), pq.Int64Array(eduNIDs))
+	return err
+}
+
+func (s *transactionIDsStatements) SelectInFlightTransaction(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (transactionID gomatrixserverlib.TransactionID, pduNIDs, eduNIDs []int64, err error) {
+	var pdus, edus pq.Int64Array
+	stmt := sqlutil.TxStmt(txn, s.selectInFlightTransactionStmt)
+	err = stmt.QueryRowContext(ctx, serverName).Scan(&transactionID, &pdus, &edus)
+	if err == sql.ErrNoRows {
+		return "", nil, nil, nil
+	}
+	return transactionID, pdus, edus, err
+}
+
+func (s *transactionIDsStatements) SelectTransactionIDPrefix(
+	ctx context.Context, txn *sql.Tx,
+) (prefix string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectTransactionIDPrefixStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&prefix)
+	return
+}
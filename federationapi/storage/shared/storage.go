@@ -39,6 +39,8 @@ type Database struct {
 	FederationQueueJSON      tables.FederationQueueJSON
 	FederationJoinedHosts    tables.FederationJoinedHosts
 	FederationBlacklist      tables.FederationBlacklist
+	FederationDisabledRooms  tables.FederationDisabledRooms
+	FederationTransactionIDs tables.FederationTransactionIDs
 	NotaryServerKeysJSON     tables.FederationNotaryServerKeysJSON
 	NotaryServerKeysMetadata tables.FederationNotaryServerKeysMetadata
 	ServerSigningKeys        tables.FederationServerSigningKeys
@@ -172,6 +174,79 @@ func (d *Database) IsServerBlacklisted(
 	return d.FederationBlacklist.SelectBlacklist(context.TODO(), nil, serverName)
 }
 
+func (d *Database) GetBlacklistedServers(
+	ctx context.Context,
+) ([]spec.ServerName, error) {
+	return d.FederationBlacklist.SelectAllBlacklist(ctx, nil)
+}
+
+func (d *Database) SetRoomFederationDisabled(
+	ctx context.Context, roomID string, disabled bool,
+) error {
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if disabled {
+			return d.FederationDisabledRooms.InsertDisabledRoom(ctx, txn, roomID)
+		}
+		return d.FederationDisabledRooms.DeleteDisabledRoom(ctx, txn, roomID)
+	})
+	if err != nil {
+		return err
+	}
+	d.Cache.StoreFederationDisabledRoom(roomID, disabled)
+	return nil
+}
+
+// IsRoomFederationDisabled is checked for every federation request about a
+// room, so the answer is cached.
+func (d *Database) IsRoomFederationDisabled(
+	ctx context.Context, roomID string,
+) (bool, error) {
+	if disabled, ok := d.Cache.GetFederationDisabledRoom(roomID); ok {
+		return disabled, nil
+	}
+	disabled, err := d.FederationDisabledRooms.SelectDisabledRoom(ctx, nil, roomID)
+	if err != nil {
+		return false, err
+	}
+	d.Cache.StoreFederationDisabledRoom(roomID, disabled)
+	return disabled, nil
+}
+
+// FederatedRooms looks up any of the rooms whose answer isn't cached in one
+// go, so that it can be used for all of a user's rooms at once.
+func (d *Database) FederatedRooms(
+	ctx context.Context, roomIDs []string,
+) ([]string, error) {
+	var uncached []string
+	for _, roomID := range roomIDs {
+		if _, ok := d.Cache.GetFederationDisabledRoom(roomID); !ok {
+			uncached = append(uncached, roomID)
+		}
+	}
+	var disabledRooms map[string]struct{}
+	if len(uncached) > 0 {
+		var err error
+		if disabledRooms, err = d.FederationDisabledRooms.SelectDisabledRooms(ctx, nil, uncached); err != nil {
+			return nil, err
+		}
+		for _, roomID := range uncached {
+			_, disabled := disabledRooms[roomID]
+			d.Cache.StoreFederationDisabledRoom(roomID, disabled)
+		}
+	}
+	federated := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		disabled, ok := d.Cache.GetFederationDisabledRoom(roomID)
+		if !ok {
+			_, disabled = disabledRooms[roomID]
+		}
+		if !disabled {
+			federated = append(federated, roomID)
+		}
+	}
+	return federated, nil
+}
+
 func (d *Database) UpdateNotaryKeys(
 	ctx context.Context,
 	serverName spec.ServerName,
@@ -222,11 +297,35 @@ func (d *Database) GetNotaryKeys(
 	return sks, err
 }
 
+func (d *Database) GetServerKeys(
+	ctx context.Context, serverName spec.ServerName,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return d.ServerSigningKeys.SelectServerKeys(ctx, nil, serverName)
+}
+
+func (d *Database) PurgeExpiredServerKeys(
+	ctx context.Context, before spec.Timestamp,
+) (deleted []gomatrixserverlib.PublicKeyLookupRequest, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		deleted, err = d.ServerSigningKeys.DeleteExpiredServerKeys(ctx, txn, before)
+		return err
+	})
+	return deleted, err
+}
+
 func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
-	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		if err := d.FederationJoinedHosts.DeleteJoinedHostsForRoom(ctx, txn, roomID); err != nil {
 			return fmt.Errorf("failed to purge joined hosts: %w", err)
 		}
+		if err := d.FederationDisabledRooms.DeleteDisabledRoom(ctx, txn, roomID); err != nil {
+			return fmt.Errorf("failed to purge disabled room: %w", err)
+		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	d.Cache.StoreFederationDisabledRoom(roomID, false)
+	return nil
 }
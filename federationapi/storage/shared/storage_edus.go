@@ -93,34 +93,45 @@ func (d *Database) GetPendingEDUs(
 			return fmt.Errorf("SelectQueueEDUs: %w", err)
 		}
 
-		retrieve := make([]int64, 0, len(nids))
-		for _, nid := range nids {
-			if edu, ok := d.Cache.GetFederationQueuedEDU(nid); ok {
-				newReceipt := receipt.NewReceipt(nid)
-				edus[&newReceipt] = edu
-			} else {
-				retrieve = append(retrieve, nid)
-			}
-		}
+		return d.loadEDUs(ctx, txn, nids, edus)
+	})
+	return
+}
 
-		blobs, err := d.FederationQueueJSON.SelectQueueJSON(ctx, txn, retrieve)
-		if err != nil {
-			return fmt.Errorf("SelectQueueJSON: %w", err)
+// loadEDUs adds the EDUs with the given NIDs to the map, from the
+// cache if possible and otherwise from the database.
+func (d *Database) loadEDUs(
+	ctx context.Context,
+	txn *sql.Tx,
+	nids []int64,
+	edus map[*receipt.Receipt]*gomatrixserverlib.EDU,
+) error {
+	retrieve := make([]int64, 0, len(nids))
+	for _, nid := range nids {
+		if edu, ok := d.Cache.GetFederationQueuedEDU(nid); ok {
+			newReceipt := receipt.NewReceipt(nid)
+			edus[&newReceipt] = edu
+		} else {
+			retrieve = append(retrieve, nid)
 		}
+	}
 
-		for nid, blob := range blobs {
-			var event gomatrixserverlib.EDU
-			if err := json.Unmarshal(blob, &event); err != nil {
-				return fmt.Errorf("json.Unmarshal: %w", err)
-			}
-			newReceipt := receipt.NewReceipt(nid)
-			edus[&newReceipt] = &event
-			d.Cache.StoreFederationQueuedEDU(nid, &event)
+	blobs, err := d.FederationQueueJSON.SelectQueueJSON(ctx, txn, retrieve)
+	if err != nil {
+		return fmt.Errorf("SelectQueueJSON: %w", err)
+	}
+
+	for nid, blob := range blobs {
+		var event gomatrixserverlib.EDU
+		if err := json.Unmarshal(blob, &event); err != nil {
+			return fmt.Errorf("json.Unmarshal: %w", err)
 		}
+		newReceipt := receipt.NewReceipt(nid)
+		edus[&newReceipt] = &event
+		d.Cache.StoreFederationQueuedEDU(nid, &event)
+	}
 
-		return nil
-	})
-	return
+	return nil
 }
 
 // CleanEDUs cleans up all specified EDUs. This is done when a
@@ -134,36 +145,42 @@ func (d *Database) CleanEDUs(
 		return errors.New("expected receipt")
 	}
 
-	nids := make([]int64, len(receipts))
-	for i := range receipts {
-		nids[i] = receipts[i].GetNID()
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.cleanEDUs(ctx, txn, serverName, receiptNIDs(receipts))
+	})
+}
+
+// cleanEDUs removes the EDUs with the given NIDs from the queue for the
+// server, deleting their JSON if no other server is waiting for them.
+func (d *Database) cleanEDUs(
+	ctx context.Context,
+	txn *sql.Tx,
+	serverName spec.ServerName,
+	nids []int64,
+) error {
+	if err := d.FederationQueueEDUs.DeleteQueueEDUs(ctx, txn, serverName, nids); err != nil {
+		return err
 	}
 
-	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		if err := d.FederationQueueEDUs.DeleteQueueEDUs(ctx, txn, serverName, nids); err != nil {
-			return err
+	var deleteNIDs []int64
+	for _, nid := range nids {
+		count, err := d.FederationQueueEDUs.SelectQueueEDUReferenceJSONCount(ctx, txn, nid)
+		if err != nil {
+			return fmt.Errorf("SelectQueueEDUReferenceJSONCount: %w", err)
 		}
-
-		var deleteNIDs []int64
-		for _, nid := range nids {
-			count, err := d.FederationQueueEDUs.SelectQueueEDUReferenceJSONCount(ctx, txn, nid)
-			if err != nil {
-				return fmt.Errorf("SelectQueueEDUReferenceJSONCount: %w", err)
-			}
-			if count == 0 {
-				deleteNIDs = append(deleteNIDs, nid)
-				d.Cache.EvictFederationQueuedEDU(nid)
-			}
+		if count == 0 {
+			deleteNIDs = append(deleteNIDs, nid)
+			d.Cache.EvictFederationQueuedEDU(nid)
 		}
+	}
 
-		if len(deleteNIDs) > 0 {
-			if err := d.FederationQueueJSON.DeleteQueueJSON(ctx, txn, deleteNIDs); err != nil {
-				return fmt.Errorf("DeleteQueueJSON: %w", err)
-			}
+	if len(deleteNIDs) > 0 {
+		if err := d.FederationQueueJSON.DeleteQueueJSON(ctx, txn, deleteNIDs); err != nil {
+			return fmt.Errorf("DeleteQueueJSON: %w", err)
 		}
+	}
 
-		return nil
-	})
+	return nil
 }
 
 // GetPendingServerNames returns the server names that have EDUs
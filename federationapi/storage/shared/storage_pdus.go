@@ -71,34 +71,45 @@ func (d *Database) GetPendingPDUs(
 			return fmt.Errorf("SelectQueuePDUs: %w", err)
 		}
 
-		retrieve := make([]int64, 0, len(nids))
-		for _, nid := range nids {
-			if event, ok := d.Cache.GetFederationQueuedPDU(nid); ok {
-				newReceipt := receipt.NewReceipt(nid)
-				events[&newReceipt] = event
-			} else {
-				retrieve = append(retrieve, nid)
-			}
-		}
+		return d.loadPDUs(ctx, txn, nids, events)
+	})
+	return
+}
 
-		blobs, err := d.FederationQueueJSON.SelectQueueJSON(ctx, txn, retrieve)
-		if err != nil {
-			return fmt.Errorf("SelectQueueJSON: %w", err)
+// loadPDUs adds the PDUs with the given NIDs to the map, from the
+// cache if possible and otherwise from the database.
+func (d *Database) loadPDUs(
+	ctx context.Context,
+	txn *sql.Tx,
+	nids []int64,
+	events map[*receipt.Receipt]*types.HeaderedEvent,
+) error {
+	retrieve := make([]int64, 0, len(nids))
+	for _, nid := range nids {
+		if event, ok := d.Cache.GetFederationQueuedPDU(nid); ok {
+			newReceipt := receipt.NewReceipt(nid)
+			events[&newReceipt] = event
+		} else {
+			retrieve = append(retrieve, nid)
 		}
+	}
 
-		for nid, blob := range blobs {
-			var event types.HeaderedEvent
-			if err := json.Unmarshal(blob, &event); err != nil {
-				return fmt.Errorf("json.Unmarshal: %w", err)
-			}
-			newReceipt := receipt.NewReceipt(nid)
-			events[&newReceipt] = &event
-			d.Cache.StoreFederationQueuedPDU(nid, &event)
+	blobs, err := d.FederationQueueJSON.SelectQueueJSON(ctx, txn, retrieve)
+	if err != nil {
+		return fmt.Errorf("SelectQueueJSON: %w", err)
+	}
+
+	for nid, blob := range blobs {
+		var event types.HeaderedEvent
+		if err := json.Unmarshal(blob, &event); err != nil {
+			return fmt.Errorf("json.Unmarshal: %w", err)
 		}
+		newReceipt := receipt.NewReceipt(nid)
+		events[&newReceipt] = &event
+		d.Cache.StoreFederationQueuedPDU(nid, &event)
+	}
 
-		return nil
-	})
-	return
+	return nil
 }
 
 // CleanTransactionPDUs cleans up all associated events for a
@@ -113,36 +124,42 @@ func (d *Database) CleanPDUs(
 		return errors.New("expected receipt")
 	}
 
-	nids := make([]int64, len(receipts))
-	for i := range receipts {
-		nids[i] = receipts[i].GetNID()
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.cleanPDUs(ctx, txn, serverName, receiptNIDs(receipts))
+	})
+}
+
+// cleanPDUs removes the PDUs with the given NIDs from the queue for the
+// server, deleting their JSON if no other server is waiting for them.
+func (d *Database) cleanPDUs(
+	ctx context.Context,
+	txn *sql.Tx,
+	serverName spec.ServerName,
+	nids []int64,
+) error {
+	if err := d.FederationQueuePDUs.DeleteQueuePDUs(ctx, txn, serverName, nids); err != nil {
+		return err
 	}
 
-	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		if err := d.FederationQueuePDUs.DeleteQueuePDUs(ctx, txn, serverName, nids); err != nil {
-			return err
+	var deleteNIDs []int64
+	for _, nid := range nids {
+		count, err := d.FederationQueuePDUs.SelectQueuePDUReferenceJSONCount(ctx, txn, nid)
+		if err != nil {
+			return fmt.Errorf("SelectQueuePDUReferenceJSONCount: %w", err)
 		}
-
-		var deleteNIDs []int64
-		for _, nid := range nids {
-			count, err := d.FederationQueuePDUs.SelectQueuePDUReferenceJSONCount(ctx, txn, nid)
-			if err != nil {
-				return fmt.Errorf("SelectQueuePDUReferenceJSONCount: %w", err)
-			}
-			if count == 0 {
-				deleteNIDs = append(deleteNIDs, nid)
-				d.Cache.EvictFederationQueuedPDU(nid)
-			}
+		if count == 0 {
+			deleteNIDs = append(deleteNIDs, nid)
+			d.Cache.EvictFederationQueuedPDU(nid)
 		}
+	}
 
-		if len(deleteNIDs) > 0 {
-			if err := d.FederationQueueJSON.DeleteQueueJSON(ctx, txn, deleteNIDs); err != nil {
-				return fmt.Errorf("DeleteQueueJSON: %w", err)
-			}
+	if len(deleteNIDs) > 0 {
+		if err := d.FederationQueueJSON.DeleteQueueJSON(ctx, txn, deleteNIDs); err != nil {
+			return fmt.Errorf("DeleteQueueJSON: %w", err)
 		}
+	}
 
-		return nil
-	})
+	return nil
 }
 
 // GetPendingServerNames returns the server names that have PDUs
@@ -0,0 +1,166 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/neilalexander/harmony/federationapi/storage/shared/receipt"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/types"
+)
+
+// GetPendingSummary returns how many PDUs and EDUs are waiting to be
+// sent to the given server, and when the oldest of them was queued.
+func (d *Database) GetPendingSummary(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (pdus, edus int64, oldest spec.Timestamp, err error) {
+	var oldestPDU, oldestEDU spec.Timestamp
+	if pdus, oldestPDU, err = d.FederationQueuePDUs.SelectQueuePDUSummary(ctx, nil, serverName); err != nil {
+		return 0, 0, 0, fmt.Errorf("SelectQueuePDUSummary: %w", err)
+	}
+	if edus, oldestEDU, err = d.FederationQueueEDUs.SelectQueueEDUSummary(ctx, nil, serverName); err != nil {
+		return 0, 0, 0, fmt.Errorf("SelectQueueEDUSummary: %w", err)
+	}
+	oldest = oldestPDU
+	if oldest == 0 || (oldestEDU != 0 && oldestEDU < oldest) {
+		oldest = oldestEDU
+	}
+	return pdus, edus, oldest, nil
+}
+
+// StartTransaction returns the next transaction ID for the given
+// server and stores the PDUs and EDUs in the transaction with it.
+// The counter is stored so that transaction IDs aren't reused after
+// restarting, and the transaction can be retried unchanged. It's put
+// after the database's random prefix, so that IDs aren't reused when
+// the counter goes backwards either, because the database was reset or
+// restored from a backup.
+func (d *Database) StartTransaction(
+	ctx context.Context,
+	serverName spec.ServerName,
+	pdus, edus []*receipt.Receipt,
+) (transactionID gomatrixserverlib.TransactionID, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		prefix, err := d.FederationTransactionIDs.SelectTransactionIDPrefix(ctx, txn)
+		if err != nil {
+			return fmt.Errorf("SelectTransactionIDPrefix: %w", err)
+		}
+		counter, err := d.FederationTransactionIDs.NextTransactionID(ctx, txn, serverName)
+		if err != nil {
+			return fmt.Errorf("NextTransactionID: %w", err)
+		}
+		transactionID = gomatrixserverlib.TransactionID(fmt.Sprintf("%s-%d", prefix, counter))
+		return d.FederationTransactionIDs.UpdateInFlightTransaction(
+			ctx, txn, serverName, transactionID, receiptNIDs(pdus), receiptNIDs(edus),
+		)
+	})
+	return
+}
+
+// GetInFlightTransaction returns the transaction which was started for
+// the given server but not finished, if any. PDUs and EDUs which are no
+// longer in the database are left out.
+func (d *Database) GetInFlightTransaction(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (
+	transactionID gomatrixserverlib.TransactionID,
+	pdus map[*receipt.Receipt]*types.HeaderedEvent,
+	edus map[*receipt.Receipt]*gomatrixserverlib.EDU,
+	err error,
+) {
+	pdus = make(map[*receipt.Receipt]*types.HeaderedEvent)
+	edus = make(map[*receipt.Receipt]*gomatrixserverlib.EDU)
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		id, pduNIDs, eduNIDs, err := d.FederationTransactionIDs.SelectInFlightTransaction(ctx, txn, serverName)
+		if err != nil {
+			return fmt.Errorf("SelectInFlightTransaction: %w", err)
+		}
+		transactionID = id
+		if err = d.loadPDUs(ctx, txn, pduNIDs, pdus); err != nil {
+			return err
+		}
+		return d.loadEDUs(ctx, txn, eduNIDs, edus)
+	})
+	return
+}
+
+// FinishTransaction cleans up the PDUs and EDUs in a transaction which
+// was sent successfully, and forgets about the in-flight transaction.
+func (d *Database) FinishTransaction(
+	ctx context.Context,
+	serverName spec.ServerName,
+	pdus, edus []*receipt.Receipt,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if len(pdus) > 0 {
+			if err := d.cleanPDUs(ctx, txn, serverName, receiptNIDs(pdus)); err != nil {
+				return fmt.Errorf("cleanPDUs: %w", err)
+			}
+		}
+		if len(edus) > 0 {
+			if err := d.cleanEDUs(ctx, txn, serverName, receiptNIDs(edus)); err != nil {
+				return fmt.Errorf("cleanEDUs: %w", err)
+			}
+		}
+		return d.FederationTransactionIDs.UpdateInFlightTransaction(ctx, txn, serverName, "", nil, nil)
+	})
+}
+
+func receiptNIDs(receipts []*receipt.Receipt) []int64 {
+	nids := make([]int64, len(receipts))
+	for i := range receipts {
+		nids[i] = receipts[i].GetNID()
+	}
+	return nids
+}
+
+// DropPending removes all of the PDUs and EDUs that are waiting to
+// be sent to the given server.
+func (d *Database) DropPending(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		pduNIDs, err := d.FederationQueuePDUs.DeleteAllQueuePDUs(ctx, txn, serverName)
+		if err != nil {
+			return fmt.Errorf("DeleteAllQueuePDUs: %w", err)
+		}
+		eduNIDs, err := d.FederationQueueEDUs.DeleteAllQueueEDUs(ctx, txn, serverName)
+		if err != nil {
+			return fmt.Errorf("DeleteAllQueueEDUs: %w", err)
+		}
+
+		var deleteNIDs []int64
+		for _, nid := range pduNIDs {
+			count, err := d.FederationQueuePDUs.SelectQueuePDUReferenceJSONCount(ctx, txn, nid)
+			if err != nil {
+				return fmt.Errorf("SelectQueuePDUReferenceJSONCount: %w", err)
+			}
+			if count == 0 {
+				deleteNIDs = append(deleteNIDs, nid)
+				d.Cache.EvictFederationQueuedPDU(nid)
+			}
+		}
+		for _, nid := range eduNIDs {
+			count, err := d.FederationQueueEDUs.SelectQueueEDUReferenceJSONCount(ctx, txn, nid)
+			if err != nil {
+				return fmt.Errorf("SelectQueueEDUReferenceJSONCount: %w", err)
+			}
+			if count == 0 {
+				deleteNIDs = append(deleteNIDs, nid)
+				d.Cache.EvictFederationQueuedEDU(nid)
+			}
+		}
+
+		if len(deleteNIDs) > 0 {
+			if err := d.FederationQueueJSON.DeleteQueueJSON(ctx, txn, deleteNIDs); err != nil {
+				return fmt.Errorf("DeleteQueueJSON: %w", err)
+			}
+		}
+		return d.FederationTransactionIDs.UpdateInFlightTransaction(ctx, txn, serverName, "", nil, nil)
+	})
+}
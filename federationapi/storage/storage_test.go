@@ -7,6 +7,7 @@ import (
 
 	"github.com/neilalexander/harmony/federationapi/storage"
 	"github.com/neilalexander/harmony/internal/caching"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/setup/config"
@@ -81,3 +82,96 @@ func TestExpireEDUs(t *testing.T) {
 		assert.Equal(t, 2, len(data))
 	})
 }
+
+func TestPurgeExpiredServerKeys(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateFederationDatabase(t, dbType)
+		defer close()
+
+		key := func(serverName spec.ServerName, keyID gomatrixserverlib.KeyID) gomatrixserverlib.PublicKeyLookupRequest {
+			return gomatrixserverlib.PublicKeyLookupRequest{ServerName: serverName, KeyID: keyID}
+		}
+		err := db.StoreKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			// Replaced by ed25519:new and stopped being valid before the purge time.
+			key("remote", "ed25519:old"): {ValidUntilTS: 1000},
+			// Marked as expired by the server, so needed to verify old events.
+			key("remote", "ed25519:expired"): {ValidUntilTS: 1000, ExpiredTS: 900},
+			// Replaced by ed25519:new, but still valid at the purge time.
+			key("remote", "ed25519:recent"): {ValidUntilTS: 6000},
+			key("remote", "ed25519:new"):    {ValidUntilTS: 10000},
+			// The only key that we have for the server, so not replaced.
+			key("other", "ed25519:only"): {ValidUntilTS: 1000},
+		})
+		assert.NoError(t, err)
+
+		keys, err := db.GetServerKeys(ctx, "")
+		assert.NoError(t, err)
+		assert.Len(t, keys, 5)
+		keys, err = db.GetServerKeys(ctx, "remote")
+		assert.NoError(t, err)
+		assert.Len(t, keys, 4)
+		assert.Equal(t, spec.Timestamp(900), keys[key("remote", "ed25519:expired")].ExpiredTS)
+
+		purged, err := db.PurgeExpiredServerKeys(ctx, 5000)
+		assert.NoError(t, err)
+		assert.Equal(t, []gomatrixserverlib.PublicKeyLookupRequest{key("remote", "ed25519:old")}, purged)
+
+		keys, err = db.GetServerKeys(ctx, "")
+		assert.NoError(t, err)
+		assert.Len(t, keys, 4)
+		assert.NotContains(t, keys, key("remote", "ed25519:old"))
+	})
+}
+
+func TestRoomFederationDisabled(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateFederationDatabase(t, dbType)
+		defer close()
+
+		// The answer is cached, so changes must update the cache too.
+		roomID := "!room:localhost"
+		disabled, err := db.IsRoomFederationDisabled(ctx, roomID)
+		assert.NoError(t, err)
+		assert.False(t, disabled)
+
+		assert.NoError(t, db.SetRoomFederationDisabled(ctx, roomID, true))
+		disabled, err = db.IsRoomFederationDisabled(ctx, roomID)
+		assert.NoError(t, err)
+		assert.True(t, disabled)
+
+		// Rooms whose answer is cached and those whose answer isn't can be
+		// looked up together.
+		otherRoomID := "!other:localhost"
+		assert.NoError(t, db.SetRoomFederationDisabled(ctx, otherRoomID, true))
+		federated, err := db.FederatedRooms(ctx, []string{"!a:localhost", roomID, otherRoomID, "!b:localhost"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"!a:localhost", "!b:localhost"}, federated)
+
+		assert.NoError(t, db.PurgeRoom(ctx, roomID))
+		disabled, err = db.IsRoomFederationDisabled(ctx, roomID)
+		assert.NoError(t, err)
+		assert.False(t, disabled)
+	})
+}
+
+func TestTransactionIDsNotReusedAfterReset(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateFederationDatabase(t, dbType)
+		first, err := db.StartTransaction(ctx, "remote", nil, nil)
+		assert.NoError(t, err)
+		second, err := db.StartTransaction(ctx, "remote", nil, nil)
+		assert.NoError(t, err)
+		assert.NotEqual(t, first, second)
+		close()
+
+		// A new database counts from the start again, but with a new prefix.
+		db, close = mustCreateFederationDatabase(t, dbType)
+		defer close()
+		reset, err := db.StartTransaction(ctx, "remote", nil, nil)
+		assert.NoError(t, err)
+		assert.NotEqual(t, first, reset)
+	})
+}
@@ -31,6 +31,10 @@ type FederationQueuePDUs interface {
 	SelectQueuePDUReferenceJSONCount(ctx context.Context, txn *sql.Tx, jsonNID int64) (int64, error)
 	SelectQueuePDUs(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, limit int) ([]int64, error)
 	SelectQueuePDUServerNames(ctx context.Context, txn *sql.Tx) ([]spec.ServerName, error)
+	// SelectQueuePDUSummary returns the number of PDUs queued for the server and when the oldest was queued.
+	SelectQueuePDUSummary(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (count int64, oldest spec.Timestamp, err error)
+	// DeleteAllQueuePDUs removes all of the PDUs queued for the server, returning their JSON NIDs.
+	DeleteAllQueuePDUs(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) ([]int64, error)
 }
 
 type FederationQueueEDUs interface {
@@ -39,6 +43,10 @@ type FederationQueueEDUs interface {
 	SelectQueueEDUs(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, limit int) ([]int64, error)
 	SelectQueueEDUReferenceJSONCount(ctx context.Context, txn *sql.Tx, jsonNID int64) (int64, error)
 	SelectQueueEDUServerNames(ctx context.Context, txn *sql.Tx) ([]spec.ServerName, error)
+	// SelectQueueEDUSummary returns the number of EDUs queued for the server and when the oldest was queued.
+	SelectQueueEDUSummary(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (count int64, oldest spec.Timestamp, err error)
+	// DeleteAllQueueEDUs removes all of the EDUs queued for the server, returning their JSON NIDs.
+	DeleteAllQueueEDUs(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) ([]int64, error)
 	SelectExpiredEDUs(ctx context.Context, txn *sql.Tx, expiredBefore spec.Timestamp) ([]int64, error)
 	DeleteExpiredEDUs(ctx context.Context, txn *sql.Tx, expiredBefore spec.Timestamp) error
 	Prepare() error
@@ -76,10 +84,32 @@ type FederationJoinedHosts interface {
 type FederationBlacklist interface {
 	InsertBlacklist(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) error
 	SelectBlacklist(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (bool, error)
+	SelectAllBlacklist(ctx context.Context, txn *sql.Tx) ([]spec.ServerName, error)
 	DeleteBlacklist(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) error
 	DeleteAllBlacklist(ctx context.Context, txn *sql.Tx) error
 }
 
+type FederationTransactionIDs interface {
+	// NextTransactionID increments and returns the transaction counter for the server.
+	NextTransactionID(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (int64, error)
+	// SelectTransactionIDPrefix returns the random prefix which was chosen for
+	// transaction IDs when the database was created.
+	SelectTransactionIDPrefix(ctx context.Context, txn *sql.Tx) (string, error)
+	// UpdateInFlightTransaction stores the transaction being sent to the server, or clears it
+	// if the transaction ID is empty.
+	UpdateInFlightTransaction(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, transactionID gomatrixserverlib.TransactionID, pduNIDs, eduNIDs []int64) error
+	// SelectInFlightTransaction returns the transaction being sent to the server, if any.
+	SelectInFlightTransaction(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (gomatrixserverlib.TransactionID, []int64, []int64, error)
+}
+
+type FederationDisabledRooms interface {
+	InsertDisabledRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	SelectDisabledRoom(ctx context.Context, txn *sql.Tx, roomID string) (bool, error)
+	// SelectDisabledRooms returns which of the rooms have federation disabled.
+	SelectDisabledRooms(ctx context.Context, txn *sql.Tx, roomIDs []string) (map[string]struct{}, error)
+	DeleteDisabledRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+}
+
 // FederationNotaryServerKeysJSON contains the byte-for-byte responses from servers which contain their keys and is signed by them.
 type FederationNotaryServerKeysJSON interface {
 	// InsertJSONResponse inserts a new response JSON. Useless on its own, needs querying via FederationNotaryServerKeysMetadata
@@ -105,4 +135,11 @@ type FederationNotaryServerKeysMetadata interface {
 type FederationServerSigningKeys interface {
 	BulkSelectServerKeys(ctx context.Context, txn *sql.Tx, requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
 	UpsertServerKeys(ctx context.Context, txn *sql.Tx, request gomatrixserverlib.PublicKeyLookupRequest, key gomatrixserverlib.PublicKeyLookupResult) error
+	// SelectServerKeys returns all of the keys for the server, or for every server if serverName is empty.
+	SelectServerKeys(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
+	// DeleteExpiredServerKeys removes the keys which were only valid until before the given time
+	// and which have been replaced by a key for the same server that is valid for longer, returning
+	// which keys were removed. Keys which the server has expired are kept, as they are still needed
+	// to verify old events.
+	DeleteExpiredServerKeys(ctx context.Context, txn *sql.Tx, before spec.Timestamp) ([]gomatrixserverlib.PublicKeyLookupRequest, error)
 }
@@ -15,6 +15,9 @@ type FederationCache interface {
 	GetFederationQueuedEDU(eventNID int64) (event *gomatrixserverlib.EDU, ok bool)
 	StoreFederationQueuedEDU(eventNID int64, event *gomatrixserverlib.EDU)
 	EvictFederationQueuedEDU(eventNID int64)
+
+	GetFederationDisabledRoom(roomID string) (disabled bool, ok bool)
+	StoreFederationDisabledRoom(roomID string, disabled bool)
 }
 
 func (c Caches) GetFederationQueuedPDU(eventNID int64) (*types.HeaderedEvent, bool) {
@@ -40,3 +43,11 @@ func (c Caches) StoreFederationQueuedEDU(eventNID int64, event *gomatrixserverli
 func (c Caches) EvictFederationQueuedEDU(eventNID int64) {
 	c.FederationEDUs.Unset(eventNID)
 }
+
+func (c Caches) GetFederationDisabledRoom(roomID string) (bool, bool) {
+	return c.FederationDisabledRooms.Get(roomID)
+}
+
+func (c Caches) StoreFederationDisabledRoom(roomID string, disabled bool) {
+	c.FederationDisabledRooms.Set(roomID, disabled)
+}
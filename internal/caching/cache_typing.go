@@ -170,6 +170,16 @@ func (t *EDUCache) RemoveUser(userID, roomID string) int64 {
 	return t.latestSyncPosition
 }
 
+// SetLatestSyncPosition moves the latest sync position forward, so that typing
+// positions carry on from where they were before a restart.
+func (t *EDUCache) SetLatestSyncPosition(pos int64) {
+	t.Lock()
+	defer t.Unlock()
+	if pos > t.latestSyncPosition {
+		t.latestSyncPosition = pos
+	}
+}
+
 func (t *EDUCache) GetLatestSyncPosition() int64 {
 	t.Lock()
 	defer t.Unlock()
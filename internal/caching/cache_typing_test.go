@@ -101,3 +101,15 @@ func testRemoveUser(t *testing.T, tCache *EDUCache) {
 		}
 	}
 }
+
+func TestEDUCacheSetLatestSyncPosition(t *testing.T) {
+	tCache := NewTypingCache()
+	tCache.SetLatestSyncPosition(100)
+	if pos := tCache.AddTypingUser("user1", "room1", nil); pos != 101 {
+		t.Fatalf("expected typing to carry on from the set position, got %d", pos)
+	}
+	tCache.SetLatestSyncPosition(50)
+	if pos := tCache.GetLatestSyncPosition(); pos != 101 {
+		t.Fatalf("expected the position not to go backwards, got %d", pos)
+	}
+}
@@ -0,0 +1,20 @@
+package caching
+
+import "github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+
+// VerifiedEventCache remembers which events received from an origin have
+// already passed signature checks, so that events which are sent to us more
+// than once, e.g. in retried transactions, aren't verified again.
+type VerifiedEventCache interface {
+	IsEventVerified(origin spec.ServerName, eventID string) bool
+	StoreVerifiedEvent(origin spec.ServerName, eventID string)
+}
+
+func (c Caches) IsEventVerified(origin spec.ServerName, eventID string) bool {
+	verified, ok := c.VerifiedEvents.Get(string(origin) + "\000" + eventID)
+	return ok && verified
+}
+
+func (c Caches) StoreVerifiedEvent(origin spec.ServerName, eventID string) {
+	c.VerifiedEvents.Set(string(origin)+"\000"+eventID, true)
+}
@@ -36,7 +36,8 @@ type Caches struct {
 	FederationPDUs          Cache[int64, *types.HeaderedEvent]                     // queue NID -> PDU
 	FederationEDUs          Cache[int64, *gomatrixserverlib.EDU]                   // queue NID -> EDU
 	RoomHierarchies         Cache[string, fclient.RoomHierarchyResponse]           // room ID -> space response
-	LazyLoading             Cache[lazyLoadingCacheKey, string]                     // composite key -> event ID
+	VerifiedEvents          Cache[string, bool]                                    // origin + event ID -> verified
+	FederationDisabledRooms Cache[string, bool]                                    // room ID -> federation disabled
 }
 
 // Cache is the interface that an implementation must satisfy.
@@ -48,7 +49,7 @@ type Cache[K keyable, T any] interface {
 
 type keyable interface {
 	// from https://github.com/dgraph-io/ristretto/blob/8e850b710d6df0383c375ec6a7beae4ce48fc8d5/z/z.go#L34
-	~uint64 | ~string | []byte | byte | ~int | ~int32 | ~uint32 | ~int64 | lazyLoadingCacheKey
+	~uint64 | ~string | []byte | byte | ~int | ~int32 | ~uint32 | ~int64
 }
 
 type costable interface {
@@ -40,11 +40,12 @@ const (
 	federationPDUsCache
 	federationEDUsCache
 	spaceSummaryRoomsCache
-	lazyLoadingCache
 	eventStateKeyCache
 	eventTypeCache
 	eventTypeNIDCache
 	eventStateKeyNIDCache
+	verifiedEventsCache
+	federationDisabledRoomsCache
 )
 
 const (
@@ -52,19 +53,61 @@ const (
 	EnableMetrics  = true
 )
 
+// cacheNames labels the metrics for each partition, and is how the
+// partitions are referred to in the cache config.
+var cacheNames = map[byte]string{
+	roomVersionsCache:            "room_versions",
+	serverKeysCache:              "server_keys",
+	roomNIDsCache:                "room_nids",
+	roomIDsCache:                 "room_ids",
+	roomEventsCache:              "room_events",
+	federationPDUsCache:          "federation_pdus",
+	federationEDUsCache:          "federation_edus",
+	spaceSummaryRoomsCache:       "space_summary_rooms",
+	eventStateKeyCache:           "event_state_keys",
+	eventTypeCache:               "event_types",
+	eventTypeNIDCache:            "event_type_nids",
+	eventStateKeyNIDCache:        "event_state_key_nids",
+	verifiedEventsCache:          "verified_events",
+	federationDisabledRoomsCache: "federation_disabled_rooms",
+}
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheMisses, cacheEvictions)
+}
+
+var (
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "caching_ristretto",
+		Name:      "hits_total",
+		Help:      "Total number of lookups which were found in the cache",
+	}, []string{"cache"})
+	cacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "caching_ristretto",
+		Name:      "misses_total",
+		Help:      "Total number of lookups which weren't found in the cache",
+	}, []string{"cache"})
+	cacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "caching_ristretto",
+		Name:      "evictions_total",
+		Help:      "Total number of entries evicted from the cache to make room for others",
+	}, []string{"cache"})
+)
+
 func NewRistrettoCache(maxCost config.DataUnit, maxAge time.Duration, enablePrometheus bool) *Caches {
-	cache, err := ristretto.NewCache(&ristretto.Config{
-		NumCounters: int64((maxCost / 1024) * 10), // 10 counters per 1KB data, affects bloom filter size
-		BufferItems: 64,                           // recommended by the ristretto godocs as a sane buffer size value
-		MaxCost:     int64(maxCost),               // max cost is in bytes, as per the Dendrite config
-		Metrics:     true,
-		KeyToHash: func(key interface{}) (uint64, uint64) {
-			return z.KeyToHash(key)
-		},
-	})
-	if err != nil {
-		panic(err)
-	}
+	return NewRistrettoCacheFromConfig(&config.Cache{
+		EstimatedMaxSize: maxCost,
+		MaxAge:           maxAge,
+	}, enablePrometheus)
+}
+
+// NewRistrettoCacheFromConfig creates the caches, all sharing one global
+// cache except for those which are given their own size in the config.
+func NewRistrettoCacheFromConfig(cfg *config.Cache, enablePrometheus bool) *Caches {
+	cache := newRistretto(cfg.EstimatedMaxSize)
 	if enablePrometheus {
 		promauto.NewGaugeFunc(prometheus.GaugeOpts{
 			Namespace: "dendrite",
@@ -81,85 +124,88 @@ func NewRistrettoCache(maxCost config.DataUnit, maxAge time.Duration, enableProm
 			return float64(cache.Metrics.CostAdded() - cache.Metrics.CostEvicted())
 		})
 	}
+	b := &cacheBuilder{cfg: cfg, shared: cache}
 	return &Caches{
-		RoomVersions: &RistrettoCachePartition[string, gomatrixserverlib.RoomVersion]{ // room ID -> room version
-			cache:  cache,
-			Prefix: roomVersionsCache,
-			MaxAge: maxAge,
-		},
-		ServerKeys: &RistrettoCachePartition[string, gomatrixserverlib.PublicKeyLookupResult]{ // server name -> server keys
-			cache:   cache,
-			Prefix:  serverKeysCache,
-			Mutable: true,
-			MaxAge:  maxAge,
-		},
-		RoomServerRoomNIDs: &RistrettoCachePartition[string, types.RoomNID]{ // room ID -> room NID
-			cache:  cache,
-			Prefix: roomNIDsCache,
-			MaxAge: maxAge,
-		},
-		RoomServerRoomIDs: &RistrettoCachePartition[types.RoomNID, string]{ // room NID -> room ID
-			cache:  cache,
-			Prefix: roomIDsCache,
-			MaxAge: maxAge,
-		},
+		RoomVersions:       newPartition[string, gomatrixserverlib.RoomVersion](b, roomVersionsCache, false),        // room ID -> room version
+		ServerKeys:         newPartition[string, gomatrixserverlib.PublicKeyLookupResult](b, serverKeysCache, true), // server name -> server keys
+		RoomServerRoomNIDs: newPartition[string, types.RoomNID](b, roomNIDsCache, false),                            // room ID -> room NID
+		RoomServerRoomIDs:  newPartition[types.RoomNID, string](b, roomIDsCache, false),                             // room NID -> room ID
 		RoomServerEvents: &RistrettoCostedCachePartition[int64, *types.HeaderedEvent]{ // event NID -> event
-			&RistrettoCachePartition[int64, *types.HeaderedEvent]{
-				cache:   cache,
-				Prefix:  roomEventsCache,
-				MaxAge:  maxAge,
-				Mutable: true,
-			},
-		},
-		RoomServerStateKeys: &RistrettoCachePartition[types.EventStateKeyNID, string]{ // event NID -> event state key
-			cache:  cache,
-			Prefix: eventStateKeyCache,
-			MaxAge: maxAge,
-		},
-		RoomServerStateKeyNIDs: &RistrettoCachePartition[string, types.EventStateKeyNID]{ // eventStateKey -> eventStateKey NID
-			cache:  cache,
-			Prefix: eventStateKeyNIDCache,
-			MaxAge: maxAge,
-		},
-		RoomServerEventTypeNIDs: &RistrettoCachePartition[string, types.EventTypeNID]{ // eventType -> eventType NID
-			cache:  cache,
-			Prefix: eventTypeCache,
-			MaxAge: maxAge,
-		},
-		RoomServerEventTypes: &RistrettoCachePartition[types.EventTypeNID, string]{ // eventType NID -> eventType
-			cache:  cache,
-			Prefix: eventTypeNIDCache,
-			MaxAge: maxAge,
+			newPartition[int64, *types.HeaderedEvent](b, roomEventsCache, true),
 		},
+		RoomServerStateKeys:     newPartition[types.EventStateKeyNID, string](b, eventStateKeyCache, false),    // event NID -> event state key
+		RoomServerStateKeyNIDs:  newPartition[string, types.EventStateKeyNID](b, eventStateKeyNIDCache, false), // eventStateKey -> eventStateKey NID
+		RoomServerEventTypeNIDs: newPartition[string, types.EventTypeNID](b, eventTypeCache, false),            // eventType -> eventType NID
+		RoomServerEventTypes:    newPartition[types.EventTypeNID, string](b, eventTypeNIDCache, false),         // eventType NID -> eventType
 		FederationPDUs: &RistrettoCostedCachePartition[int64, *types.HeaderedEvent]{ // queue NID -> PDU
-			&RistrettoCachePartition[int64, *types.HeaderedEvent]{
-				cache:   cache,
-				Prefix:  federationPDUsCache,
-				Mutable: true,
-				MaxAge:  lesserOf(time.Hour/2, maxAge),
-			},
+			newPartition[int64, *types.HeaderedEvent](b, federationPDUsCache, true),
 		},
 		FederationEDUs: &RistrettoCostedCachePartition[int64, *gomatrixserverlib.EDU]{ // queue NID -> EDU
-			&RistrettoCachePartition[int64, *gomatrixserverlib.EDU]{
-				cache:   cache,
-				Prefix:  federationEDUsCache,
-				Mutable: true,
-				MaxAge:  lesserOf(time.Hour/2, maxAge),
-			},
-		},
-		RoomHierarchies: &RistrettoCachePartition[string, fclient.RoomHierarchyResponse]{ // room ID -> space response
-			cache:   cache,
-			Prefix:  spaceSummaryRoomsCache,
-			Mutable: true,
-			MaxAge:  maxAge,
+			newPartition[int64, *gomatrixserverlib.EDU](b, federationEDUsCache, true),
 		},
-		LazyLoading: &RistrettoCachePartition[lazyLoadingCacheKey, string]{ // composite key -> event ID
-			cache:   cache,
-			Prefix:  lazyLoadingCache,
-			Mutable: true,
-			MaxAge:  maxAge,
+		RoomHierarchies:         newPartition[string, fclient.RoomHierarchyResponse](b, spaceSummaryRoomsCache, true), // room ID -> space response
+		VerifiedEvents:          newPartition[string, bool](b, verifiedEventsCache, false),                            // origin + event ID -> verified
+		FederationDisabledRooms: newPartition[string, bool](b, federationDisabledRoomsCache, true),                    // room ID -> federation disabled
+	}
+}
+
+// cacheBuilder decides which cache each partition uses and for how long
+// entries are kept.
+type cacheBuilder struct {
+	cfg    *config.Cache
+	shared *ristretto.Cache
+}
+
+func newPartition[K keyable, V any](b *cacheBuilder, prefix byte, mutable bool) *RistrettoCachePartition[K, V] {
+	name := cacheNames[prefix]
+	size, maxAge := b.cfg.Options(name)
+	if _, ok := b.cfg.Caches[name]; !ok && (prefix == federationPDUsCache || prefix == federationEDUsCache) {
+		// Queued federation events are only cached for a short time unless
+		// configured otherwise, as they are usually sent straight away.
+		maxAge = lesserOf(time.Hour/2, maxAge)
+	}
+	cache := b.shared
+	if size > 0 {
+		cache = newRistretto(size)
+	}
+	return &RistrettoCachePartition[K, V]{
+		cache:   cache,
+		Prefix:  prefix,
+		Mutable: mutable,
+		MaxAge:  maxAge,
+		hits:    cacheHits.WithLabelValues(name),
+		misses:  cacheMisses.WithLabelValues(name),
+	}
+}
+
+func newRistretto(maxCost config.DataUnit) *ristretto.Cache {
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: max(int64((maxCost/1024)*10), 100), // 10 counters per 1KB data, affects bloom filter size
+		BufferItems: 64,                                 // recommended by the ristretto godocs as a sane buffer size value
+		MaxCost:     int64(maxCost),                     // max cost is in bytes, as per the Dendrite config
+		Metrics:     true,
+		KeyToHash:   keyToHash,
+		OnEvict: func(item *ristretto.Item) {
+			if name, ok := cacheNames[byte(item.Conflict)]; ok {
+				cacheEvictions.WithLabelValues(name).Inc()
+			}
 		},
+	})
+	if err != nil {
+		panic(err)
 	}
+	return cache
+}
+
+// keyToHash hashes the cache key as normal, but keeps the partition prefix
+// in the low byte of the conflict hash. Evicted items only carry the hashes
+// and not the key, so this is how evictions are attributed to a partition.
+func keyToHash(key interface{}) (uint64, uint64) {
+	keyHash, conflictHash := z.KeyToHash(key)
+	if s, ok := key.(string); ok && len(s) > 0 {
+		conflictHash = conflictHash&^0xff | uint64(s[0])
+	}
+	return keyHash, conflictHash
 }
 
 type RistrettoCostedCachePartition[k keyable, v costable] struct {
@@ -176,6 +222,8 @@ type RistrettoCachePartition[K keyable, V any] struct {
 	Prefix  byte
 	Mutable bool
 	MaxAge  time.Duration
+	hits    prometheus.Counter
+	misses  prometheus.Counter
 }
 
 func (c *RistrettoCachePartition[K, V]) setWithCost(key K, value V, cost int64) {
@@ -210,10 +258,15 @@ func (c *RistrettoCachePartition[K, V]) Get(key K) (value V, ok bool) {
 	bkey := fmt.Sprintf("%c%v", c.Prefix, key)
 	v, ok := c.cache.Get(bkey)
 	if !ok || v == nil {
+		c.misses.Inc()
 		var empty V
 		return empty, false
 	}
-	value, ok = v.(V)
+	if value, ok = v.(V); ok {
+		c.hits.Inc()
+	} else {
+		c.misses.Inc()
+	}
 	return
 }
 
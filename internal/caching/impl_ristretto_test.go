@@ -0,0 +1,82 @@
+package caching
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func TestCacheNames(t *testing.T) {
+	if len(cacheNames) != len(config.CacheNames) {
+		t.Fatalf("got %d cache names but the config has %d", len(cacheNames), len(config.CacheNames))
+	}
+	for prefix, name := range cacheNames {
+		if !slices.Contains(config.CacheNames, name) {
+			t.Errorf("cache %d has name %q which isn't in the config", prefix, name)
+		}
+	}
+}
+
+func TestPerCacheOptions(t *testing.T) {
+	caches := NewRistrettoCacheFromConfig(&config.Cache{
+		EstimatedMaxSize: 8 * 1024 * 1024,
+		MaxAge:           time.Hour,
+		Caches: map[string]config.CacheOptions{
+			"room_versions": {EstimatedMaxSize: 1024 * 1024},
+			"room_ids":      {MaxAge: time.Minute},
+		},
+	}, DisableMetrics)
+
+	roomVersions := caches.RoomVersions.(*RistrettoCachePartition[string, gomatrixserverlib.RoomVersion])
+	roomIDs := caches.RoomServerRoomIDs.(*RistrettoCachePartition[types.RoomNID, string])
+	roomNIDs := caches.RoomServerRoomNIDs.(*RistrettoCachePartition[string, types.RoomNID])
+	if roomVersions.cache == roomNIDs.cache {
+		t.Error("room_versions should have its own cache")
+	}
+	if roomIDs.cache != roomNIDs.cache {
+		t.Error("room_ids should share the global cache")
+	}
+	if roomIDs.MaxAge != time.Minute || roomNIDs.MaxAge != time.Hour {
+		t.Errorf("unexpected max ages %s and %s", roomIDs.MaxAge, roomNIDs.MaxAge)
+	}
+	pdus := caches.FederationPDUs.(*RistrettoCostedCachePartition[int64, *types.HeaderedEvent])
+	if pdus.MaxAge != time.Hour/2 {
+		t.Errorf("federation_pdus should default to a max age of %s, got %s", time.Hour/2, pdus.MaxAge)
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	caches := NewRistrettoCache(8*1024*1024, time.Hour, DisableMetrics)
+	hits := testutil.ToFloat64(cacheHits.WithLabelValues("room_ids"))
+	misses := testutil.ToFloat64(cacheMisses.WithLabelValues("room_ids"))
+
+	caches.RoomServerRoomIDs.Set(1, "!room:test")
+	caches.RoomServerRoomIDs.(*RistrettoCachePartition[types.RoomNID, string]).cache.Wait()
+	if _, ok := caches.RoomServerRoomIDs.Get(1); !ok {
+		t.Fatal("expected a cache hit")
+	}
+	if _, ok := caches.RoomServerRoomIDs.Get(2); ok {
+		t.Fatal("expected a cache miss")
+	}
+	if got := testutil.ToFloat64(cacheHits.WithLabelValues("room_ids")) - hits; got != 1 {
+		t.Errorf("expected 1 hit, got %v", got)
+	}
+	if got := testutil.ToFloat64(cacheMisses.WithLabelValues("room_ids")) - misses; got != 1 {
+		t.Errorf("expected 1 miss, got %v", got)
+	}
+}
+
+func TestKeyToHashKeepsPrefix(t *testing.T) {
+	for prefix := range cacheNames {
+		_, conflict := keyToHash(string([]byte{prefix}) + "key")
+		if byte(conflict) != prefix {
+			t.Errorf("expected prefix %d in the conflict hash, got %d", prefix, byte(conflict))
+		}
+	}
+}
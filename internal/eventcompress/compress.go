@@ -0,0 +1,185 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package eventcompress implements optional compression of event JSON that is
+// stored at rest in the database.
+//
+// Compressed values start with a single marker byte identifying the algorithm.
+// Event JSON always starts with '{', so it can never be mistaken for a
+// compressed value. This means that compressed and uncompressed rows can live
+// side by side in the same table, and that reading is always transparent
+// regardless of which algorithm, if any, is currently configured for writing.
+package eventcompress
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithm is a compression algorithm for event JSON.
+type Algorithm string
+
+const (
+	AlgorithmNone   Algorithm = "none"
+	AlgorithmZstd   Algorithm = "zstd"
+	AlgorithmSnappy Algorithm = "snappy"
+)
+
+// Marker bytes for compressed values. These must never change, as they are
+// persisted in the database. A new dictionary for zstd needs a new marker.
+const (
+	markerZstdDictV1 byte = 0x01
+	markerSnappy     byte = 0x02
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodec returns the shared zstd encoder and decoder, which are both
+// safe for concurrent use through EncodeAll and DecodeAll.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(
+			nil,
+			zstd.WithEncoderDictRaw(zstdDictionaryID, zstdDictionary),
+			zstd.WithEncoderConcurrency(1),
+		)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(
+			nil,
+			zstd.WithDecoderDictRaw(zstdDictionaryID, zstdDictionary),
+			zstd.WithDecoderConcurrency(0),
+		)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// ParseAlgorithm returns the Algorithm for the given config value. An empty
+// string is treated as no compression.
+func ParseAlgorithm(s string) (Algorithm, error) {
+	switch Algorithm(s) {
+	case "", AlgorithmNone:
+		return AlgorithmNone, nil
+	case AlgorithmZstd, AlgorithmSnappy:
+		return Algorithm(s), nil
+	default:
+		return "", fmt.Errorf("unknown event compression algorithm %q", s)
+	}
+}
+
+// Compressor compresses event JSON for storage using a single algorithm.
+// A nil Compressor is valid and stores event JSON as-is.
+type Compressor struct {
+	algorithm Algorithm
+}
+
+// NewCompressor returns a Compressor for the named algorithm.
+func NewCompressor(algorithm string) (*Compressor, error) {
+	alg, err := ParseAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if alg == AlgorithmZstd {
+		if _, _, err = zstdCodec(); err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+	}
+	return &Compressor{algorithm: alg}, nil
+}
+
+// Algorithm returns the algorithm that the Compressor writes with.
+func (c *Compressor) Algorithm() Algorithm {
+	if c == nil {
+		return AlgorithmNone
+	}
+	return c.algorithm
+}
+
+// Compress returns the value that should be stored for the given event JSON.
+// If the result would not be smaller than the original then the original is
+// returned, so that tiny events don't pay for the compression overhead.
+func (c *Compressor) Compress(eventJSON []byte) []byte {
+	if len(eventJSON) == 0 {
+		return eventJSON
+	}
+	out := make([]byte, 1, len(eventJSON))
+	switch c.Algorithm() {
+	case AlgorithmZstd:
+		enc, _, _ := zstdCodec()
+		out[0] = markerZstdDictV1
+		out = enc.EncodeAll(eventJSON, out)
+	case AlgorithmSnappy:
+		out[0] = markerSnappy
+		out = append(out, snappy.Encode(nil, eventJSON)...)
+	default:
+		return eventJSON
+	}
+	if len(out) >= len(eventJSON) {
+		return eventJSON
+	}
+	return out
+}
+
+// IsCompressed returns whether the stored value is compressed.
+func IsCompressed(stored []byte) bool {
+	return len(stored) > 0 && (stored[0] == markerZstdDictV1 || stored[0] == markerSnappy)
+}
+
+// Decompress returns the event JSON for a stored value, whichever algorithm
+// it was compressed with. Values which are not compressed are returned as-is.
+func Decompress(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return stored, nil
+	}
+	switch stored[0] {
+	case markerZstdDictV1:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		eventJSON, err := dec.DecodeAll(stored[1:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		return eventJSON, nil
+	case markerSnappy:
+		eventJSON, err := snappy.Decode(nil, stored[1:])
+		if err != nil {
+			return nil, fmt.Errorf("snappy: %w", err)
+		}
+		return eventJSON, nil
+	default:
+		return stored, nil
+	}
+}
+
+// Unmarshal decompresses the stored value, if needed, and then unmarshals
+// the event JSON into v.
+func Unmarshal(stored []byte, v any) error {
+	eventJSON, err := Decompress(stored)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(eventJSON, v)
+}
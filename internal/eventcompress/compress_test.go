@@ -0,0 +1,78 @@
+package eventcompress
+
+import (
+	"bytes"
+	"testing"
+)
+
+var testEventJSON = []byte(`{"auth_events":["$6lKeL8c2WbdHL-cpcxNlMTXALJRNTAOiv4sVGaVBt6s","$8vXpFdPx4dQpJHvPWdPPYpHzXoB6GYRsJYQJmHBxSK0"],"content":{"body":"Hello, world! This is a message which is long enough to be worth compressing.","msgtype":"m.text"},"depth":42,"hashes":{"sha256":"Uj6ymCbwAi3Yp6jZB1yJxn+KkcUJHMLzmxXkxZgHR3c"},"origin":"example.com","origin_server_ts":1700000000000,"prev_events":["$Y2d0vYSqlmLKe7oWwD8Dq5T64T2ukVVvYy1VUJS9Sqw"],"room_id":"!abcdefghijk:example.com","sender":"@alice:example.com","signatures":{"example.com":{"ed25519:auto":"x1RN4EKrDDGvSJjbL5eXg3QWUaVmMJBkLmgpx4QyjTJ06YTc0DX4EkbDjjqZqXZtvhO9sI6Ss8vE8Y2wM8N2Bw"}},"type":"m.room.message","unsigned":{"age_ts":1700000000000}}`)
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, alg := range []string{"", "none", "zstd", "snappy"} {
+		t.Run(alg, func(t *testing.T) {
+			c, err := NewCompressor(alg)
+			if err != nil {
+				t.Fatalf("NewCompressor: %s", err)
+			}
+			stored := c.Compress(testEventJSON)
+			switch c.Algorithm() {
+			case AlgorithmNone:
+				if !bytes.Equal(stored, testEventJSON) {
+					t.Fatalf("expected event JSON to be stored as-is")
+				}
+			case AlgorithmZstd:
+				if !IsCompressed(stored) {
+					t.Fatalf("expected event JSON to be compressed")
+				}
+				if len(stored) >= len(testEventJSON) {
+					t.Fatalf("compressed value (%d bytes) is not smaller than original (%d bytes)", len(stored), len(testEventJSON))
+				}
+			}
+			got, err := Decompress(stored)
+			if err != nil {
+				t.Fatalf("Decompress: %s", err)
+			}
+			if !bytes.Equal(got, testEventJSON) {
+				t.Fatalf("round trip mismatch\nwant: %s\n got: %s", testEventJSON, got)
+			}
+		})
+	}
+}
+
+func TestCompressSkipsSmallEvents(t *testing.T) {
+	c, err := NewCompressor("zstd")
+	if err != nil {
+		t.Fatalf("NewCompressor: %s", err)
+	}
+	small := []byte(`{}`)
+	if got := c.Compress(small); !bytes.Equal(got, small) {
+		t.Fatalf("expected small event to be stored as-is, got %q", got)
+	}
+}
+
+func TestCompressEmpty(t *testing.T) {
+	for _, alg := range []string{"none", "zstd", "snappy"} {
+		c, err := NewCompressor(alg)
+		if err != nil {
+			t.Fatalf("NewCompressor: %s", err)
+		}
+		for _, empty := range [][]byte{nil, {}} {
+			if got := c.Compress(empty); len(got) != 0 {
+				t.Fatalf("%s: expected empty input to be stored as-is, got %q", alg, got)
+			}
+		}
+	}
+}
+
+func TestNilCompressor(t *testing.T) {
+	var c *Compressor
+	if got := c.Compress(testEventJSON); !bytes.Equal(got, testEventJSON) {
+		t.Fatalf("expected nil compressor to store event JSON as-is")
+	}
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	if _, err := NewCompressor("lzma"); err == nil {
+		t.Fatalf("expected an error for an unknown algorithm")
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventcompress
+
+import _ "embed"
+
+//go:generate go run gendictionary.go -o zstd_dictionary.bin
+
+// zstdDictionaryID identifies the dictionary below in the zstd frame header.
+// If the dictionary content ever changes then this ID and the zstd marker
+// byte must both be bumped, otherwise existing rows will no longer decompress.
+const zstdDictionaryID = 0x4d780001
+
+// zstdDictionary is a raw content dictionary trained by gendictionary.go on
+// sample events in the shapes of common Matrix events, as they are stored in
+// canonical JSON form. zstd will match against it before any data in the
+// event itself, which makes a substantial difference for small events where
+// there is otherwise little to reference.
+//
+//go:embed zstd_dictionary.bin
+var zstdDictionary []byte
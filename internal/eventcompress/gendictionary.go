@@ -0,0 +1,379 @@
+//go:build ignore
+
+// This program trains the zstd dictionary used for compressing event JSON.
+// It generates sample events in the shapes of the most common Matrix events,
+// as they are stored by the roomserver and the sync API, with random IDs,
+// hashes, signatures and text so that the dictionary learns the structure
+// of events rather than any particular values. Run it with go generate.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+var (
+	output  = flag.String("o", "zstd_dictionary.bin", "the file to write the dictionary to")
+	size    = flag.Int("size", 16<<10, "the size of the dictionary in bytes")
+	samples = flag.Int("samples", 5000, "the number of sample events to train on")
+	seed    = flag.Int64("seed", 1, "the seed for generating sample events")
+)
+
+func main() {
+	flag.Parse()
+	g := &generator{rng: rand.New(rand.NewSource(*seed))}
+	input := make([][]byte, 0, *samples)
+	for len(input) < *samples {
+		input = append(input, g.event())
+	}
+	if err := os.WriteFile(*output, train(input, *size), 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// The lengths of the segments which make up the dictionary, and of the
+// substrings that they are scored by.
+const (
+	segmentLength = 64
+	dmerLength    = 8
+)
+
+// train builds a raw content dictionary from the samples in the same way
+// as the COVER algorithm that zstd uses. Each substring of dmerLength bytes
+// is scored by the number of samples that it appears in, and the samples
+// are split into one epoch per segment of the dictionary. From each epoch,
+// the segment whose distinct substrings score the highest is added to the
+// dictionary, and the substrings are then scored zero so that they aren't
+// added again. The best segments go at the end of the dictionary, where
+// zstd can refer to them with the shortest offsets.
+func train(samples [][]byte, size int) []byte {
+	freqs := map[string]int{}
+	for _, sample := range samples {
+		seen := map[string]struct{}{}
+		for i := 0; i+dmerLength <= len(sample); i++ {
+			dmer := string(sample[i : i+dmerLength])
+			if _, ok := seen[dmer]; !ok {
+				seen[dmer] = struct{}{}
+				freqs[dmer]++
+			}
+		}
+	}
+
+	data := bytes.Join(samples, nil)
+	epochs := size / segmentLength
+	epochLength := len(data) / epochs
+	dictionary := make([]byte, 0, size)
+	for epoch := 0; epoch < epochs; epoch++ {
+		segment := bestSegment(data[epoch*epochLength:(epoch+1)*epochLength], freqs)
+		if segment == nil {
+			continue
+		}
+		for i := 0; i+dmerLength <= len(segment); i++ {
+			freqs[string(segment[i:i+dmerLength])] = 0
+		}
+		dictionary = append(append([]byte{}, segment...), dictionary...)
+	}
+	return dictionary
+}
+
+// bestSegment returns the segment of the epoch with the highest score, or
+// nil if none of its substrings score anything.
+func bestSegment(epoch []byte, freqs map[string]int) []byte {
+	dmers := segmentLength - dmerLength + 1
+	active := map[string]int{}
+	score, bestScore, bestStart := 0, 0, -1
+	for i := 0; i+dmerLength <= len(epoch); i++ {
+		dmer := string(epoch[i : i+dmerLength])
+		if active[dmer] == 0 {
+			score += freqs[dmer]
+		}
+		active[dmer]++
+		if i >= dmers {
+			old := string(epoch[i-dmers : i-dmers+dmerLength])
+			if active[old]--; active[old] == 0 {
+				score -= freqs[old]
+				delete(active, old)
+			}
+		}
+		if i+1 >= dmers && score > bestScore {
+			bestScore, bestStart = score, i+1-dmers
+		}
+	}
+	if bestStart < 0 {
+		return nil
+	}
+	return epoch[bestStart : bestStart+segmentLength]
+}
+
+type generator struct {
+	rng *rand.Rand
+}
+
+// event returns a sample event, picking the type roughly in proportion to
+// how often each type is stored.
+func (g *generator) event() []byte {
+	sender := g.userID()
+	ev := map[string]any{
+		"auth_events":      g.eventIDs(3 + g.rng.Intn(2)),
+		"depth":            g.rng.Int63n(1000000),
+		"hashes":           map[string]string{"sha256": g.base64(32)},
+		"origin_server_ts": 1500000000000 + g.rng.Int63n(300000000000),
+		"prev_events":      g.eventIDs(1 + g.rng.Intn(4)/3),
+		"room_id":          "!" + g.letters(18) + ":" + g.server(),
+		"sender":           sender,
+		"signatures": map[string]any{
+			strings.SplitN(sender, ":", 2)[1]: map[string]string{
+				"ed25519:" + g.letters(6): g.base64(64),
+			},
+		},
+	}
+	// Rooms before version 11 have an origin too.
+	if g.rng.Intn(2) == 0 {
+		ev["origin"] = strings.SplitN(sender, ":", 2)[1]
+	}
+
+	switch n := g.rng.Intn(100); {
+	case n < 30:
+		ev["type"] = "m.room.message"
+		ev["content"] = g.message()
+	case n < 50:
+		ev["type"] = "m.room.encrypted"
+		ev["content"] = map[string]any{
+			"algorithm":  "m.megolm.v1.aes-sha2",
+			"ciphertext": g.base64(100 + g.rng.Intn(400)),
+			"device_id":  g.upper(10),
+			"sender_key": g.base64(32),
+			"session_id": g.base64(32),
+		}
+	case n < 70:
+		ev["type"] = "m.room.member"
+		ev["state_key"] = sender
+		ev["content"] = g.member()
+	case n < 78:
+		ev["type"] = "m.reaction"
+		ev["content"] = map[string]any{"m.relates_to": map[string]any{
+			"event_id": g.eventID(), "key": g.pick("👍", "❤️", "😂", "🎉", "+1"), "rel_type": "m.annotation",
+		}}
+	case n < 83:
+		ev["type"] = "m.room.redaction"
+		ev["redacts"] = g.eventID()
+		ev["content"] = map[string]any{"redacts": ev["redacts"]}
+	case n < 86:
+		ev["type"] = "m.room.power_levels"
+		ev["state_key"] = ""
+		ev["content"] = g.powerLevels(sender)
+	default:
+		g.roomState(ev, sender)
+	}
+
+	if g.rng.Intn(3) == 0 {
+		unsigned := map[string]any{"age_ts": ev["origin_server_ts"]}
+		if ev["type"] == "m.room.message" && g.rng.Intn(2) == 0 {
+			unsigned["transaction_id"] = "m" + fmt.Sprint(g.rng.Int63n(1e13)) + "." + fmt.Sprint(g.rng.Intn(100))
+		}
+		if _, ok := ev["state_key"]; ok {
+			unsigned["replaces_state"] = g.eventID()
+			unsigned["prev_sender"] = sender
+		}
+		ev["unsigned"] = unsigned
+	}
+
+	// Events are stored as canonical JSON, which doesn't escape HTML.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(ev); err != nil {
+		panic(err)
+	}
+	js := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	// The sync API stores events with a header after the rest of the event.
+	if g.rng.Intn(2) == 0 {
+		js = append(js[:len(js)-1], fmt.Sprintf(`,"_room_version":%q,"_event_id":%q}`, g.pick("9", "10", "11"), g.eventID())...)
+	}
+	return js
+}
+
+func (g *generator) message() map[string]any {
+	body := g.text()
+	content := map[string]any{"body": body, "msgtype": "m.text"}
+	switch n := g.rng.Intn(10); {
+	case n < 2:
+		content["format"] = "org.matrix.custom.html"
+		content["formatted_body"] = "<p>" + body + "</p>"
+		content["m.relates_to"] = map[string]any{"m.in_reply_to": map[string]any{"event_id": g.eventID()}}
+		content["m.mentions"] = map[string]any{"user_ids": []string{g.userID()}}
+	case n < 3:
+		content["m.new_content"] = map[string]any{"body": body, "msgtype": "m.text"}
+		content["m.relates_to"] = map[string]any{"event_id": g.eventID(), "rel_type": "m.replace"}
+		content["body"] = " * " + body
+	case n < 4:
+		content["m.relates_to"] = map[string]any{
+			"event_id": g.eventID(), "is_falling_back": true, "rel_type": "m.thread",
+			"m.in_reply_to": map[string]any{"event_id": g.eventID()},
+		}
+	case n < 5:
+		content["msgtype"] = "m.image"
+		content["body"] = g.letters(8) + ".jpg"
+		content["url"] = g.mxc()
+		content["info"] = map[string]any{
+			"h": g.rng.Intn(2000), "w": g.rng.Intn(2000), "mimetype": g.pick("image/jpeg", "image/png"),
+			"size": g.rng.Intn(5000000), "thumbnail_url": g.mxc(),
+			"thumbnail_info": map[string]any{"h": g.rng.Intn(600), "w": g.rng.Intn(800), "mimetype": "image/jpeg", "size": g.rng.Intn(100000)},
+		}
+	case n < 6:
+		content["m.mentions"] = map[string]any{}
+	}
+	return content
+}
+
+func (g *generator) member() map[string]any {
+	content := map[string]any{"membership": g.pick("join", "join", "join", "leave", "invite", "ban")}
+	if content["membership"] == "join" || content["membership"] == "invite" {
+		content["displayname"] = g.letters(4 + g.rng.Intn(10))
+		if g.rng.Intn(2) == 0 {
+			content["avatar_url"] = g.mxc()
+		}
+	}
+	switch {
+	case content["membership"] == "invite" && g.rng.Intn(2) == 0:
+		content["is_direct"] = true
+	case content["membership"] == "join" && g.rng.Intn(5) == 0:
+		content["join_authorised_via_users_server"] = g.userID()
+	case content["membership"] != "join" && g.rng.Intn(3) == 0:
+		content["reason"] = g.text()
+	}
+	return content
+}
+
+func (g *generator) powerLevels(creator string) map[string]any {
+	users := map[string]int{creator: 100}
+	for i := g.rng.Intn(5); i > 0; i-- {
+		users[g.userID()] = g.pick2(50, 100)
+	}
+	return map[string]any{
+		"ban": 50, "invite": 0, "kick": 50, "redact": 50, "state_default": 50,
+		"events_default": 0, "users_default": 0, "users": users,
+		"notifications": map[string]int{"room": 50},
+		"events": map[string]int{
+			"m.room.avatar": 50, "m.room.canonical_alias": 50, "m.room.encryption": 100,
+			"m.room.history_visibility": 100, "m.room.name": 50, "m.room.power_levels": 100,
+			"m.room.server_acl": 100, "m.room.tombstone": 100,
+		},
+	}
+}
+
+// roomState fills in one of the less common state events.
+func (g *generator) roomState(ev map[string]any, sender string) {
+	ev["state_key"] = ""
+	switch g.rng.Intn(10) {
+	case 0:
+		ev["type"] = "m.room.create"
+		ev["content"] = map[string]any{"creator": sender, "room_version": g.pick("9", "10", "11")}
+	case 1:
+		ev["type"] = "m.room.join_rules"
+		if g.rng.Intn(3) == 0 {
+			ev["content"] = map[string]any{"join_rule": "restricted", "allow": []map[string]string{{"room_id": "!" + g.letters(18) + ":" + g.server(), "type": "m.room_membership"}}}
+		} else {
+			ev["content"] = map[string]any{"join_rule": g.pick("invite", "public")}
+		}
+	case 2:
+		ev["type"] = "m.room.history_visibility"
+		ev["content"] = map[string]any{"history_visibility": g.pick("shared", "joined", "invited", "world_readable")}
+	case 3:
+		ev["type"] = "m.room.guest_access"
+		ev["content"] = map[string]any{"guest_access": g.pick("can_join", "forbidden")}
+	case 4:
+		ev["type"] = "m.room.encryption"
+		ev["content"] = map[string]any{"algorithm": "m.megolm.v1.aes-sha2", "rotation_period_ms": 604800000, "rotation_period_msgs": 100}
+	case 5:
+		ev["type"] = "m.room.name"
+		ev["content"] = map[string]any{"name": g.text()}
+	case 6:
+		ev["type"] = "m.room.topic"
+		ev["content"] = map[string]any{"topic": g.text()}
+	case 7:
+		ev["type"] = "m.room.canonical_alias"
+		ev["content"] = map[string]any{"alias": "#" + g.letters(8) + ":" + g.server(), "alt_aliases": []string{}}
+	case 8:
+		ev["type"] = "m.room.avatar"
+		ev["content"] = map[string]any{"url": g.mxc(), "info": map[string]any{"h": 256, "w": 256, "mimetype": "image/png", "size": g.rng.Intn(100000)}}
+	default:
+		ev["type"] = "m.room.server_acl"
+		ev["content"] = map[string]any{"allow": []string{"*"}, "allow_ip_literals": false, "deny": []string{"*." + g.server()}}
+	}
+}
+
+// server returns a random server name. The server names in real events are
+// different on every deployment, so the dictionary mustn't learn any.
+func (g *generator) server() string {
+	return g.letters(3+g.rng.Intn(8)) + "." + g.pick("org", "com", "net", "io", "chat")
+}
+
+func (g *generator) userID() string {
+	return "@" + g.letters(3+g.rng.Intn(10)) + ":" + g.server()
+}
+
+func (g *generator) eventID() string {
+	return "$" + strings.NewReplacer("+", "-", "/", "_").Replace(g.base64(32))
+}
+
+func (g *generator) eventIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = g.eventID()
+	}
+	return ids
+}
+
+func (g *generator) mxc() string {
+	return "mxc://" + g.server() + "/" + g.letters(24)
+}
+
+// text returns a few random words.
+func (g *generator) text() string {
+	words := make([]string, 1+g.rng.Intn(15))
+	for i := range words {
+		words[i] = g.letters(1 + g.rng.Intn(8))
+	}
+	return strings.Join(words, " ")
+}
+
+func (g *generator) base64(n int) string {
+	b := make([]byte, n)
+	g.rng.Read(b)
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func (g *generator) letters(n int) string {
+	return g.chars(n, "abcdefghijklmnopqrstuvwxyz")
+}
+
+func (g *generator) upper(n int) string {
+	return g.chars(n, "ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+}
+
+func (g *generator) chars(n int, alphabet string) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphabet[g.rng.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+func (g *generator) pick(s ...string) string {
+	return s[g.rng.Intn(len(s))]
+}
+
+func (g *generator) pick2(a, b int) int {
+	if g.rng.Intn(2) == 0 {
+		return a
+	}
+	return b
+}
@@ -75,3 +75,15 @@ func (b *WeakBoolean) UnmarshalJSON(data []byte) error {
 
 	return nil
 }
+
+// TagContent is the content of the m.tag room account data.
+type TagContent struct {
+	Tags map[string]TagProperties `json:"tags"`
+}
+
+// TagProperties holds the properties of a single tag. Order is a number
+// between 0 and 1 which clients use to sort the rooms with the same tag,
+// so it is kept at full precision and only omitted when it wasn't set.
+type TagProperties struct {
+	Order *float64 `json:"order,omitempty"`
+}
@@ -92,8 +92,8 @@ func New(processCtx *process.ProcessContext, cfg config.Fulltext) (fts *Search,
 	}
 	go func() {
 		processCtx.ComponentStarted()
-		// Wait for the processContext to be done, indicating that Dendrite is shutting down.
-		<-processCtx.WaitForShutdown()
+		// Wait for the processContext to close, once work in progress has finished.
+		<-processCtx.WaitForClose()
 		_ = fts.Close()
 		processCtx.ComponentFinished()
 	}()
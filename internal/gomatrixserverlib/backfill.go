@@ -3,6 +3,7 @@ package gomatrixserverlib
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 )
@@ -55,33 +56,65 @@ func RequestBackfill(ctx context.Context, origin spec.ServerName, b BackfillRequ
 	}
 	haveEventIDs := make(map[string]bool)
 	var result []PDU
-	loader := NewEventsLoader(ver, keyRing, b, b.ProvideEvents, false)
+	// The requester is shared between the servers being fetched from at once, so
+	// make sure that it is only called by one of them at a time.
+	locked := &lockedBackfillRequester{BackfillRequester: b}
+	loader := NewEventsLoader(ver, keyRing, locked, locked.ProvideEvents, false)
 	// pick a server to backfill from
 	// TODO: use other event IDs and make a set out of all the returned servers?
 	servers := b.ServersAtEvent(ctx, roomID, fromEventIDs[0])
+	rejecter, _ := b.(BackfillServerRejecter)
+
+	// Fetch and verify events from a few servers at once, so that a server which
+	// is slow or unreachable doesn't hold up the others. The results are still
+	// used in the order of preference of the servers.
+	// Fetches which are still going when we return are stopped and waited for,
+	// as they call into the requester, which the caller reads once we return.
+	fetchCtx, cancel := context.WithCancel(ctx)
+	var fetches sync.WaitGroup
+	defer fetches.Wait()
+	defer cancel()
+	pending := make([]chan backfillServerResult, len(servers))
+	fetch := func(i int) {
+		pending[i] = make(chan backfillServerResult, 1)
+		fetches.Add(1)
+		go func(s spec.ServerName, ch chan<- backfillServerResult) {
+			defer fetches.Done()
+			// fetch some events, and try a different server if it fails
+			txn, err := b.Backfill(fetchCtx, origin, s, roomID, limit, fromEventIDs)
+			if err != nil {
+				ch <- backfillServerResult{err: err}
+				return
+			}
+			// topologically sort the events so implementations of 'get state at event' can do optimisations
+			loadResults, err := loader.LoadAndVerify(fetchCtx, txn.PDUs, TopologicalOrderByPrevEvents, userIDForSender)
+			ch <- backfillServerResult{results: loadResults, err: err}
+		}(servers[i], pending[i])
+	}
+	for i := 0; i < len(servers) && i < maxConcurrentBackfillServers; i++ {
+		fetch(i)
+	}
+
 	// loop each server asking it for `limit` events. Worst case, we ask every server for `limit`
 	// events before giving up. Best case, we just ask one.
 	var lastErr error
-	for _, s := range servers {
+	for i, s := range servers {
 		if len(result) >= limit {
 			break
 		}
 		if ctx.Err() != nil {
 			return nil, fmt.Errorf("gomatrixserverlib: RequestBackfill context cancelled %w", ctx.Err())
 		}
-		// fetch some events, and try a different server if it fails
-		txn, err := b.Backfill(ctx, origin, s, roomID, limit, fromEventIDs)
-		if err != nil {
-			lastErr = err
-			continue // try the next server
+		res := <-pending[i]
+		if next := i + maxConcurrentBackfillServers; next < len(servers) {
+			fetch(next)
 		}
-		// topologically sort the events so implementations of 'get state at event' can do optimisations
-		loadResults, err := loader.LoadAndVerify(ctx, txn.PDUs, TopologicalOrderByPrevEvents, userIDForSender)
-		if err != nil {
-			lastErr = err
+		if res.err != nil {
+			lastErr = res.err
 			continue // try the next server
 		}
-		for _, res := range loadResults {
+		accepted := 0
+		for _, res := range res.results {
 			switch res.Error.(type) {
 			case nil, SignatureErr:
 				// The signature of the event might not be valid anymore, for example if
@@ -91,17 +124,68 @@ func RequestBackfill(ctx context.Context, origin spec.ServerName, b BackfillRequ
 			default:
 				continue
 			}
+			accepted++
 			if haveEventIDs[res.Event.EventID()] {
 				continue // we got this event from a different server
 			}
 			haveEventIDs[res.Event.EventID()] = true
 			result = append(result, res.Event)
 		}
+		if accepted == 0 && len(res.results) > 0 && rejecter != nil {
+			// Every event the server sent us failed verification, so there's no
+			// point asking it again. Other fetches may still be calling into the
+			// requester, so hold the same lock as they do.
+			locked.mu.Lock()
+			rejecter.RejectBackfillServer(roomID, s)
+			locked.mu.Unlock()
+		}
 	}
 
 	return result, lastErr
 }
 
+// maxConcurrentBackfillServers is how many servers RequestBackfill fetches and
+// verifies events from at once.
+const maxConcurrentBackfillServers = 3
+
+type backfillServerResult struct {
+	results []EventLoadResult
+	err     error
+}
+
+// BackfillServerRejecter can optionally be implemented by a BackfillRequester to be
+// told about servers which returned backfilled events that all failed verification,
+// so that they can be avoided for the rest of the backfill request in the room.
+type BackfillServerRejecter interface {
+	RejectBackfillServer(roomID string, server spec.ServerName)
+}
+
+// lockedBackfillRequester serialises calls to the StateProvider and ProvideEvents
+// functions of a BackfillRequester, as events from several servers are verified
+// at once.
+type lockedBackfillRequester struct {
+	BackfillRequester
+	mu sync.Mutex
+}
+
+func (l *lockedBackfillRequester) StateIDsBeforeEvent(ctx context.Context, event PDU) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.BackfillRequester.StateIDsBeforeEvent(ctx, event)
+}
+
+func (l *lockedBackfillRequester) StateBeforeEvent(ctx context.Context, roomVer RoomVersion, event PDU, eventIDs []string) (map[string]PDU, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.BackfillRequester.StateBeforeEvent(ctx, roomVer, event, eventIDs)
+}
+
+func (l *lockedBackfillRequester) ProvideEvents(roomVer RoomVersion, eventIDs []string) ([]PDU, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.BackfillRequester.ProvideEvents(roomVer, eventIDs)
+}
+
 /*
 // BackfillResponder contains the necessary functions to handle backfill requests.
 type backfillResponder interface {
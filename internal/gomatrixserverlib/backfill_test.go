@@ -23,6 +23,9 @@ type testBackfillRequester struct {
 	authEventsToProvide             [][]byte
 	stateIDsAtEvent                 map[string][]string
 	callOrderForStateIDsBeforeEvent []string // event IDs called
+	rejectedServers                 []spec.ServerName
+	waitForCancel                   spec.ServerName // backfilling from this server waits until the request is cancelled
+	cancelled                       bool
 }
 
 func (t *testBackfillRequester) StateIDsBeforeEvent(ctx context.Context, atEvent PDU) ([]string, error) {
@@ -36,12 +39,20 @@ func (t *testBackfillRequester) ServersAtEvent(ctx context.Context, roomID, even
 	return t.servers
 }
 func (t *testBackfillRequester) Backfill(ctx context.Context, origin, server spec.ServerName, roomID string, limit int, fromEventIDs []string) (Transaction, error) {
+	if server == t.waitForCancel {
+		<-ctx.Done()
+		t.cancelled = true
+		return Transaction{}, ctx.Err()
+	}
 	txn, err := t.backfillFn(origin, server, roomID, fromEventIDs, limit)
 	if err != nil {
 		return Transaction{}, err
 	}
 	return *txn, nil
 }
+func (t *testBackfillRequester) RejectBackfillServer(roomID string, server spec.ServerName) {
+	t.rejectedServers = append(t.rejectedServers, server)
+}
 func (t *testBackfillRequester) ProvideEvents(roomVer RoomVersion, eventIDs []string) (result []PDU, err error) {
 	eventMap := make(map[string]PDU)
 	for _, eventBytes := range t.authEventsToProvide {
@@ -195,6 +206,115 @@ func TestRequestBackfillTopologicalSort(t *testing.T) {
 
 }
 
+// The purpose of this test is to make sure that RequestBackfill asks several servers at once, so that a slow
+// server doesn't hold up the others, and that servers which only return invalid events are reported.
+func TestRequestBackfillConcurrentServers(t *testing.T) {
+	ctx := context.Background()
+	slowServer := spec.ServerName("slow.is.sink")
+	junkServer := spec.ServerName("junk.is.hot")
+	testFromEventIDs := []string{"foo"}
+	testLimit := 4
+	testBackfillEvents := [][]byte{
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:baba.is.you"},"depth":0,"event_id":"$WCraVpPZe5TtHAqs:baba.is.you","hashes":{"sha256":"EehWNbKy+oDOMC0vIvYl1FekdDxMNuabXKUVzV7DG74"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"08aF4/bYWKrdGPFdXmZCQU6IrOE1ulpevmWBM3kiShJPAbRbZ6Awk7buWkIxlMF6kX3kb4QpbAlZfHLQgncjCw"}},"state_key":"","type":"m.room.create"}`),
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}]],"content":{"membership":"join"},"depth":1,"event_id":"$fnwGrQEpiOIUoDU2:baba.is.you","hashes":{"sha256":"DqOjdFgvFQ3V/jvQW2j3ygHL4D+t7/LaIPZ/tHTDZtI"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}]],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"qBWLb42zicQVsbh333YrcKpHfKokcUOM/ytldGlrgSdXqDEDDxvpcFlfadYnyvj3Z/GjA2XZkqKHanNEh575Bw"}},"state_key":"@userid:baba.is.you","type":"m.room.member"}`),
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Test Message"},"depth":2,"event_id":"$xOJZshi3NeKKJiCf:baba.is.you","hashes":{"sha256":"lu5fF5HE090AXdu/+NpJ/RjRVRk/2tWCUozUc5t7Ru4"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"5KoVSLOBesqH9vciKXDExdu95lKFDtK1I72Hq1GG/UeEsH9jx7wL3V4jGYSKDnX2aLYp/VPiBQje7DFjde+hDQ"}},"type":"m.room.message"}`),
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Test Message"},"depth":3,"event_id":"$4Kp0G1yWZ6tNpeI7:baba.is.you","hashes":{"sha256":"B+MjcGZRh72iaGOgyNbIxgFkHDJo6NO8NQDgiKDKDBA"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$xOJZshi3NeKKJiCf:baba.is.you",{"sha256":"5PGENImHC863Yz9sO6IJX+bIQthZFI2RMhFZyFy+bC0"}]],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"rP+Ybp17GPCqQBrTQ3yz+q6PihdaMWvNY3SngV8aDLHv8wdDlH4ULGnjsB+Az7trqYdCE3rZVo9M7Hy5tOObDg"}},"type":"m.room.message"}`),
+	}
+	// A message from a user who isn't in the room, which fails the auth checks.
+	junkEvent := []byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Junk Message"},"depth":2,"event_id":"$junk:junk.is.hot","hashes":{"sha256":"lu5fF5HE090AXdu/+NpJ/RjRVRk/2tWCUozUc5t7Ru4"},"origin":"junk.is.hot","origin_server_ts":0,"prev_events":[["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"room_id":"!roomid:baba.is.you","sender":"@mallory:junk.is.hot","signatures":{},"type":"m.room.message"}`)
+	askedServerA := make(chan struct{})
+	keyRing := &testNopJSONVerifier{}
+	tbr := &testBackfillRequester{
+		servers:             []spec.ServerName{slowServer, junkServer, serverA},
+		authEventsToProvide: testBackfillEvents,
+		stateIDsAtEvent: map[string][]string{
+			"$4Kp0G1yWZ6tNpeI7:baba.is.you": {"$fnwGrQEpiOIUoDU2:baba.is.you", "$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$xOJZshi3NeKKJiCf:baba.is.you": {"$fnwGrQEpiOIUoDU2:baba.is.you", "$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$fnwGrQEpiOIUoDU2:baba.is.you": {"$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$WCraVpPZe5TtHAqs:baba.is.you": nil,
+			"$junk:junk.is.hot":             {"$fnwGrQEpiOIUoDU2:baba.is.you", "$WCraVpPZe5TtHAqs:baba.is.you"},
+		},
+		backfillFn: func(origin, server spec.ServerName, roomID string, fromEventIDs []string, limit int) (*Transaction, error) {
+			switch server {
+			case slowServer:
+				// the slow server only answers once server A has been asked
+				select {
+				case <-askedServerA:
+				case <-time.After(5 * time.Second):
+					t.Errorf("server A wasn't asked while waiting for the slow server")
+				}
+				return nil, fmt.Errorf("timed out")
+			case junkServer:
+				return &Transaction{
+					Origin:         origin,
+					OriginServerTS: spec.AsTimestamp(time.Now()),
+					PDUs:           []json.RawMessage{junkEvent},
+				}, nil
+			case serverA:
+				close(askedServerA)
+				return &Transaction{
+					Origin:         origin,
+					OriginServerTS: spec.AsTimestamp(time.Now()),
+					PDUs: []json.RawMessage{
+						testBackfillEvents[0], testBackfillEvents[1], testBackfillEvents[2], testBackfillEvents[3],
+					},
+				}, nil
+			}
+			return nil, fmt.Errorf("bad server name: %s", server)
+		},
+	}
+	result, _ := RequestBackfill(ctx, serverA, tbr, keyRing, testRoomID, RoomVersionV1, testFromEventIDs, testLimit, UserIDForSenderTest)
+	assertUnsortedEqual(t, result, testBackfillEvents)
+
+	if len(tbr.rejectedServers) != 1 || tbr.rejectedServers[0] != junkServer {
+		t.Errorf("RequestBackfill rejected servers %v, want [%s]", tbr.rejectedServers, junkServer)
+	}
+}
+
+// The purpose of this test is to make sure that RequestBackfill doesn't return while servers which it no longer
+// needs are still being fetched from, as they would still be using the requester.
+func TestRequestBackfillCancelsUnneededServers(t *testing.T) {
+	ctx := context.Background()
+	slowServer := spec.ServerName("slow.is.sink")
+	testFromEventIDs := []string{"foo"}
+	testLimit := 4
+	testBackfillEvents := [][]byte{
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:baba.is.you"},"depth":0,"event_id":"$WCraVpPZe5TtHAqs:baba.is.you","hashes":{"sha256":"EehWNbKy+oDOMC0vIvYl1FekdDxMNuabXKUVzV7DG74"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"08aF4/bYWKrdGPFdXmZCQU6IrOE1ulpevmWBM3kiShJPAbRbZ6Awk7buWkIxlMF6kX3kb4QpbAlZfHLQgncjCw"}},"state_key":"","type":"m.room.create"}`),
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}]],"content":{"membership":"join"},"depth":1,"event_id":"$fnwGrQEpiOIUoDU2:baba.is.you","hashes":{"sha256":"DqOjdFgvFQ3V/jvQW2j3ygHL4D+t7/LaIPZ/tHTDZtI"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}]],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"qBWLb42zicQVsbh333YrcKpHfKokcUOM/ytldGlrgSdXqDEDDxvpcFlfadYnyvj3Z/GjA2XZkqKHanNEh575Bw"}},"state_key":"@userid:baba.is.you","type":"m.room.member"}`),
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Test Message"},"depth":2,"event_id":"$xOJZshi3NeKKJiCf:baba.is.you","hashes":{"sha256":"lu5fF5HE090AXdu/+NpJ/RjRVRk/2tWCUozUc5t7Ru4"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"5KoVSLOBesqH9vciKXDExdu95lKFDtK1I72Hq1GG/UeEsH9jx7wL3V4jGYSKDnX2aLYp/VPiBQje7DFjde+hDQ"}},"type":"m.room.message"}`),
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Test Message"},"depth":3,"event_id":"$4Kp0G1yWZ6tNpeI7:baba.is.you","hashes":{"sha256":"B+MjcGZRh72iaGOgyNbIxgFkHDJo6NO8NQDgiKDKDBA"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$xOJZshi3NeKKJiCf:baba.is.you",{"sha256":"5PGENImHC863Yz9sO6IJX+bIQthZFI2RMhFZyFy+bC0"}]],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"rP+Ybp17GPCqQBrTQ3yz+q6PihdaMWvNY3SngV8aDLHv8wdDlH4ULGnjsB+Az7trqYdCE3rZVo9M7Hy5tOObDg"}},"type":"m.room.message"}`),
+	}
+	keyRing := &testNopJSONVerifier{}
+	tbr := &testBackfillRequester{
+		servers:             []spec.ServerName{serverA, slowServer},
+		authEventsToProvide: testBackfillEvents,
+		stateIDsAtEvent: map[string][]string{
+			"$4Kp0G1yWZ6tNpeI7:baba.is.you": {"$fnwGrQEpiOIUoDU2:baba.is.you", "$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$xOJZshi3NeKKJiCf:baba.is.you": {"$fnwGrQEpiOIUoDU2:baba.is.you", "$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$fnwGrQEpiOIUoDU2:baba.is.you": {"$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$WCraVpPZe5TtHAqs:baba.is.you": nil,
+		},
+		waitForCancel: slowServer,
+		backfillFn: func(origin, server spec.ServerName, roomID string, fromEventIDs []string, limit int) (*Transaction, error) {
+			return &Transaction{
+				Origin:         origin,
+				OriginServerTS: spec.AsTimestamp(time.Now()),
+				PDUs: []json.RawMessage{
+					testBackfillEvents[0], testBackfillEvents[1], testBackfillEvents[2], testBackfillEvents[3],
+				},
+			}, nil
+		},
+	}
+	result, err := RequestBackfill(ctx, serverA, tbr, keyRing, testRoomID, RoomVersionV1, testFromEventIDs, testLimit, UserIDForSenderTest)
+	if err != nil {
+		t.Fatalf("RequestBackfill returned an error: %s", err)
+	}
+	assertUnsortedEqual(t, result, testBackfillEvents)
+	if !tbr.cancelled {
+		t.Errorf("RequestBackfill returned before the request to the slow server was cancelled")
+	}
+}
+
 func TestRequestBackfillError(t *testing.T) {
 	ctx := context.Background()
 	// currently we have no way of checking that the events returned link back to the from event, so anything works here.
@@ -55,13 +55,14 @@ type eventFields struct {
 var emptyEventReferenceList = []eventReference{}
 
 const (
-	// The event ID, room ID, sender, event type and state key fields cannot be
-	// bigger than this.
+	// MaxIDLength is the most that the event ID, room ID, sender, event type
+	// and state key fields can be.
 	// https://github.com/matrix-org/synapse/blob/v0.21.0/synapse/event_auth.py#L173-L182
-	maxIDLength = 255
-	// The entire event JSON, including signatures cannot be bigger than this.
+	MaxIDLength = 255
+	// MaxEventLength is the most that the entire event JSON, including
+	// signatures, can be.
 	// https://github.com/matrix-org/synapse/blob/v0.21.0/synapse/event_auth.py#L183-184
-	maxEventLength = 65536
+	MaxEventLength = 65536
 )
 
 func checkID(id, kind string, sigil byte) (err error) {
@@ -75,17 +76,17 @@ func checkID(id, kind string, sigil byte) (err error) {
 		)
 		return
 	}
-	if l := utf8.RuneCountInString(id); l > maxIDLength {
+	if l := utf8.RuneCountInString(id); l > MaxIDLength {
 		err = EventValidationError{
 			Code:    EventValidationTooLarge,
-			Message: fmt.Sprintf("gomatrixserverlib: %s ID is too long, length %d > maximum %d", kind, l, maxIDLength),
+			Message: fmt.Sprintf("gomatrixserverlib: %s ID is too long, length %d > maximum %d", kind, l, MaxIDLength),
 		}
 		return
 	}
-	if l := len(id); l > maxIDLength {
+	if l := len(id); l > MaxIDLength {
 		err = EventValidationError{
 			Code:        EventValidationTooLarge,
-			Message:     fmt.Sprintf("gomatrixserverlib: %s ID is too long, length %d bytes > maximum %d bytes", kind, l, maxIDLength),
+			Message:     fmt.Sprintf("gomatrixserverlib: %s ID is too long, length %d bytes > maximum %d bytes", kind, l, MaxIDLength),
 			Persistable: true,
 		}
 		return
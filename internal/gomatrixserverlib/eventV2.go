@@ -205,26 +205,26 @@ func CheckFields(input PDU) error { // nolint: gocyclo
 	if input.AuthEventIDs() == nil || input.PrevEventIDs() == nil {
 		return errors.New("gomatrixserverlib: auth events and prev events must not be nil")
 	}
-	if l := len(input.JSON()); l > maxEventLength {
+	if l := len(input.JSON()); l > MaxEventLength {
 		return EventValidationError{
 			Code:    EventValidationTooLarge,
-			Message: fmt.Sprintf("gomatrixserverlib: event is too long, length %d bytes > maximum %d bytes", l, maxEventLength),
+			Message: fmt.Sprintf("gomatrixserverlib: event is too long, length %d bytes > maximum %d bytes", l, MaxEventLength),
 		}
 	}
 
 	// Compatibility to Synapse and older rooms. This was always enforced by Synapse
-	if l := utf8.RuneCountInString(input.Type()); l > maxIDLength {
+	if l := utf8.RuneCountInString(input.Type()); l > MaxIDLength {
 		return EventValidationError{
 			Code:    EventValidationTooLarge,
-			Message: fmt.Sprintf("gomatrixserverlib: event type is too long, length %d bytes > maximum %d bytes", l, maxIDLength),
+			Message: fmt.Sprintf("gomatrixserverlib: event type is too long, length %d bytes > maximum %d bytes", l, MaxIDLength),
 		}
 	}
 
 	if input.StateKey() != nil {
-		if l := utf8.RuneCountInString(*input.StateKey()); l > maxIDLength {
+		if l := utf8.RuneCountInString(*input.StateKey()); l > MaxIDLength {
 			return EventValidationError{
 				Code:    EventValidationTooLarge,
-				Message: fmt.Sprintf("gomatrixserverlib: state key is too long, length %d bytes > maximum %d bytes", l, maxIDLength),
+				Message: fmt.Sprintf("gomatrixserverlib: state key is too long, length %d bytes > maximum %d bytes", l, MaxIDLength),
 			}
 		}
 	}
@@ -232,19 +232,19 @@ func CheckFields(input PDU) error { // nolint: gocyclo
 	_, persistable := lenientByteLimitRoomVersions[input.Version()]
 
 	// Byte size check: if these fail, then be lenient to avoid breaking rooms.
-	if l := len(input.Type()); l > maxIDLength {
+	if l := len(input.Type()); l > MaxIDLength {
 		return EventValidationError{
 			Code:        EventValidationTooLarge,
-			Message:     fmt.Sprintf("gomatrixserverlib: event type is too long, length %d bytes > maximum %d bytes", l, maxIDLength),
+			Message:     fmt.Sprintf("gomatrixserverlib: event type is too long, length %d bytes > maximum %d bytes", l, MaxIDLength),
 			Persistable: persistable,
 		}
 	}
 
 	if input.StateKey() != nil {
-		if l := len(*input.StateKey()); l > maxIDLength {
+		if l := len(*input.StateKey()); l > MaxIDLength {
 			return EventValidationError{
 				Code:        EventValidationTooLarge,
-				Message:     fmt.Sprintf("gomatrixserverlib: state key is too long, length %d bytes > maximum %d bytes", l, maxIDLength),
+				Message:     fmt.Sprintf("gomatrixserverlib: state key is too long, length %d bytes > maximum %d bytes", l, MaxIDLength),
 				Persistable: persistable,
 			}
 		}
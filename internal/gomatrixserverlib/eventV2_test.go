@@ -43,7 +43,7 @@ func TestCheckFields(t *testing.T) {
 				RoomID:     roomID,
 				PrevEvents: []string{},
 				AuthEvents: []string{},
-				Content:    spec.RawJSON(fmt.Sprintf(`{"data":"%s"}`, strings.Repeat("x", maxEventLength))),
+				Content:    spec.RawJSON(fmt.Sprintf(`{"data":"%s"}`, strings.Repeat("x", MaxEventLength))),
 				Unsigned:   spec.RawJSON("{}"),
 			},
 			wantErr: assert.Error,
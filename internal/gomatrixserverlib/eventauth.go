@@ -18,6 +18,7 @@ package gomatrixserverlib
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 
 	"golang.org/x/crypto/ed25519"
@@ -292,6 +293,16 @@ func (a *AuthEvents) ThirdPartyInvite(stateKey string) (PDU, error) {
 	return a.events[StateKeyTuple{spec.MRoomThirdPartyInvite, stateKey}], nil
 }
 
+// EventIDs returns the IDs of the events in the AuthEventProvider, sorted.
+func (a *AuthEvents) EventIDs() []string {
+	eventIDs := make([]string, 0, len(a.events))
+	for _, event := range a.events {
+		eventIDs = append(eventIDs, event.EventID())
+	}
+	sort.Strings(eventIDs)
+	return eventIDs
+}
+
 // Clear removes all entries from the AuthEventProvider.
 func (a *AuthEvents) Clear() {
 	for k := range a.events {
@@ -579,6 +579,7 @@ type RelationContent struct {
 type RelatesTo struct {
 	EventID      string `json:"event_id"`
 	RelationType string `json:"rel_type"`
+	Key          string `json:"key,omitempty"` // for m.annotation relations
 }
 
 func noCheckCreateEvent(event PDU, knownRoomVersion knownRoomVersionFunc) error {
@@ -148,25 +148,7 @@ func emptyAuthorisedViaServerName([]byte) (spec.ServerName, error) { return "",
 // This hash is used to detect whether the unredacted content of the event is valid.
 // Returns the event JSON with a "hashes" key added to it.
 func addContentHashesToEvent(eventJSON []byte) ([]byte, error) {
-	var event map[string]spec.RawJSON
-
-	if err := json.Unmarshal(eventJSON, &event); err != nil {
-		return nil, err
-	}
-
-	unsignedJSON := event["unsigned"]
-	signatures := event["signatures"]
-
-	delete(event, "signatures")
-	delete(event, "unsigned")
-	delete(event, "hashes")
-
-	hashableEventJSON, err := json.Marshal(event)
-	if err != nil {
-		return nil, err
-	}
-
-	hashableEventJSON, err = CanonicalJSON(hashableEventJSON)
+	hashableEventJSON, err := canonicalJSONWithout(eventJSON, "signatures", "unsigned", "hashes")
 	if err != nil {
 		return nil, err
 	}
@@ -180,15 +162,9 @@ func addContentHashesToEvent(eventJSON []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	if len(unsignedJSON) > 0 {
-		event["unsigned"] = unsignedJSON
-	}
-	if len(signatures) > 0 {
-		event["signatures"] = signatures
-	}
-	event["hashes"] = spec.RawJSON(hashesJSON)
-
-	return json.Marshal(event)
+	// The "unsigned" and "signatures" keys are left where they are, and the
+	// event is canonicalised once it has been signed.
+	return sjson.SetRawBytes(eventJSON, "hashes", hashesJSON)
 }
 
 // checkEventContentHash checks if the unredacted content of the event matches the SHA-256 hash under the "hashes" key.
@@ -226,25 +202,18 @@ func referenceOfEvent(eventJSON []byte, roomVersion RoomVersion) (eventReference
 	if err != nil {
 		return eventReference{}, err
 	}
-	redactedJSON, err := verImpl.RedactEventJSON(eventJSON)
-	if err != nil {
-		return eventReference{}, err
-	}
-
-	var event map[string]spec.RawJSON
-	if err = json.Unmarshal(redactedJSON, &event); err != nil {
-		return eventReference{}, err
+	// Redacting the event keeps the last of any duplicated keys, but gjson
+	// reads the first, so the event ID could differ from the one that other
+	// code reads from the event.
+	if key, ok := duplicateKey(gjson.ParseBytes(eventJSON)); ok {
+		return eventReference{}, BadJSONError{fmt.Errorf("duplicate key %q", key)}
 	}
-
-	delete(event, "signatures")
-	delete(event, "unsigned")
-
-	hashableEventJSON, err := json.Marshal(event)
+	redactedJSON, err := verImpl.RedactEventJSON(eventJSON)
 	if err != nil {
 		return eventReference{}, err
 	}
 
-	hashableEventJSON, err = CanonicalJSON(hashableEventJSON)
+	hashableEventJSON, err := canonicalJSONWithout(redactedJSON, "signatures", "unsigned")
 	if err != nil {
 		return eventReference{}, err
 	}
@@ -257,9 +226,11 @@ func referenceOfEvent(eventJSON []byte, roomVersion RoomVersion) (eventReference
 
 	switch eventFormat {
 	case EventFormatV1:
-		if err = json.Unmarshal(event["event_id"], &eventID); err != nil {
-			return eventReference{}, err
+		eventIDResult := gjson.GetBytes(redactedJSON, "event_id")
+		if eventIDResult.Type != gjson.String {
+			return eventReference{}, fmt.Errorf("event_id is not a string")
 		}
+		eventID = eventIDResult.Str
 	case EventFormatV2:
 		var encoder *base64.Encoding
 		switch eventIDFormat {
@@ -297,20 +268,7 @@ func signEvent(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, e
 		return nil, err
 	}
 
-	var signedEvent struct {
-		Signatures spec.RawJSON `json:"signatures"`
-	}
-	if err := json.Unmarshal(signedJSON, &signedEvent); err != nil {
-		return nil, err
-	}
-
-	// Unmarshal the event JSON so that we can replace the signatures key.
-	var event map[string]spec.RawJSON
-	if err := json.Unmarshal(eventJSON, &event); err != nil {
-		return nil, err
-	}
-
-	event["signatures"] = signedEvent.Signatures
-
-	return json.Marshal(event)
+	// Replace the signatures key of the unredacted event in place. Callers
+	// canonicalise the event afterwards.
+	return sjson.SetRawBytes(eventJSON, "signatures", []byte(gjson.GetBytes(signedJSON, "signatures").Raw))
 }
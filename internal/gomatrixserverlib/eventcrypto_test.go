@@ -20,6 +20,7 @@ import (
 	"context"
 	"encoding/base64"
 	"sort"
+	"strings"
 	"testing"
 
 	"golang.org/x/crypto/ed25519"
@@ -473,3 +474,14 @@ func TestVerifyAllEventSignaturesForInvite(t *testing.T) {
 		t.Errorf("Verify server 1: got %s, want %s", servers[1], "bobserver")
 	}
 }
+
+func TestReferenceOfEventDuplicateKeys(t *testing.T) {
+	eventJSON := `{"content":{},"event_id":"$a:localhost","room_id":"!r:localhost","sender":"@u:localhost","type":"m.room.message"}`
+	if _, err := referenceOfEvent([]byte(eventJSON), RoomVersionV1); err != nil {
+		t.Fatal(err)
+	}
+	duplicated := strings.Replace(eventJSON, `"event_id":"$a:localhost"`, `"event_id":"$a:localhost","event_id":"$b:localhost"`, 1)
+	if _, err := referenceOfEvent([]byte(duplicated), RoomVersionV1); err == nil {
+		t.Fatalf("expected an error for an event with a duplicated event_id")
+	}
+}
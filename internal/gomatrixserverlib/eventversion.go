@@ -338,6 +338,7 @@ var roomVersionMeta = map[RoomVersion]IRoomVersion{
 		checkRestrictedJoin:                    checkRestrictedJoin,
 		parsePowerLevelsFunc:                   parsePowerLevels,
 		checkKnockingAllowedFunc:               checkKnocking,
+		checkRestrictedJoinAllowedFunc:         allowRestrictedJoins,
 		checkCreateEvent:                       checkCreateEvent,
 		newEventFromUntrustedJSONFunc:          newEventFromUntrustedJSONV2,
 		newEventFromTrustedJSONFunc:            newEventFromTrustedJSONV2,
@@ -471,6 +472,15 @@ func (v RoomVersionImpl) CheckRestrictedJoinsAllowed() error {
 	return v.checkRestrictedJoinAllowedFunc()
 }
 
+// KnockingAllowed returns whether the room version supports knocking on
+// rooms at all, regardless of who is knocking.
+func KnockingAllowed(verImpl IRoomVersion) bool {
+	return verImpl.CheckKnockingAllowed(&membershipAllower{
+		allowerContext:  &allowerContext{joinRule: JoinRuleContent{JoinRule: spec.Knock}},
+		roomVersionImpl: verImpl,
+	}) == nil
+}
+
 // RestrictedJoinServername returns the severName from a potentially existing
 // join_authorised_via_users_server content field. Used to verify event signatures.
 func (v RoomVersionImpl) RestrictedJoinServername(content []byte) (spec.ServerName, error) {
@@ -44,8 +44,9 @@ const requestTimeout time.Duration = time.Duration(30) * time.Second
 // centralise a number of configurable options, such as DNS caching,
 // timeouts etc.
 type Client struct {
-	client    http.Client
-	userAgent string
+	client          http.Client
+	userAgent       string
+	resolutionCache *ResolutionCache
 }
 
 // UserInfo represents information about a user.
@@ -56,11 +57,14 @@ type UserInfo struct {
 type clientOptions struct {
 	transport    http.RoundTripper
 	dnsCache     *DNSCache
+	resolutions  *ResolutionCache
 	timeout      time.Duration
 	skipVerify   bool
 	keepAlives   bool
 	wellKnownSRV bool
 	userAgent    string
+	proxy        func(*http.Request) (*url.URL, error)
+	sources      *SourceAddresses
 }
 
 // ClientOption are supplied to NewClient or NewFederationClient.
@@ -77,19 +81,18 @@ func NewClient(options ...ClientOption) *Client {
 		option(clientOpts)
 	}
 	if clientOpts.transport == nil {
-		clientOpts.transport = newDestinationTripper(
-			clientOpts.skipVerify,
-			clientOpts.dnsCache,
-			clientOpts.keepAlives,
-			clientOpts.wellKnownSRV,
-		)
+		if clientOpts.resolutions == nil {
+			clientOpts.resolutions = NewResolutionCache()
+		}
+		clientOpts.transport = newDestinationTripper(clientOpts)
 	}
 	client := &Client{
 		client: http.Client{
 			Transport: clientOpts.transport,
 			Timeout:   clientOpts.timeout,
 		},
-		userAgent: clientOpts.userAgent,
+		userAgent:       clientOpts.userAgent,
+		resolutionCache: clientOpts.resolutions,
 	}
 	return client
 }
@@ -103,6 +106,16 @@ func WithTransport(transport http.RoundTripper) ClientOption {
 	}
 }
 
+// WithResolutionCache is an option that can be supplied to either NewClient
+// or NewFederationClient, which shares the cache of resolved server names
+// between clients. This option will be ineffective if WithTransport has
+// already been supplied.
+func WithResolutionCache(cache *ResolutionCache) ClientOption {
+	return func(options *clientOptions) {
+		options.resolutions = cache
+	}
+}
+
 // WithTimeout is an option that can be supplied to either NewClient or
 // NewFederationClient.
 func WithTimeout(duration time.Duration) ClientOption {
@@ -138,6 +151,27 @@ func WithKeepAlives(keepAlives bool) ClientOption {
 	}
 }
 
+// WithProxy is an option that can be supplied to either NewClient or
+// NewFederationClient, which sends requests through the HTTP, HTTPS or
+// SOCKS5 proxy at the given URL. Otherwise the proxy is taken from the
+// environment. This option will be ineffective if WithTransport has
+// already been supplied.
+func WithProxy(proxyURL *url.URL) ClientOption {
+	return func(options *clientOptions) {
+		options.proxy = http.ProxyURL(proxyURL)
+	}
+}
+
+// WithSourceAddresses is an option that can be supplied to either NewClient
+// or NewFederationClient, which makes connections from the given local
+// addresses. This option will be ineffective if WithTransport has already
+// been supplied.
+func WithSourceAddresses(sources SourceAddresses) ClientOption {
+	return func(options *clientOptions) {
+		options.sources = &sources
+	}
+}
+
 // WithWellKnownSRVLookups enables federation lookups of well-known and SRV records.
 func WithWellKnownSRVLookups(wellKnownSRV bool) ClientOption {
 	return func(options *clientOptions) {
@@ -161,19 +195,50 @@ type destinationTripper struct {
 	transports      map[string]*destinationTripperTransport
 	transportsMutex sync.Mutex
 	skipVerify      bool
-	resolutionCache sync.Map // serverName -> []ResolutionResult
+	resolutionCache *ResolutionCache
 	dnsCache        *DNSCache
 	keepAlives      bool
 	wellKnownSRV    bool
+	proxy           func(*http.Request) (*url.URL, error)
+	dialContext     func(ctx context.Context, network, address string) (net.Conn, error)
+	wellKnownClient *http.Client // used to look up .well-known files
 }
 
-func newDestinationTripper(skipVerify bool, dnsCache *DNSCache, keepAlives, wellKnownSRV bool) *destinationTripper {
+func newDestinationTripper(opts *clientOptions) *destinationTripper {
 	tripper := &destinationTripper{
-		transports:   make(map[string]*destinationTripperTransport),
-		skipVerify:   skipVerify,
-		dnsCache:     dnsCache,
-		keepAlives:   keepAlives,
-		wellKnownSRV: wellKnownSRV,
+		transports:      make(map[string]*destinationTripperTransport),
+		skipVerify:      opts.skipVerify,
+		resolutionCache: opts.resolutions,
+		dnsCache:        opts.dnsCache,
+		keepAlives:      opts.keepAlives,
+		wellKnownSRV:    opts.wellKnownSRV,
+		proxy:           http.ProxyFromEnvironment,
+		dialContext:     destinationTripperDialer.DialContext,
+		wellKnownClient: http.DefaultClient,
+	}
+	if opts.proxy != nil {
+		tripper.proxy = opts.proxy
+	}
+	dialIP := dialIPWith(destinationTripperDialer)
+	if opts.sources != nil {
+		sources := newSourceDialer(destinationTripperDialer, *opts.sources)
+		dialIP = sources.dialIP
+		tripper.dialContext = sources.DialContext
+	}
+	if opts.dnsCache != nil {
+		tripper.dialContext = func(ctx context.Context, _, address string) (net.Conn, error) {
+			return opts.dnsCache.dialContext(ctx, address, dialIP)
+		}
+	}
+	if opts.proxy != nil || opts.sources != nil {
+		// The .well-known files need to be fetched the same way as
+		// everything else, as it may be the only way out.
+		tripper.wellKnownClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:       tripper.proxy,
+				DialContext: tripper.dialContext,
+			},
+		}
 	}
 	time.AfterFunc(destinationTripperReapInterval, tripper.reaper)
 	return tripper
@@ -231,14 +296,11 @@ func (f *destinationTripper) getTransport(tlsServerName string) http.RoundTrippe
 					ClientSessionCache: tls.NewLRUClientSessionCache(0), // 0 = use default
 				},
 				Dial:              destinationTripperDialer.Dial, // nolint: staticcheck
-				DialContext:       destinationTripperDialer.DialContext,
-				Proxy:             http.ProxyFromEnvironment,
+				DialContext:       f.dialContext,
+				Proxy:             f.proxy,
 				ForceAttemptHTTP2: true, // if we can multiplex requests over HTTP/2, we should
 			},
 		}
-		if f.dnsCache != nil {
-			tr.DialContext = f.dnsCache.DialContext
-		}
 		transport, f.transports[tlsServerName] = tr, tr
 	}
 
@@ -262,19 +324,9 @@ func (f *destinationTripper) RoundTrip(r *http.Request) (*http.Response, error)
 
 retryResolution:
 	if f.wellKnownSRV {
-		if cached, ok := f.resolutionCache.Load(serverName); ok {
-			if results, ok := cached.([]ResolutionResult); ok {
-				resolutionResults = results
-			}
-		}
-
-		// If the cache returned nothing then we'll have no results here,
-		// so go and hit the network.
-		if len(resolutionResults) == 0 {
-			if err = ResolveServer(r.Context(), serverName, &resolutionResults); err != nil {
-				return nil, err
-			}
-			f.resolutionCache.Store(serverName, resolutionResults)
+		// If the results aren't cached, this will go and hit the network.
+		if resolutionResults, err = f.resolutionCache.resolve(r.Context(), f.wellKnownClient, serverName); err != nil {
+			return nil, err
 		}
 	} else {
 		resolutionResults = append(resolutionResults, ResolutionResult{
@@ -305,9 +357,10 @@ retryResolution:
 	}
 
 	// We failed to reach any of the locations in the resolution results,
-	// so clear the cache and mark that we're retrying, then give it a
-	// try again.
-	f.resolutionCache.Delete(serverName)
+	// so expire them and mark that we're retrying, then give it a try
+	// again. The number of .well-known failures in a row is kept, so that
+	// the backoff carries on growing.
+	f.resolutionCache.expire(serverName)
 	if !resolutionRetried {
 		resolutionRetried = true
 		goto retryResolution
@@ -317,6 +370,12 @@ retryResolution:
 	return nil, err
 }
 
+// ResolutionCache returns the cache of resolved server names used by the
+// client, or nil if the client was given its own transport.
+func (fc *Client) ResolutionCache() *ResolutionCache {
+	return fc.resolutionCache
+}
+
 // SetUserAgent sets the user agent string that is sent in the headers of
 // outbound HTTP requests.
 func (fc *Client) SetUserAgent(ua string) {
@@ -0,0 +1,99 @@
+package fclient_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+)
+
+func TestClientWithProxy(t *testing.T) {
+	// The proxy refuses to connect anywhere, but records where it was
+	// asked to connect to and who by.
+	connects := make(chan *http.Request, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			select {
+			case connects <- r:
+			default:
+			}
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL.User = url.UserPassword("alice", "secret")
+	client := fclient.NewClient(fclient.WithProxy(proxyURL))
+
+	req, err := http.NewRequest(http.MethodGet, "matrix://remote.test:8448/_matrix/key/v2/server", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.DoHTTPRequest(context.Background(), req); err == nil {
+		t.Fatal("expected the request to fail as the proxy refused it")
+	}
+
+	select {
+	case r := <-connects:
+		if r.Host != "remote.test:8448" {
+			t.Fatalf("proxy was asked to connect to %q, want %q", r.Host, "remote.test:8448")
+		}
+		user, pass, ok := (&http.Request{Header: http.Header{
+			"Authorization": r.Header["Proxy-Authorization"],
+		}}).BasicAuth()
+		if !ok || user != "alice" || pass != "secret" {
+			t.Fatalf("proxy was not given the credentials, got %q", r.Header.Get("Proxy-Authorization"))
+		}
+	default:
+		t.Fatal("request was not sent through the proxy")
+	}
+}
+
+func TestClientWithSourceAddresses(t *testing.T) {
+	// 127.0.0.2 is also a loopback address, but isn't the one that the
+	// operating system would pick to connect to 127.0.0.1 with. Not every
+	// operating system has it, e.g. macOS only has 127.0.0.1.
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 can't be bound: %s", err)
+	}
+	_ = l.Close()
+	remotes := make(chan string, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case remotes <- r.RemoteAddr:
+		default:
+		}
+	}))
+	defer server.Close()
+
+	client := fclient.NewClient(fclient.WithSkipVerify(true), fclient.WithSourceAddresses(fclient.SourceAddresses{
+		IPv4: net.ParseIP("127.0.0.2"),
+	}))
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.DoHTTPRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	remote := <-remotes
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "127.0.0.2" {
+		t.Fatalf("request came from %q, want %q", host, "127.0.0.2")
+	}
+}
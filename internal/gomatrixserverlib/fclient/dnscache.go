@@ -89,6 +89,12 @@ func (c *DNSCache) lookup(ctx context.Context, name string) (*dnsCacheEntry, boo
 }
 
 func (c *DNSCache) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return c.dialContext(ctx, address, dialIPWith(&net.Dialer{}))
+}
+
+// dialContext connects to the address, looking up the host in the cache,
+// using the dial function to connect to each of its IP addresses.
+func (c *DNSCache) dialContext(ctx context.Context, address string, dialIP func(ctx context.Context, ip net.IP, port string) (net.Conn, error)) (net.Conn, error) {
 	// Split up the host and port from the give address.
 	host, port, err := net.SplitHostPort(address)
 	if err != nil {
@@ -100,7 +106,6 @@ func (c *DNSCache) DialContext(ctx context.Context, network, address string) (ne
 	// retried set to true. This stops us from recursing more than
 	// once.
 	retried := false
-	dialer := net.Dialer{}
 
 retryLookup:
 	// Consult the cache for the hostname. This will cause the OS to
@@ -113,7 +118,7 @@ retryLookup:
 	// Try each address in the cached entry. If we successfully connect
 	// to one of those addresses then return the conn and stop there.
 	for _, addr := range entry.addrs {
-		conn, err := dialer.DialContext(ctx, "tcp", addr.String()+":"+port)
+		conn, err := dialIP(ctx, addr.IP, port)
 		if err != nil {
 			continue
 		}
@@ -23,6 +23,10 @@ type FederationClient interface {
 
 	SendTransaction(ctx context.Context, t gomatrixserverlib.Transaction) (res RespSend, err error)
 
+	// ResolutionCache returns the cache of resolved server names, or nil if
+	// there isn't one.
+	ResolutionCache() *ResolutionCache
+
 	// Perform operations
 	LookupRoomAlias(ctx context.Context, origin, s spec.ServerName, roomAlias string) (res RespDirectory, err error)
 	Peek(ctx context.Context, origin, s spec.ServerName, roomID, peekID string, roomVersions []gomatrixserverlib.RoomVersion) (res RespPeek, err error)
@@ -70,7 +74,7 @@ type FederationClient interface {
 // "Authorization: X-Matrix" headers to requests that need ed25519 signatures
 type federationClient struct {
 	Client
-	identities []*SigningIdentity
+	identityFor func(serverName spec.ServerName) (*SigningIdentity, error)
 }
 
 type SigningIdentity struct {
@@ -87,12 +91,33 @@ type SigningIdentity struct {
 func NewFederationClient(
 	identities []*SigningIdentity,
 	options ...ClientOption,
+) FederationClient {
+	identities = append([]*SigningIdentity{}, identities...)
+	return NewFederationClientWithIdentityFunc(
+		func(serverName spec.ServerName) (*SigningIdentity, error) {
+			for _, id := range identities {
+				if id.ServerName == serverName {
+					return id, nil
+				}
+			}
+			return nil, fmt.Errorf("no signing identity for server name %q", serverName)
+		},
+		options...,
+	)
+}
+
+// NewFederationClientWithIdentityFunc makes a new FederationClient which
+// looks up the signing identity for every request, so that the signing
+// keys can be changed while the client is in use.
+func NewFederationClientWithIdentityFunc(
+	identityFor func(serverName spec.ServerName) (*SigningIdentity, error),
+	options ...ClientOption,
 ) FederationClient {
 	return &federationClient{
 		Client: *NewClient(
 			append(options, WithWellKnownSRVLookups(true))...,
 		),
-		identities: append([]*SigningIdentity{}, identities...),
+		identityFor: identityFor,
 	}
 }
 
@@ -101,17 +126,11 @@ func (ac *federationClient) DoRequestAndParseResponse(ctx context.Context, req *
 }
 
 func (ac *federationClient) doRequest(ctx context.Context, r FederationRequest, resBody interface{}) error {
-	var identity *SigningIdentity
-	for _, id := range ac.identities {
-		if id.ServerName == r.Origin() {
-			identity = id
-			break
-		}
-	}
-	if identity == nil {
-		return fmt.Errorf("no signing identity for server name %q", r.Origin())
+	identity, err := ac.identityFor(r.Origin())
+	if err != nil {
+		return err
 	}
-	if err := r.Sign(identity.ServerName, identity.KeyID, identity.PrivateKey); err != nil {
+	if err = r.Sign(identity.ServerName, identity.KeyID, identity.PrivateKey); err != nil {
 		return err
 	}
 
@@ -694,15 +713,9 @@ func (ac *federationClient) RoomHierarchy(
 func (ac *federationClient) DownloadMedia(
 	ctx context.Context, origin, destination spec.ServerName, mediaID string,
 ) (*http.Response, error) {
-	var identity *SigningIdentity
-	for _, id := range ac.identities {
-		if id.ServerName == origin {
-			identity = id
-			break
-		}
-	}
-	if identity == nil {
-		return nil, fmt.Errorf("no signing identity for server name %q", origin)
+	identity, err := ac.identityFor(origin)
+	if err != nil {
+		return nil, err
 	}
 
 	path := federationPathPrefixV1 + "/media/download/" + url.PathEscape(mediaID)
@@ -162,3 +162,44 @@ func jsonify(x interface{}) string {
 	b, _ := json.Marshal(x)
 	return string(b)
 }
+
+func TestFederationClientWithIdentityFunc(t *testing.T) {
+	serverName := spec.ServerName("local.server.name")
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	identity := &fclient.SigningIdentity{ServerName: serverName, KeyID: "ed25519:old", PrivateKey: privateKey}
+	var authorization string
+	fc := fclient.NewFederationClientWithIdentityFunc(
+		func(origin spec.ServerName) (*fclient.SigningIdentity, error) {
+			if origin != serverName {
+				return nil, fmt.Errorf("no signing identity for %q", origin)
+			}
+			return identity, nil
+		},
+		fclient.WithSkipVerify(true),
+		fclient.WithTransport(
+			&roundTripper{
+				fn: func(req *http.Request) (*http.Response, error) {
+					authorization = req.Header.Get("Authorization")
+					return &http.Response{
+						StatusCode: 404,
+						Body:       io.NopCloser(strings.NewReader("404 not found")),
+					}, nil
+				},
+			},
+		),
+	)
+
+	// The identity is looked up for every request, so a new key is used as
+	// soon as it is swapped in.
+	for _, keyID := range []gomatrixserverlib.KeyID{"ed25519:old", "ed25519:new"} {
+		identity = &fclient.SigningIdentity{ServerName: serverName, KeyID: keyID, PrivateKey: privateKey}
+		_, _ = fc.LookupRoomAlias(context.Background(), serverName, "target.server.name", "#alias:target.server.name")
+		if !strings.Contains(authorization, `key="`+string(keyID)+`"`) {
+			t.Fatalf("expected the request to be signed with %s, got %q", keyID, authorization)
+		}
+	}
+
+	if _, err := fc.LookupRoomAlias(context.Background(), "other.server.name", "target.server.name", "#alias:target.server.name"); err == nil {
+		t.Fatal("expected a request from an unknown server name to fail")
+	}
+}
@@ -0,0 +1,246 @@
+package fclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// How long to cache the results of looking up a server, following the
+// recommendations of the federation specification. A .well-known file is
+// cached for as long as its Cache-Control or Expires headers say, or for the
+// default if it has neither, but never for longer than the maximum. Failing
+// to fetch a .well-known file is cached for the minimum error time at first,
+// doubling for each failure in a row up to the maximum error time.
+const (
+	wellKnownDefaultCacheTime  = time.Hour * 24
+	wellKnownMaxCacheTime      = time.Hour * 48
+	wellKnownMinErrorCacheTime = time.Minute * 5
+	wellKnownMaxErrorCacheTime = time.Hour
+)
+
+// resolutionCacheMaxEntries is how many servers are kept in the cache. Once
+// it is full, the expired entries are removed, or if there are none, the
+// entry which expires soonest.
+const resolutionCacheMaxEntries = 10000
+
+// The outcomes of resolving a server, for the resolutions metric.
+const (
+	resolutionCached      = "cached"        // the results were already cached
+	resolutionDirect      = "direct"        // the server name was an IP address or had a port
+	resolutionWellKnown   = "well_known"    // the server delegated to another with .well-known
+	resolutionNoWellKnown = "no_well_known" // SRV records or the default port were used instead
+	resolutionInvalid     = "invalid"       // the server name was not valid
+)
+
+var (
+	serverResolutions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "server_resolutions_total",
+			Help:      "Number of times that the address of another server was resolved, by outcome",
+		},
+		[]string{"outcome"},
+	)
+	serverResolutionDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "server_resolution_duration_seconds",
+			Help:      "How long it took to resolve the address of another server which was not cached",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		serverResolutions, serverResolutionDuration,
+	)
+}
+
+// ResolutionCacheEntry is what has been found out about how to reach a
+// server, and until when.
+type ResolutionCacheEntry struct {
+	ServerName spec.ServerName    `json:"server_name"`
+	Results    []ResolutionResult `json:"results"`
+	// The server which the .well-known file delegated to, if there was one.
+	WellKnown spec.ServerName `json:"well_known,omitempty"`
+	// Why the .well-known file couldn't be used, and how many times in a row
+	// that has happened.
+	WellKnownError    string         `json:"well_known_error,omitempty"`
+	WellKnownFailures int            `json:"well_known_failures,omitempty"`
+	ExpiresAt         spec.Timestamp `json:"expires_at"`
+}
+
+// ResolutionCache remembers the results of resolving server names, so that
+// .well-known files and SRV records don't have to be looked up again for
+// every new connection to a server. It is safe to share between clients.
+type ResolutionCache struct {
+	mu      sync.Mutex
+	entries map[spec.ServerName]*ResolutionCacheEntry
+}
+
+func NewResolutionCache() *ResolutionCache {
+	return &ResolutionCache{
+		entries: make(map[spec.ServerName]*ResolutionCacheEntry),
+	}
+}
+
+// Entries returns everything in the cache, including the entries which have
+// expired but not yet been looked up again, sorted by server name.
+func (c *ResolutionCache) Entries() []ResolutionCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make([]ResolutionCacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ServerName < entries[j].ServerName
+	})
+	return entries
+}
+
+// Forget removes a server from the cache, so that it is resolved again the
+// next time that it is contacted. Returns false if it wasn't in the cache.
+func (c *ResolutionCache) Forget(serverName spec.ServerName) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[serverName]
+	delete(c.entries, serverName)
+	return ok
+}
+
+// expire drops the cached results for a server, so that it is resolved again
+// the next time that it is contacted, but keeps the number of times in a row
+// that its .well-known file couldn't be used.
+func (c *ResolutionCache) expire(serverName spec.ServerName) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[serverName]
+	if !ok {
+		return
+	}
+	// The entry may still be in use by resolve, so it is replaced rather
+	// than changed.
+	expired := *entry
+	expired.Results = nil
+	expired.ExpiresAt = spec.AsTimestamp(time.Now())
+	c.entries[serverName] = &expired
+}
+
+// store adds the entry to the cache, making room for it if the cache is full.
+func (c *ResolutionCache) store(entry *ResolutionCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[entry.ServerName]; !ok && len(c.entries) >= resolutionCacheMaxEntries {
+		now := spec.AsTimestamp(time.Now())
+		var soonest *ResolutionCacheEntry
+		for serverName, e := range c.entries {
+			if e.ExpiresAt <= now {
+				delete(c.entries, serverName)
+			} else if soonest == nil || e.ExpiresAt < soonest.ExpiresAt {
+				soonest = e
+			}
+		}
+		if len(c.entries) >= resolutionCacheMaxEntries && soonest != nil {
+			delete(c.entries, soonest.ServerName)
+		}
+	}
+	c.entries[entry.ServerName] = entry
+}
+
+// resolve returns the results of resolving the server name, looking up the
+// .well-known file with the client if they aren't cached or have expired.
+func (c *ResolutionCache) resolve(ctx context.Context, client *http.Client, serverName spec.ServerName) ([]ResolutionResult, error) {
+	c.mu.Lock()
+	cached := c.entries[serverName]
+	c.mu.Unlock()
+	if cached != nil && time.Now().Before(cached.ExpiresAt.Time()) {
+		serverResolutions.WithLabelValues(resolutionCached).Inc()
+		return cached.Results, nil
+	}
+
+	// Keep count of the .well-known failures in a row, so that we back off
+	// for longer each time.
+	failures := 0
+	if cached != nil && cached.WellKnownError != "" {
+		failures = cached.WellKnownFailures
+	}
+	start := time.Now()
+	entry, outcome, err := lookupResolutionCacheEntry(ctx, client, serverName, failures)
+	serverResolutions.WithLabelValues(outcome).Inc()
+	if err != nil {
+		return nil, err
+	}
+	serverResolutionDuration.Observe(time.Since(start).Seconds())
+
+	c.store(entry)
+	return entry.Results, nil
+}
+
+// lookupResolutionCacheEntry resolves the server name from scratch, working
+// out how long the results can be cached for. failures is the number of
+// times in a row that the .well-known file couldn't be used before now.
+func lookupResolutionCacheEntry(ctx context.Context, client *http.Client, serverName spec.ServerName, failures int) (*ResolutionCacheEntry, string, error) {
+	host, port, valid := spec.ParseAndValidateServerName(serverName)
+	if !valid {
+		return nil, resolutionInvalid, fmt.Errorf("Invalid server name")
+	}
+	now := time.Now()
+	entry := &ResolutionCacheEntry{
+		ServerName: serverName,
+	}
+
+	// IP addresses and server names with ports are resolved without looking
+	// anything up, so can be cached for as long as we like.
+	if host[0] == '[' && host[len(host)-1] == ']' {
+		host = host[1 : len(host)-1]
+	}
+	if port != -1 || net.ParseIP(host) != nil {
+		if err := resolveServer(ctx, client, serverName, false, &entry.Results); err != nil {
+			return nil, resolutionInvalid, err
+		}
+		entry.ExpiresAt = spec.AsTimestamp(now.Add(wellKnownDefaultCacheTime))
+		return entry, resolutionDirect, nil
+	}
+
+	wellKnown, err := lookupWellKnown(ctx, client, serverName)
+	if err == nil {
+		if err = resolveServer(ctx, client, wellKnown.NewAddress, false, &entry.Results); err == nil {
+			entry.WellKnown = wellKnown.NewAddress
+			expires := now.Add(wellKnownDefaultCacheTime)
+			if wellKnown.CacheExpiresAt != 0 {
+				expires = time.Unix(wellKnown.CacheExpiresAt, 0)
+			}
+			if latest := now.Add(wellKnownMaxCacheTime); expires.After(latest) {
+				expires = latest
+			}
+			entry.ExpiresAt = spec.AsTimestamp(expires)
+			return entry, resolutionWellKnown, nil
+		}
+		err = fmt.Errorf("invalid m.server %q: %w", wellKnown.NewAddress, err)
+	}
+
+	handleNoWellKnown(ctx, serverName, &entry.Results)
+	entry.WellKnownError = err.Error()
+	entry.WellKnownFailures = failures + 1
+	backoff := wellKnownMaxErrorCacheTime
+	if failures < 10 {
+		backoff = wellKnownMinErrorCacheTime << failures
+	}
+	if backoff > wellKnownMaxErrorCacheTime {
+		backoff = wellKnownMaxErrorCacheTime
+	}
+	entry.ExpiresAt = spec.AsTimestamp(now.Add(backoff))
+	return entry, resolutionNoWellKnown, nil
+}
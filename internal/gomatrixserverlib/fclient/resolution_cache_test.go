@@ -0,0 +1,145 @@
+package fclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"gopkg.in/h2non/gock.v1"
+)
+
+// assertExpiresIn checks that the cache entry expires after roughly the
+// given duration from now.
+func assertExpiresIn(t *testing.T, entry ResolutionCacheEntry, d time.Duration) {
+	t.Helper()
+	if expiresIn := time.Until(entry.ExpiresAt.Time()); expiresIn > d || expiresIn < d-time.Minute {
+		t.Fatalf("entry expires in %s, want %s", expiresIn, d)
+	}
+}
+
+func TestResolutionCacheWellKnown(t *testing.T) {
+	defer gock.Off()
+
+	// The .well-known file asks to be cached for longer than we allow. It
+	// can only be fetched once, so the second resolution must be cached.
+	gock.New("https://example.com").
+		Get("/.well-known/matrix/server").
+		Reply(200).
+		SetHeader("Cache-Control", "max-age=604800").
+		BodyString("{\"m.server\": \"42.42.42.42:443\"}")
+
+	cache := NewResolutionCache()
+	for i := 0; i < 2; i++ {
+		res, err := cache.resolve(context.Background(), http.DefaultClient, "example.com")
+		assertCritical(t, err, nil)
+		assertCritical(t, len(res), 1)
+		assertCritical(t, res[0].Destination, "42.42.42.42:443")
+	}
+	assertCritical(t, gock.IsDone(), true)
+
+	entries := cache.Entries()
+	assertCritical(t, len(entries), 1)
+	assertCritical(t, entries[0].WellKnown, spec.ServerName("42.42.42.42:443"))
+	assertCritical(t, entries[0].WellKnownFailures, 0)
+	assertExpiresIn(t, entries[0], wellKnownMaxCacheTime)
+
+	assertCritical(t, cache.Forget("example.com"), true)
+	assertCritical(t, len(cache.Entries()), 0)
+}
+
+func TestResolutionCacheWellKnownError(t *testing.T) {
+	defer gock.Off()
+
+	cleanup := setupFakeDNS(false)
+	defer cleanup()
+
+	cache := NewResolutionCache()
+	for failures := 1; failures <= 3; failures++ {
+		gock.New("https://example.com").
+			Get("/.well-known/matrix/server").
+			Reply(404)
+
+		res, err := cache.resolve(context.Background(), http.DefaultClient, "example.com")
+		assertCritical(t, err, nil)
+		assertCritical(t, len(res), 1)
+		assertCritical(t, res[0].Destination, "example.com:8448")
+
+		// Each failure in a row is cached for twice as long as the last.
+		entries := cache.Entries()
+		assertCritical(t, len(entries), 1)
+		assertCritical(t, entries[0].WellKnownFailures, failures)
+		assertExpiresIn(t, entries[0], wellKnownMinErrorCacheTime<<(failures-1))
+
+		// Expire the entry, so that the .well-known file is fetched again.
+		cache.entries["example.com"].ExpiresAt = spec.AsTimestamp(time.Now())
+	}
+	assertCritical(t, gock.IsDone(), true)
+}
+
+func TestResolutionCacheInvalid(t *testing.T) {
+	cache := NewResolutionCache()
+	if _, err := cache.resolve(context.Background(), http.DefaultClient, "invalid:name:here"); err == nil {
+		t.Fatal("expected an invalid server name to fail to resolve")
+	}
+	assertCritical(t, len(cache.Entries()), 0)
+}
+
+func TestResolutionCacheExpireKeepsFailures(t *testing.T) {
+	cache := NewResolutionCache()
+	cache.entries["example.com"] = &ResolutionCacheEntry{
+		ServerName:        "example.com",
+		Results:           []ResolutionResult{{Destination: "example.com:8448"}},
+		WellKnownError:    "not found",
+		WellKnownFailures: 3,
+		ExpiresAt:         spec.AsTimestamp(time.Now().Add(time.Hour)),
+	}
+
+	// Failing to connect drops the results, but not the failure count.
+	cache.expire("example.com")
+	entries := cache.Entries()
+	assertCritical(t, len(entries), 1)
+	assertCritical(t, len(entries[0].Results), 0)
+	assertCritical(t, entries[0].WellKnownFailures, 3)
+	if entries[0].ExpiresAt.Time().After(time.Now()) {
+		t.Fatal("expected the entry to have expired")
+	}
+
+	// Expiring a server which isn't cached does nothing.
+	cache.expire("missing.com")
+	assertCritical(t, len(cache.Entries()), 1)
+}
+
+func TestResolutionCacheEviction(t *testing.T) {
+	cache := NewResolutionCache()
+	now := time.Now()
+	for i := 0; i < resolutionCacheMaxEntries; i++ {
+		serverName := spec.ServerName(fmt.Sprintf("server%d.com", i))
+		cache.entries[serverName] = &ResolutionCacheEntry{
+			ServerName: serverName,
+			ExpiresAt:  spec.AsTimestamp(now.Add(time.Hour + time.Duration(i)*time.Second)),
+		}
+	}
+
+	// When nothing has expired, the entry which expires soonest is evicted.
+	cache.store(&ResolutionCacheEntry{ServerName: "new1.com", ExpiresAt: spec.AsTimestamp(now.Add(time.Hour))})
+	assertCritical(t, len(cache.entries), resolutionCacheMaxEntries)
+	if _, ok := cache.entries["server0.com"]; ok {
+		t.Fatal("expected the entry which expires soonest to be evicted")
+	}
+
+	// Otherwise all of the expired entries are.
+	cache.entries["server1.com"].ExpiresAt = spec.AsTimestamp(now.Add(-time.Minute))
+	cache.entries["server2.com"].ExpiresAt = spec.AsTimestamp(now.Add(-time.Minute))
+	cache.store(&ResolutionCacheEntry{ServerName: "new2.com", ExpiresAt: spec.AsTimestamp(now.Add(time.Hour))})
+	assertCritical(t, len(cache.entries), resolutionCacheMaxEntries-1)
+	if _, ok := cache.entries["server3.com"]; !ok {
+		t.Fatal("expected an entry which hasn't expired to be kept")
+	}
+
+	// Replacing an entry doesn't evict anything.
+	cache.store(&ResolutionCacheEntry{ServerName: "new2.com", ExpiresAt: spec.AsTimestamp(now.Add(time.Hour))})
+	assertCritical(t, len(cache.entries), resolutionCacheMaxEntries-1)
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"strconv"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -27,9 +28,9 @@ import (
 // ResolutionResult is a result of looking up a Matrix homeserver according to
 // the federation specification.
 type ResolutionResult struct {
-	Destination   string          // The hostname and port to send federation requests to.
-	Host          spec.ServerName // The value of the Host headers.
-	TLSServerName string          // The TLS server name to request a certificate for.
+	Destination   string          `json:"destination"`     // The hostname and port to send federation requests to.
+	Host          spec.ServerName `json:"host"`            // The value of the Host headers.
+	TLSServerName string          `json:"tls_server_name"` // The TLS server name to request a certificate for.
 }
 
 // ResolveServer implements the server name resolution algorithm described at
@@ -38,13 +39,13 @@ type ResolutionResult struct {
 // request to the server using a given server name.
 // Returns an error if the server name isn't valid.
 func ResolveServer(ctx context.Context, serverName spec.ServerName, results *[]ResolutionResult) error {
-	return resolveServer(ctx, serverName, true, results)
+	return resolveServer(ctx, http.DefaultClient, serverName, true, results)
 }
 
 // resolveServer does the same thing as ResolveServer, except it also requires
 // the checkWellKnown parameter, which indicates whether a .well-known file
-// should be looked up.
-func resolveServer(ctx context.Context, serverName spec.ServerName, checkWellKnown bool, results *[]ResolutionResult) error {
+// should be looked up, and the client to look it up with.
+func resolveServer(ctx context.Context, client *http.Client, serverName spec.ServerName, checkWellKnown bool, results *[]ResolutionResult) error {
 	host, port, valid := spec.ParseAndValidateServerName(serverName)
 	if !valid {
 		return fmt.Errorf("Invalid server name")
@@ -86,9 +87,9 @@ func resolveServer(ctx context.Context, serverName spec.ServerName, checkWellKno
 
 	if checkWellKnown {
 		// 3. If the hostname is not an IP literal
-		if result, err := LookupWellKnown(ctx, serverName); err == nil {
+		if result, err := lookupWellKnown(ctx, client, serverName); err == nil {
 			// We don't want to check .well-known on the result
-			return resolveServer(ctx, result.NewAddress, false, results)
+			return resolveServer(ctx, client, result.NewAddress, false, results)
 		}
 	}
 
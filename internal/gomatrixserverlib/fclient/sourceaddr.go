@@ -0,0 +1,222 @@
+package fclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// SourceAddresses are the local addresses which outbound connections are
+// made from, for hosts which have more than one. If the address for an
+// address family is nil then the operating system chooses it as normal.
+type SourceAddresses struct {
+	IPv4 net.IP
+	IPv6 net.IP
+}
+
+// SourceAddressesOfInterface returns the first global unicast IPv4 and
+// IPv6 addresses of the network interface.
+func SourceAddressesOfInterface(name string) (SourceAddresses, error) {
+	var sources SourceAddresses
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return sources, fmt.Errorf("net.InterfaceByName: %w", err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return sources, fmt.Errorf("iface.Addrs: %w", err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		switch {
+		case ipNet.IP.To4() != nil:
+			if sources.IPv4 == nil {
+				sources.IPv4 = ipNet.IP
+			}
+		case sources.IPv6 == nil:
+			sources.IPv6 = ipNet.IP
+		}
+	}
+	if sources.IPv4 == nil && sources.IPv6 == nil {
+		return sources, fmt.Errorf("interface %q has no global unicast addresses", name)
+	}
+	return sources, nil
+}
+
+// dialIPWith returns a function which connects to an IP address and port
+// using the dialer.
+func dialIPWith(dialer *net.Dialer) func(ctx context.Context, ip net.IP, port string) (net.Conn, error) {
+	return func(ctx context.Context, ip net.IP, port string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+	}
+}
+
+// sourceDialer makes connections from the source addresses. There is a
+// dialer for each address family, because a net.Dialer with a LocalAddr
+// skips any remote addresses which are of a different family.
+type sourceDialer struct {
+	ipv4 *net.Dialer
+	ipv6 *net.Dialer
+}
+
+func newSourceDialer(base *net.Dialer, sources SourceAddresses) *sourceDialer {
+	ipv4, ipv6 := *base, *base
+	d := &sourceDialer{ipv4: &ipv4, ipv6: &ipv6}
+	if sources.IPv4 != nil {
+		d.ipv4.LocalAddr = &net.TCPAddr{IP: sources.IPv4}
+	}
+	if sources.IPv6 != nil {
+		d.ipv6.LocalAddr = &net.TCPAddr{IP: sources.IPv6}
+	}
+	return d
+}
+
+// dialIP connects to the IP address and port from the source address of
+// the same family.
+func (d *sourceDialer) dialIP(ctx context.Context, ip net.IP, port string) (net.Conn, error) {
+	dialer := d.ipv6
+	if ip.To4() != nil {
+		dialer = d.ipv4
+	}
+	return dialIPWith(dialer)(ctx, ip, port)
+}
+
+// DialContext looks up the host of the address and connects to its IP
+// addresses, in the same way as net.Dialer does.
+func (d *sourceDialer) DialContext(ctx context.Context, _, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("net.SplitHostPort: %w", err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return d.dialIP(ctx, ip, port)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %q", host)
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return dialHappyEyeballs(ctx, ips, port, d.ipv4.FallbackDelay, d.dialIP)
+}
+
+// defaultFallbackDelay is how long to wait for the addresses of the first
+// address family before trying the other, if the dialer doesn't say. It is
+// the same as net.Dialer uses.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// dialHappyEyeballs connects to the IP addresses as described by RFC 6555.
+// The addresses of the same family as the first are tried in turn, and if
+// none of them have connected after the fallback delay, or they have all
+// failed, then the addresses of the other family are tried alongside them.
+// A negative fallback delay tries all of the addresses in turn.
+func dialHappyEyeballs(
+	ctx context.Context, ips []net.IP, port string, fallbackDelay time.Duration,
+	dialIP func(ctx context.Context, ip net.IP, port string) (net.Conn, error),
+) (net.Conn, error) {
+	var primaries, fallbacks []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	if len(fallbacks) == 0 || fallbackDelay < 0 {
+		return dialSerial(ctx, ips, port, dialIP)
+	}
+	if fallbackDelay == 0 {
+		fallbackDelay = defaultFallbackDelay
+	}
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+		done    bool
+	}
+	results := make(chan dialResult)
+	returned := make(chan struct{})
+	defer close(returned)
+	dial := func(ctx context.Context, primary bool) {
+		addrs := primaries
+		if !primary {
+			addrs = fallbacks
+		}
+		conn, err := dialSerial(ctx, addrs, port, dialIP)
+		select {
+		case results <- dialResult{conn: conn, err: err, primary: primary, done: true}:
+		case <-returned:
+			// The other family connected first.
+			if conn != nil {
+				_ = conn.Close()
+			}
+		}
+	}
+
+	primaryCtx, primaryCancel := context.WithCancel(ctx)
+	defer primaryCancel()
+	go dial(primaryCtx, true)
+
+	fallbackCtx, fallbackCancel := context.WithCancel(ctx)
+	defer fallbackCancel()
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var primary, fallback dialResult
+	for {
+		select {
+		case <-fallbackTimer.C:
+			go dial(fallbackCtx, false)
+
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primary = res
+			} else {
+				fallback = res
+			}
+			if primary.done && fallback.done {
+				return nil, primary.err
+			}
+			// If the primary addresses have all failed before the fallback
+			// delay then there is no reason to wait any longer.
+			if res.primary && fallbackTimer.Stop() {
+				fallbackTimer.Reset(0)
+			}
+		}
+	}
+}
+
+// dialSerial connects to each of the IP addresses in turn until one
+// succeeds, returning the first error if none of them do.
+func dialSerial(
+	ctx context.Context, ips []net.IP, port string,
+	dialIP func(ctx context.Context, ip net.IP, port string) (net.Conn, error),
+) (net.Conn, error) {
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := dialIP(ctx, ip, port)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,112 @@
+package fclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDialer connects to the addresses in conns, fails to connect to the
+// addresses in errs and waits for the context to be done for the others.
+type fakeDialer struct {
+	mu     sync.Mutex
+	conns  map[string]net.Conn
+	errs   map[string]error
+	dialed []string
+}
+
+func (f *fakeDialer) dialIP(ctx context.Context, ip net.IP, port string) (net.Conn, error) {
+	f.mu.Lock()
+	f.dialed = append(f.dialed, ip.String())
+	conn, err := f.conns[ip.String()], f.errs[ip.String()]
+	f.mu.Unlock()
+	switch {
+	case conn != nil:
+		return conn, nil
+	case err != nil:
+		return nil, err
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *fakeDialer) dialedIPs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.dialed...)
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("::1"), net.ParseIP("::2"), net.ParseIP("127.0.0.1")}
+	refused := errors.New("connection refused")
+	conn, other := net.Pipe()
+	defer conn.Close()  // nolint: errcheck
+	defer other.Close() // nolint: errcheck
+
+	t.Run("primary connects", func(t *testing.T) {
+		f := &fakeDialer{conns: map[string]net.Conn{"::2": conn}, errs: map[string]error{"::1": refused}}
+		got, err := dialHappyEyeballs(context.Background(), ips, "8448", time.Hour, f.dialIP)
+		if err != nil || got != conn {
+			t.Fatalf("got %v, %v, want the connection to ::2", got, err)
+		}
+		if dialed := f.dialedIPs(); len(dialed) != 2 {
+			t.Fatalf("expected only the IPv6 addresses to be dialed, got %v", dialed)
+		}
+	})
+
+	t.Run("fallback after delay", func(t *testing.T) {
+		// The IPv6 addresses never connect, so the IPv4 address is tried
+		// once the fallback delay has passed.
+		f := &fakeDialer{conns: map[string]net.Conn{"127.0.0.1": conn}}
+		start := time.Now()
+		got, err := dialHappyEyeballs(context.Background(), ips, "8448", time.Millisecond*50, f.dialIP)
+		if err != nil || got != conn {
+			t.Fatalf("got %v, %v, want the connection to 127.0.0.1", got, err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Millisecond*50 {
+			t.Fatalf("fell back after %s, before the fallback delay", elapsed)
+		}
+	})
+
+	t.Run("fallback after primaries fail", func(t *testing.T) {
+		// There is no need to wait for the fallback delay once the IPv6
+		// addresses have all failed.
+		f := &fakeDialer{
+			conns: map[string]net.Conn{"127.0.0.1": conn},
+			errs:  map[string]error{"::1": refused, "::2": refused},
+		}
+		got, err := dialHappyEyeballs(context.Background(), ips, "8448", time.Hour, f.dialIP)
+		if err != nil || got != conn {
+			t.Fatalf("got %v, %v, want the connection to 127.0.0.1", got, err)
+		}
+	})
+
+	t.Run("all fail", func(t *testing.T) {
+		f := &fakeDialer{errs: map[string]error{
+			"::1":       refused,
+			"::2":       errors.New("no route to host"),
+			"127.0.0.1": errors.New("network is unreachable"),
+		}}
+		if _, err := dialHappyEyeballs(context.Background(), ips, "8448", time.Hour, f.dialIP); !errors.Is(err, refused) {
+			t.Fatalf("got error %v, want the first error of the primary addresses", err)
+		}
+	})
+
+	t.Run("fallback disabled", func(t *testing.T) {
+		f := &fakeDialer{
+			conns: map[string]net.Conn{"127.0.0.1": conn},
+			errs:  map[string]error{"::1": refused, "::2": refused},
+		}
+		got, err := dialHappyEyeballs(context.Background(), ips, "8448", -1, f.dialIP)
+		if err != nil || got != conn {
+			t.Fatalf("got %v, %v, want the connection to 127.0.0.1", got, err)
+		}
+		dialed := f.dialedIPs()
+		if len(dialed) != 3 || dialed[2] != "127.0.0.1" {
+			t.Fatalf("expected the addresses to be dialed in turn, got %v", dialed)
+		}
+	})
+}
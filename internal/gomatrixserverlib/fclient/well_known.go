@@ -30,6 +30,11 @@ type WellKnownResult struct {
 // LookupWellKnown looks up a well-known record for a matrix server. If one if
 // found, it returns the server to redirect to.
 func LookupWellKnown(ctx context.Context, serverNameType spec.ServerName) (*WellKnownResult, error) {
+	return lookupWellKnown(ctx, http.DefaultClient, serverNameType)
+}
+
+// lookupWellKnown is LookupWellKnown, making the request with the given client.
+func lookupWellKnown(ctx context.Context, client *http.Client, serverNameType spec.ServerName) (*WellKnownResult, error) {
 	serverName := string(serverNameType)
 
 	// Handle ending "/"
@@ -43,7 +48,7 @@ func LookupWellKnown(ctx context.Context, serverNameType spec.ServerName) (*Well
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -18,8 +18,10 @@ package gomatrixserverlib
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"slices"
 	"strings"
+	"sync"
 	"unicode/utf16"
 	"unicode/utf8"
 
@@ -148,11 +150,82 @@ func verifyEnforcedCanonicalJSON(input []byte) error {
 	return nil
 }
 
+// compactBufferPool holds the intermediate buffers used by
+// CanonicalJSONAssumeValid. Only the sorted output is returned to the
+// caller, so the compacted copy can be reused by the next call rather
+// than being allocated for every event that is hashed or verified.
+var compactBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// maxPooledBufferSize stops unusually large inputs from pinning big buffers
+// in the pool.
+const maxPooledBufferSize = 64 * 1024
+
 // CanonicalJSONAssumeValid is the same as CanonicalJSON, but assumes the
 // input is valid JSON
 func CanonicalJSONAssumeValid(input []byte) []byte {
-	input = CompactJSON(input, make([]byte, 0, len(input)))
-	return SortJSON(input, make([]byte, 0, len(input)))
+	buf := compactBufferPool.Get().(*[]byte)
+	compacted := CompactJSON(input, (*buf)[:0])
+	output := SortJSON(compacted, make([]byte, 0, len(compacted)))
+	putCompactBuffer(buf, compacted)
+	return output
+}
+
+// canonicalJSONWithout returns the canonical encoding of the JSON object
+// without the given top-level keys. This gives the same result as
+// unmarshalling the object into a map, deleting the keys, marshalling it
+// again and passing it to CanonicalJSON, which is what hashing, signing and
+// verifying events used to do, but without the round trip through
+// encoding/json. Objects with duplicated top-level keys are rejected, as
+// gjson, which is used to read keys like "signatures" and "event_id", picks
+// the first of them, whereas the map would have kept the last. Otherwise the
+// keys that were read could differ from the ones that were hashed or signed.
+func canonicalJSONWithout(input []byte, without ...string) ([]byte, error) {
+	if !gjson.ValidBytes(input) {
+		return nil, BadJSONError{errors.New("gjson validation failed")}
+	}
+	buf := compactBufferPool.Get().(*[]byte)
+	compacted := CompactJSON(input, (*buf)[:0])
+	defer putCompactBuffer(buf, compacted)
+	result := gjson.ParseBytes(compacted)
+	if !result.IsObject() {
+		return nil, BadJSONError{errors.New("expected a JSON object")}
+	}
+	if key, ok := duplicateKey(result); ok {
+		return nil, BadJSONError{fmt.Errorf("duplicate key %q", key)}
+	}
+	return sortJSONObject(result, make([]byte, 0, len(compacted)), without), nil
+}
+
+// duplicateKey returns a key which appears more than once in the object,
+// if there is one.
+func duplicateKey(object gjson.Result) (string, bool) {
+	var _keys [32]string
+	keys := _keys[:0]
+	object.ForEach(func(key, _ gjson.Result) bool {
+		keys = append(keys, key.String())
+		return true // keep iterating
+	})
+	slices.Sort(keys)
+	for i := 1; i < len(keys); i++ {
+		if keys[i] == keys[i-1] {
+			return keys[i], true
+		}
+	}
+	return "", false
+}
+
+// putCompactBuffer returns a buffer taken from compactBufferPool, which
+// may have been grown since, to the pool.
+func putCompactBuffer(buf *[]byte, compacted []byte) {
+	if cap(compacted) <= maxPooledBufferSize {
+		*buf = compacted[:0]
+		compactBufferPool.Put(buf)
+	}
 }
 
 // SortJSON reencodes the JSON with the object keys sorted by lexicographically
@@ -169,7 +242,7 @@ func sortJSONValue(input gjson.Result, output []byte) []byte {
 		return sortJSONArray(input, output)
 	}
 	if input.IsObject() {
-		return sortJSONObject(input, output)
+		return sortJSONObject(input, output, nil)
 	}
 	// If its neither an object nor an array then there is no sub structure
 	// to sort, so just append the raw bytes.
@@ -201,44 +274,49 @@ func sortJSONArray(input gjson.Result, output []byte) []byte {
 }
 
 // sortJSONObject takes a gjson.Result and sorts it, assuming its an object.
-// inputJSON must be the raw JSON bytes that gjson.Result points to.
-func sortJSONObject(input gjson.Result, output []byte) []byte {
+// inputJSON must be the raw JSON bytes that gjson.Result points to. Keys
+// listed in without are left out.
+func sortJSONObject(input gjson.Result, output []byte, without []string) []byte {
 	type entry struct {
 		key   string // The parsed key string
 		value gjson.Result
 	}
 
-	// Try to stay on the stack here if we can.
-	var _entries [1024]*entry
+	// Try to stay on the stack here if we can. Most objects in events
+	// have only a handful of keys, so this rarely needs to grow.
+	var _entries [32]entry
 	entries := _entries[:0]
 
 	// Iterate over each key/value pair and add it to a slice
 	// that we can sort
 	input.ForEach(func(key, value gjson.Result) bool {
-		entries = append(entries, &entry{
-			key:   key.String(),
-			value: value,
-		})
+		k := key.String()
+		if !slices.Contains(without, k) {
+			entries = append(entries, entry{
+				key:   k,
+				value: value,
+			})
+		}
 		return true // keep iterating
 	})
 
 	// Using slices.SortFunc here instead of sort.Slice avoids
 	// heap escapes due to reflection.
-	slices.SortFunc(entries, func(a, b *entry) int {
+	slices.SortFunc(entries, func(a, b entry) int {
 		return strings.Compare(a.key, b.key)
 	})
 
 	sep := byte('{')
 
-	for _, entry := range entries {
+	for i := range entries {
 		output = append(output, sep)
 		sep = ','
 
 		// Append the raw unparsed JSON key, *not* the parsed key
 		output = append(output, '"')
-		output = append(output, entry.key...)
+		output = append(output, entries[i].key...)
 		output = append(output, '"', ':')
-		output = sortJSONValue(entry.value, output)
+		output = sortJSONValue(entries[i].value, output)
 	}
 	if sep == '{' {
 		// If sep is still '{' then the object was empty and we never wrote the
@@ -20,6 +20,9 @@ import (
 	"encoding/json"
 	"reflect"
 	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"golang.org/x/crypto/ed25519"
 )
 
 func TestJSONIntegerRanges(t *testing.T) {
@@ -361,3 +364,123 @@ func TestEventJSON(t *testing.T) {
 		t.Fatalf("first event wrong, got %s", string(resp.Events[1]))
 	}
 }
+
+// canonicalJSONWithoutRoundTrip is how canonicalJSONWithout used to be done,
+// which it must give the same results as.
+func canonicalJSONWithoutRoundTrip(input []byte, without ...string) ([]byte, error) {
+	var object map[string]spec.RawJSON
+	if err := json.Unmarshal(input, &object); err != nil {
+		return nil, err
+	}
+	for _, key := range without {
+		delete(object, key)
+	}
+	unsorted, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	return CanonicalJSON(unsorted)
+}
+
+func TestCanonicalJSONWithout(t *testing.T) {
+	for _, input := range []string{
+		`{}`,
+		`{"signatures":{"a":{"b":"c"}}}`,
+		`{"b":2,"a":1,"unsigned":{"age":3},"signatures":{}}`,
+		`{"b":{"d":1,"c":2},"unsigned":1}`,
+		`{"b":"\u00e9\/\n","a":["<&>",{"z":-0,"y":1.5}]}`,
+		"{ \"c\" : [ 1 , 2 ] ,\n\t\"b\" : null }",
+		benchmarkEventJSON,
+	} {
+		want, err := canonicalJSONWithoutRoundTrip([]byte(input), "signatures", "unsigned")
+		if err != nil {
+			t.Fatalf("canonicalJSONWithoutRoundTrip(%q): %s", input, err)
+		}
+		got, err := canonicalJSONWithout([]byte(input), "signatures", "unsigned")
+		if err != nil {
+			t.Fatalf("canonicalJSONWithout(%q): %s", input, err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("canonicalJSONWithout(%q): want %q got %q", input, want, got)
+		}
+	}
+
+	for _, input := range []string{`[]`, `"a"`, `{"a":}`, `{"a":1`, `{"a":1,"a":2}`, `{"signatures":{},"signatures":{}}`} {
+		if _, err := canonicalJSONWithout([]byte(input), "signatures"); err == nil {
+			t.Errorf("canonicalJSONWithout(%q): expected an error", input)
+		}
+	}
+}
+
+// benchmarkEventJSON is a power levels event, which is one of the larger
+// events that is regularly hashed and verified.
+const benchmarkEventJSON = `{"auth_events":[["$Stdin0028C5qBjz5:localhost",{"sha256":"PvTyW+Mfb0aCajkIlBk1XlQE+1uVco3to8C2+/1J7iQ"}],["$klXtjBwwDQIGglax:localhost",{"sha256":"hLoiSkcGLZJr5wkIDA8+bujNJPsYX1SOCCXIErHEcgM"}]],"content":{"ban":50,"events":{"m.room.avatar":50,"m.room.canonical_alias":50,"m.room.history_visibility":100,"m.room.name":50,"m.room.power_levels":100},"events_default":0,"invite":0,"kick":50,"redact":50,"state_default":50,"users":{"@test:localhost":100},"users_default":0},"depth":3,"event_id":"$7gPR7SLdkfDsMvJL:localhost","hashes":{"sha256":"/kQnrzO5vhbnwyGvKso4CVMRyyryiyanq6t27mt5kSw"},"origin":"localhost","origin_server_ts":1510854446548,"prev_events":[["$klXtjBwwDQIGglax:localhost",{"sha256":"hLoiSkcGLZJr5wkIDA8+bujNJPsYX1SOCCXIErHEcgM"}]],"prev_state":[],"room_id":"!pUjJbIC8V32G0FLt:localhost","sender":"@test:localhost","signatures":{"localhost":{"ed25519:u9kP":"NOxjrcci7AIRhcTVmJ6nrsslLsaOJzB0iusDZ6cOFrv2OXkDY7mrBM3cQQS3DhGWltEtu3OC0nsvkfeYtwr9DQ"}},"state_key":"","type":"m.room.power_levels","unsigned":{"age":1234}}`
+
+func BenchmarkCanonicalJSON(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := CanonicalJSON([]byte(benchmarkEventJSON)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCanonicalJSONWithout(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := canonicalJSONWithout([]byte(benchmarkEventJSON), "signatures", "unsigned"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCanonicalJSONWithoutRoundTrip(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := canonicalJSONWithoutRoundTrip([]byte(benchmarkEventJSON), "signatures", "unsigned"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAddContentHashesToEvent(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := addContentHashesToEvent([]byte(benchmarkEventJSON)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReferenceOfEvent(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := referenceOfEvent([]byte(benchmarkEventJSON), RoomVersionV10); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSignEvent(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := signEvent("localhost", "ed25519:test", privateKey1, []byte(benchmarkEventJSON), RoomVersionV10); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVerifyJSON(b *testing.B) {
+	signed, err := SignJSON("localhost", "ed25519:test", privateKey1, []byte(benchmarkEventJSON))
+	if err != nil {
+		b.Fatal(err)
+	}
+	publicKey := privateKey1.Public().(ed25519.PublicKey)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := VerifyJSON("localhost", "ed25519:test", publicKey, signed); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
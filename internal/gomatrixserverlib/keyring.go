@@ -487,7 +487,9 @@ type DirectKeyFetcher struct {
 	// The federation client to use to fetch keys with.
 	Client            KeyClient
 	IsLocalServerName func(server spec.ServerName) bool
-	LocalPublicKey    spec.Base64Bytes
+	// Looks up a key of the local server, which is never fetched over the
+	// network.
+	LocalKey func(keyID KeyID) (PublicKeyLookupResult, bool)
 }
 
 // FetcherName implements KeyFetcher
@@ -528,14 +530,13 @@ func (d *DirectKeyFetcher) FetchKeys(
 	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
 
 	// Populate the results map with any requests directed at the local server
-	localKey := &PublicKeyLookupResult{
-		VerifyKey: VerifyKey{Key: d.LocalPublicKey},
-		ExpiredTS: PublicKeyNotExpired,
-		// This must evaluate to a year which is 4 digits (ie. 2020), or the code breaks currently
-		ValidUntilTS: spec.AsTimestamp(time.Unix(1<<37, 0)), // NOTE: 6325-04-08 15:04:32 +0000 UTC (a date very far in the future)
-	}
 	for _, req := range localServerRequests {
-		results[req] = *localKey
+		if d.LocalKey == nil {
+			break
+		}
+		if localKey, ok := d.LocalKey(req.KeyID); ok {
+			results[req] = localKey
+		}
 	}
 	var resultsMutex sync.Mutex
 
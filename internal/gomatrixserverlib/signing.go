@@ -20,6 +20,7 @@ import (
 	"fmt"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 	"golang.org/x/crypto/ed25519"
 )
@@ -95,20 +96,21 @@ func ListKeyIDs(signingName string, message []byte) ([]KeyID, error) {
 
 // VerifyJSON checks that the entity has signed the message using a particular key.
 func VerifyJSON(signingName string, keyID KeyID, publicKey ed25519.PublicKey, message []byte) error {
-	// Unpack the top-level key of the JSON object without unpacking the contents of the keys.
-	// This allows us to add and remove the top-level keys from the JSON object.
-	// It also ensures that the JSON is actually a valid JSON object.
-	var object map[string]*json.RawMessage
-	var signatures map[string]map[KeyID]spec.Base64Bytes
-	if err := json.Unmarshal(message, &object); err != nil {
+	// Encode the JSON in the canonical format without the "unsigned" and
+	// "signatures" keys, which aren't covered by the signature. This also
+	// ensures that the JSON is actually a valid JSON object.
+	canonical, err := canonicalJSONWithout(message, "unsigned", "signatures")
+	if err != nil {
 		return err
 	}
 
 	// Check that there is a signature from the entity that we are expecting a signature from.
-	if object["signatures"] == nil {
+	var signatures map[string]map[KeyID]spec.Base64Bytes
+	signaturesJSON := gjson.GetBytes(message, "signatures")
+	if !signaturesJSON.Exists() || signaturesJSON.Type == gjson.Null {
 		return fmt.Errorf("No signatures")
 	}
-	if err := json.Unmarshal(*object["signatures"], &signatures); err != nil {
+	if err = json.Unmarshal([]byte(signaturesJSON.Raw), &signatures); err != nil {
 		return err
 	}
 	signature, ok := signatures[signingName][keyID]
@@ -119,20 +121,6 @@ func VerifyJSON(signingName string, keyID KeyID, publicKey ed25519.PublicKey, me
 		return fmt.Errorf("Bad signature length from %q with ID %q", signingName, keyID)
 	}
 
-	// The "unsigned" key and "signatures" keys aren't covered by the signature so remove them.
-	delete(object, "unsigned")
-	delete(object, "signatures")
-
-	// Encode the JSON without the "unsigned" and "signatures" keys in the canonical format.
-	unsorted, err := json.Marshal(object)
-	if err != nil {
-		return err
-	}
-	canonical, err := CanonicalJSON(unsorted)
-	if err != nil {
-		return err
-	}
-
 	// Verify the ed25519 signature.
 	if !ed25519.Verify(publicKey, canonical, signature) {
 		return fmt.Errorf("Bad signature from %q with ID %q", signingName, keyID)
@@ -77,6 +77,14 @@ func TestVerifyJSON(t *testing.T) {
 			}
 		}
 	}`)
+	testVerifyNotOK("the signatures are duplicated", `{
+		"signatures": {
+			"domain": {
+				"ed25519:1": "K8280/U9SSy9IVtjBuVeLr+HpOB4BQFWbg+UZaADMtTdGYI7Geitb76LTrr5QV/7Xg4ahLwYGYZzuHGZKM5ZAQ"
+			}
+		},
+		"signatures": {}
+	}`)
 	testVerifyNotOK("there are no signatures", `{}`)
 	testVerifyNotOK("there are no signatures", `{"signatures": {}}`)
 
@@ -15,6 +15,7 @@
 package spec
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 )
@@ -46,10 +47,12 @@ const (
 	ErrorIncompatibleRoomVersion     MatrixErrorCode = "M_INCOMPATIBLE_ROOM_VERSION"
 	ErrorUnsupportedRoomVersion      MatrixErrorCode = "M_UNSUPPORTED_ROOM_VERSION"
 	ErrorLimitExceeded               MatrixErrorCode = "M_LIMIT_EXCEEDED"
+	ErrorTooLarge                    MatrixErrorCode = "M_TOO_LARGE"
 	ErrorServerNotTrusted            MatrixErrorCode = "M_SERVER_NOT_TRUSTED"
 	ErrorSessionNotValidated         MatrixErrorCode = "M_SESSION_NOT_VALIDATED"
 	ErrorThreePIDInUse               MatrixErrorCode = "M_THREEPID_IN_USE"
 	ErrorThreePIDAuthFailed          MatrixErrorCode = "M_THREEPID_AUTH_FAILED"
+	ErrorDuplicateAnnotation         MatrixErrorCode = "M_DUPLICATE_ANNOTATION"
 )
 
 // MatrixError represents the "standard error response" in Matrix.
@@ -76,6 +79,12 @@ func (e InternalServerError) Error() string {
 	return fmt.Sprintf("Internal server error: %s", e.Err)
 }
 
+// MarshalJSON returns the error as a standard M_UNKNOWN error response. The
+// underlying error is never sent to the client as it may leak internal detail.
+func (e InternalServerError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(MatrixError{ErrorUnknown, "Internal server error"})
+}
+
 // Unknown is an unexpected error
 func Unknown(msg string) MatrixError {
 	return MatrixError{ErrorUnknown, msg}
@@ -110,6 +119,12 @@ func NotJSON(msg string) MatrixError {
 	return MatrixError{ErrorNotJSON, msg}
 }
 
+// TooLarge is an error when the request body is larger than the server
+// allows.
+func TooLarge(msg string) MatrixError {
+	return MatrixError{ErrorTooLarge, msg}
+}
+
 // NotFound is an error when the client tries to access an unknown resource.
 func NotFound(msg string) MatrixError {
 	return MatrixError{ErrorNotFound, msg}
@@ -127,6 +142,31 @@ func UnknownToken(msg string) MatrixError {
 	return MatrixError{ErrorUnknownToken, msg}
 }
 
+// UnknownTokenError is an M_UNKNOWN_TOKEN error which tells the client
+// whether it has been soft logged out. If so, the client can log in again
+// with the same device ID without discarding its data, e.g. its keys.
+type UnknownTokenError struct {
+	MatrixError
+	SoftLogout bool `json:"soft_logout"`
+}
+
+func (e UnknownTokenError) Error() string {
+	return fmt.Sprintf("%s: %s", e.ErrCode, e.Err)
+}
+
+func (e UnknownTokenError) Unwrap() error {
+	return e.MatrixError
+}
+
+// UnknownTokenWithSoftLogout is an UnknownToken error which includes the
+// soft_logout flag.
+func UnknownTokenWithSoftLogout(msg string, softLogout bool) UnknownTokenError {
+	return UnknownTokenError{
+		MatrixError: MatrixError{ErrorUnknownToken, msg},
+		SoftLogout:  softLogout,
+	}
+}
+
 // WeakPassword is an error which is returned when the client tries to register
 // using a weak password. http://matrix.org/docs/spec/client_server/r0.2.0.html#password-based
 func WeakPassword(msg string) MatrixError {
@@ -254,6 +294,12 @@ func UnsupportedRoomVersion(msg string) MatrixError {
 	return MatrixError{ErrorUnsupportedRoomVersion, msg}
 }
 
+// DuplicateAnnotation is an error returned when a user tries to annotate an
+// event with a key they have already used, such as reacting twice.
+func DuplicateAnnotation(msg string) MatrixError {
+	return MatrixError{ErrorDuplicateAnnotation, msg}
+}
+
 // LimitExceededError is a rate-limiting error.
 type LimitExceededError struct {
 	MatrixError
@@ -284,3 +330,9 @@ func NotTrusted(serverName string) MatrixError {
 		Err:     fmt.Sprintf("Untrusted server '%s'", serverName),
 	}
 }
+
+// ThreePIDAuthFailed is an error when a third-party identifier couldn't be
+// validated or bound by the identity server.
+func ThreePIDAuthFailed(msg string) MatrixError {
+	return MatrixError{ErrorThreePIDAuthFailed, msg}
+}
@@ -72,6 +72,11 @@ func TestSimpleMatrixErrors(t *testing.T) {
 func TestInternalServerError(t *testing.T) {
 	e := InternalServerError{}
 	assert.NotPanics(t, func() { _ = e.Error() })
+
+	e = InternalServerError{Err: "database exploded"}
+	jsonBytes, err := json.Marshal(e)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"errcode":"M_UNKNOWN","error":"Internal server error"}`, string(jsonBytes))
 }
 
 func TestLimitExceeded(t *testing.T) {
@@ -86,6 +91,22 @@ func TestLimitExceeded(t *testing.T) {
 	}
 }
 
+func TestUnknownTokenWithSoftLogout(t *testing.T) {
+	for softLogout, want := range map[bool]string{
+		true:  `{"errcode":"M_UNKNOWN_TOKEN","error":"error msg","soft_logout":true}`,
+		false: `{"errcode":"M_UNKNOWN_TOKEN","error":"error msg","soft_logout":false}`,
+	} {
+		e := UnknownTokenWithSoftLogout("error msg", softLogout)
+		jsonBytes, err := json.Marshal(&e)
+		if err != nil {
+			t.Fatalf("Failed to marshal error. %s", err.Error())
+		}
+		if string(jsonBytes) != want {
+			t.Errorf("want %s, got %s", want, string(jsonBytes))
+		}
+	}
+}
+
 func TestLeaveServerNoticeError(t *testing.T) {
 	e := LeaveServerNoticeError()
 	jsonBytes, err := json.Marshal(&e)
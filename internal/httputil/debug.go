@@ -0,0 +1,87 @@
+package httputil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+)
+
+// DebugHandler serves the pprof endpoints under /debug/pprof/, runtime and
+// garbage collector statistics at /debug/runtime and forces a garbage
+// collection on a POST to /debug/gc. stripPrefix is removed from the path
+// first, so that the endpoints can be served beneath another path. Requests
+// are answered with a 404 while enabled returns false.
+func DebugHandler(stripPrefix string, enabled func() bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, req *http.Request) {
+		writeRuntimeStats(w)
+	})
+	mux.HandleFunc("/debug/gc", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			NotAllowedHandler.ServeHTTP(w, req)
+			return
+		}
+		debug.FreeOSMemory()
+		writeRuntimeStats(w)
+	})
+	h := http.StripPrefix(stripPrefix, mux)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !enabled() {
+			NotFoundCORSHandler.ServeHTTP(w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+type runtimeStats struct {
+	GoVersion    string         `json:"go_version"`
+	NumCPU       int            `json:"num_cpu"`
+	GOMAXPROCS   int            `json:"gomaxprocs"`
+	Goroutines   int            `json:"goroutines"`
+	HeapAlloc    uint64         `json:"heap_alloc_bytes"`
+	HeapInuse    uint64         `json:"heap_inuse_bytes"`
+	HeapIdle     uint64         `json:"heap_idle_bytes"`
+	HeapReleased uint64         `json:"heap_released_bytes"`
+	HeapObjects  uint64         `json:"heap_objects"`
+	Sys          uint64         `json:"sys_bytes"`
+	NextGC       uint64         `json:"next_gc_bytes"`
+	NumGC        uint32         `json:"num_gc"`
+	LastGC       spec.Timestamp `json:"last_gc_ts,omitempty"`
+	PauseTotalMS int64          `json:"gc_pause_total_ms"`
+}
+
+func writeRuntimeStats(w http.ResponseWriter) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := runtimeStats{
+		GoVersion:    runtime.Version(),
+		NumCPU:       runtime.NumCPU(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapInuse:    mem.HeapInuse,
+		HeapIdle:     mem.HeapIdle,
+		HeapReleased: mem.HeapReleased,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NextGC:       mem.NextGC,
+		NumGC:        mem.NumGC,
+		PauseTotalMS: time.Duration(mem.PauseTotalNs).Milliseconds(),
+	}
+	if mem.LastGC > 0 {
+		stats.LastGC = spec.AsTimestamp(time.Unix(0, int64(mem.LastGC)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,45 @@
+package httputil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	enabled := false
+	h := DebugHandler("/_dendrite/admin", func() bool { return enabled })
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_dendrite/admin/debug/runtime", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected HTTP 404 while disabled, got %d", rec.Code)
+	}
+
+	enabled = true
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_dendrite/admin/debug/runtime", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d", rec.Code)
+	}
+	var stats runtimeStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Goroutines == 0 || stats.HeapAlloc == 0 {
+		t.Fatalf("unexpected runtime stats %+v", stats)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_dendrite/admin/debug/pprof/goroutine?debug=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200 for a goroutine dump, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_dendrite/admin/debug/gc", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected HTTP 405 for a GET to the GC endpoint, got %d", rec.Code)
+	}
+}
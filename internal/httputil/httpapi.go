@@ -16,12 +16,14 @@ package httputil
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -31,6 +33,7 @@ import (
 
 	"github.com/neilalexander/harmony/clientapi/auth"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 )
 
@@ -43,6 +46,7 @@ type BasicAuth struct {
 type AuthAPIOpts struct {
 	GuestAccessAllowed bool
 	WithAuth           bool
+	AdminOnly          bool
 }
 
 // AuthAPIOption is an option to MakeAuthAPI to add additional checks (e.g. guest access) to verify
@@ -63,6 +67,15 @@ func WithAuth() AuthAPIOption {
 	}
 }
 
+// WithAdminOnly is an option to MakeHTTPAPI to only allow server administrators.
+// It implies WithAuth.
+func WithAdminOnly() AuthAPIOption {
+	return func(opts *AuthAPIOpts) {
+		opts.WithAuth = true
+		opts.AdminOnly = true
+	}
+}
+
 // MakeAuthAPI turns a util.JSONRequestHandler function into an http.Handler which authenticates the request.
 func MakeAuthAPI(
 	metricsName string, userAPI userapi.QueryAcccessTokenAPI,
@@ -121,6 +134,14 @@ func MakeAdminAPI(
 	})
 }
 
+// CacheHeaders returns the headers which allow a response to be cached by
+// clients and proxies for the given time.
+func CacheHeaders(maxAge time.Duration) map[string]string {
+	return map[string]string{
+		"Cache-Control": fmt.Sprintf("public, max-age=%d", int64(maxAge.Seconds())),
+	}
+}
+
 // MakeExternalAPI turns a util.JSONRequestHandler function into an http.Handler.
 // This is used for APIs that are called from the internet.
 func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
@@ -130,7 +151,7 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 	if os.Getenv("DENDRITE_TRACE_HTTP") == "1" {
 		verbose = true
 	}
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	h := tracing.HTTPHandler(metricsName, util.MakeJSONAPI(util.NewJSONRequestHandler(f)))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
 		nextWriter := w
 		if verbose {
@@ -191,7 +212,13 @@ func MakeHTTPAPI(metricsName string, userAPI userapi.QueryAcccessTokenAPI, enabl
 
 		if opts.WithAuth {
 			logger := util.GetLogger(req.Context())
-			_, jsonErr := auth.VerifyUserFromRequest(req, userAPI)
+			device, jsonErr := auth.VerifyUserFromRequest(req, userAPI)
+			if jsonErr == nil && opts.AdminOnly && device.AccountType != userapi.AccountTypeAdmin {
+				jsonErr = &util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: spec.Forbidden("This API can only be used by admin users."),
+				}
+			}
 			if jsonErr != nil {
 				w.WriteHeader(jsonErr.Code)
 				if err := json.NewEncoder(w).Encode(jsonErr.JSON); err != nil {
@@ -204,7 +231,7 @@ func MakeHTTPAPI(metricsName string, userAPI userapi.QueryAcccessTokenAPI, enabl
 	}
 
 	if !enableMetrics {
-		return http.HandlerFunc(withSpan)
+		return tracing.HTTPHandler(metricsName, http.HandlerFunc(withSpan))
 	}
 
 	return promhttp.InstrumentHandlerCounter(
@@ -216,7 +243,7 @@ func MakeHTTPAPI(metricsName string, userAPI userapi.QueryAcccessTokenAPI, enabl
 			},
 			[]string{"code"},
 		),
-		http.HandlerFunc(withSpan),
+		tracing.HTTPHandler(metricsName, http.HandlerFunc(withSpan)),
 	)
 }
 
@@ -0,0 +1,74 @@
+package httputil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+)
+
+// RequestLimits are the limits applied to each request to a router.
+type RequestLimits struct {
+	// The maximum size of the request body, or 0 for no limit.
+	MaxBodySize int64
+	// How long the client has to send the request body.
+	ReadTimeout time.Duration
+	// How long the handler has to write the response.
+	WriteTimeout time.Duration
+}
+
+// WithRequestLimits wraps a handler so that each request is subject to the
+// limits. Requests which say up front that their body is too large are
+// rejected with M_TOO_LARGE, and otherwise reading more than the maximum from
+// the body fails with an *http.MaxBytesError.
+func WithRequestLimits(h http.Handler, limits RequestLimits) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if limits.MaxBodySize > 0 && req.ContentLength > limits.MaxBodySize {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			_ = json.NewEncoder(w).Encode(tooLargeError(limits.MaxBodySize))
+			return
+		}
+		rc := http.NewResponseController(w)
+		if limits.WriteTimeout > 0 {
+			_ = rc.SetWriteDeadline(time.Now().Add(limits.WriteTimeout))
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if limits.MaxBodySize > 0 {
+				req.Body = http.MaxBytesReader(w, req.Body, limits.MaxBodySize)
+			}
+			// The read deadline is only for the request body. It is lifted once
+			// the body has been read, as the server keeps reading from the
+			// connection in the background to notice if the client goes away
+			// while the response is being written.
+			if limits.ReadTimeout > 0 && rc.SetReadDeadline(time.Now().Add(limits.ReadTimeout)) == nil {
+				req.Body = &deadlineBody{ReadCloser: req.Body, rc: rc}
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// tooLargeError is the error returned when a request body is larger than
+// maxBodySize.
+func tooLargeError(maxBodySize int64) spec.MatrixError {
+	return spec.TooLarge(fmt.Sprintf("The request body is larger than the maximum allowed size (%d bytes).", maxBodySize))
+}
+
+// deadlineBody lifts the read deadline once the request body has been read.
+type deadlineBody struct {
+	io.ReadCloser
+	rc *http.ResponseController
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		_ = b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
@@ -0,0 +1,75 @@
+package httputil
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+)
+
+func TestWithRequestLimitsBodySize(t *testing.T) {
+	var readErr error
+	h := WithRequestLimits(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, readErr = io.ReadAll(req.Body)
+	}), RequestLimits{MaxBodySize: 8})
+
+	// A Content-Length over the limit is rejected before the handler runs.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large body")))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected HTTP 413, got %d", rec.Code)
+	}
+	var matrixErr spec.MatrixError
+	if err := json.Unmarshal(rec.Body.Bytes(), &matrixErr); err != nil || matrixErr.ErrCode != spec.ErrorTooLarge {
+		t.Fatalf("expected M_TOO_LARGE, got %s", rec.Body.String())
+	}
+
+	// Without a Content-Length, reading past the limit fails.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large body"))
+	req.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(readErr, &maxBytesErr) {
+		t.Fatalf("expected a MaxBytesError, got %v", readErr)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("small")))
+	if readErr != nil {
+		t.Fatalf("expected a body under the limit to be read, got %v", readErr)
+	}
+}
+
+func TestWithRequestLimitsReadTimeout(t *testing.T) {
+	readErr := make(chan error, 1)
+	srv := httptest.NewServer(WithRequestLimits(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, err := io.ReadAll(req.Body)
+		readErr <- err
+	}), RequestLimits{ReadTimeout: 50 * time.Millisecond}))
+	defer srv.Close()
+
+	body, bodyWriter := io.Pipe()
+	defer bodyWriter.Close() // nolint: errcheck
+	go func() {
+		_, _ = bodyWriter.Write([]byte("slow"))
+	}()
+	go func() {
+		res, err := srv.Client().Post(srv.URL, "application/json", body)
+		if err == nil {
+			_ = res.Body.Close()
+		}
+	}()
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Fatal("expected reading a slow body to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the read deadline")
+	}
+}
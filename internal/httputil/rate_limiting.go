@@ -1,10 +1,13 @@
 package httputil
 
 import (
+	"context"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/neilalexander/harmony/setup/config"
@@ -12,55 +15,120 @@ import (
 )
 
 type RateLimits struct {
+	name             string
+	cfg              *config.RateLimiting
+	store            RateLimitStore
+	storeFailedAt    time.Time
 	limits           map[string]chan struct{}
 	limitsMutex      sync.RWMutex
 	cleanMutex       sync.RWMutex
+	settingsMutex    sync.RWMutex
 	enabled          bool
 	requestThreshold int64
 	cooloffDuration  time.Duration
 	exemptUserIDs    map[string]struct{}
 }
 
-func NewRateLimits(cfg *config.RateLimiting) *RateLimits {
+var (
+	// rateLimitsReload registers a single reload hook for all of the rate
+	// limiters, rather than one for each.
+	rateLimitsReload sync.Once
+	rateLimitsMutex  sync.Mutex
+	rateLimits       []*RateLimits
+)
+
+// NewRateLimits creates a rate limiter, which stops cleaning up after itself
+// once ctx is done. If store isn't nil then the limits are kept there, falling
+// back to local limits if it fails, and the name keeps them apart from those
+// of other rate limiters in the same store.
+func NewRateLimits(ctx context.Context, name string, cfg *config.RateLimiting, store RateLimitStore) *RateLimits {
 	l := &RateLimits{
-		limits:           make(map[string]chan struct{}),
-		enabled:          cfg.Enabled,
-		requestThreshold: cfg.Threshold,
-		cooloffDuration:  time.Duration(cfg.CooloffMS) * time.Millisecond,
-		exemptUserIDs:    map[string]struct{}{},
+		name:   name,
+		cfg:    cfg,
+		store:  store,
+		limits: make(map[string]chan struct{}),
 	}
-	for _, userID := range cfg.ExemptUserIDs {
-		l.exemptUserIDs[userID] = struct{}{}
+	l.configure(cfg.Current())
+	rateLimitsMutex.Lock()
+	rateLimits = append(rateLimits, l)
+	rateLimitsMutex.Unlock()
+	rateLimitsReload.Do(func() {
+		config.OnReload(reloadRateLimits)
+	})
+	go l.clean(ctx)
+	return l
+}
+
+// reloadRateLimits picks up any changes to the options of every rate limiter.
+func reloadRateLimits() {
+	rateLimitsMutex.Lock()
+	defer rateLimitsMutex.Unlock()
+	for _, l := range rateLimits {
+		l.configure(l.cfg.Current())
 	}
-	if l.enabled {
-		go l.clean()
+}
+
+// configure applies the rate limiting options. Changes to the threshold
+// only apply to callers who aren't already being tracked.
+func (l *RateLimits) configure(cfg config.RateLimiting) {
+	exemptUserIDs := make(map[string]struct{}, len(cfg.ExemptUserIDs))
+	for _, userID := range cfg.ExemptUserIDs {
+		exemptUserIDs[userID] = struct{}{}
 	}
-	return l
+	l.settingsMutex.Lock()
+	defer l.settingsMutex.Unlock()
+	l.enabled = cfg.Enabled
+	l.requestThreshold = cfg.Threshold
+	l.cooloffDuration = time.Duration(cfg.CooloffMS) * time.Millisecond
+	l.exemptUserIDs = exemptUserIDs
 }
 
-func (l *RateLimits) clean() {
+// clean removes unused limits every 30 seconds until ctx is done, at which
+// point the rate limiter no longer picks up reloaded options either.
+func (l *RateLimits) clean(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
 	for {
-		// On a 30 second interval, we'll take an exclusive write
-		// lock of the entire map and see if any of the channels are
-		// empty. If they are then we will close and delete them,
-		// freeing up memory.
-		time.Sleep(time.Second * 30)
-		l.cleanMutex.Lock()
-		l.limitsMutex.Lock()
-		for k, c := range l.limits {
-			if len(c) == 0 {
-				close(c)
-				delete(l.limits, k)
+		select {
+		case <-ctx.Done():
+			rateLimitsMutex.Lock()
+			for i, other := range rateLimits {
+				if other == l {
+					rateLimits = append(rateLimits[:i:i], rateLimits[i+1:]...)
+					break
+				}
 			}
+			rateLimitsMutex.Unlock()
+			return
+		case <-ticker.C:
+			l.removeUnused()
+		}
+	}
+}
+
+// removeUnused takes an exclusive write lock of the entire map and closes
+// and deletes any of the channels which are empty, freeing up memory.
+func (l *RateLimits) removeUnused() {
+	l.cleanMutex.Lock()
+	defer l.cleanMutex.Unlock()
+	l.limitsMutex.Lock()
+	defer l.limitsMutex.Unlock()
+	for k, c := range l.limits {
+		if len(c) == 0 {
+			close(c)
+			delete(l.limits, k)
 		}
-		l.limitsMutex.Unlock()
-		l.cleanMutex.Unlock()
 	}
 }
 
 func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSONResponse {
+	l.settingsMutex.RLock()
+	enabled, requestThreshold, cooloffDuration := l.enabled, l.requestThreshold, l.cooloffDuration
+	exemptUserIDs := l.exemptUserIDs
+	l.settingsMutex.RUnlock()
+
 	// If rate limiting is disabled then do nothing.
-	if !l.enabled {
+	if !enabled {
 		return nil
 	}
 
@@ -81,7 +149,7 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 		case userapi.AccountTypeAppService:
 			return nil // don't rate-limit appservice users
 		default:
-			if _, ok := l.exemptUserIDs[device.UserID]; ok {
+			if _, ok := exemptUserIDs[device.UserID]; ok {
 				// If the user is exempt from rate limiting then do nothing.
 				return nil
 			}
@@ -95,6 +163,16 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 		}
 	}
 
+	if l.store != nil {
+		allowed, err := l.takeFromStore(req.Context(), caller, requestThreshold, cooloffDuration)
+		switch {
+		case err == nil && allowed:
+			return nil
+		case err == nil:
+			return limitExceeded(cooloffDuration)
+		}
+	}
+
 	// Look up the caller's channel, if they have one.
 	l.limitsMutex.RLock()
 	rateLimit, ok := l.limits[caller]
@@ -103,7 +181,7 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 	// If the caller doesn't have a channel, create one and write it
 	// back to the map.
 	if !ok {
-		rateLimit = make(chan struct{}, l.requestThreshold)
+		rateLimit = make(chan struct{}, requestThreshold)
 
 		l.limitsMutex.Lock()
 		l.limits[caller] = rateLimit
@@ -116,17 +194,40 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 	case rateLimit <- struct{}{}:
 	default:
 		// We hit the rate limit. Tell the client to back off.
-		return &util.JSONResponse{
-			Code: http.StatusTooManyRequests,
-			JSON: spec.LimitExceeded("You are sending too many requests too quickly!", l.cooloffDuration.Milliseconds()),
-		}
+		return limitExceeded(cooloffDuration)
 	}
 
 	// After the time interval, drain a resource from the rate limiting
 	// channel. This will free up space in the channel for new requests.
 	go func() {
-		<-time.After(l.cooloffDuration)
+		<-time.After(cooloffDuration)
 		<-rateLimit
 	}()
 	return nil
 }
+
+// takeFromStore takes one of the caller's requests from the shared store. If
+// the store fails then the error is logged, at most once a minute so as not
+// to flood the logs during an outage, and the caller should fall back to the
+// local limits.
+func (l *RateLimits) takeFromStore(ctx context.Context, caller string, threshold int64, cooloff time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	allowed, err := l.store.Take(ctx, l.name+"|"+caller, threshold, cooloff)
+	if err != nil {
+		l.settingsMutex.Lock()
+		if time.Since(l.storeFailedAt) > time.Minute {
+			l.storeFailedAt = time.Now()
+			logrus.WithError(err).Warnf("Shared rate limit store failed, falling back to local rate limits for %s", l.name)
+		}
+		l.settingsMutex.Unlock()
+	}
+	return allowed, err
+}
+
+func limitExceeded(cooloff time.Duration) *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: http.StatusTooManyRequests,
+		JSON: spec.LimitExceeded("You are sending too many requests too quickly!", cooloff.Milliseconds()),
+	}
+}
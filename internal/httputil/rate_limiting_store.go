@@ -0,0 +1,115 @@
+package httputil
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// RateLimitStore keeps rate limits somewhere which is shared between
+// instances, so that a caller gets the same limits whichever instance their
+// requests end up at.
+type RateLimitStore interface {
+	// Take uses up one of the caller's requests, returning false if they have
+	// made threshold requests within the cooloff period already.
+	Take(ctx context.Context, caller string, threshold int64, cooloff time.Duration) (bool, error)
+}
+
+const rateLimitsSchema = `
+-- Rate limits which are shared between instances, using the generic cell rate
+-- algorithm so that each caller only needs a single row.
+CREATE TABLE IF NOT EXISTS clientapi_rate_limits (
+    -- The rate limiter and the user and device or IP address being limited.
+    caller TEXT NOT NULL PRIMARY KEY,
+    -- The theoretical arrival time of the caller's next request in UNIX
+    -- epoch ms. The caller is limited when this is more than the cooloff
+    -- period away.
+    tat BIGINT NOT NULL
+);
+`
+
+// takeRateLimitSQL moves the caller's theoretical arrival time on by one
+// request, or returns no rows if that would put it more than the cooloff
+// period ($4) ahead of now ($2). $3 is how far one request moves it.
+const takeRateLimitSQL = `
+INSERT INTO clientapi_rate_limits AS r (caller, tat) VALUES ($1, $2::BIGINT + $3::BIGINT)
+    ON CONFLICT (caller) DO UPDATE SET tat = GREATEST(r.tat, $2::BIGINT) + $3::BIGINT
+    WHERE GREATEST(r.tat, $2::BIGINT) + $3::BIGINT - $4::BIGINT <= $2::BIGINT
+    RETURNING tat
+`
+
+const deleteExpiredRateLimitsSQL = `
+DELETE FROM clientapi_rate_limits WHERE tat < $1
+`
+
+type postgresRateLimitStore struct {
+	takeStmt          *sql.Stmt
+	deleteExpiredStmt *sql.Stmt
+}
+
+// NewPostgresRateLimitStore creates a RateLimitStore which keeps the rate
+// limits in the database, removing those which have expired every minute
+// until ctx is done.
+func NewPostgresRateLimitStore(ctx context.Context, cm *sqlutil.Connections, dbProperties *config.DatabaseOptions) (RateLimitStore, error) {
+	db, _, err := cm.Connection(dbProperties)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(rateLimitsSchema); err != nil {
+		return nil, err
+	}
+	s := &postgresRateLimitStore{}
+	if err = (sqlutil.StatementList{
+		{&s.takeStmt, takeRateLimitSQL},
+		{&s.deleteExpiredStmt, deleteExpiredRateLimitsSQL},
+	}.Prepare(db)); err != nil {
+		return nil, err
+	}
+	go s.clean(ctx)
+	return s, nil
+}
+
+func (s *postgresRateLimitStore) Take(ctx context.Context, caller string, threshold int64, cooloff time.Duration) (bool, error) {
+	now := time.Now().UnixMilli()
+	interval := cooloff.Milliseconds() / threshold
+	if interval < 1 {
+		interval = 1
+	}
+	var tat int64
+	err := s.takeStmt.QueryRowContext(ctx, caller, now, interval, cooloff.Milliseconds()).Scan(&tat)
+	switch err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (s *postgresRateLimitStore) clean(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.deleteExpired(ctx, time.Now()); err != nil && ctx.Err() == nil {
+				logrus.WithError(err).Warn("Failed to remove expired rate limits")
+			}
+		}
+	}
+}
+
+// deleteExpired removes the rate limits of callers who are no longer being
+// limited at all.
+func (s *postgresRateLimitStore) deleteExpired(ctx context.Context, now time.Time) error {
+	_, err := s.deleteExpiredStmt.ExecContext(ctx, now.UnixMilli())
+	return err
+}
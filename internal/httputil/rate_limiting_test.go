@@ -0,0 +1,205 @@
+package httputil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+	"github.com/neilalexander/harmony/test"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+type fakeRateLimitStore struct {
+	allowed bool
+	err     error
+	callers []string
+}
+
+func (s *fakeRateLimitStore) Take(ctx context.Context, caller string, threshold int64, cooloff time.Duration) (bool, error) {
+	s.callers = append(s.callers, caller)
+	return s.allowed, s.err
+}
+
+func TestRateLimitsSharedStore(t *testing.T) {
+	cfg := &config.RateLimiting{Enabled: true, Threshold: 1, CooloffMS: 60000}
+	device := &userapi.Device{UserID: "@alice:test", ID: "DEVICE"}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &fakeRateLimitStore{allowed: true}
+	l := NewRateLimits(ctx, "test", cfg, store)
+
+	// The store decides, so the local threshold of 1 doesn't apply.
+	for i := 0; i < 3; i++ {
+		if res := l.Limit(req, device); res != nil {
+			t.Fatalf("request %d was limited, but the store allowed it", i)
+		}
+	}
+	if store.callers[0] != "test|@alice:testDEVICE" {
+		t.Fatalf("unexpected caller %q", store.callers[0])
+	}
+
+	store.allowed = false
+	if res := l.Limit(req, device); res == nil || res.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the request to be limited by the store, got %+v", res)
+	}
+
+	// When the store fails, the local limits apply instead.
+	store.err = errors.New("store unavailable")
+	if res := l.Limit(req, device); res != nil {
+		t.Fatalf("expected the first request to be allowed by the local limits, got %+v", res)
+	}
+	if res := l.Limit(req, device); res == nil || res.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the second request to be limited by the local limits, got %+v", res)
+	}
+}
+
+func TestRateLimitsReload(t *testing.T) {
+	var cfg, newer config.Dendrite
+	cfg.ClientAPI.RateLimiting = config.RateLimiting{Enabled: true, Threshold: 1, CooloffMS: 60000}
+	device := &userapi.Device{UserID: "@alice:test", ID: "DEVICE"}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := NewRateLimits(ctx, "first", &cfg.ClientAPI.RateLimiting, nil)
+	second := NewRateLimits(ctx, "second", &cfg.ClientAPI.RateLimiting, nil)
+	for _, l := range []*RateLimits{first, second} {
+		if res := l.Limit(req, device); res != nil {
+			t.Fatalf("expected the first request to be allowed, got %+v", res)
+		}
+		if res := l.Limit(req, device); res == nil || res.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected the second request to be limited, got %+v", res)
+		}
+	}
+
+	// Both rate limiters pick up the reloaded options.
+	cfg.ApplyReload(&newer)
+	for _, l := range []*RateLimits{first, second} {
+		if res := l.Limit(req, device); res != nil {
+			t.Fatalf("expected rate limiting to be disabled after reload, got %+v", res)
+		}
+	}
+}
+
+func TestRateLimitsClean(t *testing.T) {
+	cfg := &config.RateLimiting{Enabled: true, Threshold: 1, CooloffMS: 60000}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	l := NewRateLimits(ctx, "test", cfg, nil)
+
+	// Callers who are still limited are kept, the rest are removed.
+	if res := l.Limit(req, &userapi.Device{UserID: "@alice:test", ID: "DEVICE"}); res != nil {
+		t.Fatalf("expected the request to be allowed, got %+v", res)
+	}
+	l.limits["@bob:testDEVICE"] = make(chan struct{}, 1)
+	l.removeUnused()
+	if _, ok := l.limits["@alice:testDEVICE"]; !ok || len(l.limits) != 1 {
+		t.Fatalf("expected only the limited caller to be kept, got %v", l.limits)
+	}
+
+	// Once the context is done, the rate limiter stops cleaning up and no
+	// longer picks up reloaded options.
+	cancel()
+	deadline := time.Now().Add(time.Second * 5)
+	for registered := true; registered; {
+		if time.Now().After(deadline) {
+			t.Fatal("rate limiter is still registered after its context was done")
+		}
+		time.Sleep(time.Millisecond * 10)
+		rateLimitsMutex.Lock()
+		registered = false
+		for _, other := range rateLimits {
+			registered = registered || other == l
+		}
+		rateLimitsMutex.Unlock()
+	}
+}
+
+func TestPostgresRateLimitStore(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		processCtx := process.NewProcessContext()
+		defer processCtx.ShutdownDendrite()
+		cm := sqlutil.NewConnectionManager(processCtx, config.DatabaseOptions{})
+		store, err := NewPostgresRateLimitStore(processCtx.Context(), cm, &config.DatabaseOptions{ConnectionString: config.DataSource(connStr)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+
+		// Two requests are allowed within the cooloff period, and the third
+		// is limited, without affecting other callers.
+		for i, want := range []bool{true, true, false} {
+			if allowed, err := store.Take(ctx, "alice", 2, time.Minute); err != nil || allowed != want {
+				t.Fatalf("request %d: got %v, %v, want %v", i, allowed, err, want)
+			}
+		}
+		if allowed, err := store.Take(ctx, "bob", 2, time.Minute); err != nil || !allowed {
+			t.Fatalf("expected another caller to be allowed, got %v, %v", allowed, err)
+		}
+
+		// Once the cooloff period has passed, the caller's limits are removed
+		// and they are allowed again.
+		s := store.(*postgresRateLimitStore)
+		if err = s.deleteExpired(ctx, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if allowed, err := store.Take(ctx, "alice", 2, time.Minute); err != nil || allowed {
+			t.Fatalf("expected the caller to still be limited, got %v, %v", allowed, err)
+		}
+		if err = s.deleteExpired(ctx, time.Now().Add(time.Minute*3)); err != nil {
+			t.Fatal(err)
+		}
+		db, _, err := cm.Connection(&config.DatabaseOptions{ConnectionString: config.DataSource(connStr)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		if err = db.QueryRow("SELECT COUNT(*) FROM clientapi_rate_limits").Scan(&count); err != nil || count != 0 {
+			t.Fatalf("got %d rate limits, %v, want none", count, err)
+		}
+	})
+}
+
+func TestPostgresRateLimitStoreTake(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() // nolint: errcheck
+	mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO clientapi_rate_limits"))
+	takeStmt, err := db.Prepare(takeRateLimitSQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &postgresRateLimitStore{takeStmt: takeStmt}
+
+	// Five requests per second moves the arrival time on by 200ms each.
+	mock.ExpectQuery("INSERT INTO clientapi_rate_limits").
+		WithArgs("caller", sqlmock.AnyArg(), int64(200), int64(1000)).
+		WillReturnRows(sqlmock.NewRows([]string{"tat"}).AddRow(1))
+	if allowed, err := s.Take(context.Background(), "caller", 5, time.Second); err != nil || !allowed {
+		t.Fatalf("expected the request to be allowed, got %v, %v", allowed, err)
+	}
+
+	mock.ExpectQuery("INSERT INTO clientapi_rate_limits").
+		WillReturnRows(sqlmock.NewRows([]string{"tat"}))
+	if allowed, err := s.Take(context.Background(), "caller", 5, time.Second); err != nil || allowed {
+		t.Fatalf("expected the request to be limited, got %v, %v", allowed, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
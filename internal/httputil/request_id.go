@@ -0,0 +1,38 @@
+package httputil
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/neilalexander/harmony/internal/util"
+)
+
+// WithTrustedRequestIDs wraps a handler so that the X-Request-ID header is
+// removed from requests which didn't come from one of the trusted proxies.
+// Otherwise clients could choose the request IDs which are logged for their
+// requests, i.e. to make them look like someone else's.
+func WithTrustedRequestIDs(h http.Handler, trustedProxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(util.RequestIDHeader) != "" && !isTrustedProxy(req.RemoteAddr, trustedProxies) {
+			req.Header.Del(util.RequestIDHeader)
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func isTrustedProxy(remoteAddr string, trustedProxies []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package httputil
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/util"
+)
+
+func TestWithTrustedRequestIDs(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	h := WithTrustedRequestIDs(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Get(util.RequestIDHeader)
+	}), []*net.IPNet{proxies})
+
+	for remoteAddr, want := range map[string]string{
+		"10.1.2.3:1234":    "proxy-id",
+		"192.168.1.1:1234": "",
+		"[::1]:1234":       "",
+		"not an address":   "",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(util.RequestIDHeader, "proxy-id")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != want {
+			t.Errorf("got request ID %q from %s, want %q", got, remoteAddr, want)
+		}
+	}
+}
@@ -18,10 +18,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"sync"
@@ -40,6 +42,34 @@ import (
 var stdLevelLogAdded = make(map[logrus.Level]bool)
 var levelLogAddedMu = &sync.Mutex{}
 
+// configuredHooks remembers the hooks passed to SetupHookLogging, so that
+// ReloadHookLogging can tell whether anything other than levels changed.
+var configuredHooks []config.LogrusHook
+
+// sinkHooks are the file and syslog hooks made by SetupHookLogging, at the
+// same index as their configuration in configuredHooks. ReloadHookLogging
+// hands them back to SetupHookLogging through reusedSinkHooks, as making new
+// ones would leave the old ones' goroutines and connections behind.
+var sinkHooks, reusedSinkHooks []logrus.Hook
+
+// addSinkHook adds the file or syslog hook for the i-th configured hook,
+// reusing the one from before a reload if there is one. newHook returns nil
+// if the hook couldn't be made.
+func addSinkHook(i int, level logrus.Level, newHook func() logrus.Hook) {
+	var hook logrus.Hook
+	if i < len(reusedSinkHooks) {
+		hook = reusedSinkHooks[i]
+	}
+	if hook == nil {
+		hook = newHook()
+	}
+	if hook == nil {
+		return
+	}
+	sinkHooks[i] = hook
+	logrus.AddHook(&logLevelHook{level, hook})
+}
+
 type utcFormatter struct {
 	logrus.Formatter
 }
@@ -51,23 +81,72 @@ func (f utcFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 
 // Logrus hook which wraps another hook and filters log entries according to their level.
 // (Note that we cannot use solely logrus.SetLevel, because Dendrite supports multiple
-// levels of logging at the same time.)
+// levels of logging at the same time.) Components with their own log level configured
+// are filtered according to that level instead.
 type logLevelHook struct {
 	level logrus.Level
 	logrus.Hook
 }
 
-// Levels returns all the levels supported by this hook.
+// Levels returns all the levels supported by this hook. This is every
+// level, as a component may be configured to log more verbosely than the
+// hook itself, so filtering happens in Fire instead.
 func (h *logLevelHook) Levels() []logrus.Level {
-	levels := make([]logrus.Level, 0)
+	return logrus.AllLevels
+}
 
-	for _, level := range logrus.AllLevels {
-		if level <= h.level {
-			levels = append(levels, level)
+// Fire tags the entry with the component that logged it, and the request
+// that it was logged for if there is one in the entry's context, and then
+// passes it on to the wrapped hook, if the level is enabled.
+func (h *logLevelHook) Fire(entry *logrus.Entry) error {
+	component := entryComponent(entry)
+	level, ok := componentLevel(component)
+	if !ok {
+		level = h.level
+	}
+	if entry.Level > level {
+		return nil
+	}
+	if component != "" {
+		entry.Data["component"] = component
+	}
+	if entry.Context != nil {
+		if _, ok := entry.Data["req.id"]; !ok {
+			if reqID := util.GetRequestID(entry.Context); reqID != "" {
+				entry.Data["req.id"] = reqID
+			}
 		}
 	}
+	return h.Hook.Fire(entry)
+}
+
+// textFormatter returns the formatter used for plain text logs on stdout.
+func textFormatter() logrus.Formatter {
+	return &utcFormatter{
+		&logrus.TextFormatter{
+			TimestampFormat:  "2006-01-02T15:04:05.000000000Z07:00",
+			FullTimestamp:    true,
+			DisableColors:    false,
+			DisableTimestamp: false,
+			QuoteEmptyFields: true,
+			CallerPrettyfier: callerPrettyfier,
+		},
+	}
+}
+
+// jsonFormatter returns the formatter used for logs with the "json" format.
+func jsonFormatter() logrus.Formatter {
+	return &utcFormatter{
+		&logrus.JSONFormatter{
+			TimestampFormat: "2006-01-02T15:04:05.000000000Z07:00",
+		},
+	}
+}
 
-	return levels
+// isJSONFormat returns whether the hook params ask for JSON output.
+func isJSONFormat(params map[string]interface{}) bool {
+	format, _ := params["format"].(string)
+	return format == "json"
 }
 
 // callerPrettyfier is a function that given a runtime.Frame object, will
@@ -104,16 +183,38 @@ func SetupStdLogging() {
 	levelLogAddedMu.Lock()
 	defer levelLogAddedMu.Unlock()
 	logrus.SetReportCaller(true)
-	logrus.SetFormatter(&utcFormatter{
-		&logrus.TextFormatter{
-			TimestampFormat:  "2006-01-02T15:04:05.000000000Z07:00",
-			FullTimestamp:    true,
-			DisableColors:    false,
-			DisableTimestamp: false,
-			QuoteEmptyFields: true,
-			CallerPrettyfier: callerPrettyfier,
-		},
-	})
+	logrus.SetFormatter(textFormatter())
+	slog.SetDefault(slog.New(&slogHandler{}))
+}
+
+// ReloadHookLogging replaces the logging hooks with those defined in the
+// configuration. Only the levels of the hooks can be changed this way, as
+// adding, removing or reconfiguring hooks needs a restart.
+func ReloadHookLogging(hooks []config.LogrusHook) error {
+	levelLogAddedMu.Lock()
+	if len(hooks) != len(configuredHooks) {
+		levelLogAddedMu.Unlock()
+		return fmt.Errorf("logging hooks cannot be added or removed without a restart")
+	}
+	for i, hook := range hooks {
+		if hook.Type != configuredHooks[i].Type || !reflect.DeepEqual(hook.Params, configuredHooks[i].Params) {
+			levelLogAddedMu.Unlock()
+			return fmt.Errorf("logging hook %d cannot be reconfigured without a restart", i)
+		}
+		if _, err := logrus.ParseLevel(hook.Level); err != nil {
+			levelLogAddedMu.Unlock()
+			return fmt.Errorf("logging hook %d: %w", i, err)
+		}
+	}
+	logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	reusedSinkHooks = sinkHooks
+	stdLevelLogAdded = make(map[logrus.Level]bool)
+	hooksLevel = logrus.InfoLevel
+	logrus.SetLevel(logrus.InfoLevel)
+	levelLogAddedMu.Unlock()
+
+	SetupHookLogging(hooks)
+	return nil
 }
 
 // File type hooks should be provided a path to a directory to store log files
@@ -129,7 +230,7 @@ func checkFileHookParams(params map[string]interface{}) {
 }
 
 // Add a new FSHook to the logger. Each component will log in its own file
-func setupFileHook(hook config.LogrusHook, level logrus.Level) {
+func setupFileHook(i int, hook config.LogrusHook, level logrus.Level) {
 	dirPath := (hook.Params["path"]).(string)
 	fullPath := filepath.Join(dirPath, "dendrite.log")
 
@@ -137,21 +238,25 @@ func setupFileHook(hook config.LogrusHook, level logrus.Level) {
 		logrus.Fatalf("Couldn't create directory %s: %q", path.Dir(fullPath), err)
 	}
 
-	logrus.AddHook(&logLevelHook{
-		level,
-		dugong.NewFSHook(
+	var formatter logrus.Formatter = &utcFormatter{
+		&logrus.TextFormatter{
+			TimestampFormat:  "2006-01-02T15:04:05.000000000Z07:00",
+			DisableColors:    true,
+			DisableTimestamp: false,
+			DisableSorting:   false,
+			QuoteEmptyFields: true,
+		},
+	}
+	if isJSONFormat(hook.Params) {
+		formatter = jsonFormatter()
+	}
+
+	addSinkHook(i, level, func() logrus.Hook {
+		return dugong.NewFSHook(
 			fullPath,
-			&utcFormatter{
-				&logrus.TextFormatter{
-					TimestampFormat:  "2006-01-02T15:04:05.000000000Z07:00",
-					DisableColors:    true,
-					DisableTimestamp: false,
-					DisableSorting:   false,
-					QuoteEmptyFields: true,
-				},
-			},
+			formatter,
 			&dugong.DailyRotationSchedule{GZip: true},
-		),
+		)
 	})
 }
 
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// modulePrefix is stripped from function names to work out which component
+// logged an entry, i.e. "roomserver" or "federationapi".
+const modulePrefix = "github.com/neilalexander/harmony/"
+
+// hooksLevel is the most verbose level of any of the configured logging
+// hooks. It is guarded by levelLogAddedMu.
+var hooksLevel = logrus.InfoLevel
+
+var (
+	componentLevelsMu sync.RWMutex
+	componentLevels   map[string]logrus.Level
+)
+
+// SetComponentLogLevels configures log levels for individual components,
+// which take the place of the logging hook levels for any entries logged
+// by those components. This allows noisy components to be quietened, or
+// a single component to be debugged, without affecting everything else.
+func SetComponentLogLevels(levels map[string]string) error {
+	parsed := make(map[string]logrus.Level, len(levels))
+	for component, level := range levels {
+		l, err := logrus.ParseLevel(level)
+		if err != nil {
+			return fmt.Errorf("component %q: %w", component, err)
+		}
+		parsed[component] = l
+	}
+	componentLevelsMu.Lock()
+	componentLevels = parsed
+	componentLevelsMu.Unlock()
+
+	levelLogAddedMu.Lock()
+	defer levelLogAddedMu.Unlock()
+	updateGlobalLogLevel()
+	return nil
+}
+
+// updateGlobalLogLevel sets the logrus level to the most verbose level of
+// any hook or component, so that entries aren't dropped before they reach
+// the hooks. The caller must hold levelLogAddedMu.
+func updateGlobalLogLevel() {
+	level := hooksLevel
+	componentLevelsMu.RLock()
+	for _, l := range componentLevels {
+		if l > level {
+			level = l
+		}
+	}
+	componentLevelsMu.RUnlock()
+	logrus.SetLevel(level)
+}
+
+// componentLevel returns the log level configured for the component, if any.
+func componentLevel(component string) (logrus.Level, bool) {
+	if component == "" {
+		return 0, false
+	}
+	componentLevelsMu.RLock()
+	defer componentLevelsMu.RUnlock()
+	level, ok := componentLevels[component]
+	return level, ok
+}
+
+// entryComponent returns the component that logged the entry. A component
+// field set by the caller takes precedence over the calling function.
+func entryComponent(entry *logrus.Entry) string {
+	if component, ok := entry.Data["component"].(string); ok {
+		return component
+	}
+	if entry.Caller == nil {
+		return ""
+	}
+	return componentFromFunction(entry.Caller.Function)
+}
+
+// componentFromFunction returns the top-level package within this module
+// that the fully qualified function name belongs to.
+func componentFromFunction(function string) string {
+	if !strings.HasPrefix(function, modulePrefix) {
+		return ""
+	}
+	function = function[len(modulePrefix):]
+	if i := strings.IndexAny(function, "/."); i > 0 {
+		return function[:i]
+	}
+	return function
+}
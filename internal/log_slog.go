@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+// slogHandler passes records logged through log/slog on to logrus, so that
+// they go through the same hooks, levels and formatting as everything else.
+type slogHandler struct {
+	attrs  []slog.Attr
+	groups []string
+}
+
+func slogToLogrusLevel(level slog.Level) logrus.Level {
+	switch {
+	case level >= slog.LevelError:
+		return logrus.ErrorLevel
+	case level >= slog.LevelWarn:
+		return logrus.WarnLevel
+	case level >= slog.LevelInfo:
+		return logrus.InfoLevel
+	default:
+		return logrus.DebugLevel
+	}
+}
+
+func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return logrus.IsLevelEnabled(slogToLogrusLevel(level))
+}
+
+func (h *slogHandler) Handle(ctx context.Context, r slog.Record) error {
+	fields := make(logrus.Fields, len(h.attrs)+r.NumAttrs()+1)
+	for _, attr := range h.attrs {
+		h.addField(fields, nil, attr)
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		h.addField(fields, h.groups, attr)
+		return true
+	})
+	// logrus would report this handler as the caller, so work out the
+	// component from the original caller instead.
+	if _, ok := fields["component"]; !ok && r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		if component := componentFromFunction(frame.Function); component != "" {
+			fields["component"] = component
+		}
+	}
+	logrus.WithContext(ctx).WithTime(r.Time).WithFields(fields).Log(slogToLogrusLevel(r.Level), r.Message)
+	return nil
+}
+
+func (h *slogHandler) addField(fields logrus.Fields, groups []string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			groups = append(groups[:len(groups):len(groups)], attr.Key)
+		}
+		for _, a := range attr.Value.Group() {
+			h.addField(fields, groups, a)
+		}
+		return
+	}
+	key := attr.Key
+	for i := len(groups) - 1; i >= 0; i-- {
+		key = groups[i] + "." + key
+	}
+	fields[key] = attr.Value.Any()
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := &slogHandler{
+		attrs:  append(h.attrs[:len(h.attrs):len(h.attrs)], make([]slog.Attr, 0, len(attrs))...),
+		groups: h.groups,
+	}
+	for _, attr := range attrs {
+		// Attributes added within a group are stored with the group applied.
+		for i := len(h.groups) - 1; i >= 0; i-- {
+			attr = slog.Group(h.groups[i], attr)
+		}
+		clone.attrs = append(clone.attrs, attr)
+	}
+	return clone
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &slogHandler{
+		attrs:  h.attrs,
+		groups: append(h.groups[:len(h.groups):len(h.groups)], name),
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/neilalexander/harmony/internal/util"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func TestComponentFromFunction(t *testing.T) {
+	tests := map[string]string{
+		"github.com/neilalexander/harmony/roomserver/internal/input.(*Inputer).Start": "roomserver",
+		"github.com/neilalexander/harmony/federationapi.NewInternalAPI":               "federationapi",
+		"github.com/neilalexander/harmony/internal.SetupPprof":                        "internal",
+		"github.com/nats-io/nats.go.(*Conn).Publish":                                  "",
+		"main.main": "",
+	}
+	for function, want := range tests {
+		if got := componentFromFunction(function); got != want {
+			t.Errorf("componentFromFunction(%q) = %q, want %q", function, got, want)
+		}
+	}
+}
+
+func TestComponentLogLevels(t *testing.T) {
+	hook := new(test.Hook)
+	t.Cleanup(func() {
+		logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+		_ = SetComponentLogLevels(nil)
+	})
+	logrus.AddHook(&logLevelHook{logrus.InfoLevel, hook})
+	if err := SetComponentLogLevels(map[string]string{"roomserver": "debug"}); err != nil {
+		t.Fatal(err)
+	}
+
+	logrus.WithField("component", "roomserver").Debug("roomserver")
+	logrus.WithField("component", "syncapi").Debug("syncapi")
+	if len(hook.AllEntries()) != 1 || hook.LastEntry().Message != "roomserver" {
+		t.Fatalf("expected only the roomserver debug entry, got %d entries", len(hook.AllEntries()))
+	}
+}
+
+func TestLogRequestID(t *testing.T) {
+	hook := new(test.Hook)
+	t.Cleanup(func() {
+		logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	})
+	logrus.AddHook(&logLevelHook{logrus.InfoLevel, hook})
+
+	ctx := util.ContextWithRequestID(context.Background(), "abc123")
+	logrus.WithContext(ctx).Info("with request")
+	if got := hook.LastEntry().Data["req.id"]; got != "abc123" {
+		t.Fatalf("got request ID %v, want %q", got, "abc123")
+	}
+	logrus.WithContext(context.Background()).Info("without request")
+	if _, ok := hook.LastEntry().Data["req.id"]; ok {
+		t.Fatalf("didn't expect a request ID")
+	}
+}
+
+func TestSlogHandler(t *testing.T) {
+	hook := test.NewGlobal()
+	t.Cleanup(func() {
+		logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	})
+	logger := slog.New(&slogHandler{}).With("room_id", "!room:test").WithGroup("req")
+	logger.Warn("hello", "method", "GET")
+
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("expected an entry to be logged")
+	}
+	if entry.Level != logrus.WarnLevel || entry.Message != "hello" {
+		t.Fatalf("got %s entry %q", entry.Level, entry.Message)
+	}
+	if entry.Data["room_id"] != "!room:test" || entry.Data["req.method"] != "GET" {
+		t.Fatalf("unexpected fields: %v", entry.Data)
+	}
+	if entry.Data["component"] != "internal" {
+		t.Fatalf("got component %v, want internal", entry.Data["component"])
+	}
+}
+
+func TestReloadHookLoggingReusesFileHook(t *testing.T) {
+	t.Cleanup(func() {
+		levelLogAddedMu.Lock()
+		defer levelLogAddedMu.Unlock()
+		logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+		logrus.SetOutput(os.Stderr)
+		logrus.SetFormatter(textFormatter())
+		logrus.SetLevel(logrus.InfoLevel)
+		stdLevelLogAdded = make(map[logrus.Level]bool)
+		hooksLevel = logrus.InfoLevel
+		configuredHooks, sinkHooks = nil, nil
+	})
+	hooks := []config.LogrusHook{{
+		Type:   "file",
+		Level:  "info",
+		Params: map[string]interface{}{"path": t.TempDir()},
+	}}
+	SetupHookLogging(hooks)
+	fileHook := sinkHooks[0]
+
+	// Only the level changes, so the file hook is kept rather than another
+	// one being made.
+	hooks[0].Level = "debug"
+	if err := ReloadHookLogging(hooks); err != nil {
+		t.Fatal(err)
+	}
+	if sinkHooks[0] != fileHook {
+		t.Fatalf("reloading made a new file hook")
+	}
+	var levels []logrus.Level
+	for _, hook := range logrus.StandardLogger().Hooks[logrus.DebugLevel] {
+		if h, ok := hook.(*logLevelHook); ok && h.Hook == fileHook {
+			levels = append(levels, h.level)
+		}
+	}
+	if len(levels) != 1 || levels[0] != logrus.DebugLevel {
+		t.Fatalf("got file hooks with levels %v, want one at debug", levels)
+	}
+}
@@ -20,8 +20,8 @@ package internal
 import (
 	"io"
 	"log/syslog"
+	"os"
 
-	"github.com/MFAshby/stdemuxerhook"
 	"github.com/sirupsen/logrus"
 	lSyslog "github.com/sirupsen/logrus/hooks/syslog"
 
@@ -34,7 +34,11 @@ import (
 func SetupHookLogging(hooks []config.LogrusHook) {
 	levelLogAddedMu.Lock()
 	defer levelLogAddedMu.Unlock()
-	for _, hook := range hooks {
+	configuredHooks = hooks
+	sinkHooks = make([]logrus.Hook, len(hooks))
+	defer func() { reusedSinkHooks = nil }()
+	hasStdHook := false
+	for i, hook := range hooks {
 		// Check we received a proper logging level
 		level, err := logrus.ParseLevel(hook.Level)
 		if err != nil {
@@ -43,26 +47,31 @@ func SetupHookLogging(hooks []config.LogrusHook) {
 
 		// Perform a first filter on the logs according to the lowest level of all
 		// (Eg: If we have hook for info and above, prevent logrus from processing debug logs)
-		if logrus.GetLevel() < level {
-			logrus.SetLevel(level)
+		if hooksLevel < level {
+			hooksLevel = level
 		}
 
 		switch hook.Type {
 		case "file":
 			checkFileHookParams(hook.Params)
-			setupFileHook(hook, level)
+			setupFileHook(i, hook, level)
 		case "syslog":
 			checkSyslogHookParams(hook.Params)
-			setupSyslogHook(hook, level)
+			setupSyslogHook(i, hook, level)
 		case "std":
-			setupStdLogHook(level)
+			hasStdHook = true
+			setupStdLogHook(level, hook.Params)
 		default:
 			logrus.Fatalf("Unrecognised logging hook type: %s", hook.Type)
 		}
 	}
-	setupStdLogHook(logrus.InfoLevel)
+	if !hasStdHook {
+		setupStdLogHook(logrus.InfoLevel, nil)
+	}
+	updateGlobalLogLevel()
 	// Hooks are now configured for stdout/err, so throw away the default logger output
 	logrus.SetOutput(io.Discard)
+	logrus.SetFormatter(nopFormatter{})
 }
 
 func checkSyslogHookParams(params map[string]interface{}) {
@@ -86,17 +95,54 @@ func checkSyslogHookParams(params map[string]interface{}) {
 
 }
 
-func setupStdLogHook(level logrus.Level) {
+func setupStdLogHook(level logrus.Level, params map[string]interface{}) {
 	if stdLevelLogAdded[level] {
 		return
 	}
-	logrus.AddHook(&logLevelHook{level, stdemuxerhook.New(logrus.StandardLogger())})
+	formatter := textFormatter()
+	if isJSONFormat(params) {
+		formatter = jsonFormatter()
+	}
+	logrus.AddHook(&logLevelHook{level, &stdHook{formatter}})
 	stdLevelLogAdded[level] = true
 }
 
-func setupSyslogHook(hook config.LogrusHook, level logrus.Level) {
-	syslogHook, err := lSyslog.NewSyslogHook(hook.Params["protocol"].(string), hook.Params["address"].(string), syslog.LOG_INFO, "dendrite")
-	if err == nil {
-		logrus.AddHook(&logLevelHook{level, syslogHook})
+// stdHook writes log entries to stdout, or to stderr for errors and above.
+type stdHook struct {
+	formatter logrus.Formatter
+}
+
+func (h *stdHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *stdHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	if entry.Level <= logrus.ErrorLevel {
+		out = os.Stderr
 	}
+	_, err = out.Write(line)
+	return err
+}
+
+// nopFormatter is used for the standard logger once all output goes through
+// the hooks, so that entries aren't formatted only to be thrown away.
+type nopFormatter struct{}
+
+func (nopFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+func setupSyslogHook(i int, hook config.LogrusHook, level logrus.Level) {
+	addSinkHook(i, level, func() logrus.Hook {
+		syslogHook, err := lSyslog.NewSyslogHook(hook.Params["protocol"].(string), hook.Params["address"].(string), syslog.LOG_INFO, "dendrite")
+		if err != nil {
+			return nil
+		}
+		return syslogHook
+	})
 }
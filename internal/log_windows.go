@@ -23,8 +23,13 @@ import (
 // If something fails here it means that the logging was improperly configured,
 // so we just exit with the error
 func SetupHookLogging(hooks []config.LogrusHook) {
+	levelLogAddedMu.Lock()
+	defer levelLogAddedMu.Unlock()
 	logrus.SetReportCaller(true)
-	for _, hook := range hooks {
+	configuredHooks = hooks
+	sinkHooks = make([]logrus.Hook, len(hooks))
+	defer func() { reusedSinkHooks = nil }()
+	for i, hook := range hooks {
 		// Check we received a proper logging level
 		level, err := logrus.ParseLevel(hook.Level)
 		if err != nil {
@@ -33,16 +38,17 @@ func SetupHookLogging(hooks []config.LogrusHook) {
 
 		// Perform a first filter on the logs according to the lowest level of all
 		// (Eg: If we have hook for info and above, prevent logrus from processing debug logs)
-		if logrus.GetLevel() < level {
-			logrus.SetLevel(level)
+		if hooksLevel < level {
+			hooksLevel = level
 		}
 
 		switch hook.Type {
 		case "file":
 			checkFileHookParams(hook.Params)
-			setupFileHook(hook, level)
+			setupFileHook(i, hook, level)
 		default:
 			logrus.Fatalf("Unrecognised logging hook type: %s", hook.Type)
 		}
 	}
+	updateGlobalLogLevel()
 }
@@ -0,0 +1,75 @@
+package pushrules
+
+// ServerRules are rules configured by the server operator, which are
+// merged into every account's rule set when events are evaluated. They
+// are never stored in the account data of the users.
+type ServerRules struct {
+	// Override rules take precedence over all rules apart from the
+	// master rule, so they can be used to mute events server-wide.
+	Override []*Rule
+	// Content rules are evaluated after the user's own content rules
+	// but before the spec default content rules.
+	Content []*Rule
+	// Underride rules are evaluated after the user's own underride
+	// rules but before the spec default underride rules.
+	Underride []*Rule
+	// DisabledDefaults contains the IDs of spec default rules which
+	// are disabled for all users.
+	DisabledDefaults map[string]struct{}
+}
+
+// Apply returns a copy of the rule set with the server rules merged in.
+// The given rule set is not modified.
+func (s *ServerRules) Apply(rs *RuleSet) *RuleSet {
+	if s == nil {
+		return rs
+	}
+	override := make([]*Rule, 0, len(rs.Override)+len(s.Override))
+	rest := rs.Override
+	if len(rest) > 0 && rest[0].RuleID == MRuleMaster {
+		override = append(override, s.disable(rest[0]))
+		rest = rest[1:]
+	}
+	override = append(override, s.Override...)
+	for _, rule := range rest {
+		override = append(override, s.disable(rule))
+	}
+	return &RuleSet{
+		Override:  override,
+		Content:   s.merge(rs.Content, s.Content),
+		Room:      rs.Room,
+		Sender:    rs.Sender,
+		Underride: s.merge(rs.Underride, s.Underride),
+	}
+}
+
+// merge inserts the server rules ahead of the first default rule.
+func (s *ServerRules) merge(rules, server []*Rule) []*Rule {
+	merged := make([]*Rule, 0, len(rules)+len(server))
+	inserted := false
+	for _, rule := range rules {
+		if rule.Default && !inserted {
+			merged = append(merged, server...)
+			inserted = true
+		}
+		merged = append(merged, s.disable(rule))
+	}
+	if !inserted {
+		merged = append(merged, server...)
+	}
+	return merged
+}
+
+// disable returns a disabled copy of the rule if it is a default rule
+// which has been disabled by the server, or the rule otherwise.
+func (s *ServerRules) disable(rule *Rule) *Rule {
+	if !rule.Default || !rule.Enabled {
+		return rule
+	}
+	if _, ok := s.DisabledDefaults[rule.RuleID]; !ok {
+		return rule
+	}
+	disabled := *rule
+	disabled.Enabled = false
+	return &disabled
+}
@@ -0,0 +1,45 @@
+package pushrules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerRulesApply(t *testing.T) {
+	serverOverride := &Rule{RuleID: "mute_bots", Default: true, Enabled: true, Actions: []*Action{{Kind: DontNotifyAction}}}
+	serverUnderride := &Rule{RuleID: "notify_all", Default: true, Enabled: true, Actions: []*Action{{Kind: NotifyAction}}}
+	userOverride := &Rule{RuleID: "mine", Enabled: true}
+	userUnderride := &Rule{RuleID: "my_underride", Enabled: true}
+
+	rs := DefaultGlobalRuleSet("test", "localhost")
+	rs.Override = append([]*Rule{rs.Override[0], userOverride}, rs.Override[1:]...)
+	rs.Underride = append([]*Rule{userUnderride}, rs.Underride...)
+
+	serverRules := &ServerRules{
+		Override:         []*Rule{serverOverride},
+		Underride:        []*Rule{serverUnderride},
+		DisabledDefaults: map[string]struct{}{MRuleSuppressNotices: {}},
+	}
+	merged := serverRules.Apply(rs)
+
+	assert.Equal(t, MRuleMaster, merged.Override[0].RuleID)
+	assert.Same(t, serverOverride, merged.Override[1])
+	assert.Same(t, userOverride, merged.Override[2])
+	assert.Len(t, merged.Override, len(rs.Override)+1)
+	assert.Same(t, userUnderride, merged.Underride[0])
+	assert.Same(t, serverUnderride, merged.Underride[1])
+	assert.Equal(t, rs.Content, merged.Content)
+
+	for _, rule := range merged.Override {
+		if rule.RuleID == MRuleSuppressNotices {
+			assert.False(t, rule.Enabled)
+		}
+	}
+	// The user's rule set must not be modified.
+	assert.True(t, mRuleSuppressNoticesDefinition.Enabled)
+	assert.Len(t, rs.Override, len(merged.Override)-1)
+
+	var nilRules *ServerRules
+	assert.Same(t, rs, nilRules.Apply(rs))
+}
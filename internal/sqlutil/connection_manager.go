@@ -15,9 +15,11 @@
 package sqlutil
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/setup/process"
@@ -27,6 +29,7 @@ type Connections struct {
 	globalConfig        config.DatabaseOptions
 	processContext      *process.ProcessContext
 	existingConnections sync.Map
+	sandboxObserver     func(ctx context.Context, start time.Time, query string)
 }
 
 type con struct {
@@ -41,20 +44,43 @@ func NewConnectionManager(processCtx *process.ProcessContext, globalConfig confi
 	}
 }
 
+// NewSandboxConnectionManager returns a connection manager for which nothing
+// is ever committed to the database. Each database gets a single connection
+// which runs everything in one transaction, which is rolled back when the
+// connection is closed. The observe function is called after each statement.
+// As any error outside of a transaction aborts the whole thing, this is only
+// really useful for seeing what opening the storage for a component would do.
+func NewSandboxConnectionManager(globalConfig config.DatabaseOptions, observe func(ctx context.Context, start time.Time, query string)) *Connections {
+	return &Connections{
+		globalConfig:    globalConfig,
+		sandboxObserver: observe,
+	}
+}
+
 func (c *Connections) Connection(dbProperties *config.DatabaseOptions) (*sql.DB, Writer, error) {
 	var err error
+	key := string(dbProperties.ConnectionString)
 	// If no connectionString was provided, try the global one
 	if dbProperties.ConnectionString == "" {
-		dbProperties = &c.globalConfig
-		// If we still don't have a connection string, that's a problem
-		if dbProperties.ConnectionString == "" {
+		// If we don't have a global connection string either, that's a problem
+		if c.globalConfig.ConnectionString == "" {
 			return nil, nil, fmt.Errorf("no database connections configured")
 		}
+		key = string(c.globalConfig.ConnectionString)
+		if dbProperties.HasPoolOptions() && c.sandboxObserver == nil {
+			// The component wants its own pool limits, so give it a pool of
+			// its own on the global database instead of sharing one.
+			pooled := c.globalConfig.WithPoolOptions(*dbProperties)
+			dbProperties = &pooled
+			key = dbProperties.Name + ":" + key
+		} else {
+			dbProperties = &c.globalConfig
+		}
 	}
 
 	writer := NewDummyWriter()
 
-	existing, loaded := c.existingConnections.LoadOrStore(dbProperties.ConnectionString, &con{})
+	existing, loaded := c.existingConnections.LoadOrStore(key, &con{})
 	if loaded {
 		// We found an existing connection
 		ex := existing.(*con)
@@ -62,11 +88,20 @@ func (c *Connections) Connection(dbProperties *config.DatabaseOptions) (*sql.DB,
 	}
 
 	// Open a new database connection using the supplied config.
-	db, err := Open(dbProperties, writer)
+	var db *sql.DB
+	if c.sandboxObserver != nil {
+		db, err = openSandbox(dbProperties, c.sandboxObserver)
+	} else {
+		db, err = Open(dbProperties, writer)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
-	c.existingConnections.Store(dbProperties.ConnectionString, &con{db: db, writer: writer})
+	c.existingConnections.Store(key, &con{db: db, writer: writer})
+	registerPoolMetrics(db, dbProperties.Name)
+	if c.processContext != nil {
+		c.processContext.AddReadinessCheck("database:"+dbProperties.Name, db.PingContext)
+	}
 	go func() {
 		if c.processContext == nil {
 			return
@@ -74,7 +109,7 @@ func (c *Connections) Connection(dbProperties *config.DatabaseOptions) (*sql.DB,
 		// If we have a ProcessContext, start a component and wait for
 		// Dendrite to shut down to cleanly close the database connection.
 		c.processContext.ComponentStarted()
-		<-c.processContext.WaitForShutdown()
+		<-c.processContext.WaitForClose()
 		_ = db.Close()
 		c.processContext.ComponentFinished()
 	}()
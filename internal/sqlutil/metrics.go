@@ -0,0 +1,34 @@
+package sqlutil
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(slowQueriesTotal)
+}
+
+var slowQueriesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "database",
+		Name:      "slow_queries_total",
+		Help:      "Total number of statements which took longer than the slow query threshold",
+	},
+	[]string{"database"},
+)
+
+// registerPoolMetrics exports the connection pool statistics for the
+// database, i.e. open, in use and idle connections and time spent waiting
+// for one, labelled with the name of the component using it.
+func registerPoolMetrics(db *sql.DB, name string) {
+	err := prometheus.Register(collectors.NewDBStatsCollector(db, name))
+	if err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		logrus.WithError(err).WithField("database", name).Warn("Failed to register database pool metrics")
+	}
+}
@@ -39,16 +39,122 @@ const insertVersionSQL = "" +
 
 const selectDBMigrationsSQL = "SELECT version FROM db_migrations"
 
+const deleteVersionSQL = "DELETE FROM db_migrations WHERE version = $1"
+
 // Migration defines a migration to be run.
 type Migration struct {
 	// Version is a simple description/name of this migration.
 	Version string
 	// Up defines the function to execute for an upgrade.
 	Up func(ctx context.Context, txn *sql.Tx) error
-	// Down defines the function to execute for a downgrade (not implemented yet).
+	// Down defines the function to execute for a downgrade, which is only
+	// ever run when asked for using RevertMigration.
 	Down func(ctx context.Context, txn *sql.Tx) error
 }
 
+// MigrationStatus describes a migration which a Migrator has seen since
+// the process started.
+type MigrationStatus struct {
+	Version string
+	// Applied is true if the migration had already been applied before
+	// this process saw it.
+	Applied bool
+	// Reversible is true if the migration can be reverted.
+	Reversible bool
+}
+
+type seenMigration struct {
+	MigrationStatus
+	db   *sql.DB
+	down func(ctx context.Context, txn *sql.Tx) error
+}
+
+// seenMigrations remembers every migration that has been through Up, in
+// the order they were seen, so that they can be listed or reverted later.
+var seenMigrations = struct {
+	sync.Mutex
+	order     []*seenMigration
+	byVersion map[string]*seenMigration
+}{byVersion: map[string]*seenMigration{}}
+
+func recordMigration(db *sql.DB, migration Migration, applied bool) {
+	seenMigrations.Lock()
+	defer seenMigrations.Unlock()
+	if seen, ok := seenMigrations.byVersion[migration.Version]; ok {
+		// The storage was opened again, possibly on another connection,
+		// so remember the latest one.
+		seen.Applied, seen.db = applied, db
+		return
+	}
+	seen := &seenMigration{
+		MigrationStatus: MigrationStatus{
+			Version:    migration.Version,
+			Applied:    applied,
+			Reversible: migration.Down != nil,
+		},
+		db:   db,
+		down: migration.Down,
+	}
+	seenMigrations.order = append(seenMigrations.order, seen)
+	seenMigrations.byVersion[migration.Version] = seen
+}
+
+// Migrations returns the status of every migration seen since the process
+// started. As migrations are added when the storage for each component is
+// opened, the storage must have been opened first.
+func Migrations() []MigrationStatus {
+	seenMigrations.Lock()
+	defer seenMigrations.Unlock()
+	statuses := make([]MigrationStatus, 0, len(seenMigrations.order))
+	for _, seen := range seenMigrations.order {
+		statuses = append(statuses, seen.MigrationStatus)
+	}
+	return statuses
+}
+
+// RevertMigration runs the downgrade for an applied migration and removes
+// it from the list of executed migrations. Note that the migration will be
+// applied again the next time the storage is opened.
+func RevertMigration(ctx context.Context, version string) error {
+	seenMigrations.Lock()
+	seen, ok := seenMigrations.byVersion[version]
+	seenMigrations.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown migration '%s'", version)
+	}
+	if seen.down == nil {
+		return fmt.Errorf("migration '%s' cannot be reverted", version)
+	}
+	executedMigrations, err := NewMigrator(seen.db).ExecutedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok = executedMigrations[version]; !ok {
+		return fmt.Errorf("migration '%s' has not been applied", version)
+	}
+	return WithTransaction(seen.db, func(txn *sql.Tx) error {
+		if err := seen.down(withMigration(ctx, version), txn); err != nil {
+			return fmt.Errorf("unable to revert migration '%s': %w", version, err)
+		}
+		_, err := txn.ExecContext(ctx, deleteVersionSQL, version)
+		return err
+	})
+}
+
+type migrationContextKey struct{}
+
+func withMigration(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, migrationContextKey{}, version)
+}
+
+// MigrationFromContext returns the version of the migration that is being
+// run with the context, if there is one. Statements run by the migration
+// can be picked out this way when observing a connection.
+func MigrationFromContext(ctx context.Context) (string, bool) {
+	version, ok := ctx.Value(migrationContextKey{}).(string)
+	return version, ok
+}
+
 // Migrator contains fields required to run migrations.
 type Migrator struct {
 	db              *sql.DB
@@ -88,6 +194,10 @@ func (m *Migrator) Up(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("unable to create/get migrations: %w", err)
 	}
+	for _, migration := range m.migrations {
+		_, applied := executedMigrations[migration.Version]
+		recordMigration(m.db, migration, applied)
+	}
 	// ensure we close the insert statement, as it's not needed anymore
 	defer m.close()
 	return WithTransaction(m.db, func(txn *sql.Tx) error {
@@ -99,7 +209,7 @@ func (m *Migrator) Up(ctx context.Context) error {
 			}
 			logrus.Debugf("Executing database migration '%s'", migration.Version)
 
-			if err = migration.Up(ctx, txn); err != nil {
+			if err = migration.Up(withMigration(ctx, migration.Version), txn); err != nil {
 				return fmt.Errorf("unable to execute migration '%s': %w", migration.Version, err)
 			}
 			if err = m.insertMigration(ctx, txn, migration.Version); err != nil {
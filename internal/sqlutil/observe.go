@@ -0,0 +1,143 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// observingConnector wraps the connections made by a driver so that the
+// observe function is called after every statement. For queries, it is
+// called once the first results are back, not when the caller has finished
+// reading the rows.
+type observingConnector struct {
+	driver.Connector
+	observe func(ctx context.Context, start time.Time, query string)
+}
+
+func (c *observingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &observingConn{Conn: conn, connector: c}, nil
+}
+
+// slowQueryObserver returns an observe function which logs any statement
+// which took longer than the threshold.
+func slowQueryObserver(name string, threshold time.Duration) func(context.Context, time.Time, string) {
+	return func(_ context.Context, start time.Time, query string) {
+		duration := time.Since(start)
+		if duration < threshold {
+			return
+		}
+		slowQueriesTotal.WithLabelValues(name).Inc()
+		logrus.WithFields(logrus.Fields{
+			"database": name,
+			"duration": duration,
+			"query":    strings.Join(strings.Fields(query), " "),
+		}).Warn("Slow database query")
+	}
+}
+
+type observingConn struct {
+	driver.Conn
+	connector *observingConnector
+}
+
+func (c *observingConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *observingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &observingStmt{Stmt: stmt, query: query, connector: c.connector}, nil
+}
+
+func (c *observingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer c.connector.observe(ctx, time.Now(), query)
+	return q.QueryContext(ctx, query, args)
+}
+
+func (c *observingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer c.connector.observe(ctx, time.Now(), query)
+	return e.ExecContext(ctx, query, args)
+}
+
+func (c *observingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin() // nolint:staticcheck
+}
+
+func (c *observingConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *observingConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *observingConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+type observingStmt struct {
+	driver.Stmt
+	query     string
+	connector *observingConnector
+}
+
+func (s *observingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	defer s.connector.observe(ctx, time.Now(), s.query)
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(namedValuesToValues(args)) // nolint:staticcheck
+}
+
+func (s *observingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	defer s.connector.observe(ctx, time.Now(), s.query)
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return q.QueryContext(ctx, args)
+	}
+	return s.Stmt.Query(namedValuesToValues(args)) // nolint:staticcheck
+}
+
+func namedValuesToValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
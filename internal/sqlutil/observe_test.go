@@ -0,0 +1,44 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type dsnConnector struct {
+	dsn string
+	drv driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) { return c.drv.Open(c.dsn) }
+func (c dsnConnector) Driver() driver.Driver                        { return c.drv }
+
+func TestSlowQueryConnector(t *testing.T) {
+	mockDB, mock, err := sqlmock.NewWithDSN("slow_query_test")
+	assertNoError(t, err, "Failed to make DB")
+	defer mockDB.Close() // nolint: errcheck
+
+	db := sql.OpenDB(&observingConnector{
+		Connector: dsnConnector{dsn: "slow_query_test", drv: mockDB.Driver()},
+		observe:   slowQueryObserver("test", 20*time.Millisecond),
+	})
+	defer db.Close() // nolint: errcheck
+
+	mock.ExpectExec("UPDATE fast").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE slow").WillDelayFor(50 * time.Millisecond).WillReturnResult(sqlmock.NewResult(0, 1))
+	_, err = db.Exec("UPDATE fast")
+	assertNoError(t, err, "Failed to exec fast statement")
+	_, err = db.Exec("UPDATE slow")
+	assertNoError(t, err, "Failed to exec slow statement")
+
+	if got := testutil.ToFloat64(slowQueriesTotal.WithLabelValues("test")); got != 1 {
+		t.Fatalf("got %v slow queries, want 1", got)
+	}
+	assertNoError(t, mock.ExpectationsWereMet(), "Unmet expectations")
+}
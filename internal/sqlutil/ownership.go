@@ -0,0 +1,87 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neilalexander/harmony/internal"
+)
+
+// The schema owners table records which components keep their tables in
+// the database. When the components are split across several databases,
+// this makes it possible to tell when a component has been pointed at a
+// new database without its data having been moved there.
+const createSchemaOwnersSQL = "" +
+	"CREATE TABLE IF NOT EXISTS db_schema_owners (" +
+	" component TEXT PRIMARY KEY NOT NULL," +
+	" time TEXT NOT NULL," +
+	" dendrite_version TEXT NOT NULL" +
+	");"
+
+const selectSchemaOwnersSQL = "SELECT component FROM db_schema_owners"
+
+const insertSchemaOwnerSQL = "" +
+	"INSERT INTO db_schema_owners (component, time, dendrite_version) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (component) DO NOTHING"
+
+const deleteSchemaOwnerSQL = "DELETE FROM db_schema_owners WHERE component = $1"
+
+const selectTableWithPrefixSQL = "" +
+	"SELECT EXISTS (SELECT 1 FROM information_schema.tables" +
+	" WHERE table_schema = current_schema() AND table_name LIKE ANY($1))"
+
+// SchemaOwners returns the components which own schemas in the database.
+func SchemaOwners(ctx context.Context, db *sql.DB) (map[string]struct{}, error) {
+	if _, err := db.ExecContext(ctx, createSchemaOwnersSQL); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, selectSchemaOwnersSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SchemaOwners: rows.close() failed")
+	owners := map[string]struct{}{}
+	var component string
+	for rows.Next() {
+		if err = rows.Scan(&component); err != nil {
+			return nil, err
+		}
+		owners[component] = struct{}{}
+	}
+	return owners, rows.Err()
+}
+
+// ClaimSchema records that the component owns a schema in the database.
+func ClaimSchema(ctx context.Context, db *sql.DB, component string) error {
+	if _, err := db.ExecContext(ctx, createSchemaOwnersSQL); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, insertSchemaOwnerSQL, component, time.Now().Format(time.RFC3339), internal.VersionString())
+	return err
+}
+
+// ReleaseSchema records that the component no longer owns a schema in the
+// database. Its tables are left alone.
+func ReleaseSchema(ctx context.Context, db *sql.DB, component string) error {
+	if _, err := db.ExecContext(ctx, createSchemaOwnersSQL); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, deleteSchemaOwnerSQL, component)
+	return err
+}
+
+// HasTablesWithPrefix returns whether the database has any tables with
+// names starting with one of the prefixes.
+func HasTablesWithPrefix(ctx context.Context, db *sql.DB, prefixes []string) (bool, error) {
+	patterns := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		patterns[i] = strings.ReplaceAll(prefix, "_", `\_`) + "%"
+	}
+	var exists bool
+	err := db.QueryRowContext(ctx, selectTableWithPrefixSQL, pq.StringArray(patterns)).Scan(&exists)
+	return exists, err
+}
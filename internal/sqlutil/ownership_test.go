@@ -0,0 +1,51 @@
+package sqlutil_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaOwnership(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		conStr, close := test.PrepareDBConnectionString(t, dbType)
+		defer close()
+		db, err := sql.Open("postgres", conStr)
+		assert.NoError(t, err)
+		defer db.Close() // nolint: errcheck
+
+		owners, err := sqlutil.SchemaOwners(ctx, db)
+		assert.NoError(t, err)
+		assert.Empty(t, owners)
+
+		// Claiming is idempotent.
+		assert.NoError(t, sqlutil.ClaimSchema(ctx, db, "syncapi"))
+		assert.NoError(t, sqlutil.ClaimSchema(ctx, db, "syncapi"))
+		assert.NoError(t, sqlutil.ClaimSchema(ctx, db, "roomserver"))
+		owners, err = sqlutil.SchemaOwners(ctx, db)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]struct{}{"syncapi": {}, "roomserver": {}}, owners)
+
+		assert.NoError(t, sqlutil.ReleaseSchema(ctx, db, "syncapi"))
+		owners, err = sqlutil.SchemaOwners(ctx, db)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]struct{}{"roomserver": {}}, owners)
+
+		// The underscore in the prefix mustn't match any character.
+		_, err = db.ExecContext(ctx, "CREATE TABLE syncapixfoo (id BIGINT)")
+		assert.NoError(t, err)
+		has, err := sqlutil.HasTablesWithPrefix(ctx, db, []string{"syncapi_"})
+		assert.NoError(t, err)
+		assert.False(t, has)
+		_, err = db.ExecContext(ctx, "CREATE TABLE syncapi_foo (id BIGINT)")
+		assert.NoError(t, err)
+		has, err = sqlutil.HasTablesWithPrefix(ctx, db, []string{"roomserver_", "syncapi_"})
+		assert.NoError(t, err)
+		assert.True(t, has)
+	})
+}
@@ -0,0 +1,134 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// openSandbox opens the database with a single sandboxed connection.
+func openSandbox(dbProperties *config.DatabaseOptions, observe func(context.Context, time.Time, string)) (*sql.DB, error) {
+	if !dbProperties.ConnectionString.IsPostgres() {
+		return nil, fmt.Errorf("invalid database connection string %q", dbProperties.ConnectionString)
+	}
+	connector, err := pq.NewConnector(string(dbProperties.ConnectionString))
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(&observingConnector{
+		Connector: &sandboxConnector{Connector: connector},
+		observe:   observe,
+	})
+	// The connection must never be closed and replaced while in use.
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+	return db, nil
+}
+
+// sandboxConnector makes a single connection which runs everything inside
+// one transaction that is never committed. Transactions started by callers
+// become savepoints within it, so they can still be committed or rolled
+// back as normal without anything reaching the database. It's used to find
+// out what opening the storage would do without changing anything.
+type sandboxConnector struct {
+	driver.Connector
+	mu        sync.Mutex
+	connected bool
+}
+
+func (c *sandboxConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// If the connection was ever closed, its transaction was rolled back.
+	// Carrying on with a new connection would mean running statements for
+	// real, with none of the earlier changes in place.
+	if c.connected {
+		return nil, fmt.Errorf("sandbox connection was closed")
+	}
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sc := &sandboxConn{Conn: conn}
+	if err = sc.exec(ctx, "BEGIN"); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	c.connected = true
+	return sc, nil
+}
+
+type sandboxConn struct {
+	driver.Conn
+	savepoints int
+}
+
+func (c *sandboxConn) exec(ctx context.Context, query string) error {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return fmt.Errorf("driver doesn't support ExecerContext")
+	}
+	_, err := e.ExecContext(ctx, query, nil)
+	return err
+}
+
+func (c *sandboxConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *sandboxConn) BeginTx(ctx context.Context, _ driver.TxOptions) (driver.Tx, error) {
+	c.savepoints++
+	tx := &sandboxTx{conn: c, name: fmt.Sprintf("sandbox_%d", c.savepoints)}
+	if err := c.exec(ctx, "SAVEPOINT "+tx.name); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (c *sandboxConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *sandboxConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *sandboxConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *sandboxConn) Close() error {
+	_ = c.exec(context.Background(), "ROLLBACK")
+	return c.Conn.Close()
+}
+
+type sandboxTx struct {
+	conn *sandboxConn
+	name string
+}
+
+func (t *sandboxTx) Commit() error {
+	return t.conn.exec(context.Background(), "RELEASE SAVEPOINT "+t.name)
+}
+
+func (t *sandboxTx) Rollback() error {
+	return t.conn.exec(context.Background(), "ROLLBACK TO SAVEPOINT "+t.name)
+}
@@ -0,0 +1,46 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSandboxConnector(t *testing.T) {
+	mockDB, mock, err := sqlmock.NewWithDSN("sandbox_test", sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	assertNoError(t, err, "Failed to make DB")
+	defer mockDB.Close() // nolint: errcheck
+
+	var migrationQueries []string
+	db := sql.OpenDB(&observingConnector{
+		Connector: &sandboxConnector{Connector: dsnConnector{dsn: "sandbox_test", drv: mockDB.Driver()}},
+		observe: func(ctx context.Context, _ time.Time, query string) {
+			if version, ok := MigrationFromContext(ctx); ok && version == "v1" {
+				migrationQueries = append(migrationQueries, query)
+			}
+		},
+	})
+	db.SetMaxOpenConns(1)
+
+	mock.ExpectExec("BEGIN").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SAVEPOINT sandbox_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE dummy ADD COLUMN test TEXT").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("RELEASE SAVEPOINT sandbox_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectClose()
+
+	err = WithTransaction(db, func(txn *sql.Tx) error {
+		_, err := txn.ExecContext(withMigration(context.Background(), "v1"), "ALTER TABLE dummy ADD COLUMN test TEXT")
+		return err
+	})
+	assertNoError(t, err, "Failed to run transaction")
+	assertNoError(t, db.Close(), "Failed to close DB")
+	assertNoError(t, mock.ExpectationsWereMet(), "Unmet expectations")
+
+	if len(migrationQueries) != 1 || migrationQueries[0] != "ALTER TABLE dummy ADD COLUMN test TEXT" {
+		t.Fatalf("unexpected migration queries: %v", migrationQueries)
+	}
+}
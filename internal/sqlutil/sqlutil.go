@@ -2,10 +2,12 @@ package sqlutil
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"flag"
 	"fmt"
 	"regexp"
 
+	"github.com/lib/pq"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/sirupsen/logrus"
 )
@@ -24,15 +26,26 @@ func Open(dbProperties *config.DatabaseOptions, writer Writer) (*sql.DB, error)
 	default:
 		return nil, fmt.Errorf("invalid database connection string %q", dbProperties.ConnectionString)
 	}
-	db, err := sql.Open(driverName, dsn)
-	if err != nil {
+	var db *sql.DB
+	if dbProperties.SlowQueryThreshold > 0 {
+		var connector driver.Connector
+		if connector, err = pq.NewConnector(dsn); err != nil {
+			return nil, err
+		}
+		db = sql.OpenDB(&observingConnector{
+			Connector: connector,
+			observe:   slowQueryObserver(dbProperties.Name, dbProperties.SlowQueryThreshold),
+		})
+	} else if db, err = sql.Open(driverName, dsn); err != nil {
 		return nil, err
 	}
 	logger := logrus.WithFields(logrus.Fields{
-		"max_open_conns":    dbProperties.MaxOpenConns(),
-		"max_idle_conns":    dbProperties.MaxIdleConns(),
-		"conn_max_lifetime": dbProperties.ConnMaxLifetime(),
-		"data_source_name":  regexp.MustCompile(`://[^@]*@`).ReplaceAllLiteralString(dsn, "://"),
+		"database":             dbProperties.Name,
+		"max_open_conns":       dbProperties.MaxOpenConns(),
+		"max_idle_conns":       dbProperties.MaxIdleConns(),
+		"conn_max_lifetime":    dbProperties.ConnMaxLifetime(),
+		"slow_query_threshold": dbProperties.SlowQueryThreshold,
+		"data_source_name":     regexp.MustCompile(`://[^@]*@`).ReplaceAllLiteralString(dsn, "://"),
 	})
 	logger.Debug("Setting DB connection limits")
 	db.SetMaxOpenConns(dbProperties.MaxOpenConns())
@@ -0,0 +1,199 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing wraps OpenTelemetry so that trace context can follow a
+// request from the HTTP handler that received it, through the internal APIs
+// and across NATS messages to the components that consume them.
+//
+// Until Setup is called, or if tracing is disabled in the config, all of the
+// functions in this package use the OpenTelemetry no-op implementations and
+// are cheap to call.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/neilalexander/harmony/internal/util"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+const tracerName = "github.com/neilalexander/harmony"
+
+// Setup configures the global tracer provider to export spans to the OTLP
+// collector given in the config. The returned function flushes any pending
+// spans and must be called before the process exits.
+func Setup(ctx context.Context, cfg *config.Tracing, version string) (func(context.Context) error, error) {
+	if !cfg.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(cfg.OTLPEndpoint),
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("otlptracehttp.New: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("resource.Merge: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	return provider.Shutdown, nil
+}
+
+// StartSpan starts a new internal span as a child of any span in the context.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan records the error, if any, against the span and then ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// statusRecorder remembers the status code written to a response so that
+// it can be attached to the span once the handler has finished.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush is needed so that wrapping doesn't break handlers which stream
+// their responses.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// HTTPHandler wraps the handler in a server span with the given name.
+// Requests come from clients and other servers, which could use their trace
+// context to force every request to be sampled, so the span always starts a
+// new trace, sampled at our own ratio. If the request has a trace context,
+// it is linked to the span instead.
+func HTTPHandler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		opts := []trace.SpanStartOption{
+			trace.WithNewRoot(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(req.Method),
+				semconv.URLPath(req.URL.Path),
+			),
+		}
+		remote := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(req.Header))
+		if sc := trace.SpanContextFromContext(remote); sc.IsValid() {
+			opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+		}
+		ctx, span := otel.Tracer(tracerName).Start(req.Context(), name, opts...)
+		defer span.End()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, req.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// InjectNATS adds the trace context, and the ID of the request that the
+// message is being sent for, to the headers of a NATS message before it is
+// published.
+func InjectNATS(ctx context.Context, msg *nats.Msg) {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(msg.Header))
+	if reqID := util.GetRequestID(ctx); reqID != "" {
+		msg.Header.Set(util.RequestIDHeader, reqID)
+	}
+}
+
+// ExtractNATS returns a context carrying the trace context and request ID
+// from the headers of a NATS message, if there are any. If there is a request
+// ID, the context also gets a logger which includes it.
+func ExtractNATS(ctx context.Context, msg *nats.Msg) context.Context {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(msg.Header))
+	if reqID := msg.Header.Get(util.RequestIDHeader); reqID != "" {
+		ctx = util.ContextWithRequestID(ctx, reqID)
+		ctx = util.ContextWithLogger(ctx, logrus.WithField("req.id", reqID))
+	}
+	return ctx
+}
+
+// StartConsumerSpan starts a consumer span for processing a batch of NATS
+// messages. A single message continues the trace that published it. As a
+// batch may span several traces, each of them is linked to the span instead.
+func StartConsumerSpan(ctx context.Context, name string, msgs []*nats.Msg) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("nats"),
+			semconv.MessagingOperationReceive,
+			semconv.MessagingBatchMessageCount(len(msgs)),
+		),
+	}
+	switch len(msgs) {
+	case 0:
+	case 1:
+		ctx = ExtractNATS(ctx, msgs[0])
+		opts = append(opts, trace.WithAttributes(semconv.MessagingDestinationName(msgs[0].Subject)))
+	default:
+		for _, msg := range msgs {
+			sc := trace.SpanContextFromContext(ExtractNATS(context.Background(), msg))
+			if sc.IsValid() {
+				opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+			}
+		}
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
@@ -0,0 +1,145 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/neilalexander/harmony/internal/util"
+)
+
+func setupTestProvider(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		_ = provider.Shutdown(context.Background())
+	})
+	return recorder
+}
+
+func TestNATSPropagation(t *testing.T) {
+	setupTestProvider(t)
+
+	ctx, span := StartSpan(context.Background(), "producer")
+	msg := nats.NewMsg("test")
+	InjectNATS(ctx, msg)
+	span.End()
+
+	_, consumer := StartConsumerSpan(context.Background(), "consumer", []*nats.Msg{msg})
+	defer consumer.End()
+	if got, want := consumer.SpanContext().TraceID(), span.SpanContext().TraceID(); got != want {
+		t.Fatalf("consumer span has trace ID %s, want %s", got, want)
+	}
+}
+
+func TestNATSRequestIDPropagation(t *testing.T) {
+	setupTestProvider(t)
+
+	msg := nats.NewMsg("test")
+	InjectNATS(util.ContextWithRequestID(context.Background(), "abc123"), msg)
+
+	ctx := ExtractNATS(context.Background(), msg)
+	if got := util.GetRequestID(ctx); got != "abc123" {
+		t.Fatalf("got request ID %q, want %q", got, "abc123")
+	}
+	if got := util.GetLogger(ctx).Data["req.id"]; got != "abc123" {
+		t.Fatalf("got logger request ID %v, want %q", got, "abc123")
+	}
+}
+
+func TestConsumerSpanLinksBatch(t *testing.T) {
+	recorder := setupTestProvider(t)
+
+	var msgs []*nats.Msg
+	var traceIDs []trace.TraceID
+	for i := 0; i < 2; i++ {
+		ctx, span := StartSpan(context.Background(), "producer")
+		msg := nats.NewMsg("test")
+		InjectNATS(ctx, msg)
+		span.End()
+		msgs = append(msgs, msg)
+		traceIDs = append(traceIDs, span.SpanContext().TraceID())
+	}
+
+	_, consumer := StartConsumerSpan(context.Background(), "consumer", msgs)
+	consumer.End()
+	ended := recorder.Ended()
+	links := ended[len(ended)-1].Links()
+	if len(links) != len(traceIDs) {
+		t.Fatalf("got %d links, want %d", len(links), len(traceIDs))
+	}
+	for i, link := range links {
+		if link.SpanContext.TraceID() != traceIDs[i] {
+			t.Fatalf("link %d has trace ID %s, want %s", i, link.SpanContext.TraceID(), traceIDs[i])
+		}
+	}
+}
+
+func TestHTTPHandlerLinksTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(recorder),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.NeverSample())),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		_ = provider.Shutdown(context.Background())
+	})
+
+	// The request claims to be part of a sampled trace, but that mustn't
+	// decide whether the handler's span is sampled.
+	remote := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	otel.GetTextMapPropagator().Inject(
+		trace.ContextWithRemoteSpanContext(context.Background(), remote),
+		propagation.HeaderCarrier(req.Header),
+	)
+
+	var got trace.SpanContext
+	h := HTTPHandler("test", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = trace.SpanContextFromContext(req.Context())
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got.TraceID() == remote.TraceID() {
+		t.Fatalf("handler continued the trace from the request")
+	}
+	if got.IsSampled() {
+		t.Fatalf("handler span was sampled because the request was")
+	}
+	if len(recorder.Ended()) != 0 {
+		t.Fatalf("got %d recorded spans, want none", len(recorder.Ended()))
+	}
+
+	// When the span is sampled, it links to the trace from the request.
+	sampled := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(sampled)
+	t.Cleanup(func() {
+		_ = sampled.Shutdown(context.Background())
+	})
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("got %d recorded spans, want 1", len(ended))
+	}
+	links := ended[0].Links()
+	if len(links) != 1 || links[0].SpanContext.TraceID() != remote.TraceID() {
+		t.Fatalf("got links %+v, want a link to trace %s", links, remote.TraceID())
+	}
+}
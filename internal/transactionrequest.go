@@ -20,8 +20,10 @@ import (
 	"fmt"
 	"sync"
 
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/federationapi/producers"
 	"github.com/neilalexander/harmony/federationapi/types"
+	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -57,9 +59,12 @@ var (
 type TxnReq struct {
 	gomatrixserverlib.Transaction
 	rsAPI                  api.FederationRoomserverAPI
+	fsAPI                  federationAPI.ClientFederationAPI
 	userAPI                userAPI.FederationUserAPI
 	ourServerName          spec.ServerName
 	keys                   gomatrixserverlib.JSONVerifier
+	verifiedEvents         caching.VerifiedEventCache
+	verifyWorkers          int
 	roomsMu                *MutexByRoom
 	producer               *producers.SyncAPIProducer
 	inboundPresenceEnabled bool
@@ -67,9 +72,12 @@ type TxnReq struct {
 
 func NewTxnReq(
 	rsAPI api.FederationRoomserverAPI,
+	fsAPI federationAPI.ClientFederationAPI,
 	userAPI userAPI.FederationUserAPI,
 	ourServerName spec.ServerName,
 	keys gomatrixserverlib.JSONVerifier,
+	verifiedEvents caching.VerifiedEventCache,
+	verifyWorkers int,
 	roomsMu *MutexByRoom,
 	producer *producers.SyncAPIProducer,
 	inboundPresenceEnabled bool,
@@ -81,9 +89,12 @@ func NewTxnReq(
 ) TxnReq {
 	t := TxnReq{
 		rsAPI:                  rsAPI,
+		fsAPI:                  fsAPI,
 		userAPI:                userAPI,
 		ourServerName:          ourServerName,
 		keys:                   keys,
+		verifiedEvents:         verifiedEvents,
+		verifyWorkers:          verifyWorkers,
 		roomsMu:                roomsMu,
 		producer:               producer,
 		inboundPresenceEnabled: inboundPresenceEnabled,
@@ -123,6 +134,10 @@ func (t *TxnReq) ProcessTransaction(ctx context.Context) (*fclient.RespSend, *ut
 		return roomVersion
 	}
 
+	// Parse and pre-check all of the events first, so that their signatures
+	// can be verified in parallel before they are sent to the roomserver in
+	// the order that they appeared in the transaction.
+	events := make([]gomatrixserverlib.PDU, 0, len(t.PDUs))
 	for _, pdu := range t.PDUs {
 		PDUCountTotal.WithLabelValues("total").Inc()
 		var header struct {
@@ -166,20 +181,36 @@ func (t *TxnReq) ProcessTransaction(ctx context.Context) (*fclient.RespSend, *ut
 			}
 			continue
 		}
-		if err = gomatrixserverlib.VerifyEventSignatures(ctx, event, t.keys, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
-			return t.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
-		}); err != nil {
+		if t.isRoomFederationDisabled(ctx, event.RoomID().String()) {
+			results[event.EventID()] = fclient.PDUResult{
+				Error: "Federation is disabled for this room",
+			}
+			continue
+		}
+		events = append(events, event)
+	}
+
+	verifyErrs := t.verifyEventSignatures(ctx, events)
+	for i, event := range events {
+		if err := verifyErrs[i]; err != nil {
 			util.GetLogger(ctx).WithError(err).Debugf("Transaction: Couldn't validate signature of event %q", event.EventID())
 			results[event.EventID()] = fclient.PDUResult{
 				Error: err.Error(),
 			}
 			continue
 		}
+		if err := t.recordMembership(ctx, event); err != nil {
+			util.GetLogger(ctx).WithError(err).Debugf("Transaction: Rejected membership event %q", event.EventID())
+			results[event.EventID()] = fclient.PDUResult{
+				Error: err.Error(),
+			}
+			continue
+		}
 
 		// pass the event to the roomserver which will do auth checks
 		// If the event fail auth checks, gmsl.NotAllowed error will be returned which we be silently
 		// discarded by the caller of this function
-		if err = api.SendEvents(
+		if err := api.SendEvents(
 			ctx,
 			t.rsAPI,
 			api.KindNew,
@@ -207,6 +238,73 @@ func (t *TxnReq) ProcessTransaction(ctx context.Context) (*fclient.RespSend, *ut
 	return &fclient.RespSend{PDUs: results}, nil
 }
 
+// recordMembership counts a user on another server joining or leaving a room
+// against the join flood limits, returning an error if the event should be
+// rejected.
+func (t *TxnReq) recordMembership(ctx context.Context, event gomatrixserverlib.PDU) error {
+	if t.fsAPI == nil || event.Type() != spec.MRoomMember || !event.StateKeyEquals(string(event.SenderID())) {
+		return nil
+	}
+	membership, err := event.Membership()
+	if err != nil || (membership != spec.Join && membership != spec.Leave) {
+		return nil
+	}
+	userID, err := t.rsAPI.QueryUserIDForSender(ctx, event.RoomID(), event.SenderID())
+	if err != nil || userID == nil || userID.Domain() == t.ourServerName {
+		// Leave it to the roomserver to reject the event if it isn't valid.
+		return nil
+	}
+	return t.fsAPI.RecordInboundMembership(ctx, event.RoomID(), *userID, membership)
+}
+
+// verifyEventSignatures checks the signatures of the events using a pool of
+// workers, returning an error for each event whose signatures aren't valid.
+func (t *TxnReq) verifyEventSignatures(ctx context.Context, events []gomatrixserverlib.PDU) []error {
+	errs := make([]error, len(events))
+	workers := min(max(t.verifyWorkers, 1), len(events))
+	indices := make(chan int, len(events))
+	for i := range events {
+		indices <- i
+	}
+	close(indices)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs[i] = t.verifyEventSignature(ctx, events[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func (t *TxnReq) verifyEventSignature(ctx context.Context, event gomatrixserverlib.PDU) error {
+	// From room version 3, the event ID is the hash of the redacted event,
+	// which is exactly what the signatures cover, so an event ID that has
+	// been verified before can't refer to different signed content. Older
+	// event IDs are chosen by the sender, so those are always verified.
+	cacheable := t.verifiedEvents != nil
+	if verImpl, err := gomatrixserverlib.GetRoomVersion(event.Version()); err != nil || verImpl.EventIDFormat() == gomatrixserverlib.EventIDFormatV1 {
+		cacheable = false
+	}
+	if cacheable && t.verifiedEvents.IsEventVerified(t.Origin, event.EventID()) {
+		return nil
+	}
+	if err := gomatrixserverlib.VerifyEventSignatures(ctx, event, t.keys, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		return t.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+	}); err != nil {
+		return err
+	}
+	if cacheable {
+		t.verifiedEvents.StoreVerifiedEvent(t.Origin, event.EventID())
+	}
+	return nil
+}
+
 // nolint:gocyclo
 func (t *TxnReq) processEDUs(ctx context.Context) {
 	for _, e := range t.EDUs {
@@ -230,6 +328,9 @@ func (t *TxnReq) processEDUs(ctx context.Context) {
 			} else if serverName != t.Origin {
 				continue
 			}
+			if t.isRoomFederationDisabled(ctx, typingPayload.RoomID) {
+				continue
+			}
 			if err := t.producer.SendTyping(ctx, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, 30*1000); err != nil {
 				util.GetLogger(ctx).WithError(err).Error("Failed to send typing event to JetStream")
 			}
@@ -273,6 +374,9 @@ func (t *TxnReq) processEDUs(ctx context.Context) {
 			}
 
 			for roomID, receipt := range payload {
+				if t.isRoomFederationDisabled(ctx, roomID) {
+					continue
+				}
 				for userID, mread := range receipt.User {
 					_, domain, err := gomatrixserverlib.SplitID('@', userID)
 					if err != nil {
@@ -310,6 +414,15 @@ func (t *TxnReq) processEDUs(ctx context.Context) {
 	}
 }
 
+// isRoomFederationDisabled returns whether federation is disabled for the
+// room, in which case PDUs and EDUs for it should be dropped.
+func (t *TxnReq) isRoomFederationDisabled(ctx context.Context, roomID string) bool {
+	if t.fsAPI == nil {
+		return false
+	}
+	return federationAPI.IsRoomFederationDisabled(ctx, t.fsAPI, roomID)
+}
+
 // processPresence handles m.receipt events
 func (t *TxnReq) processPresence(ctx context.Context, e gomatrixserverlib.EDU) error {
 	payload := types.Presence{}
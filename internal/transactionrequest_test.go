@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -105,7 +106,7 @@ func (r *FakeRsAPI) InputRoomEvents(
 }
 
 func TestEmptyTransactionRequest(t *testing.T) {
-	txn := NewTxnReq(&FakeRsAPI{}, nil, "ourserver", nil, nil, nil, false, []json.RawMessage{}, []gomatrixserverlib.EDU{}, "", "", "")
+	txn := NewTxnReq(&FakeRsAPI{}, nil, nil, "ourserver", nil, nil, 1, nil, nil, false, []json.RawMessage{}, []gomatrixserverlib.EDU{}, "", "", "")
 	txnRes, jsonRes := txn.ProcessTransaction(context.Background())
 
 	assert.Nil(t, jsonRes)
@@ -114,7 +115,7 @@ func TestEmptyTransactionRequest(t *testing.T) {
 
 func TestProcessTransactionRequestPDU(t *testing.T) {
 	keyRing := &test.NopJSONVerifier{}
-	txn := NewTxnReq(&FakeRsAPI{}, nil, "ourserver", keyRing, nil, nil, false, []json.RawMessage{testEvent}, []gomatrixserverlib.EDU{}, "", "", "")
+	txn := NewTxnReq(&FakeRsAPI{}, nil, nil, "ourserver", keyRing, nil, 1, nil, nil, false, []json.RawMessage{testEvent}, []gomatrixserverlib.EDU{}, "", "", "")
 	txnRes, jsonRes := txn.ProcessTransaction(context.Background())
 
 	assert.Nil(t, jsonRes)
@@ -126,7 +127,7 @@ func TestProcessTransactionRequestPDU(t *testing.T) {
 
 func TestProcessTransactionRequestPDUs(t *testing.T) {
 	keyRing := &test.NopJSONVerifier{}
-	txn := NewTxnReq(&FakeRsAPI{}, nil, "ourserver", keyRing, nil, nil, false, append(testData, testEvent), []gomatrixserverlib.EDU{}, "", "", "")
+	txn := NewTxnReq(&FakeRsAPI{}, nil, nil, "ourserver", keyRing, nil, 1, nil, nil, false, append(testData, testEvent), []gomatrixserverlib.EDU{}, "", "", "")
 	txnRes, jsonRes := txn.ProcessTransaction(context.Background())
 
 	assert.Nil(t, jsonRes)
@@ -140,7 +141,7 @@ func TestProcessTransactionRequestBadPDU(t *testing.T) {
 	pdu := json.RawMessage("{\"room_id\":\"asdf\"}")
 	pdu2 := json.RawMessage("\"roomid\":\"asdf\"")
 	keyRing := &test.NopJSONVerifier{}
-	txn := NewTxnReq(&FakeRsAPI{}, nil, "ourserver", keyRing, nil, nil, false, []json.RawMessage{pdu, pdu2, testEvent}, []gomatrixserverlib.EDU{}, "", "", "")
+	txn := NewTxnReq(&FakeRsAPI{}, nil, nil, "ourserver", keyRing, nil, 1, nil, nil, false, []json.RawMessage{pdu, pdu2, testEvent}, []gomatrixserverlib.EDU{}, "", "", "")
 	txnRes, jsonRes := txn.ProcessTransaction(context.Background())
 
 	assert.Nil(t, jsonRes)
@@ -152,7 +153,7 @@ func TestProcessTransactionRequestBadPDU(t *testing.T) {
 
 func TestProcessTransactionRequestPDUQueryFailure(t *testing.T) {
 	keyRing := &test.NopJSONVerifier{}
-	txn := NewTxnReq(&FakeRsAPI{shouldFailQuery: true}, nil, "ourserver", keyRing, nil, nil, false, []json.RawMessage{testEvent}, []gomatrixserverlib.EDU{}, "", "", "")
+	txn := NewTxnReq(&FakeRsAPI{shouldFailQuery: true}, nil, nil, "ourserver", keyRing, nil, 1, nil, nil, false, []json.RawMessage{testEvent}, []gomatrixserverlib.EDU{}, "", "", "")
 	txnRes, jsonRes := txn.ProcessTransaction(context.Background())
 
 	assert.Nil(t, jsonRes)
@@ -161,7 +162,7 @@ func TestProcessTransactionRequestPDUQueryFailure(t *testing.T) {
 
 func TestProcessTransactionRequestPDUBannedFromRoom(t *testing.T) {
 	keyRing := &test.NopJSONVerifier{}
-	txn := NewTxnReq(&FakeRsAPI{bannedFromRoom: true}, nil, "ourserver", keyRing, nil, nil, false, []json.RawMessage{testEvent}, []gomatrixserverlib.EDU{}, "", "", "")
+	txn := NewTxnReq(&FakeRsAPI{bannedFromRoom: true}, nil, nil, "ourserver", keyRing, nil, 1, nil, nil, false, []json.RawMessage{testEvent}, []gomatrixserverlib.EDU{}, "", "", "")
 	txnRes, jsonRes := txn.ProcessTransaction(context.Background())
 
 	assert.Nil(t, jsonRes)
@@ -173,7 +174,7 @@ func TestProcessTransactionRequestPDUBannedFromRoom(t *testing.T) {
 
 func TestProcessTransactionRequestPDUInvalidSignature(t *testing.T) {
 	keyRing := &test.NopJSONVerifier{}
-	txn := NewTxnReq(&FakeRsAPI{}, nil, "ourserver", keyRing, nil, nil, false, []json.RawMessage{invalidSignatures}, []gomatrixserverlib.EDU{}, "", "", "")
+	txn := NewTxnReq(&FakeRsAPI{}, nil, nil, "ourserver", keyRing, nil, 1, nil, nil, false, []json.RawMessage{invalidSignatures}, []gomatrixserverlib.EDU{}, "", "", "")
 	txnRes, jsonRes := txn.ProcessTransaction(context.Background())
 
 	assert.Nil(t, jsonRes)
@@ -183,6 +184,49 @@ func TestProcessTransactionRequestPDUInvalidSignature(t *testing.T) {
 	}
 }
 
+type countingJSONVerifier struct {
+	test.NopJSONVerifier
+	calls atomic.Int32
+}
+
+func (v *countingJSONVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	v.calls.Add(1)
+	return v.NopJSONVerifier.VerifyJSONs(ctx, requests)
+}
+
+type fakeVerifiedEventCache struct {
+	sync.Mutex
+	verified map[string]bool
+}
+
+func (c *fakeVerifiedEventCache) IsEventVerified(origin spec.ServerName, eventID string) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.verified[string(origin)+eventID]
+}
+
+func (c *fakeVerifiedEventCache) StoreVerifiedEvent(origin spec.ServerName, eventID string) {
+	c.Lock()
+	defer c.Unlock()
+	c.verified[string(origin)+eventID] = true
+}
+
+func TestProcessTransactionRequestPDUVerifiedCache(t *testing.T) {
+	keyRing := &countingJSONVerifier{}
+	cache := &fakeVerifiedEventCache{verified: map[string]bool{}}
+	for _, origin := range []spec.ServerName{"origin", "origin", "other"} {
+		txn := NewTxnReq(&FakeRsAPI{}, nil, nil, "ourserver", keyRing, cache, 4, nil, nil, false, []json.RawMessage{testEvent}, []gomatrixserverlib.EDU{}, origin, "", "")
+		txnRes, jsonRes := txn.ProcessTransaction(context.Background())
+		assert.Nil(t, jsonRes)
+		assert.Equal(t, 1, len(txnRes.PDUs))
+		for _, result := range txnRes.PDUs {
+			assert.Empty(t, result.Error)
+		}
+	}
+	// The event is only verified once for each origin.
+	assert.Equal(t, int32(2), keyRing.calls.Load())
+}
+
 func createTransactionWithEDU(ctx *process.ProcessContext, edus []gomatrixserverlib.EDU) (TxnReq, nats.JetStreamContext, *config.Dendrite) {
 	cfg := &config.Dendrite{}
 	cfg.Defaults(config.DefaultOpts{
@@ -204,7 +248,7 @@ func createTransactionWithEDU(ctx *process.ProcessContext, edus []gomatrixserver
 		UserAPI:                nil,
 	}
 	keyRing := &test.NopJSONVerifier{}
-	txn := NewTxnReq(&FakeRsAPI{}, nil, "ourserver", keyRing, nil, producer, true, []json.RawMessage{}, edus, "kaer.morhen", "", "ourserver")
+	txn := NewTxnReq(&FakeRsAPI{}, nil, nil, "ourserver", keyRing, nil, 1, nil, producer, true, []json.RawMessage{}, edus, "kaer.morhen", "", "ourserver")
 	return txn, js, cfg
 }
 
@@ -727,8 +771,11 @@ func mustCreateTransaction(rsAPI rsAPI.FederationRoomserverAPI, pdus []json.RawM
 	t := NewTxnReq(
 		rsAPI,
 		nil,
+		nil,
 		"",
 		&test.NopJSONVerifier{},
+		nil,
+		1,
 		NewMutexByRoom(),
 		nil,
 		false,
@@ -22,6 +22,13 @@ func GetRequestID(ctx context.Context) string {
 	return id.(string)
 }
 
+// ContextWithRequestID creates a new context carrying the given request ID, e.g.
+// so that work done on behalf of a request in another component can be correlated
+// with it.
+func ContextWithRequestID(ctx context.Context, reqID string) context.Context {
+	return context.WithValue(ctx, ctxValueRequestID, reqID)
+}
+
 // ctxValueLogger is the key to extract the logrus Logger.
 const ctxValueLogger = contextKeys("logger")
 
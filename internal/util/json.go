@@ -1,7 +1,6 @@
 package util
 
 import (
-	"context"
 	"encoding/json"
 	"math/rand"
 	"net/http"
@@ -103,18 +102,46 @@ func Protect(handler http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// RequestIDHeader is the HTTP header which carries the request ID, both on
+// incoming requests and on our responses.
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID returns whether an inbound request ID is safe to use. IDs end
+// up in log lines and response bodies, so only short, plain IDs are accepted.
+func validRequestID(reqID string) bool {
+	if reqID == "" || len(reqID) > 64 {
+		return false
+	}
+	for _, c := range reqID {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // RequestWithLogging sets up standard logging for http.Requests.
 // http.Requests will have a logger (with a request ID/method/path logged) attached to the Context.
 // This can be accessed via GetLogger(Context).
+// The request ID is taken from the X-Request-ID header if a trusted reverse proxy
+// in front of us supplied a sensible one. Otherwise a new one is generated. The
+// header is removed from requests which didn't come through a trusted proxy
+// before they get here, see httputil.WithTrustedRequestIDs.
 func RequestWithLogging(req *http.Request) *http.Request {
-	reqID := RandomString(12)
+	reqID := req.Header.Get(RequestIDHeader)
+	if !validRequestID(reqID) {
+		reqID = RandomString(12)
+	}
 	// Set a Logger and request ID on the context
 	ctx := ContextWithLogger(req.Context(), log.WithFields(log.Fields{
 		"req.method": req.Method,
 		"req.path":   req.URL.Path,
 		"req.id":     reqID,
 	}))
-	ctx = context.WithValue(ctx, ctxValueRequestID, reqID)
+	ctx = ContextWithRequestID(ctx, reqID)
 	req = req.WithContext(ctx)
 
 	if req.Method != http.MethodOptions {
@@ -157,6 +184,11 @@ func respond(w http.ResponseWriter, req *http.Request, res JSONResponse) {
 		}
 	}
 
+	reqID := GetRequestID(req.Context())
+	if reqID != "" {
+		w.Header().Set(RequestIDHeader, reqID)
+	}
+
 	// Marshal JSON response into raw bytes to send as the HTTP body
 	resBytes, err := json.Marshal(res.JSON)
 	if err != nil {
@@ -165,6 +197,9 @@ func respond(w http.ResponseWriter, req *http.Request, res JSONResponse) {
 		res = MessageResponse(500, "Internal Server Error")
 		resBytes, _ = json.Marshal(res.JSON)
 	}
+	if reqID != "" && !res.Is2xx() {
+		resBytes = withRequestID(resBytes, reqID)
+	}
 
 	// Set status code and write the body
 	w.WriteHeader(res.Code)
@@ -174,6 +209,27 @@ func respond(w http.ResponseWriter, req *http.Request, res JSONResponse) {
 	_, _ = w.Write(resBytes)
 }
 
+// withRequestID adds the request ID to a Matrix error response body, so that
+// users reporting an error can quote it. Any other body is returned unchanged.
+func withRequestID(body []byte, reqID string) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	if _, ok := fields["errcode"]; !ok {
+		return body
+	}
+	if _, ok := fields["request_id"]; ok {
+		return body
+	}
+	fields["request_id"], _ = json.Marshal(reqID)
+	withID, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return withID
+}
+
 // WithCORSOptions intercepts all OPTIONS requests and responds with CORS headers. The request handler
 // is not invoked when this happens.
 func WithCORSOptions(handler http.HandlerFunc) http.HandlerFunc {
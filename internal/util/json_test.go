@@ -259,3 +259,41 @@ func TestGetRequestID(t *testing.T) {
 		t.Errorf("TestGetRequestID wanted empty request ID, got '%s'", ctxReqID)
 	}
 }
+
+func TestRequestIDHeader(t *testing.T) {
+	log.SetLevel(log.PanicLevel) // suppress logs in test output
+	var gotReqID string
+	mock := MockJSONRequestHandler{func(req *http.Request) JSONResponse {
+		gotReqID = GetRequestID(req.Context())
+		return MatrixErrorResponse(http.StatusForbidden, "M_FORBIDDEN", "nope")
+	}}
+	handlerFunc := MakeJSONAPI(&mock)
+
+	// A sensible inbound request ID is used as-is
+	mockReq, _ := http.NewRequest("GET", "http://example.com/foo", nil)
+	mockReq.Header.Set(RequestIDHeader, "abc-123")
+	mockWriter := httptest.NewRecorder()
+	handlerFunc(mockWriter, mockReq)
+	if gotReqID != "abc-123" {
+		t.Errorf("TestRequestIDHeader wanted request ID 'abc-123', got '%s'", gotReqID)
+	}
+	if h := mockWriter.Header().Get(RequestIDHeader); h != "abc-123" {
+		t.Errorf("TestRequestIDHeader wanted response header 'abc-123', got '%s'", h)
+	}
+	expect := `{"errcode":"M_FORBIDDEN","error":"nope","request_id":"abc-123"}`
+	if actualBody := mockWriter.Body.String(); actualBody != expect {
+		t.Errorf("TestRequestIDHeader wanted body '%s', got '%s'", expect, actualBody)
+	}
+
+	// Anything else is replaced with a generated one
+	mockReq, _ = http.NewRequest("GET", "http://example.com/foo", nil)
+	mockReq.Header.Set(RequestIDHeader, "not\nsensible")
+	mockWriter = httptest.NewRecorder()
+	handlerFunc(mockWriter, mockReq)
+	if gotReqID == "" || gotReqID == "not\nsensible" {
+		t.Errorf("TestRequestIDHeader wanted a generated request ID, got '%s'", gotReqID)
+	}
+	if h := mockWriter.Header().Get(RequestIDHeader); h != gotReqID {
+		t.Errorf("TestRequestIDHeader wanted response header '%s', got '%s'", gotReqID, h)
+	}
+}
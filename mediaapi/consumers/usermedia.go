@@ -0,0 +1,59 @@
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/nats-io/nats.go"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/mediaapi/storage"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/sirupsen/logrus"
+)
+
+// UserMedia describes a file uploaded by a user, as returned to the client
+// API when the user's data is exported.
+type UserMedia struct {
+	MediaID     types.MediaID       `json:"media_id"`
+	Origin      spec.ServerName     `json:"media_origin"`
+	ContentType types.ContentType   `json:"content_type"`
+	Size        types.FileSizeBytes `json:"size"`
+	CreatedTS   spec.Timestamp      `json:"created_ts"`
+	UploadName  types.Filename      `json:"upload_name,omitempty"`
+	Quarantined bool                `json:"quarantined"`
+}
+
+// StartUserMediaResponder answers requests from the client API for the
+// list of media uploaded by a user.
+func StartUserMediaResponder(ctx context.Context, cfg *config.Dendrite, nc *nats.Conn, db storage.Database) error {
+	_, err := nc.Subscribe(cfg.Global.JetStream.Prefixed(jetstream.RequestUserMedia), func(msg *nats.Msg) {
+		m := &nats.Msg{
+			Header: nats.Header{},
+		}
+		media, err := db.GetMediaForUser(ctx, types.MatrixUserID(msg.Header.Get(jetstream.UserID)))
+		if err == nil {
+			list := make([]UserMedia, 0, len(media))
+			for _, md := range media {
+				list = append(list, UserMedia{
+					MediaID:     md.MediaID,
+					Origin:      md.Origin,
+					ContentType: md.ContentType,
+					Size:        md.FileSizeBytes,
+					CreatedTS:   md.CreationTimestamp,
+					UploadName:  md.UploadName,
+					Quarantined: md.Quarantined,
+				})
+			}
+			m.Data, err = json.Marshal(list)
+		}
+		if err != nil {
+			m.Header.Set("error", err.Error())
+		}
+		if err = msg.RespondMsg(m); err != nil {
+			logrus.WithError(err).Error("Unable to respond to messages")
+		}
+	})
+	return err
+}
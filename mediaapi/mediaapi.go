@@ -19,29 +19,42 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/httputil"
 	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/mediaapi/consumers"
 	"github.com/neilalexander/harmony/mediaapi/routing"
 	"github.com/neilalexander/harmony/mediaapi/storage"
 	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/neilalexander/harmony/setup/process"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 	"github.com/sirupsen/logrus"
 )
 
 // AddPublicRoutes sets up and registers HTTP handlers for the MediaAPI component.
 func AddPublicRoutes(
+	processCtx *process.ProcessContext,
 	routers httputil.Routers,
 	cm *sqlutil.Connections,
 	cfg *config.Dendrite,
+	natsInstance *jetstream.NATSInstance,
 	userAPI userapi.MediaUserAPI,
 	client *fclient.Client,
 	fedClient fclient.FederationClient,
 	keyRing gomatrixserverlib.JSONVerifier,
+	rateLimitStore httputil.RateLimitStore,
 ) {
 	mediaDB, err := storage.NewMediaAPIDatasource(cm, &cfg.MediaAPI.Database)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
 
+	_, natsClient := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	if err = consumers.StartUserMediaResponder(processCtx.Context(), cfg, natsClient, mediaDB); err != nil {
+		logrus.WithError(err).Panic("failed to start user media responder")
+	}
+
+	rateLimits := httputil.NewRateLimits(processCtx.Context(), "mediaapi", &cfg.ClientAPI.RateLimiting, rateLimitStore)
+
 	routing.Setup(
-		routers, cfg, mediaDB, userAPI, client, fedClient, keyRing,
+		processCtx, routers, cfg, mediaDB, userAPI, client, fedClient, keyRing, rateLimits,
 	)
 }
@@ -0,0 +1,49 @@
+package routing
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/httputil"
+	"github.com/neilalexander/harmony/internal/util"
+	"github.com/neilalexander/harmony/mediaapi/storage"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminQuarantineMedia quarantines media on a POST, so that it is no longer
+// served to anyone, or lifts the quarantine on a DELETE.
+func AdminQuarantineMedia(req *http.Request, db storage.Database) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	mediaID := types.MediaID(vars["mediaId"])
+	serverName := spec.ServerName(vars["serverName"])
+	quarantined := req.Method != http.MethodDelete
+
+	found, err := db.SetMediaQuarantined(req.Context(), mediaID, serverName, quarantined)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.SetMediaQuarantined failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !found {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Media not found"),
+		}
+	}
+	log.WithFields(log.Fields{
+		"media_id":    mediaID,
+		"origin":      serverName,
+		"quarantined": quarantined,
+	}).Warn("Changing quarantine status of media")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]bool{"quarantined": quarantined},
+	}
+}
@@ -0,0 +1,141 @@
+package routing
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/neilalexander/harmony/mediaapi/types"
+)
+
+// errContentTypeBlocked is returned when the media is of a type which the
+// server has been configured not to serve.
+var errContentTypeBlocked = errors.New("content type is blocked")
+
+// activeContentTypes can run scripts if a browser renders them, so they are
+// always served as attachments and sandboxed.
+var activeContentTypes = map[string]struct{}{
+	"text/html":              {},
+	"text/xml":               {},
+	"text/javascript":        {},
+	"text/ecmascript":        {},
+	"application/xhtml+xml":  {},
+	"application/xml":        {},
+	"application/javascript": {},
+	"application/ecmascript": {},
+	"image/svg+xml":          {},
+}
+
+// contentSecurityPolicy is sent with all media, and activeContentSecurityPolicy
+// with media which could otherwise run scripts.
+const (
+	contentSecurityPolicy = "default-src 'none';" +
+		" script-src 'none';" +
+		" plugin-types application/pdf;" +
+		" style-src 'unsafe-inline';" +
+		" object-src 'self';"
+	activeContentSecurityPolicy = "sandbox; default-src 'none';"
+)
+
+// mediaType returns the lower-cased media type without any parameters.
+func mediaType(contentType types.ContentType) string {
+	if t, _, err := mime.ParseMediaType(string(contentType)); err == nil {
+		return t
+	}
+	t, _, _ := strings.Cut(string(contentType), ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+func isActiveContent(contentType types.ContentType) bool {
+	t := mediaType(contentType)
+	_, ok := activeContentTypes[t]
+	return ok || strings.HasSuffix(t, "+xml")
+}
+
+func isTextContent(contentType types.ContentType) bool {
+	t := mediaType(contentType)
+	return strings.HasPrefix(t, "text/") || t == "application/json" || t == "application/xml" ||
+		strings.HasSuffix(t, "+json") || strings.HasSuffix(t, "+xml")
+}
+
+// zipContainerTypes are stored as ZIP archives, so sniffing can only tell
+// that they are ZIP archives.
+var zipContainerTypes = map[string]struct{}{
+	"application/epub+zip":                    {},
+	"application/java-archive":                {},
+	"application/vnd.android.package-archive": {},
+}
+
+// zipContainerTypePrefixes cover the office document formats, i.e.
+// "application/vnd.openxmlformats-officedocument.wordprocessingml.document".
+var zipContainerTypePrefixes = []string{
+	"application/vnd.openxmlformats-officedocument.",
+	"application/vnd.oasis.opendocument.",
+}
+
+func isZipContainer(contentType types.ContentType) bool {
+	t := mediaType(contentType)
+	if _, ok := zipContainerTypes[t]; ok || strings.HasSuffix(t, "+zip") {
+		return true
+	}
+	for _, prefix := range zipContainerTypePrefixes {
+		if strings.HasPrefix(t, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffContentType works out the type to serve media as from its first bytes,
+// rather than trusting the type given by the uploader. The uploader's type is
+// only kept if sniffing can't tell what the media is, if sniffing finds plain
+// text or XML and the uploader gave a more specific text type, or if sniffing
+// finds a ZIP archive and the uploader gave a format which is stored as one.
+func sniffContentType(claimed types.ContentType, head []byte) types.ContentType {
+	sniffed := types.ContentType(http.DetectContentType(head))
+	switch mediaType(sniffed) {
+	case "application/octet-stream":
+		if claimed == "" {
+			return sniffed
+		}
+		return claimed
+	case "text/plain", "text/xml":
+		if isTextContent(claimed) {
+			return claimed
+		}
+	case "application/zip":
+		if isZipContainer(claimed) {
+			return claimed
+		}
+	}
+	return sniffed
+}
+
+// contentTypeBlocked returns true if any of the content types match the blocked
+// types, which are either full media types or a type with a wildcard subtype,
+// such as "video/*".
+func contentTypeBlocked(blocked []string, contentTypes ...types.ContentType) bool {
+	for _, contentType := range contentTypes {
+		t := mediaType(contentType)
+		if t == "" {
+			continue
+		}
+		for _, b := range blocked {
+			b = strings.ToLower(b)
+			if b == t || (strings.HasSuffix(b, "/*") && strings.HasPrefix(t, strings.TrimSuffix(b, "*"))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contentSecurityPolicyFor returns the Content-Security-Policy for a given
+// content type.
+func contentSecurityPolicyFor(contentType types.ContentType) string {
+	if isActiveContent(contentType) {
+		return activeContentSecurityPolicy
+	}
+	return contentSecurityPolicy
+}
@@ -0,0 +1,49 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_sniffContentType(t *testing.T) {
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+	html := []byte("<!DOCTYPE html><html><script>alert(1)</script></html>")
+	svg := []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`)
+
+	assert.Equal(t, types.ContentType("image/png"), sniffContentType("image/jpeg", png), "wrong image type")
+	assert.Equal(t, types.ContentType("text/html; charset=utf-8"), sniffContentType("image/png", html), "HTML claiming to be an image")
+	assert.Equal(t, types.ContentType("image/svg+xml"), sniffContentType("image/svg+xml", svg), "SVG")
+	assert.Equal(t, types.ContentType("text/xml; charset=utf-8"), sniffContentType("image/png", svg), "SVG claiming to be an image")
+	assert.Equal(t, types.ContentType("application/json"), sniffContentType("application/json", []byte(`{"a":1}`)), "JSON")
+	assert.Equal(t, types.ContentType("text/plain; charset=utf-8"), sniffContentType("video/mp4", []byte("hello")), "text claiming to be a video")
+	assert.Equal(t, types.ContentType("audio/flac"), sniffContentType("audio/flac", []byte("fLaC\x00\x00\x00\x22")), "unknown to sniffing")
+	assert.Equal(t, types.ContentType("application/octet-stream"), sniffContentType("", []byte{0x00, 0x01}), "no type given")
+
+	zip := []byte("PK\x03\x04\x14\x00\x06\x00\x08\x00\x00\x00!\x00[Content_Types].xml")
+	docx := types.ContentType("application/vnd.openxmlformats-officedocument.wordprocessingml.document")
+	assert.Equal(t, docx, sniffContentType(docx, zip), "Word document")
+	assert.Equal(t, types.ContentType("application/vnd.oasis.opendocument.spreadsheet"), sniffContentType("application/vnd.oasis.opendocument.spreadsheet", zip), "OpenDocument spreadsheet")
+	assert.Equal(t, types.ContentType("application/epub+zip"), sniffContentType("application/epub+zip", zip), "EPUB")
+	assert.Equal(t, types.ContentType("application/zip"), sniffContentType("image/png", zip), "ZIP claiming to be an image")
+	assert.Equal(t, types.ContentType("text/html; charset=utf-8"), sniffContentType(docx, html), "HTML claiming to be a Word document")
+}
+
+func Test_contentTypeBlocked(t *testing.T) {
+	blocked := []string{"text/html", "Video/*"}
+	assert.True(t, contentTypeBlocked(blocked, "text/html; charset=utf-8"), "exact type with parameters")
+	assert.True(t, contentTypeBlocked(blocked, "video/mp4"), "wildcard subtype")
+	assert.True(t, contentTypeBlocked(blocked, "image/png", "TEXT/HTML"), "any of the types")
+	assert.False(t, contentTypeBlocked(blocked, "image/png", ""), "allowed type")
+	assert.False(t, contentTypeBlocked(blocked, "videos/mp4"), "similar type")
+	assert.False(t, contentTypeBlocked(nil, "text/html"), "nothing blocked")
+}
+
+func Test_activeContent(t *testing.T) {
+	assert.Equal(t, "attachment", contentDispositionFor("image/svg+xml"), "SVG")
+	assert.Equal(t, "attachment", contentDispositionFor("text/html; charset=utf-8"), "HTML")
+	assert.Equal(t, "inline", contentDispositionFor("text/plain; charset=utf-8"), "plain text")
+	assert.Equal(t, activeContentSecurityPolicy, contentSecurityPolicyFor("application/xhtml+xml"), "XHTML")
+	assert.Equal(t, contentSecurityPolicy, contentSecurityPolicyFor("image/png"), "image")
+}
@@ -31,6 +31,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
@@ -103,6 +104,10 @@ var allowInlineTypes = map[types.ContentType]struct{}{
 	"audio/x-flac":    {},
 }
 
+// thumbnailRetryAfterSeconds is how long clients are asked to wait before
+// retrying when too many thumbnails are waiting to be generated.
+const thumbnailRetryAfterSeconds = 5
+
 // Download implements GET /download and GET /thumbnail
 // Files from this server (i.e. origin == cfg.ServerName) are served directly
 // Files from remote servers (i.e. origin != cfg.ServerName) are cached locally.
@@ -175,6 +180,28 @@ func Download(
 		req.Context(), w, cfg, db, client,
 		activeRemoteRequests, activeThumbnailGeneration,
 	)
+	if errors.Is(err, errRemoteFileTooLarge) {
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: spec.TooLarge("Remote media is too large"),
+		})
+		return
+	}
+	if errors.Is(err, thumbnailer.ErrOverloaded) {
+		w.Header().Set("Retry-After", strconv.Itoa(thumbnailRetryAfterSeconds))
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: spec.Unknown("Too many thumbnails are being generated, try again later"),
+		})
+		return
+	}
+	if errors.Is(err, errContentTypeBlocked) {
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("Media of this type is not allowed"),
+		})
+		return
+	}
 	if err != nil {
 		// If we bubbled up a os.PathError, e.g. no such file or directory, don't send
 		// it to the client, be more generic.
@@ -277,6 +304,10 @@ func (r *downloadRequest) doDownload(
 	if err != nil {
 		return nil, fmt.Errorf("db.GetMediaMetadata: %w", err)
 	}
+	if mediaMetadata != nil && mediaMetadata.Quarantined {
+		// Quarantined media is treated as though it doesn't exist
+		return nil, nil
+	}
 	if mediaMetadata == nil {
 		if r.MediaMetadata.Origin == cfg.Matrix.ServerName {
 			// If we do not have a record and the origin is local, the file is not found
@@ -296,7 +327,8 @@ func (r *downloadRequest) doDownload(
 	return r.respondFromLocalFile(
 		ctx, w, cfg.AbsBasePath, activeThumbnailGeneration,
 		cfg.MaxThumbnailGenerators, db,
-		cfg.DynamicThumbnails, cfg.ThumbnailSizes,
+		cfg.DynamicThumbnails, cfg.ThumbnailSizes, cfg.BlockedContentTypes,
+		&cfg.SignedURLs,
 	)
 }
 
@@ -311,6 +343,8 @@ func (r *downloadRequest) respondFromLocalFile(
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
+	blockedContentTypes []string,
+	signedURLs *config.SignedURLs,
 ) (*types.MediaMetadata, error) {
 	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash, absBasePath)
 	if err != nil {
@@ -370,21 +404,59 @@ func (r *downloadRequest) respondFromLocalFile(
 		}).Trace("Responding with file")
 		responseFile = file
 		responseMetadata = r.MediaMetadata
+	}
+
+	// Serve the media as the type that it looks like, rather than the type
+	// that the uploader said that it was.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(responseFile, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("responseFile.Read: %w", err)
+	}
+	if _, err = responseFile.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("responseFile.Seek: %w", err)
+	}
+	claimedContentType := responseMetadata.ContentType
+	responseMetadata.ContentType = sniffContentType(claimedContentType, head[:n])
+	if contentTypeBlocked(blockedContentTypes, claimedContentType, responseMetadata.ContentType) {
+		r.Logger.WithField("ContentType", responseMetadata.ContentType).Info("Refusing to serve blocked content type")
+		return nil, errContentTypeBlocked
+	}
+	if !r.IsThumbnailRequest {
 		if err = r.addDownloadFilenameToHeaders(w, responseMetadata); err != nil {
 			return nil, err
 		}
+	} else if isActiveContent(responseMetadata.ContentType) {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+
+	// Everything has been checked, so the object store can serve the file
+	// instead. It is told which headers to serve it with as part of the signed
+	// URL. The security headers are kept on the redirect, but the object store
+	// can't send them, so media which needs them is served from here.
+	if signedURLs.Enabled() && !r.multipartResponse && canRedirectToSignedURL(responseMetadata.ContentType) {
+		location, signErr := signMediaURL(
+			signedURLs, absBasePath, responseFile.Name(), string(responseMetadata.ContentType),
+			w.Header().Get("Content-Disposition"), time.Now(),
+		)
+		if signErr != nil {
+			return nil, fmt.Errorf("signMediaURL: %w", signErr)
+		}
+		w.Header().Del("Content-Disposition")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicyFor(responseMetadata.ContentType))
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+		return responseMetadata, nil
 	}
 
 	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
 	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
-	contentSecurityPolicy := "default-src 'none';" +
-		" script-src 'none';" +
-		" plugin-types application/pdf;" +
-		" style-src 'unsafe-inline';" +
-		" object-src 'self';"
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
 	if !r.multipartResponse {
-		w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicyFor(responseMetadata.ContentType))
 		if _, err = io.Copy(w, responseFile); err != nil {
 			return nil, fmt.Errorf("io.Copy: %w", err)
 		}
@@ -508,12 +580,16 @@ func (r *downloadRequest) getThumbnailFile(
 	var thumbnail *types.ThumbnailMetadata
 	var err error
 
+	var overloaded error
 	if dynamicThumbnails {
 		thumbnail, err = r.generateThumbnail(
 			ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
 			maxThumbnailGenerators, db,
 		)
-		if err != nil {
+		if errors.Is(err, thumbnailer.ErrOverloaded) {
+			// Fall back to an existing thumbnail, if there is one.
+			overloaded = err
+		} else if err != nil {
 			return nil, nil, err
 		}
 	}
@@ -550,7 +626,7 @@ func (r *downloadRequest) getThumbnailFile(
 		}
 	}
 	if thumbnail == nil {
-		return nil, nil, nil
+		return nil, nil, overloaded
 	}
 	r.Logger = r.Logger.WithFields(log.Fields{
 		"Width":         thumbnail.ThumbnailSize.Width,
@@ -590,17 +666,31 @@ func (r *downloadRequest) generateThumbnail(
 		"Height":       thumbnailSize.Height,
 		"ResizeMethod": thumbnailSize.ResizeMethod,
 	})
-	busy, err := thumbnailer.GenerateThumbnail(
-		ctx, filePath, thumbnailSize, r.MediaMetadata,
-		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
+	// Only queue thumbnails which don't exist yet.
+	thumbnail, err := db.GetThumbnail(
+		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
+		thumbnailSize.Width, thumbnailSize.Height, thumbnailSize.ResizeMethod,
 	)
+	if err != nil || thumbnail != nil {
+		return thumbnail, err
+	}
+	// Generation may carry on after the request has been answered, so it
+	// mustn't use anything from the request which is changed afterwards.
+	var busy bool
+	mediaMetadata, logger := *r.MediaMetadata, r.Logger
+	generated, err := thumbnailer.GenerateOnDemand(&activeThumbnailGeneration.OnDemand, thumbnailSize, func() (err error) {
+		busy, err = thumbnailer.GenerateThumbnail(
+			context.WithoutCancel(ctx), filePath, thumbnailSize, &mediaMetadata,
+			activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
+		)
+		return err
+	}, r.Logger)
 	if err != nil {
 		return nil, fmt.Errorf("thumbnailer.GenerateThumbnail: %w", err)
 	}
-	if busy {
+	if !generated || busy {
 		return nil, nil
 	}
-	var thumbnail *types.ThumbnailMetadata
 	thumbnail, err = db.GetThumbnail(
 		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
 		thumbnailSize.Width, thumbnailSize.Height, thumbnailSize.ResizeMethod,
@@ -624,7 +714,10 @@ func (r *downloadRequest) getRemoteFile(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (errorResponse error) {
 	// Note: getMediaMetadataFromActiveRequest uses mutexes and conditions from activeRemoteRequests
-	mediaMetadata, resErr := r.getMediaMetadataFromActiveRequest(activeRemoteRequests)
+	mediaMetadata, shared, resErr := r.getMediaMetadataFromActiveRequest(activeRemoteRequests)
+	if shared {
+		remoteFetchCounter.WithLabelValues("deduplicated").Inc()
+	}
 	if resErr != nil {
 		return resErr
 	} else if mediaMetadata != nil {
@@ -654,10 +747,18 @@ func (r *downloadRequest) getRemoteFile(
 			// If we do not have a record, we need to fetch the remote file first and then respond from the local file
 			err := r.fetchRemoteFileAndStoreMetadata(
 				ctx, client,
-				cfg.AbsBasePath, cfg.MaxFileSizeBytes, db,
-				cfg.ThumbnailSizes, activeThumbnailGeneration,
+				cfg.AbsBasePath, cfg.RemoteFileSizeLimit(), db,
+				cfg.PreGeneratedThumbnailSizes(), activeThumbnailGeneration,
 				cfg.MaxThumbnailGenerators,
 			)
+			switch {
+			case err == nil:
+				remoteFetchCounter.WithLabelValues("success").Inc()
+			case errors.Is(err, errRemoteFileTooLarge):
+				remoteFetchCounter.WithLabelValues("too_large").Inc()
+			default:
+				remoteFetchCounter.WithLabelValues("failed").Inc()
+			}
 			if err != nil {
 				r.Logger.WithError(err).Errorf("r.fetchRemoteFileAndStoreMetadata: failed to fetch remote file")
 				return err
@@ -670,7 +771,9 @@ func (r *downloadRequest) getRemoteFile(
 	return nil
 }
 
-func (r *downloadRequest) getMediaMetadataFromActiveRequest(activeRemoteRequests *types.ActiveRemoteRequests) (*types.MediaMetadata, error) {
+// getMediaMetadataFromActiveRequest waits for another goroutine which is already fetching
+// the remote file, returning true if there was one, or registers this one as the fetcher.
+func (r *downloadRequest) getMediaMetadataFromActiveRequest(activeRemoteRequests *types.ActiveRemoteRequests) (*types.MediaMetadata, bool, error) {
 	// Check if there is an active remote request for the file
 	mxcURL := "mxc://" + string(r.MediaMetadata.Origin) + "/" + string(r.MediaMetadata.MediaID)
 
@@ -683,14 +786,14 @@ func (r *downloadRequest) getMediaMetadataFromActiveRequest(activeRemoteRequests
 		// NOTE: Wait unlocks and locks again internally. There is still a deferred Unlock() that will unlock this.
 		activeRemoteRequestResult.Cond.Wait()
 		if activeRemoteRequestResult.Error != nil {
-			return nil, activeRemoteRequestResult.Error
+			return nil, true, activeRemoteRequestResult.Error
 		}
 
 		if activeRemoteRequestResult.MediaMetadata == nil {
-			return nil, nil
+			return nil, true, nil
 		}
 
-		return activeRemoteRequestResult.MediaMetadata, nil
+		return activeRemoteRequestResult.MediaMetadata, true, nil
 	}
 
 	// No active remote request so create one
@@ -698,7 +801,7 @@ func (r *downloadRequest) getMediaMetadataFromActiveRequest(activeRemoteRequests
 		Cond: &sync.Cond{L: activeRemoteRequests},
 	}
 
-	return nil, nil
+	return nil, false, nil
 }
 
 // broadcastMediaMetadata broadcasts the media metadata and error response to waiting goroutines
@@ -790,8 +893,8 @@ func (r *downloadRequest) GetContentLengthAndReader(contentLengthHeader string,
 		}
 		if maxFileSizeBytes > 0 && parsedLength > int64(maxFileSizeBytes) {
 			return 0, nil, fmt.Errorf(
-				"remote file size (%d bytes) exceeds locally configured max media size (%d bytes)",
-				parsedLength, maxFileSizeBytes,
+				"%w: remote file size (%d bytes) exceeds locally configured max media size (%d bytes)",
+				errRemoteFileTooLarge, parsedLength, maxFileSizeBytes,
 			)
 		}
 
@@ -801,12 +904,13 @@ func (r *downloadRequest) GetContentLengthAndReader(contentLengthHeader string,
 		contentLength = parsedLength
 	} else {
 		// Content-Length header is missing. If we have a maximum file size
-		// configured then we'll just make sure that the reader is limited to
-		// that size. We'll return a zero content length, but that's OK, since
-		// ultimately it will get rewritten later when the temp file is written
-		// to disk.
+		// configured then we'll make sure that reading fails if the file turns
+		// out to be larger, so that the download is aborted rather than a
+		// truncated file being stored. We'll return a zero content length, but
+		// that's OK, since ultimately it will get rewritten later when the temp
+		// file is written to disk.
 		if maxFileSizeBytes > 0 {
-			reader = io.NopCloser(io.LimitReader(reader, int64(maxFileSizeBytes)))
+			reader = io.NopCloser(&maxSizeReader{reader: reader, max: int64(maxFileSizeBytes)})
 		}
 		contentLength = 0
 	}
@@ -814,6 +918,27 @@ func (r *downloadRequest) GetContentLengthAndReader(contentLengthHeader string,
 	return contentLength, reader, nil
 }
 
+// errRemoteFileTooLarge is returned when remote media is larger than the
+// configured maximum size.
+var errRemoteFileTooLarge = errors.New("remote file is too large")
+
+// maxSizeReader reads from the underlying reader, but fails with
+// errRemoteFileTooLarge once more than max bytes have been read.
+type maxSizeReader struct {
+	reader io.Reader
+	max    int64
+	read   int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.reader.Read(p)
+	m.read += int64(n)
+	if m.read > m.max {
+		return 0, fmt.Errorf("%w (more than %d bytes)", errRemoteFileTooLarge, m.max)
+	}
+	return n, err
+}
+
 // mediaMeta contains information about a multipart media response.
 // TODO: extend once something is defined.
 type mediaMeta struct{}
@@ -864,8 +989,7 @@ func (r *downloadRequest) fetchRemoteFile(
 	}
 
 	if maxFileSizeBytes > 0 && contentLength > int64(maxFileSizeBytes) {
-		// TODO: Bubble up this as a 413
-		return "", false, fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
+		return "", false, fmt.Errorf("%w (%v > %v bytes)", errRemoteFileTooLarge, contentLength, maxFileSizeBytes)
 	}
 
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(contentLength)
@@ -893,11 +1017,15 @@ func (r *downloadRequest) fetchRemoteFile(
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
 	// Data is truncated to maxFileSizeBytes. Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes so this is OK.
+	// If the file turns out to be too large then the partial download is removed.
 	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, reader, absBasePath)
 	if err != nil {
 		r.Logger.WithError(err).WithFields(log.Fields{
 			"MaxFileSizeBytes": maxFileSizeBytes,
 		}).Warn("Error while downloading file from remote server")
+		if errors.Is(err, errRemoteFileTooLarge) {
+			return "", false, err
+		}
 		return "", false, errors.New("file could not be downloaded from remote server")
 	}
 
@@ -969,7 +1097,10 @@ func parseMultipartResponse(r *downloadRequest, resp *http.Response, maxFileSize
 // contentDispositionFor returns the Content-Disposition for a given
 // content type.
 func contentDispositionFor(contentType types.ContentType) string {
-	if _, ok := allowInlineTypes[contentType]; ok {
+	if isActiveContent(contentType) {
+		return "attachment"
+	}
+	if _, ok := allowInlineTypes[types.ContentType(mediaType(contentType))]; ok {
 		return "inline"
 	}
 	return "attachment"
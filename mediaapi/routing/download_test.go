@@ -5,9 +5,11 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/neilalexander/harmony/mediaapi/types"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -41,3 +43,29 @@ func Test_Multipart(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, responseBody, string(gotResponse))
 }
+
+func Test_RemoteFileSizeLimit(t *testing.T) {
+	r := &downloadRequest{
+		MediaMetadata: &types.MediaMetadata{},
+		Logger:        log.WithField("test", t.Name()),
+	}
+	body := func(size int) io.ReadCloser {
+		return io.NopCloser(strings.NewReader(strings.Repeat("a", size)))
+	}
+
+	// Files which say that they are too large are refused up front.
+	_, _, err := r.GetContentLengthAndReader("20", body(20), 10)
+	assert.ErrorIs(t, err, errRemoteFileTooLarge)
+
+	// Files which don't say how large they are are aborted once they're too large.
+	_, reader, err := r.GetContentLengthAndReader("", body(20), 10)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	assert.ErrorIs(t, err, errRemoteFileTooLarge)
+
+	_, reader, err = r.GetContentLengthAndReader("", body(10), 10)
+	assert.NoError(t, err)
+	got, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Len(t, got, 10)
+}
@@ -27,8 +27,10 @@ import (
 	"github.com/neilalexander/harmony/internal/httputil"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/neilalexander/harmony/mediaapi/storage"
+	"github.com/neilalexander/harmony/mediaapi/thumbnailer"
 	"github.com/neilalexander/harmony/mediaapi/types"
 	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -47,6 +49,7 @@ type configResponse struct {
 // applied:
 // nolint: gocyclo
 func Setup(
+	processCtx *process.ProcessContext,
 	routers httputil.Routers,
 	cfg *config.Dendrite,
 	db storage.Database,
@@ -54,16 +57,20 @@ func Setup(
 	client *fclient.Client,
 	federationClient fclient.FederationClient,
 	keyRing gomatrixserverlib.JSONVerifier,
+	rateLimits *httputil.RateLimits,
 ) {
-	rateLimits := httputil.NewRateLimits(&cfg.ClientAPI.RateLimiting)
-
 	v3mux := routers.Media.PathPrefix("/{apiversion:(?:r0|v1|v3)}/").Subrouter()
 	v1mux := routers.Client.PathPrefix("/v1/media/").Subrouter()
 	v1fedMux := routers.Federation.PathPrefix("/v1/media/").Subrouter()
 
 	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		OnDemand: types.OnDemandThumbnailGeneration{
+			Queue:   make(chan func(), cfg.MediaAPI.OnDemandThumbnails.QueueSize),
+			Timeout: cfg.MediaAPI.OnDemandThumbnails.Timeout,
+		},
 	}
+	thumbnailer.StartOnDemandWorkers(processCtx, &activeThumbnailGeneration.OnDemand, cfg.MediaAPI.OnDemandThumbnails.MaxGenerators)
 
 	uploadHandler := httputil.MakeAuthAPI(
 		"upload", userAPI,
@@ -121,6 +128,12 @@ func Setup(
 	v1fedMux.Handle("/thumbnail/{mediaId}", routing.MakeFedHTTPAPI(cfg.Global.ServerName, cfg.Global.IsLocalServerName, keyRing,
 		makeDownloadAPI("thumbnail_authed_federation", &cfg.MediaAPI, rateLimits, db, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, true),
 	)).Methods(http.MethodGet, http.MethodOptions)
+
+	routers.DendriteAdmin.Handle("/admin/quarantineMedia/{serverName}/{mediaId}",
+		httputil.MakeAdminAPI("admin_quarantine_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminQuarantineMedia(req, db)
+		}),
+	).Methods(http.MethodPost, http.MethodDelete, http.MethodOptions)
 }
 
 var thumbnailCounter = promauto.NewCounterVec(
@@ -165,6 +178,16 @@ var downloadSize = promauto.NewHistogramVec(
 	[]string{"code", "type"},
 )
 
+var remoteFetchCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "mediaapi",
+		Name:      "remote_fetches",
+		Help:      "Total number of remote media fetches, by outcome",
+	},
+	[]string{"outcome"},
+)
+
 func makeDownloadAPI(
 	name string,
 	cfg *config.MediaAPI,
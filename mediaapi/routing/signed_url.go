@@ -0,0 +1,134 @@
+package routing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// canRedirectToSignedURL returns true if media of the given type can be served by
+// the object store. Object stores can't be told to send the Content-Security-Policy
+// and X-Content-Type-Options headers, so media which relies on them is served by
+// the media API.
+func canRedirectToSignedURL(contentType types.ContentType) bool {
+	return !isActiveContent(contentType) && !isTextContent(contentType)
+}
+
+// signMediaURL returns a presigned S3 URL for a file in the media store, which the
+// object store serves with the given headers until the URL expires.
+func signMediaURL(
+	cfg *config.SignedURLs, absBasePath config.Path, filePath string,
+	contentType, contentDisposition string, now time.Time,
+) (string, error) {
+	rel, err := filepath.Rel(string(absBasePath), filePath)
+	if err != nil {
+		return "", fmt.Errorf("filepath.Rel: %w", err)
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %q is outside of the media store", filePath)
+	}
+	objectURL, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return "", fmt.Errorf("url.Parse: %w", err)
+	}
+	objectURL.Path = path.Join("/", objectURL.Path, filepath.ToSlash(rel))
+
+	query := url.Values{}
+	query.Set("response-content-type", contentType)
+	if contentDisposition != "" {
+		query.Set("response-content-disposition", contentDisposition)
+	}
+	return presignS3URL(cfg, objectURL, query, now), nil
+}
+
+// presignS3URL signs a GET request for the object with AWS Signature Version 4,
+// putting the signature in the query string so that the URL can be followed by
+// the client. See https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func presignS3URL(cfg *config.SignedURLs, objectURL *url.URL, query url.Values, now time.Time) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + cfg.Region + "/s3/aws4_request"
+
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", cfg.AccessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(cfg.Expiry/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalURI := s3URIEncode(objectURL.Path, false)
+	canonicalQuery := s3CanonicalQuery(query)
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		canonicalURI,
+		canonicalQuery,
+		"host:" + objectURL.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		query.Get("X-Amz-Date"),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return objectURL.Scheme + "://" + objectURL.Host + canonicalURI + "?" +
+		canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data)) // nolint: errcheck
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes the query sorted by key, as it is signed.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		params = append(params, s3URIEncode(k, true)+"="+s3URIEncode(query.Get(k), true))
+	}
+	return strings.Join(params, "&")
+}
+
+// s3URIEncode percent-encodes everything but unreserved characters, and slashes
+// unless encodeSlash is set, as S3 expects when checking signatures.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -159,6 +160,9 @@ func (r *uploadRequest) doUpload(
 	}
 
 	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, reqReader, cfg.AbsBasePath)
+	if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+		return requestEntityTooLargeJSONResponse(cfg.MaxFileSizeBytes)
+	}
 	if err != nil {
 		r.Logger.WithError(err).WithFields(log.Fields{
 			"MaxFileSizeBytes": cfg.MaxFileSizeBytes,
@@ -189,6 +193,13 @@ func (r *uploadRequest) doUpload(
 			JSON: spec.InternalServerError{},
 		}
 	}
+	if existingMetadata != nil && existingMetadata.Quarantined {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("This file has been quarantined"),
+		}
+	}
 	if existingMetadata != nil {
 		// The file already exists, delete the uploaded temporary file.
 		defer fileutils.RemoveDir(tmpDir, r.Logger)
@@ -237,7 +248,7 @@ func (r *uploadRequest) doUpload(
 	}).Info("File uploaded")
 
 	return r.storeFileAndMetadata(
-		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
+		ctx, tmpDir, cfg.AbsBasePath, db, cfg.PreGeneratedThumbnailSizes(),
 		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
 	)
 }
@@ -30,6 +30,10 @@ type MediaRepository interface {
 	StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error
 	GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (*types.MediaMetadata, error)
 	GetMediaMetadataByHash(ctx context.Context, mediaHash types.Base64Hash, mediaOrigin spec.ServerName) (*types.MediaMetadata, error)
+	// SetMediaQuarantined marks media as quarantined, or not, returning false if the media isn't known.
+	SetMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, quarantined bool) (bool, error)
+	// GetMediaForUser returns the metadata of all media uploaded by the user, oldest first.
+	GetMediaForUser(ctx context.Context, userID types.MatrixUserID) ([]*types.MediaMetadata, error)
 }
 
 type Thumbnails interface {
@@ -20,8 +20,10 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/mediaapi/storage/postgres/deltas"
 	"github.com/neilalexander/harmony/mediaapi/storage/tables"
 	"github.com/neilalexander/harmony/mediaapi/types"
 )
@@ -47,9 +49,12 @@ CREATE TABLE IF NOT EXISTS mediaapi_media_repository (
     -- Alternate RFC 4648 unpadded base64 encoding string representation of a SHA-256 hash sum of the file data.
     base64hash TEXT NOT NULL,
     -- The user who uploaded the file. Should be a Matrix user ID.
-    user_id TEXT NOT NULL
+    user_id TEXT NOT NULL,
+    -- Whether an admin has quarantined the media, so that it is no longer served.
+    quarantined BOOLEAN NOT NULL DEFAULT FALSE
 );
 CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_media_repository_index ON mediaapi_media_repository (media_id, media_origin);
+CREATE INDEX IF NOT EXISTS mediaapi_media_repository_user_id_idx ON mediaapi_media_repository (user_id);
 `
 
 const insertMediaSQL = `
@@ -58,17 +63,27 @@ INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, fil
 `
 
 const selectMediaSQL = `
-SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, quarantined FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
 `
 
 const selectMediaByHashSQL = `
-SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id, quarantined FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
+`
+
+const updateMediaQuarantinedSQL = `
+UPDATE mediaapi_media_repository SET quarantined = $3 WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectMediaByUserSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, quarantined FROM mediaapi_media_repository WHERE user_id = $1 ORDER BY creation_ts ASC
 `
 
 type mediaStatements struct {
 	insertMediaStmt       *sql.Stmt
 	selectMediaStmt       *sql.Stmt
 	selectMediaByHashStmt *sql.Stmt
+	updateQuarantinedStmt *sql.Stmt
+	selectMediaByUserStmt *sql.Stmt
 }
 
 func NewPostgresMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error) {
@@ -78,10 +93,21 @@ func NewPostgresMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error)
 		return nil, err
 	}
 
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "mediaapi: add quarantined column",
+		Up:      deltas.UpQuarantined,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
+
 	return s, sqlutil.StatementList{
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
 		{&s.selectMediaByHashStmt, selectMediaByHashSQL},
+		{&s.updateQuarantinedStmt, updateMediaQuarantinedSQL},
+		{&s.selectMediaByUserStmt, selectMediaByUserSQL},
 	}.Prepare(db)
 }
 
@@ -119,6 +145,7 @@ func (s *mediaStatements) SelectMedia(
 		&mediaMetadata.UploadName,
 		&mediaMetadata.Base64Hash,
 		&mediaMetadata.UserID,
+		&mediaMetadata.Quarantined,
 	)
 	return &mediaMetadata, err
 }
@@ -139,6 +166,50 @@ func (s *mediaStatements) SelectMediaByHash(
 		&mediaMetadata.UploadName,
 		&mediaMetadata.MediaID,
 		&mediaMetadata.UserID,
+		&mediaMetadata.Quarantined,
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) SelectMediaByUser(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) ([]*types.MediaMetadata, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectMediaByUserStmt).QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMediaByUser: rows.close() failed")
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		mediaMetadata := &types.MediaMetadata{
+			UserID: userID,
+		}
+		if err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.Quarantined,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, mediaMetadata)
+	}
+	return media, rows.Err()
+}
+
+func (s *mediaStatements) UpdateMediaQuarantined(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName, quarantined bool,
+) (bool, error) {
+	res, err := sqlutil.TxStmtContext(ctx, txn, s.updateQuarantinedStmt).ExecContext(
+		ctx, mediaID, mediaOrigin, quarantined,
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
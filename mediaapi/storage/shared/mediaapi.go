@@ -61,6 +61,21 @@ func (d Database) GetMediaMetadataByHash(ctx context.Context, mediaHash types.Ba
 	return mediaMetadata, err
 }
 
+// SetMediaQuarantined marks media as quarantined, so that it is no longer served,
+// or lifts the quarantine. Returns false if there is no record of the media.
+func (d Database) SetMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, quarantined bool) (found bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		found, err = d.MediaRepository.UpdateMediaQuarantined(ctx, txn, mediaID, mediaOrigin, quarantined)
+		return err
+	})
+	return
+}
+
+// GetMediaForUser returns the metadata of all media uploaded by the user, oldest first.
+func (d Database) GetMediaForUser(ctx context.Context, userID types.MatrixUserID) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectMediaByUser(ctx, nil, userID)
+}
+
 // StoreThumbnail inserts the metadata about the thumbnail into the database.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
 func (d Database) StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error {
@@ -58,6 +58,25 @@ func TestMediaRepository(t *testing.T) {
 				t.Fatalf("expected metadata %+v, got %v", metadata, gotMetadata)
 			}
 		})
+		t.Run("can quarantine media", func(t *testing.T) {
+			found, err := db.SetMediaQuarantined(ctx, "testing", "localhost", true)
+			if err != nil {
+				t.Fatalf("unable to quarantine media: %v", err)
+			}
+			if !found {
+				t.Fatalf("expected media to be found")
+			}
+			gotMetadata, err := db.GetMediaMetadata(ctx, "testing", "localhost")
+			if err != nil {
+				t.Fatalf("unable to query media metadata: %v", err)
+			}
+			if !gotMetadata.Quarantined {
+				t.Fatalf("expected media to be quarantined")
+			}
+			if found, err = db.SetMediaQuarantined(ctx, "unknown", "localhost", true); err != nil || found {
+				t.Fatalf("expected unknown media not to be found, got %v, %v", found, err)
+			}
+		})
 	})
 }
 
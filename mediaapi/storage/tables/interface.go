@@ -43,4 +43,9 @@ type MediaRepository interface {
 		ctx context.Context, txn *sql.Tx,
 		mediaHash types.Base64Hash, mediaOrigin spec.ServerName,
 	) (*types.MediaMetadata, error)
+	UpdateMediaQuarantined(
+		ctx context.Context, txn *sql.Tx,
+		mediaID types.MediaID, mediaOrigin spec.ServerName, quarantined bool,
+	) (bool, error)
+	SelectMediaByUser(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) ([]*types.MediaMetadata, error)
 }
@@ -16,15 +16,20 @@ package thumbnailer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/neilalexander/harmony/mediaapi/storage"
 	"github.com/neilalexander/harmony/mediaapi/types"
 	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -88,6 +93,89 @@ func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailM
 	return chosenThumbnail, chosenThumbnailSize
 }
 
+// ErrOverloaded is returned when too many thumbnails are waiting to be generated.
+var ErrOverloaded = errors.New("too many thumbnails waiting to be generated")
+
+var onDemandQueueDepth = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "mediaapi",
+		Name:      "thumbnail_queue_depth",
+		Help:      "Number of requested thumbnails waiting to be generated",
+	},
+)
+
+var onDemandGenerationTime = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "mediaapi",
+		Name:      "thumbnail_generation_seconds",
+		Help:      "Time taken to generate requested thumbnails, by size",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	},
+	[]string{"size"},
+)
+
+// StartOnDemandWorkers starts the workers which generate the queued thumbnails. They
+// stop when the process shuts down, leaving anything still queued ungenerated.
+func StartOnDemandWorkers(processCtx *process.ProcessContext, onDemand *types.OnDemandThumbnailGeneration, workers int) {
+	for i := 0; i < workers; i++ {
+		processCtx.ComponentStarted()
+		go func() {
+			defer processCtx.ComponentFinished()
+			for {
+				select {
+				case <-processCtx.WaitForShutdown():
+					return
+				case generate := <-onDemand.Queue:
+					onDemandQueueDepth.Dec()
+					generate()
+				}
+			}
+		}()
+	}
+}
+
+// GenerateOnDemand queues generate for a thumbnail which has been requested, returning
+// ErrOverloaded if the queue is full. It waits up to the timeout for generate to finish,
+// after which generation carries on in the background so that the thumbnail is ready for
+// later requests. Returns false if the thumbnail was not generated in time.
+func GenerateOnDemand(onDemand *types.OnDemandThumbnailGeneration, size types.ThumbnailSize, generate func() error, logger *log.Entry) (bool, error) {
+	done := make(chan error, 1)
+	job := func() {
+		start := time.Now()
+		err := generate()
+		onDemandGenerationTime.WithLabelValues(fmt.Sprintf("%dx%d-%s", size.Width, size.Height, size.ResizeMethod)).Observe(time.Since(start).Seconds())
+		done <- err
+	}
+	if onDemand.Queue == nil {
+		go job()
+	} else {
+		// Count the job before queueing it, so that a worker taking it straight
+		// away can't decrement the gauge first.
+		onDemandQueueDepth.Inc()
+		select {
+		case onDemand.Queue <- job:
+		default:
+			onDemandQueueDepth.Dec()
+			logger.Warn("Too many thumbnails waiting to be generated.")
+			return false, ErrOverloaded
+		}
+	}
+	if onDemand.Timeout == 0 {
+		return true, <-done
+	}
+	timer := time.NewTimer(onDemand.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return true, err
+	case <-timer.C:
+		logger.Warn("Timed out waiting for thumbnail, generating it in the background.")
+		return false, nil
+	}
+}
+
 // getActiveThumbnailGeneration checks for active thumbnail generation
 func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeThumbnailGeneration *types.ActiveThumbnailGeneration, maxThumbnailGenerators int, logger *log.Entry) (isActive bool, busy bool, errorReturn error) {
 	// Check if there is active thumbnail generation.
@@ -0,0 +1,70 @@
+package thumbnailer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/process"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestGenerateOnDemand(t *testing.T) {
+	logger := log.WithField("test", t.Name())
+	size := types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop}
+	processCtx := process.NewProcessContext()
+	onDemand := &types.OnDemandThumbnailGeneration{
+		Queue: make(chan func(), 1),
+	}
+	StartOnDemandWorkers(processCtx, onDemand, 1)
+
+	// Without a timeout, requests wait for the thumbnail to be generated.
+	generated, err := GenerateOnDemand(onDemand, size, func() error { return nil }, logger)
+	if !generated || err != nil {
+		t.Fatalf("expected the thumbnail to be generated, got %v, %v", generated, err)
+	}
+	wantErr := errors.New("failed")
+	if _, err = GenerateOnDemand(onDemand, size, func() error { return wantErr }, logger); err != wantErr {
+		t.Fatalf("expected %v, got %v", wantErr, err)
+	}
+
+	// A generation which can't finish times out, but keeps its worker busy until it does.
+	onDemand.Timeout = time.Millisecond
+	release := make(chan struct{})
+	started := make(chan struct{})
+	generated, err = GenerateOnDemand(onDemand, size, func() error {
+		close(started)
+		<-release
+		return nil
+	}, logger)
+	if generated || err != nil {
+		t.Fatalf("expected the thumbnail to time out, got %v, %v", generated, err)
+	}
+	<-started
+
+	// The next thumbnail waits in the queue, after which the queue is full.
+	queued := make(chan struct{})
+	if generated, err = GenerateOnDemand(onDemand, size, func() error {
+		close(queued)
+		return nil
+	}, logger); generated || err != nil {
+		t.Fatalf("expected the thumbnail to be queued, got %v, %v", generated, err)
+	}
+	if _, err = GenerateOnDemand(onDemand, size, func() error { return nil }, logger); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected %v, got %v", ErrOverloaded, err)
+	}
+
+	// The worker takes the queued thumbnail off the queue before generating it,
+	// so there is room in the queue again once it has been generated.
+	close(release)
+	<-queued
+	onDemand.Timeout = 0
+	if generated, _ = GenerateOnDemand(onDemand, size, func() error { return nil }, logger); !generated {
+		t.Fatal("expected the thumbnail to be generated once the queue had drained")
+	}
+
+	// The workers stop when the process shuts down.
+	processCtx.ShutdownDendrite()
+	processCtx.WaitForComponentsToFinish()
+}
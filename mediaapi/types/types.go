@@ -16,6 +16,7 @@ package types
 
 import (
 	"sync"
+	"time"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/setup/config"
@@ -55,6 +56,7 @@ type MediaMetadata struct {
 	UploadName        Filename
 	Base64Hash        Base64Hash
 	UserID            MatrixUserID
+	Quarantined       bool
 }
 
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
@@ -98,6 +100,18 @@ type ActiveThumbnailGeneration struct {
 	sync.Mutex
 	// The string key is a thumbnail file path
 	PathToResult map[string]*ThumbnailGenerationResult
+	// Limits for thumbnails generated when they are requested
+	OnDemand OnDemandThumbnailGeneration
+}
+
+// OnDemandThumbnailGeneration queues the thumbnails generated when they are requested.
+type OnDemandThumbnailGeneration struct {
+	// Queue holds the thumbnails waiting for a worker. If nil, thumbnails are
+	// generated without being queued.
+	Queue chan func()
+	// Timeout is how long a request waits for a thumbnail. If zero, it waits
+	// until the thumbnail is generated.
+	Timeout time.Duration
 }
 
 // Crop indicates we should crop the thumbnail on resize
@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"crypto/ed25519"
+	"io"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
@@ -155,6 +156,11 @@ type QueryMembershipAPI interface {
 		eventIDs []string,
 		senderID spec.SenderID,
 	) (map[string]*types.HeaderedEvent, error)
+
+	// QueryEventsVisibleToUser filters the given events, which must all be from
+	// the same room, down to those that the user is allowed to see based on the
+	// history visibility and the user's membership at each event.
+	QueryEventsVisibleToUser(ctx context.Context, req *QueryEventsVisibleToUserRequest, res *QueryEventsVisibleToUserResponse) error
 }
 
 // API functions required by the syncapi
@@ -237,12 +243,37 @@ type ClientRoomserverAPI interface {
 	PerformRoomUpgrade(ctx context.Context, roomID string, userID spec.UserID, roomVersion gomatrixserverlib.RoomVersion) (newRoomID string, err error)
 	PerformAdminEvacuateRoom(ctx context.Context, roomID string) (affected []string, err error)
 	PerformAdminEvacuateUser(ctx context.Context, userID string) (affected []string, err error)
+	// PerformAdminForceJoin joins a local user to a room, inviting them first if needed.
+	PerformAdminForceJoin(ctx context.Context, roomIDOrAlias string, userID spec.UserID) (roomID string, err error)
 	PerformAdminPurgeRoom(ctx context.Context, roomID string) error
 	PerformAdminDownloadState(ctx context.Context, roomID, userID string, serverName spec.ServerName) error
+	PerformAdminRepairRoomState(ctx context.Context, roomID string, dryRun bool) (added, removed []string, err error)
+	// QueryAdminEventContext returns how an event was stored, or nil if the event isn't known.
+	QueryAdminEventContext(ctx context.Context, eventID string) (*AdminEventContext, error)
+	// QueryAdminAuthRejections returns the most recent events in the room which were
+	// rejected or soft-failed, newest first.
+	QueryAdminAuthRejections(ctx context.Context, roomID string) ([]AuthRejection, error)
+	// PerformAdminExportRoom writes every stored event in the room along with its state
+	// to w as a JSON RoomExport, reporting its progress as it goes.
+	PerformAdminExportRoom(ctx context.Context, roomID string, w io.Writer, progress func(done, total int64)) error
+	// PerformAdminImportRoom stores the events of a room exported to archive which
+	// isn't already known, without sending them to other servers, reporting its
+	// progress as it goes.
+	PerformAdminImportRoom(ctx context.Context, archive io.ReadSeeker, progress func(done, total int64)) (*RoomImportResult, error)
+	// PerformAdminReplayInputQueue queues the journalled input events again, returning
+	// how many were queued.
+	PerformAdminReplayInputQueue(ctx context.Context) (int, error)
 	PerformInvite(ctx context.Context, req *PerformInviteRequest) error
 	PerformJoin(ctx context.Context, req *PerformJoinRequest) (roomID string, joinedVia spec.ServerName, err error)
 	PerformLeave(ctx context.Context, req *PerformLeaveRequest, res *PerformLeaveResponse) error
 	PerformPublish(ctx context.Context, req *PerformPublishRequest) error
+	// PerformAdminUnpublishRoom removes a room from the room directory for every appservice and network.
+	PerformAdminUnpublishRoom(ctx context.Context, roomID string) error
+	// PerformAdminSetRoomDirectoryBlocked blocks or unblocks a room from being published in the
+	// room directory. Blocking a room also unpublishes it.
+	PerformAdminSetRoomDirectoryBlocked(ctx context.Context, roomID string, blocked bool) error
+	// QueryDirectoryBlockedRooms returns the rooms which are blocked from the room directory.
+	QueryDirectoryBlockedRooms(ctx context.Context) ([]string, error)
 	// PerformForget forgets a rooms history for a specific user
 	PerformForget(ctx context.Context, req *PerformForgetRequest, resp *PerformForgetResponse) error
 
@@ -257,6 +288,10 @@ type ClientRoomserverAPI interface {
 	//
 	// Returns whether the alias was found, whether it was removed, and an error (if any occurred)
 	RemoveRoomAlias(ctx context.Context, senderID spec.SenderID, alias string) (aliasFound bool, aliasRemoved bool, err error)
+	// PerformAdminRemoveRoomAlias removes a local alias regardless of who created it.
+	//
+	// Returns whether the alias was found, and an error (if any occurred)
+	PerformAdminRemoveRoomAlias(ctx context.Context, alias string) (aliasFound bool, err error)
 
 	SigningIdentityFor(ctx context.Context, senderID spec.UserID) (fclient.SigningIdentity, error)
 }
@@ -269,6 +304,8 @@ type UserRoomserverAPI interface {
 	QueryMembershipsForRoom(ctx context.Context, req *QueryMembershipsForRoomRequest, res *QueryMembershipsForRoomResponse) error
 	PerformAdminEvacuateUser(ctx context.Context, userID string) (affected []string, err error)
 	PerformJoin(ctx context.Context, req *PerformJoinRequest) (roomID string, joinedVia spec.ServerName, err error)
+	PerformInvite(ctx context.Context, req *PerformInviteRequest) error
+	GetRoomIDForAlias(ctx context.Context, req *GetRoomIDForAliasRequest, res *GetRoomIDForAliasResponse) error
 	JoinedUserCount(ctx context.Context, roomID string) (int, error)
 }
 
@@ -100,6 +100,10 @@ type OutputNewRoomEvent struct {
 	// Does the event completely rewrite the room state? If so, then AddsStateEventIDs
 	// will contain the entire room state.
 	RewritesState bool `json:"rewrites_state,omitempty"`
+	// Is this an event that was already sent, which is being sent again only
+	// to carry a repaired room state? If so, then RewritesState is also set and
+	// consumers should update their room state but not otherwise act on the event.
+	RepairsState bool `json:"repairs_state,omitempty"`
 	// The latest events in the room after this event.
 	// This can be used to set the prev events for new events in the room.
 	// This also can be used to get the full current state after this event.
@@ -148,12 +148,23 @@ type QueryMembershipsForRoomRequest struct {
 	// user is allowed to see the memberships. If not specified then all
 	// room memberships will be returned.
 	SenderID spec.SenderID `json:"sender"`
+	// Optional - the maximum number of membership events to return. If there
+	// are more then NextBatch will be set in the response, which can be passed
+	// back as From to fetch the next page. If zero then all are returned.
+	Limit int    `json:"limit,omitempty"`
+	From  string `json:"from,omitempty"`
+	// If true, only the type, state key, sender and content of the membership
+	// events are returned.
+	MinimalEvents bool `json:"minimal_events,omitempty"`
 }
 
 // QueryMembershipsForRoomResponse is a response to QueryMembershipsForRoom
 type QueryMembershipsForRoomResponse struct {
 	// The "m.room.member" events (of "join" membership) in the client format
 	JoinEvents []synctypes.ClientEvent `json:"join_events"`
+	// Set if there are more membership events than the requested limit, to
+	// be passed as From to fetch the next page.
+	NextBatch string `json:"next_batch,omitempty"`
 	// True if the user has been in room before and has either stayed in it or
 	// left it.
 	HasBeenInRoom bool `json:"has_been_in_room"`
@@ -194,6 +205,29 @@ type QueryServerAllowedToSeeEventResponse struct {
 	AllowedToSeeEvent bool `json:"can_see_event"`
 }
 
+// QueryEventsVisibleToUserRequest is a request to QueryEventsVisibleToUser
+type QueryEventsVisibleToUserRequest struct {
+	// The room that all of the events belong to.
+	RoomID spec.RoomID
+	// The user requesting the events.
+	UserID spec.UserID
+	// The events to filter. The Visibility field of each event, if set, is
+	// used as the history visibility at the event.
+	Events []*types.HeaderedEvent
+	// Events which should always be returned regardless of the history
+	// visibility, e.g. state events for /sync responses.
+	AlwaysIncludeEventIDs map[string]struct{}
+	// Optional - the current membership of the user in the room. If not set,
+	// the current membership is looked up in the roomserver.
+	CurrentMembership string
+}
+
+// QueryEventsVisibleToUserResponse is a response to QueryEventsVisibleToUser
+type QueryEventsVisibleToUserResponse struct {
+	// The events which the user is allowed to see, in the original order.
+	Events []*types.HeaderedEvent
+}
+
 // QueryMissingEventsRequest is a request to QueryMissingEvents
 type QueryMissingEventsRequest struct {
 	// Events which are known previous to the gap in the timeline.
@@ -228,6 +262,10 @@ type QueryStateAndAuthChainRequest struct {
 	// Should state resolution be ran on the result events?
 	// TODO: check call sites and remove if we always want to do state res
 	ResolveState bool `json:"resolve_state"`
+	// If true, only the IDs of the state and auth chain events are returned, in
+	// StateEventIDs and AuthChainEventIDs, without loading the events. Ignored if
+	// ResolveState or OnlyFetchAuthChain are set.
+	OnlyEventIDs bool `json:"only_event_ids,omitempty"`
 }
 
 // QueryStateAndAuthChainResponse is a response to QueryStateAndAuthChain
@@ -245,6 +283,9 @@ type QueryStateAndAuthChainResponse struct {
 	// The lists will be in an arbitrary order.
 	StateEvents     []*types.HeaderedEvent `json:"state_events"`
 	AuthChainEvents []*types.HeaderedEvent `json:"auth_chain_events"`
+	// The IDs of the state and auth chain events, if only they were requested.
+	StateEventIDs     []string `json:"state_event_ids,omitempty"`
+	AuthChainEventIDs []string `json:"auth_chain_event_ids,omitempty"`
 	// True if the queried event was rejected earlier.
 	IsRejected bool `json:"is_rejected"`
 }
@@ -279,6 +320,84 @@ type QueryAuthChainResponse struct {
 	AuthChain []*types.HeaderedEvent
 }
 
+// AdminEventContext describes how the roomserver stored an event.
+type AdminEventContext struct {
+	Event     *types.HeaderedEvent
+	AuthChain []*types.HeaderedEvent
+	// The state before the event, or 0 if the event is an outlier.
+	StateSnapshotNID types.StateSnapshotNID
+	Rejected         bool
+	// Soft-failed events are stored with state but were never sent
+	// downstream, since they didn't pass auth against the current state.
+	SoftFailed   bool
+	SentToOutput bool
+	// The remote servers that were joined to the room after a local event
+	// and so were sent it over federation.
+	Destinations []spec.ServerName
+}
+
+// AuthRejection describes why an event was rejected or soft-failed.
+type AuthRejection struct {
+	EventID string          `json:"event_id"`
+	Type    string          `json:"type"`
+	Sender  spec.SenderID   `json:"sender"`
+	Origin  spec.ServerName `json:"origin,omitempty"`
+	// SoftFailed is true if the event passed auth against the state before
+	// it but not against the current state of the room.
+	SoftFailed bool `json:"soft_failed"`
+	// Reason is the auth rule that the event failed.
+	Reason string `json:"reason"`
+	// StateEventIDs are the state events that the event was checked against.
+	StateEventIDs []string       `json:"state_event_ids"`
+	Timestamp     spec.Timestamp `json:"timestamp"`
+}
+
+// RoomExportFormat identifies the format of a RoomExport, so that archives
+// written by other versions can be recognised.
+const RoomExportFormat = "org.matrix.dendrite.room_export.v1"
+
+// RoomExport is a portable archive of the event DAG and state of a room. The
+// events are in the federation format, so that they can be imported into
+// another server or inspected with any Matrix tooling.
+type RoomExport struct {
+	Format      string                        `json:"format"`
+	RoomID      string                        `json:"room_id"`
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	ExportedBy  spec.ServerName               `json:"exported_by"`
+	ExportedTS  spec.Timestamp                `json:"exported_ts"`
+	// The forward extremities of the room and the current state after them.
+	LatestEventIDs []string `json:"latest_event_ids"`
+	StateEventIDs  []string `json:"state_event_ids"`
+	// Every stored event in the room, in the order in which they were stored.
+	// This must be the last field, as the events are written out after the
+	// rest of the export.
+	Events []RoomExportEvent `json:"events"`
+}
+
+// RoomExportEvent is an event in a RoomExport along with how it was stored.
+type RoomExportEvent struct {
+	Event spec.RawJSON `json:"event"`
+	// Outliers were only ever used for auth and have no state of their own.
+	Outlier  bool `json:"outlier,omitempty"`
+	Rejected bool `json:"rejected,omitempty"`
+	// The state before the event, given only for events which aren't outliers
+	// but which have prev_events that aren't in the archive or are outliers,
+	// such as the event we joined a federated room with.
+	StateBefore []string `json:"state_before,omitempty"`
+}
+
+// RoomImportResult describes what happened to the events of an imported room.
+type RoomImportResult struct {
+	RoomID   string `json:"room_id"`
+	Imported int    `json:"imported"`
+	// Events which were rejected when they were exported. They are still
+	// imported, but are rejected again.
+	Rejected int `json:"rejected"`
+	// Events sent by our own server names which were signed with keys that
+	// can no longer be checked, and so were signed again.
+	Resigned int `json:"resigned"`
+}
+
 type QuerySharedUsersRequest struct {
 	UserID         string
 	OtherUserIDs   []string
@@ -331,10 +450,15 @@ type QueryKnownUsersRequest struct {
 	UserID       string `json:"user_id"`
 	SearchString string `json:"search_string"`
 	Limit        int    `json:"limit"`
+	// Optional - the NextBatch of the previous response, to fetch the next page.
+	From string `json:"from,omitempty"`
 }
 
 type QueryKnownUsersResponse struct {
 	Users []authtypes.FullyQualifiedProfile `json:"profiles"`
+	// Set if there are more users than the requested limit, to be passed as
+	// From to fetch the next page.
+	NextBatch string `json:"next_batch,omitempty"`
 }
 
 type QueryServerBannedFromRoomRequest struct {
@@ -16,6 +16,7 @@ package api
 
 import (
 	"context"
+	"strings"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
@@ -157,6 +158,36 @@ func IsServerBannedFromRoom(ctx context.Context, rsAPI FederationRoomserverAPI,
 	return res.Banned
 }
 
+// FilterPublicRooms returns the rooms which contain every word of the search
+// term somewhere in their name, topic or aliases, ignoring case. If aliases is
+// given, it is used to look up any aliases of a room other than its canonical
+// alias, which is only done for rooms which don't match otherwise.
+func FilterPublicRooms(rooms []fclient.PublicRoom, searchTerm string, aliases func(roomID string) []string) []fclient.PublicRoom {
+	words := strings.Fields(strings.ToLower(searchTerm))
+	if len(words) == 0 {
+		return rooms
+	}
+	matches := func(text string) bool {
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				return false
+			}
+		}
+		return true
+	}
+	result := make([]fclient.PublicRoom, 0)
+	for _, room := range rooms {
+		text := strings.ToLower(room.Name + "\n" + room.Topic + "\n" + room.CanonicalAlias)
+		if !matches(text) && aliases != nil {
+			text += "\n" + strings.ToLower(strings.Join(aliases(room.RoomID), "\n"))
+		}
+		if matches(text) {
+			result = append(result, room)
+		}
+	}
+	return result
+}
+
 // PopulatePublicRooms extracts PublicRoom information for all the provided room IDs. The IDs are not checked to see if they are visible in the
 // published room directory.
 // due to lots of switches
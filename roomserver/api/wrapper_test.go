@@ -0,0 +1,45 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+)
+
+func TestFilterPublicRooms(t *testing.T) {
+	rooms := []fclient.PublicRoom{
+		{RoomID: "!a:test", Name: "Go Programming", Topic: "Talk about Go"},
+		{RoomID: "!b:test", Name: "Rust", CanonicalAlias: "#rust:test"},
+		{RoomID: "!c:test", Name: "Off topic"},
+	}
+	aliases := func(roomID string) []string {
+		if roomID == "!c:test" {
+			return []string{"#random-go:test"}
+		}
+		return nil
+	}
+	tests := []struct {
+		term string
+		want []string
+	}{
+		{term: "", want: []string{"!a:test", "!b:test", "!c:test"}},
+		{term: "go", want: []string{"!a:test", "!c:test"}},
+		{term: "GO talk", want: []string{"!a:test"}},
+		{term: "#rust", want: []string{"!b:test"}},
+		{term: "random go", want: []string{"!c:test"}},
+		{term: "python", want: []string{}},
+	}
+	for _, tt := range tests {
+		got := FilterPublicRooms(rooms, tt.term, aliases)
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: expected %v, got %v", tt.term, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i].RoomID != tt.want[i] {
+				t.Errorf("%q: expected %v, got %v", tt.term, tt.want, got)
+				break
+			}
+		}
+	}
+}
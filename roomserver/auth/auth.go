@@ -30,29 +30,24 @@ func IsServerAllowed(
 	serverCurrentlyInRoom bool,
 	authEvents []gomatrixserverlib.PDU,
 ) bool {
-	historyVisibility := HistoryVisibilityForRoom(authEvents)
-
-	// 1. If the history_visibility was set to world_readable, allow.
-	if historyVisibility == gomatrixserverlib.HistoryVisibilityWorldReadable {
-		return true
-	}
-	// 2. If the user's membership was join, allow.
-	joinedUserExists := IsAnyUserOnServerWithMembership(ctx, querier, serverName, authEvents, spec.Join)
-	if joinedUserExists {
-		return true
+	// A server is treated as a user who is joined (or invited) at the event if any
+	// of its users were, and as currently joined if it is currently in the room,
+	// so that the same rules apply as for users on the client-server API.
+	evVis := EventVisibility{
+		Visibility:        HistoryVisibilityForRoom(authEvents),
+		MembershipAtEvent: spec.Leave,
+		MembershipCurrent: spec.Leave,
 	}
-	// 3. If history_visibility was set to shared, and the user joined the room at any point after the event was sent, allow.
-	if historyVisibility == gomatrixserverlib.HistoryVisibilityShared && serverCurrentlyInRoom {
-		return true
+	switch {
+	case IsAnyUserOnServerWithMembership(ctx, querier, serverName, authEvents, spec.Join):
+		evVis.MembershipAtEvent = spec.Join
+	case IsAnyUserOnServerWithMembership(ctx, querier, serverName, authEvents, spec.Invite):
+		evVis.MembershipAtEvent = spec.Invite
 	}
-	// 4. If the user's membership was invite, and the history_visibility was set to invited, allow.
-	invitedUserExists := IsAnyUserOnServerWithMembership(ctx, querier, serverName, authEvents, spec.Invite)
-	if invitedUserExists && historyVisibility == gomatrixserverlib.HistoryVisibilityInvited {
-		return true
+	if serverCurrentlyInRoom {
+		evVis.MembershipCurrent = spec.Join
 	}
-
-	// 5. Otherwise, deny.
-	return false
+	return evVis.Allowed()
 }
 
 func HistoryVisibilityForRoom(authEvents []gomatrixserverlib.PDU) gomatrixserverlib.HistoryVisibility {
@@ -0,0 +1,228 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/types"
+)
+
+var historyVisibilityPriority = map[gomatrixserverlib.HistoryVisibility]uint8{
+	spec.WorldReadable:                         0,
+	gomatrixserverlib.HistoryVisibilityShared:  1,
+	gomatrixserverlib.HistoryVisibilityInvited: 2,
+	gomatrixserverlib.HistoryVisibilityJoined:  3,
+}
+
+// EventVisibility contains the history visibility and membership state at a given event
+type EventVisibility struct {
+	Visibility        gomatrixserverlib.HistoryVisibility
+	MembershipAtEvent string
+	MembershipCurrent string
+}
+
+// Allowed checks the EventVisibility if the user is allowed to see the event.
+// Rules as defined by https://spec.matrix.org/v1.3/client-server-api/#server-behaviour-5
+func (ev EventVisibility) Allowed() (allowed bool) {
+	switch ev.Visibility {
+	case gomatrixserverlib.HistoryVisibilityWorldReadable:
+		// If the history_visibility was set to world_readable, allow.
+		return true
+	case gomatrixserverlib.HistoryVisibilityJoined:
+		// If the user’s membership was join, allow.
+		if ev.MembershipAtEvent == spec.Join {
+			return true
+		}
+		return false
+	case gomatrixserverlib.HistoryVisibilityShared:
+		// If the user’s membership was join, allow.
+		// If history_visibility was set to shared, and the user joined the room at any point after the event was sent, allow.
+		if ev.MembershipAtEvent == spec.Join || ev.MembershipCurrent == spec.Join {
+			return true
+		}
+		return false
+	case gomatrixserverlib.HistoryVisibilityInvited:
+		// If the user’s membership was join, allow.
+		if ev.MembershipAtEvent == spec.Join {
+			return true
+		}
+		if ev.MembershipAtEvent == spec.Invite {
+			return true
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// BoundaryHistoryVisibility returns the effective history visibility of a
+// m.room.history_visibility event, which is the least restrictive of the old
+// and new visibility, so that history visibility changes are visible on the
+// boundaries. Returns the provided visibility for all other events.
+// https://spec.matrix.org/v1.3/client-server-api/#server-behaviour-5
+func BoundaryHistoryVisibility(ev gomatrixserverlib.PDU, visibility gomatrixserverlib.HistoryVisibility) gomatrixserverlib.HistoryVisibility {
+	if ev.Type() != spec.MRoomHistoryVisibility {
+		return visibility
+	}
+	hisVis, err := ev.HistoryVisibility()
+	if err != nil || hisVis == "" {
+		return visibility
+	}
+	prevHisVis := gjson.GetBytes(ev.Unsigned(), "prev_content.history_visibility").String()
+	oldPrio, ok := historyVisibilityPriority[gomatrixserverlib.HistoryVisibility(prevHisVis)]
+	// if we can't get the previous history visibility, default to shared.
+	if !ok {
+		oldPrio = historyVisibilityPriority[gomatrixserverlib.HistoryVisibilityShared]
+	}
+	// no OK check, since this should have been validated when setting the value
+	newPrio := historyVisibilityPriority[hisVis]
+	if oldPrio < newPrio {
+		return gomatrixserverlib.HistoryVisibility(prevHisVis)
+	}
+	return hisVis
+}
+
+// HistoryVisibilityQuerier is the subset of the roomserver API needed to
+// work out which events a user is allowed to see.
+type HistoryVisibilityQuerier interface {
+	api.QuerySenderIDAPI
+	QueryMembershipForSenderID(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID, res *api.QueryMembershipForUserResponse) error
+	QueryMembershipAtEvent(ctx context.Context, roomID spec.RoomID, eventIDs []string, senderID spec.SenderID) (map[string]*types.HeaderedEvent, error)
+}
+
+// FilterEventsVisibleToUser applies the room history visibility rules to the
+// events in the request, returning only those which the user is allowed to see.
+// The history visibility at each event is taken from the Visibility field of
+// the event, and events without one are never visible.
+//
+// All provided events must be from the same room.
+func FilterEventsVisibleToUser(
+	ctx context.Context, querier HistoryVisibilityQuerier,
+	req *api.QueryEventsVisibleToUserRequest,
+	res *api.QueryEventsVisibleToUserResponse,
+) error {
+	res.Events = make([]*types.HeaderedEvent, 0, len(req.Events))
+	if len(req.Events) == 0 {
+		return nil
+	}
+
+	senderID, err := querier.QuerySenderIDForUser(ctx, req.RoomID, req.UserID)
+	if err != nil {
+		return err
+	}
+
+	membershipCurrent := req.CurrentMembership
+	if membershipCurrent == "" {
+		membershipCurrent = spec.Leave
+		if senderID != nil {
+			membershipRes := api.QueryMembershipForUserResponse{}
+			if err = querier.QueryMembershipForSenderID(ctx, req.RoomID, *senderID, &membershipRes); err != nil {
+				return err
+			}
+			if membershipRes.Membership != "" {
+				membershipCurrent = membershipRes.Membership
+			}
+		}
+	}
+
+	visibilities := visibilityForEvents(ctx, querier, req.Events, senderID, req.RoomID)
+
+	for _, ev := range req.Events {
+		// Validate same room assumption
+		if ev.RoomID().String() != req.RoomID.String() {
+			return fmt.Errorf("events from different rooms supplied to FilterEventsVisibleToUser")
+		}
+
+		// Always include specific state events for /sync responses
+		if _, ok := req.AlwaysIncludeEventIDs[ev.EventID()]; ok {
+			res.Events = append(res.Events, ev)
+			continue
+		}
+
+		// NOTSPEC: Always allow user to see their own membership events (spec contains more "rules")
+		if senderID != nil {
+			if ev.Type() == spec.MRoomMember && ev.StateKeyEquals(string(*senderID)) {
+				res.Events = append(res.Events, ev)
+				continue
+			}
+		}
+
+		evVis := visibilities[ev.EventID()]
+		evVis.MembershipCurrent = membershipCurrent
+		evVis.Visibility = BoundaryHistoryVisibility(ev, evVis.Visibility)
+		if evVis.Allowed() {
+			res.Events = append(res.Events, ev)
+		}
+	}
+	return nil
+}
+
+// visibilityForEvents returns a map from eventID to EventVisibility containing the visibility and the membership
+// of `senderID` at the given event. If provided sender ID is nil, assume that membership is Leave
+func visibilityForEvents(
+	ctx context.Context,
+	querier HistoryVisibilityQuerier,
+	events []*types.HeaderedEvent,
+	senderID *spec.SenderID, roomID spec.RoomID,
+) map[string]EventVisibility {
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+
+	result := make(map[string]EventVisibility, len(eventIDs))
+
+	// get the membership events for all eventIDs
+	var err error
+	membershipEvents := make(map[string]*types.HeaderedEvent)
+	if senderID != nil {
+		membershipEvents, err = querier.QueryMembershipAtEvent(ctx, roomID, eventIDs, *senderID)
+		if err != nil {
+			logrus.WithError(err).Error("visibilityForEvents: failed to fetch membership at event, defaulting to 'leave'")
+		}
+	}
+
+	// Create a map from eventID -> EventVisibility
+	for _, event := range events {
+		eventID := event.EventID()
+		vis := EventVisibility{
+			MembershipAtEvent: spec.Leave, // default to leave, to not expose events by accident
+			Visibility:        event.Visibility,
+		}
+		ev, ok := membershipEvents[eventID]
+		if !ok || ev == nil {
+			result[eventID] = vis
+			continue
+		}
+
+		membership, err := ev.Membership()
+		if err != nil {
+			result[eventID] = vis
+			continue
+		}
+		vis.MembershipAtEvent = membership
+
+		result[eventID] = vis
+	}
+	return result
+}
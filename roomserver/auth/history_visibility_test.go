@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+)
+
+func TestEventVisibilityAllowed(t *testing.T) {
+	tests := []struct {
+		name string
+		vis  EventVisibility
+		want bool
+	}{
+		{
+			name: "world readable is always allowed",
+			vis:  EventVisibility{Visibility: gomatrixserverlib.HistoryVisibilityWorldReadable, MembershipAtEvent: spec.Leave, MembershipCurrent: spec.Leave},
+			want: true,
+		},
+		{
+			name: "shared allowed if currently joined",
+			vis:  EventVisibility{Visibility: gomatrixserverlib.HistoryVisibilityShared, MembershipAtEvent: spec.Leave, MembershipCurrent: spec.Join},
+			want: true,
+		},
+		{
+			name: "shared denied if never joined",
+			vis:  EventVisibility{Visibility: gomatrixserverlib.HistoryVisibilityShared, MembershipAtEvent: spec.Leave, MembershipCurrent: spec.Leave},
+		},
+		{
+			name: "invited allowed if invited at event",
+			vis:  EventVisibility{Visibility: gomatrixserverlib.HistoryVisibilityInvited, MembershipAtEvent: spec.Invite, MembershipCurrent: spec.Leave},
+			want: true,
+		},
+		{
+			name: "joined denied if only invited at event",
+			vis:  EventVisibility{Visibility: gomatrixserverlib.HistoryVisibilityJoined, MembershipAtEvent: spec.Invite, MembershipCurrent: spec.Join},
+		},
+		{
+			name: "joined allowed if joined at event",
+			vis:  EventVisibility{Visibility: gomatrixserverlib.HistoryVisibilityJoined, MembershipAtEvent: spec.Join, MembershipCurrent: spec.Leave},
+			want: true,
+		},
+		{
+			name: "unknown visibility is denied",
+			vis:  EventVisibility{MembershipAtEvent: spec.Join, MembershipCurrent: spec.Join},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.vis.Allowed(); got != tt.want {
+				t.Errorf("Allowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
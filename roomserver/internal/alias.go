@@ -24,6 +24,7 @@ import (
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/roomserver/internal/helpers"
 	"github.com/neilalexander/harmony/roomserver/types"
@@ -135,66 +136,115 @@ func (r *RoomserverInternalAPI) RemoveRoomAlias(ctx context.Context, senderID sp
 		}
 	}
 
-	ev, err := r.DB.GetStateEvent(ctx, roomID, spec.MRoomCanonicalAlias, "")
-	if err != nil && err != sql.ErrNoRows {
+	if err = r.removeRoomAlias(ctx, *validRoomID, alias, virtualHost); err != nil {
 		return true, false, err
+	}
+	return true, true, nil
+}
+
+// PerformAdminRemoveRoomAlias removes a local alias on behalf of a server
+// administrator, regardless of who created it or the power levels in the room.
+func (r *RoomserverInternalAPI) PerformAdminRemoveRoomAlias(ctx context.Context, alias string) (aliasFound bool, err error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminRemoveRoomAlias")
+	defer span.End()
+
+	roomID, err := r.DB.GetRoomIDForAlias(ctx, alias)
+	if err != nil {
+		return false, fmt.Errorf("r.DB.GetRoomIDForAlias: %w", err)
+	}
+	if roomID == "" {
+		return false, nil
+	}
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return true, err
+	}
+	return true, r.removeRoomAlias(ctx, *validRoomID, alias, r.ServerName)
+}
+
+// removeRoomAlias removes the alias from the room's canonical alias event, if
+// it is listed there, and then deletes the alias.
+func (r *RoomserverInternalAPI) removeRoomAlias(ctx context.Context, roomID spec.RoomID, alias string, virtualHost spec.ServerName) error {
+	ev, err := r.DB.GetStateEvent(ctx, roomID.String(), spec.MRoomCanonicalAlias, "")
+	if err != nil && err != sql.ErrNoRows {
+		return err
 	} else if ev != nil {
-		stateAlias := gjson.GetBytes(ev.Content(), "alias").Str
+		content := ev.Content()
+		changed := false
 		// the alias to remove is currently set as the canonical alias, remove it
-		if stateAlias == alias {
-			res, err := sjson.DeleteBytes(ev.Content(), "alias")
-			if err != nil {
-				return true, false, err
+		if gjson.GetBytes(content, "alias").Str == alias {
+			if content, err = sjson.DeleteBytes(content, "alias"); err != nil {
+				return err
 			}
-
-			canonicalSenderID := ev.SenderID()
-			canonicalSender, err := r.QueryUserIDForSender(ctx, *validRoomID, canonicalSenderID)
-			if err != nil || canonicalSender == nil {
-				return true, false, err
+			changed = true
+		}
+		// the alias to remove is one of the alternative aliases, remove it too
+		if altAliases := gjson.GetBytes(content, "alt_aliases"); altAliases.IsArray() {
+			remaining := []string{}
+			for _, altAlias := range altAliases.Array() {
+				if altAlias.Str != alias {
+					remaining = append(remaining, altAlias.Str)
+				}
 			}
-
-			identity, err := r.SigningIdentityFor(ctx, *canonicalSender)
-			if err != nil {
-				return true, false, err
+			if len(remaining) != len(altAliases.Array()) {
+				if content, err = sjson.SetBytes(content, "alt_aliases", remaining); err != nil {
+					return err
+				}
+				changed = true
 			}
-
-			proto := &gomatrixserverlib.ProtoEvent{
-				SenderID: string(canonicalSenderID),
-				RoomID:   ev.RoomID().String(),
-				Type:     ev.Type(),
-				StateKey: ev.StateKey(),
-				Content:  res,
+		}
+		if changed {
+			if err = r.sendCanonicalAliasUpdate(ctx, roomID, ev, content, virtualHost); err != nil {
+				return err
 			}
+		}
+	}
 
-			eventsNeeded, err := gomatrixserverlib.StateNeededForProtoEvent(proto)
-			if err != nil {
-				return true, false, fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
-			}
-			if len(eventsNeeded.Tuples()) == 0 {
-				return true, false, errors.New("expecting state tuples for event builder, got none")
-			}
+	// Remove the alias from the database
+	return r.DB.RemoveRoomAlias(ctx, alias)
+}
 
-			stateRes := &api.QueryLatestEventsAndStateResponse{}
-			if err = helpers.QueryLatestEventsAndState(ctx, r.DB, r, &api.QueryLatestEventsAndStateRequest{RoomID: roomID, StateToFetch: eventsNeeded.Tuples()}, stateRes); err != nil {
-				return true, false, err
-			}
+// sendCanonicalAliasUpdate replaces the room's canonical alias event with one
+// containing the given content, sent by the sender of the existing event.
+func (r *RoomserverInternalAPI) sendCanonicalAliasUpdate(
+	ctx context.Context, roomID spec.RoomID, ev *types.HeaderedEvent, content []byte, virtualHost spec.ServerName,
+) error {
+	canonicalSenderID := ev.SenderID()
+	canonicalSender, err := r.QueryUserIDForSender(ctx, roomID, canonicalSenderID)
+	if err != nil || canonicalSender == nil {
+		return err
+	}
 
-			newEvent, err := eventutil.BuildEvent(ctx, proto, &identity, time.Now(), &eventsNeeded, stateRes)
-			if err != nil {
-				return true, false, err
-			}
+	identity, err := r.SigningIdentityFor(ctx, *canonicalSender)
+	if err != nil {
+		return err
+	}
 
-			err = api.SendEvents(ctx, r, api.KindNew, []*types.HeaderedEvent{newEvent}, virtualHost, r.ServerName, r.ServerName, nil, false)
-			if err != nil {
-				return true, false, err
-			}
-		}
+	proto := &gomatrixserverlib.ProtoEvent{
+		SenderID: string(canonicalSenderID),
+		RoomID:   ev.RoomID().String(),
+		Type:     ev.Type(),
+		StateKey: ev.StateKey(),
+		Content:  content,
 	}
 
-	// Remove the alias from the database
-	if err := r.DB.RemoveRoomAlias(ctx, alias); err != nil {
-		return true, false, err
+	eventsNeeded, err := gomatrixserverlib.StateNeededForProtoEvent(proto)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
+	}
+	if len(eventsNeeded.Tuples()) == 0 {
+		return errors.New("expecting state tuples for event builder, got none")
 	}
 
-	return true, true, nil
+	stateRes := &api.QueryLatestEventsAndStateResponse{}
+	if err = helpers.QueryLatestEventsAndState(ctx, r.DB, r, &api.QueryLatestEventsAndStateRequest{RoomID: roomID.String(), StateToFetch: eventsNeeded.Tuples()}, stateRes); err != nil {
+		return err
+	}
+
+	newEvent, err := eventutil.BuildEvent(ctx, proto, &identity, time.Now(), &eventsNeeded, stateRes)
+	if err != nil {
+		return err
+	}
+
+	return api.SendEvents(ctx, r, api.KindNew, []*types.HeaderedEvent{newEvent}, virtualHost, r.ServerName, r.ServerName, nil, false)
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/sirupsen/logrus"
 
@@ -176,6 +177,8 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		Inputer: r.Inputer,
 		Queryer: r.Queryer,
 		Leaver:  r.Leaver,
+		Joiner:  r.Joiner,
+		Inviter: r.Inviter,
 	}
 	r.Creator = &perform.Creator{
 		DB:    r.DB,
@@ -186,6 +189,8 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 	if err := r.Inputer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start roomserver input API")
 	}
+
+	r.startDeadRoomCleanup()
 }
 
 func (r *RoomserverInternalAPI) SetUserAPI(userAPI userapi.RoomserverUserAPI) {
@@ -212,12 +217,15 @@ func (r *RoomserverInternalAPI) HandleInvite(
 	if err != nil {
 		return err
 	}
-	return r.OutputProducer.ProduceRoomEvents(inviteEvent.RoomID().String(), outputEvents)
+	return r.OutputProducer.ProduceRoomEvents(ctx, inviteEvent.RoomID().String(), outputEvents)
 }
 
 func (r *RoomserverInternalAPI) PerformCreateRoom(
 	ctx context.Context, userID spec.UserID, roomID spec.RoomID, createRequest *api.PerformCreateRoomRequest,
 ) (string, *util.JSONResponse) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformCreateRoom")
+	defer span.End()
+
 	return r.Creator.PerformCreateRoom(ctx, userID, roomID, createRequest)
 }
 
@@ -225,6 +233,9 @@ func (r *RoomserverInternalAPI) PerformInvite(
 	ctx context.Context,
 	req *api.PerformInviteRequest,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformInvite")
+	defer span.End()
+
 	return r.Inviter.PerformInvite(ctx, req)
 }
 
@@ -233,6 +244,9 @@ func (r *RoomserverInternalAPI) PerformLeave(
 	req *api.PerformLeaveRequest,
 	res *api.PerformLeaveResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformLeave")
+	defer span.End()
+
 	outputEvents, err := r.Leaver.PerformLeave(ctx, req, res)
 	if err != nil {
 		return err
@@ -240,7 +254,7 @@ func (r *RoomserverInternalAPI) PerformLeave(
 	if len(outputEvents) == 0 {
 		return nil
 	}
-	return r.OutputProducer.ProduceRoomEvents(req.RoomID, outputEvents)
+	return r.OutputProducer.ProduceRoomEvents(ctx, req.RoomID, outputEvents)
 }
 
 func (r *RoomserverInternalAPI) PerformForget(
@@ -248,6 +262,9 @@ func (r *RoomserverInternalAPI) PerformForget(
 	req *api.PerformForgetRequest,
 	resp *api.PerformForgetResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformForget")
+	defer span.End()
+
 	return r.Forgetter.PerformForget(ctx, req, resp)
 }
 
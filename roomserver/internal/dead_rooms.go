@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/sirupsen/logrus"
+)
+
+// deadRoomBatchSize is how many rooms are looked at by each query of the
+// dead room cleanup.
+const deadRoomBatchSize = 100
+
+// startDeadRoomCleanup starts looking for dead rooms in the background, if
+// dead room cleanup is enabled. A dead room is one which no local users are
+// joined to, invited to or knocking on, and which has had no new events for a
+// while. Dead rooms are purged from the roomserver and the sync API after a
+// grace period, unless a local user comes back to them first. Both are purged
+// together, so that a room is never left in the roomserver without its
+// history in the sync API.
+func (r *RoomserverInternalAPI) startDeadRoomCleanup() {
+	cfg := &r.Cfg.RoomServer.DeadRoomCleanup
+	if !cfg.Enabled {
+		return
+	}
+	ctx := r.ProcessContext.Context()
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := r.cleanupDeadRooms(ctx); err != nil && ctx.Err() == nil {
+				logrus.WithError(err).Error("Failed to clean up dead rooms")
+			}
+		}
+	}()
+}
+
+func (r *RoomserverInternalAPI) cleanupDeadRooms(ctx context.Context) error {
+	cfg := &r.Cfg.RoomServer.DeadRoomCleanup
+	now := time.Now()
+
+	// Rooms which local users have come back to shouldn't be purged, and
+	// should be looked at afresh if they are abandoned again.
+	if err := r.DB.ForgetRevivedDeadRooms(ctx); err != nil {
+		return err
+	}
+
+	inactiveSince := spec.AsTimestamp(now.Add(-cfg.InactiveFor))
+	found := 0
+	var afterRoomNID types.RoomNID
+	for {
+		roomNIDs, roomIDs, err := r.DB.RoomsWithoutLocalMembers(ctx, afterRoomNID, deadRoomBatchSize)
+		if err != nil {
+			return err
+		}
+		for i, roomNID := range roomNIDs {
+			lastActive, err := r.lastActivity(ctx, roomNID)
+			if err != nil {
+				logrus.WithError(err).WithField("room_id", roomIDs[i]).Warn("Failed to find last activity of room")
+				continue
+			}
+			if lastActive > inactiveSince {
+				continue
+			}
+			if err = r.DB.MarkRoomDead(ctx, roomIDs[i], spec.AsTimestamp(now)); err != nil {
+				return err
+			}
+			found++
+		}
+		if len(roomNIDs) < deadRoomBatchSize {
+			break
+		}
+		afterRoomNID = roomNIDs[len(roomNIDs)-1]
+	}
+	if found > 0 {
+		logrus.Infof("Found %d dead rooms, which will be purged in %s", found, cfg.PurgeAfter)
+	}
+
+	purgeBefore := spec.AsTimestamp(now.Add(-cfg.PurgeAfter))
+	for {
+		roomIDs, err := r.DB.DeadRoomsBefore(ctx, purgeBefore, deadRoomBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, roomID := range roomIDs {
+			if err = r.PerformAdminPurgeRoom(ctx, roomID); err != nil {
+				return err
+			}
+		}
+		if len(roomIDs) < deadRoomBatchSize {
+			return nil
+		}
+	}
+}
+
+// lastActivity returns the newest origin_server_ts of the forward extremities
+// of the room, or zero if we have no events for it.
+func (r *RoomserverInternalAPI) lastActivity(ctx context.Context, roomNID types.RoomNID) (spec.Timestamp, error) {
+	roomInfo, err := r.DB.RoomInfoByNID(ctx, roomNID)
+	if err != nil {
+		return 0, err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return 0, nil
+	}
+	eventIDs, _, _, err := r.DB.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		return 0, err
+	}
+	events, err := r.DB.EventsFromIDs(ctx, roomInfo, eventIDs)
+	if err != nil {
+		return 0, err
+	}
+	var lastActive spec.Timestamp
+	for _, event := range events {
+		if ts := event.OriginServerTS(); ts > lastActive {
+			lastActive = ts
+		}
+	}
+	return lastActive, nil
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/internal/input"
+	"github.com/neilalexander/harmony/roomserver/internal/perform"
+	"github.com/neilalexander/harmony/roomserver/producers"
+	"github.com/neilalexander/harmony/roomserver/storage"
+	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/jetstream"
+)
+
+// deadRoomsDatabase has rooms without any local members or events, which
+// are all inactive, and records which are marked dead and purged.
+type deadRoomsDatabase struct {
+	storage.Database
+	withoutMembers map[string]types.RoomNID
+	dead           map[string]spec.Timestamp
+	purged         []string
+}
+
+func (d *deadRoomsDatabase) ForgetRevivedDeadRooms(ctx context.Context) error {
+	for roomID := range d.dead {
+		if _, ok := d.withoutMembers[roomID]; !ok {
+			delete(d.dead, roomID)
+		}
+	}
+	return nil
+}
+
+func (d *deadRoomsDatabase) RoomsWithoutLocalMembers(ctx context.Context, afterRoomNID types.RoomNID, limit int) ([]types.RoomNID, []string, error) {
+	var roomNIDs []types.RoomNID
+	var roomIDs []string
+	for roomID, roomNID := range d.withoutMembers {
+		if _, ok := d.dead[roomID]; !ok && roomNID > afterRoomNID {
+			roomNIDs = append(roomNIDs, roomNID)
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	return roomNIDs, roomIDs, nil
+}
+
+func (d *deadRoomsDatabase) RoomInfoByNID(ctx context.Context, roomNID types.RoomNID) (*types.RoomInfo, error) {
+	return nil, nil
+}
+
+func (d *deadRoomsDatabase) MarkRoomDead(ctx context.Context, roomID string, detectedAt spec.Timestamp) error {
+	d.dead[roomID] = detectedAt
+	return nil
+}
+
+func (d *deadRoomsDatabase) DeadRoomsBefore(ctx context.Context, before spec.Timestamp, limit int) ([]string, error) {
+	var roomIDs []string
+	for roomID, detectedAt := range d.dead {
+		if _, ok := d.withoutMembers[roomID]; ok && detectedAt < before {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	return roomIDs, nil
+}
+
+func (d *deadRoomsDatabase) PurgeRoom(ctx context.Context, roomID string) error {
+	d.purged = append(d.purged, roomID)
+	delete(d.withoutMembers, roomID)
+	delete(d.dead, roomID)
+	return nil
+}
+
+// outputJetStream records the types of the output events which are published.
+type outputJetStream struct {
+	nats.JetStreamContext
+	published []api.OutputType
+}
+
+func (js *outputJetStream) PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	js.published = append(js.published, api.OutputType(m.Header.Get(jetstream.RoomEventType)))
+	return &nats.PubAck{}, nil
+}
+
+func TestCleanupDeadRooms(t *testing.T) {
+	db := &deadRoomsDatabase{
+		withoutMembers: map[string]types.RoomNID{"!dead:test": 1, "!revived:test": 2},
+		dead:           map[string]spec.Timestamp{},
+	}
+	js := &outputJetStream{}
+	cfg := &config.Dendrite{}
+	cfg.RoomServer.DeadRoomCleanup = config.DeadRoomCleanup{
+		Enabled:     true,
+		Interval:    time.Hour,
+		InactiveFor: time.Hour,
+		PurgeAfter:  time.Hour,
+	}
+	r := &RoomserverInternalAPI{
+		DB:  db,
+		Cfg: cfg,
+		Admin: &perform.Admin{
+			DB: db,
+			Inputer: &input.Inputer{
+				OutputProducer: &producers.RoomEventProducer{JetStream: js},
+			},
+		},
+	}
+	ctx := context.Background()
+
+	// Dead rooms are only marked at first, and nothing is purged from the
+	// roomserver or the sync API.
+	if err := r.cleanupDeadRooms(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.dead) != 2 || len(db.purged) != 0 || len(js.published) != 0 {
+		t.Fatalf("expected both rooms to be marked dead and nothing purged, got %v dead, %v purged, %v published", db.dead, db.purged, js.published)
+	}
+
+	// A local user comes back to one of the rooms before the grace period
+	// is over, so only the other is purged, from both the roomserver and the
+	// sync API.
+	delete(db.withoutMembers, "!revived:test")
+	for roomID := range db.dead {
+		db.dead[roomID] = spec.AsTimestamp(time.Now().Add(-2 * time.Hour))
+	}
+	if err := r.cleanupDeadRooms(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.purged) != 1 || db.purged[0] != "!dead:test" {
+		t.Fatalf("expected only the dead room to be purged, got %v", db.purged)
+	}
+	if len(js.published) != 1 || js.published[0] != api.OutputTypePurgeRoom {
+		t.Fatalf("expected the sync API to be told to purge the room, got %v", js.published)
+	}
+	if _, ok := db.dead["!revived:test"]; ok {
+		t.Fatalf("expected the revived room to be forgotten")
+	}
+}
@@ -38,7 +38,7 @@ func CheckForSoftFail(
 	event *types.HeaderedEvent,
 	stateEventIDs []string,
 	querier api.QuerySenderIDAPI,
-) (bool, error) {
+) (bool, []string, error) {
 	rewritesState := len(stateEventIDs) > 1
 
 	var authStateEntries []types.StateEntry
@@ -46,7 +46,7 @@ func CheckForSoftFail(
 	if rewritesState {
 		authStateEntries, err = db.StateEntriesForEventIDs(ctx, stateEventIDs, true)
 		if err != nil {
-			return true, fmt.Errorf("StateEntriesForEventIDs failed: %w", err)
+			return true, nil, fmt.Errorf("StateEntriesForEventIDs failed: %w", err)
 		}
 	} else {
 		// Then get the state entries for the current state snapshot.
@@ -54,7 +54,7 @@ func CheckForSoftFail(
 		roomState := state.NewStateResolution(db, roomInfo, querier)
 		authStateEntries, err = roomState.LoadStateAtSnapshot(ctx, roomInfo.StateSnapshotNID())
 		if err != nil {
-			return true, fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+			return true, nil, fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
 		}
 	}
 
@@ -63,7 +63,7 @@ func CheckForSoftFail(
 	// If we're now processing the first create event then never
 	// soft-fail it.
 	if len(authStateEntries) == 0 && event.Type() == spec.MRoomCreate {
-		return false, nil
+		return false, nil, nil
 	}
 
 	// Work out which of the state events we actually need.
@@ -74,17 +74,16 @@ func CheckForSoftFail(
 	// Load the actual auth events from the database.
 	authEvents, err := loadAuthEvents(ctx, db, roomInfo.RoomVersion, stateNeeded, authStateEntries)
 	if err != nil {
-		return true, fmt.Errorf("loadAuthEvents: %w", err)
+		return true, nil, fmt.Errorf("loadAuthEvents: %w", err)
 	}
 
 	// Check if the event is allowed.
 	if err = gomatrixserverlib.Allowed(event.PDU, &authEvents, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return querier.QueryUserIDForSender(ctx, roomID, senderID)
 	}); err != nil {
-		// return true, nil
-		return true, err
+		return true, authEvents.eventIDs(), err
 	}
-	return false, nil
+	return false, nil, nil
 }
 
 // GetAuthEvents returns the numeric IDs for the auth events.
@@ -150,6 +149,16 @@ func (ae *authEvents) ThirdPartyInvite(stateKey string) (gomatrixserverlib.PDU,
 	return ae.lookupEvent(types.MRoomThirdPartyInviteNID, stateKey), nil
 }
 
+// eventIDs returns the IDs of the loaded auth events, sorted.
+func (ae *authEvents) eventIDs() []string {
+	eventIDs := make([]string, 0, len(ae.events))
+	for _, event := range ae.events {
+		eventIDs = append(eventIDs, event.EventID())
+	}
+	sort.Strings(eventIDs)
+	return eventIDs
+}
+
 func (ae *authEvents) lookupEventWithEmptyStateKey(typeNID types.EventTypeNID) gomatrixserverlib.PDU {
 	eventNID, ok := ae.state.lookup(types.StateKeyTuple{
 		EventTypeNID:     typeNID,
@@ -165,50 +165,80 @@ func IsInvitePending(
 func GetMembershipsAtState(
 	ctx context.Context, db storage.RoomDatabase, roomInfo *types.RoomInfo, stateEntries []types.StateEntry, joinedOnly bool,
 ) ([]types.Event, error) {
+	events, _, err := GetMembershipsAtStatePage(ctx, db, roomInfo, stateEntries, joinedOnly, 0, 0)
+	return events, err
+}
+
+// GetMembershipsAtStatePage is like GetMembershipsAtState, but only returns up to
+// limit membership events with numeric IDs after the given one, in order. Events
+// are loaded a page at a time rather than all at once. The numeric ID to pass to
+// get the next page is returned, or zero if there are no more. If limit is zero
+// then all of the membership events are returned.
+func GetMembershipsAtStatePage(
+	ctx context.Context, db storage.RoomDatabase, roomInfo *types.RoomInfo, stateEntries []types.StateEntry,
+	joinedOnly bool, afterEventNID types.EventNID, limit int,
+) ([]types.Event, types.EventNID, error) {
 
 	var eventNIDs types.EventNIDs
 	for _, entry := range stateEntries {
 		// Filter the events to retrieve to only keep the membership events
-		if entry.EventTypeNID == types.MRoomMemberNID {
+		if entry.EventTypeNID == types.MRoomMemberNID && entry.EventNID > afterEventNID {
 			eventNIDs = append(eventNIDs, entry.EventNID)
 		}
 	}
 
 	// There are no events to get, don't bother asking the database
 	if len(eventNIDs) == 0 {
-		return []types.Event{}, nil
+		return []types.Event{}, 0, nil
 	}
 
 	sort.Sort(eventNIDs)
-	util.Unique(eventNIDs)
+	eventNIDs = eventNIDs[:util.Unique(eventNIDs)]
 
-	// Get all of the events in this state
 	if roomInfo == nil {
-		return nil, types.ErrorInvalidRoomInfo
+		return nil, 0, types.ErrorInvalidRoomInfo
 	}
-	stateEvents, err := db.Events(ctx, roomInfo.RoomVersion, eventNIDs)
-	if err != nil {
-		return nil, err
-	}
-
-	if !joinedOnly {
-		return stateEvents, nil
+	pageSize := limit
+	if pageSize <= 0 {
+		pageSize = len(eventNIDs)
 	}
 
-	// Filter the events to only keep the "join" membership events
-	var events []types.Event
-	for _, event := range stateEvents {
-		membership, err := event.Membership()
+	// Get the events in this state a page at a time, until there are
+	// enough of them
+	events := []types.Event{}
+	for start := 0; start < len(eventNIDs); start += pageSize {
+		end := start + pageSize
+		if end > len(eventNIDs) {
+			end = len(eventNIDs)
+		}
+		stateEvents, err := db.Events(ctx, roomInfo.RoomVersion, eventNIDs[start:end])
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-
-		if membership == spec.Join {
+		sort.Slice(stateEvents, func(i, j int) bool { return stateEvents[i].EventNID < stateEvents[j].EventNID })
+
+		for _, event := range stateEvents {
+			if joinedOnly {
+				// Filter the events to only keep the "join" membership events
+				membership, err := event.Membership()
+				if err != nil {
+					return nil, 0, err
+				}
+				if membership != spec.Join {
+					continue
+				}
+			}
 			events = append(events, event)
+			if limit > 0 && len(events) == limit {
+				if event.EventNID == eventNIDs[len(eventNIDs)-1] {
+					return events, 0, nil
+				}
+				return events, event.EventNID, nil
+			}
 		}
 	}
 
-	return events, nil
+	return events, 0, nil
 }
 
 func StateBeforeEvent(ctx context.Context, db storage.Database, info *types.RoomInfo, eventNID types.EventNID, querier api.QuerySenderIDAPI) ([]types.StateEntry, error) {
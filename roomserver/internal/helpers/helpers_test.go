@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/neilalexander/harmony/internal/caching"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/setup/config"
@@ -69,3 +70,75 @@ func TestIsInvitePendingWithoutNID(t *testing.T) {
 		assert.False(t, pendingInvite, "unexpected pending invite")
 	})
 }
+
+// membershipsDB serves the events from the room by NID, keeping track of
+// how many are asked for at once.
+type membershipsDB struct {
+	storage.RoomDatabase
+	events     map[types.EventNID]*types.HeaderedEvent
+	largestGet int
+}
+
+func (d *membershipsDB) Events(ctx context.Context, roomVersion gomatrixserverlib.RoomVersion, eventNIDs []types.EventNID) ([]types.Event, error) {
+	if len(eventNIDs) > d.largestGet {
+		d.largestGet = len(eventNIDs)
+	}
+	events := make([]types.Event, 0, len(eventNIDs))
+	for _, eventNID := range eventNIDs {
+		events = append(events, types.Event{EventNID: eventNID, PDU: d.events[eventNID].PDU})
+	}
+	return events, nil
+}
+
+func TestGetMembershipsAtStatePage(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	db := &membershipsDB{events: map[types.EventNID]*types.HeaderedEvent{}}
+	var stateEntries []types.StateEntry
+	addMember := func(eventNID types.EventNID, user *test.User, membership string) {
+		ev := room.CreateAndInsert(t, user, spec.MRoomMember, map[string]interface{}{
+			"membership": membership,
+		}, test.WithStateKey(user.ID))
+		db.events[eventNID] = ev
+		stateEntries = append(stateEntries, types.StateEntry{
+			StateKeyTuple: types.StateKeyTuple{EventTypeNID: types.MRoomMemberNID},
+			EventNID:      eventNID,
+		})
+	}
+	// Every other member has left the room.
+	for i := 1; i <= 10; i++ {
+		membership := spec.Join
+		if i%2 == 0 {
+			membership = spec.Leave
+		}
+		addMember(types.EventNID(i), test.NewUser(t), membership)
+	}
+	roomInfo := &types.RoomInfo{RoomVersion: room.Version}
+
+	// The joined members are returned two at a time, without loading more
+	// than a page of events at once.
+	var joined []types.EventNID
+	var after types.EventNID
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		events, next, err := GetMembershipsAtStatePage(context.Background(), db, roomInfo, stateEntries, true, after, 2)
+		assert.NoError(t, err)
+		for _, ev := range events {
+			joined = append(joined, ev.EventNID)
+		}
+		if next == 0 {
+			break
+		}
+		after = next
+	}
+	assert.Equal(t, []types.EventNID{1, 3, 5, 7, 9}, joined)
+	assert.Equal(t, 2, db.largestGet)
+
+	// Without a limit, all of the members are returned.
+	events, next, err := GetMembershipsAtStatePage(context.Background(), db, roomInfo, stateEntries, false, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, events, 10)
+	assert.Equal(t, types.EventNID(0), next)
+}
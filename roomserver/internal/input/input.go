@@ -32,8 +32,10 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
 	fedapi "github.com/neilalexander/harmony/federationapi/api"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/roomserver/acls"
 	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/roomserver/internal/query"
@@ -88,6 +90,7 @@ type Inputer struct {
 	InputRoomEventTopic string
 	OutputProducer      *producers.RoomEventProducer
 	workers             sync.Map // room ID -> *worker
+	authRejections      authRejections
 
 	Queryer       *query.Queryer
 	UserAPI       userapi.RoomserverUserAPI
@@ -255,6 +258,11 @@ func (r *Inputer) Start() error {
 		}
 	}
 
+	// If the input stream has lost the journalled events then queue them again.
+	if rerr := r.replayLostInputQueue(r.ProcessContext.Context()); rerr != nil {
+		logrus.WithError(rerr).Error("Failed to replay the input queue journal")
+	}
+
 	return err
 }
 
@@ -305,6 +313,14 @@ func (w *worker) _next() {
 		return
 	}
 
+	// If the process is already closing then leave the message alone, so
+	// that it is redelivered after restarting. Otherwise processing is
+	// allowed to finish even if the process starts shutting down.
+	if !w.r.ProcessContext.WorkStarted() {
+		return
+	}
+	defer w.r.ProcessContext.WorkFinished()
+
 	// Since we either Ack() or Term() the message at this point, we can defer decrementing the room backpressure
 	defer roomserverInputBackpressure.With(prometheus.Labels{"room_id": w.roomID}).Dec()
 
@@ -316,6 +332,8 @@ func (w *worker) _next() {
 	if err = json.Unmarshal(msg.Data, &inputRoomEvent); err != nil {
 		// using AckWait here makes the call synchronous; 5 seconds is the default value used by NATS
 		_ = msg.Term(nats.AckWait(time.Second * 5))
+		// Otherwise the journalled event would be replayed and terminated again forever.
+		w.r.forgetInputEvent(w.r.ProcessContext.Context(), msg.Header.Get(jetstream.EventID), msg.Data)
 		return
 	}
 
@@ -324,21 +342,28 @@ func (w *worker) _next() {
 	// a string, because we might want to return that to the caller if
 	// it was a synchronous request.
 	var errString string
-	if err = w.r.processRoomEvent(
-		w.r.ProcessContext.Context(),
+	processCtx, span := tracing.StartSpan(
+		tracing.ExtractNATS(context.WithoutCancel(w.r.ProcessContext.Context()), msg), "roomserver.processRoomEvent",
+		attribute.String("room_id", w.roomID),
+		attribute.String("event_id", inputRoomEvent.Event.EventID()),
+	)
+	err = w.r.processRoomEvent(
+		processCtx,
 		spec.ServerName(msg.Header.Get("virtual_host")),
 		&inputRoomEvent,
-	); err != nil {
+	)
+	tracing.EndSpan(span, err)
+	if err != nil {
 		switch err.(type) {
 		case types.RejectedError:
 			// Don't send events that were rejected to Sentry
-			logrus.WithError(err).WithFields(logrus.Fields{
+			logrus.WithContext(processCtx).WithError(err).WithFields(logrus.Fields{
 				"room_id":  w.roomID,
 				"event_id": inputRoomEvent.Event.EventID(),
 				"type":     inputRoomEvent.Event.Type(),
 			}).Warn("Roomserver rejected event")
 		default:
-			logrus.WithError(err).WithFields(logrus.Fields{
+			logrus.WithContext(processCtx).WithError(err).WithFields(logrus.Fields{
 				"room_id":  w.roomID,
 				"event_id": inputRoomEvent.Event.EventID(),
 				"type":     inputRoomEvent.Event.Type(),
@@ -349,10 +374,12 @@ func (w *worker) _next() {
 		// after restarting. We only Ack if the context was not yet canceled.
 		if w.r.ProcessContext.Context().Err() == nil {
 			_ = msg.AckSync()
+			w.r.forgetInputEvent(processCtx, inputRoomEvent.Event.EventID(), msg.Data)
 		}
 		errString = err.Error()
 	} else {
 		_ = msg.AckSync()
+		w.r.forgetInputEvent(processCtx, inputRoomEvent.Event.EventID(), msg.Data)
 	}
 
 	// If it was a synchronous input request then the "sync" field
@@ -363,7 +390,7 @@ func (w *worker) _next() {
 	// that everything was OK.
 	if replyTo := msg.Header.Get("sync"); replyTo != "" {
 		if err = w.r.NATSClient.Publish(replyTo, []byte(errString)); err != nil {
-			logrus.WithError(err).WithFields(logrus.Fields{
+			logrus.WithContext(processCtx).WithError(err).WithFields(logrus.Fields{
 				"room_id":  w.roomID,
 				"event_id": inputRoomEvent.Event.EventID(),
 				"type":     inputRoomEvent.Event.Type(),
@@ -401,41 +428,79 @@ func (r *Inputer) queueInputRoomEvents(
 	// send it into the input queue.
 	for _, e := range request.InputRoomEvents {
 		roomID := e.Event.RoomID().String()
-		subj := r.Cfg.Matrix.JetStream.Prefixed(jetstream.InputRoomEventSubj(roomID))
-		msg := &nats.Msg{
-			Subject: subj,
-			Header:  nats.Header{},
-		}
-		msg.Header.Set("room_id", roomID)
-		if replyTo != "" {
-			msg.Header.Set("sync", replyTo)
-		}
-		msg.Header.Set("virtual_host", string(request.VirtualHost))
-		msg.Data, err = json.Marshal(e)
+		data, err := json.Marshal(e)
 		if err != nil {
 			return nil, fmt.Errorf("json.Marshal: %w", err)
 		}
-		if _, err = r.JetStream.PublishMsg(msg, nats.Context(ctx)); err != nil {
-			logrus.WithError(err).WithFields(logrus.Fields{
+
+		// If the input queue is persisted then journal the event first, so
+		// that it can be replayed if it is lost from the stream. There's no
+		// need to queue an asynchronous event which is already waiting to
+		// be processed with the same kind and state, but a synchronous one
+		// is queued again so that the caller gets a response.
+		journalled := false
+		if r.Cfg.PersistInputQueue {
+			journalled, err = r.DB.JournalInputEvent(ctx, e.Event.EventID(), roomID, request.VirtualHost, data)
+			if err != nil {
+				return nil, fmt.Errorf("r.DB.JournalInputEvent: %w", err)
+			}
+			if !journalled && replyTo == "" {
+				continue
+			}
+		}
+
+		if err = r.publishInputRoomEvent(ctx, e.Event.EventID(), roomID, request.VirtualHost, replyTo, data); err != nil {
+			logrus.WithContext(ctx).WithError(err).WithFields(logrus.Fields{
 				"room_id":  roomID,
 				"event_id": e.Event.EventID(),
-				"subj":     subj,
 			}).Error("Roomserver failed to queue async event")
-			return nil, fmt.Errorf("r.JetStream.PublishMsg: %w", err)
+			// The caller has been told that the event wasn't queued, so it
+			// mustn't be replayed later. Only the entry that we added is
+			// removed, as an existing one is still waiting in the stream.
+			if journalled {
+				r.forgetInputEvent(context.WithoutCancel(ctx), e.Event.EventID(), data)
+			}
+			return nil, err
 		}
-
-		// Now that the event is queued, increment the room backpressure
-		roomserverInputBackpressure.With(prometheus.Labels{"room_id": roomID}).Inc()
 	}
 	return
 }
 
+// publishInputRoomEvent publishes a marshalled input room event into the
+// roomserver input stream.
+func (r *Inputer) publishInputRoomEvent(
+	ctx context.Context, eventID, roomID string, virtualHost spec.ServerName, replyTo string, data []byte,
+) error {
+	msg := &nats.Msg{
+		Subject: r.Cfg.Matrix.JetStream.Prefixed(jetstream.InputRoomEventSubj(roomID)),
+		Header:  nats.Header{},
+		Data:    data,
+	}
+	msg.Header.Set("room_id", roomID)
+	msg.Header.Set(jetstream.EventID, eventID)
+	if replyTo != "" {
+		msg.Header.Set("sync", replyTo)
+	}
+	msg.Header.Set("virtual_host", string(virtualHost))
+	tracing.InjectNATS(ctx, msg)
+	if _, err := r.JetStream.PublishMsg(msg, nats.Context(ctx)); err != nil {
+		return fmt.Errorf("r.JetStream.PublishMsg: %w", err)
+	}
+
+	// Now that the event is queued, increment the room backpressure
+	roomserverInputBackpressure.With(prometheus.Labels{"room_id": roomID}).Inc()
+	return nil
+}
+
 // InputRoomEvents implements api.RoomserverInternalAPI
 func (r *Inputer) InputRoomEvents(
 	ctx context.Context,
 	request *api.InputRoomEventsRequest,
 	response *api.InputRoomEventsResponse,
 ) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.InputRoomEvents")
+	defer span.End()
+
 	// Queue up the event into the roomserver.
 	replySub, err := r.queueInputRoomEvents(ctx, request)
 	if err != nil {
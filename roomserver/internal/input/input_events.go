@@ -218,6 +218,7 @@ func (r *Inputer) processRoomEvent(
 
 	isRejected := false
 	var rejectionErr error
+	var rejectionState []string // the state that the event failed auth against
 
 	// Check if the event is allowed by its auth events. If it isn't then
 	// we consider the event to be "rejected" — it will still be persisted.
@@ -226,6 +227,7 @@ func (r *Inputer) processRoomEvent(
 	}); err != nil {
 		isRejected = true
 		rejectionErr = err
+		rejectionState = authEvents.EventIDs()
 		logger.WithError(rejectionErr).Warnf("Event %s not allowed by auth events", event.EventID())
 	}
 
@@ -332,12 +334,14 @@ func (r *Inputer) processRoomEvent(
 	}
 
 	var softfail bool
+	var softfailErr error
+	var softfailState []string
 	if input.Kind == api.KindNew && !isCreateEvent {
 		// Check that the event passes authentication checks based on the
 		// current room state.
-		softfail, err = helpers.CheckForSoftFail(ctx, r.DB, roomInfo, headered, input.StateEventIDs, r.Queryer)
-		if err != nil {
-			logger.WithError(err).Warn("Error authing soft-failed event")
+		softfail, softfailState, softfailErr = helpers.CheckForSoftFail(ctx, r.DB, roomInfo, headered, input.StateEventIDs, r.Queryer)
+		if softfailErr != nil {
+			logger.WithError(softfailErr).Warn("Error authing soft-failed event")
 		}
 	}
 
@@ -347,7 +351,7 @@ func (r *Inputer) processRoomEvent(
 	// burning CPU time.
 	historyVisibility := gomatrixserverlib.HistoryVisibilityShared // Default to shared.
 	if input.Kind != api.KindOutlier && rejectionErr == nil && !isRejected && !isCreateEvent {
-		historyVisibility, rejectionErr, err = r.processStateBefore(ctx, roomInfo, input, missingPrev)
+		historyVisibility, rejectionErr, rejectionState, err = r.processStateBefore(ctx, roomInfo, input, missingPrev)
 		if err != nil {
 			return fmt.Errorf("r.processStateBefore: %w", err)
 		}
@@ -430,13 +434,18 @@ func (r *Inputer) processRoomEvent(
 	switch {
 	case isRejected:
 		logger.WithError(rejectionErr).Warn("Stored rejected event")
+		r.recordAuthRejection(input, false, rejectionErr, rejectionState)
 		if rejectionErr != nil {
 			return types.RejectedError(rejectionErr.Error())
 		}
 		return nil
 
 	case softfail:
+		if err = r.DB.SetEventSoftFailed(ctx, eventNID); err != nil {
+			return fmt.Errorf("r.DB.SetEventSoftFailed: %w", err)
+		}
 		logger.WithError(rejectionErr).Warn("Stored soft-failed event")
+		r.recordAuthRejection(input, true, softfailErr, softfailState)
 		if rejectionErr != nil {
 			return types.RejectedError(rejectionErr.Error())
 		}
@@ -458,7 +467,7 @@ func (r *Inputer) processRoomEvent(
 			return fmt.Errorf("r.updateLatestEvents: %w", err)
 		}
 	case api.KindOld:
-		err = r.OutputProducer.ProduceRoomEvents(event.RoomID().String(), []api.OutputEvent{
+		err = r.OutputProducer.ProduceRoomEvents(ctx, event.RoomID().String(), []api.OutputEvent{
 			{
 				Type: api.OutputTypeOldRoomEvent,
 				OldRoomEvent: &api.OutputOldRoomEvent{
@@ -511,7 +520,7 @@ func (r *Inputer) processRoomEvent(
 	// so notify downstream components to redact this event - they should have it if they've
 	// been tracking our output log.
 	if redactedEventID != "" {
-		err = r.OutputProducer.ProduceRoomEvents(event.RoomID().String(), []api.OutputEvent{
+		err = r.OutputProducer.ProduceRoomEvents(ctx, event.RoomID().String(), []api.OutputEvent{
 			{
 				Type: api.OutputTypeRedactedEvent,
 				RedactedEvent: &api.OutputRedactedEvent{
@@ -556,7 +565,7 @@ func (r *Inputer) processStateBefore(
 	roomInfo *types.RoomInfo,
 	input *api.InputRoomEvent,
 	missingPrev bool,
-) (historyVisibility gomatrixserverlib.HistoryVisibility, rejectionErr error, err error) {
+) (historyVisibility gomatrixserverlib.HistoryVisibility, rejectionErr error, rejectionState []string, err error) {
 	historyVisibility = gomatrixserverlib.HistoryVisibilityShared // Default to shared.
 	event := input.Event.PDU
 	isCreateEvent := event.Type() == spec.MRoomCreate && event.StateKeyEquals("")
@@ -571,7 +580,7 @@ func (r *Inputer) processStateBefore(
 		// them from the database. It's a hard error if they are missing.
 		stateEvents, err := r.DB.EventsFromIDs(ctx, roomInfo, input.StateEventIDs)
 		if err != nil {
-			return "", nil, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+			return "", nil, nil, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
 		}
 		stateBeforeEvent = make([]gomatrixserverlib.PDU, 0, len(stateEvents))
 		for _, entry := range stateEvents {
@@ -606,7 +615,7 @@ func (r *Inputer) processStateBefore(
 		}
 		stateBeforeRes := &api.QueryStateAfterEventsResponse{}
 		if err := r.Queryer.QueryStateAfterEvents(ctx, stateBeforeReq, stateBeforeRes); err != nil {
-			return "", nil, fmt.Errorf("r.Queryer.QueryStateAfterEvents: %w", err)
+			return "", nil, nil, fmt.Errorf("r.Queryer.QueryStateAfterEvents: %w", err)
 		}
 		switch {
 		case !stateBeforeRes.RoomExists:
@@ -636,6 +645,7 @@ func (r *Inputer) processStateBefore(
 		return r.Queryer.QueryUserIDForSender(ctx, roomID, senderID)
 	}); rejectionErr != nil {
 		rejectionErr = fmt.Errorf("Allowed() failed for stateBeforeEvent: %w", rejectionErr)
+		rejectionState = stateBeforeAuth.EventIDs()
 		return
 	}
 	// Work out what the history visibility was at the time of the
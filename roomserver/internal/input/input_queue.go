@@ -0,0 +1,80 @@
+package input
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/internal/tracing"
+)
+
+// replayInputQueueBatchSize is how many journalled input events are read
+// from the database at a time when replaying them.
+const replayInputQueueBatchSize = 100
+
+// forgetInputEvent removes a processed event from the input queue journal.
+// If this fails then the event is only replayed again needlessly, which is
+// harmless, so the error is just logged.
+func (r *Inputer) forgetInputEvent(ctx context.Context, eventID string, inputJSON []byte) {
+	if !r.Cfg.PersistInputQueue || eventID == "" {
+		return
+	}
+	if err := r.DB.ForgetInputEvent(ctx, eventID, inputJSON); err != nil {
+		logrus.WithContext(ctx).WithError(err).WithField("event_id", eventID).Warn("Failed to remove event from the input queue journal")
+	}
+}
+
+// replayLostInputQueue replays the journalled input events if the input
+// stream is empty, as then none of them can still be waiting in it.
+func (r *Inputer) replayLostInputQueue(ctx context.Context) error {
+	if !r.Cfg.PersistInputQueue {
+		return nil
+	}
+	info, err := r.JetStream.StreamInfo(r.InputRoomEventTopic)
+	if err != nil {
+		return fmt.Errorf("r.JetStream.StreamInfo: %w", err)
+	}
+	if info.State.Msgs > 0 {
+		return nil
+	}
+	replayed, err := r.replayInputQueue(ctx)
+	if replayed > 0 {
+		logrus.Warnf("The roomserver input stream was empty, so replayed %d events from the input queue journal", replayed)
+	}
+	return err
+}
+
+// PerformAdminReplayInputQueue queues every journalled input event again,
+// returning how many were queued. Events which have already been processed
+// are skipped by the workers, so this is safe to do at any time.
+func (r *Inputer) PerformAdminReplayInputQueue(ctx context.Context) (int, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminReplayInputQueue")
+	defer span.End()
+
+	if !r.Cfg.PersistInputQueue {
+		return 0, fmt.Errorf("the input queue isn't persisted, enable room_server.persist_input_queue to use this")
+	}
+	return r.replayInputQueue(ctx)
+}
+
+func (r *Inputer) replayInputQueue(ctx context.Context) (int, error) {
+	var afterID int64
+	replayed := 0
+	for {
+		entries, err := r.DB.JournalledInputEvents(ctx, afterID, replayInputQueueBatchSize)
+		if err != nil {
+			return replayed, fmt.Errorf("r.DB.JournalledInputEvents: %w", err)
+		}
+		if len(entries) == 0 {
+			return replayed, nil
+		}
+		for _, entry := range entries {
+			if err = r.publishInputRoomEvent(ctx, entry.EventID, entry.RoomID, entry.VirtualHost, "", entry.InputJSON); err != nil {
+				return replayed, err
+			}
+			replayed++
+			afterID = entry.ID
+		}
+	}
+}
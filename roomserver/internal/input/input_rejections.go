@@ -0,0 +1,91 @@
+package input
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
+	"github.com/neilalexander/harmony/roomserver/api"
+)
+
+const (
+	// maxAuthRejectionsPerRoom is how many rejected or soft-failed events
+	// are remembered for each room.
+	maxAuthRejectionsPerRoom = 50
+	// maxAuthRejectionRooms is how many rooms rejections are remembered for,
+	// after which the room with the oldest rejection is forgotten.
+	maxAuthRejectionRooms = 1000
+)
+
+// authRejections remembers the most recent events which failed auth in each
+// room, so that operators can find out why without trawling through logs.
+type authRejections struct {
+	sync.Mutex
+	rooms map[string][]api.AuthRejection // room ID -> rejections, oldest first
+}
+
+func (a *authRejections) add(roomID string, rejection api.AuthRejection) {
+	a.Lock()
+	defer a.Unlock()
+	if a.rooms == nil {
+		a.rooms = make(map[string][]api.AuthRejection)
+	}
+	rejections, ok := a.rooms[roomID]
+	if !ok && len(a.rooms) >= maxAuthRejectionRooms {
+		oldestRoomID := ""
+		for otherRoomID, other := range a.rooms {
+			if oldestRoomID == "" || other[len(other)-1].Timestamp < a.rooms[oldestRoomID][len(a.rooms[oldestRoomID])-1].Timestamp {
+				oldestRoomID = otherRoomID
+			}
+		}
+		delete(a.rooms, oldestRoomID)
+	}
+	if len(rejections) >= maxAuthRejectionsPerRoom {
+		rejections = rejections[len(rejections)-maxAuthRejectionsPerRoom+1:]
+	}
+	a.rooms[roomID] = append(rejections, rejection)
+}
+
+func (a *authRejections) forRoom(roomID string) []api.AuthRejection {
+	a.Lock()
+	defer a.Unlock()
+	rejections := a.rooms[roomID]
+	res := make([]api.AuthRejection, 0, len(rejections))
+	for i := len(rejections) - 1; i >= 0; i-- {
+		res = append(res, rejections[i])
+	}
+	return res
+}
+
+// recordAuthRejection remembers why an incoming event was rejected or soft-failed.
+func (r *Inputer) recordAuthRejection(input *api.InputRoomEvent, softFailed bool, reason error, stateEventIDs []string) {
+	event := input.Event.PDU
+	rejection := api.AuthRejection{
+		EventID:       event.EventID(),
+		Type:          event.Type(),
+		Sender:        event.SenderID(),
+		Origin:        input.Origin,
+		SoftFailed:    softFailed,
+		Reason:        "unknown",
+		StateEventIDs: stateEventIDs,
+		Timestamp:     spec.AsTimestamp(time.Now()),
+	}
+	if reason != nil {
+		rejection.Reason = reason.Error()
+	}
+	if rejection.StateEventIDs == nil {
+		rejection.StateEventIDs = []string{}
+	}
+	r.authRejections.add(event.RoomID().String(), rejection)
+}
+
+// QueryAdminAuthRejections returns the most recent events in the room which
+// were rejected or soft-failed, newest first.
+func (r *Inputer) QueryAdminAuthRejections(ctx context.Context, roomID string) ([]api.AuthRejection, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryAdminAuthRejections")
+	defer span.End()
+
+	return r.authRejections.forRoom(roomID), nil
+}
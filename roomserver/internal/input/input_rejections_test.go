@@ -0,0 +1,43 @@
+package input
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthRejections(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	r := &Inputer{}
+
+	var eventIDs []string
+	for i := 0; i < maxAuthRejectionsPerRoom+5; i++ {
+		event := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+		eventIDs = append(eventIDs, event.EventID())
+		r.recordAuthRejection(&api.InputRoomEvent{
+			Event:  event,
+			Origin: "remote",
+		}, i%2 == 1, errors.New("sender not in room"), []string{"$create"})
+	}
+
+	rejections, err := r.QueryAdminAuthRejections(context.Background(), room.ID)
+	assert.NoError(t, err)
+	assert.Len(t, rejections, maxAuthRejectionsPerRoom, "only the most recent rejections are kept")
+	assert.Equal(t, eventIDs[len(eventIDs)-1], rejections[0].EventID, "newest rejection first")
+	assert.Equal(t, eventIDs[5], rejections[len(rejections)-1].EventID)
+	assert.Equal(t, "sender not in room", rejections[0].Reason)
+	assert.Equal(t, []string{"$create"}, rejections[0].StateEventIDs)
+	assert.Equal(t, spec.ServerName("remote"), rejections[0].Origin)
+	assert.False(t, rejections[0].SoftFailed)
+	assert.True(t, rejections[1].SoftFailed)
+
+	rejections, err = r.QueryAdminAuthRejections(context.Background(), "!other:test")
+	assert.NoError(t, err)
+	assert.Empty(t, rejections)
+}
@@ -0,0 +1,162 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/state"
+	"github.com/neilalexander/harmony/roomserver/types"
+)
+
+// RepairRoomState recalculates the current state of the room by resolving the
+// state after each of the forward extremities, and compares it against the stored
+// current state snapshot. The event IDs which would be added to and removed from
+// the current state are returned. If dryRun is false and there are differences
+// then the current state is replaced with the resolved state, and downstream
+// components are told to rebuild their copy of the room state.
+func (r *Inputer) RepairRoomState(
+	ctx context.Context, roomID string, roomInfo *types.RoomInfo, dryRun bool,
+) (added, removed []string, err error) {
+	var succeeded bool
+	updater, err := r.DB.GetRoomUpdater(ctx, roomInfo)
+	if err != nil {
+		return nil, nil, fmt.Errorf("r.DB.GetRoomUpdater: %w", err)
+	}
+	// Nothing is committed unless we actually repair the state, so that a
+	// dry run doesn't leave a new state snapshot behind.
+	defer sqlutil.EndTransactionWithCheck(updater, &succeeded, &err)
+
+	latest := updater.LatestEvents()
+	if len(latest) == 0 {
+		return nil, nil, fmt.Errorf("room has no forward extremities")
+	}
+	latestStateAtEvents := make([]types.StateAtEvent, len(latest))
+	latestEventIDs := make([]string, len(latest))
+	for i := range latest {
+		latestStateAtEvents[i] = latest[i].StateAtEvent
+		latestEventIDs[i] = latest[i].EventID
+	}
+
+	roomState := state.NewStateResolution(updater, roomInfo, r.Queryer)
+	oldStateNID := updater.CurrentStateSnapshotNID()
+	newStateNID, err := roomState.CalculateAndStoreStateAfterEvents(ctx, latestStateAtEvents)
+	if err != nil {
+		return nil, nil, fmt.Errorf("roomState.CalculateAndStoreStateAfterEvents: %w", err)
+	}
+	removedEntries, addedEntries, err := roomState.DifferenceBetweenStateSnapshots(ctx, oldStateNID, newStateNID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("roomState.DifferenceBetweenStateSnapshots: %w", err)
+	}
+	if len(removedEntries) == 0 && len(addedEntries) == 0 {
+		return nil, nil, nil
+	}
+
+	newStateEntries, err := roomState.LoadStateAtSnapshot(ctx, newStateNID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+	}
+	eventNIDs := make([]types.EventNID, 0, len(newStateEntries)+len(removedEntries))
+	for _, entry := range append(newStateEntries, removedEntries...) {
+		eventNIDs = append(eventNIDs, entry.EventNID)
+	}
+	eventIDMap, err := updater.EventIDs(ctx, eventNIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("updater.EventIDs: %w", err)
+	}
+	for _, entry := range addedEntries {
+		added = append(added, eventIDMap[entry.EventNID])
+	}
+	for _, entry := range removedEntries {
+		removed = append(removed, eventIDMap[entry.EventNID])
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id":       roomID,
+		"old_state_nid": oldStateNID,
+		"new_state_nid": newStateNID,
+		"added":         len(added),
+		"removed":       len(removed),
+	})
+	if dryRun {
+		logger.Info("Room state differs from resolved state, not repairing as dry run")
+		return added, removed, nil
+	}
+
+	lastEventIDSent := updater.LastEventIDSent()
+	lastEventNIDs, err := r.DB.EventNIDs(ctx, []string{lastEventIDSent})
+	if err != nil {
+		return nil, nil, fmt.Errorf("r.DB.EventNIDs: %w", err)
+	}
+	if err = updater.SetLatestEvents(roomInfo.RoomNID, latest, lastEventNIDs[lastEventIDSent].EventNID, newStateNID); err != nil {
+		return nil, nil, fmt.Errorf("updater.SetLatestEvents: %w", err)
+	}
+
+	updates, err := r.updateMemberships(ctx, updater, removedEntries, addedEntries)
+	if err != nil {
+		return nil, nil, fmt.Errorf("r.updateMemberships: %w", err)
+	}
+
+	// Downstream components only learn about state through new room events, so
+	// send the most recent event again, this time rewriting the state with the
+	// entire repaired state snapshot.
+	events, err := updater.EventsFromIDs(ctx, roomInfo, []string{lastEventIDSent})
+	if err != nil {
+		return nil, nil, fmt.Errorf("updater.EventsFromIDs: %w", err)
+	}
+	if len(events) == 0 {
+		return nil, nil, fmt.Errorf("last sent event %s not found", lastEventIDSent)
+	}
+	historyVisibility := gomatrixserverlib.HistoryVisibilityShared
+	ore := api.OutputNewRoomEvent{
+		Event:           &types.HeaderedEvent{PDU: events[0].PDU},
+		RewritesState:   true,
+		RepairsState:    true,
+		LatestEventIDs:  latestEventIDs,
+		LastSentEventID: lastEventIDSent,
+	}
+	// Include what was removed, so that clients which already had it are told.
+	ore.RemovesStateEventIDs = removed
+	for _, entry := range newStateEntries {
+		ore.AddsStateEventIDs = append(ore.AddsStateEventIDs, eventIDMap[entry.EventNID])
+		if entry.EventTypeNID != types.MRoomHistoryVisibilityNID {
+			continue
+		}
+		hisVisEvents, err := updater.Events(ctx, roomInfo.RoomVersion, []types.EventNID{entry.EventNID})
+		if err == nil && len(hisVisEvents) == 1 {
+			if hisVis, err := hisVisEvents[0].HistoryVisibility(); err == nil {
+				historyVisibility = hisVis
+			}
+		}
+	}
+	ore.HistoryVisibility = historyVisibility
+	updates = append(updates, api.OutputEvent{
+		Type:         api.OutputTypeNewRoomEvent,
+		NewRoomEvent: &ore,
+	})
+	if err = r.OutputProducer.ProduceRoomEvents(ctx, roomID, updates); err != nil {
+		return nil, nil, fmt.Errorf("r.OutputProducer.ProduceRoomEvents: %w", err)
+	}
+
+	logger.Warn("Repaired room state")
+	succeeded = true
+	return added, removed, nil
+}
@@ -19,12 +19,14 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/roomserver/internal/input"
 	"github.com/neilalexander/harmony/roomserver/internal/query"
@@ -40,6 +42,8 @@ type Admin struct {
 	Queryer *query.Queryer
 	Inputer *input.Inputer
 	Leaver  *Leaver
+	Joiner  *Joiner
+	Inviter *Inviter
 }
 
 // PerformAdminEvacuateRoom will remove all local users from the given room.
@@ -47,6 +51,9 @@ func (r *Admin) PerformAdminEvacuateRoom(
 	ctx context.Context,
 	roomID string,
 ) (affected []string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminEvacuateRoom")
+	defer span.End()
+
 	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
 	if err != nil {
 		return nil, err
@@ -153,6 +160,9 @@ func (r *Admin) PerformAdminEvacuateUser(
 	ctx context.Context,
 	userID string,
 ) (affected []string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminEvacuateUser")
+	defer span.End()
+
 	fullUserID, err := spec.NewUserID(userID, true)
 	if err != nil {
 		return nil, err
@@ -187,18 +197,134 @@ func (r *Admin) PerformAdminEvacuateUser(
 		if len(outputEvents) == 0 {
 			continue
 		}
-		if err := r.Inputer.OutputProducer.ProduceRoomEvents(roomID, outputEvents); err != nil {
+		if err := r.Inputer.OutputProducer.ProduceRoomEvents(ctx, roomID, outputEvents); err != nil {
 			return nil, err
 		}
 	}
 	return affected, nil
 }
 
+// PerformAdminForceJoin joins a local user to the given room. If the user isn't
+// allowed to join by themselves, e.g. because the room is invite-only, then they
+// are first invited by the local member with the highest power level that is
+// allowed to send invites.
+func (r *Admin) PerformAdminForceJoin(
+	ctx context.Context,
+	roomIDOrAlias string,
+	userID spec.UserID,
+) (roomID string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminForceJoin")
+	defer span.End()
+
+	if !r.Cfg.Matrix.IsLocalServerName(userID.Domain()) {
+		return "", fmt.Errorf("can only force join local users using this endpoint")
+	}
+	joinReq := &api.PerformJoinRequest{
+		RoomIDOrAlias: roomIDOrAlias,
+		UserID:        userID.String(),
+	}
+	roomID, _, err = r.Joiner.PerformJoin(ctx, joinReq)
+	if _, ok := err.(api.ErrNotAllowed); !ok {
+		return roomID, err
+	}
+
+	roomID = roomIDOrAlias
+	if strings.HasPrefix(roomIDOrAlias, "#") {
+		if roomID, err = r.DB.GetRoomIDForAlias(ctx, roomIDOrAlias); err != nil {
+			return "", err
+		}
+	}
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return "", err
+	}
+	inviter, err := r.localInviter(ctx, *validRoomID)
+	if err != nil {
+		return "", err
+	}
+	identity, err := r.Cfg.Matrix.SigningIdentityFor(inviter.Domain())
+	if err != nil {
+		return "", err
+	}
+	if err = r.Inviter.PerformInvite(ctx, &api.PerformInviteRequest{
+		InviteInput: api.InviteInput{
+			RoomID:     *validRoomID,
+			Inviter:    *inviter,
+			Invitee:    userID,
+			KeyID:      identity.KeyID,
+			PrivateKey: identity.PrivateKey,
+			EventTime:  time.Now(),
+		},
+		SendAsServer: string(inviter.Domain()),
+	}); err != nil {
+		return "", fmt.Errorf("failed to invite user on behalf of %s: %w", inviter, err)
+	}
+
+	joinReq.RoomIDOrAlias = roomID
+	roomID, _, err = r.Joiner.PerformJoin(ctx, joinReq)
+	return roomID, err
+}
+
+// localInviter returns the joined local member of the room with the highest
+// power level, as long as that power level allows them to send invites.
+func (r *Admin) localInviter(ctx context.Context, roomID spec.RoomID) (*spec.UserID, error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID.String())
+	if err != nil {
+		return nil, err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, eventutil.ErrRoomNoExists{}
+	}
+	plEvent, err := r.DB.GetStateEvent(ctx, roomID.String(), spec.MRoomPowerLevels, "")
+	if err != nil {
+		return nil, err
+	}
+	if plEvent == nil {
+		return nil, fmt.Errorf("room has no power levels")
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(plEvent)
+	if err != nil {
+		return nil, err
+	}
+	memberNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, true)
+	if err != nil {
+		return nil, err
+	}
+	memberEvents, err := r.DB.Events(ctx, roomInfo.RoomVersion, memberNIDs)
+	if err != nil {
+		return nil, err
+	}
+	var inviter *spec.UserID
+	inviterLevel := powerLevels.Invite - 1
+	for _, memberEvent := range memberEvents {
+		if memberEvent.StateKey() == nil {
+			continue
+		}
+		senderID := spec.SenderID(*memberEvent.StateKey())
+		level := powerLevels.UserLevel(senderID)
+		if level <= inviterLevel {
+			continue
+		}
+		userID, err := r.Queryer.QueryUserIDForSender(ctx, roomID, senderID)
+		if err != nil || userID == nil || !r.Cfg.Matrix.IsLocalServerName(userID.Domain()) {
+			continue
+		}
+		inviter, inviterLevel = userID, level
+	}
+	if inviter == nil {
+		return nil, api.ErrNotAllowed{Err: fmt.Errorf("no local member of the room is allowed to invite")}
+	}
+	return inviter, nil
+}
+
 // PerformAdminPurgeRoom removes all traces for the given room from the database.
 func (r *Admin) PerformAdminPurgeRoom(
 	ctx context.Context,
 	roomID string,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminPurgeRoom")
+	defer span.End()
+
 	// Validate we actually got a room ID and nothing else
 	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
 		return err
@@ -212,7 +338,7 @@ func (r *Admin) PerformAdminPurgeRoom(
 
 	logrus.WithField("room_id", roomID).Warn("Room purged from roomserver, informing other components")
 
-	return r.Inputer.OutputProducer.ProduceRoomEvents(roomID, []api.OutputEvent{
+	return r.Inputer.OutputProducer.ProduceRoomEvents(ctx, roomID, []api.OutputEvent{
 		{
 			Type: api.OutputTypePurgeRoom,
 			PurgeRoom: &api.OutputPurgeRoom{
@@ -226,6 +352,9 @@ func (r *Admin) PerformAdminDownloadState(
 	ctx context.Context,
 	roomID, userID string, serverName spec.ServerName,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminDownloadState")
+	defer span.End()
+
 	fullUserID, err := spec.NewUserID(userID, true)
 	if err != nil {
 		return err
@@ -354,3 +483,24 @@ func (r *Admin) PerformAdminDownloadState(
 
 	return nil
 }
+
+// PerformAdminRepairRoomState recalculates the current state of the room from
+// its forward extremities and, unless dryRun is set, replaces the stored current
+// state if it has diverged. Returns the event IDs added to and removed from the
+// current state.
+func (r *Admin) PerformAdminRepairRoomState(
+	ctx context.Context,
+	roomID string, dryRun bool,
+) (added, removed []string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminRepairRoomState")
+	defer span.End()
+
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, nil, eventutil.ErrRoomNoExists{}
+	}
+	return r.Inputer.RepairRoomState(ctx, roomID, roomInfo, dryRun)
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/sirupsen/logrus"
 
@@ -54,6 +55,9 @@ func (r *Backfiller) PerformBackfill(
 	request *api.PerformBackfillRequest,
 	response *api.PerformBackfillResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformBackfill")
+	defer span.End()
+
 	// if we are requesting the backfill then we need to do a federation hit
 	// TODO: we could be more sensible and fetch as many events we already have then request the rest
 	//       which is what the syncapi does already.
@@ -262,6 +266,7 @@ type backfillRequester struct {
 
 	// per-request state
 	servers                 []spec.ServerName
+	rejectedServers         map[string]map[spec.ServerName]bool // room ID -> servers
 	eventIDToBeforeStateIDs map[string][]string
 	eventIDMap              map[string]gomatrixserverlib.PDU
 	historyVisiblity        gomatrixserverlib.HistoryVisibility
@@ -286,6 +291,7 @@ func newBackfillRequester(
 		querier:                 querier,
 		virtualHost:             virtualHost,
 		isLocalServerName:       isLocalServerName,
+		rejectedServers:         make(map[string]map[spec.ServerName]bool),
 		eventIDToBeforeStateIDs: make(map[string][]string),
 		eventIDMap:              make(map[string]gomatrixserverlib.PDU),
 		bwExtrems:               bwExtrems,
@@ -500,7 +506,7 @@ FindSuccessor:
 	}
 	var servers []spec.ServerName
 	for server := range serverSet {
-		if b.isLocalServerName(server) {
+		if b.isLocalServerName(server) || b.rejectedServers[roomID][server] || b.fsAPI.IsServerBackingOff(server) {
 			continue
 		}
 		if b.preferServer[server] { // insert at the front
@@ -517,6 +523,27 @@ FindSuccessor:
 	return servers
 }
 
+// RejectBackfillServer is called when all of the events that a server returned
+// failed verification. The server is only skipped for the rest of this backfill
+// request in the room, as it may well be fine for other rooms.
+func (b *backfillRequester) RejectBackfillServer(roomID string, server spec.ServerName) {
+	logrus.WithFields(logrus.Fields{
+		"room_id":     roomID,
+		"server_name": server,
+	}).Warn("Server returned only invalid events when backfilling, skipping it")
+	if b.rejectedServers[roomID] == nil {
+		b.rejectedServers[roomID] = make(map[spec.ServerName]bool)
+	}
+	b.rejectedServers[roomID][server] = true
+	servers := make([]spec.ServerName, 0, len(b.servers))
+	for _, srv := range b.servers {
+		if srv != server {
+			servers = append(servers, srv)
+		}
+	}
+	b.servers = servers
+}
+
 // Backfill performs a backfill request to the given server.
 // https://matrix.org/docs/spec/server_server/latest#get-matrix-federation-v1-backfill-roomid
 func (b *backfillRequester) Backfill(ctx context.Context, origin, server spec.ServerName, roomID string,
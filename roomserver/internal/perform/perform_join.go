@@ -24,6 +24,7 @@ import (
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
 
@@ -54,6 +55,9 @@ func (r *Joiner) PerformJoin(
 	ctx context.Context,
 	req *rsAPI.PerformJoinRequest,
 ) (roomID string, joinedVia spec.ServerName, err error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformJoin")
+	defer span.End()
+
 	logger := logrus.WithContext(ctx).WithFields(logrus.Fields{
 		"room_id": req.RoomIDOrAlias,
 		"user_id": req.UserID,
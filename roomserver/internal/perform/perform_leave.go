@@ -21,7 +21,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/matrix-org/gomatrix"
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -54,7 +53,7 @@ func (r *Leaver) PerformLeave(
 	res *api.PerformLeaveResponse,
 ) ([]api.OutputEvent, error) {
 	if !r.Cfg.Matrix.IsLocalServerName(req.Leaver.Domain()) {
-		return nil, fmt.Errorf("user %q does not belong to this homeserver", req.Leaver.String())
+		return nil, api.ErrInvalidID{Err: fmt.Errorf("user %q does not belong to this homeserver", req.Leaver.String())}
 	}
 	logger := logrus.WithContext(ctx).WithFields(logrus.Fields{
 		"room_id": req.RoomID,
@@ -70,7 +69,7 @@ func (r *Leaver) PerformLeave(
 		}
 		return output, err
 	}
-	return nil, fmt.Errorf("room ID %q is invalid", req.RoomID)
+	return nil, api.ErrInvalidID{Err: fmt.Errorf("room ID %q is invalid", req.RoomID)}
 }
 
 // nolint:gocyclo
@@ -81,7 +80,7 @@ func (r *Leaver) performLeaveRoomByID(
 ) ([]api.OutputEvent, error) {
 	roomID, err := spec.NewRoomID(req.RoomID)
 	if err != nil {
-		return nil, err
+		return nil, api.ErrInvalidID{Err: fmt.Errorf("room ID %q is invalid: %w", req.RoomID, err)}
 	}
 	leaver, err := r.RSAPI.QuerySenderIDForUser(ctx, *roomID, req.Leaver)
 	if err != nil || leaver == nil {
@@ -122,7 +121,7 @@ func (r *Leaver) performLeaveRoomByID(
 		if roomData, ok := accData.RoomAccountData[req.RoomID]; ok {
 			tagData, ok := roomData["m.tag"]
 			if ok {
-				tags := gomatrix.TagContent{}
+				tags := eventutil.TagContent{}
 				if err = json.Unmarshal(tagData, &tags); err != nil {
 					return nil, fmt.Errorf("unable to unmarshal tag content")
 				}
@@ -152,19 +151,19 @@ func (r *Leaver) performLeaveRoomByID(
 		return nil, err
 	}
 	if !latestRes.RoomExists {
-		return nil, fmt.Errorf("room %q does not exist", req.RoomID)
+		return nil, api.ErrNotAllowed{Err: fmt.Errorf("room %q does not exist", req.RoomID)}
 	}
 
 	// Now let's see if the user is in the room.
 	if len(latestRes.StateEvents) == 0 {
-		return nil, fmt.Errorf("user %q is not a member of room %q", req.Leaver.String(), req.RoomID)
+		return nil, api.ErrNotAllowed{Err: fmt.Errorf("user %q is not a member of room %q", req.Leaver.String(), req.RoomID)}
 	}
 	membership, err := latestRes.StateEvents[0].Membership()
 	if err != nil {
 		return nil, fmt.Errorf("error getting membership: %w", err)
 	}
 	if membership != spec.Join && membership != spec.Invite {
-		return nil, fmt.Errorf("user %q is not joined to the room (membership is %q)", req.Leaver.String(), membership)
+		return nil, api.ErrNotAllowed{Err: fmt.Errorf("user %q is not joined to the room (membership is %q)", req.Leaver.String(), membership)}
 	}
 
 	// Prepare the template for the leave event.
@@ -16,7 +16,9 @@ package perform
 
 import (
 	"context"
+	"errors"
 
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/roomserver/storage"
 )
@@ -30,5 +32,35 @@ func (r *Publisher) PerformPublish(
 	ctx context.Context,
 	req *api.PerformPublishRequest,
 ) error {
-	return r.DB.PublishRoom(ctx, req.RoomID, req.AppserviceID, req.NetworkID, req.Visibility == "public")
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformPublish")
+	defer span.End()
+
+	publish := req.Visibility == "public"
+	if publish {
+		blocked, err := r.DB.IsRoomDirectoryBlocked(ctx, req.RoomID)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return api.ErrNotAllowed{Err: errors.New("this room has been blocked from the room directory")}
+		}
+	}
+	return r.DB.PublishRoom(ctx, req.RoomID, req.AppserviceID, req.NetworkID, publish)
+}
+
+// PerformAdminUnpublishRoom removes a room from the room directory for every appservice and network.
+func (r *Publisher) PerformAdminUnpublishRoom(ctx context.Context, roomID string) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminUnpublishRoom")
+	defer span.End()
+
+	return r.DB.UnpublishRoom(ctx, roomID)
+}
+
+// PerformAdminSetRoomDirectoryBlocked blocks or unblocks a room from being published in the
+// room directory. Blocking a room also unpublishes it.
+func (r *Publisher) PerformAdminSetRoomDirectoryBlocked(ctx context.Context, roomID string, blocked bool) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminSetRoomDirectoryBlocked")
+	defer span.End()
+
+	return r.DB.SetRoomDirectoryBlocked(ctx, roomID, blocked)
 }
@@ -0,0 +1,490 @@
+package perform
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/eventutil"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/internal/helpers"
+	"github.com/neilalexander/harmony/roomserver/state"
+	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// roomExportBatchSize is how many events are loaded from the database at a
+// time when exporting a room.
+const roomExportBatchSize = 500
+
+// roomImportBatchSize is how many events are sent to the input API at a time
+// when importing a room.
+const roomImportBatchSize = 100
+
+// PerformAdminExportRoom writes every stored event in the room, along with
+// the state needed to import the room into another server, to w as a JSON
+// RoomExport. The events are loaded and written a batch at a time, so that
+// large rooms don't have to be held in memory.
+func (r *Admin) PerformAdminExportRoom(ctx context.Context, roomID string, w io.Writer, progress func(done, total int64)) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminExportRoom")
+	defer span.End()
+
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return eventutil.ErrRoomNoExists{}
+	}
+
+	latestEventIDs, stateSnapshotNID, _, err := r.DB.LatestEventIDs(ctx, roomInfo.RoomNID)
+	if err != nil {
+		return err
+	}
+	roomState := state.NewStateResolution(r.DB, roomInfo, r.Queryer)
+	stateEntries, err := roomState.LoadStateAtSnapshot(ctx, stateSnapshotNID)
+	if err != nil {
+		return err
+	}
+	stateEventIDs, err := r.stateEventIDs(ctx, stateEntries)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := r.DB.RoomEventStatuses(ctx, roomInfo.RoomNID)
+	if err != nil {
+		return err
+	}
+
+	// The events are written out one at a time into the events array, which
+	// is the last field of the export.
+	header, err := json.Marshal(&api.RoomExport{
+		Format:         api.RoomExportFormat,
+		RoomID:         roomID,
+		RoomVersion:    roomInfo.RoomVersion,
+		ExportedBy:     r.Cfg.Matrix.ServerName,
+		ExportedTS:     spec.AsTimestamp(time.Now()),
+		LatestEventIDs: latestEventIDs,
+		StateEventIDs:  stateEventIDs,
+		Events:         []api.RoomExportEvent{},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(bytes.TrimSuffix(header, []byte("]}"))); err != nil {
+		return err
+	}
+
+	// The events which will have state of their own once imported, so that
+	// the events after them don't need to carry their state before.
+	withState := make(map[string]struct{}, len(statuses))
+	total := int64(len(statuses))
+	progress(0, total)
+	written := 0
+	for start := 0; start < len(statuses); start += roomExportBatchSize {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		batch := statuses[start:min(start+roomExportBatchSize, len(statuses))]
+		eventNIDs := make([]types.EventNID, len(batch))
+		for i := range batch {
+			eventNIDs[i] = batch[i].EventNID
+		}
+		events, err := r.DB.Events(ctx, roomInfo.RoomVersion, eventNIDs)
+		if err != nil {
+			return err
+		}
+		eventsByNID := make(map[types.EventNID]gomatrixserverlib.PDU, len(events))
+		for _, event := range events {
+			eventsByNID[event.EventNID] = event.PDU
+		}
+
+		for _, status := range batch {
+			event, ok := eventsByNID[status.EventNID]
+			if !ok {
+				continue
+			}
+			exported := api.RoomExportEvent{
+				Event:    event.JSON(),
+				Outlier:  status.StateSnapshotNID == 0,
+				Rejected: status.IsRejected,
+			}
+			if !exported.Outlier {
+				for _, prevEventID := range event.PrevEventIDs() {
+					if _, ok = withState[prevEventID]; !ok {
+						if exported.StateBefore, err = r.stateBeforeEvent(ctx, roomInfo, status.EventNID); err != nil {
+							return fmt.Errorf("failed to load state before %s: %w", event.EventID(), err)
+						}
+						break
+					}
+				}
+				withState[event.EventID()] = struct{}{}
+			}
+			js, err := json.Marshal(&exported)
+			if err != nil {
+				return err
+			}
+			if written > 0 {
+				if _, err = io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			if _, err = w.Write(js); err != nil {
+				return err
+			}
+			written++
+		}
+		progress(int64(start+len(batch)), total)
+	}
+	_, err = io.WriteString(w, "]}")
+	return err
+}
+
+func (r *Admin) stateBeforeEvent(ctx context.Context, roomInfo *types.RoomInfo, eventNID types.EventNID) ([]string, error) {
+	stateEntries, err := helpers.StateBeforeEvent(ctx, r.DB, roomInfo, eventNID, r.Queryer)
+	if err != nil {
+		return nil, err
+	}
+	return r.stateEventIDs(ctx, stateEntries)
+}
+
+func (r *Admin) stateEventIDs(ctx context.Context, stateEntries []types.StateEntry) ([]string, error) {
+	eventNIDs := make([]types.EventNID, len(stateEntries))
+	for i := range stateEntries {
+		eventNIDs[i] = stateEntries[i].EventNID
+	}
+	eventIDMap, err := r.DB.EventIDs(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	eventIDs := make([]string, 0, len(eventIDMap))
+	for _, eventID := range eventIDMap {
+		eventIDs = append(eventIDs, eventID)
+	}
+	sort.Strings(eventIDs)
+	return eventIDs, nil
+}
+
+// PerformAdminImportRoom stores the events of an exported room. The room must
+// not already be known, and the imported events are never sent to other
+// servers. The archive is read twice, an event at a time, so that it doesn't
+// have to be held in memory: every event is checked on the first pass before
+// anything is stored, and the events are stored on the second.
+//
+// The import is refused if any of the events fail signature checks. In rooms
+// created by one of our own server names, the events which were signed by our
+// server name with one of the keys in old_private_keys, such as when the
+// server has been moved to a new signing key, are re-signed with our current
+// key. Any other events must pass as they are, as an archive could otherwise
+// be used to forge them.
+func (r *Admin) PerformAdminImportRoom(ctx context.Context, archive io.ReadSeeker, progress func(done, total int64)) (*api.RoomImportResult, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformAdminImportRoom")
+	defer span.End()
+
+	var export api.RoomExport
+	var roomID *spec.RoomID
+	var verImpl gomatrixserverlib.IRoomVersion
+	checkHeader := func(header *api.RoomExport) error {
+		if header.Format != api.RoomExportFormat {
+			return api.ErrInvalidID{Err: fmt.Errorf("unsupported archive format %q", header.Format)}
+		}
+		var err error
+		if roomID, err = spec.NewRoomID(header.RoomID); err != nil {
+			return api.ErrInvalidID{Err: err}
+		}
+		if verImpl, err = gomatrixserverlib.GetRoomVersion(header.RoomVersion); err != nil {
+			return api.ErrInvalidID{Err: err}
+		}
+		roomInfo, err := r.DB.RoomInfo(ctx, roomID.String())
+		if err != nil {
+			return err
+		}
+		if roomInfo != nil && !roomInfo.IsStub() {
+			return api.ErrNotAllowed{Err: fmt.Errorf("room %s already exists", roomID.String())}
+		}
+		export = *header
+		return nil
+	}
+
+	userIDForSender := func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		return r.Queryer.QueryUserIDForSender(ctx, roomID, senderID)
+	}
+	// The events which needed to be re-signed, so that they are re-signed
+	// again when they are stored. Signing is deterministic, so they end up
+	// with the same signatures as were checked.
+	resigned := map[string]struct{}{}
+	var total int64
+	if err := readRoomExport(archive, checkHeader, func(i int, exported *api.RoomExportEvent) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		event, err := r.importedEvent(verImpl, roomID, i, exported, nil)
+		if err != nil {
+			return err
+		}
+		if err = gomatrixserverlib.VerifyEventSignatures(ctx, event, r.Inputer.KeyRing, userIDForSender); err != nil {
+			if !r.Cfg.Matrix.IsLocalServerName(roomID.Domain()) {
+				return api.ErrNotAllowed{Err: fmt.Errorf("event %s failed signature checks: %w", event.EventID(), err)}
+			}
+			resignedEvent, resignErr := r.resignEvent(verImpl, event)
+			if resignErr != nil {
+				return api.ErrNotAllowed{Err: fmt.Errorf("event %s failed signature checks: %w", event.EventID(), err)}
+			}
+			if err = gomatrixserverlib.VerifyEventSignatures(ctx, resignedEvent, r.Inputer.KeyRing, userIDForSender); err != nil {
+				return api.ErrNotAllowed{Err: fmt.Errorf("event %s failed signature checks after being re-signed: %w", event.EventID(), err)}
+			}
+			resigned[event.EventID()] = struct{}{}
+		}
+		total++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"room_id":     roomID.String(),
+		"exported_by": export.ExportedBy,
+		"events":      total,
+		"resigned":    len(resigned),
+	}).Warn("Importing room")
+
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	res := &api.RoomImportResult{RoomID: roomID.String(), Resigned: len(resigned)}
+	var done int64
+	progress(done, total)
+	inputBatch := func(inputEvents []api.InputRoomEvent, rejected bool) error {
+		inputRes := &api.InputRoomEventsResponse{}
+		r.Inputer.InputRoomEvents(ctx, &api.InputRoomEventsRequest{
+			InputRoomEvents: inputEvents,
+		}, inputRes)
+		switch err := inputRes.Err(); {
+		case rejected:
+			res.Rejected++
+		case err != nil:
+			return fmt.Errorf("failed to import events %d to %d: %w", done, done+int64(len(inputEvents))-1, err)
+		default:
+			res.Imported += len(inputEvents)
+		}
+		done += int64(len(inputEvents))
+		progress(done, total)
+		return nil
+	}
+
+	// Events which were rejected before are input on their own, so that
+	// them being rejected again doesn't stop the rest of the room being imported.
+	inputEvents := make([]api.InputRoomEvent, 0, roomImportBatchSize)
+	if err := readRoomExport(archive, func(*api.RoomExport) error { return nil }, func(i int, exported *api.RoomExportEvent) error {
+		event, err := r.importedEvent(verImpl, roomID, i, exported, resigned)
+		if err != nil {
+			return err
+		}
+		input := api.InputRoomEvent{
+			Kind:         api.KindNew,
+			Event:        &types.HeaderedEvent{PDU: event},
+			Origin:       r.Cfg.Matrix.ServerName,
+			SendAsServer: api.DoNotSendToOtherServers,
+		}
+		switch {
+		case exported.Outlier:
+			input.Kind = api.KindOutlier
+		case exported.StateBefore != nil:
+			input.HasState = true
+			input.StateEventIDs = exported.StateBefore
+		}
+		if exported.Rejected || len(inputEvents) == roomImportBatchSize {
+			if len(inputEvents) > 0 {
+				if err = inputBatch(inputEvents, false); err != nil {
+					return err
+				}
+				inputEvents = inputEvents[:0]
+			}
+		}
+		if exported.Rejected {
+			return inputBatch([]api.InputRoomEvent{input}, true)
+		}
+		inputEvents = append(inputEvents, input)
+		return nil
+	}); err != nil {
+		return res, err
+	}
+	if len(inputEvents) > 0 {
+		if err := inputBatch(inputEvents, false); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// importedEvent parses an event from an archive being imported, re-signing it
+// if its event ID is in resigned.
+func (r *Admin) importedEvent(
+	verImpl gomatrixserverlib.IRoomVersion, roomID *spec.RoomID, i int,
+	exported *api.RoomExportEvent, resigned map[string]struct{},
+) (gomatrixserverlib.PDU, error) {
+	event, err := verImpl.NewEventFromUntrustedJSON(exported.Event)
+	if err != nil {
+		return nil, api.ErrInvalidID{Err: fmt.Errorf("event %d: %w", i, err)}
+	}
+	if event.RoomID().String() != roomID.String() {
+		return nil, api.ErrInvalidID{Err: fmt.Errorf("event %s is not in room %s", event.EventID(), roomID.String())}
+	}
+	if _, ok := resigned[event.EventID()]; ok {
+		return r.resignEvent(verImpl, event)
+	}
+	return event, nil
+}
+
+// resignEvent replaces the signatures of our own server names on the event
+// with new ones from their current signing keys. Only events which were
+// signed by our server name with one of its old keys are re-signed, so that
+// an archive can't be used to get us to sign events we never signed. The
+// signatures aren't part of the event ID, so the event keeps the same ID.
+func (r *Admin) resignEvent(verImpl gomatrixserverlib.IRoomVersion, event gomatrixserverlib.PDU) (gomatrixserverlib.PDU, error) {
+	var signed struct {
+		Signatures map[spec.ServerName]map[gomatrixserverlib.KeyID]spec.Base64Bytes `json:"signatures"`
+	}
+	if err := json.Unmarshal(event.JSON(), &signed); err != nil {
+		return nil, err
+	}
+	redactedJSON, err := verImpl.RedactEventJSON(event.JSON())
+	if err != nil {
+		return nil, err
+	}
+	eventJSON := event.JSON()
+	identities := []*fclient.SigningIdentity{}
+	for serverName, signatures := range signed.Signatures {
+		if !r.Cfg.Matrix.IsLocalServerName(serverName) {
+			continue
+		}
+		if !r.signedWithOldKey(serverName, signatures, redactedJSON) {
+			return nil, fmt.Errorf("event %s wasn't signed by %s with any of its old keys", event.EventID(), serverName)
+		}
+		identity, err := r.Cfg.Matrix.SigningIdentityFor(serverName)
+		if err != nil {
+			return nil, err
+		}
+		if eventJSON, err = sjson.DeleteBytes(eventJSON, "signatures."+gjson.Escape(string(serverName))); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("event %s wasn't signed by this server", event.EventID())
+	}
+	resigned, err := verImpl.NewEventFromTrustedJSON(eventJSON, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, identity := range identities {
+		resigned = resigned.Sign(string(identity.ServerName), identity.KeyID, identity.PrivateKey)
+	}
+	if resigned.EventID() != event.EventID() {
+		return nil, fmt.Errorf("event %s changed ID to %s when re-signed", event.EventID(), resigned.EventID())
+	}
+	return resigned, nil
+}
+
+// signedWithOldKey returns whether one of the signatures was made by the
+// server name with a key from old_private_keys. The old keys only belong to
+// the main server name, not to virtual hosts.
+func (r *Admin) signedWithOldKey(
+	serverName spec.ServerName, signatures map[gomatrixserverlib.KeyID]spec.Base64Bytes, redactedJSON []byte,
+) bool {
+	if serverName != r.Cfg.Matrix.ServerName {
+		return false
+	}
+	for _, oldKey := range r.Cfg.Matrix.CurrentOldVerifyKeys() {
+		if _, ok := signatures[oldKey.KeyID]; !ok {
+			continue
+		}
+		if gomatrixserverlib.VerifyJSON(string(serverName), oldKey.KeyID, ed25519.PublicKey(oldKey.PublicKey), redactedJSON) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readRoomExport reads a RoomExport an event at a time. The events must be the
+// last field of the export, as they are when it is exported, and header is
+// called with the rest of the export before fn is called with each event.
+func readRoomExport(
+	r io.Reader, header func(export *api.RoomExport) error,
+	fn func(i int, exported *api.RoomExportEvent) error,
+) error {
+	dec := json.NewDecoder(r)
+	if err := expectJSONDelim(dec, '{'); err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return api.ErrInvalidID{Err: fmt.Errorf("invalid archive: %w", err)}
+		}
+		key, _ := token.(string)
+		if key != "events" {
+			var value json.RawMessage
+			if err = dec.Decode(&value); err != nil {
+				return api.ErrInvalidID{Err: fmt.Errorf("invalid archive: %w", err)}
+			}
+			fields[key] = value
+			continue
+		}
+
+		js, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		var export api.RoomExport
+		if err = json.Unmarshal(js, &export); err != nil {
+			return api.ErrInvalidID{Err: fmt.Errorf("invalid archive: %w", err)}
+		}
+		if err = header(&export); err != nil {
+			return err
+		}
+		if err = expectJSONDelim(dec, '['); err != nil {
+			return err
+		}
+		for i := 0; dec.More(); i++ {
+			var exported api.RoomExportEvent
+			if err = dec.Decode(&exported); err != nil {
+				return api.ErrInvalidID{Err: fmt.Errorf("event %d: %w", i, err)}
+			}
+			if err = fn(i, &exported); err != nil {
+				return err
+			}
+		}
+		if err = expectJSONDelim(dec, ']'); err != nil {
+			return err
+		}
+		if dec.More() {
+			return api.ErrInvalidID{Err: fmt.Errorf("invalid archive: the events must be the last field")}
+		}
+		return nil
+	}
+	return api.ErrInvalidID{Err: fmt.Errorf("invalid archive: no events")}
+}
+
+func expectJSONDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return api.ErrInvalidID{Err: fmt.Errorf("invalid archive: %w", err)}
+	}
+	if token != delim {
+		return api.ErrInvalidID{Err: fmt.Errorf("invalid archive: expected %q but found %v", delim, token)}
+	}
+	return nil
+}
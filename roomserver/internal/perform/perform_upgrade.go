@@ -23,6 +23,7 @@ import (
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/roomserver/types"
@@ -40,6 +41,9 @@ func (r *Upgrader) PerformRoomUpgrade(
 	ctx context.Context,
 	roomID string, userID spec.UserID, roomVersion gomatrixserverlib.RoomVersion,
 ) (newRoomID string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.PerformRoomUpgrade")
+	defer span.End()
+
 	return r.performRoomUpgrade(ctx, roomID, userID, roomVersion)
 }
 
@@ -63,7 +67,7 @@ func (r *Upgrader) performRoomUpgrade(
 		util.GetLogger(ctx).WithError(err).Error("Failed getting senderID for user")
 		return "", err
 	} else if senderID == nil {
-		util.GetLogger(ctx).WithField("userID", userID).WithField("roomID", *fullRoomID).Error("No senderID for user")
+		util.GetLogger(ctx).WithField("user_id", userID).WithField("room_id", *fullRoomID).Error("No senderID for user")
 		return "", fmt.Errorf("No sender ID for %s in %s", userID, *fullRoomID)
 	}
 
@@ -507,8 +511,9 @@ func (r *Upgrader) sendInitialEvents(ctx context.Context, evTime time.Time, send
 			return err
 		}
 
+		keyID, privateKey := r.Cfg.Matrix.SigningKey()
 		var event gomatrixserverlib.PDU
-		event, err = builder.Build(evTime, userDomain, r.Cfg.Matrix.KeyID, r.Cfg.Matrix.PrivateKey)
+		event, err = builder.Build(evTime, userDomain, keyID, privateKey)
 		if err != nil {
 			return fmt.Errorf("failed to build new %q event: %w", builder.Type, err)
 
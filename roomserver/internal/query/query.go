@@ -20,10 +20,14 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
 
 	//"github.com/neilalexander/harmony/roomserver/internal"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/sirupsen/logrus"
@@ -36,6 +40,7 @@ import (
 	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/roomserver/acls"
 	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/auth"
 	"github.com/neilalexander/harmony/roomserver/internal/helpers"
 	"github.com/neilalexander/harmony/roomserver/state"
 	"github.com/neilalexander/harmony/roomserver/storage"
@@ -92,6 +97,9 @@ func (r *Queryer) QueryLatestEventsAndState(
 	request *api.QueryLatestEventsAndStateRequest,
 	response *api.QueryLatestEventsAndStateResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryLatestEventsAndState")
+	defer span.End()
+
 	return helpers.QueryLatestEventsAndState(ctx, r.DB, r, request, response)
 }
 
@@ -101,6 +109,9 @@ func (r *Queryer) QueryStateAfterEvents(
 	request *api.QueryStateAfterEventsRequest,
 	response *api.QueryStateAfterEventsResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryStateAfterEvents")
+	defer span.End()
+
 	info, err := r.DB.RoomInfo(ctx, request.RoomID)
 	if err != nil {
 		return err
@@ -192,6 +203,9 @@ func (r *Queryer) QueryEventsByID(
 	request *api.QueryEventsByIDRequest,
 	response *api.QueryEventsByIDResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryEventsByID")
+	defer span.End()
+
 	if len(request.EventIDs) == 0 {
 		return nil
 	}
@@ -237,6 +251,9 @@ func (r *Queryer) QueryMembershipForSenderID(
 	senderID spec.SenderID,
 	response *api.QueryMembershipForUserResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryMembershipForSenderID")
+	defer span.End()
+
 	return r.queryMembershipForOptionalSenderID(ctx, roomID, &senderID, response)
 }
 
@@ -246,6 +263,9 @@ func (r *Queryer) QueryMembershipForUser(
 	request *api.QueryMembershipForUserRequest,
 	response *api.QueryMembershipForUserResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryMembershipForUser")
+	defer span.End()
+
 	roomID, err := spec.NewRoomID(request.RoomID)
 	if err != nil {
 		return err
@@ -319,6 +339,9 @@ func (r *Queryer) QueryMembershipAtEvent(
 	eventIDs []string,
 	senderID spec.SenderID,
 ) (map[string]*types.HeaderedEvent, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryMembershipAtEvent")
+	defer span.End()
+
 	info, err := r.DB.RoomInfo(ctx, roomID.String())
 	if err != nil {
 		return nil, fmt.Errorf("unable to get roomInfo: %w", err)
@@ -401,12 +424,52 @@ func (r *Queryer) QueryMembershipAtEvent(
 	return eventIDMembershipMap, nil
 }
 
+// QueryEventsVisibleToUser implements api.RoomserverInternalAPI. Events which
+// don't already have a known history visibility will have it populated from
+// the state before the event.
+func (r *Queryer) QueryEventsVisibleToUser(
+	ctx context.Context,
+	req *api.QueryEventsVisibleToUserRequest,
+	res *api.QueryEventsVisibleToUserResponse,
+) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryEventsVisibleToUser")
+	defer span.End()
+
+	var info *types.RoomInfo
+	for _, ev := range req.Events {
+		if ev.Visibility != "" {
+			continue
+		}
+		if info == nil {
+			var err error
+			info, err = r.DB.RoomInfo(ctx, req.RoomID.String())
+			if err != nil {
+				return fmt.Errorf("unable to get roomInfo: %w", err)
+			}
+			if info == nil || info.IsStub() {
+				return fmt.Errorf("no roomInfo found")
+			}
+		}
+		stateAtEvent, err := r.DB.GetHistoryVisibilityState(ctx, info, ev.EventID(), string(req.UserID.Domain()))
+		if err != nil {
+			if _, ok := err.(types.MissingStateError); !ok {
+				return fmt.Errorf("r.DB.GetHistoryVisibilityState: %w", err)
+			}
+		}
+		ev.Visibility = auth.HistoryVisibilityForRoom(stateAtEvent)
+	}
+	return auth.FilterEventsVisibleToUser(ctx, r, req, res)
+}
+
 // QueryMembershipsForRoom implements api.RoomserverInternalAPI
 func (r *Queryer) QueryMembershipsForRoom(
 	ctx context.Context,
 	request *api.QueryMembershipsForRoomRequest,
 	response *api.QueryMembershipsForRoomResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryMembershipsForRoom")
+	defer span.End()
+
 	info, err := r.DB.RoomInfo(ctx, request.RoomID)
 	if err != nil {
 		return err
@@ -414,6 +477,14 @@ func (r *Queryer) QueryMembershipsForRoom(
 	if info == nil {
 		return nil
 	}
+	var from types.EventNID
+	if request.From != "" {
+		nid, parseErr := strconv.ParseInt(request.From, 10, 64)
+		if parseErr != nil {
+			return fmt.Errorf("invalid membership pagination token %q: %w", request.From, parseErr)
+		}
+		from = types.EventNID(nid)
+	}
 
 	// If no sender is specified then we will just return the entire
 	// set of memberships for the room, regardless of whether a specific
@@ -421,20 +492,19 @@ func (r *Queryer) QueryMembershipsForRoom(
 	if request.SenderID == "" {
 		var events []types.Event
 		var eventNIDs []types.EventNID
-		eventNIDs, err = r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, request.JoinedOnly, request.LocalOnly)
+		eventNIDs, response.NextBatch, err = r.membershipEventNIDs(ctx, info, request.JoinedOnly, request.LocalOnly, from, request.Limit)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				return nil
 			}
-			return fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+			return fmt.Errorf("r.membershipEventNIDs: %w", err)
 		}
 		events, err = r.DB.Events(ctx, info.RoomVersion, eventNIDs)
 		if err != nil {
 			return fmt.Errorf("r.DB.Events: %w", err)
 		}
 		for _, event := range events {
-			clientEvent := synctypes.ToClientEvent(event, synctypes.FormatAll)
-			response.JoinEvents = append(response.JoinEvents, *clientEvent)
+			response.JoinEvents = append(response.JoinEvents, membershipClientEvent(event, request.MinimalEvents))
 		}
 		return nil
 	}
@@ -459,7 +529,7 @@ func (r *Queryer) QueryMembershipsForRoom(
 	var stateEntries []types.StateEntry
 	if stillInRoom {
 		var eventNIDs []types.EventNID
-		eventNIDs, err = r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, request.JoinedOnly, false)
+		eventNIDs, response.NextBatch, err = r.membershipEventNIDs(ctx, info, request.JoinedOnly, false, from, request.Limit)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				return nil
@@ -474,7 +544,9 @@ func (r *Queryer) QueryMembershipsForRoom(
 			logrus.WithField("membership_event_nid", membershipEventNID).WithError(err).Error("failed to load state before event")
 			return err
 		}
-		events, err = helpers.GetMembershipsAtState(ctx, r.DB, info, stateEntries, request.JoinedOnly)
+		var next types.EventNID
+		events, next, err = helpers.GetMembershipsAtStatePage(ctx, r.DB, info, stateEntries, request.JoinedOnly, from, request.Limit)
+		response.NextBatch = membershipsNextBatch(next)
 	}
 
 	if err != nil {
@@ -482,19 +554,70 @@ func (r *Queryer) QueryMembershipsForRoom(
 	}
 
 	for _, event := range events {
-		clientEvent := synctypes.ToClientEvent(event, synctypes.FormatAll)
-		response.JoinEvents = append(response.JoinEvents, *clientEvent)
+		response.JoinEvents = append(response.JoinEvents, membershipClientEvent(event, request.MinimalEvents))
 	}
 
 	return nil
 }
 
+// membershipEventNIDs returns the membership event NIDs for the room. If a limit
+// is given then only a page of them, after the given NID, is returned, along with
+// the pagination token for the next page if there is one.
+func (r *Queryer) membershipEventNIDs(
+	ctx context.Context, info *types.RoomInfo, joinOnly, localOnly bool, from types.EventNID, limit int,
+) ([]types.EventNID, string, error) {
+	if from == 0 && limit <= 0 {
+		eventNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, joinOnly, localOnly)
+		return eventNIDs, "", err
+	}
+	pageSize := limit
+	if pageSize <= 0 {
+		pageSize = math.MaxInt32
+	} else {
+		// Ask for one more than the limit so that we know if there's another page.
+		pageSize++
+	}
+	eventNIDs, err := r.DB.GetMembershipEventNIDsForRoomPage(ctx, info.RoomNID, joinOnly, localOnly, from, pageSize)
+	if err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 || len(eventNIDs) <= limit {
+		return eventNIDs, "", nil
+	}
+	eventNIDs = eventNIDs[:limit]
+	return eventNIDs, membershipsNextBatch(eventNIDs[limit-1]), nil
+}
+
+// membershipsNextBatch returns the pagination token for the memberships after
+// the given NID, or nothing if there are none.
+func membershipsNextBatch(eventNID types.EventNID) string {
+	if eventNID == 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(eventNID), 10)
+}
+
+func membershipClientEvent(event types.Event, minimal bool) synctypes.ClientEvent {
+	if minimal {
+		return synctypes.ClientEvent{
+			Content:  event.Content(),
+			Sender:   string(event.SenderID()),
+			StateKey: event.StateKey(),
+			Type:     event.Type(),
+		}
+	}
+	return *synctypes.ToClientEvent(event, synctypes.FormatAll)
+}
+
 // QueryServerJoinedToRoom implements api.RoomserverInternalAPI
 func (r *Queryer) QueryServerJoinedToRoom(
 	ctx context.Context,
 	request *api.QueryServerJoinedToRoomRequest,
 	response *api.QueryServerJoinedToRoomResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryServerJoinedToRoom")
+	defer span.End()
+
 	info, err := r.DB.RoomInfo(ctx, request.RoomID)
 	if err != nil {
 		return fmt.Errorf("r.DB.RoomInfo: %w", err)
@@ -529,6 +652,9 @@ func (r *Queryer) QueryServerAllowedToSeeEvent(
 	eventID string,
 	roomID string,
 ) (allowed bool, err error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryServerAllowedToSeeEvent")
+	defer span.End()
+
 	events, err := r.DB.EventNIDs(ctx, []string{eventID})
 	if err != nil {
 		return
@@ -567,6 +693,9 @@ func (r *Queryer) QueryMissingEvents(
 	request *api.QueryMissingEventsRequest,
 	response *api.QueryMissingEventsResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryMissingEvents")
+	defer span.End()
+
 	var front []string
 	eventsToFilter := make(map[string]bool, len(request.LatestEvents))
 	visited := make(map[string]bool, request.Limit) // request.Limit acts as a hint to size.
@@ -627,6 +756,9 @@ func (r *Queryer) QueryStateAndAuthChain(
 	request *api.QueryStateAndAuthChainRequest,
 	response *api.QueryStateAndAuthChainResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryStateAndAuthChain")
+	defer span.End()
+
 	info, err := r.DB.RoomInfo(ctx, request.RoomID)
 	if err != nil {
 		return err
@@ -652,6 +784,10 @@ func (r *Queryer) QueryStateAndAuthChain(
 		return nil
 	}
 
+	if request.OnlyEventIDs && !request.ResolveState {
+		return r.queryStateAndAuthChainIDs(ctx, info, request, response)
+	}
+
 	var stateEvents []gomatrixserverlib.PDU
 	stateEvents, rejected, stateMissing, err := r.loadStateAtEventIDs(ctx, info, request.PrevEventIDs)
 	if err != nil {
@@ -703,8 +839,66 @@ func (r *Queryer) QueryStateAndAuthChain(
 	return err
 }
 
+// queryStateAndAuthChainIDs looks up the IDs of the state and auth chain events
+// for QueryStateAndAuthChain, without loading the events, so that large rooms
+// don't need to be held in memory to answer /state_ids.
+func (r *Queryer) queryStateAndAuthChainIDs(
+	ctx context.Context, info *types.RoomInfo,
+	request *api.QueryStateAndAuthChainRequest,
+	response *api.QueryStateAndAuthChainResponse,
+) error {
+	stateEntries, rejected, stateMissing, err := r.loadStateEntriesAtEventIDs(ctx, info, request.PrevEventIDs)
+	if err != nil {
+		return err
+	}
+	response.StateKnown = !stateMissing
+	response.IsRejected = rejected
+	response.PrevEventsExist = true
+
+	stateEventNIDs := make([]types.EventNID, 0, len(stateEntries))
+	for _, entry := range stateEntries {
+		stateEventNIDs = append(stateEventNIDs, entry.EventNID)
+	}
+	stateEventIDs, err := r.DB.EventIDs(ctx, stateEventNIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.EventIDs: %w", err)
+	}
+	response.StateEventIDs = make([]string, 0, len(stateEventIDs))
+	for _, eventID := range stateEventIDs {
+		response.StateEventIDs = append(response.StateEventIDs, eventID)
+	}
+
+	authEvents, err := r.DB.EventNIDs(ctx, request.AuthEventIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.EventNIDs: %w", err)
+	}
+	authEventNIDs := make([]types.EventNID, 0, len(authEvents))
+	for _, authEvent := range authEvents {
+		authEventNIDs = append(authEventNIDs, authEvent.EventNID)
+	}
+	response.AuthChainEventIDs, err = r.DB.AuthChainEventIDs(ctx, authEventNIDs, stateEventNIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.AuthChainEventIDs: %w", err)
+	}
+	if response.AuthChainEventIDs == nil {
+		response.AuthChainEventIDs = []string{}
+	}
+	return nil
+}
+
 // first bool: is rejected, second bool: state missing
 func (r *Queryer) loadStateAtEventIDs(ctx context.Context, roomInfo *types.RoomInfo, eventIDs []string) ([]gomatrixserverlib.PDU, bool, bool, error) {
+	stateEntries, rejected, stateMissing, err := r.loadStateEntriesAtEventIDs(ctx, roomInfo, eventIDs)
+	if err != nil || stateMissing {
+		return nil, rejected, stateMissing, err
+	}
+
+	events, err := helpers.LoadStateEvents(ctx, r.DB, roomInfo, stateEntries)
+	return events, rejected, false, err
+}
+
+// first bool: is rejected, second bool: state missing
+func (r *Queryer) loadStateEntriesAtEventIDs(ctx context.Context, roomInfo *types.RoomInfo, eventIDs []string) ([]types.StateEntry, bool, bool, error) {
 	roomState := state.NewStateResolution(r.DB, roomInfo, r)
 	prevStates, err := r.DB.StateAtEventIDs(ctx, eventIDs)
 	if err != nil {
@@ -730,12 +924,7 @@ func (r *Queryer) loadStateAtEventIDs(ctx context.Context, roomInfo *types.RoomI
 	stateEntries, err := roomState.LoadCombinedStateAfterEvents(
 		ctx, prevStates,
 	)
-	if err != nil {
-		return nil, rejected, false, err
-	}
-
-	events, err := helpers.LoadStateEvents(ctx, r.DB, roomInfo, stateEntries)
-	return events, rejected, false, err
+	return stateEntries, rejected, false, err
 }
 
 type eventsFromIDs func(context.Context, *types.RoomInfo, []string) ([]types.Event, error)
@@ -793,6 +982,9 @@ func GetAuthChain(
 
 // QueryRoomVersionForRoom implements api.RoomserverInternalAPI
 func (r *Queryer) QueryRoomVersionForRoom(ctx context.Context, roomID string) (gomatrixserverlib.RoomVersion, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryRoomVersionForRoom")
+	defer span.End()
+
 	if roomVersion, ok := r.Cache.GetRoomVersion(roomID); ok {
 		return roomVersion, nil
 	}
@@ -813,6 +1005,9 @@ func (r *Queryer) QueryPublishedRooms(
 	req *api.QueryPublishedRoomsRequest,
 	res *api.QueryPublishedRoomsResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryPublishedRooms")
+	defer span.End()
+
 	if req.RoomID != "" {
 		visible, err := r.DB.GetPublishedRoom(ctx, req.RoomID)
 		if err == nil && visible {
@@ -829,7 +1024,17 @@ func (r *Queryer) QueryPublishedRooms(
 	return nil
 }
 
+func (r *Queryer) QueryDirectoryBlockedRooms(ctx context.Context) ([]string, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryDirectoryBlockedRooms")
+	defer span.End()
+
+	return r.DB.GetDirectoryBlockedRooms(ctx)
+}
+
 func (r *Queryer) QueryCurrentState(ctx context.Context, req *api.QueryCurrentStateRequest, res *api.QueryCurrentStateResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryCurrentState")
+	defer span.End()
+
 	res.StateEvents = make(map[gomatrixserverlib.StateKeyTuple]*types.HeaderedEvent)
 	for _, tuple := range req.StateTuples {
 		if tuple.StateKey == "*" && req.AllowWildcards {
@@ -857,6 +1062,9 @@ func (r *Queryer) QueryCurrentState(ctx context.Context, req *api.QueryCurrentSt
 }
 
 func (r *Queryer) QueryRoomsForUser(ctx context.Context, userID spec.UserID, desiredMembership string) ([]spec.RoomID, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryRoomsForUser")
+	defer span.End()
+
 	roomIDStrs, err := r.DB.GetRoomsByMembership(ctx, userID, desiredMembership)
 	if err != nil {
 		return nil, err
@@ -873,10 +1081,21 @@ func (r *Queryer) QueryRoomsForUser(ctx context.Context, userID spec.UserID, des
 }
 
 func (r *Queryer) QueryKnownUsers(ctx context.Context, req *api.QueryKnownUsersRequest, res *api.QueryKnownUsersResponse) error {
-	users, err := r.DB.GetKnownUsers(ctx, req.UserID, req.SearchString, req.Limit)
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryKnownUsers")
+	defer span.End()
+
+	if req.Limit <= 0 {
+		return nil
+	}
+	// Ask for one more than the limit so that we know if there's another page.
+	users, err := r.DB.GetKnownUsers(ctx, req.UserID, req.SearchString, req.From, req.Limit+1)
 	if err != nil && err != sql.ErrNoRows {
 		return err
 	}
+	if len(users) > req.Limit {
+		users = users[:req.Limit]
+		res.NextBatch = users[req.Limit-1]
+	}
 	for _, user := range users {
 		res.Users = append(res.Users, authtypes.FullyQualifiedProfile{
 			UserID: user,
@@ -886,6 +1105,9 @@ func (r *Queryer) QueryKnownUsers(ctx context.Context, req *api.QueryKnownUsersR
 }
 
 func (r *Queryer) QueryBulkStateContent(ctx context.Context, req *api.QueryBulkStateContentRequest, res *api.QueryBulkStateContentResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryBulkStateContent")
+	defer span.End()
+
 	events, err := r.DB.GetBulkStateContent(ctx, req.RoomIDs, req.StateTuples, req.AllowWildcards)
 	if err != nil {
 		return err
@@ -906,12 +1128,18 @@ func (r *Queryer) QueryBulkStateContent(ctx context.Context, req *api.QueryBulkS
 }
 
 func (r *Queryer) QueryLeftUsers(ctx context.Context, req *api.QueryLeftUsersRequest, res *api.QueryLeftUsersResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryLeftUsers")
+	defer span.End()
+
 	var err error
 	res.LeftUsers, err = r.DB.GetLeftUsers(ctx, req.StaleDeviceListUsers)
 	return err
 }
 
 func (r *Queryer) QuerySharedUsers(ctx context.Context, req *api.QuerySharedUsersRequest, res *api.QuerySharedUsersResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QuerySharedUsers")
+	defer span.End()
+
 	parsedUserID, err := spec.NewUserID(req.UserID, true)
 	if err != nil {
 		return err
@@ -947,6 +1175,9 @@ func (r *Queryer) QuerySharedUsers(ctx context.Context, req *api.QuerySharedUser
 }
 
 func (r *Queryer) QueryServerBannedFromRoom(ctx context.Context, req *api.QueryServerBannedFromRoomRequest, res *api.QueryServerBannedFromRoomResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryServerBannedFromRoom")
+	defer span.End()
+
 	if r.ServerACLs == nil {
 		return errors.New("no server ACL tracking")
 	}
@@ -955,6 +1186,9 @@ func (r *Queryer) QueryServerBannedFromRoom(ctx context.Context, req *api.QueryS
 }
 
 func (r *Queryer) QueryAuthChain(ctx context.Context, req *api.QueryAuthChainRequest, res *api.QueryAuthChainResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryAuthChain")
+	defer span.End()
+
 	chain, err := GetAuthChain(ctx, r.DB.EventsFromIDs, nil, req.EventIDs)
 	if err != nil {
 		return err
@@ -967,12 +1201,93 @@ func (r *Queryer) QueryAuthChain(ctx context.Context, req *api.QueryAuthChainReq
 	return nil
 }
 
+func (r *Queryer) QueryAdminEventContext(ctx context.Context, eventID string) (*api.AdminEventContext, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryAdminEventContext")
+	defer span.End()
+
+	status, err := r.DB.EventStatus(ctx, eventID)
+	if err != nil || status == nil {
+		return nil, err
+	}
+	roomInfo, err := r.DB.RoomInfoByNID(ctx, status.RoomNID)
+	if err != nil {
+		return nil, err
+	}
+	if roomInfo == nil {
+		return nil, types.ErrorInvalidRoomInfo
+	}
+	events, err := r.DB.Events(ctx, roomInfo.RoomVersion, []types.EventNID{status.EventNID})
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	event := events[0]
+
+	chain, err := GetAuthChain(ctx, r.DB.EventsFromIDs, roomInfo, event.AuthEventIDs())
+	if err != nil {
+		return nil, err
+	}
+	res := &api.AdminEventContext{
+		Event:            &types.HeaderedEvent{PDU: event.PDU},
+		AuthChain:        make([]*types.HeaderedEvent, len(chain)),
+		StateSnapshotNID: status.StateSnapshotNID,
+		Rejected:         status.IsRejected,
+		SoftFailed:       status.IsSoftFailed,
+		SentToOutput:     status.SentToOutput,
+	}
+	for i := range chain {
+		res.AuthChain[i] = &types.HeaderedEvent{PDU: chain[i]}
+	}
+
+	// Only local events which made it downstream were sent over federation, to
+	// the servers that were joined to the room after the event.
+	if !status.SentToOutput || status.StateSnapshotNID == 0 {
+		return res, nil
+	}
+	sender, err := r.QueryUserIDForSender(ctx, event.RoomID(), event.SenderID())
+	if err != nil || sender == nil || !r.IsLocalServerName(sender.Domain()) {
+		return res, err
+	}
+	stateEntries, err := helpers.StateBeforeEvent(ctx, r.DB, roomInfo, status.EventNID, r)
+	if err != nil {
+		return nil, err
+	}
+	memberships, err := helpers.GetMembershipsAtState(ctx, r.DB, roomInfo, stateEntries, true)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[spec.ServerName]struct{}{}
+	for _, membership := range memberships {
+		if membership.StateKey() == nil {
+			continue
+		}
+		userID, err := r.QueryUserIDForSender(ctx, event.RoomID(), spec.SenderID(*membership.StateKey()))
+		if err != nil || userID == nil {
+			continue
+		}
+		if _, ok := seen[userID.Domain()]; ok || r.IsLocalServerName(userID.Domain()) {
+			continue
+		}
+		seen[userID.Domain()] = struct{}{}
+		res.Destinations = append(res.Destinations, userID.Domain())
+	}
+	sort.Slice(res.Destinations, func(i, j int) bool {
+		return res.Destinations[i] < res.Destinations[j]
+	})
+	return res, nil
+}
+
 func (r *Queryer) InvitePending(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (bool, error) {
 	pending, _, _, _, err := helpers.IsInvitePending(ctx, r.DB, roomID.String(), senderID)
 	return pending, err
 }
 
 func (r *Queryer) QueryRoomInfo(ctx context.Context, roomID spec.RoomID) (*types.RoomInfo, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryRoomInfo")
+	defer span.End()
+
 	return r.DB.RoomInfo(ctx, roomID.String())
 }
 
@@ -1030,6 +1345,9 @@ func (r *Queryer) JoinedUserCount(ctx context.Context, roomID string) (int, erro
 
 // nolint:gocyclo
 func (r *Queryer) QueryRestrictedJoinAllowed(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (string, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryRestrictedJoinAllowed")
+	defer span.End()
+
 	// Look up if we know anything about the room. If it doesn't exist
 	// or is a stub entry then we can't do anything.
 	roomInfo, err := r.DB.RoomInfo(ctx, roomID.String())
@@ -1048,11 +1366,17 @@ func (r *Queryer) QueryRestrictedJoinAllowed(ctx context.Context, roomID spec.Ro
 }
 
 func (r *Queryer) QuerySenderIDForUser(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.SenderID, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QuerySenderIDForUser")
+	defer span.End()
+
 	senderID := spec.SenderID(userID.String())
 	return &senderID, nil
 }
 
 func (r *Queryer) QueryUserIDForSender(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	ctx, span := tracing.StartSpan(ctx, "roomserver.QueryUserIDForSender")
+	defer span.End()
+
 	userID, err := spec.NewUserID(string(senderID), true)
 	if err == nil {
 		return userID, nil
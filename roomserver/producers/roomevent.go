@@ -15,6 +15,7 @@
 package producers
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/nats-io/nats.go"
@@ -22,6 +23,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
 
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/roomserver/acls"
 	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/setup/jetstream"
@@ -39,12 +41,13 @@ type RoomEventProducer struct {
 	JetStream nats.JetStreamContext
 }
 
-func (r *RoomEventProducer) ProduceRoomEvents(roomID string, updates []api.OutputEvent) error {
+func (r *RoomEventProducer) ProduceRoomEvents(ctx context.Context, roomID string, updates []api.OutputEvent) error {
 	var err error
 	for _, update := range updates {
 		msg := nats.NewMsg(r.Topic)
 		msg.Header.Set(jetstream.RoomEventType, string(update.Type))
 		msg.Header.Set(jetstream.RoomID, roomID)
+		tracing.InjectNATS(ctx, msg)
 		msg.Data, err = json.Marshal(update)
 		if err != nil {
 			return err
@@ -1,8 +1,11 @@
 package roomserver_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"reflect"
 	"testing"
 	"time"
@@ -14,6 +17,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/httputil"
 	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/internal"
 	"github.com/neilalexander/harmony/roomserver/internal/input"
 	"github.com/stretchr/testify/assert"
 	"github.com/tidwall/gjson"
@@ -34,6 +38,7 @@ import (
 	"github.com/neilalexander/harmony/roomserver"
 	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/roomserver/storage"
+	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/test"
 	"github.com/neilalexander/harmony/test/testrig"
 )
@@ -229,6 +234,189 @@ func Test_QueryLeftUsers(t *testing.T) {
 	})
 }
 
+func TestQueryAdminEventContext(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	msg := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{
+		"body": "hello",
+	})
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		res, err := rsAPI.QueryAdminEventContext(ctx, msg.EventID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res == nil || res.Event.EventID() != msg.EventID() {
+			t.Fatalf("expected the message event, got %+v", res)
+		}
+		if len(res.AuthChain) == 0 || res.StateSnapshotNID == 0 {
+			t.Fatalf("expected an auth chain and state snapshot, got %+v", res)
+		}
+		if res.Rejected || res.SoftFailed || !res.SentToOutput {
+			t.Fatalf("unexpected event status %+v", res)
+		}
+		if len(res.Destinations) != 0 {
+			t.Fatalf("expected no remote destinations, got %v", res.Destinations)
+		}
+
+		res, err = rsAPI.QueryAdminEventContext(ctx, "$idontexist")
+		if err != nil || res != nil {
+			t.Fatalf("expected unknown event not to be found, got %+v, %v", res, err)
+		}
+	})
+}
+
+// failingJSONVerifier fails to verify every signature.
+type failingJSONVerifier struct{}
+
+func (v *failingJSONVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i := range results {
+		results[i].Error = errors.New("bad signature")
+	}
+	return results, nil
+}
+
+// keyJSONVerifier only accepts signatures made with a single key.
+type keyJSONVerifier struct {
+	keyID     gomatrixserverlib.KeyID
+	publicKey ed25519.PublicKey
+}
+
+func (v *keyJSONVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i := range requests {
+		results[i].Error = gomatrixserverlib.VerifyJSON(string(requests[i].ServerName), v.keyID, v.publicKey, requests[i].Message)
+	}
+	return results, nil
+}
+
+func TestAdminRoomExportImport(t *testing.T) {
+	// Alice's events are signed with a key which is rotated away before
+	// the room is imported again.
+	alice := test.NewUser(t, test.WithSigningServer("test", "ed25519:old", test.PrivateKeyA))
+	room := test.NewRoom(t, alice)
+	msg := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{
+		"body": "hello",
+	})
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		rsAPI.(*internal.RoomserverInternalAPI).Inputer.KeyRing = &test.NopJSONVerifier{}
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		exportRoom := func(roomID string) (*api.RoomExport, []byte, error) {
+			var buf bytes.Buffer
+			if err := rsAPI.PerformAdminExportRoom(ctx, roomID, &buf, func(done, total int64) {}); err != nil {
+				return nil, nil, err
+			}
+			export := &api.RoomExport{}
+			return export, buf.Bytes(), json.Unmarshal(buf.Bytes(), export)
+		}
+		importRoom := func(archive []byte) (*api.RoomImportResult, error) {
+			return rsAPI.PerformAdminImportRoom(ctx, bytes.NewReader(archive), func(done, total int64) {})
+		}
+		export, archive, err := exportRoom(room.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, api.RoomExportFormat, export.Format)
+		assert.Equal(t, []string{msg.EventID()}, export.LatestEventIDs)
+		assert.NotEmpty(t, export.StateEventIDs)
+		assert.Equal(t, len(room.Events()), len(export.Events))
+		for _, exported := range export.Events {
+			// Every event was sent with its prev_events, so none need state.
+			assert.False(t, exported.Outlier)
+			assert.Nil(t, exported.StateBefore)
+		}
+
+		_, _, err = exportRoom("!idontexist:test")
+		assert.ErrorAs(t, err, &eventutil.ErrRoomNoExists{})
+
+		// The room can't be imported while it still exists.
+		_, err = importRoom(archive)
+		assert.ErrorAs(t, err, &api.ErrNotAllowed{})
+
+		if err = rsAPI.PerformAdminPurgeRoom(ctx, room.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		// Events which fail signature checks are never imported, even if
+		// they were sent by us and are re-signed.
+		rsAPI.(*internal.RoomserverInternalAPI).Inputer.KeyRing = &failingJSONVerifier{}
+		_, err = importRoom(archive)
+		assert.ErrorAs(t, err, &api.ErrNotAllowed{})
+
+		// Events signed with a key that we no longer have aren't re-signed
+		// unless the key is one of our old keys, as anyone could otherwise
+		// make an archive of events from our users.
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Global.KeyID = "ed25519:new"
+		cfg.Global.PrivateKey = privateKey
+		rsAPI.(*internal.RoomserverInternalAPI).Inputer.KeyRing = &keyJSONVerifier{
+			keyID:     cfg.Global.KeyID,
+			publicKey: publicKey,
+		}
+		_, err = importRoom(archive)
+		assert.ErrorAs(t, err, &api.ErrNotAllowed{})
+
+		// Events signed with one of our old keys are re-signed with our
+		// current key.
+		cfg.Global.OldVerifyKeys = []*config.OldVerifyKeys{{
+			KeyID:     "ed25519:old",
+			PublicKey: spec.Base64Bytes(test.PrivateKeyA.Public().(ed25519.PublicKey)),
+		}}
+		res, err := importRoom(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, &api.RoomImportResult{
+			RoomID:   room.ID,
+			Imported: len(room.Events()),
+			Resigned: len(room.Events()),
+		}, res)
+
+		eventContext, err := rsAPI.QueryAdminEventContext(ctx, msg.EventID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eventContext == nil || eventContext.StateSnapshotNID == 0 || eventContext.Rejected {
+			t.Fatalf("expected the message to be imported with state, got %+v", eventContext)
+		}
+		reexport, _, err := exportRoom(room.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, export.StateEventIDs, reexport.StateEventIDs)
+	})
+}
+
 func TestPurgeRoom(t *testing.T) {
 	alice := test.NewUser(t)
 	bob := test.NewUser(t)
@@ -267,7 +455,7 @@ func TestPurgeRoom(t *testing.T) {
 		rsAPI.SetFederationAPI(fsAPI, nil)
 
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, fsAPI.IsBlacklistedOrBackingOff)
-		syncapi.AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, userAPI, rsAPI, caches, caching.DisableMetrics)
+		syncapi.AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, userAPI, rsAPI, nil, caching.DisableMetrics)
 
 		// Create the room
 		if err = api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
@@ -1318,3 +1506,79 @@ func TestRoomsWithACLs(t *testing.T) {
 		assert.Equal(t, []string{aclRoom.ID}, roomsWithACLs)
 	})
 }
+
+func TestInputQueueJournal(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		cfg.RoomServer.PersistInputQueue = true
+
+		natsInstance := jetstream.NATSInstance{}
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		db, err := storage.Open(processCtx.Context(), cm, &cfg.RoomServer.Database, caches)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsCtx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsCtx, &cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		// Events which have been processed are removed from the journal.
+		if err = api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		entries, err := db.JournalledInputEvents(ctx, 0, 100)
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+
+		// Replaying the journal queues an event that was lost from the stream.
+		msg := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "lost"})
+		data, err := json.Marshal(api.InputRoomEvent{Kind: api.KindNew, Event: msg})
+		assert.NoError(t, err)
+		queued, err := db.JournalInputEvent(ctx, msg.EventID(), room.ID, "test", data)
+		assert.NoError(t, err)
+		assert.True(t, queued)
+		replayed, err := rsAPI.PerformAdminReplayInputQueue(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, replayed)
+
+		// An event which can't be unmarshalled is terminated, so it must be
+		// removed from the journal too or it would be replayed forever.
+		queued, err = db.JournalInputEvent(ctx, "$broken", room.ID, "test", []byte("{"))
+		assert.NoError(t, err)
+		assert.True(t, queued)
+		broken := &nats.Msg{
+			Subject: cfg.Global.JetStream.Prefixed(jetstream.InputRoomEventSubj(room.ID)),
+			Header:  nats.Header{},
+			Data:    []byte("{"),
+		}
+		broken.Header.Set(jetstream.RoomID, room.ID)
+		broken.Header.Set(jetstream.EventID, "$broken")
+		if _, err = jsCtx.PublishMsg(broken); err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(time.Second * 10)
+		for {
+			entries, err = db.JournalledInputEvents(ctx, 0, 100)
+			assert.NoError(t, err)
+			if len(entries) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("journal still has %d entries", len(entries))
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+		events, err := db.EventsFromIDs(ctx, nil, []string{msg.EventID()})
+		assert.NoError(t, err)
+		assert.Len(t, events, 1)
+	})
+}
@@ -97,11 +97,21 @@ type Database interface {
 	// Lookup the event IDs for a batch of event numeric IDs.
 	// Returns an error if the retrieval went wrong.
 	EventIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error)
+	// Lookup the event IDs of the auth chain made up of the given auth events and the auth
+	// events of the given events, recursively, without loading the events.
+	AuthChainEventIDs(ctx context.Context, authEventNIDs, eventNIDs []types.EventNID) ([]string, error)
 	// Opens and returns a room updater, which locks the room and opens a transaction.
 	// The GetRoomUpdater must have Commit or Rollback called on it if this doesn't return an error.
 	// If this returns an error then no further action is required.
 	// IsEventRejected returns true if the event is known and rejected.
 	IsEventRejected(ctx context.Context, roomNID types.RoomNID, eventID string) (rejected bool, err error)
+	// EventStatus returns how the event was stored, or nil if the event isn't known.
+	EventStatus(ctx context.Context, eventID string) (*types.EventStatus, error)
+	// SetEventSoftFailed records that the event was soft-failed.
+	SetEventSoftFailed(ctx context.Context, eventNID types.EventNID) error
+	// RoomEventStatuses returns how each event in the room was stored, in the order
+	// in which they were stored.
+	RoomEventStatuses(ctx context.Context, roomNID types.RoomNID) ([]types.EventStatus, error)
 	GetRoomUpdater(ctx context.Context, roomInfo *types.RoomInfo) (*shared.RoomUpdater, error)
 	// Look up event references for the latest events in the room and the current state snapshot.
 	// Returns the latest events, the current state and the maximum depth of the latest events plus 1.
@@ -139,6 +149,9 @@ type Database interface {
 	// joinOnly is set to true.
 	// Returns an error if there was a problem talking to the database.
 	GetMembershipEventNIDsForRoom(ctx context.Context, roomNID types.RoomNID, joinOnly bool, localOnly bool) ([]types.EventNID, error)
+	// Lookup up to limit membership event numeric IDs for the room which are after
+	// the given numeric ID, in order, so that large rooms can be paged through.
+	GetMembershipEventNIDsForRoomPage(ctx context.Context, roomNID types.RoomNID, joinOnly, localOnly bool, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
 	// EventsFromIDs looks up the Events for a list of event IDs. Does not error if event was
 	// not found.
 	// Returns an error if the retrieval went wrong.
@@ -149,6 +162,33 @@ type Database interface {
 	GetPublishedRooms(ctx context.Context, networkID string, includeAllNetworks bool) ([]string, error)
 	// Returns whether a given room is published or not.
 	GetPublishedRoom(ctx context.Context, roomID string) (bool, error)
+	// UnpublishRoom removes a room from the room directory for every appservice and network.
+	UnpublishRoom(ctx context.Context, roomID string) error
+	// SetRoomDirectoryBlocked blocks or unblocks a room from being published in the
+	// room directory. Blocking a room also unpublishes it.
+	SetRoomDirectoryBlocked(ctx context.Context, roomID string, blocked bool) error
+	// IsRoomDirectoryBlocked returns whether a room is blocked from the room directory.
+	IsRoomDirectoryBlocked(ctx context.Context, roomID string) (bool, error)
+	// GetDirectoryBlockedRooms returns the rooms which are blocked from the room directory.
+	GetDirectoryBlockedRooms(ctx context.Context) ([]string, error)
+	// RoomsWithoutLocalMembers returns up to limit rooms after the given room NID which have
+	// no local members and which haven't already been found to be dead.
+	RoomsWithoutLocalMembers(ctx context.Context, afterRoomNID types.RoomNID, limit int) ([]types.RoomNID, []string, error)
+	// MarkRoomDead records that a room was found to be dead, so that it can be purged later.
+	MarkRoomDead(ctx context.Context, roomID string, detectedAt spec.Timestamp) error
+	// DeadRoomsBefore returns up to limit dead rooms which were found before the given time
+	// and which still have no local members.
+	DeadRoomsBefore(ctx context.Context, before spec.Timestamp, limit int) ([]string, error)
+	// ForgetRevivedDeadRooms forgets the dead rooms which have local members again.
+	ForgetRevivedDeadRooms(ctx context.Context) error
+	// JournalInputEvent records an input event before it is queued, returning false if the
+	// same input event was already waiting to be processed.
+	JournalInputEvent(ctx context.Context, eventID, roomID string, virtualHost spec.ServerName, inputJSON []byte) (bool, error)
+	// ForgetInputEvent removes an input event from the journal once it has been processed.
+	ForgetInputEvent(ctx context.Context, eventID string, inputJSON []byte) error
+	// JournalledInputEvents returns up to limit journalled input events after the given ID,
+	// oldest first.
+	JournalledInputEvents(ctx context.Context, afterID int64, limit int) ([]tables.InputQueueEntry, error)
 
 	// TODO: factor out - from currentstateserver
 
@@ -168,8 +208,9 @@ type Database interface {
 	GetLocalServerInRoom(ctx context.Context, roomNID types.RoomNID) (bool, error)
 	// GetServerInRoom returns true if we think a server is in a given room or false otherwise.
 	GetServerInRoom(ctx context.Context, roomNID types.RoomNID, serverName spec.ServerName) (bool, error)
-	// GetKnownUsers searches all users that userID knows about.
-	GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]string, error)
+	// GetKnownUsers searches all users that userID knows about, in order, starting after
+	// the given user ID.
+	GetKnownUsers(ctx context.Context, userID, searchString, from string, limit int) ([]string, error)
 	// ForgetRoom sets a flag in the membership table, that the user wishes to forget a specific room
 	ForgetRoom(ctx context.Context, userID, roomID string, forget bool) error
 
@@ -222,6 +263,8 @@ type RoomDatabase interface {
 	RoomInfoByNID(ctx context.Context, roomNID types.RoomNID) (*types.RoomInfo, error)
 	// IsEventRejected returns true if the event is known and rejected.
 	IsEventRejected(ctx context.Context, roomNID types.RoomNID, eventID string) (rejected bool, err error)
+	// SetEventSoftFailed records that the event was soft-failed.
+	SetEventSoftFailed(ctx context.Context, eventNID types.EventNID) error
 	MissingAuthPrevEvents(ctx context.Context, e gomatrixserverlib.PDU) (missingAuth, missingPrev []string, err error)
 	UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventSender string) error
 	GetRoomUpdater(ctx context.Context, roomInfo *types.RoomInfo) (*shared.RoomUpdater, error)
@@ -236,6 +279,14 @@ type RoomDatabase interface {
 	GetOrCreateEventTypeNID(ctx context.Context, eventType string) (eventTypeNID types.EventTypeNID, err error)
 	GetOrCreateEventStateKeyNID(ctx context.Context, eventStateKey *string) (types.EventStateKeyNID, error)
 	GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*types.HeaderedEvent, error)
+	// JournalInputEvent records an input event before it is queued, returning false if the
+	// same input event was already waiting to be processed.
+	JournalInputEvent(ctx context.Context, eventID, roomID string, virtualHost spec.ServerName, inputJSON []byte) (bool, error)
+	// ForgetInputEvent removes an input event from the journal once it has been processed.
+	ForgetInputEvent(ctx context.Context, eventID string, inputJSON []byte) error
+	// JournalledInputEvents returns up to limit journalled input events after the given ID,
+	// oldest first.
+	JournalledInputEvents(ctx context.Context, afterID int64, limit int) ([]tables.InputQueueEntry, error)
 }
 
 type EventDatabase interface {
@@ -248,6 +299,9 @@ type EventDatabase interface {
 	StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error)
 	SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error)
 	EventIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error)
+	// AuthChainEventIDs returns the event IDs of the auth chain made up of the given auth events
+	// and the auth events of the given events, recursively, without loading the events.
+	AuthChainEventIDs(ctx context.Context, authEventNIDs, eventNIDs []types.EventNID) ([]string, error)
 	EventsFromIDs(ctx context.Context, roomInfo *types.RoomInfo, eventIDs []string) ([]types.Event, error)
 	Events(ctx context.Context, roomVersion gomatrixserverlib.RoomVersion, eventNIDs []types.EventNID) ([]types.Event, error)
 	// MaybeRedactEvent returns the redaction event and the redacted event if this call resulted in a redaction, else an error
@@ -0,0 +1,135 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/storage/tables"
+	"github.com/neilalexander/harmony/roomserver/types"
+)
+
+const deadRoomsSchema = `
+-- Stores the rooms which the dead room cleanup will purge, because they had no
+-- local members and no recent activity.
+CREATE TABLE IF NOT EXISTS roomserver_dead_rooms (
+    -- The room ID of the room
+    room_id TEXT NOT NULL PRIMARY KEY,
+    -- When the room was found to be dead, in UNIX epoch ms
+    detected_ts BIGINT NOT NULL
+);
+`
+
+// A local member is a local user who is joined, invited or knocking.
+const hasLocalMembersSQL = "" +
+	"EXISTS (SELECT 1 FROM roomserver_membership m" +
+	" WHERE m.room_nid = r.room_nid AND m.target_local = true AND m.membership_nid > $1)"
+
+const insertDeadRoomSQL = "" +
+	"INSERT INTO roomserver_dead_rooms (room_id, detected_ts) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+
+// Selects rooms after the given room NID which have no local members and
+// which haven't been found to be dead already.
+const selectRoomsWithoutLocalMembersSQL = "" +
+	"SELECT r.room_nid, r.room_id FROM roomserver_rooms r" +
+	" WHERE r.room_nid > $2 AND NOT " + hasLocalMembersSQL +
+	" AND NOT EXISTS (SELECT 1 FROM roomserver_dead_rooms d WHERE d.room_id = r.room_id)" +
+	" ORDER BY r.room_nid ASC LIMIT $3"
+
+// Selects dead rooms found before the given time which still have no local
+// members.
+const selectDeadRoomsBeforeSQL = "" +
+	"SELECT d.room_id FROM roomserver_dead_rooms d" +
+	" JOIN roomserver_rooms r ON r.room_id = d.room_id" +
+	" WHERE d.detected_ts < $2 AND NOT " + hasLocalMembersSQL +
+	" ORDER BY d.detected_ts ASC LIMIT $3"
+
+// Forgets dead rooms which have local members again, so that they are looked
+// at afresh if they are abandoned again.
+const deleteRevivedDeadRoomsSQL = "" +
+	"DELETE FROM roomserver_dead_rooms d USING roomserver_rooms r" +
+	" WHERE r.room_id = d.room_id AND " + hasLocalMembersSQL
+
+type deadRoomsStatements struct {
+	insertDeadRoomStmt                 *sql.Stmt
+	selectRoomsWithoutLocalMembersStmt *sql.Stmt
+	selectDeadRoomsBeforeStmt          *sql.Stmt
+	deleteRevivedDeadRoomsStmt         *sql.Stmt
+}
+
+func CreateDeadRoomsTable(db *sql.DB) error {
+	_, err := db.Exec(deadRoomsSchema)
+	return err
+}
+
+func PrepareDeadRoomsTable(db *sql.DB) (tables.DeadRooms, error) {
+	s := &deadRoomsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertDeadRoomStmt, insertDeadRoomSQL},
+		{&s.selectRoomsWithoutLocalMembersStmt, selectRoomsWithoutLocalMembersSQL},
+		{&s.selectDeadRoomsBeforeStmt, selectDeadRoomsBeforeSQL},
+		{&s.deleteRevivedDeadRoomsStmt, deleteRevivedDeadRoomsSQL},
+	}.Prepare(db)
+}
+
+func (s *deadRoomsStatements) InsertDeadRoom(
+	ctx context.Context, txn *sql.Tx, roomID string, detectedAt spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertDeadRoomStmt).ExecContext(ctx, roomID, detectedAt)
+	return err
+}
+
+func (s *deadRoomsStatements) SelectRoomsWithoutLocalMembers(
+	ctx context.Context, txn *sql.Tx, afterRoomNID types.RoomNID, limit int,
+) ([]types.RoomNID, []string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomsWithoutLocalMembersStmt).QueryContext(
+		ctx, tables.MembershipStateLeaveOrBan, afterRoomNID, limit,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomsWithoutLocalMembersStmt: rows.close() failed")
+
+	var roomNIDs []types.RoomNID
+	var roomIDs []string
+	var roomNID types.RoomNID
+	var roomID string
+	for rows.Next() {
+		if err = rows.Scan(&roomNID, &roomID); err != nil {
+			return nil, nil, err
+		}
+		roomNIDs = append(roomNIDs, roomNID)
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomNIDs, roomIDs, rows.Err()
+}
+
+func (s *deadRoomsStatements) SelectDeadRoomsBefore(
+	ctx context.Context, txn *sql.Tx, before spec.Timestamp, limit int,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectDeadRoomsBeforeStmt).QueryContext(
+		ctx, tables.MembershipStateLeaveOrBan, before, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectDeadRoomsBeforeStmt: rows.close() failed")
+
+	var roomIDs []string
+	var roomID string
+	for rows.Next() {
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+func (s *deadRoomsStatements) DeleteRevivedDeadRooms(ctx context.Context, txn *sql.Tx) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteRevivedDeadRoomsStmt).ExecContext(ctx, tables.MembershipStateLeaveOrBan)
+	return err
+}
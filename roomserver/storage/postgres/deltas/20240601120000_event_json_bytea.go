@@ -0,0 +1,40 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpEventJSONBytea converts the event JSON column to BYTEA so that it can
+// hold compressed event JSON. Fresh databases already create it as BYTEA.
+func UpEventJSONBytea(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+DO $$
+BEGIN
+	IF (SELECT data_type FROM information_schema.columns
+		WHERE table_name = 'roomserver_event_json' AND column_name = 'event_json') = 'text' THEN
+		ALTER TABLE roomserver_event_json
+			ALTER COLUMN event_json TYPE BYTEA USING convert_to(event_json, 'UTF8');
+	END IF;
+END $$;
+`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/storage/tables"
+)
+
+const directoryBlockedSchema = `
+-- Stores which rooms an administrator has blocked from the room directory
+CREATE TABLE IF NOT EXISTS roomserver_directory_blocked (
+    -- The room ID of the room
+    room_id TEXT NOT NULL PRIMARY KEY
+);
+`
+
+const insertDirectoryBlockedSQL = "" +
+	"INSERT INTO roomserver_directory_blocked (room_id) VALUES ($1) ON CONFLICT DO NOTHING"
+
+const deleteDirectoryBlockedSQL = "" +
+	"DELETE FROM roomserver_directory_blocked WHERE room_id = $1"
+
+const selectDirectoryBlockedSQL = "" +
+	"SELECT EXISTS(SELECT 1 FROM roomserver_directory_blocked WHERE room_id = $1)"
+
+const selectAllDirectoryBlockedSQL = "" +
+	"SELECT room_id FROM roomserver_directory_blocked ORDER BY room_id ASC"
+
+type directoryBlockedStatements struct {
+	insertDirectoryBlockedStmt    *sql.Stmt
+	deleteDirectoryBlockedStmt    *sql.Stmt
+	selectDirectoryBlockedStmt    *sql.Stmt
+	selectAllDirectoryBlockedStmt *sql.Stmt
+}
+
+func CreateDirectoryBlockedTable(db *sql.DB) error {
+	_, err := db.Exec(directoryBlockedSchema)
+	return err
+}
+
+func PrepareDirectoryBlockedTable(db *sql.DB) (tables.DirectoryBlocked, error) {
+	s := &directoryBlockedStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertDirectoryBlockedStmt, insertDirectoryBlockedSQL},
+		{&s.deleteDirectoryBlockedStmt, deleteDirectoryBlockedSQL},
+		{&s.selectDirectoryBlockedStmt, selectDirectoryBlockedSQL},
+		{&s.selectAllDirectoryBlockedStmt, selectAllDirectoryBlockedSQL},
+	}.Prepare(db)
+}
+
+func (s *directoryBlockedStatements) InsertDirectoryBlocked(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertDirectoryBlockedStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *directoryBlockedStatements) DeleteDirectoryBlocked(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteDirectoryBlockedStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *directoryBlockedStatements) SelectDirectoryBlocked(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (blocked bool, err error) {
+	err = sqlutil.TxStmt(txn, s.selectDirectoryBlockedStmt).QueryRowContext(ctx, roomID).Scan(&blocked)
+	return
+}
+
+func (s *directoryBlockedStatements) SelectAllDirectoryBlocked(
+	ctx context.Context, txn *sql.Tx,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectAllDirectoryBlockedStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAllDirectoryBlockedStmt: rows.close() failed")
+
+	roomIDs := []string{}
+	var roomID string
+	for rows.Next() {
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
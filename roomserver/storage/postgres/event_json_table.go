@@ -20,7 +20,9 @@ import (
 	"database/sql"
 
 	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/eventcompress"
 	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/storage/postgres/deltas"
 	"github.com/neilalexander/harmony/roomserver/storage/tables"
 	"github.com/neilalexander/harmony/roomserver/types"
 )
@@ -32,13 +34,13 @@ CREATE TABLE IF NOT EXISTS roomserver_event_json (
     -- Local numeric ID for the event.
     event_nid BIGINT NOT NULL PRIMARY KEY,
     -- The JSON for the event.
-    -- Stored as TEXT because this should be valid UTF-8.
+    -- Stored as BYTEA because the JSON may be compressed, depending on the
+    -- event_compression database option. See internal/eventcompress.
     -- Not stored as a JSONB because we always just pull the entire event
     -- so there is no point in postgres parsing it.
     -- Not stored as JSON because we already validate the JSON in the server
     -- so there is no point in postgres validating it.
-    -- TODO: Should we be compressing the events with Snappy or DEFLATE?
-    event_json TEXT NOT NULL
+    event_json BYTEA NOT NULL
 );
 `
 
@@ -55,17 +57,29 @@ const bulkSelectEventJSONSQL = "" +
 	" ORDER BY event_nid ASC"
 
 type eventJSONStatements struct {
+	compressor              *eventcompress.Compressor
 	insertEventJSONStmt     *sql.Stmt
 	bulkSelectEventJSONStmt *sql.Stmt
 }
 
 func CreateEventJSONTable(db *sql.DB) error {
 	_, err := db.Exec(eventJSONSchema)
-	return err
+	if err != nil {
+		return err
+	}
+
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "roomserver: convert event_json to bytea",
+		Up:      deltas.UpEventJSONBytea,
+	})
+	return m.Up(context.Background())
 }
 
-func PrepareEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
-	s := &eventJSONStatements{}
+func PrepareEventJSONTable(db *sql.DB, compressor *eventcompress.Compressor) (tables.EventJSON, error) {
+	s := &eventJSONStatements{
+		compressor: compressor,
+	}
 
 	return s, sqlutil.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
@@ -77,7 +91,7 @@ func (s *eventJSONStatements) InsertEventJSON(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
 ) error {
 	stmt := sqlutil.TxStmt(txn, s.insertEventJSONStmt)
-	_, err := stmt.ExecContext(ctx, int64(eventNID), eventJSON)
+	_, err := stmt.ExecContext(ctx, int64(eventNID), s.compressor.Compress(eventJSON))
 	return err
 }
 
@@ -103,6 +117,9 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 		if err := rows.Scan(&eventNID, &result.EventJSON); err != nil {
 			return nil, err
 		}
+		if result.EventJSON, err = eventcompress.Decompress(result.EventJSON); err != nil {
+			return nil, err
+		}
 		result.EventNID = types.EventNID(eventNID)
 	}
 	return results[:i], rows.Err()
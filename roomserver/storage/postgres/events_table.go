@@ -63,7 +63,10 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
     event_id TEXT NOT NULL CONSTRAINT roomserver_event_id_unique UNIQUE,
     -- A list of numeric IDs for events that can authenticate this event.
 	auth_event_nids BIGINT[] NOT NULL,
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+	-- Whether the event passed auth against the state before it but not
+	-- against the current state, and so was never sent to the output log.
+	is_soft_failed BOOLEAN NOT NULL DEFAULT FALSE
 );
 
 -- Create an index which helps in resolving membership events (event_type_nid = 5) - (used for history visibility)
@@ -126,6 +129,9 @@ const selectEventSentToOutputSQL = "" +
 const updateEventSentToOutputSQL = "" +
 	"UPDATE roomserver_events SET sent_to_output = TRUE WHERE event_nid = $1"
 
+const updateEventSoftFailedSQL = "" +
+	"UPDATE roomserver_events SET is_soft_failed = TRUE WHERE event_nid = $1"
+
 const selectEventIDSQL = "" +
 	"SELECT event_id FROM roomserver_events WHERE event_nid = $1"
 
@@ -136,6 +142,19 @@ const bulkSelectStateAtEventAndReferenceSQL = "" +
 const bulkSelectEventIDSQL = "" +
 	"SELECT event_nid, event_id FROM roomserver_events WHERE event_nid = ANY($1)"
 
+// selectAuthChainEventIDsSQL follows the auth events recursively, starting from
+// the events in $1 and the auth events of the events in $2, so that the auth
+// chain can be found without loading the events themselves.
+const selectAuthChainEventIDsSQL = "" +
+	"WITH RECURSIVE auth_chain(event_nid) AS (" +
+	"SELECT UNNEST($1::BIGINT[])" +
+	" UNION SELECT UNNEST(auth_event_nids) FROM roomserver_events WHERE event_nid = ANY($2::BIGINT[])" +
+	" UNION SELECT a.event_nid FROM roomserver_events e" +
+	" INNER JOIN auth_chain c ON e.event_nid = c.event_nid" +
+	" CROSS JOIN UNNEST(e.auth_event_nids) AS a(event_nid)" +
+	")" +
+	" SELECT e.event_id FROM auth_chain c INNER JOIN roomserver_events e ON e.event_nid = c.event_nid"
+
 const bulkSelectEventNIDSQL = "" +
 	"SELECT event_id, event_nid, room_nid FROM roomserver_events WHERE event_id = ANY($1)"
 
@@ -151,6 +170,15 @@ const selectRoomNIDsForEventNIDsSQL = "" +
 const selectEventRejectedSQL = "" +
 	"SELECT is_rejected FROM roomserver_events WHERE room_nid = $1 AND event_id = $2"
 
+const selectEventStatusSQL = "" +
+	"SELECT event_nid, room_nid, state_snapshot_nid, is_rejected, is_soft_failed, sent_to_output FROM roomserver_events WHERE event_id = $1"
+
+// Selects how each event in a room was stored, in the order in which they were
+// stored. This isn't by depth, as the depth of an event is chosen by its sender.
+const selectRoomEventStatusesSQL = "" +
+	"SELECT event_nid, room_nid, state_snapshot_nid, is_rejected, is_soft_failed, sent_to_output FROM roomserver_events" +
+	" WHERE room_nid = $1 ORDER BY event_nid ASC"
+
 const selectRoomsWithEventTypeNIDSQL = `SELECT DISTINCT room_nid FROM roomserver_events WHERE event_type_nid = $1`
 
 type eventStatements struct {
@@ -164,15 +192,19 @@ type eventStatements struct {
 	updateEventStateStmt                          *sql.Stmt
 	selectEventSentToOutputStmt                   *sql.Stmt
 	updateEventSentToOutputStmt                   *sql.Stmt
+	updateEventSoftFailedStmt                     *sql.Stmt
 	selectEventIDStmt                             *sql.Stmt
 	bulkSelectStateAtEventAndReferenceStmt        *sql.Stmt
 	bulkSelectEventIDStmt                         *sql.Stmt
+	selectAuthChainEventIDsStmt                   *sql.Stmt
 	bulkSelectEventNIDStmt                        *sql.Stmt
 	bulkSelectUnsentEventNIDStmt                  *sql.Stmt
 	selectMaxEventDepthStmt                       *sql.Stmt
 	selectRoomNIDsForEventNIDsStmt                *sql.Stmt
 	selectEventRejectedStmt                       *sql.Stmt
+	selectEventStatusStmt                         *sql.Stmt
 	selectRoomsWithEventTypeNIDStmt               *sql.Stmt
+	selectRoomEventStatusesStmt                   *sql.Stmt
 }
 
 func CreateEventsTable(db *sql.DB) error {
@@ -187,6 +219,10 @@ func CreateEventsTable(db *sql.DB) error {
 			Version: "roomserver: drop column reference_sha from roomserver_events",
 			Up:      deltas.UpDropEventReferenceSHAEvents,
 		},
+		{
+			Version: "roomserver: add is_soft_failed column to roomserver_events",
+			Up:      deltas.UpAddSoftFailedColumn,
+		},
 	}...)
 	return m.Up(context.Background())
 }
@@ -204,16 +240,20 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectStateAtEventByIDStmt, bulkSelectStateAtEventByIDSQL},
 		{&s.updateEventStateStmt, updateEventStateSQL},
 		{&s.updateEventSentToOutputStmt, updateEventSentToOutputSQL},
+		{&s.updateEventSoftFailedStmt, updateEventSoftFailedSQL},
 		{&s.selectEventSentToOutputStmt, selectEventSentToOutputSQL},
 		{&s.selectEventIDStmt, selectEventIDSQL},
 		{&s.bulkSelectStateAtEventAndReferenceStmt, bulkSelectStateAtEventAndReferenceSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
+		{&s.selectAuthChainEventIDsStmt, selectAuthChainEventIDsSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.bulkSelectUnsentEventNIDStmt, bulkSelectUnsentEventNIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
 		{&s.selectRoomNIDsForEventNIDsStmt, selectRoomNIDsForEventNIDsSQL},
 		{&s.selectEventRejectedStmt, selectEventRejectedSQL},
+		{&s.selectEventStatusStmt, selectEventStatusSQL},
 		{&s.selectRoomsWithEventTypeNIDStmt, selectRoomsWithEventTypeNIDSQL},
+		{&s.selectRoomEventStatusesStmt, selectRoomEventStatusesSQL},
 	}.Prepare(db)
 }
 
@@ -426,6 +466,12 @@ func (s *eventStatements) UpdateEventSentToOutput(ctx context.Context, txn *sql.
 	return err
 }
 
+func (s *eventStatements) UpdateEventSoftFailed(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error {
+	stmt := sqlutil.TxStmt(txn, s.updateEventSoftFailedStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID))
+	return err
+}
+
 func (s *eventStatements) SelectEventID(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (eventID string, err error) {
@@ -475,6 +521,26 @@ func (s *eventStatements) BulkSelectStateAtEventAndReference(
 }
 
 // bulkSelectEventID returns a map from numeric event ID to string event ID.
+func (s *eventStatements) SelectAuthChainEventIDs(
+	ctx context.Context, txn *sql.Tx, authEventNIDs, eventNIDs []types.EventNID,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAuthChainEventIDsStmt)
+	rows, err := stmt.QueryContext(ctx, eventNIDsAsArray(authEventNIDs), eventNIDsAsArray(eventNIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAuthChainEventIDs: rows.close() failed")
+	var eventIDs []string
+	var eventID string
+	for rows.Next() {
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
 func (s *eventStatements) BulkSelectEventID(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
 	stmt := sqlutil.TxStmt(txn, s.bulkSelectEventIDStmt)
 	rows, err := stmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs))
@@ -591,6 +657,45 @@ func (s *eventStatements) SelectEventRejected(
 	return
 }
 
+func (s *eventStatements) SelectEventStatus(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) (*types.EventStatus, error) {
+	var status types.EventStatus
+	stmt := sqlutil.TxStmt(txn, s.selectEventStatusStmt)
+	err := stmt.QueryRowContext(ctx, eventID).Scan(
+		&status.EventNID, &status.RoomNID, &status.StateSnapshotNID,
+		&status.IsRejected, &status.IsSoftFailed, &status.SentToOutput,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (s *eventStatements) SelectRoomEventStatuses(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.EventStatus, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomEventStatusesStmt)
+	rows, err := stmt.QueryContext(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomEventStatuses: rows.close() failed")
+
+	var statuses []types.EventStatus
+	var status types.EventStatus
+	for rows.Next() {
+		if err = rows.Scan(
+			&status.EventNID, &status.RoomNID, &status.StateSnapshotNID,
+			&status.IsRejected, &status.IsSoftFailed, &status.SentToOutput,
+		); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, rows.Err()
+}
+
 func (s *eventStatements) SelectRoomsWithEventTypeNID(
 	ctx context.Context, txn *sql.Tx, eventTypeNID types.EventTypeNID,
 ) ([]types.RoomNID, error) {
@@ -0,0 +1,112 @@
+package postgres
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"time"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/storage/tables"
+)
+
+const inputQueueSchema = `
+-- Stores the input events which have been accepted by the roomserver but not
+-- yet processed, so that they can be replayed if they are lost from JetStream.
+CREATE TABLE IF NOT EXISTS roomserver_input_queue (
+    -- The order in which the events were queued
+    id BIGSERIAL PRIMARY KEY,
+    -- The event ID of the queued event
+    event_id TEXT NOT NULL,
+    -- The room ID of the queued event
+    room_id TEXT NOT NULL,
+    -- The virtual host which the event was sent to
+    virtual_host TEXT NOT NULL,
+    -- The JSON of the input room event
+    input_json BYTEA NOT NULL,
+    -- The SHA-256 hash of the JSON of the input room event, as the same
+    -- event can be queued more than once with a different kind or state
+    input_hash BYTEA NOT NULL,
+    -- When the event was queued, in UNIX epoch ms
+    queued_ts BIGINT NOT NULL,
+    CONSTRAINT roomserver_input_queue_unique UNIQUE (event_id, input_hash)
+);
+`
+
+const insertInputQueueEntrySQL = "" +
+	"INSERT INTO roomserver_input_queue (event_id, room_id, virtual_host, input_json, input_hash, queued_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT ON CONSTRAINT roomserver_input_queue_unique DO NOTHING"
+
+const deleteInputQueueEntrySQL = "" +
+	"DELETE FROM roomserver_input_queue WHERE event_id = $1 AND input_hash = $2"
+
+const selectInputQueueEntriesSQL = "" +
+	"SELECT id, event_id, room_id, virtual_host, input_json, queued_ts FROM roomserver_input_queue" +
+	" WHERE id > $1 ORDER BY id ASC LIMIT $2"
+
+type inputQueueStatements struct {
+	insertInputQueueEntryStmt   *sql.Stmt
+	deleteInputQueueEntryStmt   *sql.Stmt
+	selectInputQueueEntriesStmt *sql.Stmt
+}
+
+func CreateInputQueueTable(db *sql.DB) error {
+	_, err := db.Exec(inputQueueSchema)
+	return err
+}
+
+func PrepareInputQueueTable(db *sql.DB) (tables.InputQueue, error) {
+	s := &inputQueueStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertInputQueueEntryStmt, insertInputQueueEntrySQL},
+		{&s.deleteInputQueueEntryStmt, deleteInputQueueEntrySQL},
+		{&s.selectInputQueueEntriesStmt, selectInputQueueEntriesSQL},
+	}.Prepare(db)
+}
+
+func (s *inputQueueStatements) InsertInputQueueEntry(
+	ctx context.Context, txn *sql.Tx, eventID, roomID string, virtualHost spec.ServerName, inputJSON []byte,
+) (bool, error) {
+	inputHash := sha256.Sum256(inputJSON)
+	res, err := sqlutil.TxStmt(txn, s.insertInputQueueEntryStmt).ExecContext(
+		ctx, eventID, roomID, virtualHost, inputJSON, inputHash[:], spec.AsTimestamp(time.Now()),
+	)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	return inserted > 0, err
+}
+
+func (s *inputQueueStatements) DeleteInputQueueEntry(
+	ctx context.Context, txn *sql.Tx, eventID string, inputJSON []byte,
+) error {
+	inputHash := sha256.Sum256(inputJSON)
+	_, err := sqlutil.TxStmt(txn, s.deleteInputQueueEntryStmt).ExecContext(ctx, eventID, inputHash[:])
+	return err
+}
+
+func (s *inputQueueStatements) SelectInputQueueEntries(
+	ctx context.Context, txn *sql.Tx, afterID int64, limit int,
+) ([]tables.InputQueueEntry, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectInputQueueEntriesStmt).QueryContext(ctx, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectInputQueueEntriesStmt: rows.close() failed")
+
+	var entries []tables.InputQueueEntry
+	for rows.Next() {
+		var entry tables.InputQueueEntry
+		if err = rows.Scan(
+			&entry.ID, &entry.EventID, &entry.RoomID, &entry.VirtualHost, &entry.InputJSON, &entry.QueuedAt,
+		); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -112,6 +112,14 @@ const selectLocalMembershipsFromRoomSQL = "" +
 	" WHERE room_nid = $1 AND event_nid != 0" +
 	" AND target_local = true and forgotten = false"
 
+// selectMembershipsFromRoomPageSQL pages through the memberships in event NID
+// order, optionally only returning joins and local users.
+const selectMembershipsFromRoomPageSQL = "" +
+	"SELECT event_nid FROM roomserver_membership" +
+	" WHERE room_nid = $1 AND event_nid > $2 AND forgotten = false" +
+	" AND ($3 = false OR membership_nid = $4) AND ($5 = false OR target_local = true)" +
+	" ORDER BY event_nid LIMIT $6"
+
 const selectMembershipForUpdateSQL = "" +
 	"SELECT membership_nid FROM roomserver_membership" +
 	" WHERE room_nid = $1 AND target_nid = $2 FOR UPDATE"
@@ -138,7 +146,8 @@ var selectKnownUsersSQL = "" +
 	"roomserver_membership.target_nid = roomserver_event_state_keys.event_state_key_nid" +
 	" WHERE room_nid = ANY(" +
 	"  SELECT DISTINCT room_nid FROM roomserver_membership WHERE target_nid=$1 AND membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) +
-	") AND membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) + " AND event_state_key LIKE $2 LIMIT $3"
+	") AND membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) + " AND event_state_key LIKE $2" +
+	" AND event_state_key > $4 ORDER BY event_state_key LIMIT $3"
 
 // selectLocalServerInRoomSQL is an optimised case for checking if we, the local server,
 // are in the room by using the target_local column of the membership table. Normally when
@@ -172,6 +181,7 @@ type membershipStatements struct {
 	selectLocalMembershipsFromRoomAndMembershipStmt *sql.Stmt
 	selectMembershipsFromRoomStmt                   *sql.Stmt
 	selectLocalMembershipsFromRoomStmt              *sql.Stmt
+	selectMembershipsFromRoomPageStmt               *sql.Stmt
 	updateMembershipStmt                            *sql.Stmt
 	selectRoomsWithMembershipStmt                   *sql.Stmt
 	selectJoinedUsersSetForRoomsAndUserStmt         *sql.Stmt
@@ -208,6 +218,7 @@ func PrepareMembershipTable(db *sql.DB) (tables.Membership, error) {
 		{&s.selectLocalMembershipsFromRoomAndMembershipStmt, selectLocalMembershipsFromRoomAndMembershipSQL},
 		{&s.selectMembershipsFromRoomStmt, selectMembershipsFromRoomSQL},
 		{&s.selectLocalMembershipsFromRoomStmt, selectLocalMembershipsFromRoomSQL},
+		{&s.selectMembershipsFromRoomPageStmt, selectMembershipsFromRoomPageSQL},
 		{&s.updateMembershipStmt, updateMembershipSQL},
 		{&s.selectRoomsWithMembershipStmt, selectRoomsWithMembershipSQL},
 		{&s.selectJoinedUsersSetForRoomsAndUserStmt, selectJoinedUsersSetForRoomsAndUserSQL},
@@ -302,6 +313,27 @@ func (s *membershipStatements) SelectMembershipsFromRoom(
 	return eventNIDs, rows.Err()
 }
 
+func (s *membershipStatements) SelectMembershipsFromRoomPage(
+	ctx context.Context, txn *sql.Tx,
+	roomNID types.RoomNID, joinOnly, localOnly bool, afterEventNID types.EventNID, limit int,
+) (eventNIDs []types.EventNID, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembershipsFromRoomPageStmt)
+	rows, err := stmt.QueryContext(ctx, roomNID, afterEventNID, joinOnly, tables.MembershipStateJoin, localOnly, limit)
+	if err != nil {
+		return
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMembershipsFromRoomPage: rows.close() failed")
+
+	var eNID types.EventNID
+	for rows.Next() {
+		if err = rows.Scan(&eNID); err != nil {
+			return
+		}
+		eventNIDs = append(eventNIDs, eNID)
+	}
+	return eventNIDs, rows.Err()
+}
+
 func (s *membershipStatements) SelectMembershipsFromRoomAndMembership(
 	ctx context.Context, txn *sql.Tx,
 	roomNID types.RoomNID, membership tables.MembershipState, localOnly bool,
@@ -402,10 +434,10 @@ func (s *membershipStatements) SelectJoinedUsersSetForRooms(
 
 func (s *membershipStatements) SelectKnownUsers(
 	ctx context.Context, txn *sql.Tx,
-	userID types.EventStateKeyNID, searchString string, limit int,
+	userID types.EventStateKeyNID, searchString, from string, limit int,
 ) ([]string, error) {
 	stmt := sqlutil.TxStmt(txn, s.selectKnownUsersStmt)
-	rows, err := stmt.QueryContext(ctx, userID, fmt.Sprintf("%%%s%%", searchString), limit)
+	rows, err := stmt.QueryContext(ctx, userID, fmt.Sprintf("%%%s%%", searchString), limit, from)
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +49,9 @@ const selectAllPublishedSQL = "" +
 const selectNetworkPublishedSQL = "" +
 	"SELECT room_id FROM roomserver_published WHERE published = $1 AND network_id = $2 ORDER BY room_id ASC"
 
+const unpublishRoomSQL = "" +
+	"UPDATE roomserver_published SET published = false WHERE room_id = $1"
+
 const selectPublishedSQL = "" +
 	"SELECT published FROM roomserver_published WHERE room_id = $1"
 
@@ -57,6 +60,7 @@ type publishedStatements struct {
 	selectAllPublishedStmt     *sql.Stmt
 	selectPublishedStmt        *sql.Stmt
 	selectNetworkPublishedStmt *sql.Stmt
+	unpublishRoomStmt          *sql.Stmt
 }
 
 func CreatePublishedTable(db *sql.DB) error {
@@ -86,6 +90,7 @@ func PreparePublishedTable(db *sql.DB) (tables.Published, error) {
 		{&s.selectAllPublishedStmt, selectAllPublishedSQL},
 		{&s.selectPublishedStmt, selectPublishedSQL},
 		{&s.selectNetworkPublishedStmt, selectNetworkPublishedSQL},
+		{&s.unpublishRoomStmt, unpublishRoomSQL},
 	}.Prepare(db)
 }
 
@@ -97,6 +102,14 @@ func (s *publishedStatements) UpsertRoomPublished(
 	return
 }
 
+func (s *publishedStatements) UnpublishRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.unpublishRoomStmt)
+	_, err = stmt.ExecContext(ctx, roomID)
+	return
+}
+
 func (s *publishedStatements) SelectPublishedFromRoomID(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) (published bool, err error) {
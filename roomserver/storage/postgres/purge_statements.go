@@ -52,6 +52,9 @@ const purgeRedactionsSQL = "" +
 const purgeRoomAliasesSQL = "" +
 	"DELETE FROM roomserver_room_aliases WHERE room_id = $1"
 
+const purgeDeadRoomSQL = "" +
+	"DELETE FROM roomserver_dead_rooms WHERE room_id = $1"
+
 const purgeRoomSQL = "" +
 	"DELETE FROM roomserver_rooms WHERE room_nid = $1"
 
@@ -72,6 +75,7 @@ type purgeStatements struct {
 	purgePublishedStmt            *sql.Stmt
 	purgeRedactionStmt            *sql.Stmt
 	purgeRoomAliasesStmt          *sql.Stmt
+	purgeDeadRoomStmt             *sql.Stmt
 	purgeRoomStmt                 *sql.Stmt
 	purgeStateBlockEntriesStmt    *sql.Stmt
 	purgeStateSnapshotEntriesStmt *sql.Stmt
@@ -89,6 +93,7 @@ func PreparePurgeStatements(db *sql.DB) (*purgeStatements, error) {
 		{&s.purgePreviousEventsStmt, purgePreviousEventsSQL},
 		{&s.purgeRedactionStmt, purgeRedactionsSQL},
 		{&s.purgeRoomAliasesStmt, purgeRoomAliasesSQL},
+		{&s.purgeDeadRoomStmt, purgeDeadRoomSQL},
 		{&s.purgeRoomStmt, purgeRoomSQL},
 		{&s.purgeStateBlockEntriesStmt, purgeStateBlockEntriesSQL},
 		{&s.purgeStateSnapshotEntriesStmt, purgeStateSnapshotEntriesSQL},
@@ -103,6 +108,7 @@ func (s *purgeStatements) PurgeRoom(
 	purgeByRoomID := []*sql.Stmt{
 		s.purgeRoomAliasesStmt,
 		s.purgePublishedStmt,
+		s.purgeDeadRoomStmt,
 	}
 	for _, stmt := range purgeByRoomID {
 		_, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomID)
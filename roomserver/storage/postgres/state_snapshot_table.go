@@ -21,6 +21,7 @@ import (
 	"fmt"
 
 	"github.com/lib/pq"
+	"github.com/neilalexander/harmony/internal/eventcompress"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/util"
 
@@ -236,6 +237,9 @@ func (s *stateSnapshotStatements) BulkSelectMembershipForHistoryVisibility(
 			result[eventID] = ev
 			continue
 		}
+		if evJson, err = eventcompress.Decompress(evJson); err != nil {
+			return nil, err
+		}
 		event, err := verImpl.NewEventFromTrustedJSON(evJson, false)
 		if err != nil {
 			result[eventID] = &types.HeaderedEvent{}
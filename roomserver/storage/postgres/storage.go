@@ -25,6 +25,7 @@ import (
 	_ "github.com/lib/pq"
 
 	"github.com/neilalexander/harmony/internal/caching"
+	"github.com/neilalexander/harmony/internal/eventcompress"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/roomserver/storage/postgres/deltas"
 	"github.com/neilalexander/harmony/roomserver/storage/shared"
@@ -58,7 +59,11 @@ func Open(ctx context.Context, conMan *sqlutil.Connections, dbProperties *config
 
 	// Then prepare the statements. Now that the migrations have run, any columns referred
 	// to in the database code should now exist.
-	if err = d.prepare(db, writer, cache); err != nil {
+	compressor, err := eventcompress.NewCompressor(dbProperties.EventCompression)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.prepare(db, writer, cache, compressor); err != nil {
 		return nil, err
 	}
 
@@ -128,6 +133,15 @@ func (d *Database) create(db *sql.DB) error {
 	if err := CreatePublishedTable(db); err != nil {
 		return err
 	}
+	if err := CreateDirectoryBlockedTable(db); err != nil {
+		return err
+	}
+	if err := CreateDeadRoomsTable(db); err != nil {
+		return err
+	}
+	if err := CreateInputQueueTable(db); err != nil {
+		return err
+	}
 	if err := CreateRedactionsTable(db); err != nil {
 		return err
 	}
@@ -138,7 +152,7 @@ func (d *Database) create(db *sql.DB) error {
 	return nil
 }
 
-func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.RoomServerCaches) error {
+func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.RoomServerCaches, compressor *eventcompress.Compressor) error {
 	eventStateKeys, err := PrepareEventStateKeysTable(db)
 	if err != nil {
 		return err
@@ -147,7 +161,7 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 	if err != nil {
 		return err
 	}
-	eventJSON, err := PrepareEventJSONTable(db)
+	eventJSON, err := PrepareEventJSONTable(db, compressor)
 	if err != nil {
 		return err
 	}
@@ -187,6 +201,18 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 	if err != nil {
 		return err
 	}
+	directoryBlocked, err := PrepareDirectoryBlockedTable(db)
+	if err != nil {
+		return err
+	}
+	deadRooms, err := PrepareDeadRoomsTable(db)
+	if err != nil {
+		return err
+	}
+	inputQueue, err := PrepareInputQueueTable(db)
+	if err != nil {
+		return err
+	}
 	redactions, err := PrepareRedactionsTable(db)
 	if err != nil {
 		return err
@@ -222,6 +248,9 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 		InvitesTable:       invites,
 		MembershipTable:    membership,
 		PublishedTable:     published,
+		DirectoryBlocked:   directoryBlocked,
+		DeadRooms:          deadRooms,
+		InputQueue:         inputQueue,
 		Purge:              purge,
 		UserRoomKeyTable:   userRoomKeys,
 	}
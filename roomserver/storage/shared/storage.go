@@ -45,6 +45,9 @@ type Database struct {
 	InvitesTable       tables.Invites
 	MembershipTable    tables.Membership
 	PublishedTable     tables.Published
+	DirectoryBlocked   tables.DirectoryBlocked
+	DeadRooms          tables.DeadRooms
+	InputQueue         tables.InputQueue
 	Purge              tables.Purge
 	UserRoomKeyTable   tables.UserRoomKeys
 	GetRoomUpdaterFn   func(ctx context.Context, roomInfo *types.RoomInfo) (*RoomUpdater, error)
@@ -383,6 +386,12 @@ func (d *EventDatabase) EventIDs(
 	return d.EventsTable.BulkSelectEventID(ctx, nil, eventNIDs)
 }
 
+func (d *EventDatabase) AuthChainEventIDs(
+	ctx context.Context, authEventNIDs, eventNIDs []types.EventNID,
+) ([]string, error) {
+	return d.EventsTable.SelectAuthChainEventIDs(ctx, nil, authEventNIDs, eventNIDs)
+}
+
 func (d *EventDatabase) EventsFromIDs(ctx context.Context, roomInfo *types.RoomInfo, eventIDs []string) ([]types.Event, error) {
 	return d.eventsFromIDs(ctx, nil, roomInfo, eventIDs, NoFilter)
 }
@@ -523,6 +532,12 @@ func (d *Database) GetMembershipEventNIDsForRoom(
 	return d.getMembershipEventNIDsForRoom(ctx, nil, roomNID, joinOnly, localOnly)
 }
 
+func (d *Database) GetMembershipEventNIDsForRoomPage(
+	ctx context.Context, roomNID types.RoomNID, joinOnly, localOnly bool, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	return d.MembershipTable.SelectMembershipsFromRoomPage(ctx, nil, roomNID, joinOnly, localOnly, afterEventNID, limit)
+}
+
 func (d *Database) getMembershipEventNIDsForRoom(
 	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, joinOnly bool, localOnly bool,
 ) ([]types.EventNID, error) {
@@ -665,6 +680,24 @@ func (d *Database) IsEventRejected(ctx context.Context, roomNID types.RoomNID, e
 	return d.EventsTable.SelectEventRejected(ctx, nil, roomNID, eventID)
 }
 
+func (d *Database) EventStatus(ctx context.Context, eventID string) (*types.EventStatus, error) {
+	status, err := d.EventsTable.SelectEventStatus(ctx, nil, eventID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return status, err
+}
+
+func (d *Database) SetEventSoftFailed(ctx context.Context, eventNID types.EventNID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.EventsTable.UpdateEventSoftFailed(ctx, txn, eventNID)
+	})
+}
+
+func (d *Database) RoomEventStatuses(ctx context.Context, roomNID types.RoomNID) ([]types.EventStatus, error) {
+	return d.EventsTable.SelectRoomEventStatuses(ctx, nil, roomNID)
+}
+
 func (d *Database) AssignRoomNID(ctx context.Context, roomID spec.RoomID, roomVersion gomatrixserverlib.RoomVersion) (roomNID types.RoomNID, err error) {
 	// This should already be checked, let's check it anyway.
 	_, err = gomatrixserverlib.GetRoomVersion(roomVersion)
@@ -850,6 +883,70 @@ func (d *Database) PublishRoom(ctx context.Context, roomID, appserviceID, networ
 	})
 }
 
+func (d *Database) UnpublishRoom(ctx context.Context, roomID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PublishedTable.UnpublishRoom(ctx, txn, roomID)
+	})
+}
+
+func (d *Database) SetRoomDirectoryBlocked(ctx context.Context, roomID string, blocked bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if !blocked {
+			return d.DirectoryBlocked.DeleteDirectoryBlocked(ctx, txn, roomID)
+		}
+		if err := d.DirectoryBlocked.InsertDirectoryBlocked(ctx, txn, roomID); err != nil {
+			return err
+		}
+		return d.PublishedTable.UnpublishRoom(ctx, txn, roomID)
+	})
+}
+
+func (d *Database) IsRoomDirectoryBlocked(ctx context.Context, roomID string) (bool, error) {
+	return d.DirectoryBlocked.SelectDirectoryBlocked(ctx, nil, roomID)
+}
+
+func (d *Database) GetDirectoryBlockedRooms(ctx context.Context) ([]string, error) {
+	return d.DirectoryBlocked.SelectAllDirectoryBlocked(ctx, nil)
+}
+
+func (d *Database) RoomsWithoutLocalMembers(ctx context.Context, afterRoomNID types.RoomNID, limit int) ([]types.RoomNID, []string, error) {
+	return d.DeadRooms.SelectRoomsWithoutLocalMembers(ctx, nil, afterRoomNID, limit)
+}
+
+func (d *Database) MarkRoomDead(ctx context.Context, roomID string, detectedAt spec.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.DeadRooms.InsertDeadRoom(ctx, txn, roomID, detectedAt)
+	})
+}
+
+func (d *Database) DeadRoomsBefore(ctx context.Context, before spec.Timestamp, limit int) ([]string, error) {
+	return d.DeadRooms.SelectDeadRoomsBefore(ctx, nil, before, limit)
+}
+
+func (d *Database) ForgetRevivedDeadRooms(ctx context.Context) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.DeadRooms.DeleteRevivedDeadRooms(ctx, txn)
+	})
+}
+
+func (d *Database) JournalInputEvent(ctx context.Context, eventID, roomID string, virtualHost spec.ServerName, inputJSON []byte) (queued bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		queued, err = d.InputQueue.InsertInputQueueEntry(ctx, txn, eventID, roomID, virtualHost, inputJSON)
+		return err
+	})
+	return
+}
+
+func (d *Database) ForgetInputEvent(ctx context.Context, eventID string, inputJSON []byte) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.InputQueue.DeleteInputQueueEntry(ctx, txn, eventID, inputJSON)
+	})
+}
+
+func (d *Database) JournalledInputEvents(ctx context.Context, afterID int64, limit int) ([]tables.InputQueueEntry, error) {
+	return d.InputQueue.SelectInputQueueEntries(ctx, nil, afterID, limit)
+}
+
 func (d *Database) GetPublishedRoom(ctx context.Context, roomID string) (bool, error) {
 	return d.PublishedTable.SelectPublishedFromRoomID(ctx, nil, roomID)
 }
@@ -1618,12 +1715,12 @@ func (d *Database) GetServerInRoom(ctx context.Context, roomNID types.RoomNID, s
 }
 
 // GetKnownUsers searches all users that userID knows about.
-func (d *Database) GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]string, error) {
+func (d *Database) GetKnownUsers(ctx context.Context, userID, searchString, from string, limit int) ([]string, error) {
 	stateKeyNID, err := d.EventStateKeysTable.SelectEventStateKeyNID(ctx, nil, userID)
 	if err != nil {
 		return nil, err
 	}
-	return d.MembershipTable.SelectKnownUsers(ctx, nil, stateKeyNID, searchString, limit)
+	return d.MembershipTable.SelectKnownUsers(ctx, nil, stateKeyNID, searchString, from, limit)
 }
 
 func (d *Database) RoomsWithACLs(ctx context.Context) ([]string, error) {
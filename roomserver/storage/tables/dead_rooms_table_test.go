@@ -0,0 +1,106 @@
+package tables_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/storage/postgres"
+	"github.com/neilalexander/harmony/roomserver/storage/tables"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+)
+
+func mustCreateDeadRoomsTable(t *testing.T, dbType test.DBType) (tab tables.DeadRooms, roomsTab tables.Rooms, membershipTab tables.Membership, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreateRoomsTable(db)
+		assert.NoError(t, err)
+		err = postgres.CreateMembershipTable(db)
+		assert.NoError(t, err)
+		err = postgres.CreateDeadRoomsTable(db)
+		assert.NoError(t, err)
+		roomsTab, err = postgres.PrepareRoomsTable(db)
+		assert.NoError(t, err)
+		membershipTab, err = postgres.PrepareMembershipTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareDeadRoomsTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, roomsTab, membershipTab, close
+}
+
+func TestDeadRoomsTable(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, roomsTab, membershipTab, close := mustCreateDeadRoomsTable(t, dbType)
+		defer close()
+
+		room := test.NewRoom(t, alice)
+		roomNID, err := roomsTab.InsertRoomNID(ctx, nil, room.ID, gomatrixserverlib.RoomVersionV10)
+		assert.NoError(t, err)
+
+		// A room where the only local user has left has no local members.
+		err = membershipTab.InsertMembership(ctx, nil, roomNID, 1, true)
+		assert.NoError(t, err)
+		roomNIDs, roomIDs, err := tab.SelectRoomsWithoutLocalMembers(ctx, nil, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{room.ID}, roomIDs)
+		assert.Len(t, roomNIDs, 1)
+
+		// Paging past the room finds nothing more.
+		_, roomIDs, err = tab.SelectRoomsWithoutLocalMembers(ctx, nil, roomNIDs[0], 10)
+		assert.NoError(t, err)
+		assert.Empty(t, roomIDs)
+
+		// Dead rooms aren't found again, and marking them twice shouldn't fail.
+		detectedAt := spec.AsTimestamp(time.Now())
+		for i := 0; i < 2; i++ {
+			err = tab.InsertDeadRoom(ctx, nil, room.ID, detectedAt)
+			assert.NoError(t, err)
+		}
+		_, roomIDs, err = tab.SelectRoomsWithoutLocalMembers(ctx, nil, 0, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, roomIDs)
+
+		roomIDs, err = tab.SelectDeadRoomsBefore(ctx, nil, detectedAt, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, roomIDs)
+		roomIDs, err = tab.SelectDeadRoomsBefore(ctx, nil, detectedAt+1, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{room.ID}, roomIDs)
+
+		// Once a local user joins again, the room is no longer dead.
+		_, err = membershipTab.UpdateMembership(ctx, nil, roomNID, 1, 1, tables.MembershipStateJoin, 1, false)
+		assert.NoError(t, err)
+		roomIDs, err = tab.SelectDeadRoomsBefore(ctx, nil, detectedAt+1, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, roomIDs)
+		err = tab.DeleteRevivedDeadRooms(ctx, nil)
+		assert.NoError(t, err)
+		_, roomIDs, err = tab.SelectRoomsWithoutLocalMembers(ctx, nil, 0, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, roomIDs)
+
+		// Leaving again makes it a candidate once more.
+		_, err = membershipTab.UpdateMembership(ctx, nil, roomNID, 1, 1, tables.MembershipStateLeaveOrBan, 2, false)
+		assert.NoError(t, err)
+		_, roomIDs, err = tab.SelectRoomsWithoutLocalMembers(ctx, nil, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{room.ID}, roomIDs)
+	})
+}
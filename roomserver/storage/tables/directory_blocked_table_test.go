@@ -0,0 +1,65 @@
+package tables_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/storage/postgres"
+	"github.com/neilalexander/harmony/roomserver/storage/tables"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+)
+
+func mustCreateDirectoryBlockedTable(t *testing.T, dbType test.DBType) (tab tables.DirectoryBlocked, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreateDirectoryBlockedTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareDirectoryBlockedTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestDirectoryBlockedTable(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateDirectoryBlockedTable(t, dbType)
+		defer close()
+
+		room := test.NewRoom(t, alice)
+		blocked, err := tab.SelectDirectoryBlocked(ctx, nil, room.ID)
+		assert.NoError(t, err)
+		assert.False(t, blocked)
+
+		// blocking twice shouldn't fail
+		for i := 0; i < 2; i++ {
+			err = tab.InsertDirectoryBlocked(ctx, nil, room.ID)
+			assert.NoError(t, err)
+		}
+		blocked, err = tab.SelectDirectoryBlocked(ctx, nil, room.ID)
+		assert.NoError(t, err)
+		assert.True(t, blocked)
+		roomIDs, err := tab.SelectAllDirectoryBlocked(ctx, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{room.ID}, roomIDs)
+
+		err = tab.DeleteDirectoryBlocked(ctx, nil, room.ID)
+		assert.NoError(t, err)
+		roomIDs, err = tab.SelectAllDirectoryBlocked(ctx, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, roomIDs)
+	})
+}
@@ -26,7 +26,7 @@ func mustCreateEventJSONTable(t *testing.T, dbType test.DBType) (tables.EventJSO
 	case test.DBTypePostgres:
 		err = postgres.CreateEventJSONTable(db)
 		assert.NoError(t, err)
-		tab, err = postgres.PrepareEventJSONTable(db)
+		tab, err = postgres.PrepareEventJSONTable(db, nil)
 	}
 	assert.NoError(t, err)
 
@@ -141,6 +141,17 @@ func Test_EventsTable(t *testing.T) {
 		maxDepth, err := tab.SelectMaxEventDepth(ctx, nil, nids)
 		assert.NoError(t, err)
 		assert.Equal(t, int64(len(room.Events())+1), maxDepth)
+
+		// Soft-failed events are recorded as such.
+		status, err := tab.SelectEventStatus(ctx, nil, eventIDs[0])
+		assert.NoError(t, err)
+		assert.False(t, status.IsSoftFailed)
+		err = tab.UpdateEventSoftFailed(ctx, nil, status.EventNID)
+		assert.NoError(t, err)
+		status, err = tab.SelectEventStatus(ctx, nil, eventIDs[0])
+		assert.NoError(t, err)
+		assert.True(t, status.IsSoftFailed)
+		assert.False(t, status.IsRejected)
 	})
 }
 
@@ -178,3 +189,41 @@ func TestRoomsWithACL(t *testing.T) {
 		assert.Equal(t, wantRoomNIDs, gotRoomNIDs)
 	})
 }
+
+func Test_EventsTableAuthChain(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateEventsTable(t, dbType)
+		defer close()
+
+		// $d is authed by $c, which is authed by $b and $a, and $b by $a.
+		nids := map[string]types.EventNID{}
+		for _, ev := range []struct {
+			eventID string
+			auth    []string
+		}{
+			{"$a", nil},
+			{"$b", []string{"$a"}},
+			{"$c", []string{"$a", "$b"}},
+			{"$d", []string{"$c"}},
+		} {
+			authNIDs := make([]types.EventNID, 0, len(ev.auth))
+			for _, authID := range ev.auth {
+				authNIDs = append(authNIDs, nids[authID])
+			}
+			eventNID, _, err := tab.InsertEvent(ctx, nil, 1, 1, 1, ev.eventID, authNIDs, 1, false)
+			assert.NoError(t, err)
+			nids[ev.eventID] = eventNID
+		}
+
+		// The auth chain of an event doesn't include the event itself...
+		eventIDs, err := tab.SelectAuthChainEventIDs(ctx, nil, nil, []types.EventNID{nids["$d"]})
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"$a", "$b", "$c"}, eventIDs)
+
+		// ... but it does include the auth events it starts from.
+		eventIDs, err = tab.SelectAuthChainEventIDs(ctx, nil, []types.EventNID{nids["$b"]}, nil)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"$a", "$b"}, eventIDs)
+	})
+}
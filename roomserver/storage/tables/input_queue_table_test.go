@@ -0,0 +1,85 @@
+package tables_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/storage/postgres"
+	"github.com/neilalexander/harmony/roomserver/storage/tables"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+)
+
+func mustCreateInputQueueTable(t *testing.T, dbType test.DBType) (tab tables.InputQueue, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreateInputQueueTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareInputQueueTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestInputQueueTable(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateInputQueueTable(t, dbType)
+		defer close()
+
+		room := test.NewRoom(t, alice)
+		events := room.Events()
+		for _, ev := range events {
+			queued, err := tab.InsertInputQueueEntry(ctx, nil, ev.EventID(), room.ID, "test", ev.JSON())
+			assert.NoError(t, err)
+			assert.True(t, queued)
+		}
+
+		// queueing an event which is already queued is deduplicated
+		queued, err := tab.InsertInputQueueEntry(ctx, nil, events[0].EventID(), room.ID, "test", events[0].JSON())
+		assert.NoError(t, err)
+		assert.False(t, queued)
+
+		// but queueing the same event with different input isn't
+		otherInput := []byte(`{"kind":2}`)
+		queued, err = tab.InsertInputQueueEntry(ctx, nil, events[1].EventID(), room.ID, "test", otherInput)
+		assert.NoError(t, err)
+		assert.True(t, queued)
+		err = tab.DeleteInputQueueEntry(ctx, nil, events[1].EventID(), otherInput)
+		assert.NoError(t, err)
+
+		// the entries are returned in the order they were queued, a page at a time
+		entries, err := tab.SelectInputQueueEntries(ctx, nil, 0, 2)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		assert.Equal(t, events[0].EventID(), entries[0].EventID)
+		assert.Equal(t, events[1].EventID(), entries[1].EventID)
+		assert.Equal(t, room.ID, entries[0].RoomID)
+		assert.Equal(t, events[0].JSON(), entries[0].InputJSON)
+		entries, err = tab.SelectInputQueueEntries(ctx, nil, entries[1].ID, len(events))
+		assert.NoError(t, err)
+		assert.Len(t, entries, len(events)-2)
+
+		// processed events are removed, and can be queued again afterwards
+		err = tab.DeleteInputQueueEntry(ctx, nil, events[0].EventID(), events[0].JSON())
+		assert.NoError(t, err)
+		entries, err = tab.SelectInputQueueEntries(ctx, nil, 0, len(events))
+		assert.NoError(t, err)
+		assert.Len(t, entries, len(events)-1)
+		queued, err = tab.InsertInputQueueEntry(ctx, nil, events[0].EventID(), room.ID, "test", events[0].JSON())
+		assert.NoError(t, err)
+		assert.True(t, queued)
+	})
+}
@@ -58,10 +58,14 @@ type Events interface {
 	UpdateEventState(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, stateNID types.StateSnapshotNID) error
 	SelectEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (sentToOutput bool, err error)
 	UpdateEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
+	UpdateEventSoftFailed(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
 	SelectEventID(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (eventID string, err error)
 	BulkSelectStateAtEventAndReference(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) ([]types.StateAtEventAndReference, error)
 	// BulkSelectEventID returns a map from numeric event ID to string event ID.
 	BulkSelectEventID(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (map[types.EventNID]string, error)
+	// SelectAuthChainEventIDs returns the event IDs of the auth chain made up of the given auth
+	// events and the auth events of the given events, recursively.
+	SelectAuthChainEventIDs(ctx context.Context, txn *sql.Tx, authEventNIDs, eventNIDs []types.EventNID) ([]string, error)
 	// BulkSelectEventNIDs returns a map from string event ID to numeric event ID.
 	// If an event ID is not in the database then it is omitted from the map.
 	BulkSelectEventNID(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[string]types.EventMetadata, error)
@@ -69,6 +73,10 @@ type Events interface {
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDsForEventNIDs(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (roomNIDs map[types.EventNID]types.RoomNID, err error)
 	SelectEventRejected(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string) (rejected bool, err error)
+	// SelectEventStatus returns how the event was stored, or sql.ErrNoRows if it isn't known.
+	SelectEventStatus(ctx context.Context, txn *sql.Tx, eventID string) (*types.EventStatus, error)
+	// SelectRoomEventStatuses returns how each event in the room was stored, in the order in which they were stored.
+	SelectRoomEventStatuses(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) ([]types.EventStatus, error)
 
 	SelectRoomsWithEventTypeNID(ctx context.Context, txn *sql.Tx, eventTypeNID types.EventTypeNID) ([]types.RoomNID, error)
 }
@@ -141,12 +149,17 @@ type Membership interface {
 	SelectMembershipForUpdate(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) (MembershipState, error)
 	SelectMembershipFromRoomAndTarget(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) (types.EventNID, MembershipState, bool, error)
 	SelectMembershipsFromRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, localOnly bool) (eventNIDs []types.EventNID, err error)
+	// SelectMembershipsFromRoomPage returns up to limit membership event NIDs after the given
+	// event NID, in event NID order.
+	SelectMembershipsFromRoomPage(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, joinOnly, localOnly bool, afterEventNID types.EventNID, limit int) (eventNIDs []types.EventNID, err error)
 	SelectMembershipsFromRoomAndMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, membership MembershipState, localOnly bool) (eventNIDs []types.EventNID, err error)
 	UpdateMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, senderUserNID types.EventStateKeyNID, membership MembershipState, eventNID types.EventNID, forgotten bool) (bool, error)
 	SelectRoomsWithMembership(ctx context.Context, txn *sql.Tx, userID types.EventStateKeyNID, membershipState MembershipState) ([]types.RoomNID, error)
 	// SelectJoinedUsersSetForRooms returns how many times each of the given users appears across the given rooms.
 	SelectJoinedUsersSetForRooms(ctx context.Context, txn *sql.Tx, roomNIDs []types.RoomNID, userNIDs []types.EventStateKeyNID, localOnly bool) (map[types.EventStateKeyNID]int, error)
-	SelectKnownUsers(ctx context.Context, txn *sql.Tx, userID types.EventStateKeyNID, searchString string, limit int) ([]string, error)
+	// SelectKnownUsers returns up to limit of the users who share a room with the user, in order,
+	// starting after the given user ID.
+	SelectKnownUsers(ctx context.Context, txn *sql.Tx, userID types.EventStateKeyNID, searchString, from string, limit int) ([]string, error)
 	UpdateForgetMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, forget bool) error
 	SelectLocalServerInRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (bool, error)
 	SelectServerInRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, serverName spec.ServerName) (bool, error)
@@ -158,6 +171,49 @@ type Published interface {
 	UpsertRoomPublished(ctx context.Context, txn *sql.Tx, roomID, appserviceID, networkID string, published bool) (err error)
 	SelectPublishedFromRoomID(ctx context.Context, txn *sql.Tx, roomID string) (published bool, err error)
 	SelectAllPublishedRooms(ctx context.Context, txn *sql.Tx, networkdID string, published, includeAllNetworks bool) ([]string, error)
+	// UnpublishRoom unpublishes the room from the room directory for every appservice and network.
+	UnpublishRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+}
+
+type DirectoryBlocked interface {
+	InsertDirectoryBlocked(ctx context.Context, txn *sql.Tx, roomID string) error
+	DeleteDirectoryBlocked(ctx context.Context, txn *sql.Tx, roomID string) error
+	SelectDirectoryBlocked(ctx context.Context, txn *sql.Tx, roomID string) (bool, error)
+	SelectAllDirectoryBlocked(ctx context.Context, txn *sql.Tx) ([]string, error)
+}
+
+type DeadRooms interface {
+	InsertDeadRoom(ctx context.Context, txn *sql.Tx, roomID string, detectedAt spec.Timestamp) error
+	// SelectRoomsWithoutLocalMembers returns up to limit rooms after the given room NID which no
+	// local users are joined to, invited to or knocking on, and which aren't already dead rooms.
+	SelectRoomsWithoutLocalMembers(ctx context.Context, txn *sql.Tx, afterRoomNID types.RoomNID, limit int) ([]types.RoomNID, []string, error)
+	// SelectDeadRoomsBefore returns up to limit dead rooms which were found before the given
+	// time and which still have no local members.
+	SelectDeadRoomsBefore(ctx context.Context, txn *sql.Tx, before spec.Timestamp, limit int) ([]string, error)
+	// DeleteRevivedDeadRooms forgets the dead rooms which have local members again.
+	DeleteRevivedDeadRooms(ctx context.Context, txn *sql.Tx) error
+}
+
+// InputQueue journals the input events which haven't been processed yet.
+type InputQueue interface {
+	// InsertInputQueueEntry journals an input event, returning false if the same input
+	// event was already in the queue.
+	InsertInputQueueEntry(ctx context.Context, txn *sql.Tx, eventID, roomID string, virtualHost spec.ServerName, inputJSON []byte) (bool, error)
+	// DeleteInputQueueEntry removes the entry for the input event with the given JSON.
+	DeleteInputQueueEntry(ctx context.Context, txn *sql.Tx, eventID string, inputJSON []byte) error
+	// SelectInputQueueEntries returns up to limit queued input events after the given ID,
+	// oldest first.
+	SelectInputQueueEntries(ctx context.Context, txn *sql.Tx, afterID int64, limit int) ([]InputQueueEntry, error)
+}
+
+// InputQueueEntry is an input event which was journalled before being queued.
+type InputQueueEntry struct {
+	ID          int64
+	EventID     string
+	RoomID      string
+	VirtualHost spec.ServerName
+	InputJSON   []byte
+	QueuedAt    spec.Timestamp
 }
 
 type RedactionInfo struct {
@@ -117,10 +117,15 @@ func TestMembershipTable(t *testing.T) {
 		assert.False(t, serverInRoom)
 
 		// get all users we know about; should be only one user, since no other user joined the room
-		knownUsers, err := tab.SelectKnownUsers(ctx, nil, userNIDs[0], "localhost", 2)
+		knownUsers, err := tab.SelectKnownUsers(ctx, nil, userNIDs[0], "localhost", "", 2)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, len(knownUsers))
 
+		// ... and none after it
+		knownUsers, err = tab.SelectKnownUsers(ctx, nil, userNIDs[0], "localhost", knownUsers[0], 2)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(knownUsers))
+
 		// get users we share a room with, given their userNID
 		joinedUsers, err := tab.SelectJoinedUsers(ctx, nil, userNIDs)
 		assert.NoError(t, err)
@@ -128,3 +133,45 @@ func TestMembershipTable(t *testing.T) {
 		assert.Equal(t, userNIDs[:1], joinedUsers)
 	})
 }
+
+func TestMembershipTablePage(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, stateKeyTab, close := mustCreateMembershipTable(t, dbType)
+		defer close()
+
+		// Every other user has left the room, and the last one is remote.
+		for i := 0; i < 6; i++ {
+			userID := fmt.Sprintf("@dummy%d:localhost", i)
+			if i == 5 {
+				userID = "@dummy:remote"
+			}
+			stateKeyNID, err := stateKeyTab.InsertEventStateKeyNID(ctx, nil, userID)
+			assert.NoError(t, err)
+			err = tab.InsertMembership(ctx, nil, 1, stateKeyNID, i != 5)
+			assert.NoError(t, err)
+			membership := tables.MembershipStateJoin
+			if i%2 == 1 {
+				membership = tables.MembershipStateLeaveOrBan
+			}
+			_, err = tab.UpdateMembership(ctx, nil, 1, stateKeyNID, stateKeyNID, membership, types.EventNID(10+i), false)
+			assert.NoError(t, err)
+		}
+
+		eventNIDs, err := tab.SelectMembershipsFromRoomPage(ctx, nil, 1, false, false, 0, 4)
+		assert.NoError(t, err)
+		assert.Equal(t, []types.EventNID{10, 11, 12, 13}, eventNIDs)
+
+		eventNIDs, err = tab.SelectMembershipsFromRoomPage(ctx, nil, 1, false, false, 13, 4)
+		assert.NoError(t, err)
+		assert.Equal(t, []types.EventNID{14, 15}, eventNIDs)
+
+		eventNIDs, err = tab.SelectMembershipsFromRoomPage(ctx, nil, 1, true, false, 10, 4)
+		assert.NoError(t, err)
+		assert.Equal(t, []types.EventNID{12, 14}, eventNIDs)
+
+		eventNIDs, err = tab.SelectMembershipsFromRoomPage(ctx, nil, 1, false, true, 12, 4)
+		assert.NoError(t, err)
+		assert.Equal(t, []types.EventNID{13, 14}, eventNIDs)
+	})
+}
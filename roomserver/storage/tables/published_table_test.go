@@ -91,5 +91,17 @@ func TestPublishedTable(t *testing.T) {
 		roomIDs, err = tab.SelectAllPublishedRooms(ctx, nil, "", true, true)
 		assert.NoError(t, err)
 		assert.Equal(t, publishedRooms, roomIDs)
+
+		// unpublishing should remove the room from every network
+		err = tab.UpsertRoomPublished(ctx, nil, room.ID, asID, "", true)
+		assert.NoError(t, err)
+		err = tab.UnpublishRoom(ctx, nil, room.ID)
+		assert.NoError(t, err)
+		publishedRes, err = tab.SelectPublishedFromRoomID(ctx, nil, room.ID)
+		assert.NoError(t, err)
+		assert.False(t, publishedRes, fmt.Sprintf("expected room %s to be unpublished", room.ID))
+		allNWPublished, err = tab.SelectAllPublishedRooms(ctx, nil, nwID, true, true)
+		assert.NoError(t, err)
+		assert.Empty(t, allNWPublished)
 	})
 }
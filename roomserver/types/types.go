@@ -196,6 +196,21 @@ type StateAtEvent struct {
 	StateEntry
 }
 
+// EventStatus is how the roomserver has stored an event.
+type EventStatus struct {
+	EventNID EventNID
+	RoomNID  RoomNID
+	// The state before the event, or 0 if the event is an outlier.
+	StateSnapshotNID StateSnapshotNID
+	IsRejected       bool
+	// True if the event passed auth against the state before it but not
+	// against the current state of the room, and so was never sent to the
+	// output stream.
+	IsSoftFailed bool
+	// True once the event has been sent to the output stream.
+	SentToOutput bool
+}
+
 // IsStateEvent returns whether the event the state is at is a state event.
 func (s StateAtEvent) IsStateEvent() bool {
 	return s.EventStateKeyNID != 0
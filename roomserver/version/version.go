@@ -16,8 +16,11 @@ package version
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 )
 
 // RoomVersions returns a map of all known room versions to this
@@ -50,6 +53,103 @@ func SupportedRoomVersion(version gomatrixserverlib.RoomVersion) (gomatrixserver
 	return RoomVersion(version)
 }
 
+// SortedSupportedRoomVersions returns the room versions that are
+// supported by this homeserver, oldest first.
+func SortedSupportedRoomVersions() []gomatrixserverlib.RoomVersion {
+	versions := make([]gomatrixserverlib.RoomVersion, 0, len(SupportedRoomVersions()))
+	for v := range SupportedRoomVersions() {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		// Room versions are opaque strings, but the ones that are numbers
+		// are in the order that they were introduced.
+		a, aErr := strconv.Atoi(string(versions[i]))
+		b, bErr := strconv.Atoi(string(versions[j]))
+		switch {
+		case aErr == nil && bErr == nil:
+			return a < b
+		case aErr == nil || bErr == nil:
+			return aErr == nil
+		default:
+			return versions[i] < versions[j]
+		}
+	})
+	return versions
+}
+
+// Feature is an optional feature of rooms which only some room versions
+// support.
+type Feature string
+
+const (
+	// FeatureKnock is knocking on rooms with the "knock" join rule.
+	FeatureKnock Feature = "knock"
+	// FeatureRestricted is joining rooms with the "restricted" join rule.
+	FeatureRestricted Feature = "restricted"
+)
+
+// Features are all of the optional features, in the order that they
+// were introduced.
+var Features = []Feature{FeatureKnock, FeatureRestricted}
+
+// SupportsFeature returns whether the room version supports the feature.
+func SupportsFeature(v gomatrixserverlib.IRoomVersion, feature Feature) bool {
+	switch feature {
+	case FeatureKnock:
+		return gomatrixserverlib.KnockingAllowed(v)
+	case FeatureRestricted:
+		return v.CheckRestrictedJoinsAllowed() == nil
+	default:
+		return false
+	}
+}
+
+// JoinRuleFeatures returns the features which rooms with the join rule
+// need their room version to support.
+func JoinRuleFeatures(joinRule string) []Feature {
+	switch joinRule {
+	case spec.Knock:
+		return []Feature{FeatureKnock}
+	case spec.Restricted:
+		return []Feature{FeatureRestricted}
+	case spec.KnockRestricted:
+		return []Feature{FeatureKnock, FeatureRestricted}
+	default:
+		return nil
+	}
+}
+
+// FeatureSupport is which room versions support a feature.
+type FeatureSupport struct {
+	// The room version which rooms that need the feature should use
+	Preferred gomatrixserverlib.RoomVersion `json:"preferred"`
+	// All of the supported room versions which support the feature
+	Support []gomatrixserverlib.RoomVersion `json:"support"`
+}
+
+// FeatureSupportFor returns which of the supported room versions support
+// all of the features. The preferred room version is the default room
+// version if it supports them, and otherwise the newest stable room version
+// which does. It is empty if no supported room version supports them.
+func FeatureSupportFor(defaultVersion gomatrixserverlib.RoomVersion, features ...Feature) FeatureSupport {
+	var support FeatureSupport
+	for _, v := range SortedSupportedRoomVersions() {
+		verImpl := SupportedRoomVersions()[v]
+		supported := true
+		for _, feature := range features {
+			supported = supported && SupportsFeature(verImpl, feature)
+		}
+		if !supported {
+			continue
+		}
+		support.Support = append(support.Support, v)
+		if support.Preferred != defaultVersion && (v == defaultVersion || verImpl.Stable()) {
+			support.Preferred = v
+		}
+	}
+	return support
+}
+
 // UnknownVersionError is caused when the room version is not known.
 type UnknownVersionError struct {
 	Version gomatrixserverlib.RoomVersion
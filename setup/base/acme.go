@@ -0,0 +1,81 @@
+package base
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+)
+
+var (
+	acmeOnce    sync.Once
+	acmeManager *autocert.Manager
+)
+
+// certManager returns the ACME certificate manager, which is shared by the
+// HTTP and HTTPS listeners so that challenges started on one can be answered
+// on the other. Certificates are renewed by the manager in the background
+// before they expire.
+func certManager(processContext *process.ProcessContext, cfg *config.Dendrite) *autocert.Manager {
+	acmeOnce.Do(func() {
+		domains := acmeDomains(cfg)
+		acmeManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cfg.Global.ACME.CacheDir),
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Email:      cfg.Global.ACME.Email,
+		}
+		if cfg.Global.ACME.DirectoryURL != "" {
+			acmeManager.Client = &acme.Client{DirectoryURL: cfg.Global.ACME.DirectoryURL}
+		}
+		logrus.Infof("Using ACME certificates for %v", domains)
+		if addr := cfg.Global.ACME.ChallengeListenAddress; addr != "" {
+			go serveACMEChallenges(processContext, acmeManager, addr)
+		}
+	})
+	return acmeManager
+}
+
+// acmeDomains returns the configured domains, or otherwise the hostnames of
+// the server name and any virtual hosts.
+func acmeDomains(cfg *config.Dendrite) []string {
+	if len(cfg.Global.ACME.Domains) > 0 {
+		return cfg.Global.ACME.Domains
+	}
+	domains := []string{hostname(string(cfg.Global.ServerName))}
+	for _, host := range cfg.Global.VirtualHosts {
+		domains = append(domains, hostname(string(host.ServerName)))
+	}
+	return domains
+}
+
+// hostname strips the port, if any, from a server name.
+func hostname(serverName string) string {
+	u := url.URL{Host: serverName}
+	return u.Hostname()
+}
+
+// serveACMEChallenges answers HTTP-01 challenges on a separate listener,
+// redirecting everything else to HTTPS.
+func serveACMEChallenges(processContext *process.ProcessContext, manager *autocert.Manager, addr string) {
+	serv := &http.Server{
+		Addr:         addr,
+		WriteTimeout: HTTPServerTimeout,
+		Handler:      manager.HTTPHandler(nil),
+	}
+	go func() {
+		<-processContext.WaitForShutdown()
+		_ = serv.Shutdown(context.Background())
+	}()
+	logrus.Infof("Starting ACME challenge listener on %s", addr)
+	if err := serv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logrus.WithError(err).Fatal("failed to serve ACME challenges")
+	}
+}
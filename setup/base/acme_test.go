@@ -0,0 +1,20 @@
+package base
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func TestACMEDomains(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Global.ServerName = "example.com:8448"
+	cfg.Global.VirtualHosts = []*config.VirtualHost{{}}
+	cfg.Global.VirtualHosts[0].ServerName = "other.example.com"
+	assert.Equal(t, []string{"example.com", "other.example.com"}, acmeDomains(cfg))
+
+	cfg.Global.ACME.Domains = []string{"matrix.example.com"}
+	assert.Equal(t, []string{"matrix.example.com"}, acmeDomains(cfg))
+}
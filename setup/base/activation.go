@@ -0,0 +1,52 @@
+package base
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// SystemdListeners returns the sockets passed in by systemd socket
+// activation, keyed by the FileDescriptorName of each socket in the unit. A
+// socket without a name is given its position instead, i.e. "0", "1". If the
+// process wasn't socket activated, no listeners are returned.
+func SystemdListeners() (map[string]net.Listener, error) {
+	defer func() {
+		// The sockets shouldn't be passed on to any child processes.
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count == 0 {
+		return nil, nil
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	listeners := make(map[string]net.Listener, count)
+	for i := 0; i < count; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %s passed by systemd isn't a listener: %w", name, err)
+		}
+		listeners[name] = listener
+	}
+	return listeners, nil
+}
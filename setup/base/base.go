@@ -17,6 +17,7 @@ package base
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"errors"
@@ -41,6 +42,7 @@ import (
 	"github.com/neilalexander/harmony/internal/httputil"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
 
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/setup/process"
@@ -56,7 +58,7 @@ const HTTPServerTimeout = time.Minute * 5
 
 // CreateClient creates a new client (normally used for media fetch requests).
 // Should only be called once per component.
-func CreateClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache) *fclient.Client {
+func CreateClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache, resolutionCache *fclient.ResolutionCache) *fclient.Client {
 	if cfg.Global.DisableFederation {
 		return fclient.NewClient(
 			fclient.WithTransport(noOpHTTPTransport),
@@ -65,10 +67,17 @@ func CreateClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache) *fclient.Cli
 	opts := []fclient.ClientOption{
 		fclient.WithSkipVerify(cfg.FederationAPI.DisableTLSValidation),
 		fclient.WithWellKnownSRVLookups(true),
+		fclient.WithResolutionCache(resolutionCache),
 	}
 	if cfg.Global.DNSCache.Enabled && dnsCache != nil {
 		opts = append(opts, fclient.WithDNSCache(dnsCache))
 	}
+	if cfg.FederationAPI.Proxy.Enabled {
+		opts = append(opts, fclient.WithProxy(cfg.FederationAPI.Proxy.URL()))
+	}
+	if cfg.FederationAPI.OutboundBind.Enabled() {
+		opts = append(opts, fclient.WithSourceAddresses(outboundSourceAddresses(&cfg.FederationAPI.OutboundBind)))
+	}
 	client := fclient.NewClient(opts...)
 	client.SetUserAgent(fmt.Sprintf("Harmony/%s", internal.VersionString()))
 	return client
@@ -76,11 +85,13 @@ func CreateClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache) *fclient.Cli
 
 // CreateFederationClient creates a new federation client. Should only be called
 // once per component.
-func CreateFederationClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache) fclient.FederationClient {
-	identities := cfg.Global.SigningIdentities()
+func CreateFederationClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache, resolutionCache *fclient.ResolutionCache) fclient.FederationClient {
+	// The identities are looked up for each request, so that the signing key
+	// can be rotated while the server is running.
+	identityFor := cfg.Global.SigningIdentityFor
 	if cfg.Global.DisableFederation {
-		return fclient.NewFederationClient(
-			identities, fclient.WithTransport(noOpHTTPTransport),
+		return fclient.NewFederationClientWithIdentityFunc(
+			identityFor, fclient.WithTransport(noOpHTTPTransport),
 		)
 	}
 	opts := []fclient.ClientOption{
@@ -88,16 +99,43 @@ func CreateFederationClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache) fc
 		fclient.WithSkipVerify(cfg.FederationAPI.DisableTLSValidation),
 		fclient.WithKeepAlives(!cfg.FederationAPI.DisableHTTPKeepalives),
 		fclient.WithUserAgent(fmt.Sprintf("Harmony/%s", internal.VersionString())),
+		fclient.WithResolutionCache(resolutionCache),
 	}
 	if cfg.Global.DNSCache.Enabled {
 		opts = append(opts, fclient.WithDNSCache(dnsCache))
 	}
-	client := fclient.NewFederationClient(
-		identities, opts...,
+	if cfg.FederationAPI.Proxy.Enabled {
+		opts = append(opts, fclient.WithProxy(cfg.FederationAPI.Proxy.URL()))
+	}
+	if cfg.FederationAPI.OutboundBind.Enabled() {
+		opts = append(opts, fclient.WithSourceAddresses(outboundSourceAddresses(&cfg.FederationAPI.OutboundBind)))
+	}
+	client := fclient.NewFederationClientWithIdentityFunc(
+		identityFor, opts...,
 	)
 	return client
 }
 
+// outboundSourceAddresses works out which local addresses to send requests
+// to other servers from. The explicitly configured addresses take priority
+// over those of the interface.
+func outboundSourceAddresses(cfg *config.OutboundBind) fclient.SourceAddresses {
+	var sources fclient.SourceAddresses
+	if cfg.Interface != "" {
+		var err error
+		if sources, err = fclient.SourceAddressesOfInterface(cfg.Interface); err != nil {
+			logrus.WithError(err).Fatalf("Failed to find the addresses of interface %q", cfg.Interface)
+		}
+	}
+	if cfg.IPv4Address != "" {
+		sources.IPv4 = net.ParseIP(cfg.IPv4Address)
+	}
+	if cfg.IPv6Address != "" {
+		sources.IPv6 = net.ParseIP(cfg.IPv6Address)
+	}
+	return sources
+}
+
 func ConfigureAdminEndpoints(processContext *process.ProcessContext, routers httputil.Routers) {
 	routers.DendriteAdmin.HandleFunc("/monitor/up", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
@@ -125,12 +163,18 @@ func SetupAndServeHTTP(
 	externalHTTPAddr config.ServerAddress,
 	certFile, keyFile *string,
 ) {
+	if !processContext.ListenerStarted() {
+		return
+	}
+	defer processContext.ListenerFinished()
+
 	externalRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
 
 	externalServ := &http.Server{
-		Addr:         externalHTTPAddr.Address,
-		WriteTimeout: HTTPServerTimeout,
-		Handler:      externalRouter,
+		Addr:              externalHTTPAddr.Address,
+		ReadHeaderTimeout: cfg.Global.HTTP.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Global.HTTP.WriteTimeout,
+		Handler:           externalRouter,
 		BaseContext: func(_ net.Listener) context.Context {
 			return processContext.Context()
 		},
@@ -141,12 +185,19 @@ func SetupAndServeHTTP(
 		http.Redirect(w, r, httputil.PublicStaticPath, http.StatusFound)
 	})
 
+	externalRouter.HandleFunc("/healthz", livenessHandler).Methods(http.MethodGet)
+	externalRouter.HandleFunc("/readyz", readinessHandler(processContext, cfg)).Methods(http.MethodGet)
+
 	if cfg.Global.Metrics.Enabled {
 		externalRouter.Handle("/metrics", httputil.WrapHandlerInBasicAuth(promhttp.Handler(), cfg.Global.Metrics.BasicAuth))
 	}
 
 	ConfigureAdminEndpoints(processContext, routers)
 
+	if addr := cfg.Global.Debug.ListenAddress; addr != "" {
+		go serveDebug(processContext, cfg, addr)
+	}
+
 	// Parse and execute the landing page template
 	tmpl := template.Must(template.ParseFS(staticContent, "static/*.gotmpl"))
 	landingPage := &bytes.Buffer{}
@@ -168,22 +219,49 @@ func SetupAndServeHTTP(
 	// Serve a static page for login fallback
 	routers.Static.PathPrefix("/client/login/").Handler(http.StripPrefix("/_matrix/static/client/login/", http.FileServer(http.FS(sub))))
 
-	clientHandler := routers.Client
-	federationHandler := routers.Federation
-	externalRouter.PathPrefix(httputil.DendriteAdminPathPrefix).Handler(routers.DendriteAdmin)
-	externalRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(clientHandler)
+	limits := httputil.RequestLimits{
+		MaxBodySize:  int64(cfg.Global.HTTP.MaxRequestBodySize),
+		ReadTimeout:  cfg.Global.HTTP.ReadTimeout,
+		WriteTimeout: cfg.Global.HTTP.WriteTimeout,
+	}
+	mediaLimits := httputil.RequestLimits{
+		MaxBodySize:  int64(cfg.MediaAPI.MaxFileSizeBytes),
+		ReadTimeout:  cfg.Global.HTTP.MediaReadTimeout,
+		WriteTimeout: cfg.Global.HTTP.MediaWriteTimeout,
+	}
+	roomImportLimits := httputil.RequestLimits{
+		MaxBodySize:  int64(cfg.ClientAPI.MaxRoomImportSize),
+		ReadTimeout:  cfg.ClientAPI.RoomImportTimeout,
+		WriteTimeout: cfg.ClientAPI.RoomImportTimeout,
+	}
+	// The config has already been verified at this point.
+	trustedProxies, _ := cfg.Global.HTTP.TrustedProxyNetworks()
+	withLimits := func(h http.Handler) http.Handler {
+		return httputil.WithTrustedRequestIDs(httputil.WithRequestLimits(h, limits), trustedProxies)
+	}
+
+	// Room archives are too large for the usual limits, so room imports have
+	// their own, which must be routed before the rest of the admin API.
+	externalRouter.Path(httputil.DendriteAdminPathPrefix + "admin/importRoom").Handler(httputil.WithTrustedRequestIDs(httputil.WithRequestLimits(routers.DendriteAdmin, roomImportLimits), trustedProxies))
+	externalRouter.PathPrefix(httputil.DendriteAdminPathPrefix).Handler(withLimits(routers.DendriteAdmin))
+	externalRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(withLimits(routers.Client))
 	if !cfg.Global.DisableFederation {
-		externalRouter.PathPrefix(httputil.PublicKeyPathPrefix).Handler(routers.Keys)
-		externalRouter.PathPrefix(httputil.PublicFederationPathPrefix).Handler(federationHandler)
+		externalRouter.PathPrefix(httputil.PublicKeyPathPrefix).Handler(withLimits(routers.Keys))
+		externalRouter.PathPrefix(httputil.PublicFederationPathPrefix).Handler(withLimits(routers.Federation))
 	}
-	externalRouter.PathPrefix(httputil.SynapseAdminPathPrefix).Handler(routers.SynapseAdmin)
-	externalRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(routers.Media)
-	externalRouter.PathPrefix(httputil.PublicWellKnownPrefix).Handler(routers.WellKnown)
-	externalRouter.PathPrefix(httputil.PublicStaticPath).Handler(routers.Static)
+	externalRouter.PathPrefix(httputil.SynapseAdminPathPrefix).Handler(withLimits(routers.SynapseAdmin))
+	externalRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(httputil.WithTrustedRequestIDs(httputil.WithRequestLimits(routers.Media, mediaLimits), trustedProxies))
+	externalRouter.PathPrefix(httputil.PublicWellKnownPrefix).Handler(withLimits(routers.WellKnown))
+	externalRouter.PathPrefix(httputil.PublicStaticPath).Handler(withLimits(routers.Static))
 
 	externalRouter.NotFoundHandler = httputil.NotFoundCORSHandler
 	externalRouter.MethodNotAllowedHandler = httputil.NotAllowedHandler
 
+	var acme *autocert.Manager
+	if cfg.Global.ACME.Enabled && !externalHTTPAddr.IsUnixSocket() {
+		acme = certManager(processContext, cfg)
+	}
+
 	if externalHTTPAddr.Enabled() {
 		go func() {
 			var externalShutdown atomic.Bool // RegisterOnShutdown can be called more than once
@@ -195,37 +273,34 @@ func SetupAndServeHTTP(
 					logrus.Infof("Stopped external HTTP listener")
 				}
 			})
+			listener, err := listen(externalHTTPAddr)
+			if err != nil {
+				logrus.WithError(err).Fatalf("failed to listen on %s", externalHTTPAddr.Address)
+			}
 			if certFile != nil && keyFile != nil {
-				if err := externalServ.ListenAndServeTLS(*certFile, *keyFile); err != nil {
+				if acme != nil {
+					externalServ.TLSConfig = acme.TLSConfig()
+				} else {
+					certs, err := newCertificateReloader(*certFile, *keyFile)
+					if err != nil {
+						logrus.WithError(err).Fatal("failed to load TLS certificate")
+					}
+					externalServ.TLSConfig = &tls.Config{
+						GetCertificate: certs.GetCertificate,
+					}
+				}
+				if err := externalServ.ServeTLS(listener, "", ""); err != nil {
 					if err != http.ErrServerClosed {
 						logrus.WithError(err).Fatal("failed to serve HTTPS")
 					}
 				}
 			} else {
-				if externalHTTPAddr.IsUnixSocket() {
-					err := os.Remove(externalHTTPAddr.Address)
-					if err != nil && !errors.Is(err, fs.ErrNotExist) {
-						logrus.WithError(err).Fatal("failed to remove existing unix socket")
-					}
-					listener, err := net.Listen(externalHTTPAddr.Network(), externalHTTPAddr.Address)
-					if err != nil {
-						logrus.WithError(err).Fatal("failed to serve unix socket")
-					}
-					err = os.Chmod(externalHTTPAddr.Address, externalHTTPAddr.UnixSocketPermission)
-					if err != nil {
-						logrus.WithError(err).Fatal("failed to set unix socket permissions")
-					}
-					if err := externalServ.Serve(listener); err != nil {
-						if err != http.ErrServerClosed {
-							logrus.WithError(err).Fatal("failed to serve unix socket")
-						}
-					}
-
-				} else {
-					if err := externalServ.ListenAndServe(); err != nil {
-						if err != http.ErrServerClosed {
-							logrus.WithError(err).Fatal("failed to serve HTTP")
-						}
+				if acme != nil {
+					externalServ.Handler = acme.HTTPHandler(externalRouter)
+				}
+				if err := externalServ.Serve(listener); err != nil {
+					if err != http.ErrServerClosed {
+						logrus.WithError(err).Fatal("failed to serve HTTP")
 					}
 				}
 			}
@@ -234,25 +309,74 @@ func SetupAndServeHTTP(
 	}
 
 	minwinsvc.SetOnExit(processContext.ShutdownDendrite)
-	<-processContext.WaitForShutdown()
+	<-processContext.WaitForDrain()
 
+	// Stop accepting new requests and wait for those in progress, until the
+	// process moves on to stopping, at which point any left are cut off.
 	logrus.Infof("Stopping HTTP listeners")
-	_ = externalServ.Shutdown(context.Background())
+	if err := externalServ.Shutdown(processContext.Context()); err != nil {
+		_ = externalServ.Close()
+	}
 	logrus.Infof("Stopped HTTP listeners")
 }
 
-func WaitForShutdown(processCtx *process.ProcessContext) {
+// serveDebug serves the debug endpoints without authentication on a separate
+// listener, which is expected to only be reachable internally.
+func serveDebug(processContext *process.ProcessContext, cfg *config.Dendrite, addr string) {
+	serv := &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: cfg.Global.HTTP.ReadHeaderTimeout,
+		Handler:           httputil.DebugHandler("", cfg.Global.Debug.IsEnabled),
+	}
+	go func() {
+		<-processContext.WaitForShutdown()
+		_ = serv.Shutdown(context.Background())
+	}()
+	logrus.Warnf("Starting unauthenticated debug listener on %s", addr)
+	if err := serv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logrus.WithError(err).Fatal("failed to serve debug endpoints")
+	}
+}
+
+// listen returns the listener for the address, which is either one that is
+// already open or a new TCP or unix socket listener.
+func listen(addr config.ServerAddress) (net.Listener, error) {
+	if addr.Listener != nil {
+		return addr.Listener, nil
+	}
+	if !addr.IsUnixSocket() {
+		return net.Listen(addr.Network(), addr.Address)
+	}
+	if err := os.Remove(addr.Address); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove existing unix socket: %w", err)
+	}
+	listener, err := net.Listen(addr.Network(), addr.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(addr.Address, addr.UnixSocketPermission); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to set unix socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+// WaitForShutdown blocks until a signal is received and then shuts down
+// gracefully, giving requests and work in progress up to the drain timeout
+// to finish. If the process is shut down some other way, it doesn't wait.
+func WaitForShutdown(processCtx *process.ProcessContext, drainTimeout time.Duration) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	select {
 	case <-sigs:
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+		logrus.Warnf("Shutdown signal received")
+		processCtx.GracefulShutdown(drainTimeout)
 	case <-processCtx.WaitForShutdown():
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+		logrus.Warnf("Shutdown signal received")
+		processCtx.ShutdownDendrite()
 	}
-	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
-
-	logrus.Warnf("Shutdown signal received")
-
-	processCtx.ShutdownDendrite()
 	processCtx.WaitForComponentsToFinish()
 
 	logrus.Warnf("Dendrite is exiting now")
@@ -0,0 +1,91 @@
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+)
+
+// readinessTimeout bounds how long all of the readiness checks can take.
+const readinessTimeout = time.Second * 5
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// livenessHandler reports that the process is alive and able to serve
+// requests at all.
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// readinessHandler reports whether the databases, NATS and signing keys are
+// all available, with the status of each. The process isn't ready once it
+// has started shutting down, so that traffic is sent elsewhere.
+func readinessHandler(processContext *process.ProcessContext, cfg *config.Dendrite) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := processContext.ReadinessChecks()
+		checks["keys"] = func(context.Context) error {
+			if _, privateKey := cfg.Global.SigningKey(); len(privateKey) == 0 {
+				return errors.New("no signing key loaded")
+			}
+			return nil
+		}
+		checks["shutdown"] = func(context.Context) error {
+			select {
+			case <-processContext.WaitForDrain():
+				return errors.New("shutting down")
+			default:
+				return nil
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+		res := healthResponse{Status: "ok", Checks: make(map[string]healthCheck, len(checks))}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for name, check := range checks {
+			wg.Add(1)
+			go func(name string, check process.ReadinessCheck) {
+				defer wg.Done()
+				result := healthCheck{Status: "ok"}
+				if err := check(ctx); err != nil {
+					result = healthCheck{Status: "unavailable", Error: err.Error()}
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				res.Checks[name] = result
+				if result.Error != "" {
+					res.Status = "unavailable"
+				}
+			}(name, check)
+		}
+		wg.Wait()
+
+		code := http.StatusOK
+		if res.Status != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, res)
+	}
+}
+
+func writeHealth(w http.ResponseWriter, code int, res healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,50 @@
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+)
+
+func TestReadiness(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	cfg := &config.Dendrite{}
+	cfg.Defaults(config.DefaultOpts{Generate: true, SingleDatabase: true})
+	handler := readinessHandler(processCtx, cfg)
+
+	ready := func() (int, healthResponse) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var res healthResponse
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		return rec.Code, res
+	}
+
+	processCtx.AddReadinessCheck("database:global", func(context.Context) error { return nil })
+	code, res := ready()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", res.Status)
+	assert.Equal(t, "ok", res.Checks["database:global"].Status)
+	assert.Equal(t, "ok", res.Checks["keys"].Status)
+
+	processCtx.AddReadinessCheck("nats", func(context.Context) error { return errors.New("disconnected") })
+	code, res = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", res.Status)
+	assert.Equal(t, "disconnected", res.Checks["nats"].Error)
+	assert.Equal(t, "ok", res.Checks["database:global"].Status)
+
+	processCtx.AddReadinessCheck("nats", func(context.Context) error { return nil })
+	processCtx.ShutdownDendrite()
+	code, res = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", res.Checks["shutdown"].Status)
+}
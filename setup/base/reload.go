@@ -0,0 +1,81 @@
+package base
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+)
+
+// HandleReloadSignal reloads the config whenever SIGHUP is received, until
+// the process shuts down.
+func HandleReloadSignal(processCtx *process.ProcessContext, cfg *config.Dendrite) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-processCtx.WaitForShutdown():
+				return
+			case <-sigs:
+				logrus.Info("SIGHUP received, reloading config")
+				if err := cfg.Reload(); err != nil {
+					logrus.WithError(err).Error("Failed to reload config")
+					continue
+				}
+				logrus.Info("Config reloaded")
+			}
+		}
+	}()
+}
+
+// certificateReloader serves a TLS certificate which is loaded again from
+// disk when the config is reloaded, so that renewed certificates can be
+// picked up without restarting.
+type certificateReloader struct {
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	config.OnReload(func() {
+		if err := r.reload(); err != nil {
+			logrus.WithError(err).Error("Failed to reload TLS certificate, continuing to use the old one")
+			return
+		}
+		logrus.Info("Reloaded TLS certificate")
+	})
+	return r, nil
+}
+
+func (r *certificateReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	return nil
+}
+
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
@@ -23,9 +23,11 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/lib/pq"
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ed25519"
 	"gopkg.in/yaml.v2"
 )
@@ -62,8 +64,15 @@ type Dendrite struct {
 	// The config for logging informations. Each hook will be added to logrus.
 	Logging []LogrusHook `yaml:"logging"`
 
+	// Log levels for individual components, e.g. "roomserver" or "federationapi",
+	// which override the levels of the logging hooks.
+	ComponentLogLevels map[string]string `yaml:"component_log_levels"`
+
 	// Any information derived from the configuration options for later use.
 	Derived Derived `yaml:"-"`
+
+	// The path that the config was loaded from, so that it can be reloaded.
+	path string
 }
 
 // TODO: Kill Derived
@@ -109,6 +118,9 @@ type ThumbnailSize struct {
 	// crop scales to fill the requested dimensions and crops the excess.
 	// scale scales to fit the requested dimensions and one dimension may be smaller than requested.
 	ResizeMethod string `yaml:"method,omitempty"`
+	// OnDemand stops the thumbnail from being generated when media is uploaded or
+	// fetched. Instead it is generated the first time that it is requested.
+	OnDemand bool `yaml:"on_demand,omitempty"`
 }
 
 // LogrusHook represents a single logrus hook. At this point, only parsing and
@@ -142,7 +154,12 @@ func Load(configPath string) (*Dendrite, error) {
 	}
 	// Pass the current working directory and os.ReadFile so that they can
 	// be mocked in the tests
-	return loadConfig(basePath, configData, os.ReadFile)
+	c, err := loadConfig(basePath, configData, os.ReadFile)
+	if err != nil {
+		return nil, err
+	}
+	c.path = configPath
+	return c, nil
 }
 
 func loadConfig(
@@ -157,6 +174,9 @@ func loadConfig(
 	})
 
 	var err error
+	if configData, err = resolveSecrets(basePath, configData, readFile); err != nil {
+		return nil, err
+	}
 	if err = yaml.Unmarshal(configData, &c); err != nil {
 		return nil, err
 	}
@@ -221,7 +241,16 @@ func loadConfig(
 		}
 	}
 
+	if c.SyncAPI.RealIPHeader != "" {
+		logrus.Warn("DEPRECATED: config key \"sync_api.real_ip_header\" has moved to \"global.real_ip_header\"")
+		if c.Global.RealIPHeader == "" {
+			c.Global.RealIPHeader = c.SyncAPI.RealIPHeader
+		}
+	}
+
 	c.MediaAPI.AbsBasePath = Path(absPath(basePath, c.MediaAPI.BasePath))
+	c.ClientAPI.AbsDataExportPath = Path(absPath(basePath, c.ClientAPI.DataExportPath))
+	c.ClientAPI.AbsAdminTaskDataPath = Path(absPath(basePath, c.ClientAPI.AdminTaskDataPath))
 
 	// Generate data from config options
 	err = c.Derive()
@@ -297,6 +326,27 @@ func (c *Dendrite) Verify(configErrs *ConfigErrors) {
 	} {
 		c.Verify(configErrs)
 	}
+	c.verifyDatabases(configErrs)
+}
+
+// verifyDatabases checks the connection strings of the global database and
+// of any components which have been given databases of their own.
+func (c *Dendrite) verifyDatabases(configErrs *ConfigErrors) {
+	for _, db := range []struct {
+		key  string
+		opts *DatabaseOptions
+	}{
+		{"global.database", &c.Global.DatabaseOptions},
+		{"room_server.database", &c.RoomServer.Database},
+		{"sync_api.database", &c.SyncAPI.Database},
+		{"user_api.account_database", &c.UserAPI.AccountDatabase},
+		{"key_server.database", &c.KeyServer.Database},
+		{"federation_api.database", &c.FederationAPI.Database},
+		{"media_api.database", &c.MediaAPI.Database},
+		{"mscs.database", &c.MSCs.Database},
+	} {
+		checkDataSource(configErrs, db.key+".connection_string", db.opts.ConnectionString)
+	}
 }
 
 func (c *Dendrite) Wiring() {
@@ -342,6 +392,18 @@ func checkNotEmpty(configErrs *ConfigErrors, key, value string) {
 	}
 }
 
+// checkDataSource verifies that the given connection string, if it is a
+// PostgreSQL URL, can be parsed. If it can't, adds an error to the list.
+func checkDataSource(configErrs *ConfigErrors, key string, value DataSource) {
+	cs := string(value)
+	if !strings.HasPrefix(cs, "postgres://") && !strings.HasPrefix(cs, "postgresql://") {
+		return
+	}
+	if _, err := pq.ParseURL(cs); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key, err))
+	}
+}
+
 // checkPositive verifies the given value is positive (zero included)
 // in the configuration. If it is not, adds an error to the list.
 func checkPositive(configErrs *ConfigErrors, key string, value int64) {
@@ -350,11 +412,32 @@ func checkPositive(configErrs *ConfigErrors, key string, value int64) {
 	}
 }
 
+// checkAtLeastOne verifies the given value is at least one in the
+// configuration. If it is not, adds an error to the list.
+func checkAtLeastOne(configErrs *ConfigErrors, key string, value int64) {
+	if value < 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", key, value))
+	}
+}
+
 // checkLogging verifies the parameters logging.* are valid.
 func (config *Dendrite) checkLogging(configErrs *ConfigErrors) {
 	for _, logrusHook := range config.Logging {
 		checkNotEmpty(configErrs, "logging.type", string(logrusHook.Type))
 		checkNotEmpty(configErrs, "logging.level", string(logrusHook.Level))
+		if logrusHook.Level != "" {
+			if _, err := logrus.ParseLevel(logrusHook.Level); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid log level %q for logging.level", logrusHook.Level))
+			}
+		}
+		if format, ok := logrusHook.Params["format"]; ok && format != "text" && format != "json" {
+			configErrs.Add(fmt.Sprintf("invalid log format %q for logging.params.format, must be \"text\" or \"json\"", format))
+		}
+	}
+	for component, level := range config.ComponentLogLevels {
+		if _, err := logrus.ParseLevel(level); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid log level %q for component_log_levels.%s", level, component))
+		}
 	}
 }
 
@@ -2,6 +2,7 @@ package config
 
 import (
 	"io/fs"
+	"net"
 	"net/url"
 	"strconv"
 )
@@ -15,6 +16,9 @@ type ServerAddress struct {
 	Address              string
 	Scheme               string
 	UnixSocketPermission fs.FileMode
+	// A listener which is already open, i.e. passed in by systemd socket
+	// activation, in which case nothing new is listened on.
+	Listener net.Listener
 }
 
 func (s ServerAddress) Enabled() bool {
@@ -26,6 +30,9 @@ func (s ServerAddress) IsUnixSocket() bool {
 }
 
 func (s ServerAddress) Network() string {
+	if s.Listener != nil {
+		return s.Listener.Addr().Network()
+	}
 	if s.Scheme == NetworkUnix {
 		return NetworkUnix
 	} else {
@@ -46,5 +53,14 @@ func HTTPAddress(urlAddress string) (ServerAddress, error) {
 	if err != nil {
 		return ServerAddress{}, err
 	}
-	return ServerAddress{parsedUrl.Host, parsedUrl.Scheme, 0}, nil
+	return ServerAddress{Address: parsedUrl.Host, Scheme: parsedUrl.Scheme}, nil
+}
+
+// ListenerAddress returns the address of a listener which is already open.
+func ListenerAddress(listener net.Listener) ServerAddress {
+	return ServerAddress{
+		Address:  listener.Addr().String(),
+		Scheme:   listener.Addr().Network(),
+		Listener: listener,
+	}
 }
@@ -2,6 +2,8 @@ package config
 
 import (
 	"io/fs"
+	"net"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -41,3 +43,14 @@ func TestUnixSocketAddress_Permission_NonOctal_Bad(t *testing.T) {
 	_, err := UnixSocketAddress("/tmp", "855")
 	assert.Error(t, err)
 }
+
+func TestListenerAddress(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "socket"))
+	assert.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	address := ListenerAddress(listener)
+	assert.True(t, address.Enabled())
+	assert.True(t, address.IsUnixSocket())
+	assert.Equal(t, "unix", address.Network())
+	assert.Equal(t, listener, address.Listener)
+}
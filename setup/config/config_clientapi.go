@@ -2,7 +2,11 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"text/template"
 	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 )
 
 type ClientAPI struct {
@@ -52,9 +56,58 @@ type ClientAPI struct {
 	// TURN options
 	TURN TURN `yaml:"turn"`
 
+	// The longest that clients may delay sending an event for (MSC4140),
+	// or 0 to not allow delayed events. Element Call uses these to remove
+	// a user's call membership if they disconnect. Delayed events are stored
+	// in the user API database and are deleted along with their device.
+	MaxEventDelayDuration time.Duration `yaml:"max_event_delay_duration"`
+
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
 
+	// Limits on how quickly events can be sent into rooms
+	SendRateLimiting SendRateLimiting `yaml:"send_rate_limiting"`
+
+	// Public room directory options
+	PublicRooms PublicRooms `yaml:"public_rooms"`
+
+	// How long the rooms which remote servers' aliases point to are cached
+	// for. Aliases can be moved to other rooms, so this shouldn't be long.
+	RemoteAliasCacheDuration time.Duration `yaml:"remote_alias_cache_duration"`
+
+	// How many background admin tasks may run at the same time.
+	AdminTaskConcurrency int `yaml:"admin_task_concurrency"`
+
+	// Where the archives produced by user data and room exports are written.
+	DataExportPath    Path `yaml:"data_export_path"`
+	AbsDataExportPath Path `yaml:"-"`
+
+	// How long export archives are kept for before they are deleted.
+	DataExportRetention time.Duration `yaml:"data_export_retention"`
+
+	// The largest room archive which can be imported, and how long an import
+	// can take, including uploading the archive. These replace the global
+	// HTTP limits for imports, as room archives are often much larger.
+	MaxRoomImportSize FileSizeBytes `yaml:"max_room_import_size"`
+	RoomImportTimeout time.Duration `yaml:"room_import_timeout"`
+
+	// Where background admin tasks keep their inputs, so that they can be
+	// resumed after an interruption.
+	AdminTaskDataPath    Path `yaml:"admin_task_data_path"`
+	AbsAdminTaskDataPath Path `yaml:"-"`
+
+	// Spam checker modules and hooks which can reject or modify actions
+	SpamChecker SpamChecker `yaml:"spam_checker"`
+
+	// Identity servers which users can bind third-party identifiers to
+	IdentityServers IdentityServers `yaml:"identity_servers"`
+
+	// Defaults applied to the rooms which users create
+	RoomCreation RoomCreation `yaml:"room_creation"`
+
+	// Actions taken once a user has registered
+	PostRegistration PostRegistration `yaml:"post_registration"`
+
 	MSCs *MSCs `yaml:"-"`
 }
 
@@ -69,11 +122,42 @@ func (c *ClientAPI) Defaults(opts DefaultOpts) {
 	c.RegistrationDisabled = true
 	c.OpenRegistrationWithoutVerificationEnabled = false
 	c.RateLimiting.Defaults()
+	c.SendRateLimiting.Defaults()
+	c.PublicRooms.Defaults()
+	c.RemoteAliasCacheDuration = time.Minute * 5
+	c.AdminTaskConcurrency = 2
+	c.DataExportPath = "./data_exports"
+	c.DataExportRetention = time.Hour * 24 * 7
+	c.MaxRoomImportSize = 1073741824
+	c.RoomImportTimeout = time.Hour
+	c.AdminTaskDataPath = "./admin_task_data"
+	c.SpamChecker.Defaults()
+	c.IdentityServers.Defaults()
+	c.RoomCreation.Defaults()
+	c.PostRegistration.Defaults()
 }
 
 func (c *ClientAPI) Verify(configErrs *ConfigErrors) {
 	c.TURN.Verify(configErrs)
+	if c.MaxEventDelayDuration < 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "client_api.max_event_delay_duration", c.MaxEventDelayDuration))
+	}
 	c.RateLimiting.Verify(configErrs)
+	c.SendRateLimiting.Verify(configErrs)
+	c.PublicRooms.Verify(configErrs)
+	checkPositive(configErrs, "client_api.remote_alias_cache_duration", int64(c.RemoteAliasCacheDuration))
+	checkPositive(configErrs, "client_api.admin_task_concurrency", int64(c.AdminTaskConcurrency))
+	checkNotEmpty(configErrs, "client_api.data_export_path", string(c.DataExportPath))
+	if c.DataExportRetention <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "client_api.data_export_retention", c.DataExportRetention))
+	}
+	checkPositive(configErrs, "client_api.max_room_import_size", int64(c.MaxRoomImportSize))
+	checkPositive(configErrs, "client_api.room_import_timeout", int64(c.RoomImportTimeout))
+	checkNotEmpty(configErrs, "client_api.admin_task_data_path", string(c.AdminTaskDataPath))
+	c.SpamChecker.Verify(configErrs)
+	c.IdentityServers.Verify(configErrs)
+	c.RoomCreation.Verify(configErrs)
+	c.PostRegistration.Verify(configErrs, c.Matrix)
 	if c.RecaptchaEnabled {
 		if c.RecaptchaSiteVerifyAPI == "" {
 			c.RecaptchaSiteVerifyAPI = "https://www.google.com/recaptcha/api/siteverify"
@@ -122,6 +206,50 @@ type TURN struct {
 	// Hardcoded Username and Password
 	Username string `yaml:"turn_username"`
 	Password string `yaml:"turn_password"`
+
+	// Further TURN and STUN servers, each with their own credentials
+	Servers []TURNServer `yaml:"turn_servers"`
+}
+
+// TURNServer is a TURN or STUN server which clients can be told about. A
+// server without credentials is treated as a STUN server.
+type TURNServer struct {
+	// The URIs of the server to pass to clients
+	URIs []string `yaml:"uris"`
+	// The shared secret from coturn, used to issue ephemeral credentials
+	SharedSecret string `yaml:"shared_secret"`
+	// Static credentials, if the server doesn't use a shared secret
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// How long the credentials should last, defaulting to turn_user_lifetime
+	UserLifetime string `yaml:"user_lifetime"`
+}
+
+// HasCredentials returns whether clients are given credentials for the server.
+func (s *TURNServer) HasCredentials() bool {
+	return s.SharedSecret != "" || (s.Username != "" && s.Password != "")
+}
+
+// ServerList returns the configured servers, starting with the one given by
+// the turn_uris and turn_* credentials if there is one. Servers which don't
+// set their own lifetime are given turn_user_lifetime.
+func (c *TURN) ServerList() []TURNServer {
+	servers := make([]TURNServer, 0, len(c.Servers)+1)
+	if len(c.URIs) > 0 {
+		servers = append(servers, TURNServer{
+			URIs:         c.URIs,
+			SharedSecret: c.SharedSecret,
+			Username:     c.Username,
+			Password:     c.Password,
+		})
+	}
+	servers = append(servers, c.Servers...)
+	for i := range servers {
+		if servers[i].UserLifetime == "" {
+			servers[i].UserLifetime = c.UserLifetime
+		}
+	}
+	return servers
 }
 
 func (c *TURN) Verify(configErrs *ConfigErrors) {
@@ -131,6 +259,226 @@ func (c *TURN) Verify(configErrs *ConfigErrors) {
 			configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "client_api.turn.turn_user_lifetime", value))
 		}
 	}
+	for i, server := range c.Servers {
+		key := fmt.Sprintf("client_api.turn.turn_servers[%d]", i)
+		if len(server.URIs) == 0 {
+			configErrs.Add(fmt.Sprintf("missing config key %q", key+".uris"))
+		}
+		if server.UserLifetime != "" {
+			if _, err := time.ParseDuration(server.UserLifetime); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", key+".user_lifetime", server.UserLifetime))
+			}
+		} else if server.HasCredentials() && c.UserLifetime == "" {
+			configErrs.Add(fmt.Sprintf("missing config key %q", key+".user_lifetime"))
+		}
+	}
+}
+
+type PublicRooms struct {
+	// Remote servers whose public rooms are listed in our own directory
+	IncludeServers []spec.ServerName `yaml:"include_servers"`
+	// Remote servers whose directories clients can't browse through us
+	ExcludeServers []spec.ServerName `yaml:"exclude_servers"`
+	// How long the directories of remote servers are cached for
+	RemoteCacheDuration time.Duration `yaml:"remote_cache_duration"`
+}
+
+func (c *PublicRooms) Defaults() {
+	c.RemoteCacheDuration = time.Minute * 5
+}
+
+func (c *PublicRooms) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "client_api.public_rooms.remote_cache_duration", int64(c.RemoteCacheDuration))
+}
+
+// IsExcluded returns whether clients are prevented from browsing the
+// directory of the server.
+func (c *PublicRooms) IsExcluded(serverName spec.ServerName) bool {
+	for _, excluded := range c.ExcludeServers {
+		if excluded == serverName {
+			return true
+		}
+	}
+	return false
+}
+
+type SpamChecker struct {
+	// The names of the in-process modules to run, in order. Modules are
+	// compiled in and registered with spamcheck.Register.
+	Modules []string `yaml:"modules"`
+	// An external HTTP hook which is called after the modules
+	HTTPHook SpamCheckerHTTPHook `yaml:"http_hook"`
+}
+
+type SpamCheckerHTTPHook struct {
+	// The URL to POST each check to, or empty to disable the hook
+	URL string `yaml:"url"`
+	// How long to wait for the hook to respond
+	Timeout time.Duration `yaml:"timeout"`
+	// Allow actions if the hook can't be reached or returns an error,
+	// rather than rejecting them
+	FailOpen bool `yaml:"fail_open"`
+}
+
+func (c *SpamChecker) Defaults() {
+	c.HTTPHook.Timeout = time.Second * 5
+	c.HTTPHook.FailOpen = true
+}
+
+func (c *SpamChecker) Verify(configErrs *ConfigErrors) {
+	if c.HTTPHook.URL != "" {
+		if u, err := url.Parse(c.HTTPHook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			configErrs.Add(fmt.Sprintf("invalid URL for config key %q: %s", "client_api.spam_checker.http_hook.url", c.HTTPHook.URL))
+		}
+		checkPositive(configErrs, "client_api.spam_checker.http_hook.timeout", int64(c.HTTPHook.Timeout))
+	}
+}
+
+type IdentityServers struct {
+	// The identity servers which we will bind, unbind and look up
+	// third-party identifiers with on behalf of users
+	TrustedServers []string `yaml:"trusted_servers"`
+	// Allow clients to look up third-party identifiers through us, so
+	// that they don't need to hash them themselves
+	ProxyLookups bool `yaml:"proxy_lookups"`
+	// How long to wait for identity servers to respond
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+}
+
+func (c *IdentityServers) Defaults() {
+	c.RequestTimeout = time.Second * 10
+}
+
+func (c *IdentityServers) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "client_api.identity_servers.request_timeout", int64(c.RequestTimeout))
+}
+
+// IsTrusted returns whether the identity server is one of the trusted ones.
+func (c *IdentityServers) IsTrusted(server string) bool {
+	for _, trusted := range c.TrustedServers {
+		if trusted == server {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	EncryptionByDefaultOff    = "off"
+	EncryptionByDefaultInvite = "invite"
+	EncryptionByDefaultAll    = "all"
+)
+
+type RoomCreation struct {
+	// Which new rooms have end-to-end encryption turned on unless the
+	// client sets it up itself: "off", "invite" for rooms created with
+	// the private_chat or trusted_private_chat presets, or "all"
+	EncryptionByDefault string `yaml:"encryption_by_default"`
+	// Power levels applied over the defaults for rooms created with each
+	// preset. The client's power_level_content_override takes precedence.
+	PowerLevelOverrides map[string]PowerLevelOverride `yaml:"power_level_overrides"`
+	// Presets which users may not create rooms with
+	BlockedPresets []string `yaml:"blocked_presets"`
+}
+
+// PowerLevelOverride holds the m.room.power_levels fields which can be
+// overridden at room creation. Unset fields keep their defaults.
+type PowerLevelOverride struct {
+	Ban           *int64           `yaml:"ban" json:"ban,omitempty"`
+	Invite        *int64           `yaml:"invite" json:"invite,omitempty"`
+	Kick          *int64           `yaml:"kick" json:"kick,omitempty"`
+	Redact        *int64           `yaml:"redact" json:"redact,omitempty"`
+	StateDefault  *int64           `yaml:"state_default" json:"state_default,omitempty"`
+	EventsDefault *int64           `yaml:"events_default" json:"events_default,omitempty"`
+	UsersDefault  *int64           `yaml:"users_default" json:"users_default,omitempty"`
+	Events        map[string]int64 `yaml:"events" json:"events,omitempty"`
+}
+
+func (c *RoomCreation) Defaults() {
+	c.EncryptionByDefault = EncryptionByDefaultOff
+}
+
+func (c *RoomCreation) Verify(configErrs *ConfigErrors) {
+	switch c.EncryptionByDefault {
+	case EncryptionByDefaultOff, EncryptionByDefaultInvite, EncryptionByDefaultAll:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key 'client_api.room_creation.encryption_by_default': %q", c.EncryptionByDefault))
+	}
+	for preset := range c.PowerLevelOverrides {
+		if !knownRoomPreset(preset) {
+			configErrs.Add(fmt.Sprintf("invalid preset for config key 'client_api.room_creation.power_level_overrides': %q", preset))
+		}
+	}
+	for _, preset := range c.BlockedPresets {
+		if !knownRoomPreset(preset) {
+			configErrs.Add(fmt.Sprintf("invalid preset for config key 'client_api.room_creation.blocked_presets': %q", preset))
+		}
+	}
+}
+
+// IsPresetBlocked returns whether users may not create rooms with the preset.
+func (c *RoomCreation) IsPresetBlocked(preset string) bool {
+	for _, blocked := range c.BlockedPresets {
+		if blocked == preset {
+			return true
+		}
+	}
+	return false
+}
+
+func knownRoomPreset(preset string) bool {
+	switch preset {
+	case spec.PresetPrivateChat, spec.PresetTrustedPrivateChat, spec.PresetPublicChat:
+		return true
+	}
+	return false
+}
+
+type PostRegistration struct {
+	// A message sent to new users by the server notices user
+	WelcomeMessage WelcomeMessage `yaml:"welcome_message"`
+	// A webhook which is told about new users
+	Webhook PostRegistrationWebhook `yaml:"webhook"`
+}
+
+type WelcomeMessage struct {
+	Enabled bool   `yaml:"enabled"`
+	MsgType string `yaml:"msgtype"`
+	// A Go text/template, which is given the new user's UserID, Localpart
+	// and ServerName
+	Body string `yaml:"body"`
+}
+
+type PostRegistrationWebhook struct {
+	// The URL which is sent a POST request with the new user's ID, or
+	// empty to disable the webhook
+	URL string `yaml:"url"`
+	// How long to wait for the webhook to respond
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *PostRegistration) Defaults() {
+	c.WelcomeMessage.MsgType = "m.text"
+	c.Webhook.Timeout = time.Second * 5
+}
+
+func (c *PostRegistration) Verify(configErrs *ConfigErrors, global *Global) {
+	if c.WelcomeMessage.Enabled {
+		checkNotEmpty(configErrs, "client_api.post_registration.welcome_message.msgtype", c.WelcomeMessage.MsgType)
+		checkNotEmpty(configErrs, "client_api.post_registration.welcome_message.body", c.WelcomeMessage.Body)
+		if _, err := template.New("welcome").Parse(c.WelcomeMessage.Body); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid template for config key 'client_api.post_registration.welcome_message.body': %s", err))
+		}
+		if global != nil && !global.ServerNotices.Enabled {
+			configErrs.Add("client_api.post_registration.welcome_message requires global.server_notices to be enabled")
+		}
+	}
+	if c.Webhook.URL != "" {
+		if _, err := url.Parse(c.Webhook.URL); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid URL for config key 'client_api.post_registration.webhook.url': %s", err))
+		}
+		checkPositive(configErrs, "client_api.post_registration.webhook.timeout", int64(c.Webhook.Timeout))
+	}
 }
 
 type RateLimiting struct {
@@ -148,6 +496,15 @@ type RateLimiting struct {
 	// A list of users that are exempt from rate limiting, i.e. if you want
 	// to run Mjolnir or other bots.
 	ExemptUserIDs []string `yaml:"exempt_user_ids"`
+
+	// Whether the rate limits are kept in the database, so that they are
+	// shared between instances behind a load balancer. If the database
+	// can't be reached, each instance falls back to its own limits. This
+	// can't be changed without a restart.
+	SharedStore bool `yaml:"shared_store"`
+
+	// The database for the shared rate limits, if not the global database.
+	Database DatabaseOptions `yaml:"database,omitempty"`
 }
 
 func (r *RateLimiting) Verify(configErrs *ConfigErrors) {
@@ -162,3 +519,46 @@ func (r *RateLimiting) Defaults() {
 	r.Threshold = 5
 	r.CooloffMS = 500
 }
+
+type SendRateLimiting struct {
+	// Is send rate limiting enabled or disabled?
+	Enabled bool `yaml:"enabled"`
+	// How quickly each local user can send events, across all rooms
+	PerUser SendRate `yaml:"per_user"`
+	// How quickly each local user can send events into a single room
+	PerRoom SendRate `yaml:"per_room"`
+	// Users with at least this power level in a room are never limited
+	// when sending into it
+	ExemptPowerLevel int64 `yaml:"exempt_power_level"`
+}
+
+// SendRate is a sustained rate of events along with how many events can be
+// sent in a burst before the rate applies.
+type SendRate struct {
+	EventsPerSecond float64 `yaml:"events_per_second"`
+	Burst           int     `yaml:"burst"`
+}
+
+func (r *SendRateLimiting) Verify(configErrs *ConfigErrors) {
+	if !r.Enabled {
+		return
+	}
+	r.PerUser.verify(configErrs, "client_api.send_rate_limiting.per_user")
+	r.PerRoom.verify(configErrs, "client_api.send_rate_limiting.per_room")
+}
+
+func (r *SendRate) verify(configErrs *ConfigErrors, key string) {
+	if r.EventsPerSecond <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %v", key+".events_per_second", r.EventsPerSecond))
+	}
+	if r.Burst <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", key+".burst", r.Burst))
+	}
+}
+
+func (r *SendRateLimiting) Defaults() {
+	r.Enabled = true
+	r.PerUser = SendRate{EventsPerSecond: 5, Burst: 20}
+	r.PerRoom = SendRate{EventsPerSecond: 2, Burst: 10}
+	r.ExemptPowerLevel = 50
+}
@@ -1,6 +1,12 @@
 package config
 
 import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 )
@@ -33,12 +39,51 @@ type FederationAPI struct {
 
 	// Should we prefer direct key fetches over perspective ones?
 	PreferDirectFetch bool `yaml:"prefer_direct_fetch"`
+
+	// Whether other servers can list the rooms in our public room directory
+	AllowPublicRoomsOverFederation bool `yaml:"allow_public_rooms_over_federation"`
+
+	// The number of workers which check the signatures of the events in each
+	// incoming transaction in parallel. Defaults to 4.
+	SignatureVerificationWorkers int `yaml:"signature_verification_workers"`
+
+	// How long to wait before sending read receipts to other servers, so that
+	// receipts for many users and rooms can be sent together in a single EDU.
+	// Receipts are sent straight away if this is 0. Defaults to 500ms.
+	ReceiptBatchWindow time.Duration `yaml:"receipt_batch_window"`
+
+	// Limits on the joins and leaves accepted from users on other servers,
+	// so that rooms can't be flooded with membership changes.
+	JoinFloodProtection JoinFloodProtection `yaml:"join_flood_protection"`
+
+	// Which types of EDUs are processed when received from other servers and
+	// which are sent to them.
+	EDUTypes EDUTypes `yaml:"edu_types"`
+
+	// How the transactions received from other servers share the workers
+	// which process them.
+	TransactionScheduling TransactionScheduling `yaml:"transaction_scheduling"`
+
+	// The proxy to send requests to other servers through, including the
+	// requests for remote media.
+	Proxy Proxy `yaml:"proxy_outbound"`
+
+	// The local addresses to send requests to other servers from, including
+	// the requests for remote media.
+	OutboundBind OutboundBind `yaml:"outbound_bind"`
 }
 
 func (c *FederationAPI) Defaults(opts DefaultOpts) {
+	c.Database.Name = "federationapi"
 	c.FederationMaxRetries = 16
 	c.DisableTLSValidation = false
 	c.DisableHTTPKeepalives = false
+	c.AllowPublicRoomsOverFederation = true
+	c.SignatureVerificationWorkers = 4
+	c.ReceiptBatchWindow = time.Millisecond * 500
+	c.JoinFloodProtection.Defaults()
+	c.TransactionScheduling.Defaults()
+	c.Proxy.Defaults()
 	if opts.Generate {
 		c.KeyPerspectives = KeyPerspectives{
 			{
@@ -65,6 +110,156 @@ func (c *FederationAPI) Verify(configErrs *ConfigErrors) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "federation_api.database.connection_string", string(c.Database.ConnectionString))
 	}
+	checkPositive(configErrs, "federation_api.signature_verification_workers", int64(c.SignatureVerificationWorkers))
+	checkPositive(configErrs, "federation_api.receipt_batch_window", int64(c.ReceiptBatchWindow))
+	c.JoinFloodProtection.Verify(configErrs)
+	c.EDUTypes.Inbound.Verify(configErrs, "federation_api.edu_types.inbound")
+	c.EDUTypes.Outbound.Verify(configErrs, "federation_api.edu_types.outbound")
+	c.TransactionScheduling.Verify(configErrs)
+	c.Proxy.Verify(configErrs)
+	c.OutboundBind.Verify(configErrs)
+}
+
+type EDUTypes struct {
+	// EDU types received from other servers
+	Inbound EDUTypeFilter `yaml:"inbound"`
+	// EDU types sent to other servers
+	Outbound EDUTypeFilter `yaml:"outbound"`
+}
+
+// EDUTypeFilter decides which EDU types are allowed. If the allow list is
+// empty then all types are allowed, apart from those in the deny list.
+type EDUTypeFilter struct {
+	// If set, only these EDU types are allowed
+	Allow []string `yaml:"allow"`
+	// These EDU types are never allowed
+	Deny []string `yaml:"deny"`
+}
+
+// requiredEDUTypes are the EDU types which end-to-end encryption depends on,
+// so they can't be filtered out.
+var requiredEDUTypes = []string{
+	spec.MDeviceListUpdate,
+	"m.signing_key_update",
+	spec.MDirectToDevice,
+}
+
+func (c *EDUTypeFilter) Verify(configErrs *ConfigErrors, key string) {
+	for _, eduType := range c.Allow {
+		checkNotEmpty(configErrs, key+".allow", eduType)
+	}
+	for _, eduType := range c.Deny {
+		checkNotEmpty(configErrs, key+".deny", eduType)
+	}
+	for _, eduType := range requiredEDUTypes {
+		if !c.Allows(eduType) {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s is needed for end-to-end encryption and can't be filtered out", key, eduType))
+		}
+	}
+}
+
+// Allows returns whether EDUs of the given type are allowed.
+func (c *EDUTypeFilter) Allows(eduType string) bool {
+	for _, denied := range c.Deny {
+		if denied == eduType {
+			return false
+		}
+	}
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range c.Allow {
+		if allowed == eduType {
+			return true
+		}
+	}
+	return false
+}
+
+// TransactionScheduling decides how transactions from different servers are
+// processed. Each server has its own queue of transactions, and the queues
+// take turns to use the workers, so that a busy server can't hold up the
+// events from all of the others.
+type TransactionScheduling struct {
+	// How many transactions are processed at once, across all servers
+	Workers int `yaml:"workers"`
+	// How many transactions from a single server can be waiting for a
+	// worker before any more are rejected
+	MaxQueuedPerServer int `yaml:"max_queued_per_server"`
+	// How many transactions from each of these servers are processed in a
+	// row when it is their turn. Servers which aren't listed have a weight
+	// of 1.
+	ServerWeights map[spec.ServerName]int `yaml:"server_weights"`
+}
+
+func (c *TransactionScheduling) Defaults() {
+	c.Workers = 32
+	c.MaxQueuedPerServer = 16
+}
+
+func (c *TransactionScheduling) Verify(configErrs *ConfigErrors) {
+	checkAtLeastOne(configErrs, "federation_api.transaction_scheduling.workers", int64(c.Workers))
+	checkAtLeastOne(configErrs, "federation_api.transaction_scheduling.max_queued_per_server", int64(c.MaxQueuedPerServer))
+	for serverName, weight := range c.ServerWeights {
+		checkAtLeastOne(configErrs, "federation_api.transaction_scheduling.server_weights."+string(serverName), int64(weight))
+	}
+}
+
+// Weight returns how many transactions from the server are processed in a
+// row when it is its turn.
+func (c *TransactionScheduling) Weight(serverName spec.ServerName) int {
+	if weight, ok := c.ServerWeights[serverName]; ok {
+		return weight
+	}
+	return 1
+}
+
+type JoinFloodProtection struct {
+	// Is join flood protection enabled or disabled?
+	Enabled bool `yaml:"enabled"`
+	// How many users from each remote server can join a single room each second
+	RoomJoinsPerSecond int `yaml:"room_joins_per_second"`
+	// How many times a remote user can join or leave rooms within the user churn period
+	UserChurnLimit int `yaml:"user_churn_limit"`
+	// The period over which a user's joins and leaves are counted
+	UserChurnPeriod time.Duration `yaml:"user_churn_period"`
+	// How many joins and leaves by users from a server can be rejected within
+	// a minute before the server is ignored
+	IgnoreThreshold int `yaml:"ignore_threshold"`
+	// How long a server is ignored for after going over the threshold
+	IgnoreDuration time.Duration `yaml:"ignore_duration"`
+	// Servers which are never limited or ignored
+	ExemptServers []spec.ServerName `yaml:"exempt_servers"`
+}
+
+func (c *JoinFloodProtection) Defaults() {
+	c.Enabled = true
+	c.RoomJoinsPerSecond = 10
+	c.UserChurnLimit = 30
+	c.UserChurnPeriod = time.Minute
+	c.IgnoreThreshold = 100
+	c.IgnoreDuration = time.Minute * 10
+}
+
+func (c *JoinFloodProtection) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkPositive(configErrs, "federation_api.join_flood_protection.room_joins_per_second", int64(c.RoomJoinsPerSecond))
+	checkPositive(configErrs, "federation_api.join_flood_protection.user_churn_limit", int64(c.UserChurnLimit))
+	checkPositive(configErrs, "federation_api.join_flood_protection.user_churn_period", int64(c.UserChurnPeriod))
+	checkPositive(configErrs, "federation_api.join_flood_protection.ignore_threshold", int64(c.IgnoreThreshold))
+	checkPositive(configErrs, "federation_api.join_flood_protection.ignore_duration", int64(c.IgnoreDuration))
+}
+
+// IsExempt returns whether the server is exempt from join flood protection.
+func (c *JoinFloodProtection) IsExempt(serverName spec.ServerName) bool {
+	for _, exempt := range c.ExemptServers {
+		if exempt == serverName {
+			return true
+		}
+	}
+	return false
 }
 
 // The config for setting a proxy to use for server->server requests
@@ -77,6 +272,10 @@ type Proxy struct {
 	Host string `yaml:"host"`
 	// The port on which the proxy is listening
 	Port uint16 `yaml:"port"`
+	// The username and password to authenticate to the proxy with, if it
+	// needs them
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
 }
 
 func (c *Proxy) Defaults() {
@@ -87,6 +286,36 @@ func (c *Proxy) Defaults() {
 }
 
 func (c *Proxy) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	switch c.Protocol {
+	case "http", "https", "socks5":
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q (must be http, https or socks5)", "federation_api.proxy_outbound.protocol", c.Protocol))
+	}
+	checkNotEmpty(configErrs, "federation_api.proxy_outbound.host", c.Host)
+	// The port can't be above 65535 since it wouldn't fit into a uint16.
+	checkAtLeastOne(configErrs, "federation_api.proxy_outbound.port", int64(c.Port))
+	if c.Password != "" {
+		checkNotEmpty(configErrs, "federation_api.proxy_outbound.username", c.Username)
+	}
+}
+
+// URL returns the URL of the proxy, including the credentials if there
+// are any.
+func (c *Proxy) URL() *url.URL {
+	u := &url.URL{
+		Scheme: c.Protocol,
+		Host:   net.JoinHostPort(c.Host, strconv.Itoa(int(c.Port))),
+	}
+	switch {
+	case c.Password != "":
+		u.User = url.UserPassword(c.Username, c.Password)
+	case c.Username != "":
+		u.User = url.User(c.Username)
+	}
+	return u
 }
 
 // KeyPerspectives are used to configure perspective key servers for
@@ -107,3 +336,32 @@ type KeyPerspectiveTrustKey struct {
 	// The public key in base64 unpadded format
 	PublicKey string `yaml:"public_key"`
 }
+
+// The config for choosing the local addresses of server->server requests,
+// for hosts with more than one
+type OutboundBind struct {
+	// The network interface to use the addresses of
+	Interface string `yaml:"interface"`
+	// The IPv4 address to send requests from, instead of the interface's
+	IPv4Address string `yaml:"ipv4_address"`
+	// The IPv6 address to send requests from, instead of the interface's
+	IPv6Address string `yaml:"ipv6_address"`
+}
+
+// Enabled returns true if any of the local addresses have been chosen.
+func (c *OutboundBind) Enabled() bool {
+	return c.Interface != "" || c.IPv4Address != "" || c.IPv6Address != ""
+}
+
+func (c *OutboundBind) Verify(configErrs *ConfigErrors) {
+	if c.IPv4Address != "" {
+		if ip := net.ParseIP(c.IPv4Address); ip == nil || ip.To4() == nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q (must be an IPv4 address)", "federation_api.outbound_bind.ipv4_address", c.IPv4Address))
+		}
+	}
+	if c.IPv6Address != "" {
+		if ip := net.ParseIP(c.IPv6Address); ip == nil || ip.To4() != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q (must be an IPv6 address)", "federation_api.outbound_bind.ipv6_address", c.IPv6Address))
+		}
+	}
+}
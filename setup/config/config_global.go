@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"math/rand"
+	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -10,6 +12,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -52,10 +55,30 @@ type Global struct {
 	// Requires `well_known_client_name` to also be configured.
 	WellKnownSlidingSyncProxy string `yaml:"well_known_sliding_sync_proxy"`
 
+	// The support contacts to serve at /.well-known/matrix/support (MSC1929)
+	WellKnownSupport WellKnownSupport `yaml:"well_known_support"`
+
+	// The MatrixRTC foci, such as LiveKit SFUs, to advertise to clients at
+	// /.well-known/matrix/client for Element Call (MSC4143)
+	WellKnownRTCFoci []RTCFocus `yaml:"well_known_rtc_foci"`
+
+	// How long clients and servers may cache the .well-known responses for
+	WellKnownCacheMaxAge time.Duration `yaml:"well_known_cache_max_age"`
+
 	// Disables federation. Dendrite will not be able to make any outbound HTTP requests
 	// to other servers and the federation API will not be exposed.
 	DisableFederation bool `yaml:"disable_federation"`
 
+	// How long to wait on shutdown for requests and work in progress to
+	// finish before closing databases and exiting anyway.
+	ShutdownDrainTimeout time.Duration `yaml:"shutdown_drain_timeout"`
+
+	// The HTTP header which a reverse proxy puts the client's IP address in,
+	// for limiting failed logins and recording devices' last seen addresses.
+	// Requests' own addresses are used if this isn't set, as clients could
+	// set the header to anything.
+	RealIPHeader string `yaml:"real_ip_header"`
+
 	// Configures the handling of presence events.
 	Presence PresenceOptions `yaml:"presence"`
 
@@ -65,9 +88,21 @@ type Global struct {
 	// Metrics configuration
 	Metrics Metrics `yaml:"metrics"`
 
+	// Profiling and runtime debug endpoints
+	Debug Debug `yaml:"debug"`
+
+	// OpenTelemetry tracing configuration
+	Tracing Tracing `yaml:"tracing"`
+
+	// Automatic TLS certificates using ACME, i.e. Let's Encrypt
+	ACME ACME `yaml:"acme"`
+
 	// DNS caching options for all outbound HTTP requests
 	DNSCache DNSCacheOptions `yaml:"dns_cache"`
 
+	// Limits on the size of and time taken by inbound HTTP requests
+	HTTP HTTPOptions `yaml:"http"`
+
 	// ServerNotices configuration used for sending server notices
 	ServerNotices ServerNotices `yaml:"server_notices"`
 
@@ -83,32 +118,49 @@ func (c *Global) Defaults(opts DefaultOpts) {
 		c.KeyID = "ed25519:auto"
 	}
 	c.KeyValidityPeriod = time.Hour * 24 * 7
+	c.ShutdownDrainTimeout = time.Second * 30
+	c.WellKnownCacheMaxAge = time.Hour
 	if opts.SingleDatabase {
 		c.DatabaseOptions.Defaults(90)
 	}
+	c.DatabaseOptions.Name = "global"
 	c.JetStream.Defaults(opts)
 	c.Metrics.Defaults(opts)
+	c.Tracing.Defaults()
+	c.ACME.Defaults()
 	c.DNSCache.Defaults()
+	c.HTTP.Defaults()
 	c.ServerNotices.Defaults(opts)
 	c.Cache.Defaults()
+	c.Presence.Defaults()
 }
 
 func (c *Global) Verify(configErrs *ConfigErrors) {
 	checkNotEmpty(configErrs, "global.server_name", string(c.ServerName))
 	checkNotEmpty(configErrs, "global.private_key", string(c.PrivateKeyPath))
+	checkPositive(configErrs, "global.shutdown_drain_timeout", int64(c.ShutdownDrainTimeout))
 
 	// Check that client well-known has a proper format
 	if c.WellKnownClientName != "" && !strings.HasPrefix(c.WellKnownClientName, "http://") && !strings.HasPrefix(c.WellKnownClientName, "https://") {
 		configErrs.Add("The configuration for well_known_client_name does not have a proper format, consider adding http:// or https://. Some clients may fail to connect.")
 	}
 
+	checkPositive(configErrs, "global.well_known_cache_max_age", int64(c.WellKnownCacheMaxAge))
+	c.WellKnownSupport.Verify(configErrs)
+	for i, focus := range c.WellKnownRTCFoci {
+		focus.Verify(configErrs, fmt.Sprintf("global.well_known_rtc_foci[%d]", i))
+	}
+
 	for _, v := range c.VirtualHosts {
 		v.Verify(configErrs)
 	}
 
 	c.JetStream.Verify(configErrs)
 	c.Metrics.Verify(configErrs)
+	c.Tracing.Verify(configErrs)
+	c.ACME.Verify(configErrs)
 	c.DNSCache.Verify(configErrs)
+	c.HTTP.Verify(configErrs)
 	c.ServerNotices.Verify(configErrs)
 	c.Cache.Verify(configErrs)
 }
@@ -159,10 +211,15 @@ func (c *Global) VirtualHostForHTTPHost(serverName spec.ServerName) *VirtualHost
 	return nil
 }
 
+// SigningIdentityFor returns a copy of the signing identity for a server name.
+// It is safe to call while the key is being rotated.
 func (c *Global) SigningIdentityFor(serverName spec.ServerName) (*fclient.SigningIdentity, error) {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
 	for _, id := range c.SigningIdentities() {
 		if id.ServerName == serverName {
-			return id, nil
+			identity := *id
+			return &identity, nil
 		}
 	}
 	return nil, fmt.Errorf("no signing identity for %q", serverName)
@@ -237,6 +294,59 @@ type OldVerifyKeys struct {
 	ExpiredAt spec.Timestamp `yaml:"expired_at"`
 }
 
+// WellKnownSupport is how to contact the administrators of the server, as
+// described by MSC1929.
+type WellKnownSupport struct {
+	Contacts    []SupportContact `yaml:"contacts"`
+	SupportPage string           `yaml:"support_page"`
+}
+
+type SupportContact struct {
+	// The role of the contact, i.e. m.role.admin or m.role.security
+	Role         string `yaml:"role" json:"role"`
+	MatrixID     string `yaml:"matrix_id" json:"matrix_id,omitempty"`
+	EmailAddress string `yaml:"email_address" json:"email_address,omitempty"`
+}
+
+// Enabled returns whether there is anything to serve.
+func (c *WellKnownSupport) Enabled() bool {
+	return len(c.Contacts) > 0 || c.SupportPage != ""
+}
+
+func (c *WellKnownSupport) Verify(configErrs *ConfigErrors) {
+	for i, contact := range c.Contacts {
+		key := fmt.Sprintf("global.well_known_support.contacts[%d]", i)
+		checkNotEmpty(configErrs, key+".role", contact.Role)
+		if contact.MatrixID == "" && contact.EmailAddress == "" {
+			configErrs.Add(fmt.Sprintf("config key %q must have a matrix_id or an email_address", key))
+		}
+		if contact.MatrixID != "" {
+			if _, err := spec.NewUserID(contact.MatrixID, true); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".matrix_id", contact.MatrixID))
+			}
+		}
+	}
+}
+
+// RTCFocus is a MatrixRTC focus, through which the media for calls is sent,
+// as described by MSC4143.
+type RTCFocus struct {
+	// The type of the focus, e.g. livekit
+	Type string `yaml:"type" json:"type"`
+	// The URL of the LiveKit JWT service, for livekit foci
+	LiveKitServiceURL string `yaml:"livekit_service_url" json:"livekit_service_url,omitempty"`
+}
+
+func (c *RTCFocus) Verify(configErrs *ConfigErrors, key string) {
+	checkNotEmpty(configErrs, key+".type", c.Type)
+	if c.Type == "livekit" {
+		checkNotEmpty(configErrs, key+".livekit_service_url", c.LiveKitServiceURL)
+	}
+	if c.LiveKitServiceURL != "" && !strings.HasPrefix(c.LiveKitServiceURL, "https://") && !strings.HasPrefix(c.LiveKitServiceURL, "http://") {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".livekit_service_url", c.LiveKitServiceURL))
+	}
+}
+
 // The configuration to use for Prometheus metrics
 type Metrics struct {
 	// Whether or not the metrics are enabled
@@ -261,6 +371,80 @@ func (c *Metrics) Defaults(opts DefaultOpts) {
 func (c *Metrics) Verify(configErrs *ConfigErrors) {
 }
 
+// The configuration to use for obtaining TLS certificates automatically
+type ACME struct {
+	// Whether or not certificates are obtained using ACME
+	Enabled bool `yaml:"enabled"`
+	// The domains to obtain certificates for. Defaults to the server name
+	// and the server names of any virtual hosts.
+	Domains []string `yaml:"domains"`
+	// The contact email address given to the certificate authority
+	Email string `yaml:"email"`
+	// The directory URL of the certificate authority, defaults to Let's Encrypt
+	DirectoryURL string `yaml:"directory_url"`
+	// Where certificates and the account key are kept between restarts
+	CacheDir Path `yaml:"cache_dir"`
+	// An extra plain HTTP listener for HTTP-01 challenges, i.e. ":80", which
+	// redirects everything else to HTTPS. Challenges are always answered on
+	// the HTTP listener and TLS-ALPN-01 challenges on the HTTPS listener.
+	ChallengeListenAddress string `yaml:"challenge_listen_address"`
+}
+
+func (c *ACME) Defaults() {
+	c.Enabled = false
+	c.CacheDir = "./acme"
+}
+
+func (c *ACME) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "global.acme.cache_dir", string(c.CacheDir))
+}
+
+// The configuration for the pprof and runtime debug endpoints
+type Debug struct {
+	// Whether the debug endpoints are served. This can be changed by
+	// reloading the config.
+	Enabled bool `yaml:"enabled"`
+	// An optional separate listener for the debug endpoints, i.e.
+	// "localhost:6060". Requests to it aren't authenticated, so it must not
+	// be reachable from outside. The endpoints are always available to admin
+	// users under /_dendrite/admin/debug/ while enabled.
+	ListenAddress string `yaml:"listen_address"`
+}
+
+// The configuration to use for OpenTelemetry tracing
+type Tracing struct {
+	// Whether or not tracing is enabled
+	Enabled bool `yaml:"enabled"`
+	// The OTLP/HTTP collector endpoint to export spans to, i.e. "localhost:4318"
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+	// Whether to export spans over plain HTTP instead of HTTPS
+	Insecure bool `yaml:"insecure"`
+	// The service name reported with all spans
+	ServiceName string `yaml:"service_name"`
+	// The fraction of requests to sample, between 0 and 1. Every request
+	// starts a new trace, so callers can't choose to have it sampled.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func (c *Tracing) Defaults() {
+	c.Enabled = false
+	c.ServiceName = "dendrite"
+	c.SampleRatio = 1
+}
+
+func (c *Tracing) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "global.tracing.otlp_endpoint", c.OTLPEndpoint)
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %v", "global.tracing.sample_ratio", c.SampleRatio))
+	}
+}
+
 // ServerNotices defines the configuration used for sending server notices
 type ServerNotices struct {
 	Enabled bool `yaml:"enabled"`
@@ -289,6 +473,43 @@ func (c *ServerNotices) Verify(errors *ConfigErrors) {}
 type Cache struct {
 	EstimatedMaxSize DataUnit      `yaml:"max_size_estimated"`
 	MaxAge           time.Duration `yaml:"max_age"`
+	// Options for individual caches, keyed by one of CacheNames. A cache
+	// with its own size is kept separately, rather than sharing the global
+	// cache with all of the others.
+	Caches map[string]CacheOptions `yaml:"caches,omitempty"`
+}
+
+// CacheOptions overrides the global cache options for one cache. Zero
+// values mean that the global options are used.
+type CacheOptions struct {
+	EstimatedMaxSize DataUnit      `yaml:"max_size_estimated"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// CacheNames are the names of the caches which can be configured
+// individually. They are also used to label the cache metrics.
+var CacheNames = []string{
+	"room_versions",
+	"server_keys",
+	"room_nids",
+	"room_ids",
+	"room_events",
+	"federation_pdus",
+	"federation_edus",
+	"space_summary_rooms",
+	"event_state_keys",
+	"event_types",
+	"event_type_nids",
+	"event_state_key_nids",
+	"verified_events",
+	"federation_disabled_rooms",
+}
+
+// deprecatedCacheNames are the names of caches which have been removed.
+// Options for them are ignored rather than rejected, so that existing
+// configs keep working.
+var deprecatedCacheNames = []string{
+	"lazy_loading", // lazy-loaded members are stored in the sync API database
 }
 
 func (c *Cache) Defaults() {
@@ -298,6 +519,28 @@ func (c *Cache) Defaults() {
 
 func (c *Cache) Verify(errors *ConfigErrors) {
 	checkPositive(errors, "max_size_estimated", int64(c.EstimatedMaxSize))
+	for name, opts := range c.Caches {
+		if slices.Contains(deprecatedCacheNames, name) {
+			log.Warnf("DEPRECATED: cache %q in config key \"caches\" is no longer used, its options are ignored", name)
+			continue
+		}
+		if !slices.Contains(CacheNames, name) {
+			errors.Add(fmt.Sprintf("unknown cache %q in config key \"caches\", must be one of %v", name, CacheNames))
+			continue
+		}
+		checkPositive(errors, "caches."+name+".max_size_estimated", int64(opts.EstimatedMaxSize))
+		checkPositive(errors, "caches."+name+".max_age", int64(opts.MaxAge))
+	}
+}
+
+// Options returns the size and maximum age for the named cache. A size of
+// zero means that the cache shares the global cache.
+func (c *Cache) Options(name string) (DataUnit, time.Duration) {
+	opts := c.Caches[name]
+	if opts.MaxAge == 0 {
+		opts.MaxAge = c.MaxAge
+	}
+	return opts.EstimatedMaxSize, opts.MaxAge
 }
 
 type DatabaseOptions struct {
@@ -309,6 +552,13 @@ type DatabaseOptions struct {
 	MaxIdleConnections int `yaml:"max_idle_conns"`
 	// maximum amount of time (in seconds) a connection may be reused (<= 0 means unlimited)
 	ConnMaxLifetimeSeconds int `yaml:"conn_max_lifetime"`
+	// Compression algorithm for newly stored event JSON: "none", "zstd" or "snappy".
+	// Only used by the roomserver and sync API. Existing rows are always readable.
+	EventCompression string `yaml:"event_compression,omitempty"`
+	// Statements which take longer than this are logged (0 = disabled)
+	SlowQueryThreshold time.Duration `yaml:"slow_query_threshold,omitempty"`
+	// The name of the component using the database, for logging and metrics
+	Name string `yaml:"-"`
 }
 
 func (c *DatabaseOptions) Defaults(conns int) {
@@ -319,6 +569,34 @@ func (c *DatabaseOptions) Defaults(conns int) {
 
 func (c *DatabaseOptions) Verify(configErrs *ConfigErrors) {}
 
+// HasPoolOptions returns whether any of the connection pool options, or
+// the slow query threshold, have been set, in which case a component using
+// the global database gets its own connection pool rather than sharing the
+// global one.
+func (c DatabaseOptions) HasPoolOptions() bool {
+	return c.MaxOpenConnections != 0 || c.MaxIdleConnections != 0 || c.ConnMaxLifetimeSeconds != 0 ||
+		c.SlowQueryThreshold != 0
+}
+
+// WithPoolOptions returns a copy of c with any pool options that have been
+// set in component overriding those in c.
+func (c DatabaseOptions) WithPoolOptions(component DatabaseOptions) DatabaseOptions {
+	if component.MaxOpenConnections != 0 {
+		c.MaxOpenConnections = component.MaxOpenConnections
+	}
+	if component.MaxIdleConnections != 0 {
+		c.MaxIdleConnections = component.MaxIdleConnections
+	}
+	if component.ConnMaxLifetimeSeconds != 0 {
+		c.ConnMaxLifetimeSeconds = component.ConnMaxLifetimeSeconds
+	}
+	if component.SlowQueryThreshold != 0 {
+		c.SlowQueryThreshold = component.SlowQueryThreshold
+	}
+	c.Name = component.Name
+	return c
+}
+
 // MaxIdleConns returns maximum idle connections to the DB
 func (c DatabaseOptions) MaxIdleConns() int {
 	return c.MaxIdleConnections
@@ -334,6 +612,68 @@ func (c DatabaseOptions) ConnMaxLifetime() time.Duration {
 	return time.Duration(c.ConnMaxLifetimeSeconds) * time.Second
 }
 
+type HTTPOptions struct {
+	// The maximum size of a request body. Media uploads are limited by
+	// media_api.max_file_size_bytes instead.
+	MaxRequestBodySize FileSizeBytes `yaml:"max_request_body_size"`
+	// How long a client has to send the request headers
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// How long a client has to send the request body, other than for media
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+	// How long a response can take to write, other than for media
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// How long a client has to upload media
+	MediaReadTimeout time.Duration `yaml:"media_read_timeout"`
+	// How long a media download can take to write
+	MediaWriteTimeout time.Duration `yaml:"media_write_timeout"`
+	// Addresses or CIDR ranges of the reverse proxies which are trusted to
+	// set the request ID with the X-Request-ID header
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+func (c *HTTPOptions) Defaults() {
+	c.MaxRequestBodySize = 10485760
+	c.ReadHeaderTimeout = time.Second * 30
+	c.ReadTimeout = time.Minute
+	c.WriteTimeout = time.Minute * 5
+	c.MediaReadTimeout = time.Minute * 10
+	c.MediaWriteTimeout = time.Minute * 10
+}
+
+func (c *HTTPOptions) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "global.http.max_request_body_size", int64(c.MaxRequestBodySize))
+	checkPositive(configErrs, "global.http.read_header_timeout", int64(c.ReadHeaderTimeout))
+	checkPositive(configErrs, "global.http.read_timeout", int64(c.ReadTimeout))
+	checkPositive(configErrs, "global.http.write_timeout", int64(c.WriteTimeout))
+	checkPositive(configErrs, "global.http.media_read_timeout", int64(c.MediaReadTimeout))
+	checkPositive(configErrs, "global.http.media_write_timeout", int64(c.MediaWriteTimeout))
+	if _, err := c.TrustedProxyNetworks(); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "global.http.trusted_proxies", err))
+	}
+}
+
+// TrustedProxyNetworks returns the networks of the trusted proxies. A plain
+// address is treated as a network containing only that address.
+func (c *HTTPOptions) TrustedProxyNetworks() ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(c.TrustedProxies))
+	for _, proxy := range c.TrustedProxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR range", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 type DNSCacheOptions struct {
 	// Whether the DNS cache is enabled or not
 	Enabled bool `yaml:"enabled"`
@@ -360,6 +700,13 @@ type PresenceOptions struct {
 	EnableInbound bool `yaml:"enable_inbound"`
 	// Whether outbound presence events are allowed
 	EnableOutbound bool `yaml:"enable_outbound"`
+	// The minimum time between sending a user's presence to the same server,
+	// unless their presence or status message has changed. Defaults to 30 seconds.
+	OutboundMinInterval time.Duration `yaml:"outbound_min_interval"`
+}
+
+func (c *PresenceOptions) Defaults() {
+	c.OutboundMinInterval = time.Second * 30
 }
 
 type DataUnit int64
@@ -43,4 +43,8 @@ func (c *JetStream) Defaults(opts DefaultOpts) {
 	}
 }
 
-func (c *JetStream) Verify(configErrs *ConfigErrors) {}
+func (c *JetStream) Verify(configErrs *ConfigErrors) {
+	if len(c.Addresses) > 0 && c.InMemory {
+		configErrs.Add("global.jetstream.in_memory only applies to the embedded NATS server and can't be used with global.jetstream.addresses")
+	}
+}
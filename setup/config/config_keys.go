@@ -0,0 +1,272 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+)
+
+// RotateSigningKey replaces the signing key at global.private_key with a newly
+// generated one. The old key is moved to a file next to it and is added to
+// global.old_private_keys in the config file, expiring now, so that it is still
+// published for verifying anything which was signed with it. The running
+// server switches to the new key straight away, as do virtual hosts which
+// share the key. Virtual hosts with their own keys aren't rotated.
+func (c *Dendrite) RotateSigningKey() (oldKeyID, newKeyID gomatrixserverlib.KeyID, err error) {
+	reloadSerialiser.Lock()
+	defer reloadSerialiser.Unlock()
+
+	if c.path == "" {
+		return "", "", fmt.Errorf("config was not loaded from a file")
+	}
+	basePath, err := filepath.Abs(".")
+	if err != nil {
+		return "", "", err
+	}
+	configData, err := os.ReadFile(c.path)
+	if err != nil {
+		return "", "", err
+	}
+	// The key may have been rotated already since the server was started, so
+	// go by the files rather than what was loaded.
+	var current struct {
+		Global struct {
+			PrivateKeyPath Path `yaml:"private_key"`
+		} `yaml:"global"`
+	}
+	resolvedData, err := resolveSecrets(basePath, configData, os.ReadFile)
+	if err != nil {
+		return "", "", err
+	}
+	if err = yaml.Unmarshal(resolvedData, &current); err != nil {
+		return "", "", fmt.Errorf("failed to parse %q: %w", c.path, err)
+	}
+	keyPathInConfig := current.Global.PrivateKeyPath
+	keyPath := absPath(basePath, keyPathInConfig)
+	oldKeyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return "", "", err
+	}
+	if oldKeyID, _, err = readKeyPEM(keyPath, oldKeyData, false); err != nil {
+		return "", "", err
+	}
+	newKeyID, newKeyData, err := generateMatrixKey()
+	if err != nil {
+		return "", "", err
+	}
+
+	// The old key is kept next to the current one, e.g. matrix_key.pem becomes
+	// matrix_key_abc123.pem.
+	ext := filepath.Ext(string(keyPathInConfig))
+	oldKeyPathInConfig := Path(fmt.Sprintf(
+		"%s_%s%s", strings.TrimSuffix(string(keyPathInConfig), ext),
+		strings.TrimPrefix(string(oldKeyID), "ed25519:"), ext,
+	))
+	oldKeyPath := absPath(basePath, oldKeyPathInConfig)
+	newConfigData, err := addOldPrivateKey(configData, oldKeyPathInConfig, spec.AsTimestamp(time.Now()))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to update %q: %w", c.path, err)
+	}
+
+	// Make sure that the server will start with the new config and keys before
+	// touching anything.
+	readFile := func(path string) ([]byte, error) {
+		switch path {
+		case keyPath:
+			return newKeyData, nil
+		case oldKeyPath:
+			return oldKeyData, nil
+		}
+		return os.ReadFile(path)
+	}
+	if _, err = loadConfig(basePath, newConfigData, readFile); err != nil {
+		return "", "", fmt.Errorf("rotated config doesn't load: %w", err)
+	}
+
+	if err = writeFileExclusive(oldKeyPath, oldKeyData, 0o600); err != nil {
+		return "", "", fmt.Errorf("failed to save old key: %w", err)
+	}
+	if err = replaceFile(c.path, newConfigData, 0o600); err != nil {
+		_ = os.Remove(oldKeyPath)
+		return "", "", fmt.Errorf("failed to save config: %w", err)
+	}
+	if err = replaceFile(keyPath, newKeyData, 0o600); err != nil {
+		return "", "", fmt.Errorf("failed to save new key (the old key is still in use): %w", err)
+	}
+
+	_, oldKey, err := readKeyPEM(oldKeyPath, oldKeyData, false)
+	if err != nil {
+		return "", "", err
+	}
+	_, newKey, err := readKeyPEM(keyPath, newKeyData, false)
+	if err != nil {
+		return "", "", err
+	}
+	c.Global.swapSigningKey(newKeyID, newKey, &OldVerifyKeys{
+		PrivateKeyPath: oldKeyPathInConfig,
+		PrivateKey:     oldKey,
+		PublicKey:      spec.Base64Bytes(oldKey.Public().(ed25519.PublicKey)),
+		KeyID:          oldKeyID,
+		ExpiredAt:      spec.AsTimestamp(time.Now()),
+	})
+	return oldKeyID, newKeyID, nil
+}
+
+// swapSigningKey makes the running server sign with a new key, publishing the
+// old one as expired.
+func (c *Global) swapSigningKey(keyID gomatrixserverlib.KeyID, privateKey ed25519.PrivateKey, old *OldVerifyKeys) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	for _, v := range c.VirtualHosts {
+		if v.KeyID == c.KeyID && v.PrivateKey.Equal(c.PrivateKey) {
+			v.KeyID, v.PrivateKey = keyID, privateKey
+		}
+	}
+	c.KeyID, c.PrivateKey = keyID, privateKey
+	c.OldVerifyKeys = append(append([]*OldVerifyKeys(nil), c.OldVerifyKeys...), old)
+}
+
+// SigningKey returns the key which the server signs with. It is safe to call
+// while the key is being rotated.
+func (c *Global) SigningKey() (gomatrixserverlib.KeyID, ed25519.PrivateKey) {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	return c.KeyID, c.PrivateKey
+}
+
+// CurrentOldVerifyKeys returns the keys which the server used to sign with.
+// It is safe to call while the key is being rotated.
+func (c *Global) CurrentOldVerifyKeys() []*OldVerifyKeys {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	return c.OldVerifyKeys
+}
+
+// generateMatrixKey generates a new signing key in PEM format.
+func generateMatrixKey() (gomatrixserverlib.KeyID, []byte, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return "", nil, err
+	}
+	keyID := base64.RawURLEncoding.EncodeToString(seed)
+	keyID = strings.ReplaceAll(keyID, "-", "")
+	keyID = strings.ReplaceAll(keyID, "_", "")
+	keyID = "ed25519:" + keyID[:6]
+	data := pem.EncodeToMemory(&pem.Block{
+		Type: "MATRIX PRIVATE KEY",
+		Headers: map[string]string{
+			"Key-ID": keyID,
+		},
+		Bytes: seed,
+	})
+	return gomatrixserverlib.KeyID(keyID), data, nil
+}
+
+// addOldPrivateKey adds a key to global.old_private_keys, keeping the rest of
+// the config, including comments, as it was.
+func addOldPrivateKey(configData []byte, keyPath Path, expiredAt spec.Timestamp) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(configData, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, fmt.Errorf("config is empty")
+	}
+	global := mappingValue(doc.Content[0], "global")
+	if global == nil || global.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config has no global section")
+	}
+	keys := mappingValue(global, "old_private_keys")
+	switch {
+	case keys == nil:
+		keys = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		global.Content = append(global.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "old_private_keys"},
+			keys,
+		)
+	case keys.Kind == yaml.ScalarNode && keys.Tag == "!!null":
+		keys.Kind, keys.Tag, keys.Value = yaml.SequenceNode, "!!seq", ""
+	case keys.Kind != yaml.SequenceNode:
+		return nil, fmt.Errorf("global.old_private_keys isn't a list")
+	}
+	keys.Style = 0
+	keys.Content = append(keys.Content, &yaml.Node{
+		Kind: yaml.MappingNode,
+		Tag:  "!!map",
+		Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: "private_key"},
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: string(keyPath)},
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: "expired_at"},
+			{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatUint(uint64(expiredAt), 10)},
+		},
+	})
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mappingValue returns the value for a key in a YAML mapping, or nil if it
+// isn't there.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// writeFileExclusive writes a file, failing if it already exists.
+func writeFileExclusive(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// replaceFile atomically replaces the contents of a file, keeping its
+// permissions if it exists already.
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+)
+
+func TestRotateSigningKey(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "matrix_key.pem")
+	configPath := filepath.Join(dir, "dendrite.yaml")
+	if err := os.WriteFile(keyPath, []byte(testKey), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configPath, []byte(
+		"# The comments should be kept.\n"+
+			"version: 2\n"+
+			"global:\n"+
+			"  server_name: localhost\n"+
+			"  private_key: "+keyPath+"\n"+
+			"  # Old keys go here.\n"+
+			"  old_private_keys:\n",
+	), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ownKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedHost := &VirtualHost{SigningIdentity: cfg.Global.SigningIdentity}
+	sharedHost.ServerName = "shared"
+	ownHost := &VirtualHost{SigningIdentity: fclient.SigningIdentity{ServerName: "own", KeyID: "ed25519:own", PrivateKey: ownKey}}
+	cfg.Global.VirtualHosts = []*VirtualHost{sharedHost, ownHost}
+	oldKeyID, newKeyID, err := cfg.RotateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldKeyID != testKeyID || newKeyID == oldKeyID {
+		t.Fatalf("unexpected key IDs %q and %q", oldKeyID, newKeyID)
+	}
+
+	// The running server signs with the new key straight away, and publishes
+	// the old one as expired.
+	keyID, privateKey := cfg.Global.SigningKey()
+	if keyID != newKeyID {
+		t.Errorf("expected the new key %q to be in use, got %q", newKeyID, keyID)
+	}
+	identity, err := cfg.Global.SigningIdentityFor("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.KeyID != newKeyID || !identity.PrivateKey.Equal(privateKey) {
+		t.Errorf("expected the virtual host sharing the key to use the new key, got %q", identity.KeyID)
+	}
+	if identity, err = cfg.Global.SigningIdentityFor("own"); err != nil {
+		t.Fatal(err)
+	}
+	if identity.KeyID != "ed25519:own" || !identity.PrivateKey.Equal(ownKey) {
+		t.Errorf("expected the virtual host with its own key to keep it, got %q", identity.KeyID)
+	}
+	oldKeys := cfg.Global.CurrentOldVerifyKeys()
+	if len(oldKeys) != 1 || oldKeys[0].KeyID != oldKeyID || oldKeys[0].ExpiredAt == 0 || len(oldKeys[0].PublicKey) != ed25519.PublicKeySize {
+		t.Fatalf("unexpected old keys %+v", oldKeys)
+	}
+
+	rotated, err := Load(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Global.KeyID != newKeyID {
+		t.Errorf("expected the new key %q to be in use, got %q", newKeyID, rotated.Global.KeyID)
+	}
+	if len(rotated.Global.OldVerifyKeys) != 1 {
+		t.Fatalf("expected 1 old key, got %d", len(rotated.Global.OldVerifyKeys))
+	}
+	old := rotated.Global.OldVerifyKeys[0]
+	if old.KeyID != oldKeyID || old.ExpiredAt == 0 || string(old.PrivateKeyPath) != filepath.Join(dir, "matrix_key_c8NsuQ.pem") {
+		t.Errorf("unexpected old key %+v", old)
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, comment := range []string{"# The comments should be kept.", "# Old keys go here."} {
+		if !bytes.Contains(data, []byte(comment)) {
+			t.Errorf("expected comment %q to be kept in:\n%s", comment, data)
+		}
+	}
+
+	// Rotating again should add to the old keys.
+	if _, _, err = rotated.RotateSigningKey(); err != nil {
+		t.Fatal(err)
+	}
+	if rotated, err = Load(configPath); err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated.Global.OldVerifyKeys) != 2 {
+		t.Fatalf("expected 2 old keys, got %d", len(rotated.Global.OldVerifyKeys))
+	}
+}
@@ -7,6 +7,7 @@ type KeyServer struct {
 }
 
 func (c *KeyServer) Defaults(opts DefaultOpts) {
+	c.Database.Name = "keyserver"
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.Database.ConnectionString = "file:keyserver.db"
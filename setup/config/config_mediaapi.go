@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"time"
 )
 
 type MediaAPI struct {
@@ -22,22 +24,87 @@ type MediaAPI struct {
 	// Note: if max_file_size_bytes is not set, it will default to 10485760 (10MB)
 	MaxFileSizeBytes FileSizeBytes `yaml:"max_file_size_bytes,omitempty"`
 
+	// The maximum file size in bytes of remote media that is fetched over federation.
+	// Fetches of larger files are aborted and the partial download is removed.
+	// Note: if max_remote_file_size_bytes is 0 or not set, max_file_size_bytes is used.
+	MaxRemoteFileSizeBytes FileSizeBytes `yaml:"max_remote_file_size_bytes,omitempty"`
+
 	// Whether to dynamically generate thumbnails on-the-fly if the requested resolution is not already generated
 	DynamicThumbnails bool `yaml:"dynamic_thumbnails"`
 
 	// The maximum number of simultaneous thumbnail generators. default: 10
 	MaxThumbnailGenerators int `yaml:"max_thumbnail_generators"`
 
-	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
+	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content,
+	// unless they are marked to be generated on demand
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// Limits for generating thumbnails when they are requested rather than in advance
+	OnDemandThumbnails OnDemandThumbnails `yaml:"on_demand_thumbnails"`
+
+	// Media types which are never served, either full types such as "text/html" or
+	// types with a wildcard subtype such as "video/*". They are matched against both
+	// the type given by the uploader and the type worked out from the content.
+	BlockedContentTypes []string `yaml:"blocked_content_types"`
+
+	// Redirect media downloads to presigned URLs so that an S3-compatible object store can serve them
+	SignedURLs SignedURLs `yaml:"signed_urls"`
+}
+
+// SignedURLs configures redirecting media downloads to an S3-compatible object store
+// which holds a copy of the media store. Requests are still checked by the media API,
+// which then redirects to a presigned URL for the object which expires.
+type SignedURLs struct {
+	// The URL of the bucket, which the path of the file in the media store is appended
+	// to. Downloads are served by the media API itself if this is empty.
+	BaseURL string `yaml:"base_url"`
+
+	// The region of the bucket.
+	Region string `yaml:"region"`
+
+	// The credentials used to presign the URLs.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+
+	// How long presigned URLs are valid for.
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+// maxSignedURLExpiry is the longest that S3 allows presigned URLs to be valid for.
+const maxSignedURLExpiry = time.Hour * 24 * 7
+
+// Enabled returns true if downloads should be redirected to signed URLs.
+func (c *SignedURLs) Enabled() bool {
+	return c.BaseURL != ""
+}
+
+// OnDemandThumbnails limits the thumbnails generated when a client requests them,
+// either dynamically or because the configured size is generated on demand.
+type OnDemandThumbnails struct {
+	// The number of workers generating thumbnails on demand.
+	MaxGenerators int `yaml:"max_generators"`
+
+	// The number of requested thumbnails which can wait for a worker. Once the queue
+	// is full, requests are given the closest existing thumbnail, or a 503 if there
+	// isn't one.
+	QueueSize int `yaml:"queue_size"`
+
+	// How long a request waits for a thumbnail to be generated before it is given the
+	// closest existing thumbnail instead. The thumbnail is still generated for later requests.
+	Timeout time.Duration `yaml:"timeout"`
 }
 
 // DefaultMaxFileSizeBytes defines the default file size allowed in transfers
 var DefaultMaxFileSizeBytes = FileSizeBytes(10485760)
 
 func (c *MediaAPI) Defaults(opts DefaultOpts) {
+	c.Database.Name = "mediaapi"
 	c.MaxFileSizeBytes = DefaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
+	c.OnDemandThumbnails.MaxGenerators = 4
+	c.OnDemandThumbnails.QueueSize = 32
+	c.OnDemandThumbnails.Timeout = time.Second * 10
+	c.SignedURLs.Expiry = time.Minute * 5
 	if opts.Generate {
 		c.ThumbnailSizes = []ThumbnailSize{
 			{
@@ -66,7 +133,23 @@ func (c *MediaAPI) Defaults(opts DefaultOpts) {
 func (c *MediaAPI) Verify(configErrs *ConfigErrors) {
 	checkNotEmpty(configErrs, "media_api.base_path", string(c.BasePath))
 	checkPositive(configErrs, "media_api.max_file_size_bytes", int64(c.MaxFileSizeBytes))
+	checkPositive(configErrs, "media_api.max_remote_file_size_bytes", int64(c.MaxRemoteFileSizeBytes))
 	checkPositive(configErrs, "media_api.max_thumbnail_generators", int64(c.MaxThumbnailGenerators))
+	checkAtLeastOne(configErrs, "media_api.on_demand_thumbnails.max_generators", int64(c.OnDemandThumbnails.MaxGenerators))
+	checkAtLeastOne(configErrs, "media_api.on_demand_thumbnails.queue_size", int64(c.OnDemandThumbnails.QueueSize))
+	checkPositive(configErrs, "media_api.on_demand_thumbnails.timeout", int64(c.OnDemandThumbnails.Timeout))
+
+	if c.SignedURLs.Enabled() {
+		if u, err := url.Parse(c.SignedURLs.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.signed_urls.base_url", c.SignedURLs.BaseURL))
+		}
+		checkNotEmpty(configErrs, "media_api.signed_urls.region", c.SignedURLs.Region)
+		checkNotEmpty(configErrs, "media_api.signed_urls.access_key_id", c.SignedURLs.AccessKeyID)
+		checkNotEmpty(configErrs, "media_api.signed_urls.secret_access_key", c.SignedURLs.SecretAccessKey)
+		if c.SignedURLs.Expiry < time.Second || c.SignedURLs.Expiry > maxSignedURLExpiry {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.signed_urls.expiry", c.SignedURLs.Expiry))
+		}
+	}
 
 	for i, size := range c.ThumbnailSizes {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
@@ -77,3 +160,23 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors) {
 		checkNotEmpty(configErrs, "media_api.database.connection_string", string(c.Database.ConnectionString))
 	}
 }
+
+// RemoteFileSizeLimit returns the maximum size of remote media, or 0 if it is unlimited.
+func (c *MediaAPI) RemoteFileSizeLimit() FileSizeBytes {
+	if c.MaxRemoteFileSizeBytes > 0 {
+		return c.MaxRemoteFileSizeBytes
+	}
+	return c.MaxFileSizeBytes
+}
+
+// PreGeneratedThumbnailSizes returns the thumbnail sizes which are generated
+// when media is uploaded or fetched, rather than on demand.
+func (c *MediaAPI) PreGeneratedThumbnailSizes() []ThumbnailSize {
+	sizes := make([]ThumbnailSize, 0, len(c.ThumbnailSizes))
+	for _, size := range c.ThumbnailSizes {
+		if !size.OnDemand {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
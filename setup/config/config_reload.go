@@ -0,0 +1,154 @@
+package config
+
+import (
+	"fmt"
+	"sync"
+)
+
+// reloadMutex guards the options which ApplyReload can change while the
+// server is running. Anything which reads those options after startup must
+// do so through an accessor which takes the read lock, or else register
+// with OnReload and take its own copy.
+var reloadMutex sync.RWMutex
+
+// reloadSerialiser makes sure that only one reload happens at a time, i.e.
+// if SIGHUP is received while an admin has also asked for a reload.
+var reloadSerialiser sync.Mutex
+
+var (
+	reloadHooksMutex sync.Mutex
+	reloadHooks      []*reloadHook
+)
+
+type reloadHook struct {
+	f func()
+}
+
+// OnReload registers a function which will be called after the config
+// has been reloaded, so that components which keep their own copy of any
+// reloadable options can pick up the new values. The returned function
+// unregisters it again.
+func OnReload(f func()) (unregister func()) {
+	hook := &reloadHook{f: f}
+	reloadHooksMutex.Lock()
+	defer reloadHooksMutex.Unlock()
+	reloadHooks = append(reloadHooks, hook)
+	return func() {
+		reloadHooksMutex.Lock()
+		defer reloadHooksMutex.Unlock()
+		for i, h := range reloadHooks {
+			if h == hook {
+				reloadHooks = append(reloadHooks[:i:i], reloadHooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Reload loads the config file that c was originally loaded from and, if
+// it is valid, applies the options which can be changed at runtime. These
+// are the logging levels, rate limiting, whether registration is enabled and
+// whether the debug endpoints are enabled.
+// Changes to any other options are ignored and need a restart.
+func (c *Dendrite) Reload() error {
+	reloadSerialiser.Lock()
+	defer reloadSerialiser.Unlock()
+
+	if c.path == "" {
+		return fmt.Errorf("config was not loaded from a file")
+	}
+	newer, err := Load(c.path)
+	if err != nil {
+		return err
+	}
+	configErrs := &ConfigErrors{}
+	newer.Verify(configErrs)
+	if len(*configErrs) > 0 {
+		return configErrs
+	}
+	c.ApplyReload(newer)
+	return nil
+}
+
+// ApplyReload copies the options which can be changed at runtime from newer
+// into c and then calls any functions registered with OnReload.
+func (c *Dendrite) ApplyReload(newer *Dendrite) {
+	reloadMutex.Lock()
+	c.Logging = newer.Logging
+	c.ComponentLogLevels = newer.ComponentLogLevels
+	c.ClientAPI.RegistrationDisabled = newer.ClientAPI.RegistrationDisabled
+	c.ClientAPI.GuestsDisabled = newer.ClientAPI.GuestsDisabled
+	c.ClientAPI.RateLimiting = newer.ClientAPI.RateLimiting
+	c.Global.Debug.Enabled = newer.Global.Debug.Enabled
+	c.FederationAPI.AllowPublicRoomsOverFederation = newer.FederationAPI.AllowPublicRoomsOverFederation
+	reloadMutex.Unlock()
+
+	reloadHooksMutex.Lock()
+	hooks := append([]*reloadHook(nil), reloadHooks...)
+	reloadHooksMutex.Unlock()
+	for _, hook := range hooks {
+		hook.f()
+	}
+}
+
+// IsRegistrationDisabled returns whether registration is disabled. It is
+// safe to call while the config is being reloaded.
+func (c *ClientAPI) IsRegistrationDisabled() bool {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	return c.RegistrationDisabled
+}
+
+// IsGuestsDisabled returns whether guest registration is disabled. It is
+// safe to call while the config is being reloaded.
+func (c *ClientAPI) IsGuestsDisabled() bool {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	return c.GuestsDisabled
+}
+
+// IsPublicRoomsOverFederationAllowed returns whether other servers can list
+// our public rooms. It is safe to call while the config is being reloaded.
+func (c *FederationAPI) IsPublicRoomsOverFederationAllowed() bool {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	return c.AllowPublicRoomsOverFederation
+}
+
+// IsEnabled returns whether the debug endpoints are enabled. It is safe to
+// call while the config is being reloaded.
+func (c *Debug) IsEnabled() bool {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	return c.Enabled
+}
+
+// Current returns a copy of the rate limiting options. It is safe to call
+// while the config is being reloaded.
+func (r *RateLimiting) Current() RateLimiting {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	current := *r
+	current.ExemptUserIDs = append([]string(nil), r.ExemptUserIDs...)
+	return current
+}
+
+// CurrentLogging returns a copy of the logging hooks. It is safe to call
+// while the config is being reloaded.
+func (c *Dendrite) CurrentLogging() []LogrusHook {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	return append([]LogrusHook(nil), c.Logging...)
+}
+
+// CurrentComponentLogLevels returns a copy of the per-component log levels.
+// It is safe to call while the config is being reloaded.
+func (c *Dendrite) CurrentComponentLogLevels() map[string]string {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	levels := make(map[string]string, len(c.ComponentLogLevels))
+	for component, level := range c.ComponentLogLevels {
+		levels[component] = level
+	}
+	return levels
+}
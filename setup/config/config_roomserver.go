@@ -2,7 +2,9 @@ package config
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/neilalexander/harmony/internal/eventcompress"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
 )
@@ -13,10 +15,18 @@ type RoomServer struct {
 	DefaultRoomVersion gomatrixserverlib.RoomVersion `yaml:"default_room_version,omitempty"`
 
 	Database DatabaseOptions `yaml:"database,omitempty"`
+
+	DeadRoomCleanup DeadRoomCleanup `yaml:"dead_room_cleanup"`
+
+	// Journal input events in the database until they have been processed, so
+	// that they can be replayed if they are lost from JetStream
+	PersistInputQueue bool `yaml:"persist_input_queue"`
 }
 
 func (c *RoomServer) Defaults(opts DefaultOpts) {
+	c.Database.Name = "roomserver"
 	c.DefaultRoomVersion = gomatrixserverlib.RoomVersionV10
+	c.DeadRoomCleanup.Defaults()
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.Database.ConnectionString = "file:roomserver.db"
@@ -29,9 +39,46 @@ func (c *RoomServer) Verify(configErrs *ConfigErrors) {
 		checkNotEmpty(configErrs, "room_server.database.connection_string", string(c.Database.ConnectionString))
 	}
 
+	if _, err := eventcompress.ParseAlgorithm(c.Database.EventCompression); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key 'room_server.database.event_compression': %s", err))
+	}
+
 	if !gomatrixserverlib.KnownRoomVersion(c.DefaultRoomVersion) {
 		configErrs.Add(fmt.Sprintf("invalid value for config key 'room_server.default_room_version': unsupported room version: %q", c.DefaultRoomVersion))
 	} else if !gomatrixserverlib.StableRoomVersion(c.DefaultRoomVersion) {
 		log.Warnf("WARNING: Provided default room version %q is unstable", c.DefaultRoomVersion)
 	}
+
+	c.DeadRoomCleanup.Verify(configErrs)
+}
+
+type DeadRoomCleanup struct {
+	// Is dead room cleanup enabled or disabled?
+	Enabled bool `yaml:"enabled"`
+	// How often to look for dead rooms
+	Interval time.Duration `yaml:"interval"`
+	// How long a room with no local members must have had no new events
+	// for before it is treated as dead
+	InactiveFor time.Duration `yaml:"inactive_for"`
+	// How long after finding a dead room to purge it from the room server
+	// and the sync API, in case local users come back to it
+	PurgeAfter time.Duration `yaml:"purge_after"`
+}
+
+func (c *DeadRoomCleanup) Defaults() {
+	c.Enabled = false
+	c.Interval = time.Hour
+	c.InactiveFor = time.Hour * 24 * 30
+	c.PurgeAfter = time.Hour * 24 * 7
+}
+
+func (c *DeadRoomCleanup) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if c.Interval <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.dead_room_cleanup.interval", c.Interval))
+	}
+	checkPositive(configErrs, "room_server.dead_room_cleanup.inactive_for", int64(c.InactiveFor))
+	checkPositive(configErrs, "room_server.dead_room_cleanup.purge_after", int64(c.PurgeAfter))
 }
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretKeys are the options whose values are secret, which are redacted when
+// the config is dumped.
+var secretKeys = map[string]bool{
+	"registration_shared_secret": true,
+	"recaptcha_private_key":      true,
+	"recaptcha_bypass_secret":    true,
+	"turn_shared_secret":         true,
+	"turn_password":              true,
+	"shared_secret":              true,
+	"password":                   true,
+	"secret_access_key":          true,
+}
+
+// readableFromFile returns whether an option can be read from a file by adding
+// "_file" to the key, e.g. "registration_shared_secret_file: /run/secrets/reg".
+// This is the secret options and database connection strings, which usually
+// contain a password.
+func readableFromFile(key string) bool {
+	return secretKeys[key] || key == "connection_string"
+}
+
+// envVarRegexp matches ${ENV_VAR}, or $${ENV_VAR} which is left as ${ENV_VAR}.
+var envVarRegexp = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// resolveSecrets replaces ${ENV_VAR} in any value with that environment
+// variable, and the "_file" variants of secret options with the contents of
+// the file, so that a config can be committed without any of the secrets in
+// it. An error is returned if an environment variable isn't set, rather than
+// quietly leaving a secret empty. The config is returned as it was if there
+// is nothing to resolve.
+func resolveSecrets(basePath string, configData []byte, readFile func(string) ([]byte, error)) ([]byte, error) {
+	if !bytes.Contains(configData, []byte("${")) && !bytes.Contains(configData, []byte("_file")) {
+		return configData, nil
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(configData, &doc); err != nil {
+		return nil, err
+	}
+	changed, err := resolveNode(basePath, &doc, readFile)
+	if err != nil || !changed {
+		return configData, err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	if err = enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err = enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func resolveNode(basePath string, node *yaml.Node, readFile func(string) ([]byte, error)) (changed bool, err error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return expandEnv(node)
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			name, ok := strings.CutSuffix(key.Value, "_file")
+			if !ok || !readableFromFile(name) || value.Kind != yaml.ScalarNode {
+				c, err := resolveNode(basePath, value, readFile)
+				if err != nil {
+					return false, err
+				}
+				changed = changed || c
+				continue
+			}
+			if mappingValue(node, name) != nil {
+				return false, fmt.Errorf("only one of %q and %q can be given", name, key.Value)
+			}
+			if _, err = expandEnv(value); err != nil {
+				return false, err
+			}
+			path := absPath(basePath, Path(value.Value))
+			secret, err := readFile(path)
+			if err != nil {
+				return false, fmt.Errorf("failed to read %q for %q: %w", path, key.Value, err)
+			}
+			key.Value = name
+			value.Value = strings.TrimRight(string(secret), "\r\n")
+			value.Tag, value.Style = "!!str", 0
+			changed = true
+		}
+		return changed, nil
+	default:
+		for _, child := range node.Content {
+			c, err := resolveNode(basePath, child, readFile)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || c
+		}
+		return changed, nil
+	}
+}
+
+// expandEnv replaces any environment variables in a scalar. If the scalar
+// wasn't quoted, the result is parsed as though it had been written in the
+// config, so that e.g. a port number from an environment variable is still a
+// number.
+func expandEnv(node *yaml.Node) (bool, error) {
+	if !strings.Contains(node.Value, "${") {
+		return false, nil
+	}
+	var err error
+	node.Value = envVarRegexp.ReplaceAllStringFunc(node.Value, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		name := match[2 : len(match)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %q is not set", name)
+		}
+		return value
+	})
+	if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+		node.Tag = ""
+	}
+	return true, err
+}
@@ -1,17 +1,29 @@
 package config
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/eventcompress"
+)
+
 type SyncAPI struct {
 	Matrix *Global `yaml:"-"`
 
 	Database DatabaseOptions `yaml:"database,omitempty"`
 
+	// Deprecated: use global.real_ip_header instead.
 	RealIPHeader string `yaml:"real_ip_header"`
 
 	Fulltext Fulltext `yaml:"search"`
+
+	SendToDevice SendToDevice `yaml:"send_to_device"`
 }
 
 func (c *SyncAPI) Defaults(opts DefaultOpts) {
+	c.Database.Name = "syncapi"
 	c.Fulltext.Defaults(opts)
+	c.SendToDevice.Defaults()
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.Database.ConnectionString = "file:syncapi.db"
@@ -21,9 +33,13 @@ func (c *SyncAPI) Defaults(opts DefaultOpts) {
 
 func (c *SyncAPI) Verify(configErrs *ConfigErrors) {
 	c.Fulltext.Verify(configErrs)
+	c.SendToDevice.Verify(configErrs)
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "sync_api.database", string(c.Database.ConnectionString))
 	}
+	if _, err := eventcompress.ParseAlgorithm(c.Database.EventCompression); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key 'sync_api.database.event_compression': %s", err))
+	}
 }
 
 type Fulltext struct {
@@ -46,3 +62,21 @@ func (f *Fulltext) Verify(configErrs *ConfigErrors) {
 	checkNotEmpty(configErrs, "syncapi.search.index_path", string(f.IndexPath))
 	checkNotEmpty(configErrs, "syncapi.search.language", f.Language)
 }
+
+type SendToDevice struct {
+	// The maximum number of undelivered messages to keep for each device.
+	// When the limit is reached, the oldest messages are dropped first.
+	MaxMessagesPerDevice int `yaml:"max_messages_per_device"`
+	// How long undelivered messages are kept before they are expired.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (s *SendToDevice) Defaults() {
+	s.MaxMessagesPerDevice = 1000
+	s.MaxAge = time.Hour * 24 * 30
+}
+
+func (s *SendToDevice) Verify(configErrs *ConfigErrors) {
+	checkAtLeastOne(configErrs, "sync_api.send_to_device.max_messages_per_device", int64(s.MaxMessagesPerDevice))
+	checkPositive(configErrs, "sync_api.send_to_device.max_age", int64(s.MaxAge))
+}
@@ -1,6 +1,15 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/pushrules"
+	"golang.org/x/crypto/bcrypt"
+)
 
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
@@ -19,14 +28,217 @@ type UserAPI struct {
 	// be joined to the rooms listed under this option.
 	AutoJoinRooms []string `yaml:"auto_join_rooms"`
 
+	// The localpart of a local user who invites newly registered users to
+	// the auto-join rooms before they join, so that rooms which aren't
+	// public can be auto-joined. The user must be able to invite.
+	AutoJoinRoomsInviter string `yaml:"auto_join_rooms_inviter"`
+
+	// Only invite newly registered users to the auto-join rooms, leaving
+	// them to decide whether to join. Requires auto_join_rooms_inviter.
+	AutoJoinRoomsInviteOnly bool `yaml:"auto_join_rooms_invite_only"`
+
+	// Local members of a room which is upgraded will automatically be
+	// joined to the replacement room when this option is enabled.
+	AutoJoinUpgradedRooms bool `yaml:"auto_join_upgraded_rooms"`
+
 	// The number of workers to start for the DeviceListUpdater. Defaults to 8.
 	// This only needs updating if the "InputDeviceListUpdate" stream keeps growing indefinitely.
 	WorkerCount int `yaml:"worker_count"`
+
+	// Limits on failed password logins.
+	LoginProtection LoginProtection `yaml:"login_protection"`
+
+	// Push rules which are applied to all local users.
+	PushRules ServerPushRules `yaml:"push_rules"`
+
+	// Controls what is sent to push gateways.
+	PushNotifications PushNotifications `yaml:"push_notifications"`
+}
+
+type PushNotifications struct {
+	// The format used for pushers which don't request one, either
+	// empty for full notifications or "event_id_only"
+	DefaultFormat string `yaml:"default_format"`
+	// Send "event_id_only" notifications to all pushers, regardless
+	// of the format they requested
+	ForceEventIDOnly bool `yaml:"force_event_id_only"`
+	// Leave the event content out of full notifications for events
+	// in encrypted rooms
+	RedactEncryptedRooms bool `yaml:"redact_encrypted_rooms"`
+}
+
+// Format returns the format to use for a pusher which requested the
+// given format.
+func (c *PushNotifications) Format(requested string) string {
+	switch {
+	case c.ForceEventIDOnly:
+		return PushFormatEventIDOnly
+	case requested == "":
+		return c.DefaultFormat
+	default:
+		return requested
+	}
+}
+
+// PushFormatEventIDOnly is the push format which only includes the
+// event and room IDs and the unread counts in notifications.
+const PushFormatEventIDOnly = "event_id_only"
+
+type ServerPushRules struct {
+	// Extra override rules, which take precedence over the rules of
+	// the users apart from the master rule
+	Override []ServerPushRule `yaml:"override"`
+	// Extra content rules, evaluated before the default content rules
+	Content []ServerPushRule `yaml:"content"`
+	// Extra underride rules, evaluated before the default underride rules
+	Underride []ServerPushRule `yaml:"underride"`
+	// The IDs of default rules from the spec which are disabled for everyone
+	DisabledDefaults []string `yaml:"disabled_defaults"`
+}
+
+type ServerPushRule struct {
+	RuleID     string                    `yaml:"rule_id"`
+	Conditions []ServerPushRuleCondition `yaml:"conditions"`
+	Pattern    string                    `yaml:"pattern"`
+	// Actions such as "notify" or "dont_notify"
+	Actions []string `yaml:"actions"`
+	// Tweaks which are set when the rule matches, i.e. "sound" or "highlight"
+	Tweaks map[string]interface{} `yaml:"tweaks"`
+}
+
+type ServerPushRuleCondition struct {
+	Kind    string `yaml:"kind"`
+	Key     string `yaml:"key"`
+	Pattern string `yaml:"pattern"`
+	Is      string `yaml:"is"`
+}
+
+// ServerRules converts the configured rules into push rules, returning
+// an error if any of them are invalid.
+func (c *ServerPushRules) ServerRules() (*pushrules.ServerRules, error) {
+	if len(c.Override) == 0 && len(c.Content) == 0 && len(c.Underride) == 0 && len(c.DisabledDefaults) == 0 {
+		return nil, nil
+	}
+	rules := &pushrules.ServerRules{
+		DisabledDefaults: make(map[string]struct{}, len(c.DisabledDefaults)),
+	}
+	for _, ruleID := range c.DisabledDefaults {
+		if !strings.HasPrefix(ruleID, ".") {
+			return nil, fmt.Errorf("disabled default rule %q is not a default rule", ruleID)
+		}
+		rules.DisabledDefaults[ruleID] = struct{}{}
+	}
+	var err error
+	if rules.Override, err = c.rules(pushrules.OverrideKind, c.Override); err != nil {
+		return nil, err
+	}
+	if rules.Content, err = c.rules(pushrules.ContentKind, c.Content); err != nil {
+		return nil, err
+	}
+	if rules.Underride, err = c.rules(pushrules.UnderrideKind, c.Underride); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (c *ServerPushRules) rules(kind pushrules.Kind, configured []ServerPushRule) ([]*pushrules.Rule, error) {
+	rules := make([]*pushrules.Rule, 0, len(configured))
+	for _, r := range configured {
+		rule := &pushrules.Rule{
+			RuleID:     r.RuleID,
+			Default:    true,
+			Enabled:    true,
+			Conditions: []*pushrules.Condition{},
+			Actions:    []*pushrules.Action{},
+		}
+		if kind == pushrules.ContentKind {
+			pattern := r.Pattern
+			rule.Pattern = &pattern
+		}
+		for _, cond := range r.Conditions {
+			condition := &pushrules.Condition{
+				Kind: pushrules.ConditionKind(cond.Kind),
+				Key:  cond.Key,
+				Is:   cond.Is,
+			}
+			if cond.Pattern != "" {
+				pattern := cond.Pattern
+				condition.Pattern = &pattern
+			}
+			rule.Conditions = append(rule.Conditions, condition)
+		}
+		for _, action := range r.Actions {
+			rule.Actions = append(rule.Actions, &pushrules.Action{Kind: pushrules.ActionKind(action)})
+		}
+		tweaks := make([]string, 0, len(r.Tweaks))
+		for tweak := range r.Tweaks {
+			tweaks = append(tweaks, tweak)
+		}
+		sort.Strings(tweaks)
+		for _, tweak := range tweaks {
+			rule.Actions = append(rule.Actions, &pushrules.Action{
+				Kind:  pushrules.SetTweakAction,
+				Tweak: pushrules.TweakKey(tweak),
+				Value: r.Tweaks[tweak],
+			})
+		}
+		if errs := pushrules.ValidateRule(kind, rule); len(errs) > 0 {
+			return nil, fmt.Errorf("%s rule %q: %w", kind, r.RuleID, errs[0])
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+type LoginProtection struct {
+	// Is login protection enabled or disabled?
+	Enabled bool `yaml:"enabled"`
+	// How many failed attempts an account or IP address can make before
+	// each further attempt is delayed
+	FreeAttempts int `yaml:"free_attempts"`
+	// The delay after the first attempt beyond the free attempts, which
+	// doubles with each further failure
+	BaseDelay time.Duration `yaml:"base_delay"`
+	// How many failed attempts an account can make before it is locked
+	MaxAttempts int `yaml:"max_attempts"`
+	// How many failed attempts an IP address can make, across all accounts,
+	// before it is locked
+	IPMaxAttempts int `yaml:"ip_max_attempts"`
+	// How long accounts and IP addresses are locked for
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+	// How long failed attempts are remembered for after the last one
+	AttemptWindow time.Duration `yaml:"attempt_window"`
+}
+
+func (c *LoginProtection) Defaults() {
+	c.Enabled = true
+	c.FreeAttempts = 3
+	c.BaseDelay = time.Second
+	c.MaxAttempts = 10
+	c.IPMaxAttempts = 50
+	c.LockoutDuration = time.Minute * 15
+	c.AttemptWindow = time.Hour
+}
+
+func (c *LoginProtection) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkPositive(configErrs, "user_api.login_protection.base_delay", int64(c.BaseDelay))
+	checkPositive(configErrs, "user_api.login_protection.max_attempts", int64(c.MaxAttempts))
+	checkPositive(configErrs, "user_api.login_protection.ip_max_attempts", int64(c.IPMaxAttempts))
+	checkPositive(configErrs, "user_api.login_protection.lockout_duration", int64(c.LockoutDuration))
+	checkPositive(configErrs, "user_api.login_protection.attempt_window", int64(c.AttemptWindow))
+	if c.FreeAttempts < 0 || c.FreeAttempts > c.MaxAttempts {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "user_api.login_protection.free_attempts", c.FreeAttempts))
+	}
 }
 
 func (c *UserAPI) Defaults(opts DefaultOpts) {
+	c.AccountDatabase.Name = "userapi"
 	c.BCryptCost = bcrypt.DefaultCost
 	c.WorkerCount = 8
+	c.LoginProtection.Defaults()
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.AccountDatabase.ConnectionString = "file:userapi_accounts.db"
@@ -38,4 +250,19 @@ func (c *UserAPI) Verify(configErrs *ConfigErrors) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	}
+	if c.AutoJoinRoomsInviteOnly {
+		checkNotEmpty(configErrs, "user_api.auto_join_rooms_inviter", c.AutoJoinRoomsInviter)
+	}
+	if c.AutoJoinRoomsInviter != "" {
+		if _, err := spec.NewUserID(fmt.Sprintf("@%s:%s", c.AutoJoinRoomsInviter, c.Matrix.ServerName), true); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q is not a valid localpart", "user_api.auto_join_rooms_inviter", c.AutoJoinRoomsInviter))
+		}
+	}
+	c.LoginProtection.Verify(configErrs)
+	if f := c.PushNotifications.DefaultFormat; f != "" && f != PushFormatEventIDOnly {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "user_api.push_notifications.default_format", f))
+	}
+	if _, err := c.PushRules.ServerRules(); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "user_api.push_rules", err))
+	}
 }
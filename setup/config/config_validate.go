@@ -0,0 +1,122 @@
+package config
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Validate checks the config file at configPath, returning every problem with
+// it rather than stopping at the first: keys which aren't recognised, values
+// which are missing or invalid and options which conflict with each other.
+func Validate(configPath string) ConfigErrors {
+	configErrs := &ConfigErrors{}
+	configData, err := os.ReadFile(configPath)
+	if err == nil {
+		var basePath string
+		if basePath, err = filepath.Abs("."); err == nil {
+			configData, err = resolveSecrets(basePath, configData, os.ReadFile)
+		}
+	}
+	if err != nil {
+		configErrs.Add(err.Error())
+		return *configErrs
+	}
+	checkUnknownKeys(configErrs, configData)
+	cfg, err := Load(configPath)
+	if err != nil {
+		configErrs.Add(err.Error())
+		return *configErrs
+	}
+	cfg.Verify(configErrs)
+	return *configErrs
+}
+
+// checkUnknownKeys adds an error for each key in the config which doesn't
+// correspond to an option, which is usually a typo or an option which has
+// been removed.
+func checkUnknownKeys(configErrs *ConfigErrors, configData []byte) {
+	var c Dendrite
+	err := yamlv2.UnmarshalStrict(configData, &c)
+	var typeErr *yamlv2.TypeError
+	switch {
+	case errors.As(err, &typeErr):
+		for _, e := range typeErr.Errors {
+			configErrs.Add(e)
+		}
+	case err != nil:
+		configErrs.Add(err.Error())
+	}
+}
+
+// dsnPasswordRegexp matches the password in a key=value connection string.
+var dsnPasswordRegexp = regexp.MustCompile(`(password=)('[^']*'|\S*)`)
+
+const redacted = "REDACTED"
+
+// Dump returns the effective config, including the defaults for any options
+// which weren't set, as YAML. Secrets, including passwords in connection
+// strings, are redacted.
+func (c *Dendrite) Dump() ([]byte, error) {
+	reloadMutex.RLock()
+	data, err := yamlv2.Marshal(c)
+	reloadMutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	redactNode(&doc)
+	var buf strings.Builder
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err = enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err = enc.Close(); err != nil {
+		return nil, err
+	}
+	return []byte(buf.String()), nil
+}
+
+func redactNode(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if secretKeys[key.Value] && value.Kind == yaml.ScalarNode && value.Value != "" {
+				value.Value, value.Tag, value.Style = redacted, "!!str", 0
+				continue
+			}
+			redactNode(value)
+		}
+	case yaml.ScalarNode:
+		node.Value = redactCredentials(node.Value)
+	default:
+		for _, child := range node.Content {
+			redactNode(child)
+		}
+	}
+}
+
+// redactCredentials redacts the password in a URL, such as a database or NATS
+// address, or in a key=value database connection string.
+func redactCredentials(value string) string {
+	if strings.Contains(value, "://") {
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				return u.String()
+			}
+		}
+	}
+	return dsnPasswordRegexp.ReplaceAllString(value, "${1}"+redacted)
+}
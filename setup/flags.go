@@ -27,6 +27,8 @@ import (
 var (
 	configPath                            = flag.String("config", "dendrite.yaml", "The path to the config file. For more information, see the config file in this repository.")
 	version                               = flag.Bool("version", false, "Shows the current version and exits immediately.")
+	validateConfig                        = flag.Bool("validate-config", false, "Checks the config file for unknown keys, missing values and conflicting options, then exits.")
+	dumpConfig                            = flag.Bool("dump-config", false, "Prints the effective config, including defaults, with secrets redacted, then exits.")
 	enableRegistrationWithoutVerification = flag.Bool("really-enable-open-registration", false, "This allows open registration without secondary verification (reCAPTCHA). This is NOT RECOMMENDED and will SIGNIFICANTLY increase the risk that your server will be used to send spam or conduct attacks, which may result in your server being banned from rooms.")
 )
 
@@ -43,12 +45,35 @@ func ParseFlags(monolith bool) *config.Dendrite {
 		logrus.Fatal("--config must be supplied")
 	}
 
+	if *validateConfig {
+		configErrs := config.Validate(*configPath)
+		for _, err := range configErrs {
+			fmt.Fprintf(os.Stderr, "Configuration error: %s\n", err)
+		}
+		if len(configErrs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "%s is valid\n", *configPath)
+		if !*dumpConfig {
+			os.Exit(0)
+		}
+	}
+
 	cfg, err := config.Load(*configPath)
 
 	if err != nil {
 		logrus.Fatalf("Invalid config file: %s", err)
 	}
 
+	if *dumpConfig {
+		data, err := cfg.Dump()
+		if err != nil {
+			logrus.Fatalf("Failed to dump config: %s", err)
+		}
+		_, _ = os.Stdout.Write(data)
+		os.Exit(0)
+	}
+
 	if *enableRegistrationWithoutVerification {
 		cfg.ClientAPI.OpenRegistrationWithoutVerificationEnabled = true
 	}
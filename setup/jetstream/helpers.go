@@ -8,6 +8,10 @@ import (
 
 	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+
+	"github.com/neilalexander/harmony/internal/tracing"
+	"github.com/neilalexander/harmony/setup/process"
 )
 
 // JetStreamConsumer starts a durable consumer on the given subject with the
@@ -102,24 +106,54 @@ retry:
 		if len(msgs) < 1 {
 			continue
 		}
+		if !consumeBatch(ctx, subj, durable, msgs, f) {
+			return
+		}
+	}
+}
+
+// consumeBatch processes a batch of messages and then acks or naks them. If
+// the process is shutting down, the batch is still finished, so that nothing
+// is left waiting to be redelivered, unless the process is already closing,
+// in which case it returns false without touching the batch.
+func consumeBatch(
+	ctx context.Context, subj, durable string, msgs []*nats.Msg,
+	f func(ctx context.Context, msgs []*nats.Msg) bool,
+) bool {
+	if processCtx := process.FromContext(ctx); processCtx != nil {
+		if !processCtx.WorkStarted() {
+			return false
+		}
+		defer processCtx.WorkFinished()
+		ctx = context.WithoutCancel(ctx)
+	}
+	for _, msg := range msgs {
+		if err := msg.InProgress(nats.Context(ctx)); err != nil {
+			logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.InProgress: %w", err))
+			continue
+		}
+	}
+	observeDeliveries(durable, msgs)
+	msgCtx, span := tracing.StartConsumerSpan(ctx, durable, msgs)
+	defer span.End()
+	started := time.Now()
+	ok := f(msgCtx, msgs)
+	consumerProcessingDuration.WithLabelValues(durable).Observe(time.Since(started).Seconds())
+	if ok {
+		consumerMessagesTotal.WithLabelValues(durable, "ack").Add(float64(len(msgs)))
 		for _, msg := range msgs {
-			if err = msg.InProgress(nats.Context(ctx)); err != nil {
-				logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.InProgress: %w", err))
-				continue
+			if err := msg.AckSync(nats.Context(ctx)); err != nil {
+				logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.AckSync: %w", err))
 			}
 		}
-		if f(ctx, msgs) {
-			for _, msg := range msgs {
-				if err = msg.AckSync(nats.Context(ctx)); err != nil {
-					logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.AckSync: %w", err))
-				}
-			}
-		} else {
-			for _, msg := range msgs {
-				if err = msg.Nak(nats.Context(ctx)); err != nil {
-					logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.Nak: %w", err))
-				}
+	} else {
+		span.SetStatus(codes.Error, "messages were not processed")
+		consumerMessagesTotal.WithLabelValues(durable, "nak").Add(float64(len(msgs)))
+		for _, msg := range msgs {
+			if err := msg.Nak(nats.Context(ctx)); err != nil {
+				logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.Nak: %w", err))
 			}
 		}
 	}
+	return true
 }
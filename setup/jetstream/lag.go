@@ -0,0 +1,117 @@
+package jetstream
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// StreamLag is how far behind the consumers of a stream are.
+type StreamLag struct {
+	Stream string `json:"stream"`
+	// The sequence of the last message produced into the stream
+	LastSequence uint64 `json:"last_sequence"`
+	// How many messages are stored in the stream
+	Messages  uint64        `json:"messages"`
+	Consumers []ConsumerLag `json:"consumers"`
+}
+
+// ConsumerLag is how far behind a durable consumer is.
+type ConsumerLag struct {
+	Consumer string `json:"consumer"`
+	// The sequence of the last message delivered to the consumer
+	DeliveredSequence uint64 `json:"delivered_sequence"`
+	// The sequence up to which the consumer has acknowledged every message
+	AckFloorSequence uint64 `json:"ack_floor_sequence"`
+	// How many messages haven't been delivered to the consumer yet
+	Pending uint64 `json:"pending"`
+	// How many messages have been delivered but not acknowledged yet
+	AckPending int `json:"ack_pending"`
+	// How many messages are being redelivered
+	Redelivered int `json:"redelivered"`
+	// How many messages the consumer has yet to process, which is the
+	// pending and the unacknowledged messages together
+	Lag uint64 `json:"lag"`
+}
+
+// SyncStreamLag is how far behind the sync API is in syncing clients up to
+// what has been produced into one of its streams.
+type SyncStreamLag struct {
+	Stream string `json:"stream"`
+	// The position which clients are synced up to
+	Position int64 `json:"position"`
+	// The latest position produced into the stream
+	LatestPosition int64 `json:"latest_position"`
+	// How many positions clients have yet to be synced up to
+	Lag int64 `json:"lag"`
+}
+
+// Lag returns how far behind the durable consumers of each of our streams
+// are. Streams which have a consumer per room are reported as a single
+// consumer, with the total lag of the rooms and the sequences of the room
+// which is furthest behind.
+func Lag(cfg *config.JetStream, js nats.JetStreamContext) ([]StreamLag, error) {
+	res := make([]StreamLag, 0, len(streams))
+	for _, stream := range streams { // streams are defined in streams.go
+		name := cfg.Prefixed(stream.Name)
+		info, err := js.StreamInfo(name)
+		if err != nil {
+			return nil, fmt.Errorf("js.StreamInfo(%q): %w", name, err)
+		}
+		streamLag := StreamLag{
+			Stream:       stream.Name,
+			LastSequence: info.State.LastSeq,
+			Messages:     info.State.Msgs,
+			Consumers:    []ConsumerLag{},
+		}
+
+		perRoom := stream.Name == InputRoomEvent
+		var rooms *ConsumerLag
+		var furthestBehind uint64
+		for consumer := range js.Consumers(name) {
+			if consumer.Config.Durable == "" {
+				continue // Ignore ephemeral consumers
+			}
+			lag := consumerLag(consumer.Name, consumer)
+			if !perRoom {
+				streamLag.Consumers = append(streamLag.Consumers, lag)
+				continue
+			}
+			if rooms == nil {
+				rooms = &ConsumerLag{Consumer: roomConsumersLabel}
+			}
+			if lag.Lag >= furthestBehind {
+				rooms.DeliveredSequence = lag.DeliveredSequence
+				rooms.AckFloorSequence = lag.AckFloorSequence
+				furthestBehind = lag.Lag
+			}
+			rooms.Pending += lag.Pending
+			rooms.AckPending += lag.AckPending
+			rooms.Redelivered += lag.Redelivered
+			rooms.Lag += lag.Lag
+		}
+		if rooms != nil {
+			streamLag.Consumers = append(streamLag.Consumers, *rooms)
+		}
+		sort.Slice(streamLag.Consumers, func(i, j int) bool {
+			return streamLag.Consumers[i].Consumer < streamLag.Consumers[j].Consumer
+		})
+		res = append(res, streamLag)
+	}
+	return res, nil
+}
+
+func consumerLag(name string, info *nats.ConsumerInfo) ConsumerLag {
+	return ConsumerLag{
+		Consumer:          name,
+		DeliveredSequence: info.Delivered.Stream,
+		AckFloorSequence:  info.AckFloor.Stream,
+		Pending:           info.NumPending,
+		AckPending:        info.NumAckPending,
+		Redelivered:       info.NumRedelivered,
+		Lag:               info.NumPending + uint64(info.NumAckPending),
+	}
+}
@@ -0,0 +1,68 @@
+package jetstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+)
+
+func TestLag(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	defer func() {
+		processCtx.ShutdownDendrite()
+		processCtx.WaitForComponentsToFinish()
+	}()
+	global := &config.Global{}
+	global.JetStream = config.JetStream{Matrix: global, InMemory: true, NoLog: true, TopicPrefix: "LagTest"}
+	cfg := &global.JetStream
+	natsInstance := NATSInstance{}
+	js, _ := natsInstance.Prepare(processCtx, cfg)
+
+	stream := cfg.Prefixed(OutputReceiptEvent)
+	// The stream only keeps messages which a consumer is interested in, so
+	// the consumer has to exist before they are published.
+	sub, err := js.PullSubscribe(stream, cfg.Durable("LagTestConsumer"), nats.BindStream(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = js.Publish(stream, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, err := sub.Fetch(2, nats.MaxWait(time.Second*5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = msgs[0].AckSync(); err != nil {
+		t.Fatal(err)
+	}
+
+	lags, err := Lag(cfg, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lags) != len(streams) {
+		t.Fatalf("expected %d streams, got %d", len(streams), len(lags))
+	}
+	for _, s := range lags {
+		if s.Stream != OutputReceiptEvent {
+			continue
+		}
+		if s.LastSequence != 3 || len(s.Consumers) != 1 {
+			t.Fatalf("unexpected stream lag: %+v", s)
+		}
+		// One message has been processed, one is waiting to be acknowledged
+		// and one hasn't been delivered yet.
+		c := s.Consumers[0]
+		if c.AckFloorSequence != 1 || c.DeliveredSequence != 2 || c.Pending != 1 || c.AckPending != 1 || c.Lag != 2 {
+			t.Fatalf("unexpected consumer lag: %+v", c)
+		}
+		return
+	}
+	t.Fatalf("stream %q not reported", OutputReceiptEvent)
+}
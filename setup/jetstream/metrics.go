@@ -0,0 +1,174 @@
+package jetstream
+
+import (
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func init() {
+	prometheus.MustRegister(
+		consumerProcessingDuration, consumerMessagesTotal,
+		consumerRedeliveriesTotal, streamMetrics,
+	)
+}
+
+var consumerProcessingDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "jetstream",
+		Name:      "consumer_processing_duration_seconds",
+		Help:      "How long it takes a consumer to process a batch of messages",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	},
+	[]string{"consumer"},
+)
+
+var consumerMessagesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "jetstream",
+		Name:      "consumer_messages_total",
+		Help:      "Total number of messages processed by a consumer, by whether they were acked or nacked",
+	},
+	[]string{"consumer", "result"},
+)
+
+var consumerRedeliveriesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "jetstream",
+		Name:      "consumer_redeliveries_total",
+		Help:      "Total number of messages which were delivered to a consumer more than once",
+	},
+	[]string{"consumer"},
+)
+
+// streamMetrics reports the state of our streams and their consumers, as
+// JetStream sees it, at the time of each scrape.
+var streamMetrics = &streamCollector{
+	streamMessages: prometheus.NewDesc(
+		"dendrite_jetstream_stream_messages",
+		"Number of messages stored in the stream",
+		[]string{"stream"}, nil,
+	),
+	streamConsumers: prometheus.NewDesc(
+		"dendrite_jetstream_stream_consumers",
+		"Number of consumers on the stream",
+		[]string{"stream"}, nil,
+	),
+	consumerPending: prometheus.NewDesc(
+		"dendrite_jetstream_consumer_pending_messages",
+		"Number of messages in the stream which haven't yet been delivered to the consumer",
+		[]string{"stream", "consumer"}, nil,
+	),
+	consumerAckPending: prometheus.NewDesc(
+		"dendrite_jetstream_consumer_ack_pending_messages",
+		"Number of messages delivered to the consumer which are waiting to be acknowledged",
+		[]string{"stream", "consumer"}, nil,
+	),
+	consumerRedelivered: prometheus.NewDesc(
+		"dendrite_jetstream_consumer_redelivered_messages",
+		"Number of messages which are being redelivered to the consumer",
+		[]string{"stream", "consumer"}, nil,
+	),
+	consumerAckWait: prometheus.NewDesc(
+		"dendrite_jetstream_consumer_ack_wait_seconds",
+		"How long JetStream waits for the consumer to acknowledge a message before redelivering it",
+		[]string{"stream", "consumer"}, nil,
+	),
+}
+
+// roomConsumersLabel is used in place of the consumer name for streams
+// which have a durable consumer per room, so that the number of series
+// doesn't grow with the number of rooms.
+const roomConsumersLabel = "rooms"
+
+type streamCollector struct {
+	mu                  sync.RWMutex
+	js                  nats.JetStreamContext
+	cfg                 *config.JetStream
+	streamMessages      *prometheus.Desc
+	streamConsumers     *prometheus.Desc
+	consumerPending     *prometheus.Desc
+	consumerAckPending  *prometheus.Desc
+	consumerRedelivered *prometheus.Desc
+	consumerAckWait     *prometheus.Desc
+}
+
+// setJetStream sets the JetStream context to query when scraped. It is
+// called again when NATS reconnects.
+func (c *streamCollector) setJetStream(cfg *config.JetStream, js nats.JetStreamContext) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg, c.js = cfg, js
+}
+
+func (c *streamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.streamMessages
+	ch <- c.streamConsumers
+	ch <- c.consumerPending
+	ch <- c.consumerAckPending
+	ch <- c.consumerRedelivered
+	ch <- c.consumerAckWait
+}
+
+func (c *streamCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	cfg, js := c.cfg, c.js
+	c.mu.RUnlock()
+	if js == nil {
+		return
+	}
+	for _, stream := range streams { // streams are defined in streams.go
+		name := cfg.Prefixed(stream.Name)
+		info, err := js.StreamInfo(name)
+		if err != nil {
+			logrus.WithError(err).WithField("stream", name).Debug("Failed to get stream info for metrics")
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.streamMessages, prometheus.GaugeValue, float64(info.State.Msgs), stream.Name)
+		ch <- prometheus.MustNewConstMetric(c.streamConsumers, prometheus.GaugeValue, float64(info.State.Consumers), stream.Name)
+
+		perRoom := stream.Name == InputRoomEvent
+		var rooms nats.ConsumerInfo
+		for consumer := range js.Consumers(name) {
+			if consumer.Config.Durable == "" {
+				continue // Ignore ephemeral consumers
+			}
+			if perRoom {
+				rooms.NumPending += consumer.NumPending
+				rooms.NumAckPending += consumer.NumAckPending
+				rooms.NumRedelivered += consumer.NumRedelivered
+				rooms.Config.AckWait = consumer.Config.AckWait
+				continue
+			}
+			c.collectConsumer(ch, stream.Name, consumer.Name, consumer)
+		}
+		if perRoom {
+			c.collectConsumer(ch, stream.Name, roomConsumersLabel, &rooms)
+		}
+	}
+}
+
+func (c *streamCollector) collectConsumer(ch chan<- prometheus.Metric, stream, consumer string, info *nats.ConsumerInfo) {
+	ch <- prometheus.MustNewConstMetric(c.consumerPending, prometheus.GaugeValue, float64(info.NumPending), stream, consumer)
+	ch <- prometheus.MustNewConstMetric(c.consumerAckPending, prometheus.GaugeValue, float64(info.NumAckPending), stream, consumer)
+	ch <- prometheus.MustNewConstMetric(c.consumerRedelivered, prometheus.GaugeValue, float64(info.NumRedelivered), stream, consumer)
+	ch <- prometheus.MustNewConstMetric(c.consumerAckWait, prometheus.GaugeValue, info.Config.AckWait.Seconds(), stream, consumer)
+}
+
+// observeDeliveries counts any messages in the batch which have been
+// delivered to the consumer before.
+func observeDeliveries(consumer string, msgs []*nats.Msg) {
+	for _, msg := range msgs {
+		meta, err := msg.Metadata()
+		if err == nil && meta.NumDelivered > 1 {
+			consumerRedeliveriesTotal.WithLabelValues(consumer).Inc()
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package jetstream
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+)
+
+func prepareMetricsTest(t *testing.T, prefix string) (*config.JetStream, nats.JetStreamContext) {
+	t.Helper()
+	processCtx := process.NewProcessContext()
+	t.Cleanup(func() {
+		processCtx.ShutdownDendrite()
+		processCtx.WaitForComponentsToFinish()
+	})
+	global := &config.Global{}
+	global.JetStream = config.JetStream{Matrix: global, InMemory: true, NoLog: true, TopicPrefix: prefix}
+	cfg := &global.JetStream
+	natsInstance := NATSInstance{}
+	js, _ := natsInstance.Prepare(processCtx, cfg)
+	return cfg, js
+}
+
+// gatherMetrics collects the metrics into a map keyed by their name and
+// label values, i.e. "dendrite_jetstream_stream_messages{OutputReceiptEvent}".
+func gatherMetrics(t *testing.T, c prometheus.Collector) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make([]string, 0, len(metric.GetLabel()))
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, label.GetValue())
+			}
+			metrics[family.GetName()+"{"+strings.Join(labels, ",")+"}"] = metric.GetGauge().GetValue()
+		}
+	}
+	return metrics
+}
+
+func TestStreamMetrics(t *testing.T) {
+	cfg, js := prepareMetricsTest(t, "MetricsTest")
+	collector := &streamCollector{
+		streamMessages:      streamMetrics.streamMessages,
+		streamConsumers:     streamMetrics.streamConsumers,
+		consumerPending:     streamMetrics.consumerPending,
+		consumerAckPending:  streamMetrics.consumerAckPending,
+		consumerRedelivered: streamMetrics.consumerRedelivered,
+		consumerAckWait:     streamMetrics.consumerAckWait,
+	}
+
+	// Nothing is reported until there is a JetStream to ask.
+	if metrics := gatherMetrics(t, collector); len(metrics) != 0 {
+		t.Fatalf("expected no metrics, got %v", metrics)
+	}
+	collector.setJetStream(cfg, js)
+
+	// One message has been processed, which the stream no longer keeps, one
+	// is waiting to be acknowledged and one hasn't been delivered.
+	stream := cfg.Prefixed(OutputReceiptEvent)
+	sub, err := js.PullSubscribe(stream, cfg.Durable("MetricsTestConsumer"), nats.BindStream(stream), nats.AckWait(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = js.Publish(stream, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, err := sub.Fetch(2, nats.MaxWait(time.Second*5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = msgs[0].AckSync(); err != nil {
+		t.Fatal(err)
+	}
+	// Ephemeral consumers aren't reported.
+	if _, err = js.AddConsumer(stream, &nats.ConsumerConfig{AckPolicy: nats.AckExplicitPolicy}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The room input stream has a consumer per room, which are reported
+	// together.
+	inputStream := cfg.Prefixed(InputRoomEvent)
+	for _, roomID := range []string{"!a:test", "!b:test"} {
+		subject := cfg.Prefixed(InputRoomEventSubj(roomID))
+		if _, err = js.AddConsumer(inputStream, &nats.ConsumerConfig{
+			Durable:       cfg.Durable("Room" + Tokenise(roomID)),
+			FilterSubject: subject,
+			AckPolicy:     nats.AckExplicitPolicy,
+			AckWait:       time.Minute,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = js.Publish(subject, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	metrics := gatherMetrics(t, collector)
+	consumer := cfg.Durable("MetricsTestConsumer")
+	for key, want := range map[string]float64{
+		"dendrite_jetstream_stream_messages{OutputReceiptEvent}":                                2,
+		"dendrite_jetstream_stream_consumers{OutputReceiptEvent}":                               2,
+		"dendrite_jetstream_consumer_pending_messages{" + consumer + ",OutputReceiptEvent}":     1,
+		"dendrite_jetstream_consumer_ack_pending_messages{" + consumer + ",OutputReceiptEvent}": 1,
+		"dendrite_jetstream_consumer_ack_wait_seconds{" + consumer + ",OutputReceiptEvent}":     60,
+		"dendrite_jetstream_stream_messages{InputRoomEvent}":                                    2,
+		"dendrite_jetstream_stream_consumers{InputRoomEvent}":                                   2,
+		"dendrite_jetstream_consumer_pending_messages{rooms,InputRoomEvent}":                    2,
+		"dendrite_jetstream_consumer_ack_wait_seconds{rooms,InputRoomEvent}":                    60,
+	} {
+		got, ok := metrics[key]
+		if !ok {
+			t.Errorf("%s wasn't reported", key)
+		} else if got != want {
+			t.Errorf("got %s = %v, want %v", key, got, want)
+		}
+	}
+	for key := range metrics {
+		if strings.HasPrefix(key, "dendrite_jetstream_consumer_") && strings.HasSuffix(key, ",InputRoomEvent}") && !strings.Contains(key, "{rooms,") {
+			t.Errorf("per-room consumer reported on its own: %s", key)
+		}
+	}
+}
+
+func TestConsumerMetrics(t *testing.T) {
+	cfg, js := prepareMetricsTest(t, "ConsumerMetricsTest")
+	stream := cfg.Prefixed(OutputReceiptEvent)
+	durable := cfg.Durable("ConsumerMetricsTestConsumer")
+	sub, err := js.PullSubscribe(stream, durable, nats.BindStream(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = js.Publish(stream, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	fetch := func() []*nats.Msg {
+		t.Helper()
+		msgs, err := sub.Fetch(1, nats.MaxWait(time.Second*5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgs
+	}
+
+	// The counters are global, so only count what this test adds to them.
+	acked := testutil.ToFloat64(consumerMessagesTotal.WithLabelValues(durable, "ack"))
+	naked := testutil.ToFloat64(consumerMessagesTotal.WithLabelValues(durable, "nak"))
+	redelivered := testutil.ToFloat64(consumerRedeliveriesTotal.WithLabelValues(durable))
+
+	// The message is naked the first time, so it is delivered again, and
+	// acked the second time.
+	for _, ok := range []bool{false, true} {
+		consumeBatch(context.Background(), stream, durable, fetch(), func(ctx context.Context, msgs []*nats.Msg) bool {
+			return ok
+		})
+	}
+	if got := testutil.ToFloat64(consumerMessagesTotal.WithLabelValues(durable, "ack")) - acked; got != 1 {
+		t.Errorf("got %v acked messages, want 1", got)
+	}
+	if got := testutil.ToFloat64(consumerMessagesTotal.WithLabelValues(durable, "nak")) - naked; got != 1 {
+		t.Errorf("got %v naked messages, want 1", got)
+	}
+	if got := testutil.ToFloat64(consumerRedeliveriesTotal.WithLabelValues(durable)) - redelivered; got != 1 {
+		t.Errorf("got %v redeliveries, want 1", got)
+	}
+	if got := testutil.CollectAndCount(consumerProcessingDuration, "dendrite_jetstream_consumer_processing_duration_seconds"); got < 1 {
+		t.Errorf("expected the processing duration to be observed")
+	}
+}
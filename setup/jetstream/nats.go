@@ -1,6 +1,7 @@
 package jetstream
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"reflect"
@@ -72,7 +73,7 @@ func (s *NATSInstance) Prepare(process *process.ProcessContext, cfg *config.JetS
 			s.Start()
 		}()
 		go func() {
-			<-process.WaitForShutdown()
+			<-process.WaitForClose()
 			s.Shutdown()
 			s.WaitForShutdown()
 			process.ComponentFinished()
@@ -111,6 +112,7 @@ func setupNATS(process *process.ProcessContext, cfg *config.JetStream, nc *natsc
 					return
 				}
 				checkAndConfigureStreams(process, cfg, js)
+				streamMetrics.setJetStream(cfg, js)
 			}),
 		}
 		if cfg.DisableTLSValidation {
@@ -123,6 +125,12 @@ func setupNATS(process *process.ProcessContext, cfg *config.JetStream, nc *natsc
 			logrus.WithError(err).Panic("Unable to connect to NATS")
 			return nil, nil
 		}
+		process.ComponentStarted()
+		go func() {
+			<-process.WaitForClose()
+			nc.Close()
+			process.ComponentFinished()
+		}()
 	}
 
 	js, err := nc.JetStream(jsOpts...)
@@ -130,7 +138,14 @@ func setupNATS(process *process.ProcessContext, cfg *config.JetStream, nc *natsc
 		logrus.WithError(err).Panic("Unable to get JetStream context")
 		return nil, nil
 	}
+	process.AddReadinessCheck("nats", func(context.Context) error {
+		if !nc.IsConnected() {
+			return fmt.Errorf("NATS connection is %s", nc.Status())
+		}
+		return nil
+	})
 	checkAndConfigureStreams(process, cfg, js)
+	streamMetrics.setJetStream(cfg, js)
 	return js, nc
 }
 
@@ -29,6 +29,10 @@ var (
 	OutputStreamEvent       = "OutputStreamEvent"
 	OutputReadUpdate        = "OutputReadUpdate"
 	RequestPresence         = "GetPresence"
+	RequestAnnotation       = "GetAnnotation"
+	RequestUserEvents       = "GetUserEvents"
+	RequestUserMedia        = "GetUserMedia"
+	RequestSyncStreamLag    = "GetSyncStreamLag"
 	OutputPresenceEvent     = "OutputPresenceEvent"
 	InputFulltextReindex    = "InputFulltextReindex"
 )
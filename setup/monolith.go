@@ -15,6 +15,8 @@
 package setup
 
 import (
+	"fmt"
+
 	"github.com/neilalexander/harmony/clientapi"
 	"github.com/neilalexander/harmony/clientapi/api"
 	"github.com/neilalexander/harmony/federationapi"
@@ -51,7 +53,8 @@ type Monolith struct {
 	ExtUserDirectoryProvider userapi.QuerySearchProfilesAPI
 }
 
-// AddAllPublicRoutes attaches all public paths to the given router
+// AddAllPublicRoutes attaches all public paths to the given router. It returns
+// an error if any of the components can't be set up from the config.
 func (m *Monolith) AddAllPublicRoutes(
 	processCtx *process.ProcessContext,
 	cfg *config.Dendrite,
@@ -60,19 +63,30 @@ func (m *Monolith) AddAllPublicRoutes(
 	natsInstance *jetstream.NATSInstance,
 	caches *caching.Caches,
 	enableMetrics bool,
-) {
+) error {
+	var rateLimitStore httputil.RateLimitStore
+	if cfg.ClientAPI.RateLimiting.SharedStore {
+		store, err := httputil.NewPostgresRateLimitStore(processCtx.Context(), cm, &cfg.ClientAPI.RateLimiting.Database)
+		if err != nil {
+			return fmt.Errorf("failed to connect to rate limits db: %w", err)
+		}
+		rateLimitStore = store
+	}
 	userDirectoryProvider := m.ExtUserDirectoryProvider
 	if userDirectoryProvider == nil {
 		userDirectoryProvider = m.UserAPI
 	}
-	clientapi.AddPublicRoutes(
+	if err := clientapi.AddPublicRoutes(
 		processCtx, routers, cfg, natsInstance, m.FedClient, m.RoomserverAPI, transactions.New(),
 		m.FederationAPI, m.UserAPI, userDirectoryProvider,
-		m.ExtPublicRoomsProvider, enableMetrics,
-	)
+		m.ExtPublicRoomsProvider, rateLimitStore, enableMetrics,
+	); err != nil {
+		return err
+	}
 	federationapi.AddPublicRoutes(
-		processCtx, routers, cfg, natsInstance, m.UserAPI, m.FedClient, m.KeyRing, m.RoomserverAPI, m.FederationAPI, enableMetrics,
+		processCtx, routers, cfg, natsInstance, m.UserAPI, m.FedClient, m.KeyRing, m.RoomserverAPI, m.FederationAPI, caches, enableMetrics,
 	)
-	mediaapi.AddPublicRoutes(routers, cm, cfg, m.UserAPI, m.Client, m.FedClient, m.KeyRing)
-	syncapi.AddPublicRoutes(processCtx, routers, cfg, cm, natsInstance, m.UserAPI, m.RoomserverAPI, caches, enableMetrics)
+	mediaapi.AddPublicRoutes(processCtx, routers, cm, cfg, natsInstance, m.UserAPI, m.Client, m.FedClient, m.KeyRing, rateLimitStore)
+	syncapi.AddPublicRoutes(processCtx, routers, cfg, cm, natsInstance, m.UserAPI, m.RoomserverAPI, rateLimitStore, enableMetrics)
+	return nil
 }
@@ -0,0 +1,99 @@
+package setup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/sirupsen/logrus"
+)
+
+// componentTablePrefixes are the prefixes of the names of the tables which
+// belong to each component.
+var componentTablePrefixes = map[string][]string{
+	"roomserver":    {"roomserver_"},
+	"syncapi":       {"syncapi_"},
+	"userapi":       {"userapi_"},
+	"keyserver":     {"keyserver_"},
+	"federationapi": {"federationsender_", "keydb_"},
+	"mediaapi":      {"mediaapi_"},
+	"mscs":          {"msc2836_"},
+}
+
+// CheckSchemaOwnership makes sure that each component is using the database
+// which holds its tables. It returns an error if a component has been moved
+// to a new database but its tables haven't been copied over, as otherwise it
+// would start again from nothing while its data sits in the old database.
+// Each component claims ownership of its schema in the database it uses, so
+// this must be called before the components are started.
+func CheckSchemaOwnership(ctx context.Context, cm *sqlutil.Connections, cfg *config.Dendrite) error {
+	components := ComponentDatabases(cfg)
+	names := make([]string, 0, len(components))
+	for component := range components {
+		names = append(names, component)
+	}
+	sort.Strings(names)
+
+	// Several components can share a database, so look up the owners of
+	// each database only once.
+	dbs := map[config.DataSource]*sql.DB{}
+	owners := map[config.DataSource]map[string]struct{}{}
+	using := map[string]config.DataSource{}
+	for _, component := range names {
+		connectionString := components[component].ConnectionString
+		if connectionString == "" {
+			connectionString = cfg.Global.DatabaseOptions.ConnectionString
+		}
+		using[component] = connectionString
+		if _, ok := dbs[connectionString]; ok {
+			continue
+		}
+		db, _, err := cm.Connection(components[component])
+		if err != nil {
+			return fmt.Errorf("%s: %w", component, err)
+		}
+		if owners[connectionString], err = sqlutil.SchemaOwners(ctx, db); err != nil {
+			return fmt.Errorf("%s: unable to get schema owners: %w", component, err)
+		}
+		dbs[connectionString] = db
+	}
+
+	for _, component := range names {
+		current := using[component]
+		if _, ok := owners[current][component]; ok {
+			continue
+		}
+		db := dbs[current]
+		previous, moved := config.DataSource(""), false
+		for connectionString, owned := range owners {
+			if _, ok := owned[component]; ok && connectionString != current {
+				previous, moved = connectionString, true
+				break
+			}
+		}
+		if moved {
+			hasTables, err := sqlutil.HasTablesWithPrefix(ctx, db, componentTablePrefixes[component])
+			if err != nil {
+				return fmt.Errorf("%s: %w", component, err)
+			}
+			if !hasTables {
+				return fmt.Errorf(
+					"%s has been configured to use a different database to before, but its tables haven't been copied there. "+
+						"Copy them over from the old database, or remove the %q row from the db_schema_owners table in the old database to start again with no data",
+					component, component,
+				)
+			}
+			if err = sqlutil.ReleaseSchema(ctx, dbs[previous], component); err != nil {
+				return fmt.Errorf("%s: unable to release schema in the old database: %w", component, err)
+			}
+			logrus.Infof("The %s tables have been moved to a new database", component)
+		}
+		if err := sqlutil.ClaimSchema(ctx, db, component); err != nil {
+			return fmt.Errorf("%s: unable to claim schema: %w", component, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package setup
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSchemaOwnership(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, close := test.PrepareDBConnectionString(t, dbType)
+		defer close()
+		var cfg config.Dendrite
+		cfg.Defaults(config.DefaultOpts{SingleDatabase: true})
+		cfg.Global.ServerName = "test"
+		cfg.Global.DatabaseOptions.ConnectionString = config.DataSource(connStr)
+		cfg.Global.PrivateKeyPath = config.Path(filepath.Join(t.TempDir(), "matrix_key.pem"))
+		cm := sqlutil.NewConnectionManager(nil, cfg.Global.DatabaseOptions)
+		db, _, err := cm.Connection(&cfg.Global.DatabaseOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every component claims the database they all share.
+		assert.NoError(t, CheckSchemaOwnership(ctx, cm, &cfg))
+		owners, err := sqlutil.SchemaOwners(ctx, db)
+		assert.NoError(t, err)
+		assert.Len(t, owners, len(componentTablePrefixes))
+
+		// Another schema stands in for a second database.
+		_, err = db.ExecContext(ctx, "CREATE SCHEMA moved")
+		assert.NoError(t, err)
+		defer db.ExecContext(ctx, "DROP SCHEMA moved CASCADE") // nolint: errcheck
+		cfg.SyncAPI.Database.ConnectionString = config.DataSource(connStr + " search_path=moved")
+		movedDB, _, err := cm.Connection(&cfg.SyncAPI.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The sync API can't be moved without its tables.
+		err = CheckSchemaOwnership(ctx, cm, &cfg)
+		if err == nil || !strings.Contains(err.Error(), "syncapi") {
+			t.Fatalf("expected moving the sync API without its tables to fail, got %v", err)
+		}
+
+		// Once they have been copied over, the new database takes over.
+		_, err = movedDB.ExecContext(ctx, "CREATE TABLE syncapi_stream_checkpoints (stream_name TEXT)")
+		assert.NoError(t, err)
+		assert.NoError(t, CheckSchemaOwnership(ctx, cm, &cfg))
+		owners, err = sqlutil.SchemaOwners(ctx, db)
+		assert.NoError(t, err)
+		assert.NotContains(t, owners, "syncapi")
+		assert.Contains(t, owners, "roomserver")
+		owners, err = sqlutil.SchemaOwners(ctx, movedDB)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]struct{}{"syncapi": {}}, owners)
+
+		// Checking again changes nothing.
+		assert.NoError(t, CheckSchemaOwnership(ctx, cm, &cfg))
+	})
+}
@@ -3,29 +3,66 @@ package process
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Shutdown happens in stages, so that work which is in progress can finish
+// before the things it depends on go away:
+//
+//  1. Draining: listeners stop accepting new requests, long-polls return
+//     and the requests which are in progress are left to complete.
+//  2. Stopping: the process context is cancelled, so that consumers stop
+//     taking new messages. Work which has already started is left to
+//     finish, i.e. messages which are being processed are acked or nacked.
+//  3. Closing: resources such as databases and NATS are closed.
+//
+// A graceful shutdown waits for each stage to finish, up to a drain timeout
+// for the whole thing, before starting the next.
 type ProcessContext struct {
-	mu       sync.RWMutex
-	wg       sync.WaitGroup      // used to wait for components to shutdown
-	ctx      context.Context     // cancelled when Stop is called
-	shutdown context.CancelFunc  // shut down Dendrite
-	degraded map[string]struct{} // reasons why the process is degraded
+	mu        sync.RWMutex
+	wg        sync.WaitGroup      // used to wait for components to shutdown
+	ctx       context.Context     // cancelled when Stop is called
+	shutdown  context.CancelFunc  // shut down Dendrite
+	degraded  map[string]struct{} // reasons why the process is degraded
+	draining  chan struct{}       // closed when listeners should drain
+	closing   chan struct{}       // closed when resources should be closed
+	drainOnce sync.Once
+	closeOnce sync.Once
+	listeners stageGroup // listeners which are serving requests
+	work      stageGroup // work in progress which must finish before closing
+	checks    map[string]ReadinessCheck
 }
 
+// ReadinessCheck returns an error if a dependency isn't ready for requests.
+type ReadinessCheck func(ctx context.Context) error
+
+type contextKey struct{}
+
 func NewProcessContext() *ProcessContext {
 	ctx, shutdown := context.WithCancel(context.Background())
 	return &ProcessContext{
 		ctx:      ctx,
 		shutdown: shutdown,
 		wg:       sync.WaitGroup{},
+		degraded: map[string]struct{}{},
+		draining: make(chan struct{}),
+		closing:  make(chan struct{}),
+		checks:   map[string]ReadinessCheck{},
 	}
 }
 
+// FromContext returns the process context which the context was derived
+// from, or nil if it wasn't.
+func FromContext(ctx context.Context) *ProcessContext {
+	b, _ := ctx.Value(contextKey{}).(*ProcessContext)
+	return b
+}
+
 func (b *ProcessContext) Context() context.Context {
-	return context.WithValue(b.ctx, "scope", "process") // nolint:staticcheck
+	ctx := context.WithValue(b.ctx, contextKey{}, b)
+	return context.WithValue(ctx, "scope", "process") // nolint:staticcheck
 }
 
 func (b *ProcessContext) ComponentStarted() {
@@ -36,14 +73,69 @@ func (b *ProcessContext) ComponentFinished() {
 	b.wg.Done()
 }
 
+// ListenerStarted registers a listener, which the drain stage will wait for.
+// It returns false if the process is already draining.
+func (b *ProcessContext) ListenerStarted() bool {
+	return b.listeners.add()
+}
+
+func (b *ProcessContext) ListenerFinished() {
+	b.listeners.done()
+}
+
+// WorkStarted registers work which must finish before resources are closed.
+// It returns false if the process is already closing, in which case the work
+// shouldn't be started.
+func (b *ProcessContext) WorkStarted() bool {
+	return b.work.add()
+}
+
+func (b *ProcessContext) WorkFinished() {
+	b.work.done()
+}
+
+// ShutdownDendrite shuts down immediately, without waiting for anything which
+// is in progress.
 func (b *ProcessContext) ShutdownDendrite() {
+	b.drainOnce.Do(func() { close(b.draining) })
 	b.shutdown()
+	b.closeOnce.Do(func() { close(b.closing) })
+}
+
+// GracefulShutdown goes through each stage of shutting down in turn, giving
+// up on waiting once the timeout has passed.
+func (b *ProcessContext) GracefulShutdown(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	logrus.Info("Draining requests")
+	b.drainOnce.Do(func() { close(b.draining) })
+	if !b.listeners.wait(deadline) {
+		logrus.Warn("Timed out waiting for requests to drain")
+	}
+
+	logrus.Info("Waiting for work in progress to finish")
+	b.shutdown()
+	if !b.work.wait(deadline) {
+		logrus.Warn("Timed out waiting for work in progress to finish")
+	}
+
+	b.closeOnce.Do(func() { close(b.closing) })
+}
+
+// WaitForDrain is closed when listeners should stop accepting requests.
+func (b *ProcessContext) WaitForDrain() <-chan struct{} {
+	return b.draining
 }
 
 func (b *ProcessContext) WaitForShutdown() <-chan struct{} {
 	return b.ctx.Done()
 }
 
+// WaitForClose is closed when resources should be closed.
+func (b *ProcessContext) WaitForClose() <-chan struct{} {
+	return b.closing
+}
+
 func (b *ProcessContext) WaitForComponentsToFinish() {
 	b.wg.Wait()
 }
@@ -69,3 +161,64 @@ func (b *ProcessContext) IsDegraded() (bool, []string) {
 	}
 	return true, reasons
 }
+
+// AddReadinessCheck registers a check for a dependency, replacing any other
+// check with the same name.
+func (b *ProcessContext) AddReadinessCheck(name string, check ReadinessCheck) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checks[name] = check
+}
+
+// ReadinessChecks returns all of the registered readiness checks.
+func (b *ProcessContext) ReadinessChecks() map[string]ReadinessCheck {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	checks := make(map[string]ReadinessCheck, len(b.checks))
+	for name, check := range b.checks {
+		checks[name] = check
+	}
+	return checks
+}
+
+// stageGroup is a WaitGroup which stops taking new members once it has been
+// waited on, so that members can be added while a wait might be happening.
+type stageGroup struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func (g *stageGroup) add() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.wg.Add(1)
+	return true
+}
+
+func (g *stageGroup) done() {
+	g.wg.Done()
+}
+
+// wait returns false if the members didn't all finish before the deadline.
+func (g *stageGroup) wait(deadline time.Time) bool {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(finished)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-finished:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
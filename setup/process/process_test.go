@@ -0,0 +1,62 @@
+package process
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	p := NewProcessContext()
+	if FromContext(p.Context()) != p {
+		t.Fatal("expected the process context to be found from its context")
+	}
+
+	var events []string
+	p.ListenerStarted()
+	go func() {
+		<-p.WaitForDrain()
+		events = append(events, "drained")
+		p.ListenerFinished()
+	}()
+	p.WorkStarted()
+	go func() {
+		<-p.WaitForShutdown()
+		events = append(events, "stopped")
+		p.WorkFinished()
+	}()
+	p.ComponentStarted()
+	go func() {
+		<-p.WaitForClose()
+		events = append(events, "closed")
+		p.ComponentFinished()
+	}()
+
+	p.GracefulShutdown(time.Second)
+	p.WaitForComponentsToFinish()
+	if len(events) != 3 || events[0] != "drained" || events[1] != "stopped" || events[2] != "closed" {
+		t.Fatalf("unexpected shutdown order %v", events)
+	}
+	if p.WorkStarted() {
+		t.Fatal("expected no new work to be started once closing")
+	}
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	p := NewProcessContext()
+	p.WorkStarted() // never finishes
+
+	started := time.Now()
+	p.GracefulShutdown(time.Millisecond * 50)
+	if took := time.Since(started); took > time.Second {
+		t.Fatalf("shutdown took %s, expected it to time out", took)
+	}
+	select {
+	case <-p.WaitForClose():
+	default:
+		t.Fatal("expected the process to be closing")
+	}
+	if p.Context().Err() != context.Canceled {
+		t.Fatal("expected the process context to be cancelled")
+	}
+}
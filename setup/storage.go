@@ -0,0 +1,60 @@
+package setup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	federationapiStorage "github.com/neilalexander/harmony/federationapi/storage"
+	"github.com/neilalexander/harmony/internal/caching"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	mediaapiStorage "github.com/neilalexander/harmony/mediaapi/storage"
+	roomserverStorage "github.com/neilalexander/harmony/roomserver/storage"
+	"github.com/neilalexander/harmony/setup/config"
+	syncapiStorage "github.com/neilalexander/harmony/syncapi/storage"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+	userapiStorage "github.com/neilalexander/harmony/userapi/storage"
+)
+
+// OpenStorage opens the storage for each component without starting it,
+// which creates any missing tables and runs any pending migrations. It is
+// used by the tools which work on the databases directly.
+func OpenStorage(ctx context.Context, cm *sqlutil.Connections, cfg *config.Dendrite) error {
+	caches := caching.NewRistrettoCache(8*1024*1024, time.Minute*5, caching.DisableMetrics)
+	if _, err := roomserverStorage.Open(ctx, cm, &cfg.RoomServer.Database, caches); err != nil {
+		return fmt.Errorf("roomserver: %w", err)
+	}
+	if _, err := syncapiStorage.NewSyncServerDatasource(ctx, cm, &cfg.SyncAPI.Database); err != nil {
+		return fmt.Errorf("syncapi: %w", err)
+	}
+	if _, err := userapiStorage.NewUserDatabase(
+		ctx, cm, &cfg.UserAPI.AccountDatabase, cfg.Global.ServerName, cfg.UserAPI.BCryptCost,
+		userapi.DefaultLoginTokenLifetime, cfg.UserAPI.Matrix.ServerNotices.LocalPart,
+	); err != nil {
+		return fmt.Errorf("userapi: %w", err)
+	}
+	if _, err := userapiStorage.NewKeyDatabase(cm, &cfg.KeyServer.Database); err != nil {
+		return fmt.Errorf("keyserver: %w", err)
+	}
+	if _, err := federationapiStorage.NewDatabase(ctx, cm, &cfg.FederationAPI.Database, caches, cfg.Global.IsLocalServerName); err != nil {
+		return fmt.Errorf("federationapi: %w", err)
+	}
+	if _, err := mediaapiStorage.NewMediaAPIDatasource(cm, &cfg.MediaAPI.Database); err != nil {
+		return fmt.Errorf("mediaapi: %w", err)
+	}
+	return nil
+}
+
+// ComponentDatabases returns the database options for each component which
+// has a database, keyed by component name.
+func ComponentDatabases(cfg *config.Dendrite) map[string]*config.DatabaseOptions {
+	return map[string]*config.DatabaseOptions{
+		"roomserver":    &cfg.RoomServer.Database,
+		"syncapi":       &cfg.SyncAPI.Database,
+		"userapi":       &cfg.UserAPI.AccountDatabase,
+		"keyserver":     &cfg.KeyServer.Database,
+		"federationapi": &cfg.FederationAPI.Database,
+		"mediaapi":      &cfg.MediaAPI.Database,
+		"mscs":          &cfg.MSCs.Database,
+	}
+}
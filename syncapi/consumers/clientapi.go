@@ -17,6 +17,9 @@ package consumers
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,23 +37,26 @@ import (
 	"github.com/neilalexander/harmony/syncapi/notifier"
 	"github.com/neilalexander/harmony/syncapi/storage"
 	"github.com/neilalexander/harmony/syncapi/streams"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
 	"github.com/neilalexander/harmony/syncapi/types"
 )
 
 // OutputClientDataConsumer consumes events that originated in the client API server.
 type OutputClientDataConsumer struct {
-	ctx          context.Context
-	jetstream    nats.JetStreamContext
-	nats         *nats.Conn
-	durable      string
-	topic        string
-	topicReIndex string
-	db           storage.Database
-	stream       streams.StreamProvider
-	notifier     *notifier.Notifier
-	serverName   spec.ServerName
-	fts          fulltext.Indexer
-	cfg          *config.SyncAPI
+	ctx             context.Context
+	jetstream       nats.JetStreamContext
+	nats            *nats.Conn
+	durable         string
+	topic           string
+	topicReIndex    string
+	topicAnnotation string
+	topicUserEvents string
+	db              storage.Database
+	stream          streams.StreamProvider
+	notifier        *notifier.Notifier
+	serverName      spec.ServerName
+	fts             fulltext.Indexer
+	cfg             *config.SyncAPI
 }
 
 // NewOutputClientDataConsumer creates a new OutputClientData consumer. Call Start() to begin consuming from room servers.
@@ -65,29 +71,42 @@ func NewOutputClientDataConsumer(
 	fts *fulltext.Search,
 ) *OutputClientDataConsumer {
 	return &OutputClientDataConsumer{
-		ctx:          process.Context(),
-		jetstream:    js,
-		topic:        cfg.Matrix.JetStream.Prefixed(jetstream.OutputClientData),
-		topicReIndex: cfg.Matrix.JetStream.Prefixed(jetstream.InputFulltextReindex),
-		durable:      cfg.Matrix.JetStream.Durable("SyncAPIAccountDataConsumer"),
-		nats:         nats,
-		db:           store,
-		notifier:     notifier,
-		stream:       stream,
-		serverName:   cfg.Matrix.ServerName,
-		fts:          fts,
-		cfg:          cfg,
+		ctx:             process.Context(),
+		jetstream:       js,
+		topic:           cfg.Matrix.JetStream.Prefixed(jetstream.OutputClientData),
+		topicReIndex:    cfg.Matrix.JetStream.Prefixed(jetstream.InputFulltextReindex),
+		topicAnnotation: cfg.Matrix.JetStream.Prefixed(jetstream.RequestAnnotation),
+		topicUserEvents: cfg.Matrix.JetStream.Prefixed(jetstream.RequestUserEvents),
+		durable:         cfg.Matrix.JetStream.Durable("SyncAPIAccountDataConsumer"),
+		nats:            nats,
+		db:              store,
+		notifier:        notifier,
+		stream:          stream,
+		serverName:      cfg.Matrix.ServerName,
+		fts:             fts,
+		cfg:             cfg,
 	}
 }
 
 // Start consuming from room servers
 func (s *OutputClientDataConsumer) Start() error {
+	// The reindex is requested by an admin task, which waits for the
+	// reply to find out when the reindex has finished.
 	_, err := s.nats.Subscribe(s.topicReIndex, func(msg *nats.Msg) {
-		if err := msg.Ack(); err != nil {
-			return
+		respond := func(err error) {
+			m := &nats.Msg{
+				Header: nats.Header{},
+			}
+			if err != nil {
+				m.Header.Set("error", err.Error())
+			}
+			if err = msg.RespondMsg(m); err != nil {
+				logrus.WithError(err).Error("Unable to respond to messages")
+			}
 		}
 		if !s.cfg.Fulltext.Enabled {
 			logrus.Warn("Fulltext indexing is disabled")
+			respond(errors.New("fulltext indexing is disabled"))
 			return
 		}
 		ctx := context.Background()
@@ -100,6 +119,7 @@ func (s *OutputClientDataConsumer) Start() error {
 			evs, err := s.db.ReIndex(ctx, 1000, id)
 			if err != nil {
 				logrus.WithError(err).Errorf("unable to get events to index")
+				respond(err)
 				return
 			}
 			if len(evs) == 0 {
@@ -141,6 +161,46 @@ func (s *OutputClientDataConsumer) Start() error {
 			count += len(elements)
 		}
 		logrus.Infof("Indexed %d events in %v", count, time.Since(start))
+		respond(nil)
+	})
+	if err != nil {
+		return err
+	}
+	// The client API asks whether a user has already reacted to an event
+	// with the same key before sending a new annotation.
+	_, err = s.nats.Subscribe(s.topicAnnotation, func(msg *nats.Msg) {
+		m := &nats.Msg{
+			Header: nats.Header{},
+		}
+		exists, err := s.db.AnnotationExists(
+			context.Background(),
+			msg.Header.Get(jetstream.RoomID), msg.Header.Get(jetstream.EventID),
+			msg.Header.Get("type"), msg.Header.Get(jetstream.UserID), msg.Header.Get("key"),
+		)
+		if err != nil {
+			m.Header.Set("error", err.Error())
+		} else {
+			m.Header.Set("duplicate", strconv.FormatBool(exists))
+		}
+		if err = msg.RespondMsg(m); err != nil {
+			logrus.WithError(err).Error("Unable to respond to messages")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// The client API pages through the events sent by a user when
+	// exporting their data.
+	_, err = s.nats.Subscribe(s.topicUserEvents, func(msg *nats.Msg) {
+		m := &nats.Msg{
+			Header: nats.Header{},
+		}
+		if err := s.respondUserEvents(msg, m); err != nil {
+			m.Header.Set("error", err.Error())
+		}
+		if err := msg.RespondMsg(m); err != nil {
+			logrus.WithError(err).Error("Unable to respond to messages")
+		}
 	})
 	if err != nil {
 		return err
@@ -151,6 +211,33 @@ func (s *OutputClientDataConsumer) Start() error {
 	)
 }
 
+// respondUserEvents fills the response with a page of the events sent by the
+// user, and the position to request the next page from.
+func (s *OutputClientDataConsumer) respondUserEvents(msg, res *nats.Msg) error {
+	from, err := strconv.ParseInt(msg.Header.Get("from"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid from: %w", err)
+	}
+	limit, err := strconv.Atoi(msg.Header.Get("limit"))
+	if err != nil || limit < 1 {
+		return fmt.Errorf("invalid limit %q", msg.Header.Get("limit"))
+	}
+	evs, err := s.db.EventsBySender(s.ctx, msg.Header.Get(jetstream.UserID), types.StreamPosition(from), limit)
+	if err != nil {
+		return err
+	}
+	chunk := make([]*synctypes.ClientEvent, 0, len(evs))
+	for _, ev := range evs {
+		chunk = append(chunk, synctypes.ToClientEvent(ev.HeaderedEvent, synctypes.FormatAll))
+		from = int64(ev.StreamPosition)
+	}
+	if len(evs) == limit {
+		res.Header.Set("next", strconv.FormatInt(from, 10))
+	}
+	res.Data, err = json.Marshal(chunk)
+	return err
+}
+
 // onMessage is called when the sync server receives a new event from the client API server output log.
 // It is not safe for this function to be called from multiple goroutines, or else the
 // sync stream position may race and be incorrectly calculated.
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 
 	"github.com/nats-io/nats.go"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/setup/jetstream"
@@ -41,6 +42,8 @@ type OutputKeyChangeEventConsumer struct {
 	notifier  *notifier.Notifier
 	stream    streams.StreamProvider
 	rsAPI     roomserverAPI.SyncRoomserverAPI
+	userAPI   api.SyncUserAPI
+	cfg       *config.SyncAPI
 }
 
 // NewOutputKeyChangeEventConsumer creates a new OutputKeyChangeEventConsumer.
@@ -51,6 +54,7 @@ func NewOutputKeyChangeEventConsumer(
 	topic string,
 	js nats.JetStreamContext,
 	rsAPI roomserverAPI.SyncRoomserverAPI,
+	userAPI api.SyncUserAPI,
 	store storage.Database,
 	notifier *notifier.Notifier,
 	stream streams.StreamProvider,
@@ -62,6 +66,8 @@ func NewOutputKeyChangeEventConsumer(
 		topic:     topic,
 		db:        store,
 		rsAPI:     rsAPI,
+		userAPI:   userAPI,
+		cfg:       cfg,
 		notifier:  notifier,
 		stream:    stream,
 	}
@@ -104,6 +110,11 @@ func (s *OutputKeyChangeEventConsumer) onDeviceKeyMessage(m api.DeviceMessage, d
 		return true
 	}
 	output := m.DeviceKeys
+	// a device without keys may have been deleted, in which case the
+	// memberships lazy-loaded to it are no longer needed
+	if len(output.KeyJSON) == 0 {
+		s.forgetDeletedDevice(output.UserID, output.DeviceID)
+	}
 	// work out who we need to notify about the new key
 	var queryRes roomserverAPI.QuerySharedUsersResponse
 	err := s.rsAPI.QuerySharedUsers(s.ctx, &roomserverAPI.QuerySharedUsersRequest{
@@ -126,6 +137,29 @@ func (s *OutputKeyChangeEventConsumer) onDeviceKeyMessage(m api.DeviceMessage, d
 	return true
 }
 
+// forgetDeletedDevice removes the lazy-loaded members of the device if it no
+// longer exists. Key updates without keys are also sent when a device without
+// keys is renamed, so the device list is checked first.
+func (s *OutputKeyChangeEventConsumer) forgetDeletedDevice(userID, deviceID string) {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || !s.cfg.Matrix.IsLocalServerName(domain) {
+		return
+	}
+	var res api.QueryDevicesResponse
+	if err = s.userAPI.QueryDevices(s.ctx, &api.QueryDevicesRequest{UserID: userID}, &res); err != nil {
+		logrus.WithError(err).Error("syncapi: failed to QueryDevices for key change event from key server")
+		return
+	}
+	for _, device := range res.Devices {
+		if device.ID == deviceID {
+			return
+		}
+	}
+	if err = s.db.ResetLazyLoadedMembers(s.ctx, userID, deviceID); err != nil {
+		logrus.WithError(err).Error("syncapi: failed to forget lazy-loaded members of deleted device")
+	}
+}
+
 func (s *OutputKeyChangeEventConsumer) onCrossSigningMessage(m api.DeviceMessage, deviceChangeID int64) bool {
 	output := m.CrossSigningKeyUpdate
 	// work out who we need to notify about the new key
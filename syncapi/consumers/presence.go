@@ -19,6 +19,7 @@ import (
 	"strconv"
 
 	"github.com/nats-io/nats.go"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/setup/jetstream"
@@ -31,7 +32,20 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// OutputTypingEventConsumer consumes events that originated in the EDU server.
+// presenceBatchSize is how many presence updates are consumed at once. Busy
+// servers can send many updates for the same users in quick succession, and
+// only the latest of them matters, so only that one is applied from each
+// batch. This saves waking up every syncing client for each update.
+const presenceBatchSize = 100
+
+// pendingPresence is the latest presence update in a batch for a remote user.
+type pendingPresence struct {
+	presence  types.Presence
+	statusMsg *string
+	ts        spec.Timestamp
+}
+
+// PresenceConsumer consumes presence updates from the client API and federation.
 type PresenceConsumer struct {
 	ctx           context.Context
 	jetstream     nats.JetStreamContext
@@ -131,46 +145,79 @@ func (s *PresenceConsumer) Start() error {
 		return nil
 	}
 	return jetstream.JetStreamConsumer(
-		s.ctx, s.jetstream, s.presenceTopic, s.durable, 1, s.onMessage,
+		s.ctx, s.jetstream, s.presenceTopic, s.durable, presenceBatchSize, s.onMessage,
 		nats.DeliverAll(), nats.ManualAck(), nats.HeadersOnly(),
 	)
 }
 
+// onMessage applies a batch of presence updates before they are acked. Only
+// the latest update for each remote user in the batch is applied.
 func (s *PresenceConsumer) onMessage(ctx context.Context, msgs []*nats.Msg) bool {
-	msg := msgs[0] // Guaranteed to exist if onMessage is called
-	userID := msg.Header.Get(jetstream.UserID)
-	presence := msg.Header.Get("presence")
-	timestamp := msg.Header.Get("last_active_ts")
-	fromSync, _ := strconv.ParseBool(msg.Header.Get("from_sync"))
-	logrus.Tracef("syncAPI received presence event: %+v", msg.Header)
-
-	if fromSync { // do not process local presence changes; we already did this synchronously.
-		return true
-	}
+	remote := map[string]pendingPresence{}
+	for _, msg := range msgs {
+		userID := msg.Header.Get(jetstream.UserID)
+		presence := msg.Header.Get("presence")
+		timestamp := msg.Header.Get("last_active_ts")
+		fromSync, _ := strconv.ParseBool(msg.Header.Get("from_sync"))
+		logrus.Tracef("syncAPI received presence event: %+v", msg.Header)
 
-	ts, err := strconv.ParseUint(timestamp, 10, 64)
-	if err != nil {
-		return true
-	}
+		if fromSync { // do not process local presence changes; we already did this synchronously.
+			continue
+		}
 
-	var statusMsg *string = nil
-	if data, ok := msg.Header["status_msg"]; ok && len(data) > 0 {
-		newMsg := msg.Header.Get("status_msg")
-		statusMsg = &newMsg
-	}
-	// already checked, so no need to check error
-	p, _ := types.PresenceFromString(presence)
+		ts, err := strconv.ParseUint(timestamp, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		var statusMsg *string = nil
+		if data, ok := msg.Header["status_msg"]; ok && len(data) > 0 {
+			newMsg := msg.Header.Get("status_msg")
+			statusMsg = &newMsg
+		}
+		// already checked, so no need to check error
+		p, _ := types.PresenceFromString(presence)
+
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && !s.cfg.Matrix.IsLocalServerName(domain) {
+			coalescePresence(remote, userID, pendingPresence{presence: p, statusMsg: statusMsg, ts: spec.Timestamp(ts)})
+			continue
+		}
 
-	s.EmitPresence(ctx, userID, p, statusMsg, spec.Timestamp(ts), fromSync)
+		if err = s.applyPresence(ctx, userID, p, statusMsg, spec.Timestamp(ts), fromSync); err != nil {
+			logrus.WithError(err).WithField("user_id", userID).WithField("presence", presence).Warn("failed to updated presence for user")
+			return false
+		}
+	}
+	for userID, p := range remote {
+		if err := s.applyPresence(ctx, userID, p.presence, p.statusMsg, p.ts, false); err != nil {
+			logrus.WithError(err).WithField("user_id", userID).WithField("presence", p.presence).Warn("failed to updated presence for user")
+			return false
+		}
+	}
 	return true
 }
 
+// coalescePresence keeps the update for a remote user unless there is a
+// newer one for them already.
+func coalescePresence(pending map[string]pendingPresence, userID string, update pendingPresence) {
+	if existing, ok := pending[userID]; ok && existing.ts > update.ts {
+		return
+	}
+	pending[userID] = update
+}
+
 func (s *PresenceConsumer) EmitPresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, ts spec.Timestamp, fromSync bool) {
+	if err := s.applyPresence(ctx, userID, presence, statusMsg, ts, fromSync); err != nil {
+		logrus.WithError(err).WithField("user_id", userID).WithField("presence", presence).Warn("failed to updated presence for user")
+	}
+}
+
+func (s *PresenceConsumer) applyPresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, ts spec.Timestamp, fromSync bool) error {
 	pos, err := s.db.UpdatePresence(ctx, userID, presence, statusMsg, ts, fromSync)
 	if err != nil {
-		logrus.WithError(err).WithField("user", userID).WithField("presence", presence).Warn("failed to updated presence for user")
-		return
+		return err
 	}
 	s.stream.Advance(pos)
-	s.notifier.OnNewPresence(types.StreamingToken{PresencePosition: pos}, userID)
+	s.notifier.OnNewPresence(ctx, types.StreamingToken{PresencePosition: pos}, userID)
+	return nil
 }
@@ -0,0 +1,114 @@
+package consumers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/neilalexander/harmony/syncapi/notifier"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/streams"
+	"github.com/neilalexander/harmony/syncapi/types"
+)
+
+func TestCoalescePresenceKeepsLatest(t *testing.T) {
+	pending := map[string]pendingPresence{}
+	coalescePresence(pending, "@alice:remote", pendingPresence{presence: types.PresenceOnline, ts: 2000})
+	coalescePresence(pending, "@alice:remote", pendingPresence{presence: types.PresenceOffline, ts: 1000})
+	coalescePresence(pending, "@bob:remote", pendingPresence{presence: types.PresenceOnline, ts: 1000})
+	coalescePresence(pending, "@bob:remote", pendingPresence{presence: types.PresenceUnavailable, ts: 3000})
+
+	if len(pending) != 2 {
+		t.Fatalf("expected 2 pending updates, got %d", len(pending))
+	}
+	if got := pending["@alice:remote"].presence; got != types.PresenceOnline {
+		t.Errorf("expected an older update to be ignored, got %s", got)
+	}
+	if got := pending["@bob:remote"].presence; got != types.PresenceUnavailable {
+		t.Errorf("expected a newer update to replace the pending one, got %s", got)
+	}
+}
+
+type presenceDB struct {
+	storage.Database
+	err     error
+	updates []string
+}
+
+func (d *presenceDB) UpdatePresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, lastActiveTS spec.Timestamp, fromSync bool) (types.StreamPosition, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	d.updates = append(d.updates, userID+" "+presence.String())
+	return types.StreamPosition(len(d.updates)), nil
+}
+
+type presenceStream struct {
+	streams.StreamProvider
+	latest types.StreamPosition
+}
+
+func (s *presenceStream) Advance(latest types.StreamPosition) {
+	s.latest = latest
+}
+
+func presenceMsg(userID, presence, ts string) *nats.Msg {
+	msg := nats.NewMsg("presence")
+	msg.Header.Set(jetstream.UserID, userID)
+	msg.Header.Set("presence", presence)
+	msg.Header.Set("last_active_ts", ts)
+	return msg
+}
+
+func TestPresenceConsumerOnMessage(t *testing.T) {
+	cfg := &config.SyncAPI{Matrix: &config.Global{}}
+	cfg.Matrix.ServerName = "local"
+	db := &presenceDB{}
+	stream := &presenceStream{}
+	s := &PresenceConsumer{
+		db:       db,
+		stream:   stream,
+		notifier: notifier.NewNotifier(nil),
+		cfg:      cfg,
+	}
+
+	// Every local update is applied, but only the latest for each remote user.
+	fromSync := presenceMsg("@carol:local", "online", "1000")
+	fromSync.Header.Set("from_sync", "true")
+	msgs := []*nats.Msg{
+		presenceMsg("@alice:remote", "online", "2000"),
+		presenceMsg("@bob:local", "online", "1000"),
+		presenceMsg("@alice:remote", "offline", "3000"),
+		presenceMsg("@bob:local", "unavailable", "2000"),
+		presenceMsg("@alice:remote", "unavailable", "1000"),
+		fromSync,
+		presenceMsg("@dave:remote", "online", "not a timestamp"),
+	}
+	if !s.onMessage(context.Background(), msgs) {
+		t.Fatal("expected the presence updates to be acked")
+	}
+	want := []string{"@bob:local online", "@bob:local unavailable", "@alice:remote offline"}
+	if len(db.updates) != len(want) {
+		t.Fatalf("got updates %v, want %v", db.updates, want)
+	}
+	for i := range want {
+		if db.updates[i] != want[i] {
+			t.Fatalf("got updates %v, want %v", db.updates, want)
+		}
+	}
+	if stream.latest != 3 {
+		t.Fatalf("got stream position %d, want 3", stream.latest)
+	}
+
+	// If the updates can't be applied then they aren't acked, so that they
+	// are delivered again.
+	db.err = errors.New("database is down")
+	if s.onMessage(context.Background(), msgs[:1]) {
+		t.Fatal("expected the presence update not to be acked")
+	}
+}
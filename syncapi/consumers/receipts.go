@@ -102,7 +102,7 @@ func (s *OutputReceiptEventConsumer) onMessage(ctx context.Context, msgs []*nats
 	}
 
 	s.stream.Advance(streamPos)
-	s.notifier.OnNewReceipt(output.RoomID, types.StreamingToken{ReceiptPosition: streamPos})
+	s.notifier.OnNewReceipt(ctx, output.RoomID, types.StreamingToken{ReceiptPosition: streamPos})
 
 	return true
 }
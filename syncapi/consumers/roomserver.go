@@ -257,7 +257,7 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		}
 	}
 
-	if msg.RewritesState {
+	if msg.RewritesState && !msg.RepairsState {
 		if err = s.db.PurgeRoomState(ctx, ev.RoomID().String()); err != nil {
 			return fmt.Errorf("s.db.PurgeRoom: %w", err)
 		}
@@ -270,7 +270,12 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 
 	ev.UserID = *userID
 
-	pduPos, err := s.db.WriteEvent(ctx, ev, addsStateEvents, msg.AddsStateEventIDs, msg.RemovesStateEventIDs, msg.TransactionID, false, msg.HistoryVisibility)
+	var pduPos types.StreamPosition
+	if msg.RepairsState {
+		pduPos, err = s.db.RepairRoomState(ctx, ev, addsStateEvents, msg.AddsStateEventIDs, msg.RemovesStateEventIDs, msg.HistoryVisibility)
+	} else {
+		pduPos, err = s.db.WriteEvent(ctx, ev, addsStateEvents, msg.AddsStateEventIDs, msg.RemovesStateEventIDs, msg.TransactionID, false, msg.HistoryVisibility)
+	}
 	if err != nil {
 		// panic rather than continue with an inconsistent database
 		log.WithFields(log.Fields{
@@ -282,6 +287,11 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		}).Panicf("roomserver output log: write new event failure")
 		return nil
 	}
+	if err = s.invalidateLazyLoadedMembers(ctx, ev, addsStateEvents); err != nil {
+		log.WithFields(log.Fields{
+			"event_id": ev.EventID(),
+		}).WithError(err).Warn("Failed to invalidate lazy-loaded members")
+	}
 	if err = s.writeFTS(ev, pduPos); err != nil {
 		log.WithFields(log.Fields{
 			"event_id": ev.EventID(),
@@ -298,7 +308,7 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 	}
 
 	s.pduStream.Advance(pduPos)
-	s.notifier.OnNewEvent(ev, ev.RoomID().String(), nil, types.StreamingToken{PDUPosition: pduPos})
+	s.notifier.OnNewEvent(ctx, ev, ev.RoomID().String(), nil, types.StreamingToken{PDUPosition: pduPos})
 
 	return nil
 }
@@ -349,7 +359,7 @@ func (s *OutputRoomEventConsumer) onOldRoomEvent(
 	}
 
 	s.pduStream.Advance(pduPos)
-	s.notifier.OnNewEvent(ev, ev.RoomID().String(), nil, types.StreamingToken{PDUPosition: pduPos})
+	s.notifier.OnNewEvent(ctx, ev, ev.RoomID().String(), nil, types.StreamingToken{PDUPosition: pduPos})
 
 	return nil
 }
@@ -446,6 +456,21 @@ func (s *OutputRoomEventConsumer) onPurgeRoom(
 	}
 }
 
+// invalidateLazyLoadedMembers forgets which devices have been sent the memberships that
+// have changed, so that clients which lazy-load members are sent the new ones.
+func (s *OutputRoomEventConsumer) invalidateLazyLoadedMembers(
+	ctx context.Context, ev *rstypes.HeaderedEvent, addsStateEvents []*rstypes.HeaderedEvent,
+) error {
+	var targetUserIDs []string
+	for _, event := range append([]*rstypes.HeaderedEvent{ev}, addsStateEvents...) {
+		if event.Type() != spec.MRoomMember || event.StateKeyResolved == nil {
+			continue
+		}
+		targetUserIDs = append(targetUserIDs, *event.StateKeyResolved)
+	}
+	return s.db.InvalidateLazyLoadedMembers(ctx, ev.RoomID().String(), targetUserIDs)
+}
+
 func (s *OutputRoomEventConsumer) updateStateEvent(event *rstypes.HeaderedEvent) (*rstypes.HeaderedEvent, error) {
 	event.StateKeyResolved = event.StateKey()
 	if event.StateKey() == nil {
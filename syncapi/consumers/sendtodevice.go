@@ -17,11 +17,13 @@ package consumers
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
 
@@ -46,8 +48,28 @@ type OutputSendToDeviceEventConsumer struct {
 	isLocalServerName func(spec.ServerName) bool
 	stream            streams.StreamProvider
 	notifier          *notifier.Notifier
+	maxPerDevice      int
+	maxAge            time.Duration
 }
 
+func init() {
+	prometheus.MustRegister(sendToDeviceMessagesDropped)
+}
+
+var sendToDeviceMessagesDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "send_to_device_messages_dropped",
+		Help:      "The number of undelivered send-to-device messages dropped, by reason",
+	},
+	[]string{"reason"},
+)
+
+// sendToDeviceExpiryInterval is how often expired send-to-device messages
+// are removed from the database.
+const sendToDeviceExpiryInterval = time.Hour
+
 // NewOutputSendToDeviceEventConsumer creates a new OutputSendToDeviceEventConsumer.
 // Call Start() to begin consuming from the EDU server.
 func NewOutputSendToDeviceEventConsumer(
@@ -69,11 +91,14 @@ func NewOutputSendToDeviceEventConsumer(
 		isLocalServerName: cfg.Matrix.IsLocalServerName,
 		notifier:          notifier,
 		stream:            stream,
+		maxPerDevice:      cfg.SendToDevice.MaxMessagesPerDevice,
+		maxAge:            cfg.SendToDevice.MaxAge,
 	}
 }
 
 // Start consuming send-to-device events.
 func (s *OutputSendToDeviceEventConsumer) Start() error {
+	go s.expireMessages()
 	return jetstream.JetStreamConsumer(
 		s.ctx, s.jetstream, s.topic, s.durable, 1,
 		s.onMessage, nats.DeliverAll(), nats.ManualAck(),
@@ -131,6 +156,14 @@ func (s *OutputSendToDeviceEventConsumer) onMessage(ctx context.Context, msgs []
 		return false
 	}
 
+	evicted, err := s.db.EvictSendToDeviceMessages(s.ctx, output.UserID, output.DeviceID, s.maxPerDevice)
+	if err != nil {
+		logger.WithError(err).Errorf("send-to-device: failed to evict old messages")
+	} else if evicted > 0 {
+		logger.Warnf("send-to-device: device has too many undelivered messages, dropped %d oldest", evicted)
+		sendToDeviceMessagesDropped.WithLabelValues("limit").Add(float64(evicted))
+	}
+
 	s.stream.Advance(streamPos)
 	s.notifier.OnNewSendToDevice(
 		output.UserID,
@@ -140,3 +173,26 @@ func (s *OutputSendToDeviceEventConsumer) onMessage(ctx context.Context, msgs []
 
 	return true
 }
+
+// expireMessages periodically drops send-to-device messages which have not
+// been delivered within the configured maximum age, e.g. for devices that
+// have been abandoned without being deleted.
+func (s *OutputSendToDeviceEventConsumer) expireMessages() {
+	ticker := time.NewTicker(sendToDeviceExpiryInterval)
+	defer ticker.Stop()
+	for {
+		before := spec.AsTimestamp(time.Now().Add(-s.maxAge))
+		expired, err := s.db.ExpireSendToDeviceMessages(s.ctx, before)
+		if err != nil {
+			log.WithError(err).Errorf("send-to-device: failed to expire old messages")
+		} else if expired > 0 {
+			log.Infof("send-to-device: expired %d undelivered messages", expired)
+			sendToDeviceMessagesDropped.WithLabelValues("expired").Add(float64(expired))
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
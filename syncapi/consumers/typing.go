@@ -105,7 +105,7 @@ func (s *OutputTypingEventConsumer) onMessage(ctx context.Context, msgs []*nats.
 	}
 
 	s.stream.Advance(typingPos)
-	s.notifier.OnNewTyping(roomID, types.StreamingToken{TypingPosition: typingPos})
+	s.notifier.OnNewTyping(ctx, roomID, types.StreamingToken{TypingPosition: typingPos})
 
 	return true
 }
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/api"
+	rstypes "github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/tidwall/sjson"
+)
+
+// maxBundledAnnotations limits how many different keys are bundled with
+// each event, so that events with lots of different reactions don't make
+// every response which includes them very large.
+const maxBundledAnnotations = 50
+
+// bundledThread is the bundled m.thread aggregation of a thread root.
+type bundledThread struct {
+	LatestEvent             *synctypes.ClientEvent `json:"latest_event"`
+	Count                   int                    `json:"count"`
+	CurrentUserParticipated bool                   `json:"current_user_participated"`
+}
+
+// RoomEvents are events in a room which are being sent to a client. The
+// events don't need their room IDs set, as they aren't in /sync responses.
+type RoomEvents struct {
+	RoomID string
+	Events []synctypes.ClientEvent
+}
+
+// BundleAggregations adds the aggregations of the given events to their
+// unsigned m.relations, all of which come from the relations table: the
+// number of m.annotation annotations for each key, the latest reply and
+// number of replies of m.thread threads, and the latest m.replace edit by
+// the sender of the event. The user is the one the events are being sent to,
+// and the latest replies and edits are only bundled if the history
+// visibility of the room lets them see them.
+// The events of all of the rooms are looked up together, so that a /sync
+// response makes the same number of queries however many rooms it has.
+func BundleAggregations(
+	ctx context.Context, snapshot storage.DatabaseTransaction, rsAPI api.SyncRoomserverAPI,
+	userID string, rooms ...RoomEvents,
+) error {
+	var events []*synctypes.ClientEvent
+	var roomIDs, eventIDs, senders []string
+	for _, room := range rooms {
+		for i := range room.Events {
+			events = append(events, &room.Events[i])
+			roomIDs = append(roomIDs, room.RoomID)
+			eventIDs = append(eventIDs, room.Events[i].EventID)
+			senders = append(senders, room.Events[i].Sender)
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	aggregations, err := snapshot.Aggregations(ctx, roomIDs, eventIDs, senders, userID, maxBundledAnnotations)
+	if err != nil {
+		return err
+	}
+
+	// The latest thread replies and edits are bundled in full, so fetch
+	// them all at once.
+	relatedIDs := make([]string, 0, len(aggregations.Threads)+len(aggregations.Edits))
+	for _, thread := range aggregations.Threads {
+		relatedIDs = append(relatedIDs, thread.LatestEventID)
+	}
+	for _, editID := range aggregations.Edits {
+		relatedIDs = append(relatedIDs, editID)
+	}
+	related, err := visibleEvents(ctx, snapshot, rsAPI, userID, relatedIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		unsigned := []byte(event.Unsigned)
+		if len(unsigned) == 0 {
+			unsigned = []byte("{}")
+		}
+		bundled := false
+		if chunk, ok := aggregations.Annotations[event.EventID]; ok {
+			if unsigned, err = sjson.SetBytes(unsigned, `m\.relations.m\.annotation.chunk`, chunk); err != nil {
+				return err
+			}
+			bundled = true
+		}
+		if thread, ok := aggregations.Threads[event.EventID]; ok && related[thread.LatestEventID] != nil {
+			if unsigned, err = sjson.SetBytes(unsigned, `m\.relations.m\.thread`, bundledThread{
+				LatestEvent:             related[thread.LatestEventID],
+				Count:                   thread.Count,
+				CurrentUserParticipated: thread.Participated || event.Sender == userID,
+			}); err != nil {
+				return err
+			}
+			bundled = true
+		}
+		if editID, ok := aggregations.Edits[event.EventID]; ok && related[editID] != nil {
+			if unsigned, err = sjson.SetBytes(unsigned, `m\.relations.m\.replace`, related[editID]); err != nil {
+				return err
+			}
+			bundled = true
+		}
+		if bundled {
+			event.Unsigned = unsigned
+		}
+	}
+	return nil
+}
+
+// visibleEvents fetches the given events, keyed by their event IDs, leaving
+// out those which the history visibility of their rooms hides from the user.
+func visibleEvents(
+	ctx context.Context, snapshot storage.DatabaseTransaction, rsAPI api.SyncRoomserverAPI,
+	userID string, eventIDs []string,
+) (map[string]*synctypes.ClientEvent, error) {
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	user, err := spec.NewUserID(userID, true)
+	if err != nil {
+		return nil, err
+	}
+	events, err := snapshot.Events(ctx, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	// The history visibility is worked out a room at a time.
+	byRoom := map[string][]*rstypes.HeaderedEvent{}
+	for _, event := range events {
+		roomID := event.RoomID().String()
+		byRoom[roomID] = append(byRoom[roomID], event)
+	}
+	visible := make(map[string]*synctypes.ClientEvent, len(events))
+	for _, roomEvents := range byRoom {
+		filtered, err := ApplyHistoryVisibilityFilter(ctx, snapshot, rsAPI, roomEvents, nil, *user, "aggregations")
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range filtered {
+			visible[event.EventID()] = synctypes.ToClientEvent(event, synctypes.FormatAll)
+		}
+	}
+	return visible, nil
+}
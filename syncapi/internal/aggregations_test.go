@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	rsapi "github.com/neilalexander/harmony/roomserver/api"
+	rstypes "github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/syncapi/types"
+	"github.com/neilalexander/harmony/test"
+	"github.com/tidwall/gjson"
+)
+
+type aggregationsDB struct {
+	storage.DatabaseTransaction
+	aggregations *types.Aggregations
+	events       map[string]*rstypes.HeaderedEvent
+	queried      [][]string
+}
+
+func (d *aggregationsDB) Aggregations(ctx context.Context, roomIDs, eventIDs, senders []string, userID string, annotationLimit int) (*types.Aggregations, error) {
+	d.queried = append(d.queried, eventIDs)
+	return d.aggregations, nil
+}
+
+func (d *aggregationsDB) Events(ctx context.Context, eventIDs []string) ([]*rstypes.HeaderedEvent, error) {
+	events := make([]*rstypes.HeaderedEvent, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		if event, ok := d.events[eventID]; ok {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (d *aggregationsDB) SelectMembershipForUser(ctx context.Context, roomID, userID string, pos int64) (string, int64, error) {
+	return spec.Join, math.MaxInt64, nil
+}
+
+// aggregationsRoomserverAPI hides the given events from every user.
+type aggregationsRoomserverAPI struct {
+	rsapi.SyncRoomserverAPI
+	hidden map[string]bool
+}
+
+func (a *aggregationsRoomserverAPI) QueryEventsVisibleToUser(ctx context.Context, req *rsapi.QueryEventsVisibleToUserRequest, res *rsapi.QueryEventsVisibleToUserResponse) error {
+	for _, event := range req.Events {
+		if !a.hidden[event.EventID()] {
+			res.Events = append(res.Events, event)
+		}
+	}
+	return nil
+}
+
+func TestBundleAggregations(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+	otherRoom := test.NewRoom(t, bob)
+	root := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "root"})
+	reply := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "reply"})
+	edited := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "edited"})
+	edit := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "edit"})
+	secret := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "secret"})
+	secretReply := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "secret reply"})
+	reacted := otherRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "reacted"})
+	plain := otherRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "plain"})
+
+	snapshot := &aggregationsDB{
+		aggregations: &types.Aggregations{
+			Annotations: map[string][]types.AnnotationCount{
+				reacted.EventID(): {{Type: "m.reaction", Key: "👍", Count: 2}},
+			},
+			Threads: map[string]types.ThreadSummary{
+				root.EventID():   {Count: 3, LatestEventID: reply.EventID()},
+				secret.EventID(): {Count: 1, LatestEventID: secretReply.EventID()},
+			},
+			Edits: map[string]string{
+				edited.EventID(): edit.EventID(),
+				secret.EventID(): secretReply.EventID(),
+			},
+		},
+		events: map[string]*rstypes.HeaderedEvent{
+			reply.EventID():       reply,
+			edit.EventID():        edit,
+			secretReply.EventID(): secretReply,
+		},
+	}
+	rsAPI := &aggregationsRoomserverAPI{hidden: map[string]bool{secretReply.EventID(): true}}
+
+	toClientEvents := func(events ...*rstypes.HeaderedEvent) []synctypes.ClientEvent {
+		clientEvents := make([]synctypes.ClientEvent, 0, len(events))
+		for _, event := range events {
+			clientEvents = append(clientEvents, *synctypes.ToClientEvent(event, synctypes.FormatAll))
+		}
+		return clientEvents
+	}
+	roomEvents := toClientEvents(root, edited, secret)
+	otherRoomEvents := toClientEvents(reacted, plain)
+	if err := BundleAggregations(context.Background(), snapshot, rsAPI, alice.ID,
+		RoomEvents{RoomID: room.ID, Events: roomEvents},
+		RoomEvents{RoomID: otherRoom.ID, Events: otherRoomEvents},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The events of both rooms are looked up at once.
+	if len(snapshot.queried) != 1 || len(snapshot.queried[0]) != 5 {
+		t.Fatalf("expected the aggregations of all 5 events to be looked up at once, got %v", snapshot.queried)
+	}
+
+	// Alice sent the thread root, so she has participated in the thread.
+	thread := gjson.GetBytes(roomEvents[0].Unsigned, `m\.relations.m\.thread`)
+	if thread.Get("count").Int() != 3 || !thread.Get("current_user_participated").Bool() || thread.Get("latest_event.event_id").Str != reply.EventID() {
+		t.Errorf("unexpected thread aggregation %s", thread.Raw)
+	}
+	if bundled := gjson.GetBytes(roomEvents[1].Unsigned, `m\.relations.m\.replace.event_id`); bundled.Str != edit.EventID() {
+		t.Errorf("expected the edit to be bundled, got %s", roomEvents[1].Unsigned)
+	}
+	// The latest reply and edit of the secret event can't be seen by Alice,
+	// so they aren't bundled.
+	if roomEvents[2].Unsigned != nil {
+		t.Errorf("expected nothing to be bundled with an event whose relations are hidden, got %s", roomEvents[2].Unsigned)
+	}
+	annotations := gjson.GetBytes(otherRoomEvents[0].Unsigned, `m\.relations.m\.annotation.chunk`)
+	if annotations.Raw != `[{"type":"m.reaction","key":"👍","count":2}]` {
+		t.Errorf("unexpected annotation aggregation %s", annotations.Raw)
+	}
+	if otherRoomEvents[1].Unsigned != nil {
+		t.Errorf("expected nothing to be bundled with an event without relations, got %s", otherRoomEvents[1].Unsigned)
+	}
+}
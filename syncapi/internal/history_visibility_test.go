@@ -9,6 +9,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	rsapi "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/auth"
 	"github.com/neilalexander/harmony/roomserver/types"
 	"github.com/neilalexander/harmony/syncapi/storage"
 	"gotest.tools/v3/assert"
@@ -38,6 +39,10 @@ func (s *mockHisVisRoomserverAPI) QueryMembershipAtEvent(ctx context.Context, ro
 	}
 }
 
+func (s *mockHisVisRoomserverAPI) QueryEventsVisibleToUser(ctx context.Context, req *rsapi.QueryEventsVisibleToUserRequest, res *rsapi.QueryEventsVisibleToUserResponse) error {
+	return auth.FilterEventsVisibleToUser(ctx, s, req, res)
+}
+
 func (s *mockHisVisRoomserverAPI) QuerySenderIDForUser(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.SenderID, error) {
 	senderID := spec.SenderIDFromUserID(userID)
 	return &senderID, nil
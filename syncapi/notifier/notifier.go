@@ -39,30 +39,37 @@ import (
 type Notifier struct {
 	lock  *sync.RWMutex
 	rsAPI api.SyncRoomserverAPI
+	// The database which rooms and users are loaded from when they're first
+	// needed. If nil, only the memberships the notifier is told about are known.
+	db storage.Database
 	// A map of RoomID => Set<UserID> : Must only be accessed by the OnNewEvent goroutine
 	roomIDToJoinedUsers map[string]*userIDSet
+	// A map of UserID => Set<RoomID> for the users whose rooms have been loaded
+	userIDToJoinedRooms map[string]map[string]struct{}
+	// Incremented whenever a membership changes, so that memberships which
+	// were loaded from the database at the same time can be thrown away.
+	membershipVersion uint64
 	// The latest sync position
 	currPos types.StreamingToken
 	// A map of user_id => device_id => UserStream which can be used to wake a given user's /sync request.
 	userDeviceStreams map[string]map[string]*UserDeviceStream
 	// The last time we cleaned out stale entries from the userStreams map
 	lastCleanUpTime time.Time
-	// This map is reused to prevent allocations and GC pressure in SharedUsers.
-	_sharedUserMap map[string]struct{}
+	// This map is reused to prevent allocations and GC pressure in _wakeupUsers.
 	_wakeupUserMap map[string]struct{}
 }
 
 // NewNotifier creates a new notifier set to the given sync position.
-// In order for this to be of any use, the Notifier needs to be told all rooms and
+// In order for this to be of any use, the Notifier needs to be able to load rooms and
 // the joined users within each of them by calling Notifier.Load(*storage.SyncServerDatabase).
 func NewNotifier(rsAPI api.SyncRoomserverAPI) *Notifier {
 	return &Notifier{
 		rsAPI:               rsAPI,
 		roomIDToJoinedUsers: make(map[string]*userIDSet),
+		userIDToJoinedRooms: make(map[string]map[string]struct{}),
 		userDeviceStreams:   make(map[string]map[string]*UserDeviceStream),
 		lock:                &sync.RWMutex{},
 		lastCleanUpTime:     time.Now(),
-		_sharedUserMap:      map[string]struct{}{},
 		_wakeupUserMap:      map[string]struct{}{},
 	}
 }
@@ -87,9 +94,16 @@ func (n *Notifier) SetCurrentPosition(currPos types.StreamingToken) {
 // Typically a consumer supplies a posUpdate with the latest sync position for the
 // event type it handles, leaving other fields as 0.
 func (n *Notifier) OnNewEvent(
+	ctx context.Context,
 	ev *rstypes.HeaderedEvent, roomID string, userIDs []string,
 	posUpdate types.StreamingToken,
 ) {
+	if ev != nil {
+		n.load(ctx, nil, nil, []string{ev.RoomID().String()})
+	} else if roomID != "" {
+		n.load(ctx, nil, nil, []string{roomID})
+	}
+
 	// update the current position then notify relevant /sync streams.
 	// This needs to be done PRIOR to waking up users as they will read this value.
 	n.lock.Lock()
@@ -102,7 +116,7 @@ func (n *Notifier) OnNewEvent(
 		usersToNotify := n._joinedUsers(ev.RoomID().String())
 		// If this is an invite, also add in the invitee to this list.
 		if ev.Type() == "m.room.member" && ev.StateKey() != nil {
-			targetUserID, err := n.rsAPI.QueryUserIDForSender(context.Background(), ev.RoomID(), spec.SenderID(*ev.StateKey()))
+			targetUserID, err := n.rsAPI.QueryUserIDForSender(ctx, ev.RoomID(), spec.SenderID(*ev.StateKey()))
 			if err != nil || targetUserID == nil {
 				log.WithError(err).WithField("event_id", ev.EventID()).Errorf(
 					"Notifier.OnNewEvent: Failed to find the userID for this event",
@@ -167,9 +181,11 @@ func (n *Notifier) OnNewSendToDevice(
 
 // OnNewReceipt updates the current position
 func (n *Notifier) OnNewTyping(
-	roomID string,
+	ctx context.Context, roomID string,
 	posUpdate types.StreamingToken,
 ) {
+	n.load(ctx, nil, nil, []string{roomID})
+
 	n.lock.Lock()
 	defer n.lock.Unlock()
 
@@ -179,9 +195,11 @@ func (n *Notifier) OnNewTyping(
 
 // OnNewReceipt updates the current position
 func (n *Notifier) OnNewReceipt(
-	roomID string,
+	ctx context.Context, roomID string,
 	posUpdate types.StreamingToken,
 ) {
+	n.load(ctx, nil, nil, []string{roomID})
+
 	n.lock.Lock()
 	defer n.lock.Unlock()
 
@@ -221,8 +239,10 @@ func (n *Notifier) OnNewNotificationData(
 }
 
 func (n *Notifier) OnNewPresence(
-	posUpdate types.StreamingToken, userID string,
+	ctx context.Context, posUpdate types.StreamingToken, userID string,
 ) {
+	n.load(ctx, nil, []string{userID}, nil)
+
 	n.lock.Lock()
 	defer n.lock.Unlock()
 
@@ -233,41 +253,35 @@ func (n *Notifier) OnNewPresence(
 	n._wakeupUsers(sharedUsers, n.currPos)
 }
 
-func (n *Notifier) SharedUsers(userID string) []string {
+func (n *Notifier) SharedUsers(ctx context.Context, userID string) []string {
+	n.load(ctx, nil, []string{userID}, nil)
+
 	n.lock.RLock()
 	defer n.lock.RUnlock()
 	return n._sharedUsers(userID)
 }
 
 func (n *Notifier) _sharedUsers(userID string) []string {
-	n._sharedUserMap[userID] = struct{}{}
-	for roomID, users := range n.roomIDToJoinedUsers {
-		if ok := users.isIn(userID); !ok {
-			continue
-		}
+	sharedUserMap := map[string]struct{}{userID: {}}
+	for roomID := range n._joinedRooms(userID) {
 		for _, userID := range n._joinedUsers(roomID) {
-			n._sharedUserMap[userID] = struct{}{}
+			sharedUserMap[userID] = struct{}{}
 		}
 	}
-	sharedUsers := make([]string, 0, len(n._sharedUserMap)+1)
-	for userID := range n._sharedUserMap {
+	sharedUsers := make([]string, 0, len(sharedUserMap)+1)
+	for userID := range sharedUserMap {
 		sharedUsers = append(sharedUsers, userID)
-		delete(n._sharedUserMap, userID)
 	}
 	return sharedUsers
 }
 
-func (n *Notifier) IsSharedUser(userA, userB string) bool {
+func (n *Notifier) IsSharedUser(ctx context.Context, userA, userB string) bool {
+	n.load(ctx, nil, []string{userA}, nil)
+
 	n.lock.RLock()
 	defer n.lock.RUnlock()
-	var okA, okB bool
-	for _, users := range n.roomIDToJoinedUsers {
-		okA = users.isIn(userA)
-		if !okA {
-			continue
-		}
-		okB = users.isIn(userB)
-		if okA && okB {
+	for roomID := range n._joinedRooms(userA) {
+		if users, ok := n.roomIDToJoinedUsers[roomID]; ok && users.isIn(userB) {
 			return true
 		}
 	}
@@ -291,48 +305,122 @@ func (n *Notifier) GetListener(req types.SyncRequest) UserDeviceStreamListener {
 	return n._fetchUserDeviceStream(req.Device.UserID, req.Device.ID, true).GetListener(req.Context)
 }
 
-// Load the membership states required to notify users correctly.
+// Load sets the database which the membership states required to notify users
+// correctly are loaded from. Each room and user is loaded the first time that
+// it is needed rather than all of them up front, so that starting up doesn't
+// take a long time when there are many rooms.
 func (n *Notifier) Load(ctx context.Context, db storage.Database) error {
 	n.lock.Lock()
 	defer n.lock.Unlock()
 
-	snapshot, err := db.NewDatabaseSnapshot(ctx)
-	if err != nil {
-		return err
-	}
-	var succeeded bool
-	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
-
-	roomToUsers, err := snapshot.AllJoinedUsersInRooms(ctx)
-	if err != nil {
-		return err
-	}
-	n.setUsersJoinedToRooms(roomToUsers)
-
-	succeeded = true
+	n.db = db
 	return nil
 }
 
 // LoadRooms loads the membership states required to notify users correctly.
 func (n *Notifier) LoadRooms(ctx context.Context, db storage.Database, roomIDs []string) error {
-	n.lock.Lock()
-	defer n.lock.Unlock()
+	return n.load(ctx, db, nil, roomIDs)
+}
+
+// load loads the rooms which the users are joined to, and the users joined to
+// those rooms and to the given rooms, for any which haven't been loaded yet.
+// The database is queried without holding the lock so that other syncs aren't
+// held up. If a membership changes in the meantime then what was loaded may
+// already be out of date, so it is thrown away and loaded again.
+func (n *Notifier) load(ctx context.Context, db storage.Database, userIDs, roomIDs []string) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		n.lock.RLock()
+		if db == nil {
+			db = n.db
+		}
+		version := n.membershipVersion
+		var missingUsers, missingRooms []string
+		for _, userID := range userIDs {
+			if _, ok := n.userIDToJoinedRooms[userID]; !ok {
+				missingUsers = append(missingUsers, userID)
+			}
+		}
+		for _, roomID := range roomIDs {
+			if _, ok := n.roomIDToJoinedUsers[roomID]; !ok {
+				missingRooms = append(missingRooms, roomID)
+			}
+		}
+		n.lock.RUnlock()
+		if db == nil || (len(missingUsers) == 0 && len(missingRooms) == 0) {
+			return nil
+		}
+
+		userToRooms, roomToUsers, err := loadMemberships(ctx, db, missingUsers, missingRooms)
+		if err != nil {
+			log.WithError(err).Error("Notifier: Failed to load memberships")
+			return err
+		}
 
+		n.lock.Lock()
+		if n.membershipVersion == version {
+			n._setMemberships(userToRooms, roomToUsers)
+			n.lock.Unlock()
+			return nil
+		}
+		n.lock.Unlock()
+	}
+	return nil
+}
+
+// loadMemberships loads the rooms which the users are joined to, and the users
+// joined to those rooms and the given rooms.
+func loadMemberships(
+	ctx context.Context, db storage.Database, userIDs, roomIDs []string,
+) (userToRooms, roomToUsers map[string][]string, err error) {
 	snapshot, err := db.NewDatabaseSnapshot(ctx)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	var succeeded bool
 	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
 
-	roomToUsers, err := snapshot.AllJoinedUsersInRoom(ctx, roomIDs)
+	userToRooms = make(map[string][]string, len(userIDs))
+	for _, userID := range userIDs {
+		userToRooms[userID], err = snapshot.RoomIDsWithMembership(ctx, userID, spec.Join, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		roomIDs = append(roomIDs, userToRooms[userID]...)
+	}
+	roomToUsers, err = snapshot.AllJoinedUsersInRoom(ctx, roomIDs)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	// Rooms which nobody is joined to are missing from the results, but they
+	// are loaded too.
+	for _, roomID := range roomIDs {
+		if _, ok := roomToUsers[roomID]; !ok {
+			roomToUsers[roomID] = nil
+		}
 	}
-	n.setUsersJoinedToRooms(roomToUsers)
-
 	succeeded = true
-	return nil
+	return userToRooms, roomToUsers, nil
+}
+
+// _setMemberships stores the memberships which were loaded from the database,
+// apart from those which have been loaded since.
+func (n *Notifier) _setMemberships(userToRooms, roomToUsers map[string][]string) {
+	for roomID := range roomToUsers {
+		if _, ok := n.roomIDToJoinedUsers[roomID]; ok {
+			delete(roomToUsers, roomID)
+		}
+	}
+	n.setUsersJoinedToRooms(roomToUsers)
+	for userID, roomIDs := range userToRooms {
+		if _, ok := n.userIDToJoinedRooms[userID]; ok {
+			continue
+		}
+		rooms := make(map[string]struct{}, len(roomIDs))
+		for _, roomID := range roomIDs {
+			rooms[roomID] = struct{}{}
+		}
+		n.userIDToJoinedRooms[userID] = rooms
+	}
 }
 
 // CurrentPosition returns the current sync position
@@ -354,6 +442,9 @@ func (n *Notifier) setUsersJoinedToRooms(roomIDToUserIDs map[string][]string) {
 		}
 		for _, userID := range userIDs {
 			n.roomIDToJoinedUsers[roomID].add(userID)
+			if rooms, ok := n.userIDToJoinedRooms[userID]; ok {
+				rooms[roomID] = struct{}{}
+			}
 		}
 		n.roomIDToJoinedUsers[roomID].precompute()
 	}
@@ -426,33 +517,66 @@ func (n *Notifier) _fetchUserStreams(userID string) []*UserDeviceStream {
 	return streams
 }
 
+// _addJoinedUser records that the user has joined the room. Rooms and users
+// which haven't been loaded yet are left alone, as they will be loaded from
+// the database, which already has the new membership, when they're needed.
 func (n *Notifier) _addJoinedUser(roomID, userID string) {
-	if _, ok := n.roomIDToJoinedUsers[roomID]; !ok {
-		n.roomIDToJoinedUsers[roomID] = newUserIDSet(8)
+	n.membershipVersion++
+	if users, ok := n.roomIDToJoinedUsers[roomID]; ok {
+		users.add(userID)
+		users.precompute()
+	} else if n.db == nil {
+		n.setUsersJoinedToRooms(map[string][]string{roomID: {userID}})
+	}
+	if rooms, ok := n.userIDToJoinedRooms[userID]; ok {
+		rooms[roomID] = struct{}{}
 	}
-	n.roomIDToJoinedUsers[roomID].add(userID)
-	n.roomIDToJoinedUsers[roomID].precompute()
 }
 
 func (n *Notifier) _removeJoinedUser(roomID, userID string) {
-	if _, ok := n.roomIDToJoinedUsers[roomID]; !ok {
-		n.roomIDToJoinedUsers[roomID] = newUserIDSet(8)
+	n.membershipVersion++
+	if users, ok := n.roomIDToJoinedUsers[roomID]; ok {
+		users.remove(userID)
+		users.precompute()
+	}
+	if rooms, ok := n.userIDToJoinedRooms[userID]; ok {
+		delete(rooms, roomID)
 	}
-	n.roomIDToJoinedUsers[roomID].remove(userID)
-	n.roomIDToJoinedUsers[roomID].precompute()
 }
 
-func (n *Notifier) JoinedUsers(roomID string) (userIDs []string) {
+func (n *Notifier) JoinedUsers(ctx context.Context, roomID string) (userIDs []string) {
+	n.load(ctx, nil, nil, []string{roomID})
+
 	n.lock.RLock()
 	defer n.lock.RUnlock()
 	return n._joinedUsers(roomID)
 }
 
+// _joinedUsers returns the users joined to the room, or none if the room
+// couldn't be loaded.
 func (n *Notifier) _joinedUsers(roomID string) (userIDs []string) {
-	if _, ok := n.roomIDToJoinedUsers[roomID]; !ok {
-		return
+	if users, ok := n.roomIDToJoinedUsers[roomID]; ok {
+		return users.values()
+	}
+	return nil
+}
+
+// _joinedRooms returns the rooms which the user is joined to, or none if the
+// user couldn't be loaded. Without a database, the rooms are worked out from
+// the rooms which the notifier knows about.
+func (n *Notifier) _joinedRooms(userID string) map[string]struct{} {
+	if rooms, ok := n.userIDToJoinedRooms[userID]; ok {
+		return rooms
+	}
+	rooms := map[string]struct{}{}
+	if n.db == nil {
+		for roomID, users := range n.roomIDToJoinedUsers {
+			if users.isIn(userID) {
+				rooms[roomID] = struct{}{}
+			}
+		}
 	}
-	return n.roomIDToJoinedUsers[roomID].values()
+	return rooms
 }
 
 // _removeEmptyUserStreams iterates through the user stream map and removes any
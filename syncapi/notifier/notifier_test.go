@@ -17,7 +17,10 @@ package notifier
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -26,6 +29,8 @@ import (
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/neilalexander/harmony/roomserver/api"
 	rstypes "github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/storage/shared"
 	"github.com/neilalexander/harmony/syncapi/types"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 )
@@ -146,7 +151,7 @@ func TestNewEventAndJoinedToRoom(t *testing.T) {
 	stream := lockedFetchUserStream(n, bob, bobDev)
 	waitForBlocking(stream, 1)
 
-	n.OnNewEvent(&randomMessageEvent, "", nil, syncPositionAfter)
+	n.OnNewEvent(context.Background(), &randomMessageEvent, "", nil, syncPositionAfter)
 
 	wg.Wait()
 }
@@ -212,7 +217,7 @@ func TestNewInviteEventForUser(t *testing.T) {
 	stream := lockedFetchUserStream(n, bob, bobDev)
 	waitForBlocking(stream, 1)
 
-	n.OnNewEvent(&aliceInviteBobEvent, "", nil, syncPositionAfter)
+	n.OnNewEvent(context.Background(), &aliceInviteBobEvent, "", nil, syncPositionAfter)
 
 	wg.Wait()
 }
@@ -241,7 +246,7 @@ func TestEDUWakeup(t *testing.T) {
 	stream := lockedFetchUserStream(n, bob, bobDev)
 	waitForBlocking(stream, 1)
 
-	n.OnNewEvent(&aliceInviteBobEvent, "", nil, syncPositionNewEDU)
+	n.OnNewEvent(context.Background(), &aliceInviteBobEvent, "", nil, syncPositionNewEDU)
 
 	wg.Wait()
 }
@@ -272,7 +277,7 @@ func TestMultipleRequestWakeup(t *testing.T) {
 	stream := lockedFetchUserStream(n, bob, bobDev)
 	waitForBlocking(stream, 3)
 
-	n.OnNewEvent(&randomMessageEvent, "", nil, syncPositionAfter)
+	n.OnNewEvent(context.Background(), &randomMessageEvent, "", nil, syncPositionAfter)
 
 	wg.Wait()
 
@@ -306,7 +311,7 @@ func TestNewEventAndWasPreviouslyJoinedToRoom(t *testing.T) {
 	}()
 	bobStream := lockedFetchUserStream(n, bob, bobDev)
 	waitForBlocking(bobStream, 1)
-	n.OnNewEvent(&bobLeaveEvent, "", nil, syncPositionAfter)
+	n.OnNewEvent(context.Background(), &bobLeaveEvent, "", nil, syncPositionAfter)
 	leaveWG.Wait()
 
 	// send an event into the room. Make sure alice gets it. Bob should not.
@@ -333,7 +338,7 @@ func TestNewEventAndWasPreviouslyJoinedToRoom(t *testing.T) {
 	waitForBlocking(aliceStream, 1)
 	waitForBlocking(bobStream, 1)
 
-	n.OnNewEvent(&randomMessageEvent, "", nil, syncPositionAfter2)
+	n.OnNewEvent(context.Background(), &randomMessageEvent, "", nil, syncPositionAfter2)
 	aliceWG.Wait()
 
 	// it's possible that at this point alice has been informed and bob is about to be informed, so wait
@@ -386,3 +391,66 @@ func newTestSyncRequest(userID, deviceID string, since types.StreamingToken) typ
 		Context:       context.TODO(),
 	}
 }
+
+func TestSharedUsers(t *testing.T) {
+	charlie := "@charlie:localhost"
+	n := NewNotifier(&TestRoomServer{})
+	n.SetCurrentPosition(syncPositionBefore)
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID:             {alice, bob},
+		"!other:localhost": {alice, charlie},
+	})
+
+	if !n.IsSharedUser(context.Background(), alice, charlie) {
+		t.Fatalf("expected alice and charlie to share a room")
+	}
+	if n.IsSharedUser(context.Background(), bob, charlie) {
+		t.Fatalf("expected bob and charlie not to share a room")
+	}
+	shared := n.SharedUsers(context.Background(), alice)
+	sort.Strings(shared)
+	if want := []string{alice, bob, charlie}; !reflect.DeepEqual(shared, want) {
+		t.Fatalf("got shared users %v, want %v", shared, want)
+	}
+
+	// Once bob's rooms have been loaded, they must follow his membership.
+	n.userIDToJoinedRooms[bob] = map[string]struct{}{roomID: {}}
+	n.OnNewEvent(context.Background(), &bobLeaveEvent, "", nil, syncPositionAfter)
+	if n.IsSharedUser(context.Background(), bob, alice) {
+		t.Fatalf("expected bob not to share a room with alice after leaving")
+	}
+}
+
+// unavailableDatabase fails to load anything, as if the database were down.
+type unavailableDatabase struct{ storage.Database }
+
+func (d *unavailableDatabase) NewDatabaseSnapshot(ctx context.Context) (*shared.DatabaseTransaction, error) {
+	return nil, errors.New("database unavailable")
+}
+
+func TestLoadMembershipsFailure(t *testing.T) {
+	n := NewNotifier(&TestRoomServer{})
+	n.SetCurrentPosition(syncPositionBefore)
+	if err := n.Load(context.Background(), &unavailableDatabase{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A room which couldn't be loaded isn't remembered as having no members,
+	// so that it is loaded again next time.
+	if users := n.JoinedUsers(context.Background(), roomID); len(users) != 0 {
+		t.Fatalf("expected no joined users, got %v", users)
+	}
+	if _, ok := n.roomIDToJoinedUsers[roomID]; ok {
+		t.Fatalf("expected the room not to be stored")
+	}
+
+	// Membership changes in rooms which haven't been loaded are left for the
+	// database to catch up on, rather than storing a partial set of members.
+	n.OnNewEvent(context.Background(), &bobLeaveEvent, "", nil, syncPositionAfter)
+	if _, ok := n.roomIDToJoinedUsers[roomID]; ok {
+		t.Fatalf("expected the room not to be stored")
+	}
+	if n.membershipVersion == 0 {
+		t.Fatalf("expected the membership change to be counted")
+	}
+}
@@ -16,7 +16,6 @@ package producers
 
 import (
 	"strconv"
-	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -31,13 +30,13 @@ type FederationAPIPresenceProducer struct {
 }
 
 func (f *FederationAPIPresenceProducer) SendPresence(
-	userID string, presence types.Presence, statusMsg *string,
+	userID string, presence types.Presence, statusMsg *string, lastActiveTS spec.Timestamp,
 ) error {
 	msg := nats.NewMsg(f.Topic)
 	msg.Header.Set(jetstream.UserID, userID)
 	msg.Header.Set("presence", presence.String())
 	msg.Header.Set("from_sync", "true") // only update last_active_ts and presence
-	msg.Header.Set("last_active_ts", strconv.Itoa(int(spec.AsTimestamp(time.Now()))))
+	msg.Header.Set("last_active_ts", strconv.Itoa(int(lastActiveTS)))
 
 	if statusMsg != nil {
 		msg.Header.Set("status_msg", *statusMsg)
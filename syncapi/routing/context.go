@@ -23,7 +23,6 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
@@ -52,7 +51,6 @@ func Context(
 	rsAPI roomserver.SyncRoomserverAPI,
 	syncDB storage.Database,
 	roomID, eventID string,
-	lazyLoadCache caching.LazyLoadCache,
 ) util.JSONResponse {
 	snapshot, err := syncDB.NewDatabaseSnapshot(req.Context())
 	if err != nil {
@@ -130,7 +128,7 @@ func Context(
 				JSON: spec.NotFound(fmt.Sprintf("Event %s not found", eventID)),
 			}
 		}
-		logrus.WithError(err).WithField("eventID", eventID).Error("unable to find requested event")
+		logrus.WithError(err).WithField("event_id", eventID).Error("unable to find requested event")
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
 			JSON: spec.InternalServerError{},
@@ -213,7 +211,7 @@ func Context(
 		allEvents := append(eventsBeforeFiltered, eventsAfterFiltered...)
 		allEvents = append(allEvents, &requestedEvent)
 		evs := synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(allEvents), synctypes.FormatAll)
-		newState, err = applyLazyLoadMembers(ctx, device, snapshot, roomID, evs, lazyLoadCache)
+		newState, err = applyLazyLoadMembers(ctx, device, syncDB, snapshot, roomID, evs)
 		if err != nil {
 			logrus.WithError(err).Error("unable to load membership events")
 			return util.JSONResponse{
@@ -223,7 +221,19 @@ func Context(
 		}
 	}
 
-	ev := synctypes.ToClientEvent(requestedEvent, synctypes.FormatAll)
+	requestedClient := []synctypes.ClientEvent{*synctypes.ToClientEvent(requestedEvent, synctypes.FormatAll)}
+	if err = internal.BundleAggregations(ctx, snapshot, rsAPI, device.UserID,
+		internal.RoomEvents{RoomID: roomID, Events: requestedClient},
+		internal.RoomEvents{RoomID: roomID, Events: eventsBeforeClient},
+		internal.RoomEvents{RoomID: roomID, Events: eventsAfterClient},
+	); err != nil {
+		logrus.WithError(err).Error("unable to bundle aggregations")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	ev := &requestedClient[0]
 	response := ContextRespsonse{
 		Event:        ev,
 		EventsAfter:  eventsAfterClient,
@@ -300,24 +310,34 @@ func getStartEnd(ctx context.Context, snapshot storage.DatabaseTransaction, star
 func applyLazyLoadMembers(
 	ctx context.Context,
 	device *userapi.Device,
+	syncDB storage.Database,
 	snapshot storage.DatabaseTransaction,
 	roomID string,
 	events []synctypes.ClientEvent,
-	lazyLoadCache caching.LazyLoadCache,
 ) ([]*rstypes.HeaderedEvent, error) {
 	eventSenders := make(map[string]struct{})
+	senders := make([]string, 0, len(events))
 	// get members who actually send an event
 	for _, e := range events {
-		// Don't add membership events the client should already know about
-		if _, cached := lazyLoadCache.IsLazyLoadedUserCached(device, e.RoomID, e.Sender); cached {
-			continue
+		if _, ok := eventSenders[e.Sender]; !ok {
+			eventSenders[e.Sender] = struct{}{}
+			senders = append(senders, e.Sender)
 		}
-		eventSenders[e.Sender] = struct{}{}
 	}
 
-	wantUsers := make([]string, 0, len(eventSenders))
-	for userID := range eventSenders {
-		wantUsers = append(wantUsers, userID)
+	// Don't add membership events the client should already know about
+	sent, err := syncDB.SelectLazyLoadedMembers(ctx, device.UserID, device.ID, roomID, senders)
+	if err != nil {
+		return nil, err
+	}
+	wantUsers := make([]string, 0, len(senders))
+	for _, userID := range senders {
+		if _, ok := sent[userID]; !ok {
+			wantUsers = append(wantUsers, userID)
+		}
+	}
+	if len(wantUsers) == 0 {
+		return nil, nil
 	}
 
 	// Query missing membership events
@@ -329,9 +349,13 @@ func applyLazyLoadMembers(
 		return nil, err
 	}
 
-	// cache the membership events
+	// remember the membership events we've sent
+	newlySent := make(map[string]string, len(memberships))
 	for _, membership := range memberships {
-		lazyLoadCache.StoreLazyLoadedUser(device, roomID, *membership.StateKey(), membership.EventID())
+		newlySent[*membership.StateKey()] = membership.EventID()
+	}
+	if err = syncDB.StoreLazyLoadedMembers(ctx, device.UserID, device.ID, roomID, newlySent); err != nil {
+		return nil, err
 	}
 
 	return memberships, nil
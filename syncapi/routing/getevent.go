@@ -111,10 +111,17 @@ func GetEvent(
 		}
 	}
 
-	clientEvent := synctypes.ToClientEvent(events[0], synctypes.FormatAll)
+	clientEvents := []synctypes.ClientEvent{*synctypes.ToClientEvent(events[0], synctypes.FormatAll)}
+	if err = internal.BundleAggregations(ctx, db, rsAPI, userID.String(), internal.RoomEvents{RoomID: events[0].RoomID().String(), Events: clientEvents}); err != nil {
+		logger.WithError(err).Error("GetEvent: internal.BundleAggregations failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: *clientEvent,
+		JSON: clientEvents[0],
 	}
 }
@@ -27,7 +27,6 @@ import (
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/sirupsen/logrus"
 
-	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/roomserver/api"
 	rstypes "github.com/neilalexander/harmony/roomserver/types"
@@ -74,7 +73,6 @@ func OnIncomingMessagesRequest(
 	rsAPI api.SyncRoomserverAPI,
 	cfg *config.SyncAPI,
 	srp *sync.RequestPool,
-	lazyLoadCache caching.LazyLoadCache,
 ) util.JSONResponse {
 	var err error
 
@@ -294,7 +292,7 @@ func OnIncomingMessagesRequest(
 		End:   end.String(),
 	}
 	if filter.LazyLoadMembers {
-		membershipEvents, err := applyLazyLoadMembers(req.Context(), device, snapshot, roomID, clientEvents, lazyLoadCache)
+		membershipEvents, err := applyLazyLoadMembers(req.Context(), device, db, snapshot, roomID, clientEvents)
 		if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("failed to apply lazy loading")
 			return util.JSONResponse{
@@ -424,7 +422,11 @@ func (r *messagesReq) retrieveEvents() (
 
 	start = *r.from
 
-	return synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(filteredEvents), synctypes.FormatAll), start, end, nil
+	clientEvents = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(filteredEvents), synctypes.FormatAll)
+	if err = internal.BundleAggregations(r.ctx, r.snapshot, r.rsAPI, r.device.UserID, internal.RoomEvents{RoomID: r.roomID, Events: clientEvents}); err != nil {
+		return []synctypes.ClientEvent{}, *r.from, *r.to, err
+	}
+	return clientEvents, start, end, nil
 }
 
 func (r *messagesReq) getStartEnd(events []*rstypes.HeaderedEvent) (start, end types.TopologyToken, err error) {
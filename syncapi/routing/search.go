@@ -78,7 +78,7 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
 
 	// only search rooms the user is actually joined to
-	joinedRooms, err := snapshot.RoomIDsWithMembership(ctx, device.UserID, "join")
+	joinedRooms, err := snapshot.RoomIDsWithMembership(ctx, device.UserID, "join", nil)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
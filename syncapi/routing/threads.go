@@ -0,0 +1,141 @@
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/neilalexander/harmony/internal/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/api"
+	rstypes "github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/syncapi/internal"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/syncapi/types"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+type ThreadsResponse struct {
+	Chunk     []synctypes.ClientEvent `json:"chunk"`
+	NextBatch string                  `json:"next_batch,omitempty"`
+}
+
+// Threads returns the thread roots in a room, most recently replied to first,
+// with their bundled aggregations.
+func Threads(
+	req *http.Request, device *userapi.Device,
+	syncDB storage.Database,
+	rsAPI api.SyncRoomserverAPI,
+	rawRoomID string,
+) util.JSONResponse {
+	roomID, err := spec.NewRoomID(rawRoomID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("invalid room ID"),
+		}
+	}
+
+	userID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("device.UserID invalid")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.Unknown("internal server error"),
+		}
+	}
+
+	var from types.StreamPosition
+	var limit int
+	if f := req.URL.Query().Get("from"); f != "" {
+		if from, err = types.NewStreamPositionFromString(f); err != nil {
+			return util.ErrorResponse(err)
+		}
+	}
+	if l := req.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			return util.ErrorResponse(err)
+		}
+	}
+	if limit <= 0 || limit > 50 {
+		limit = 50
+	}
+	var participant string
+	switch req.URL.Query().Get("include") {
+	case "", "all":
+	case "participated":
+		participant = userID.String()
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Bad include query parameter (should be either 'all' or 'participated')"),
+		}
+	}
+
+	snapshot, err := syncDB.NewDatabaseSnapshot(req.Context())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get snapshot for threads")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	var succeeded bool
+	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
+
+	// Look up one more thread than the limit, so that we can tell if there
+	// are more to come.
+	roots, err := snapshot.ThreadRoots(req.Context(), roomID.String(), participant, from, limit+1)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	res := &ThreadsResponse{
+		Chunk: []synctypes.ClientEvent{},
+	}
+	if len(roots) > limit {
+		roots = roots[:limit]
+		res.NextBatch = fmt.Sprintf("%d", roots[len(roots)-1].Position)
+	}
+	eventIDs := make([]string, 0, len(roots))
+	for _, root := range roots {
+		eventIDs = append(eventIDs, root.EventID)
+	}
+	events, err := snapshot.Events(req.Context(), eventIDs)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	// The events come back in no particular order, so put them back into
+	// the order of the threads.
+	byID := make(map[string]*rstypes.HeaderedEvent, len(events))
+	for _, event := range events {
+		byID[event.EventID()] = event
+	}
+	ordered := make([]*rstypes.HeaderedEvent, 0, len(events))
+	for _, eventID := range eventIDs {
+		if event, ok := byID[eventID]; ok {
+			ordered = append(ordered, event)
+		}
+	}
+
+	filteredEvents, err := internal.ApplyHistoryVisibilityFilter(req.Context(), snapshot, rsAPI, ordered, nil, *userID, "threads")
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	for _, event := range filteredEvents {
+		res.Chunk = append(res.Chunk, *synctypes.ToClientEvent(event.PDU, synctypes.FormatAll))
+	}
+	if err = internal.BundleAggregations(req.Context(), snapshot, rsAPI, userID.String(), internal.RoomEvents{RoomID: roomID.String(), Events: res.Chunk}); err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	succeeded = true
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
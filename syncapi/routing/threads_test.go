@@ -0,0 +1,194 @@
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	rsapi "github.com/neilalexander/harmony/roomserver/api"
+	rstypes "github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/storage/shared"
+	"github.com/neilalexander/harmony/syncapi/storage/tables"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/syncapi/types"
+	"github.com/neilalexander/harmony/test"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+	"github.com/tidwall/gjson"
+)
+
+// threadsRelations holds the thread roots of a room, most recently replied
+// to first, and the position of their latest replies.
+type threadsRelations struct {
+	tables.Relations
+	roots        []types.RelationEntry
+	participated map[string]bool
+	aggregations *types.Aggregations
+}
+
+func (r *threadsRelations) SelectMaxRelationID(ctx context.Context, txn *sql.Tx) (int64, error) {
+	return int64(r.roots[0].Position), nil
+}
+
+func (r *threadsRelations) SelectThreadRoots(
+	ctx context.Context, txn *sql.Tx, roomID, participant string, before types.StreamPosition, limit int,
+) ([]types.RelationEntry, error) {
+	var roots []types.RelationEntry
+	for _, root := range r.roots {
+		if root.Position < before && (participant == "" || r.participated[root.EventID]) && len(roots) < limit {
+			roots = append(roots, root)
+		}
+	}
+	return roots, nil
+}
+
+func (r *threadsRelations) SelectAggregations(
+	ctx context.Context, txn *sql.Tx, roomIDs, eventIDs, senders []string, userID string, limit int,
+) (*types.Aggregations, error) {
+	return r.aggregations, nil
+}
+
+type threadsEvents struct {
+	tables.Events
+	events map[string]*rstypes.HeaderedEvent
+}
+
+func (e *threadsEvents) SelectEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string, filter *synctypes.RoomEventFilter, preserveOrder bool,
+) ([]types.StreamEvent, error) {
+	// The events are returned out of order, which the handler must fix.
+	var events []types.StreamEvent
+	for i := len(eventIDs) - 1; i >= 0; i-- {
+		if event, ok := e.events[eventIDs[i]]; ok {
+			events = append(events, types.StreamEvent{HeaderedEvent: event})
+		}
+	}
+	return events, nil
+}
+
+type threadsMemberships struct {
+	tables.Memberships
+}
+
+func (m *threadsMemberships) SelectMembershipForUser(ctx context.Context, txn *sql.Tx, roomID, userID string, pos int64) (string, int64, error) {
+	return spec.Join, math.MaxInt64, nil
+}
+
+type threadsDatabase struct {
+	storage.Database
+	db *shared.Database
+}
+
+func (d *threadsDatabase) NewDatabaseSnapshot(ctx context.Context) (*shared.DatabaseTransaction, error) {
+	return &shared.DatabaseTransaction{Database: d.db}, nil
+}
+
+// threadsRoomserverAPI hides the given events from every user.
+type threadsRoomserverAPI struct {
+	rsapi.SyncRoomserverAPI
+	hidden map[string]bool
+}
+
+func (a *threadsRoomserverAPI) QueryEventsVisibleToUser(ctx context.Context, req *rsapi.QueryEventsVisibleToUserRequest, res *rsapi.QueryEventsVisibleToUserResponse) error {
+	for _, event := range req.Events {
+		if !a.hidden[event.EventID()] {
+			res.Events = append(res.Events, event)
+		}
+	}
+	return nil
+}
+
+func TestThreads(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	var roots []*rstypes.HeaderedEvent
+	for _, body := range []string{"newest", "hidden", "middle", "oldest"} {
+		roots = append(roots, room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": body}))
+	}
+	reply := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "reply"})
+
+	relations := &threadsRelations{
+		participated: map[string]bool{roots[2].EventID(): true},
+		aggregations: &types.Aggregations{
+			Threads: map[string]types.ThreadSummary{
+				roots[0].EventID(): {Count: 1, LatestEventID: reply.EventID()},
+			},
+		},
+	}
+	events := &threadsEvents{events: map[string]*rstypes.HeaderedEvent{reply.EventID(): reply}}
+	for i, root := range roots {
+		relations.roots = append(relations.roots, types.RelationEntry{EventID: root.EventID(), Position: types.StreamPosition(40 - i*10)})
+		events.events[root.EventID()] = root
+	}
+	syncDB := &threadsDatabase{db: &shared.Database{
+		Relations:    relations,
+		OutputEvents: events,
+		Memberships:  &threadsMemberships{},
+	}}
+	rsAPI := &threadsRoomserverAPI{hidden: map[string]bool{roots[1].EventID(): true}}
+	device := &userapi.Device{UserID: alice.ID}
+
+	threads := func(t *testing.T, roomID, query string, wantCode int) ThreadsResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/threads?"+query, nil)
+		res := Threads(req, device, syncDB, rsAPI, roomID)
+		if res.Code != wantCode {
+			t.Fatalf("got status %d, want %d: %+v", res.Code, wantCode, res.JSON)
+		}
+		var threadsRes ThreadsResponse
+		if wantCode == http.StatusOK {
+			data, err := json.Marshal(res.JSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = json.Unmarshal(data, &threadsRes); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return threadsRes
+	}
+	eventIDs := func(res ThreadsResponse) []string {
+		ids := make([]string, 0, len(res.Chunk))
+		for _, event := range res.Chunk {
+			ids = append(ids, event.EventID)
+		}
+		return ids
+	}
+
+	t.Run("pages through the threads, newest first", func(t *testing.T) {
+		res := threads(t, room.ID, "limit=3", http.StatusOK)
+		// The hidden thread still takes up a place in the page.
+		if got := eventIDs(res); len(got) != 2 || got[0] != roots[0].EventID() || got[1] != roots[2].EventID() {
+			t.Fatalf("unexpected first page %v", got)
+		}
+		if res.NextBatch != "20" {
+			t.Fatalf("got next batch %q, want 20", res.NextBatch)
+		}
+		latest := gjson.GetBytes(res.Chunk[0].Unsigned, `m\.relations.m\.thread.latest_event.event_id`)
+		if latest.Str != reply.EventID() {
+			t.Fatalf("expected the thread aggregation to be bundled, got %s", res.Chunk[0].Unsigned)
+		}
+
+		res = threads(t, room.ID, "limit=3&from="+res.NextBatch, http.StatusOK)
+		if got := eventIDs(res); len(got) != 1 || got[0] != roots[3].EventID() || res.NextBatch != "" {
+			t.Fatalf("unexpected last page %v, next batch %q", got, res.NextBatch)
+		}
+	})
+
+	t.Run("only the participated threads", func(t *testing.T) {
+		res := threads(t, room.ID, "include=participated", http.StatusOK)
+		if got := eventIDs(res); len(got) != 1 || got[0] != roots[2].EventID() {
+			t.Fatalf("unexpected participated threads %v", got)
+		}
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		threads(t, room.ID, "include=some", http.StatusBadRequest)
+		threads(t, "not a room ID", "", http.StatusBadRequest)
+	})
+}
@@ -44,12 +44,18 @@ type DatabaseTransaction interface {
 	MaxStreamPositionForRelations(ctx context.Context) (types.StreamPosition, error)
 
 	CurrentState(ctx context.Context, roomID string, stateFilterPart *synctypes.StateFilter, excludeEventIDs []string) ([]*rstypes.HeaderedEvent, error)
-	GetStateDeltasForFullStateSync(ctx context.Context, device *userapi.Device, r types.Range, userID string, stateFilter *synctypes.StateFilter, rsAPI api.SyncRoomserverAPI) ([]types.StateDelta, []string, error)
-	GetStateDeltas(ctx context.Context, device *userapi.Device, r types.Range, userID string, stateFilter *synctypes.StateFilter, rsAPI api.SyncRoomserverAPI) ([]types.StateDelta, []string, error)
-	RoomIDsWithMembership(ctx context.Context, userID string, membership string) ([]string, error)
+	GetStateDeltasForFullStateSync(ctx context.Context, device *userapi.Device, r types.Range, userID string, roomFilter *synctypes.RoomFilter, rsAPI api.SyncRoomserverAPI) ([]types.StateDelta, []string, error)
+	GetStateDeltas(ctx context.Context, device *userapi.Device, r types.Range, userID string, roomFilter *synctypes.RoomFilter, rsAPI api.SyncRoomserverAPI) ([]types.StateDelta, []string, error)
+	// RoomIDsWithMembership returns the rooms in which the user has the given membership.
+	// If roomFilter is not nil, only the rooms it includes are returned.
+	RoomIDsWithMembership(ctx context.Context, userID string, membership string, roomFilter *synctypes.RoomFilter) ([]string, error)
 	MembershipCount(ctx context.Context, roomID, membership string, pos types.StreamPosition) (int, error)
 	GetRoomSummary(ctx context.Context, roomID, userID string) (summary *types.Summary, err error)
 	RecentEvents(ctx context.Context, roomIDs []string, r types.Range, eventFilter *synctypes.RoomEventFilter, chronologicalOrder bool, onlySyncEvents bool) (map[string]types.RecentEvents, error)
+	// RoomBumpStamps returns the bump stamp of each of the given rooms for the user, which is
+	// the stream position of the last activity that should move the room up their room list.
+	// Rooms which have had no such activity are omitted.
+	RoomBumpStamps(ctx context.Context, userID string, roomIDs []string) (map[string]types.StreamPosition, error)
 	GetBackwardTopologyPos(ctx context.Context, events []*rstypes.HeaderedEvent) (types.TopologyToken, error)
 	PositionInTopology(ctx context.Context, eventID string) (pos types.StreamPosition, spos types.StreamPosition, err error)
 	InviteEventsInRange(ctx context.Context, targetUserID string, r types.Range) (map[string]*rstypes.HeaderedEvent, map[string]*rstypes.HeaderedEvent, types.StreamPosition, error)
@@ -77,7 +83,7 @@ type DatabaseTransaction interface {
 	// Returns a map following the format data[roomID] = []dataTypes
 	// If no data is retrieved, returns an empty map
 	// If there was an issue with the retrieval, returns an error
-	GetAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataFilterPart *synctypes.EventFilter) (map[string][]string, types.StreamPosition, error)
+	GetAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataFilterPart *synctypes.EventFilter, roomFilter *synctypes.RoomFilter) (map[string][]string, types.StreamPosition, error)
 	// GetEventsInTopologicalRange retrieves all of the events on a given ordering using the given extremities and limit.
 	// If backwardsOrdering is true, the most recent event must be first, else last.
 	// Returns the filtered StreamEvents on success. Returns **unfiltered** StreamEvents and ErrNoEventsForFilter if
@@ -110,6 +116,13 @@ type DatabaseTransaction interface {
 	GetPresences(ctx context.Context, userID []string) ([]*types.PresenceInternal, error)
 	PresenceAfter(ctx context.Context, after types.StreamPosition, filter synctypes.EventFilter) (map[string]*types.PresenceInternal, error)
 	RelationsFor(ctx context.Context, roomID, eventID, relType, eventType string, from, to types.StreamPosition, backwards bool, limit int) (events []types.StreamEvent, prevBatch, nextBatch string, err error)
+	// Aggregations returns the m.annotation, m.thread and m.replace aggregations of the given
+	// events, whose rooms and senders are paired with them by index, with at most
+	// annotationLimit annotation keys per event.
+	Aggregations(ctx context.Context, roomIDs, eventIDs, senders []string, userID string, annotationLimit int) (*types.Aggregations, error)
+	// ThreadRoots returns up to limit threads in the room whose latest reply is before the given
+	// position, most recently replied to first, optionally only those the participant replied to.
+	ThreadRoots(ctx context.Context, roomID, participant string, before types.StreamPosition, limit int) ([]types.RelationEntry, error)
 }
 
 type Database interface {
@@ -132,6 +145,13 @@ type Database interface {
 		addStateEventIDs []string, removeStateEventIDs []string, transactionID *api.TransactionID, excludeFromSync bool,
 		historyVisibility gomatrixserverlib.HistoryVisibility,
 	) (types.StreamPosition, error)
+	// RepairRoomState replaces the state of the room with the given state, after the roomserver
+	// has repaired it. The event, which has usually been seen before, is moved to a new stream
+	// position so that incremental syncs pick up the new state. Returns the new stream position.
+	RepairRoomState(ctx context.Context, ev *rstypes.HeaderedEvent, addStateEvents []*rstypes.HeaderedEvent,
+		addStateEventIDs []string, removeStateEventIDs []string,
+		historyVisibility gomatrixserverlib.HistoryVisibility,
+	) (types.StreamPosition, error)
 	// PurgeRoomState completely purges room state from the sync API. This is done when
 	// receiving an output event that completely resets the state.
 	PurgeRoomState(ctx context.Context, roomID string) error
@@ -153,9 +173,16 @@ type Database interface {
 	RetireInviteEvent(ctx context.Context, inviteEventID string) (types.StreamPosition, error)
 	// StoreNewSendForDeviceMessage stores a new send-to-device event for a user's device.
 	StoreNewSendForDeviceMessage(ctx context.Context, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent) (types.StreamPosition, error)
-	// CleanSendToDeviceUpdates removes all send-to-device messages BEFORE the specified
-	// from position, preventing the send-to-device table from growing indefinitely.
-	CleanSendToDeviceUpdates(ctx context.Context, userID, deviceID string, before types.StreamPosition) (err error)
+	// CleanSendToDeviceUpdates removes, for each acknowledgement, all send-to-device messages
+	// up to and including the acknowledged position for that device, in a single transaction.
+	CleanSendToDeviceUpdates(ctx context.Context, acks []types.SendToDeviceAck) (err error)
+	// EvictSendToDeviceMessages drops the oldest send-to-device messages for a device so that
+	// no more than keep remain. Returns the number of messages that were dropped.
+	EvictSendToDeviceMessages(ctx context.Context, userID, deviceID string, keep int) (int64, error)
+	// ExpireSendToDeviceMessages drops the send-to-device messages stored before the given
+	// time, in batches and up to a limit so that a large backlog is worked through over several
+	// calls. Returns the number of messages that were dropped.
+	ExpireSendToDeviceMessages(ctx context.Context, before spec.Timestamp) (int64, error)
 	// GetFilter looks up the filter associated with a given local user and filter ID
 	// and populates the target filter. Otherwise returns an error if no such filter exists
 	// or if there was an error talking to the database.
@@ -169,9 +196,32 @@ type Database interface {
 	// StoreReceipt stores new receipt events
 	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp spec.Timestamp) (pos types.StreamPosition, err error)
 	UpdateIgnoresForUser(ctx context.Context, userID string, ignores *types.IgnoredUsers) error
+	// SelectLazyLoadedMembers returns the event IDs of the memberships of the target users which have
+	// already been sent to the device in the room, keyed by target user ID.
+	SelectLazyLoadedMembers(ctx context.Context, userID, deviceID, roomID string, targetUserIDs []string) (map[string]string, error)
+	// StoreLazyLoadedMembers records that the memberships, given as target user ID -> event ID,
+	// have been sent to the device in the room.
+	StoreLazyLoadedMembers(ctx context.Context, userID, deviceID, roomID string, members map[string]string) error
+	// ResetLazyLoadedMembers forgets all memberships sent to the device in every room, e.g. when
+	// the device does an initial sync or is deleted.
+	ResetLazyLoadedMembers(ctx context.Context, userID, deviceID string) error
+	// InvalidateLazyLoadedMembers forgets that the target users' memberships in the room have been
+	// sent to any device. It is called when the memberships change.
+	InvalidateLazyLoadedMembers(ctx context.Context, roomID string, targetUserIDs []string) error
+	// StoreStreamCheckpoint stores the positions of the sync streams, so that
+	// they can carry on from there after a restart.
+	StoreStreamCheckpoint(ctx context.Context, token types.StreamingToken) error
+	// StreamCheckpoint returns the stream positions last stored by StoreStreamCheckpoint.
+	StreamCheckpoint(ctx context.Context) (types.StreamingToken, error)
 	ReIndex(ctx context.Context, limit, afterID int64) (map[int64]rstypes.HeaderedEvent, error)
+	// EventsBySender returns up to limit events sent by the sender after the given
+	// stream position, for exporting the data of a user.
+	EventsBySender(ctx context.Context, sender string, afterID types.StreamPosition, limit int) ([]types.StreamEvent, error)
 	UpdateRelations(ctx context.Context, event *rstypes.HeaderedEvent) error
 	RedactRelations(ctx context.Context, roomID, redactedEventID string) error
+	// AnnotationExists returns true if the sender has already annotated the event with an
+	// event of the given type and the given key.
+	AnnotationExists(ctx context.Context, roomID, eventID, eventType, sender, key string) (bool, error)
 	SelectMemberships(
 		ctx context.Context,
 		roomID string, pos types.TopologyToken,
@@ -182,6 +232,9 @@ type Database interface {
 type Presence interface {
 	GetPresences(ctx context.Context, userIDs []string) ([]*types.PresenceInternal, error)
 	UpdatePresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, lastActiveTS spec.Timestamp, fromSync bool) (types.StreamPosition, error)
+	// UpdateLastActive moves the user's last active time forward without
+	// changing their presence, so syncing clients aren't woken up.
+	UpdateLastActive(ctx context.Context, userID string, lastActiveTS spec.Timestamp) error
 }
 
 type SharedUsers interface {
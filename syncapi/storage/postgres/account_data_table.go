@@ -56,12 +56,24 @@ const insertAccountDataSQL = "" +
 	" DO UPDATE SET id = nextval('syncapi_stream_id')" +
 	" RETURNING id"
 
+// Global account data is filtered by the top-level account_data filter and
+// room account data by the room filter, so that filtering out a room or a
+// room account data type doesn't affect the other.
 const selectAccountDataInRangeSQL = "" +
 	"SELECT id, room_id, type FROM syncapi_account_data_type" +
 	" WHERE user_id = $1 AND id > $2 AND id <= $3" +
-	" AND ( $4::text[] IS NULL OR     type LIKE ANY($4)  )" +
-	" AND ( $5::text[] IS NULL OR NOT(type LIKE ANY($5)) )" +
-	" ORDER BY id ASC LIMIT $6"
+	" AND (" +
+	"  ( room_id = ''" +
+	"   AND ( $4::text[] IS NULL OR     type LIKE ANY($4)  )" +
+	"   AND ( $5::text[] IS NULL OR NOT(type LIKE ANY($5)) )" +
+	"  ) OR ( room_id <> ''" +
+	"   AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
+	"   AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
+	"   AND ( $8::text[] IS NULL OR     room_id = ANY($8)  )" +
+	"   AND ( $9::text[] IS NULL OR NOT(room_id = ANY($9)) )" +
+	"  )" +
+	" )" +
+	" ORDER BY id ASC LIMIT $10"
 
 const selectMaxAccountDataIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_account_data_type"
@@ -98,13 +110,19 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 	userID string,
 	r types.Range,
 	accountDataEventFilter *synctypes.EventFilter,
+	roomFilter *synctypes.RoomFilter,
 ) (data map[string][]string, pos types.StreamPosition, err error) {
 	data = make(map[string][]string)
+	rooms, notRooms := getRoomsAccountDataFilter(roomFilter)
 
 	rows, err := sqlutil.TxStmt(txn, s.selectAccountDataInRangeStmt).QueryContext(
 		ctx, userID, r.Low(), r.High(),
 		pq.StringArray(filterConvertTypeWildcardToSQL(accountDataEventFilter.Types)),
 		pq.StringArray(filterConvertTypeWildcardToSQL(accountDataEventFilter.NotTypes)),
+		pq.StringArray(filterConvertTypeWildcardToSQL(roomFilter.AccountData.Types)),
+		pq.StringArray(filterConvertTypeWildcardToSQL(roomFilter.AccountData.NotTypes)),
+		pq.StringArray(rooms),
+		pq.StringArray(notRooms),
 		accountDataEventFilter.Limit,
 	)
 	if err != nil {
@@ -23,6 +23,7 @@ import (
 
 	"github.com/lib/pq"
 	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/eventcompress"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
@@ -48,8 +49,8 @@ CREATE TABLE IF NOT EXISTS syncapi_current_room_state (
     contains_url BOOL NOT NULL,
     -- The state_key value for this state event e.g ''
     state_key TEXT NOT NULL,
-    -- The JSON for the event. Stored as TEXT because this should be valid UTF-8.
-    headered_event_json TEXT NOT NULL,
+    -- The JSON for the event. Stored as BYTEA because the JSON may be compressed.
+    headered_event_json BYTEA NOT NULL,
     -- The 'content.membership' value if this event is an m.room.member event. For other
     -- events, this will be NULL.
     membership TEXT,
@@ -83,10 +84,14 @@ const deleteRoomStateForRoomSQL = "" +
 	"DELETE FROM syncapi_current_room_state WHERE room_id = $1"
 
 const selectRoomIDsWithMembershipSQL = "" +
-	"SELECT DISTINCT room_id FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND membership = $2"
+	"SELECT DISTINCT room_id FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND membership = $2" +
+	" AND ( $3::text[] IS NULL OR     room_id = ANY($3)  )" +
+	" AND ( $4::text[] IS NULL OR NOT(room_id = ANY($4)) )"
 
 const selectRoomIDsWithAnyMembershipSQL = "" +
-	"SELECT room_id, membership FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1"
+	"SELECT room_id, membership FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1" +
+	" AND ( $2::text[] IS NULL OR     room_id = ANY($2)  )" +
+	" AND ( $3::text[] IS NULL OR NOT(room_id = ANY($3)) )"
 
 const selectCurrentStateSQL = "" +
 	"SELECT event_id, headered_event_json FROM syncapi_current_room_state WHERE room_id = $1" +
@@ -95,7 +100,9 @@ const selectCurrentStateSQL = "" +
 	" AND ( $4::text[] IS NULL OR     type LIKE ANY($4)  )" +
 	" AND ( $5::text[] IS NULL OR NOT(type LIKE ANY($5)) )" +
 	" AND ( $6::bool IS NULL   OR     contains_url = $6  )" +
-	" AND (event_id = ANY($7)) IS NOT TRUE"
+	" AND (event_id = ANY($7)) IS NOT TRUE" +
+	" AND ( $8::text[] IS NULL OR     room_id = ANY($8)  )" +
+	" AND ( $9::text[] IS NULL OR NOT(room_id = ANY($9)) )"
 
 const selectJoinedUsersSQL = "" +
 	"SELECT room_id, state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND membership = 'join'"
@@ -124,6 +131,7 @@ LIMIT 5
 `
 
 type currentRoomStateStatements struct {
+	compressor                         *eventcompress.Compressor
 	upsertRoomStateStmt                *sql.Stmt
 	deleteRoomStateByEventIDStmt       *sql.Stmt
 	deleteRoomStateForRoomStmt         *sql.Stmt
@@ -139,18 +147,26 @@ type currentRoomStateStatements struct {
 	selectRoomHeroesStmt               *sql.Stmt
 }
 
-func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, error) {
-	s := &currentRoomStateStatements{}
+func NewPostgresCurrentRoomStateTable(db *sql.DB, compressor *eventcompress.Compressor) (tables.CurrentRoomState, error) {
+	s := &currentRoomStateStatements{
+		compressor: compressor,
+	}
 	_, err := db.Exec(currentRoomStateSchema)
 	if err != nil {
 		return nil, err
 	}
 
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "syncapi: add history visibility column (current_room_state)",
-		Up:      deltas.UpAddHistoryVisibilityColumnCurrentRoomState,
-	})
+	m.AddMigrations(
+		sqlutil.Migration{
+			Version: "syncapi: add history visibility column (current_room_state)",
+			Up:      deltas.UpAddHistoryVisibilityColumnCurrentRoomState,
+		},
+		sqlutil.Migration{
+			Version: "syncapi: convert headered_event_json to bytea (current_room_state)",
+			Up:      deltas.UpEventJSONByteaCurrentRoomState,
+		},
+	)
 	err = m.Up(context.Background())
 	if err != nil {
 		return nil, err
@@ -221,14 +237,17 @@ func (s *currentRoomStateStatements) SelectJoinedUsersInRoom(
 }
 
 // SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
+// If a room filter is given, only the rooms it includes are returned.
 func (s *currentRoomStateStatements) SelectRoomIDsWithMembership(
 	ctx context.Context,
 	txn *sql.Tx,
 	userID string,
 	membership string, // nolint: unparam
+	roomFilter *synctypes.RoomFilter,
 ) ([]string, error) {
 	stmt := sqlutil.TxStmt(txn, s.selectRoomIDsWithMembershipStmt)
-	rows, err := stmt.QueryContext(ctx, userID, membership)
+	rooms, notRooms := getRoomsRoomFilter(roomFilter)
+	rows, err := stmt.QueryContext(ctx, userID, membership, pq.StringArray(rooms), pq.StringArray(notRooms))
 	if err != nil {
 		return nil, err
 	}
@@ -246,13 +265,16 @@ func (s *currentRoomStateStatements) SelectRoomIDsWithMembership(
 }
 
 // SelectRoomIDsWithAnyMembership returns a map of all memberships for the given user.
+// If a room filter is given, only the rooms it includes are returned.
 func (s *currentRoomStateStatements) SelectRoomIDsWithAnyMembership(
 	ctx context.Context,
 	txn *sql.Tx,
 	userID string,
+	roomFilter *synctypes.RoomFilter,
 ) (map[string]string, error) {
 	stmt := sqlutil.TxStmt(txn, s.selectRoomIDsWithAnyMembershipStmt)
-	rows, err := stmt.QueryContext(ctx, userID)
+	rooms, notRooms := getRoomsRoomFilter(roomFilter)
+	rows, err := stmt.QueryContext(ctx, userID, pq.StringArray(rooms), pq.StringArray(notRooms))
 	if err != nil {
 		return nil, err
 	}
@@ -278,6 +300,7 @@ func (s *currentRoomStateStatements) SelectCurrentState(
 ) ([]*rstypes.HeaderedEvent, error) {
 	stmt := sqlutil.TxStmt(txn, s.selectCurrentStateStmt)
 	senders, notSenders := getSendersStateFilterFilter(stateFilter)
+	rooms, notRooms := getRoomsStateFilter(stateFilter)
 	// We're going to query members later, so remove them from this request
 	if stateFilter.LazyLoadMembers && !stateFilter.IncludeRedundantMembers {
 		notTypes := &[]string{spec.MRoomMember}
@@ -294,6 +317,8 @@ func (s *currentRoomStateStatements) SelectCurrentState(
 		pq.StringArray(filterConvertTypeWildcardToSQL(stateFilter.NotTypes)),
 		stateFilter.ContainsURL,
 		pq.StringArray(excludeEventIDs),
+		pq.StringArray(rooms),
+		pq.StringArray(notRooms),
 	)
 	if err != nil {
 		return nil, err
@@ -346,7 +371,7 @@ func (s *currentRoomStateStatements) UpsertRoomState(
 		event.UserID.String(),
 		containsURL,
 		*event.StateKeyResolved,
-		headeredJSON,
+		s.compressor.Compress(headeredJSON),
 		membership,
 		addedAt,
 		event.Visibility,
@@ -380,7 +405,7 @@ func currentRoomStateRowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, er
 		}
 		// TODO: Handle redacted events
 		var ev rstypes.HeaderedEvent
-		if err := json.Unmarshal(eventBytes, &ev); err != nil {
+		if err := eventcompress.Unmarshal(eventBytes, &ev); err != nil {
 			return nil, err
 		}
 
@@ -405,7 +430,7 @@ func rowsToEvents(rows *sql.Rows) ([]*rstypes.HeaderedEvent, error) {
 		}
 		// TODO: Handle redacted events
 		var ev rstypes.HeaderedEvent
-		if err := json.Unmarshal(eventBytes, &ev); err != nil {
+		if err := eventcompress.Unmarshal(eventBytes, &ev); err != nil {
 			return nil, err
 		}
 		result = append(result, &ev)
@@ -426,7 +451,7 @@ func (s *currentRoomStateStatements) SelectStateEvent(
 		return nil, err
 	}
 	var ev rstypes.HeaderedEvent
-	if err = json.Unmarshal(res, &ev); err != nil {
+	if err = eventcompress.Unmarshal(res, &ev); err != nil {
 		return nil, err
 	}
 	return &ev, err
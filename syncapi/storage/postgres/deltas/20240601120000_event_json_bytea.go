@@ -0,0 +1,49 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// convertEventJSONToBytea converts the headered_event_json column of the given
+// table to BYTEA so that it can hold compressed event JSON. Fresh databases
+// already create it as BYTEA, in which case this does nothing.
+func convertEventJSONToBytea(ctx context.Context, tx *sql.Tx, table string) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+DO $$
+BEGIN
+	IF (SELECT data_type FROM information_schema.columns
+		WHERE table_name = '%[1]s' AND column_name = 'headered_event_json') = 'text' THEN
+		ALTER TABLE %[1]s
+			ALTER COLUMN headered_event_json TYPE BYTEA USING convert_to(headered_event_json, 'UTF8');
+	END IF;
+END $$;
+`, table))
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func UpEventJSONByteaOutputRoomEvents(ctx context.Context, tx *sql.Tx) error {
+	return convertEventJSONToBytea(ctx, tx, "syncapi_output_room_events")
+}
+
+func UpEventJSONByteaCurrentRoomState(ctx context.Context, tx *sql.Tx) error {
+	return convertEventJSONToBytea(ctx, tx, "syncapi_current_room_state")
+}
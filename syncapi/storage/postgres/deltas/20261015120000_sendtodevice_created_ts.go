@@ -0,0 +1,31 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpAddSendToDeviceCreatedTS(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		ALTER TABLE syncapi_send_to_device
+		  ADD COLUMN IF NOT EXISTS created_ts BIGINT NOT NULL DEFAULT (EXTRACT(EPOCH FROM NOW()) * 1000)::BIGINT;
+		CREATE INDEX IF NOT EXISTS syncapi_send_to_device_created_ts_idx ON syncapi_send_to_device(created_ts);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddSendToDeviceCreatedTS(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		DROP INDEX IF EXISTS syncapi_send_to_device_created_ts_idx;
+		ALTER TABLE syncapi_send_to_device
+		  DROP COLUMN IF EXISTS created_ts;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/neilalexander/harmony/internal/eventcompress"
+	"github.com/tidwall/gjson"
+)
+
+// UpAddRelationAnnotations stores the sender and key of relations, so that
+// annotations can be counted and duplicate reactions detected without
+// loading the events.
+func UpAddRelationAnnotations(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		ALTER TABLE syncapi_relations ADD COLUMN IF NOT EXISTS sender TEXT NOT NULL DEFAULT '';
+		ALTER TABLE syncapi_relations ADD COLUMN IF NOT EXISTS annotation_key TEXT NOT NULL DEFAULT '';
+		CREATE INDEX IF NOT EXISTS syncapi_relations_annotations_idx ON syncapi_relations (room_id, event_id, annotation_key)
+			WHERE rel_type = 'm.annotation';
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+// populateRelationAnnotationsBatchSize is how many annotations are filled
+// in at a time, so that the events don't all have to be held in memory.
+const populateRelationAnnotationsBatchSize = 1000
+
+// UpPopulateRelationAnnotations fills in the sender and key of annotations
+// which were stored before UpAddRelationAnnotations.
+// Requires relations and output_room_events to be created.
+func UpPopulateRelationAnnotations(ctx context.Context, tx *sql.Tx) error {
+	var afterID int64
+	for {
+		ids, senders, keys, err := selectRelationAnnotations(ctx, tx, afterID)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		if _, err = tx.ExecContext(ctx, `
+			UPDATE syncapi_relations r SET sender = a.sender, annotation_key = a.key
+			FROM UNNEST($1::BIGINT[], $2::TEXT[], $3::TEXT[]) AS a(id, sender, key)
+			WHERE r.id = a.id
+		`, pq.Int64Array(ids), pq.StringArray(senders), pq.StringArray(keys)); err != nil {
+			return fmt.Errorf("failed to update annotations: %w", err)
+		}
+		afterID = ids[len(ids)-1]
+	}
+}
+
+// selectRelationAnnotations returns the next batch of annotations after the
+// given relation ID, with their senders and keys taken from their events.
+func selectRelationAnnotations(ctx context.Context, tx *sql.Tx, afterID int64) (ids []int64, senders, keys []string, err error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT r.id, e.sender, e.headered_event_json FROM syncapi_relations r
+		JOIN syncapi_output_room_events e ON e.event_id = r.child_event_id
+		WHERE r.rel_type = 'm.annotation' AND r.id > $1
+		ORDER BY r.id ASC LIMIT $2
+	`, afterID, populateRelationAnnotationsBatchSize)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to query annotations: %w", err)
+	}
+	defer rows.Close() // nolint: errcheck
+	for rows.Next() {
+		var id int64
+		var sender string
+		var eventBytes []byte
+		if err = rows.Scan(&id, &sender, &eventBytes); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if eventBytes, err = eventcompress.Decompress(eventBytes); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to decompress event: %w", err)
+		}
+		ids = append(ids, id)
+		senders = append(senders, sender)
+		keys = append(keys, gjson.GetBytes(eventBytes, `content.m\.relates_to.key`).Str)
+	}
+	return ids, senders, keys, rows.Err()
+}
+
+func DownAddRelationAnnotations(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		DROP INDEX IF EXISTS syncapi_relations_annotations_idx;
+		ALTER TABLE syncapi_relations DROP COLUMN IF EXISTS sender;
+		ALTER TABLE syncapi_relations DROP COLUMN IF EXISTS annotation_key;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
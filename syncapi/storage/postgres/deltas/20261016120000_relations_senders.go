@@ -0,0 +1,23 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpPopulateRelationSenders fills in the sender of every relation which was
+// stored before UpAddRelationAnnotations, as UpPopulateRelationAnnotations
+// only fills in annotations, but edits and threads need the sender too.
+// Requires relations and output_room_events to be created.
+func UpPopulateRelationSenders(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE syncapi_relations r SET sender = e.sender
+		FROM syncapi_output_room_events e
+		WHERE e.event_id = r.child_event_id AND r.sender = ''
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
@@ -49,6 +49,45 @@ func getSendersRoomEventFilter(filter *synctypes.RoomEventFilter) (senders []str
 	return senders, notSenders
 }
 
+// getRoomsRoomEventFilter returns the rooms to include and exclude when
+// selecting events for the given filter.
+func getRoomsRoomEventFilter(filter *synctypes.RoomEventFilter) (rooms []string, notRooms []string) {
+	if filter.Rooms != nil {
+		rooms = *filter.Rooms
+	}
+	if filter.NotRooms != nil {
+		notRooms = *filter.NotRooms
+	}
+	return rooms, notRooms
+}
+
+// getRoomsStateFilter returns the rooms to include and exclude when selecting
+// state events for the given filter.
+func getRoomsStateFilter(filter *synctypes.StateFilter) (rooms []string, notRooms []string) {
+	if filter.Rooms != nil {
+		rooms = *filter.Rooms
+	}
+	if filter.NotRooms != nil {
+		notRooms = *filter.NotRooms
+	}
+	return rooms, notRooms
+}
+
+// getRoomsRoomFilter returns the rooms to include and exclude for the room
+// filter as a whole. A nil filter includes every room.
+func getRoomsRoomFilter(filter *synctypes.RoomFilter) (rooms []string, notRooms []string) {
+	if filter == nil {
+		return nil, nil
+	}
+	if filter.Rooms != nil {
+		rooms = *filter.Rooms
+	}
+	if filter.NotRooms != nil {
+		notRooms = *filter.NotRooms
+	}
+	return rooms, notRooms
+}
+
 func getSendersStateFilterFilter(filter *synctypes.StateFilter) (senders []string, notSenders []string) {
 	if filter.Senders != nil {
 		senders = *filter.Senders
@@ -58,3 +97,22 @@ func getSendersStateFilterFilter(filter *synctypes.StateFilter) (senders []strin
 	}
 	return senders, notSenders
 }
+
+// getRoomsAccountDataFilter returns the rooms to include and exclude when
+// selecting room account data. The account_data part of the room filter
+// takes precedence over the room filter itself.
+func getRoomsAccountDataFilter(filter *synctypes.RoomFilter) (rooms []string, notRooms []string) {
+	if filter.Rooms != nil {
+		rooms = *filter.Rooms
+	}
+	if filter.NotRooms != nil {
+		notRooms = *filter.NotRooms
+	}
+	if filter.AccountData.Rooms != nil {
+		rooms = *filter.AccountData.Rooms
+	}
+	if filter.AccountData.NotRooms != nil {
+		notRooms = *filter.AccountData.NotRooms
+	}
+	return rooms, notRooms
+}
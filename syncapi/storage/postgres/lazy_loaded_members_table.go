@@ -0,0 +1,123 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/syncapi/storage/tables"
+)
+
+const lazyLoadedMembersSchema = `
+-- Stores which membership events have been sent to each device when lazy
+-- loading members, so that they aren't sent again on later syncs.
+CREATE TABLE IF NOT EXISTS syncapi_lazy_loaded_members (
+	-- The user and device the membership was sent to
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	-- The room the membership is in
+	room_id TEXT NOT NULL,
+	-- The user whose membership was sent
+	target_user_id TEXT NOT NULL,
+	-- The membership event that was sent
+	event_id TEXT NOT NULL,
+	PRIMARY KEY(user_id, device_id, room_id, target_user_id)
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_lazy_loaded_members_target_idx ON syncapi_lazy_loaded_members(room_id, target_user_id);
+`
+
+const selectLazyLoadedMembersSQL = "" +
+	"SELECT target_user_id, event_id FROM syncapi_lazy_loaded_members" +
+	" WHERE user_id = $1 AND device_id = $2 AND room_id = $3 AND target_user_id = ANY($4)"
+
+// The target user IDs and event IDs are given as a pair of arrays, so that
+// all of the memberships sent in a room are stored at once.
+const upsertLazyLoadedMembersSQL = "" +
+	"INSERT INTO syncapi_lazy_loaded_members (user_id, device_id, room_id, target_user_id, event_id)" +
+	" SELECT $1, $2, $3, target_user_id, event_id FROM UNNEST($4::TEXT[], $5::TEXT[]) AS m(target_user_id, event_id)" +
+	" ON CONFLICT (user_id, device_id, room_id, target_user_id) DO UPDATE SET event_id = EXCLUDED.event_id"
+
+const deleteLazyLoadedMembersForDeviceSQL = "" +
+	"DELETE FROM syncapi_lazy_loaded_members WHERE user_id = $1 AND device_id = $2"
+
+const deleteLazyLoadedMembersForTargetsSQL = "" +
+	"DELETE FROM syncapi_lazy_loaded_members WHERE room_id = $1 AND target_user_id = ANY($2)"
+
+const purgeLazyLoadedMembersSQL = "" +
+	"DELETE FROM syncapi_lazy_loaded_members WHERE room_id = $1"
+
+type lazyLoadedMembersStatements struct {
+	selectLazyLoadedMembersStmt           *sql.Stmt
+	upsertLazyLoadedMembersStmt           *sql.Stmt
+	deleteLazyLoadedMembersForDeviceStmt  *sql.Stmt
+	deleteLazyLoadedMembersForTargetsStmt *sql.Stmt
+	purgeLazyLoadedMembersStmt            *sql.Stmt
+}
+
+func NewPostgresLazyLoadedMembersTable(db *sql.DB) (tables.LazyLoadedMembers, error) {
+	_, err := db.Exec(lazyLoadedMembersSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &lazyLoadedMembersStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.selectLazyLoadedMembersStmt, selectLazyLoadedMembersSQL},
+		{&s.upsertLazyLoadedMembersStmt, upsertLazyLoadedMembersSQL},
+		{&s.deleteLazyLoadedMembersForDeviceStmt, deleteLazyLoadedMembersForDeviceSQL},
+		{&s.deleteLazyLoadedMembersForTargetsStmt, deleteLazyLoadedMembersForTargetsSQL},
+		{&s.purgeLazyLoadedMembersStmt, purgeLazyLoadedMembersSQL},
+	}.Prepare(db)
+}
+
+func (s *lazyLoadedMembersStatements) SelectLazyLoadedMembers(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, roomID string, targetUserIDs []string,
+) (map[string]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectLazyLoadedMembersStmt).QueryContext(ctx, userID, deviceID, roomID, pq.StringArray(targetUserIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectLazyLoadedMembers: rows.close() failed")
+	result := make(map[string]string, len(targetUserIDs))
+	var targetUserID, eventID string
+	for rows.Next() {
+		if err = rows.Scan(&targetUserID, &eventID); err != nil {
+			return nil, err
+		}
+		result[targetUserID] = eventID
+	}
+	return result, rows.Err()
+}
+
+func (s *lazyLoadedMembersStatements) UpsertLazyLoadedMembers(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, roomID string, targetUserIDs, eventIDs []string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertLazyLoadedMembersStmt).ExecContext(
+		ctx, userID, deviceID, roomID, pq.StringArray(targetUserIDs), pq.StringArray(eventIDs),
+	)
+	return err
+}
+
+func (s *lazyLoadedMembersStatements) DeleteLazyLoadedMembersForDevice(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteLazyLoadedMembersForDeviceStmt).ExecContext(ctx, userID, deviceID)
+	return err
+}
+
+func (s *lazyLoadedMembersStatements) DeleteLazyLoadedMembersForTargets(
+	ctx context.Context, txn *sql.Tx, roomID string, targetUserIDs []string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteLazyLoadedMembersForTargetsStmt).ExecContext(ctx, roomID, pq.StringArray(targetUserIDs))
+	return err
+}
+
+func (s *lazyLoadedMembersStatements) PurgeLazyLoadedMembers(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.purgeLazyLoadedMembersStmt).ExecContext(ctx, roomID)
+	return err
+}
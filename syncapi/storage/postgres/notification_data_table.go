@@ -70,7 +70,7 @@ const selectUserUnreadNotificationsForRooms = `SELECT room_id, notification_coun
 	WHERE user_id = $1 AND
 	      room_id = ANY($2)`
 
-const selectMaxNotificationIDSQL = `SELECT CASE COUNT(*) WHEN 0 THEN 0 ELSE MAX(id) END FROM syncapi_notification_data`
+const selectMaxNotificationIDSQL = `SELECT COALESCE(MAX(id), 0) FROM syncapi_notification_data`
 
 const purgeNotificationDataSQL = "" +
 	"DELETE FROM syncapi_notification_data WHERE room_id = $1"
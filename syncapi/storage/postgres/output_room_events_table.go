@@ -24,6 +24,7 @@ import (
 
 	"github.com/lib/pq"
 	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/eventcompress"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/roomserver/api"
@@ -49,8 +50,8 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events (
   -- The 'room_id' key for the event.
   room_id TEXT NOT NULL,
   -- The headered JSON for the event, containing potentially additional metadata such as
-  -- the room version. Stored as TEXT because this should be valid UTF-8.
-  headered_event_json TEXT NOT NULL,
+  -- the room version. Stored as BYTEA because the JSON may be compressed.
+  headered_event_json BYTEA NOT NULL,
   -- The event type e.g 'm.room.member'.
   type TEXT NOT NULL,
   -- The 'sender' property of the event.
@@ -81,6 +82,7 @@ CREATE INDEX IF NOT EXISTS syncapi_output_room_events_exclude_from_sync_idx ON s
 CREATE INDEX IF NOT EXISTS syncapi_output_room_events_add_state_ids_idx ON syncapi_output_room_events ((add_state_ids IS NOT NULL));
 CREATE INDEX IF NOT EXISTS syncapi_output_room_events_remove_state_ids_idx ON syncapi_output_room_events ((remove_state_ids IS NOT NULL));
 CREATE INDEX IF NOT EXISTS syncapi_output_room_events_recent_events_idx ON syncapi_output_room_events (room_id, exclude_from_sync, id, sender, type);
+CREATE INDEX IF NOT EXISTS syncapi_output_room_events_bump_stamp_idx ON syncapi_output_room_events (room_id, type, id);
 
 
 `
@@ -92,6 +94,12 @@ const insertEventSQL = "" +
 	"ON CONFLICT ON CONSTRAINT syncapi_output_room_event_id_idx DO UPDATE SET exclude_from_sync = (excluded.exclude_from_sync AND $11) " +
 	"RETURNING id"
 
+const repositionEventSQL = "" +
+	"UPDATE syncapi_output_room_events SET id = nextval('syncapi_stream_id')," +
+	" add_state_ids = $2, remove_state_ids = $3, exclude_from_sync = FALSE, history_visibility = $4" +
+	" WHERE event_id = $1" +
+	" RETURNING id"
+
 const selectEventsSQL = "" +
 	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events WHERE event_id = ANY($1)"
 
@@ -102,22 +110,30 @@ const selectEventsWithFilterSQL = "" +
 	" AND ( $4::text[] IS NULL OR     type LIKE ANY($4)  )" +
 	" AND ( $5::text[] IS NULL OR NOT(type LIKE ANY($5)) )" +
 	" AND ( $6::bool   IS NULL OR     contains_url = $6 )" +
+	" AND ( $8::text[] IS NULL OR     room_id = ANY($8)  )" +
+	" AND ( $9::text[] IS NULL OR NOT(room_id = ANY($9)) )" +
 	" LIMIT $7"
 
 const selectRecentEventsSQL = "" +
-	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events" +
-	" WHERE room_id = $1 AND id > $2 AND id <= $3" +
+	"SELECT room_id, event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events" +
+	" WHERE room_id = ANY($1) AND id > $2 AND id <= $3" +
+	" AND ( $10::text[] IS NULL OR     room_id = ANY($10)  )" +
+	" AND ( $11::text[] IS NULL OR NOT(room_id = ANY($11)) )" +
 	" AND ( $4::text[] IS NULL OR     sender  = ANY($4)  )" +
 	" AND ( $5::text[] IS NULL OR NOT(sender  = ANY($5)) )" +
 	" AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
+	" AND ( $9::bool   IS NULL OR     contains_url = $9  )" +
 	" ORDER BY id DESC LIMIT $8"
 
 // selectRecentEventsForSyncSQL contains an optimization to get the recent events for a list of rooms, using a LATERAL JOIN
 // The sub select inside LATERAL () is executed for all room_ids it gets as a parameter $1
+// which aren't excluded by the rooms ($10) and not_rooms ($11) of the filter.
 const selectRecentEventsForSyncSQL = `
 WITH room_ids AS (
-     SELECT unnest($1::text[]) AS room_id
+     SELECT room_id FROM unnest($1::text[]) AS room_id
+     WHERE ( $10::text[] IS NULL OR     room_id = ANY($10)  )
+       AND ( $11::text[] IS NULL OR NOT(room_id = ANY($11)) )
 )
 SELECT    x.*
 FROM room_ids,
@@ -132,6 +148,7 @@ FROM room_ids,
                       AND ( $5::text[] IS NULL OR NOT(sender  = ANY($5)) )
                       AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )
                       AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )
+                      AND ( $9::bool   IS NULL OR     contains_url = $9  )
                     ORDER BY recent_events.id DESC
                     LIMIT $8
               ) AS x
@@ -140,6 +157,15 @@ FROM room_ids,
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
+// The bump stamp of a room is the position of the most recent event which should
+// bring it to the top of the user's room list: one of the bump event types, or a
+// membership change made by the user themselves.
+const selectRoomBumpStampsSQL = "" +
+	"SELECT room_id, MAX(id) FROM syncapi_output_room_events" +
+	" WHERE room_id = ANY($1) AND exclude_from_sync = FALSE" +
+	" AND (type = ANY($2) OR (type = 'm.room.member' AND sender = $3))" +
+	" GROUP BY room_id"
+
 const updateEventJSONSQL = "" +
 	"UPDATE syncapi_output_room_events SET headered_event_json=$1 WHERE event_id=$2"
 
@@ -154,6 +180,8 @@ const selectStateInRangeFilteredSQL = "" +
 	" AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
 	" AND ( $8::bool IS NULL   OR     contains_url = $8  )" +
+	" AND ( $9::text[] IS NULL OR     room_id = ANY($9)  )" +
+	" AND ( $10::text[] IS NULL OR NOT(room_id = ANY($10)) )" +
 	" ORDER BY id ASC"
 
 // In order for us to apply the state updates correctly, rows need to be ordered in the order they were received (id).
@@ -189,13 +217,20 @@ const selectContextAfterEventSQL = "" +
 const purgeEventsSQL = "" +
 	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
 
+const selectEventsBySenderSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events" +
+	" WHERE sender = $1 AND id > $2 ORDER BY id ASC LIMIT $3"
+
 const selectSearchSQL = "SELECT id, event_id, headered_event_json FROM syncapi_output_room_events WHERE id > $1 AND type = ANY($2) ORDER BY id ASC LIMIT $3"
 
 type outputRoomEventsStatements struct {
+	compressor                     *eventcompress.Compressor
 	insertEventStmt                *sql.Stmt
+	repositionEventStmt            *sql.Stmt
 	selectEventsStmt               *sql.Stmt
 	selectEventsWitFilterStmt      *sql.Stmt
 	selectMaxEventIDStmt           *sql.Stmt
+	selectRoomBumpStampsStmt       *sql.Stmt
 	selectRecentEventsStmt         *sql.Stmt
 	selectRecentEventsForSyncStmt  *sql.Stmt
 	selectStateInRangeFilteredStmt *sql.Stmt
@@ -207,10 +242,13 @@ type outputRoomEventsStatements struct {
 	selectContextAfterEventStmt    *sql.Stmt
 	purgeEventsStmt                *sql.Stmt
 	selectSearchStmt               *sql.Stmt
+	selectEventsBySenderStmt       *sql.Stmt
 }
 
-func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
-	s := &outputRoomEventsStatements{}
+func NewPostgresEventsTable(db *sql.DB, compressor *eventcompress.Compressor) (tables.Events, error) {
+	s := &outputRoomEventsStatements{
+		compressor: compressor,
+	}
 	_, err := db.Exec(outputRoomEventsSchema)
 	if err != nil {
 		return nil, err
@@ -240,6 +278,10 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 			Version: migrationName,
 			Up:      deltas.UpRenameOutputRoomEventsIndex,
 		},
+		sqlutil.Migration{
+			Version: "syncapi: convert headered_event_json to bytea (output_room_events)",
+			Up:      deltas.UpEventJSONByteaOutputRoomEvents,
+		},
 	)
 	err = m.Up(context.Background())
 	if err != nil {
@@ -248,9 +290,11 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 
 	return s, sqlutil.StatementList{
 		{&s.insertEventStmt, insertEventSQL},
+		{&s.repositionEventStmt, repositionEventSQL},
 		{&s.selectEventsStmt, selectEventsSQL},
 		{&s.selectEventsWitFilterStmt, selectEventsWithFilterSQL},
 		{&s.selectMaxEventIDStmt, selectMaxEventIDSQL},
+		{&s.selectRoomBumpStampsStmt, selectRoomBumpStampsSQL},
 		{&s.selectRecentEventsStmt, selectRecentEventsSQL},
 		{&s.selectRecentEventsForSyncStmt, selectRecentEventsForSyncSQL},
 		{&s.selectStateInRangeFilteredStmt, selectStateInRangeFilteredSQL},
@@ -262,6 +306,7 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.selectContextAfterEventStmt, selectContextAfterEventSQL},
 		{&s.purgeEventsStmt, purgeEventsSQL},
 		{&s.selectSearchStmt, selectSearchSQL},
+		{&s.selectEventsBySenderStmt, selectEventsBySenderSQL},
 	}.Prepare(db)
 }
 
@@ -270,7 +315,7 @@ func (s *outputRoomEventsStatements) UpdateEventJSON(ctx context.Context, txn *s
 	if err != nil {
 		return err
 	}
-	_, err = sqlutil.TxStmt(txn, s.updateEventJSONStmt).ExecContext(ctx, headeredJSON, event.EventID())
+	_, err = sqlutil.TxStmt(txn, s.updateEventJSONStmt).ExecContext(ctx, s.compressor.Compress(headeredJSON), event.EventID())
 	return err
 }
 
@@ -286,6 +331,7 @@ func (s *outputRoomEventsStatements) SelectStateInRange(
 	if stateFilter != nil {
 		stmt := sqlutil.TxStmt(txn, s.selectStateInRangeFilteredStmt)
 		senders, notSenders := getSendersStateFilterFilter(stateFilter)
+		rooms, notRooms := getRoomsStateFilter(stateFilter)
 		rows, err = stmt.QueryContext(
 			ctx, r.Low(), r.High(), pq.StringArray(roomIDs),
 			pq.StringArray(senders),
@@ -293,6 +339,8 @@ func (s *outputRoomEventsStatements) SelectStateInRange(
 			pq.StringArray(filterConvertTypeWildcardToSQL(stateFilter.Types)),
 			pq.StringArray(filterConvertTypeWildcardToSQL(stateFilter.NotTypes)),
 			stateFilter.ContainsURL,
+			pq.StringArray(rooms),
+			pq.StringArray(notRooms),
 		)
 	} else {
 		stmt := sqlutil.TxStmt(txn, s.selectStateInRangeStmt)
@@ -331,7 +379,7 @@ func (s *outputRoomEventsStatements) SelectStateInRange(
 
 		// TODO: Handle redacted events
 		var ev rstypes.HeaderedEvent
-		if err := json.Unmarshal(eventBytes, &ev); err != nil {
+		if err := eventcompress.Unmarshal(eventBytes, &ev); err != nil {
 			return nil, nil, err
 		}
 		needSet := stateNeeded[ev.RoomID().String()]
@@ -372,6 +420,29 @@ func (s *outputRoomEventsStatements) SelectMaxEventID(
 	return
 }
 
+// SelectRoomBumpStamps returns the bump stamp for each of the given rooms, as
+// seen by the user. Rooms without any bump events are left out of the map.
+func (s *outputRoomEventsStatements) SelectRoomBumpStamps(
+	ctx context.Context, txn *sql.Tx, userID string, roomIDs []string,
+) (map[string]types.StreamPosition, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomBumpStampsStmt)
+	rows, err := stmt.QueryContext(ctx, pq.StringArray(roomIDs), pq.StringArray(types.BumpEventTypes), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomBumpStamps: rows.close() failed")
+	result := make(map[string]types.StreamPosition, len(roomIDs))
+	var roomID string
+	var pos types.StreamPosition
+	for rows.Next() {
+		if err = rows.Scan(&roomID, &pos); err != nil {
+			return nil, err
+		}
+		result[roomID] = pos
+	}
+	return result, rows.Err()
+}
+
 // InsertEvent into the output_room_events table. addState and removeState are an optional list of state event IDs. Returns the position
 // of the inserted event.
 func (s *outputRoomEventsStatements) InsertEvent(
@@ -405,7 +476,7 @@ func (s *outputRoomEventsStatements) InsertEvent(
 		ctx,
 		event.RoomID().String(),
 		event.EventID(),
-		headeredJSON,
+		s.compressor.Compress(headeredJSON),
 		event.Type(),
 		event.UserID.String(),
 		containsURL,
@@ -419,6 +490,18 @@ func (s *outputRoomEventsStatements) InsertEvent(
 	return
 }
 
+func (s *outputRoomEventsStatements) RepositionEvent(
+	ctx context.Context, txn *sql.Tx,
+	eventID string, addState, removeState []string,
+	historyVisibility gomatrixserverlib.HistoryVisibility,
+) (streamPos types.StreamPosition, err error) {
+	stmt := sqlutil.TxStmt(txn, s.repositionEventStmt)
+	err = stmt.QueryRowContext(
+		ctx, eventID, pq.StringArray(addState), pq.StringArray(removeState), historyVisibility,
+	).Scan(&streamPos)
+	return
+}
+
 // selectRecentEvents returns the most recent events in the given room, up to a maximum of 'limit'.
 // If onlySyncEvents has a value of true, only returns the events that aren't marked as to exclude
 // from sync.
@@ -434,6 +517,7 @@ func (s *outputRoomEventsStatements) SelectRecentEvents(
 		stmt = sqlutil.TxStmt(txn, s.selectRecentEventsStmt)
 	}
 	senders, notSenders := getSendersRoomEventFilter(eventFilter)
+	rooms, notRooms := getRoomsRoomEventFilter(eventFilter)
 
 	rows, err := stmt.QueryContext(
 		ctx, pq.StringArray(roomIDs), ra.Low(), ra.High(),
@@ -442,6 +526,9 @@ func (s *outputRoomEventsStatements) SelectRecentEvents(
 		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.Types)),
 		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.NotTypes)),
 		eventFilter.Limit+1,
+		eventFilter.ContainsURL,
+		pq.StringArray(rooms),
+		pq.StringArray(notRooms),
 	)
 	if err != nil {
 		return nil, err
@@ -467,7 +554,7 @@ func (s *outputRoomEventsStatements) SelectRecentEvents(
 		}
 		// TODO: Handle redacted events
 		var ev rstypes.HeaderedEvent
-		if err := json.Unmarshal(eventBytes, &ev); err != nil {
+		if err := eventcompress.Unmarshal(eventBytes, &ev); err != nil {
 			return nil, err
 		}
 
@@ -535,6 +622,7 @@ func (s *outputRoomEventsStatements) SelectEvents(
 		rows, err = stmt.QueryContext(ctx, pq.StringArray(eventIDs))
 	} else {
 		senders, notSenders := getSendersRoomEventFilter(filter)
+		rooms, notRooms := getRoomsRoomEventFilter(filter)
 		stmt = sqlutil.TxStmt(txn, s.selectEventsWitFilterStmt)
 		rows, err = stmt.QueryContext(ctx,
 			pq.StringArray(eventIDs),
@@ -544,6 +632,8 @@ func (s *outputRoomEventsStatements) SelectEvents(
 			pq.StringArray(filterConvertTypeWildcardToSQL(filter.NotTypes)),
 			filter.ContainsURL,
 			filter.Limit,
+			pq.StringArray(rooms),
+			pq.StringArray(notRooms),
 		)
 	}
 	if err != nil {
@@ -581,13 +671,13 @@ func (s *outputRoomEventsStatements) DeleteEventsForRoom(
 func (s *outputRoomEventsStatements) SelectContextEvent(ctx context.Context, txn *sql.Tx, roomID, eventID string) (id int, evt rstypes.HeaderedEvent, err error) {
 	row := sqlutil.TxStmt(txn, s.selectContextEventStmt).QueryRowContext(ctx, roomID, eventID)
 
-	var eventAsString string
+	var eventBytes []byte
 	var historyVisibility gomatrixserverlib.HistoryVisibility
-	if err = row.Scan(&id, &eventAsString, &historyVisibility); err != nil {
+	if err = row.Scan(&id, &eventBytes, &historyVisibility); err != nil {
 		return 0, evt, err
 	}
 
-	if err = json.Unmarshal([]byte(eventAsString), &evt); err != nil {
+	if err = eventcompress.Unmarshal(eventBytes, &evt); err != nil {
 		return 0, evt, err
 	}
 	evt.Visibility = historyVisibility
@@ -619,7 +709,7 @@ func (s *outputRoomEventsStatements) SelectContextBeforeEvent(
 		if err = rows.Scan(&eventBytes, &historyVisibility); err != nil {
 			return evts, err
 		}
-		if err = json.Unmarshal(eventBytes, &evt); err != nil {
+		if err = eventcompress.Unmarshal(eventBytes, &evt); err != nil {
 			return evts, err
 		}
 		evt.Visibility = historyVisibility
@@ -654,7 +744,7 @@ func (s *outputRoomEventsStatements) SelectContextAfterEvent(
 		if err = rows.Scan(&lastID, &eventBytes, &historyVisibility); err != nil {
 			return 0, evts, err
 		}
-		if err = json.Unmarshal(eventBytes, &evt); err != nil {
+		if err = eventcompress.Unmarshal(eventBytes, &evt); err != nil {
 			return 0, evts, err
 		}
 		evt.Visibility = historyVisibility
@@ -682,7 +772,7 @@ func rowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, error) {
 		}
 		// TODO: Handle redacted events
 		var ev rstypes.HeaderedEvent
-		if err := json.Unmarshal(eventBytes, &ev); err != nil {
+		if err := eventcompress.Unmarshal(eventBytes, &ev); err != nil {
 			return nil, err
 		}
 
@@ -710,6 +800,17 @@ func (s *outputRoomEventsStatements) PurgeEvents(
 	return err
 }
 
+func (s *outputRoomEventsStatements) SelectEventsBySender(
+	ctx context.Context, txn *sql.Tx, sender string, afterID types.StreamPosition, limit int,
+) ([]types.StreamEvent, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectEventsBySenderStmt).QueryContext(ctx, sender, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectEventsBySender: rows.close() failed")
+	return rowsToStreamEvents(rows)
+}
+
 func (s *outputRoomEventsStatements) ReIndex(ctx context.Context, txn *sql.Tx, limit, afterID int64, types []string) (map[int64]rstypes.HeaderedEvent, error) {
 	rows, err := sqlutil.TxStmt(txn, s.selectSearchStmt).QueryContext(ctx, afterID, pq.StringArray(types), limit)
 	if err != nil {
@@ -726,7 +827,7 @@ func (s *outputRoomEventsStatements) ReIndex(ctx context.Context, txn *sql.Tx, l
 		if err = rows.Scan(&id, &eventID, &eventBytes); err != nil {
 			return nil, err
 		}
-		if err = json.Unmarshal(eventBytes, &ev); err != nil {
+		if err = eventcompress.Unmarshal(eventBytes, &ev); err != nil {
 			return nil, err
 		}
 		result[id] = ev
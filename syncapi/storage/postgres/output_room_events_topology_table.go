@@ -47,6 +47,11 @@ const insertEventInTopologySQL = "" +
 	" ON CONFLICT (topological_position, stream_position, room_id) DO UPDATE SET event_id = $1" +
 	" RETURNING topological_position"
 
+const updateStreamPositionSQL = "" +
+	"UPDATE syncapi_output_room_events_topology SET stream_position = $2" +
+	" WHERE event_id = $1" +
+	" RETURNING topological_position"
+
 const selectEventIDsInRangeASCSQL = "" +
 	"SELECT event_id, topological_position, stream_position FROM syncapi_output_room_events_topology" +
 	" WHERE room_id = $1 AND (" +
@@ -76,6 +81,7 @@ const purgeEventsTopologySQL = "" +
 
 type outputRoomEventsTopologyStatements struct {
 	insertEventInTopologyStmt                 *sql.Stmt
+	updateStreamPositionStmt                  *sql.Stmt
 	selectEventIDsInRangeASCStmt              *sql.Stmt
 	selectEventIDsInRangeDESCStmt             *sql.Stmt
 	selectPositionInTopologyStmt              *sql.Stmt
@@ -92,6 +98,7 @@ func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
 	}
 	return s, sqlutil.StatementList{
 		{&s.insertEventInTopologyStmt, insertEventInTopologySQL},
+		{&s.updateStreamPositionStmt, updateStreamPositionSQL},
 		{&s.selectEventIDsInRangeASCStmt, selectEventIDsInRangeASCSQL},
 		{&s.selectEventIDsInRangeDESCStmt, selectEventIDsInRangeDESCSQL},
 		{&s.selectPositionInTopologyStmt, selectPositionInTopologySQL},
@@ -112,6 +119,15 @@ func (s *outputRoomEventsTopologyStatements) InsertEventInTopology(
 	return
 }
 
+func (s *outputRoomEventsTopologyStatements) UpdateStreamPosition(
+	ctx context.Context, txn *sql.Tx, eventID string, pos types.StreamPosition,
+) (topoPos types.StreamPosition, err error) {
+	err = sqlutil.TxStmt(txn, s.updateStreamPositionStmt).QueryRowContext(
+		ctx, eventID, pos,
+	).Scan(&topoPos)
+	return
+}
+
 // SelectEventIDsInRange selects the IDs of events which positions are within a
 // given range in a given room's topological order. Returns the start/end topological tokens for
 // the returned eventIDs.
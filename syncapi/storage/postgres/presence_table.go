@@ -65,6 +65,10 @@ const upsertPresenceFromSyncSQL = "" +
 	" presence = $2, last_active_ts = $3" +
 	" RETURNING id"
 
+const updateLastActiveSQL = "" +
+	"UPDATE syncapi_presence SET last_active_ts = $2" +
+	" WHERE user_id = $1 AND last_active_ts < $2"
+
 const selectPresenceForUserSQL = "" +
 	"SELECT user_id, presence, status_msg, last_active_ts" +
 	" FROM syncapi_presence" +
@@ -73,15 +77,18 @@ const selectPresenceForUserSQL = "" +
 const selectMaxPresenceSQL = "" +
 	"SELECT COALESCE(MAX(id), 0) FROM syncapi_presence"
 
+// Initial syncs only get recent presence, but incremental syncs get every
+// change, including users going idle some time after they were last active.
 const selectPresenceAfter = "" +
 	" SELECT id, user_id, presence, status_msg, last_active_ts" +
 	" FROM syncapi_presence" +
-	" WHERE id > $1 AND last_active_ts >= $2" +
+	" WHERE id > $1 AND ($1 > 0 OR last_active_ts >= $2)" +
 	" ORDER BY id ASC LIMIT $3"
 
 type presenceStatements struct {
 	upsertPresenceStmt         *sql.Stmt
 	upsertPresenceFromSyncStmt *sql.Stmt
+	updateLastActiveStmt       *sql.Stmt
 	selectPresenceForUsersStmt *sql.Stmt
 	selectMaxPresenceStmt      *sql.Stmt
 	selectPresenceAfterStmt    *sql.Stmt
@@ -96,6 +103,7 @@ func NewPostgresPresenceTable(db *sql.DB) (*presenceStatements, error) {
 	return s, sqlutil.StatementList{
 		{&s.upsertPresenceStmt, upsertPresenceSQL},
 		{&s.upsertPresenceFromSyncStmt, upsertPresenceFromSyncSQL},
+		{&s.updateLastActiveStmt, updateLastActiveSQL},
 		{&s.selectPresenceForUsersStmt, selectPresenceForUserSQL},
 		{&s.selectMaxPresenceStmt, selectMaxPresenceSQL},
 		{&s.selectPresenceAfterStmt, selectPresenceAfter},
@@ -122,6 +130,15 @@ func (p *presenceStatements) UpsertPresence(
 	return
 }
 
+// UpdateLastActive moves the last active time forward without changing the
+// stream position, as nothing that clients need to be told about has changed.
+func (p *presenceStatements) UpdateLastActive(
+	ctx context.Context, txn *sql.Tx, userID string, lastActiveTS spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, p.updateLastActiveStmt).ExecContext(ctx, userID, lastActiveTS)
+	return err
+}
+
 // GetPresenceForUsers returns the current presence for a list of users.
 // If the user doesn't have a presence status yet, it is omitted from the response.
 func (p *presenceStatements) GetPresenceForUsers(
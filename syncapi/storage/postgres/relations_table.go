@@ -18,8 +18,10 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/lib/pq"
 	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/syncapi/storage/postgres/deltas"
 	"github.com/neilalexander/harmony/syncapi/storage/tables"
 	"github.com/neilalexander/harmony/syncapi/types"
 )
@@ -34,14 +36,31 @@ CREATE TABLE IF NOT EXISTS syncapi_relations (
 	child_event_id TEXT NOT NULL,
 	child_event_type TEXT NOT NULL,
 	rel_type TEXT NOT NULL,
+	-- The sender of the child event.
+	sender TEXT NOT NULL DEFAULT '',
+	-- The key of an m.annotation relation, such as the emoji of a reaction.
+	annotation_key TEXT NOT NULL DEFAULT '',
 	CONSTRAINT syncapi_relations_unique UNIQUE (room_id, event_id, child_event_id, rel_type)
 );
+
+CREATE INDEX IF NOT EXISTS syncapi_relations_annotations_idx ON syncapi_relations (room_id, event_id, annotation_key)
+	WHERE rel_type = 'm.annotation';
+
+-- Relations are looked up by the event they relate to and their type, in stream order.
+CREATE INDEX IF NOT EXISTS syncapi_relations_rel_type_idx ON syncapi_relations (room_id, event_id, rel_type, id);
+
+-- Relations are deleted by the event which they come from when it is redacted.
+CREATE INDEX IF NOT EXISTS syncapi_relations_child_event_idx ON syncapi_relations (room_id, child_event_id);
+
+-- Threads are listed by their latest reply.
+CREATE INDEX IF NOT EXISTS syncapi_relations_threads_idx ON syncapi_relations (room_id, id, event_id)
+	WHERE rel_type = 'm.thread';
 `
 
 const insertRelationSQL = "" +
 	"INSERT INTO syncapi_relations (" +
-	"  room_id, event_id, child_event_id, child_event_type, rel_type" +
-	") VALUES ($1, $2, $3, $4, $5) " +
+	"  room_id, event_id, child_event_id, child_event_type, rel_type, sender, annotation_key" +
+	") VALUES ($1, $2, $3, $4, $5, $6, $7) " +
 	" ON CONFLICT DO NOTHING"
 
 const deleteRelationSQL = "" +
@@ -63,6 +82,63 @@ const selectRelationsInRangeDescSQL = "" +
 	" AND id >= $5 AND id < $6" +
 	" ORDER BY id DESC LIMIT $7"
 
+const selectAnnotationExistsSQL = "" +
+	"SELECT EXISTS(SELECT 1 FROM syncapi_relations" +
+	" WHERE room_id = $1 AND event_id = $2 AND rel_type = 'm.annotation'" +
+	" AND child_event_type = $3 AND sender = $4 AND annotation_key = $5)"
+
+// All of the aggregations of the events are looked up at once, one row per
+// annotation key, thread or edit, with the type of relation in the first
+// column. The events can be in different rooms, so their room IDs, event IDs
+// and senders are given as arrays.
+//   - Annotations are grouped by event type and key, with the most used keys
+//     first, and only the top $5 keys of each event are returned.
+//   - Threads are summarised by the number of replies, the latest reply and
+//     whether the user $4 has replied.
+//   - Only edits sent by the sender of the original event are valid, and only
+//     the latest one is returned.
+const selectAggregationsSQL = "" +
+	"WITH events (room_id, event_id, sender) AS (SELECT * FROM UNNEST($1::TEXT[], $2::TEXT[], $3::TEXT[]))" +
+	" SELECT 'm.annotation', event_id, child_event_type, annotation_key, count, FALSE, rank FROM (" +
+	"  SELECT event_id, child_event_type, annotation_key, COUNT(*) AS count," +
+	"  ROW_NUMBER() OVER (PARTITION BY event_id ORDER BY COUNT(*) DESC, MIN(id) ASC) AS rank" +
+	"  FROM syncapi_relations" +
+	"  WHERE (room_id, event_id) IN (SELECT room_id, event_id FROM events) AND rel_type = 'm.annotation'" +
+	"  GROUP BY event_id, child_event_type, annotation_key" +
+	" ) AS counts WHERE rank <= $5" +
+	" UNION ALL" +
+	" SELECT 'm.thread', event_id, (ARRAY_AGG(child_event_id ORDER BY id DESC))[1], '', COUNT(*), BOOL_OR(sender = $4), 0" +
+	"  FROM syncapi_relations" +
+	"  WHERE (room_id, event_id) IN (SELECT room_id, event_id FROM events) AND rel_type = 'm.thread'" +
+	"  GROUP BY event_id" +
+	" UNION ALL" +
+	" SELECT 'm.replace', event_id, child_event_id, '', 0, FALSE, 0 FROM (" +
+	"  SELECT DISTINCT ON (event_id) event_id, child_event_id FROM syncapi_relations" +
+	"  WHERE (room_id, event_id, sender) IN (SELECT * FROM events) AND rel_type = 'm.replace'" +
+	"  ORDER BY event_id, id DESC" +
+	" ) AS edits" +
+	" ORDER BY 2, 7"
+
+// Threads are ordered by their latest reply, newest first, and can be
+// limited to the threads which the given sender has replied to. The replies
+// are walked back from $3 using the threads index, keeping only the latest
+// reply of each thread, so that a page doesn't have to look at every thread
+// in the room.
+const selectThreadRootsSQL = "" +
+	"SELECT event_id, id FROM syncapi_relations AS reply" +
+	" WHERE room_id = $1 AND rel_type = 'm.thread' AND id < $3" +
+	" AND NOT EXISTS (" +
+	"  SELECT 1 FROM syncapi_relations AS later" +
+	"  WHERE later.room_id = reply.room_id AND later.event_id = reply.event_id" +
+	"  AND later.rel_type = 'm.thread' AND later.id > reply.id" +
+	" )" +
+	" AND ( $2 = '' OR EXISTS (" +
+	"  SELECT 1 FROM syncapi_relations AS participated" +
+	"  WHERE participated.room_id = reply.room_id AND participated.event_id = reply.event_id" +
+	"  AND participated.rel_type = 'm.thread' AND participated.sender = $2" +
+	" ) )" +
+	" ORDER BY id DESC LIMIT $4"
+
 const selectMaxRelationIDSQL = "" +
 	"SELECT COALESCE(MAX(id), 0) FROM syncapi_relations"
 
@@ -72,6 +148,9 @@ type relationsStatements struct {
 	selectRelationsInRangeDescStmt *sql.Stmt
 	deleteRelationStmt             *sql.Stmt
 	selectMaxRelationIDStmt        *sql.Stmt
+	selectAnnotationExistsStmt     *sql.Stmt
+	selectAggregationsStmt         *sql.Stmt
+	selectThreadRootsStmt          *sql.Stmt
 }
 
 func NewPostgresRelationsTable(db *sql.DB) (tables.Relations, error) {
@@ -80,20 +159,31 @@ func NewPostgresRelationsTable(db *sql.DB) (tables.Relations, error) {
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "syncapi: add relation sender and annotation key",
+		Up:      deltas.UpAddRelationAnnotations,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	return s, sqlutil.StatementList{
 		{&s.insertRelationStmt, insertRelationSQL},
 		{&s.selectRelationsInRangeAscStmt, selectRelationsInRangeAscSQL},
 		{&s.selectRelationsInRangeDescStmt, selectRelationsInRangeDescSQL},
 		{&s.deleteRelationStmt, deleteRelationSQL},
 		{&s.selectMaxRelationIDStmt, selectMaxRelationIDSQL},
+		{&s.selectAnnotationExistsStmt, selectAnnotationExistsSQL},
+		{&s.selectAggregationsStmt, selectAggregationsSQL},
+		{&s.selectThreadRootsStmt, selectThreadRootsSQL},
 	}.Prepare(db)
 }
 
 func (s *relationsStatements) InsertRelation(
-	ctx context.Context, txn *sql.Tx, roomID, eventID, childEventID, childEventType, relType string,
+	ctx context.Context, txn *sql.Tx, roomID, eventID, childEventID, childEventType, relType, sender, annotationKey string,
 ) (err error) {
 	_, err = sqlutil.TxStmt(txn, s.insertRelationStmt).ExecContext(
-		ctx, roomID, eventID, childEventID, childEventType, relType,
+		ctx, roomID, eventID, childEventID, childEventType, relType, sender, annotationKey,
 	)
 	return
 }
@@ -156,3 +246,77 @@ func (s *relationsStatements) SelectMaxRelationID(
 	err = stmt.QueryRowContext(ctx).Scan(&id)
 	return
 }
+
+func (s *relationsStatements) SelectAnnotationExists(
+	ctx context.Context, txn *sql.Tx, roomID, eventID, eventType, sender, key string,
+) (exists bool, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAnnotationExistsStmt)
+	err = stmt.QueryRowContext(ctx, roomID, eventID, eventType, sender, key).Scan(&exists)
+	return
+}
+
+func (s *relationsStatements) SelectAggregations(
+	ctx context.Context, txn *sql.Tx, roomIDs, eventIDs, senders []string, userID string, limit int,
+) (*types.Aggregations, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAggregationsStmt)
+	rows, err := stmt.QueryContext(
+		ctx, pq.StringArray(roomIDs), pq.StringArray(eventIDs), pq.StringArray(senders), userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAggregations: rows.close() failed")
+	result := &types.Aggregations{
+		Annotations: map[string][]types.AnnotationCount{},
+		Threads:     map[string]types.ThreadSummary{},
+		Edits:       map[string]string{},
+	}
+	var (
+		relType, eventID, childValue, key string
+		count                             int
+		participated                      bool
+		rank                              int64
+	)
+	for rows.Next() {
+		if err = rows.Scan(&relType, &eventID, &childValue, &key, &count, &participated, &rank); err != nil {
+			return nil, err
+		}
+		switch relType {
+		case "m.annotation":
+			result.Annotations[eventID] = append(result.Annotations[eventID], types.AnnotationCount{
+				Type:  childValue,
+				Key:   key,
+				Count: count,
+			})
+		case "m.thread":
+			result.Threads[eventID] = types.ThreadSummary{
+				Count:         count,
+				LatestEventID: childValue,
+				Participated:  participated,
+			}
+		case "m.replace":
+			result.Edits[eventID] = childValue
+		}
+	}
+	return result, rows.Err()
+}
+
+func (s *relationsStatements) SelectThreadRoots(
+	ctx context.Context, txn *sql.Tx, roomID, participant string, before types.StreamPosition, limit int,
+) ([]types.RelationEntry, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectThreadRootsStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, participant, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectThreadRoots: rows.close() failed")
+	var result []types.RelationEntry
+	for rows.Next() {
+		var entry types.RelationEntry
+		if err = rows.Scan(&entry.EventID, &entry.Position); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
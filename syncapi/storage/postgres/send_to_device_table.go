@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 
 	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/syncapi/storage/postgres/deltas"
 	"github.com/neilalexander/harmony/syncapi/storage/tables"
@@ -39,15 +40,17 @@ CREATE TABLE IF NOT EXISTS syncapi_send_to_device (
 	-- The device ID to send the message to.
 	device_id TEXT NOT NULL,
 	-- The event content JSON.
-	content TEXT NOT NULL
+	content TEXT NOT NULL,
+	-- The time the message was stored, in milliseconds.
+	created_ts BIGINT NOT NULL
 );
 
 CREATE INDEX IF NOT EXISTS syncapi_send_to_device_user_id_device_id_idx ON syncapi_send_to_device(user_id, device_id);
 `
 
 const insertSendToDeviceMessageSQL = `
-	INSERT INTO syncapi_send_to_device (user_id, device_id, content)
-	  VALUES ($1, $2, $3)
+	INSERT INTO syncapi_send_to_device (user_id, device_id, content, created_ts)
+	  VALUES ($1, $2, $3, $4)
 	  RETURNING id
 `
 
@@ -63,14 +66,36 @@ const deleteSendToDeviceMessagesSQL = `
 	  WHERE user_id = $1 AND device_id = $2 AND id <= $3
 `
 
+// Keeps the newest $3 messages for the device and deletes the rest.
+const deleteOldestSendToDeviceMessagesSQL = `
+	DELETE FROM syncapi_send_to_device
+	  WHERE user_id = $1 AND device_id = $2 AND id <= (
+	    SELECT id FROM syncapi_send_to_device
+	      WHERE user_id = $1 AND device_id = $2
+	      ORDER BY id DESC
+	      OFFSET $3 LIMIT 1
+	  )
+`
+
+const deleteExpiredSendToDeviceMessagesSQL = `
+	DELETE FROM syncapi_send_to_device
+	  WHERE id IN (
+	    SELECT id FROM syncapi_send_to_device
+	      WHERE created_ts < $1
+	      LIMIT $2
+	  )
+`
+
 const selectMaxSendToDeviceIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_send_to_device"
 
 type sendToDeviceStatements struct {
-	insertSendToDeviceMessageStmt  *sql.Stmt
-	selectSendToDeviceMessagesStmt *sql.Stmt
-	deleteSendToDeviceMessagesStmt *sql.Stmt
-	selectMaxSendToDeviceIDStmt    *sql.Stmt
+	insertSendToDeviceMessageStmt         *sql.Stmt
+	selectSendToDeviceMessagesStmt        *sql.Stmt
+	deleteSendToDeviceMessagesStmt        *sql.Stmt
+	deleteOldestSendToDeviceMessagesStmt  *sql.Stmt
+	deleteExpiredSendToDeviceMessagesStmt *sql.Stmt
+	selectMaxSendToDeviceIDStmt           *sql.Stmt
 }
 
 func NewPostgresSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
@@ -83,6 +108,9 @@ func NewPostgresSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
 	m.AddMigrations(sqlutil.Migration{
 		Version: "syncapi: drop sent_by_token",
 		Up:      deltas.UpRemoveSendToDeviceSentColumn,
+	}, sqlutil.Migration{
+		Version: "syncapi: add send-to-device created_ts",
+		Up:      deltas.UpAddSendToDeviceCreatedTS,
 	})
 	err = m.Up(context.Background())
 	if err != nil {
@@ -92,14 +120,16 @@ func NewPostgresSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
 		{&s.insertSendToDeviceMessageStmt, insertSendToDeviceMessageSQL},
 		{&s.selectSendToDeviceMessagesStmt, selectSendToDeviceMessagesSQL},
 		{&s.deleteSendToDeviceMessagesStmt, deleteSendToDeviceMessagesSQL},
+		{&s.deleteOldestSendToDeviceMessagesStmt, deleteOldestSendToDeviceMessagesSQL},
+		{&s.deleteExpiredSendToDeviceMessagesStmt, deleteExpiredSendToDeviceMessagesSQL},
 		{&s.selectMaxSendToDeviceIDStmt, selectMaxSendToDeviceIDSQL},
 	}.Prepare(db)
 }
 
 func (s *sendToDeviceStatements) InsertSendToDeviceMessage(
-	ctx context.Context, txn *sql.Tx, userID, deviceID, content string,
+	ctx context.Context, txn *sql.Tx, userID, deviceID, content string, createdTS spec.Timestamp,
 ) (pos types.StreamPosition, err error) {
-	err = sqlutil.TxStmt(txn, s.insertSendToDeviceMessageStmt).QueryRowContext(ctx, userID, deviceID, content).Scan(&pos)
+	err = sqlutil.TxStmt(txn, s.insertSendToDeviceMessageStmt).QueryRowContext(ctx, userID, deviceID, content, createdTS).Scan(&pos)
 	return
 }
 
@@ -145,6 +175,26 @@ func (s *sendToDeviceStatements) DeleteSendToDeviceMessages(
 	return
 }
 
+func (s *sendToDeviceStatements) DeleteOldestSendToDeviceMessages(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, keep int,
+) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteOldestSendToDeviceMessagesStmt).ExecContext(ctx, userID, deviceID, keep)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sendToDeviceStatements) DeleteExpiredSendToDeviceMessages(
+	ctx context.Context, txn *sql.Tx, before spec.Timestamp, limit int,
+) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteExpiredSendToDeviceMessagesStmt).ExecContext(ctx, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (s *sendToDeviceStatements) SelectMaxSendToDeviceMessageID(
 	ctx context.Context, txn *sql.Tx,
 ) (id int64, err error) {
@@ -0,0 +1,76 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/syncapi/storage/tables"
+	"github.com/neilalexander/harmony/syncapi/types"
+)
+
+const streamCheckpointsSchema = `
+-- Stores the latest known position of each sync stream, so that positions
+-- which aren't derived from the sync API's own tables, such as typing and
+-- device lists, carry on from where they were after a restart.
+CREATE TABLE IF NOT EXISTS syncapi_stream_checkpoints (
+	-- The name of the stream
+	stream_name TEXT NOT NULL PRIMARY KEY,
+	-- The latest position of the stream
+	stream_position BIGINT NOT NULL
+);
+`
+
+const upsertStreamCheckpointSQL = "" +
+	"INSERT INTO syncapi_stream_checkpoints (stream_name, stream_position) VALUES ($1, $2)" +
+	" ON CONFLICT (stream_name) DO UPDATE SET stream_position = GREATEST(syncapi_stream_checkpoints.stream_position, $2)"
+
+const selectStreamCheckpointsSQL = "" +
+	"SELECT stream_name, stream_position FROM syncapi_stream_checkpoints"
+
+type streamCheckpointsStatements struct {
+	upsertStreamCheckpointStmt  *sql.Stmt
+	selectStreamCheckpointsStmt *sql.Stmt
+}
+
+func NewPostgresStreamCheckpointsTable(db *sql.DB) (tables.StreamCheckpoints, error) {
+	_, err := db.Exec(streamCheckpointsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &streamCheckpointsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertStreamCheckpointStmt, upsertStreamCheckpointSQL},
+		{&s.selectStreamCheckpointsStmt, selectStreamCheckpointsSQL},
+	}.Prepare(db)
+}
+
+func (s *streamCheckpointsStatements) UpsertStreamCheckpoint(
+	ctx context.Context, txn *sql.Tx, streamName string, pos types.StreamPosition,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertStreamCheckpointStmt).ExecContext(ctx, streamName, pos)
+	return err
+}
+
+func (s *streamCheckpointsStatements) SelectStreamCheckpoints(
+	ctx context.Context, txn *sql.Tx,
+) (map[string]types.StreamPosition, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectStreamCheckpointsStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStreamCheckpoints: rows.close() failed")
+
+	checkpoints := map[string]types.StreamPosition{}
+	var streamName string
+	var pos types.StreamPosition
+	for rows.Next() {
+		if err = rows.Scan(&streamName, &pos); err != nil {
+			return nil, err
+		}
+		checkpoints[streamName] = pos
+	}
+	return checkpoints, rows.Err()
+}
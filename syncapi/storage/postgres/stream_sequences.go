@@ -0,0 +1,64 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// streamSequence is a sequence which stream positions are taken from.
+type streamSequence struct {
+	name        string
+	tables      []string // tables with an id column taken from the sequence
+	checkpoints []string // streams which are checkpointed with positions from the sequence
+}
+
+var streamSequences = []streamSequence{
+	{"syncapi_stream_id", []string{"syncapi_output_room_events", "syncapi_invite_events", "syncapi_account_data_type"}, []string{"pdu", "invite", "account_data"}},
+	{"syncapi_receipt_id", []string{"syncapi_receipts"}, []string{"receipt"}},
+	{"syncapi_send_to_device_id", []string{"syncapi_send_to_device"}, []string{"send_to_device"}},
+	{"syncapi_notification_data_id_seq", []string{"syncapi_notification_data"}, []string{"notification_data"}},
+	{"syncapi_presence_id", []string{"syncapi_presence"}, []string{"presence"}},
+	{"syncapi_relation_id", []string{"syncapi_relations"}, nil},
+}
+
+// advanceStreamSequences makes sure that each of the stream sequences is
+// past every position which has already been used or handed out to clients.
+// Sequences aren't always copied along with the tables when the database is
+// moved to a new server, and if they were behind, new events would be given
+// positions which clients have already synced past and so never see them.
+func advanceStreamSequences(ctx context.Context, db *sql.DB) error {
+	for _, seq := range streamSequences {
+		positions := make([]string, 0, len(seq.tables)+1)
+		for _, table := range seq.tables {
+			positions = append(positions, fmt.Sprintf("(SELECT COALESCE(MAX(id), 0) FROM %s)", table))
+		}
+		if len(seq.checkpoints) > 0 {
+			positions = append(positions, fmt.Sprintf(
+				"(SELECT COALESCE(MAX(stream_position), 0) FROM syncapi_stream_checkpoints WHERE stream_name IN ('%s'))",
+				strings.Join(seq.checkpoints, "','"),
+			))
+		}
+		var lastValue, used int64
+		err := db.QueryRowContext(ctx, fmt.Sprintf(
+			"SELECT (SELECT last_value FROM %s), GREATEST(%s)", seq.name, strings.Join(positions, ", "),
+		)).Scan(&lastValue, &used)
+		if err != nil {
+			return fmt.Errorf("unable to check sequence %q: %w", seq.name, err)
+		}
+		if lastValue >= used {
+			continue
+		}
+		logrus.Warnf(
+			"Sequence %q is at %d but positions up to %d have already been used, most likely because the database was copied without it. Advancing it.",
+			seq.name, lastValue, used,
+		)
+		if _, err = db.ExecContext(ctx, "SELECT setval($1, $2)", seq.name, used); err != nil {
+			return fmt.Errorf("unable to advance sequence %q: %w", seq.name, err)
+		}
+	}
+	return nil
+}
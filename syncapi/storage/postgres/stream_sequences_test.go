@@ -0,0 +1,57 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdvanceStreamSequences(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, close := test.PrepareDBConnectionString(t, dbType)
+		defer close()
+		cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+		d, err := NewDatabase(ctx, cm, &config.DatabaseOptions{ConnectionString: config.DataSource(connStr)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastValue := func(seq string) int64 {
+			t.Helper()
+			var value int64
+			if err = d.db.QueryRowContext(ctx, "SELECT last_value FROM "+seq).Scan(&value); err != nil {
+				t.Fatal(err)
+			}
+			return value
+		}
+
+		// As if the database was copied without its sequences, positions
+		// have been used both in the tables and in the checkpoints.
+		_, err = d.db.ExecContext(ctx, "INSERT INTO syncapi_stream_checkpoints (stream_name, stream_position) VALUES ('receipt', 50)")
+		assert.NoError(t, err)
+		_, err = d.db.ExecContext(ctx, "INSERT INTO syncapi_relations (id, room_id, event_id, child_event_id, child_event_type, rel_type)"+
+			" VALUES (40, '!room:test', '$parent', '$child', 'm.room.message', 'm.thread')")
+		assert.NoError(t, err)
+		// A sequence which is already ahead must be left alone.
+		_, err = d.db.ExecContext(ctx, "SELECT setval('syncapi_presence_id', 100)")
+		assert.NoError(t, err)
+
+		assert.NoError(t, advanceStreamSequences(ctx, d.db))
+		assert.Equal(t, int64(50), lastValue("syncapi_receipt_id"))
+		assert.Equal(t, int64(40), lastValue("syncapi_relation_id"))
+		assert.Equal(t, int64(100), lastValue("syncapi_presence_id"))
+
+		// New positions come after the ones which were used.
+		var next int64
+		assert.NoError(t, d.db.QueryRowContext(ctx, "SELECT nextval('syncapi_receipt_id')").Scan(&next))
+		assert.Equal(t, int64(51), next)
+
+		// Running it again changes nothing.
+		assert.NoError(t, advanceStreamSequences(ctx, d.db))
+		assert.Equal(t, int64(51), lastValue("syncapi_receipt_id"))
+	})
+}
@@ -21,6 +21,7 @@ import (
 
 	// Import the postgres database driver.
 	_ "github.com/lib/pq"
+	"github.com/neilalexander/harmony/internal/eventcompress"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/syncapi/storage/postgres/deltas"
@@ -42,15 +43,19 @@ func NewDatabase(ctx context.Context, cm *sqlutil.Connections, dbProperties *con
 	if d.db, d.writer, err = cm.Connection(dbProperties); err != nil {
 		return nil, err
 	}
+	compressor, err := eventcompress.NewCompressor(dbProperties.EventCompression)
+	if err != nil {
+		return nil, err
+	}
 	accountData, err := NewPostgresAccountDataTable(d.db)
 	if err != nil {
 		return nil, err
 	}
-	events, err := NewPostgresEventsTable(d.db)
+	events, err := NewPostgresEventsTable(d.db, compressor)
 	if err != nil {
 		return nil, err
 	}
-	currState, err := NewPostgresCurrentRoomStateTable(d.db)
+	currState, err := NewPostgresCurrentRoomStateTable(d.db, compressor)
 	if err != nil {
 		return nil, err
 	}
@@ -98,6 +103,14 @@ func NewDatabase(ctx context.Context, cm *sqlutil.Connections, dbProperties *con
 	if err != nil {
 		return nil, err
 	}
+	streamCheckpoints, err := NewPostgresStreamCheckpointsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	lazyLoadedMembers, err := NewPostgresLazyLoadedMembersTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 
 	// apply migrations which need multiple tables
 	m := sqlutil.NewMigrator(d.db)
@@ -106,11 +119,22 @@ func NewDatabase(ctx context.Context, cm *sqlutil.Connections, dbProperties *con
 			Version: "syncapi: set history visibility for existing events",
 			Up:      deltas.UpSetHistoryVisibility, // Requires current_room_state and output_room_events to be created.
 		},
+		sqlutil.Migration{
+			Version: "syncapi: populate relation sender and annotation key",
+			Up:      deltas.UpPopulateRelationAnnotations, // Requires relations and output_room_events to be created.
+		},
+		sqlutil.Migration{
+			Version: "syncapi: populate relation sender",
+			Up:      deltas.UpPopulateRelationSenders, // Requires relations and output_room_events to be created.
+		},
 	)
 	err = m.Up(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if err = advanceStreamSequences(ctx, d.db); err != nil {
+		return nil, err
+	}
 
 	d.Database = shared.Database{
 		DB:                  d.db,
@@ -129,6 +153,8 @@ func NewDatabase(ctx context.Context, cm *sqlutil.Connections, dbProperties *con
 		Ignores:             ignores,
 		Presence:            presence,
 		Relations:           relations,
+		StreamCheckpoints:   streamCheckpoints,
+		LazyLoadedMembers:   lazyLoadedMembers,
 	}
 	return &d, nil
 }
@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/tidwall/gjson"
 
@@ -54,6 +55,8 @@ type Database struct {
 	Ignores             tables.Ignores
 	Presence            tables.Presence
 	Relations           tables.Relations
+	StreamCheckpoints   tables.StreamCheckpoints
+	LazyLoadedMembers   tables.LazyLoadedMembers
 }
 
 func (d *Database) NewDatabaseSnapshot(ctx context.Context) (*DatabaseTransaction, error) {
@@ -174,6 +177,55 @@ func (d *Database) UpsertAccountData(
 	return
 }
 
+// RepairRoomState replaces the current state of the room with the state repaired by the
+// roomserver, and moves the event to a new stream position so that incremental syncs see it.
+func (d *Database) RepairRoomState(
+	ctx context.Context,
+	ev *rstypes.HeaderedEvent,
+	addStateEvents []*rstypes.HeaderedEvent,
+	addStateEventIDs, removeStateEventIDs []string,
+	historyVisibility gomatrixserverlib.HistoryVisibility,
+) (pduPosition types.StreamPosition, returnErr error) {
+	returnErr = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		roomID := ev.RoomID().String()
+		if err := d.CurrentRoomState.DeleteRoomStateForRoom(ctx, txn, roomID); err != nil {
+			return fmt.Errorf("d.CurrentRoomState.DeleteRoomStateForRoom: %w", err)
+		}
+
+		// The event will normally have been written before, in which case it
+		// would keep its old stream position if we inserted it again, and
+		// clients that have synced past it would never see the repaired state.
+		ev.Visibility = historyVisibility
+		pos, err := d.OutputEvents.RepositionEvent(ctx, txn, ev.EventID(), addStateEventIDs, removeStateEventIDs, historyVisibility)
+		var topoPosition types.StreamPosition
+		switch {
+		case err == sql.ErrNoRows:
+			if pos, err = d.OutputEvents.InsertEvent(ctx, txn, ev, addStateEventIDs, removeStateEventIDs, nil, false, historyVisibility); err != nil {
+				return fmt.Errorf("d.OutputEvents.InsertEvent: %w", err)
+			}
+			if topoPosition, err = d.Topology.InsertEventInTopology(ctx, txn, ev, pos); err != nil {
+				return fmt.Errorf("d.Topology.InsertEventInTopology: %w", err)
+			}
+		case err != nil:
+			return fmt.Errorf("d.OutputEvents.RepositionEvent: %w", err)
+		default:
+			if topoPosition, err = d.Topology.UpdateStreamPosition(ctx, txn, ev.EventID(), pos); err == sql.ErrNoRows {
+				topoPosition, err = d.Topology.InsertEventInTopology(ctx, txn, ev, pos)
+			}
+			if err != nil {
+				return fmt.Errorf("d.Topology.UpdateStreamPosition: %w", err)
+			}
+		}
+		pduPosition = pos
+
+		for i := range addStateEvents {
+			addStateEvents[i].Visibility = historyVisibility
+		}
+		return d.updateRoomState(ctx, txn, removeStateEventIDs, addStateEvents, pduPosition, topoPosition)
+	})
+	return pduPosition, returnErr
+}
+
 // handleBackwardExtremities adds this event as a backwards extremity if and only if we do not have all of
 // the events listed in the event's 'prev_events'. This function also updates the backwards extremities table
 // to account for the fact that the given event is no longer a backwards extremity, but may be marked as such.
@@ -432,7 +484,7 @@ func (d *Database) StoreNewSendForDeviceMessage(
 	// that we don't lock the table for writes in more than one place.
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		newPos, err = d.SendToDevice.InsertSendToDeviceMessage(
-			ctx, txn, userID, deviceID, string(j),
+			ctx, txn, userID, deviceID, string(j), spec.AsTimestamp(time.Now()),
 		)
 		return err
 	})
@@ -443,18 +495,67 @@ func (d *Database) StoreNewSendForDeviceMessage(
 }
 
 func (d *Database) CleanSendToDeviceUpdates(
-	ctx context.Context,
-	userID, deviceID string, before types.StreamPosition,
+	ctx context.Context, acks []types.SendToDeviceAck,
 ) (err error) {
+	if len(acks) == 0 {
+		return nil
+	}
 	if err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.SendToDevice.DeleteSendToDeviceMessages(ctx, txn, userID, deviceID, before)
+		for _, ack := range acks {
+			if err := d.SendToDevice.DeleteSendToDeviceMessages(ctx, txn, ack.UserID, ack.DeviceID, ack.Position); err != nil {
+				return fmt.Errorf("d.SendToDevice.DeleteSendToDeviceMessages: %w", err)
+			}
+		}
+		return nil
 	}); err != nil {
-		logrus.WithError(err).Errorf("Failed to clean up old send-to-device messages for user %q device %q", userID, deviceID)
+		logrus.WithError(err).Errorf("Failed to clean up old send-to-device messages for %d devices", len(acks))
 		return err
 	}
 	return nil
 }
 
+func (d *Database) EvictSendToDeviceMessages(
+	ctx context.Context, userID, deviceID string, keep int,
+) (evicted int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		evicted, err = d.SendToDevice.DeleteOldestSendToDeviceMessages(ctx, txn, userID, deviceID, keep)
+		return err
+	})
+	return
+}
+
+// sendToDeviceExpiryBatchSize is the number of expired send-to-device
+// messages deleted in each transaction, so that expiring a large backlog
+// doesn't hold the writer for a long time.
+const sendToDeviceExpiryBatchSize = 1000
+
+// sendToDeviceExpiryMaxBatches is the most batches of expired send-to-device
+// messages deleted in one go. Anything left over is expired the next time.
+const sendToDeviceExpiryMaxBatches = 100
+
+func (d *Database) ExpireSendToDeviceMessages(
+	ctx context.Context, before spec.Timestamp,
+) (expired int64, err error) {
+	for batch := 0; batch < sendToDeviceExpiryMaxBatches; batch++ {
+		if err = ctx.Err(); err != nil {
+			return expired, err
+		}
+		var deleted int64
+		err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+			deleted, err = d.SendToDevice.DeleteExpiredSendToDeviceMessages(ctx, txn, before, sendToDeviceExpiryBatchSize)
+			return err
+		})
+		if err != nil {
+			return expired, err
+		}
+		expired += deleted
+		if deleted < sendToDeviceExpiryBatchSize {
+			break
+		}
+	}
+	return expired, nil
+}
+
 // getMembershipFromEvent returns the value of content.membership iff the event is a state event
 // with type 'm.room.member' and state_key of userID. Otherwise, an empty string is returned.
 func getMembershipFromEvent(ctx context.Context, ev gomatrixserverlib.PDU, userID string, rsAPI api.SyncRoomserverAPI) (string, string) {
@@ -519,6 +620,82 @@ func (d *Database) UpdateIgnoresForUser(ctx context.Context, userID string, igno
 	})
 }
 
+func (d *Database) SelectLazyLoadedMembers(ctx context.Context, userID, deviceID, roomID string, targetUserIDs []string) (map[string]string, error) {
+	if len(targetUserIDs) == 0 {
+		return map[string]string{}, nil
+	}
+	return d.LazyLoadedMembers.SelectLazyLoadedMembers(ctx, nil, userID, deviceID, roomID, targetUserIDs)
+}
+
+func (d *Database) StoreLazyLoadedMembers(ctx context.Context, userID, deviceID, roomID string, members map[string]string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	targetUserIDs := make([]string, 0, len(members))
+	eventIDs := make([]string, 0, len(members))
+	for targetUserID, eventID := range members {
+		targetUserIDs = append(targetUserIDs, targetUserID)
+		eventIDs = append(eventIDs, eventID)
+	}
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.LazyLoadedMembers.UpsertLazyLoadedMembers(ctx, txn, userID, deviceID, roomID, targetUserIDs, eventIDs)
+	})
+}
+
+func (d *Database) ResetLazyLoadedMembers(ctx context.Context, userID, deviceID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.LazyLoadedMembers.DeleteLazyLoadedMembersForDevice(ctx, txn, userID, deviceID)
+	})
+}
+
+func (d *Database) InvalidateLazyLoadedMembers(ctx context.Context, roomID string, targetUserIDs []string) error {
+	if len(targetUserIDs) == 0 {
+		return nil
+	}
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.LazyLoadedMembers.DeleteLazyLoadedMembersForTargets(ctx, txn, roomID, targetUserIDs)
+	})
+}
+
+// streamCheckpointPositions maps the names which stream positions are
+// checkpointed under to the positions in the token.
+func streamCheckpointPositions(token *types.StreamingToken) map[string]*types.StreamPosition {
+	return map[string]*types.StreamPosition{
+		"pdu":               &token.PDUPosition,
+		"typing":            &token.TypingPosition,
+		"receipt":           &token.ReceiptPosition,
+		"send_to_device":    &token.SendToDevicePosition,
+		"invite":            &token.InvitePosition,
+		"account_data":      &token.AccountDataPosition,
+		"device_list":       &token.DeviceListPosition,
+		"notification_data": &token.NotificationDataPosition,
+		"presence":          &token.PresencePosition,
+	}
+}
+
+func (d *Database) StoreStreamCheckpoint(ctx context.Context, token types.StreamingToken) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for streamName, pos := range streamCheckpointPositions(&token) {
+			if err := d.StreamCheckpoints.UpsertStreamCheckpoint(ctx, txn, streamName, *pos); err != nil {
+				return fmt.Errorf("d.StreamCheckpoints.UpsertStreamCheckpoint: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) StreamCheckpoint(ctx context.Context) (types.StreamingToken, error) {
+	var token types.StreamingToken
+	checkpoints, err := d.StreamCheckpoints.SelectStreamCheckpoints(ctx, nil)
+	if err != nil {
+		return token, fmt.Errorf("d.StreamCheckpoints.SelectStreamCheckpoints: %w", err)
+	}
+	for streamName, pos := range streamCheckpointPositions(&token) {
+		*pos = checkpoints[streamName]
+	}
+	return token, nil
+}
+
 func (d *Database) UpdatePresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, lastActiveTS spec.Timestamp, fromSync bool) (types.StreamPosition, error) {
 	var pos types.StreamPosition
 	var err error
@@ -529,6 +706,12 @@ func (d *Database) UpdatePresence(ctx context.Context, userID string, presence t
 	return pos, err
 }
 
+func (d *Database) UpdateLastActive(ctx context.Context, userID string, lastActiveTS spec.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Presence.UpdateLastActive(ctx, txn, userID, lastActiveTS)
+	})
+}
+
 func (d *Database) GetPresences(ctx context.Context, userIDs []string) ([]*types.PresenceInternal, error) {
 	return d.Presence.GetPresenceForUsers(ctx, nil, userIDs)
 }
@@ -545,6 +728,10 @@ func (d *Database) ReIndex(ctx context.Context, limit, afterID int64) (map[int64
 	})
 }
 
+func (d *Database) EventsBySender(ctx context.Context, sender string, afterID types.StreamPosition, limit int) ([]types.StreamEvent, error) {
+	return d.OutputEvents.SelectEventsBySender(ctx, nil, sender, afterID, limit)
+}
+
 func (d *Database) UpdateRelations(ctx context.Context, event *rstypes.HeaderedEvent) error {
 	// No need to unmarshal if the event is a redaction
 	if event.Type() == spec.MRoomRedaction {
@@ -567,11 +754,18 @@ func (d *Database) UpdateRelations(ctx context.Context, event *rstypes.HeaderedE
 			return d.Relations.InsertRelation(
 				ctx, txn, event.RoomID().String(), content.Relations.EventID,
 				event.EventID(), event.Type(), content.Relations.RelationType,
+				event.UserID.String(), content.Relations.Key,
 			)
 		})
 	}
 }
 
+// AnnotationExists returns true if the sender has already annotated the
+// event with an event of the given type and the given key.
+func (d *Database) AnnotationExists(ctx context.Context, roomID, eventID, eventType, sender, key string) (bool, error) {
+	return d.Relations.SelectAnnotationExists(ctx, nil, roomID, eventID, eventType, sender, key)
+}
+
 func (d *Database) RedactRelations(ctx context.Context, roomID, redactedEventID string) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		return d.Relations.DeleteRelation(ctx, txn, roomID, redactedEventID)
@@ -101,3 +101,62 @@ func TestIgnores(t *testing.T) {
 		}
 	})
 }
+
+func TestLazyLoadedMembers(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		syncDB, closeDB := newSyncDB(t, dbType)
+		defer closeDB()
+		ctx := context.Background()
+		roomID := "!room:test"
+		targets := []string{bob.ID, charlie.ID}
+
+		for _, deviceID := range []string{"DEVICE1", "DEVICE2"} {
+			if err := syncDB.StoreLazyLoadedMembers(ctx, alice.ID, deviceID, roomID, map[string]string{
+				bob.ID:     "$bob",
+				charlie.ID: "$charlie",
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := syncDB.SelectLazyLoadedMembers(ctx, alice.ID, "DEVICE1", roomID, targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]string{bob.ID: "$bob", charlie.ID: "$charlie"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+
+		// A membership change is forgotten for every device.
+		if err = syncDB.InvalidateLazyLoadedMembers(ctx, roomID, []string{bob.ID}); err != nil {
+			t.Fatal(err)
+		}
+		for _, deviceID := range []string{"DEVICE1", "DEVICE2"} {
+			if got, err = syncDB.SelectLazyLoadedMembers(ctx, alice.ID, deviceID, roomID, targets); err != nil {
+				t.Fatal(err)
+			}
+			if want := map[string]string{charlie.ID: "$charlie"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: got %v, want %v", deviceID, got, want)
+			}
+		}
+
+		// Resetting a device only forgets what that device was sent.
+		if err = syncDB.ResetLazyLoadedMembers(ctx, alice.ID, "DEVICE1"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err = syncDB.SelectLazyLoadedMembers(ctx, alice.ID, "DEVICE1", roomID, targets); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Fatalf("expected nothing for the reset device, got %v", got)
+		}
+		if got, err = syncDB.SelectLazyLoadedMembers(ctx, alice.ID, "DEVICE2", roomID, targets); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 {
+			t.Fatalf("expected the other device to be unaffected, got %v", got)
+		}
+	})
+}
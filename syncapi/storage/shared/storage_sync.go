@@ -89,8 +89,8 @@ func (d *DatabaseTransaction) CurrentState(ctx context.Context, roomID string, s
 	return d.CurrentRoomState.SelectCurrentState(ctx, d.txn, roomID, stateFilterPart, excludeEventIDs)
 }
 
-func (d *DatabaseTransaction) RoomIDsWithMembership(ctx context.Context, userID string, membership string) ([]string, error) {
-	return d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, d.txn, userID, membership)
+func (d *DatabaseTransaction) RoomIDsWithMembership(ctx context.Context, userID string, membership string, roomFilter *synctypes.RoomFilter) ([]string, error) {
+	return d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, d.txn, userID, membership, roomFilter)
 }
 
 func (d *DatabaseTransaction) MembershipCount(ctx context.Context, roomID, membership string, pos types.StreamPosition) (int, error) {
@@ -154,6 +154,10 @@ func (d *DatabaseTransaction) GetRoomSummary(ctx context.Context, roomID, userID
 	return summary, nil
 }
 
+func (d *DatabaseTransaction) RoomBumpStamps(ctx context.Context, userID string, roomIDs []string) (map[string]types.StreamPosition, error) {
+	return d.OutputEvents.SelectRoomBumpStamps(ctx, d.txn, userID, roomIDs)
+}
+
 func (d *DatabaseTransaction) RecentEvents(ctx context.Context, roomIDs []string, r types.Range, eventFilter *synctypes.RoomEventFilter, chronologicalOrder bool, onlySyncEvents bool) (map[string]types.RecentEvents, error) {
 	return d.OutputEvents.SelectRecentEvents(ctx, d.txn, roomIDs, r, eventFilter, chronologicalOrder, onlySyncEvents)
 }
@@ -213,14 +217,17 @@ func (d *DatabaseTransaction) GetStateEventsForRoom(
 
 // GetAccountDataInRange returns all account data for a given user inserted or
 // updated between two given positions
+// Global account data is filtered by accountDataFilterPart and room account
+// data by roomFilter.
 // Returns a map following the format data[roomID] = []dataTypes
 // If no data is retrieved, returns an empty map
 // If there was an issue with the retrieval, returns an error
 func (d *DatabaseTransaction) GetAccountDataInRange(
 	ctx context.Context, userID string, r types.Range,
 	accountDataFilterPart *synctypes.EventFilter,
+	roomFilter *synctypes.RoomFilter,
 ) (map[string][]string, types.StreamPosition, error) {
-	return d.AccountData.SelectAccountDataInRange(ctx, d.txn, userID, r, accountDataFilterPart)
+	return d.AccountData.SelectAccountDataInRange(ctx, d.txn, userID, r, accountDataFilterPart, roomFilter)
 }
 
 func (d *DatabaseTransaction) GetEventsInTopologicalRange(
@@ -316,14 +323,17 @@ func (d *DatabaseTransaction) GetBackwardTopologyPos(
 
 // GetStateDeltas returns the state deltas between fromPos and toPos,
 // exclusive of oldPos, inclusive of newPos, for the rooms in which
-// the user has new membership events.
+// the user has new membership events. Rooms which aren't included by
+// the room filter are skipped entirely.
 // A list of joined room IDs is also returned in case the caller needs it.
 // nolint:gocyclo
 func (d *DatabaseTransaction) GetStateDeltas(
 	ctx context.Context, device *userapi.Device,
 	r types.Range, userID string,
-	stateFilter *synctypes.StateFilter, rsAPI api.SyncRoomserverAPI,
+	roomFilter *synctypes.RoomFilter, rsAPI api.SyncRoomserverAPI,
 ) (deltas []types.StateDelta, joinedRoomsIDs []string, err error) {
+	stateFilter := &roomFilter.State
+
 	// Implement membership change algorithm: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L821
 	// - Get membership list changes for this user in this sync response
 	// - For each room which has membership list changes:
@@ -335,7 +345,7 @@ func (d *DatabaseTransaction) GetStateDeltas(
 
 	// Look up all memberships for the user. We only care about rooms that a
 	// user has ever interacted with — joined to, kicked/banned from, left.
-	memberships, err := d.CurrentRoomState.SelectRoomIDsWithAnyMembership(ctx, d.txn, userID)
+	memberships, err := d.CurrentRoomState.SelectRoomIDsWithAnyMembership(ctx, d.txn, userID, roomFilter)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil, nil
@@ -457,11 +467,13 @@ func (d *DatabaseTransaction) GetStateDeltas(
 func (d *DatabaseTransaction) GetStateDeltasForFullStateSync(
 	ctx context.Context, device *userapi.Device,
 	r types.Range, userID string,
-	stateFilter *synctypes.StateFilter, rsAPI api.SyncRoomserverAPI,
+	roomFilter *synctypes.RoomFilter, rsAPI api.SyncRoomserverAPI,
 ) ([]types.StateDelta, []string, error) {
+	stateFilter := &roomFilter.State
+
 	// Look up all memberships for the user. We only care about rooms that a
 	// user has ever interacted with — joined to, kicked/banned from, left.
-	memberships, err := d.CurrentRoomState.SelectRoomIDsWithAnyMembership(ctx, d.txn, userID)
+	memberships, err := d.CurrentRoomState.SelectRoomIDsWithAnyMembership(ctx, d.txn, userID, roomFilter)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil, nil
@@ -627,6 +639,9 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 		if err := d.Receipts.PurgeReceipts(ctx, txn, roomID); err != nil {
 			return fmt.Errorf("failed to purge receipts: %w", err)
 		}
+		if err := d.LazyLoadedMembers.PurgeLazyLoadedMembers(ctx, txn, roomID); err != nil {
+			return fmt.Errorf("failed to purge lazy-loaded members: %w", err)
+		}
 		return nil
 	})
 }
@@ -650,6 +665,24 @@ func (d *DatabaseTransaction) MaxStreamPositionForRelations(ctx context.Context)
 	return types.StreamPosition(id), err
 }
 
+func (d *DatabaseTransaction) Aggregations(ctx context.Context, roomIDs, eventIDs, senders []string, userID string, annotationLimit int) (*types.Aggregations, error) {
+	if len(eventIDs) == 0 {
+		return &types.Aggregations{}, nil
+	}
+	return d.Relations.SelectAggregations(ctx, d.txn, roomIDs, eventIDs, senders, userID, annotationLimit)
+}
+
+func (d *DatabaseTransaction) ThreadRoots(ctx context.Context, roomID, participant string, before types.StreamPosition, limit int) ([]types.RelationEntry, error) {
+	if before == 0 {
+		maxID, err := d.MaxStreamPositionForRelations(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("d.MaxStreamPositionForRelations: %w", err)
+		}
+		before = maxID + 1
+	}
+	return d.Relations.SelectThreadRoots(ctx, d.txn, roomID, participant, before, limit)
+}
+
 func isStatefilterEmpty(filter *synctypes.StateFilter) bool {
 	if filter == nil {
 		return true
@@ -665,6 +698,8 @@ func isStatefilterEmpty(filter *synctypes.StateFilter) bool {
 		return false
 	case filter.NotRooms != nil && len(*filter.NotRooms) > 0:
 		return false
+	case filter.Rooms != nil:
+		return false
 	case filter.ContainsURL != nil:
 		return false
 	default:
@@ -8,6 +8,7 @@ import (
 	"math"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -602,7 +603,9 @@ func TestSendToDeviceBehaviour(t *testing.T) {
 			}
 		})
 
-		err = db.CleanSendToDeviceUpdates(context.Background(), alice.ID, deviceID, streamPos)
+		err = db.CleanSendToDeviceUpdates(context.Background(), []types.SendToDeviceAck{
+			{UserID: alice.ID, DeviceID: deviceID, Position: streamPos},
+		})
 		if err != nil {
 			return
 		}
@@ -658,6 +661,36 @@ func TestSendToDeviceBehaviour(t *testing.T) {
 				}
 			}
 		})
+
+		// Only the newest messages should be kept when the device is over the limit.
+		evicted, err := db.EvictSendToDeviceMessages(ctx, alice.ID, deviceID, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if evicted != 7 {
+			t.Fatalf("expected 7 messages to be evicted, got %d", evicted)
+		}
+		WithSnapshot(t, db, func(snapshot storage.DatabaseTransaction) {
+			_, events, err := snapshot.SendToDeviceUpdatesForSync(ctx, alice.ID, deviceID, 0, lastPos)
+			if err != nil {
+				t.Fatalf("unable to get events: %v", err)
+			}
+			if len(events) != 3 {
+				t.Fatalf("expected 3 messages after eviction, got %d", len(events))
+			}
+			if want := json.RawMessage(`{"count":7}`); !bytes.Equal(events[0].Content, want) {
+				t.Fatalf("expected oldest messages to be evicted, got %s", string(events[0].Content))
+			}
+		})
+
+		// Messages stored before the expiry time should all be dropped.
+		expired, err := db.ExpireSendToDeviceMessages(ctx, spec.AsTimestamp(time.Now().Add(time.Minute)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expired != 3 {
+			t.Fatalf("expected 3 messages to be expired, got %d", expired)
+		}
 	})
 }
 
@@ -1015,6 +1048,120 @@ func TestRecentEvents(t *testing.T) {
 			assert.Equal(t, 1, len(recentEvents.Events), "unexpected recent events for room")
 			assert.Equal(t, origEvents[len(origEvents)-1].EventID(), recentEvents.Events[0].EventID())
 		}
+
+		// rooms and not_rooms in the filter exclude rooms from the results
+		filter.Rooms = &[]string{room1.ID}
+		roomEvs, err = transaction.RecentEvents(ctx, roomIDs, types.Range{From: 0, To: 100}, &filter, true, true)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(roomEvs), "unexpected recent events response")
+		assert.Contains(t, roomEvs, room1.ID)
+
+		filter.Rooms = nil
+		filter.NotRooms = &[]string{room1.ID}
+		roomEvs, err = transaction.RecentEvents(ctx, roomIDs, types.Range{From: 0, To: 100}, &filter, true, true)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(roomEvs), "unexpected recent events response")
+		assert.Contains(t, roomEvs, room2.ID)
+
+		// the membership lookup applies the room filter too
+		joinedRoomIDs, err := transaction.RoomIDsWithMembership(ctx, alice.ID, spec.Join, &synctypes.RoomFilter{NotRooms: &[]string{room1.ID}})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{room2.ID}, joinedRoomIDs)
+	})
+}
+
+func TestRoomBumpStamps(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room1 := test.NewRoom(t, alice)
+	room2 := test.NewRoom(t, alice)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		t.Cleanup(close)
+
+		// Alice's own join is the most recent bump event in either room so far.
+		MustWriteEvents(t, db, room1.Events())
+		positions := MustWriteEvents(t, db, room2.Events())
+		room2AliceJoined := positions[1]
+
+		// A message bumps the first room above the second, but a state event doesn't.
+		positions = MustWriteEvents(t, db, []*rstypes.HeaderedEvent{
+			room1.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"}),
+			room2.CreateAndInsert(t, alice, spec.MRoomTopic, map[string]interface{}{"topic": "boring"}),
+		})
+		room1Message := positions[0]
+
+		// Bob joining the second room only bumps it for Bob.
+		positions = MustWriteEvents(t, db, []*rstypes.HeaderedEvent{
+			room2.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID)),
+		})
+		bobJoined := positions[0]
+
+		transaction, err := db.NewDatabaseTransaction(ctx)
+		assert.NoError(t, err)
+		defer transaction.Rollback()
+
+		roomIDs := []string{room1.ID, room2.ID, "!unknown:test"}
+		stamps, err := transaction.RoomBumpStamps(ctx, alice.ID, roomIDs)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]types.StreamPosition{room1.ID: room1Message, room2.ID: room2AliceJoined}, stamps)
+
+		stamps, err = transaction.RoomBumpStamps(ctx, bob.ID, roomIDs)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]types.StreamPosition{room1.ID: room1Message, room2.ID: bobJoined}, stamps)
+	})
+}
+
+func TestRepairRoomState(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	topic := room.CreateAndInsert(t, alice, spec.MRoomTopic, map[string]interface{}{"topic": "wrong"})
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		t.Cleanup(close)
+		positions := MustWriteEvents(t, db, room.Events())
+
+		// The repaired state leaves out the topic, which was sent by the event
+		// that the repair is attached to, as it was the latest in the room.
+		var stateEvents []*rstypes.HeaderedEvent
+		var stateEventIDs []string
+		for _, ev := range room.Events() {
+			if ev.StateKey() != nil && ev.EventID() != topic.EventID() {
+				stateEvents = append(stateEvents, ev)
+				stateEventIDs = append(stateEventIDs, ev.EventID())
+			}
+		}
+		pos, err := db.RepairRoomState(ctx, topic, stateEvents, stateEventIDs, []string{topic.EventID()}, gomatrixserverlib.HistoryVisibilityShared)
+		assert.NoError(t, err)
+
+		// The event must have moved past everything else in the stream, or
+		// clients which have already synced past it won't see the new state.
+		assert.Greater(t, pos, positions[len(positions)-1])
+
+		WithSnapshot(t, db, func(snapshot storage.DatabaseTransaction) {
+			latest, err := snapshot.MaxStreamPositionForPDUs(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, pos, latest)
+
+			ev, err := snapshot.GetStateEvent(ctx, room.ID, spec.MRoomTopic, "")
+			assert.NoError(t, err)
+			assert.Nil(t, ev)
+
+			stateFilter := synctypes.DefaultStateFilter()
+			state, err := snapshot.CurrentState(ctx, room.ID, &stateFilter, nil)
+			assert.NoError(t, err)
+			assert.Len(t, state, len(stateEventIDs))
+
+			// The event is only returned once, at its new position.
+			filter := synctypes.DefaultRoomEventFilter()
+			recent, err := snapshot.RecentEvents(ctx, []string{room.ID}, types.Range{From: positions[len(positions)-2], To: pos}, &filter, true, true)
+			assert.NoError(t, err)
+			if events := recent[room.ID].Events; assert.Len(t, events, 1) {
+				assert.Equal(t, topic.EventID(), events[0].EventID())
+			}
+		})
 	})
 }
 
@@ -1066,3 +1213,35 @@ func TestRedaction(t *testing.T) {
 		}
 	})
 }
+
+func TestStreamCheckpoint(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+
+		checkpoint, err := db.StreamCheckpoint(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkpoint != (types.StreamingToken{}) {
+			t.Fatalf("expected an empty checkpoint, got %s", checkpoint.String())
+		}
+
+		want := types.StreamingToken{PDUPosition: 10, TypingPosition: 5, DeviceListPosition: 7}
+		if err = db.StoreStreamCheckpoint(ctx, want); err != nil {
+			t.Fatal(err)
+		}
+		// Storing earlier positions must not move the checkpoint backwards.
+		if err = db.StoreStreamCheckpoint(ctx, types.StreamingToken{PDUPosition: 3, TypingPosition: 6}); err != nil {
+			t.Fatal(err)
+		}
+		want.TypingPosition = 6
+		checkpoint, err = db.StreamCheckpoint(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkpoint != want {
+			t.Fatalf("got checkpoint %s, want %s", checkpoint.String(), want.String())
+		}
+	})
+}
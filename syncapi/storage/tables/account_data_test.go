@@ -0,0 +1,118 @@
+package tables_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/syncapi/storage/postgres"
+	"github.com/neilalexander/harmony/syncapi/storage/tables"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/syncapi/types"
+	"github.com/neilalexander/harmony/test"
+)
+
+func newAccountDataTable(t *testing.T, dbType test.DBType) (tables.AccountData, func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	if err != nil {
+		t.Fatalf("failed to open db: %s", err)
+	}
+
+	var tab tables.AccountData
+	switch dbType {
+	case test.DBTypePostgres:
+		tab, err = postgres.NewPostgresAccountDataTable(db)
+	}
+	if err != nil {
+		t.Fatalf("failed to make new table: %s", err)
+	}
+	return tab, close
+}
+
+func TestAccountDataTableFilters(t *testing.T) {
+	ctx := context.Background()
+	alice := "@alice:server"
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := newAccountDataTable(t, dbType)
+		defer close()
+
+		for _, data := range [][2]string{
+			{"", "m.push_rules"},
+			{"!a:server", "m.tag"},
+			{"!a:server", "m.fully_read"},
+			{"!b:server", "m.tag"},
+		} {
+			if _, err := tab.InsertAccountData(ctx, nil, alice, data[0], data[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		max, err := tab.SelectMaxAccountDataID(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := types.Range{From: 0, To: types.StreamPosition(max)}
+
+		notRooms := []string{"!b:server"}
+		roomTypes := []string{"m.tag"}
+		globalTypes := []string{"m.direct"}
+		testCases := []struct {
+			name       string
+			filter     synctypes.EventFilter
+			roomFilter synctypes.RoomFilter
+			want       map[string][]string
+		}{
+			{
+				name:       "no filters",
+				filter:     synctypes.DefaultEventFilter(),
+				roomFilter: synctypes.DefaultFilter().Room,
+				want: map[string][]string{
+					"":          {"m.push_rules"},
+					"!a:server": {"m.tag", "m.fully_read"},
+					"!b:server": {"m.tag"},
+				},
+			},
+			{
+				name:   "global types don't filter room data",
+				filter: synctypes.EventFilter{Limit: 10, Types: &globalTypes},
+				roomFilter: synctypes.RoomFilter{
+					AccountData: synctypes.RoomEventFilter{Types: &roomTypes},
+				},
+				want: map[string][]string{
+					"!a:server": {"m.tag"},
+					"!b:server": {"m.tag"},
+				},
+			},
+			{
+				name:   "rooms can be excluded",
+				filter: synctypes.DefaultEventFilter(),
+				roomFilter: synctypes.RoomFilter{
+					NotRooms: &notRooms,
+				},
+				want: map[string][]string{
+					"":          {"m.push_rules"},
+					"!a:server": {"m.tag", "m.fully_read"},
+				},
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				data, pos, err := tab.SelectAccountDataInRange(ctx, nil, alice, r, &tc.filter, &tc.roomFilter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(data, tc.want) {
+					t.Fatalf("got %v, want %v", data, tc.want)
+				}
+				if pos == 0 || pos > r.To {
+					t.Fatalf("unexpected position %d", pos)
+				}
+			})
+		}
+	})
+}
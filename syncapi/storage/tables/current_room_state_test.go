@@ -29,7 +29,7 @@ func newCurrentRoomStateTable(t *testing.T, dbType test.DBType) (tables.CurrentR
 	var tab tables.CurrentRoomState
 	switch dbType {
 	case test.DBTypePostgres:
-		tab, err = postgres.NewPostgresCurrentRoomStateTable(db)
+		tab, err = postgres.NewPostgresCurrentRoomStateTable(db, nil)
 	}
 	if err != nil {
 		t.Fatalf("failed to make new table: %s", err)
@@ -31,7 +31,7 @@ import (
 type AccountData interface {
 	InsertAccountData(ctx context.Context, txn *sql.Tx, userID, roomID, dataType string) (pos types.StreamPosition, err error)
 	// SelectAccountDataInRange returns a map of room ID to a list of `dataType`.
-	SelectAccountDataInRange(ctx context.Context, txn *sql.Tx, userID string, r types.Range, accountDataEventFilter *synctypes.EventFilter) (data map[string][]string, pos types.StreamPosition, err error)
+	SelectAccountDataInRange(ctx context.Context, txn *sql.Tx, userID string, r types.Range, accountDataEventFilter *synctypes.EventFilter, roomFilter *synctypes.RoomFilter) (data map[string][]string, pos types.StreamPosition, err error)
 	SelectMaxAccountDataID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
 
@@ -56,11 +56,22 @@ type Events interface {
 		excludeFromSync bool,
 		historyVisibility gomatrixserverlib.HistoryVisibility,
 	) (streamPos types.StreamPosition, err error)
+	// RepositionEvent moves an event which is already known to a new stream position, replacing
+	// its state delta, so that incremental syncs see it again. Returns sql.ErrNoRows if the
+	// event isn't known.
+	RepositionEvent(
+		ctx context.Context, txn *sql.Tx,
+		eventID string, addState, removeState []string,
+		historyVisibility gomatrixserverlib.HistoryVisibility,
+	) (streamPos types.StreamPosition, err error)
 	// SelectRecentEvents returns events between the two stream positions: exclusive of low and inclusive of high.
 	// If onlySyncEvents has a value of true, only returns the events that aren't marked as to exclude from sync.
 	// Returns up to `limit` events. Returns `limited=true` if there are more events in this range but we hit the `limit`.
 	SelectRecentEvents(ctx context.Context, txn *sql.Tx, roomIDs []string, r types.Range, eventFilter *synctypes.RoomEventFilter, chronologicalOrder bool, onlySyncEvents bool) (map[string]types.RecentEvents, error)
 	SelectEvents(ctx context.Context, txn *sql.Tx, eventIDs []string, filter *synctypes.RoomEventFilter, preserveOrder bool) ([]types.StreamEvent, error)
+	// SelectRoomBumpStamps returns the stream position of the most recent activity in each
+	// room which should move it up the user's room list. Rooms without any are omitted.
+	SelectRoomBumpStamps(ctx context.Context, txn *sql.Tx, userID string, roomIDs []string) (map[string]types.StreamPosition, error)
 	UpdateEventJSON(ctx context.Context, txn *sql.Tx, event *rstypes.HeaderedEvent) error
 	// DeleteEventsForRoom removes all event information for a room. This should only be done when removing the room entirely.
 	DeleteEventsForRoom(ctx context.Context, txn *sql.Tx, roomID string) (err error)
@@ -71,6 +82,9 @@ type Events interface {
 
 	PurgeEvents(ctx context.Context, txn *sql.Tx, roomID string) error
 	ReIndex(ctx context.Context, txn *sql.Tx, limit, offset int64, types []string) (map[int64]rstypes.HeaderedEvent, error)
+	// SelectEventsBySender returns up to limit events sent by the sender after the
+	// given stream position, in the order they were received.
+	SelectEventsBySender(ctx context.Context, txn *sql.Tx, sender string, afterID types.StreamPosition, limit int) ([]types.StreamEvent, error)
 }
 
 // Topology keeps track of the depths and stream positions for all events.
@@ -79,6 +93,9 @@ type Topology interface {
 	// InsertEventInTopology inserts the given event in the room's topology, based on the event's depth.
 	// `pos` is the stream position of this event in the events table, and is used to order events which have the same depth.
 	InsertEventInTopology(ctx context.Context, txn *sql.Tx, event *rstypes.HeaderedEvent, pos types.StreamPosition) (topoPos types.StreamPosition, err error)
+	// UpdateStreamPosition updates the stream position of an event already in the topology, after
+	// it has been moved with RepositionEvent.
+	UpdateStreamPosition(ctx context.Context, txn *sql.Tx, eventID string, pos types.StreamPosition) (topoPos types.StreamPosition, err error)
 	// SelectEventIDsInRange selects the IDs and the topological position of events whose depths are within a given range in a given room's topological order.
 	// Events with `minDepth` are *exclusive*, as is the event which has exactly `minDepth`,`maxStreamPos`. Returns the eventIDs and start/end topological tokens.
 	// `maxStreamPos` is only used when events have the same depth as `maxDepth`, which results in events less than `maxStreamPos` being returned.
@@ -100,9 +117,11 @@ type CurrentRoomState interface {
 	// SelectCurrentState returns all the current state events for the given room.
 	SelectCurrentState(ctx context.Context, txn *sql.Tx, roomID string, stateFilter *synctypes.StateFilter, excludeEventIDs []string) ([]*rstypes.HeaderedEvent, error)
 	// SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
-	SelectRoomIDsWithMembership(ctx context.Context, txn *sql.Tx, userID string, membership string) ([]string, error)
+	// If roomFilter is not nil, only the rooms it includes are returned.
+	SelectRoomIDsWithMembership(ctx context.Context, txn *sql.Tx, userID string, membership string, roomFilter *synctypes.RoomFilter) ([]string, error)
 	// SelectRoomIDsWithAnyMembership returns a map of all memberships for the given user.
-	SelectRoomIDsWithAnyMembership(ctx context.Context, txn *sql.Tx, userID string) (map[string]string, error)
+	// If roomFilter is not nil, only the rooms it includes are returned.
+	SelectRoomIDsWithAnyMembership(ctx context.Context, txn *sql.Tx, userID string, roomFilter *synctypes.RoomFilter) (map[string]string, error)
 	// SelectJoinedUsers returns a map of room ID to a list of joined user IDs.
 	SelectJoinedUsers(ctx context.Context, txn *sql.Tx) (map[string][]string, error)
 	// SelectJoinedUsersInRoom returns a map of room ID to a list of joined user IDs for a given room.
@@ -163,9 +182,13 @@ type BackwardsExtremities interface {
 // sync parameter isn't later then we will keep including the updates in the
 // sync response, as the client is seemingly trying to repeat the same /sync.
 type SendToDevice interface {
-	InsertSendToDeviceMessage(ctx context.Context, txn *sql.Tx, userID, deviceID, content string) (pos types.StreamPosition, err error)
+	InsertSendToDeviceMessage(ctx context.Context, txn *sql.Tx, userID, deviceID, content string, createdTS spec.Timestamp) (pos types.StreamPosition, err error)
 	SelectSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, from, to types.StreamPosition) (lastPos types.StreamPosition, events []types.SendToDeviceEvent, err error)
 	DeleteSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, from types.StreamPosition) (err error)
+	// DeleteOldestSendToDeviceMessages keeps only the newest messages for the device, returning how many were deleted.
+	DeleteOldestSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, keep int) (int64, error)
+	// DeleteExpiredSendToDeviceMessages deletes up to limit messages stored before the given time, returning how many were deleted.
+	DeleteExpiredSendToDeviceMessages(ctx context.Context, txn *sql.Tx, before spec.Timestamp, limit int) (int64, error)
 	SelectMaxSendToDeviceMessageID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
 
@@ -207,6 +230,7 @@ type Ignores interface {
 
 type Presence interface {
 	UpsertPresence(ctx context.Context, txn *sql.Tx, userID string, statusMsg *string, presence types.Presence, lastActiveTS spec.Timestamp, fromSync bool) (pos types.StreamPosition, err error)
+	UpdateLastActive(ctx context.Context, txn *sql.Tx, userID string, lastActiveTS spec.Timestamp) error
 	GetPresenceForUsers(ctx context.Context, txn *sql.Tx, userIDs []string) (presence []*types.PresenceInternal, err error)
 	GetMaxPresenceID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error)
 	GetPresenceAfter(ctx context.Context, txn *sql.Tx, after types.StreamPosition, filter synctypes.EventFilter) (presences map[string]*types.PresenceInternal, err error)
@@ -215,7 +239,8 @@ type Presence interface {
 type Relations interface {
 	// Inserts a relation which refers from the child event ID to the event ID in the given room.
 	// If the relation already exists then this function will do nothing and return no error.
-	InsertRelation(ctx context.Context, txn *sql.Tx, roomID, eventID, childEventID, childEventType, relType string) (err error)
+	// The sender and annotation key are stored so that annotations can be aggregated.
+	InsertRelation(ctx context.Context, txn *sql.Tx, roomID, eventID, childEventID, childEventType, relType, sender, annotationKey string) (err error)
 	// Deletes a relation which already exists as the result of an event redaction. If the relation
 	// does not exist then this function will do nothing and return no error.
 	DeleteRelation(ctx context.Context, txn *sql.Tx, roomID, childEventID string) error
@@ -229,4 +254,41 @@ type Relations interface {
 	// should be if there are no boundaries supplied (i.e. we want to work backwards but don't have a
 	// "from" or want to work forwards and don't have a "to").
 	SelectMaxRelationID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// SelectAnnotationExists returns true if the sender has already annotated the event with
+	// an event of the given type and the given key.
+	SelectAnnotationExists(ctx context.Context, txn *sql.Tx, roomID, eventID, eventType, sender, key string) (bool, error)
+	// SelectAggregations returns the aggregations of each of the given events in one query:
+	// the number of annotations with each type and key, most used first and up to limit keys
+	// per event, the number of m.thread replies, the latest reply and whether the user has
+	// replied, and the latest m.replace edit which was sent by the sender of the event. The room
+	// IDs, event IDs and senders are paired by index. Events without aggregations are omitted.
+	SelectAggregations(ctx context.Context, txn *sql.Tx, roomIDs, eventIDs, senders []string, userID string, limit int) (*types.Aggregations, error)
+	// SelectThreadRoots returns up to limit thread roots in the room whose latest reply is before
+	// the given position, most recently replied to first. The position of each entry is that of
+	// its latest reply. If a participant is given then only the threads which they have replied
+	// to are returned.
+	SelectThreadRoots(ctx context.Context, txn *sql.Tx, roomID, participant string, before types.StreamPosition, limit int) ([]types.RelationEntry, error)
+}
+
+type StreamCheckpoints interface {
+	// UpsertStreamCheckpoint stores the position of the named stream, unless
+	// a later position is already stored.
+	UpsertStreamCheckpoint(ctx context.Context, txn *sql.Tx, streamName string, pos types.StreamPosition) error
+	// SelectStreamCheckpoints returns the stored position of each stream.
+	SelectStreamCheckpoints(ctx context.Context, txn *sql.Tx) (map[string]types.StreamPosition, error)
+}
+
+type LazyLoadedMembers interface {
+	// SelectLazyLoadedMembers returns the event IDs of the memberships of the target users which
+	// have already been sent to the device, keyed by target user ID.
+	SelectLazyLoadedMembers(ctx context.Context, txn *sql.Tx, userID, deviceID, roomID string, targetUserIDs []string) (map[string]string, error)
+	// UpsertLazyLoadedMembers records that the memberships of the target users, whose event IDs
+	// are paired with them by index, have been sent to the device.
+	UpsertLazyLoadedMembers(ctx context.Context, txn *sql.Tx, userID, deviceID, roomID string, targetUserIDs, eventIDs []string) error
+	// DeleteLazyLoadedMembersForDevice forgets all memberships sent to the device in every room.
+	DeleteLazyLoadedMembersForDevice(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
+	// DeleteLazyLoadedMembersForTargets forgets that the memberships of the target users have been
+	// sent to any device, so that they are sent again.
+	DeleteLazyLoadedMembersForTargets(ctx context.Context, txn *sql.Tx, roomID string, targetUserIDs []string) error
+	PurgeLazyLoadedMembers(ctx context.Context, txn *sql.Tx, roomID string) error
 }
@@ -30,7 +30,7 @@ func newOutputRoomEventsTable(t *testing.T, dbType test.DBType) (tables.Events,
 	var tab tables.Events
 	switch dbType {
 	case test.DBTypePostgres:
-		tab, err = postgres.NewPostgresEventsTable(db)
+		tab, err = postgres.NewPostgresEventsTable(db, nil)
 	}
 	if err != nil {
 		t.Fatalf("failed to make new table: %s", err)
@@ -3,6 +3,7 @@ package tables_test
 import (
 	"context"
 	"database/sql"
+	"reflect"
 	"testing"
 
 	"github.com/neilalexander/harmony/internal/sqlutil"
@@ -64,7 +65,7 @@ func TestRelationsTable(t *testing.T) {
 
 		// Insert some relations
 		for _, child := range []string{"b", "c", "d"} {
-			if err := tab.InsertRelation(ctx, nil, roomID, "a", child, childType, relType); err != nil {
+			if err := tab.InsertRelation(ctx, nil, roomID, "a", child, childType, relType, "@alice:server", ""); err != nil {
 				t.Fatal(err)
 			}
 		}
@@ -132,7 +133,7 @@ func TestRelationsTable(t *testing.T) {
 
 		// Insert some new relations
 		for _, child := range []string{"e", "f", "g", "h"} {
-			if err := tab.InsertRelation(ctx, nil, roomID, "a", child, childType, relType); err != nil {
+			if err := tab.InsertRelation(ctx, nil, roomID, "a", child, childType, relType, "@alice:server", ""); err != nil {
 				t.Fatal(err)
 			}
 		}
@@ -177,3 +178,145 @@ func TestRelationsTable(t *testing.T) {
 		}
 	})
 }
+
+func TestRelationsTableAnnotations(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, _, close := newRelationsTable(t, dbType)
+		defer close()
+
+		for _, r := range []struct{ eventID, child, sender, key string }{
+			{"a", "b", "@alice:server", "👍"},
+			{"a", "c", "@bob:server", "👍"},
+			{"a", "d", "@alice:server", "🎉"},
+			{"x", "y", "@alice:server", "👍"},
+		} {
+			if err := tab.InsertRelation(ctx, nil, roomID, r.eventID, r.child, "m.reaction", "m.annotation", r.sender, r.key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		otherRoomID := "!other:server"
+		if err := tab.InsertRelation(ctx, nil, otherRoomID, "o", "p", "m.reaction", "m.annotation", "@alice:server", "🎉"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range []struct {
+			sender, key string
+			want        bool
+		}{
+			{"@alice:server", "👍", true},
+			{"@bob:server", "👍", true},
+			{"@bob:server", "🎉", false},
+			{"@charlie:server", "👍", false},
+		} {
+			exists, err := tab.SelectAnnotationExists(ctx, nil, roomID, "a", "m.reaction", tc.sender, tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists != tc.want {
+				t.Fatalf("annotation %s by %s: expected exists %v, got %v", tc.key, tc.sender, tc.want, exists)
+			}
+		}
+
+		// Events from different rooms are counted at once, but only in
+		// the room which they are paired with.
+		senders := []string{"@alice:server", "@alice:server", "@alice:server", "@alice:server", "@alice:server"}
+		aggregations, err := tab.SelectAggregations(ctx, nil,
+			[]string{roomID, roomID, roomID, otherRoomID, otherRoomID},
+			[]string{"a", "x", "none", "o", "a"}, senders, "@alice:server", 10,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(aggregations.Annotations, map[string][]types.AnnotationCount{
+			"a": {{Type: "m.reaction", Key: "👍", Count: 2}, {Type: "m.reaction", Key: "🎉", Count: 1}},
+			"x": {{Type: "m.reaction", Key: "👍", Count: 1}},
+			"o": {{Type: "m.reaction", Key: "🎉", Count: 1}},
+		}) {
+			t.Fatalf("unexpected annotation counts %+v", aggregations.Annotations)
+		}
+		if len(aggregations.Threads) != 0 || len(aggregations.Edits) != 0 {
+			t.Fatalf("unexpected threads %+v and edits %+v", aggregations.Threads, aggregations.Edits)
+		}
+
+		// Only the most used keys are returned when limited
+		aggregations, err = tab.SelectAggregations(ctx, nil, []string{roomID}, []string{"a"}, senders[:1], "@alice:server", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts := aggregations.Annotations["a"]; len(counts) != 1 || counts[0].Key != "👍" {
+			t.Fatalf("unexpected limited annotation counts %+v", counts)
+		}
+	})
+}
+
+func TestRelationsTableThreadsAndEdits(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, _, close := newRelationsTable(t, dbType)
+		defer close()
+
+		for _, r := range []struct{ eventID, child, relType, sender string }{
+			{"a", "a1", "m.thread", "@alice:server"},
+			{"x", "x1", "m.thread", "@bob:server"},
+			{"a", "a2", "m.thread", "@bob:server"},
+			{"a", "e1", "m.replace", "@alice:server"},
+			{"a", "e2", "m.replace", "@bob:server"},
+			{"x", "e3", "m.replace", "@bob:server"},
+		} {
+			if err := tab.InsertRelation(ctx, nil, roomID, r.eventID, r.child, "m.room.message", r.relType, r.sender, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Only edits by the sender of the original event count, so Bob's
+		// later edit of Alice's event and his edit of his own event, which
+		// is paired with Alice as its sender, are ignored.
+		aggregations, err := tab.SelectAggregations(ctx, nil,
+			[]string{roomID, roomID, roomID}, []string{"a", "x", "none"},
+			[]string{"@alice:server", "@alice:server", "@alice:server"}, "@alice:server", 10,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(aggregations.Threads, map[string]types.ThreadSummary{
+			"a": {Count: 2, LatestEventID: "a2", Participated: true},
+			"x": {Count: 1, LatestEventID: "x1", Participated: false},
+		}) {
+			t.Fatalf("unexpected thread summaries %+v", aggregations.Threads)
+		}
+		if !reflect.DeepEqual(aggregations.Edits, map[string]string{"a": "e1"}) {
+			t.Fatalf("unexpected edits %+v", aggregations.Edits)
+		}
+		if len(aggregations.Annotations) != 0 {
+			t.Fatalf("unexpected annotations %+v", aggregations.Annotations)
+		}
+
+		// Threads are listed by their latest reply, newest first.
+		maxID, err := tab.SelectMaxRelationID(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots, err := tab.SelectThreadRoots(ctx, nil, roomID, "", types.StreamPosition(maxID+1), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roots) != 2 || roots[0].EventID != "a" || roots[1].EventID != "x" {
+			t.Fatalf("unexpected thread roots %+v", roots)
+		}
+		roots, err = tab.SelectThreadRoots(ctx, nil, roomID, "", roots[0].Position, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roots) != 1 || roots[0].EventID != "x" {
+			t.Fatalf("unexpected thread roots after the first %+v", roots)
+		}
+		roots, err = tab.SelectThreadRoots(ctx, nil, roomID, "@alice:server", types.StreamPosition(maxID+1), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roots) != 1 || roots[0].EventID != "a" {
+			t.Fatalf("unexpected participated thread roots %+v", roots)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package streams
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/types"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+	userapitypes "github.com/neilalexander/harmony/userapi/types"
+)
+
+// Lag returns how far behind the PDU and device list streams are, from the
+// positions which clients are synced up to and the latest positions produced
+// into them. PDUs are produced into the sync API's database by the room
+// server consumer, and device list changes into the key server's database.
+func (s *Streams) Lag(ctx context.Context, d storage.Database, userAPI userapi.SyncKeyAPI) ([]jetstream.SyncStreamLag, error) {
+	// Take the positions before the snapshot, so that they can't get ahead
+	// of the latest positions unless something is produced in between.
+	pduPosition := s.PDUStreamProvider.LatestPosition(ctx)
+	deviceListPosition := s.DeviceListStreamProvider.LatestPosition(ctx)
+
+	snapshot, err := d.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("d.NewDatabaseSnapshot: %w", err)
+	}
+	defer snapshot.Rollback() // nolint: errcheck
+	return lag(ctx, pduPosition, deviceListPosition, snapshot, userAPI)
+}
+
+func lag(
+	ctx context.Context, pduPosition, deviceListPosition types.StreamPosition,
+	snapshot storage.DatabaseTransaction, userAPI userapi.SyncKeyAPI,
+) ([]jetstream.SyncStreamLag, error) {
+	latestPDU, err := snapshot.MaxStreamPositionForPDUs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot.MaxStreamPositionForPDUs: %w", err)
+	}
+
+	var res userapi.QueryKeyChangesResponse
+	err = userAPI.QueryKeyChanges(ctx, &userapi.QueryKeyChangesRequest{
+		Offset:   int64(deviceListPosition),
+		ToOffset: userapitypes.OffsetNewest,
+	}, &res)
+	if err == nil && res.Error != nil {
+		err = res.Error
+	}
+	if err != nil {
+		return nil, fmt.Errorf("userAPI.QueryKeyChanges: %w", err)
+	}
+
+	return []jetstream.SyncStreamLag{
+		syncStreamLag("pdu", pduPosition, latestPDU),
+		syncStreamLag("device_list", deviceListPosition, types.StreamPosition(res.Offset)),
+	}, nil
+}
+
+func syncStreamLag(stream string, position, latest types.StreamPosition) jetstream.SyncStreamLag {
+	lag := jetstream.SyncStreamLag{
+		Stream:         stream,
+		Position:       int64(position),
+		LatestPosition: int64(latest),
+	}
+	if latest > position {
+		lag.Lag = int64(latest - position)
+	}
+	return lag
+}
+
+// RespondToLagRequests answers the requests for Lag made on the given
+// subject, which the client API makes to report the lag to admins.
+func (s *Streams) RespondToLagRequests(natsClient *nats.Conn, subject string, d storage.Database, userAPI userapi.SyncKeyAPI) error {
+	_, err := natsClient.Subscribe(subject, func(msg *nats.Msg) {
+		m := &nats.Msg{
+			Header: nats.Header{},
+		}
+		lag, err := s.Lag(context.Background(), d, userAPI)
+		if err == nil {
+			m.Data, err = json.Marshal(lag)
+		}
+		if err != nil {
+			m.Header.Set("error", err.Error())
+		}
+		if err = msg.RespondMsg(m); err != nil {
+			logrus.WithError(err).Error("Unable to respond to messages")
+		}
+	})
+	return err
+}
@@ -0,0 +1,66 @@
+package streams
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/types"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+type lagSnapshot struct {
+	storage.DatabaseTransaction
+	latestPDU types.StreamPosition
+}
+
+func (s *lagSnapshot) MaxStreamPositionForPDUs(ctx context.Context) (types.StreamPosition, error) {
+	return s.latestPDU, nil
+}
+
+// lagKeyAPI behaves like the key server, which returns the newest offset of
+// the key changes after the requested one, or the requested one if there
+// are none.
+type lagKeyAPI struct {
+	userapi.SyncKeyAPI
+	latest int64
+}
+
+func (k *lagKeyAPI) QueryKeyChanges(ctx context.Context, req *userapi.QueryKeyChangesRequest, res *userapi.QueryKeyChangesResponse) error {
+	res.Offset = req.Offset
+	if k.latest > res.Offset {
+		res.Offset = k.latest
+	}
+	return nil
+}
+
+func TestLag(t *testing.T) {
+	// Clients are synced up to PDU 5 of 8. A device list position ahead of
+	// the key server, which the key server returns as the latest position,
+	// isn't reported as lag.
+	for _, tc := range []struct {
+		deviceListPosition, latestDeviceList int64
+		want                                 jetstream.SyncStreamLag
+	}{
+		{3, 7, jetstream.SyncStreamLag{Stream: "device_list", Position: 3, LatestPosition: 7, Lag: 4}},
+		{7, 7, jetstream.SyncStreamLag{Stream: "device_list", Position: 7, LatestPosition: 7}},
+		{9, 7, jetstream.SyncStreamLag{Stream: "device_list", Position: 9, LatestPosition: 9}},
+	} {
+		got, err := lag(
+			context.Background(), 5, types.StreamPosition(tc.deviceListPosition),
+			&lagSnapshot{latestPDU: 8}, &lagKeyAPI{latest: tc.latestDeviceList},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []jetstream.SyncStreamLag{
+			{Stream: "pdu", Position: 5, LatestPosition: 8, Lag: 3},
+			tc.want,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got lag %+v, want %+v", got, want)
+		}
+	}
+}
@@ -50,7 +50,7 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 	}
 
 	dataTypes, pos, err := snapshot.GetAccountDataInRange(
-		ctx, req.Device.UserID, r, &req.Filter.AccountData,
+		ctx, req.Device.UserID, r, &req.Filter.AccountData, &req.Filter.Room,
 	)
 	if err != nil {
 		req.Log.WithError(err).Error("p.DB.GetAccountDataInRange failed")
@@ -59,9 +59,12 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 
 	// Iterate over the rooms
 	for roomID, dataTypes := range dataTypes {
-		// For a complete sync, make sure we're only including this room if
-		// that room was present in the joined rooms.
-		if from == 0 && roomID != "" && !req.IsRoomPresent(roomID) {
+		// Room account data only belongs in the sync response of rooms that
+		// the user is joined to. The PDU stream has already worked out which
+		// rooms those are, for both complete and incremental syncs, so data
+		// for rooms that have since been left or are only invited to doesn't
+		// create an empty joined room entry.
+		if roomID != "" && req.Rooms[roomID] != spec.Join {
 			continue
 		}
 
@@ -4,9 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"time"
 
-	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
 	rstypes "github.com/neilalexander/harmony/roomserver/types"
@@ -33,10 +33,8 @@ const PDU_STREAM_QUEUESIZE = PDU_STREAM_WORKERS * 8
 type PDUStreamProvider struct {
 	DefaultStreamProvider
 
-	// userID+deviceID -> lazy loading cache
-	lazyLoadCache caching.LazyLoadCache
-	rsAPI         roomserverAPI.SyncRoomserverAPI
-	notifier      *notifier.Notifier
+	rsAPI    roomserverAPI.SyncRoomserverAPI
+	notifier *notifier.Notifier
 }
 
 func (p *PDUStreamProvider) Setup(
@@ -72,12 +70,28 @@ func (p *PDUStreamProvider) CompleteSync(
 	}
 
 	// Extract room state and recent events for all rooms the user is joined to.
-	joinedRoomIDs, err := snapshot.RoomIDsWithMembership(ctx, req.Device.UserID, spec.Join)
+	joinedRoomIDs, err := snapshot.RoomIDsWithMembership(ctx, req.Device.UserID, spec.Join, &req.Filter.Room)
 	if err != nil {
 		req.Log.WithError(err).Error("p.DB.RoomIDsWithMembership failed")
 		return from
 	}
 
+	// If the client has asked for only some of their rooms, put the most
+	// recently active rooms first so that they are the ones included. The
+	// response says that rooms were left out, as they won't be sent in later
+	// incremental syncs until they have new activity.
+	var bumpStamps map[string]types.StreamPosition
+	if limit := req.Filter.Room.Limit; limit > 0 && len(joinedRoomIDs) > limit {
+		bumpStamps, err = snapshot.RoomBumpStamps(ctx, req.Device.UserID, joinedRoomIDs)
+		if err != nil {
+			req.Log.WithError(err).Error("p.DB.RoomBumpStamps failed")
+			return from
+		}
+		sortRoomsByBumpStamp(joinedRoomIDs, bumpStamps)
+		joinedRoomIDs = joinedRoomIDs[:limit]
+		req.Response.Rooms.Limited = true
+	}
+
 	stateFilter := req.Filter.Room.State
 	eventFilter := req.Filter.Room.Timeline
 
@@ -94,15 +108,16 @@ func (p *PDUStreamProvider) CompleteSync(
 	if err != nil {
 		return from
 	}
+	// Forget which members were lazy-loaded, otherwise we end up with missing displaynames/avatars
+	if stateFilter.LazyLoadMembers {
+		if err = p.DB.ResetLazyLoadedMembers(ctx, req.Device.UserID, req.Device.ID); err != nil {
+			req.Log.WithError(err).Error("p.DB.ResetLazyLoadedMembers failed")
+			return from
+		}
+	}
 	// Build up a /sync response. Add joined rooms.
 	for _, roomID := range joinedRoomIDs {
 		events := recentEvents[roomID]
-		// Invalidate the lazyLoadCache, otherwise we end up with missing displaynames/avatars
-		// TODO: This might be inefficient, when joined to many and/or large rooms.
-		joinedUsers := p.notifier.JoinedUsers(roomID)
-		for _, sharedUser := range joinedUsers {
-			p.lazyLoadCache.InvalidateLazyLoadedUser(req.Device, roomID, sharedUser)
-		}
 
 		// get the join response for each room
 		jr, jerr := p.getJoinResponseForCompleteSync(
@@ -116,10 +131,16 @@ func (p *PDUStreamProvider) CompleteSync(
 			}
 			continue
 		}
+		jr.BumpStamp = bumpStamps[roomID]
 		req.Response.Rooms.Join[roomID] = jr
 		req.Rooms[roomID] = spec.Join
 	}
 
+	if err = p.addAggregations(ctx, snapshot, req, joinedRoomIDs); err != nil {
+		req.Log.WithError(err).Error("p.addAggregations failed")
+		return from
+	}
+
 	return to
 }
 
@@ -139,16 +160,17 @@ func (p *PDUStreamProvider) IncrementalSync(
 	var stateDeltas []types.StateDelta
 	var syncJoinedRooms []string
 
+	roomFilter := req.Filter.Room
 	stateFilter := req.Filter.Room.State
 	eventFilter := req.Filter.Room.Timeline
 
 	if req.WantFullState {
-		if stateDeltas, syncJoinedRooms, err = snapshot.GetStateDeltasForFullStateSync(ctx, req.Device, r, req.Device.UserID, &stateFilter, p.rsAPI); err != nil {
+		if stateDeltas, syncJoinedRooms, err = snapshot.GetStateDeltasForFullStateSync(ctx, req.Device, r, req.Device.UserID, &roomFilter, p.rsAPI); err != nil {
 			req.Log.WithError(err).Error("p.DB.GetStateDeltasForFullStateSync failed")
 			return from
 		}
 	} else {
-		if stateDeltas, syncJoinedRooms, err = snapshot.GetStateDeltas(ctx, req.Device, r, req.Device.UserID, &stateFilter, p.rsAPI); err != nil {
+		if stateDeltas, syncJoinedRooms, err = snapshot.GetStateDeltas(ctx, req.Device, r, req.Device.UserID, &roomFilter, p.rsAPI); err != nil {
 			req.Log.WithError(err).Error("p.DB.GetStateDeltas failed")
 			return from
 		}
@@ -206,9 +228,79 @@ func (p *PDUStreamProvider) IncrementalSync(
 		}
 	}
 
+	roomIDs := make([]string, 0, len(stateDeltas))
+	for _, delta := range stateDeltas {
+		roomIDs = append(roomIDs, delta.RoomID)
+	}
+	if err = p.addAggregations(ctx, snapshot, req, roomIDs); err != nil {
+		req.Log.WithError(err).Error("p.addAggregations failed")
+		return from
+	}
+
+	p.addBumpStamps(ctx, snapshot, req, stateDeltas)
+
 	return newPos
 }
 
+// addAggregations bundles the aggregations of the timeline events of the
+// given rooms in the response. The rooms are done all at once, rather than
+// as each is added to the response, so that the number of queries doesn't
+// grow with the number of rooms.
+func (p *PDUStreamProvider) addAggregations(
+	ctx context.Context, snapshot storage.DatabaseTransaction,
+	req *types.SyncRequest, roomIDs []string,
+) error {
+	rooms := make([]internal.RoomEvents, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if jr, ok := req.Response.Rooms.Join[roomID]; ok && jr.Timeline != nil {
+			rooms = append(rooms, internal.RoomEvents{RoomID: roomID, Events: jr.Timeline.Events})
+		} else if lr, ok := req.Response.Rooms.Leave[roomID]; ok && lr.Timeline != nil {
+			rooms = append(rooms, internal.RoomEvents{RoomID: roomID, Events: lr.Timeline.Events})
+		}
+	}
+	return internal.BundleAggregations(ctx, snapshot, p.rsAPI, req.Device.UserID, rooms...)
+}
+
+// addBumpStamps sets the bump stamps of the joined rooms in the response which
+// had activity in this sync, so that clients can reorder their room lists.
+func (p *PDUStreamProvider) addBumpStamps(
+	ctx context.Context, snapshot storage.DatabaseTransaction,
+	req *types.SyncRequest, stateDeltas []types.StateDelta,
+) {
+	roomIDs := make([]string, 0, len(stateDeltas))
+	for _, delta := range stateDeltas {
+		if _, ok := req.Response.Rooms.Join[delta.RoomID]; ok {
+			roomIDs = append(roomIDs, delta.RoomID)
+		}
+	}
+	if len(roomIDs) == 0 {
+		return
+	}
+	bumpStamps, err := snapshot.RoomBumpStamps(ctx, req.Device.UserID, roomIDs)
+	if err != nil {
+		req.Log.WithError(err).Error("p.DB.RoomBumpStamps failed")
+		return
+	}
+	for _, roomID := range roomIDs {
+		jr := req.Response.Rooms.Join[roomID]
+		jr.BumpStamp = bumpStamps[roomID]
+		req.Response.Rooms.Join[roomID] = jr
+	}
+}
+
+// sortRoomsByBumpStamp sorts the room IDs so that the most recently active
+// rooms come first. Rooms with the same bump stamp are sorted by room ID so
+// that the order is stable between syncs.
+func sortRoomsByBumpStamp(roomIDs []string, bumpStamps map[string]types.StreamPosition) {
+	sort.Slice(roomIDs, func(i, j int) bool {
+		a, b := bumpStamps[roomIDs[i]], bumpStamps[roomIDs[j]]
+		if a != b {
+			return a > b
+		}
+		return roomIDs[i] < roomIDs[j]
+	})
+}
+
 func (p *PDUStreamProvider) getRecentEvents(ctx context.Context, stateDeltas []types.StateDelta, r types.Range, eventFilter synctypes.RoomEventFilter, snapshot storage.DatabaseTransaction) (map[string]types.RecentEvents, error) {
 	var roomIDs []string
 	var newlyJoinedRoomIDs []string
@@ -599,12 +691,21 @@ func (p *PDUStreamProvider) lazyLoadMembers(
 		timelineUsers[device.UserID] = struct{}{}
 	}
 	// Add all users the client doesn't know about yet to a list
+	senders := make([]string, 0, len(timelineEvents))
 	for _, event := range timelineEvents {
-		// Membership is not yet cached, add it to the list
-		if _, ok := p.lazyLoadCache.IsLazyLoadedUserCached(device, roomID, string(event.SenderID())); !ok {
-			timelineUsers[string(event.SenderID())] = struct{}{}
+		senders = append(senders, string(event.SenderID()))
+	}
+	sent, err := p.DB.SelectLazyLoadedMembers(ctx, device.UserID, device.ID, roomID, senders)
+	if err != nil {
+		return nil, err
+	}
+	for _, sender := range senders {
+		// Membership has not been sent yet, add it to the list
+		if _, ok := sent[sender]; !ok {
+			timelineUsers[sender] = struct{}{}
 		}
 	}
+	newlySent := make(map[string]string)
 	// Preallocate with the same amount, even if it will end up with fewer values
 	newStateEvents := make([]*rstypes.HeaderedEvent, 0, len(stateEvents))
 	// Remove existing membership events we don't care about, e.g. users not in the timeline.events
@@ -621,7 +722,7 @@ func (p *PDUStreamProvider) lazyLoadMembers(
 			if _, ok := timelineUsers[userID]; ok || isGappedIncremental || userID == device.UserID {
 				newStateEvents = append(newStateEvents, event)
 				if !stateFilter.IncludeRedundantMembers {
-					p.lazyLoadCache.StoreLazyLoadedUser(device, roomID, userID, event.EventID())
+					newlySent[userID] = event.EventID()
 				}
 				delete(timelineUsers, userID)
 			}
@@ -641,9 +742,12 @@ func (p *PDUStreamProvider) lazyLoadMembers(
 	if err != nil {
 		return stateEvents, err
 	}
-	// cache the membership events
+	// remember the membership events we've sent
 	for _, membership := range memberships {
-		p.lazyLoadCache.StoreLazyLoadedUser(device, roomID, *membership.StateKey(), membership.EventID())
+		newlySent[*membership.StateKey()] = membership.EventID()
+	}
+	if err = p.DB.StoreLazyLoadedMembers(ctx, device.UserID, device.ID, roomID, newlySent); err != nil {
+		return stateEvents, err
 	}
 	stateEvents = append(newStateEvents, memberships...)
 	return stateEvents, nil
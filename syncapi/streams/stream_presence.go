@@ -99,7 +99,7 @@ func (p *PresenceStreamProvider) IncrementalSync(
 			continue
 		}
 		// Ignore users we don't share a room with
-		if req.Device.UserID != presence.UserID && !p.notifier.IsSharedUser(req.Device.UserID, presence.UserID) {
+		if req.Device.UserID != presence.UserID && !p.notifier.IsSharedUser(ctx, req.Device.UserID, presence.UserID) {
 			continue
 		}
 		cacheKey := req.Device.UserID + req.Device.ID + presence.UserID
@@ -173,7 +173,7 @@ func (p *PresenceStreamProvider) getNeededUsersFromRequest(ctx context.Context,
 		return getPresenceForUsers, fmt.Errorf("unable to refresh notifier lists: %w", err)
 	}
 	for _, roomID := range newlyJoined {
-		roomUsers := p.notifier.JoinedUsers(roomID)
+		roomUsers := p.notifier.JoinedUsers(ctx, roomID)
 		for i := range roomUsers {
 			// we already got a presence from this user
 			if _, ok := presences[roomUsers[i]]; ok {
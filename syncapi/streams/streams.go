@@ -2,16 +2,23 @@ package streams
 
 import (
 	"context"
+	"time"
 
 	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	rsapi "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/process"
 	"github.com/neilalexander/harmony/syncapi/notifier"
 	"github.com/neilalexander/harmony/syncapi/storage"
 	"github.com/neilalexander/harmony/syncapi/types"
 	userapi "github.com/neilalexander/harmony/userapi/api"
+	userapitypes "github.com/neilalexander/harmony/userapi/types"
+	"github.com/sirupsen/logrus"
 )
 
+// checkpointInterval is how often the positions of the streams are stored.
+const checkpointInterval = time.Second * 30
+
 type Streams struct {
 	PDUStreamProvider              StreamProvider
 	TypingStreamProvider           StreamProvider
@@ -27,12 +34,11 @@ type Streams struct {
 func NewSyncStreamProviders(
 	d storage.Database, userAPI userapi.SyncUserAPI,
 	rsAPI rsapi.SyncRoomserverAPI,
-	eduCache *caching.EDUCache, lazyLoadCache caching.LazyLoadCache, notifier *notifier.Notifier,
+	eduCache *caching.EDUCache, notifier *notifier.Notifier,
 ) *Streams {
 	streams := &Streams{
 		PDUStreamProvider: &PDUStreamProvider{
 			DefaultStreamProvider: DefaultStreamProvider{DB: d},
-			lazyLoadCache:         lazyLoadCache,
 			rsAPI:                 rsAPI,
 			notifier:              notifier,
 		},
@@ -86,10 +92,95 @@ func NewSyncStreamProviders(
 	streams.DeviceListStreamProvider.Setup(ctx, snapshot)
 	streams.PresenceStreamProvider.Setup(ctx, snapshot)
 
+	// Carry on from the positions which the streams had reached before the
+	// last restart. Typing and device list positions aren't derived from the
+	// database, and send-to-device messages are deleted once delivered, so
+	// otherwise those positions could go backwards.
+	checkpoint, err := d.StreamCheckpoint(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to load sync stream checkpoint, stream positions may go backwards")
+		err = nil
+	}
+	eduCache.SetLatestSyncPosition(int64(checkpoint.TypingPosition))
+	streams.PDUStreamProvider.Advance(checkpoint.PDUPosition)
+	streams.TypingStreamProvider.Advance(checkpoint.TypingPosition)
+	streams.ReceiptStreamProvider.Advance(checkpoint.ReceiptPosition)
+	streams.InviteStreamProvider.Advance(checkpoint.InvitePosition)
+	streams.SendToDeviceStreamProvider.Advance(checkpoint.SendToDevicePosition)
+	streams.AccountDataStreamProvider.Advance(checkpoint.AccountDataPosition)
+	streams.NotificationDataStreamProvider.Advance(checkpoint.NotificationDataPosition)
+	streams.DeviceListStreamProvider.Advance(checkpoint.DeviceListPosition)
+	streams.PresenceStreamProvider.Advance(checkpoint.PresencePosition)
+	checkDeviceListPosition(ctx, userAPI, checkpoint.DeviceListPosition)
+
 	succeeded = true
 	return streams
 }
 
+// checkDeviceListPosition logs an error if the key server hasn't reached the
+// device list position which the sync API has already given to clients. The
+// device list positions come from the key server's database rather than the
+// sync API's own, so this happens if the two databases are restored from
+// backups taken at different times. Until the key server catches up, clients
+// will miss the device list changes in between.
+func checkDeviceListPosition(ctx context.Context, userAPI userapi.SyncKeyAPI, pos types.StreamPosition) {
+	if pos == 0 {
+		return
+	}
+	var res userapi.QueryKeyChangesResponse
+	err := userAPI.QueryKeyChanges(ctx, &userapi.QueryKeyChangesRequest{
+		Offset:   int64(pos) - 1,
+		ToOffset: userapitypes.OffsetNewest,
+	}, &res)
+	if err == nil && res.Error != nil {
+		err = res.Error
+	}
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to check the key server's device list position")
+		return
+	}
+	if res.Offset < int64(pos) {
+		logrus.Errorf(
+			"The key server's database is behind the device list position of the sync API's database (%d < %d). "+
+				"Clients will miss device list changes until it catches up. Were the databases restored from different backups?",
+			res.Offset, pos,
+		)
+	}
+}
+
+// Checkpoint stores the latest positions of the streams every so often, and
+// once more when shutting down, until the process shuts down.
+func (s *Streams) Checkpoint(processContext *process.ProcessContext, d storage.Database) {
+	if !processContext.WorkStarted() {
+		return
+	}
+	defer processContext.WorkFinished()
+
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	var stored types.StreamingToken
+	store := func() {
+		latest := s.Latest(context.Background())
+		if latest == stored {
+			return
+		}
+		if err := d.StoreStreamCheckpoint(context.Background(), latest); err != nil {
+			logrus.WithError(err).Error("Failed to store sync stream checkpoint")
+			return
+		}
+		stored = latest
+	}
+	for {
+		select {
+		case <-processContext.WaitForShutdown():
+			store()
+			return
+		case <-ticker.C:
+			store()
+		}
+	}
+}
+
 func (s *Streams) Latest(ctx context.Context) types.StreamingToken {
 	return types.StreamingToken{
 		PDUPosition:              s.PDUStreamProvider.LatestPosition(ctx),
@@ -19,12 +19,11 @@ package sync
 import (
 	"context"
 	"database/sql"
-	"net"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/neilalexander/harmony/clientapi/httputil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -33,6 +32,7 @@ import (
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
 	"github.com/neilalexander/harmony/syncapi/internal"
 	"github.com/neilalexander/harmony/syncapi/notifier"
 	"github.com/neilalexander/harmony/syncapi/storage"
@@ -53,10 +53,22 @@ type RequestPool struct {
 	Notifier *notifier.Notifier
 	producer PresencePublisher
 	consumer PresenceConsumer
+
+	sendToDeviceAcksMutex sync.Mutex
+	sendToDeviceAcks      map[sendToDeviceKey]types.StreamPosition
+}
+
+type sendToDeviceKey struct {
+	userID   string
+	deviceID string
 }
 
+// sendToDeviceAckInterval is how often acknowledged send-to-device
+// messages are deleted from the database.
+const sendToDeviceAckInterval = time.Second * 5
+
 type PresencePublisher interface {
-	SendPresence(userID string, presence types.Presence, statusMsg *string) error
+	SendPresence(userID string, presence types.Presence, statusMsg *string, lastActiveTS spec.Timestamp) error
 }
 
 type PresenceConsumer interface {
@@ -65,6 +77,7 @@ type PresenceConsumer interface {
 
 // NewRequestPool makes a new RequestPool
 func NewRequestPool(
+	processContext *process.ProcessContext,
 	db storage.Database, cfg *config.SyncAPI,
 	userAPI userapi.SyncUserAPI,
 	rsAPI roomserverAPI.SyncRoomserverAPI,
@@ -87,8 +100,11 @@ func NewRequestPool(
 		Notifier: notifier,
 		producer: producer,
 		consumer: consumer,
+
+		sendToDeviceAcks: map[sendToDeviceKey]types.StreamPosition{},
 	}
 	go rp.cleanLastSeen()
+	go rp.cleanSendToDevice(processContext)
 	go rp.cleanPresence(db, time.Minute*5)
 	return rp
 }
@@ -103,6 +119,69 @@ func (rp *RequestPool) cleanLastSeen() {
 	}
 }
 
+// ackSendToDevice records that the device has received all send-to-device
+// messages up to and including pos. The messages are deleted in batches by
+// cleanSendToDevice rather than on every sync request.
+func (rp *RequestPool) ackSendToDevice(userID, deviceID string, pos types.StreamPosition) {
+	if pos == 0 {
+		return
+	}
+	rp.sendToDeviceAcksMutex.Lock()
+	defer rp.sendToDeviceAcksMutex.Unlock()
+	key := sendToDeviceKey{userID, deviceID}
+	if pos > rp.sendToDeviceAcks[key] {
+		rp.sendToDeviceAcks[key] = pos
+	}
+}
+
+// flushSendToDeviceAcks deletes the acknowledged send-to-device messages.
+// If key is given then only the acknowledgement for that device is flushed.
+func (rp *RequestPool) flushSendToDeviceAcks(ctx context.Context, key *sendToDeviceKey) error {
+	rp.sendToDeviceAcksMutex.Lock()
+	acks := make([]types.SendToDeviceAck, 0, len(rp.sendToDeviceAcks))
+	for k, pos := range rp.sendToDeviceAcks {
+		if key != nil && k != *key {
+			continue
+		}
+		acks = append(acks, types.SendToDeviceAck{
+			UserID:   k.userID,
+			DeviceID: k.deviceID,
+			Position: pos,
+		})
+		delete(rp.sendToDeviceAcks, k)
+	}
+	rp.sendToDeviceAcksMutex.Unlock()
+
+	return rp.db.CleanSendToDeviceUpdates(ctx, acks)
+}
+
+// cleanSendToDevice deletes the acknowledged send-to-device messages every
+// sendToDeviceAckInterval until the server shuts down, when any outstanding
+// acknowledgements are flushed one last time.
+func (rp *RequestPool) cleanSendToDevice(processContext *process.ProcessContext) {
+	if !processContext.WorkStarted() {
+		return
+	}
+	defer processContext.WorkFinished()
+
+	ticker := time.NewTicker(sendToDeviceAckInterval)
+	defer ticker.Stop()
+	flush := func(ctx context.Context) {
+		if err := rp.flushSendToDeviceAcks(ctx, nil); err != nil {
+			logrus.WithError(err).Error("Failed to clean up acknowledged send-to-device messages")
+		}
+	}
+	for {
+		select {
+		case <-processContext.WaitForShutdown():
+			flush(context.Background())
+			return
+		case <-ticker.C:
+			flush(processContext.Context())
+		}
+	}
+}
+
 func (rp *RequestPool) cleanPresence(db storage.Presence, cleanupTime time.Duration) {
 	if !rp.cfg.Matrix.Presence.EnableOutbound {
 		return
@@ -111,7 +190,9 @@ func (rp *RequestPool) cleanPresence(db storage.Presence, cleanupTime time.Durat
 		rp.presence.Range(func(key interface{}, v interface{}) bool {
 			p := v.(types.PresenceInternal)
 			if time.Since(p.LastActiveTS.Time()) > cleanupTime {
-				rp.updatePresence(db, types.PresenceUnavailable.String(), p.UserID)
+				// The user hasn't been active since, so don't move their
+				// last active time forward when marking them as idle.
+				rp.updatePresenceInternal(db, types.PresenceUnavailable.String(), p.UserID, p.LastActiveTS, true)
 				rp.presence.Delete(key)
 			}
 			return true
@@ -133,13 +214,17 @@ var lastPresence PresenceMap
 // should be long enough that any client will have another sync before expiring
 const presenceTimeout = time.Second * 10
 
+// how often the last active time is written to the database while the
+// presence doesn't change, so that every sync doesn't result in a write
+const lastActiveGranularity = time.Minute
+
 // updatePresence sends presence updates to the SyncAPI and FederationAPI
 func (rp *RequestPool) updatePresence(db storage.Presence, presence string, userID string) {
 	// allow checking back on presence to set offline if needed
-	rp.updatePresenceInternal(db, presence, userID, true)
+	rp.updatePresenceInternal(db, presence, userID, spec.AsTimestamp(time.Now()), true)
 }
 
-func (rp *RequestPool) updatePresenceInternal(db storage.Presence, presence string, userID string, checkAgain bool) {
+func (rp *RequestPool) updatePresenceInternal(db storage.Presence, presence string, userID string, lastActiveTS spec.Timestamp, checkAgain bool) {
 	if !rp.cfg.Matrix.Presence.EnableOutbound {
 		return
 	}
@@ -160,7 +245,7 @@ func (rp *RequestPool) updatePresenceInternal(db storage.Presence, presence stri
 	newPresence := types.PresenceInternal{
 		Presence:     presenceID,
 		UserID:       userID,
-		LastActiveTS: spec.AsTimestamp(time.Now()),
+		LastActiveTS: lastActiveTS,
 	}
 
 	// make sure that the map is defined correctly as needed
@@ -193,7 +278,7 @@ func (rp *RequestPool) updatePresenceInternal(db storage.Presence, presence stri
 		if checkAgain {
 			// after a timeout, check presence again to make sure it gets set as offline sooner or later
 			time.AfterFunc(presenceTimeout, func() {
-				rp.updatePresenceInternal(db, types.PresenceOffline.String(), userID, false)
+				rp.updatePresenceInternal(db, types.PresenceOffline.String(), userID, lastActiveTS, false)
 			})
 		}
 	}
@@ -203,22 +288,35 @@ func (rp *RequestPool) updatePresenceInternal(db storage.Presence, presence stri
 	if err != nil && err != sql.ErrNoRows {
 		return
 	}
+	var stored *types.PresenceInternal
 	if len(dbPresence) > 0 && dbPresence[0] != nil {
-		newPresence.ClientFields = dbPresence[0].ClientFields
+		stored = dbPresence[0]
+		newPresence.ClientFields = stored.ClientFields
 	}
 	newPresence.ClientFields.Presence = presenceToSet.String()
 
 	defer rp.presence.Store(userID, newPresence)
-	// avoid spamming presence updates when syncing
+	// avoid spamming presence updates when syncing. The stored presence is
+	// checked too, as it may have been changed by PUT /presence since, in
+	// which case the next sync should correct it.
 	existingPresence, ok := rp.presence.LoadOrStore(userID, newPresence)
 	if ok {
 		p := existingPresence.(types.PresenceInternal)
-		if p.ClientFields.Presence == newPresence.ClientFields.Presence {
+		if p.ClientFields.Presence == newPresence.ClientFields.Presence &&
+			(stored == nil || stored.Presence == presenceToSet) {
+			// Nothing has changed that other users need to be told about, but
+			// keep the last active time roughly up to date so that it is right
+			// when they are next told.
+			if stored != nil && lastActiveTS.Time().Sub(stored.LastActiveTS.Time()) > lastActiveGranularity {
+				if err = db.UpdateLastActive(context.Background(), userID, lastActiveTS); err != nil {
+					logrus.WithError(err).Error("Unable to update last active time from sync")
+				}
+			}
 			return
 		}
 	}
 
-	if err := rp.producer.SendPresence(userID, presenceToSet, newPresence.ClientFields.StatusMsg); err != nil {
+	if err := rp.producer.SendPresence(userID, presenceToSet, newPresence.ClientFields.StatusMsg, lastActiveTS); err != nil {
 		logrus.WithError(err).Error("Unable to publish presence message from sync")
 		return
 	}
@@ -227,7 +325,7 @@ func (rp *RequestPool) updatePresenceInternal(db storage.Presence, presence stri
 	// the /sync response else we may not return presence: online immediately.
 	rp.consumer.EmitPresence(
 		context.Background(), userID, presenceToSet, newPresence.ClientFields.StatusMsg,
-		spec.AsTimestamp(time.Now()), true,
+		lastActiveTS, true,
 	)
 
 }
@@ -237,23 +335,10 @@ func (rp *RequestPool) updateLastSeen(req *http.Request, device *userapi.Device)
 		return
 	}
 
-	remoteAddr := req.RemoteAddr
-	if rp.cfg.RealIPHeader != "" {
-		if header := req.Header.Get(rp.cfg.RealIPHeader); header != "" {
-			// TODO: Maybe this isn't great but it will satisfy both X-Real-IP
-			// and X-Forwarded-For (which can be a list where the real client
-			// address is the first listed address). Make more intelligent?
-			addresses := strings.Split(header, ",")
-			if ip := net.ParseIP(addresses[0]); ip != nil {
-				remoteAddr = addresses[0]
-			}
-		}
-	}
-
 	lsreq := &userapi.PerformLastSeenUpdateRequest{
 		UserID:     device.UserID,
 		DeviceID:   device.ID,
-		RemoteAddr: remoteAddr,
+		RemoteAddr: httputil.RemoteIP(req, rp.cfg.Matrix.RealIPHeader),
 		UserAgent:  req.UserAgent(),
 	}
 	lsres := &userapi.PerformLastSeenUpdateResponse{}
@@ -308,10 +393,16 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	waitingSyncRequests.Inc()
 	defer waitingSyncRequests.Dec()
 
-	// Clean up old send-to-device messages from before this stream position.
-	// This is needed to avoid sending the same message multiple times
-	if err = rp.db.CleanSendToDeviceUpdates(syncReq.Context, syncReq.Device.UserID, syncReq.Device.ID, syncReq.Since.SendToDevicePosition); err != nil {
-		syncReq.Log.WithError(err).Error("p.DB.CleanSendToDeviceUpdates failed")
+	// The since token acknowledges all send-to-device messages up to this
+	// stream position, so they can be cleaned up.
+	rp.ackSendToDevice(syncReq.Device.UserID, syncReq.Device.ID, syncReq.Since.SendToDevicePosition)
+	if syncReq.Since.SendToDevicePosition == 0 {
+		// An initial sync would otherwise return messages that have already
+		// been acknowledged but not yet cleaned up.
+		key := sendToDeviceKey{syncReq.Device.UserID, syncReq.Device.ID}
+		if err = rp.flushSendToDeviceAcks(syncReq.Context, &key); err != nil {
+			syncReq.Log.WithError(err).Error("rp.flushSendToDeviceAcks failed")
+		}
 	}
 
 	// loop until we get some data
@@ -346,10 +437,20 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 				}
 			}
 
+			// If the process starts shutting down then respond straight
+			// away, so that the long-poll doesn't hold up the shutdown.
+			var draining <-chan struct{}
+			if processCtx := process.FromContext(syncReq.Context); processCtx != nil {
+				draining = processCtx.WaitForDrain()
+			}
+
 			select {
 			case <-syncReq.Context.Done(): // Caller gave up
 				return giveup()
 
+			case <-draining: // Shutting down
+				return giveup()
+
 			case <-timer.C: // Timeout reached
 				return giveup()
 
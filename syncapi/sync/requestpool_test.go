@@ -2,12 +2,15 @@ package sync
 
 import (
 	"context"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+	"github.com/neilalexander/harmony/syncapi/storage"
 	"github.com/neilalexander/harmony/syncapi/synctypes"
 	"github.com/neilalexander/harmony/syncapi/types"
 )
@@ -17,7 +20,7 @@ type dummyPublisher struct {
 	count int
 }
 
-func (d *dummyPublisher) SendPresence(userID string, presence types.Presence, statusMsg *string) error {
+func (d *dummyPublisher) SendPresence(userID string, presence types.Presence, statusMsg *string, lastActiveTS spec.Timestamp) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	d.count++
@@ -34,6 +37,10 @@ func (d dummyDB) GetPresences(ctx context.Context, userID []string) ([]*types.Pr
 	return []*types.PresenceInternal{}, nil
 }
 
+func (d dummyDB) UpdateLastActive(ctx context.Context, userID string, lastActiveTS spec.Timestamp) error {
+	return nil
+}
+
 func (d dummyDB) PresenceAfter(ctx context.Context, after types.StreamPosition, filter synctypes.EventFilter) (map[string]*types.PresenceInternal, error) {
 	return map[string]*types.PresenceInternal{}, nil
 }
@@ -145,3 +152,47 @@ func TestRequestPool_updatePresence(t *testing.T) {
 		})
 	}
 }
+
+type sendToDeviceDB struct {
+	storage.Database
+	cleaned chan []types.SendToDeviceAck
+}
+
+func (d *sendToDeviceDB) CleanSendToDeviceUpdates(ctx context.Context, acks []types.SendToDeviceAck) error {
+	d.cleaned <- acks
+	return nil
+}
+
+func TestRequestPool_cleanSendToDevice(t *testing.T) {
+	db := &sendToDeviceDB{cleaned: make(chan []types.SendToDeviceAck, 10)}
+	rp := &RequestPool{
+		db:               db,
+		sendToDeviceAcks: map[sendToDeviceKey]types.StreamPosition{},
+	}
+	processCtx := process.NewProcessContext()
+	done := make(chan struct{})
+	go func() {
+		rp.cleanSendToDevice(processCtx)
+		close(done)
+	}()
+
+	// The acknowledgements which are still outstanding when the server shuts
+	// down are flushed before it stops.
+	rp.ackSendToDevice("@alice:test", "DEVICE", 3)
+	processCtx.ShutdownDendrite()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("cleaning up send-to-device messages didn't stop on shutdown")
+	}
+	processCtx.WaitForComponentsToFinish()
+	close(db.cleaned)
+	var acks []types.SendToDeviceAck
+	for cleaned := range db.cleaned {
+		acks = append(acks, cleaned...)
+	}
+	want := []types.SendToDeviceAck{{UserID: "@alice:test", DeviceID: "DEVICE", Position: 3}}
+	if !reflect.DeepEqual(acks, want) {
+		t.Fatalf("got acks %+v, want %+v", acks, want)
+	}
+}
@@ -49,7 +49,7 @@ func AddPublicRoutes(
 	natsInstance *jetstream.NATSInstance,
 	userAPI userapi.SyncUserAPI,
 	rsAPI api.SyncRoomserverAPI,
-	caches caching.LazyLoadCache,
+	rateLimitStore httputil.RateLimitStore,
 	enableMetrics bool,
 ) {
 	js, natsClient := natsInstance.Prepare(processContext, &dendriteCfg.Global.JetStream)
@@ -61,8 +61,14 @@ func AddPublicRoutes(
 
 	eduCache := caching.NewTypingCache()
 	notifier := notifier.NewNotifier(rsAPI)
-	streams := streams.NewSyncStreamProviders(syncDB, userAPI, rsAPI, eduCache, caches, notifier)
+	streams := streams.NewSyncStreamProviders(syncDB, userAPI, rsAPI, eduCache, notifier)
 	notifier.SetCurrentPosition(streams.Latest(context.Background()))
+	go streams.Checkpoint(processContext, syncDB)
+	if err = streams.RespondToLagRequests(
+		natsClient, dendriteCfg.Global.JetStream.Prefixed(jetstream.RequestSyncStreamLag), syncDB, userAPI,
+	); err != nil {
+		logrus.WithError(err).Panicf("failed to respond to sync stream lag requests")
+	}
 	if err = notifier.Load(context.Background(), syncDB); err != nil {
 		logrus.WithError(err).Panicf("failed to load notifier ")
 	}
@@ -85,7 +91,7 @@ func AddPublicRoutes(
 		userAPI,
 	)
 
-	requestPool := sync.NewRequestPool(syncDB, &dendriteCfg.SyncAPI, userAPI, rsAPI, streams, notifier, federationPresenceProducer, presenceConsumer, enableMetrics)
+	requestPool := sync.NewRequestPool(processContext, syncDB, &dendriteCfg.SyncAPI, userAPI, rsAPI, streams, notifier, federationPresenceProducer, presenceConsumer, enableMetrics)
 
 	if err = presenceConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start presence consumer")
@@ -93,7 +99,7 @@ func AddPublicRoutes(
 
 	keyChangeConsumer := consumers.NewOutputKeyChangeEventConsumer(
 		processContext, &dendriteCfg.SyncAPI, dendriteCfg.Global.JetStream.Prefixed(jetstream.OutputKeyChangeEvent),
-		js, rsAPI, syncDB, notifier,
+		js, rsAPI, userAPI, syncDB, notifier,
 		streams.DeviceListStreamProvider,
 	)
 	if err = keyChangeConsumer.Start(); err != nil {
@@ -144,11 +150,11 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start receipts consumer")
 	}
 
-	rateLimits := httputil.NewRateLimits(&dendriteCfg.ClientAPI.RateLimiting)
+	rateLimits := httputil.NewRateLimits(processContext.Context(), "syncapi", &dendriteCfg.ClientAPI.RateLimiting, rateLimitStore)
 
 	routing.Setup(
 		routers.Client, requestPool, syncDB, userAPI,
-		rsAPI, &dendriteCfg.SyncAPI, caches, fts,
+		rsAPI, &dendriteCfg.SyncAPI, fts,
 		rateLimits,
 	)
 }
@@ -46,6 +46,14 @@ type RoomFilter struct {
 	State        StateFilter     `json:"state,omitempty"`
 	Timeline     RoomEventFilter `json:"timeline,omitempty"`
 	AccountData  RoomEventFilter `json:"account_data,omitempty"`
+	// Limit is the maximum number of joined rooms to include in a complete
+	// sync. The most recently active rooms are included first. This is not
+	// part of the spec, but allows clients to quickly show the rooms which are
+	// most likely to be relevant. When rooms are left out, the rooms section
+	// of the response has org.matrix.harmony.limited set. Those rooms won't be
+	// sent in later incremental syncs until they have new activity, so clients
+	// must follow up with a complete sync without a limit.
+	Limit int `json:"org.matrix.harmony.room_limit,omitempty"`
 }
 
 // StateFilter is used to define filtering rules for state events
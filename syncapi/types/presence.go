@@ -73,9 +73,10 @@ func (p1 *PresenceInternal) Equals(p2 *PresenceInternal) bool {
 		p1.UserID == p2.UserID
 }
 
-// CurrentlyActive returns the current active state.
+// CurrentlyActive returns the current active state. Only users who are online
+// can be currently active.
 func (p *PresenceInternal) CurrentlyActive() bool {
-	return time.Since(p.LastActiveTS.Time()).Minutes() < 5
+	return p.Presence == PresenceOnline && time.Since(p.LastActiveTS.Time()).Minutes() < 5
 }
 
 // LastActiveAgo returns the time since the LastActiveTS in milliseconds.
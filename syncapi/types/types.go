@@ -38,6 +38,19 @@ var (
 	ErrMalformedSyncToken = errors.New("malformed sync token")
 )
 
+// BumpEventTypes are the event types which move a room to the top of a
+// user's room list when they are sent into it. Other activity, such as
+// state changes made by other users, doesn't affect the ordering.
+var BumpEventTypes = []string{
+	spec.MRoomCreate,
+	"m.room.message",
+	"m.room.encrypted",
+	"m.sticker",
+	"m.call.invite",
+	"m.poll.start",
+	"m.beacon_info",
+}
+
 type StateDelta struct {
 	RoomID      string
 	StateEvents []*types.HeaderedEvent
@@ -349,6 +362,9 @@ type RoomsResponse struct {
 	Join   map[string]*JoinResponse   `json:"join,omitempty"`
 	Invite map[string]*InviteResponse `json:"invite,omitempty"`
 	Leave  map[string]*LeaveResponse  `json:"leave,omitempty"`
+	// Limited is set when joined rooms were left out of a complete sync
+	// because of the room limit of the filter.
+	Limited bool `json:"org.matrix.harmony.limited,omitempty"`
 }
 
 type ToDeviceResponse struct {
@@ -383,7 +399,7 @@ func (r Response) MarshalJSON() ([]byte, error) {
 	}
 	if r.Rooms != nil {
 		if len(r.Rooms.Join) == 0 &&
-			len(r.Rooms.Invite) == 0 && len(r.Rooms.Leave) == 0 {
+			len(r.Rooms.Invite) == 0 && len(r.Rooms.Leave) == 0 && !r.Rooms.Limited {
 			a.Rooms = nil
 		}
 	}
@@ -470,6 +486,9 @@ type JoinResponse struct {
 	Ephemeral            *ClientEvents `json:"ephemeral,omitempty"`
 	AccountData          *ClientEvents `json:"account_data,omitempty"`
 	*UnreadNotifications `json:"unread_notifications,omitempty"`
+	// BumpStamp is the stream position of the last activity in the room which
+	// should move it up the user's room list, so that clients can order rooms.
+	BumpStamp StreamPosition `json:"org.matrix.msc4186.bump_stamp,omitempty"`
 }
 
 func (jr JoinResponse) MarshalJSON() ([]byte, error) {
@@ -599,6 +618,14 @@ type SendToDeviceEvent struct {
 	DeviceID string
 }
 
+// SendToDeviceAck records that a device has received all send-to-device
+// messages up to and including Position, as implied by its sync token.
+type SendToDeviceAck struct {
+	UserID   string
+	DeviceID string
+	Position StreamPosition
+}
+
 // OutputReceiptEvent is an entry in the receipt output kafka log
 type OutputReceiptEvent struct {
 	UserID    string         `json:"user_id"`
@@ -614,6 +641,9 @@ type OutputReceiptEvent struct {
 type OutputSendToDeviceEvent struct {
 	UserID   string `json:"user_id"`
 	DeviceID string `json:"device_id"`
+	// MessageID is shared by all messages sent by the same client request,
+	// so that they can be batched and deduplicated over federation.
+	MessageID string `json:"message_id,omitempty"`
 	gomatrixserverlib.SendToDeviceEvent
 }
 
@@ -625,3 +655,30 @@ type RelationEntry struct {
 	Position StreamPosition
 	EventID  string
 }
+
+// ThreadSummary is used for the bundled m.thread aggregation of a thread
+// root, from the replies to it.
+type ThreadSummary struct {
+	Count         int
+	LatestEventID string
+	// Whether the user the summary is for has replied to the thread
+	Participated bool
+}
+
+// Aggregations are the bundled aggregations of a set of events, keyed by
+// the event ID of the event which they relate to.
+type Aggregations struct {
+	// The annotations of each event, most used first.
+	Annotations map[string][]AnnotationCount
+	Threads     map[string]ThreadSummary
+	// The event ID of the latest valid edit of each event.
+	Edits map[string]string
+}
+
+// AnnotationCount is an entry in the bundled m.annotation aggregation of an
+// event, counting the annotations which share a type and key.
+type AnnotationCount struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -25,6 +26,7 @@ import (
 	"github.com/neilalexander/harmony/federationapi/types"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/util"
 	rstypes "github.com/neilalexander/harmony/roomserver/types"
 )
 
@@ -42,6 +44,15 @@ type InMemoryFederationDatabase struct {
 	associatedPDUs     map[spec.ServerName]map[*receipt.Receipt]struct{}
 	associatedEDUs     map[spec.ServerName]map[*receipt.Receipt]struct{}
 	relayServers       map[spec.ServerName][]spec.ServerName
+	disabledRooms      map[string]struct{}
+	transactionIDs     map[spec.ServerName]int64
+	transactionPrefix  string
+	inFlight           map[spec.ServerName]inFlightTransaction
+}
+
+type inFlightTransaction struct {
+	transactionID gomatrixserverlib.TransactionID
+	pdus, edus    []*receipt.Receipt
 }
 
 func NewInMemoryFederationDatabase() *InMemoryFederationDatabase {
@@ -55,6 +66,10 @@ func NewInMemoryFederationDatabase() *InMemoryFederationDatabase {
 		associatedPDUs:     make(map[spec.ServerName]map[*receipt.Receipt]struct{}),
 		associatedEDUs:     make(map[spec.ServerName]map[*receipt.Receipt]struct{}),
 		relayServers:       make(map[spec.ServerName][]spec.ServerName),
+		disabledRooms:      make(map[string]struct{}),
+		transactionIDs:     make(map[spec.ServerName]int64),
+		transactionPrefix:  util.RandomString(8),
+		inFlight:           make(map[spec.ServerName]inFlightTransaction),
 	}
 }
 
@@ -244,6 +259,29 @@ func (d *InMemoryFederationDatabase) GetPendingEDUCount(
 	return count, nil
 }
 
+func (d *InMemoryFederationDatabase) GetPendingSummary(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (pdus, edus int64, oldest spec.Timestamp, err error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	return int64(len(d.associatedPDUs[serverName])), int64(len(d.associatedEDUs[serverName])), 0, nil
+}
+
+func (d *InMemoryFederationDatabase) DropPending(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	delete(d.associatedPDUs, serverName)
+	delete(d.associatedEDUs, serverName)
+	delete(d.inFlight, serverName)
+	return nil
+}
+
 func (d *InMemoryFederationDatabase) GetPendingPDUServerNames(
 	ctx context.Context,
 ) ([]spec.ServerName, error) {
@@ -312,6 +350,19 @@ func (d *InMemoryFederationDatabase) IsServerBlacklisted(
 	return isBlacklisted, nil
 }
 
+func (d *InMemoryFederationDatabase) GetBlacklistedServers(
+	ctx context.Context,
+) ([]spec.ServerName, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	servers := []spec.ServerName{}
+	for serverName := range d.blacklistedServers {
+		servers = append(servers, serverName)
+	}
+	return servers, nil
+}
+
 func (d *InMemoryFederationDatabase) SetServerAssumedOffline(
 	ctx context.Context,
 	serverName spec.ServerName,
@@ -399,6 +450,14 @@ func (d *InMemoryFederationDatabase) GetNotaryKeys(ctx context.Context, serverNa
 	return nil, nil
 }
 
+func (d *InMemoryFederationDatabase) GetServerKeys(ctx context.Context, serverName spec.ServerName) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return nil, nil
+}
+
+func (d *InMemoryFederationDatabase) PurgeExpiredServerKeys(ctx context.Context, before spec.Timestamp) ([]gomatrixserverlib.PublicKeyLookupRequest, error) {
+	return nil, nil
+}
+
 func (d *InMemoryFederationDatabase) DeleteExpiredEDUs(ctx context.Context) error {
 	return nil
 }
@@ -406,3 +465,96 @@ func (d *InMemoryFederationDatabase) DeleteExpiredEDUs(ctx context.Context) erro
 func (d *InMemoryFederationDatabase) PurgeRoom(ctx context.Context, roomID string) error {
 	return nil
 }
+
+func (d *InMemoryFederationDatabase) SetRoomFederationDisabled(ctx context.Context, roomID string, disabled bool) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	if disabled {
+		d.disabledRooms[roomID] = struct{}{}
+	} else {
+		delete(d.disabledRooms, roomID)
+	}
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) StartTransaction(
+	ctx context.Context,
+	serverName spec.ServerName,
+	pdus, edus []*receipt.Receipt,
+) (gomatrixserverlib.TransactionID, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	d.transactionIDs[serverName]++
+	transactionID := gomatrixserverlib.TransactionID(fmt.Sprintf("%s-%d", d.transactionPrefix, d.transactionIDs[serverName]))
+	d.inFlight[serverName] = inFlightTransaction{transactionID, pdus, edus}
+	return transactionID, nil
+}
+
+func (d *InMemoryFederationDatabase) GetInFlightTransaction(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (
+	gomatrixserverlib.TransactionID,
+	map[*receipt.Receipt]*rstypes.HeaderedEvent,
+	map[*receipt.Receipt]*gomatrixserverlib.EDU,
+	error,
+) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	inFlight := d.inFlight[serverName]
+	pdus := make(map[*receipt.Receipt]*rstypes.HeaderedEvent)
+	for _, dbReceipt := range inFlight.pdus {
+		if _, ok := d.associatedPDUs[serverName][dbReceipt]; ok {
+			pdus[dbReceipt] = d.pendingPDUs[dbReceipt]
+		}
+	}
+	edus := make(map[*receipt.Receipt]*gomatrixserverlib.EDU)
+	for _, dbReceipt := range inFlight.edus {
+		if _, ok := d.associatedEDUs[serverName][dbReceipt]; ok {
+			edus[dbReceipt] = d.pendingEDUs[dbReceipt]
+		}
+	}
+	return inFlight.transactionID, pdus, edus, nil
+}
+
+func (d *InMemoryFederationDatabase) FinishTransaction(
+	ctx context.Context,
+	serverName spec.ServerName,
+	pdus, edus []*receipt.Receipt,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	for _, dbReceipt := range pdus {
+		delete(d.associatedPDUs[serverName], dbReceipt)
+	}
+	for _, dbReceipt := range edus {
+		delete(d.associatedEDUs[serverName], dbReceipt)
+	}
+	delete(d.inFlight, serverName)
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) IsRoomFederationDisabled(ctx context.Context, roomID string) (bool, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	_, ok := d.disabledRooms[roomID]
+	return ok, nil
+}
+
+func (d *InMemoryFederationDatabase) FederatedRooms(ctx context.Context, roomIDs []string) ([]string, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	federated := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if _, ok := d.disabledRooms[roomID]; !ok {
+			federated = append(federated, roomID)
+		}
+	}
+	return federated, nil
+}
@@ -99,6 +99,18 @@ type ClientUserAPI interface {
 	PerformAdminGetRegistrationToken(ctx context.Context, tokenString string) (*clientapi.RegistrationToken, error)
 	PerformAdminDeleteRegistrationToken(ctx context.Context, tokenString string) error
 	PerformAdminUpdateRegistrationToken(ctx context.Context, tokenString string, newAttributes map[string]interface{}) (*clientapi.RegistrationToken, error)
+	PerformAdminUpsertTask(ctx context.Context, task *clientapi.AdminTask) error
+	PerformAdminFailUnfinishedTasks(ctx context.Context, reason string) (int64, error)
+	QueryAdminTask(ctx context.Context, taskID string) (*clientapi.AdminTask, error)
+	QueryAdminTasks(ctx context.Context, limit int) ([]clientapi.AdminTask, error)
+	PerformSaveThreePIDBinding(ctx context.Context, userID string, binding *ThreePIDBinding) error
+	PerformRemoveThreePIDBinding(ctx context.Context, userID string, binding *ThreePIDBinding) error
+	QueryThreePIDBindings(ctx context.Context, userID string) ([]ThreePIDBinding, error)
+	PerformSaveDelayedEvent(ctx context.Context, ev *DelayedEvent) error
+	PerformRestartDelayedEvent(ctx context.Context, delayID string, runningSince spec.Timestamp) (bool, error)
+	PerformRemoveDelayedEvent(ctx context.Context, delayID string) (bool, error)
+	// QueryDelayedEvents returns the user's delayed events, or everyone's if userID is empty.
+	QueryDelayedEvents(ctx context.Context, userID string) ([]DelayedEvent, error)
 	PerformAccountCreation(ctx context.Context, req *PerformAccountCreationRequest, res *PerformAccountCreationResponse) error
 	PerformDeviceCreation(ctx context.Context, req *PerformDeviceCreationRequest, res *PerformDeviceCreationResponse) error
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
@@ -253,9 +265,10 @@ type QueryDeviceInfosRequest struct {
 
 // QueryDeviceInfosResponse is the response to QueryDeviceInfos
 type QueryDeviceInfosResponse struct {
-	DeviceInfo map[string]struct {
+	// Keyed by user ID and then device ID, as devices of different users can
+	// have the same ID.
+	DeviceInfo map[string]map[string]struct {
 		DisplayName string
-		UserID      string
 	}
 }
 
@@ -269,8 +282,9 @@ type QueryAccessTokenRequest struct {
 
 // QueryAccessTokenResponse is the response for QueryAccessToken
 type QueryAccessTokenResponse struct {
-	Device *Device
-	Err    string // e.g ErrorForbidden
+	Device     *Device
+	Err        string // e.g ErrorForbidden
+	SoftLogout bool   // true if the token belonged to a device that was soft logged out
 }
 
 // QueryAccountDataRequest is the request for QueryAccountData
@@ -319,6 +333,7 @@ type PerformAccountCreationRequest struct {
 
 	AppServiceID string // optional: the application service ID (not user ID) creating this account, if any.
 	Password     string // optional: if missing then this account will be a passwordless account
+	PasswordHash string // optional: a bcrypt hash of the password, used instead of Password
 	OnConflict   Conflict
 }
 
@@ -334,6 +349,7 @@ type PerformPasswordUpdateRequest struct {
 	ServerName    spec.ServerName // Required: The domain for this account.
 	Password      string          // Required: The new password to set.
 	LogoutDevices bool            // Optional: Whether to log out all user devices.
+	SoftLogout    bool            // Optional: Whether logging out should keep the devices and their keys.
 }
 
 // PerformAccountCreationResponse is the response for PerformAccountCreation
@@ -560,15 +576,43 @@ type QueryAccountAvailabilityResponse struct {
 	Available bool
 }
 
+// ThreePIDBinding records that a third-party identifier was bound to a local
+// user on an identity server.
+type ThreePIDBinding struct {
+	Medium   string
+	Address  string
+	IDServer string
+}
+
+// DelayedEvent is an event which a device has asked to be sent after a delay,
+// as described by MSC4140.
+type DelayedEvent struct {
+	DelayID      string
+	UserID       string
+	DeviceID     string
+	RoomID       string
+	Type         string
+	StateKey     *string
+	Content      json.RawMessage
+	Delay        int64 // milliseconds
+	RunningSince spec.Timestamp
+}
+
 type QueryAccountByPasswordRequest struct {
 	Localpart         string
 	ServerName        spec.ServerName
 	PlaintextPassword string
+	// The IP address the attempt came from, if known, so that failed
+	// attempts can be limited per IP address as well as per account
+	RemoteIP string
 }
 
 type QueryAccountByPasswordResponse struct {
 	Account *Account
 	Exists  bool
+	// Set if the attempt was refused without checking the password, because
+	// of too many failed attempts on the account or from the IP address
+	RetryAfter time.Duration
 }
 
 type QueryAccountByLocalpartRequest struct {
@@ -584,6 +628,9 @@ type QueryAccountByLocalpartResponse struct {
 type ClientKeyAPI interface {
 	UploadDeviceKeysAPI
 	QueryKeys(ctx context.Context, req *QueryKeysRequest, res *QueryKeysResponse)
+	// QueryDeviceKeysSnapshot returns all of the known device and cross-signing keys for the
+	// given users, local or remote, as they were at a single point in time.
+	QueryDeviceKeysSnapshot(ctx context.Context, req *QueryDeviceKeysSnapshotRequest, res *QueryDeviceKeysSnapshotResponse) error
 	PerformUploadKeys(ctx context.Context, req *PerformUploadKeysRequest, res *PerformUploadKeysResponse) error
 
 	PerformUploadDeviceSignatures(ctx context.Context, req *PerformUploadDeviceSignaturesRequest, res *PerformUploadDeviceSignaturesResponse)
@@ -845,6 +892,18 @@ type QueryKeysResponse struct {
 	Error *KeyError
 }
 
+type QueryDeviceKeysSnapshotRequest struct {
+	UserIDs []string
+}
+
+type QueryDeviceKeysSnapshotResponse struct {
+	// Map of user_id to device_id to device_key
+	DeviceKeys map[string]map[string]json.RawMessage
+	// Maps of user_id to cross signing key
+	MasterKeys      map[string]fclient.CrossSigningKey
+	SelfSigningKeys map[string]fclient.CrossSigningKey
+}
+
 type QueryKeyChangesRequest struct {
 	// The offset of the last received key event, or sarama.OffsetOldest if this is from the beginning
 	Offset int64
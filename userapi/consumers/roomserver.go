@@ -47,6 +47,7 @@ type OutputRoomEventConsumer struct {
 	lastUpdate   time.Time
 	countsLock   sync.Mutex
 	serverName   spec.ServerName
+	serverRules  *pushrules.ServerRules
 }
 
 func NewOutputRoomEventConsumer(
@@ -58,6 +59,11 @@ func NewOutputRoomEventConsumer(
 	rsAPI rsapi.UserRoomserverAPI,
 	syncProducer *producers.SyncAPI,
 ) *OutputRoomEventConsumer {
+	// The config has already been verified at this point.
+	serverRules, err := cfg.PushRules.ServerRules()
+	if err != nil {
+		log.WithError(err).Error("UserAPI: ignoring invalid server push rules")
+	}
 	return &OutputRoomEventConsumer{
 		ctx:          process.Context(),
 		cfg:          cfg,
@@ -71,6 +77,7 @@ func NewOutputRoomEventConsumer(
 		lastUpdate:   time.Now(),
 		countsLock:   sync.Mutex{},
 		serverName:   cfg.Matrix.ServerName,
+		serverRules:  serverRules,
 	}
 }
 
@@ -102,6 +109,10 @@ func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msgs []*nats.Ms
 			return true
 		}
 		if isNewRoomEvent {
+			if output.NewRoomEvent.RepairsState {
+				// The event has already been processed before.
+				return true
+			}
 			event = output.NewRoomEvent.Event
 		} else {
 			event = output.NewInviteEvent.Event
@@ -154,6 +165,51 @@ func (s *OutputRoomEventConsumer) handleRoomUpgrade(ctx context.Context, oldRoom
 	return nil
 }
 
+// joinUpgradedRoom joins the local members of an upgraded room to the replacement
+// room. The joins happen in the background, as joining over federation can be slow
+// and shouldn't hold up the consumer, but they stop when the server shuts down.
+func (s *OutputRoomEventConsumer) joinUpgradedRoom(ctx context.Context, event *rstypes.HeaderedEvent, newRoomID string, localMembers []*localMembership) {
+	// The sender of the tombstone is already in the new room, so their server
+	// is the best one to join through. If the upgrade was done locally then the
+	// sender will already be joined, so we can skip them.
+	var serverNames []spec.ServerName
+	sender, err := s.rsAPI.QueryUserIDForSender(ctx, event.RoomID(), event.SenderID())
+	if err != nil || sender == nil {
+		log.WithError(err).WithField("room_id", newRoomID).Warn("UserAPI: failed to find sender of tombstone event")
+	} else {
+		serverNames = append(serverNames, sender.Domain())
+	}
+
+	// The context of the message is done with once it has been processed,
+	// so the joins use the context of the consumer instead.
+	go s.joinUpgradedRoomMembers(s.ctx, sender, newRoomID, serverNames, localMembers)
+}
+
+func (s *OutputRoomEventConsumer) joinUpgradedRoomMembers(
+	ctx context.Context, sender *spec.UserID, newRoomID string, serverNames []spec.ServerName, localMembers []*localMembership,
+) {
+	for _, member := range localMembers {
+		if ctx.Err() != nil {
+			return
+		}
+		if member.Membership != spec.Join || (sender != nil && member.UserID == sender.String()) {
+			continue
+		}
+		_, _, err := s.rsAPI.PerformJoin(ctx, &rsapi.PerformJoinRequest{
+			RoomIDOrAlias: newRoomID,
+			UserID:        member.UserID,
+			Content:       map[string]interface{}{},
+			ServerNames:   serverNames,
+		})
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"user_id": member.UserID,
+				"room_id": newRoomID,
+			}).Warn("UserAPI: failed to join upgraded room")
+		}
+	}
+}
+
 func (s *OutputRoomEventConsumer) copyPushrules(ctx context.Context, oldRoomID, newRoomID string, localpart string, serverName spec.ServerName) error {
 	pushRules, err := s.db.QueryPushRules(ctx, localpart, serverName)
 	if err != nil {
@@ -262,6 +318,9 @@ func (s *OutputRoomEventConsumer) processMessage(ctx context.Context, event *rst
 			// while inconvenient, this shouldn't stop us from sending push notifications
 			log.WithError(err).Errorf("UserAPI: failed to handle room upgrade for users")
 		}
+		if s.cfg.AutoJoinUpgradedRooms && newRoomID != "" {
+			s.joinUpgradedRoom(ctx, event, newRoomID, members)
+		}
 
 	}
 
@@ -324,46 +383,58 @@ func newLocalMembership(event *synctypes.ClientEvent) (*localMembership, error)
 	return &member, nil
 }
 
+// membershipsPageSize is how many membership events are fetched from the
+// roomserver at once.
+const membershipsPageSize = 1000
+
 // localRoomMembers fetches the current local members of a room, and
 // the total number of members.
 func (s *OutputRoomEventConsumer) localRoomMembers(ctx context.Context, roomID string) ([]*localMembership, int, error) {
-	// Get only locally joined users to avoid unmarshalling and caching
-	// membership events we only use to calculate the room size.
-	req := &rsapi.QueryMembershipsForRoomRequest{
-		RoomID:     roomID,
-		JoinedOnly: true,
-		LocalOnly:  true,
-	}
-	var res rsapi.QueryMembershipsForRoomResponse
-	if err := s.rsAPI.QueryMembershipsForRoom(ctx, req, &res); err != nil {
-		return nil, 0, err
-	}
-
-	// Since we only queried locally joined users above,
+	// Since we only query locally joined users below,
 	// we also need to ask the roomserver about the joined user count.
 	totalCount, err := s.rsAPI.JoinedUserCount(ctx, roomID)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	// Get only locally joined users to avoid unmarshalling and caching
+	// membership events we only use to calculate the room size. They are
+	// fetched a page at a time so that large rooms aren't loaded at once.
+	req := &rsapi.QueryMembershipsForRoomRequest{
+		RoomID:        roomID,
+		JoinedOnly:    true,
+		LocalOnly:     true,
+		Limit:         membershipsPageSize,
+		MinimalEvents: true,
+	}
 	var members []*localMembership
-	for _, event := range res.JoinEvents {
-		// Filter out invalid join events
-		if event.StateKey == nil {
-			continue
-		}
-		if *event.StateKey == "" {
-			continue
+	for {
+		var res rsapi.QueryMembershipsForRoomResponse
+		if err = s.rsAPI.QueryMembershipsForRoom(ctx, req, &res); err != nil {
+			return nil, 0, err
+		}
+		for _, event := range res.JoinEvents {
+			// Filter out invalid join events
+			if event.StateKey == nil {
+				continue
+			}
+			if *event.StateKey == "" {
+				continue
+			}
+			// We're going to trust the Query from above to really just return
+			// local users
+			member, err := newLocalMembership(&event)
+			if err != nil {
+				log.WithError(err).Errorf("Parsing MemberContent")
+				continue
+			}
+
+			members = append(members, member)
 		}
-		// We're going to trust the Query from above to really just return
-		// local users
-		member, err := newLocalMembership(&event)
-		if err != nil {
-			log.WithError(err).Errorf("Parsing MemberContent")
-			continue
+		if res.NextBatch == "" {
+			break
 		}
-
-		members = append(members, member)
+		req.From = res.NextBatch
 	}
 
 	return members, totalCount, nil
@@ -433,6 +504,7 @@ func (s *OutputRoomEventConsumer) roomName(ctx context.Context, event *rstypes.H
 var (
 	canonicalAliasTuple = gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomCanonicalAlias}
 	roomNameTuple       = gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomName}
+	roomEncryptionTuple = gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomEncryption}
 )
 
 func unmarshalRoomName(event *rstypes.HeaderedEvent) (string, error) {
@@ -603,7 +675,7 @@ func (s *OutputRoomEventConsumer) evaluatePushRules(ctx context.Context, event *
 		roomID:   event.RoomID().String(),
 		roomSize: roomSize,
 	}
-	eval := pushrules.NewRuleSetEvaluator(ec, &ruleSets.Global)
+	eval := pushrules.NewRuleSetEvaluator(ec, s.serverRules.Apply(&ruleSets.Global))
 	rule, err := eval.MatchEvent(event.PDU, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return s.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 	})
@@ -682,12 +754,31 @@ func (s *OutputRoomEventConsumer) localPushDevices(ctx context.Context, localpar
 		if devicesByURL[url] == nil {
 			devicesByURL[url] = make(map[string][]*pushgateway.Device, 2)
 		}
-		devicesByURL[url][pusherDevice.Format] = append(devicesByURL[url][pusherDevice.Format], &pusherDevice.Device)
+		format := s.cfg.PushNotifications.Format(pusherDevice.Format)
+		devicesByURL[url][format] = append(devicesByURL[url][format], &pusherDevice.Device)
 	}
 
 	return devicesByURL, profileTag, nil
 }
 
+// roomIsEncrypted returns whether the event is encrypted or was sent
+// in a room with encryption enabled. If the room state can't be
+// queried then the room is assumed to be encrypted.
+func (s *OutputRoomEventConsumer) roomIsEncrypted(ctx context.Context, event *rstypes.HeaderedEvent) bool {
+	if event.Type() == "m.room.encrypted" {
+		return true
+	}
+	req := &rsapi.QueryCurrentStateRequest{
+		RoomID:      event.RoomID().String(),
+		StateTuples: []gomatrixserverlib.StateKeyTuple{roomEncryptionTuple},
+	}
+	var res rsapi.QueryCurrentStateResponse
+	if err := s.rsAPI.QueryCurrentState(ctx, req, &res); err != nil {
+		return true
+	}
+	return res.StateEvents[roomEncryptionTuple] != nil
+}
+
 // notifyHTTP performs a notificatation to a Push Gateway.
 func (s *OutputRoomEventConsumer) notifyHTTP(ctx context.Context, event *rstypes.HeaderedEvent, url, format string, devices []*pushgateway.Device, localpart, roomName string, userNumUnreadNotifs int) ([]*pushgateway.Device, error) {
 	logger := log.WithFields(log.Fields{
@@ -699,7 +790,7 @@ func (s *OutputRoomEventConsumer) notifyHTTP(ctx context.Context, event *rstypes
 
 	var req pushgateway.NotifyRequest
 	switch format {
-	case "event_id_only":
+	case config.PushFormatEventIDOnly:
 		req = pushgateway.NotifyRequest{
 			Notification: pushgateway.Notification{
 				Counts: &pushgateway.Counts{
@@ -735,6 +826,9 @@ func (s *OutputRoomEventConsumer) notifyHTTP(ctx context.Context, event *rstypes
 		if mem, memberErr := event.Membership(); memberErr == nil {
 			req.Notification.Membership = mem
 		}
+		if s.cfg.PushNotifications.RedactEncryptedRooms && s.roomIsEncrypted(ctx, event) {
+			req.Notification.Content = nil
+		}
 		userID, err := spec.NewUserID(fmt.Sprintf("@%s:%s", localpart, s.cfg.Matrix.ServerName), true)
 		if err != nil {
 			logger.WithError(err).Errorf("Failed to convert local user to userID %s", localpart)
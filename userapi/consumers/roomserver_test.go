@@ -3,12 +3,14 @@ package consumers
 import (
 	"context"
 	"crypto/ed25519"
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/pushgateway"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/roomserver"
 	"github.com/neilalexander/harmony/roomserver/types"
@@ -212,3 +214,139 @@ func BenchmarkLocalRoomMembers(b *testing.B) {
 		assert.Equal(b, expectedLocalMember, members[0])
 	}
 }
+
+// joiningRoomserverAPI records the joins which are performed, cancelling
+// the context after cancelAfter joins if it is set.
+type joiningRoomserverAPI struct {
+	FakeUserRoomserverAPI
+	joins       chan string
+	contexts    chan context.Context
+	cancelAfter int
+	cancel      context.CancelFunc
+}
+
+func (f *joiningRoomserverAPI) PerformJoin(ctx context.Context, req *rsapi.PerformJoinRequest) (string, spec.ServerName, error) {
+	f.joins <- req.UserID
+	f.contexts <- ctx
+	if f.cancelAfter--; f.cancelAfter == 0 {
+		f.cancel()
+	}
+	return req.RoomIDOrAlias, "test", nil
+}
+
+func TestJoinUpgradedRoom(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	tombstone := room.CreateEvent(t, alice, "m.room.tombstone", map[string]string{"replacement_room": "!new:test"}, test.WithStateKey(""))
+	members := []*localMembership{
+		{UserID: alice.ID, MemberContent: gomatrixserverlib.MemberContent{Membership: spec.Join}},
+		{UserID: "@bob:test", MemberContent: gomatrixserverlib.MemberContent{Membership: spec.Join}},
+		{UserID: "@charlie:test", MemberContent: gomatrixserverlib.MemberContent{Membership: spec.Leave}},
+		{UserID: "@dave:test", MemberContent: gomatrixserverlib.MemberContent{Membership: spec.Join}},
+	}
+
+	// The joined members other than the sender of the tombstone are joined in
+	// the background, using the context of the consumer.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rsAPI := &joiningRoomserverAPI{joins: make(chan string, 4), contexts: make(chan context.Context, 4)}
+	consumer := OutputRoomEventConsumer{ctx: ctx, rsAPI: rsAPI}
+	consumer.joinUpgradedRoom(context.Background(), tombstone, "!new:test", members)
+	for _, want := range []string{"@bob:test", "@dave:test"} {
+		select {
+		case userID := <-rsAPI.joins:
+			assert.Equal(t, want, userID)
+			assert.Equal(t, ctx, <-rsAPI.contexts)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s to join", want)
+		}
+	}
+
+	// Once the context is done, no more members are joined.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	rsAPI = &joiningRoomserverAPI{joins: make(chan string, 4), contexts: make(chan context.Context, 4), cancelAfter: 1, cancel: cancel}
+	consumer = OutputRoomEventConsumer{ctx: ctx, rsAPI: rsAPI}
+	consumer.joinUpgradedRoomMembers(ctx, nil, "!new:test", nil, members)
+	assert.Len(t, rsAPI.joins, 1)
+	assert.Equal(t, alice.ID, <-rsAPI.joins)
+}
+
+type encryptionRoomserverAPI struct {
+	FakeUserRoomserverAPI
+	encryption *types.HeaderedEvent
+	err        error
+}
+
+func (f *encryptionRoomserverAPI) QuerySenderIDForUser(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.SenderID, error) {
+	senderID := spec.SenderID(userID.String())
+	return &senderID, nil
+}
+
+func (f *encryptionRoomserverAPI) QueryCurrentState(ctx context.Context, req *rsapi.QueryCurrentStateRequest, res *rsapi.QueryCurrentStateResponse) error {
+	if f.err != nil {
+		return f.err
+	}
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*types.HeaderedEvent{}
+	if f.encryption != nil {
+		res.StateEvents[roomEncryptionTuple] = f.encryption
+	}
+	return nil
+}
+
+type recordingPushGateway struct {
+	reqs []*pushgateway.NotifyRequest
+}
+
+func (g *recordingPushGateway) Notify(ctx context.Context, url string, req *pushgateway.NotifyRequest, resp *pushgateway.NotifyResponse) error {
+	g.reqs = append(g.reqs, req)
+	return nil
+}
+
+func TestNotifyHTTPRedactsEncryptedRooms(t *testing.T) {
+	ctx := context.Background()
+	message := mustCreateEvent(t, `{"type":"m.room.message","content":{"body":"secret"},"room_id":"!room:test","sender":"@bob:test"}`)
+	encrypted := mustCreateEvent(t, `{"type":"m.room.encrypted","content":{"ciphertext":"secret"},"room_id":"!room:test","sender":"@bob:test"}`)
+	encryption := mustCreateEvent(t, `{"type":"m.room.encryption","state_key":"","content":{"algorithm":"m.megolm.v1.aes-sha2"},"room_id":"!room:test","sender":"@bob:test"}`)
+
+	for name, tc := range map[string]struct {
+		redact      bool
+		event       *types.HeaderedEvent
+		encryption  *types.HeaderedEvent
+		err         error
+		format      string
+		wantContent bool
+	}{
+		"redaction disabled":         {event: message, encryption: encryption, wantContent: true},
+		"unencrypted room":           {redact: true, event: message, wantContent: true},
+		"encrypted room":             {redact: true, event: message, encryption: encryption},
+		"encrypted event":            {redact: true, event: encrypted},
+		"room state unavailable":     {redact: true, event: message, err: errors.New("roomserver is down")},
+		"event ID only notification": {redact: true, event: message, format: config.PushFormatEventIDOnly},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.UserAPI{Matrix: &config.Global{}}
+			cfg.Matrix.ServerName = "test"
+			cfg.PushNotifications.RedactEncryptedRooms = tc.redact
+			gateway := &recordingPushGateway{}
+			consumer := OutputRoomEventConsumer{
+				cfg:      cfg,
+				rsAPI:    &encryptionRoomserverAPI{encryption: tc.encryption, err: tc.err},
+				pgClient: gateway,
+			}
+			if _, err := consumer.notifyHTTP(ctx, tc.event, "https://push.test/_matrix/push/v1/notify", tc.format, nil, "alice", "", 1); err != nil {
+				t.Fatal(err)
+			}
+			if len(gateway.reqs) != 1 {
+				t.Fatalf("expected one notification, got %d", len(gateway.reqs))
+			}
+			notification := gateway.reqs[0].Notification
+			if got := notification.Content != nil; got != tc.wantContent {
+				t.Fatalf("got content %s, want content: %v", notification.Content, tc.wantContent)
+			}
+			if notification.EventID != tc.event.EventID() {
+				t.Fatalf("got event ID %q, want %q", notification.EventID, tc.event.EventID())
+			}
+		})
+	}
+}
@@ -20,12 +20,16 @@ import (
 	"fmt"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/neilalexander/harmony/userapi/api"
 )
 
 // PerformLoginTokenCreation creates a new login token and associates it with the provided data.
 func (a *UserInternalAPI) PerformLoginTokenCreation(ctx context.Context, req *api.PerformLoginTokenCreationRequest, res *api.PerformLoginTokenCreationResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformLoginTokenCreation")
+	defer span.End()
+
 	util.GetLogger(ctx).WithField("user_id", req.Data.UserID).Info("PerformLoginTokenCreation")
 	_, domain, err := gomatrixserverlib.SplitID('@', req.Data.UserID)
 	if err != nil {
@@ -44,6 +48,9 @@ func (a *UserInternalAPI) PerformLoginTokenCreation(ctx context.Context, req *ap
 
 // PerformLoginTokenDeletion ensures the token doesn't exist.
 func (a *UserInternalAPI) PerformLoginTokenDeletion(ctx context.Context, req *api.PerformLoginTokenDeletionRequest, res *api.PerformLoginTokenDeletionResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformLoginTokenDeletion")
+	defer span.End()
+
 	util.GetLogger(ctx).Info("PerformLoginTokenDeletion")
 	return a.DB.RemoveLoginToken(ctx, req.Token)
 }
@@ -51,6 +58,9 @@ func (a *UserInternalAPI) PerformLoginTokenDeletion(ctx context.Context, req *ap
 // QueryLoginToken returns the data associated with a login token. If
 // the token is not valid, success is returned, but res.Data == nil.
 func (a *UserInternalAPI) QueryLoginToken(ctx context.Context, req *api.QueryLoginTokenRequest, res *api.QueryLoginTokenResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryLoginToken")
+	defer span.End()
+
 	tokenData, err := a.DB.GetLoginTokenDataByToken(ctx, req.Token)
 	if err != nil {
 		res.Data = nil
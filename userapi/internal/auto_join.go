@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/neilalexander/harmony/clientapi/userutil"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	rsapi "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+	"github.com/neilalexander/harmony/userapi/api"
+	"github.com/sirupsen/logrus"
+)
+
+// postRegisterJoinRooms joins newly registered users to the rooms in the
+// "auto_join_rooms" configuration. Joining remote rooms can take a while, so
+// it happens in the background once registration has completed, and failures
+// are only logged. Shutting down waits for it, and cancels any joins which
+// are still in progress.
+func postRegisterJoinRooms(processCtx *process.ProcessContext, cfg *config.UserAPI, acc *api.Account, rsAPI rsapi.UserRoomserverAPI) {
+	// Appservice users are left for their appservice to manage.
+	if acc.AccountType == api.AccountTypeAppService || acc.AppServiceID != "" || len(cfg.AutoJoinRooms) == 0 {
+		return
+	}
+	if !processCtx.WorkStarted() {
+		return
+	}
+	go func() {
+		defer processCtx.WorkFinished()
+		autoJoinRooms(processCtx.Context(), cfg, acc, rsAPI)
+	}()
+}
+
+func autoJoinRooms(ctx context.Context, cfg *config.UserAPI, acc *api.Account, rsAPI rsapi.UserRoomserverAPI) {
+	userID := userutil.MakeUserID(acc.Localpart, acc.ServerName)
+	for _, room := range cfg.AutoJoinRooms {
+		logger := logrus.WithFields(logrus.Fields{
+			"user_id": userID,
+			"room_id": room,
+		})
+		if cfg.AutoJoinRoomsInviter != "" {
+			// The room may not need an invite, i.e. if it's public, so the
+			// user still tries to join if the invite fails.
+			inviter := userutil.MakeUserID(cfg.AutoJoinRoomsInviter, cfg.Matrix.ServerName)
+			if err := inviteUserToRoom(ctx, cfg, rsAPI, room, inviter, userID); err != nil {
+				logger.WithError(err).Error("user failed to be invited to auto-join room")
+			}
+			if cfg.AutoJoinRoomsInviteOnly {
+				continue
+			}
+		}
+		if err := addUserToRoom(ctx, rsAPI, room, acc.Localpart, userID); err != nil {
+			logger.WithError(err).Error("user failed to auto-join room")
+		}
+	}
+}
+
+// Add user to a room. This function currently working for auto_join_rooms config,
+// which can add a newly registered user to a specified room.
+func addUserToRoom(
+	ctx context.Context,
+	rsAPI rsapi.UserRoomserverAPI,
+	roomID string,
+	username string,
+	userID string,
+) error {
+	addGroupContent := make(map[string]interface{})
+	// This make sure the user's username can be displayed correctly.
+	// Because the newly-registered user doesn't have an avatar, the avatar_url is not needed.
+	addGroupContent["displayname"] = username
+	joinReq := rsapi.PerformJoinRequest{
+		RoomIDOrAlias: roomID,
+		UserID:        userID,
+		Content:       addGroupContent,
+	}
+	_, _, err := rsAPI.PerformJoin(ctx, &joinReq)
+	return err
+}
+
+// inviteUserToRoom invites the user to an auto-join room on behalf of the
+// configured inviter, resolving the room's alias first if needed.
+func inviteUserToRoom(
+	ctx context.Context,
+	cfg *config.UserAPI,
+	rsAPI rsapi.UserRoomserverAPI,
+	roomIDOrAlias, inviterID, userID string,
+) error {
+	if strings.HasPrefix(roomIDOrAlias, "#") {
+		aliasRes := rsapi.GetRoomIDForAliasResponse{}
+		if err := rsAPI.GetRoomIDForAlias(ctx, &rsapi.GetRoomIDForAliasRequest{Alias: roomIDOrAlias}, &aliasRes); err != nil {
+			return fmt.Errorf("rsAPI.GetRoomIDForAlias: %w", err)
+		}
+		if aliasRes.RoomID == "" {
+			return fmt.Errorf("alias %q doesn't exist", roomIDOrAlias)
+		}
+		roomIDOrAlias = aliasRes.RoomID
+	}
+	roomID, err := spec.NewRoomID(roomIDOrAlias)
+	if err != nil {
+		return err
+	}
+	inviter, err := spec.NewUserID(inviterID, true)
+	if err != nil {
+		return err
+	}
+	invitee, err := spec.NewUserID(userID, true)
+	if err != nil {
+		return err
+	}
+	identity, err := cfg.Matrix.SigningIdentityFor(inviter.Domain())
+	if err != nil {
+		return err
+	}
+	return rsAPI.PerformInvite(ctx, &rsapi.PerformInviteRequest{
+		InviteInput: rsapi.InviteInput{
+			RoomID:     *roomID,
+			Inviter:    *inviter,
+			Invitee:    *invitee,
+			KeyID:      identity.KeyID,
+			PrivateKey: identity.PrivateKey,
+			EventTime:  time.Now(),
+		},
+		SendAsServer: string(inviter.Domain()),
+	})
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	rsapi "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
+	"github.com/neilalexander/harmony/userapi/api"
+)
+
+type autoJoinRoomserverAPI struct {
+	rsapi.UserRoomserverAPI
+	calls []string
+}
+
+func (r *autoJoinRoomserverAPI) GetRoomIDForAlias(ctx context.Context, req *rsapi.GetRoomIDForAliasRequest, res *rsapi.GetRoomIDForAliasResponse) error {
+	if req.Alias == "#main:test" {
+		res.RoomID = "!main:test"
+	}
+	return nil
+}
+
+func (r *autoJoinRoomserverAPI) PerformInvite(ctx context.Context, req *rsapi.PerformInviteRequest) error {
+	r.calls = append(r.calls, "invite "+req.InviteInput.Invitee.String()+" to "+req.InviteInput.RoomID.String()+" by "+req.InviteInput.Inviter.String())
+	return nil
+}
+
+func (r *autoJoinRoomserverAPI) PerformJoin(ctx context.Context, req *rsapi.PerformJoinRequest) (string, spec.ServerName, error) {
+	r.calls = append(r.calls, "join "+req.UserID+" to "+req.RoomIDOrAlias)
+	return req.RoomIDOrAlias, "test", nil
+}
+
+func TestAutoJoinRooms(t *testing.T) {
+	cfg := &config.UserAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{ServerName: "test"},
+		},
+		AutoJoinRooms: []string{"#main:test", "#missing:test"},
+	}
+	acc := &api.Account{Localpart: "alice", ServerName: "test"}
+
+	rsAPI := &autoJoinRoomserverAPI{}
+	autoJoinRooms(context.Background(), cfg, acc, rsAPI)
+	want := []string{"join @alice:test to #main:test", "join @alice:test to #missing:test"}
+	if !reflect.DeepEqual(rsAPI.calls, want) {
+		t.Fatalf("got %v, want %v", rsAPI.calls, want)
+	}
+
+	// With an inviter, rooms which can't be invited to are still joined, as
+	// they may not need an invite.
+	cfg.AutoJoinRoomsInviter = "bot"
+	rsAPI = &autoJoinRoomserverAPI{}
+	autoJoinRooms(context.Background(), cfg, acc, rsAPI)
+	want = []string{"invite @alice:test to !main:test by @bot:test", "join @alice:test to #main:test", "join @alice:test to #missing:test"}
+	if !reflect.DeepEqual(rsAPI.calls, want) {
+		t.Fatalf("got %v, want %v", rsAPI.calls, want)
+	}
+
+	cfg.AutoJoinRoomsInviteOnly = true
+	rsAPI = &autoJoinRoomserverAPI{}
+	autoJoinRooms(context.Background(), cfg, acc, rsAPI)
+	want = []string{"invite @alice:test to !main:test by @bot:test"}
+	if !reflect.DeepEqual(rsAPI.calls, want) {
+		t.Fatalf("got %v, want %v", rsAPI.calls, want)
+	}
+}
+
+func TestPostRegisterJoinRooms(t *testing.T) {
+	cfg := &config.UserAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{ServerName: "test"},
+		},
+		AutoJoinRooms: []string{"#main:test"},
+	}
+	acc := &api.Account{Localpart: "alice", ServerName: "test"}
+
+	// Shutting down waits for the joins, which happen in the background.
+	processCtx := process.NewProcessContext()
+	rsAPI := &autoJoinRoomserverAPI{}
+	postRegisterJoinRooms(processCtx, cfg, acc, rsAPI)
+	processCtx.GracefulShutdown(time.Second * 5)
+	want := []string{"join @alice:test to #main:test"}
+	if !reflect.DeepEqual(rsAPI.calls, want) {
+		t.Fatalf("got %v, want %v", rsAPI.calls, want)
+	}
+
+	// Nothing is started once shutting down.
+	rsAPI = &autoJoinRoomserverAPI{}
+	postRegisterJoinRooms(processCtx, cfg, acc, rsAPI)
+	if len(rsAPI.calls) != 0 {
+		t.Fatalf("expected nothing to be joined, got %v", rsAPI.calls)
+	}
+}
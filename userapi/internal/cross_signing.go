@@ -26,6 +26,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/userapi/api"
 	"github.com/neilalexander/harmony/userapi/types"
 	"github.com/sirupsen/logrus"
@@ -107,6 +108,9 @@ func sanityCheckKey(key fclient.CrossSigningKey, userID string, purpose fclient.
 
 // nolint:gocyclo
 func (a *UserInternalAPI) PerformUploadDeviceKeys(ctx context.Context, req *api.PerformUploadDeviceKeysRequest, res *api.PerformUploadDeviceKeysResponse) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformUploadDeviceKeys")
+	defer span.End()
+
 	// Find the keys to store.
 	byPurpose := map[fclient.CrossSigningKeyPurpose]fclient.CrossSigningKey{}
 	toStore := types.CrossSigningKeyMap{}
@@ -268,6 +272,9 @@ func (a *UserInternalAPI) PerformUploadDeviceKeys(ctx context.Context, req *api.
 }
 
 func (a *UserInternalAPI) PerformUploadDeviceSignatures(ctx context.Context, req *api.PerformUploadDeviceSignaturesRequest, res *api.PerformUploadDeviceSignaturesResponse) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformUploadDeviceSignatures")
+	defer span.End()
+
 	// Before we do anything, we need the master and self-signing keys for this user.
 	// Then we can verify the signatures make sense.
 	queryReq := &api.QueryKeysRequest{
@@ -526,6 +533,9 @@ func (a *UserInternalAPI) crossSigningKeysFromDatabase(
 }
 
 func (a *UserInternalAPI) QuerySignatures(ctx context.Context, req *api.QuerySignaturesRequest, res *api.QuerySignaturesResponse) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QuerySignatures")
+	defer span.End()
+
 	for targetUserID, forTargetUser := range req.TargetIDs {
 		keyMap, err := a.KeyDatabase.CrossSigningKeysForUser(ctx, targetUserID)
 		if err != nil && err != sql.ErrNoRows {
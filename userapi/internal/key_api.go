@@ -20,12 +20,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
@@ -35,6 +37,9 @@ import (
 )
 
 func (a *UserInternalAPI) QueryKeyChanges(ctx context.Context, req *api.QueryKeyChangesRequest, res *api.QueryKeyChangesResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryKeyChanges")
+	defer span.End()
+
 	userIDs, latest, err := a.KeyDatabase.KeyChanges(ctx, req.Offset, req.ToOffset)
 	if err != nil {
 		res.Error = &api.KeyError{
@@ -48,6 +53,9 @@ func (a *UserInternalAPI) QueryKeyChanges(ctx context.Context, req *api.QueryKey
 }
 
 func (a *UserInternalAPI) PerformUploadKeys(ctx context.Context, req *api.PerformUploadKeysRequest, res *api.PerformUploadKeysResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformUploadKeys")
+	defer span.End()
+
 	res.KeyErrors = make(map[string]map[string]*api.KeyError)
 	if len(req.DeviceKeys) > 0 {
 		a.uploadLocalDeviceKeys(ctx, req, res)
@@ -72,6 +80,9 @@ func (a *UserInternalAPI) PerformUploadKeys(ctx context.Context, req *api.Perfor
 }
 
 func (a *UserInternalAPI) PerformClaimKeys(ctx context.Context, req *api.PerformClaimKeysRequest, res *api.PerformClaimKeysResponse) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformClaimKeys")
+	defer span.End()
+
 	res.OneTimeKeys = make(map[string]map[string]map[string]json.RawMessage)
 	res.Failures = make(map[string]interface{})
 	// wrap request map in a top-level by-domain map
@@ -120,6 +131,69 @@ func (a *UserInternalAPI) PerformClaimKeys(ctx context.Context, req *api.Perform
 	}
 }
 
+const (
+	// maxClaimKeysBatchSize is how many users' keys are claimed from a
+	// remote server in a single request.
+	maxClaimKeysBatchSize = 100
+	// claimKeysFailureTTL is how long a server which failed to answer a
+	// key claim is skipped for, so that clients retrying don't keep
+	// waiting on a server which is down.
+	claimKeysFailureTTL = time.Second * 30
+)
+
+// claimKeysFailures remembers remote servers which recently failed to answer
+// a key claim.
+type claimKeysFailures struct {
+	sync.Mutex
+	expiries map[spec.ServerName]time.Time
+}
+
+func (c *claimKeysFailures) add(serverName spec.ServerName) {
+	c.Lock()
+	defer c.Unlock()
+	if c.expiries == nil {
+		c.expiries = make(map[spec.ServerName]time.Time)
+	}
+	now := time.Now()
+	for k, expiry := range c.expiries {
+		if now.After(expiry) {
+			delete(c.expiries, k)
+		}
+	}
+	c.expiries[serverName] = now.Add(claimKeysFailureTTL)
+}
+
+func (c *claimKeysFailures) failed(serverName spec.ServerName) bool {
+	c.Lock()
+	defer c.Unlock()
+	expiry, ok := c.expiries[serverName]
+	return ok && time.Now().Before(expiry)
+}
+
+// claimKeysBatches splits the keys to claim from a server into batches of at
+// most maxClaimKeysBatchSize users, sorted by user ID.
+func claimKeysBatches(keysToClaim map[string]map[string]string) []map[string]map[string]string {
+	userIDs := make([]string, 0, len(keysToClaim))
+	for userID := range keysToClaim {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	var batches []map[string]map[string]string
+	for len(userIDs) > 0 {
+		n := len(userIDs)
+		if n > maxClaimKeysBatchSize {
+			n = maxClaimKeysBatchSize
+		}
+		batch := make(map[string]map[string]string, n)
+		for _, userID := range userIDs[:n] {
+			batch[userID] = keysToClaim[userID]
+		}
+		batches = append(batches, batch)
+		userIDs = userIDs[n:]
+	}
+	return batches
+}
+
 func (a *UserInternalAPI) claimRemoteKeys(
 	ctx context.Context, timeout time.Duration, res *api.PerformClaimKeysResponse, domainToDeviceKeys map[string]map[string]map[string]string,
 ) {
@@ -131,32 +205,84 @@ func (a *UserInternalAPI) claimRemoteKeys(
 	util.GetLogger(ctx).Infof("Claiming remote keys from %d server(s)", len(domainToDeviceKeys))
 	wg.Add(len(domainToDeviceKeys))
 
+	// The timeout covers all of the batches rather than each of them, so
+	// that the client isn't kept waiting for longer than it asked for.
+	claimCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		claimCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// failed records that the keys of the given users couldn't be claimed
+	// from the server. Callers must hold mu.
+	failed := func(domain string, batch map[string]map[string]string, message string) {
+		failure, ok := res.Failures[domain].(map[string]interface{})
+		if !ok {
+			failure = map[string]interface{}{
+				"message":  message,
+				"user_ids": []string{},
+			}
+			res.Failures[domain] = failure
+			failures++
+		}
+		userIDs := failure["user_ids"].([]string)
+		for userID := range batch {
+			userIDs = append(userIDs, userID)
+		}
+		sort.Strings(userIDs)
+		failure["user_ids"] = userIDs
+	}
+
 	for d, k := range domainToDeviceKeys {
 		go func(domain string, keysToClaim map[string]map[string]string) {
-			fedCtx, cancel := context.WithTimeout(ctx, timeout)
-			defer cancel()
 			defer wg.Done()
+			batches := claimKeysBatches(keysToClaim)
 
-			claimKeyRes, err := a.FedClient.ClaimKeys(fedCtx, a.Config.Matrix.ServerName, spec.ServerName(domain), keysToClaim)
-
-			mu.Lock()
-			defer mu.Unlock()
-
-			if err != nil {
-				util.GetLogger(ctx).WithError(err).WithField("server", domain).Error("ClaimKeys failed")
-				res.Failures[domain] = map[string]interface{}{
-					"message": err.Error(),
+			// Don't wait on servers which have only just failed to answer.
+			if a.claimFailures.failed(spec.ServerName(domain)) {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, batch := range batches {
+					failed(domain, batch, "server recently failed to respond, not retrying yet")
 				}
-				failures++
 				return
 			}
 
-			for userID, deviceIDToKeys := range claimKeyRes.OneTimeKeys {
-				res.OneTimeKeys[userID] = make(map[string]map[string]json.RawMessage)
-				for deviceID, keys := range deviceIDToKeys {
-					res.OneTimeKeys[userID][deviceID] = keys
-					claimed += len(keys)
+			// The batches for a server are claimed one after another, so that
+			// one server isn't sent lots of requests at once.
+			for i, batch := range batches {
+				claimKeyRes, err := a.FedClient.ClaimKeys(claimCtx, a.Config.Matrix.ServerName, spec.ServerName(domain), batch)
+
+				if err != nil {
+					util.GetLogger(ctx).WithError(err).WithField("server", domain).Error("ClaimKeys failed")
+					// Running out of the time that the client gave us isn't
+					// the server's fault, so it isn't recorded as a failure.
+					if claimCtx.Err() == nil {
+						a.claimFailures.add(spec.ServerName(domain))
+					}
+					mu.Lock()
+					// Don't bother asking for the rest of the batches, as
+					// the server probably won't answer them either.
+					for _, batch := range batches[i:] {
+						failed(domain, batch, err.Error())
+					}
+					mu.Unlock()
+					return
 				}
+
+				mu.Lock()
+				for userID, deviceIDToKeys := range claimKeyRes.OneTimeKeys {
+					if _, ok := batch[userID]; !ok {
+						continue // we didn't ask for this user
+					}
+					res.OneTimeKeys[userID] = make(map[string]map[string]json.RawMessage)
+					for deviceID, keys := range deviceIDToKeys {
+						res.OneTimeKeys[userID][deviceID] = keys
+						claimed += len(keys)
+					}
+				}
+				mu.Unlock()
 			}
 		}(d, k)
 	}
@@ -169,6 +295,9 @@ func (a *UserInternalAPI) claimRemoteKeys(
 }
 
 func (a *UserInternalAPI) PerformDeleteKeys(ctx context.Context, req *api.PerformDeleteKeysRequest, res *api.PerformDeleteKeysResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformDeleteKeys")
+	defer span.End()
+
 	if err := a.KeyDatabase.DeleteDeviceKeys(ctx, req.UserID, req.KeyIDs); err != nil {
 		res.Error = &api.KeyError{
 			Err: fmt.Sprintf("Failed to delete device keys: %s", err),
@@ -178,6 +307,9 @@ func (a *UserInternalAPI) PerformDeleteKeys(ctx context.Context, req *api.Perfor
 }
 
 func (a *UserInternalAPI) QueryOneTimeKeys(ctx context.Context, req *api.QueryOneTimeKeysRequest, res *api.QueryOneTimeKeysResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryOneTimeKeys")
+	defer span.End()
+
 	count, err := a.KeyDatabase.OneTimeKeysCount(ctx, req.UserID, req.DeviceID)
 	if err != nil {
 		res.Error = &api.KeyError{
@@ -198,6 +330,9 @@ func (a *UserInternalAPI) QueryOneTimeKeys(ctx context.Context, req *api.QueryOn
 }
 
 func (a *UserInternalAPI) QueryDeviceMessages(ctx context.Context, req *api.QueryDeviceMessagesRequest, res *api.QueryDeviceMessagesResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryDeviceMessages")
+	defer span.End()
+
 	msgs, err := a.KeyDatabase.DeviceKeysForUser(ctx, req.UserID, nil, false)
 	if err != nil {
 		res.Error = &api.KeyError{
@@ -225,6 +360,9 @@ func (a *UserInternalAPI) QueryDeviceMessages(ctx context.Context, req *api.Quer
 // PerformMarkAsStaleIfNeeded marks the users device list as stale, if the given deviceID is not present
 // in our database.
 func (a *UserInternalAPI) PerformMarkAsStaleIfNeeded(ctx context.Context, req *api.PerformMarkAsStaleRequest, res *struct{}) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformMarkAsStaleIfNeeded")
+	defer span.End()
+
 	knownDevices, err := a.KeyDatabase.DeviceKeysForUser(ctx, req.UserID, []string{}, true)
 	if err != nil {
 		return err
@@ -244,6 +382,9 @@ func (a *UserInternalAPI) PerformMarkAsStaleIfNeeded(ctx context.Context, req *a
 
 // nolint:gocyclo
 func (a *UserInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysRequest, res *api.QueryKeysResponse) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryKeys")
+	defer span.End()
+
 	var respMu sync.Mutex
 	res.DeviceKeys = make(map[string]map[string]json.RawMessage)
 	res.MasterKeys = make(map[string]fclient.CrossSigningKey)
@@ -292,8 +433,8 @@ func (a *UserInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReque
 				}
 				// inject display name if known (either locally or remotely)
 				displayName := dk.DisplayName
-				if queryRes.DeviceInfo[dk.DeviceID].DisplayName != "" {
-					displayName = queryRes.DeviceInfo[dk.DeviceID].DisplayName
+				if info := queryRes.DeviceInfo[userID][dk.DeviceID]; info.DisplayName != "" {
+					displayName = info.DisplayName
 				}
 				dk.KeyJSON, _ = sjson.SetBytes(dk.KeyJSON, "unsigned", struct {
 					DisplayName string `json:"device_display_name,omitempty"`
@@ -401,6 +542,58 @@ func (a *UserInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReque
 	}
 }
 
+func (a *UserInternalAPI) QueryDeviceKeysSnapshot(ctx context.Context, req *api.QueryDeviceKeysSnapshotRequest, res *api.QueryDeviceKeysSnapshotResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryDeviceKeysSnapshot")
+	defer span.End()
+
+	res.DeviceKeys = make(map[string]map[string]json.RawMessage)
+	res.MasterKeys = make(map[string]fclient.CrossSigningKey)
+	res.SelfSigningKeys = make(map[string]fclient.CrossSigningKey)
+	deviceKeys, crossSigningKeys, err := a.KeyDatabase.DeviceKeysSnapshot(ctx, req.UserIDs)
+	if err != nil {
+		return fmt.Errorf("a.KeyDatabase.DeviceKeysSnapshot: %w", err)
+	}
+
+	// Display names of local devices are stored with the devices rather
+	// than the keys.
+	var localDeviceIDs []string
+	for _, dk := range deviceKeys {
+		if _, serverName, err := gomatrixserverlib.SplitID('@', dk.UserID); err == nil && a.Config.Matrix.IsLocalServerName(serverName) {
+			localDeviceIDs = append(localDeviceIDs, dk.DeviceID)
+		}
+	}
+	var queryRes api.QueryDeviceInfosResponse
+	if len(localDeviceIDs) > 0 {
+		if err = a.QueryDeviceInfos(ctx, &api.QueryDeviceInfosRequest{
+			DeviceIDs: localDeviceIDs,
+		}, &queryRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Warn("Failed to QueryDeviceInfos for device IDs, display names will be missing")
+		}
+	}
+
+	for _, dk := range deviceKeys {
+		displayName := dk.DisplayName
+		if info := queryRes.DeviceInfo[dk.UserID][dk.DeviceID]; info.DisplayName != "" {
+			displayName = info.DisplayName
+		}
+		if res.DeviceKeys[dk.UserID] == nil {
+			res.DeviceKeys[dk.UserID] = make(map[string]json.RawMessage)
+		}
+		res.DeviceKeys[dk.UserID][dk.DeviceID], _ = sjson.SetBytes(dk.KeyJSON, "unsigned", struct {
+			DisplayName string `json:"device_display_name,omitempty"`
+		}{displayName})
+	}
+	for userID, keys := range crossSigningKeys {
+		if key, ok := keys[fclient.CrossSigningKeyPurposeMaster]; ok {
+			res.MasterKeys[userID] = key
+		}
+		if key, ok := keys[fclient.CrossSigningKeyPurposeSelfSigning]; ok {
+			res.SelfSigningKeys[userID] = key
+		}
+	}
+	return nil
+}
+
 func (a *UserInternalAPI) remoteKeysFromDatabase(
 	ctx context.Context, res *api.QueryKeysResponse, respMu *sync.Mutex, domainToDeviceKeys map[string]map[string][]string,
 ) map[string]map[string][]string {
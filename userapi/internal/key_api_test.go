@@ -2,9 +2,17 @@ package internal_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	fedapi "github.com/neilalexander/harmony/federationapi/api"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/test"
@@ -158,3 +166,128 @@ func Test_QueryDeviceMessages(t *testing.T) {
 		}
 	})
 }
+
+type claimKeysFedClient struct {
+	fedapi.KeyserverFederationAPI
+	mu    sync.Mutex
+	calls map[spec.ServerName]int
+}
+
+func (f *claimKeysFedClient) ClaimKeys(ctx context.Context, origin, s spec.ServerName, oneTimeKeys map[string]map[string]string) (fclient.RespClaimKeys, error) {
+	f.mu.Lock()
+	f.calls[s]++
+	f.mu.Unlock()
+	switch s {
+	case "dead":
+		return fclient.RespClaimKeys{}, errors.New("connection refused")
+	case "slow":
+		select {
+		case <-time.After(time.Millisecond * 300):
+		case <-ctx.Done():
+			return fclient.RespClaimKeys{}, ctx.Err()
+		}
+	}
+	res := fclient.RespClaimKeys{OneTimeKeys: map[string]map[string]map[string]json.RawMessage{}}
+	for userID, devices := range oneTimeKeys {
+		res.OneTimeKeys[userID] = map[string]map[string]json.RawMessage{}
+		for deviceID, algorithm := range devices {
+			res.OneTimeKeys[userID][deviceID] = map[string]json.RawMessage{algorithm + ":AAAA": json.RawMessage(`"key"`)}
+		}
+	}
+	return res, nil
+}
+
+func TestPerformClaimKeysRemote(t *testing.T) {
+	fedClient := &claimKeysFedClient{calls: map[spec.ServerName]int{}}
+	keyAPI := &internal.UserInternalAPI{
+		Config: &config.UserAPI{
+			Matrix: &config.Global{
+				SigningIdentity: fclient.SigningIdentity{ServerName: "test"},
+			},
+		},
+		FedClient: fedClient,
+	}
+
+	req := &api.PerformClaimKeysRequest{
+		OneTimeKeys: map[string]map[string]string{
+			"@bob:dead": {"DEVICE": "signed_curve25519"},
+		},
+		Timeout: time.Second,
+	}
+	for i := 0; i < 150; i++ {
+		req.OneTimeKeys[fmt.Sprintf("@user%d:remote", i)] = map[string]string{"DEVICE": "signed_curve25519"}
+	}
+	var res api.PerformClaimKeysResponse
+	keyAPI.PerformClaimKeys(context.Background(), req, &res)
+
+	if len(res.OneTimeKeys) != 150 {
+		t.Fatalf("expected keys for 150 users, got %d", len(res.OneTimeKeys))
+	}
+	if fedClient.calls["remote"] != 2 {
+		t.Fatalf("expected keys to be claimed from remote in 2 batches, got %d", fedClient.calls["remote"])
+	}
+	failure, ok := res.Failures["dead"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a failure for the dead server, got %v", res.Failures)
+	}
+	if !reflect.DeepEqual(failure["user_ids"], []string{"@bob:dead"}) {
+		t.Fatalf("expected the failure to list the affected users, got %v", failure["user_ids"])
+	}
+
+	// The dead server shouldn't be asked again straight away.
+	res = api.PerformClaimKeysResponse{}
+	keyAPI.PerformClaimKeys(context.Background(), req, &res)
+	if fedClient.calls["dead"] != 1 {
+		t.Fatalf("expected the dead server to be asked once, got %d", fedClient.calls["dead"])
+	}
+	if _, ok = res.Failures["dead"]; !ok {
+		t.Fatalf("expected a failure for the dead server, got %v", res.Failures)
+	}
+}
+
+func TestPerformClaimKeysRemoteTimeout(t *testing.T) {
+	fedClient := &claimKeysFedClient{calls: map[spec.ServerName]int{}}
+	keyAPI := &internal.UserInternalAPI{
+		Config: &config.UserAPI{
+			Matrix: &config.Global{
+				SigningIdentity: fclient.SigningIdentity{ServerName: "test"},
+			},
+		},
+		FedClient: fedClient,
+	}
+
+	// Each batch is answered within the timeout, but all three of them
+	// together aren't.
+	req := &api.PerformClaimKeysRequest{
+		OneTimeKeys: map[string]map[string]string{},
+		Timeout:     time.Millisecond * 500,
+	}
+	for i := 0; i < 250; i++ {
+		req.OneTimeKeys[fmt.Sprintf("@user%d:slow", i)] = map[string]string{"DEVICE": "signed_curve25519"}
+	}
+	var res api.PerformClaimKeysResponse
+	start := time.Now()
+	keyAPI.PerformClaimKeys(context.Background(), req, &res)
+
+	if elapsed := time.Since(start); elapsed > time.Millisecond*800 {
+		t.Fatalf("expected claiming to stop at the timeout, took %s", elapsed)
+	}
+	if len(res.OneTimeKeys) != 100 {
+		t.Fatalf("expected keys for the 100 users in the first batch, got %d", len(res.OneTimeKeys))
+	}
+	failure, ok := res.Failures["slow"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a failure for the slow server, got %v", res.Failures)
+	}
+	if userIDs := failure["user_ids"].([]string); len(userIDs) != 150 {
+		t.Fatalf("expected the failure to list the 150 remaining users, got %d", len(userIDs))
+	}
+
+	// Running out of time isn't the server's fault, so it is asked again.
+	calls := fedClient.calls["slow"]
+	res = api.PerformClaimKeysResponse{}
+	keyAPI.PerformClaimKeys(context.Background(), req, &res)
+	if fedClient.calls["slow"] == calls {
+		t.Fatalf("expected the slow server to be asked again")
+	}
+}
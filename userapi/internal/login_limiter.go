@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	loginFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "userapi",
+			Name:      "login_failures_total",
+			Help:      "Number of failed password logins",
+		},
+	)
+	loginRefusals = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "userapi",
+			Name:      "login_refusals_total",
+			Help:      "Number of password logins refused because the account or IP address was delayed or locked",
+		},
+	)
+	loginLockouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "userapi",
+			Name:      "login_lockouts_total",
+			Help:      "Number of times an account or IP address was locked after too many failed password logins",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		loginFailures, loginRefusals, loginLockouts,
+	)
+}
+
+type loginAttempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// LoginLimiter tracks failed password logins per account and per IP address,
+// delaying further attempts once the free attempts are used up and locking
+// the account or IP address out after too many failures. Accounts are
+// tracked whether or not they exist, so that lockouts don't reveal which
+// accounts do.
+type LoginLimiter struct {
+	cfg       *config.LoginProtection
+	mu        sync.Mutex
+	accounts  map[string]*loginAttempts
+	ips       map[string]*loginAttempts
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// NewLoginLimiter returns a LoginLimiter, or nil if login protection is
+// disabled. A nil LoginLimiter allows every attempt.
+func NewLoginLimiter(cfg *config.LoginProtection) *LoginLimiter {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &LoginLimiter{
+		cfg:      cfg,
+		accounts: map[string]*loginAttempts{},
+		ips:      map[string]*loginAttempts{},
+		now:      time.Now,
+	}
+}
+
+// Check returns how long the caller must wait before attempting to log in to
+// the account from the IP address, or zero if they can try now.
+func (l *LoginLimiter) Check(userID, ip string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	wait := l.accounts[userID].retryAfter(now)
+	if ipWait := l.ips[ip].retryAfter(now); ipWait > wait {
+		wait = ipWait
+	}
+	if wait > 0 {
+		loginRefusals.Inc()
+	}
+	return wait
+}
+
+// Failure records a failed attempt. If the account was locked as a result,
+// it returns when the lockout ends.
+func (l *LoginLimiter) Failure(userID, ip string) (lockedUntil time.Time, locked bool) {
+	if l == nil {
+		return time.Time{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+	loginFailures.Inc()
+	if ip != "" && l.record(l.ips, ip, l.cfg.IPMaxAttempts, now) {
+		loginLockouts.WithLabelValues("ip").Inc()
+	}
+	if l.record(l.accounts, userID, l.cfg.MaxAttempts, now) {
+		loginLockouts.WithLabelValues("account").Inc()
+		return l.accounts[userID].blockedUntil, true
+	}
+	return time.Time{}, false
+}
+
+// Success forgets the failed attempts on the account. The IP address keeps
+// its failures, so that they can't be reset by logging in to another account.
+func (l *LoginLimiter) Success(userID string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.accounts, userID)
+}
+
+// record adds a failure for the key, delaying or locking it out as needed,
+// and returns whether it was locked out.
+func (l *LoginLimiter) record(attempts map[string]*loginAttempts, key string, maxAttempts int, now time.Time) bool {
+	a, ok := attempts[key]
+	if !ok || now.Sub(a.lastFailure) > l.cfg.AttemptWindow {
+		a = &loginAttempts{}
+		attempts[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+	switch {
+	case a.failures >= maxAttempts:
+		// Once the lockout ends the free attempts aren't given back, so
+		// each further failure is delayed again.
+		a.failures = l.cfg.FreeAttempts
+		a.blockedUntil = now.Add(l.cfg.LockoutDuration)
+		return true
+	case a.failures > l.cfg.FreeAttempts:
+		a.blockedUntil = now.Add(l.delay(a.failures - l.cfg.FreeAttempts))
+	}
+	return false
+}
+
+// delay returns the wait after the nth failure beyond the free attempts,
+// which doubles each time up to the lockout duration.
+func (l *LoginLimiter) delay(n int) time.Duration {
+	delay := l.cfg.BaseDelay
+	for i := 1; i < n && delay < l.cfg.LockoutDuration; i++ {
+		delay *= 2
+	}
+	if delay > l.cfg.LockoutDuration {
+		delay = l.cfg.LockoutDuration
+	}
+	return delay
+}
+
+// prune removes entries which are no longer blocked and whose failures are
+// old enough to be forgotten. It runs at most once per attempt window.
+func (l *LoginLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.cfg.AttemptWindow {
+		return
+	}
+	l.lastPrune = now
+	for _, attempts := range []map[string]*loginAttempts{l.accounts, l.ips} {
+		for key, a := range attempts {
+			if now.Sub(a.lastFailure) > l.cfg.AttemptWindow && !now.Before(a.blockedUntil) {
+				delete(attempts, key)
+			}
+		}
+	}
+}
+
+func (a *loginAttempts) retryAfter(now time.Time) time.Duration {
+	if a == nil || !now.Before(a.blockedUntil) {
+		return 0
+	}
+	return a.blockedUntil.Sub(now)
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	cfg := &config.LoginProtection{}
+	cfg.Defaults()
+	cfg.FreeAttempts = 2
+	cfg.MaxAttempts = 5
+	cfg.IPMaxAttempts = 8
+
+	now := time.Unix(1700000000, 0)
+	l := NewLoginLimiter(cfg)
+	l.now = func() time.Time { return now }
+
+	alice, bob := "@alice:test", "@bob:test"
+	fail := func(userID, ip string) bool {
+		t.Helper()
+		if wait := l.Check(userID, ip); wait > 0 {
+			t.Fatalf("attempt on %s from %s refused for %s", userID, ip, wait)
+		}
+		_, locked := l.Failure(userID, ip)
+		return locked
+	}
+
+	// The free attempts aren't delayed.
+	for i := 0; i < cfg.FreeAttempts; i++ {
+		fail(alice, "1.1.1.1")
+	}
+	// Each further failure is delayed for twice as long as the last.
+	for _, want := range []time.Duration{time.Second, time.Second * 2} {
+		fail(alice, "1.1.1.1")
+		if wait := l.Check(alice, "2.2.2.2"); wait != want {
+			t.Fatalf("got wait %s, want %s", wait, want)
+		}
+		now = now.Add(want)
+	}
+	// The last failure locks the account, from any IP address.
+	if !fail(alice, "1.1.1.1") {
+		t.Fatal("expected account to be locked")
+	}
+	if wait := l.Check(alice, "2.2.2.2"); wait != cfg.LockoutDuration {
+		t.Fatalf("got wait %s, want %s", wait, cfg.LockoutDuration)
+	}
+	if wait := l.Check(bob, "2.2.2.2"); wait != 0 {
+		t.Fatalf("other accounts shouldn't be locked, got wait %s", wait)
+	}
+
+	// Once the lockout ends, further failures are delayed again.
+	now = now.Add(cfg.LockoutDuration)
+	fail(alice, "1.1.1.1")
+	if wait := l.Check(alice, "2.2.2.2"); wait != time.Second {
+		t.Fatalf("got wait %s, want %s", wait, time.Second)
+	}
+
+	// Success forgets the account's failures but not the IP address's.
+	now = now.Add(time.Second)
+	l.Success(alice)
+	if wait := l.Check(alice, "2.2.2.2"); wait != 0 {
+		t.Fatalf("expected account to be allowed after success, got wait %s", wait)
+	}
+
+	// Failures spread over many accounts lock the IP address.
+	for i := 0; i < cfg.IPMaxAttempts-6; i++ {
+		now = now.Add(cfg.LockoutDuration)
+		fail(bob, "1.1.1.1")
+	}
+	if wait := l.Check("@charlie:test", "1.1.1.1"); wait != cfg.LockoutDuration {
+		t.Fatalf("expected IP address to be locked, got wait %s", wait)
+	}
+
+	// Failures are forgotten after the attempt window.
+	now = now.Add(cfg.LockoutDuration + cfg.AttemptWindow + time.Second)
+	fail(bob, "3.3.3.3")
+	if _, ok := l.ips["1.1.1.1"]; ok {
+		t.Fatal("expected old failures to be pruned")
+	}
+	if l.accounts[bob].failures != 1 {
+		t.Fatalf("expected bob's failures to be reset, got %d", l.accounts[bob].failures)
+	}
+
+	if NewLoginLimiter(&config.LoginProtection{}) != nil {
+		t.Fatal("expected a nil limiter when disabled")
+	}
+	var disabled *LoginLimiter
+	if _, locked := disabled.Failure(alice, "1.1.1.1"); locked || disabled.Check(alice, "1.1.1.1") != 0 {
+		t.Fatal("a nil limiter should allow everything")
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
@@ -28,6 +29,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/pushrules"
+	"github.com/neilalexander/harmony/internal/tracing"
 	"github.com/neilalexander/harmony/internal/util"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
@@ -39,6 +41,7 @@ import (
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	rsapi "github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/process"
 	synctypes "github.com/neilalexander/harmony/syncapi/types"
 	"github.com/neilalexander/harmony/userapi/api"
 	"github.com/neilalexander/harmony/userapi/producers"
@@ -59,9 +62,16 @@ type UserInternalAPI struct {
 	PgClient             pushgateway.Client
 	FedClient            fedsenderapi.KeyserverFederationAPI
 	Updater              *DeviceListUpdater
+	LoginLimiter         *LoginLimiter
+	ProcessContext       *process.ProcessContext
+
+	claimFailures claimKeysFailures
 }
 
 func (a *UserInternalAPI) PerformAdminCreateRegistrationToken(ctx context.Context, registrationToken *clientapi.RegistrationToken) (bool, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformAdminCreateRegistrationToken")
+	defer span.End()
+
 	exists, err := a.DB.RegistrationTokenExists(ctx, *registrationToken.Token)
 	if err != nil {
 		return false, err
@@ -77,21 +87,133 @@ func (a *UserInternalAPI) PerformAdminCreateRegistrationToken(ctx context.Contex
 }
 
 func (a *UserInternalAPI) PerformAdminListRegistrationTokens(ctx context.Context, returnAll bool, valid bool) ([]clientapi.RegistrationToken, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformAdminListRegistrationTokens")
+	defer span.End()
+
 	return a.DB.ListRegistrationTokens(ctx, returnAll, valid)
 }
 
 func (a *UserInternalAPI) PerformAdminGetRegistrationToken(ctx context.Context, tokenString string) (*clientapi.RegistrationToken, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformAdminGetRegistrationToken")
+	defer span.End()
+
 	return a.DB.GetRegistrationToken(ctx, tokenString)
 }
 
 func (a *UserInternalAPI) PerformAdminDeleteRegistrationToken(ctx context.Context, tokenString string) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformAdminDeleteRegistrationToken")
+	defer span.End()
+
 	return a.DB.DeleteRegistrationToken(ctx, tokenString)
 }
 
 func (a *UserInternalAPI) PerformAdminUpdateRegistrationToken(ctx context.Context, tokenString string, newAttributes map[string]interface{}) (*clientapi.RegistrationToken, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformAdminUpdateRegistrationToken")
+	defer span.End()
+
 	return a.DB.UpdateRegistrationToken(ctx, tokenString, newAttributes)
 }
 
+func (a *UserInternalAPI) PerformAdminUpsertTask(ctx context.Context, task *clientapi.AdminTask) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformAdminUpsertTask")
+	defer span.End()
+
+	return a.DB.UpsertAdminTask(ctx, task)
+}
+
+func (a *UserInternalAPI) PerformAdminFailUnfinishedTasks(ctx context.Context, reason string) (int64, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformAdminFailUnfinishedTasks")
+	defer span.End()
+
+	return a.DB.FailUnfinishedAdminTasks(ctx, reason)
+}
+
+func (a *UserInternalAPI) QueryAdminTask(ctx context.Context, taskID string) (*clientapi.AdminTask, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryAdminTask")
+	defer span.End()
+
+	return a.DB.GetAdminTask(ctx, taskID)
+}
+
+func (a *UserInternalAPI) QueryAdminTasks(ctx context.Context, limit int) ([]clientapi.AdminTask, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryAdminTasks")
+	defer span.End()
+
+	return a.DB.ListAdminTasks(ctx, limit)
+}
+
+func (a *UserInternalAPI) PerformSaveThreePIDBinding(ctx context.Context, userID string, binding *api.ThreePIDBinding) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformSaveThreePIDBinding")
+	defer span.End()
+
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	return a.DB.SaveThreePIDBinding(ctx, localpart, domain, binding)
+}
+
+func (a *UserInternalAPI) PerformRemoveThreePIDBinding(ctx context.Context, userID string, binding *api.ThreePIDBinding) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformRemoveThreePIDBinding")
+	defer span.End()
+
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	return a.DB.RemoveThreePIDBinding(ctx, localpart, domain, binding)
+}
+
+func (a *UserInternalAPI) QueryThreePIDBindings(ctx context.Context, userID string) ([]api.ThreePIDBinding, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryThreePIDBindings")
+	defer span.End()
+
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	return a.DB.GetThreePIDBindings(ctx, localpart, domain)
+}
+
+func (a *UserInternalAPI) PerformSaveDelayedEvent(ctx context.Context, ev *api.DelayedEvent) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformSaveDelayedEvent")
+	defer span.End()
+
+	localpart, domain, err := gomatrixserverlib.SplitID('@', ev.UserID)
+	if err != nil {
+		return err
+	}
+	return a.DB.SaveDelayedEvent(ctx, localpart, domain, ev)
+}
+
+func (a *UserInternalAPI) PerformRestartDelayedEvent(ctx context.Context, delayID string, runningSince spec.Timestamp) (bool, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformRestartDelayedEvent")
+	defer span.End()
+
+	return a.DB.RestartDelayedEvent(ctx, delayID, runningSince)
+}
+
+func (a *UserInternalAPI) PerformRemoveDelayedEvent(ctx context.Context, delayID string) (bool, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformRemoveDelayedEvent")
+	defer span.End()
+
+	return a.DB.RemoveDelayedEvent(ctx, delayID)
+}
+
+func (a *UserInternalAPI) QueryDelayedEvents(ctx context.Context, userID string) ([]api.DelayedEvent, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryDelayedEvents")
+	defer span.End()
+
+	if userID == "" {
+		return a.DB.GetDelayedEvents(ctx, "", "")
+	}
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	return a.DB.GetDelayedEvents(ctx, localpart, domain)
+}
+
 func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
 	if err != nil {
@@ -166,46 +288,10 @@ func (a *UserInternalAPI) setFullyRead(ctx context.Context, req *api.InputAccoun
 	return nil
 }
 
-func postRegisterJoinRooms(cfg *config.UserAPI, acc *api.Account, rsAPI rsapi.UserRoomserverAPI) {
-	// POST register behaviour: check if the user is a normal user.
-	// If the user is a normal user, add user to room specified in the configuration "auto_join_rooms".
-	if acc.AccountType != api.AccountTypeAppService && acc.AppServiceID == "" {
-		for room := range cfg.AutoJoinRooms {
-			userID := userutil.MakeUserID(acc.Localpart, cfg.Matrix.ServerName)
-			err := addUserToRoom(context.Background(), rsAPI, cfg.AutoJoinRooms[room], acc.Localpart, userID)
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"user_id": userID,
-					"room":    cfg.AutoJoinRooms[room],
-				}).WithError(err).Errorf("user failed to auto-join room")
-			}
-		}
-	}
-}
-
-// Add user to a room. This function currently working for auto_join_rooms config,
-// which can add a newly registered user to a specified room.
-func addUserToRoom(
-	ctx context.Context,
-	rsAPI rsapi.UserRoomserverAPI,
-	roomID string,
-	username string,
-	userID string,
-) error {
-	addGroupContent := make(map[string]interface{})
-	// This make sure the user's username can be displayed correctly.
-	// Because the newly-registered user doesn't have an avatar, the avatar_url is not needed.
-	addGroupContent["displayname"] = username
-	joinReq := rsapi.PerformJoinRequest{
-		RoomIDOrAlias: roomID,
-		UserID:        userID,
-		Content:       addGroupContent,
-	}
-	_, _, err := rsAPI.PerformJoin(ctx, &joinReq)
-	return err
-}
-
 func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.PerformAccountCreationRequest, res *api.PerformAccountCreationResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformAccountCreation")
+	defer span.End()
+
 	serverName := req.ServerName
 	if serverName == "" {
 		serverName = a.Config.Matrix.ServerName
@@ -213,16 +299,21 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 	if !a.Config.Matrix.IsLocalServerName(serverName) {
 		return fmt.Errorf("server name %s is not local", serverName)
 	}
-	acc, err := a.DB.CreateAccount(ctx, req.Localpart, serverName, req.Password, req.AppServiceID, req.AccountType)
+	var acc *api.Account
+	var err error
+	if req.PasswordHash != "" {
+		acc, err = a.DB.CreateAccountWithPasswordHash(ctx, req.Localpart, serverName, req.PasswordHash, req.AccountType)
+	} else {
+		acc, err = a.DB.CreateAccount(ctx, req.Localpart, serverName, req.Password, req.AppServiceID, req.AccountType)
+	}
 	if err != nil {
-		if errors.Is(err, sqlutil.ErrUserExists) { // This account already exists
-			switch req.OnConflict {
-			case api.ConflictUpdate:
-				break
-			case api.ConflictAbort:
-				return &api.ErrorConflict{
-					Message: err.Error(),
-				}
+		if !errors.Is(err, sqlutil.ErrUserExists) {
+			return err
+		}
+		// This account already exists
+		if req.OnConflict == api.ConflictAbort {
+			return &api.ErrorConflict{
+				Message: err.Error(),
 			}
 		}
 		// account already exists
@@ -256,7 +347,7 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 		return fmt.Errorf("a.DB.SetDisplayName: %w", err)
 	}
 
-	postRegisterJoinRooms(a.Config, acc, a.RSAPI)
+	postRegisterJoinRooms(a.ProcessContext, a.Config, acc, a.RSAPI)
 
 	res.AccountCreated = true
 	res.Account = acc
@@ -264,13 +355,21 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 }
 
 func (a *UserInternalAPI) PerformPasswordUpdate(ctx context.Context, req *api.PerformPasswordUpdateRequest, res *api.PerformPasswordUpdateResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformPasswordUpdate")
+	defer span.End()
+
 	if !a.Config.Matrix.IsLocalServerName(req.ServerName) {
 		return fmt.Errorf("server name %s is not local", req.ServerName)
 	}
 	if err := a.DB.SetPassword(ctx, req.Localpart, req.ServerName, req.Password); err != nil {
 		return err
 	}
-	if req.LogoutDevices {
+	switch {
+	case req.LogoutDevices && req.SoftLogout:
+		if err := a.DB.SoftLogoutAllDevices(ctx, req.Localpart, req.ServerName, ""); err != nil {
+			return err
+		}
+	case req.LogoutDevices:
 		if _, err := a.DB.RemoveAllDevices(context.Background(), req.Localpart, req.ServerName, ""); err != nil {
 			return err
 		}
@@ -280,6 +379,9 @@ func (a *UserInternalAPI) PerformPasswordUpdate(ctx context.Context, req *api.Pe
 }
 
 func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.PerformDeviceCreationRequest, res *api.PerformDeviceCreationResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformDeviceCreation")
+	defer span.End()
+
 	serverName := req.ServerName
 	if serverName == "" {
 		serverName = a.Config.Matrix.ServerName
@@ -317,6 +419,9 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 }
 
 func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformDeviceDeletion")
+	defer span.End()
+
 	util.GetLogger(ctx).WithField("user_id", req.UserID).WithField("devices", req.DeviceIDs).Info("PerformDeviceDeletion")
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
 	if err != nil {
@@ -388,6 +493,9 @@ func (a *UserInternalAPI) PerformLastSeenUpdate(
 	req *api.PerformLastSeenUpdateRequest,
 	res *api.PerformLastSeenUpdateResponse,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformLastSeenUpdate")
+	defer span.End()
+
 	localpart, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
 	if err != nil {
 		return fmt.Errorf("gomatrixserverlib.SplitID: %w", err)
@@ -402,6 +510,9 @@ func (a *UserInternalAPI) PerformLastSeenUpdate(
 }
 
 func (a *UserInternalAPI) PerformDeviceUpdate(ctx context.Context, req *api.PerformDeviceUpdateRequest, res *api.PerformDeviceUpdateResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformDeviceUpdate")
+	defer span.End()
+
 	localpart, domain, err := gomatrixserverlib.SplitID('@', req.RequestingUserID)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
@@ -457,6 +568,9 @@ var (
 )
 
 func (a *UserInternalAPI) QueryProfile(ctx context.Context, userID string) (*authtypes.Profile, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryProfile")
+	defer span.End()
+
 	local, domain, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		return nil, err
@@ -475,6 +589,9 @@ func (a *UserInternalAPI) QueryProfile(ctx context.Context, userID string) (*aut
 }
 
 func (a *UserInternalAPI) QuerySearchProfiles(ctx context.Context, req *api.QuerySearchProfilesRequest, res *api.QuerySearchProfilesResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QuerySearchProfiles")
+	defer span.End()
+
 	profiles, err := a.DB.SearchProfiles(ctx, req.SearchString, req.Limit)
 	if err != nil {
 		return err
@@ -484,27 +601,35 @@ func (a *UserInternalAPI) QuerySearchProfiles(ctx context.Context, req *api.Quer
 }
 
 func (a *UserInternalAPI) QueryDeviceInfos(ctx context.Context, req *api.QueryDeviceInfosRequest, res *api.QueryDeviceInfosResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryDeviceInfos")
+	defer span.End()
+
 	devices, err := a.DB.GetDevicesByID(ctx, req.DeviceIDs)
 	if err != nil {
 		return err
 	}
-	res.DeviceInfo = make(map[string]struct {
+	res.DeviceInfo = make(map[string]map[string]struct {
 		DisplayName string
-		UserID      string
 	})
 	for _, d := range devices {
-		res.DeviceInfo[d.ID] = struct {
+		if res.DeviceInfo[d.UserID] == nil {
+			res.DeviceInfo[d.UserID] = make(map[string]struct {
+				DisplayName string
+			})
+		}
+		res.DeviceInfo[d.UserID][d.ID] = struct {
 			DisplayName string
-			UserID      string
 		}{
 			DisplayName: d.DisplayName,
-			UserID:      d.UserID,
 		}
 	}
 	return nil
 }
 
 func (a *UserInternalAPI) QueryDevices(ctx context.Context, req *api.QueryDevicesRequest, res *api.QueryDevicesResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryDevices")
+	defer span.End()
+
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
 	if err != nil {
 		return err
@@ -522,6 +647,9 @@ func (a *UserInternalAPI) QueryDevices(ctx context.Context, req *api.QueryDevice
 }
 
 func (a *UserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryAccountData")
+	defer span.End()
+
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
 	if err != nil {
 		return err
@@ -559,10 +687,14 @@ func (a *UserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAc
 }
 
 func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAccessTokenRequest, res *api.QueryAccessTokenResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryAccessToken")
+	defer span.End()
+
 	device, err := a.DB.GetDeviceByAccessToken(ctx, req.AccessToken)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil
+			res.SoftLogout, err = a.DB.IsAccessTokenSoftLoggedOut(ctx, req.AccessToken)
+			return err
 		}
 		return err
 	}
@@ -583,12 +715,18 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 }
 
 func (a *UserInternalAPI) QueryAccountByLocalpart(ctx context.Context, req *api.QueryAccountByLocalpartRequest, res *api.QueryAccountByLocalpartResponse) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryAccountByLocalpart")
+	defer span.End()
+
 	res.Account, err = a.DB.GetAccountByLocalpart(ctx, req.Localpart, req.ServerName)
 	return
 }
 
 // PerformAccountDeactivation deactivates the user's account, removing all ability for the user to login again.
 func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *api.PerformAccountDeactivationRequest, res *api.PerformAccountDeactivationResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformAccountDeactivation")
+	defer span.End()
+
 	serverName := req.ServerName
 	if serverName == "" {
 		serverName = a.Config.Matrix.ServerName
@@ -600,7 +738,7 @@ func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *a
 	userID := fmt.Sprintf("@%s:%s", req.Localpart, serverName)
 	_, err := a.RSAPI.PerformAdminEvacuateUser(ctx, userID)
 	if err != nil {
-		logrus.WithError(err).WithField("userID", userID).Errorf("Failed to evacuate user after account deactivation")
+		logrus.WithError(err).WithField("user_id", userID).Errorf("Failed to evacuate user after account deactivation")
 	}
 
 	deviceReq := &api.PerformDeviceDeletionRequest{
@@ -628,6 +766,9 @@ func (a *UserInternalAPI) DeleteKeyBackup(ctx context.Context, userID, version s
 }
 
 func (a *UserInternalAPI) PerformKeyBackup(ctx context.Context, req *api.PerformKeyBackupRequest) (string, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformKeyBackup")
+	defer span.End()
+
 	// Create metadata
 	return a.DB.CreateKeyBackup(ctx, req.UserID, req.Algorithm, req.AuthData)
 }
@@ -685,6 +826,9 @@ func (a *UserInternalAPI) uploadBackupKeys(ctx context.Context, req *api.Perform
 }
 
 func (a *UserInternalAPI) QueryKeyBackup(ctx context.Context, req *api.QueryKeyBackupRequest) (*api.QueryKeyBackupResponse, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryKeyBackup")
+	defer span.End()
+
 	res := &api.QueryKeyBackupResponse{}
 	version, algorithm, authData, etag, deleted, err := a.DB.GetKeyBackup(ctx, req.UserID, req.Version)
 	res.Version = version
@@ -719,6 +863,9 @@ func (a *UserInternalAPI) QueryKeyBackup(ctx context.Context, req *api.QueryKeyB
 }
 
 func (a *UserInternalAPI) QueryNotifications(ctx context.Context, req *api.QueryNotificationsRequest, res *api.QueryNotificationsResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryNotifications")
+	defer span.End()
+
 	if req.Limit == 0 || req.Limit > 1000 {
 		req.Limit = 1000
 	}
@@ -751,6 +898,9 @@ func (a *UserInternalAPI) QueryNotifications(ctx context.Context, req *api.Query
 }
 
 func (a *UserInternalAPI) PerformPusherSet(ctx context.Context, req *api.PerformPusherSetRequest, res *struct{}) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformPusherSet")
+	defer span.End()
+
 	util.GetLogger(ctx).WithFields(logrus.Fields{
 		"localpart":    req.Localpart,
 		"pushkey":      req.Pusher.PushKey,
@@ -772,6 +922,9 @@ func (a *UserInternalAPI) PerformPusherSet(ctx context.Context, req *api.Perform
 }
 
 func (a *UserInternalAPI) PerformPusherDeletion(ctx context.Context, req *api.PerformPusherDeletionRequest, res *struct{}) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformPusherDeletion")
+	defer span.End()
+
 	pushers, err := a.DB.GetPushers(ctx, req.Localpart, req.ServerName)
 	if err != nil {
 		return err
@@ -789,6 +942,9 @@ func (a *UserInternalAPI) PerformPusherDeletion(ctx context.Context, req *api.Pe
 }
 
 func (a *UserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryPushers")
+	defer span.End()
+
 	var err error
 	res.Pushers, err = a.DB.GetPushers(ctx, req.Localpart, req.ServerName)
 	return err
@@ -799,6 +955,9 @@ func (a *UserInternalAPI) PerformPushRulesPut(
 	userID string,
 	ruleSets *pushrules.AccountRuleSets,
 ) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.PerformPushRulesPut")
+	defer span.End()
+
 	bs, err := json.Marshal(ruleSets)
 	if err != nil {
 		return err
@@ -813,6 +972,9 @@ func (a *UserInternalAPI) PerformPushRulesPut(
 }
 
 func (a *UserInternalAPI) QueryPushRules(ctx context.Context, userID string) (*pushrules.AccountRuleSets, error) {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryPushRules")
+	defer span.End()
+
 	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to split user ID %q for push rules", userID)
@@ -825,6 +987,9 @@ func (a *UserInternalAPI) SetAvatarURL(ctx context.Context, localpart string, se
 }
 
 func (a *UserInternalAPI) QueryNumericLocalpart(ctx context.Context, req *api.QueryNumericLocalpartRequest, res *api.QueryNumericLocalpartResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryNumericLocalpart")
+	defer span.End()
+
 	id, err := a.DB.GetNewNumericLocalpart(ctx, req.ServerName)
 	if err != nil {
 		return err
@@ -834,24 +999,80 @@ func (a *UserInternalAPI) QueryNumericLocalpart(ctx context.Context, req *api.Qu
 }
 
 func (a *UserInternalAPI) QueryAccountAvailability(ctx context.Context, req *api.QueryAccountAvailabilityRequest, res *api.QueryAccountAvailabilityResponse) error {
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryAccountAvailability")
+	defer span.End()
+
 	var err error
 	res.Available, err = a.DB.CheckAccountAvailability(ctx, req.Localpart, req.ServerName)
 	return err
 }
 
 func (a *UserInternalAPI) QueryAccountByPassword(ctx context.Context, req *api.QueryAccountByPasswordRequest, res *api.QueryAccountByPasswordResponse) error {
-	acc, err := a.DB.GetAccountByPassword(ctx, req.Localpart, req.ServerName, req.PlaintextPassword)
+	ctx, span := tracing.StartSpan(ctx, "userapi.QueryAccountByPassword")
+	defer span.End()
+
+	// Failed attempts are tracked by the lower cased localpart, as that's
+	// what is tried first.
+	userID := userutil.MakeUserID(strings.ToLower(req.Localpart), req.ServerName)
+	if res.RetryAfter = a.LoginLimiter.Check(userID, req.RemoteIP); res.RetryAfter > 0 {
+		return nil
+	}
+
+	// Squash the localpart to all lowercase letters, and if we couldn't
+	// find the user by that, try the provided localpart as is.
+	localpart := strings.ToLower(req.Localpart)
+	acc, err := a.DB.GetAccountByPassword(ctx, localpart, req.ServerName, req.PlaintextPassword)
+	if err == sql.ErrNoRows && localpart != req.Localpart {
+		localpart = req.Localpart
+		acc, err = a.DB.GetAccountByPassword(ctx, localpart, req.ServerName, req.PlaintextPassword)
+	}
 	switch err {
-	case sql.ErrNoRows: // user does not exist
+	case nil:
+		a.LoginLimiter.Success(userID)
+		res.Exists = true
+		res.Account = acc
 		return nil
-	case bcrypt.ErrMismatchedHashAndPassword: // user exists, but password doesn't match
+	case sql.ErrNoRows: // user does not exist
+		a.LoginLimiter.Failure(userID, req.RemoteIP)
 		return nil
-	case bcrypt.ErrHashTooShort: // user exists, but probably a passwordless account
+	case bcrypt.ErrMismatchedHashAndPassword, // user exists, but password doesn't match
+		bcrypt.ErrHashTooShort: // user exists, but probably a passwordless account
+		if lockedUntil, locked := a.LoginLimiter.Failure(userID, req.RemoteIP); locked {
+			a.notifyLoginLockout(ctx, localpart, req.ServerName, lockedUntil)
+		}
 		return nil
 	default:
-		res.Exists = true
-		res.Account = acc
-		return nil
+		return err
+	}
+}
+
+// loginLockoutEventType is the type of the send-to-device message which tells
+// the devices of a user that their account has been locked.
+const loginLockoutEventType = "org.matrix.dendrite.login_lockout"
+
+// notifyLoginLockout tells the existing devices of a user that their account
+// has been locked after too many failed logins.
+func (a *UserInternalAPI) notifyLoginLockout(ctx context.Context, localpart string, serverName spec.ServerName, lockedUntil time.Time) {
+	userID := userutil.MakeUserID(localpart, serverName)
+	logger := util.GetLogger(ctx).WithField("user_id", userID)
+	logger.Warn("Account locked after too many failed logins")
+
+	devices, err := a.DB.GetDevicesByLocalpart(ctx, localpart, serverName)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get devices to notify of lockout")
+		return
+	}
+	if len(devices) == 0 {
+		return
+	}
+	deviceIDs := make([]string, 0, len(devices))
+	for _, device := range devices {
+		deviceIDs = append(deviceIDs, device.ID)
+	}
+	if err = a.SyncProducer.SendToDevice(userID, deviceIDs, loginLockoutEventType, map[string]interface{}{
+		"locked_until": spec.AsTimestamp(lockedUntil),
+	}); err != nil {
+		logger.WithError(err).Error("Failed to notify devices of lockout")
 	}
 }
 
@@ -10,6 +10,7 @@ import (
 
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/neilalexander/harmony/syncapi/types"
 	"github.com/neilalexander/harmony/userapi/storage"
 )
 
@@ -23,14 +24,16 @@ type SyncAPI struct {
 	producer              JetStreamPublisher
 	clientDataTopic       string
 	notificationDataTopic string
+	sendToDeviceTopic     string
 }
 
-func NewSyncAPI(db storage.UserDatabase, js JetStreamPublisher, clientDataTopic string, notificationDataTopic string) *SyncAPI {
+func NewSyncAPI(db storage.UserDatabase, js JetStreamPublisher, clientDataTopic, notificationDataTopic, sendToDeviceTopic string) *SyncAPI {
 	return &SyncAPI{
 		db:                    db,
 		producer:              js,
 		clientDataTopic:       clientDataTopic,
 		notificationDataTopic: notificationDataTopic,
+		sendToDeviceTopic:     sendToDeviceTopic,
 	}
 }
 
@@ -100,3 +103,43 @@ func (p *SyncAPI) sendNotificationData(userID string, data *eventutil.Notificati
 	_, err = p.producer.PublishMsg(m)
 	return err
 }
+
+// SendToDevice sends a server-generated send-to-device message to each of
+// the given devices of a local user.
+func (p *SyncAPI) SendToDevice(userID string, deviceIDs []string, eventType string, content interface{}) error {
+	message, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	for _, deviceID := range deviceIDs {
+		ote := &types.OutputSendToDeviceEvent{
+			UserID:   userID,
+			DeviceID: deviceID,
+			SendToDeviceEvent: gomatrixserverlib.SendToDeviceEvent{
+				Sender:  userID,
+				Type:    eventType,
+				Content: message,
+			},
+		}
+		m := &nats.Msg{
+			Subject: p.sendToDeviceTopic,
+			Header:  nats.Header{},
+		}
+		m.Header.Set("sender", userID)
+		m.Header.Set(jetstream.UserID, userID)
+		if m.Data, err = json.Marshal(ote); err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"user_id":   userID,
+			"device_id": deviceID,
+			"type":      eventType,
+		}).Tracef("Producing to topic '%s'", p.sendToDeviceTopic)
+
+		if _, err = p.producer.PublishMsg(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
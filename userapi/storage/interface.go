@@ -40,6 +40,43 @@ type RegistrationTokens interface {
 	UpdateRegistrationToken(ctx context.Context, tokenString string, newAttributes map[string]interface{}) (*clientapi.RegistrationToken, error)
 }
 
+type AdminTasks interface {
+	// UpsertAdminTask stores the task record, updating the status and
+	// progress of an existing record with the same task ID.
+	UpsertAdminTask(ctx context.Context, task *clientapi.AdminTask) error
+	// GetAdminTask returns sql.ErrNoRows if no task exists with the given ID.
+	GetAdminTask(ctx context.Context, taskID string) (*clientapi.AdminTask, error)
+	// ListAdminTasks returns the most recently created tasks first.
+	ListAdminTasks(ctx context.Context, limit int) ([]clientapi.AdminTask, error)
+	// FailUnfinishedAdminTasks marks all pending or running tasks as failed
+	// with the given reason, returning how many were updated.
+	FailUnfinishedAdminTasks(ctx context.Context, reason string) (int64, error)
+}
+
+type ThreePIDBindings interface {
+	// SaveThreePIDBinding records that the user bound the third-party
+	// identifier to the identity server, replacing any earlier binding of
+	// the identifier to another user on the same identity server.
+	SaveThreePIDBinding(ctx context.Context, localpart string, serverName spec.ServerName, binding *api.ThreePIDBinding) error
+	// GetThreePIDBindings returns the user's bindings, oldest first.
+	GetThreePIDBindings(ctx context.Context, localpart string, serverName spec.ServerName) ([]api.ThreePIDBinding, error)
+	RemoveThreePIDBinding(ctx context.Context, localpart string, serverName spec.ServerName, binding *api.ThreePIDBinding) error
+}
+
+type DelayedEvents interface {
+	// SaveDelayedEvent stores an event which the user's device has asked to be sent after a delay.
+	SaveDelayedEvent(ctx context.Context, localpart string, serverName spec.ServerName, ev *api.DelayedEvent) error
+	// GetDelayedEvents returns the user's delayed events, or everyone's if localpart is empty,
+	// in the order that their delays started.
+	GetDelayedEvents(ctx context.Context, localpart string, serverName spec.ServerName) ([]api.DelayedEvent, error)
+	// RestartDelayedEvent restarts the delay of the event from the given time, returning false
+	// if there is no such delayed event.
+	RestartDelayedEvent(ctx context.Context, delayID string, runningSince spec.Timestamp) (bool, error)
+	// RemoveDelayedEvent removes a delayed event once it has been sent or cancelled, returning
+	// false if there was no such delayed event, e.g. because its device was deleted.
+	RemoveDelayedEvent(ctx context.Context, delayID string) (bool, error)
+}
+
 type Profile interface {
 	GetProfileByLocalpart(ctx context.Context, localpart string, serverName spec.ServerName) (*authtypes.Profile, error)
 	SearchProfiles(ctx context.Context, searchString string, limit int) ([]authtypes.Profile, error)
@@ -52,6 +89,9 @@ type Account interface {
 	// for this account. If no password is supplied, the account will be a passwordless account. If the
 	// account already exists, it will return nil, ErrUserExists.
 	CreateAccount(ctx context.Context, localpart string, serverName spec.ServerName, plaintextPassword string, appserviceID string, accountType api.AccountType) (*api.Account, error)
+	// CreateAccountWithPasswordHash makes a new account in the same way as CreateAccount, but with a
+	// bcrypt hash of the password rather than the password itself.
+	CreateAccountWithPasswordHash(ctx context.Context, localpart string, serverName spec.ServerName, passwordHash string, accountType api.AccountType) (*api.Account, error)
 	GetAccountByPassword(ctx context.Context, localpart string, serverName spec.ServerName, plaintextPassword string) (*api.Account, error)
 	GetNewNumericLocalpart(ctx context.Context, serverName spec.ServerName) (int64, error)
 	CheckAccountAvailability(ctx context.Context, localpart string, serverName spec.ServerName) (bool, error)
@@ -88,6 +128,12 @@ type Device interface {
 	RemoveDevices(ctx context.Context, localpart string, serverName spec.ServerName, devices []string) error
 	// RemoveAllDevices deleted all devices for this user. Returns the devices deleted.
 	RemoveAllDevices(ctx context.Context, localpart string, serverName spec.ServerName, exceptDeviceID string) (devices []api.Device, err error)
+	// SoftLogoutAllDevices invalidates the access tokens of all devices for this user,
+	// but keeps the devices themselves so that clients can log in again and keep their keys.
+	SoftLogoutAllDevices(ctx context.Context, localpart string, serverName spec.ServerName, exceptDeviceID string) error
+	// IsAccessTokenSoftLoggedOut returns whether the access token belonged to a device that
+	// has been soft logged out. Returns false if the access token is unknown.
+	IsAccessTokenSoftLoggedOut(ctx context.Context, token string) (bool, error)
 }
 
 type KeyBackup interface {
@@ -133,6 +179,9 @@ type Notification interface {
 type UserDatabase interface {
 	Account
 	AccountData
+	AdminTasks
+	ThreePIDBindings
+	DelayedEvents
 	Device
 	KeyBackup
 	LoginToken
@@ -211,6 +260,9 @@ type KeyDatabase interface {
 	MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error
 
 	CrossSigningKeysForUser(ctx context.Context, userID string) (map[fclient.CrossSigningKeyPurpose]fclient.CrossSigningKey, error)
+	// DeviceKeysSnapshot returns the device keys and cross-signing keys of the given users, as they were at a
+	// single point in time. Only keys that we know about are returned, which for remote users are the cached keys.
+	DeviceKeysSnapshot(ctx context.Context, userIDs []string) ([]api.DeviceMessage, map[string]map[fclient.CrossSigningKeyPurpose]fclient.CrossSigningKey, error)
 	CrossSigningKeysDataForUser(ctx context.Context, userID string) (types.CrossSigningKeyMap, error)
 	CrossSigningSigsForTarget(ctx context.Context, originUserID, targetUserID string, targetKeyID gomatrixserverlib.KeyID) (types.CrossSigningSigMap, error)
 
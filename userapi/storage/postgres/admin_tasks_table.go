@@ -0,0 +1,118 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/neilalexander/harmony/clientapi/api"
+	internal "github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/userapi/storage/tables"
+)
+
+const adminTasksSchema = `
+-- Stores the records of background admin tasks, so that their progress
+-- and outcome can be inspected after the request that started them.
+CREATE TABLE IF NOT EXISTS userapi_admin_tasks (
+	task_id TEXT PRIMARY KEY,
+	task_type TEXT NOT NULL,
+	target TEXT NOT NULL,
+	status TEXT NOT NULL,
+	progress BIGINT NOT NULL DEFAULT 0,
+	total BIGINT NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	created_by TEXT NOT NULL,
+	created_ts BIGINT NOT NULL,
+	updated_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS userapi_admin_tasks_created_ts_idx ON userapi_admin_tasks(created_ts);
+`
+
+const upsertAdminTaskSQL = "" +
+	"INSERT INTO userapi_admin_tasks (task_id, task_type, target, status, progress, total, error, created_by, created_ts, updated_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" +
+	" ON CONFLICT (task_id) DO UPDATE SET status = $4, progress = $5, total = $6, error = $7, updated_ts = $10"
+
+const selectAdminTaskSQL = "" +
+	"SELECT task_id, task_type, target, status, progress, total, error, created_by, created_ts, updated_ts" +
+	" FROM userapi_admin_tasks WHERE task_id = $1"
+
+const selectAdminTasksSQL = "" +
+	"SELECT task_id, task_type, target, status, progress, total, error, created_by, created_ts, updated_ts" +
+	" FROM userapi_admin_tasks ORDER BY created_ts DESC LIMIT $1"
+
+const updateUnfinishedAdminTasksSQL = "" +
+	"UPDATE userapi_admin_tasks SET status = $1, error = $2, updated_ts = $3" +
+	" WHERE status = ANY($4)"
+
+type adminTasksStatements struct {
+	upsertAdminTaskStmt            *sql.Stmt
+	selectAdminTaskStmt            *sql.Stmt
+	selectAdminTasksStmt           *sql.Stmt
+	updateUnfinishedAdminTasksStmt *sql.Stmt
+}
+
+func NewPostgresAdminTasksTable(db *sql.DB) (tables.AdminTasksTable, error) {
+	s := &adminTasksStatements{}
+	_, err := db.Exec(adminTasksSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.upsertAdminTaskStmt, upsertAdminTaskSQL},
+		{&s.selectAdminTaskStmt, selectAdminTaskSQL},
+		{&s.selectAdminTasksStmt, selectAdminTasksSQL},
+		{&s.updateUnfinishedAdminTasksStmt, updateUnfinishedAdminTasksSQL},
+	}.Prepare(db)
+}
+
+func (s *adminTasksStatements) UpsertAdminTask(ctx context.Context, txn *sql.Tx, task *api.AdminTask) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertAdminTaskStmt).ExecContext(
+		ctx, task.TaskID, task.Type, task.Target, task.Status, task.Progress,
+		task.Total, task.Error, task.CreatedBy, task.CreatedTS, task.UpdatedTS,
+	)
+	return err
+}
+
+func (s *adminTasksStatements) SelectAdminTask(ctx context.Context, txn *sql.Tx, taskID string) (*api.AdminTask, error) {
+	var task api.AdminTask
+	err := sqlutil.TxStmt(txn, s.selectAdminTaskStmt).QueryRowContext(ctx, taskID).Scan(
+		&task.TaskID, &task.Type, &task.Target, &task.Status, &task.Progress,
+		&task.Total, &task.Error, &task.CreatedBy, &task.CreatedTS, &task.UpdatedTS,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (s *adminTasksStatements) SelectAdminTasks(ctx context.Context, txn *sql.Tx, limit int) ([]api.AdminTask, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectAdminTasksStmt).QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectAdminTasks: rows.close() failed")
+	tasks := []api.AdminTask{}
+	for rows.Next() {
+		var task api.AdminTask
+		if err = rows.Scan(
+			&task.TaskID, &task.Type, &task.Target, &task.Status, &task.Progress,
+			&task.Total, &task.Error, &task.CreatedBy, &task.CreatedTS, &task.UpdatedTS,
+		); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+func (s *adminTasksStatements) UpdateUnfinishedAdminTasks(ctx context.Context, txn *sql.Tx, status api.AdminTaskStatus, reason string, updatedTS int64) (int64, error) {
+	unfinished := pq.StringArray{string(api.AdminTaskPending), string(api.AdminTaskRunning)}
+	res, err := sqlutil.TxStmt(txn, s.updateUnfinishedAdminTasksStmt).ExecContext(ctx, status, reason, updatedTS, unfinished)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,157 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/lib/pq"
+	"github.com/neilalexander/harmony/clientapi/userutil"
+	internal "github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/userapi/api"
+	"github.com/neilalexander/harmony/userapi/storage/tables"
+)
+
+const delayedEventsSchema = `
+-- Stores the events which clients have asked to be sent after a delay
+-- (MSC4140), so that they survive restarts. They belong to the device which
+-- scheduled them, and are deleted along with it.
+CREATE TABLE IF NOT EXISTS userapi_delayed_events (
+	delay_id TEXT NOT NULL PRIMARY KEY,
+	localpart TEXT NOT NULL,
+	server_name TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_type TEXT NOT NULL,
+	-- NULL if the event isn't a state event
+	state_key TEXT,
+	content TEXT NOT NULL,
+	delay_ms BIGINT NOT NULL,
+	running_since BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS userapi_delayed_events_device_idx ON userapi_delayed_events(localpart, server_name, device_id);
+`
+
+const insertDelayedEventSQL = "" +
+	"INSERT INTO userapi_delayed_events (delay_id, localpart, server_name, device_id, room_id, event_type, state_key, content, delay_ms, running_since)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+
+const selectDelayedEventsSQL = "" +
+	"SELECT delay_id, localpart, server_name, device_id, room_id, event_type, state_key, content, delay_ms, running_since" +
+	" FROM userapi_delayed_events WHERE $1 = '' OR (localpart = $1 AND server_name = $2) ORDER BY running_since"
+
+const updateDelayedEventRunningSinceSQL = "" +
+	"UPDATE userapi_delayed_events SET running_since = $2 WHERE delay_id = $1"
+
+const deleteDelayedEventSQL = "" +
+	"DELETE FROM userapi_delayed_events WHERE delay_id = $1"
+
+const deleteDelayedEventsByDevicesSQL = "" +
+	"DELETE FROM userapi_delayed_events WHERE localpart = $1 AND server_name = $2 AND device_id = ANY($3)"
+
+const deleteDelayedEventsByLocalpartSQL = "" +
+	"DELETE FROM userapi_delayed_events WHERE localpart = $1 AND server_name = $2 AND device_id != $3"
+
+type delayedEventsStatements struct {
+	insertDelayedEventStmt             *sql.Stmt
+	selectDelayedEventsStmt            *sql.Stmt
+	updateDelayedEventRunningSinceStmt *sql.Stmt
+	deleteDelayedEventStmt             *sql.Stmt
+	deleteDelayedEventsByDevicesStmt   *sql.Stmt
+	deleteDelayedEventsByLocalpartStmt *sql.Stmt
+}
+
+func NewPostgresDelayedEventsTable(db *sql.DB) (tables.DelayedEventsTable, error) {
+	s := &delayedEventsStatements{}
+	_, err := db.Exec(delayedEventsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertDelayedEventStmt, insertDelayedEventSQL},
+		{&s.selectDelayedEventsStmt, selectDelayedEventsSQL},
+		{&s.updateDelayedEventRunningSinceStmt, updateDelayedEventRunningSinceSQL},
+		{&s.deleteDelayedEventStmt, deleteDelayedEventSQL},
+		{&s.deleteDelayedEventsByDevicesStmt, deleteDelayedEventsByDevicesSQL},
+		{&s.deleteDelayedEventsByLocalpartStmt, deleteDelayedEventsByLocalpartSQL},
+	}.Prepare(db)
+}
+
+func (s *delayedEventsStatements) InsertDelayedEvent(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, ev *api.DelayedEvent,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertDelayedEventStmt).ExecContext(
+		ctx, ev.DelayID, localpart, serverName, ev.DeviceID, ev.RoomID, ev.Type, ev.StateKey,
+		string(ev.Content), ev.Delay, ev.RunningSince,
+	)
+	return err
+}
+
+func (s *delayedEventsStatements) SelectDelayedEvents(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName,
+) ([]api.DelayedEvent, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectDelayedEventsStmt).QueryContext(ctx, localpart, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectDelayedEvents: rows.close() failed")
+	events := []api.DelayedEvent{}
+	for rows.Next() {
+		var ev api.DelayedEvent
+		var evLocalpart, content string
+		var evServerName spec.ServerName
+		var stateKey sql.NullString
+		if err = rows.Scan(
+			&ev.DelayID, &evLocalpart, &evServerName, &ev.DeviceID, &ev.RoomID, &ev.Type, &stateKey,
+			&content, &ev.Delay, &ev.RunningSince,
+		); err != nil {
+			return nil, err
+		}
+		ev.UserID = userutil.MakeUserID(evLocalpart, evServerName)
+		if stateKey.Valid {
+			ev.StateKey = &stateKey.String
+		}
+		ev.Content = json.RawMessage(content)
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+func (s *delayedEventsStatements) UpdateDelayedEventRunningSince(
+	ctx context.Context, txn *sql.Tx, delayID string, runningSince spec.Timestamp,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.updateDelayedEventRunningSinceStmt).ExecContext(ctx, delayID, runningSince)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *delayedEventsStatements) DeleteDelayedEvent(
+	ctx context.Context, txn *sql.Tx, delayID string,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteDelayedEventStmt).ExecContext(ctx, delayID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *delayedEventsStatements) DeleteDelayedEventsByDevices(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceIDs []string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteDelayedEventsByDevicesStmt).ExecContext(ctx, localpart, serverName, pq.Array(deviceIDs))
+	return err
+}
+
+func (s *delayedEventsStatements) DeleteDelayedEventsByLocalpart(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, exceptDeviceID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteDelayedEventsByLocalpartStmt).ExecContext(ctx, localpart, serverName, exceptDeviceID)
+	return err
+}
@@ -60,6 +60,9 @@ const selectBatchDeviceKeysSQL = "" +
 const selectBatchDeviceKeysWithEmptiesSQL = "" +
 	"SELECT device_id, key_json, stream_id, display_name FROM keyserver_device_keys WHERE user_id=$1"
 
+const selectDeviceKeysForUsersSQL = "" +
+	"SELECT user_id, device_id, key_json, stream_id, display_name FROM keyserver_device_keys WHERE user_id = ANY($1) AND key_json <> ''"
+
 const selectMaxStreamForUserSQL = "" +
 	"SELECT MAX(stream_id) FROM keyserver_device_keys WHERE user_id=$1"
 
@@ -78,6 +81,7 @@ type deviceKeysStatements struct {
 	selectDeviceKeysStmt                 *sql.Stmt
 	selectBatchDeviceKeysStmt            *sql.Stmt
 	selectBatchDeviceKeysWithEmptiesStmt *sql.Stmt
+	selectDeviceKeysForUsersStmt         *sql.Stmt
 	selectMaxStreamForUserStmt           *sql.Stmt
 	countStreamIDsForUserStmt            *sql.Stmt
 	deleteDeviceKeysStmt                 *sql.Stmt
@@ -97,6 +101,7 @@ func NewPostgresDeviceKeysTable(db *sql.DB) (tables.DeviceKeys, error) {
 		{&s.selectDeviceKeysStmt, selectDeviceKeysSQL},
 		{&s.selectBatchDeviceKeysStmt, selectBatchDeviceKeysSQL},
 		{&s.selectBatchDeviceKeysWithEmptiesStmt, selectBatchDeviceKeysWithEmptiesSQL},
+		{&s.selectDeviceKeysForUsersStmt, selectDeviceKeysForUsersSQL},
 		{&s.selectMaxStreamForUserStmt, selectMaxStreamForUserSQL},
 		{&s.countStreamIDsForUserStmt, countStreamIDsForUserSQL},
 		{&s.deleteDeviceKeysStmt, deleteDeviceKeysSQL},
@@ -173,6 +178,31 @@ func (s *deviceKeysStatements) DeleteAllDeviceKeys(ctx context.Context, txn *sql
 	return err
 }
 
+func (s *deviceKeysStatements) SelectDeviceKeysForUsers(ctx context.Context, txn *sql.Tx, userIDs []string) ([]api.DeviceMessage, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectDeviceKeysForUsersStmt)
+	rows, err := stmt.QueryContext(ctx, pq.StringArray(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectDeviceKeysForUsersStmt: rows.close() failed")
+	var result []api.DeviceMessage
+	var displayName sql.NullString
+	for rows.Next() {
+		dk := api.DeviceMessage{
+			Type:       api.TypeDeviceKeyUpdate,
+			DeviceKeys: &api.DeviceKeys{},
+		}
+		if err := rows.Scan(&dk.UserID, &dk.DeviceID, &dk.KeyJSON, &dk.StreamID, &displayName); err != nil {
+			return nil, err
+		}
+		if displayName.Valid {
+			dk.DisplayName = displayName.String
+		}
+		result = append(result, dk)
+	}
+	return result, rows.Err()
+}
+
 func (s *deviceKeysStatements) SelectBatchDeviceKeys(ctx context.Context, userID string, deviceIDs []string, includeEmpty bool) ([]api.DeviceMessage, error) {
 	var stmt *sql.Stmt
 	if includeEmpty {
@@ -61,7 +61,10 @@ CREATE TABLE IF NOT EXISTS userapi_devices (
 	-- The last seen IP address of this device
 	ip TEXT,
 	-- User agent of this device
-	user_agent TEXT
+	user_agent TEXT,
+	-- Whether the access token was invalidated while keeping the device, so
+	-- that the client can log in again without losing its encryption state.
+	soft_logged_out BOOLEAN NOT NULL DEFAULT FALSE
                                           
     -- TODO: device keys, device display names, token restrictions (if 3rd-party OAuth app)
 );
@@ -75,7 +78,13 @@ const insertDeviceSQL = "" +
 	" RETURNING session_id"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart, server_name FROM userapi_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, server_name FROM userapi_devices WHERE access_token = $1 AND NOT soft_logged_out"
+
+const selectSoftLoggedOutByTokenSQL = "" +
+	"SELECT soft_logged_out FROM userapi_devices WHERE access_token = $1"
+
+const updateDevicesSoftLogoutSQL = "" +
+	"UPDATE userapi_devices SET soft_logged_out = TRUE WHERE localpart = $1 AND server_name = $2 AND device_id != $3"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name, last_seen_ts, ip FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id = $3"
@@ -112,6 +121,8 @@ type devicesStatements struct {
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
 	deleteDevicesStmt            *sql.Stmt
+	selectSoftLoggedOutStmt      *sql.Stmt
+	updateDevicesSoftLogoutStmt  *sql.Stmt
 	serverName                   spec.ServerName
 }
 
@@ -127,6 +138,9 @@ func NewPostgresDevicesTable(db *sql.DB, serverName spec.ServerName) (tables.Dev
 	m.AddMigrations(sqlutil.Migration{
 		Version: "userapi: add last_seen_ts",
 		Up:      deltas.UpLastSeenTSIP,
+	}, sqlutil.Migration{
+		Version: "userapi: add soft_logged_out",
+		Up:      deltas.UpDeviceSoftLogout,
 	})
 	err = m.Up(context.Background())
 	if err != nil {
@@ -143,6 +157,8 @@ func NewPostgresDevicesTable(db *sql.DB, serverName spec.ServerName) (tables.Dev
 		{&s.deleteDevicesStmt, deleteDevicesSQL},
 		{&s.selectDevicesByIDStmt, selectDevicesByIDSQL},
 		{&s.updateDeviceLastSeenStmt, updateDeviceLastSeen},
+		{&s.selectSoftLoggedOutStmt, selectSoftLoggedOutByTokenSQL},
+		{&s.updateDevicesSoftLogoutStmt, updateDevicesSoftLogoutSQL},
 	}.Prepare(db)
 }
 
@@ -242,6 +258,26 @@ func (s *devicesStatements) SelectDeviceByToken(
 	return &dev, err
 }
 
+// SelectSoftLoggedOutByToken returns whether the given access token belongs to
+// a device that has been soft logged out. Returns sql.ErrNoRows if no device
+// has the access token.
+func (s *devicesStatements) SelectSoftLoggedOutByToken(
+	ctx context.Context, accessToken string,
+) (softLoggedOut bool, err error) {
+	err = s.selectSoftLoggedOutStmt.QueryRowContext(ctx, accessToken).Scan(&softLoggedOut)
+	return
+}
+
+func (s *devicesStatements) UpdateDevicesSoftLogout(
+	ctx context.Context, txn *sql.Tx,
+	localpart string, serverName spec.ServerName,
+	exceptDeviceID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateDevicesSoftLogoutStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName, exceptDeviceID)
+	return err
+}
+
 // selectDeviceByID retrieves a device from the database with the given user
 // localpart and deviceID
 func (s *devicesStatements) SelectDeviceByID(
@@ -57,6 +57,18 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresRegistrationsTokenTable: %w", err)
 	}
+	adminTasksTable, err := NewPostgresAdminTasksTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresAdminTasksTable: %w", err)
+	}
+	threePIDBindingsTable, err := NewPostgresThreePIDBindingsTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresThreePIDBindingsTable: %w", err)
+	}
+	delayedEventsTable, err := NewPostgresDelayedEventsTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresDelayedEventsTable: %w", err)
+	}
 	accountsTable, err := NewPostgresAccountsTable(db, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresAccountsTable: %w", err)
@@ -108,6 +120,8 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	return &shared.Database{
 		AccountDatas:       accountDataTable,
 		Accounts:           accountsTable,
+		AdminTasks:         adminTasksTable,
+		DelayedEvents:      delayedEventsTable,
 		Devices:            devicesTable,
 		KeyBackups:         keyBackupTable,
 		KeyBackupVersions:  keyBackupVersionTable,
@@ -116,6 +130,7 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 		Pushers:            pusherTable,
 		Notifications:      notificationsTable,
 		RegistrationTokens: registationTokensTable,
+		ThreePIDBindings:   threePIDBindingsTable,
 		ServerName:         serverName,
 		DB:                 db,
 		Writer:             writer,
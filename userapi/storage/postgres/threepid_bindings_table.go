@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	internal "github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/userapi/api"
+	"github.com/neilalexander/harmony/userapi/storage/tables"
+)
+
+const threePIDBindingsSchema = `
+-- Stores the third-party identifiers which local users have bound to
+-- identity servers through us, so that we know which identity server to
+-- unbind them from.
+CREATE TABLE IF NOT EXISTS userapi_threepid_bindings (
+	medium TEXT NOT NULL,
+	address TEXT NOT NULL,
+	id_server TEXT NOT NULL,
+	localpart TEXT NOT NULL,
+	server_name TEXT NOT NULL,
+	bound_ts BIGINT NOT NULL,
+	PRIMARY KEY (medium, address, id_server)
+);
+
+CREATE INDEX IF NOT EXISTS userapi_threepid_bindings_localpart_idx ON userapi_threepid_bindings(localpart, server_name);
+`
+
+const upsertThreePIDBindingSQL = "" +
+	"INSERT INTO userapi_threepid_bindings (medium, address, id_server, localpart, server_name, bound_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT (medium, address, id_server) DO UPDATE SET localpart = $4, server_name = $5, bound_ts = $6"
+
+const selectThreePIDBindingsSQL = "" +
+	"SELECT medium, address, id_server FROM userapi_threepid_bindings" +
+	" WHERE localpart = $1 AND server_name = $2 ORDER BY bound_ts"
+
+const deleteThreePIDBindingSQL = "" +
+	"DELETE FROM userapi_threepid_bindings" +
+	" WHERE medium = $1 AND address = $2 AND id_server = $3 AND localpart = $4 AND server_name = $5"
+
+type threePIDBindingsStatements struct {
+	upsertThreePIDBindingStmt  *sql.Stmt
+	selectThreePIDBindingsStmt *sql.Stmt
+	deleteThreePIDBindingStmt  *sql.Stmt
+}
+
+func NewPostgresThreePIDBindingsTable(db *sql.DB) (tables.ThreePIDBindingsTable, error) {
+	s := &threePIDBindingsStatements{}
+	_, err := db.Exec(threePIDBindingsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.upsertThreePIDBindingStmt, upsertThreePIDBindingSQL},
+		{&s.selectThreePIDBindingsStmt, selectThreePIDBindingsSQL},
+		{&s.deleteThreePIDBindingStmt, deleteThreePIDBindingSQL},
+	}.Prepare(db)
+}
+
+func (s *threePIDBindingsStatements) UpsertThreePIDBinding(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, binding *api.ThreePIDBinding, boundTS int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertThreePIDBindingStmt).ExecContext(
+		ctx, binding.Medium, binding.Address, binding.IDServer, localpart, serverName, boundTS,
+	)
+	return err
+}
+
+func (s *threePIDBindingsStatements) SelectThreePIDBindings(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName,
+) ([]api.ThreePIDBinding, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectThreePIDBindingsStmt).QueryContext(ctx, localpart, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectThreePIDBindings: rows.close() failed")
+	bindings := []api.ThreePIDBinding{}
+	for rows.Next() {
+		var binding api.ThreePIDBinding
+		if err = rows.Scan(&binding.Medium, &binding.Address, &binding.IDServer); err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings, rows.Err()
+}
+
+func (s *threePIDBindingsStatements) DeleteThreePIDBinding(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, binding *api.ThreePIDBinding,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteThreePIDBindingStmt).ExecContext(
+		ctx, binding.Medium, binding.Address, binding.IDServer, localpart, serverName,
+	)
+	return err
+}
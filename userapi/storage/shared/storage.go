@@ -46,6 +46,7 @@ type Database struct {
 	Writer             sqlutil.Writer
 	RegistrationTokens tables.RegistrationTokensTable
 	Accounts           tables.AccountsTable
+	AdminTasks         tables.AdminTasksTable
 	Profiles           tables.ProfileTable
 	AccountDatas       tables.AccountDataTable
 	KeyBackups         tables.KeyBackupTable
@@ -54,6 +55,8 @@ type Database struct {
 	LoginTokens        tables.LoginTokenTable
 	Notifications      tables.NotificationTable
 	Pushers            tables.PusherTable
+	ThreePIDBindings   tables.ThreePIDBindingsTable
+	DelayedEvents      tables.DelayedEventsTable
 	LoginTokenLifetime time.Duration
 	ServerName         spec.ServerName
 	BcryptCost         int
@@ -113,6 +116,70 @@ func (d *Database) UpdateRegistrationToken(ctx context.Context, tokenString stri
 	return
 }
 
+func (d *Database) UpsertAdminTask(ctx context.Context, task *clientapi.AdminTask) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.AdminTasks.UpsertAdminTask(ctx, txn, task)
+	})
+}
+
+func (d *Database) GetAdminTask(ctx context.Context, taskID string) (*clientapi.AdminTask, error) {
+	return d.AdminTasks.SelectAdminTask(ctx, nil, taskID)
+}
+
+func (d *Database) ListAdminTasks(ctx context.Context, limit int) ([]clientapi.AdminTask, error) {
+	return d.AdminTasks.SelectAdminTasks(ctx, nil, limit)
+}
+
+func (d *Database) FailUnfinishedAdminTasks(ctx context.Context, reason string) (affected int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		affected, err = d.AdminTasks.UpdateUnfinishedAdminTasks(ctx, txn, clientapi.AdminTaskFailed, reason, int64(spec.AsTimestamp(time.Now())))
+		return err
+	})
+	return
+}
+
+func (d *Database) SaveThreePIDBinding(ctx context.Context, localpart string, serverName spec.ServerName, binding *api.ThreePIDBinding) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.ThreePIDBindings.UpsertThreePIDBinding(ctx, txn, localpart, serverName, binding, int64(spec.AsTimestamp(time.Now())))
+	})
+}
+
+func (d *Database) GetThreePIDBindings(ctx context.Context, localpart string, serverName spec.ServerName) ([]api.ThreePIDBinding, error) {
+	return d.ThreePIDBindings.SelectThreePIDBindings(ctx, nil, localpart, serverName)
+}
+
+func (d *Database) RemoveThreePIDBinding(ctx context.Context, localpart string, serverName spec.ServerName, binding *api.ThreePIDBinding) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.ThreePIDBindings.DeleteThreePIDBinding(ctx, txn, localpart, serverName, binding)
+	})
+}
+
+func (d *Database) SaveDelayedEvent(ctx context.Context, localpart string, serverName spec.ServerName, ev *api.DelayedEvent) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.DelayedEvents.InsertDelayedEvent(ctx, txn, localpart, serverName, ev)
+	})
+}
+
+func (d *Database) GetDelayedEvents(ctx context.Context, localpart string, serverName spec.ServerName) ([]api.DelayedEvent, error) {
+	return d.DelayedEvents.SelectDelayedEvents(ctx, nil, localpart, serverName)
+}
+
+func (d *Database) RestartDelayedEvent(ctx context.Context, delayID string, runningSince spec.Timestamp) (found bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		found, err = d.DelayedEvents.UpdateDelayedEventRunningSince(ctx, txn, delayID, runningSince)
+		return err
+	})
+	return
+}
+
+func (d *Database) RemoveDelayedEvent(ctx context.Context, delayID string) (found bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		found, err = d.DelayedEvents.DeleteDelayedEvent(ctx, txn, delayID)
+		return err
+	})
+	return
+}
+
 // GetAccountByPassword returns the account associated with the given localpart and password.
 // Returns sql.ErrNoRows if no account exists which matches the given localpart.
 func (d *Database) GetAccountByPassword(
@@ -202,7 +269,30 @@ func (d *Database) CreateAccount(
 			plaintextPassword = ""
 			appserviceID = ""
 		}
-		acc, err = d.createAccount(ctx, txn, localpart, serverName, plaintextPassword, appserviceID, accountType)
+		// Generate a password hash if this is not a password-less user
+		hash := ""
+		if plaintextPassword != "" {
+			if hash, err = d.hashPassword(plaintextPassword); err != nil {
+				return err
+			}
+		}
+		acc, err = d.createAccount(ctx, txn, localpart, serverName, hash, appserviceID, accountType)
+		return err
+	})
+	return
+}
+
+// CreateAccountWithPasswordHash makes a new account in the same way as CreateAccount,
+// but with a password which has already been hashed.
+func (d *Database) CreateAccountWithPasswordHash(
+	ctx context.Context, localpart string, serverName spec.ServerName,
+	passwordHash string, accountType api.AccountType,
+) (acc *api.Account, err error) {
+	if _, err = bcrypt.Cost([]byte(passwordHash)); err != nil {
+		return nil, fmt.Errorf("invalid password hash: %w", err)
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		acc, err = d.createAccount(ctx, txn, localpart, serverName, passwordHash, "", accountType)
 		return err
 	})
 	return
@@ -213,18 +303,10 @@ func (d *Database) CreateAccount(
 func (d *Database) createAccount(
 	ctx context.Context, txn *sql.Tx,
 	localpart string, serverName spec.ServerName,
-	plaintextPassword, appserviceID string, accountType api.AccountType,
+	hash, appserviceID string, accountType api.AccountType,
 ) (*api.Account, error) {
 	var err error
 	var account *api.Account
-	// Generate a password hash if this is not a password-less user
-	hash := ""
-	if plaintextPassword != "" {
-		hash, err = d.hashPassword(plaintextPassword)
-		if err != nil {
-			return nil, err
-		}
-	}
 	if account, err = d.Accounts.InsertAccount(ctx, txn, localpart, serverName, hash, appserviceID, accountType); err != nil {
 		return nil, sqlutil.ErrUserExists
 	}
@@ -642,10 +724,11 @@ func (d *Database) RemoveDevices(
 	devices []string,
 ) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		if err := d.Devices.DeleteDevices(ctx, txn, localpart, serverName, devices); err != sql.ErrNoRows {
+		if err := d.Devices.DeleteDevices(ctx, txn, localpart, serverName, devices); err != nil && err != sql.ErrNoRows {
 			return err
 		}
-		return nil
+		// Delayed events can't be sent without the device which scheduled them.
+		return d.DelayedEvents.DeleteDelayedEventsByDevices(ctx, txn, localpart, serverName, devices)
 	})
 }
 
@@ -662,14 +745,32 @@ func (d *Database) RemoveAllDevices(
 		if err != nil {
 			return err
 		}
-		if err := d.Devices.DeleteDevicesByLocalpart(ctx, txn, localpart, serverName, exceptDeviceID); err != sql.ErrNoRows {
+		if err := d.Devices.DeleteDevicesByLocalpart(ctx, txn, localpart, serverName, exceptDeviceID); err != nil && err != sql.ErrNoRows {
 			return err
 		}
-		return nil
+		return d.DelayedEvents.DeleteDelayedEventsByLocalpart(ctx, txn, localpart, serverName, exceptDeviceID)
 	})
 	return
 }
 
+func (d *Database) SoftLogoutAllDevices(
+	ctx context.Context,
+	localpart string, serverName spec.ServerName,
+	exceptDeviceID string,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Devices.UpdateDevicesSoftLogout(ctx, txn, localpart, serverName, exceptDeviceID)
+	})
+}
+
+func (d *Database) IsAccessTokenSoftLoggedOut(ctx context.Context, token string) (bool, error) {
+	softLoggedOut, err := d.Devices.SelectSoftLoggedOutByToken(ctx, token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return softLoggedOut, err
+}
+
 // UpdateDeviceLastSeen updates a last seen timestamp and the ip address.
 func (d *Database) UpdateDeviceLastSeen(ctx context.Context, localpart string, serverName spec.ServerName, deviceID, ipAddr, userAgent string) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
@@ -980,7 +1081,38 @@ func (d *KeyDatabase) DeleteDeviceKeys(ctx context.Context, userID string, devic
 
 // CrossSigningKeysForUser returns the latest known cross-signing keys for a user, if any.
 func (d *KeyDatabase) CrossSigningKeysForUser(ctx context.Context, userID string) (map[fclient.CrossSigningKeyPurpose]fclient.CrossSigningKey, error) {
-	keyMap, err := d.CrossSigningKeysTable.SelectCrossSigningKeysForUser(ctx, nil, userID)
+	return d.crossSigningKeysForUser(ctx, nil, userID)
+}
+
+// DeviceKeysSnapshot returns the device keys and cross-signing keys of the given
+// users, as they were at a single point in time.
+func (d *KeyDatabase) DeviceKeysSnapshot(ctx context.Context, userIDs []string) (
+	[]api.DeviceMessage, map[string]map[fclient.CrossSigningKeyPurpose]fclient.CrossSigningKey, error,
+) {
+	txn, err := d.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer txn.Rollback() // nolint:errcheck
+	deviceKeys, err := d.DeviceKeysTable.SelectDeviceKeysForUsers(ctx, txn, userIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("d.DeviceKeysTable.SelectDeviceKeysForUsers: %w", err)
+	}
+	crossSigningKeys := make(map[string]map[fclient.CrossSigningKeyPurpose]fclient.CrossSigningKey, len(userIDs))
+	for _, userID := range userIDs {
+		keys, err := d.crossSigningKeysForUser(ctx, txn, userID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(keys) > 0 {
+			crossSigningKeys[userID] = keys
+		}
+	}
+	return deviceKeys, crossSigningKeys, nil
+}
+
+func (d *KeyDatabase) crossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string) (map[fclient.CrossSigningKeyPurpose]fclient.CrossSigningKey, error) {
+	keyMap, err := d.CrossSigningKeysTable.SelectCrossSigningKeysForUser(ctx, txn, userID)
 	if err != nil {
 		return nil, fmt.Errorf("d.CrossSigningKeysTable.SelectCrossSigningKeysForUser: %w", err)
 	}
@@ -994,7 +1126,7 @@ func (d *KeyDatabase) CrossSigningKeysForUser(ctx context.Context, userID string
 				keyID: key,
 			},
 		}
-		sigMap, err := d.CrossSigningSigsTable.SelectCrossSigningSigsForTarget(ctx, nil, userID, userID, keyID)
+		sigMap, err := d.CrossSigningSigsTable.SelectCrossSigningSigsForTarget(ctx, txn, userID, userID, keyID)
 		if err != nil {
 			continue
 		}
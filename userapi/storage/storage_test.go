@@ -3,6 +3,7 @@ package storage_test
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -19,6 +20,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/bcrypt"
 
+	clientapi "github.com/neilalexander/harmony/clientapi/api"
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
 	"github.com/neilalexander/harmony/internal/pushrules"
 	"github.com/neilalexander/harmony/setup/config"
@@ -119,6 +121,16 @@ func Test_Accounts(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Greater(t, second, first)
 
+		// create an account from a password which has already been hashed
+		hash, err := bcrypt.GenerateFromPassword([]byte("hashed"), bcrypt.MinCost)
+		assert.NoError(t, err)
+		_, err = db.CreateAccountWithPasswordHash(ctx, "prehashed", aliceDomain, string(hash), api.AccountTypeUser)
+		assert.NoError(t, err, "failed to create account with password hash")
+		_, err = db.GetAccountByPassword(ctx, "prehashed", aliceDomain, "hashed")
+		assert.NoError(t, err, "failed to get account by password")
+		_, err = db.CreateAccountWithPasswordHash(ctx, "badhash", aliceDomain, "hashed", api.AccountTypeUser)
+		assert.Error(t, err, "expected an invalid password hash to be rejected")
+
 		// update password for alice
 		err = db.SetPassword(ctx, aliceLocalpart, aliceDomain, "newPassword")
 		assert.NoError(t, err, "failed to update password")
@@ -231,6 +243,26 @@ func Test_Devices(t *testing.T) {
 		assert.NoError(t, err, "unable to get device by id")
 		assert.Equal(t, 1, len(devices))
 
+		// soft logging out keeps the device, but the access token no longer works
+		err = db.SoftLogoutAllDevices(ctx, localpart, domain, "")
+		assert.NoError(t, err, "unable to soft logout devices")
+		_, err = db.GetDeviceByAccessToken(ctx, accessToken)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		softLoggedOut, err := db.IsAccessTokenSoftLoggedOut(ctx, accessToken)
+		assert.NoError(t, err, "unable to check soft logout")
+		assert.True(t, softLoggedOut)
+		softLoggedOut, err = db.IsAccessTokenSoftLoggedOut(ctx, "unknown")
+		assert.NoError(t, err, "unable to check soft logout")
+		assert.False(t, softLoggedOut)
+
+		// logging in again with the same device ID replaces the access token
+		accessToken = util.RandomString(16)
+		_, err = db.CreateDevice(ctx, localpart, domain, &newDeviceID, accessToken, nil, "", "")
+		assert.NoError(t, err, "unable to recreate device")
+		gotDeviceAccessToken, err = db.GetDeviceByAccessToken(ctx, accessToken)
+		assert.NoError(t, err, "unable to get device by access token")
+		assert.Equal(t, newDeviceID, gotDeviceAccessToken.ID)
+
 		deleted, err := db.RemoveAllDevices(ctx, localpart, domain, "")
 		assert.NoError(t, err, "unable to remove all devices")
 		assert.Equal(t, 1, len(deleted))
@@ -347,6 +379,132 @@ func Test_LoginToken(t *testing.T) {
 	})
 }
 
+func Test_ThreePIDBindings(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		localpart, domain, err := gomatrixserverlib.SplitID('@', alice.ID)
+		assert.NoError(t, err)
+
+		first := api.ThreePIDBinding{Medium: "email", Address: "alice@example.com", IDServer: "id.example.com"}
+		second := api.ThreePIDBinding{Medium: "msisdn", Address: "447700900000", IDServer: "id.example.com"}
+		assert.NoError(t, db.SaveThreePIDBinding(ctx, localpart, domain, &first))
+		assert.NoError(t, db.SaveThreePIDBinding(ctx, localpart, domain, &second))
+		// Binding the same identifier again doesn't add another binding.
+		assert.NoError(t, db.SaveThreePIDBinding(ctx, localpart, domain, &first))
+
+		bindings, err := db.GetThreePIDBindings(ctx, localpart, domain)
+		assert.NoError(t, err)
+		assert.Equal(t, []api.ThreePIDBinding{first, second}, bindings)
+
+		assert.NoError(t, db.RemoveThreePIDBinding(ctx, localpart, domain, &first))
+		bindings, err = db.GetThreePIDBindings(ctx, localpart, domain)
+		assert.NoError(t, err)
+		assert.Equal(t, []api.ThreePIDBinding{second}, bindings)
+	})
+}
+
+func Test_AdminTasks(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+
+		running := &clientapi.AdminTask{
+			TaskID: "running", Type: "purge_room", Target: "!room:test",
+			Status: clientapi.AdminTaskRunning, CreatedBy: "@admin:test", CreatedTS: 1, UpdatedTS: 1,
+		}
+		done := &clientapi.AdminTask{
+			TaskID: "done", Type: "reindex_search",
+			Status: clientapi.AdminTaskPending, CreatedBy: "@admin:test", CreatedTS: 2, UpdatedTS: 2,
+		}
+		assert.NoError(t, db.UpsertAdminTask(ctx, running))
+		assert.NoError(t, db.UpsertAdminTask(ctx, done))
+
+		// Updating a task changes its status and progress
+		done.Status, done.Progress, done.Total, done.UpdatedTS = clientapi.AdminTaskCompleted, 5, 5, 3
+		assert.NoError(t, db.UpsertAdminTask(ctx, done))
+		got, err := db.GetAdminTask(ctx, "done")
+		assert.NoError(t, err)
+		assert.Equal(t, done, got)
+
+		_, err = db.GetAdminTask(ctx, "missing")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		// Only the unfinished task is marked as failed
+		affected, err := db.FailUnfinishedAdminTasks(ctx, "interrupted")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), affected)
+
+		tasks, err := db.ListAdminTasks(ctx, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(tasks))
+		assert.Equal(t, "done", tasks[0].TaskID)
+		assert.Equal(t, clientapi.AdminTaskCompleted, tasks[0].Status)
+		assert.Equal(t, clientapi.AdminTaskFailed, tasks[1].Status)
+		assert.Equal(t, "interrupted", tasks[1].Error)
+
+		tasks, err = db.ListAdminTasks(ctx, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(tasks))
+	})
+}
+
+func Test_DelayedEvents(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceLocalpart, domain, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+
+		stateKey := "key"
+		for i, deviceID := range []string{"first", "second", "third"} {
+			assert.NoError(t, db.SaveDelayedEvent(ctx, aliceLocalpart, domain, &api.DelayedEvent{
+				DelayID:      deviceID,
+				DeviceID:     deviceID,
+				RoomID:       "!room:test",
+				Type:         "m.call.member",
+				StateKey:     &stateKey,
+				Content:      json.RawMessage(`{"foo":"bar"}`),
+				Delay:        1000,
+				RunningSince: spec.Timestamp(i),
+			}))
+		}
+		events, err := db.GetDelayedEvents(ctx, aliceLocalpart, domain)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(events))
+		assert.Equal(t, alice.ID, events[0].UserID)
+		assert.Equal(t, &stateKey, events[0].StateKey)
+		assert.JSONEq(t, `{"foo":"bar"}`, string(events[0].Content))
+
+		// Restarting only works on events which still exist
+		found, err := db.RestartDelayedEvent(ctx, "first", 100)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		found, err = db.RestartDelayedEvent(ctx, "missing", 100)
+		assert.NoError(t, err)
+		assert.False(t, found)
+
+		// Deleting devices deletes their delayed events
+		assert.NoError(t, db.RemoveDevices(ctx, aliceLocalpart, domain, []string{"first"}))
+		found, err = db.RemoveDelayedEvent(ctx, "first")
+		assert.NoError(t, err)
+		assert.False(t, found)
+		_, err = db.RemoveAllDevices(ctx, aliceLocalpart, domain, "third")
+		assert.NoError(t, err)
+
+		events, err = db.GetDelayedEvents(ctx, "", "")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(events))
+		assert.Equal(t, "third", events[0].DelayID)
+
+		found, err = db.RemoveDelayedEvent(ctx, "third")
+		assert.NoError(t, err)
+		assert.True(t, found)
+	})
+}
+
 func Test_Profile(t *testing.T) {
 	alice := test.NewUser(t)
 	aliceLocalpart, aliceDomain, err := gomatrixserverlib.SplitID('@', alice.ID)
@@ -750,3 +908,38 @@ func TestOneTimeKeys(t *testing.T) {
 		}
 	})
 }
+
+func TestDeviceKeysSnapshot(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, clean := mustCreateKeyDatabase(t, dbType)
+		defer clean()
+		alice := "@alice:TestDeviceKeysSnapshot"
+		bob := "@bob:remote"
+		charlie := "@charlie:TestDeviceKeysSnapshot"
+		MustNotError(t, db.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+			{Type: api.TypeDeviceKeyUpdate, DeviceKeys: &api.DeviceKeys{DeviceID: "AAA", UserID: alice, KeyJSON: []byte(`{"key":"a"}`)}},
+			{Type: api.TypeDeviceKeyUpdate, DeviceKeys: &api.DeviceKeys{DeviceID: "AAA", UserID: charlie, KeyJSON: []byte(`{"key":"c"}`)}},
+		}))
+		MustNotError(t, db.StoreRemoteDeviceKeys(ctx, []api.DeviceMessage{
+			{Type: api.TypeDeviceKeyUpdate, DeviceKeys: &api.DeviceKeys{DeviceID: "BBB", UserID: bob, KeyJSON: []byte(`{"key":"b"}`), DisplayName: "Bob's phone"}},
+		}, nil))
+
+		deviceKeys, crossSigningKeys, err := db.DeviceKeysSnapshot(ctx, []string{alice, bob})
+		MustNotError(t, err)
+		if len(deviceKeys) != 2 {
+			t.Fatalf("expected 2 device keys, got %d", len(deviceKeys))
+		}
+		for _, dk := range deviceKeys {
+			switch dk.UserID {
+			case alice:
+				assert.Equal(t, `{"key":"a"}`, string(dk.KeyJSON))
+			case bob:
+				assert.Equal(t, `{"key":"b"}`, string(dk.KeyJSON))
+				assert.Equal(t, "Bob's phone", dk.DisplayName)
+			default:
+				t.Fatalf("unexpected keys for %s", dk.UserID)
+			}
+		}
+		assert.Empty(t, crossSigningKeys)
+	})
+}
@@ -38,6 +38,29 @@ type RegistrationTokensTable interface {
 	UpdateRegistrationToken(ctx context.Context, txn *sql.Tx, tokenString string, newAttributes map[string]interface{}) (*clientapi.RegistrationToken, error)
 }
 
+type AdminTasksTable interface {
+	UpsertAdminTask(ctx context.Context, txn *sql.Tx, task *clientapi.AdminTask) error
+	SelectAdminTask(ctx context.Context, txn *sql.Tx, taskID string) (*clientapi.AdminTask, error)
+	SelectAdminTasks(ctx context.Context, txn *sql.Tx, limit int) ([]clientapi.AdminTask, error)
+	UpdateUnfinishedAdminTasks(ctx context.Context, txn *sql.Tx, status clientapi.AdminTaskStatus, reason string, updatedTS int64) (int64, error)
+}
+
+type ThreePIDBindingsTable interface {
+	UpsertThreePIDBinding(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, binding *api.ThreePIDBinding, boundTS int64) error
+	SelectThreePIDBindings(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) ([]api.ThreePIDBinding, error)
+	DeleteThreePIDBinding(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, binding *api.ThreePIDBinding) error
+}
+
+type DelayedEventsTable interface {
+	InsertDelayedEvent(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, ev *api.DelayedEvent) error
+	// SelectDelayedEvents returns the user's delayed events, or everyone's if localpart is empty.
+	SelectDelayedEvents(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) ([]api.DelayedEvent, error)
+	UpdateDelayedEventRunningSince(ctx context.Context, txn *sql.Tx, delayID string, runningSince spec.Timestamp) (bool, error)
+	DeleteDelayedEvent(ctx context.Context, txn *sql.Tx, delayID string) (bool, error)
+	DeleteDelayedEventsByDevices(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceIDs []string) error
+	DeleteDelayedEventsByLocalpart(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, exceptDeviceID string) error
+}
+
 type AccountDataTable interface {
 	InsertAccountData(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID, dataType string, content json.RawMessage) error
 	SelectAccountData(ctx context.Context, localpart string, serverName spec.ServerName) (map[string]json.RawMessage, map[string]map[string]json.RawMessage, error)
@@ -61,6 +84,8 @@ type DevicesTable interface {
 	DeleteDevicesByLocalpart(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, exceptDeviceID string) error
 	UpdateDeviceName(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID string, displayName *string) error
 	SelectDeviceByToken(ctx context.Context, accessToken string) (*api.Device, error)
+	SelectSoftLoggedOutByToken(ctx context.Context, accessToken string) (bool, error)
+	UpdateDevicesSoftLogout(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, exceptDeviceID string) error
 	SelectDeviceByID(ctx context.Context, localpart string, serverName spec.ServerName, deviceID string) (*api.Device, error)
 	SelectDevicesByLocalpart(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, exceptDeviceID string) ([]api.Device, error)
 	SelectDevicesByID(ctx context.Context, deviceIDs []string) ([]api.Device, error)
@@ -162,6 +187,8 @@ type DeviceKeys interface {
 	SelectMaxStreamIDForUser(ctx context.Context, txn *sql.Tx, userID string) (streamID int64, err error)
 	CountStreamIDsForUser(ctx context.Context, userID string, streamIDs []int64) (int, error)
 	SelectBatchDeviceKeys(ctx context.Context, userID string, deviceIDs []string, includeEmpty bool) ([]api.DeviceMessage, error)
+	// SelectDeviceKeysForUsers returns all of the non-empty device keys for the given users.
+	SelectDeviceKeysForUsers(ctx context.Context, txn *sql.Tx, userIDs []string) ([]api.DeviceMessage, error)
 	DeleteDeviceKeys(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
 	DeleteAllDeviceKeys(ctx context.Context, txn *sql.Tx, userID string) error
 }
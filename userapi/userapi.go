@@ -80,6 +80,7 @@ func NewInternalAPI(
 		// here.
 		dendriteCfg.Global.JetStream.Prefixed(jetstream.OutputClientData),
 		dendriteCfg.Global.JetStream.Prefixed(jetstream.OutputNotificationData),
+		dendriteCfg.Global.JetStream.Prefixed(jetstream.OutputSendToDeviceEvent),
 	)
 	keyChangeProducer := &producers.KeyChange{
 		Topic:     dendriteCfg.Global.JetStream.Prefixed(jetstream.OutputKeyChangeEvent),
@@ -97,6 +98,8 @@ func NewInternalAPI(
 		DisableTLSValidation: dendriteCfg.UserAPI.PushGatewayDisableTLSValidation,
 		PgClient:             pgClient,
 		FedClient:            fedClient,
+		LoginLimiter:         internal.NewLoginLimiter(&dendriteCfg.UserAPI.LoginProtection),
+		ProcessContext:       processContext,
 	}
 
 	updater := internal.NewDeviceListUpdater(processContext, keyDB, userAPI, keyChangeProducer, fedClient, dendriteCfg.UserAPI.WorkerCount, rsAPI, dendriteCfg.Global.ServerName, enableMetrics, blacklistedOrBackingOffFn)
@@ -96,7 +96,7 @@ func MustMakeInternalAPI(t *testing.T, opts apiTestOpts, dbType test.DBType, pub
 		publisher = &dummyProducer{t: t}
 	}
 
-	syncProducer := producers.NewSyncAPI(accountDB, publisher, "client_data", "notification_data")
+	syncProducer := producers.NewSyncAPI(accountDB, publisher, "client_data", "notification_data", "send_to_device")
 	keyChangeProducer := &producers.KeyChange{DB: keyDB, JetStream: publisher, Topic: "keychange"}
 	return &internal.UserInternalAPI{
 			DB:                accountDB,
@@ -581,7 +581,7 @@ func TestDevices(t *testing.T) {
 				if err = intAPI.QueryDeviceInfos(ctx, &queryDeviceInfosReq, &queryDeviceInfosRes); err != nil {
 					t.Fatal(err)
 				}
-				gotDisplayName := queryDeviceInfosRes.DeviceInfo[*tc.inputData.DeviceID].DisplayName
+				gotDisplayName := queryDeviceInfosRes.DeviceInfo[res.Device.UserID][*tc.inputData.DeviceID].DisplayName
 				if tc.inputData.DeviceDisplayName != nil {
 					wantDisplayName := *tc.inputData.DeviceDisplayName
 					if wantDisplayName != gotDisplayName {
@@ -664,3 +664,39 @@ func TestDeviceIDReuse(t *testing.T) {
 		})
 	})
 }
+
+func TestQueryDeviceInfosSameDeviceID(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		intAPI, _, close := MustMakeInternalAPI(t, apiTestOpts{serverName: "test"}, dbType, nil)
+		defer close()
+
+		// Devices of different users can have the same ID, which mustn't
+		// mix up their display names.
+		deviceID := "SAMEDEVICE"
+		for _, localpart := range []string{"alice", "bob"} {
+			displayName := localpart + "'s phone"
+			if err := intAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+				Localpart:          localpart,
+				ServerName:         "test",
+				AccessToken:        util.RandomString(8),
+				DeviceID:           &deviceID,
+				DeviceDisplayName:  &displayName,
+				NoDeviceListUpdate: true,
+			}, &api.PerformDeviceCreationResponse{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		res := api.QueryDeviceInfosResponse{}
+		if err := intAPI.QueryDeviceInfos(ctx, &api.QueryDeviceInfosRequest{DeviceIDs: []string{deviceID}}, &res); err != nil {
+			t.Fatal(err)
+		}
+		for _, localpart := range []string{"alice", "bob"} {
+			userID := "@" + localpart + ":test"
+			if got, want := res.DeviceInfo[userID][deviceID].DisplayName, localpart+"'s phone"; got != want {
+				t.Fatalf("got display name %q for %s, want %q", got, userID, want)
+			}
+		}
+	})
+}
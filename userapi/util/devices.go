@@ -6,6 +6,7 @@ import (
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/pushgateway"
+	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/userapi/api"
 	"github.com/neilalexander/harmony/userapi/storage"
 	log "github.com/sirupsen/logrus"
@@ -39,7 +40,7 @@ func GetPushDevices(ctx context.Context, localpart string, serverName spec.Serve
 			fmtIface := pusher.Data["format"]
 			var ok bool
 			format, ok = fmtIface.(string)
-			if ok && format != "event_id_only" {
+			if ok && format != "" && format != config.PushFormatEventIDOnly {
 				log.WithFields(log.Fields{
 					"localpart": localpart,
 					"app_id":    pusher.AppID,